@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"os"
 
@@ -10,6 +11,11 @@ import (
 func main() {
 	if err := cli.Run(os.Args[1:]); err != nil {
 		fmt.Fprintf(os.Stderr, "error: %v\n", err)
-		os.Exit(1)
+		code := 1
+		var exitErr *cli.ExitError
+		if errors.As(err, &exitErr) {
+			code = exitErr.Code
+		}
+		os.Exit(code)
 	}
 }
@@ -4,16 +4,36 @@ package main
 import (
 	"context"
 	"crypto/tls"
+	"flag"
 	"fmt"
 	"log"
+	"maps"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/quic"
+	"gopkg.in/yaml.v3"
+
+	"github.com/lobber-dev/lobber/internal/auth"
+	"github.com/lobber-dev/lobber/internal/billing"
 	"github.com/lobber-dev/lobber/internal/db"
+	"github.com/lobber-dev/lobber/internal/export"
+	"github.com/lobber-dev/lobber/internal/notify"
+	"github.com/lobber-dev/lobber/internal/oidc"
+	"github.com/lobber-dev/lobber/internal/ratelimit"
 	"github.com/lobber-dev/lobber/internal/relay"
+	"github.com/lobber-dev/lobber/internal/scrub"
+	"github.com/lobber-dev/lobber/internal/tunnel"
+	"github.com/lobber-dev/lobber/plugin"
 )
 
 func main() {
@@ -23,41 +43,114 @@ func main() {
 }
 
 func run() error {
+	sandbox := flag.Bool("dev", false, "Sandbox mode: in-memory stores, a printed dev token and plain HTTP on one port")
+	flag.Parse()
+
 	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer cancel()
 
 	// Check for dev mode (HTTP only, no TLS)
-	devMode := os.Getenv("DEV_MODE") == "true"
+	devMode := os.Getenv("DEV_MODE") == "true" || *sandbox
 
-	// Connect to database
-	database, err := db.New(ctx)
-	if err != nil {
-		log.Printf("Warning: database connection failed, continuing without DB: %v", err)
-		database = nil
-	} else {
-		defer database.Close()
+	if err := applyQueryTimeoutEnv(); err != nil {
+		return err
+	}
+
+	// Connect to database; the sandbox keeps everything in memory
+	var database *db.DB
+	if !*sandbox {
+		var err error
+		database, err = db.New(ctx)
+		if err != nil {
+			log.Printf("Warning: database connection failed, continuing without DB: %v", err)
+			database = nil
+		} else {
+			defer database.Close()
+		}
 	}
 
 	// Create server config with Stripe settings
 	config := relay.DefaultServerConfig()
 	config.StripeAPIKey = os.Getenv("STRIPE_API_KEY")
 	config.StripeWebhookKey = os.Getenv("STRIPE_WEBHOOK_SECRET")
+	config.StripeTaxEnabled = os.Getenv("STRIPE_TAX_ENABLED") == "true"
+	config.Notifier = notify.FromEnv()
+	config.ReconcileAutoFix = os.Getenv("BILLING_RECONCILE_AUTOFIX") == "true"
+	config.AdminToken = os.Getenv("ADMIN_TOKEN")
+	config.UsageAuditKey = os.Getenv("USAGE_AUDIT_KEY")
+	// Passthrough routes connections before TLS is terminated, so there's
+	// none in dev mode
+	config.TLSPassthrough = !devMode && os.Getenv("TLS_PASSTHROUGH") == "true"
+	if err := applyBillingEnv(config); err != nil {
+		return err
+	}
+	if err := applyStatusEnv(config); err != nil {
+		return err
+	}
+	if err := applyRateLimitEnv(config); err != nil {
+		return err
+	}
+	if err := applyAPIQuotaEnv(config); err != nil {
+		return err
+	}
+	if err := applyConnectLimitEnv(config); err != nil {
+		return err
+	}
+	if err := applyRetryEnv(config); err != nil {
+		return err
+	}
+	if err := applyTraceEnv(config); err != nil {
+		return err
+	}
+	if err := applyWatchdogEnv(config); err != nil {
+		return err
+	}
+	if err := applyFeatureEnv(config); err != nil {
+		return err
+	}
+	if err := applyPluginEnv(ctx, config); err != nil {
+		return err
+	}
+	if err := applyScrubEnv(config); err != nil {
+		return err
+	}
+	if err := applySSOEnv(config); err != nil {
+		return err
+	}
+	if err := applyExportEnv(config); err != nil {
+		return err
+	}
+	if err := applyRetentionEnv(config.Retention); err != nil {
+		return err
+	}
+	if *sandbox {
+		if err := applyDevEnv(config); err != nil {
+			return err
+		}
+	}
 
 	// Set up domain
 	serviceDomain := os.Getenv("SERVICE_DOMAIN")
 	if serviceDomain == "" {
 		serviceDomain = "lobber.dev"
+		if *sandbox {
+			serviceDomain = "localhost"
+		}
 	}
 
 	config.BaseDomain = serviceDomain
 
 	// Create server
 	server := relay.NewServerWithConfig(database, config)
+	server.StartJobs(ctx)
 
 	// HTTP server address
 	httpAddr := os.Getenv("HTTP_ADDR")
 	if httpAddr == "" {
 		httpAddr = ":80"
+		if *sandbox {
+			httpAddr = ":8080"
+		}
 	}
 
 	errCh := make(chan error, 2)
@@ -77,6 +170,9 @@ func run() error {
 				errCh <- fmt.Errorf("http: %w", err)
 			}
 		}()
+		if *sandbox {
+			printDevBanner(httpAddr, serviceDomain, config.DevToken)
+		}
 
 		// Wait for shutdown
 		select {
@@ -90,6 +186,7 @@ func run() error {
 		shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 30*time.Second)
 		defer shutdownCancel()
 
+		drain(shutdownCtx, server)
 		if err := httpServer.Shutdown(shutdownCtx); err != nil {
 			log.Printf("HTTP shutdown error: %v", err)
 		}
@@ -103,7 +200,22 @@ func run() error {
 		cacheDir = "/var/cache/lobber/certs"
 	}
 
-	tlsMgr := relay.NewTLSManager(serviceDomain, cacheDir)
+	// Relays sharing a database share certificates with CERT_CACHE=db;
+	// each keeping its own directory would order every certificate again
+	var certCache autocert.Cache = autocert.DirCache(cacheDir)
+	switch v := os.Getenv("CERT_CACHE"); v {
+	case "", "dir":
+	case "db":
+		if database == nil && config.Store == nil {
+			return fmt.Errorf("CERT_CACHE=db needs a database")
+		}
+		certCache = server.CertCache(certCache)
+	default:
+		return fmt.Errorf("CERT_CACHE: want dir or db, got %q", v)
+	}
+
+	tlsMgr := relay.NewTLSManagerWithCache(serviceDomain, certCache)
+	tlsMgr.OnCertIssued = server.CertIssued
 
 	httpServer := &http.Server{
 		Addr:    httpAddr,
@@ -120,9 +232,11 @@ func run() error {
 		Addr:    httpsAddr,
 		Handler: server,
 		TLSConfig: &tls.Config{
-			GetCertificate: tlsMgr.GetCertificate,
-			NextProtos:     []string{"h2", "http/1.1"},
+			GetCertificate:     tlsMgr.GetCertificate,
+			GetConfigForClient: server.RecordClientHello,
+			NextProtos:         []string{"h2", "http/1.1"},
 		},
+		ConnState: server.ConnState,
 	}
 
 	// Start servers
@@ -133,13 +247,37 @@ func run() error {
 		}
 	}()
 
+	// TLS_PASSTHROUGH=true hands connections for passthrough tunnels to
+	// their clients unopened, before the HTTPS server sees them
+	httpsListener, err := net.Listen("tcp", httpsAddr)
+	if err != nil {
+		return fmt.Errorf("https: %w", err)
+	}
+	if config.TLSPassthrough {
+		httpsListener = server.PassthroughListener(httpsListener)
+	}
 	go func() {
 		log.Printf("HTTPS server listening on %s", httpsAddr)
-		if err := httpsServer.ListenAndServeTLS("", ""); err != http.ErrServerClosed {
+		if err := httpsServer.ServeTLS(httpsListener, "", ""); err != http.ErrServerClosed {
 			errCh <- fmt.Errorf("https: %w", err)
 		}
 	}()
 
+	// QUIC=true also takes tunnels over QUIC on the HTTPS port's UDP side
+	var quicEndpoint *quic.Endpoint
+	if os.Getenv("QUIC") == "true" {
+		quicEndpoint, err = quic.Listen("udp", httpsAddr, relay.QUICConfig(httpsServer.TLSConfig))
+		if err != nil {
+			return fmt.Errorf("quic: %w", err)
+		}
+		go func() {
+			log.Printf("QUIC tunnels accepted on %s/udp", httpsAddr)
+			if err := server.ServeQUIC(ctx, quicEndpoint); err != nil {
+				errCh <- fmt.Errorf("quic: %w", err)
+			}
+		}()
+	}
+
 	// Wait for shutdown
 	select {
 	case <-ctx.Done():
@@ -152,12 +290,475 @@ func run() error {
 	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer shutdownCancel()
 
+	drain(shutdownCtx, server)
 	if err := httpServer.Shutdown(shutdownCtx); err != nil {
 		log.Printf("HTTP shutdown error: %v", err)
 	}
 	if err := httpsServer.Shutdown(shutdownCtx); err != nil {
 		log.Printf("HTTPS shutdown error: %v", err)
 	}
+	if quicEndpoint != nil {
+		if err := quicEndpoint.Close(shutdownCtx); err != nil {
+			log.Printf("QUIC shutdown error: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// drain moves tunnels off the relay before its servers shut down, leaving
+// most of ctx's time for that and the rest for the servers' requests to
+// finish
+func drain(ctx context.Context, server *relay.Server) {
+	drainCtx := ctx
+	if deadline, ok := ctx.Deadline(); ok {
+		var cancel context.CancelFunc
+		drainCtx, cancel = context.WithDeadline(ctx, deadline.Add(-time.Until(deadline)/3))
+		defer cancel()
+	}
+	if err := server.Drain(drainCtx); err != nil {
+		log.Printf("drain: %v", err)
+	}
+}
+
+// applyDevEnv sets the sandbox's dev token from DEV_TOKEN, or generates a
+// fresh one on every start
+func applyDevEnv(config *relay.ServerConfig) error {
+	config.DevToken = os.Getenv("DEV_TOKEN")
+	if config.DevToken == "" {
+		token, _, err := auth.GenerateAPIToken()
+		if err != nil {
+			return fmt.Errorf("generate dev token: %w", err)
+		}
+		config.DevToken = token
+	}
+	return nil
+}
+
+// printDevBanner tells a contributor how to use the sandbox relay
+func printDevBanner(addr, domain, token string) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, port = addr, "80"
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = domain
+	}
+	base := "http://" + net.JoinHostPort(host, port)
+
+	fmt.Printf(`
+Lobber relay sandbox: in-memory stores, nothing is saved on exit
+
+  Dev token:  %s
+  Dashboard:  %s
+  Tunnel:     lobber up --relay %s --token %s app.%s:3000
+              then open http://app.%s:%s
+
+`, token, relay.DevLoginURL(base, token), base, token, domain, domain, port)
+}
+
+// applyRetentionEnv overrides the default retention windows from the environment
+func applyRetentionEnv(policy *db.RetentionPolicy) error {
+	if v := os.Getenv("RETENTION_REQUEST_LOGS"); v != "" {
+		windows, err := db.ParsePlanRetention(v)
+		if err != nil {
+			return fmt.Errorf("RETENTION_REQUEST_LOGS: %w", err)
+		}
+		for plan, d := range windows {
+			policy.RequestLogs[plan] = d
+		}
+	}
+
+	for env, target := range map[string]*time.Duration{
+		"RETENTION_BANDWIDTH_USAGE": &policy.BandwidthUsage,
+		"RETENTION_BILLING_EVENTS":  &policy.BillingEvents,
+		"RETENTION_HEALTH_CHECKS":   &policy.HealthChecks,
+		"RETENTION_EVENTS":          &policy.Events,
+	} {
+		v := os.Getenv(env)
+		if v == "" {
+			continue
+		}
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return fmt.Errorf("%s: invalid duration %q", env, v)
+		}
+		*target = d
+	}
+
+	return nil
+}
+
+// applyStatusEnv sets how this relay identifies itself on the status page
+func applyStatusEnv(config *relay.ServerConfig) error {
+	config.RelayID = os.Getenv("RELAY_ID")
+	if config.RelayID == "" {
+		if host, err := os.Hostname(); err == nil && host != "" {
+			config.RelayID = host
+		} else {
+			config.RelayID = "relay"
+		}
+	}
+	config.Region = os.Getenv("RELAY_REGION")
+
+	if v := os.Getenv("HEALTH_CHECK_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("HEALTH_CHECK_INTERVAL: invalid duration %q", v)
+		}
+		config.HealthInterval = d
+	}
+	return nil
+}
+
+// applyBillingEnv picks the payment processor from BILLING_PROVIDER. Other
+// processors are plugged in by embedders through ServerConfig.BillingProvider.
+func applyBillingEnv(config *relay.ServerConfig) error {
+	switch v := os.Getenv("BILLING_PROVIDER"); v {
+	case "", "stripe":
+		// Stripe when STRIPE_API_KEY is set
+	case "none":
+		config.BillingProvider = billing.NoopProvider{}
+	default:
+		return fmt.Errorf("BILLING_PROVIDER: unknown provider %q (want stripe or none)", v)
+	}
+	return nil
+}
+
+// applyRateLimitEnv shares auth failure counters through Redis when
+// REDIS_URL is set, so a lockout on one relay applies to the whole fleet
+func applyRateLimitEnv(config *relay.ServerConfig) error {
+	url := os.Getenv("REDIS_URL")
+	if url == "" {
+		return nil
+	}
+	backend, err := ratelimit.NewRedisFromURL(url)
+	if err != nil {
+		return fmt.Errorf("REDIS_URL: %w", err)
+	}
+	config.RateLimitBackend = backend
+	return nil
+}
+
+// applyAPIQuotaEnv overrides how many API requests each token may make per
+// API_RATE_WINDOW, with API_RATE_LIMITS such as "default=60,pro=300,team=600".
+// Plans left out keep their limit, and 0 lifts a plan's limit.
+func applyAPIQuotaEnv(config *relay.ServerConfig) error {
+	if v := os.Getenv("API_RATE_WINDOW"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("API_RATE_WINDOW: invalid duration %q", v)
+		}
+		config.APIQuota.Window = d
+	}
+	v := os.Getenv("API_RATE_LIMITS")
+	if v == "" {
+		return nil
+	}
+	plans := maps.Clone(config.APIQuota.Plans)
+	if plans == nil {
+		plans = make(map[string]int)
+	}
+	for entry := range strings.SplitSeq(v, ",") {
+		plan, count, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		n, err := strconv.Atoi(count)
+		if !ok || plan == "" || err != nil || n < 0 {
+			return fmt.Errorf("API_RATE_LIMITS: invalid limit %q (want plan=requests)", entry)
+		}
+		if plan == "default" {
+			config.APIQuota.Default = n
+		} else {
+			plans[plan] = n
+		}
+	}
+	config.APIQuota.Plans = plans
+	return nil
+}
+
+// applyConnectLimitEnv overrides the per-IP and capacity caps on
+// /_lobber/connect and the burst limit on proxied traffic, loads the ban
+// list and sets the ports for UDP tunnels
+func applyConnectLimitEnv(config *relay.ServerConfig) error {
+	if v := os.Getenv("MAX_TUNNELS_PER_IP"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return fmt.Errorf("MAX_TUNNELS_PER_IP: invalid count %q", v)
+		}
+		config.MaxTunnelsPerIP = n
+	}
+	if v := os.Getenv("MAX_TUNNELS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return fmt.Errorf("MAX_TUNNELS: invalid count %q", v)
+		}
+		config.MaxTunnels = n
+	}
+	if v := os.Getenv("CAPACITY_LIMIT"); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f < 0 || f > 1 {
+			return fmt.Errorf("CAPACITY_LIMIT: invalid share %q, want 0 to 1", v)
+		}
+		config.CapacityLimit = f
+	}
+	if v := os.Getenv("CONNECT_ATTEMPTS_PER_MINUTE"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return fmt.Errorf("CONNECT_ATTEMPTS_PER_MINUTE: invalid count %q", v)
+		}
+		config.ConnectIPLimit.MaxFailures = n
+		config.ConnectIPLimit.Window = time.Minute
+	}
+	for env, target := range map[string]*float64{
+		"BURST_LIMIT_FACTOR": &config.BurstLimit.Factor,
+		"BURST_LIMIT_FLOOR":  &config.BurstLimit.Floor,
+	} {
+		v := os.Getenv(env)
+		if v == "" {
+			continue
+		}
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f < 0 {
+			return fmt.Errorf("%s: invalid number %q", env, v)
+		}
+		*target = f
+	}
+	if v := os.Getenv("UDP_PORTS"); v != "" {
+		ports, err := relay.ParsePortRange(v)
+		if err != nil {
+			return fmt.Errorf("UDP_PORTS: %w", err)
+		}
+		config.UDPPorts = ports
+	}
+	if v := os.Getenv("BANNED_IPS"); v != "" {
+		bans, err := relay.ParseBanList(v)
+		if err != nil {
+			return fmt.Errorf("BANNED_IPS: %w", err)
+		}
+		config.BannedIPs = bans
+	}
+	return nil
+}
+
+// applyRetryEnv overrides how requests are replayed when their tunnel drops,
+// and how long its hostname is held for the client to resume
+func applyRetryEnv(config *relay.ServerConfig) error {
+	if v := os.Getenv("RETRY_BODY_LIMIT"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return fmt.Errorf("RETRY_BODY_LIMIT: invalid size %q", v)
+		}
+		config.RetryBodyLimit = n
+	}
+	if v := os.Getenv("RETRY_WAIT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return fmt.Errorf("RETRY_WAIT: invalid duration %q", v)
+		}
+		config.RetryWait = d
+	}
+	if v := os.Getenv("RESUME_WINDOW"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return fmt.Errorf("RESUME_WINDOW: invalid duration %q", v)
+		}
+		config.ResumeWindow = d
+	}
+	return nil
+}
+
+// applyTraceEnv sets how many recent requests the relay keeps timings of
+// for GET /_lobber/admin/requests from TRACE_BUFFER, and how many recent
+// errors each tunnel keeps from TUNNEL_ERRORS
+func applyTraceEnv(config *relay.ServerConfig) error {
+	if v := os.Getenv("TRACE_BUFFER"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return fmt.Errorf("TRACE_BUFFER: invalid count %q", v)
+		}
+		config.TraceBuffer = n
+	}
+	if v := os.Getenv("TUNNEL_ERRORS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return fmt.Errorf("TUNNEL_ERRORS: invalid count %q", v)
+		}
+		config.TunnelErrors = n
+	}
+	return nil
+}
+
+// applyWatchdogEnv sets how often the memory watchdog samples the relay
+// from WATCHDOG_INTERVAL, how much growth it reports from WATCHDOG_GROWTH,
+// and where it writes heap profiles from HEAP_PROFILE_DIR
+func applyWatchdogEnv(config *relay.ServerConfig) error {
+	if v := os.Getenv("WATCHDOG_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return fmt.Errorf("WATCHDOG_INTERVAL: invalid duration %q", v)
+		}
+		config.WatchdogInterval = d
+	}
+	if v := os.Getenv("WATCHDOG_GROWTH"); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f <= 1 {
+			return fmt.Errorf("WATCHDOG_GROWTH: invalid factor %q, want more than 1", v)
+		}
+		config.WatchdogGrowth = f
+	}
+	config.HeapProfileDir = os.Getenv("HEAP_PROFILE_DIR")
+	return nil
+}
+
+// applyFeatureEnv picks the optional protocol features this relay offers
+// clients from RELAY_FEATURES, and those it warns are being withdrawn from
+// RELAY_DEPRECATED_FEATURES, so a protocol change can be rolled out or back
+// one relay at a time. RELAY_MIN_PROTOCOL turns away clients too old to
+// speak to, and RELAY_MAX_FRAME_SIZE caps the frames read from clients.
+func applyFeatureEnv(config *relay.ServerConfig) error {
+	if v, ok := os.LookupEnv("RELAY_FEATURES"); ok {
+		features := tunnel.ParseFeatures(v)
+		for _, f := range features {
+			if !slices.Contains(tunnel.Features, f) {
+				return fmt.Errorf("RELAY_FEATURES: unknown feature %q (want some of %s)", f, strings.Join(tunnel.Features, ", "))
+			}
+		}
+		config.Features = features
+	}
+	if v := os.Getenv("RELAY_DEPRECATED_FEATURES"); v != "" {
+		config.Deprecated = tunnel.ParseFeatures(v)
+	}
+	if v := os.Getenv("RELAY_MIN_PROTOCOL"); v != "" {
+		n, err := tunnel.ParseVersion(v)
+		if err != nil || n > tunnel.ProtocolVersion {
+			return fmt.Errorf("RELAY_MIN_PROTOCOL: want a version from 1 to %d, got %q", tunnel.ProtocolVersion, v)
+		}
+		config.MinProtocol = n
+	}
+	if v := os.Getenv("RELAY_MAX_FRAME_SIZE"); v != "" {
+		n, err := tunnel.ParseMaxFrame(v)
+		if err != nil {
+			return fmt.Errorf("RELAY_MAX_FRAME_SIZE: %w", err)
+		}
+		config.MaxFrameSize = n
+	}
+	return nil
+}
+
+// applyScrubEnv loads the rules for redacting request data before it's
+// logged from the YAML file named by SCRUB_RULES_FILE, e.g.
+//
+//	patterns:
+//	  - '[\w.+-]+@[\w-]+\.[\w.]+'
+func applyScrubEnv(config *relay.ServerConfig) error {
+	path := os.Getenv("SCRUB_RULES_FILE")
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("SCRUB_RULES_FILE: %w", err)
+	}
+	var rules scrub.Rules
+	if err := yaml.Unmarshal(data, &rules); err != nil {
+		return fmt.Errorf("SCRUB_RULES_FILE: parse %s: %w", path, err)
+	}
+	s, err := scrub.New(rules)
+	if err != nil {
+		return fmt.Errorf("SCRUB_RULES_FILE: %w", err)
+	}
+	config.Scrub = s
+	return nil
+}
+
+// applySSOEnv loads the identity providers team members sign in to the
+// dashboard through from the YAML file named by SSO_CONNECTIONS_FILE, e.g.
+//
+//   - domain: acme.com
+//     org: <team owner's user ID>
+//     issuer: https://acme.okta.com
+//     client_id: ...
+//     client_secret: ...
+func applySSOEnv(config *relay.ServerConfig) error {
+	path := os.Getenv("SSO_CONNECTIONS_FILE")
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("SSO_CONNECTIONS_FILE: %w", err)
+	}
+	conns, err := oidc.ParseConnections(data)
+	if err != nil {
+		return fmt.Errorf("SSO_CONNECTIONS_FILE: parse %s: %w", path, err)
+	}
+	config.SSO = conns
+	return nil
+}
+
+// applyExportEnv enables exports to users' buckets and pull request
+// comments with the key sealing their credentials. Every relay sharing a
+// database needs the same key.
+func applyExportEnv(config *relay.ServerConfig) error {
+	v := os.Getenv("EXPORT_KEY")
+	if v == "" {
+		return nil
+	}
+	key, err := export.ParseKey(v)
+	if err != nil {
+		return fmt.Errorf("EXPORT_KEY: %w", err)
+	}
+	config.ExportKey = key
+	if v := os.Getenv("EXPORT_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("EXPORT_INTERVAL: invalid duration %q", v)
+		}
+		config.ExportInterval = d
+	}
+	return nil
+}
+
+// applyPluginEnv loads the plugins compiled into the binary and opens the
+// store named by STORE_URL with the storage backend plugin for its scheme
+func applyPluginEnv(ctx context.Context, config *relay.ServerConfig) error {
+	config.Plugins = plugin.Registered()
+	v := os.Getenv("STORE_URL")
+	if v == "" {
+		return nil
+	}
+	u, err := url.Parse(v)
+	if err != nil || u.Scheme == "" {
+		return fmt.Errorf("STORE_URL: invalid URL")
+	}
+	backend, ok := plugin.StorageBackendFor(config.Plugins, u.Scheme)
+	if !ok {
+		return fmt.Errorf("STORE_URL: no storage plugin for %q", u.Scheme)
+	}
+	s, err := backend.Open(ctx, v)
+	if err != nil {
+		return fmt.Errorf("STORE_URL: open %s: %w", backend.Name(), err)
+	}
+	config.Store = s
+	return nil
+}
 
+// applyQueryTimeoutEnv overrides the default database query deadline and slow-query threshold
+func applyQueryTimeoutEnv() error {
+	timeouts := db.DefaultQueryTimeouts()
+	for env, target := range map[string]*time.Duration{
+		"DB_QUERY_TIMEOUT":    &timeouts.Default,
+		"DB_SLOW_QUERY_AFTER": &timeouts.SlowThreshold,
+	} {
+		v := os.Getenv(env)
+		if v == "" {
+			continue
+		}
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return fmt.Errorf("%s: invalid duration %q", env, v)
+		}
+		*target = d
+	}
+	db.SetQueryTimeouts(timeouts)
 	return nil
 }
@@ -0,0 +1,8 @@
+// cmd/relay/plugins.go
+package main
+
+// Plugins are compiled in: add a blank import of each plugin package here
+// and rebuild. The package registers itself with plugin.Register from its
+// init function, for example
+//
+//	import _ "example.com/acme/lobber-sso"
@@ -2,137 +2,1674 @@
 package integration_test
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"maps"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"slices"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/lobber-dev/lobber/internal/auth"
+	"github.com/lobber-dev/lobber/internal/billing"
 	"github.com/lobber-dev/lobber/internal/client"
 	"github.com/lobber-dev/lobber/internal/relay"
+	"github.com/lobber-dev/lobber/internal/store"
+	"github.com/lobber-dev/lobber/internal/testsupport"
+	"github.com/lobber-dev/lobber/internal/tunnel"
+	"github.com/stripe/stripe-go/v76"
+	"golang.org/x/net/websocket"
 )
 
-func TestEndToEndTunnel(t *testing.T) {
-	// 1. Start a local HTTP server that we want to expose
-	localServer := startTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+// localApp serves body on every path and tags responses with X-Local-Server
+func localApp(t *testing.T, body string) string {
+	t.Helper()
+	return testsupport.StartServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("X-Local-Server", "true")
 		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("hello from local"))
-	}))
-	defer localServer.Close()
+		w.Write([]byte(body))
+	})).URL
+}
+
+// readBody returns the response body as a string
+func readBody(t *testing.T, resp *http.Response) string {
+	t.Helper()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("read body: %v", err)
+	}
+	return string(body)
+}
+
+func TestEndToEndTunnel(t *testing.T) {
+	r := testsupport.StartRelay(t, nil, nil)
+	r.Connect(t, "test.example.com", localApp(t, "hello from local"))
+
+	resp := r.Get(t, "test.example.com", "/api/test")
+	if body := readBody(t, resp); body != "hello from local" {
+		t.Errorf("body = %q, want %q", body, "hello from local")
+	}
+	if resp.Header.Get("X-Local-Server") != "true" {
+		t.Error("missing X-Local-Server header from local server")
+	}
+}
 
-	// 2. Start relay server (in-memory, no real TLS)
+func TestTunnelHandshake(t *testing.T) {
+	// Test that client can connect and register with relay
 	relayServer := relay.NewServer(nil)
-	relayHTTP := startTestServer(t, relayServer)
-	defer relayHTTP.Close()
+	relayHTTP := testsupport.StartServer(t, relayServer)
 
-	// 3. Create and connect client
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
 	defer cancel()
 
-	tunnelClient := client.New(localServer.URL, relayHTTP.URL, "test-token", "test.example.com")
+	tunnelClient := client.New("http://localhost:3000", relayHTTP.URL, "test-token", "myapp.example.com")
+
+	// Connect should succeed (not return "not implemented")
+	err := tunnelClient.Connect(ctx)
+	if err != nil {
+		t.Fatalf("Connect() failed: %v", err)
+	}
+
+	// Verify tunnel is registered
+	if !relayServer.HasTunnel("myapp.example.com") {
+		t.Error("tunnel not registered after Connect()")
+	}
+}
+
+func TestTunnelRejectsBadToken(t *testing.T) {
+	r := testsupport.StartRelay(t, nil, nil)
+
+	_, err := r.ConnectWithToken("test.example.com", localApp(t, "unused"), "lb_wrong")
+	if err == nil {
+		t.Fatal("ConnectWithToken() with a wrong token succeeded")
+	}
+	if r.HasTunnel("test.example.com") {
+		t.Error("tunnel registered for a rejected token")
+	}
+}
+
+func TestTunnelReconnect(t *testing.T) {
+	r := testsupport.StartRelay(t, nil, nil)
+	const domain = "app.example.com"
+
+	first := r.Connect(t, domain, localApp(t, "first"))
+	if body := readBody(t, r.Get(t, domain, "/")); body != "first" {
+		t.Fatalf("body = %q, want %q", body, "first")
+	}
+
+	// Once the client goes away the hostname stops routing
+	if err := first.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if resp := r.Get(t, domain, "/"); resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("status after disconnect = %d, want %d", resp.StatusCode, http.StatusBadGateway)
+	}
+
+	// A reconnect picks the hostname back up
+	r.Connect(t, domain, localApp(t, "second"))
+	if body := readBody(t, r.Get(t, domain, "/")); body != "second" {
+		t.Errorf("body after reconnect = %q, want %q", body, "second")
+	}
+}
+
+func TestTunnelTakeover(t *testing.T) {
+	r := testsupport.StartRelay(t, nil, nil)
+	const domain = "app.example.com"
+
+	old := r.Connect(t, domain, localApp(t, "old"))
+	r.Connect(t, domain, localApp(t, "new"))
+	if body := readBody(t, r.Get(t, domain, "/")); body != "new" {
+		t.Fatalf("body = %q, want the newer tunnel", body)
+	}
+
+	// The replaced connection closing must not take the new one down
+	old.Close()
+	if body := readBody(t, r.Get(t, domain, "/")); body != "new" {
+		t.Errorf("body after old tunnel closed = %q, want %q", body, "new")
+	}
+}
+
+func TestTunnelWelcome(t *testing.T) {
+	r := testsupport.StartRelay(t, nil, nil)
+	const domain = "app.example.com"
+
+	tun := r.Connect(t, domain, localApp(t, "ok"))
+	w := tun.Welcome()
+	if w == nil {
+		t.Fatal("Welcome() = nil, want the relay's welcome")
+	}
+	relayURL, _ := url.Parse(r.URL)
+	want := "http://" + net.JoinHostPort(domain, relayURL.Port()) + "/"
+	if len(w.URLs) != 1 || w.URLs[0] != want {
+		t.Errorf("URLs = %v, want [%s]", w.URLs, want)
+	}
+	if w.HeartbeatSeconds != 30 || w.Limits.BurstFloor != relay.DefaultBurstPolicy().Floor {
+		t.Errorf("welcome = %+v, want the relay's default heartbeat and burst floor", w)
+	}
+}
+
+func TestFeatureRollout(t *testing.T) {
+	config := relay.DefaultServerConfig()
+	config.Features = []string{tunnel.FeatureHeartbeat, tunnel.FeatureWelcome, tunnel.FeatureEcho}
+	config.Deprecated = []string{tunnel.FeatureHeartbeat}
+	config.AdminToken = "admin"
+	r := testsupport.StartRelay(t, config, nil)
+	const domain = "app.example.com"
 
-	// Set up ready channel for synchronization
-	readyCh := make(chan struct{})
-	tunnelClient.SetOnReady(func() {
-		close(readyCh)
+	// The relay holds metadata back and warns heartbeats are going away
+	w := r.Connect(t, domain, localApp(t, "ok")).Welcome()
+	if w == nil {
+		t.Fatal("Welcome() = nil, want the relay's welcome")
+	}
+	if want := config.Features; !slices.Equal(w.Features, want) {
+		t.Errorf("Features = %v, want %v", w.Features, want)
+	}
+	if !slices.Equal(w.Deprecated, config.Deprecated) {
+		t.Errorf("Deprecated = %v, want %v", w.Deprecated, config.Deprecated)
+	}
+
+	// The client echoes what it uses in its Ready frame, so operators can
+	// find the tunnels still on a deprecated feature. A request through the
+	// tunnel waits for the relay to have read it.
+	readBody(t, r.Get(t, domain, "/"))
+	req, _ := http.NewRequest("GET", r.URL+"/_lobber/admin/tunnels?feature=heartbeat", nil)
+	req.Header.Set("Authorization", "Bearer admin")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("admin tunnels: %v", err)
+	}
+	var tunnels []struct {
+		Domain   string   `json:"domain"`
+		Features []string `json:"features"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tunnels); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	resp.Body.Close()
+	if len(tunnels) != 1 || tunnels[0].Domain != domain || !slices.Equal(tunnels[0].Features, config.Features) {
+		t.Errorf("tunnels = %+v, want %s using %v", tunnels, domain, config.Features)
+	}
+}
+
+func TestCompressedTunnel(t *testing.T) {
+	for _, features := range [][]string{tunnel.Features, {tunnel.FeatureWelcome}} {
+		t.Run(strings.Join(features, ","), func(t *testing.T) {
+			config := relay.DefaultServerConfig()
+			config.Features = features
+			r := testsupport.StartRelay(t, config, nil)
+
+			// JSON-heavy bodies both ways come through whole, whether or
+			// not the relay offers compression
+			body := strings.Repeat(`{"id":1,"name":"widget","tags":["a","b"]},`, 5000)
+			app := testsupport.StartServer(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				in, _ := io.ReadAll(req.Body)
+				w.Write(in)
+				w.Write([]byte(body))
+			}))
+			r.Connect(t, "big.example.com", app.URL)
+
+			req, _ := http.NewRequest("POST", r.URL+"/upload", strings.NewReader(body))
+			req.Host = "big.example.com"
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("POST: %v", err)
+			}
+			if got := readBody(t, resp); got != body+body {
+				t.Errorf("body is %d bytes, want %d", len(got), 2*len(body))
+			}
+		})
+	}
+}
+
+func TestTunnelQuality(t *testing.T) {
+	r := testsupport.StartRelay(t, nil, nil)
+	const domain = "app.example.com"
+
+	c := client.New(localApp(t, "ok"), r.URL, r.Token, domain)
+	c.HeartbeatInterval = 20 * time.Millisecond
+	ready := make(chan struct{})
+	c.SetOnReady(func() { close(ready) })
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- c.Run(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	select {
+	case <-ready:
+	case err := <-done:
+		t.Fatalf("Run() error = %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for tunnel")
+	}
+	for range 3 {
+		readBody(t, r.Get(t, domain, "/"))
+	}
+
+	// The relay answers heartbeats, timing the round trip
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		q := c.Quality()
+		if q.RTTMs > 0 {
+			if !q.Connected || !q.Heartbeat || q.Domain != domain {
+				t.Errorf("quality = %+v, want connected with heartbeats for %s", q, domain)
+			}
+			if q.Frames < 4 || q.FrameErrors != 0 {
+				t.Errorf("frames = %d with %d errors, want the requests and a pong without errors", q.Frames, q.FrameErrors)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("quality = %+v, want a measured RTT", q)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTunnelLabels(t *testing.T) {
+	r := testsupport.StartRelay(t, nil, nil)
+	const domain = "app.customer-site.com"
+	addDomain(t, r, domain)
+
+	c := client.New(localApp(t, "ok"), r.URL, r.Token, domain)
+	c.Labels = tunnel.Labels{"env": "staging", "service": "api"}
+	ready := make(chan struct{})
+	c.SetOnReady(func() { close(ready) })
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- c.Run(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		<-done
 	})
 
-	// Start client in background
-	clientErr := make(chan error, 1)
+	select {
+	case <-ready:
+	case err := <-done:
+		t.Fatalf("Run() error = %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for tunnel")
+	}
+
+	tunnels := r.UserTunnels(relay.DevUserID)
+	if len(tunnels) != 1 || !maps.Equal(tunnels[0].Labels, map[string]string(c.Labels)) {
+		t.Errorf("UserTunnels() = %+v, want %s labelled %v", tunnels, domain, c.Labels)
+	}
+
+	// Request logs carry the labels of the tunnel that served them
+	readBody(t, r.Get(t, domain, "/"))
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		body := readBody(t, dashboard(t, r, "GET", "/api/dashboard/logs", nil))
+		if strings.Contains(body, `"labels":{"env":"staging","service":"api"}`) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("logs = %s, want the visit logged with the tunnel's labels", body)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestRequestLatencyLogged(t *testing.T) {
+	r := testsupport.StartRelay(t, nil, nil)
+	const domain = "slow.customer-site.com"
+	addDomain(t, r, domain)
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		time.Sleep(30 * time.Millisecond)
+		w.Write([]byte("ok"))
+	}))
+	t.Cleanup(slow.Close)
+	r.Connect(t, domain, slow.URL)
+
+	readBody(t, r.Get(t, domain, "/"))
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		var body struct {
+			Logs []struct {
+				DurationMs float64 `json:"duration_ms"`
+				Latency    *struct {
+					LocalMs float64 `json:"local_ms"`
+				} `json:"latency"`
+			} `json:"logs"`
+		}
+		resp := dashboard(t, r, "GET", "/api/dashboard/logs", nil)
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatalf("decode logs: %v", err)
+		}
+		resp.Body.Close()
+		if len(body.Logs) > 0 {
+			l := body.Logs[0]
+			if l.Latency == nil || l.Latency.LocalMs < 30 || l.Latency.LocalMs > l.DurationMs {
+				t.Errorf("log = %+v, want at least the local server's 30ms put down to it", l)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no request logged")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestWebSocketThroughTunnel(t *testing.T) {
+	r := testsupport.StartRelay(t, nil, nil)
+	const domain = "chat.customer-site.com"
+	addDomain(t, r, domain)
+	echo := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		var msg string
+		for websocket.Message.Receive(ws, &msg) == nil {
+			websocket.Message.Send(ws, msg)
+		}
+	}))
+	t.Cleanup(echo.Close)
+	r.Connect(t, domain, echo.URL)
+
+	relayURL, _ := url.Parse(r.URL)
+	conn, err := net.Dial("tcp", relayURL.Host)
+	if err != nil {
+		t.Fatalf("dial relay: %v", err)
+	}
+	config, _ := websocket.NewConfig("ws://"+domain+"/socket", "http://"+domain)
+	ws, err := websocket.NewClient(config, conn)
+	if err != nil {
+		t.Fatalf("WebSocket handshake: %v", err)
+	}
+	ws.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// A message larger than one Stream frame arrives whole
+	for _, msg := range []string{"hello", strings.Repeat("lobber ", 20000)} {
+		if err := websocket.Message.Send(ws, msg); err != nil {
+			t.Fatalf("send: %v", err)
+		}
+		var got string
+		if err := websocket.Message.Receive(ws, &got); err != nil {
+			t.Fatalf("receive: %v", err)
+		}
+		if got != msg {
+			t.Errorf("echo = %d bytes, want the %d sent", len(got), len(msg))
+		}
+	}
+	ws.Close()
+
+	// The connection is logged once it closes
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		var body struct {
+			Logs []struct {
+				StatusCode int    `json:"status_code"`
+				Path       string `json:"path"`
+			} `json:"logs"`
+		}
+		resp := dashboard(t, r, "GET", "/api/dashboard/logs", nil)
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatalf("decode logs: %v", err)
+		}
+		resp.Body.Close()
+		if len(body.Logs) > 0 {
+			if l := body.Logs[0]; l.StatusCode != http.StatusSwitchingProtocols || l.Path != "/socket" {
+				t.Errorf("log = %+v, want the 101 for /socket", l)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("WebSocket not logged")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestNamedTunnelHistory(t *testing.T) {
+	r := testsupport.StartRelay(t, nil, nil)
+	app := localApp(t, "ok")
+
+	// The same named tunnel comes up on a different hostname each day
+	for _, domain := range []string{"mon.customer-site.com", "tue.customer-site.com"} {
+		addDomain(t, r, domain)
+		c := client.New(app, r.URL, r.Token, domain)
+		c.Name = "checkout"
+		ready := make(chan struct{})
+		c.SetOnReady(func() { close(ready) })
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error, 1)
+		go func() { done <- c.Run(ctx) }()
+
+		select {
+		case <-ready:
+		case err := <-done:
+			t.Fatalf("Run() error = %v", err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for tunnel")
+		}
+		if tunnels := r.UserTunnels(relay.DevUserID); len(tunnels) != 1 || tunnels[0].Name != "checkout" {
+			t.Errorf("UserTunnels() = %+v, want %s named checkout", tunnels, domain)
+		}
+		readBody(t, r.Get(t, domain, "/"))
+		cancel()
+		<-done
+	}
+
+	want := `"name":"checkout","hostnames":["mon.customer-site.com","tue.customer-site.com"],"sessions":2`
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		body := readBody(t, dashboard(t, r, "GET", "/api/dashboard/tunnels", nil))
+		if strings.Contains(body, want) && strings.Contains(body, `"requests":2`) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("tunnels = %s, want both sessions grouped under checkout", body)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	body := readBody(t, dashboard(t, r, "GET", "/api/dashboard/tunnels/checkout", nil))
+	if strings.Count(body, `"hostname":`) != 2 {
+		t.Errorf("sessions = %s, want both of checkout's sessions", body)
+	}
+}
+
+func TestEventFeed(t *testing.T) {
+	r := testsupport.StartRelay(t, nil, nil)
+	app := localApp(t, "ok")
+	addDomain(t, r, "feed.customer-site.com")
+
+	c := client.New(app, r.URL, r.Token, "feed.customer-site.com")
+	c.Name = "feed"
+	ready := make(chan struct{})
+	c.SetOnReady(func() { close(ready) })
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- c.Run(ctx) }()
+	select {
+	case <-ready:
+	case err := <-done:
+		t.Fatalf("Run() error = %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for tunnel")
+	}
+
+	// The CLI follows the feed by waiting for whatever comes after the
+	// last event it printed
+	body := readBody(t, dashboard(t, r, "GET", "/api/v1/events?wait=5s", nil))
+	if !strings.Contains(body, `"id":1,"type":"tunnel.connected","hostname":"feed.customer-site.com","message":"Tunnel feed connected"`) {
+		t.Fatalf("events = %s, want the tunnel connecting", body)
+	}
+	followed := make(chan string, 1)
+	go func() { followed <- readBody(t, dashboard(t, r, "GET", "/api/v1/events?after=1&wait=5s", nil)) }()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	<-done
+
+	select {
+	case body := <-followed:
+		if !strings.Contains(body, `"type":"tunnel.disconnected"`) {
+			t.Errorf("followed events = %s, want the tunnel disconnecting", body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout following the feed")
+	}
+
+	body = readBody(t, dashboard(t, r, "GET", "/api/dashboard/events", nil))
+	if strings.Count(body, `"type":"tunnel.`) != 2 {
+		t.Errorf("dashboard events = %s, want both", body)
+	}
+}
+
+// udpEcho answers every datagram on a loopback UDP port with "echo: "
+// and the datagram, returning the port's address
+func udpEcho(t *testing.T) string {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Skipf("skipping UDP test: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
 	go func() {
-		clientErr <- tunnelClient.Run(ctx)
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDP(append([]byte("echo: "), buf[:n]...), addr)
+		}
 	}()
+	return conn.LocalAddr().String()
+}
+
+// freeUDPPort returns a UDP port nothing is listening on right now
+func freeUDPPort(t *testing.T) int {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{})
+	if err != nil {
+		t.Skipf("skipping UDP test: %v", err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+func TestUDPTunnel(t *testing.T) {
+	config := relay.DefaultServerConfig()
+	port := freeUDPPort(t)
+	config.UDPPorts = relay.PortRange{First: port, Last: port}
+	r := testsupport.StartRelay(t, config, nil)
+	const domain = "dns.customer-site.com"
+	addDomain(t, r, domain)
+
+	c := client.New(udpEcho(t), r.URL, r.Token, domain)
+	c.UDP = true
+	ready := make(chan struct{})
+	c.SetOnReady(func() { close(ready) })
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- c.Run(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
 
-	// 4. Wait for tunnel to be ready (replaces time.Sleep)
 	select {
-	case <-readyCh:
-		// Client is ready
-	case err := <-clientErr:
-		t.Fatalf("client error before ready: %v", err)
-	case <-time.After(2 * time.Second):
-		t.Fatal("timeout waiting for tunnel to become ready")
+	case <-ready:
+	case err := <-done:
+		t.Fatalf("Run() error = %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for tunnel")
+	}
+	if c.UDPPort() != port {
+		t.Fatalf("UDPPort() = %d, want the relay's only UDP port %d", c.UDPPort(), port)
 	}
 
-	// Also wait for server to receive and process the ready frame
-	tun := relayServer.GetTunnel("test.example.com")
-	if tun == nil {
-		t.Fatal("tunnel not registered")
+	// Two peers each get their own answers
+	for _, msg := range []string{"first peer", "second peer"} {
+		peer, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port})
+		if err != nil {
+			t.Fatalf("dial relay: %v", err)
+		}
+		defer peer.Close()
+		peer.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := peer.Write([]byte(msg)); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		buf := make([]byte, 2048)
+		n, err := peer.Read(buf)
+		if err != nil {
+			t.Fatalf("read reply to %q: %v", msg, err)
+		}
+		if got := string(buf[:n]); got != "echo: "+msg {
+			t.Errorf("reply = %q, want %q", got, "echo: "+msg)
+		}
 	}
-	select {
-	case <-tun.GetReadyChannel():
-		// Tunnel is ready on server side
-	case <-time.After(2 * time.Second):
-		t.Fatal("timeout waiting for server to mark tunnel ready")
+
+	// The hostname doesn't serve HTTP
+	if resp := r.Get(t, domain, "/"); resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("HTTP status = %d, want 502 for a UDP tunnel", resp.StatusCode)
 	}
 
-	// 5. Make request to relay with Host header matching the tunnel domain
-	req, err := http.NewRequest("GET", relayHTTP.URL+"/api/test", nil)
+	// A relay without free ports turns the next UDP tunnel away
+	addDomain(t, r, "other.customer-site.com")
+	other := client.New(udpEcho(t), r.URL, r.Token, "other.customer-site.com")
+	other.UDP = true
+	var connErr *client.ConnectError
+	if err := other.Connect(context.Background()); !errors.As(err, &connErr) || connErr.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Connect() with no free ports error = %v, want 503", err)
+	}
+}
+
+// quotaChecker reports a fixed quota level for every user
+type quotaChecker struct {
+	level billing.QuotaLevel
+}
+
+func (c *quotaChecker) GetQuotaLevel(ctx context.Context, userID string) (billing.QuotaLevel, error) {
+	return c.level, nil
+}
+
+func (c *quotaChecker) NotifyUsageThresholds(ctx context.Context, userID string) error {
+	return nil
+}
+
+func TestQuotaCapsTunnel(t *testing.T) {
+	tests := []struct {
+		level  billing.QuotaLevel
+		status int
+	}{
+		{billing.QuotaOK, http.StatusOK},
+		{billing.QuotaExceeded, http.StatusOK},
+		{billing.QuotaCapped, http.StatusPaymentRequired},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.level.String(), func(t *testing.T) {
+			r := testsupport.StartRelay(t, nil, nil)
+			r.SetQuotaChecker(&quotaChecker{level: tt.level})
+			r.Connect(t, "app.example.com", localApp(t, "ok"))
+
+			resp := r.Get(t, "app.example.com", "/")
+			if resp.StatusCode != tt.status {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+			if tt.status == http.StatusPaymentRequired && !strings.Contains(readBody(t, resp), "app.example.com") {
+				t.Error("quota page does not name the tunnel")
+			}
+		})
+	}
+}
+
+// dashboard sends an authenticated dashboard request as the relay's dev user
+func dashboard(t *testing.T, r *testsupport.Relay, method, path string, form url.Values) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, r.URL+path, strings.NewReader(form.Encode()))
 	if err != nil {
 		t.Fatalf("create request: %v", err)
 	}
-	req.Host = "test.example.com"
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Bearer "+r.Token)
+	req.Header.Set("HX-Request", "true")
+	resp, err := r.HTTPClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
 
-	resp, err := http.DefaultClient.Do(req)
+// addDomain registers a custom domain in the dashboard the way a user would
+func addDomain(t *testing.T, r *testsupport.Relay, domain string) {
+	t.Helper()
+	resp := dashboard(t, r, "POST", "/dashboard/domains/add", url.Values{"domain": {domain}})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("add domain status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+}
+
+func TestCustomDomain(t *testing.T) {
+	r := testsupport.StartRelay(t, nil, nil)
+	addDomain(t, r, "App.Customer-Site.com")
+
+	resp := dashboard(t, r, "GET", "/api/dashboard/domains", nil)
+	var listed struct {
+		Domains []struct {
+			Name string `json:"name"`
+		} `json:"domains"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&listed); err != nil {
+		t.Fatalf("decode domains: %v", err)
+	}
+	if len(listed.Domains) != 1 || listed.Domains[0].Name != "app.customer-site.com" {
+		t.Fatalf("domains = %+v, want app.customer-site.com", listed.Domains)
+	}
+
+	// Visitors reach it however their browser spells the host
+	r.Connect(t, "App.Customer-Site.com", localApp(t, "custom"))
+	for _, host := range []string{"app.customer-site.com", "APP.customer-site.com:443", "app.customer-site.com."} {
+		if body := readBody(t, r.Get(t, host, "/")); body != "custom" {
+			t.Errorf("Host %q: body = %q, want %q", host, body, "custom")
+		}
+	}
+	if tunnels := r.UserTunnels(relay.DevUserID); len(tunnels) != 1 || tunnels[0].Hostname != "app.customer-site.com" {
+		t.Errorf("UserTunnels() = %v, want [app.customer-site.com]", tunnels)
+	}
+}
+
+func TestStripeClientAgainstFake(t *testing.T) {
+	fake := testsupport.StartFakeStripe(t)
+	fake.AddPrice(stripe.Price{
+		ID:         "price_team_year",
+		Currency:   stripe.CurrencyUSD,
+		UnitAmount: 9600,
+		Metadata:   map[string]string{"plan": "team"},
+		Recurring:  &stripe.PriceRecurring{Interval: stripe.PriceRecurringIntervalYear, UsageType: stripe.PriceRecurringUsageTypeLicensed},
+	})
+	sc := billing.NewStripeClient("sk_test_fake")
+
+	customerID, err := sc.CreateCustomer("dev@example.com", "Dev", nil)
 	if err != nil {
-		t.Fatalf("request through tunnel: %v", err)
+		t.Fatalf("CreateCustomer() error = %v", err)
+	}
+	if c := fake.Customer(customerID); c == nil || c.Email != "dev@example.com" {
+		t.Fatalf("fake customer = %+v, want dev@example.com", c)
 	}
-	defer resp.Body.Close()
 
-	// 6. Verify response comes from local server
-	body, _ := io.ReadAll(resp.Body)
-	if !bytes.Equal(body, []byte("hello from local")) {
-		t.Errorf("body = %q, want %q", string(body), "hello from local")
+	metered, err := sc.CreateSubscription(customerID, "price_payg", nil)
+	if err != nil {
+		t.Fatalf("CreateSubscription() error = %v", err)
+	}
+	if metered.Plan != billing.PlanPAYG {
+		t.Errorf("metered Plan = %q, want %q", metered.Plan, billing.PlanPAYG)
+	}
+	if err := sc.ReportUsage(metered.ItemID, 3*1024*1024); err != nil {
+		t.Fatalf("ReportUsage() error = %v", err)
+	}
+	if got := fake.UsageReported(metered.ItemID); got != 3 {
+		t.Errorf("usage reported = %d MB, want 3", got)
 	}
 
-	if resp.Header.Get("X-Local-Server") != "true" {
-		t.Error("missing X-Local-Server header from local server")
+	team, err := sc.CreateSubscription(customerID, "price_team_year", &billing.SubscriptionOptions{Seats: 3})
+	if err != nil {
+		t.Fatalf("CreateSubscription(team) error = %v", err)
+	}
+	if _, err := sc.UpdateSeats(team.ID, 5); err != nil {
+		t.Fatalf("UpdateSeats() error = %v", err)
+	}
+	got, err := sc.GetSubscription(team.ID)
+	if err != nil {
+		t.Fatalf("GetSubscription() error = %v", err)
+	}
+	if got.Plan != billing.PlanTeam || got.Seats != 5 || got.Interval != billing.IntervalYear {
+		t.Errorf("team subscription = %+v, want 5 yearly team seats", got)
 	}
 
-	// Cancel to stop the client
+	if err := sc.CancelSubscription(metered.ID); err != nil {
+		t.Fatalf("CancelSubscription() error = %v", err)
+	}
+	if _, err := sc.GetSubscription("sub_missing"); err == nil {
+		t.Error("GetSubscription() of an unknown subscription succeeded")
+	}
+}
+
+func TestPostgresRelayBilling(t *testing.T) {
+	database := testsupport.Postgres(t)
+	fake := testsupport.StartFakeStripe(t)
+	ctx := context.Background()
+
+	var userID string
+	if err := database.QueryRowContext(ctx,
+		"INSERT INTO users (email, name) VALUES ('dev@example.com', 'Dev') RETURNING id::text").Scan(&userID); err != nil {
+		t.Fatalf("insert user: %v", err)
+	}
+	token, _, err := auth.GenerateAPIToken()
+	if err != nil {
+		t.Fatalf("generate token: %v", err)
+	}
+	if _, err := store.NewPostgres(database.DB).CreateToken(ctx, userID, "ci", auth.HashToken(token)); err != nil {
+		t.Fatalf("create token: %v", err)
+	}
+
+	config := relay.DefaultServerConfig()
+	config.StripeAPIKey = "sk_test_fake"
+	config.StripeWebhookKey = "whsec_test"
+	r := testsupport.StartRelay(t, config, database)
+
+	// Tunnels authenticate against tokens in the database
+	if _, err := r.ConnectWithToken("app.example.com", localApp(t, "unused"), "lb_wrong"); err == nil {
+		t.Error("ConnectWithToken() with an unknown token succeeded")
+	}
+	tun, err := r.ConnectWithToken("app.example.com", localApp(t, "from postgres"), token)
+	if err != nil {
+		t.Fatalf("ConnectWithToken() error = %v", err)
+	}
+	defer tun.Close()
+	if body := readBody(t, r.Get(t, "app.example.com", "/")); body != "from postgres" {
+		t.Errorf("body = %q, want %q", body, "from postgres")
+	}
+
+	// A subscription created in Stripe reaches the user through the webhook
+	svc := billing.NewServiceWithProvider(database.DB, billing.NewStripeClient("sk_test_fake"))
+	customerID, err := svc.CreateCustomerForUser(ctx, userID, "dev@example.com", "Dev")
+	if err != nil {
+		t.Fatalf("CreateCustomerForUser() error = %v", err)
+	}
+	sub, err := billing.NewStripeClient("sk_test_fake").CreateSubscription(customerID, "price_payg", nil)
+	if err != nil {
+		t.Fatalf("CreateSubscription() error = %v", err)
+	}
+	resp, err := fake.SendWebhook(r.URL+"/stripe/webhook", config.StripeWebhookKey, "customer.subscription.created", fake.Subscription(sub.ID))
+	if err != nil {
+		t.Fatalf("send webhook: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("webhook status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+
+	user, err := store.NewPostgres(database.DB).GetUser(ctx, userID)
+	if err != nil {
+		t.Fatalf("GetUser() error = %v", err)
+	}
+	if user.Plan != string(billing.PlanPAYG) {
+		t.Errorf("Plan = %q after subscription webhook, want %q", user.Plan, billing.PlanPAYG)
+	}
+}
+
+func TestTLSCustomDomain(t *testing.T) {
+	r := testsupport.StartTLSRelay(t, nil, nil)
+	r.TLS.AddDomain("app.customer-site.com")
+	r.Connect(t, "app.customer-site.com", localApp(t, "over tls"))
+
+	// The tunnel itself came in over TLS, offering only HTTP/1.1 so it can be
+	// taken over after the connect request
+	if meta := r.GetTunnel("app.customer-site.com").Meta; meta.TLSVersion != "TLS 1.3" || meta.ALPN != "http/1.1" {
+		t.Errorf("tunnel Meta = %+v, want TLS 1.3 with http/1.1", meta)
+	}
+
+	for _, host := range []string{"app.customer-site.com", "APP.Customer-Site.com"} {
+		resp := r.Get(t, host, "/")
+		if body := readBody(t, resp); body != "over tls" {
+			t.Errorf("Host %q: body = %q, want %q", host, body, "over tls")
+		}
+		if resp.TLS == nil || resp.TLS.PeerCertificates[0].Subject.CommonName != "app.customer-site.com" {
+			t.Errorf("Host %q: served the wrong certificate", host)
+		}
+		if resp.ProtoMajor != 2 {
+			t.Errorf("Host %q: Proto = %s, want HTTP/2", host, resp.Proto)
+		}
+	}
+}
+
+func TestTLSRefusesUnknownHost(t *testing.T) {
+	r := testsupport.StartTLSRelay(t, nil, nil)
+	r.Connect(t, "app.customer-site.com", localApp(t, "unused"))
+
+	// No certificate is issued for a hostname the relay doesn't serve, even
+	// with a tunnel connected for it
+	resp, err := r.TryGet("app.customer-site.com", "/")
+	if err == nil {
+		resp.Body.Close()
+		t.Fatal("GET succeeded for a hostname outside the TLS host policy")
+	}
+	if !strings.Contains(err.Error(), "tls") {
+		t.Errorf("error = %v, want a TLS handshake failure", err)
+	}
+}
+
+func TestTLSRequestLogs(t *testing.T) {
+	r := testsupport.StartTLSRelay(t, nil, nil)
+	r.TLS.AddDomain("app.customer-site.com")
+	addDomain(t, r, "app.customer-site.com")
+	r.Connect(t, "app.customer-site.com", localApp(t, "logged"))
+	readBody(t, r.Get(t, "app.customer-site.com", "/visit"))
+
+	// Request logs are written in the background
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		body := readBody(t, dashboard(t, r, "GET", "/api/dashboard/logs", nil))
+		if strings.Contains(body, `"tls_version":"TLS 1.3","alpn":"h2"`) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("logs = %s, want the visit logged with TLS 1.3 and h2", body)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestTLSPassthrough(t *testing.T) {
+	config := relay.DefaultServerConfig()
+	config.TLSPassthrough = true
+	r := testsupport.StartTLSRelay(t, config, nil)
+	const domain = "secure.customer-site.com"
+	addDomain(t, r, domain)
+
+	// The local server terminates TLS with a certificate the relay never sees
+	local := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(w, "end to end %s", req.URL.Path)
+	}))
+	t.Cleanup(local.Close)
+
+	c := client.New(local.Listener.Addr().String(), r.URL, r.Token, domain)
+	c.Passthrough = true
+	c.TLSConfig = &tls.Config{RootCAs: r.CA.CertPool()}
+	ready := make(chan struct{})
+	c.SetOnReady(func() { close(ready) })
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- c.Run(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	select {
+	case <-ready:
+	case err := <-done:
+		t.Fatalf("Run() error = %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for tunnel")
+	}
+	if w := c.Welcome(); w == nil || len(w.URLs) == 0 || w.URLs[0] != "https://"+domain+"/" {
+		t.Errorf("Welcome() = %+v, want https://%s/", w, domain)
+	}
+
+	relayAddr := strings.TrimPrefix(r.URL, "https://")
+	visitor := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return new(net.Dialer).DialContext(ctx, network, relayAddr)
+			},
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+		Timeout: 5 * time.Second,
+	}
+	for _, path := range []string{"/first", "/second"} {
+		resp, err := visitor.Get("https://" + domain + path)
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		if body := readBody(t, resp); body != "end to end "+path {
+			t.Errorf("GET %s body = %q, want %q", path, body, "end to end "+path)
+		}
+		if !resp.TLS.PeerCertificates[0].Equal(local.Certificate()) {
+			t.Errorf("GET %s was served the relay's certificate, want the local server's", path)
+		}
+	}
+
+	// Hostnames without a passthrough tunnel are still terminated by the relay
+	r.TLS.AddDomain("app.customer-site.com")
+	r.Connect(t, "app.customer-site.com", localApp(t, "terminated"))
+	if body := readBody(t, r.Get(t, "app.customer-site.com", "/")); body != "terminated" {
+		t.Errorf("body = %q, want %q", body, "terminated")
+	}
+
+	// A relay that doesn't offer passthrough turns the tunnel away
+	plain := testsupport.StartRelay(t, nil, nil)
+	other := client.New(local.Listener.Addr().String(), plain.URL, plain.Token, domain)
+	other.Passthrough = true
+	var connErr *client.ConnectError
+	if err := other.Connect(context.Background()); !errors.As(err, &connErr) || connErr.StatusCode != http.StatusBadRequest {
+		t.Errorf("Connect() to a relay without passthrough error = %v, want 400", err)
+	}
+}
+
+func TestShareOnce(t *testing.T) {
+	r := testsupport.StartRelay(t, nil, nil)
+	app := localApp(t, "preview")
+	const host = "k3vq7m2xwa4tc.share.customer-site.com"
+
+	c := client.New(app, r.URL, r.Token, host)
+	c.Share = tunnel.ShareLimits{MaxRequests: 2, TTL: time.Hour}
+	ready := make(chan struct{})
+	c.SetOnReady(func() { close(ready) })
+	done := make(chan error, 1)
+	go func() { done <- c.Run(context.Background()) }()
+	select {
+	case <-ready:
+	case err := <-done:
+		t.Fatalf("Run() error = %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for tunnel")
+	}
+
+	for i := range 2 {
+		if body := readBody(t, r.Get(t, host, "/")); body != "preview" {
+			t.Fatalf("request %d body = %q, want preview", i+1, body)
+		}
+	}
+
+	// The second request used the link up; the client is sent away for good
+	select {
+	case err := <-done:
+		var disconnect *client.DisconnectError
+		if !errors.As(err, &disconnect) || !disconnect.Until.IsZero() {
+			t.Errorf("Run() error = %v, want a disconnect for good", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("client still running after the share was retired")
+	}
+	if resp := r.Get(t, host, "/"); resp.StatusCode != http.StatusGone {
+		t.Errorf("status after retiring = %d, want %d", resp.StatusCode, http.StatusGone)
+	}
+
+	// Nobody can bring the hostname back
+	again := client.New(app, r.URL, r.Token, host)
+	again.Share = c.Share
+	var connErr *client.ConnectError
+	if err := again.Connect(context.Background()); !errors.As(err, &connErr) || connErr.StatusCode != http.StatusGone {
+		t.Errorf("Connect() to a retired share error = %v, want 410", err)
+	}
+}
+
+func TestCancelledRequest(t *testing.T) {
+	r := testsupport.StartRelay(t, nil, nil)
+	started := make(chan struct{})
+	stopped := make(chan error, 1)
+	app := testsupport.StartServer(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/slow" {
+			w.Write([]byte("fast"))
+			return
+		}
+		close(started)
+		select {
+		case <-req.Context().Done():
+			stopped <- req.Context().Err()
+		case <-time.After(5 * time.Second):
+			stopped <- nil
+		}
+	}))
+	r.Connect(t, "cancel.example.com", app.URL)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, "GET", r.URL+"/slow", nil)
+	req.Host = "cancel.example.com"
+	visitor := make(chan error, 1)
+	go func() {
+		resp, err := r.HTTPClient.Do(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		visitor <- err
+	}()
+	<-started
+
+	// The slow request doesn't hold up the ones behind it
+	if body := readBody(t, r.Get(t, "cancel.example.com", "/fast")); body != "fast" {
+		t.Errorf("body = %q, want fast", body)
+	}
+
+	// The visitor giving up cancels the local request
 	cancel()
+	<-visitor
+	select {
+	case err := <-stopped:
+		if err == nil {
+			t.Error("local request ran to completion, want it cancelled")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("local request still running")
+	}
 }
 
-func TestTunnelHandshake(t *testing.T) {
-	// Test that client can connect and register with relay
-	relayServer := relay.NewServer(nil)
-	relayHTTP := startTestServer(t, relayServer)
-	defer relayHTTP.Close()
+func TestTunnelsAPI(t *testing.T) {
+	r := testsupport.StartRelay(t, nil, nil)
+	primary := r.Connect(t, "main.example.com", localApp(t, "main"))
+	second := testsupport.StartServer(t, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Write([]byte("second"))
+	}))
+	secondPort := second.Listener.Addr().(*net.TCPAddr).Port
 
-	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
-	defer cancel()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	tunnels := client.NewTunnels(ctx, primary.Client, func(port int, domain string) (*client.Client, error) {
+		return client.New(fmt.Sprintf("http://127.0.0.1:%d", port), r.URL, r.Token, domain), nil
+	}, func(c *client.Client) string { return "http://" + c.Domain + "/" })
+	api := httptest.NewServer(tunnels)
+	t.Cleanup(api.Close)
 
-	tunnelClient := client.New("http://localhost:3000", relayHTTP.URL, "test-token", "myapp.example.com")
+	body := fmt.Sprintf(`{"port": %d, "domain": "second.example.com"}`, secondPort)
+	resp, err := http.Post(api.URL+"/api/tunnels", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("open tunnel: %v", err)
+	}
+	var opened client.TunnelInfo
+	json.NewDecoder(resp.Body).Decode(&opened)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated || !opened.Connected || opened.PublicURL != "http://second.example.com/" {
+		t.Fatalf("open = %d %+v, want a connected tunnel", resp.StatusCode, opened)
+	}
+	if got := readBody(t, r.Get(t, "second.example.com", "/")); got != "second" {
+		t.Errorf("second tunnel body = %q, want second", got)
+	}
+	if list := tunnels.List(); len(list) != 2 || !list[0].Primary || list[1].ID != opened.ID {
+		t.Errorf("List() = %+v, want the primary then the new tunnel", list)
+	}
 
-	// Connect should succeed (not return "not implemented")
-	err := tunnelClient.Connect(ctx)
+	req, _ := http.NewRequest("DELETE", api.URL+"/api/tunnels/"+opened.ID, nil)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("close tunnel = %v, %v, want 204", resp, err)
+	}
+	resp.Body.Close()
+	if list := tunnels.List(); len(list) != 1 {
+		t.Errorf("List() after close = %+v, want only the primary", list)
+	}
+	if got := readBody(t, r.Get(t, "main.example.com", "/")); got != "main" {
+		t.Errorf("primary tunnel body = %q, want main", got)
+	}
+}
+
+func TestFlowControl(t *testing.T) {
+	config := relay.DefaultServerConfig()
+	config.PendingQueueTTL = 300 * time.Millisecond
+	// Clients that take held bodies get large ones streamed, outside the
+	// window, so this relay sends every body in its request's frame
+	config.Features = slices.DeleteFunc(slices.Clone(tunnel.Features), func(f string) bool { return f == tunnel.FeatureContinue })
+	r := testsupport.StartRelay(t, config, nil)
+	started := make(chan struct{})
+	release := make(chan struct{})
+	app := testsupport.StartServer(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		n, _ := io.Copy(io.Discard, req.Body)
+		if req.URL.Path == "/slow" {
+			close(started)
+			<-release
+		}
+		fmt.Fprint(w, n)
+	}))
+	r.Connect(t, "window.example.com", app.URL)
+
+	post := func(path string, size int) (*http.Response, error) {
+		req, _ := http.NewRequest("POST", r.URL+path, strings.NewReader(strings.Repeat("x", size)))
+		req.Host = "window.example.com"
+		return r.HTTPClient.Do(req)
+	}
+
+	// A body the size of the whole window leaves no room until it's answered
+	slow := make(chan *http.Response, 1)
+	go func() {
+		resp, err := post("/slow", tunnel.DefaultWindow)
+		if err != nil {
+			t.Error(err)
+		}
+		slow <- resp
+	}()
+	<-started
+	resp := r.Get(t, "window.example.com", "/fast")
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("request to a saturated tunnel = %d, want %d with Retry-After", resp.StatusCode, http.StatusServiceUnavailable)
+	}
+	close(release)
+	if resp := <-slow; resp == nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("slow request = %v, want 200", resp)
+	}
+
+	// The client gives the room back, so more than a window's worth flows
+	for i := range 6 {
+		resp, err := post("/echo", 4<<20)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body := readBody(t, resp); body != fmt.Sprint(4<<20) {
+			t.Fatalf("request %d body = %q, want %d", i, body, 4<<20)
+		}
+	}
+}
+
+func TestChunkedResponses(t *testing.T) {
+	r := testsupport.StartRelay(t, nil, nil)
+	big := bytes.Repeat([]byte("0123456789abcdef"), 2<<20) // 32MB, more than the socket buffers hold
+	app := testsupport.StartServer(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/big" {
+			w.Write(big)
+			return
+		}
+		w.Write([]byte("fast"))
+	}))
+	r.Connect(t, "chunked.example.com", app.URL)
+
+	// A visitor that stops reading a large response holds up only its own
+	conn, err := net.Dial("tcp", strings.TrimPrefix(r.URL, "http://"))
 	if err != nil {
-		t.Fatalf("Connect() failed: %v", err)
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "GET /big HTTP/1.1\r\nHost: chunked.example.com\r\nConnection: close\r\n\r\n")
+	time.Sleep(100 * time.Millisecond)
+	for i := range 3 {
+		if body := readBody(t, r.Get(t, "chunked.example.com", "/fast")); body != "fast" {
+			t.Fatalf("request %d body = %q, want fast", i, body)
+		}
 	}
 
-	// Verify tunnel is registered
-	if !relayServer.HasTunnel("myapp.example.com") {
-		t.Error("tunnel not registered after Connect()")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(resp.Body)
+	if err != nil || !bytes.Equal(got, big) {
+		t.Errorf("large response = %d bytes, %v, want all %d", len(got), err, len(big))
+	}
+}
+
+func TestTrailers(t *testing.T) {
+	r := testsupport.StartRelay(t, nil, nil)
+
+	// The local server speaks HTTP/1.1 and, for gRPC, HTTP/2 without TLS
+	app := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		w.Write([]byte("reply"))
+		if req.ProtoMajor == 2 && req.Header.Get("Te") == "trailers" {
+			w.Header().Set("Grpc-Status", "0")
+		} else {
+			w.Header().Set("Grpc-Status", "12")
+			w.Header().Set("Grpc-Message", req.Proto+" without TE: trailers")
+		}
+	}))
+	app.Config.Protocols = new(http.Protocols)
+	app.Config.Protocols.SetHTTP1(true)
+	app.Config.Protocols.SetUnencryptedHTTP2(true)
+	app.Start()
+	t.Cleanup(app.Close)
+	r.Connect(t, "grpc.example.com", app.URL)
+
+	tests := []struct {
+		contentType string
+		want        http.Header
+	}{
+		{"application/grpc", http.Header{"Grpc-Status": {"0"}}},
+		{"text/plain", http.Header{"Grpc-Status": {"12"}, "Grpc-Message": {"HTTP/1.1 without TE: trailers"}}},
+	}
+	for _, tt := range tests {
+		req, err := http.NewRequest("POST", r.URL+"/pkg.Service/Call", strings.NewReader("call"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = "grpc.example.com"
+		req.Header.Set("Content-Type", tt.contentType)
+		resp, err := r.HTTPClient.Do(req)
+		if err != nil {
+			t.Fatalf("POST %s: %v", tt.contentType, err)
+		}
+		if body := readBody(t, resp); body != "reply" {
+			t.Errorf("%s body = %q, want reply", tt.contentType, body)
+		}
+		resp.Body.Close()
+		if !reflect.DeepEqual(resp.Trailer, tt.want) {
+			t.Errorf("%s trailers = %v, want %v", tt.contentType, resp.Trailer, tt.want)
+		}
 	}
 }
 
-func startTestServer(t *testing.T, handler http.Handler) *httptest.Server {
+// switchProxy forwards TCP connections to whichever address it's pointed
+// at, standing in for a load balancer in front of relays
+type switchProxy struct {
+	net.Listener
+	target atomic.Value // host:port
+}
+
+func startSwitchProxy(t *testing.T, target string) *switchProxy {
 	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("listen: %v", err)
+	}
+	p := &switchProxy{Listener: ln}
+	p.target.Store(target)
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				upstream, err := net.Dial("tcp", p.target.Load().(string))
+				if err != nil {
+					return
+				}
+				defer upstream.Close()
+				go func() {
+					io.Copy(upstream, conn)
+					upstream.Close()
+				}()
+				io.Copy(conn, upstream)
+			}()
+		}
+	}()
+	return p
+}
 
+func TestRelayDrain(t *testing.T) {
+	old := testsupport.StartRelay(t, nil, nil)
+	next := testsupport.StartRelay(t, nil, nil)
+	lb := startSwitchProxy(t, strings.TrimPrefix(old.URL, "http://"))
+
+	app := testsupport.StartServer(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/slow" {
+			time.Sleep(300 * time.Millisecond)
+		}
+		fmt.Fprintf(w, "served %s", req.URL.Path)
+	}))
+
+	const domain = "drain.example.com"
+	c := client.New(app.URL, "http://"+lb.Addr().String(), old.Token, domain)
+	ready := make(chan struct{})
+	c.SetOnReady(func() { close(ready) })
+	resumed := make(chan string, 1)
+	c.SetOnResume(func(reason string) { resumed <- reason })
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- c.Run(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	select {
+	case <-ready:
+	case err := <-done:
+		t.Fatalf("Run() error = %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for tunnel")
+	}
+
+	// A request in flight on the old relay finishes while the tunnel moves
+	slow := make(chan string, 1)
+	go func() { slow <- readBody(t, old.Get(t, domain, "/slow")) }()
+	time.Sleep(50 * time.Millisecond)
+	lb.target.Store(strings.TrimPrefix(next.URL, "http://"))
+	drainCtx, drainCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer drainCancel()
+	if err := old.Drain(drainCtx); err != nil {
+		t.Fatalf("Drain() error = %v, want the tunnel moved", err)
+	}
+
+	if body := <-slow; body != "served /slow" {
+		t.Errorf("in-flight request body = %q, want it served", body)
+	}
+	select {
+	case reason := <-resumed:
+		if reason != "relay restart" {
+			t.Errorf("resumed after %q, want relay restart", reason)
+		}
+	case <-time.After(time.Second):
+		t.Error("client never resumed on the next relay")
+	}
+	if body := readBody(t, next.Get(t, domain, "/")); body != "served /" {
+		t.Errorf("next relay body = %q, want the tunnel there", body)
+	}
+
+	// The draining relay sends new tunnels elsewhere
+	other := client.New(app.URL, old.URL, old.Token, "other.example.com")
+	var connErr *client.ConnectError
+	if err := other.Connect(context.Background()); !errors.As(err, &connErr) || connErr.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Connect() to a draining relay error = %v, want 503", err)
+	}
+}
+
+// startUpgradeOnlyProxy forwards connections to target, except for those
+// opening with a plain POST, which it cuts, as corporate proxies that only
+// let WebSockets hold a connection open do
+func startUpgradeOnlyProxy(t *testing.T, target string) string {
+	t.Helper()
 	ln, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
-		if strings.Contains(err.Error(), "operation not permitted") {
-			t.Skipf("skipping test server start: %v", err)
+		t.Skipf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				line, err := br.ReadString('\n')
+				if err != nil || strings.HasPrefix(line, "POST ") {
+					return
+				}
+				upstream, err := net.Dial("tcp", target)
+				if err != nil {
+					return
+				}
+				defer upstream.Close()
+				go func() {
+					io.Copy(upstream, io.MultiReader(strings.NewReader(line), br))
+					upstream.Close()
+				}()
+				io.Copy(conn, upstream)
+			}()
+		}
+	}()
+	return "http://" + ln.Addr().String()
+}
+
+func TestWebSocketTransport(t *testing.T) {
+	r := testsupport.StartRelay(t, nil, nil)
+	proxy := startUpgradeOnlyProxy(t, strings.TrimPrefix(r.URL, "http://"))
+	app := testsupport.StartServer(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		fmt.Fprintf(w, "%s %d", req.URL.Path, len(body))
+	}))
+
+	// Told to stick to TCP, the client can't get through
+	const domain = "ws.example.com"
+	tcp := client.New(app.URL, proxy, r.Token, domain)
+	tcp.Transport = tunnel.TransportTCP
+	if err := tcp.Connect(context.Background()); err == nil {
+		t.Fatal("Connect() over TCP through the proxy succeeded, want it cut")
+	}
+
+	// Left to choose, it falls back to a WebSocket
+	c := client.New(app.URL, proxy, r.Token, domain)
+	ready := make(chan struct{})
+	c.SetOnReady(func() { close(ready) })
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- c.Run(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	select {
+	case <-ready:
+	case err := <-done:
+		t.Fatalf("Run() error = %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for tunnel")
+	}
+	if !c.OverWebSocket() {
+		t.Error("OverWebSocket() = false, want the fallback used")
+	}
+
+	if body := readBody(t, r.Get(t, domain, "/small")); body != "/small 0" {
+		t.Errorf("body = %q, want %q", body, "/small 0")
+	}
+	big := strings.Repeat("x", 200_000)
+	req, _ := http.NewRequest(http.MethodPost, r.URL+"/big", strings.NewReader(big))
+	req.Host = domain
+	resp, err := r.HTTPClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := readBody(t, resp); body != "/big 200000" {
+		t.Errorf("body = %q, want %q", body, "/big 200000")
+	}
+}
+
+func TestQUICTransport(t *testing.T) {
+	r := testsupport.StartTLSRelay(t, nil, nil)
+	r.ServeQUIC(t)
+	const domain = "quic.example.com"
+	r.TLS.AddDomain(domain)
+	app := testsupport.StartServer(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		fmt.Fprintf(w, "%s %d", req.URL.Path, len(body))
+	}))
+
+	c := client.New(app.URL, r.URL, r.Token, domain)
+	c.TLSConfig = &tls.Config{RootCAs: r.CA.CertPool()}
+	c.Transport = tunnel.TransportQUIC
+	ready := make(chan struct{})
+	c.SetOnReady(func() { close(ready) })
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- c.Run(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	select {
+	case <-ready:
+	case err := <-done:
+		t.Fatalf("Run() error = %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for tunnel")
+	}
+	if meta := r.GetTunnel(domain).Meta; meta.Transport != tunnel.TransportQUIC || meta.TLSVersion != "TLS 1.3" {
+		t.Errorf("tunnel Meta = %+v, want TLS 1.3 over QUIC", meta)
+	}
+
+	if body := readBody(t, r.Get(t, domain, "/small")); body != "/small 0" {
+		t.Errorf("body = %q, want %q", body, "/small 0")
+	}
+	big := strings.Repeat("x", 3<<20)
+	req, _ := http.NewRequest(http.MethodPost, "https://"+domain+"/big", strings.NewReader(big))
+	resp, err := r.HTTPClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := readBody(t, resp); body != "/big 3145728" {
+		t.Errorf("body = %q, want %q", body, "/big 3145728")
+	}
+}
+
+func TestExpectContinue(t *testing.T) {
+	r := testsupport.StartRelay(t, nil, nil)
+	app := testsupport.StartServer(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// Turned down before the body is read, so nobody sends it
+		if req.Header.Get("Authorization") == "" {
+			http.Error(w, "sign in first", http.StatusUnauthorized)
+			return
 		}
-		t.Fatalf("listen error: %v", err)
+		body, _ := io.ReadAll(req.Body)
+		fmt.Fprintf(w, "got %d bytes", len(body))
+	}))
+	r.Connect(t, "continue.example.com", app.URL)
+
+	body := strings.Repeat("x", 1<<20) // more than a stream's window
+	tests := []struct {
+		name          string
+		header        string
+		wantContinue  bool
+		wantStatus    int
+		wantBodyStart string
+	}{
+		{"turned down", "", false, http.StatusUnauthorized, "sign in first"},
+		{"accepted", "Authorization: Bearer token\r\n", true, http.StatusOK, "got 1048576 bytes"},
 	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", strings.TrimPrefix(r.URL, "http://"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(10 * time.Second))
+			fmt.Fprintf(conn, "PUT /upload HTTP/1.1\r\nHost: continue.example.com\r\nContent-Length: %d\r\nExpect: 100-continue\r\n%s\r\n", len(body), tt.header)
+			br := bufio.NewReader(conn)
+			resp, err := http.ReadResponse(br, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			continued := resp.StatusCode == http.StatusContinue
+			if continued {
+				io.WriteString(conn, body)
+				if resp, err = http.ReadResponse(br, nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if continued != tt.wantContinue {
+				t.Errorf("told to send the body = %v, want %v", continued, tt.wantContinue)
+			}
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if got := readBody(t, resp); !strings.HasPrefix(got, tt.wantBodyStart) {
+				t.Errorf("body = %q, want it to start %q", got, tt.wantBodyStart)
+			}
+		})
+	}
+}
 
-	srv := httptest.NewUnstartedServer(handler)
-	srv.Listener = ln
-	srv.Start()
-	return srv
+func TestStreamedUploads(t *testing.T) {
+	r := testsupport.StartRelay(t, nil, nil)
+	started := make(chan struct{})
+	release := make(chan struct{})
+	app := testsupport.StartServer(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/upload" {
+			// Read a little, then stall with the rest of the upload unsent
+			io.ReadFull(req.Body, make([]byte, 1024))
+			close(started)
+			<-release
+		}
+		n, _ := io.Copy(io.Discard, req.Body)
+		fmt.Fprint(w, n)
+	}))
+	r.Connect(t, "upload.example.com", app.URL)
+	released := false
+	defer func() {
+		if !released {
+			close(release)
+		}
+	}()
+
+	// A request stuck behind the upload fails rather than waits for it
+	client := &http.Client{Timeout: 10 * time.Second}
+	post := func(path string, body io.Reader) (*http.Response, error) {
+		req, _ := http.NewRequest("POST", r.URL+path, body)
+		req.Host = "upload.example.com"
+		return client.Do(req)
+	}
+
+	// An upload larger than the whole window goes in chunks as the local
+	// server reads it, so other requests get through while it stalls
+	big := bytes.Repeat([]byte("x"), 2*tunnel.DefaultWindow)
+	uploaded := make(chan *http.Response, 1)
+	go func() {
+		resp, err := post("/upload", bytes.NewReader(big))
+		if err != nil {
+			t.Error(err)
+		}
+		uploaded <- resp
+	}()
+	select {
+	case <-started:
+	case resp := <-uploaded:
+		t.Fatalf("upload answered %v before the local server read it", resp)
+	case <-time.After(10 * time.Second):
+		t.Fatal("upload never reached the local server")
+	}
+	for i := range 3 {
+		resp, err := post("/small", strings.NewReader("hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body := readBody(t, resp); body != "5" {
+			t.Fatalf("request %d body = %q, want 5", i, body)
+		}
+	}
+
+	close(release)
+	released = true
+	resp := <-uploaded
+	if resp == nil {
+		t.Fatal("upload failed")
+	}
+	if body := readBody(t, resp); body != fmt.Sprint(len(big)-1024) {
+		t.Errorf("upload body = %q, want the remaining %d bytes read", body, len(big)-1024)
+	}
+
+	// A body of unknown length streams too
+	resp, err := post("/small", io.MultiReader(strings.NewReader("chunked "), strings.NewReader("upload")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := readBody(t, resp); body != "14" {
+		t.Errorf("chunked upload body = %q, want 14", body)
+	}
+}
+
+func TestHeadThroughTunnel(t *testing.T) {
+	r := testsupport.StartRelay(t, nil, nil)
+	app := testsupport.StartServer(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Length", "1234")
+		if req.Method != http.MethodHead {
+			w.Write(bytes.Repeat([]byte("x"), 1234))
+		}
+	}))
+	r.Connect(t, "head.example.com", app.URL)
+
+	req, _ := http.NewRequest(http.MethodHead, r.URL+"/file", nil)
+	req.Host = "head.example.com"
+	resp, err := r.HTTPClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.ContentLength != 1234 {
+		t.Errorf("HEAD = %d with length %d, want 200 with the GET's 1234", resp.StatusCode, resp.ContentLength)
+	}
 }
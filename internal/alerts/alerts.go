@@ -0,0 +1,195 @@
+// internal/alerts/alerts.go
+package alerts
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/lobber-dev/lobber/internal/notify"
+	"github.com/lobber-dev/lobber/internal/publicnet"
+	"github.com/lobber-dev/lobber/internal/store"
+)
+
+// Channels a usage alert can be delivered on
+const (
+	ChannelEmail   = "email"
+	ChannelWebhook = "webhook"
+	ChannelSlack   = "slack"
+)
+
+const (
+	// MaxPerUser caps how many alerts one user can set
+	MaxPerUser = 10
+
+	// MinThreshold is the smallest threshold accepted, 1 MB
+	MinThreshold int64 = 1024 * 1024
+
+	maxTargetLength = 2048
+	deliveryTimeout = 10 * time.Second
+)
+
+// ErrInvalid is wrapped by Validate errors
+var ErrInvalid = errors.New("invalid alert")
+
+// Validate checks an alert before it is saved
+func Validate(a store.UsageAlert) error {
+	if a.ThresholdBytes < MinThreshold {
+		return fmt.Errorf("%w: threshold must be at least 1 MB", ErrInvalid)
+	}
+
+	switch a.Channel {
+	case ChannelEmail:
+		if a.Target != "" {
+			return fmt.Errorf("%w: email alerts go to the account address", ErrInvalid)
+		}
+		return nil
+	case ChannelWebhook, ChannelSlack:
+	default:
+		return fmt.Errorf("%w: channel must be email, webhook or slack", ErrInvalid)
+	}
+
+	if len(a.Target) > maxTargetLength {
+		return fmt.Errorf("%w: URL is too long", ErrInvalid)
+	}
+	u, err := url.Parse(a.Target)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("%w: %s URL must be an https:// link", ErrInvalid, a.Channel)
+	}
+	if a.Channel == ChannelSlack && u.Host != "hooks.slack.com" {
+		return fmt.Errorf("%w: Slack URL must be an incoming webhook on hooks.slack.com", ErrInvalid)
+	}
+	if addr, err := netip.ParseAddr(u.Hostname()); err == nil && !publicnet.Public(addr) {
+		return fmt.Errorf("%w: %s URL must be a public host", ErrInvalid, a.Channel)
+	}
+	return nil
+}
+
+// Dispatcher fires usage alerts once their threshold is reached
+type Dispatcher struct {
+	alerts   store.AlertStore
+	notifier notify.Notifier
+	client   *http.Client
+	baseURL  string
+}
+
+// NewDispatcher creates a dispatcher. Email alerts are logged when notifier
+// is nil, and link to the dashboard at baseURL, e.g. https://lobber.dev.
+// Webhooks are only posted to public addresses.
+func NewDispatcher(alerts store.AlertStore, notifier notify.Notifier, baseURL string) *Dispatcher {
+	if notifier == nil {
+		notifier = notify.LogNotifier{}
+	}
+	return &Dispatcher{
+		alerts:   alerts,
+		notifier: notifier,
+		client:   publicnet.Client(deliveryTimeout),
+		baseURL:  strings.TrimSuffix(baseURL, "/"),
+	}
+}
+
+// Run fires every due alert and returns how many were delivered. An alert is
+// marked fired before it is sent so relays sharing a database only send it
+// once; a failed delivery is logged and not retried until next month.
+func (d *Dispatcher) Run(ctx context.Context) (int, error) {
+	due, err := d.alerts.DueAlerts(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	for _, a := range due {
+		claimed, err := d.alerts.MarkAlertFired(ctx, a.ID)
+		if err != nil {
+			return sent, err
+		}
+		if !claimed {
+			continue
+		}
+		if err := d.deliver(ctx, a); err != nil {
+			log.Printf("usage alert %s for user %s: %v", a.ID, a.UserID, err)
+			continue
+		}
+		sent++
+	}
+	return sent, nil
+}
+
+// payload is the JSON body posted to webhook alerts
+type payload struct {
+	Event          string    `json:"event"`
+	AlertID        string    `json:"alert_id"`
+	ThresholdBytes int64     `json:"threshold_bytes"`
+	UsedBytes      int64     `json:"used_bytes"`
+	FiredAt        time.Time `json:"fired_at"`
+}
+
+func (d *Dispatcher) deliver(ctx context.Context, a store.DueAlert) error {
+	text := fmt.Sprintf("Your Lobber tunnels have used %s of bandwidth this month, passing your %s alert.",
+		formatBytes(a.UsedBytes), formatBytes(a.ThresholdBytes))
+
+	switch a.Channel {
+	case ChannelEmail:
+		body := text + "\n"
+		if d.baseURL != "" {
+			body += "\nManage your alerts at " + d.baseURL + "/dashboard/account\n"
+		}
+		return d.notifier.Send(ctx, &notify.Message{
+			To:      a.Email,
+			Subject: "Lobber usage alert: " + formatBytes(a.ThresholdBytes) + " reached",
+			Body:    body,
+		})
+	case ChannelSlack:
+		return d.post(ctx, a.Target, map[string]string{"text": text})
+	case ChannelWebhook:
+		return d.post(ctx, a.Target, payload{
+			Event:          "usage.threshold_reached",
+			AlertID:        a.ID,
+			ThresholdBytes: a.ThresholdBytes,
+			UsedBytes:      a.UsedBytes,
+			FiredAt:        time.Now().UTC(),
+		})
+	}
+	return fmt.Errorf("unknown channel %q", a.Channel)
+}
+
+// post sends body as JSON, treating any non-2xx response as a failure
+func (d *Dispatcher) post(ctx context.Context, target string, body any) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("marshal alert: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("post alert: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Lobber-Alerts/1.0")
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("post alert: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("post alert: %s returned %d", req.URL.Host, resp.StatusCode)
+	}
+	return nil
+}
+
+// formatBytes renders a byte count in MB below 1 GB and in GB above, e.g. "2.00 GB"
+func formatBytes(n int64) string {
+	const mb, gb = 1024 * 1024, 1024 * 1024 * 1024
+	if n < gb {
+		return fmt.Sprintf("%.0f MB", float64(n)/mb)
+	}
+	return fmt.Sprintf("%.2f GB", float64(n)/gb)
+}
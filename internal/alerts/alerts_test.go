@@ -0,0 +1,137 @@
+package alerts
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/lobber-dev/lobber/internal/notify"
+	"github.com/lobber-dev/lobber/internal/store"
+)
+
+func TestValidate(t *testing.T) {
+	const gb = 1024 * 1024 * 1024
+	tests := []struct {
+		name    string
+		alert   store.UsageAlert
+		wantErr bool
+	}{
+		{"email", store.UsageAlert{ThresholdBytes: 2 * gb, Channel: ChannelEmail}, false},
+		{"email with target", store.UsageAlert{ThresholdBytes: 2 * gb, Channel: ChannelEmail, Target: "a@example.com"}, true},
+		{"webhook", store.UsageAlert{ThresholdBytes: gb, Channel: ChannelWebhook, Target: "https://example.com/hook"}, false},
+		{"plain http webhook", store.UsageAlert{ThresholdBytes: gb, Channel: ChannelWebhook, Target: "http://example.com/hook"}, true},
+		{"slack", store.UsageAlert{ThresholdBytes: gb, Channel: ChannelSlack, Target: "https://hooks.slack.com/services/T0/B0/x"}, false},
+		{"slack elsewhere", store.UsageAlert{ThresholdBytes: gb, Channel: ChannelSlack, Target: "https://example.com/services/x"}, true},
+		{"private webhook", store.UsageAlert{ThresholdBytes: gb, Channel: ChannelWebhook, Target: "https://10.0.0.5/hook"}, true},
+		{"metadata webhook", store.UsageAlert{ThresholdBytes: gb, Channel: ChannelWebhook, Target: "https://[::ffff:169.254.169.254]/"}, true},
+		{"tiny threshold", store.UsageAlert{ThresholdBytes: 10, Channel: ChannelEmail}, true},
+		{"unknown channel", store.UsageAlert{ThresholdBytes: gb, Channel: "sms"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Validate(tt.alert)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrInvalid) {
+				t.Errorf("Validate() error = %v, want ErrInvalid", err)
+			}
+		})
+	}
+}
+
+type recordingNotifier struct {
+	mu   sync.Mutex
+	sent []*notify.Message
+}
+
+func (n *recordingNotifier) Send(ctx context.Context, msg *notify.Message) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.sent = append(n.sent, msg)
+	return nil
+}
+
+func TestDispatcherRun(t *testing.T) {
+	ctx := context.Background()
+	mem := store.NewMemory()
+	mem.AddUser(store.User{ID: "u1", Email: "dev@example.com"})
+
+	var hooks []payload
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var p payload
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			t.Errorf("decode webhook: %v", err)
+		}
+		hooks = append(hooks, p)
+	}))
+	defer srv.Close()
+
+	for _, a := range []store.UsageAlert{
+		{UserID: "u1", ThresholdBytes: 2 * MinThreshold, Channel: ChannelEmail},
+		{UserID: "u1", ThresholdBytes: 3 * MinThreshold, Channel: ChannelWebhook, Target: srv.URL},
+		{UserID: "u1", ThresholdBytes: 100 * MinThreshold, Channel: ChannelEmail},
+	} {
+		if _, err := mem.CreateAlert(ctx, a); err != nil {
+			t.Fatalf("CreateAlert() error = %v", err)
+		}
+	}
+	mem.RecordBandwidth(ctx, "u1", "", 4*MinThreshold, 0)
+
+	notifier := &recordingNotifier{}
+	d := NewDispatcher(mem, notifier, "https://relay.example.com/")
+	d.client = srv.Client()
+
+	sent, err := d.Run(ctx)
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if sent != 2 {
+		t.Errorf("Run() sent %d, want the 2 alerts under 4 MB", sent)
+	}
+	if len(notifier.sent) != 1 || notifier.sent[0].To != "dev@example.com" || !strings.Contains(notifier.sent[0].Body, "4 MB") {
+		t.Errorf("emails = %+v, want one to dev@example.com mentioning 4 MB", notifier.sent)
+	} else if !strings.Contains(notifier.sent[0].Body, "https://relay.example.com/dashboard/account") {
+		t.Errorf("email body = %q, want a link to this relay's dashboard", notifier.sent[0].Body)
+	}
+	if len(hooks) != 1 || hooks[0].Event != "usage.threshold_reached" || hooks[0].UsedBytes != 4*MinThreshold {
+		t.Errorf("webhooks = %+v, want one threshold_reached with 4 MB used", hooks)
+	}
+
+	// Each alert fires once a month
+	if sent, _ := d.Run(ctx); sent != 0 {
+		t.Errorf("second Run() sent %d, want 0", sent)
+	}
+}
+
+func TestDispatcherRefusesPrivateHosts(t *testing.T) {
+	ctx := context.Background()
+	mem := store.NewMemory()
+	mem.AddUser(store.User{ID: "u1", Email: "dev@example.com"})
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("webhook reached a private address")
+	}))
+	defer srv.Close()
+
+	// localhost passes Validate as a name, so only the dial can refuse it
+	_, port, _ := strings.Cut(srv.Listener.Addr().String(), ":")
+	a := store.UsageAlert{UserID: "u1", ThresholdBytes: MinThreshold, Channel: ChannelWebhook, Target: "https://localhost:" + port + "/hook"}
+	if err := Validate(a); err != nil {
+		t.Fatalf("Validate() error = %v", err)
+	}
+	if _, err := mem.CreateAlert(ctx, a); err != nil {
+		t.Fatalf("CreateAlert() error = %v", err)
+	}
+	mem.RecordBandwidth(ctx, "u1", "", 2*MinThreshold, 0)
+
+	if sent, err := NewDispatcher(mem, nil, "").Run(ctx); err != nil || sent != 0 {
+		t.Errorf("Run() = %d, %v, want the webhook refused", sent, err)
+	}
+}
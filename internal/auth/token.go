@@ -2,6 +2,7 @@ package auth
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
 
 	"golang.org/x/crypto/bcrypt"
@@ -32,3 +33,10 @@ func ValidateAPIToken(plaintext, hash string) bool {
 	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(plaintext))
 	return err == nil
 }
+
+// HashToken returns the SHA256 hex digest used to look up dashboard-issued
+// tokens and sessions, which must be found by hash rather than compared one by one
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -68,3 +68,11 @@ func TestGenerateAPITokenUniqueness(t *testing.T) {
 		tokens[plaintext] = true
 	}
 }
+
+func TestHashToken(t *testing.T) {
+	// echo -n lb_test | sha256sum
+	want := "3d469e324ee8a7f5b2e8387cf3b1ec5f2dcc2651b0ec9589f7d06de0fb873c11"
+	if got := HashToken("lb_test"); got != want {
+		t.Errorf("HashToken() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,237 @@
+// internal/billing/audit.go
+package billing
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lobber-dev/lobber/internal/db"
+)
+
+// ErrNoAuditKey is returned when usage can't be sealed because no signing key is set
+var ErrNoAuditKey = errors.New("usage audit key not configured")
+
+// UsageAuditDay is what one domain served on one UTC day, sealed once the
+// day was over
+type UsageAuditDay struct {
+	Day           time.Time `json:"day"`
+	Domain        string    `json:"domain"` // empty for bandwidth recorded without a tunnel session
+	BytesIn       int64     `json:"bytes_in"`
+	BytesOut      int64     `json:"bytes_out"`
+	ReportedBytes int64     `json:"reported_bytes"` // already reported to Stripe when the day was sealed
+	SealedAt      time.Time `json:"sealed_at"`
+	Verified      bool      `json:"verified"` // the row still matches its signature
+}
+
+// UsageReport is a usage record sent to Stripe
+type UsageReport struct {
+	ID                 string    `json:"id"`
+	SubscriptionItemID string    `json:"subscription_item_id"`
+	Bytes              int64     `json:"bytes"`
+	Quantity           int64     `json:"quantity"` // billed MB
+	ReportedAt         time.Time `json:"reported_at"`
+	Verified           bool      `json:"verified"`
+}
+
+// UsageAudit breaks a user's served bytes down by day and domain next to
+// what was reported to Stripe, for answering billing disputes
+type UsageAudit struct {
+	UserID        string          `json:"user_id"`
+	From          time.Time       `json:"from"`
+	To            time.Time       `json:"to"`
+	Days          []UsageAuditDay `json:"days"`
+	Reports       []UsageReport   `json:"reports"`
+	TotalBytes    int64           `json:"total_bytes"`    // sum of Days
+	ReportedBytes int64           `json:"reported_bytes"` // sum of Reports
+	Unverified    int             `json:"unverified"`     // rows whose signature doesn't match
+}
+
+// SetAuditKey sets the key daily usage rollups and Stripe reports are signed with
+func (s *Service) SetAuditKey(key []byte) {
+	s.auditKey = key
+}
+
+// sign returns the HMAC of fields under the audit key, or "" without a key
+func (s *Service) sign(fields ...string) string {
+	if len(s.auditKey) == 0 {
+		return ""
+	}
+	mac := hmac.New(sha256.New, s.auditKey)
+	mac.Write([]byte(strings.Join(fields, "|")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verify reports whether sig is the signature of fields
+func (s *Service) verify(sig string, fields ...string) bool {
+	expected := s.sign(fields...)
+	return expected != "" && hmac.Equal([]byte(sig), []byte(expected))
+}
+
+func dayFields(userID string, d UsageAuditDay) []string {
+	return []string{
+		"day", userID, d.Day.Format(time.DateOnly), d.Domain,
+		strconv.FormatInt(d.BytesIn, 10), strconv.FormatInt(d.BytesOut, 10), strconv.FormatInt(d.ReportedBytes, 10),
+	}
+}
+
+func reportFields(userID string, r UsageReport) []string {
+	return []string{
+		"report", userID, r.SubscriptionItemID,
+		strconv.FormatInt(r.Bytes, 10), strconv.FormatInt(r.Quantity, 10), r.ReportedAt.UTC().Format(time.RFC3339),
+	}
+}
+
+// SealUsage rolls up bandwidth for every closed UTC day that hasn't been
+// sealed yet into signed per-domain rows, and returns how many it wrote.
+// Bandwidth is recorded as it's served, so a past day never changes.
+func (s *Service) SealUsage(ctx context.Context) (int, error) {
+	if len(s.auditKey) == 0 {
+		return 0, ErrNoAuditKey
+	}
+	if s.db == nil {
+		return 0, nil
+	}
+
+	ctx, done := db.Timed(ctx, "billing.SealUsage")
+	defer done()
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT bu.user_id, (bu.recorded_at AT TIME ZONE 'UTC')::date, COALESCE(d.hostname, ''),
+			SUM(bu.bytes_in), SUM(bu.bytes_out),
+			COALESCE(SUM(bu.bytes_in + bu.bytes_out) FILTER (WHERE bu.synced_to_stripe), 0)
+		FROM bandwidth_usage bu
+		LEFT JOIN tunnel_sessions ts ON ts.id = bu.tunnel_session_id
+		LEFT JOIN domains d ON d.id = ts.domain_id
+		WHERE bu.recorded_at < date_trunc('day', NOW() AT TIME ZONE 'UTC') AT TIME ZONE 'UTC'
+		AND NOT EXISTS (
+			SELECT 1 FROM usage_audit a
+			WHERE a.user_id = bu.user_id AND a.day = (bu.recorded_at AT TIME ZONE 'UTC')::date
+		)
+		GROUP BY 1, 2, 3
+	`)
+	if err != nil {
+		return 0, fmt.Errorf("query unsealed usage: %w", err)
+	}
+
+	type sealRow struct {
+		userID string
+		day    UsageAuditDay
+	}
+	var pending []sealRow
+	for rows.Next() {
+		var r sealRow
+		if err := rows.Scan(&r.userID, &r.day.Day, &r.day.Domain, &r.day.BytesIn, &r.day.BytesOut, &r.day.ReportedBytes); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("scan row: %w", err)
+		}
+		pending = append(pending, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("query unsealed usage: %w", err)
+	}
+	if len(pending) == 0 {
+		return 0, nil
+	}
+
+	// A day is sealed for all of a user's domains at once or not at all
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+	for _, r := range pending {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO usage_audit (day, user_id, hostname, bytes_in, bytes_out, reported_bytes, signature)
+			VALUES ($1, $2, $3, $4, $5, $6, $7)
+			ON CONFLICT DO NOTHING
+		`, r.day.Day.Format(time.DateOnly), r.userID, r.day.Domain, r.day.BytesIn, r.day.BytesOut, r.day.ReportedBytes,
+			s.sign(dayFields(r.userID, r.day)...))
+		if err != nil {
+			return 0, fmt.Errorf("seal usage: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("commit: %w", err)
+	}
+	return len(pending), nil
+}
+
+// UsageAudit returns the sealed days from one UTC date to another,
+// inclusive, and the Stripe reports sent over the same dates
+func (s *Service) UsageAudit(ctx context.Context, userID string, from, to time.Time) (*UsageAudit, error) {
+	audit := &UsageAudit{UserID: userID, From: from, To: to, Days: []UsageAuditDay{}, Reports: []UsageReport{}}
+	if s.db == nil {
+		return audit, nil
+	}
+
+	ctx, done := db.Timed(ctx, "billing.UsageAudit")
+	defer done()
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT day, hostname, bytes_in, bytes_out, reported_bytes, signature, sealed_at
+		FROM usage_audit
+		WHERE user_id = $1 AND day >= $2 AND day <= $3
+		ORDER BY day, hostname
+	`, userID, from.Format(time.DateOnly), to.Format(time.DateOnly))
+	if err != nil {
+		return nil, fmt.Errorf("query usage audit: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var d UsageAuditDay
+		var sig string
+		if err := rows.Scan(&d.Day, &d.Domain, &d.BytesIn, &d.BytesOut, &d.ReportedBytes, &sig, &d.SealedAt); err != nil {
+			return nil, fmt.Errorf("scan row: %w", err)
+		}
+		d.Verified = s.verify(sig, dayFields(userID, d)...)
+		audit.add(d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("query usage audit: %w", err)
+	}
+
+	reports, err := s.db.QueryContext(ctx, `
+		SELECT id, subscription_item_id, bytes, quantity, signature, reported_at
+		FROM usage_reports
+		WHERE user_id = $1 AND reported_at >= $2 AND reported_at < $3
+		ORDER BY reported_at
+	`, userID, from, to.AddDate(0, 0, 1))
+	if err != nil {
+		return nil, fmt.Errorf("query usage reports: %w", err)
+	}
+	defer reports.Close()
+	for reports.Next() {
+		var r UsageReport
+		var sig string
+		if err := reports.Scan(&r.ID, &r.SubscriptionItemID, &r.Bytes, &r.Quantity, &sig, &r.ReportedAt); err != nil {
+			return nil, fmt.Errorf("scan row: %w", err)
+		}
+		r.Verified = s.verify(sig, reportFields(userID, r)...)
+		audit.addReport(r)
+	}
+	return audit, reports.Err()
+}
+
+func (a *UsageAudit) add(d UsageAuditDay) {
+	a.Days = append(a.Days, d)
+	a.TotalBytes += d.BytesIn + d.BytesOut
+	if !d.Verified {
+		a.Unverified++
+	}
+}
+
+func (a *UsageAudit) addReport(r UsageReport) {
+	a.Reports = append(a.Reports, r)
+	a.ReportedBytes += r.Bytes
+	if !r.Verified {
+		a.Unverified++
+	}
+}
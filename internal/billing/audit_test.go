@@ -0,0 +1,88 @@
+package billing
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestUsageSignatures(t *testing.T) {
+	svc := NewService(nil, "")
+	day := UsageAuditDay{Day: time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC), Domain: "app.example.com", BytesIn: 1024, BytesOut: 4096, ReportedBytes: 5120}
+
+	if sig := svc.sign(dayFields("user-1", day)...); sig != "" {
+		t.Errorf("sign() without a key = %q, want empty", sig)
+	}
+
+	svc.SetAuditKey([]byte("secret"))
+	sig := svc.sign(dayFields("user-1", day)...)
+	if !svc.verify(sig, dayFields("user-1", day)...) {
+		t.Error("verify() rejected an untouched row")
+	}
+
+	edited := day
+	edited.BytesOut = 2048
+	if svc.verify(sig, dayFields("user-1", edited)...) {
+		t.Error("verify() accepted a row with edited bytes")
+	}
+	if svc.verify(sig, dayFields("user-2", day)...) {
+		t.Error("verify() accepted a row moved to another user")
+	}
+
+	report := UsageReport{SubscriptionItemID: "si_1", Bytes: 5120, Quantity: 1, ReportedAt: time.Date(2026, 3, 2, 1, 0, 0, 0, time.UTC)}
+	if svc.verify(sig, reportFields("user-1", report)...) {
+		t.Error("a day's signature verified a report")
+	}
+
+	other := NewService(nil, "")
+	other.SetAuditKey([]byte("other"))
+	if other.verify(sig, dayFields("user-1", day)...) {
+		t.Error("verify() accepted a signature made with another key")
+	}
+}
+
+func TestUsageAuditTotals(t *testing.T) {
+	a := &UsageAudit{}
+	a.add(UsageAuditDay{BytesIn: 100, BytesOut: 900, Verified: true})
+	a.add(UsageAuditDay{BytesIn: 50, BytesOut: 50})
+	a.addReport(UsageReport{Bytes: 1000, Verified: true})
+
+	if a.TotalBytes != 1100 || a.ReportedBytes != 1000 || a.Unverified != 1 {
+		t.Errorf("audit = total %d, reported %d, unverified %d, want 1100, 1000, 1", a.TotalBytes, a.ReportedBytes, a.Unverified)
+	}
+}
+
+func TestUsageAuditNoDB(t *testing.T) {
+	svc := NewService(nil, "")
+	ctx := context.Background()
+
+	if _, err := svc.SealUsage(ctx); !errors.Is(err, ErrNoAuditKey) {
+		t.Errorf("SealUsage() without a key error = %v, want ErrNoAuditKey", err)
+	}
+	svc.SetAuditKey([]byte("secret"))
+	if n, err := svc.SealUsage(ctx); n != 0 || err != nil {
+		t.Errorf("SealUsage() = %d, %v, want 0, nil", n, err)
+	}
+	audit, err := svc.UsageAudit(ctx, "user-1", time.Now(), time.Now())
+	if err != nil || len(audit.Days) != 0 || len(audit.Reports) != 0 {
+		t.Errorf("UsageAudit() = %+v, %v, want an empty audit", audit, err)
+	}
+}
+
+func TestUsageQuantity(t *testing.T) {
+	tests := []struct {
+		bytes int64
+		want  int64
+	}{
+		{0, 0},
+		{1, 1},
+		{1024 * 1024, 1},
+		{5*1024*1024 + 10, 5},
+	}
+	for _, tt := range tests {
+		if got := usageQuantity(tt.bytes); got != tt.want {
+			t.Errorf("usageQuantity(%d) = %d, want %d", tt.bytes, got, tt.want)
+		}
+	}
+}
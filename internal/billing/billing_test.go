@@ -3,6 +3,9 @@ package billing
 
 import (
 	"testing"
+	"time"
+
+	"github.com/stripe/stripe-go/v76"
 )
 
 func TestBytesToGB(t *testing.T) {
@@ -76,7 +79,7 @@ func TestNewServiceWithoutStripe(t *testing.T) {
 	if svc == nil {
 		t.Fatal("NewService returned nil")
 	}
-	if svc.stripe != nil {
+	if svc.provider != nil {
 		t.Error("stripe client should be nil when no key provided")
 	}
 }
@@ -87,7 +90,7 @@ func TestNewServiceWithStripe(t *testing.T) {
 	if svc == nil {
 		t.Fatal("NewService returned nil")
 	}
-	if svc.stripe == nil {
+	if svc.provider == nil {
 		t.Error("stripe client should not be nil when key provided")
 	}
 }
@@ -163,3 +166,58 @@ func TestUsageSummaryFields(t *testing.T) {
 		t.Errorf("PercentUsed = %v, want 20.0", summary.PercentUsed)
 	}
 }
+
+func TestTrialLapsed(t *testing.T) {
+	pm := &stripe.PaymentMethod{ID: "pm_123"}
+
+	tests := []struct {
+		name string
+		sub  *stripe.Subscription
+		want bool
+	}{
+		{"still trialing", &stripe.Subscription{Status: stripe.SubscriptionStatusTrialing}, false},
+		{"canceled", &stripe.Subscription{Status: stripe.SubscriptionStatusCanceled}, true},
+		{"paused", &stripe.Subscription{Status: stripe.SubscriptionStatusPaused}, true},
+		{"active without payment method", &stripe.Subscription{Status: stripe.SubscriptionStatusActive}, true},
+		{"active with subscription payment method", &stripe.Subscription{
+			Status:               stripe.SubscriptionStatusActive,
+			DefaultPaymentMethod: pm,
+		}, false},
+		{"active with customer payment method", &stripe.Subscription{
+			Status: stripe.SubscriptionStatusActive,
+			Customer: &stripe.Customer{
+				InvoiceSettings: &stripe.CustomerInvoiceSettings{DefaultPaymentMethod: pm},
+			},
+		}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := trialLapsed(fromStripeSubscription(tt.sub)); got != tt.want {
+				t.Errorf("trialLapsed() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTrialEnd(t *testing.T) {
+	if got := trialEnd(&stripe.Subscription{}); got != nil {
+		t.Errorf("trialEnd() without trial = %v, want nil", got)
+	}
+
+	end := time.Date(2025, 12, 20, 0, 0, 0, 0, time.UTC)
+	got := trialEnd(&stripe.Subscription{TrialEnd: end.Unix()})
+	if got == nil || !got.Equal(end) {
+		t.Errorf("trialEnd() = %v, want %v", got, end)
+	}
+}
+
+func TestServiceUpgradeNoStripe(t *testing.T) {
+	svc := NewService(nil, "")
+	if err := svc.UpgradeToPro(nil, "user-1", "price_123", &UpgradeOptions{TrialDays: 14}); err == nil {
+		t.Error("UpgradeToPro without Stripe should error")
+	}
+	if n, err := svc.ExpireLapsedTrials(nil); err != nil || n != 0 {
+		t.Errorf("ExpireLapsedTrials without Stripe = (%d, %v), want (0, nil)", n, err)
+	}
+}
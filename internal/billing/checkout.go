@@ -0,0 +1,108 @@
+// internal/billing/checkout.go
+package billing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/lobber-dev/lobber/internal/notify"
+	"github.com/stripe/stripe-go/v76"
+)
+
+// handleCheckoutSessionCompleted links the Stripe customer and subscription to
+// the user who started checkout (passed as client_reference_id) and welcomes them
+func (h *WebhookHandler) handleCheckoutSessionCompleted(ctx context.Context, event *stripe.Event) error {
+	var session stripe.CheckoutSession
+	if err := json.Unmarshal(event.Data.Raw, &session); err != nil {
+		return fmt.Errorf("unmarshal checkout session: %w", err)
+	}
+
+	userID := session.ClientReferenceID
+	if userID == "" {
+		// Not started from the dashboard, nothing to link
+		fmt.Printf("checkout session %s has no client_reference_id\n", session.ID)
+		return nil
+	}
+	if session.Customer == nil {
+		return fmt.Errorf("checkout session %s has no customer", session.ID)
+	}
+
+	var subscriptionID string
+	if session.Subscription != nil {
+		subscriptionID = session.Subscription.ID
+	}
+
+	exec := h.execFor(ctx)
+	if exec != nil {
+		_, err := exec.ExecContext(ctx, `
+			UPDATE users
+			SET stripe_customer_id = $1,
+			    stripe_subscription_id = COALESCE(NULLIF($2, ''), stripe_subscription_id),
+			    updated_at = NOW()
+			WHERE id = $3
+		`, session.Customer.ID, subscriptionID, userID)
+		if err != nil {
+			return fmt.Errorf("link checkout customer: %w", err)
+		}
+	}
+
+	// customer.subscription.created can arrive before this event, when the
+	// customer isn't linked yet, so set the plan from the live subscription
+	plan := ""
+	if subscriptionID != "" && h.service != nil && h.service.provider != nil {
+		sub, err := h.service.provider.GetSubscription(subscriptionID)
+		if err != nil {
+			return err
+		}
+		plan = string(sub.Plan)
+
+		if exec != nil {
+			_, err = exec.ExecContext(ctx, `
+				UPDATE users
+				SET `+subscriptionTerms+`, plan = $6, trial_ends_at = $7, updated_at = NOW()
+				WHERE id = $8
+			`, append(sub.termArgs(), plan, sub.TrialEnd, userID)...)
+			if err != nil {
+				return fmt.Errorf("update user plan: %w", err)
+			}
+		}
+	}
+
+	email := session.CustomerEmail
+	if session.CustomerDetails != nil && session.CustomerDetails.Email != "" {
+		email = session.CustomerDetails.Email
+	}
+	if email != "" && h.service != nil && h.service.notifier != nil {
+		// Only welcome the user once the link is committed; a failed email
+		// shouldn't replay the event
+		notifier, baseURL := h.service.notifier, h.service.baseURL
+		afterCommit(ctx, func() {
+			if err := notifier.Send(ctx, welcomeMessage(email, Plan(plan), baseURL)); err != nil {
+				fmt.Printf("send welcome email to %s: %v\n", email, err)
+			}
+		})
+	}
+
+	return nil
+}
+
+func welcomeMessage(to string, plan Plan, baseURL string) *notify.Message {
+	msg := &notify.Message{
+		To:      to,
+		Subject: "Welcome to Lobber",
+	}
+
+	switch plan {
+	case PlanPro:
+		msg.Body = "Thanks for subscribing to Lobber Pro. Your tunnels now include 50 GB of bandwidth each month, 30-day request logs and webhook replay."
+	case PlanTeam:
+		msg.Body = "Thanks for subscribing to Lobber Team. Everyone on your team now gets unlimited bandwidth, 30-day request logs and webhook replay."
+	case PlanPAYG:
+		msg.Body = "Thanks for switching to pay-as-you-go. Your tunnels are no longer capped and bandwidth is billed at the end of each month."
+	default:
+		msg.Body = "Thanks for subscribing to Lobber. Your plan is now active."
+	}
+	msg.Body += manageLink(baseURL)
+	return msg
+}
@@ -0,0 +1,80 @@
+package billing
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/lobber-dev/lobber/internal/notify"
+)
+
+// recordingNotifier captures sent messages
+type recordingNotifier struct {
+	sent []*notify.Message
+}
+
+func (n *recordingNotifier) Send(_ context.Context, msg *notify.Message) error {
+	n.sent = append(n.sent, msg)
+	return nil
+}
+
+func TestCheckoutCompletedSendsWelcome(t *testing.T) {
+	tests := []struct {
+		fixture   string
+		wantEmail string
+	}{
+		{"testdata/webhooks/checkout_session_completed.json", "dev@example.com"},
+		{"testdata/webhooks/checkout_session_completed_no_reference.json", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			notifier := &recordingNotifier{}
+			service := NewService(nil, "")
+			service.SetNotifier(notifier, "https://relay.example.com")
+			h := NewWebhookHandler(nil, "", service)
+			h.exec = &recordingExec{}
+
+			if err := h.processEvent(context.Background(), loadFixture(t, tt.fixture)); err != nil {
+				t.Fatalf("processEvent() error = %v", err)
+			}
+
+			if tt.wantEmail == "" {
+				if len(notifier.sent) != 0 {
+					t.Errorf("sent %d messages, want 0", len(notifier.sent))
+				}
+				return
+			}
+			if len(notifier.sent) != 1 {
+				t.Fatalf("sent %d messages, want 1", len(notifier.sent))
+			}
+			if notifier.sent[0].To != tt.wantEmail {
+				t.Errorf("To = %q, want %q", notifier.sent[0].To, tt.wantEmail)
+			}
+		})
+	}
+}
+
+func TestWelcomeMessage(t *testing.T) {
+	tests := []struct {
+		plan Plan
+		want string
+	}{
+		{PlanPro, "Lobber Pro"},
+		{PlanPAYG, "pay-as-you-go"},
+		{"", "Your plan is now active"},
+	}
+
+	for _, tt := range tests {
+		msg := welcomeMessage("dev@example.com", tt.plan, "https://relay.example.com")
+		if !strings.Contains(msg.Body, tt.want) {
+			t.Errorf("welcomeMessage(%q) body = %q, want it to contain %q", tt.plan, msg.Body, tt.want)
+		}
+		if !strings.Contains(msg.Body, "https://relay.example.com/dashboard/account") {
+			t.Errorf("welcomeMessage(%q) body = %q, want a link to the relay's dashboard", tt.plan, msg.Body)
+		}
+		if msg.Subject == "" {
+			t.Errorf("welcomeMessage(%q) has no subject", tt.plan)
+		}
+	}
+}
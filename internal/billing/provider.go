@@ -0,0 +1,139 @@
+// internal/billing/provider.go
+package billing
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrSubscriptionNotFound is returned by a Provider for a subscription that
+// doesn't exist, or no longer does
+var ErrSubscriptionNotFound = errors.New("subscription not found")
+
+// ErrUnsupported is returned by a Provider for operations it can't perform
+var ErrUnsupported = errors.New("not supported by the billing provider")
+
+// Subscription statuses the billing service acts on. Providers map their own
+// statuses onto these; anything else is treated as inactive.
+const (
+	SubscriptionActive   = "active"
+	SubscriptionTrialing = "trialing"
+	SubscriptionCanceled = "canceled"
+)
+
+// Subscription is a provider's subscription in the terms the billing service
+// needs
+type Subscription struct {
+	ID               string
+	Status           string
+	Plan             Plan       // plan the subscription pays for; PlanFree once it's no longer active or trialing
+	ItemID           string     // line item metered usage is reported against
+	TrialEnd         *time.Time // nil without a trial
+	HasPaymentMethod bool       // a payment method is on file to charge when a trial ends
+	Interval         string     // IntervalMonth or IntervalYear
+	Seats            int64      // quantity of the price; 1 unless it's priced per seat
+	RenewalAmount    int64      // charged at the next renewal before tax and discounts, in the currency's minor unit; 0 for metered prices
+	Currency         string
+	RenewsAt         *time.Time // end of the current billing period
+}
+
+// subscriptionTerms sets a user's billing interval, seats and renewal from
+// the first five arguments, as returned by termArgs
+const subscriptionTerms = `billing_interval = $1, seats = $2, renewal_amount = $3, renewal_currency = $4, renews_at = $5`
+
+// clearSubscriptionTerms resets a user's billing interval, seats and
+// renewal when they drop to the free plan
+const clearSubscriptionTerms = `billing_interval = 'month', seats = 1, renewal_amount = NULL, renewal_currency = NULL, renews_at = NULL`
+
+// termArgs returns the arguments for subscriptionTerms. A subscription that
+// has lapsed to the free plan clears them.
+func (sub *Subscription) termArgs() []any {
+	if sub.Plan == PlanFree {
+		return []any{IntervalMonth, int64(1), nil, nil, nil}
+	}
+	interval := sub.Interval
+	if interval != IntervalYear {
+		interval = IntervalMonth
+	}
+	seats := max(sub.Seats, 1)
+	var amount, currency any
+	if sub.RenewalAmount > 0 {
+		amount, currency = sub.RenewalAmount, sub.Currency
+	}
+	return []any{interval, seats, amount, currency, sub.RenewsAt}
+}
+
+// Provider is the payment processor behind the billing service. Stripe is
+// built in; self-hosters can plug in another processor such as Paddle or
+// Lemon Squeezy, or NoopProvider to run without one. Customers,
+// subscriptions and prices are identified by the provider's own IDs.
+type Provider interface {
+	// CreateCustomer creates a customer, with optional billing details, and returns its ID
+	CreateCustomer(email, name string, details *BillingDetails) (string, error)
+	UpdateCustomerAddress(customerID string, address Address) error
+	// AddTaxID attaches a tax ID (e.g. an EU VAT number) to a customer
+	AddTaxID(customerID, taxIDType, value string) error
+	// CreateSubscription subscribes a customer to a price
+	CreateSubscription(customerID, priceID string, opts *SubscriptionOptions) (*Subscription, error)
+	// GetSubscription returns ErrSubscriptionNotFound for a subscription that doesn't exist
+	GetSubscription(subscriptionID string) (*Subscription, error)
+	CancelSubscription(subscriptionID string) error
+	// UpdateSeats changes the quantity of a per-seat subscription, prorating
+	// the difference for the rest of the billing period
+	UpdateSeats(subscriptionID string, seats int64) (*Subscription, error)
+	// LookupPromotionCode resolves a customer-facing code to the ID SubscriptionOptions takes
+	LookupPromotionCode(code string) (string, error)
+	UpcomingInvoice(customerID, subscriptionID string) (*InvoicePreview, error)
+	// ReportUsage adds metered bytes to a subscription item
+	ReportUsage(subscriptionItemID string, bytes int64) error
+}
+
+var (
+	_ Provider = (*StripeClient)(nil)
+	_ Provider = NoopProvider{}
+)
+
+// NoopProvider runs billing without a payment processor. Nobody can
+// subscribe, so plans are only changed by operator overrides, and usage
+// reports are dropped.
+type NoopProvider struct{}
+
+func (NoopProvider) CreateCustomer(email, name string, details *BillingDetails) (string, error) {
+	return "", ErrUnsupported
+}
+
+func (NoopProvider) UpdateCustomerAddress(customerID string, address Address) error {
+	return ErrUnsupported
+}
+
+func (NoopProvider) AddTaxID(customerID, taxIDType, value string) error {
+	return ErrUnsupported
+}
+
+func (NoopProvider) CreateSubscription(customerID, priceID string, opts *SubscriptionOptions) (*Subscription, error) {
+	return nil, ErrUnsupported
+}
+
+func (NoopProvider) GetSubscription(subscriptionID string) (*Subscription, error) {
+	return nil, ErrSubscriptionNotFound
+}
+
+func (NoopProvider) CancelSubscription(subscriptionID string) error {
+	return nil
+}
+
+func (NoopProvider) UpdateSeats(subscriptionID string, seats int64) (*Subscription, error) {
+	return nil, ErrUnsupported
+}
+
+func (NoopProvider) LookupPromotionCode(code string) (string, error) {
+	return "", ErrUnsupported
+}
+
+func (NoopProvider) UpcomingInvoice(customerID, subscriptionID string) (*InvoicePreview, error) {
+	return nil, ErrUnsupported
+}
+
+func (NoopProvider) ReportUsage(subscriptionItemID string, bytes int64) error {
+	return nil
+}
@@ -0,0 +1,131 @@
+package billing
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stripe/stripe-go/v76"
+)
+
+func TestFromStripeSubscription(t *testing.T) {
+	end := time.Date(2025, 12, 20, 0, 0, 0, 0, time.UTC)
+	sub := fromStripeSubscription(&stripe.Subscription{
+		ID:       "sub_123",
+		Status:   stripe.SubscriptionStatusTrialing,
+		TrialEnd: end.Unix(),
+		Items: &stripe.SubscriptionItemList{
+			Data: []*stripe.SubscriptionItem{
+				{ID: "si_123", Price: &stripe.Price{Recurring: &stripe.PriceRecurring{UsageType: stripe.PriceRecurringUsageTypeMetered}}},
+			},
+		},
+	})
+
+	if sub.ID != "sub_123" || sub.Status != SubscriptionTrialing || sub.Plan != PlanPAYG || sub.ItemID != "si_123" {
+		t.Errorf("fromStripeSubscription() = %+v, want trialing payg sub_123 with item si_123", sub)
+	}
+	if sub.TrialEnd == nil || !sub.TrialEnd.Equal(end) {
+		t.Errorf("TrialEnd = %v, want %v", sub.TrialEnd, end)
+	}
+	if sub.HasPaymentMethod {
+		t.Error("HasPaymentMethod = true without a payment method")
+	}
+
+	canceled := fromStripeSubscription(&stripe.Subscription{Status: stripe.SubscriptionStatusCanceled})
+	if canceled.Plan != PlanFree || canceled.ItemID != "" {
+		t.Errorf("canceled subscription = %+v, want free without an item", canceled)
+	}
+}
+
+func TestNoopProvider(t *testing.T) {
+	var p Provider = NoopProvider{}
+
+	if _, err := p.GetSubscription("sub_123"); !errors.Is(err, ErrSubscriptionNotFound) {
+		t.Errorf("GetSubscription() error = %v, want ErrSubscriptionNotFound", err)
+	}
+	if _, err := p.CreateCustomer("a@example.com", "A", nil); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("CreateCustomer() error = %v, want ErrUnsupported", err)
+	}
+	if _, err := p.CreateSubscription("cus_123", "price_123", nil); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("CreateSubscription() error = %v, want ErrUnsupported", err)
+	}
+	if err := p.ReportUsage("si_123", 1024); err != nil {
+		t.Errorf("ReportUsage() error = %v, want usage dropped", err)
+	}
+	if err := p.CancelSubscription("sub_123"); err != nil {
+		t.Errorf("CancelSubscription() error = %v", err)
+	}
+}
+
+func TestServiceWithNoopProvider(t *testing.T) {
+	svc := NewServiceWithProvider(nil, NoopProvider{})
+	if _, err := svc.CreateCustomerForUser(context.Background(), "u1", "a@example.com", "A"); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("CreateCustomerForUser() error = %v, want ErrUnsupported", err)
+	}
+	if err := svc.SyncUsageToStripe(context.Background()); err != nil {
+		t.Errorf("SyncUsageToStripe() error = %v", err)
+	}
+}
+
+func TestSubscriptionTerms(t *testing.T) {
+	sub := fromStripeSubscription(&stripe.Subscription{
+		Status:           stripe.SubscriptionStatusActive,
+		CurrentPeriodEnd: time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC).Unix(),
+		Items: &stripe.SubscriptionItemList{
+			Data: []*stripe.SubscriptionItem{
+				{ID: "si_123", Quantity: 5, Price: &stripe.Price{
+					Currency:   stripe.CurrencyUSD,
+					UnitAmount: 9600,
+					Metadata:   map[string]string{"plan": "team"},
+					Recurring:  &stripe.PriceRecurring{Interval: stripe.PriceRecurringIntervalYear, UsageType: stripe.PriceRecurringUsageTypeLicensed},
+				}},
+			},
+		},
+	})
+	if sub.Plan != PlanTeam || sub.Interval != IntervalYear || sub.Seats != 5 || sub.RenewalAmount != 48000 || sub.Currency != "usd" {
+		t.Errorf("fromStripeSubscription() = %+v, want 5 yearly team seats renewing at 480.00 USD", sub)
+	}
+	if sub.RenewsAt == nil {
+		t.Error("RenewsAt = nil, want the end of the billing period")
+	}
+
+	metered := fromStripeSubscription(&stripe.Subscription{
+		Status: stripe.SubscriptionStatusActive,
+		Items: &stripe.SubscriptionItemList{
+			Data: []*stripe.SubscriptionItem{
+				{Price: &stripe.Price{UnitAmount: 10, Recurring: &stripe.PriceRecurring{UsageType: stripe.PriceRecurringUsageTypeMetered}}},
+			},
+		},
+	})
+	if args := metered.termArgs(); args[0] != IntervalMonth || args[1] != int64(1) || args[2] != nil {
+		t.Errorf("metered termArgs() = %v, want monthly, one seat, no renewal amount", args)
+	}
+
+	sub.Plan = PlanFree
+	if args := sub.termArgs(); args[1] != int64(1) || args[2] != nil || args[4] != nil {
+		t.Errorf("free termArgs() = %v, want terms cleared", args)
+	}
+}
+
+func TestSetSeats(t *testing.T) {
+	svc := NewServiceWithProvider(nil, NoopProvider{})
+	if err := svc.SetSeats(context.Background(), "u1", 5); err == nil {
+		t.Error("SetSeats() without a database should fail")
+	}
+
+	tests := []struct {
+		seats   int64
+		wantErr bool
+	}{
+		{0, true},
+		{1, false},
+		{MaxSeats, false},
+		{MaxSeats + 1, true},
+	}
+	for _, tt := range tests {
+		if err := validateSeats(tt.seats); (err != nil) != tt.wantErr {
+			t.Errorf("validateSeats(%d) error = %v, wantErr %v", tt.seats, err, tt.wantErr)
+		}
+	}
+}
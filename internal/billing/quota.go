@@ -0,0 +1,170 @@
+// internal/billing/quota.go
+package billing
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/lobber-dev/lobber/internal/db"
+	"github.com/lobber-dev/lobber/internal/notify"
+)
+
+// QuotaLevel describes where a user's usage sits relative to their plan limit
+type QuotaLevel int
+
+const (
+	QuotaOK       QuotaLevel = iota // Below the warning threshold
+	QuotaWarning                    // Past the soft warning threshold
+	QuotaExceeded                   // Past the plan limit, still serving
+	QuotaCapped                     // Past the hard cap, traffic is refused
+)
+
+// String returns the name used in the database and templates
+func (l QuotaLevel) String() string {
+	switch l {
+	case QuotaWarning:
+		return "warning"
+	case QuotaExceeded:
+		return "exceeded"
+	case QuotaCapped:
+		return "capped"
+	default:
+		return "ok"
+	}
+}
+
+// QuotaPolicy holds usage thresholds as percentages of the plan limit
+type QuotaPolicy struct {
+	WarnPercent    float64          // Soft warning (default 80)
+	LimitPercent   float64          // Plan limit reached (default 100)
+	HardCapPercent map[Plan]float64 // Hard cap per plan; 0 or missing means never capped
+}
+
+// DefaultQuotaPolicy returns the standard thresholds: warn at 80%, notify at
+// 100%, and hard cap free accounts at 120%
+func DefaultQuotaPolicy() *QuotaPolicy {
+	return &QuotaPolicy{
+		WarnPercent:  80,
+		LimitPercent: 100,
+		HardCapPercent: map[Plan]float64{
+			PlanFree: 120,
+		},
+	}
+}
+
+// Level classifies usage against a limit. Unlimited plans (limit <= 0) are always OK.
+func (p *QuotaPolicy) Level(plan Plan, usedBytes, limitBytes int64) QuotaLevel {
+	if limitBytes <= 0 {
+		return QuotaOK
+	}
+
+	percent := float64(usedBytes) / float64(limitBytes) * 100
+	if capPercent := p.HardCapPercent[plan]; capPercent > 0 && percent >= capPercent {
+		return QuotaCapped
+	}
+	if percent >= p.LimitPercent {
+		return QuotaExceeded
+	}
+	if percent >= p.WarnPercent {
+		return QuotaWarning
+	}
+	return QuotaOK
+}
+
+// SetQuotaPolicy overrides the default quota thresholds
+func (s *Service) SetQuotaPolicy(p *QuotaPolicy) {
+	if p != nil {
+		s.policy = p
+	}
+}
+
+// SetNotifier sets the notifier used for usage warnings. Emails link to
+// the dashboard at baseURL, e.g. https://lobber.dev, or to none if it's empty.
+func (s *Service) SetNotifier(n notify.Notifier, baseURL string) {
+	s.notifier = n
+	s.baseURL = strings.TrimSuffix(baseURL, "/")
+}
+
+// GetQuotaLevel returns the user's current quota level
+func (s *Service) GetQuotaLevel(ctx context.Context, userID string) (QuotaLevel, error) {
+	summary, err := s.GetUsageSummary(ctx, userID)
+	if err != nil {
+		return QuotaOK, err
+	}
+	return summary.Level, nil
+}
+
+// NotifyUsageThresholds emails the user about every threshold they have crossed
+// this billing period that they have not already been told about
+func (s *Service) NotifyUsageThresholds(ctx context.Context, userID string) error {
+	if s.db == nil || s.notifier == nil {
+		return nil
+	}
+
+	summary, err := s.GetUsageSummary(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if summary.Level == QuotaOK {
+		return nil
+	}
+
+	user, err := s.users.GetUser(ctx, userID)
+	if err != nil {
+		return fmt.Errorf("get user email: %w", err)
+	}
+	email := user.Email
+
+	for level := QuotaWarning; level <= summary.Level; level++ {
+		// Record first so concurrent callers only send once per period
+		qctx, done := db.Timed(ctx, "billing.NotifyUsageThresholds")
+		res, err := s.db.ExecContext(qctx, `
+			INSERT INTO usage_notifications (user_id, level, billing_period)
+			VALUES ($1, $2, date_trunc('month', NOW())::DATE)
+			ON CONFLICT (user_id, level, billing_period) DO NOTHING
+		`, userID, level.String())
+		done()
+		if err != nil {
+			return fmt.Errorf("record usage notification: %w", err)
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			continue
+		}
+
+		if err := s.notifier.Send(ctx, usageMessage(email, level, summary, s.baseURL)); err != nil {
+			return fmt.Errorf("send usage notification: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func usageMessage(to string, level QuotaLevel, summary *UsageSummary, baseURL string) *notify.Message {
+	msg := &notify.Message{To: to}
+	usage := fmt.Sprintf("%.2f GB of your %.0f GB monthly allowance (%.0f%%)",
+		summary.UsedGB, summary.LimitGB, summary.PercentUsed)
+
+	switch level {
+	case QuotaWarning:
+		msg.Subject = "You've used most of your Lobber bandwidth"
+		msg.Body = "You have used " + usage + ".\n\nUpgrade to pay-as-you-go or Pro to avoid interruptions."
+	case QuotaExceeded:
+		msg.Subject = "You've reached your Lobber bandwidth limit"
+		msg.Body = "You have used " + usage + ".\n\nYour tunnels keep working for now, but will be paused if usage continues to grow. Upgrade to keep them online."
+	case QuotaCapped:
+		msg.Subject = "Your Lobber tunnels have been paused"
+		msg.Body = "You have used " + usage + ".\n\nVisitors to your domains now see a quota page until the next billing period or until you upgrade."
+	}
+	msg.Body += manageLink(baseURL)
+	return msg
+}
+
+// manageLink ends an account email with a link to the dashboard at
+// baseURL, or just a newline if there's none
+func manageLink(baseURL string) string {
+	if baseURL == "" {
+		return "\n"
+	}
+	return "\n\nManage your plan at " + baseURL + "/dashboard/account\n"
+}
@@ -0,0 +1,116 @@
+package billing
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/lobber-dev/lobber/internal/store"
+)
+
+func TestQuotaPolicyLevel(t *testing.T) {
+	p := DefaultQuotaPolicy()
+	limit := FreeTierBytes
+
+	tests := []struct {
+		name  string
+		plan  Plan
+		used  int64
+		limit int64
+		want  QuotaLevel
+	}{
+		{"empty", PlanFree, 0, limit, QuotaOK},
+		{"below warning", PlanFree, limit * 79 / 100, limit, QuotaOK},
+		{"at warning", PlanFree, limit * 80 / 100, limit, QuotaWarning},
+		{"at limit", PlanFree, limit, limit, QuotaExceeded},
+		{"below hard cap", PlanFree, limit * 119 / 100, limit, QuotaExceeded},
+		{"at hard cap", PlanFree, limit * 120 / 100, limit, QuotaCapped},
+		{"no hard cap for payg", PlanPAYG, limit * 2, limit, QuotaExceeded},
+		{"unlimited plan", PlanPro, limit * 10, -1, QuotaOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := p.Level(tt.plan, tt.used, tt.limit); got != tt.want {
+				t.Errorf("Level(%s, %d, %d) = %v, want %v", tt.plan, tt.used, tt.limit, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQuotaLevelString(t *testing.T) {
+	tests := map[QuotaLevel]string{
+		QuotaOK:       "ok",
+		QuotaWarning:  "warning",
+		QuotaExceeded: "exceeded",
+		QuotaCapped:   "capped",
+	}
+	for level, want := range tests {
+		if got := level.String(); got != want {
+			t.Errorf("QuotaLevel(%d).String() = %q, want %q", level, got, want)
+		}
+	}
+}
+
+func TestServiceNotifyUsageThresholdsNoDB(t *testing.T) {
+	svc := NewService(nil, "")
+	if err := svc.NotifyUsageThresholds(nil, "user-1"); err != nil {
+		t.Errorf("NotifyUsageThresholds without DB should not error, got: %v", err)
+	}
+}
+
+func TestUsageMessage(t *testing.T) {
+	summary := &UsageSummary{UsedGB: 4.0, LimitGB: 5.0, PercentUsed: 80}
+
+	msg := usageMessage("user@example.com", QuotaWarning, summary, "https://relay.example.com")
+	if msg.To != "user@example.com" {
+		t.Errorf("To = %q, want %q", msg.To, "user@example.com")
+	}
+	if !strings.Contains(msg.Body, "4.00 GB of your 5 GB") {
+		t.Errorf("body should describe usage, got %q", msg.Body)
+	}
+	if !strings.Contains(msg.Body, "https://relay.example.com/dashboard/account") {
+		t.Errorf("body should link to the relay's dashboard, got %q", msg.Body)
+	}
+
+	capped := usageMessage("user@example.com", QuotaCapped, summary, "")
+	if capped.Subject == msg.Subject {
+		t.Error("capped and warning messages should have different subjects")
+	}
+	if strings.Contains(capped.Body, "dashboard") {
+		t.Errorf("body without a base URL should have no link, got %q", capped.Body)
+	}
+}
+
+func TestServiceGetQuotaLevelWithStore(t *testing.T) {
+	mem := store.NewMemory()
+	mem.AddUser(store.User{ID: "free-user", Plan: "free"})
+	mem.AddUser(store.User{ID: "pro-user", Plan: "pro"})
+	ctx := context.Background()
+	for _, id := range []string{"free-user", "pro-user"} {
+		mem.RecordBandwidth(ctx, id, "", FreeTierBytes*9/10, 0)
+	}
+
+	svc := NewService(nil, "")
+	svc.SetStores(mem, mem)
+
+	tests := []struct {
+		userID  string
+		want    QuotaLevel
+		wantErr bool
+	}{
+		{"free-user", QuotaWarning, false},
+		{"pro-user", QuotaOK, false},
+		{"missing", QuotaOK, true},
+	}
+
+	for _, tt := range tests {
+		got, err := svc.GetQuotaLevel(ctx, tt.userID)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("GetQuotaLevel(%q) error = %v, wantErr %v", tt.userID, err, tt.wantErr)
+		}
+		if got != tt.want {
+			t.Errorf("GetQuotaLevel(%q) = %v, want %v", tt.userID, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+// internal/billing/reconcile.go
+package billing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/lobber-dev/lobber/internal/db"
+)
+
+// Mismatch describes a user whose plan in the database disagrees with Stripe
+type Mismatch struct {
+	UserID         string `json:"user_id"`
+	Email          string `json:"email"`
+	SubscriptionID string `json:"subscription_id,omitempty"`
+	DBPlan         Plan   `json:"db_plan"`
+	StripePlan     Plan   `json:"stripe_plan"`
+	StripeStatus   string `json:"stripe_status,omitempty"`
+	Reason         string `json:"reason"`
+	Fixed          bool   `json:"fixed"`
+}
+
+// ReconcileReport is the result of a reconciliation run
+type ReconcileReport struct {
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt time.Time  `json:"finished_at"`
+	Checked    int        `json:"checked"`
+	Mismatches []Mismatch `json:"mismatches"`
+	Errors     []string   `json:"errors,omitempty"`
+}
+
+// reconcileState holds the most recent report for the admin API
+type reconcileState struct {
+	mu   sync.RWMutex
+	last *ReconcileReport
+}
+
+// Reconcile cross-checks every user with a paid plan or a subscription
+// against live Stripe state, skipping plans pinned by an operator. When fix
+// is true, drifted users are updated to match Stripe. Per-user Stripe errors
+// are collected in the report rather than aborting the run.
+func (s *Service) Reconcile(ctx context.Context, fix bool) (*ReconcileReport, error) {
+	if s.db == nil || s.provider == nil {
+		return nil, fmt.Errorf("billing not configured")
+	}
+
+	report := &ReconcileReport{StartedAt: time.Now(), Mismatches: []Mismatch{}}
+
+	qctx, done := db.Timed(ctx, "billing.Reconcile")
+	rows, err := s.db.QueryContext(qctx, `
+		SELECT id, email, COALESCE(plan, 'free'), COALESCE(stripe_subscription_id, '')
+		FROM users
+		WHERE (stripe_subscription_id IS NOT NULL OR plan <> 'free')
+		AND NOT plan_override
+	`)
+	if err != nil {
+		done()
+		return nil, fmt.Errorf("query billed users: %w", err)
+	}
+
+	type billedUser struct {
+		id, email, plan, subscriptionID string
+	}
+	var users []billedUser
+	for rows.Next() {
+		var u billedUser
+		if err := rows.Scan(&u.id, &u.email, &u.plan, &u.subscriptionID); err != nil {
+			rows.Close()
+			done()
+			return nil, fmt.Errorf("scan row: %w", err)
+		}
+		users = append(users, u)
+	}
+	rows.Close()
+	done()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("query billed users: %w", err)
+	}
+
+	for _, u := range users {
+		report.Checked++
+
+		var sub *Subscription
+		if u.subscriptionID != "" {
+			sub, err = s.provider.GetSubscription(u.subscriptionID)
+			if errors.Is(err, ErrSubscriptionNotFound) {
+				sub = nil
+			} else if err != nil {
+				report.Errors = append(report.Errors, fmt.Sprintf("user %s: %v", u.id, err))
+				continue
+			}
+		}
+
+		m := diffPlan(Plan(u.plan), u.subscriptionID, sub)
+		if m == nil {
+			continue
+		}
+		m.UserID = u.id
+		m.Email = u.email
+
+		if fix {
+			if err := s.applyStripePlan(ctx, m); err != nil {
+				report.Errors = append(report.Errors, fmt.Sprintf("fix user %s: %v", u.id, err))
+			} else {
+				m.Fixed = true
+			}
+		}
+		report.Mismatches = append(report.Mismatches, *m)
+	}
+
+	report.FinishedAt = time.Now()
+
+	s.reconcile.mu.Lock()
+	s.reconcile.last = report
+	s.reconcile.mu.Unlock()
+
+	return report, nil
+}
+
+// LastReconcileReport returns the report from the most recent run, or nil
+func (s *Service) LastReconcileReport() *ReconcileReport {
+	s.reconcile.mu.RLock()
+	defer s.reconcile.mu.RUnlock()
+	return s.reconcile.last
+}
+
+// diffPlan compares a user's stored plan with their Stripe subscription.
+// sub is nil when the user has no subscription or it no longer exists.
+func diffPlan(dbPlan Plan, subscriptionID string, sub *Subscription) *Mismatch {
+	if sub == nil {
+		if subscriptionID != "" {
+			return &Mismatch{
+				SubscriptionID: subscriptionID,
+				DBPlan:         dbPlan,
+				StripePlan:     PlanFree,
+				Reason:         "subscription not found in Stripe",
+			}
+		}
+		if dbPlan != PlanFree {
+			return &Mismatch{
+				DBPlan:     dbPlan,
+				StripePlan: PlanFree,
+				Reason:     "paid plan without a subscription",
+			}
+		}
+		return nil
+	}
+
+	stripePlan := sub.Plan
+	if stripePlan == dbPlan {
+		return nil
+	}
+
+	return &Mismatch{
+		SubscriptionID: sub.ID,
+		DBPlan:         dbPlan,
+		StripePlan:     stripePlan,
+		StripeStatus:   sub.Status,
+		Reason:         fmt.Sprintf("plan is %s in database but %s in Stripe", dbPlan, stripePlan),
+	}
+}
+
+// applyStripePlan updates a user to match Stripe. Users that end up on the
+// free plan lose their subscription reference.
+func (s *Service) applyStripePlan(ctx context.Context, m *Mismatch) error {
+	ctx, done := db.Timed(ctx, "billing.applyStripePlan")
+	defer done()
+
+	var err error
+	if m.StripePlan == PlanFree {
+		_, err = s.db.ExecContext(ctx, `
+			UPDATE users
+			SET plan = 'free', stripe_subscription_id = NULL, trial_ends_at = NULL, `+clearSubscriptionTerms+`, updated_at = NOW()
+			WHERE id = $1
+		`, m.UserID)
+	} else {
+		_, err = s.db.ExecContext(ctx, `
+			UPDATE users
+			SET plan = $1, updated_at = NOW()
+			WHERE id = $2
+		`, m.StripePlan, m.UserID)
+	}
+	if err != nil {
+		return fmt.Errorf("update user plan: %w", err)
+	}
+	return nil
+}
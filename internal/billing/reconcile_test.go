@@ -0,0 +1,70 @@
+package billing
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stripe/stripe-go/v76"
+)
+
+func meteredSub(status stripe.SubscriptionStatus) *Subscription {
+	return fromStripeSubscription(&stripe.Subscription{
+		ID:     "sub_123",
+		Status: status,
+		Items: &stripe.SubscriptionItemList{
+			Data: []*stripe.SubscriptionItem{
+				{Price: &stripe.Price{Recurring: &stripe.PriceRecurring{UsageType: stripe.PriceRecurringUsageTypeMetered}}},
+			},
+		},
+	})
+}
+
+func TestDiffPlan(t *testing.T) {
+	tests := []struct {
+		name           string
+		dbPlan         Plan
+		subscriptionID string
+		sub            *Subscription
+		wantMismatch   bool
+		wantStripePlan Plan
+	}{
+		{"free without subscription", PlanFree, "", nil, false, ""},
+		{"pro without subscription", PlanPro, "", nil, true, PlanFree},
+		{"subscription deleted in stripe", PlanPAYG, "sub_gone", nil, true, PlanFree},
+		{"matching payg", PlanPAYG, "sub_123", meteredSub(stripe.SubscriptionStatusActive), false, ""},
+		{"canceled in stripe but paid in db", PlanPAYG, "sub_123", meteredSub(stripe.SubscriptionStatusCanceled), true, PlanFree},
+		{"active in stripe but free in db", PlanFree, "sub_123", meteredSub(stripe.SubscriptionStatusActive), true, PlanPAYG},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := diffPlan(tt.dbPlan, tt.subscriptionID, tt.sub)
+			if (m != nil) != tt.wantMismatch {
+				t.Fatalf("diffPlan() = %+v, wantMismatch %v", m, tt.wantMismatch)
+			}
+			if m != nil && m.StripePlan != tt.wantStripePlan {
+				t.Errorf("StripePlan = %q, want %q", m.StripePlan, tt.wantStripePlan)
+			}
+		})
+	}
+}
+
+func TestIsResourceMissing(t *testing.T) {
+	missing := fmt.Errorf("get subscription: %w", &stripe.Error{Code: stripe.ErrorCodeResourceMissing})
+	if !isResourceMissing(missing) {
+		t.Error("wrapped resource_missing error should be detected")
+	}
+	if isResourceMissing(fmt.Errorf("network down")) {
+		t.Error("plain error should not be treated as missing")
+	}
+}
+
+func TestServiceReconcileNoStripe(t *testing.T) {
+	svc := NewService(nil, "")
+	if _, err := svc.Reconcile(nil, false); err == nil {
+		t.Error("Reconcile without Stripe should error")
+	}
+	if svc.LastReconcileReport() != nil {
+		t.Error("LastReconcileReport should be nil before any run")
+	}
+}
@@ -0,0 +1,197 @@
+// internal/billing/retry.go
+package billing
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/lobber-dev/lobber/internal/db"
+	"github.com/stripe/stripe-go/v76"
+)
+
+// MaxEventAttempts is how many times a webhook event is processed before it
+// is left for manual reprocessing
+const MaxEventAttempts = 8
+
+// FailedEvent is a webhook event whose processing has not yet succeeded
+type FailedEvent struct {
+	StripeEventID string     `json:"stripe_event_id"`
+	EventType     string     `json:"event_type"`
+	Attempts      int        `json:"attempts"`
+	LastError     string     `json:"last_error"`
+	NextAttemptAt *time.Time `json:"next_attempt_at,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+}
+
+// retryBackoff returns the delay before the next attempt: 1m, 2m, 4m... capped at 6h
+func retryBackoff(attempts int) time.Duration {
+	const maxBackoff = 6 * time.Hour
+	if attempts < 1 {
+		attempts = 1
+	}
+	if attempts > 10 {
+		return maxBackoff
+	}
+	return min(time.Minute<<(attempts-1), maxBackoff)
+}
+
+// recordFailure bumps the attempt count and schedules the next retry. Once
+// MaxEventAttempts is reached no further retry is scheduled.
+func (h *WebhookHandler) recordFailure(ctx context.Context, eventID string, procErr error) error {
+	if h.db == nil {
+		return nil
+	}
+
+	ctx, done := db.Timed(ctx, "billing.recordFailure")
+	defer done()
+
+	var attempts int
+	err := h.db.QueryRowContext(ctx, `
+		UPDATE billing_events
+		SET attempts = attempts + 1, last_error = $1
+		WHERE stripe_event_id = $2
+		RETURNING attempts
+	`, procErr.Error(), eventID).Scan(&attempts)
+	if err != nil {
+		return fmt.Errorf("record event failure: %w", err)
+	}
+
+	var nextAttempt *time.Time
+	if attempts < MaxEventAttempts {
+		t := time.Now().Add(retryBackoff(attempts))
+		nextAttempt = &t
+	}
+
+	_, err = h.db.ExecContext(ctx,
+		"UPDATE billing_events SET next_attempt_at = $1 WHERE stripe_event_id = $2",
+		nextAttempt, eventID)
+	if err != nil {
+		return fmt.Errorf("schedule event retry: %w", err)
+	}
+	return nil
+}
+
+// RetryFailedEvents reprocesses queued events whose backoff has elapsed.
+// Returns the number of events that succeeded.
+func (h *WebhookHandler) RetryFailedEvents(ctx context.Context) (int, error) {
+	if h.db == nil {
+		return 0, nil
+	}
+
+	qctx, done := db.Timed(ctx, "billing.RetryFailedEvents")
+	rows, err := h.db.QueryContext(qctx, `
+		SELECT stripe_event_id
+		FROM billing_events
+		WHERE processed = FALSE
+		AND next_attempt_at IS NOT NULL
+		AND next_attempt_at <= NOW()
+		ORDER BY created_at
+		LIMIT 100
+	`)
+	if err != nil {
+		done()
+		return 0, fmt.Errorf("query due events: %w", err)
+	}
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			done()
+			return 0, fmt.Errorf("scan row: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	done()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("query due events: %w", err)
+	}
+
+	succeeded := 0
+	for _, id := range ids {
+		if err := h.reprocess(ctx, id, false); err == nil {
+			succeeded++
+		}
+	}
+	return succeeded, nil
+}
+
+// ReprocessEvent loads a stored event and runs it through the handlers again,
+// regardless of whether it was previously processed
+func (h *WebhookHandler) ReprocessEvent(ctx context.Context, eventID string) error {
+	return h.reprocess(ctx, eventID, true)
+}
+
+// reprocess applies a stored event, recording a failure for the retry queue
+func (h *WebhookHandler) reprocess(ctx context.Context, eventID string, force bool) error {
+	if h.db == nil {
+		return fmt.Errorf("database not configured")
+	}
+
+	var payload []byte
+	qctx, done := db.Timed(ctx, "billing.reprocess")
+	err := h.db.QueryRowContext(qctx,
+		"SELECT payload FROM billing_events WHERE stripe_event_id = $1",
+		eventID).Scan(&payload)
+	done()
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("event %s not found", eventID)
+	}
+	if err != nil {
+		return fmt.Errorf("load event: %w", err)
+	}
+
+	var event stripe.Event
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return fmt.Errorf("unmarshal event: %w", err)
+	}
+
+	if err := h.applyEvent(ctx, &event, force); err != nil {
+		if recErr := h.recordFailure(ctx, eventID, err); recErr != nil {
+			fmt.Printf("record webhook failure: %v\n", recErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// FailedEvents lists unprocessed events that have failed at least once, newest first
+func (h *WebhookHandler) FailedEvents(ctx context.Context, limit int) ([]FailedEvent, error) {
+	if h.db == nil {
+		return nil, nil
+	}
+
+	ctx, done := db.Timed(ctx, "billing.FailedEvents")
+	defer done()
+
+	rows, err := h.db.QueryContext(ctx, `
+		SELECT stripe_event_id, event_type, attempts, COALESCE(last_error, ''), next_attempt_at, created_at
+		FROM billing_events
+		WHERE processed = FALSE AND attempts > 0
+		ORDER BY created_at DESC
+		LIMIT $1
+	`, limit)
+	if err != nil {
+		return nil, fmt.Errorf("query failed events: %w", err)
+	}
+	defer rows.Close()
+
+	events := []FailedEvent{}
+	for rows.Next() {
+		var e FailedEvent
+		var next sql.NullTime
+		if err := rows.Scan(&e.StripeEventID, &e.EventType, &e.Attempts, &e.LastError, &next, &e.CreatedAt); err != nil {
+			return nil, fmt.Errorf("scan row: %w", err)
+		}
+		if next.Valid {
+			e.NextAttemptAt = &next.Time
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
@@ -0,0 +1,41 @@
+package billing
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRetryBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{0, time.Minute},
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{4, 8 * time.Minute},
+		{9, 256 * time.Minute},
+		{10, 6 * time.Hour},
+		{50, 6 * time.Hour},
+	}
+
+	for _, tt := range tests {
+		if got := retryBackoff(tt.attempts); got != tt.want {
+			t.Errorf("retryBackoff(%d) = %v, want %v", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+func TestRetryWithoutDB(t *testing.T) {
+	h := NewWebhookHandler(nil, "", nil)
+	ctx := context.Background()
+
+	n, err := h.RetryFailedEvents(ctx)
+	if err != nil || n != 0 {
+		t.Errorf("RetryFailedEvents() = %d, %v, want 0, nil", n, err)
+	}
+	if err := h.ReprocessEvent(ctx, "evt_123"); err == nil {
+		t.Error("ReprocessEvent() should fail without a database")
+	}
+}
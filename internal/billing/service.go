@@ -4,8 +4,13 @@ package billing
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"time"
+
+	"github.com/lobber-dev/lobber/internal/db"
+	"github.com/lobber-dev/lobber/internal/notify"
+	"github.com/lobber-dev/lobber/internal/store"
 )
 
 // Plan represents a billing plan
@@ -15,8 +20,18 @@ const (
 	PlanFree Plan = "free"
 	PlanPAYG Plan = "payg"
 	PlanPro  Plan = "pro"
+	PlanTeam Plan = "team" // fixed price per seat
+)
+
+// Billing intervals a paid plan can renew on
+const (
+	IntervalMonth = "month"
+	IntervalYear  = "year"
 )
 
+// MaxSeats caps the seats on a team subscription
+const MaxSeats = 1000
+
 // FreeTierBytes is the free tier bandwidth limit (5GB)
 const FreeTierBytes int64 = 5 * 1024 * 1024 * 1024
 
@@ -43,73 +58,77 @@ type UserBilling struct {
 
 // Service handles billing operations
 type Service struct {
-	db     *sql.DB
-	stripe *StripeClient
+	db           *sql.DB
+	users        store.UserStore
+	usage        store.UsageStore
+	provider     Provider
+	policy       *QuotaPolicy
+	notifier     notify.Notifier
+	baseURL      string // the dashboard's origin emails link to; see SetNotifier
+	automaticTax bool
+	reconcile    reconcileState
+	auditKey     []byte
 }
 
-// NewService creates a new billing service
+// NewService creates a new billing service backed by Stripe, or by no
+// payment processor if stripeKey is empty
 func NewService(db *sql.DB, stripeKey string) *Service {
-	var stripeClient *StripeClient
+	var provider Provider
 	if stripeKey != "" {
-		stripeClient = NewStripeClient(stripeKey)
+		provider = NewStripeClient(stripeKey)
+	}
+	return NewServiceWithProvider(db, provider)
+}
+
+// NewServiceWithProvider creates a billing service backed by any payment
+// processor. A nil provider disables everything that needs one.
+func NewServiceWithProvider(db *sql.DB, provider Provider) *Service {
+	s := &Service{
+		db:       db,
+		provider: provider,
+		policy:   DefaultQuotaPolicy(),
 	}
-	return &Service{
-		db:     db,
-		stripe: stripeClient,
+	if db != nil {
+		pg := store.NewPostgres(db)
+		s.users, s.usage = pg, pg
 	}
+	return s
+}
+
+// SetStores overrides where users and usage are read from
+func (s *Service) SetStores(users store.UserStore, usage store.UsageStore) {
+	s.users, s.usage = users, usage
 }
 
 // RecordBandwidth records bandwidth usage for a user/tunnel
 func (s *Service) RecordBandwidth(ctx context.Context, userID, tunnelSessionID string, bytesIn, bytesOut int64) error {
-	if s.db == nil {
+	if s.usage == nil {
 		return nil // No-op if no database
 	}
-
-	query := `
-		INSERT INTO bandwidth_usage (user_id, tunnel_session_id, bytes_in, bytes_out, recorded_at)
-		VALUES ($1, $2, $3, $4, NOW())
-	`
-	_, err := s.db.ExecContext(ctx, query, userID, tunnelSessionID, bytesIn, bytesOut)
-	if err != nil {
-		return fmt.Errorf("record bandwidth: %w", err)
-	}
-	return nil
+	return s.usage.RecordBandwidth(ctx, userID, tunnelSessionID, bytesIn, bytesOut)
 }
 
 // GetUserUsage returns total usage for a user in the current billing period
 func (s *Service) GetUserUsage(ctx context.Context, userID string) (int64, error) {
-	if s.db == nil {
+	if s.usage == nil {
 		return 0, nil
 	}
-
-	// Get usage for current month
-	query := `
-		SELECT COALESCE(SUM(bytes_in + bytes_out), 0)
-		FROM bandwidth_usage
-		WHERE user_id = $1
-		AND recorded_at >= date_trunc('month', NOW())
-	`
-	var totalBytes int64
-	err := s.db.QueryRowContext(ctx, query, userID).Scan(&totalBytes)
-	if err != nil {
-		return 0, fmt.Errorf("get user usage: %w", err)
-	}
-	return totalBytes, nil
+	return s.usage.MonthlyUsage(ctx, userID)
 }
 
 // CheckQuota checks if user is within their quota
 // Returns (withinQuota, usedBytes, limitBytes, error)
 func (s *Service) CheckQuota(ctx context.Context, userID string) (bool, int64, int64, error) {
-	if s.db == nil {
+	if s.users == nil {
 		return true, 0, FreeTierBytes, nil
 	}
 
 	// Get user's plan
-	var plan string
-	err := s.db.QueryRowContext(ctx, "SELECT COALESCE(plan, 'free') FROM users WHERE id = $1", userID).Scan(&plan)
+	user, err := s.users.GetUser(ctx, userID)
 	if err != nil {
 		return false, 0, 0, fmt.Errorf("get user plan: %w", err)
 	}
+	plan := user.Plan
 
 	// Get current usage
 	usedBytes, err := s.GetUserUsage(ctx, userID)
@@ -124,8 +143,8 @@ func (s *Service) CheckQuota(ctx context.Context, userID string) (bool, int64, i
 		limitBytes = FreeTierBytes
 	case PlanPAYG:
 		limitBytes = -1 // No limit, just pay for usage
-	case PlanPro:
-		limitBytes = -1 // No limit for pro
+	case PlanPro, PlanTeam:
+		limitBytes = -1 // No limit for pro or team
 	default:
 		limitBytes = FreeTierBytes
 	}
@@ -139,57 +158,133 @@ func (s *Service) CheckQuota(ctx context.Context, userID string) (bool, int64, i
 
 // CreateCustomerForUser creates a Stripe customer for a user
 func (s *Service) CreateCustomerForUser(ctx context.Context, userID string, email, name string) (string, error) {
-	if s.stripe == nil {
-		return "", fmt.Errorf("stripe not configured")
+	return s.CreateCustomerWithBilling(ctx, userID, email, name, nil)
+}
+
+// UpgradeOptions holds optional promotion and trial settings for an upgrade
+type UpgradeOptions struct {
+	PromotionCode string // Customer-facing promotion code, e.g. "LAUNCH50"
+	TrialDays     int64  // Free trial length; 0 for none
+	Seats         int64  // Seats on a per-seat price; 0 for one
+}
+
+// UpgradeToPAYG upgrades a user to pay-as-you-go billing
+func (s *Service) UpgradeToPAYG(ctx context.Context, userID string, priceID string, opts *UpgradeOptions) error {
+	return s.subscribe(ctx, userID, priceID, PlanPAYG, opts)
+}
+
+// UpgradeToPro upgrades a user to the fixed-price Pro plan. The price sets
+// whether it renews monthly or yearly.
+func (s *Service) UpgradeToPro(ctx context.Context, userID string, priceID string, opts *UpgradeOptions) error {
+	return s.subscribe(ctx, userID, priceID, PlanPro, opts)
+}
+
+// UpgradeToTeam upgrades a user to the per-seat Team plan
+func (s *Service) UpgradeToTeam(ctx context.Context, userID string, priceID string, seats int64, opts *UpgradeOptions) error {
+	if err := validateSeats(seats); err != nil {
+		return err
+	}
+	if opts == nil {
+		opts = &UpgradeOptions{}
+	}
+	opts.Seats = seats
+	return s.subscribe(ctx, userID, priceID, PlanTeam, opts)
+}
+
+// SetSeats changes the seats on a user's team subscription. The provider
+// prorates the change onto the next invoice.
+func (s *Service) SetSeats(ctx context.Context, userID string, seats int64) error {
+	if s.db == nil || s.provider == nil {
+		return fmt.Errorf("billing not configured")
+	}
+	if err := validateSeats(seats); err != nil {
+		return err
 	}
 
-	// Create Stripe customer
-	customerID, err := s.stripe.CreateCustomer(email, name)
+	var plan, subscriptionID string
+	qctx, done := db.Timed(ctx, "billing.SetSeats.subscription")
+	err := s.db.QueryRowContext(qctx,
+		"SELECT COALESCE(plan, 'free'), COALESCE(stripe_subscription_id, '') FROM users WHERE id = $1",
+		userID).Scan(&plan, &subscriptionID)
+	done()
 	if err != nil {
-		return "", err
+		return fmt.Errorf("get subscription: %w", err)
+	}
+	if Plan(plan) != PlanTeam || subscriptionID == "" {
+		return fmt.Errorf("seats can only be changed on a team subscription")
 	}
 
-	// Save to database
-	if s.db != nil {
-		_, err = s.db.ExecContext(ctx,
-			"UPDATE users SET stripe_customer_id = $1 WHERE id = $2",
-			customerID, userID)
-		if err != nil {
-			return customerID, fmt.Errorf("save customer id: %w", err)
-		}
+	sub, err := s.provider.UpdateSeats(subscriptionID, seats)
+	if err != nil {
+		return err
 	}
 
-	return customerID, nil
+	qctx, done = db.Timed(ctx, "billing.SetSeats.terms")
+	_, err = s.db.ExecContext(qctx, `
+		UPDATE users
+		SET `+subscriptionTerms+`, updated_at = NOW()
+		WHERE id = $6
+	`, append(sub.termArgs(), userID)...)
+	done()
+	if err != nil {
+		return fmt.Errorf("update seats: %w", err)
+	}
+	return nil
 }
 
-// UpgradeToPAYG upgrades a user to pay-as-you-go billing
-func (s *Service) UpgradeToPAYG(ctx context.Context, userID string, priceID string) error {
-	if s.db == nil || s.stripe == nil {
+// validateSeats checks a requested seat count
+func validateSeats(seats int64) error {
+	if seats < 1 || seats > MaxSeats {
+		return fmt.Errorf("seats must be between 1 and %d", MaxSeats)
+	}
+	return nil
+}
+
+// subscribe creates a subscription for the user and records the plan and any trial end
+func (s *Service) subscribe(ctx context.Context, userID, priceID string, plan Plan, opts *UpgradeOptions) error {
+	if s.db == nil || s.provider == nil {
 		return fmt.Errorf("billing not configured")
 	}
 
-	// Get user's Stripe customer ID
+	// Get user's customer ID
 	var customerID string
-	err := s.db.QueryRowContext(ctx,
+	qctx, done := db.Timed(ctx, "billing.subscribe.customer")
+	err := s.db.QueryRowContext(qctx,
 		"SELECT stripe_customer_id FROM users WHERE id = $1", userID).Scan(&customerID)
+	done()
 	if err != nil {
 		return fmt.Errorf("get customer id: %w", err)
 	}
 
 	if customerID == "" {
-		return fmt.Errorf("user has no stripe customer")
+		return fmt.Errorf("user has no billing customer")
+	}
+
+	subOpts := &SubscriptionOptions{AutomaticTax: s.automaticTax}
+	if opts != nil {
+		subOpts.TrialDays = opts.TrialDays
+		subOpts.Seats = opts.Seats
+		if opts.PromotionCode != "" {
+			subOpts.PromotionCodeID, err = s.provider.LookupPromotionCode(opts.PromotionCode)
+			if err != nil {
+				return err
+			}
+		}
 	}
 
-	// Create metered subscription
-	sub, err := s.stripe.CreateMeteredSubscription(customerID, priceID)
+	sub, err := s.provider.CreateSubscription(customerID, priceID, subOpts)
 	if err != nil {
 		return err
 	}
 
 	// Update user's plan
-	_, err = s.db.ExecContext(ctx,
-		"UPDATE users SET plan = $1, stripe_subscription_id = $2 WHERE id = $3",
-		PlanPAYG, sub.ID, userID)
+	qctx, done = db.Timed(ctx, "billing.subscribe.plan")
+	_, err = s.db.ExecContext(qctx, `
+		UPDATE users
+		SET `+subscriptionTerms+`, plan = $6, stripe_subscription_id = $7, trial_ends_at = $8
+		WHERE id = $9
+	`, append(sub.termArgs(), plan, sub.ID, sub.TrialEnd, userID)...)
+	done()
 	if err != nil {
 		return fmt.Errorf("update user plan: %w", err)
 	}
@@ -197,24 +292,125 @@ func (s *Service) UpgradeToPAYG(ctx context.Context, userID string, priceID stri
 	return nil
 }
 
-// SyncUsageToStripe syncs unsynced usage records to Stripe
+// ExpireLapsedTrials downgrades users whose trial has ended without the
+// subscription becoming paid. Stripe cancels these subscriptions itself; this
+// sweep catches any cancellation webhook we missed, and is the only expiry
+// for providers without webhooks. Returns the number of
+// users downgraded.
+func (s *Service) ExpireLapsedTrials(ctx context.Context) (int, error) {
+	if s.db == nil || s.provider == nil {
+		return 0, nil
+	}
+
+	qctx, done := db.Timed(ctx, "billing.ExpireLapsedTrials")
+	rows, err := s.db.QueryContext(qctx, `
+		SELECT id, stripe_subscription_id
+		FROM users
+		WHERE trial_ends_at < NOW()
+		AND plan <> 'free'
+		AND stripe_subscription_id IS NOT NULL
+	`)
+	if err != nil {
+		done()
+		return 0, fmt.Errorf("query lapsed trials: %w", err)
+	}
+
+	type trialUser struct{ userID, subscriptionID string }
+	var users []trialUser
+	for rows.Next() {
+		var u trialUser
+		if err := rows.Scan(&u.userID, &u.subscriptionID); err != nil {
+			rows.Close()
+			done()
+			return 0, fmt.Errorf("scan row: %w", err)
+		}
+		users = append(users, u)
+	}
+	rows.Close()
+	done()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("query lapsed trials: %w", err)
+	}
+
+	downgraded := 0
+	for _, u := range users {
+		sub, err := s.provider.GetSubscription(u.subscriptionID)
+		if errors.Is(err, ErrSubscriptionNotFound) {
+			sub = &Subscription{ID: u.subscriptionID, Status: SubscriptionCanceled}
+		} else if err != nil {
+			return downgraded, err
+		}
+
+		if !trialLapsed(sub) {
+			// Converted to a paid subscription, the trial is over
+			qctx, done := db.Timed(ctx, "billing.ExpireLapsedTrials.clear")
+			_, err = s.db.ExecContext(qctx, "UPDATE users SET trial_ends_at = NULL WHERE id = $1", u.userID)
+			done()
+			if err != nil {
+				return downgraded, fmt.Errorf("clear trial end: %w", err)
+			}
+			continue
+		}
+
+		if sub.Status != SubscriptionCanceled {
+			if err := s.provider.CancelSubscription(sub.ID); err != nil {
+				return downgraded, err
+			}
+		}
+
+		qctx, done := db.Timed(ctx, "billing.ExpireLapsedTrials.downgrade")
+		_, err = s.db.ExecContext(qctx, `
+			UPDATE users
+			SET plan = 'free', stripe_subscription_id = NULL, trial_ends_at = NULL, `+clearSubscriptionTerms+`, updated_at = NOW()
+			WHERE id = $1
+		`, u.userID)
+		done()
+		if err != nil {
+			return downgraded, fmt.Errorf("downgrade user: %w", err)
+		}
+		downgraded++
+	}
+
+	return downgraded, nil
+}
+
+// trialLapsed reports whether a subscription whose trial has ended failed to
+// convert: it is no longer active, or there is no payment method to charge
+func trialLapsed(sub *Subscription) bool {
+	if sub.Status == SubscriptionTrialing {
+		return false
+	}
+	if sub.Status != SubscriptionActive {
+		return true
+	}
+	return !sub.HasPaymentMethod
+}
+
+// SyncUsageToStripe reports unsynced usage records to the billing provider
 func (s *Service) SyncUsageToStripe(ctx context.Context) error {
-	if s.db == nil || s.stripe == nil {
+	if s.db == nil || s.provider == nil {
 		return nil
 	}
 
-	// Get users with unsynced usage and active subscriptions
+	ctx, done := db.Timed(ctx, "billing.SyncUsageToStripe")
+	defer done()
+
+	// Get users with unsynced usage and active subscriptions. Bandwidth
+	// recorded after the cutoff is left for the next sync, so what is marked
+	// synced is exactly what was reported.
+	cutoff := time.Now()
 	query := `
 		SELECT u.id, u.stripe_subscription_id, SUM(bu.bytes_in + bu.bytes_out) as total_bytes
 		FROM users u
 		JOIN bandwidth_usage bu ON bu.user_id = u.id
 		WHERE bu.synced_to_stripe = FALSE
+		AND bu.recorded_at <= $1
 		AND u.stripe_subscription_id IS NOT NULL
 		AND u.plan IN ('payg', 'pro')
 		GROUP BY u.id, u.stripe_subscription_id
 	`
 
-	rows, err := s.db.QueryContext(ctx, query)
+	rows, err := s.db.QueryContext(ctx, query, cutoff)
 	if err != nil {
 		return fmt.Errorf("query unsynced usage: %w", err)
 	}
@@ -230,45 +426,76 @@ func (s *Service) SyncUsageToStripe(ctx context.Context) error {
 		}
 
 		// Get subscription to find the subscription item ID
-		sub, err := s.stripe.GetSubscription(subscriptionID)
+		sub, err := s.provider.GetSubscription(subscriptionID)
 		if err != nil {
 			return fmt.Errorf("get subscription: %w", err)
 		}
 
-		if len(sub.Items.Data) == 0 {
+		if sub.ItemID == "" {
 			continue
 		}
 
 		// Report usage
-		err = s.stripe.ReportUsage(sub.Items.Data[0].ID, totalBytes)
+		itemID := sub.ItemID
+		err = s.provider.ReportUsage(itemID, totalBytes)
 		if err != nil {
 			return fmt.Errorf("report usage for user %s: %w", userID, err)
 		}
 
-		// Mark as synced
-		_, err = s.db.ExecContext(ctx,
-			"UPDATE bandwidth_usage SET synced_to_stripe = TRUE WHERE user_id = $1 AND synced_to_stripe = FALSE",
-			userID)
+		if err := s.markReported(ctx, userID, itemID, totalBytes, cutoff); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// markReported keeps a signed record of a usage report sent to Stripe and
+// marks the bandwidth it covered as synced
+func (s *Service) markReported(ctx context.Context, userID, itemID string, bytes int64, cutoff time.Time) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	if quantity := usageQuantity(bytes); quantity > 0 {
+		r := UsageReport{SubscriptionItemID: itemID, Bytes: bytes, Quantity: quantity, ReportedAt: time.Now().UTC().Truncate(time.Second)}
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO usage_reports (user_id, subscription_item_id, bytes, quantity, signature, reported_at)
+			VALUES ($1, $2, $3, $4, $5, $6)
+		`, userID, itemID, r.Bytes, r.Quantity, s.sign(reportFields(userID, r)...), r.ReportedAt)
 		if err != nil {
-			return fmt.Errorf("mark synced: %w", err)
+			return fmt.Errorf("record usage report: %w", err)
 		}
 	}
 
+	_, err = tx.ExecContext(ctx,
+		"UPDATE bandwidth_usage SET synced_to_stripe = TRUE WHERE user_id = $1 AND synced_to_stripe = FALSE AND recorded_at <= $2",
+		userID, cutoff)
+	if err != nil {
+		return fmt.Errorf("mark synced: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit: %w", err)
+	}
 	return nil
 }
 
 // GetUsageSummary returns a usage summary for a user
 type UsageSummary struct {
-	UserID      string
-	Plan        Plan
-	UsedBytes   int64
-	LimitBytes  int64
-	UsedGB      float64
-	LimitGB     float64
-	PercentUsed float64
-	OverLimit   bool
-	PeriodStart time.Time
-	PeriodEnd   time.Time
+	UserID         string
+	Plan           Plan
+	UsedBytes      int64
+	LimitBytes     int64
+	RemainingBytes int64 // -1 for unlimited plans
+	UsedGB         float64
+	LimitGB        float64
+	PercentUsed    float64
+	OverLimit      bool
+	Level          QuotaLevel
+	PeriodStart    time.Time
+	PeriodEnd      time.Time
 }
 
 func (s *Service) GetUsageSummary(ctx context.Context, userID string) (*UsageSummary, error) {
@@ -279,8 +506,10 @@ func (s *Service) GetUsageSummary(ctx context.Context, userID string) (*UsageSum
 
 	// Get user's plan
 	var plan string
-	if s.db != nil {
-		s.db.QueryRowContext(ctx, "SELECT COALESCE(plan, 'free') FROM users WHERE id = $1", userID).Scan(&plan)
+	if s.users != nil {
+		if user, err := s.users.GetUser(ctx, userID); err == nil {
+			plan = user.Plan
+		}
 	}
 	if plan == "" {
 		plan = string(PlanFree)
@@ -301,10 +530,13 @@ func (s *Service) GetUsageSummary(ctx context.Context, userID string) (*UsageSum
 		OverLimit:   !withinQuota,
 	}
 
+	summary.RemainingBytes = -1
 	if limitBytes > 0 {
 		summary.LimitGB = BytesToGB(limitBytes)
 		summary.PercentUsed = float64(usedBytes) / float64(limitBytes) * 100
+		summary.RemainingBytes = max(limitBytes-usedBytes, 0)
 	}
+	summary.Level = s.policy.Level(summary.Plan, usedBytes, limitBytes)
 
 	return summary, nil
 }
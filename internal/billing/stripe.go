@@ -2,15 +2,21 @@
 package billing
 
 import (
+	"errors"
 	"fmt"
+	"time"
 
 	"github.com/stripe/stripe-go/v76"
 	"github.com/stripe/stripe-go/v76/customer"
+	"github.com/stripe/stripe-go/v76/invoice"
+	"github.com/stripe/stripe-go/v76/promotioncode"
 	"github.com/stripe/stripe-go/v76/subscription"
+	"github.com/stripe/stripe-go/v76/subscriptionitem"
+	"github.com/stripe/stripe-go/v76/taxid"
 	"github.com/stripe/stripe-go/v76/usagerecord"
 )
 
-// StripeClient wraps Stripe API operations
+// StripeClient is the Stripe billing Provider
 type StripeClient struct {
 	apiKey string
 }
@@ -21,12 +27,23 @@ func NewStripeClient(apiKey string) *StripeClient {
 	return &StripeClient{apiKey: apiKey}
 }
 
-// CreateCustomer creates a new Stripe customer
-func (c *StripeClient) CreateCustomer(email, name string) (string, error) {
+// CreateCustomer creates a new Stripe customer, with optional billing details
+func (c *StripeClient) CreateCustomer(email, name string, details *BillingDetails) (string, error) {
 	params := &stripe.CustomerParams{
 		Email: stripe.String(email),
 		Name:  stripe.String(name),
 	}
+	if details != nil {
+		params.Address = addressParams(details.Address)
+		if details.TaxID != "" {
+			params.TaxIDData = []*stripe.CustomerTaxIDDataParams{
+				{
+					Type:  stripe.String(details.TaxIDType),
+					Value: stripe.String(details.TaxID),
+				},
+			}
+		}
+	}
 
 	cust, err := customer.New(params)
 	if err != nil {
@@ -62,8 +79,87 @@ func (c *StripeClient) UpdateCustomer(customerID, email, name string) error {
 	return nil
 }
 
+// SubscriptionOptions holds optional settings for a new subscription
+type SubscriptionOptions struct {
+	PromotionCodeID string // Stripe promotion code ID (promo_...)
+	TrialDays       int64  // Length of the free trial; 0 for none
+	AutomaticTax    bool   // Let Stripe Tax compute tax from the customer's address
+	Seats           int64  // Quantity of a per-seat price; 0 for one
+}
+
+// addressParams converts an Address into Stripe request params
+func addressParams(a Address) *stripe.AddressParams {
+	params := &stripe.AddressParams{
+		Line1:      stripe.String(a.Line1),
+		City:       stripe.String(a.City),
+		PostalCode: stripe.String(a.PostalCode),
+		Country:    stripe.String(a.Country),
+	}
+	if a.Line2 != "" {
+		params.Line2 = stripe.String(a.Line2)
+	}
+	if a.State != "" {
+		params.State = stripe.String(a.State)
+	}
+	return params
+}
+
+// UpdateCustomerAddress sets a customer's billing address, used by Stripe Tax
+func (c *StripeClient) UpdateCustomerAddress(customerID string, address Address) error {
+	params := &stripe.CustomerParams{
+		Address: addressParams(address),
+	}
+
+	_, err := customer.Update(customerID, params)
+	if err != nil {
+		return fmt.Errorf("update customer address: %w", err)
+	}
+	return nil
+}
+
+// AddTaxID attaches a tax ID (e.g. an EU VAT number) to a customer
+func (c *StripeClient) AddTaxID(customerID, taxIDType, value string) error {
+	params := &stripe.TaxIDParams{
+		Customer: stripe.String(customerID),
+		Type:     stripe.String(taxIDType),
+		Value:    stripe.String(value),
+	}
+
+	_, err := taxid.New(params)
+	if err != nil {
+		return fmt.Errorf("add tax id: %w", err)
+	}
+	return nil
+}
+
+// UpcomingInvoice previews the next invoice for a subscription
+func (c *StripeClient) UpcomingInvoice(customerID, subscriptionID string) (*InvoicePreview, error) {
+	params := &stripe.InvoiceUpcomingParams{
+		Customer:     stripe.String(customerID),
+		Subscription: stripe.String(subscriptionID),
+	}
+
+	inv, err := invoice.Upcoming(params)
+	if err != nil {
+		return nil, fmt.Errorf("upcoming invoice: %w", err)
+	}
+	return &InvoicePreview{
+		Currency: string(inv.Currency),
+		Subtotal: inv.Subtotal,
+		Tax:      inv.Tax,
+		Total:    inv.Total,
+	}, nil
+}
+
 // CreateMeteredSubscription creates a subscription with metered billing
-func (c *StripeClient) CreateMeteredSubscription(customerID, priceID string) (*stripe.Subscription, error) {
+func (c *StripeClient) CreateMeteredSubscription(customerID, priceID string, opts *SubscriptionOptions) (*Subscription, error) {
+	return c.CreateSubscription(customerID, priceID, opts)
+}
+
+// CreateSubscription creates a subscription for a single price, applying any
+// promotion code and trial period. Trials that end without a payment method
+// on file are canceled by Stripe rather than invoiced.
+func (c *StripeClient) CreateSubscription(customerID, priceID string, opts *SubscriptionOptions) (*Subscription, error) {
 	params := &stripe.SubscriptionParams{
 		Customer: stripe.String(customerID),
 		Items: []*stripe.SubscriptionItemsParams{
@@ -73,21 +169,141 @@ func (c *StripeClient) CreateMeteredSubscription(customerID, priceID string) (*s
 		},
 	}
 
+	if opts != nil {
+		if opts.Seats > 0 {
+			params.Items[0].Quantity = stripe.Int64(opts.Seats)
+		}
+		if opts.AutomaticTax {
+			params.AutomaticTax = &stripe.SubscriptionAutomaticTaxParams{
+				Enabled: stripe.Bool(true),
+			}
+		}
+		if opts.PromotionCodeID != "" {
+			params.PromotionCode = stripe.String(opts.PromotionCodeID)
+		}
+		if opts.TrialDays > 0 {
+			params.TrialPeriodDays = stripe.Int64(opts.TrialDays)
+			params.TrialSettings = &stripe.SubscriptionTrialSettingsParams{
+				EndBehavior: &stripe.SubscriptionTrialSettingsEndBehaviorParams{
+					MissingPaymentMethod: stripe.String(string(stripe.SubscriptionTrialSettingsEndBehaviorMissingPaymentMethodCancel)),
+				},
+			}
+		}
+	}
+
 	sub, err := subscription.New(params)
 	if err != nil {
 		return nil, fmt.Errorf("create subscription: %w", err)
 	}
 
-	return sub, nil
+	return fromStripeSubscription(sub), nil
 }
 
-// GetSubscription retrieves a subscription by ID
-func (c *StripeClient) GetSubscription(subscriptionID string) (*stripe.Subscription, error) {
-	sub, err := subscription.Get(subscriptionID, nil)
+// LookupPromotionCode resolves a customer-facing code to an active promotion code ID
+func (c *StripeClient) LookupPromotionCode(code string) (string, error) {
+	params := &stripe.PromotionCodeListParams{
+		Code:   stripe.String(code),
+		Active: stripe.Bool(true),
+	}
+	params.Limit = stripe.Int64(1)
+
+	iter := promotioncode.List(params)
+	if iter.Next() {
+		return iter.PromotionCode().ID, nil
+	}
+	if err := iter.Err(); err != nil {
+		return "", fmt.Errorf("lookup promotion code: %w", err)
+	}
+	return "", fmt.Errorf("promotion code %q not found", code)
+}
+
+// GetSubscription retrieves a subscription by ID, with its customer expanded
+func (c *StripeClient) GetSubscription(subscriptionID string) (*Subscription, error) {
+	params := &stripe.SubscriptionParams{}
+	params.AddExpand("customer")
+	sub, err := subscription.Get(subscriptionID, params)
+	if isResourceMissing(err) {
+		return nil, ErrSubscriptionNotFound
+	}
 	if err != nil {
 		return nil, fmt.Errorf("get subscription: %w", err)
 	}
-	return sub, nil
+	return fromStripeSubscription(sub), nil
+}
+
+// fromStripeSubscription converts a Stripe subscription for the billing service
+func fromStripeSubscription(sub *stripe.Subscription) *Subscription {
+	s := &Subscription{
+		ID:       sub.ID,
+		Status:   string(sub.Status),
+		Plan:     Plan(determinePlan(sub)),
+		TrialEnd: trialEnd(sub),
+	}
+	if sub.CurrentPeriodEnd != 0 {
+		t := time.Unix(sub.CurrentPeriodEnd, 0)
+		s.RenewsAt = &t
+	}
+	s.Interval, s.Seats = IntervalMonth, 1
+	if sub.Items != nil && len(sub.Items.Data) > 0 {
+		item := sub.Items.Data[0]
+		s.ItemID = item.ID
+		s.Seats = max(item.Quantity, 1)
+		if item.Price != nil {
+			s.Currency = string(item.Price.Currency)
+			if r := item.Price.Recurring; r != nil {
+				if r.Interval == stripe.PriceRecurringIntervalYear {
+					s.Interval = IntervalYear
+				}
+				if r.UsageType != stripe.PriceRecurringUsageTypeMetered {
+					s.RenewalAmount = item.Price.UnitAmount * s.Seats
+				}
+			}
+		}
+	}
+	// A card on the customer (e.g. added through the portal) is charged too
+	if sub.DefaultPaymentMethod != nil {
+		s.HasPaymentMethod = true
+	}
+	if sub.Customer != nil && sub.Customer.InvoiceSettings != nil && sub.Customer.InvoiceSettings.DefaultPaymentMethod != nil {
+		s.HasPaymentMethod = true
+	}
+	return s
+}
+
+// trialEnd returns the subscription's trial end, or nil if it has no trial
+func trialEnd(sub *stripe.Subscription) *time.Time {
+	if sub.TrialEnd == 0 {
+		return nil
+	}
+	t := time.Unix(sub.TrialEnd, 0)
+	return &t
+}
+
+// isResourceMissing reports whether a Stripe error means the object doesn't exist
+func isResourceMissing(err error) bool {
+	var stripeErr *stripe.Error
+	return errors.As(err, &stripeErr) && stripeErr.Code == stripe.ErrorCodeResourceMissing
+}
+
+// UpdateSeats changes the quantity of a subscription's price. Stripe
+// prorates the change onto the next invoice.
+func (c *StripeClient) UpdateSeats(subscriptionID string, seats int64) (*Subscription, error) {
+	sub, err := c.GetSubscription(subscriptionID)
+	if err != nil {
+		return nil, err
+	}
+	if sub.ItemID == "" {
+		return nil, fmt.Errorf("update seats: subscription %s has no items", subscriptionID)
+	}
+
+	params := &stripe.SubscriptionItemParams{
+		Quantity:          stripe.Int64(seats),
+		ProrationBehavior: stripe.String("create_prorations"),
+	}
+	if _, err := subscriptionitem.Update(sub.ItemID, params); err != nil {
+		return nil, fmt.Errorf("update seats: %w", err)
+	}
+	return c.GetSubscription(subscriptionID)
 }
 
 // CancelSubscription cancels a subscription
@@ -102,12 +318,7 @@ func (c *StripeClient) CancelSubscription(subscriptionID string) error {
 // ReportUsage reports bandwidth usage to Stripe for metered billing
 // bytes is the amount of data transferred
 func (c *StripeClient) ReportUsage(subscriptionItemID string, bytes int64) error {
-	// Convert bytes to MB for billing (minimum 1 MB)
-	mbUsed := bytes / (1024 * 1024)
-	if mbUsed == 0 && bytes > 0 {
-		mbUsed = 1 // Minimum 1 MB if any data transferred
-	}
-
+	mbUsed := usageQuantity(bytes)
 	if mbUsed == 0 {
 		return nil // No usage to report
 	}
@@ -126,6 +337,16 @@ func (c *StripeClient) ReportUsage(subscriptionItemID string, bytes int64) error
 	return nil
 }
 
+// usageQuantity converts bytes to the MB billed for them, with a minimum of
+// 1 MB if any data was transferred
+func usageQuantity(bytes int64) int64 {
+	mbUsed := bytes / (1024 * 1024)
+	if mbUsed == 0 && bytes > 0 {
+		mbUsed = 1
+	}
+	return mbUsed
+}
+
 // BytesToGB converts bytes to gigabytes (for display)
 func BytesToGB(bytes int64) float64 {
 	return float64(bytes) / (1024 * 1024 * 1024)
@@ -0,0 +1,210 @@
+// internal/billing/tax.go
+package billing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/lobber-dev/lobber/internal/db"
+)
+
+// Address is a customer's billing address
+type Address struct {
+	Line1      string `json:"line1"`
+	Line2      string `json:"line2,omitempty"`
+	City       string `json:"city"`
+	State      string `json:"state,omitempty"`
+	PostalCode string `json:"postal_code"`
+	Country    string `json:"country"` // ISO 3166-1 alpha-2, e.g. "DE"
+}
+
+// BillingDetails holds the address and tax ID collected for invoicing
+type BillingDetails struct {
+	Address   Address `json:"address"`
+	TaxIDType string  `json:"tax_id_type,omitempty"` // Stripe tax ID type, e.g. "eu_vat"
+	TaxID     string  `json:"tax_id,omitempty"`      // e.g. "DE123456789"
+}
+
+// InvoicePreview summarizes a user's upcoming invoice, in the currency's minor unit
+type InvoicePreview struct {
+	Currency string `json:"currency"`
+	Subtotal int64  `json:"subtotal"`
+	Tax      int64  `json:"tax"`
+	Total    int64  `json:"total"`
+}
+
+// Validate checks the billing details are complete enough for Stripe Tax
+func (d *BillingDetails) Validate() error {
+	country := strings.TrimSpace(d.Address.Country)
+	if len(country) != 2 {
+		return fmt.Errorf("country must be a two-letter ISO code")
+	}
+	if strings.TrimSpace(d.Address.PostalCode) == "" {
+		return fmt.Errorf("postal code is required")
+	}
+	if (d.TaxID == "") != (d.TaxIDType == "") {
+		return fmt.Errorf("tax ID and tax ID type must be provided together")
+	}
+	return nil
+}
+
+// normalize trims fields and upper-cases the country and tax ID
+func (d *BillingDetails) normalize() {
+	d.Address.Line1 = strings.TrimSpace(d.Address.Line1)
+	d.Address.Line2 = strings.TrimSpace(d.Address.Line2)
+	d.Address.City = strings.TrimSpace(d.Address.City)
+	d.Address.State = strings.TrimSpace(d.Address.State)
+	d.Address.PostalCode = strings.TrimSpace(d.Address.PostalCode)
+	d.Address.Country = strings.ToUpper(strings.TrimSpace(d.Address.Country))
+	d.TaxIDType = strings.ToLower(strings.TrimSpace(d.TaxIDType))
+	d.TaxID = strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(d.TaxID), " ", ""))
+}
+
+// CreateCustomerWithBilling creates a billing customer with a billing address and tax ID
+func (s *Service) CreateCustomerWithBilling(ctx context.Context, userID, email, name string, details *BillingDetails) (string, error) {
+	if s.provider == nil {
+		return "", fmt.Errorf("billing not configured")
+	}
+
+	if details != nil {
+		details.normalize()
+		if err := details.Validate(); err != nil {
+			return "", err
+		}
+	}
+
+	customerID, err := s.provider.CreateCustomer(email, name, details)
+	if err != nil {
+		return "", err
+	}
+
+	if s.db != nil {
+		qctx, done := db.Timed(ctx, "billing.CreateCustomerWithBilling")
+		_, err = s.db.ExecContext(qctx,
+			"UPDATE users SET stripe_customer_id = $1 WHERE id = $2",
+			customerID, userID)
+		done()
+		if err != nil {
+			return customerID, fmt.Errorf("save customer id: %w", err)
+		}
+		if details != nil {
+			if err := s.saveBillingDetails(ctx, userID, details); err != nil {
+				return customerID, err
+			}
+		}
+	}
+
+	return customerID, nil
+}
+
+// UpdateBillingDetails updates the billing address and tax ID on the user's billing customer
+func (s *Service) UpdateBillingDetails(ctx context.Context, userID string, details *BillingDetails) error {
+	if s.db == nil || s.provider == nil {
+		return fmt.Errorf("billing not configured")
+	}
+
+	details.normalize()
+	if err := details.Validate(); err != nil {
+		return err
+	}
+
+	var customerID, currentTaxID string
+	qctx, done := db.Timed(ctx, "billing.UpdateBillingDetails")
+	err := s.db.QueryRowContext(qctx,
+		"SELECT COALESCE(stripe_customer_id, ''), COALESCE(tax_id, '') FROM users WHERE id = $1",
+		userID).Scan(&customerID, &currentTaxID)
+	done()
+	if err != nil {
+		return fmt.Errorf("get customer id: %w", err)
+	}
+	if customerID == "" {
+		return fmt.Errorf("user has no billing customer")
+	}
+
+	if err := s.provider.UpdateCustomerAddress(customerID, details.Address); err != nil {
+		return err
+	}
+	if details.TaxID != "" && details.TaxID != currentTaxID {
+		if err := s.provider.AddTaxID(customerID, details.TaxIDType, details.TaxID); err != nil {
+			return err
+		}
+	}
+
+	return s.saveBillingDetails(ctx, userID, details)
+}
+
+// saveBillingDetails stores the billing details locally for display
+func (s *Service) saveBillingDetails(ctx context.Context, userID string, details *BillingDetails) error {
+	ctx, done := db.Timed(ctx, "billing.saveBillingDetails")
+	defer done()
+
+	address, err := json.Marshal(details.Address)
+	if err != nil {
+		return fmt.Errorf("marshal address: %w", err)
+	}
+
+	_, err = s.db.ExecContext(ctx, `
+		UPDATE users
+		SET billing_address = $1, tax_id_type = NULLIF($2, ''), tax_id = NULLIF($3, ''), updated_at = NOW()
+		WHERE id = $4
+	`, address, details.TaxIDType, details.TaxID, userID)
+	if err != nil {
+		return fmt.Errorf("save billing details: %w", err)
+	}
+	return nil
+}
+
+// GetBillingDetails returns the billing details stored for a user, or nil if none
+func (s *Service) GetBillingDetails(ctx context.Context, userID string) (*BillingDetails, error) {
+	if s.db == nil {
+		return nil, nil
+	}
+
+	ctx, done := db.Timed(ctx, "billing.GetBillingDetails")
+	defer done()
+
+	var address []byte
+	details := &BillingDetails{}
+	err := s.db.QueryRowContext(ctx,
+		"SELECT billing_address, COALESCE(tax_id_type, ''), COALESCE(tax_id, '') FROM users WHERE id = $1",
+		userID).Scan(&address, &details.TaxIDType, &details.TaxID)
+	if err != nil {
+		return nil, fmt.Errorf("get billing details: %w", err)
+	}
+	if len(address) == 0 {
+		return nil, nil
+	}
+	if err := json.Unmarshal(address, &details.Address); err != nil {
+		return nil, fmt.Errorf("unmarshal address: %w", err)
+	}
+	return details, nil
+}
+
+// GetUpcomingInvoice previews the user's next invoice, including computed tax
+func (s *Service) GetUpcomingInvoice(ctx context.Context, userID string) (*InvoicePreview, error) {
+	if s.db == nil || s.provider == nil {
+		return nil, fmt.Errorf("billing not configured")
+	}
+
+	var customerID, subscriptionID string
+	qctx, done := db.Timed(ctx, "billing.GetUpcomingInvoice")
+	err := s.db.QueryRowContext(qctx,
+		"SELECT COALESCE(stripe_customer_id, ''), COALESCE(stripe_subscription_id, '') FROM users WHERE id = $1",
+		userID).Scan(&customerID, &subscriptionID)
+	done()
+	if err != nil {
+		return nil, fmt.Errorf("get subscription: %w", err)
+	}
+	if customerID == "" || subscriptionID == "" {
+		return nil, fmt.Errorf("user has no subscription")
+	}
+
+	return s.provider.UpcomingInvoice(customerID, subscriptionID)
+}
+
+// SetAutomaticTax enables Stripe Tax on new subscriptions
+func (s *Service) SetAutomaticTax(enabled bool) {
+	s.automaticTax = enabled
+}
@@ -0,0 +1,76 @@
+package billing
+
+import (
+	"testing"
+)
+
+func TestBillingDetailsValidate(t *testing.T) {
+	valid := Address{Line1: "Hauptstr. 1", City: "Berlin", PostalCode: "10115", Country: "DE"}
+
+	tests := []struct {
+		name    string
+		details BillingDetails
+		wantErr bool
+	}{
+		{"address only", BillingDetails{Address: valid}, false},
+		{"with vat", BillingDetails{Address: valid, TaxIDType: "eu_vat", TaxID: "DE123456789"}, false},
+		{"bad country", BillingDetails{Address: Address{PostalCode: "10115", Country: "Germany"}}, true},
+		{"missing postal code", BillingDetails{Address: Address{Country: "DE"}}, true},
+		{"tax id without type", BillingDetails{Address: valid, TaxID: "DE123456789"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.details.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestBillingDetailsNormalize(t *testing.T) {
+	d := &BillingDetails{
+		Address:   Address{Country: " de ", PostalCode: " 10115 "},
+		TaxIDType: "EU_VAT",
+		TaxID:     "de 123 456 789",
+	}
+	d.normalize()
+
+	if d.Address.Country != "DE" {
+		t.Errorf("Country = %q, want %q", d.Address.Country, "DE")
+	}
+	if d.Address.PostalCode != "10115" {
+		t.Errorf("PostalCode = %q, want %q", d.Address.PostalCode, "10115")
+	}
+	if d.TaxIDType != "eu_vat" {
+		t.Errorf("TaxIDType = %q, want %q", d.TaxIDType, "eu_vat")
+	}
+	if d.TaxID != "DE123456789" {
+		t.Errorf("TaxID = %q, want %q", d.TaxID, "DE123456789")
+	}
+}
+
+func TestAddressParamsOmitsEmptyOptionalFields(t *testing.T) {
+	params := addressParams(Address{Line1: "1 Main St", City: "Dublin", PostalCode: "D01", Country: "IE"})
+
+	if params.Line2 != nil {
+		t.Error("Line2 should be omitted when empty")
+	}
+	if params.State != nil {
+		t.Error("State should be omitted when empty")
+	}
+	if params.Country == nil || *params.Country != "IE" {
+		t.Errorf("Country = %v, want IE", params.Country)
+	}
+}
+
+func TestServiceBillingDetailsNoStripe(t *testing.T) {
+	svc := NewService(nil, "")
+	if err := svc.UpdateBillingDetails(nil, "user-1", &BillingDetails{}); err == nil {
+		t.Error("UpdateBillingDetails without Stripe should error")
+	}
+	if _, err := svc.GetUpcomingInvoice(nil, "user-1"); err == nil {
+		t.Error("GetUpcomingInvoice without Stripe should error")
+	}
+}
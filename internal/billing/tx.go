@@ -0,0 +1,40 @@
+// internal/billing/tx.go
+package billing
+
+import (
+	"context"
+	"database/sql"
+)
+
+type txKey struct{}
+
+// txState is carried in the context while an event is applied inside a transaction
+type txState struct {
+	tx          *sql.Tx
+	afterCommit []func()
+}
+
+// withTx returns a context whose handlers write through tx
+func withTx(ctx context.Context, tx *sql.Tx) (context.Context, *txState) {
+	st := &txState{tx: tx}
+	return context.WithValue(ctx, txKey{}, st), st
+}
+
+// execFor returns the transaction in ctx, or the handler's default execer
+func (h *WebhookHandler) execFor(ctx context.Context) execer {
+	if st, ok := ctx.Value(txKey{}).(*txState); ok {
+		return st.tx
+	}
+	return h.exec
+}
+
+// afterCommit defers a side effect such as an email until the transaction in
+// ctx commits, so a rolled back event doesn't notify anyone. Without a
+// transaction fn runs immediately.
+func afterCommit(ctx context.Context, fn func()) {
+	if st, ok := ctx.Value(txKey{}).(*txState); ok {
+		st.afterCommit = append(st.afterCommit, fn)
+		return
+	}
+	fn()
+}
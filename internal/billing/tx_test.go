@@ -0,0 +1,39 @@
+package billing
+
+import (
+	"context"
+	"testing"
+)
+
+func TestAfterCommit(t *testing.T) {
+	ran := false
+	afterCommit(context.Background(), func() { ran = true })
+	if !ran {
+		t.Error("afterCommit without a transaction should run immediately")
+	}
+
+	ctx, st := withTx(context.Background(), nil)
+	ran = false
+	afterCommit(ctx, func() { ran = true })
+	if ran {
+		t.Error("afterCommit inside a transaction should wait for commit")
+	}
+	if len(st.afterCommit) != 1 {
+		t.Errorf("queued hooks = %d, want 1", len(st.afterCommit))
+	}
+}
+
+func TestExecForPrefersTransaction(t *testing.T) {
+	rec := &recordingExec{}
+	h := NewWebhookHandler(nil, "", nil)
+	h.exec = rec
+
+	if got := h.execFor(context.Background()); got != rec {
+		t.Errorf("execFor() without a transaction = %v, want the handler's execer", got)
+	}
+
+	ctx, _ := withTx(context.Background(), nil)
+	if got := h.execFor(ctx); got == rec {
+		t.Error("execFor() inside a transaction should use the transaction")
+	}
+}
@@ -0,0 +1,145 @@
+// internal/billing/usage.go
+package billing
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/lobber-dev/lobber/internal/db"
+)
+
+// MaxUsageDays is the longest window GetDailyUsage will report
+const MaxUsageDays = 90
+
+// DomainUsage is a domain's bandwidth and request count for the current billing period
+type DomainUsage struct {
+	Domain     string `json:"domain"`
+	BytesIn    int64  `json:"bytes_in"`
+	BytesOut   int64  `json:"bytes_out"`
+	TotalBytes int64  `json:"total_bytes"`
+	Requests   int64  `json:"requests"`
+}
+
+// DailyUsage is a user's bandwidth and request count for one day
+type DailyUsage struct {
+	Date       time.Time `json:"date"`
+	BytesIn    int64     `json:"bytes_in"`
+	BytesOut   int64     `json:"bytes_out"`
+	TotalBytes int64     `json:"total_bytes"`
+	Requests   int64     `json:"requests"`
+}
+
+// GetUsageByDomain breaks the current billing period's usage down by domain,
+// heaviest first. Bandwidth recorded without a tunnel session can't be
+// attributed to a domain and is left out.
+func (s *Service) GetUsageByDomain(ctx context.Context, userID string) ([]DomainUsage, error) {
+	if s.db == nil {
+		return nil, nil
+	}
+
+	ctx, done := db.Timed(ctx, "billing.GetUsageByDomain")
+	defer done()
+
+	rows, err := s.db.QueryContext(ctx, `
+		WITH bytes AS (
+			SELECT ts.domain_id, SUM(bu.bytes_in) AS bytes_in, SUM(bu.bytes_out) AS bytes_out
+			FROM bandwidth_usage bu
+			JOIN tunnel_sessions ts ON ts.id = bu.tunnel_session_id
+			WHERE bu.user_id = $1
+			AND bu.recorded_at >= date_trunc('month', NOW())
+			GROUP BY ts.domain_id
+		), reqs AS (
+			SELECT r.domain_id, COUNT(*) AS requests
+			FROM request_logs r
+			JOIN domains d ON d.id = r.domain_id
+			WHERE d.user_id = $1
+			AND r.created_at >= date_trunc('month', NOW())
+			GROUP BY r.domain_id
+		)
+		SELECT d.hostname, COALESCE(b.bytes_in, 0), COALESCE(b.bytes_out, 0), COALESCE(q.requests, 0)
+		FROM domains d
+		LEFT JOIN bytes b ON b.domain_id = d.id
+		LEFT JOIN reqs q ON q.domain_id = d.id
+		WHERE d.user_id = $1
+		ORDER BY COALESCE(b.bytes_in, 0) + COALESCE(b.bytes_out, 0) DESC, d.hostname
+	`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("query domain usage: %w", err)
+	}
+	defer rows.Close()
+
+	var usage []DomainUsage
+	for rows.Next() {
+		var u DomainUsage
+		if err := rows.Scan(&u.Domain, &u.BytesIn, &u.BytesOut, &u.Requests); err != nil {
+			return nil, fmt.Errorf("scan row: %w", err)
+		}
+		u.TotalBytes = u.BytesIn + u.BytesOut
+		usage = append(usage, u)
+	}
+	return usage, rows.Err()
+}
+
+// GetDailyUsage returns one entry per day for the last days days, oldest
+// first and including today. Days without traffic are reported as zero.
+func (s *Service) GetDailyUsage(ctx context.Context, userID string, days int) ([]DailyUsage, error) {
+	if s.db == nil {
+		return nil, nil
+	}
+
+	ctx, done := db.Timed(ctx, "billing.GetDailyUsage")
+	defer done()
+	days = clampUsageDays(days)
+
+	rows, err := s.db.QueryContext(ctx, `
+		WITH days AS (
+			SELECT generate_series(
+				date_trunc('day', NOW()) - ($2::INT - 1) * INTERVAL '1 day',
+				date_trunc('day', NOW()),
+				INTERVAL '1 day'
+			) AS day
+		), bytes AS (
+			SELECT date_trunc('day', recorded_at) AS day, SUM(bytes_in) AS bytes_in, SUM(bytes_out) AS bytes_out
+			FROM bandwidth_usage
+			WHERE user_id = $1
+			AND recorded_at >= date_trunc('day', NOW()) - ($2::INT - 1) * INTERVAL '1 day'
+			GROUP BY 1
+		), reqs AS (
+			SELECT date_trunc('day', r.created_at) AS day, COUNT(*) AS requests
+			FROM request_logs r
+			JOIN domains d ON d.id = r.domain_id
+			WHERE d.user_id = $1
+			AND r.created_at >= date_trunc('day', NOW()) - ($2::INT - 1) * INTERVAL '1 day'
+			GROUP BY 1
+		)
+		SELECT days.day, COALESCE(b.bytes_in, 0), COALESCE(b.bytes_out, 0), COALESCE(q.requests, 0)
+		FROM days
+		LEFT JOIN bytes b USING (day)
+		LEFT JOIN reqs q USING (day)
+		ORDER BY days.day
+	`, userID, days)
+	if err != nil {
+		return nil, fmt.Errorf("query daily usage: %w", err)
+	}
+	defer rows.Close()
+
+	var usage []DailyUsage
+	for rows.Next() {
+		var u DailyUsage
+		if err := rows.Scan(&u.Date, &u.BytesIn, &u.BytesOut, &u.Requests); err != nil {
+			return nil, fmt.Errorf("scan row: %w", err)
+		}
+		u.TotalBytes = u.BytesIn + u.BytesOut
+		usage = append(usage, u)
+	}
+	return usage, rows.Err()
+}
+
+// clampUsageDays keeps a requested window between 1 and MaxUsageDays, defaulting to 30
+func clampUsageDays(days int) int {
+	if days <= 0 {
+		return 30
+	}
+	return min(days, MaxUsageDays)
+}
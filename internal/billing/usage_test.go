@@ -0,0 +1,40 @@
+package billing
+
+import (
+	"context"
+	"testing"
+)
+
+func TestClampUsageDays(t *testing.T) {
+	tests := []struct {
+		days int
+		want int
+	}{
+		{-1, 30},
+		{0, 30},
+		{1, 1},
+		{7, 7},
+		{90, 90},
+		{365, MaxUsageDays},
+	}
+
+	for _, tt := range tests {
+		if got := clampUsageDays(tt.days); got != tt.want {
+			t.Errorf("clampUsageDays(%d) = %d, want %d", tt.days, got, tt.want)
+		}
+	}
+}
+
+func TestUsageBreakdownNoDB(t *testing.T) {
+	svc := NewService(nil, "")
+	ctx := context.Background()
+
+	domains, err := svc.GetUsageByDomain(ctx, "user-1")
+	if err != nil || domains != nil {
+		t.Errorf("GetUsageByDomain() = %v, %v, want nil, nil", domains, err)
+	}
+	daily, err := svc.GetDailyUsage(ctx, "user-1", 7)
+	if err != nil || daily != nil {
+		t.Errorf("GetDailyUsage() = %v, %v, want nil, nil", daily, err)
+	}
+}
@@ -10,24 +10,56 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/lobber-dev/lobber/internal/db"
 	"github.com/stripe/stripe-go/v76"
-	"github.com/stripe/stripe-go/v76/webhook"
 )
 
 // WebhookHandler handles Stripe webhook events
 type WebhookHandler struct {
-	db            *sql.DB
-	webhookSecret string
-	service       *Service
+	db         *sql.DB
+	exec       execer
+	verifier   EventVerifier
+	dispatcher *Dispatcher
+	service    *Service
 }
 
 // NewWebhookHandler creates a new webhook handler
 func NewWebhookHandler(db *sql.DB, webhookSecret string, service *Service) *WebhookHandler {
-	return &WebhookHandler{
-		db:            db,
-		webhookSecret: webhookSecret,
-		service:       service,
+	h := &WebhookHandler{
+		db:       db,
+		verifier: NewStripeVerifier(webhookSecret),
+		service:  service,
 	}
+	if db != nil {
+		h.exec = db
+	}
+	h.dispatcher = h.defaultDispatcher()
+	return h
+}
+
+// SetVerifier overrides how webhook signatures are verified
+func (h *WebhookHandler) SetVerifier(v EventVerifier) {
+	h.verifier = v
+}
+
+// Dispatcher returns the event dispatcher so callers can register extra handlers
+func (h *WebhookHandler) Dispatcher() *Dispatcher {
+	return h.dispatcher
+}
+
+// defaultDispatcher registers the handlers for every event type we act on
+func (h *WebhookHandler) defaultDispatcher() *Dispatcher {
+	d := NewDispatcher()
+	d.On("checkout.session.completed", h.handleCheckoutSessionCompleted)
+	d.On("customer.subscription.created", h.handleSubscriptionCreated)
+	d.On("customer.subscription.updated", h.handleSubscriptionUpdated)
+	d.On("customer.subscription.deleted", h.handleSubscriptionDeleted)
+	d.On("customer.subscription.trial_will_end", h.handleTrialWillEnd)
+	d.On("invoice.paid", h.handleInvoicePaid)
+	d.On("invoice.payment_failed", h.handleInvoicePaymentFailed)
+	// No action needed - we create customers ourselves
+	d.On("customer.created", func(context.Context, *stripe.Event) error { return nil })
+	return d
 }
 
 // HandleWebhook processes incoming Stripe webhook events
@@ -45,7 +77,7 @@ func (h *WebhookHandler) HandleWebhook(w http.ResponseWriter, r *http.Request) {
 
 	// Verify webhook signature
 	sigHeader := r.Header.Get("Stripe-Signature")
-	event, err := webhook.ConstructEvent(payload, sigHeader, h.webhookSecret)
+	event, err := h.verifier.Verify(payload, sigHeader)
 	if err != nil {
 		http.Error(w, "webhook signature verification failed", http.StatusBadRequest)
 		return
@@ -70,16 +102,15 @@ func (h *WebhookHandler) HandleWebhook(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Process the event
+	// Process the event. Failures are queued for retry with backoff rather
+	// than relying on Stripe redelivery, so we still acknowledge with 200.
 	if err := h.processEvent(ctx, &event); err != nil {
-		// Log error but return 200 to prevent Stripe retries for handled events
-		// In production, you might want to retry or alert on certain errors
-		fmt.Printf("webhook processing error: %v\n", err)
+		fmt.Printf("webhook processing error for %s: %v\n", event.ID, err)
+		if err := h.recordFailure(ctx, event.ID, err); err != nil {
+			fmt.Printf("record webhook failure: %v\n", err)
+		}
 	}
 
-	// Mark event as processed
-	h.markEventProcessed(ctx, event.ID)
-
 	// Return 200 immediately
 	w.WriteHeader(http.StatusOK)
 }
@@ -90,6 +121,9 @@ func (h *WebhookHandler) isEventProcessed(ctx context.Context, eventID string) (
 		return false, nil
 	}
 
+	ctx, done := db.Timed(ctx, "billing.isEventProcessed")
+	defer done()
+
 	var processed bool
 	err := h.db.QueryRowContext(ctx,
 		"SELECT processed FROM billing_events WHERE stripe_event_id = $1",
@@ -114,7 +148,10 @@ func (h *WebhookHandler) storeEvent(ctx context.Context, event *stripe.Event) er
 		return fmt.Errorf("marshal event: %w", err)
 	}
 
-	_, err = h.db.ExecContext(ctx, `
+	qctx, done := db.Timed(ctx, "billing.storeEvent")
+	defer done()
+
+	_, err = h.db.ExecContext(qctx, `
 		INSERT INTO billing_events (stripe_event_id, event_type, payload, created_at)
 		VALUES ($1, $2, $3, $4)
 		ON CONFLICT (stripe_event_id) DO NOTHING
@@ -126,41 +163,63 @@ func (h *WebhookHandler) storeEvent(ctx context.Context, event *stripe.Event) er
 	return nil
 }
 
-// markEventProcessed marks an event as successfully processed
-func (h *WebhookHandler) markEventProcessed(ctx context.Context, eventID string) error {
+// processEvent applies an event that hasn't been processed yet
+func (h *WebhookHandler) processEvent(ctx context.Context, event *stripe.Event) error {
+	return h.applyEvent(ctx, event, false)
+}
+
+// applyEvent runs the event's handler and marks the event processed in one
+// transaction, so a crash part way through leaves nothing half-applied. The
+// event row is locked first, so concurrent deliveries of the same event apply
+// it once; force re-applies an already processed event.
+func (h *WebhookHandler) applyEvent(ctx context.Context, event *stripe.Event, force bool) error {
 	if h.db == nil {
+		return h.dispatcher.Dispatch(ctx, event)
+	}
+
+	// The deadline covers the whole transaction; side effects queued with
+	// afterCommit run on the caller's context
+	qctx, done := db.Timed(ctx, "billing.applyEvent")
+	defer done()
+
+	tx, err := h.db.BeginTx(qctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var processed bool
+	err = tx.QueryRowContext(qctx,
+		"SELECT processed FROM billing_events WHERE stripe_event_id = $1 FOR UPDATE",
+		event.ID).Scan(&processed)
+	if err != nil {
+		return fmt.Errorf("lock event: %w", err)
+	}
+	if processed && !force {
 		return nil
 	}
 
-	_, err := h.db.ExecContext(ctx, `
+	txCtx, st := withTx(ctx, tx)
+	if err := h.dispatcher.Dispatch(txCtx, event); err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(qctx, `
 		UPDATE billing_events
-		SET processed = TRUE, processed_at = NOW()
+		SET processed = TRUE, processed_at = NOW(), next_attempt_at = NULL
 		WHERE stripe_event_id = $1
-	`, eventID)
-	return err
-}
+	`, event.ID)
+	if err != nil {
+		return fmt.Errorf("mark event processed: %w", err)
+	}
 
-// processEvent handles the specific event type
-func (h *WebhookHandler) processEvent(ctx context.Context, event *stripe.Event) error {
-	switch event.Type {
-	case "customer.subscription.created":
-		return h.handleSubscriptionCreated(ctx, event)
-	case "customer.subscription.updated":
-		return h.handleSubscriptionUpdated(ctx, event)
-	case "customer.subscription.deleted":
-		return h.handleSubscriptionDeleted(ctx, event)
-	case "invoice.paid":
-		return h.handleInvoicePaid(ctx, event)
-	case "invoice.payment_failed":
-		return h.handleInvoicePaymentFailed(ctx, event)
-	case "customer.created":
-		// No action needed - we create customers ourselves
-		return nil
-	default:
-		// Unknown event type - log but don't error
-		fmt.Printf("unhandled webhook event type: %s\n", event.Type)
-		return nil
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit event: %w", err)
+	}
+	for _, fn := range st.afterCommit {
+		fn()
 	}
+	return nil
 }
 
 // handleSubscriptionCreated handles new subscription creation
@@ -170,16 +229,17 @@ func (h *WebhookHandler) handleSubscriptionCreated(ctx context.Context, event *s
 		return fmt.Errorf("unmarshal subscription: %w", err)
 	}
 
-	if h.db == nil {
+	exec := h.execFor(ctx)
+	if exec == nil {
 		return nil
 	}
 
 	// Find user by Stripe customer ID and update subscription
-	_, err := h.db.ExecContext(ctx, `
+	_, err := exec.ExecContext(ctx, `
 		UPDATE users
-		SET stripe_subscription_id = $1, plan = $2, updated_at = NOW()
-		WHERE stripe_customer_id = $3
-	`, sub.ID, determinePlan(&sub), sub.Customer.ID)
+		SET `+subscriptionTerms+`, stripe_subscription_id = $6, plan = $7, trial_ends_at = $8, updated_at = NOW()
+		WHERE stripe_customer_id = $9
+	`, append(fromStripeSubscription(&sub).termArgs(), sub.ID, determinePlan(&sub), trialEnd(&sub), sub.Customer.ID)...)
 	if err != nil {
 		return fmt.Errorf("update user subscription: %w", err)
 	}
@@ -194,7 +254,8 @@ func (h *WebhookHandler) handleSubscriptionUpdated(ctx context.Context, event *s
 		return fmt.Errorf("unmarshal subscription: %w", err)
 	}
 
-	if h.db == nil {
+	exec := h.execFor(ctx)
+	if exec == nil {
 		return nil
 	}
 
@@ -205,11 +266,18 @@ func (h *WebhookHandler) handleSubscriptionUpdated(ctx context.Context, event *s
 		plan = string(PlanFree)
 	}
 
-	_, err := h.db.ExecContext(ctx, `
+	// Keep the trial end only while the subscription is still trialing
+	var trialEndsAt *time.Time
+	if sub.Status == stripe.SubscriptionStatusTrialing {
+		trialEndsAt = trialEnd(&sub)
+	}
+
+	// Seat changes and interval switches arrive here too
+	_, err := exec.ExecContext(ctx, `
 		UPDATE users
-		SET plan = $1, updated_at = NOW()
-		WHERE stripe_subscription_id = $2
-	`, plan, sub.ID)
+		SET `+subscriptionTerms+`, plan = $6, trial_ends_at = $7, updated_at = NOW()
+		WHERE stripe_subscription_id = $8
+	`, append(fromStripeSubscription(&sub).termArgs(), plan, trialEndsAt, sub.ID)...)
 	if err != nil {
 		return fmt.Errorf("update user plan: %w", err)
 	}
@@ -224,14 +292,15 @@ func (h *WebhookHandler) handleSubscriptionDeleted(ctx context.Context, event *s
 		return fmt.Errorf("unmarshal subscription: %w", err)
 	}
 
-	if h.db == nil {
+	exec := h.execFor(ctx)
+	if exec == nil {
 		return nil
 	}
 
 	// Downgrade user to free plan
-	_, err := h.db.ExecContext(ctx, `
+	_, err := exec.ExecContext(ctx, `
 		UPDATE users
-		SET plan = 'free', stripe_subscription_id = NULL, updated_at = NOW()
+		SET plan = 'free', stripe_subscription_id = NULL, trial_ends_at = NULL, `+clearSubscriptionTerms+`, updated_at = NOW()
 		WHERE stripe_subscription_id = $1
 	`, sub.ID)
 	if err != nil {
@@ -241,6 +310,20 @@ func (h *WebhookHandler) handleSubscriptionDeleted(ctx context.Context, event *s
 	return nil
 }
 
+// handleTrialWillEnd handles the reminder Stripe sends three days before a trial ends
+func (h *WebhookHandler) handleTrialWillEnd(ctx context.Context, event *stripe.Event) error {
+	var sub stripe.Subscription
+	if err := json.Unmarshal(event.Data.Raw, &sub); err != nil {
+		return fmt.Errorf("unmarshal subscription: %w", err)
+	}
+
+	// Log upcoming trial end - in production, you'd remind the user to add a payment method
+	fmt.Printf("trial ending for customer: %s, subscription: %s, at: %s\n",
+		sub.Customer.ID, sub.ID, time.Unix(sub.TrialEnd, 0).Format(time.RFC3339))
+
+	return nil
+}
+
 // handleInvoicePaid handles successful payment
 func (h *WebhookHandler) handleInvoicePaid(ctx context.Context, event *stripe.Event) error {
 	var invoice stripe.Invoice
@@ -249,12 +332,13 @@ func (h *WebhookHandler) handleInvoicePaid(ctx context.Context, event *stripe.Ev
 	}
 
 	// Reset bandwidth counter on successful payment for the billing period
-	if h.db == nil {
+	exec := h.execFor(ctx)
+	if exec == nil {
 		return nil
 	}
 
 	// Find user and reset their monthly bandwidth
-	_, err := h.db.ExecContext(ctx, `
+	_, err := exec.ExecContext(ctx, `
 		UPDATE users
 		SET bandwidth_used_bytes = 0, bandwidth_reset_at = NOW(), updated_at = NOW()
 		WHERE stripe_customer_id = $1
@@ -280,7 +364,9 @@ func (h *WebhookHandler) handleInvoicePaymentFailed(ctx context.Context, event *
 	return nil
 }
 
-// determinePlan determines the plan type from a subscription
+// determinePlan determines the plan type from a subscription. A price can
+// name its plan in its "plan" metadata; otherwise metered prices are PAYG and
+// fixed prices are Pro.
 func determinePlan(sub *stripe.Subscription) string {
 	if sub.Status != stripe.SubscriptionStatusActive &&
 		sub.Status != stripe.SubscriptionStatusTrialing {
@@ -289,8 +375,14 @@ func determinePlan(sub *stripe.Subscription) string {
 
 	// Check subscription items for plan type
 	// This is a simplified version - in production, you'd check price IDs
-	if len(sub.Items.Data) > 0 {
+	if sub.Items != nil && len(sub.Items.Data) > 0 {
 		item := sub.Items.Data[0]
+		if item.Price != nil {
+			switch p := Plan(item.Price.Metadata["plan"]); p {
+			case PlanPAYG, PlanPro, PlanTeam:
+				return string(p)
+			}
+		}
 		if item.Price != nil && item.Price.Recurring != nil {
 			// If it's a metered price, it's PAYG
 			if item.Price.Recurring.UsageType == stripe.PriceRecurringUsageTypeMetered {
@@ -0,0 +1,194 @@
+package billing
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stripe/stripe-go/v76"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite golden files in testdata")
+
+// fakeVerifier accepts any payload without checking a signature
+type fakeVerifier struct {
+	err error
+}
+
+func (v *fakeVerifier) Verify(payload []byte, _ string) (stripe.Event, error) {
+	var event stripe.Event
+	if v.err != nil {
+		return event, v.err
+	}
+	err := json.Unmarshal(payload, &event)
+	return event, err
+}
+
+// recordedExec is a statement captured by recordingExec
+type recordedExec struct {
+	Query string `json:"query"`
+	Args  []any  `json:"args"`
+}
+
+// recordingExec records statements instead of running them
+type recordingExec struct {
+	calls []recordedExec
+}
+
+func (r *recordingExec) ExecContext(_ context.Context, query string, args ...any) (sql.Result, error) {
+	r.calls = append(r.calls, recordedExec{
+		Query: strings.Join(strings.Fields(query), " "),
+		Args:  normalizeArgs(args),
+	})
+	return driverResult{}, nil
+}
+
+type driverResult struct{}
+
+func (driverResult) LastInsertId() (int64, error) { return 0, nil }
+func (driverResult) RowsAffected() (int64, error) { return 1, nil }
+
+// normalizeArgs makes recorded args stable across time zones
+func normalizeArgs(args []any) []any {
+	out := make([]any, len(args))
+	for i, a := range args {
+		switch v := a.(type) {
+		case time.Time:
+			out[i] = v.UTC().Format(time.RFC3339)
+		case *time.Time:
+			if v != nil {
+				out[i] = v.UTC().Format(time.RFC3339)
+			}
+		default:
+			out[i] = v
+		}
+	}
+	return out
+}
+
+func loadFixture(t *testing.T, path string) *stripe.Event {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read fixture: %v", err)
+	}
+	var event stripe.Event
+	if err := json.Unmarshal(data, &event); err != nil {
+		t.Fatalf("unmarshal fixture: %v", err)
+	}
+	return &event
+}
+
+func TestWebhookEventGolden(t *testing.T) {
+	fixtures, err := filepath.Glob("testdata/webhooks/*.json")
+	if err != nil || len(fixtures) == 0 {
+		t.Fatalf("no webhook fixtures found: %v", err)
+	}
+
+	for _, fixture := range fixtures {
+		name := strings.TrimSuffix(filepath.Base(fixture), ".json")
+		t.Run(name, func(t *testing.T) {
+			rec := &recordingExec{calls: []recordedExec{}}
+			h := NewWebhookHandler(nil, "", nil)
+			h.exec = rec
+
+			event := loadFixture(t, fixture)
+			if !h.dispatcher.Handles(event.Type) {
+				t.Fatalf("no handler registered for %s", event.Type)
+			}
+			if err := h.processEvent(context.Background(), event); err != nil {
+				t.Fatalf("processEvent() error = %v", err)
+			}
+
+			got, err := json.MarshalIndent(rec.calls, "", "  ")
+			if err != nil {
+				t.Fatalf("marshal calls: %v", err)
+			}
+			got = append(got, '\n')
+
+			golden := strings.TrimSuffix(fixture, ".json") + ".golden"
+			if *updateGolden {
+				if err := os.WriteFile(golden, got, 0644); err != nil {
+					t.Fatalf("write golden: %v", err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("read golden (run with -update to create): %v", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("statements mismatch for %s\ngot:\n%s\nwant:\n%s", name, got, want)
+			}
+		})
+	}
+}
+
+func TestHandleWebhookVerification(t *testing.T) {
+	payload, err := os.ReadFile("testdata/webhooks/customer_created.json")
+	if err != nil {
+		t.Fatalf("read fixture: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		err    error
+		status int
+	}{
+		{"valid signature", nil, http.StatusOK},
+		{"invalid signature", errors.New("bad signature"), http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewWebhookHandler(nil, "", nil)
+			h.SetVerifier(&fakeVerifier{err: tt.err})
+
+			req := httptest.NewRequest("POST", "/stripe/webhook", bytes.NewReader(payload))
+			rec := httptest.NewRecorder()
+			h.HandleWebhook(rec, req)
+
+			if rec.Code != tt.status {
+				t.Errorf("status = %d, want %d", rec.Code, tt.status)
+			}
+		})
+	}
+}
+
+func TestDispatcher(t *testing.T) {
+	d := NewDispatcher()
+	var called []string
+	d.On("invoice.paid", func(_ context.Context, e *stripe.Event) error {
+		called = append(called, e.ID)
+		return nil
+	})
+	d.On("invoice.payment_failed", func(context.Context, *stripe.Event) error {
+		return errors.New("boom")
+	})
+
+	ctx := context.Background()
+	if err := d.Dispatch(ctx, &stripe.Event{ID: "evt_1", Type: "invoice.paid"}); err != nil {
+		t.Errorf("Dispatch(invoice.paid) error = %v", err)
+	}
+	if err := d.Dispatch(ctx, &stripe.Event{ID: "evt_2", Type: "invoice.payment_failed"}); err == nil {
+		t.Error("Dispatch(invoice.payment_failed) should return the handler error")
+	}
+	if err := d.Dispatch(ctx, &stripe.Event{ID: "evt_3", Type: "charge.refunded"}); err != nil {
+		t.Errorf("Dispatch(unknown) error = %v, want nil", err)
+	}
+	if len(called) != 1 || called[0] != "evt_1" {
+		t.Errorf("called = %v, want [evt_1]", called)
+	}
+	if d.Handles("charge.refunded") {
+		t.Error("Handles(charge.refunded) = true, want false")
+	}
+}
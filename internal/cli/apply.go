@@ -0,0 +1,341 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/lobber-dev/lobber/internal/dnsname"
+	"github.com/lobber-dev/lobber/internal/sampling"
+	"github.com/lobber-dev/lobber/internal/schedule"
+)
+
+// Resources is the account state `lobber apply` reconciles the relay
+// toward, read from a file such as:
+//
+//	domains:
+//	  - name: app.mysite.com
+//	    schedule: Mon-Fri 09:00-18:00 Europe/London
+//	    sampling: errors, 1%
+//	tokens:
+//	  - name: ci
+//
+// A domain's settings are what the file says, so leaving out its schedule
+// makes it always available. Tokens are created if missing but never
+// deleted, as one of them is how apply signs in.
+type Resources struct {
+	Domains []DomainResource `yaml:"domains"`
+	Tokens  []TokenResource  `yaml:"tokens"`
+}
+
+// DomainResource is a domain in a resources file
+type DomainResource struct {
+	Name     string `yaml:"name"`
+	Schedule string `yaml:"schedule,omitempty"`
+	Sampling string `yaml:"sampling,omitempty"`
+}
+
+// TokenResource is a CLI token in a resources file
+type TokenResource struct {
+	Name string `yaml:"name"`
+}
+
+// LoadResources reads and checks a resources file, normalizing names,
+// schedules and sampling policies the way the relay stores them
+func LoadResources(path string) (*Resources, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", path, err)
+	}
+	var res Resources
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&res); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	seen := make(map[string]bool)
+	for i := range res.Domains {
+		d := &res.Domains[i]
+		if d.Name, err = dnsname.Normalize(d.Name); err != nil {
+			return nil, fmt.Errorf("%s: domain %q: %w", path, res.Domains[i].Name, err)
+		}
+		if seen[d.Name] {
+			return nil, fmt.Errorf("%s: domain %s is listed twice", path, d.Name)
+		}
+		seen[d.Name] = true
+		if strings.TrimSpace(d.Schedule) != "" {
+			sched, err := schedule.Parse(d.Schedule)
+			if err != nil {
+				return nil, fmt.Errorf("%s: domain %s: %w", path, d.Name, err)
+			}
+			d.Schedule = sched.String()
+		}
+		if raw := strings.TrimSpace(d.Sampling); raw == "" || strings.EqualFold(raw, "all") {
+			d.Sampling = ""
+		} else {
+			policy, err := sampling.Parse(raw)
+			if err != nil {
+				return nil, fmt.Errorf("%s: domain %s: %w", path, d.Name, err)
+			}
+			d.Sampling = policy.String()
+		}
+	}
+	for i := range res.Tokens {
+		res.Tokens[i].Name = strings.TrimSpace(res.Tokens[i].Name)
+		if res.Tokens[i].Name == "" {
+			return nil, fmt.Errorf("%s: token %d has no name", path, i+1)
+		}
+	}
+	return &res, nil
+}
+
+// remoteDomain is a domain as the relay reports it
+type remoteDomain struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Verified bool   `json:"verified"`
+	Schedule string `json:"schedule"`
+	Sampling string `json:"sampling"`
+}
+
+// remoteToken is a CLI token as the relay reports it
+type remoteToken struct {
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	Token string `json:"token"` // the secret, only when just created
+}
+
+// Change is one step of bringing the account in line with a resources file
+type Change struct {
+	Action string // "create", "update" or "delete"
+	Kind   string // "domain" or "token"
+	Name   string
+	ID     string          // of the existing resource, for updates and deletes
+	Domain *DomainResource // the wanted domain, for creates and updates
+	Detail string          // what an update changes
+}
+
+func (c Change) String() string {
+	sign := map[string]string{"create": "+", "update": "~", "delete": "-"}[c.Action]
+	s := fmt.Sprintf("%s %s %s", sign, c.Kind, c.Name)
+	if c.Detail != "" {
+		s += ": " + c.Detail
+	}
+	return s
+}
+
+// planChanges works out the changes that take the account from its current
+// domains and tokens to want. Domains missing from want are only deleted
+// with prune.
+func planChanges(want *Resources, domains []remoteDomain, tokens []remoteToken, prune bool) []Change {
+	var changes []Change
+	current := make(map[string]remoteDomain, len(domains))
+	for _, d := range domains {
+		current[d.Name] = d
+	}
+
+	for i, d := range want.Domains {
+		have, ok := current[d.Name]
+		if !ok {
+			changes = append(changes, Change{Action: "create", Kind: "domain", Name: d.Name, Domain: &want.Domains[i]})
+			if d.Schedule != "" || d.Sampling != "" {
+				changes = append(changes, Change{Action: "update", Kind: "domain", Name: d.Name, Domain: &want.Domains[i], Detail: settingsDiff(remoteDomain{}, d)})
+			}
+			continue
+		}
+		if diff := settingsDiff(have, d); diff != "" {
+			changes = append(changes, Change{Action: "update", Kind: "domain", Name: d.Name, ID: have.ID, Domain: &want.Domains[i], Detail: diff})
+		}
+	}
+	if prune {
+		for _, d := range domains {
+			if !slices.ContainsFunc(want.Domains, func(w DomainResource) bool { return w.Name == d.Name }) {
+				changes = append(changes, Change{Action: "delete", Kind: "domain", Name: d.Name, ID: d.ID})
+			}
+		}
+	}
+
+	for _, t := range want.Tokens {
+		if !slices.ContainsFunc(tokens, func(have remoteToken) bool { return have.Name == t.Name }) {
+			changes = append(changes, Change{Action: "create", Kind: "token", Name: t.Name})
+		}
+	}
+	return changes
+}
+
+// settingsDiff describes how a domain's settings differ from want, or
+// returns "" if they don't
+func settingsDiff(have remoteDomain, want DomainResource) string {
+	var diffs []string
+	if have.Schedule != want.Schedule {
+		diffs = append(diffs, fmt.Sprintf("schedule %q -> %q", have.Schedule, want.Schedule))
+	}
+	if have.Sampling != want.Sampling {
+		diffs = append(diffs, fmt.Sprintf("sampling %q -> %q", have.Sampling, want.Sampling))
+	}
+	return strings.Join(diffs, ", ")
+}
+
+// apiClient calls the relay's CLI API with a token
+type apiClient struct {
+	relayURL string
+	token    string
+	http     *http.Client
+}
+
+// do sends a request with body as JSON and decodes the answer into out,
+// turning error statuses into errors that quote the relay
+func (c *apiClient) do(ctx context.Context, method, path string, body, out any) error {
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("encode request: %w", err)
+		}
+		reqBody = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(c.relayURL, "/")+path, reqBody)
+	if err != nil {
+		return fmt.Errorf("build request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s %s: %w", method, path, err)
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized:
+		return errors.New("token was rejected; run lobber login again")
+	case resp.StatusCode >= 300:
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s %s: relay returned %s: %s", method, path, resp.Status, strings.TrimSpace(string(msg)))
+	case out != nil:
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return fmt.Errorf("%s %s: decode answer: %w", method, path, err)
+		}
+	}
+	return nil
+}
+
+// applyChanges makes changes on the relay in order, printing each as it
+// goes and the secrets of tokens it creates
+func applyChanges(ctx context.Context, c *apiClient, changes []Change, out io.Writer) error {
+	created := make(map[string]string) // IDs of domains created on this run, by name
+	for _, ch := range changes {
+		var err error
+		switch {
+		case ch.Kind == "domain" && ch.Action == "create":
+			var d remoteDomain
+			err = c.do(ctx, http.MethodPost, "/api/v1/domains", map[string]string{"name": ch.Name}, &d)
+			created[ch.Name] = d.ID
+		case ch.Kind == "domain" && ch.Action == "update":
+			id := ch.ID
+			if id == "" {
+				id = created[ch.Name]
+			}
+			settings := map[string]string{"schedule": ch.Domain.Schedule, "sampling": ch.Domain.Sampling}
+			err = c.do(ctx, http.MethodPatch, "/api/v1/domains/"+id, settings, nil)
+		case ch.Kind == "domain" && ch.Action == "delete":
+			err = c.do(ctx, http.MethodDelete, "/api/v1/domains/"+ch.ID, nil, nil)
+		case ch.Kind == "token" && ch.Action == "create":
+			var t remoteToken
+			if err = c.do(ctx, http.MethodPost, "/api/v1/tokens", map[string]string{"name": ch.Name}, &t); err == nil {
+				ch.Detail = t.Token + " (copy it now; it won't be shown again)"
+			}
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(out, ch)
+	}
+	return nil
+}
+
+func runApply(args []string) error {
+	fs := flag.NewFlagSet("apply", flag.ExitOnError)
+	file := fs.String("f", "", "Resources file to apply (required)")
+	token := fs.String("token", "", "API token (defaults to the one saved by lobber login)")
+	relay := fs.String("relay", "https://lobber.dev", "Relay server URL")
+	dryRun := fs.Bool("dry-run", false, "Show the changes without making them")
+	prune := fs.Bool("prune", false, "Delete domains the file doesn't list")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *file == "" {
+		return errors.New("usage: lobber apply -f resources.yml [--dry-run] [--prune]")
+	}
+	want, err := LoadResources(*file)
+	if err != nil {
+		return err
+	}
+
+	authToken := *token
+	if authToken == "" {
+		cfg, err := LoadConfig()
+		if err != nil {
+			return err
+		}
+		authToken = cfg.Token
+	}
+	if authToken == "" {
+		return errors.New("not logged in: run lobber login or pass --token")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+	c := &apiClient{relayURL: *relay, token: authToken, http: &http.Client{Timeout: 15 * time.Second}}
+
+	var domains struct {
+		Domains []remoteDomain `json:"domains"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/api/v1/domains", nil, &domains); err != nil {
+		return err
+	}
+	var tokens struct {
+		Tokens []remoteToken `json:"tokens"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/api/v1/tokens", nil, &tokens); err != nil {
+		return err
+	}
+
+	changes := planChanges(want, domains.Domains, tokens.Tokens, *prune)
+	if len(changes) == 0 {
+		fmt.Println("No changes; the account matches", *file)
+		return nil
+	}
+	if *dryRun {
+		for _, ch := range changes {
+			fmt.Println(ch)
+		}
+		fmt.Printf("%d changes to make; run without --dry-run to apply them\n", len(changes))
+		return nil
+	}
+	if err := applyChanges(ctx, c, changes, os.Stdout); err != nil {
+		return err
+	}
+	fmt.Printf("Applied %d changes\n", len(changes))
+	for _, ch := range changes {
+		if ch.Kind == "domain" && ch.Action == "create" {
+			fmt.Println("Verify new domains from the dashboard's Domains page before connecting tunnels on them")
+			break
+		}
+	}
+	return nil
+}
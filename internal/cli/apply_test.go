@@ -0,0 +1,140 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadResources(t *testing.T) {
+	tests := []struct {
+		name    string
+		yaml    string
+		wantErr string
+	}{
+		{"valid", "domains:\n  - name: App.MySite.com\n    schedule: Mon-Fri  09:00-18:00 UTC\n    sampling: ALL\ntokens:\n  - name: ci\n", ""},
+		{"empty", "", ""},
+		{"unknown resource", "protection:\n  - domain: app.mysite.com\n", "field protection not found"},
+		{"bad name", "domains:\n  - name: nodot\n", "domain \"nodot\""},
+		{"duplicate", "domains:\n  - name: a.mysite.com\n  - name: A.mysite.com\n", "listed twice"},
+		{"bad schedule", "domains:\n  - name: a.mysite.com\n    schedule: weekdays\n", "domain a.mysite.com"},
+		{"unnamed token", "tokens:\n  - name: \" \"\n", "token 1 has no name"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "resources.yml")
+			os.WriteFile(path, []byte(tt.yaml), 0o600)
+			res, err := LoadResources(path)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("LoadResources() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadResources() error = %v", err)
+			}
+			if tt.name == "valid" && (res.Domains[0] != DomainResource{Name: "app.mysite.com", Schedule: "Mon-Fri 09:00-18:00 UTC"}) {
+				t.Errorf("domain = %+v, want it normalized", res.Domains[0])
+			}
+		})
+	}
+}
+
+func TestPlanChanges(t *testing.T) {
+	want := &Resources{
+		Domains: []DomainResource{
+			{Name: "same.mysite.com", Sampling: "errors"},
+			{Name: "changed.mysite.com", Schedule: "Mon-Fri 09:00-18:00 UTC"},
+			{Name: "new.mysite.com", Sampling: "errors"},
+		},
+		Tokens: []TokenResource{{Name: "ci"}, {Name: "deploy"}},
+	}
+	domains := []remoteDomain{
+		{ID: "d1", Name: "same.mysite.com", Sampling: "errors"},
+		{ID: "d2", Name: "changed.mysite.com", Sampling: "errors"},
+		{ID: "d3", Name: "old.mysite.com"},
+	}
+	tokens := []remoteToken{{ID: "t1", Name: "ci"}}
+
+	plan := func(prune bool) string {
+		var lines []string
+		for _, c := range planChanges(want, domains, tokens, prune) {
+			lines = append(lines, c.String())
+		}
+		return strings.Join(lines, "\n")
+	}
+	wantPlan := `~ domain changed.mysite.com: schedule "" -> "Mon-Fri 09:00-18:00 UTC", sampling "errors" -> ""
++ domain new.mysite.com
+~ domain new.mysite.com: sampling "" -> "errors"
++ token deploy`
+	if got := plan(false); got != wantPlan {
+		t.Errorf("plan =\n%s\nwant\n%s", got, wantPlan)
+	}
+	if got := plan(true); got != strings.Replace(wantPlan, "+ token", "- domain old.mysite.com\n+ token", 1) {
+		t.Errorf("plan with prune =\n%s\nwant old.mysite.com deleted too", got)
+	}
+}
+
+func TestApplyChanges(t *testing.T) {
+	var calls []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer lb_good" {
+			http.Error(w, "invalid token", http.StatusUnauthorized)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		calls = append(calls, r.Method+" "+r.URL.Path+" "+string(body))
+		switch r.Method + " " + r.URL.Path {
+		case "POST /api/v1/domains":
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"id":"d9","name":"new.mysite.com"}`))
+		case "POST /api/v1/tokens":
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"id":"t9","name":"deploy","token":"lb_secret"}`))
+		case "PATCH /api/v1/domains/d9", "DELETE /api/v1/domains/d3":
+			w.Write([]byte(`{}`))
+		default:
+			http.Error(w, "domain not found", http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	want := &Resources{Domains: []DomainResource{{Name: "new.mysite.com", Sampling: "errors"}}, Tokens: []TokenResource{{Name: "deploy"}}}
+	changes := planChanges(want, []remoteDomain{{ID: "d3", Name: "old.mysite.com"}}, nil, true)
+
+	var out bytes.Buffer
+	c := &apiClient{relayURL: srv.URL, token: "lb_good", http: srv.Client()}
+	if err := applyChanges(context.Background(), c, changes, &out); err != nil {
+		t.Fatalf("applyChanges() error = %v", err)
+	}
+	wantCalls := []string{
+		`POST /api/v1/domains {"name":"new.mysite.com"}`,
+		`PATCH /api/v1/domains/d9 {"sampling":"errors","schedule":""}`,
+		`DELETE /api/v1/domains/d3 `,
+		`POST /api/v1/tokens {"name":"deploy"}`,
+	}
+	if strings.Join(calls, "\n") != strings.Join(wantCalls, "\n") {
+		t.Errorf("calls =\n%s\nwant\n%s", strings.Join(calls, "\n"), strings.Join(wantCalls, "\n"))
+	}
+	if !strings.Contains(out.String(), "+ token deploy: lb_secret") {
+		t.Errorf("output = %q, want the new token's secret", out.String())
+	}
+
+	// Failures stop the run and quote the relay
+	c.token = "lb_bad"
+	if err := applyChanges(context.Background(), c, changes, io.Discard); err == nil || !strings.Contains(err.Error(), "lobber login") {
+		t.Errorf("applyChanges() with a bad token error = %v, want a login hint", err)
+	}
+	c.token = "lb_good"
+	err := applyChanges(context.Background(), c, []Change{{Action: "delete", Kind: "domain", Name: "gone", ID: "gone"}}, io.Discard)
+	if err == nil || !strings.Contains(err.Error(), "domain not found") {
+		t.Errorf("applyChanges() error = %v, want the relay's message", err)
+	}
+}
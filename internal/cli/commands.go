@@ -2,14 +2,26 @@ package cli
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"flag"
 	"fmt"
+	"log"
+	"net"
+	"net/url"
 	"os"
 	"os/signal"
+	"runtime"
+	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/lobber-dev/lobber/internal/client"
+	"github.com/lobber-dev/lobber/internal/github"
+	"github.com/lobber-dev/lobber/internal/proxyerr"
+	"github.com/lobber-dev/lobber/internal/scrub"
+	"github.com/lobber-dev/lobber/internal/tunnel"
 )
 
 func Run(args []string) error {
@@ -28,6 +40,14 @@ func Run(args []string) error {
 		return runStatus(args[1:])
 	case "domains":
 		return runDomains(args[1:])
+	case "events":
+		return runEvents(args[1:])
+	case "apply":
+		return runApply(args[1:])
+	case "share":
+		return runShare(args[1:])
+	case "service":
+		return runService(args[1:])
 	case "help", "-h", "--help":
 		return showHelp()
 	case "version", "-v", "--version":
@@ -47,8 +67,12 @@ Commands:
   login       Authenticate with Lobber
   logout      Clear saved credentials
   up          Start a tunnel
-  status      Show active tunnels
+  status      Show tunnel connection quality
   domains     List verified domains
+  events      Show activity on your tunnels and domains
+  apply       Create and update domains and tokens from a file
+  share once  Share a local port on a link that expires
+  service     Run a tunnel in the background on boot
   version     Show version
 
 Flags:
@@ -57,19 +81,33 @@ Flags:
 
 Examples:
   lobber login
+  lobber login --token lb_xxx
+  lobber login --token < token.txt
   lobber up app.mysite.com:3000 --domain my.custom.com
-  lobber up app.mysite.com:3000 --inspect`)
+  lobber up app.mysite.com:3000 --inspect
+  lobber up --debug-errors app.mysite.com:3000
+  lobber up --label env=staging --label service=api app.mysite.com:3000
+  lobber up --name checkout-api app.mysite.com:3000
+  lobber up --scrub header:Authorization --scrub field:user.email app.mysite.com:3000
+  lobber up --udp app.mysite.com:5353
+  lobber up --tls-passthrough secure.mysite.com:8443
+  lobber up --notify demo.mysite.com:3000
+  lobber up --ephemeral --github-pr $PR_NUMBER preview.mysite.com:3000
+  lobber up --noindex staging.mysite.com:3000
+  lobber up --devtools app.mysite.com:3000
+  lobber up --rewrite-origin http://localhost:3000 --rewrite-cookies app.mysite.com:3000
+  lobber up --transport ws app.mysite.com:3000
+  lobber up --supervised app.mysite.com:3000
+  lobber up --debug-addr localhost:6060 app.mysite.com:3000
+  lobber events --follow
+  lobber apply -f resources.yml --dry-run
+  lobber share once --max-requests 50 --ttl 1h share.mysite.com:3000
+  lobber service install app.mysite.com:3000`)
 	return nil
 }
 
 func showVersion() error {
-	fmt.Println("lobber version 0.1.0")
-	return nil
-}
-
-func runLogin(args []string) error {
-	// TODO: Implement OAuth flow
-	fmt.Println("Opening browser for authentication...")
+	fmt.Println("lobber version " + client.Version)
 	return nil
 }
 
@@ -88,19 +126,66 @@ func runUp(args []string) error {
 	noInspect := fs.Bool("no-inspect", false, "Disable local inspector")
 	quiet := fs.Bool("quiet", false, "Minimal output")
 	domain := fs.String("domain", "", "Custom domain to use")
+	burstLimit := fs.String("burst-limit", "", `Requests per second the relay always lets through before rate limiting traffic spikes, or "off"`)
+	name := fs.String("name", "", "Stable name for the tunnel, grouping its history in the dashboard across hostnames; overrides lobber.yml")
+	var labels labelFlags
+	fs.Var(&labels, "label", "Label the tunnel with key=value, e.g. env=staging; repeat for more")
+	var scrubs scrubFlags
+	fs.Var(&scrubs, "scrub", "Redact header:<name>, field:<json.path> or regex:<expression> from requests in the inspector; repeat for more, adds to lobber.yml")
+	var origins originFlags
+	fs.Var(&origins, "rewrite-origin", "Replace this local origin, e.g. http://localhost:3000, with the tunnel's URL in Location headers and HTML and JSON bodies; repeat for more")
+	rewriteCookies := fs.Bool("rewrite-cookies", false, "Fit the Domain, Secure and SameSite attributes of cookies the local app sets to the tunnel's hostname, so cookies meant for localhost stick")
+	transport := fs.String("transport", "auto", `How to reach the relay: "tcp", "ws" to carry the tunnel over a WebSocket for proxies that cut other connections, "auto" to fall back to one, or "quic" on relays that enable it (no mobility or head-of-line benefit over TCP yet: a network change still reconnects, and all requests share one stream)`)
+	udp := fs.Bool("udp", false, "Tunnel UDP datagrams to the local port instead of HTTP, through a public UDP port the relay allocates")
+	passthrough := fs.Bool("tls-passthrough", false, "Pass TLS connections for the hostname to the local port unopened, for a local server that terminates TLS with its own certificate")
+	debugErrors := fs.Bool("debug-errors", false, "Show a debug page with the local error and recent requests in place of 5xx responses, to visitors holding a generated debug link")
+	supervised := fs.Bool("supervised", false, "Run under systemd, launchd or Kubernetes: log lines instead of banners, sd_notify readiness and meaningful exit codes")
+	notify := fs.Bool("notify", false, "Show a desktop notification on the tunnel's first visitor and whenever its connection drops")
+	ephemeral := fs.Bool("ephemeral", false, "Serve on a random hostname under the domain, e.g. one per CI run")
+	noIndex := fs.Bool("noindex", false, "Keep search engines off the tunnel: the relay answers robots.txt and adds X-Robots-Tag: noindex (default true with --ephemeral)")
+	devTools := fs.Bool("devtools", false, "Serve /_lobber/devtools on the tunnel, where a phone's browser can send its console and errors to this terminal or show an on-screen console")
+	githubPR := fs.Int("github-pr", 0, "Comment the tunnel's link on this pull request, through the GitHub App set up in the dashboard")
+	errorBuffer := fs.Int("error-buffer", proxyerr.DefaultSize, "Recent requests the tunnel failed to forward kept for lobber status --errors; 0 keeps none")
+	debugAddr := fs.String("debug-addr", "", "Serve pprof and the client's metrics on this local address, e.g. localhost:6060, to see where its CPU and memory go")
+	githubRepo := fs.String("github-repo", os.Getenv("GITHUB_REPOSITORY"), "Repository of --github-pr as owner/name (default $GITHUB_REPOSITORY)")
 
 	if err := fs.Parse(args); err != nil {
 		return err
 	}
+	if *supervised {
+		*quiet = true
+	}
 
 	if fs.NArg() < 1 {
 		return fmt.Errorf("usage: lobber up <domain>:<port> [--relay URL]")
 	}
 
+	// The account's preferences from `lobber login` fill in flags not given
+	cfg, err := LoadConfig()
+	if err != nil {
+		cfg = &Config{}
+	}
+	applyPreferences(fs, cfg.Preferences)
+
+	// lobber.yml in the working directory names and labels the tunnel
+	project, err := LoadProject(".")
+	if err != nil {
+		return err
+	}
+	tunnelName := project.Name
+	if *name != "" {
+		if err := tunnel.ValidateName(*name); err != nil {
+			return err
+		}
+		tunnelName = *name
+	}
+	tunnelLabels := project.mergeLabels(labels.labels)
+	scrubber, err := scrub.New(project.Scrub.Merge(scrubs.rules))
+	if err != nil {
+		return err
+	}
+
 	target := fs.Arg(0)
-	_ = inspect
-	_ = inspectPort
-	_ = noInspect
 
 	// Parse target (domain:port or just port)
 	var tunnelDomain string
@@ -119,15 +204,50 @@ func runUp(args []string) error {
 	if *domain != "" {
 		tunnelDomain = *domain
 	}
+	if *ephemeral {
+		if tunnelDomain, err = shareHostname(tunnelDomain); err != nil {
+			return fmt.Errorf("ephemeral hostname: %w", err)
+		}
+		// Random hostnames are throwaway, so they stay out of search
+		// results unless --noindex=false says otherwise
+		explicit := false
+		fs.Visit(func(f *flag.Flag) { explicit = explicit || f.Name == "noindex" })
+		if !explicit {
+			*noIndex = true
+		}
+	}
+	var pr *github.PR
+	if *githubPR != 0 {
+		if pr, err = pullRequest(*githubRepo, *githubPR); err != nil {
+			return err
+		}
+	}
+
+	relayTransport := *transport
+	switch relayTransport {
+	case "auto":
+		relayTransport = ""
+	case tunnel.TransportTCP, tunnel.TransportWebSocket, tunnel.TransportQUIC:
+	default:
+		return fmt.Errorf(`--transport must be "auto", "tcp", "ws" or "quic"`)
+	}
 
 	// Build local address
 	localAddr := fmt.Sprintf("http://localhost:%s", localPort)
+	if *udp && *passthrough {
+		return fmt.Errorf("--udp and --tls-passthrough can't be combined")
+	}
+	if *udp || *passthrough {
+		if *debugErrors {
+			return fmt.Errorf("--debug-errors only applies to HTTP tunnels")
+		}
+		localAddr = net.JoinHostPort("localhost", localPort)
+	}
 
 	// Get token from flag or config
 	authToken := *token
 	if authToken == "" {
-		cfg, err := LoadConfig()
-		if err == nil && cfg.Token != "" {
+		if cfg.Token != "" {
 			authToken = cfg.Token
 		} else {
 			// Use a default dev token for local testing
@@ -140,16 +260,114 @@ func runUp(args []string) error {
 		fmt.Printf("  Local:  %s\n", localAddr)
 		fmt.Printf("  Domain: %s\n", tunnelDomain)
 		fmt.Printf("  Relay:  %s\n", *relay)
+		if tunnelName != "" {
+			fmt.Printf("  Name:   %s\n", tunnelName)
+		}
+		if len(tunnelLabels) > 0 {
+			fmt.Printf("  Labels: %s\n", tunnelLabels)
+		}
+		if pr != nil {
+			fmt.Printf("  PR:     %s\n", pr)
+		}
 		fmt.Println()
 	}
 
 	// Create client
 	c := client.New(localAddr, *relay, authToken, tunnelDomain)
+	c.BurstLimit = *burstLimit
+	c.Transport = relayTransport
+	c.Name = tunnelName
+	c.Labels = tunnelLabels
+	c.UDP = *udp
+	c.Passthrough = *passthrough
+	c.NoIndex = *noIndex
+	c.DevTools = *devTools
+	c.RewriteOrigins = origins
+	c.RewriteCookies = *rewriteCookies
+	c.SetErrorBuffer(*errorBuffer)
+	if pr != nil {
+		c.GitHubPR = pr.String()
+	}
+	var notifications *notifier
+	if *notify {
+		notifications = newNotifier(runtime.GOOS, tunnelDomain)
+		c.SetOnRequest(func(req *tunnel.Request) { notifications.visited(req.Method, req.Path) })
+		c.SetOnDrop(notifications.dropped)
+	}
+	if *debugErrors {
+		token, err := newDebugToken()
+		if err != nil {
+			return fmt.Errorf("debug token: %w", err)
+		}
+		c.DebugToken = token
+		if !*quiet {
+			fmt.Printf("Debug pages: open %s once to see local errors in place of 5xx responses\n\n", debugURL(*relay, tunnelDomain, token))
+		}
+	}
+	if *devTools {
+		if !*quiet {
+			fmt.Printf("Device debugging: open %s on a phone to send its console here\n\n", publicURL(*relay, tunnelDomain).JoinPath(client.DevToolsPath))
+		}
+		c.SetOnDevLog(func(e client.DevLog) {
+			if *supervised {
+				log.Printf("devtools %s: %s (%s)", e.Level, e.Message, e.URL)
+			} else if !*quiet {
+				fmt.Printf("[devtools] %s: %s (%s)\n", e.Level, e.Message, e.URL)
+			}
+		})
+	}
 
 	// Set up signal handling for graceful shutdown
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	// The inspector also answers `lobber status`, and lets editors and
+	// scripts open more tunnels: under a random label of this one's
+	// hostname unless they name one
+	if *inspect && !*noInspect {
+		public := func(tc *client.Client) string {
+			if w := tc.Welcome(); w != nil && len(w.URLs) > 0 {
+				return w.URLs[0]
+			}
+			return publicURL(*relay, tc.Domain).String()
+		}
+		open := func(port int, domain string) (*client.Client, error) {
+			random := domain == ""
+			if random {
+				var err error
+				if domain, err = shareHostname(tunnelDomain); err != nil {
+					return nil, err
+				}
+			}
+			nc := client.New(fmt.Sprintf("http://localhost:%d", port), *relay, authToken, domain)
+			nc.BurstLimit = *burstLimit
+			nc.Transport = relayTransport
+			nc.RewriteCookies = *rewriteCookies
+			nc.Labels = tunnelLabels
+			nc.NoIndex = *noIndex || random
+			nc.SetErrorBuffer(*errorBuffer)
+			return nc, nil
+		}
+		addr, err := serveInspector(ctx, c, *inspectPort, scrubber, public, open)
+		if err != nil {
+			log.Printf("inspector disabled: %v", err)
+		} else if !*quiet {
+			fmt.Printf("Inspector: http://%s\n\n", addr)
+		}
+	}
+
+	if *debugAddr != "" {
+		addr, err := serveDebug(ctx, *debugAddr, c)
+		if err != nil {
+			return err
+		}
+		if *supervised {
+			log.Printf("debug server: http://%s/debug/pprof/", addr)
+		} else if !*quiet {
+			fmt.Printf("Debug: http://%s/debug/pprof/ and /debug/metrics\n\n", addr)
+		}
+	}
+
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
 
@@ -158,15 +376,76 @@ func runUp(args []string) error {
 		if !*quiet {
 			fmt.Println("\nShutting down tunnel...")
 		}
+		if *supervised {
+			sdNotify("STOPPING=1")
+		}
 		cancel()
 	}()
 
 	// Set ready callback
 	c.SetOnReady(func() {
+		public := tunnelDomain
+		if *udp {
+			public = udpAddr(*relay, c.UDPPort())
+		}
+		welcome := c.Welcome()
+		if welcome != nil && len(welcome.URLs) > 0 {
+			public = welcome.URLs[0]
+		}
 		if !*quiet {
-			fmt.Printf("Tunnel ready! Forwarding %s -> %s\n", tunnelDomain, localAddr)
+			fmt.Printf("Tunnel ready! Forwarding %s -> %s\n", public, localAddr)
+			if c.OverWebSocket() && relayTransport == "" {
+				fmt.Println("Connected over a WebSocket, as something on the way cut the plain connection")
+			}
+			if plan := describeWelcome(welcome); plan != "" {
+				fmt.Println(plan)
+			}
 			fmt.Println("Press Ctrl+C to stop")
 		}
+		if warning := deprecationWarning(welcome); warning != "" {
+			fmt.Fprintln(os.Stderr, warning)
+		}
+		if *supervised {
+			log.Printf("tunnel ready: forwarding %s -> %s", public, localAddr)
+			if err := sdNotify("READY=1\nSTATUS=Forwarding " + public); err != nil {
+				log.Printf("sd_notify: %v", err)
+			}
+		}
+	})
+
+	// After sleep or a network switch the client reconnects by itself
+	c.SetOnResume(func(reason string) {
+		if !*quiet {
+			fmt.Printf("Tunnel resumed after %s\n", reason)
+		}
+		if *supervised {
+			log.Printf("tunnel resumed after %s", reason)
+		}
+	})
+
+	// Heartbeats tell a slow link apart from a slow app
+	c.SetOnLatency(func(slow bool, avg time.Duration) {
+		avg = avg.Round(time.Millisecond)
+		if !*quiet {
+			if slow {
+				fmt.Printf("Latency to the relay is high (%s average); requests will be slow until it recovers\n", avg)
+			} else {
+				fmt.Printf("Latency to the relay is back to normal (%s average)\n", avg)
+			}
+		}
+		if *supervised {
+			log.Printf("relay latency: slow=%t avg=%s", slow, avg)
+		}
+	})
+
+	// Outside its domain's schedule the relay sends the tunnel away for a while
+	c.SetOnPause(func(reason string, until time.Time) {
+		if !*quiet {
+			fmt.Printf("Tunnel paused: %s; reconnecting at %s\n", reason, until.Local().Format("Mon 15:04"))
+		}
+		if *supervised {
+			log.Printf("tunnel paused: %s; reconnecting at %s", reason, until.Format(time.RFC3339))
+		}
 	})
 
 	// Run the tunnel (blocks until cancelled or error)
@@ -174,17 +453,158 @@ func runUp(args []string) error {
 		if err == context.Canceled {
 			return nil // Normal shutdown
 		}
-		return fmt.Errorf("tunnel error: %w", err)
+		if notifications != nil {
+			notifications.stopped(err)
+		}
+		return &ExitError{Code: tunnelExitCode(err), Err: fmt.Errorf("tunnel error: %w", err)}
 	}
 
 	return nil
 }
 
-func runStatus(args []string) error {
-	fmt.Println("No active tunnels")
+// labelFlags collects repeated --label key=value flags
+type labelFlags struct {
+	labels tunnel.Labels
+}
+
+func (f *labelFlags) String() string {
+	return f.labels.String()
+}
+
+func (f *labelFlags) Set(v string) error {
+	parsed, err := tunnel.ParseLabels(v)
+	if err != nil {
+		return err
+	}
+	if f.labels == nil {
+		f.labels = tunnel.Labels{}
+	}
+	for k, val := range parsed {
+		if _, dup := f.labels[k]; dup {
+			return fmt.Errorf("label %s given twice", k)
+		}
+		f.labels[k] = val
+	}
+	if len(f.labels) > tunnel.MaxLabels {
+		return fmt.Errorf("at most %d labels allowed", tunnel.MaxLabels)
+	}
+	return nil
+}
+
+// pullRequest names the pull request for --github-pr in repo
+func pullRequest(repo string, number int) (*github.PR, error) {
+	if repo == "" {
+		return nil, fmt.Errorf("--github-pr needs --github-repo or $GITHUB_REPOSITORY")
+	}
+	pr, err := github.ParsePR(fmt.Sprintf("%s#%d", repo, number))
+	if err != nil {
+		return nil, err
+	}
+	return &pr, nil
+}
+
+// scrubFlags collects repeated --scrub rules
+type scrubFlags struct {
+	rules scrub.Rules
+	given []string
+}
+
+func (f *scrubFlags) String() string {
+	return strings.Join(f.given, ",")
+}
+
+func (f *scrubFlags) Set(v string) error {
+	if err := f.rules.Add(v); err != nil {
+		return err
+	}
+	f.given = append(f.given, v)
 	return nil
 }
 
+// originFlags collects repeated --rewrite-origin flags
+type originFlags []string
+
+func (f *originFlags) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *originFlags) Set(v string) error {
+	origin, err := client.ParseOrigin(v)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, origin)
+	return nil
+}
+
+// newDebugToken returns a random token for --debug-errors
+func newDebugToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// debugURL returns the link that gives a browser the debug cookie
+func debugURL(relay, domain, token string) string {
+	u := publicURL(relay, domain)
+	u.RawQuery = url.Values{client.DebugCookie: {token}}.Encode()
+	return u.String()
+}
+
+// publicURL returns where visitors reach a tunnel on domain. The tunnel is
+// served with the relay's scheme and port.
+func publicURL(relay, domain string) *url.URL {
+	u := &url.URL{Scheme: "https", Host: domain, Path: "/"}
+	if r, err := url.Parse(relay); err == nil && r.Scheme != "" {
+		u.Scheme = r.Scheme
+		if port := r.Port(); port != "" {
+			u.Host = net.JoinHostPort(domain, port)
+		}
+	}
+	return u
+}
+
+// describeWelcome summarizes the plan and bandwidth the relay granted a
+// tunnel, or returns "" if it said nothing about them
+func describeWelcome(w *tunnel.Welcome) string {
+	if w == nil || w.Plan == "" {
+		return ""
+	}
+	if w.Limits.MonthlyBytes == 0 {
+		return fmt.Sprintf("Plan: %s, %s used this month", w.Plan, formatBytes(w.Limits.UsedBytes))
+	}
+	return fmt.Sprintf("Plan: %s, %s of %s used this month", w.Plan, formatBytes(w.Limits.UsedBytes), formatBytes(w.Limits.MonthlyBytes))
+}
+
+// deprecationWarning tells the user to upgrade if the relay is retiring
+// protocol features this client uses, or returns ""
+func deprecationWarning(w *tunnel.Welcome) string {
+	if w == nil || len(w.Deprecated) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("Warning: the relay is retiring protocol features this lobber uses (%s); upgrade lobber to keep connecting", strings.Join(w.Deprecated, ", "))
+}
+
+// formatBytes renders a byte count in MB below a gigabyte and GB above
+func formatBytes(n int64) string {
+	const mb, gb = 1024 * 1024, 1024 * 1024 * 1024
+	if n < gb {
+		return fmt.Sprintf("%.0f MB", float64(n)/mb)
+	}
+	return fmt.Sprintf("%.2f GB", float64(n)/gb)
+}
+
+// udpAddr returns where peers reach a UDP tunnel: its port on the relay
+func udpAddr(relay string, port int) string {
+	host := relay
+	if r, err := url.Parse(relay); err == nil && r.Hostname() != "" {
+		host = r.Hostname()
+	}
+	return "udp://" + net.JoinHostPort(host, strconv.Itoa(port))
+}
+
 func runDomains(args []string) error {
 	fmt.Println("No verified domains")
 	return nil
@@ -0,0 +1,122 @@
+package cli
+
+import (
+	"flag"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/lobber-dev/lobber/internal/tunnel"
+)
+
+func TestDebugURL(t *testing.T) {
+	tests := []struct {
+		relay string
+		want  string
+	}{
+		{"https://lobber.dev", "https://app.mysite.com/?lobber_debug=tok"},
+		{"http://localhost:8080", "http://app.mysite.com:8080/?lobber_debug=tok"},
+		{"", "https://app.mysite.com/?lobber_debug=tok"},
+	}
+
+	for _, tt := range tests {
+		if got := debugURL(tt.relay, "app.mysite.com", "tok"); got != tt.want {
+			t.Errorf("debugURL(%q) = %q, want %q", tt.relay, got, tt.want)
+		}
+	}
+}
+
+func TestUDPAddr(t *testing.T) {
+	tests := []struct {
+		relay string
+		want  string
+	}{
+		{"https://lobber.dev", "udp://lobber.dev:40001"},
+		{"http://localhost:8080", "udp://localhost:40001"},
+		{"https://[2001:db8::1]:443", "udp://[2001:db8::1]:40001"},
+	}
+
+	for _, tt := range tests {
+		if got := udpAddr(tt.relay, 40001); got != tt.want {
+			t.Errorf("udpAddr(%q) = %q, want %q", tt.relay, got, tt.want)
+		}
+	}
+}
+
+func TestLabelFlags(t *testing.T) {
+	tests := []struct {
+		args    []string
+		want    string
+		wantErr bool
+	}{
+		{nil, "", false},
+		{[]string{"--label", "env=staging", "--label", "service=api"}, "env=staging,service=api", false},
+		{[]string{"--label", "env=staging,service=api"}, "env=staging,service=api", false},
+		{[]string{"--label", "env=staging", "--label", "env=prod"}, "", true},
+		{[]string{"--label", "staging"}, "", true},
+	}
+
+	for _, tt := range tests {
+		var labels labelFlags
+		fs := flag.NewFlagSet("up", flag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+		fs.Var(&labels, "label", "")
+		err := fs.Parse(tt.args)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Parse(%v) error = %v, wantErr %v", tt.args, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && labels.String() != tt.want {
+			t.Errorf("Parse(%v) labels = %q, want %q", tt.args, labels.String(), tt.want)
+		}
+	}
+}
+
+func TestDescribeWelcome(t *testing.T) {
+	tests := []struct {
+		name string
+		w    *tunnel.Welcome
+		want string
+	}{
+		{"old relay", nil, ""},
+		{"anonymous", &tunnel.Welcome{URLs: []string{"https://app.mysite.com/"}}, ""},
+		{"free", &tunnel.Welcome{Plan: "free", Limits: tunnel.Limits{MonthlyBytes: 5 << 30, UsedBytes: 300 << 20}}, "Plan: free, 300 MB of 5.00 GB used this month"},
+		{"unlimited", &tunnel.Welcome{Plan: "pro", Limits: tunnel.Limits{UsedBytes: 3 << 29}}, "Plan: pro, 1.50 GB used this month"},
+	}
+
+	for _, tt := range tests {
+		if got := describeWelcome(tt.w); got != tt.want {
+			t.Errorf("%s: describeWelcome() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDeprecationWarning(t *testing.T) {
+	tests := []struct {
+		w    *tunnel.Welcome
+		want string
+	}{
+		{nil, ""},
+		{&tunnel.Welcome{Features: []string{"heartbeat"}}, ""},
+		{&tunnel.Welcome{Features: []string{"heartbeat", "metadata"}, Deprecated: []string{"heartbeat", "metadata"}}, "(heartbeat, metadata); upgrade lobber"},
+	}
+
+	for _, tt := range tests {
+		got := deprecationWarning(tt.w)
+		if (tt.want == "") != (got == "") || !strings.Contains(got, tt.want) {
+			t.Errorf("deprecationWarning(%+v) = %q, want %q", tt.w, got, tt.want)
+		}
+	}
+}
+
+func TestPullRequest(t *testing.T) {
+	if pr, err := pullRequest("acme/web", 42); err != nil || pr.String() != "acme/web#42" {
+		t.Errorf("pullRequest() = %v, %v, want acme/web#42", pr, err)
+	}
+	if _, err := pullRequest("", 42); err == nil || !strings.Contains(err.Error(), "GITHUB_REPOSITORY") {
+		t.Errorf("pullRequest() without a repo error = %v, want a hint", err)
+	}
+	if _, err := pullRequest("acme/web", -1); err == nil {
+		t.Error("pullRequest() with a negative number succeeded")
+	}
+}
@@ -1,16 +1,63 @@
 package cli
 
 import (
+	"flag"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 
 	"gopkg.in/yaml.v3"
 )
 
 type Config struct {
-	Token          string `yaml:"token,omitempty"`
-	DefaultInspect bool   `yaml:"default_inspect,omitempty"`
+	Token          string       `yaml:"token,omitempty"`
+	DefaultInspect bool         `yaml:"default_inspect,omitempty"`
+	Preferences    *Preferences `yaml:"preferences,omitempty"` // saved by `lobber login`
+}
+
+// Preferences are the account's defaults, set in the dashboard and saved
+// from the relay at login so `lobber up` behaves the same on every machine
+type Preferences struct {
+	Region           string `json:"region" yaml:"region,omitempty"`
+	Inspect          bool   `json:"inspect" yaml:"inspect"`
+	LogRetentionDays int    `json:"log_retention_days" yaml:"log_retention_days,omitempty"`
+	BurstLimit       string `json:"burst_limit" yaml:"burst_limit,omitempty"`
+}
+
+// String summarizes the preferences for the login message
+func (p *Preferences) String() string {
+	parts := []string{"inspector off"}
+	if p.Inspect {
+		parts[0] = "inspector on"
+	}
+	if p.BurstLimit != "" {
+		parts = append(parts, "burst limit "+p.BurstLimit)
+	}
+	if p.LogRetentionDays > 0 {
+		parts = append(parts, fmt.Sprintf("logs kept %d days", p.LogRetentionDays))
+	}
+	if p.Region != "" {
+		parts = append(parts, "data in "+p.Region)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// applyPreferences sets the flags of `lobber up` left off the command line
+// to the account's preferences, so flags still override them for one run
+func applyPreferences(fs *flag.FlagSet, p *Preferences) {
+	if p == nil {
+		return
+	}
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	if !set["inspect"] && !set["no-inspect"] {
+		fs.Set("inspect", strconv.FormatBool(p.Inspect))
+	}
+	if !set["burst-limit"] && p.BurstLimit != "" {
+		fs.Set("burst-limit", p.BurstLimit)
+	}
 }
 
 func configDir() (string, error) {
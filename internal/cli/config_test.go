@@ -1,9 +1,12 @@
 package cli
 
 import (
+	"flag"
 	"os"
 	"path/filepath"
 	"testing"
+
+	"github.com/lobber-dev/lobber/internal/tunnel"
 )
 
 func TestConfigSaveLoad(t *testing.T) {
@@ -38,3 +41,88 @@ func TestConfigSaveLoad(t *testing.T) {
 		t.Error("config file not created")
 	}
 }
+
+func TestApplyPreferences(t *testing.T) {
+	prefs := &Preferences{Inspect: false, BurstLimit: "off"}
+	tests := []struct {
+		name    string
+		args    []string
+		prefs   *Preferences
+		inspect bool
+		burst   string
+	}{
+		{"no preferences", nil, nil, true, ""},
+		{"preferences", nil, prefs, false, "off"},
+		{"--inspect overrides", []string{"--inspect"}, prefs, true, "off"},
+		{"--no-inspect keeps inspect", []string{"--no-inspect"}, &Preferences{Inspect: true}, true, ""},
+		{"--burst-limit overrides", []string{"--burst-limit", "50"}, prefs, false, "50"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := flag.NewFlagSet("up", flag.ContinueOnError)
+			inspect := fs.Bool("inspect", true, "")
+			fs.Bool("no-inspect", false, "")
+			burst := fs.String("burst-limit", "", "")
+			if err := fs.Parse(tt.args); err != nil {
+				t.Fatal(err)
+			}
+
+			applyPreferences(fs, tt.prefs)
+			if *inspect != tt.inspect || *burst != tt.burst {
+				t.Errorf("inspect, burst-limit = %v, %q, want %v, %q", *inspect, *burst, tt.inspect, tt.burst)
+			}
+		})
+	}
+}
+
+func TestLoadProject(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		want    string
+		labels  map[string]string
+		wantErr bool
+	}{
+		{"no file", "", "", nil, false},
+		{"name and labels", "name: checkout\nlabels:\n  env: staging\n", "checkout", map[string]string{"env": "staging"}, false},
+		{"invalid name", "name: Checkout API\n", "", nil, true},
+		{"invalid label", "labels:\n  Env: staging\n", "", nil, true},
+		{"not yaml", "name: [", "", nil, true},
+		{"scrub rules", "scrub:\n  headers: [Authorization]\n  fields: [user.email]\n", "", nil, false},
+		{"invalid scrub pattern", "scrub:\n  patterns: ['(']\n", "", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if tt.file != "" {
+				if err := os.WriteFile(filepath.Join(dir, "lobber.yml"), []byte(tt.file), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			p, err := LoadProject(dir)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LoadProject() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if p.Name != tt.want {
+				t.Errorf("Name = %q, want %q", p.Name, tt.want)
+			}
+			if len(p.Labels) != len(tt.labels) || p.Labels["env"] != tt.labels["env"] {
+				t.Errorf("Labels = %v, want %v", p.Labels, tt.labels)
+			}
+		})
+	}
+}
+
+func TestProjectMergeLabels(t *testing.T) {
+	p := &Project{Labels: map[string]string{"env": "staging", "team": "payments"}}
+	got := p.mergeLabels(tunnel.Labels{"env": "prod"})
+	if got.String() != "env=prod,team=payments" {
+		t.Errorf("mergeLabels() = %s, want env=prod,team=payments", got)
+	}
+}
@@ -0,0 +1,100 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime/metrics"
+
+	"github.com/lobber-dev/lobber/internal/client"
+)
+
+// debugMetrics is what GET /debug/metrics on --debug-addr answers: the
+// process's runtime next to the tunnel's own counters
+type debugMetrics struct {
+	Goroutines   uint64         `json:"goroutines"`
+	HeapBytes    uint64         `json:"heap_bytes"` // live and not yet swept heap objects
+	GCCycles     uint64         `json:"gc_cycles"`
+	CPUSeconds   float64        `json:"cpu_seconds"`    // estimated from the Go runtime's view of its threads
+	GCCPUSeconds float64        `json:"gc_cpu_seconds"` // of those, spent collecting garbage
+	Tunnel       client.Metrics `json:"tunnel"`
+}
+
+// runtimeMetrics are the runtime/metrics samples debugMetrics is read from
+var runtimeMetrics = []string{
+	"/sched/goroutines:goroutines",
+	"/memory/classes/heap/objects:bytes",
+	"/gc/cycles/total:gc-cycles",
+	"/cpu/classes/total:cpu-seconds",
+	"/cpu/classes/gc/total:cpu-seconds",
+}
+
+// serveDebug serves pprof under /debug/pprof/ and c's metrics at
+// /debug/metrics on addr until ctx ends, and returns the address it
+// listens on. The profiles reveal requests' contents, so addr must be a
+// loopback one; without a host it's 127.0.0.1.
+func serveDebug(ctx context.Context, addr string, c *client.Client) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", fmt.Errorf("--debug-addr: %w", err)
+	}
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return "", fmt.Errorf("--debug-addr: %s is not a loopback address; pprof must not be reachable from other machines", host)
+	}
+	ln, err := net.Listen("tcp", net.JoinHostPort(host, port))
+	if err != nil {
+		return "", fmt.Errorf("listen: %w", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("GET /debug/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(readDebugMetrics(c))
+	})
+	go http.Serve(ln, mux)
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+	return ln.Addr().String(), nil
+}
+
+// readDebugMetrics samples the runtime and c for GET /debug/metrics
+func readDebugMetrics(c *client.Client) debugMetrics {
+	samples := make([]metrics.Sample, len(runtimeMetrics))
+	for i, name := range runtimeMetrics {
+		samples[i].Name = name
+	}
+	metrics.Read(samples)
+	u := func(i int) uint64 {
+		if samples[i].Value.Kind() != metrics.KindUint64 {
+			return 0
+		}
+		return samples[i].Value.Uint64()
+	}
+	f := func(i int) float64 {
+		if samples[i].Value.Kind() != metrics.KindFloat64 {
+			return 0
+		}
+		return samples[i].Value.Float64()
+	}
+	return debugMetrics{
+		Goroutines:   u(0),
+		HeapBytes:    u(1),
+		GCCycles:     u(2),
+		CPUSeconds:   f(3),
+		GCCPUSeconds: f(4),
+		Tunnel:       c.Metrics(),
+	}
+}
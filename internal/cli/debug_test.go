@@ -0,0 +1,52 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/lobber-dev/lobber/internal/client"
+)
+
+func TestServeDebug(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := client.New("http://localhost:3000", "http://relay.test", "token", "app.mysite.com")
+	addr, err := serveDebug(ctx, "127.0.0.1:0", c)
+	if err != nil {
+		t.Fatalf("serveDebug() error = %v", err)
+	}
+
+	resp, err := http.Get("http://" + addr + "/debug/pprof/")
+	if err != nil {
+		t.Fatalf("GET /debug/pprof/: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("GET /debug/pprof/ status = %d, want 200", resp.StatusCode)
+	}
+
+	resp, err = http.Get("http://" + addr + "/debug/metrics")
+	if err != nil {
+		t.Fatalf("GET /debug/metrics: %v", err)
+	}
+	defer resp.Body.Close()
+	var m debugMetrics
+	if err := json.NewDecoder(resp.Body).Decode(&m); err != nil {
+		t.Fatalf("decode metrics: %v", err)
+	}
+	if m.Goroutines == 0 || m.HeapBytes == 0 {
+		t.Errorf("metrics = %+v, want the runtime's goroutines and heap", m)
+	}
+
+	// Profiles aren't served beyond the machine
+	for _, addr := range []string{"0.0.0.0:0", "192.0.2.1:6060", "example.com:6060", "6060"} {
+		if _, err := serveDebug(ctx, addr, c); err == nil {
+			t.Errorf("serveDebug(%q) = nil error, want it refused", addr)
+		} else if !strings.HasPrefix(err.Error(), "--debug-addr") {
+			t.Errorf("serveDebug(%q) error = %v, want it to name the flag", addr, err)
+		}
+	}
+}
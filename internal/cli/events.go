@@ -0,0 +1,159 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// followWait is how long each request of `lobber events --follow`
+	// waits on the relay for new events
+	followWait = 30 * time.Second
+
+	// followRetry is the pause after a failed request before following again
+	followRetry = 5 * time.Second
+)
+
+// Event is an entry in the account's activity feed, as the relay reports it
+type Event struct {
+	ID        int64     `json:"id"`
+	Type      string    `json:"type"`
+	Hostname  string    `json:"hostname"`
+	Message   string    `json:"message"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func runEvents(args []string) error {
+	fs := flag.NewFlagSet("events", flag.ExitOnError)
+	token := fs.String("token", "", "API token (defaults to the one saved by lobber login)")
+	relay := fs.String("relay", "https://lobber.dev", "Relay server URL")
+	follow := fs.Bool("follow", false, "Keep printing new events as they happen")
+	limit := fs.Int("limit", 20, "Number of recent events to show")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	authToken := *token
+	if authToken == "" {
+		cfg, err := LoadConfig()
+		if err != nil {
+			return err
+		}
+		authToken = cfg.Token
+	}
+	if authToken == "" {
+		return errors.New("not logged in: run lobber login or pass --token")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	events, err := fetchEvents(ctx, *relay, authToken, 0, *limit, 0)
+	if err != nil {
+		return err
+	}
+	if len(events) == 0 && !*follow {
+		fmt.Println("No events")
+		return nil
+	}
+	var after int64
+	for _, e := range events {
+		fmt.Println(formatEvent(e))
+		after = e.ID
+	}
+	if !*follow {
+		return nil
+	}
+
+	for {
+		events, err := fetchEvents(ctx, *relay, authToken, after, 100, followWait)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "lobber: %v; retrying in %s\n", err, followRetry)
+			select {
+			case <-time.After(followRetry):
+			case <-ctx.Done():
+				return nil
+			}
+			continue
+		}
+		for _, e := range events {
+			fmt.Println(formatEvent(e))
+			after = e.ID
+		}
+	}
+}
+
+// fetchEvents asks the relay for the account's events after the given ID,
+// or the latest ones when after is 0. With a wait, the relay holds the
+// request until there is at least one.
+func fetchEvents(ctx context.Context, relayURL, token string, after int64, limit int, wait time.Duration) ([]Event, error) {
+	q := url.Values{}
+	q.Set("limit", strconv.Itoa(limit))
+	if after > 0 {
+		q.Set("after", strconv.FormatInt(after, 10))
+	}
+	if wait > 0 {
+		q.Set("wait", wait.String())
+	}
+	u := strings.TrimSuffix(relayURL, "/") + "/api/v1/events?" + q.Encode()
+
+	if wait == 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, 15*time.Second)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, fmt.Errorf("build request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetch events: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized:
+		return nil, errors.New("token was rejected; run lobber login again")
+	case http.StatusTooManyRequests:
+		return nil, fmt.Errorf("too many failed attempts, try again in %ss", resp.Header.Get("Retry-After"))
+	default:
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("fetch events: relay returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var page struct {
+		Events []Event `json:"events"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		return nil, fmt.Errorf("decode events: %w", err)
+	}
+	return page.Events, nil
+}
+
+// formatEvent renders an event as one line of `lobber events`
+func formatEvent(e Event) string {
+	line := fmt.Sprintf("%s  %-19s  %s", e.CreatedAt.Local().Format(time.DateTime), e.Type, e.Message)
+	if e.Hostname != "" {
+		line += "  " + e.Hostname
+	}
+	return line
+}
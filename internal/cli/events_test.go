@@ -0,0 +1,64 @@
+package cli
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestFetchEvents(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/events" || r.Header.Get("Authorization") != "Bearer lb_good" {
+			http.Error(w, "invalid token", http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Query().Get("after") == "7" && r.URL.Query().Get("wait") == "30s" {
+			w.Write([]byte(`{"events":[{"id":8,"type":"tunnel.disconnected","hostname":"app.example.com","message":"Tunnel disconnected (closed)"}]}`))
+			return
+		}
+		w.Write([]byte(`{"events":[{"id":7,"type":"tunnel.connected","hostname":"app.example.com","message":"Tunnel connected"}]}`))
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	events, err := fetchEvents(ctx, srv.URL+"/", "lb_good", 0, 20, 0)
+	if err != nil {
+		t.Fatalf("fetchEvents() error = %v", err)
+	}
+	if len(events) != 1 || events[0].ID != 7 || events[0].Type != "tunnel.connected" {
+		t.Errorf("events = %+v, want the connected event", events)
+	}
+
+	events, err = fetchEvents(ctx, srv.URL, "lb_good", 7, 100, followWait)
+	if err != nil {
+		t.Fatalf("fetchEvents() following error = %v", err)
+	}
+	if len(events) != 1 || events[0].ID != 8 {
+		t.Errorf("events following = %+v, want the event after 7", events)
+	}
+
+	if _, err := fetchEvents(ctx, srv.URL, "lb_bad", 0, 20, 0); err == nil {
+		t.Error("fetchEvents() with a bad token succeeded")
+	}
+}
+
+func TestFormatEvent(t *testing.T) {
+	at := time.Date(2026, 3, 1, 12, 30, 5, 0, time.Local)
+	tests := []struct {
+		event Event
+		want  string
+	}{
+		{Event{Type: "tunnel.connected", Hostname: "app.example.com", Message: "Tunnel checkout connected", CreatedAt: at},
+			"2026-03-01 12:30:05  tunnel.connected     Tunnel checkout connected  app.example.com"},
+		{Event{Type: "quota.warning", Message: "Most of this month's bandwidth is used", CreatedAt: at},
+			"2026-03-01 12:30:05  quota.warning        Most of this month's bandwidth is used"},
+	}
+
+	for _, tt := range tests {
+		if got := formatEvent(tt.event); got != tt.want {
+			t.Errorf("formatEvent() = %q, want %q", got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package cli
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// tokenEnv holds a token for `lobber login --token` on CI machines
+const tokenEnv = "LOBBER_TOKEN"
+
+// Account is the owner of an API token, as reported by the relay
+type Account struct {
+	ID    string `json:"id"`
+	Email string `json:"email"`
+	Name  string `json:"name"`
+	Plan  string `json:"plan"`
+
+	// Preferences are nil from relays too old to send them
+	Preferences *Preferences `json:"preferences,omitempty"`
+}
+
+// tokenFlag is --token. It takes the token as its value, or on its own
+// means "read it from LOBBER_TOKEN or stdin".
+type tokenFlag struct {
+	set   bool
+	value string
+}
+
+func (f *tokenFlag) String() string { return "" }
+
+func (f *tokenFlag) Set(v string) error {
+	f.set = true
+	if v != "true" {
+		f.value = v
+	}
+	return nil
+}
+
+func (f *tokenFlag) IsBoolFlag() bool { return true }
+
+func runLogin(args []string) error {
+	fs := flag.NewFlagSet("login", flag.ExitOnError)
+	var token tokenFlag
+	fs.Var(&token, "token", "Log in with an API token instead of the browser (value, $"+tokenEnv+" or stdin)")
+	relay := fs.String("relay", "https://lobber.dev", "Relay server URL")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if !token.set {
+		// TODO: Implement OAuth flow
+		fmt.Println("Opening browser for authentication...")
+		return nil
+	}
+
+	// `--token lb_...` parses as a bare flag followed by an argument
+	value := token.value
+	if value == "" && fs.NArg() > 0 {
+		value = fs.Arg(0)
+	}
+	tok, err := readToken(value, os.Getenv(tokenEnv), os.Stdin)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	account, err := fetchAccount(ctx, *relay, tok)
+	if err != nil {
+		return err
+	}
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		return err
+	}
+	cfg.Token = tok
+	cfg.Preferences = account.Preferences
+	if err := SaveConfig(cfg); err != nil {
+		return err
+	}
+
+	fmt.Printf("Logged in as %s (%s plan)\n", account.Email, account.Plan)
+	if account.Preferences != nil {
+		fmt.Printf("Preferences: %s\n", account.Preferences)
+	}
+	return nil
+}
+
+// readToken picks the token from the flag value, then the environment, then
+// stdin. A value of "-" always reads stdin. When stdin is a terminal the
+// user is prompted to paste the token.
+func readToken(value, env string, stdin *os.File) (string, error) {
+	if value == "" && env != "" {
+		value = env
+	}
+	if value == "" || value == "-" {
+		if info, err := stdin.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+			fmt.Fprint(os.Stderr, "Paste your API token: ")
+		}
+		var err error
+		value, err = readTokenFrom(stdin)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return "", errors.New("no token given: pass --token <token>, set " + tokenEnv + " or pipe it on stdin")
+	}
+	return value, nil
+}
+
+// readTokenFrom reads the first line of r
+func readTokenFrom(r io.Reader) (string, error) {
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", fmt.Errorf("read token: %w", err)
+	}
+	return strings.TrimSpace(line), nil
+}
+
+// fetchAccount checks token against the relay and returns who it belongs to
+func fetchAccount(ctx context.Context, relayURL, token string) (*Account, error) {
+	url := strings.TrimSuffix(relayURL, "/") + "/api/v1/me"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("build request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("check token: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized:
+		return nil, errors.New("token was rejected; create a new one in the dashboard")
+	case http.StatusTooManyRequests:
+		return nil, fmt.Errorf("too many failed attempts, try again in %ss", resp.Header.Get("Retry-After"))
+	default:
+		return nil, fmt.Errorf("check token: %s returned %s", url, resp.Status)
+	}
+
+	var account Account
+	if err := json.NewDecoder(resp.Body).Decode(&account); err != nil {
+		return nil, fmt.Errorf("decode account: %w", err)
+	}
+	return &account, nil
+}
@@ -0,0 +1,110 @@
+package cli
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// tokenFile returns an open file holding content, standing in for stdin
+func tokenFile(t *testing.T, content string) *os.File {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "stdin")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+func TestReadToken(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		env   string
+		stdin string
+		want  string
+	}{
+		{"flag", "lb_flag", "lb_env", "lb_stdin\n", "lb_flag"},
+		{"env", "", "lb_env", "lb_stdin\n", "lb_env"},
+		{"stdin", "", "", "lb_stdin\nignored\n", "lb_stdin"},
+		{"dash reads stdin", "-", "lb_env", "  lb_stdin  ", "lb_stdin"},
+		{"nothing", "", "", "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readToken(tt.value, tt.env, tokenFile(t, tt.stdin))
+			if tt.want == "" {
+				if err == nil {
+					t.Errorf("readToken() = %q, want an error", got)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("readToken() = %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestFetchAccount(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/me" || r.Header.Get("Authorization") != "Bearer lb_good" {
+			http.Error(w, "invalid token", http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"id":"user-1","email":"dev@example.com","plan":"pro"}`))
+	}))
+	defer srv.Close()
+
+	account, err := fetchAccount(context.Background(), srv.URL+"/", "lb_good")
+	if err != nil {
+		t.Fatalf("fetchAccount() error = %v", err)
+	}
+	if account.Email != "dev@example.com" || account.Plan != "pro" {
+		t.Errorf("account = %+v, want dev@example.com on pro", account)
+	}
+
+	if _, err := fetchAccount(context.Background(), srv.URL, "lb_bad"); err == nil {
+		t.Error("fetchAccount() with a bad token succeeded")
+	}
+}
+
+func TestLoginWithToken(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv(tokenEnv, "")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer lb_good" {
+			http.Error(w, "invalid token", http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"id":"user-1","email":"dev@example.com","plan":"free","preferences":{"region":"eu","inspect":false,"burst_limit":"off"}}`))
+	}))
+	defer srv.Close()
+
+	if err := runLogin([]string{"--relay", srv.URL, "--token", "lb_bad"}); err == nil {
+		t.Fatal("login with a bad token succeeded")
+	}
+	if cfg, _ := LoadConfig(); cfg.Token != "" {
+		t.Fatalf("bad token was saved: %q", cfg.Token)
+	}
+
+	if err := runLogin([]string{"--relay", srv.URL, "--token", "lb_good"}); err != nil {
+		t.Fatalf("login: %v", err)
+	}
+	cfg, _ := LoadConfig()
+	if cfg.Token != "lb_good" {
+		t.Errorf("saved token = %q, want lb_good", cfg.Token)
+	}
+	if want := (Preferences{Region: "eu", BurstLimit: "off"}); cfg.Preferences == nil || *cfg.Preferences != want {
+		t.Errorf("saved preferences = %+v, want %+v", cfg.Preferences, want)
+	}
+}
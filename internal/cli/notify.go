@@ -0,0 +1,92 @@
+package cli
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+)
+
+// notifier shows desktop notifications for `lobber up --notify`: the
+// tunnel's first visitor and its connection dropping, so trouble during a
+// demo doesn't go unnoticed with the terminal out of sight
+type notifier struct {
+	goos   string
+	domain string
+
+	firstVisit sync.Once
+	warnOnce   sync.Once // failures are logged once; the rest are likely the same
+}
+
+func newNotifier(goos, domain string) *notifier {
+	return &notifier{goos: goos, domain: domain}
+}
+
+// visited notes a request, notifying for the first
+func (n *notifier) visited(method, path string) {
+	n.firstVisit.Do(func() {
+		n.notify("First visitor on "+n.domain, method+" "+path)
+	})
+}
+
+// dropped notifies that the connection died and the client is reconnecting
+func (n *notifier) dropped(reason string) {
+	n.notify("Tunnel dropped", fmt.Sprintf("%s lost its connection after %s; reconnecting", n.domain, reason))
+}
+
+// stopped notifies that the tunnel has gone down for good. It waits for
+// the notification, as the process exits next.
+func (n *notifier) stopped(err error) {
+	n.show("Tunnel down", fmt.Sprintf("%s: %v", n.domain, err))
+}
+
+// notify shows a notification without waiting for it
+func (n *notifier) notify(title, message string) {
+	go n.show(title, message)
+}
+
+// show shows a notification
+func (n *notifier) show(title, message string) {
+	cmd := notifyCommand(n.goos, title, message)
+	if cmd == nil {
+		n.warnOnce.Do(func() { log.Printf("desktop notifications are not supported on %s", n.goos) })
+		return
+	}
+	if out, err := runCommand(cmd[0], cmd[1:]...); err != nil {
+		n.warnOnce.Do(func() {
+			log.Printf("desktop notification: %s: %v %s", cmd[0], err, strings.TrimSpace(string(out)))
+		})
+	}
+}
+
+// notifyCommand is the command that shows a notification on goos:
+// osascript on macOS, notify-send on Linux and a tray balloon from
+// PowerShell on Windows. It's nil elsewhere.
+func notifyCommand(goos, title, message string) []string {
+	switch goos {
+	case "darwin":
+		script := fmt.Sprintf("display notification %s with title %s", appleScriptString(message), appleScriptString("lobber: "+title))
+		return []string{"osascript", "-e", script}
+	case "linux":
+		return []string{"notify-send", "--app-name=lobber", title, message}
+	case "windows":
+		script := fmt.Sprintf("Add-Type -AssemblyName System.Windows.Forms; "+
+			"$n = New-Object System.Windows.Forms.NotifyIcon; "+
+			"$n.Icon = [System.Drawing.SystemIcons]::Information; $n.Visible = $true; "+
+			"$n.ShowBalloonTip(5000, %s, %s, 'Info'); Start-Sleep -Seconds 6; $n.Dispose()",
+			powerShellString("lobber: "+title), powerShellString(message))
+		return []string{"powershell", "-NoProfile", "-NonInteractive", "-Command", script}
+	}
+	return nil
+}
+
+// appleScriptString quotes s as an AppleScript string literal
+func appleScriptString(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// powerShellString quotes s as a single-quoted PowerShell literal, in which
+// only quotes need escaping, by doubling
+func powerShellString(s string) string {
+	return "'" + strings.NewReplacer("'", "''", "‘", "''", "’", "''").Replace(s) + "'"
+}
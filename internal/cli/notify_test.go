@@ -0,0 +1,52 @@
+package cli
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestNotifyCommand(t *testing.T) {
+	tests := []struct {
+		goos string
+		want string
+	}{
+		{"darwin", `osascript -e display notification "GET /say?q=\"hi\"" with title "lobber: First visitor"`},
+		{"linux", `notify-send --app-name=lobber First visitor GET /say?q="hi"`},
+		{"windows", `$n.ShowBalloonTip(5000, 'lobber: First visitor', 'GET /say?q="hi"', 'Info')`},
+		{"plan9", ""},
+	}
+	for _, tt := range tests {
+		got := strings.Join(notifyCommand(tt.goos, "First visitor", `GET /say?q="hi"`), " ")
+		if !strings.Contains(got, tt.want) || (tt.want == "") != (got == "") {
+			t.Errorf("notifyCommand(%s) = %q, want %q", tt.goos, got, tt.want)
+		}
+	}
+	if got := powerShellString("it's"); got != "'it''s'" {
+		t.Errorf("powerShellString() = %q, want 'it''s'", got)
+	}
+}
+
+func TestNotifierFirstVisit(t *testing.T) {
+	shown := make(chan string, 4)
+	orig := runCommand
+	runCommand = func(name string, args ...string) ([]byte, error) {
+		shown <- strings.Join(args, " ")
+		return nil, errors.New("no display")
+	}
+	t.Cleanup(func() { runCommand = orig })
+
+	n := newNotifier("linux", "demo.mysite.com")
+	n.visited("GET", "/")
+	n.visited("POST", "/checkout")
+	if got := <-shown; !strings.Contains(got, "First visitor on demo.mysite.com GET /") {
+		t.Errorf("notification = %q, want the first visit", got)
+	}
+	n.stopped(errors.New("relay went away"))
+	if got := <-shown; !strings.Contains(got, "Tunnel down") {
+		t.Errorf("notification = %q, want the tunnel down", got)
+	}
+	if len(shown) != 0 {
+		t.Errorf("%d more notifications, want one per first visit", len(shown))
+	}
+}
@@ -0,0 +1,69 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/lobber-dev/lobber/internal/scrub"
+	"github.com/lobber-dev/lobber/internal/tunnel"
+)
+
+// projectFile is lobber.yml, which a project checks in so its tunnel keeps
+// the same name, labels and scrub rules whoever runs `lobber up`
+const projectFile = "lobber.yml"
+
+type Project struct {
+	Name   string            `yaml:"name,omitempty"`
+	Labels map[string]string `yaml:"labels,omitempty"`
+	Scrub  scrub.Rules       `yaml:"scrub,omitempty"` // redacted from requests in the inspector
+}
+
+// LoadProject reads lobber.yml from dir, returning an empty project if
+// there is none
+func LoadProject(dir string) (*Project, error) {
+	data, err := os.ReadFile(filepath.Join(dir, projectFile))
+	if os.IsNotExist(err) {
+		return &Project{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", projectFile, err)
+	}
+
+	var p Project
+	if err := yaml.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", projectFile, err)
+	}
+	if p.Name != "" {
+		if err := tunnel.ValidateName(p.Name); err != nil {
+			return nil, fmt.Errorf("%s: %w", projectFile, err)
+		}
+	}
+	if len(p.Labels) > 0 {
+		if _, err := tunnel.ParseLabels(tunnel.Labels(p.Labels).String()); err != nil {
+			return nil, fmt.Errorf("%s: %w", projectFile, err)
+		}
+	}
+	if _, err := scrub.New(p.Scrub); err != nil {
+		return nil, fmt.Errorf("%s: %w", projectFile, err)
+	}
+	return &p, nil
+}
+
+// mergeLabels returns the project's labels with flags overriding any
+// with the same key
+func (p *Project) mergeLabels(flags tunnel.Labels) tunnel.Labels {
+	if len(p.Labels) == 0 {
+		return flags
+	}
+	merged := tunnel.Labels{}
+	for k, v := range p.Labels {
+		merged[k] = v
+	}
+	for k, v := range flags {
+		merged[k] = v
+	}
+	return merged
+}
@@ -0,0 +1,363 @@
+package cli
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"html"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+)
+
+const defaultServiceName = "lobber"
+
+const serviceUsage = `usage: lobber service <command> [flags] [args]
+
+Commands:
+  install <domain>:<port>  Run the tunnel in the background and start it on boot
+  uninstall                Stop the tunnel and remove the service
+  start                    Start the installed tunnel
+  stop                     Stop the installed tunnel
+  status                   Show whether the tunnel is running`
+
+var serviceNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+
+// runCommand runs a service manager command and returns its output; tests
+// replace it to avoid touching the real service manager
+var runCommand = func(name string, args ...string) ([]byte, error) {
+	return exec.Command(name, args...).CombinedOutput()
+}
+
+// serviceManager installs and controls a tunnel with the platform's service
+// manager: a systemd user unit on Linux, a launchd agent on macOS and a
+// scheduled task that runs at logon on Windows
+type serviceManager struct {
+	goos string
+	name string
+	home string
+}
+
+func newServiceManager(goos, name string) (*serviceManager, error) {
+	if !serviceNamePattern.MatchString(name) {
+		return nil, fmt.Errorf("invalid service name %q: use lowercase letters, digits and dashes", name)
+	}
+	switch goos {
+	case "linux", "darwin", "windows":
+	default:
+		return nil, fmt.Errorf("lobber service is not supported on %s", goos)
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, fmt.Errorf("get home dir: %w", err)
+	}
+	return &serviceManager{goos: goos, name: name, home: home}, nil
+}
+
+// label is the launchd job label
+func (m *serviceManager) label() string {
+	return "dev.lobber." + m.name
+}
+
+// path is the unit or plist file the service is defined in; Windows keeps
+// scheduled tasks in the registry so there is no file
+func (m *serviceManager) path() string {
+	switch m.goos {
+	case "linux":
+		dir := os.Getenv("XDG_CONFIG_HOME")
+		if dir == "" {
+			dir = filepath.Join(m.home, ".config")
+		}
+		return filepath.Join(dir, "systemd", "user", m.name+".service")
+	case "darwin":
+		return filepath.Join(m.home, "Library", "LaunchAgents", m.label()+".plist")
+	}
+	return ""
+}
+
+// run executes each command in turn and stops at the first failure
+func (m *serviceManager) run(cmds ...[]string) error {
+	for _, cmd := range cmds {
+		out, err := runCommand(cmd[0], cmd[1:]...)
+		if err != nil {
+			msg := strings.TrimSpace(string(out))
+			if msg == "" {
+				return fmt.Errorf("%s: %w", strings.Join(cmd, " "), err)
+			}
+			return fmt.Errorf("%s: %w: %s", strings.Join(cmd, " "), err, msg)
+		}
+	}
+	return nil
+}
+
+// install writes the service definition for args, enables it at boot and
+// starts it
+func (m *serviceManager) install(executable string, args []string) error {
+	switch m.goos {
+	case "linux":
+		if err := m.writeFile(systemdUnit(m.name, executable, args)); err != nil {
+			return err
+		}
+		return m.run(
+			[]string{"systemctl", "--user", "daemon-reload"},
+			[]string{"systemctl", "--user", "enable", "--now", m.name + ".service"},
+		)
+	case "darwin":
+		logPath := filepath.Join(m.home, ".lobber", m.name+".log")
+		if err := m.writeFile(launchdPlist(m.label(), executable, args, logPath)); err != nil {
+			return err
+		}
+		return m.run([]string{"launchctl", "load", "-w", m.path()})
+	default:
+		return m.run(
+			[]string{"schtasks", "/Create", "/F", "/TN", m.name, "/SC", "ONLOGON", "/RL", "LIMITED", "/TR", windowsCommandLine(executable, args)},
+			[]string{"schtasks", "/Run", "/TN", m.name},
+		)
+	}
+}
+
+func (m *serviceManager) writeFile(content string) error {
+	path := m.path()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("create service dir: %w", err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		return fmt.Errorf("write service file: %w", err)
+	}
+	return nil
+}
+
+// uninstall stops the service and removes its definition
+func (m *serviceManager) uninstall() error {
+	switch m.goos {
+	case "linux":
+		if err := m.run([]string{"systemctl", "--user", "disable", "--now", m.name + ".service"}); err != nil {
+			return err
+		}
+	case "darwin":
+		if err := m.run([]string{"launchctl", "unload", "-w", m.path()}); err != nil {
+			return err
+		}
+	default:
+		// /End fails when the task isn't running, which is fine here
+		m.run([]string{"schtasks", "/End", "/TN", m.name})
+		return m.run([]string{"schtasks", "/Delete", "/F", "/TN", m.name})
+	}
+
+	if err := os.Remove(m.path()); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("remove service file: %w", err)
+	}
+	if m.goos == "linux" {
+		return m.run([]string{"systemctl", "--user", "daemon-reload"})
+	}
+	return nil
+}
+
+func (m *serviceManager) start() error {
+	switch m.goos {
+	case "linux":
+		return m.run([]string{"systemctl", "--user", "start", m.name + ".service"})
+	case "darwin":
+		return m.run([]string{"launchctl", "load", m.path()})
+	default:
+		return m.run([]string{"schtasks", "/Run", "/TN", m.name})
+	}
+}
+
+// stop stops the tunnel until the next start or reboot; it stays installed
+func (m *serviceManager) stop() error {
+	switch m.goos {
+	case "linux":
+		return m.run([]string{"systemctl", "--user", "stop", m.name + ".service"})
+	case "darwin":
+		return m.run([]string{"launchctl", "unload", m.path()})
+	default:
+		return m.run([]string{"schtasks", "/End", "/TN", m.name})
+	}
+}
+
+// status returns the service manager's description of the service. Service
+// managers exit non-zero for stopped services, so that isn't an error.
+func (m *serviceManager) status() (string, error) {
+	var cmd []string
+	switch m.goos {
+	case "linux":
+		cmd = []string{"systemctl", "--user", "status", "--no-pager", m.name + ".service"}
+	case "darwin":
+		cmd = []string{"launchctl", "list", m.label()}
+	default:
+		cmd = []string{"schtasks", "/Query", "/V", "/FO", "LIST", "/TN", m.name}
+	}
+	out, err := runCommand(cmd[0], cmd[1:]...)
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		return "", fmt.Errorf("%s: %w", strings.Join(cmd, " "), err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// systemdUnit renders a user unit that keeps the tunnel running
+func systemdUnit(name, executable string, args []string) string {
+	quoted := make([]string, 0, len(args)+1)
+	for _, a := range append([]string{executable}, args...) {
+		quoted = append(quoted, systemdQuote(a))
+	}
+	return fmt.Sprintf(`[Unit]
+Description=Lobber tunnel (%s)
+After=network-online.target
+Wants=network-online.target
+
+[Service]
+Type=notify
+ExecStart=%s
+Restart=always
+RestartSec=5
+# A rejected token or domain won't fix itself; see lobber up --supervised
+RestartPreventExitStatus=%d %d
+
+[Install]
+WantedBy=default.target
+`, name, strings.Join(quoted, " "), ExitNoPerm, ExitConfig)
+}
+
+// systemdQuote quotes an ExecStart argument if it needs it
+func systemdQuote(s string) string {
+	if s != "" && !strings.ContainsAny(s, " \t\"'\\$%;") {
+		return s
+	}
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, `$`, `$$`, `%`, `%%`)
+	return `"` + r.Replace(s) + `"`
+}
+
+// launchdPlist renders a launch agent that starts at login and restarts the
+// tunnel if it exits
+func launchdPlist(label, executable string, args []string, logPath string) string {
+	var b strings.Builder
+	for _, a := range append([]string{executable}, args...) {
+		fmt.Fprintf(&b, "\t\t<string>%s</string>\n", html.EscapeString(a))
+	}
+	return fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Label</key>
+	<string>%s</string>
+	<key>ProgramArguments</key>
+	<array>
+%s	</array>
+	<key>RunAtLoad</key>
+	<true/>
+	<key>KeepAlive</key>
+	<true/>
+	<key>StandardOutPath</key>
+	<string>%s</string>
+	<key>StandardErrorPath</key>
+	<string>%s</string>
+</dict>
+</plist>
+`, html.EscapeString(label), b.String(), html.EscapeString(logPath), html.EscapeString(logPath))
+}
+
+// windowsCommandLine joins the command for schtasks /TR, quoting anything
+// with spaces
+func windowsCommandLine(executable string, args []string) string {
+	parts := make([]string, 0, len(args)+1)
+	for _, a := range append([]string{executable}, args...) {
+		if a == "" || strings.ContainsAny(a, " \t") {
+			a = `"` + a + `"`
+		}
+		parts = append(parts, a)
+	}
+	return strings.Join(parts, " ")
+}
+
+func runService(args []string) error {
+	if len(args) == 0 {
+		return errors.New(serviceUsage)
+	}
+
+	fs := flag.NewFlagSet("service "+args[0], flag.ExitOnError)
+	name := fs.String("name", defaultServiceName, "Service name, to run more than one tunnel")
+	relay := fs.String("relay", "https://lobber.dev", "Relay server URL")
+	domain := fs.String("domain", "", "Custom domain to use")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	m, err := newServiceManager(runtime.GOOS, *name)
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "install":
+		if fs.NArg() != 1 {
+			return errors.New("usage: lobber service install [--name NAME] [--relay URL] [--domain DOMAIN] <domain>:<port>")
+		}
+		return installService(m, fs.Arg(0), *relay, *domain)
+	case "uninstall":
+		if err := m.uninstall(); err != nil {
+			return err
+		}
+		fmt.Printf("Removed service %s\n", m.name)
+	case "start":
+		if err := m.start(); err != nil {
+			return err
+		}
+		fmt.Printf("Started %s\n", m.name)
+	case "stop":
+		if err := m.stop(); err != nil {
+			return err
+		}
+		fmt.Printf("Stopped %s\n", m.name)
+	case "status":
+		out, err := m.status()
+		if err != nil {
+			return err
+		}
+		fmt.Println(out)
+	default:
+		return fmt.Errorf("unknown service command: %s\n\n%s", args[0], serviceUsage)
+	}
+	return nil
+}
+
+// installService installs a service that runs `lobber up target`. The
+// service reads the token saved by `lobber login`, so it never appears in
+// the unit file.
+func installService(m *serviceManager, target, relay, domain string) error {
+	cfg, err := LoadConfig()
+	if err != nil {
+		return err
+	}
+	if cfg.Token == "" {
+		return errors.New("not logged in: run `lobber login` first so the service has a token")
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("find lobber binary: %w", err)
+	}
+	if resolved, err := filepath.EvalSymlinks(executable); err == nil {
+		executable = resolved
+	}
+
+	// Flags go before the target; flag parsing stops at the first argument
+	args := []string{"up", "--relay", relay, "--supervised"}
+	if domain != "" {
+		args = append(args, "--domain", domain)
+	}
+	args = append(args, target)
+	if err := m.install(executable, args); err != nil {
+		return err
+	}
+
+	fmt.Printf("Installed service %s: %s\n", m.name, target)
+	if m.goos == "linux" {
+		fmt.Println("To keep it running while you're logged out, run: loginctl enable-linger")
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package cli
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+// fakeCommands records service manager commands instead of running them
+func fakeCommands(t *testing.T) *[]string {
+	t.Helper()
+	var ran []string
+	orig := runCommand
+	runCommand = func(name string, args ...string) ([]byte, error) {
+		ran = append(ran, strings.Join(append([]string{name}, args...), " "))
+		return nil, nil
+	}
+	t.Cleanup(func() { runCommand = orig })
+	return &ran
+}
+
+func TestSystemdUnit(t *testing.T) {
+	unit := systemdUnit("lobber", "/opt/my tools/lobber", []string{"up", "--relay", "https://lobber.dev", "app.example.com:3000"})
+	want := `ExecStart="/opt/my tools/lobber" up --relay https://lobber.dev app.example.com:3000`
+	if !strings.Contains(unit, want+"\n") {
+		t.Errorf("unit is missing %q:\n%s", want, unit)
+	}
+	for _, want := range []string{"Type=notify", "Restart=always", "RestartPreventExitStatus=77 78", "WantedBy=default.target"} {
+		if !strings.Contains(unit, want+"\n") {
+			t.Errorf("unit is missing %q:\n%s", want, unit)
+		}
+	}
+}
+
+func TestSystemdQuote(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"plain", "plain"},
+		{"", `""`},
+		{"has space", `"has space"`},
+		{`50%$"x"`, `"50%%$$\"x\""`},
+	}
+	for _, tt := range tests {
+		if got := systemdQuote(tt.in); got != tt.want {
+			t.Errorf("systemdQuote(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestLaunchdPlist(t *testing.T) {
+	plist := launchdPlist("dev.lobber.web", "/usr/local/bin/lobber", []string{"up", "a&b.example.com:3000"}, "/Users/dev/.lobber/web.log")
+	for _, want := range []string{
+		"<string>dev.lobber.web</string>",
+		"\t\t<string>/usr/local/bin/lobber</string>\n\t\t<string>up</string>\n\t\t<string>a&amp;b.example.com:3000</string>\n",
+		"<key>KeepAlive</key>",
+	} {
+		if !strings.Contains(plist, want) {
+			t.Errorf("plist is missing %q:\n%s", want, plist)
+		}
+	}
+}
+
+func TestWindowsCommandLine(t *testing.T) {
+	got := windowsCommandLine(`C:\Program Files\lobber.exe`, []string{"up", "app.example.com:3000"})
+	want := `"C:\Program Files\lobber.exe" up app.example.com:3000`
+	if got != want {
+		t.Errorf("windowsCommandLine() = %q, want %q", got, want)
+	}
+}
+
+func TestNewServiceManager(t *testing.T) {
+	tests := []struct {
+		goos, name string
+		ok         bool
+	}{
+		{"linux", "lobber", true},
+		{"darwin", "api-tunnel", true},
+		{"windows", "lobber", true},
+		{"plan9", "lobber", false},
+		{"linux", "../etc", false},
+		{"linux", "Lobber", false},
+	}
+	for _, tt := range tests {
+		_, err := newServiceManager(tt.goos, tt.name)
+		if (err == nil) != tt.ok {
+			t.Errorf("newServiceManager(%q, %q) error = %v, want ok = %v", tt.goos, tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestServiceInstallLinux(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", "")
+	ran := fakeCommands(t)
+
+	m, err := newServiceManager("linux", "web")
+	if err != nil {
+		t.Fatalf("newServiceManager() error = %v", err)
+	}
+	if err := installService(m, "app.example.com:3000", "https://lobber.dev", ""); err == nil {
+		t.Fatal("install without a saved token succeeded")
+	}
+
+	if err := SaveConfig(&Config{Token: "lb_test"}); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	if err := installService(m, "app.example.com:3000", "https://lobber.dev", ""); err != nil {
+		t.Fatalf("install: %v", err)
+	}
+
+	unit, err := os.ReadFile(home + "/.config/systemd/user/web.service")
+	if err != nil {
+		t.Fatalf("read unit: %v", err)
+	}
+	if !strings.Contains(string(unit), " up --relay https://lobber.dev --supervised app.example.com:3000\n") {
+		t.Errorf("unit doesn't run the tunnel:\n%s", unit)
+	}
+	if strings.Contains(string(unit), "lb_test") {
+		t.Error("unit contains the API token")
+	}
+	want := "systemctl --user daemon-reload,systemctl --user enable --now web.service"
+	if got := strings.Join(*ran, ","); got != want {
+		t.Errorf("commands = %q, want %q", got, want)
+	}
+
+	*ran = nil
+	if err := m.uninstall(); err != nil {
+		t.Fatalf("uninstall: %v", err)
+	}
+	if _, err := os.Stat(m.path()); !os.IsNotExist(err) {
+		t.Errorf("unit still exists after uninstall: %v", err)
+	}
+	if len(*ran) != 2 || !strings.Contains((*ran)[0], "disable --now web.service") {
+		t.Errorf("uninstall commands = %q", *ran)
+	}
+}
@@ -0,0 +1,128 @@
+package cli
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"flag"
+	"fmt"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/lobber-dev/lobber/internal/client"
+	"github.com/lobber-dev/lobber/internal/dnsname"
+	"github.com/lobber-dev/lobber/internal/tunnel"
+)
+
+const shareUsage = "usage: lobber share once [--max-requests N] [--ttl DURATION] [--relay URL] <domain>:<port>"
+
+// shareLabel encodes the random label of a share hostname
+var shareLabel = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+// runShare handles `lobber share once`, which serves a local port on a
+// fresh random hostname under domain that the relay retires after a number
+// of requests or a time limit, so no standing URL is left behind
+func runShare(args []string) error {
+	if len(args) == 0 || args[0] != "once" {
+		return errors.New(shareUsage)
+	}
+
+	fs := flag.NewFlagSet("share once", flag.ExitOnError)
+	token := fs.String("token", "", "API token (for CI/CD)")
+	relay := fs.String("relay", "https://lobber.dev", "Relay server URL")
+	maxRequests := fs.Int("max-requests", 0, "Retire the link after this many requests; 0 for no request limit")
+	ttl := fs.Duration("ttl", time.Hour, "Retire the link this long after it goes live; 0 for no time limit")
+	quiet := fs.Bool("quiet", false, "Minimal output")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New(shareUsage)
+	}
+
+	limits := tunnel.ShareLimits{MaxRequests: *maxRequests, TTL: *ttl}
+	if err := limits.Validate(); err != nil {
+		return err
+	}
+
+	// Shares go under the domain given, or the default one
+	parent, localPort, ok := strings.Cut(fs.Arg(0), ":")
+	if !ok {
+		parent, localPort = "tunnel.lobber.dev", fs.Arg(0)
+	}
+	hostname, err := shareHostname(parent)
+	if err != nil {
+		return err
+	}
+
+	authToken := *token
+	if authToken == "" {
+		cfg, err := LoadConfig()
+		if err == nil && cfg.Token != "" {
+			authToken = cfg.Token
+		} else {
+			// Use a default dev token for local testing
+			authToken = "dev-token"
+		}
+	}
+
+	c := client.New(fmt.Sprintf("http://localhost:%s", localPort), *relay, authToken, hostname)
+	c.Share = limits
+	c.SetOnReady(func() {
+		link := publicURL(*relay, hostname).String()
+		if w := c.Welcome(); w != nil && len(w.URLs) > 0 {
+			link = w.URLs[0]
+		}
+		if *quiet {
+			fmt.Println(link)
+			return
+		}
+		fmt.Printf("Share link ready: %s\n", link)
+		fmt.Printf("It stops working after %s\n", describeShareLimits(limits))
+		fmt.Println("Press Ctrl+C to retire it early")
+	})
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	err = c.Run(ctx)
+	var disconnect *client.DisconnectError
+	switch {
+	case err == nil, errors.Is(err, context.Canceled):
+		return nil
+	case errors.As(err, &disconnect):
+		// The relay retiring the link is how a share is meant to end
+		if !*quiet {
+			fmt.Printf("%s: %s\n", hostname, disconnect.Reason)
+		}
+		return nil
+	}
+	return &ExitError{Code: tunnelExitCode(err), Err: fmt.Errorf("tunnel error: %w", err)}
+}
+
+// shareHostname returns a new hostname under parent with a random label
+// nobody can guess, e.g. "k3vq7m2xwa4tc.share.mysite.com"
+func shareHostname(parent string) (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return dnsname.Normalize(shareLabel.EncodeToString(b) + "." + parent)
+}
+
+// describeShareLimits says when a share retires, e.g. "50 requests or 1h0m0s"
+func describeShareLimits(l tunnel.ShareLimits) string {
+	var limits []string
+	if l.MaxRequests == 1 {
+		limits = append(limits, "1 request")
+	} else if l.MaxRequests > 0 {
+		limits = append(limits, fmt.Sprintf("%d requests", l.MaxRequests))
+	}
+	if l.TTL > 0 {
+		limits = append(limits, l.TTL.String())
+	}
+	return strings.Join(limits, " or ")
+}
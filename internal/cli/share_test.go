@@ -0,0 +1,43 @@
+package cli
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lobber-dev/lobber/internal/tunnel"
+)
+
+func TestShareHostname(t *testing.T) {
+	a, err := shareHostname("Share.MySite.com")
+	if err != nil {
+		t.Fatalf("shareHostname() error = %v", err)
+	}
+	label, parent, _ := strings.Cut(a, ".")
+	if parent != "share.mysite.com" || len(label) != 13 {
+		t.Errorf("shareHostname() = %q, want a 13-character label under share.mysite.com", a)
+	}
+	if b, _ := shareHostname("share.mysite.com"); a == b {
+		t.Errorf("shareHostname() returned %q twice", a)
+	}
+	if _, err := shareHostname("bad_domain"); err == nil {
+		t.Error("shareHostname(bad_domain) error = nil, want an invalid name")
+	}
+}
+
+func TestDescribeShareLimits(t *testing.T) {
+	tests := []struct {
+		limits tunnel.ShareLimits
+		want   string
+	}{
+		{tunnel.ShareLimits{MaxRequests: 50, TTL: time.Hour}, "50 requests or 1h0m0s"},
+		{tunnel.ShareLimits{MaxRequests: 1}, "1 request"},
+		{tunnel.ShareLimits{TTL: 30 * time.Minute}, "30m0s"},
+	}
+
+	for _, tt := range tests {
+		if got := describeShareLimits(tt.limits); got != tt.want {
+			t.Errorf("describeShareLimits(%+v) = %q, want %q", tt.limits, got, tt.want)
+		}
+	}
+}
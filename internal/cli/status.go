@@ -0,0 +1,160 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/lobber-dev/lobber/internal/client"
+	"github.com/lobber-dev/lobber/internal/proxyerr"
+	"github.com/lobber-dev/lobber/internal/scrub"
+)
+
+// serveInspector serves c's inspector on localhost:port until the process
+// exits, and returns the address it listens on. Its compose console sends
+// requests to c's local server or to the URL public returns for c. Its
+// tunnels API opens more tunnels with open, recorded in the same inspector,
+// that run until ctx ends.
+func serveInspector(ctx context.Context, c *client.Client, port int, scrubber *scrub.Scrubber, public func(*client.Client) string, open func(port int, domain string) (*client.Client, error)) (string, error) {
+	ln, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		return "", fmt.Errorf("listen: %w", err)
+	}
+	inspector := client.NewInspector()
+	inspector.SetQualitySource(c.Quality)
+	inspector.SetScrubber(scrubber)
+	inspector.SetComposeTargets(c.LocalAddr, func() string { return public(c) })
+	c.SetInspector(inspector)
+	tunnels := client.NewTunnels(ctx, c, func(port int, domain string) (*client.Client, error) {
+		nc, err := open(port, domain)
+		if err == nil {
+			nc.SetInspector(inspector)
+		}
+		return nc, err
+	}, public)
+	inspector.Handle("/api/tunnels", tunnels)
+	inspector.Handle("/api/tunnels/", tunnels)
+	go http.Serve(ln, inspector)
+	return ln.Addr().String(), nil
+}
+
+func runStatus(args []string) error {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	inspectPort := fs.Int("inspect-port", 4040, "Inspector port of the running tunnel")
+	showErrors := fs.Bool("errors", false, "List the latest requests the tunnel failed to forward, and why")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	// A running `lobber up` reports its connection through the inspector
+	httpClient := &http.Client{Timeout: 2 * time.Second}
+	resp, err := httpClient.Get(fmt.Sprintf("http://127.0.0.1:%d/api/quality", *inspectPort))
+	if err != nil {
+		fmt.Println("No active tunnels")
+		return nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		fmt.Println("No active tunnels")
+		return nil
+	}
+
+	var q client.Quality
+	if err := json.NewDecoder(resp.Body).Decode(&q); err != nil {
+		return fmt.Errorf("read tunnel status: %w", err)
+	}
+	if *showErrors {
+		printErrors(os.Stdout, q.Errors)
+		return nil
+	}
+	printQuality(os.Stdout, q, time.Now())
+	return nil
+}
+
+// printQuality writes a tunnel's connection quality for `lobber status`
+func printQuality(w io.Writer, q client.Quality, now time.Time) {
+	fmt.Fprintf(w, "Tunnel %s via %s\n", q.Domain, q.Relay)
+	if q.Name != "" {
+		fmt.Fprintf(w, "  Name:         %s\n", q.Name)
+	}
+	if q.UDPPort != 0 {
+		fmt.Fprintf(w, "  UDP port:     %d\n", q.UDPPort)
+	}
+	if len(q.Labels) > 0 {
+		fmt.Fprintf(w, "  Labels:       %s\n", strings.ReplaceAll(q.Labels.String(), ",", ", "))
+	}
+	if !q.Connected {
+		fmt.Fprintln(w, "  Status:       reconnecting")
+	} else {
+		fmt.Fprintf(w, "  Status:       connected for %s\n", now.Sub(q.Since).Round(time.Second))
+	}
+
+	switch {
+	case !q.Heartbeat:
+		fmt.Fprintln(w, "  Latency:      unknown (relay doesn't answer heartbeats)")
+	case q.RTTMs == 0:
+		fmt.Fprintln(w, "  Latency:      measuring")
+	default:
+		fmt.Fprintf(w, "  Latency:      %.0f ms (avg %.0f ms)\n", q.RTTMs, q.AvgRTTMs)
+		if q.JitterMs >= 1 {
+			fmt.Fprintf(w, "  Jitter:       %.0f ms\n", q.JitterMs)
+		}
+	}
+	if q.MissedHeartbeats > 0 {
+		fmt.Fprintf(w, "  Missed pings: %d\n", q.MissedHeartbeats)
+	}
+	fmt.Fprintf(w, "  Reconnects:   %d in the last hour\n", q.Reconnects)
+	fmt.Fprintf(w, "  Frame errors: %d of %d (%.2f%%)\n", q.FrameErrors, q.Frames, 100*q.FrameErrorRate())
+	if len(q.Errors) > 0 {
+		fmt.Fprintf(w, "  Errors:       %d recent (lobber status --errors lists them)\n", len(q.Errors))
+	}
+
+	if hint := qualityHint(q); hint != "" {
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, hint)
+	}
+}
+
+// printErrors writes a tunnel's latest errors, newest first, for
+// `lobber status --errors`
+func printErrors(w io.Writer, errs []proxyerr.Entry) {
+	if len(errs) == 0 {
+		fmt.Fprintln(w, "No recent errors")
+		return
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TIME\tREQUEST\tSTATUS\tCAUSE")
+	for _, e := range errs {
+		request, status := "-", "-"
+		if e.Method != "" {
+			request = e.Method + " " + e.Path
+		}
+		if e.Status != 0 {
+			status = strconv.Itoa(e.Status)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", e.At.Format(time.DateTime), request, status, e.Cause)
+	}
+	tw.Flush()
+}
+
+// qualityHint points at the likely culprit when the connection looks poor
+func qualityHint(q client.Quality) string {
+	switch {
+	case q.Reconnects >= 3 || q.MissedHeartbeats > 0:
+		return "The connection to the relay keeps dropping; check your network."
+	case q.Slow || q.AvgRTTMs > float64(client.SlowRTT/time.Millisecond):
+		return "Round trips to the relay are slow; your uplink is the likely bottleneck."
+	case q.FrameErrorRate() > 0.01:
+		return "The relay is sending frames this client can't read; try upgrading lobber."
+	}
+	return ""
+}
@@ -0,0 +1,99 @@
+package cli
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lobber-dev/lobber/internal/client"
+	"github.com/lobber-dev/lobber/internal/proxyerr"
+	"github.com/lobber-dev/lobber/internal/tunnel"
+)
+
+func TestPrintQuality(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name string
+		q    client.Quality
+		want []string
+	}{
+		{
+			name: "healthy",
+			q:    client.Quality{Connected: true, Since: now.Add(-90 * time.Second), Heartbeat: true, RTTMs: 41.6, AvgRTTMs: 38, Frames: 200},
+			want: []string{"connected for 1m30s", "Latency:      42 ms (avg 38 ms)", "0 in the last hour", "0 of 200 (0.00%)"},
+		},
+		{
+			name: "jittery",
+			q:    client.Quality{Connected: true, Since: now, Heartbeat: true, RTTMs: 180, AvgRTTMs: 250, JitterMs: 64.4, Slow: true},
+			want: []string{"Jitter:       64 ms", "your uplink is the likely bottleneck"},
+		},
+		{
+			name: "old relay",
+			q:    client.Quality{Connected: true, Since: now},
+			want: []string{"unknown (relay doesn't answer heartbeats)"},
+		},
+		{
+			name: "slow uplink",
+			q:    client.Quality{Connected: true, Since: now, Heartbeat: true, RTTMs: 900, AvgRTTMs: 850},
+			want: []string{"your uplink is the likely bottleneck"},
+		},
+		{
+			name: "labelled",
+			q:    client.Quality{Connected: true, Since: now, Labels: tunnel.Labels{"service": "api", "env": "staging"}},
+			want: []string{"Labels:       env=staging, service=api"},
+		},
+		{
+			name: "flapping",
+			q:    client.Quality{Heartbeat: true, Reconnects: 4},
+			want: []string{"Status:       reconnecting", "4 in the last hour", "keeps dropping"},
+		},
+		{
+			name: "erroring",
+			q:    client.Quality{Connected: true, Since: now, Errors: []proxyerr.Entry{{At: now, Cause: "local server: connection refused"}}},
+			want: []string{"Errors:       1 recent (lobber status --errors lists them)"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			printQuality(&buf, tt.q, now)
+			for _, want := range tt.want {
+				if !strings.Contains(buf.String(), want) {
+					t.Errorf("output missing %q:\n%s", want, buf.String())
+				}
+			}
+		})
+	}
+}
+
+func TestPrintErrors(t *testing.T) {
+	at := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		errs []proxyerr.Entry
+		want []string
+	}{
+		{"none", nil, []string{"No recent errors"}},
+		{
+			name: "request and frame",
+			errs: []proxyerr.Entry{
+				{At: at, Method: "POST", Path: "/login", Status: 502, Cause: "local server: connection refused"},
+				{At: at.Add(-time.Minute), Cause: "decode request frame: unexpected EOF"},
+			},
+			want: []string{"TIME", "2024-03-01 12:00:00  POST /login  502     local server: connection refused", "2024-03-01 11:59:00  -            -       decode request frame"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			printErrors(&buf, tt.errs)
+			for _, want := range tt.want {
+				if !strings.Contains(buf.String(), want) {
+					t.Errorf("output missing %q:\n%s", want, buf.String())
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/lobber-dev/lobber/internal/client"
+)
+
+// Exit codes for `lobber up`, from sysexits.h, so process managers can tell
+// a tunnel worth restarting from one that will never come up
+const (
+	// ExitUnavailable means the relay couldn't be reached or dropped the
+	// tunnel; restarting later should work
+	ExitUnavailable = 69
+	// ExitNoPerm means the relay rejected the token
+	ExitNoPerm = 77
+	// ExitConfig means the relay refused the tunnel's settings, such as a
+	// domain the token can't use
+	ExitConfig = 78
+)
+
+// ExitError carries the process exit code for an error
+type ExitError struct {
+	Code int
+	Err  error
+}
+
+func (e *ExitError) Error() string { return e.Err.Error() }
+
+func (e *ExitError) Unwrap() error { return e.Err }
+
+// tunnelExitCode maps an error from client.Run to an exit code
+func tunnelExitCode(err error) int {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return 0
+	}
+	var connErr *client.ConnectError
+	if errors.As(err, &connErr) {
+		switch {
+		case connErr.Unauthorized():
+			return ExitNoPerm
+		case !connErr.Retryable():
+			return ExitConfig
+		}
+	}
+	return ExitUnavailable
+}
+
+// sdNotify sends a state update such as "READY=1" to systemd. It does
+// nothing unless systemd started us with Type=notify.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	// A leading @ means a socket in the abstract namespace
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("dial notify socket: %w", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return fmt.Errorf("write notify socket: %w", err)
+	}
+	return nil
+}
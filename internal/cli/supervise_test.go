@@ -0,0 +1,62 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lobber-dev/lobber/internal/client"
+)
+
+func TestTunnelExitCode(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"clean", nil, 0},
+		{"cancelled", fmt.Errorf("run: %w", context.Canceled), 0},
+		{"bad token", fmt.Errorf("connect: %w", &client.ConnectError{StatusCode: 401}), ExitNoPerm},
+		{"domain not allowed", fmt.Errorf("connect: %w", &client.ConnectError{StatusCode: 400}), ExitConfig},
+		{"rate limited", fmt.Errorf("connect: %w", &client.ConnectError{StatusCode: 429}), ExitUnavailable},
+		{"relay down", fmt.Errorf("connect: %w", &client.ConnectError{StatusCode: 502}), ExitUnavailable},
+		{"network", errors.New("dial relay: connection refused"), ExitUnavailable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tunnelExitCode(tt.err); got != tt.want {
+				t.Errorf("tunnelExitCode() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSdNotify(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	if err := sdNotify("READY=1"); err != nil {
+		t.Errorf("sdNotify() without a socket error = %v, want nil", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Skipf("unixgram sockets unavailable: %v", err)
+	}
+	defer conn.Close()
+	t.Setenv("NOTIFY_SOCKET", path)
+
+	if err := sdNotify("READY=1"); err != nil {
+		t.Fatalf("sdNotify() error = %v", err)
+	}
+	buf := make([]byte, 64)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf)
+	if err != nil || string(buf[:n]) != "READY=1" {
+		t.Errorf("socket got %q, %v, want READY=1", buf[:n], err)
+	}
+}
@@ -0,0 +1,58 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// errCancelled is why a request the relay cancelled stopped
+var errCancelled = errors.New("cancelled by the relay: the visitor went away")
+
+// inflight tracks the requests being forwarded to the local server, by ID,
+// so a Cancel frame from the relay can stop them
+type inflight struct {
+	mu      sync.Mutex
+	cancels map[string]context.CancelCauseFunc
+}
+
+func newInflight() *inflight {
+	return &inflight{cancels: make(map[string]context.CancelCauseFunc)}
+}
+
+// start registers the request with id and returns the context to forward
+// it with. done forgets it.
+func (f *inflight) start(ctx context.Context, id string) (reqCtx context.Context, done func()) {
+	reqCtx, cancel := context.WithCancelCause(ctx)
+	f.mu.Lock()
+	f.cancels[id] = cancel
+	f.mu.Unlock()
+	return reqCtx, func() {
+		f.mu.Lock()
+		delete(f.cancels, id)
+		f.mu.Unlock()
+		cancel(nil)
+	}
+}
+
+// len returns how many requests are being forwarded
+func (f *inflight) len() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.cancels)
+}
+
+// cancel stops the requests with ids, and reports how many were running
+func (f *inflight) cancel(ids []string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for _, id := range ids {
+		if cancel, ok := f.cancels[id]; ok {
+			cancel(errCancelled)
+			delete(f.cancels, id)
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,28 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestInflight(t *testing.T) {
+	f := newInflight()
+	a, doneA := f.start(context.Background(), "a")
+	b, doneB := f.start(context.Background(), "b")
+	defer doneB()
+
+	if n := f.cancel([]string{"a", "gone"}); n != 1 {
+		t.Errorf("cancel() = %d, want 1", n)
+	}
+	if !errors.Is(context.Cause(a), errCancelled) {
+		t.Errorf("cancelled request's cause = %v, want errCancelled", context.Cause(a))
+	}
+	if b.Err() != nil {
+		t.Errorf("other request err = %v, want it still running", b.Err())
+	}
+	doneA()
+	if n := f.cancel([]string{"a"}); n != 0 {
+		t.Errorf("cancel() after done = %d, want 0", n)
+	}
+}
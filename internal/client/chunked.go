@@ -0,0 +1,60 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"maps"
+	"strconv"
+
+	"github.com/lobber-dev/lobber/internal/tunnel"
+)
+
+// chunkThreshold is the smallest response body sent in chunks, to relays
+// that take them
+const chunkThreshold = 4 * tunnel.MaxStreamChunk
+
+// respondChunked sends a response as respond does, unless its body is
+// large enough to hold up the tunnel and the relay takes chunked
+// responses. Then its head goes first and the body follows in Stream
+// frames, each written on its own so other responses go out in between,
+// and no faster than the relay grants room for them.
+func (c *Client) respondChunked(write func(func(io.Writer) error) error, streams *streamer, resp *tunnel.Response, meta *tunnel.Metadata) error {
+	if !c.relayChunked || len(resp.Body) < chunkThreshold {
+		return c.respond(write, resp, meta)
+	}
+
+	body := resp.Body
+	head := *resp
+	head.Headers = maps.Clone(resp.Headers)
+	if head.Headers == nil {
+		head.Headers = make(map[string][]string)
+	}
+	head.Headers["Content-Length"] = []string{strconv.Itoa(len(body))}
+	head.Body, head.Chunked = nil, true
+
+	// Registered before the head goes out, as the relay's grants follow it
+	credit := streams.open(resp.ID)
+	defer streams.remove(resp.ID)
+	if err := c.respond(write, &head, meta); err != nil {
+		return err
+	}
+	for len(body) > 0 {
+		// A relay that grants nothing for this long has stopped reading
+		ctx, cancel := context.WithTimeout(context.Background(), streamWriteTimeout)
+		n, err := credit.Take(ctx, int64(min(len(body), tunnel.MaxStreamChunk)))
+		cancel()
+		if errors.Is(err, tunnel.ErrCreditClosed) {
+			return nil // the relay ended the stream; the visitor has gone
+		}
+		if err != nil {
+			break
+		}
+		chunk := &tunnel.Stream{ID: resp.ID, Data: body[:n]}
+		if err := write(func(w io.Writer) error { return tunnel.EncodeStream(w, chunk) }); err != nil {
+			return err
+		}
+		body = body[n:]
+	}
+	return write(func(w io.Writer) error { return tunnel.EncodeStream(w, &tunnel.Stream{ID: resp.ID, Close: true}) })
+}
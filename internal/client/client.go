@@ -2,15 +2,23 @@ package client
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"net/url"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/lobber-dev/lobber/internal/proxyerr"
 	"github.com/lobber-dev/lobber/internal/tunnel"
 )
 
@@ -20,11 +28,118 @@ type Client struct {
 	Token       string
 	Domain      string
 	InspectPort int
+	TLSConfig   *tls.Config // for https:// relays; nil trusts the system roots
+	Transport   string      // tunnel.TransportTCP, TransportWebSocket or TransportQUIC; empty tries TCP and falls back to a WebSocket
+	BurstLimit  string      // "off", or requests per second the relay always lets through; empty keeps the relay's default
+	DebugToken  string      // Visitors presenting it see a debug page instead of a bare 5xx; empty disables debug pages
+	Name        string      // Stable name grouping the tunnel's history across hostnames; empty leaves it unnamed
+	UDP         bool        // Tunnel datagrams to LocalAddr, a UDP host:port, through a public port on the relay instead of HTTP
+	Passthrough bool        // Carry TLS connections for Domain to LocalAddr, a TCP host:port, unopened, so the local server terminates them with its own certificate
+	Labels      tunnel.Labels
+	GitHubPR    string             // Pull request, as owner/repo#42, the relay comments the tunnel's link on; empty for none
+	Share       tunnel.ShareLimits // Makes the tunnel a one-time share the relay retires at these limits; zero for a normal tunnel
+	NoIndex     bool               // Has the relay answer robots.txt and tag responses so search engines don't index the tunnel
+	DevTools    bool               // Serves DevToolsPath, where visitors send a browser's console to SetOnDevLog, for debugging from a phone
 
-	httpClient *http.Client
-	conn       net.Conn
-	bufrw      *bufio.ReadWriter
-	onReady    func() // Called when client is ready to receive requests
+	// Local origins, as ParseOrigin returns them, replaced with the
+	// tunnel's public one in Location headers and HTML and JSON bodies, for
+	// apps that link to themselves as http://localhost:3000
+	RewriteOrigins []string
+
+	// Adjusts the Domain, Secure and SameSite attributes of cookies the
+	// local app sets, so cookies meant for localhost stick on the tunnel's
+	// hostname
+	RewriteCookies bool
+
+	// How often Run checks whether the machine slept or changed networks,
+	// either of which leaves the connection dead without an error; 0
+	// disables the check
+	WakeCheck time.Duration
+
+	// How often Run pings the relay to time the round trip, if the relay
+	// answers pings; 0 disables heartbeats. A relay may ask for pings more
+	// often in its Welcome.
+	HeartbeatInterval time.Duration
+
+	httpClient     *http.Client
+	h2cClient      *http.Client // for gRPC; see localClient
+	h2cOnce        sync.Once
+	conn           net.Conn
+	bufrw          *bufio.ReadWriter
+	relayHeartbeat bool                                 // The relay advertised tunnel.FeatureHeartbeat on connect
+	relayMetadata  bool                                 // The relay advertised tunnel.FeatureMetadata on connect
+	relayCancel    bool                                 // The relay advertised tunnel.FeatureCancel on connect
+	relayWindow    bool                                 // The relay advertised tunnel.FeatureWindow on connect
+	relayChunked   bool                                 // The relay advertised tunnel.FeatureChunked, and the windows and cancelling it's used with
+	relayTrailers  bool                                 // The relay advertised tunnel.FeatureTrailers on connect
+	relayContinue  bool                                 // The relay advertised tunnel.FeatureContinue, and the windows and cancelling it's used with
+	relayFeatures  []string                             // Everything the relay advertised on connect
+	relayVersion   int                                  // The relay's protocol version (tunnel.VersionHeader) on connect
+	relayMaxFrame  int                                  // Largest frame payload the relay reads (tunnel.MaxFrameHeader)
+	session        string                               // The relay's tunnel.SessionHeader on the last connect, presented to resume after a drop
+	webSocket      atomic.Bool                          // The tunnel is carried over a WebSocket; see OverWebSocket
+	udpPort        atomic.Int32                         // Public port the relay allocated to a UDP tunnel
+	welcome        atomic.Pointer[tunnel.Welcome]       // What the relay granted on the last connect; see Welcome
+	quality        qualityTracker                       // See Quality
+	metrics        metricsTracker                       // See Metrics
+	errors         proxyerr.Ring                        // The latest requests the tunnel failed to forward; see Quality
+	inspector      *Inspector                           // Records forwarded requests, if set
+	onReady        func()                               // Called when client is ready to receive requests
+	onResume       func(reason string)                  // Called when a new connection has replaced a dead one
+	onPause        func(reason string, until time.Time) // Called when the relay asks the tunnel to stay away for a while
+	onDrop         func(reason string)                  // Called when the connection died and Run is about to reconnect
+	onLatency      func(slow bool, avg time.Duration)   // Called when the link to the relay goes slow or recovers
+	onRequest      func(req *tunnel.Request)            // Called for each request the relay forwards, before it's handled
+	onDevLog       func(DevLog)                         // Called for each console entry a browser sends with DevTools on
+	localAddrs     func() string                        // Snapshot of the machine's addresses; see networkAddrs
+}
+
+// Version is the client's version, which it reports to the relay with each
+// response. Release builds set it with -ldflags "-X
+// github.com/lobber-dev/lobber/internal/client.Version=...".
+var Version = "0.1.0"
+
+// minPause is the shortest a tunnel stays away when the relay asks it to,
+// so a client whose clock runs ahead doesn't reconnect in a loop. Tests
+// shorten it.
+var minPause = 5 * time.Second
+
+// DisconnectError is returned when the relay asks the tunnel to close, such
+// as when its domain's schedule closes. Run reconnects by itself at Until
+// unless it is zero.
+type DisconnectError struct {
+	Reason string
+	Until  time.Time
+}
+
+func (e *DisconnectError) Error() string {
+	return "relay closed the tunnel: " + e.Reason
+}
+
+// ConnectError is returned when the relay refuses a tunnel
+type ConnectError struct {
+	StatusCode int
+	Status     string
+	Message    string
+}
+
+func (e *ConnectError) Error() string {
+	return fmt.Sprintf("connect failed: %s - %s", e.Status, e.Message)
+}
+
+// Unauthorized reports whether the relay rejected the token, which no
+// amount of retrying will fix
+func (e *ConnectError) Unauthorized() bool {
+	return e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden
+}
+
+// Retryable reports whether connecting again later may succeed
+func (e *ConnectError) Retryable() bool {
+	switch e.StatusCode {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return true
+	}
+	return e.StatusCode >= 500
 }
 
 func New(localAddr, relayAddr, token, domain string) *Client {
@@ -33,6 +148,9 @@ func New(localAddr, relayAddr, token, domain string) *Client {
 		RelayAddr: relayAddr,
 		Token:     token,
 		Domain:    domain,
+		WakeCheck: DefaultWakeCheck,
+
+		HeartbeatInterval: DefaultHeartbeat,
 		httpClient: &http.Client{
 			Timeout: 30 * time.Second,
 		},
@@ -44,6 +162,71 @@ func (c *Client) SetOnReady(fn func()) {
 	c.onReady = fn
 }
 
+// SetInspector records every request the tunnel forwards in i
+func (c *Client) SetInspector(i *Inspector) {
+	c.inspector = i
+}
+
+// Quality reports how the tunnel's connection to the relay is doing
+func (c *Client) Quality() Quality {
+	q := c.quality.snapshot()
+	q.Domain, q.Relay, q.Name, q.Labels = c.Domain, c.RelayAddr, c.Name, c.Labels
+	q.UDPPort = c.UDPPort()
+	q.Errors = c.errors.List()
+	return q
+}
+
+// SetErrorBuffer has Quality keep the latest n errors the tunnel ran into,
+// proxyerr.DefaultSize unless set; 0 keeps none
+func (c *Client) SetErrorBuffer(n int) {
+	c.errors.SetSize(n)
+}
+
+// UDPPort returns the public port of a UDP tunnel on the relay, or 0
+// before it has connected
+func (c *Client) UDPPort() int {
+	return int(c.udpPort.Load())
+}
+
+// SetOnResume sets a callback that's invoked when Run has reconnected after
+// the machine woke up or changed networks. reason says which.
+func (c *Client) SetOnResume(fn func(reason string)) {
+	c.onResume = fn
+}
+
+// SetOnDrop sets a callback that's invoked when Run finds the connection
+// dead, after the machine woke up or changed networks, before it
+// reconnects. reason says which.
+func (c *Client) SetOnDrop(fn func(reason string)) {
+	c.onDrop = fn
+}
+
+// SetOnLatency sets a callback that's invoked when heartbeats find the
+// link to the relay slow, with their average round trip over SlowRTT, and
+// again once it has recovered
+func (c *Client) SetOnLatency(fn func(slow bool, avg time.Duration)) {
+	c.onLatency = fn
+}
+
+// SetOnDevLog sets a callback that's invoked for each console entry a
+// browser debugging the tunnel sends, with DevTools on. It must not block.
+func (c *Client) SetOnDevLog(fn func(DevLog)) {
+	c.onDevLog = fn
+}
+
+// SetOnRequest sets a callback that's invoked for each request the relay
+// forwards, before it reaches the local server. It must not block.
+func (c *Client) SetOnRequest(fn func(req *tunnel.Request)) {
+	c.onRequest = fn
+}
+
+// SetOnPause sets a callback that's invoked when the relay has asked the
+// tunnel to disconnect until a given time, such as outside its domain's
+// schedule. Run reconnects at that time.
+func (c *Client) SetOnPause(fn func(reason string, until time.Time)) {
+	c.onPause = fn
+}
+
 // ForwardToLocal forwards an incoming request to the local server
 func (c *Client) ForwardToLocal(req *http.Request) (*http.Response, error) {
 	// Lazy-init httpClient if not set
@@ -82,7 +265,12 @@ func (c *Client) ForwardToLocal(req *http.Request) (*http.Response, error) {
 	return resp, nil
 }
 
-// Connect establishes tunnel connection to relay server
+// connectTimeout bounds a connect, from dialing the relay to its Welcome
+const connectTimeout = 30 * time.Second
+
+// Connect establishes tunnel connection to relay server. With Transport
+// empty, a plain connection that something on the way cuts before the
+// relay answers is retried over a WebSocket, and later connects use one.
 func (c *Client) Connect(ctx context.Context) error {
 	// Parse relay URL
 	relayURL, err := url.Parse(c.RelayAddr)
@@ -100,21 +288,118 @@ func (c *Client) Connect(ctx context.Context) error {
 		}
 	}
 
-	// Connect to relay
-	conn, err := net.DialTimeout("tcp", host, 10*time.Second)
+	// Once a plain connection has been cut on the way, later connects go
+	// straight to a WebSocket
+	transport := c.Transport
+	if transport == "" {
+		transport = tunnel.TransportTCP
+		if c.webSocket.Load() {
+			transport = tunnel.TransportWebSocket
+		}
+	}
+	err = c.connect(ctx, relayURL, host, transport)
+	var connectErr *ConnectError
+	if err == nil || transport != tunnel.TransportTCP || c.Transport != "" || ctx.Err() != nil || errors.As(err, &connectErr) || errors.Is(err, errDial) {
+		return err
+	}
+
+	// Something between here and the relay broke the connection before it
+	// answered, as proxies that cut hijacked connections do. They tend to
+	// let WebSockets through.
+	if wsErr := c.connect(ctx, relayURL, host, tunnel.TransportWebSocket); wsErr != nil {
+		return fmt.Errorf("%w (over a WebSocket: %v)", err, wsErr)
+	}
+	return nil
+}
+
+// errDial marks a connect that didn't reach the relay at all, which a
+// WebSocket can't help with
+var errDial = errors.New("dial relay")
+
+// connect opens the tunnel connection to host over transport
+func (c *Client) connect(ctx context.Context, relayURL *url.URL, host, transport string) error {
+	var conn net.Conn
+	var err error
+	ws := transport == tunnel.TransportWebSocket
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	if transport == tunnel.TransportQUIC {
+		if relayURL.Scheme != "https" {
+			return errors.New("the QUIC transport needs an https:// relay")
+		}
+		conn, err = c.dialQUIC(ctx, relayURL, host)
+	} else if relayURL.Scheme == "https" {
+		tlsDialer := &tls.Dialer{NetDialer: dialer, Config: c.relayTLSConfig(relayURL.Hostname())}
+		conn, err = tlsDialer.DialContext(ctx, "tcp", host)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", host)
+	}
 	if err != nil {
-		return fmt.Errorf("dial relay: %w", err)
+		return fmt.Errorf("%w: %w", errDial, err)
 	}
 	c.conn = conn
 
+	// A proxy that holds the request without answering would otherwise
+	// hang the connect
+	conn.SetDeadline(time.Now().Add(connectTimeout))
+	defer conn.SetDeadline(time.Time{})
+
 	// Send HTTP request to /_lobber/connect
 	c.bufrw = bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
 
 	// Write HTTP request
-	fmt.Fprintf(c.bufrw, "POST /_lobber/connect HTTP/1.1\r\n")
+	var wsKey string
+	if ws {
+		if wsKey, err = tunnel.NewWebSocketKey(); err != nil {
+			conn.Close()
+			return fmt.Errorf("websocket key: %w", err)
+		}
+		fmt.Fprintf(c.bufrw, "GET /_lobber/connect?%s=%s HTTP/1.1\r\n", tunnel.TransportParam, tunnel.TransportWebSocket)
+		fmt.Fprintf(c.bufrw, "Upgrade: websocket\r\n")
+		fmt.Fprintf(c.bufrw, "Sec-WebSocket-Version: 13\r\n")
+		fmt.Fprintf(c.bufrw, "Sec-WebSocket-Key: %s\r\n", wsKey)
+	} else if transport == tunnel.TransportQUIC {
+		fmt.Fprintf(c.bufrw, "POST /_lobber/connect?%s=%s HTTP/1.1\r\n", tunnel.TransportParam, tunnel.TransportQUIC)
+	} else {
+		fmt.Fprintf(c.bufrw, "POST /_lobber/connect HTTP/1.1\r\n")
+	}
 	fmt.Fprintf(c.bufrw, "Host: %s\r\n", relayURL.Host)
 	fmt.Fprintf(c.bufrw, "Authorization: Bearer %s\r\n", c.Token)
 	fmt.Fprintf(c.bufrw, "X-Lobber-Domain: %s\r\n", c.Domain)
+	if c.BurstLimit != "" {
+		fmt.Fprintf(c.bufrw, "X-Lobber-Burst-Limit: %s\r\n", c.BurstLimit)
+	}
+	if c.Name != "" {
+		fmt.Fprintf(c.bufrw, "%s: %s\r\n", tunnel.NameHeader, c.Name)
+	}
+	if c.GitHubPR != "" {
+		fmt.Fprintf(c.bufrw, "%s: %s\r\n", tunnel.GitHubPRHeader, c.GitHubPR)
+	}
+	if len(c.Labels) > 0 {
+		fmt.Fprintf(c.bufrw, "%s: %s\r\n", tunnel.LabelsHeader, c.Labels)
+	}
+	if c.Share != (tunnel.ShareLimits{}) {
+		fmt.Fprintf(c.bufrw, "%s: %s\r\n", tunnel.ShareHeader, c.Share)
+	}
+	if c.NoIndex {
+		fmt.Fprintf(c.bufrw, "%s: true\r\n", tunnel.NoIndexHeader)
+	}
+	if c.UDP {
+		fmt.Fprintf(c.bufrw, "%s: %s\r\n", tunnel.ProtocolHeader, tunnel.ProtocolUDP)
+		// Ask to keep the port when reconnecting, so peers can carry on
+		if port := c.UDPPort(); port != 0 {
+			fmt.Fprintf(c.bufrw, "%s: %d\r\n", tunnel.UDPPortHeader, port)
+		}
+	}
+	if c.Passthrough {
+		fmt.Fprintf(c.bufrw, "%s: %s\r\n", tunnel.ProtocolHeader, tunnel.ProtocolTLS)
+	}
+	fmt.Fprintf(c.bufrw, "%s: %s\r\n", tunnel.FeaturesHeader, strings.Join(tunnel.Features, ","))
+	fmt.Fprintf(c.bufrw, "%s: %d\r\n", tunnel.VersionHeader, tunnel.ProtocolVersion)
+	fmt.Fprintf(c.bufrw, "%s: %d\r\n", tunnel.MaxFrameHeader, tunnel.MaxFrameSize)
+	fmt.Fprintf(c.bufrw, "%s: %d\r\n", tunnel.WindowHeader, tunnel.DefaultWindow)
+	if c.session != "" {
+		fmt.Fprintf(c.bufrw, "%s: %s\r\n", tunnel.SessionHeader, c.session)
+	}
 	fmt.Fprintf(c.bufrw, "Connection: Upgrade\r\n")
 	fmt.Fprintf(c.bufrw, "\r\n")
 	if err := c.bufrw.Flush(); err != nil {
@@ -130,42 +415,263 @@ func (c *Client) Connect(ctx context.Context) error {
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
+	want := http.StatusOK
+	if ws {
+		want = http.StatusSwitchingProtocols
+	}
+	if ws && resp.StatusCode == http.StatusOK {
+		conn.Close()
+		return errors.New("relay does not support the WebSocket transport")
+	}
+	if resp.StatusCode != want {
 		conn.Close()
 		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("connect failed: %s - %s", resp.Status, string(body))
+		return &ConnectError{StatusCode: resp.StatusCode, Status: resp.Status, Message: strings.TrimSpace(string(body))}
+	}
+	if ws {
+		if resp.Header.Get("Sec-WebSocket-Accept") != tunnel.WebSocketAccept(wsKey) {
+			conn.Close()
+			return errors.New("relay answered the WebSocket upgrade with the wrong Sec-WebSocket-Accept")
+		}
+		// From here on frames travel as the payload of binary messages
+		wsConn := tunnel.NewWebSocketConn(conn, c.bufrw.Reader, true)
+		c.conn, conn = wsConn, wsConn
+		c.bufrw = bufio.NewReadWriter(bufio.NewReader(wsConn), bufio.NewWriter(wsConn))
+	}
+	c.webSocket.Store(ws)
+
+	features := tunnel.ParseFeatures(resp.Header.Get(tunnel.FeaturesHeader))
+	c.relayFeatures = features
+	c.relayHeartbeat = slices.Contains(features, tunnel.FeatureHeartbeat)
+	c.relayMetadata = slices.Contains(features, tunnel.FeatureMetadata)
+	c.relayCancel = slices.Contains(features, tunnel.FeatureCancel)
+	c.relayWindow = slices.Contains(features, tunnel.FeatureWindow)
+	// Chunks wait for grants the reader takes in, so only go to relays
+	// whose requests are forwarded concurrently
+	c.relayChunked = slices.Contains(features, tunnel.FeatureChunked) && c.relayWindow && c.relayCancel
+	c.relayTrailers = slices.Contains(features, tunnel.FeatureTrailers)
+	// Held bodies arrive while their requests are forwarded, in grants
+	// the reader takes in
+	c.relayContinue = slices.Contains(features, tunnel.FeatureContinue) && c.relayWindow && c.relayCancel
+	if c.relayVersion, err = tunnel.ParseVersion(resp.Header.Get(tunnel.VersionHeader)); err != nil {
+		c.relayVersion = 1
+	}
+	if c.relayMaxFrame, err = tunnel.ParseMaxFrame(resp.Header.Get(tunnel.MaxFrameHeader)); err != nil {
+		c.relayMaxFrame = tunnel.MaxFrameSize
+	}
+	c.session = resp.Header.Get(tunnel.SessionHeader)
+
+	if c.UDP {
+		port, err := strconv.Atoi(resp.Header.Get(tunnel.UDPPortHeader))
+		if err != nil {
+			conn.Close()
+			return errors.New("relay does not support UDP tunnels")
+		}
+		c.udpPort.Store(int32(port))
+	}
+	if c.Passthrough && !slices.Contains(features, tunnel.FeatureStream) {
+		conn.Close()
+		return errors.New("relay does not support TLS passthrough")
+	}
+
+	// Older relays send no Welcome, and the client goes on assuming it
+	// got the hostname it asked for
+	if slices.Contains(features, tunnel.FeatureWelcome) {
+		welcome, err := tunnel.DecodeWelcome(c.bufrw)
+		if err != nil {
+			conn.Close()
+			return fmt.Errorf("read welcome: %w", err)
+		}
+		c.welcome.Store(welcome)
+		// The inspector keeps requests no longer than the plan keeps logs
+		if c.inspector != nil && welcome.Limits.RetentionSeconds > 0 {
+			c.inspector.SetMaxAge(time.Duration(welcome.Limits.RetentionSeconds) * time.Second)
+		}
+	} else {
+		c.welcome.Store(nil)
 	}
 
 	return nil
 }
 
-// Run starts the tunnel and processes incoming requests
+// OverWebSocket reports whether the tunnel is carried over a WebSocket,
+// asked for with Transport or fallen back to
+func (c *Client) OverWebSocket() bool {
+	return c.webSocket.Load()
+}
+
+// usedFeatures returns the features the relay advertised that the client
+// uses: all of them, bar heartbeats when HeartbeatInterval disables them
+func (c *Client) usedFeatures() []string {
+	var used []string
+	for _, f := range c.relayFeatures {
+		if f == tunnel.FeatureHeartbeat && c.HeartbeatInterval <= 0 {
+			continue
+		}
+		if f == tunnel.FeatureContinue && !c.relayContinue {
+			continue
+		}
+		used = append(used, f)
+	}
+	return used
+}
+
+// Welcome returns what the relay granted the tunnel on its last connect:
+// its public URLs, plan and limits. It is nil before the first connect and
+// for relays too old to send one.
+func (c *Client) Welcome() *tunnel.Welcome {
+	return c.welcome.Load()
+}
+
+// heartbeatInterval returns how often to ping the relay: HeartbeatInterval,
+// or the relay's interval if it asked for pings more often
+func (c *Client) heartbeatInterval() time.Duration {
+	d := c.HeartbeatInterval
+	if w := c.welcome.Load(); w != nil && w.HeartbeatSeconds > 0 {
+		d = min(d, time.Duration(w.HeartbeatSeconds)*time.Second)
+	}
+	return d
+}
+
+// relayTLSConfig returns the TLS settings for an https:// relay. The tunnel
+// takes over the connection after the connect request, so only HTTP/1.1 is
+// offered.
+func (c *Client) relayTLSConfig(serverName string) *tls.Config {
+	cfg := &tls.Config{}
+	if c.TLSConfig != nil {
+		cfg = c.TLSConfig.Clone()
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName = serverName
+	}
+	cfg.NextProtos = []string{"http/1.1"}
+	return cfg
+}
+
+// Run starts the tunnel and processes incoming requests. When the machine
+// wakes from sleep or changes networks, Run drops the connection and opens
+// a new one for the same domain instead of waiting on a dead socket. When
+// the relay asks the tunnel to stay away until a given time, Run waits and
+// then reconnects.
 func (c *Client) Run(ctx context.Context) error {
 	if err := c.Connect(ctx); err != nil {
 		return fmt.Errorf("connect: %w", err)
 	}
 
-	// Send ready frame to signal we're ready to receive requests
-	if err := tunnel.EncodeReady(c.bufrw); err != nil {
-		if c.conn != nil {
-			c.conn.Close()
+	resumedAfter := ""
+	for {
+		reason, err := c.serve(ctx, resumedAfter)
+		// A relay restart is planned, and the tunnel moves without a gap
+		if reason != "" && reason != drainReason && c.onDrop != nil {
+			c.onDrop(reason)
 		}
-		return fmt.Errorf("send ready frame: %w", err)
-	}
-	if err := c.bufrw.Flush(); err != nil {
-		if c.conn != nil {
-			c.conn.Close()
+		var disconnect *DisconnectError
+		if errors.As(err, &disconnect) && !disconnect.Until.IsZero() {
+			if err := c.pause(ctx, disconnect); err != nil {
+				return err
+			}
+			reason = "scheduled pause"
+		}
+		if reason == "" {
+			return err
 		}
-		return fmt.Errorf("flush ready frame: %w", err)
+		if err := c.reconnect(ctx); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("resume after %s: %w", reason, err)
+		}
+		c.quality.reconnected()
+		resumedAfter = reason
 	}
+}
+
+// pause waits out a disconnect until its Until time, or ctx
+func (c *Client) pause(ctx context.Context, d *DisconnectError) error {
+	if c.onPause != nil {
+		c.onPause(d.Reason, d.Until)
+	}
+	timer := time.NewTimer(max(time.Until(d.Until), minPause))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// serve announces the connection as ready and proxies requests over it. It
+// returns a reason to reconnect if the wake check finds the connection
+// dead, or else the error that ended it.
+func (c *Client) serve(ctx context.Context, resumedAfter string) (string, error) {
+	// The reader below outlives a dropped connection, so it keeps its own
+	conn, bufrw := c.conn, c.bufrw
+
+	// Send ready frame to signal we're ready to receive requests, telling
+	// relays that ask which features we use
+	var ready *tunnel.Ready
+	if slices.Contains(c.relayFeatures, tunnel.FeatureEcho) {
+		ready = &tunnel.Ready{Features: c.usedFeatures(), Version: tunnel.ProtocolVersion}
+	}
+	if err := tunnel.EncodeReady(bufrw, ready); err != nil {
+		conn.Close()
+		return "", fmt.Errorf("send ready frame: %w", err)
+	}
+	if err := bufrw.Flush(); err != nil {
+		conn.Close()
+		return "", fmt.Errorf("flush ready frame: %w", err)
+	}
+	c.quality.up(c.relayHeartbeat)
+	defer c.quality.down()
 
 	// Signal ready via callback if set
-	if c.onReady != nil {
+	if resumedAfter == "" && c.onReady != nil {
 		c.onReady()
 	}
+	if resumedAfter != "" && c.onResume != nil {
+		c.onResume(resumedAfter)
+	}
+
+	// Responses and pings share the connection, encoded and compressed as
+	// the relay reads them
+	framing := tunnel.Framing{Compress: tunnel.Compression(c.relayFeatures), Binary: c.relayVersion >= tunnel.BinaryVersion, MaxSize: c.relayMaxFrame}
+	out := framing.Writer(countingWriter{bufrw, &c.metrics.bytesWritten})
+	var writeMu sync.Mutex
+	write := func(encode func(io.Writer) error) error {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		if err := encode(out); err != nil {
+			return err
+		}
+		c.metrics.flushes.Add(1)
+		return bufrw.Flush()
+	}
+
+	watchCtx, stopWatch := context.WithCancel(ctx)
+	defer stopWatch()
+	wake := c.watchWake(watchCtx)
+	pings := &pinger{}
+	if c.relayHeartbeat && c.HeartbeatInterval > 0 {
+		go c.pingLoop(watchCtx, pings, write)
+	}
+	streams := newStreamer(write, c.relayWindow)
+	requests := newInflight()
+	var udp *udpForwarder
+	if c.UDP {
+		udp = newUDPForwarder(c.LocalAddr, write)
+	}
+	retiring := false // the connection outlives serve; see retire
+	defer func() {
+		if !retiring {
+			closeForwarders(streams, udp)
+		}
+	}()
 
 	// Process requests until context is cancelled
 	errCh := make(chan error, 1)
+	drained := make(chan *tunnel.Drain, 1)
+	in := countingReader{bufrw, &c.metrics.bytesRead}
 	go func() {
 		for {
 			// Check context
@@ -176,67 +682,416 @@ func (c *Client) Run(ctx context.Context) error {
 			default:
 			}
 
-			// Read request from relay
-			req, err := tunnel.DecodeRequest(c.bufrw)
+			frame, err := tunnel.ReadFrame(in)
 			if err != nil {
-				errCh <- fmt.Errorf("decode request: %w", err)
+				if errors.Is(err, tunnel.ErrFrameTooLarge) {
+					c.quality.frame(true)
+					// Say why before hanging up, so the relay can log it
+					write(func(w io.Writer) error { return tunnel.EncodeError(w, tunnel.ErrorFor(err)) })
+				}
+				errCh <- fmt.Errorf("read frame: %w", err)
 				return
 			}
 
-			// Forward to local server
-			resp, err := c.forwardRequest(ctx, req)
-			if err != nil {
-				// Send error response
-				resp = &tunnel.Response{
-					ID:         req.ID,
-					StatusCode: http.StatusBadGateway,
-					Headers:    map[string][]string{"Content-Type": {"text/plain"}},
-					Body:       []byte("local forward error: " + err.Error()),
+			switch frame.Type {
+			case tunnel.TypeRequest:
+				req := new(tunnel.Request)
+				if err := frame.Decode(req); err != nil {
+					c.quality.frame(true)
+					c.errors.Add(proxyerr.Entry{Cause: "decode request frame: " + err.Error()})
+					continue
+				}
+				c.quality.frame(false)
+				if c.onRequest != nil {
+					c.onRequest(req)
 				}
-			}
 
-			// Send response back through tunnel
-			if err := tunnel.EncodeResponse(c.bufrw, resp); err != nil {
-				errCh <- fmt.Errorf("encode response: %w", err)
+				// An upgrade lives on as a stream, so mustn't hold up the
+				// requests behind it
+				if c.Passthrough && req.Upgrade == tunnel.ProtocolTLS {
+					go c.handlePassthrough(ctx, req, streams, write)
+					continue
+				}
+				if req.Upgrade != "" {
+					go c.handleUpgrade(ctx, req, streams, write)
+					continue
+				}
+
+				// A relay that can cancel requests gets them forwarded
+				// concurrently, leaving the reader free for its Cancel frames.
+				// A cancelled request gets no response; the relay forgot it.
+				if c.relayCancel {
+					reqCtx, done := requests.start(ctx, req.ID)
+					// A held body's frames may follow straight after
+					var body *heldBody
+					if req.Continue {
+						body = streams.body(req.ID)
+					}
+					go func() {
+						defer done()
+						defer c.release(write, req)
+						resp, meta := c.handleBody(reqCtx, req, body)
+						if body != nil {
+							streams.dropBody(req.ID)
+						}
+						if reqCtx.Err() != nil {
+							return
+						}
+						if err := c.respondChunked(write, streams, resp, meta); err != nil {
+							select {
+							case errCh <- fmt.Errorf("encode response: %w", err):
+							default:
+							}
+						}
+					}()
+					continue
+				}
+
+				// A pong arriving while we forward waits behind the request
+				pings.forwarding()
+				resp, meta := c.handle(ctx, req)
+				if err := c.respond(write, resp, meta); err != nil {
+					errCh <- fmt.Errorf("encode response: %w", err)
+					return
+				}
+				c.release(write, req)
+			case tunnel.TypePong:
+				var hb tunnel.Heartbeat
+				if err := frame.Decode(&hb); err != nil {
+					c.quality.frame(true)
+					continue
+				}
+				c.quality.frame(false)
+				if rtt, ok := pings.answered(hb.Seq); ok {
+					if changed, slow, avg := c.quality.rtt(rtt); changed && c.onLatency != nil {
+						c.onLatency(slow, avg)
+					}
+				}
+			case tunnel.TypeDatagram:
+				var d tunnel.Datagram
+				if udp == nil || frame.Decode(&d) != nil {
+					c.quality.frame(true)
+					continue
+				}
+				c.quality.frame(false)
+				// A local service that's down loses the datagram, as UDP would
+				udp.forward(&d)
+			case tunnel.TypeStream:
+				var s tunnel.Stream
+				if err := frame.Decode(&s); err != nil {
+					c.quality.frame(true)
+					continue
+				}
+				c.quality.frame(false)
+				streams.forward(&s)
+			case tunnel.TypeCancel:
+				var cancel tunnel.Cancel
+				if err := frame.Decode(&cancel); err != nil {
+					c.quality.frame(true)
+					continue
+				}
+				c.quality.frame(false)
+				requests.cancel(cancel.IDs)
+			case tunnel.TypeWindow:
+				var win tunnel.Window
+				if err := frame.Decode(&win); err != nil {
+					c.quality.frame(true)
+					continue
+				}
+				c.quality.frame(false)
+				streams.grant(&win)
+			case tunnel.TypeDisconnect:
+				var d tunnel.Disconnect
+				if err := frame.Decode(&d); err != nil {
+					c.quality.frame(true)
+					continue
+				}
+				c.quality.frame(false)
+				errCh <- &DisconnectError{Reason: d.Reason, Until: d.Until}
 				return
+			case tunnel.TypeDrain:
+				// The relay keeps sending requests until the connection
+				// closes, so carry on reading
+				d := new(tunnel.Drain)
+				if err := frame.Decode(d); err != nil {
+					c.quality.frame(true)
+					continue
+				}
+				c.quality.frame(false)
+				select {
+				case drained <- d:
+				default:
+				}
+			case tunnel.TypeError:
+				// The relay is closing the tunnel, and this is why
+				e := new(tunnel.Error)
+				if err := frame.Decode(e); err != nil {
+					c.quality.frame(true)
+					continue
+				}
+				errCh <- e
+				return
+			default:
+				// Skip frames we don't understand rather than drop the tunnel
+				c.quality.frame(true)
 			}
-			c.bufrw.Flush()
 		}
 	}()
 
 	select {
 	case <-ctx.Done():
-		if c.conn != nil {
-			c.conn.Close()
+		// A relay that resumes sessions would otherwise hold the hostname
+		// for this client to come back
+		if c.session != "" {
+			conn.SetWriteDeadline(time.Now().Add(time.Second))
+			write(func(w io.Writer) error {
+				return tunnel.EncodeError(w, &tunnel.Error{Code: tunnel.ErrorShutdown, Message: "client shutting down"})
+			})
 		}
-		return ctx.Err()
+		conn.Close()
+		return "", ctx.Err()
 	case err := <-errCh:
-		if c.conn != nil {
-			c.conn.Close()
+		conn.Close()
+		return "", err
+	case reason := <-wake:
+		conn.Close()
+		return reason, nil
+	case d := <-drained:
+		// Make before break: Run connects again, and lands on another
+		// relay, while this connection finishes what it has
+		retiring = true
+		go c.retire(ctx, conn, d, requests, streams, udp)
+		return drainReason, nil
+	}
+}
+
+// handle forwards a request from the relay to the local server, answering
+// 502 if it can't be reached, and records it in the inspector. The
+// metadata tells the relay what the visitor doesn't see, such as how long
+// the local server took. Visitors with the debug token get a debug page in
+// place of any 5xx. With DevTools on, the client answers DevToolsPath
+// itself and adds the console script to pages for browsers that asked.
+// Responses that will be changed are asked for uncompressed.
+func (c *Client) handle(ctx context.Context, req *tunnel.Request) (*tunnel.Response, *tunnel.Metadata) {
+	return c.handleBody(ctx, req, nil)
+}
+
+// handleBody is handle for a request whose body, if body is set, the relay
+// holds back until the local server asks for it
+func (c *Client) handleBody(ctx context.Context, req *tunnel.Request, body *heldBody) (*tunnel.Response, *tunnel.Metadata) {
+	start := time.Now()
+	var devTools bool
+	if c.DevTools {
+		if devToolsRequest(req) {
+			return c.serveDevTools(req), &tunnel.Metadata{ID: req.ID, Client: time.Since(start), ClientVersion: Version}
+		}
+		devTools = devToolsMode(req) != ""
+	}
+	forward := req
+	if devTools || len(c.RewriteOrigins) > 0 {
+		forward = uncompressed(req)
+	}
+	debug, setCookie := c.debugging(req)
+	var recent []*InspectedRequest
+	if debug && c.inspector != nil {
+		recent = c.inspector.Recent(debugRecent)
+	}
+
+	answered := c.metrics.forwarding()
+	resp, err := c.forwardRequest(ctx, forward, body)
+	if err != nil && ctx.Err() != nil {
+		err = context.Cause(ctx)
+	}
+	meta := &tunnel.Metadata{ID: req.ID, Local: time.Since(start), ClientVersion: Version}
+	answered(meta.Local)
+	if err != nil {
+		meta.LocalError = err.Error()
+		c.addError(req, http.StatusBadGateway, err)
+		resp = &tunnel.Response{
+			ID:         req.ID,
+			StatusCode: http.StatusBadGateway,
+			Headers:    map[string][]string{"Content-Type": {"text/plain"}},
+			Body:       []byte("local forward error: " + err.Error()),
+		}
+	} else {
+		meta.LocalStatus = resp.StatusCode
+		if len(c.RewriteOrigins) > 0 {
+			c.rewriteOrigins(resp)
+		}
+		if c.RewriteCookies {
+			c.rewriteCookies(resp)
+		}
+		if devTools {
+			injectDevTools(resp)
+		}
+	}
+
+	if c.inspector != nil {
+		c.inspector.AddRequest(&InspectedRequest{
+			ID:              req.ID,
+			Method:          req.Method,
+			Path:            req.Path,
+			StatusCode:      resp.StatusCode,
+			RequestHeaders:  req.Headers,
+			ResponseHeaders: resp.Headers,
+			RequestBody:     string(req.Body),
+			ResponseBody:    string(resp.Body),
+			DurationMs:      time.Since(start).Milliseconds(),
+			Timestamp:       start,
+			RelayMs:         ms(req.RelayTime),
+			LocalMs:         ms(meta.Local),
+			NetworkMs:       c.quality.snapshot().RTTMs,
+		})
+	}
+
+	if debug && resp.StatusCode >= 500 {
+		resp = c.debugPage(req, resp, err, recent)
+	}
+	if setCookie {
+		headers := http.Header(resp.Headers).Clone()
+		if headers == nil {
+			headers = http.Header{}
+		}
+		headers.Add("Set-Cookie", c.debugCookie())
+		resp.Headers = headers
+	}
+	if !bodyAllowed(req.Method, resp.StatusCode) {
+		resp.Body = nil
+	}
+	meta.Client = time.Since(start)
+	return resp, meta
+}
+
+// respond sends a response back through the tunnel, after its metadata if
+// the relay takes it. A response too large for the relay to read becomes a
+// 502 saying so, rather than costing the tunnel.
+func (c *Client) respond(write func(func(io.Writer) error) error, resp *tunnel.Response, meta *tunnel.Metadata) error {
+	return write(func(w io.Writer) error {
+		if c.relayMetadata {
+			if err := tunnel.EncodeMetadata(w, meta); err != nil {
+				return err
+			}
+		}
+		err := tunnel.EncodeResponse(w, resp)
+		if errors.Is(err, tunnel.ErrFrameTooLarge) {
+			err = tunnel.EncodeResponse(w, &tunnel.Response{
+				ID:         resp.ID,
+				StatusCode: http.StatusBadGateway,
+				Headers:    map[string][]string{"Content-Type": {"text/plain"}},
+				Body:       []byte("local response too large for the tunnel: " + err.Error()),
+			})
 		}
 		return err
+	})
+}
+
+// release gives the relay back the room req took in the window the client
+// granted on connect, once the client is done with it
+func (c *Client) release(write func(func(io.Writer) error) error, req *tunnel.Request) {
+	if !c.relayWindow {
+		return
 	}
+	win := &tunnel.Window{Bytes: tunnel.RequestCost(int64(len(req.Body)), tunnel.DefaultWindow)}
+	write(func(w io.Writer) error { return tunnel.EncodeWindow(w, win) })
 }
 
-// forwardRequest forwards a tunnel request to the local server
-func (c *Client) forwardRequest(ctx context.Context, req *tunnel.Request) (*tunnel.Response, error) {
-	// Build local URL
+// pingLoop sends a heartbeat every heartbeatInterval until ctx ends
+func (c *Client) pingLoop(ctx context.Context, pings *pinger, write func(func(io.Writer) error) error) {
+	ticker := time.NewTicker(c.heartbeatInterval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		hb, missed := pings.next()
+		if missed {
+			c.quality.missedHeartbeat()
+		}
+		if err := write(func(w io.Writer) error { return tunnel.EncodePing(w, hb) }); err != nil {
+			return
+		}
+	}
+}
+
+// reconnect opens a new connection for the same domain, retrying while the
+// network comes back after a wake. The relay hands the domain to the new
+// connection even if it hasn't noticed the old one die.
+func (c *Client) reconnect(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, resumeTimeout)
+	defer cancel()
+
+	delay := 250 * time.Millisecond
+	for {
+		err := c.Connect(ctx)
+		if err == nil {
+			return nil
+		}
+		var connErr *ConnectError
+		if errors.As(err, &connErr) && !connErr.Retryable() {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, 2*time.Second)
+	}
+}
+
+// localURL returns where on the local server a tunnel request goes
+func (c *Client) localURL(req *tunnel.Request) (*url.URL, error) {
 	localURL, err := url.Parse(c.LocalAddr)
 	if err != nil {
 		return nil, fmt.Errorf("parse local addr: %w", err)
 	}
-	localURL.Path = req.Path
+	// req.Path is the visitor's request URI, query included
+	target, err := url.ParseRequestURI(req.Path)
+	if err != nil {
+		return nil, fmt.Errorf("parse request path: %w", err)
+	}
+	localURL.Path, localURL.RawPath, localURL.RawQuery = target.Path, target.RawPath, target.RawQuery
+	return localURL, nil
+}
+
+// forwardRequest forwards a tunnel request to the local server, with held
+// as its body if the relay held the body back
+func (c *Client) forwardRequest(ctx context.Context, req *tunnel.Request, held *heldBody) (*tunnel.Response, error) {
+	localURL, err := c.localURL(req)
+	if err != nil {
+		return nil, err
+	}
 
 	// Create HTTP request
-	httpReq, err := http.NewRequestWithContext(ctx, req.Method, localURL.String(), io.NopCloser(strings.NewReader(string(req.Body))))
+	httpReq, err := http.NewRequestWithContext(ctx, req.Method, localURL.String(), bytes.NewReader(req.Body))
 	if err != nil {
 		return nil, fmt.Errorf("create request: %w", err)
 	}
+	if held != nil {
+		// The visitor's length, if it gave one, as the body isn't here yet
+		httpReq.Body, httpReq.ContentLength = held, -1
+		if n, err := strconv.ParseInt(http.Header(req.Headers).Get("Content-Length"), 10, 64); err == nil {
+			httpReq.ContentLength = n
+		}
+	}
 
 	// Copy headers
 	for k, v := range req.Headers {
 		httpReq.Header[k] = v
 	}
+	// Only a held body is worth the local server turning down before it's
+	// sent; the rest are already here
+	if held == nil {
+		httpReq.Header.Del("Expect")
+	}
+	setForwarded(httpReq.Header, req.Caller)
+	// The relay drops TE as hop-by-hop, but gRPC servers refuse requests
+	// that don't say they take trailers
+	if c.relayTrailers && isGRPC(httpReq.Header) {
+		httpReq.Header.Set("Te", "trailers")
+	}
 
 	// Lazy init httpClient
 	if c.httpClient == nil {
@@ -244,7 +1099,7 @@ func (c *Client) forwardRequest(ctx context.Context, req *tunnel.Request) (*tunn
 	}
 
 	// Send to local server
-	httpResp, err := c.httpClient.Do(httpReq)
+	httpResp, err := c.localClient(httpReq).Do(httpReq)
 	if err != nil {
 		return nil, fmt.Errorf("local request: %w", err)
 	}
@@ -256,12 +1111,17 @@ func (c *Client) forwardRequest(ctx context.Context, req *tunnel.Request) (*tunn
 		return nil, fmt.Errorf("read body: %w", err)
 	}
 
-	return &tunnel.Response{
+	resp := &tunnel.Response{
 		ID:         req.ID,
 		StatusCode: httpResp.StatusCode,
 		Headers:    httpResp.Header,
 		Body:       body,
-	}, nil
+	}
+	// Trailers are only known once the body has been read
+	if c.relayTrailers {
+		resp.Trailers = trailers(httpResp)
+	}
+	return resp, nil
 }
 
 // ReadResponse reads the full response body
@@ -1,13 +1,19 @@
 package client
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"io"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/lobber-dev/lobber/internal/tunnel"
 )
 
 func TestClientForwardsRequests(t *testing.T) {
@@ -53,6 +59,42 @@ func TestClientForwardsRequests(t *testing.T) {
 	}
 }
 
+func TestConnectError(t *testing.T) {
+	tests := []struct {
+		status       int
+		unauthorized bool
+		retryable    bool
+	}{
+		{http.StatusUnauthorized, true, false},
+		{http.StatusForbidden, true, false},
+		{http.StatusBadRequest, false, false},
+		{http.StatusTooManyRequests, false, true},
+		{http.StatusBadGateway, false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(http.StatusText(tt.status), func(t *testing.T) {
+			relay := startClientTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "nope", tt.status)
+			}))
+			defer relay.Close()
+
+			c := New("http://localhost:3000", relay.URL, "test-token", "app.mysite.com")
+			err := c.Connect(context.Background())
+			var connErr *ConnectError
+			if !errors.As(err, &connErr) {
+				t.Fatalf("Connect() error = %v, want a *ConnectError", err)
+			}
+			if connErr.StatusCode != tt.status || connErr.Message != "nope" {
+				t.Errorf("ConnectError = %+v, want status %d with the relay's message", connErr, tt.status)
+			}
+			if connErr.Unauthorized() != tt.unauthorized || connErr.Retryable() != tt.retryable {
+				t.Errorf("Unauthorized() = %v, Retryable() = %v, want %v, %v", connErr.Unauthorized(), connErr.Retryable(), tt.unauthorized, tt.retryable)
+			}
+		})
+	}
+}
+
 func startClientTestServer(t *testing.T, handler http.Handler) *httptest.Server {
 	t.Helper()
 
@@ -69,3 +111,96 @@ func startClientTestServer(t *testing.T, handler http.Handler) *httptest.Server
 	srv.Start()
 	return srv
 }
+
+func TestRespondTooLarge(t *testing.T) {
+	var buf bytes.Buffer
+	out := tunnel.Framing{MaxSize: tunnel.MinFrameSize}.Writer(&buf)
+	write := func(encode func(io.Writer) error) error { return encode(out) }
+
+	c := &Client{}
+	resp := &tunnel.Response{ID: "req-1", StatusCode: 200, Body: make([]byte, tunnel.MinFrameSize)}
+	if err := c.respond(write, resp, &tunnel.Metadata{ID: "req-1"}); err != nil {
+		t.Fatalf("respond() error = %v", err)
+	}
+	got, err := tunnel.DecodeResponse(&buf)
+	if err != nil || got.ID != "req-1" || got.StatusCode != http.StatusBadGateway || !strings.Contains(string(got.Body), "too large") {
+		t.Errorf("response = %+v, %v, want a 502 saying it was too large", got, err)
+	}
+}
+
+func TestRespondChunked(t *testing.T) {
+	frames := make(chan *tunnel.Frame, 64)
+	write := func(encode func(io.Writer) error) error {
+		var buf bytes.Buffer
+		if err := encode(&buf); err != nil {
+			return err
+		}
+		f, err := tunnel.ReadFrame(&buf)
+		frames <- f
+		return err
+	}
+	c := &Client{relayChunked: true}
+	streams := newStreamer(write, true)
+	body := bytes.Repeat([]byte("x"), tunnel.StreamWindow+2*tunnel.MaxStreamChunk)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.respondChunked(write, streams, &tunnel.Response{ID: "req-1", StatusCode: 200, Body: body}, nil)
+	}()
+
+	var head tunnel.Response
+	if err := (<-frames).Decode(&head); err != nil || !head.Chunked || len(head.Body) != 0 || head.Headers["Content-Length"][0] != strconv.Itoa(len(body)) {
+		t.Fatalf("head = %+v, %v, want a chunked head with the body's length", head, err)
+	}
+	var got []byte
+	readChunk := func() tunnel.Stream {
+		var s tunnel.Stream
+		if err := (<-frames).Decode(&s); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, s.Data...)
+		return s
+	}
+
+	// No more than the window goes out until the relay grants more
+	for len(got) < tunnel.StreamWindow {
+		readChunk()
+	}
+	select {
+	case f := <-frames:
+		t.Fatalf("sent %s frame past the window", tunnel.FrameName(f.Type))
+	case <-time.After(50 * time.Millisecond):
+	}
+	streams.grant(&tunnel.Window{ID: "req-1", Bytes: tunnel.StreamWindow})
+	for !readChunk().Close {
+	}
+	if err := <-done; err != nil || !bytes.Equal(got, body) {
+		t.Errorf("respondChunked() = %v after %d bytes, want all %d", err, len(got), len(body))
+	}
+}
+
+func TestConnectAppliesRetention(t *testing.T) {
+	relay := startClientTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, bufrw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		bufrw.WriteString("HTTP/1.1 200 OK\r\n" + tunnel.FeaturesHeader + ": welcome\r\n\r\n")
+		tunnel.EncodeWelcome(bufrw, &tunnel.Welcome{Plan: "free", Limits: tunnel.Limits{RetentionSeconds: 3600}})
+		bufrw.Flush()
+	}))
+	defer relay.Close()
+
+	inspector := NewInspector()
+	inspector.AddRequest(&InspectedRequest{ID: "old", Timestamp: time.Now().Add(-2 * time.Hour)})
+	inspector.AddRequest(&InspectedRequest{ID: "new"})
+	c := New("http://localhost:3000", relay.URL, "test-token", "app.mysite.com")
+	c.SetInspector(inspector)
+	if err := c.Connect(context.Background()); err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+
+	if recent := inspector.Recent(10); len(recent) != 1 || recent[0].ID != "new" {
+		t.Errorf("Recent() = %+v, want requests older than the plan's hour dropped", recent)
+	}
+}
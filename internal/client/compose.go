@@ -0,0 +1,201 @@
+package client
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// composeMaxBody caps the response body the compose console shows
+const composeMaxBody = 10 << 20
+
+// Compose targets: the local server directly, or the public URL through
+// the relay and the tunnel
+const (
+	ComposeLocal  = "local"
+	ComposePublic = "public"
+)
+
+// ComposeRequest is a request crafted in the inspector's compose console
+type ComposeRequest struct {
+	Target  string              `json:"target"` // ComposeLocal or ComposePublic
+	Method  string              `json:"method"`
+	Path    string              `json:"path"`
+	Headers map[string][]string `json:"headers,omitempty"`
+	Body    string              `json:"body,omitempty"`
+}
+
+// ComposeResponse is what the target answered a ComposeRequest
+type ComposeResponse struct {
+	URL        string              `json:"url"`
+	StatusCode int                 `json:"status_code"`
+	Headers    map[string][]string `json:"headers,omitempty"`
+	Body       string              `json:"body,omitempty"`
+	Truncated  bool                `json:"truncated,omitempty"` // Body stops at composeMaxBody
+	DurationMs int64               `json:"duration_ms"`
+}
+
+// composeClient sends composed requests. Redirects are shown rather than
+// followed, as they're usually what's being debugged, and Accept-Encoding
+// is only sent if the request has it so the answer's encoding is the
+// server's choice.
+var composeClient = &http.Client{
+	Timeout:   30 * time.Second,
+	Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, DisableCompression: true},
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// SetComposeTargets lets the compose console send requests to the local
+// server at local and to the tunnel's public URL, which public returns once
+// it's known
+func (i *Inspector) SetComposeTargets(local string, public func() string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.composeLocal = local
+	i.composePublic = public
+}
+
+// composeURL resolves a composed request's path against target
+func (i *Inspector) composeURL(target, path string) (string, error) {
+	i.mu.RLock()
+	base := i.composeLocal
+	public := i.composePublic
+	i.mu.RUnlock()
+	switch target {
+	case ComposeLocal:
+	case ComposePublic:
+		base = ""
+		if public != nil {
+			base = public()
+		}
+	default:
+		return "", fmt.Errorf("unknown target %q, want %q or %q", target, ComposeLocal, ComposePublic)
+	}
+	if !strings.HasPrefix(base, "http://") && !strings.HasPrefix(base, "https://") {
+		return "", fmt.Errorf("no HTTP URL for the %s target", target)
+	}
+	if !strings.HasPrefix(path, "/") {
+		return "", fmt.Errorf("path %q must start with /", path)
+	}
+	return strings.TrimSuffix(base, "/") + path, nil
+}
+
+// composeError is an error sending a composed request, and the status the
+// console answers with
+type composeError struct {
+	status int
+	err    error
+}
+
+func (e *composeError) Error() string { return e.err.Error() }
+
+// decodeCompose reads a ComposeRequest from the console. Only JSON is
+// accepted, so other sites a browser visits can't use the inspector to
+// send requests with a plain form post.
+func decodeCompose(w http.ResponseWriter, r *http.Request) (*ComposeRequest, bool) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return nil, false
+	}
+	if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt != "application/json" {
+		http.Error(w, "want application/json", http.StatusUnsupportedMediaType)
+		return nil, false
+	}
+	var req ComposeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	if req.Method == "" {
+		req.Method = http.MethodGet
+	}
+	return &req, true
+}
+
+// send sends req to target and reads the answer. A gzipped body is
+// decompressed so it can be read and compared; Content-Encoding still
+// shows how it arrived.
+func (i *Inspector) send(ctx context.Context, req *ComposeRequest, target string) (*ComposeResponse, error) {
+	url, err := i.composeURL(target, req.Path)
+	if err != nil {
+		return nil, &composeError{http.StatusBadRequest, err}
+	}
+	out, err := http.NewRequestWithContext(ctx, req.Method, url, strings.NewReader(req.Body))
+	if err != nil {
+		return nil, &composeError{http.StatusBadRequest, fmt.Errorf("invalid request: %w", err)}
+	}
+	for name, values := range req.Headers {
+		for _, v := range values {
+			out.Header.Add(name, v)
+		}
+	}
+	if host := out.Header.Get("Host"); host != "" {
+		out.Host = host
+	}
+
+	start := time.Now()
+	resp, err := composeClient.Do(out)
+	if err != nil {
+		return nil, &composeError{http.StatusBadGateway, fmt.Errorf("send to %s: %w", target, err)}
+	}
+	defer resp.Body.Close()
+	var body io.Reader = resp.Body
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		zr, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return nil, &composeError{http.StatusBadGateway, fmt.Errorf("read %s response: %w", target, err)}
+		}
+		defer zr.Close()
+		body = zr
+	}
+	data, err := io.ReadAll(io.LimitReader(body, composeMaxBody+1))
+	if err != nil {
+		return nil, &composeError{http.StatusBadGateway, fmt.Errorf("read %s response: %w", target, err)}
+	}
+
+	result := &ComposeResponse{
+		URL:        url,
+		StatusCode: resp.StatusCode,
+		Headers:    resp.Header,
+		DurationMs: time.Since(start).Milliseconds(),
+	}
+	if len(data) > composeMaxBody {
+		data, result.Truncated = data[:composeMaxBody], true
+	}
+	result.Body = string(data)
+	return result, nil
+}
+
+// writeComposeError answers the console with err's status
+func writeComposeError(w http.ResponseWriter, err error) {
+	status := http.StatusBadGateway
+	if ce, ok := err.(*composeError); ok {
+		status = ce.status
+	}
+	http.Error(w, err.Error(), status)
+}
+
+// handleCompose sends a request crafted in the console and returns the
+// answer
+func (i *Inspector) handleCompose(w http.ResponseWriter, r *http.Request) {
+	req, ok := decodeCompose(w, r)
+	if !ok {
+		return
+	}
+	resp, err := i.send(r.Context(), req, req.Target)
+	if err != nil {
+		writeComposeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,62 @@
+package client
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestInspectorCompose(t *testing.T) {
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("X-Echo-Header", r.Header.Get("X-Test"))
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(r.Method + " " + r.URL.RequestURI() + " " + string(body)))
+	}))
+	defer local.Close()
+
+	inspector := NewInspector()
+	inspector.SetComposeTargets(local.URL, func() string { return "" })
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		want        int
+	}{
+		{"local", "application/json", `{"target":"local","method":"POST","path":"/hook?x=1","headers":{"X-Test":["yes"]},"body":"hi"}`, http.StatusOK},
+		{"public before connect", "application/json", `{"target":"public","path":"/"}`, http.StatusBadRequest},
+		{"unknown target", "application/json", `{"target":"elsewhere","path":"/"}`, http.StatusBadRequest},
+		{"relative path", "application/json", `{"target":"local","path":"hook"}`, http.StatusBadRequest},
+		{"form post", "application/x-www-form-urlencoded", `target=local`, http.StatusUnsupportedMediaType},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("POST", "/api/compose", strings.NewReader(tt.body))
+		req.Host = "127.0.0.1:4040"
+		req.Header.Set("Content-Type", tt.contentType)
+		rec := httptest.NewRecorder()
+		inspector.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("%s: status = %d, want %d (body %q)", tt.name, rec.Code, tt.want, rec.Body.String())
+			continue
+		}
+		if rec.Code != http.StatusOK {
+			continue
+		}
+
+		var got ComposeResponse
+		if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		if got.StatusCode != http.StatusCreated || got.Body != "POST /hook?x=1 hi" {
+			t.Errorf("%s: response = %d %q, want the local server's answer", tt.name, got.StatusCode, got.Body)
+		}
+		if echo := http.Header(got.Headers).Get("X-Echo-Header"); echo != "yes" {
+			t.Errorf("%s: X-Echo-Header = %q, want the composed header sent", tt.name, echo)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package client
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/lobber-dev/lobber/internal/tunnel"
+)
+
+// heldBody is the body of a request the relay holds back until the local
+// server asks for it, see tunnel.FeatureContinue. Its bytes arrive in
+// Stream frames no faster than it grants room for them, so they're
+// buffered rather than making the tunnel's reader wait on the local
+// server.
+type heldBody struct {
+	grant func(n int64) // gives the relay room for n more bytes
+
+	mu    sync.Mutex
+	buf   bytes.Buffer
+	asked bool          // the relay has been asked for the body
+	err   error         // what reads get once buf is empty: io.EOF once the body ends
+	grown chan struct{} // closed and replaced whenever buf grows or the body ends
+}
+
+func newHeldBody(grant func(n int64)) *heldBody {
+	return &heldBody{grant: grant, grown: make(chan struct{})}
+}
+
+// Read asks the relay for the body the first time the local server wants
+// some of it, and hands the relay back the room each read frees
+func (b *heldBody) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	if !b.asked {
+		b.asked = true
+		b.mu.Unlock()
+		b.grant(tunnel.StreamWindow)
+		b.mu.Lock()
+	}
+	for b.buf.Len() == 0 && b.err == nil {
+		grown := b.grown
+		b.mu.Unlock()
+		<-grown
+		b.mu.Lock()
+	}
+	n, _ := b.buf.Read(p)
+	err := b.err
+	b.mu.Unlock()
+	if n == 0 {
+		return 0, err
+	}
+	b.grant(int64(n))
+	return n, nil
+}
+
+// Close drops what's left of the body, as the local server is done with it
+func (b *heldBody) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.buf.Reset()
+	b.end(io.EOF)
+	return nil
+}
+
+// write adds bytes of the body from a Stream frame
+func (b *heldBody) write(data []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err == nil {
+		b.buf.Write(data)
+		b.wake()
+	}
+}
+
+// finish ends the body with err once what's buffered has been read:
+// io.EOF once the relay has sent the last of it, or another error if the
+// tunnel went first
+func (b *heldBody) finish(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.end(err)
+}
+
+// end stops the body growing and wakes its reader. Callers hold mu.
+func (b *heldBody) end(err error) {
+	if b.err == nil {
+		b.err = err
+		b.wake()
+	}
+}
+
+// wake lets the reader look again. Callers hold mu.
+func (b *heldBody) wake() {
+	close(b.grown)
+	b.grown = make(chan struct{})
+}
+
+// bodyAllowed reports whether the response to a request with method may
+// carry a body at all. HEAD, 204 and 304 responses never do, however the
+// local server or the client's own pages filled them in.
+func bodyAllowed(method string, status int) bool {
+	return method != http.MethodHead && status >= 200 && status != http.StatusNoContent && status != http.StatusNotModified
+}
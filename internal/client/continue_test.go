@@ -0,0 +1,60 @@
+package client
+
+import (
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/lobber-dev/lobber/internal/tunnel"
+)
+
+func TestHeldBody(t *testing.T) {
+	var mu sync.Mutex
+	var grants []int64
+	b := newHeldBody(func(n int64) {
+		mu.Lock()
+		defer mu.Unlock()
+		grants = append(grants, n)
+	})
+
+	// Nothing is asked for until the local server reads
+	b.write([]byte("early"))
+	if len(grants) != 0 {
+		t.Fatalf("grants before reading = %v, want none", grants)
+	}
+
+	got := make(chan string, 1)
+	go func() {
+		data, err := io.ReadAll(b)
+		if err != nil {
+			t.Errorf("ReadAll() error = %v", err)
+		}
+		got <- string(data)
+	}()
+	b.write([]byte(" late"))
+	b.finish(io.EOF)
+	if data := <-got; data != "early late" {
+		t.Errorf("body = %q, want %q", data, "early late")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(grants) == 0 || grants[0] != tunnel.StreamWindow {
+		t.Fatalf("grants = %v, want the stream window first", grants)
+	}
+	var returned int64
+	for _, n := range grants[1:] {
+		returned += n
+	}
+	if returned != int64(len("early late")) {
+		t.Errorf("room handed back = %d, want %d", returned, len("early late"))
+	}
+
+	// A tunnel that goes mid-body cuts it short rather than ending it
+	cut := newHeldBody(func(int64) {})
+	cut.write([]byte("part"))
+	cut.finish(io.ErrUnexpectedEOF)
+	if _, err := io.ReadAll(cut); err != io.ErrUnexpectedEOF {
+		t.Errorf("ReadAll() of a cut body error = %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
@@ -0,0 +1,87 @@
+package client
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/lobber-dev/lobber/internal/tunnel"
+)
+
+// rewriteCookies adjusts the Set-Cookie headers in resp so the cookies a
+// local app sets for localhost stick on the tunnel's public hostname: a
+// Domain that doesn't cover the hostname becomes it, Secure follows
+// whether visitors arrive over https, and SameSite=None, which browsers
+// only take with Secure, becomes Lax over plain http
+func (c *Client) rewriteCookies(resp *tunnel.Response) {
+	h := http.Header(resp.Headers)
+	cookies := h.Values("Set-Cookie")
+	if len(cookies) == 0 {
+		return
+	}
+	u, err := url.Parse(c.publicOrigin())
+	if err != nil {
+		return
+	}
+	host, secure := u.Hostname(), u.Scheme == "https"
+
+	h = h.Clone()
+	h.Del("Set-Cookie")
+	for _, cookie := range cookies {
+		h.Add("Set-Cookie", rewriteCookie(cookie, host, secure))
+	}
+	resp.Headers = h
+}
+
+// rewriteCookie rewrites one Set-Cookie value for visitors reaching host,
+// over https if secure. The name, value and attributes it has no opinion
+// on are kept as they were.
+func rewriteCookie(cookie, host string, secure bool) string {
+	parts := strings.Split(cookie, ";")
+	name, _, _ := strings.Cut(strings.TrimSpace(parts[0]), "=")
+	out := []string{strings.TrimSpace(parts[0])}
+	hasSecure := false
+	for _, attr := range parts[1:] {
+		attr = strings.TrimSpace(attr)
+		key, val, _ := strings.Cut(attr, "=")
+		switch strings.ToLower(strings.TrimSpace(key)) {
+		case "":
+			continue
+		case "domain":
+			// __Host- cookies may not name a domain at all
+			if strings.HasPrefix(name, "__Host-") {
+				continue
+			}
+			if !domainCovers(strings.TrimSpace(val), host) {
+				attr = "Domain=" + host
+			}
+		case "secure":
+			if !secure {
+				continue
+			}
+			hasSecure = true
+		case "samesite":
+			if !secure && strings.EqualFold(strings.TrimSpace(val), "none") {
+				attr = "SameSite=Lax"
+			}
+		}
+		out = append(out, attr)
+	}
+	if secure && !hasSecure {
+		out = append(out, "Secure")
+	}
+	return strings.Join(out, "; ")
+}
+
+// domainCovers reports whether a cookie's Domain attribute lets browsers
+// send it to host: it names host or a parent of it. IP addresses only
+// cover themselves.
+func domainCovers(domain, host string) bool {
+	domain = strings.ToLower(strings.TrimPrefix(domain, "."))
+	host = strings.ToLower(host)
+	if domain == host {
+		return true
+	}
+	return net.ParseIP(host) == nil && strings.HasSuffix(host, "."+domain)
+}
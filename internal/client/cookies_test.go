@@ -0,0 +1,54 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"testing"
+
+	"github.com/lobber-dev/lobber/internal/tunnel"
+)
+
+func TestRewriteCookie(t *testing.T) {
+	tests := []struct {
+		name   string
+		cookie string
+		secure bool
+		want   string
+	}{
+		{"localhost domain", "sid=abc; Domain=localhost; Path=/; HttpOnly", true, "sid=abc; Domain=app.mysite.com; Path=/; HttpOnly; Secure"},
+		{"parent domain kept", "sid=abc; Domain=.mysite.com; Secure", true, "sid=abc; Domain=.mysite.com; Secure"},
+		{"host only", "sid=abc; Path=/", true, "sid=abc; Path=/; Secure"},
+		{"same site none over https", "sid=abc; SameSite=None", true, "sid=abc; SameSite=None; Secure"},
+		{"same site none over http", "sid=abc; SameSite=None; Secure", false, "sid=abc; SameSite=Lax"},
+		{"secure dropped over http", "sid=abc; secure; Max-Age=60", false, "sid=abc; Max-Age=60"},
+		{"host prefix", "__Host-sid=abc; Domain=localhost; Path=/; Secure", true, "__Host-sid=abc; Path=/; Secure"},
+		{"value with equals", "token=a=b==; Domain=127.0.0.1", true, "token=a=b==; Domain=app.mysite.com; Secure"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rewriteCookie(tt.cookie, "app.mysite.com", tt.secure); got != tt.want {
+				t.Errorf("rewriteCookie(%q) = %q, want %q", tt.cookie, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRewriteCookies(t *testing.T) {
+	local := startClientTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "sid", Value: "1", Domain: "localhost", Path: "/"})
+		http.SetCookie(w, &http.Cookie{Name: "theme", Value: "dark"})
+	}))
+	defer local.Close()
+
+	c := New(local.URL, "http://relay.invalid", "test-token", "app.mysite.com")
+	c.RewriteCookies = true
+	c.welcome.Store(&tunnel.Welcome{URLs: []string{"http://app.mysite.com:8080/"}})
+	resp, _ := c.handle(context.Background(), &tunnel.Request{ID: "1", Method: "GET", Path: "/"})
+
+	got := http.Header(resp.Headers).Values("Set-Cookie")
+	want := []string{"sid=1; Path=/; Domain=app.mysite.com", "theme=dark"}
+	if !slices.Equal(got, want) {
+		t.Errorf("Set-Cookie = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,156 @@
+package client
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"html/template"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/lobber-dev/lobber/internal/tunnel"
+)
+
+const (
+	// DebugCookie holds the debug token in the visitor's browser. Opening
+	// any page with the token in a query parameter of the same name sets it.
+	DebugCookie = "lobber_debug"
+
+	// DebugHeader carries the debug token for clients without cookies,
+	// like curl
+	DebugHeader = "X-Lobber-Debug"
+
+	// debugBodyLimit caps how much of the local app's error body the debug
+	// page shows
+	debugBodyLimit = 16 << 10
+
+	// debugRecent is how many inspector entries the debug page lists
+	debugRecent = 10
+)
+
+// debugToken returns the token a visitor presented, and whether it came
+// in the query string rather than a cookie or header
+func debugToken(req *tunnel.Request) (token string, fromQuery bool) {
+	h := http.Header(req.Headers)
+	if u, err := url.ParseRequestURI(req.Path); err == nil {
+		if v := u.Query().Get(DebugCookie); v != "" {
+			return v, true
+		}
+	}
+	if v := h.Get(DebugHeader); v != "" {
+		return v, false
+	}
+	r := http.Request{Header: h}
+	if c, err := r.Cookie(DebugCookie); err == nil {
+		return c.Value, false
+	}
+	return "", false
+}
+
+// debugging reports whether req may see debug pages, and whether the
+// response should set the debug cookie
+func (c *Client) debugging(req *tunnel.Request) (allowed, setCookie bool) {
+	if c.DebugToken == "" {
+		return false, false
+	}
+	token, fromQuery := debugToken(req)
+	if subtle.ConstantTimeCompare([]byte(token), []byte(c.DebugToken)) != 1 {
+		return false, false
+	}
+	return true, fromQuery
+}
+
+// debugCookie returns the Set-Cookie value that remembers the debug token
+func (c *Client) debugCookie() string {
+	cookie := &http.Cookie{
+		Name:     DebugCookie,
+		Value:    c.DebugToken,
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	return cookie.String()
+}
+
+var debugPageTmpl = template.Must(template.New("debug").Funcs(template.FuncMap{
+	"ago": func(t time.Time) string { return time.Since(t).Round(time.Second).String() },
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>{{.StatusCode}} from {{.LocalAddr}}</title>
+    <style>
+        body { font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", sans-serif; background: #0a0a0a; color: #fafafa; margin: 0; }
+        main { max-width: 960px; margin: 0 auto; padding: 32px; }
+        h1 { font-size: 1.5rem; margin-bottom: 4px; }
+        h2 { font-size: 1rem; margin-top: 32px; color: #a1a1aa; }
+        p { color: #a1a1aa; line-height: 1.5; }
+        code, pre { background: #18181b; border-radius: 4px; }
+        code { padding: 2px 6px; }
+        pre { padding: 16px; overflow-x: auto; white-space: pre-wrap; word-break: break-all; }
+        table { width: 100%; border-collapse: collapse; font-size: 0.875rem; }
+        td { padding: 6px 8px; border-bottom: 1px solid #27272a; }
+        .err { color: #f87171; }
+    </style>
+</head>
+<body>
+    <main>
+        <h1>{{.StatusCode}} {{.StatusText}}</h1>
+        <p><code>{{.Method}} {{.Path}}</code> forwarded to <code>{{.LocalAddr}}</code>. Only visitors with your debug token see this page; everyone else gets the original response.</p>
+        {{if .Error}}<h2>Local error</h2>
+        <pre class="err">{{.Error}}</pre>{{end}}
+        {{if .Body}}<h2>Response body{{if .Truncated}} (truncated){{end}}</h2>
+        <pre>{{.Body}}</pre>{{end}}
+        {{if .Recent}}<h2>Recent requests</h2>
+        <table>
+        {{range .Recent}}<tr><td{{if ge .StatusCode 500}} class="err"{{end}}>{{.StatusCode}}</td><td>{{.Method}}</td><td>{{.Path}}</td><td>{{.DurationMs}}ms</td><td>{{ago .Timestamp}} ago</td></tr>
+        {{end}}</table>{{end}}
+    </main>
+</body>
+</html>
+`))
+
+// debugPage renders a page explaining resp, a 5xx from the local app or
+// the 502 for localErr, listing the requests before it
+func (c *Client) debugPage(req *tunnel.Request, resp *tunnel.Response, localErr error, recent []*InspectedRequest) *tunnel.Response {
+	data := struct {
+		StatusCode   int
+		StatusText   string
+		Method, Path string
+		LocalAddr    string
+		Error, Body  string
+		Truncated    bool
+		Recent       []*InspectedRequest
+	}{
+		StatusCode: resp.StatusCode,
+		StatusText: http.StatusText(resp.StatusCode),
+		Method:     req.Method,
+		Path:       req.Path,
+		LocalAddr:  c.LocalAddr,
+		Recent:     recent,
+	}
+	if localErr != nil {
+		data.Error = localErr.Error()
+	} else {
+		body := resp.Body
+		if len(body) > debugBodyLimit {
+			body, data.Truncated = body[:debugBodyLimit], true
+		}
+		data.Body = string(body)
+	}
+
+	var buf bytes.Buffer
+	if err := debugPageTmpl.Execute(&buf, data); err != nil {
+		return resp
+	}
+	return &tunnel.Response{
+		ID:         resp.ID,
+		StatusCode: resp.StatusCode,
+		Headers: map[string][]string{
+			"Content-Type":  {"text/html; charset=utf-8"},
+			"Cache-Control": {"no-store"},
+		},
+		Body: buf.Bytes(),
+	}
+}
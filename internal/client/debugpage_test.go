@@ -0,0 +1,84 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/lobber-dev/lobber/internal/tunnel"
+)
+
+func TestDebugPage(t *testing.T) {
+	local := startClientTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/crash" {
+			http.Error(w, "panic: nil map write", http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer local.Close()
+
+	c := New(local.URL, "http://relay.invalid", "test-token", "app.mysite.com")
+	c.DebugToken = "s3cret"
+	c.SetInspector(NewInspector())
+	c.handle(context.Background(), &tunnel.Request{ID: "1", Method: "GET", Path: "/earlier"})
+
+	tests := []struct {
+		name       string
+		path       string
+		headers    map[string][]string
+		debugPage  bool
+		wantInBody string
+		setsCookie bool
+		local      int // status the relay is told the local server answered
+	}{
+		{"no token", "/crash", nil, false, "panic: nil map write", false, 500},
+		{"wrong token", "/crash", map[string][]string{"Cookie": {"lobber_debug=nope"}}, false, "panic: nil map write", false, 500},
+		{"cookie", "/crash", map[string][]string{"Cookie": {"lobber_debug=s3cret"}}, true, "/earlier", false, 500},
+		{"header", "/crash", map[string][]string{"X-Lobber-Debug": {"s3cret"}}, true, "panic: nil map write", false, 500},
+		{"query sets cookie", "/crash?lobber_debug=s3cret", nil, true, "panic: nil map write", true, 500},
+		{"success untouched", "/?lobber_debug=s3cret", nil, false, "ok", true, 200},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, meta := c.handle(context.Background(), &tunnel.Request{ID: "2", Method: "GET", Path: tt.path, Headers: tt.headers})
+
+			h := http.Header(resp.Headers)
+			if got := strings.HasPrefix(h.Get("Content-Type"), "text/html"); got != tt.debugPage {
+				t.Errorf("debug page = %v, want %v", got, tt.debugPage)
+			}
+			if !strings.Contains(string(resp.Body), tt.wantInBody) {
+				t.Errorf("body = %q, want it to contain %q", resp.Body, tt.wantInBody)
+			}
+			if got := strings.HasPrefix(h.Get("Set-Cookie"), "lobber_debug=s3cret"); got != tt.setsCookie {
+				t.Errorf("sets cookie = %v, want %v", got, tt.setsCookie)
+			}
+			if meta.LocalStatus != tt.local {
+				t.Errorf("metadata local status = %d, want %d", meta.LocalStatus, tt.local)
+			}
+		})
+	}
+}
+
+func TestDebugPageForUnreachableApp(t *testing.T) {
+	c := New("http://127.0.0.1:1", "http://relay.invalid", "test-token", "app.mysite.com")
+	c.DebugToken = "s3cret"
+
+	resp, meta := c.handle(context.Background(), &tunnel.Request{
+		ID:      "1",
+		Method:  "GET",
+		Path:    "/",
+		Headers: map[string][]string{"X-Lobber-Debug": {"s3cret"}},
+	})
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusBadGateway)
+	}
+	if body := string(resp.Body); !strings.Contains(body, "Local error") || !strings.Contains(body, "connection refused") {
+		t.Errorf("body = %q, want the local error", body)
+	}
+	if meta.LocalStatus != 0 || !strings.Contains(meta.LocalError, "connection refused") || meta.ClientVersion != Version {
+		t.Errorf("metadata = %+v, want the local error and no local status", meta)
+	}
+}
@@ -0,0 +1,273 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/lobber-dev/lobber/internal/tunnel"
+)
+
+const (
+	// DevToolsPath is where visitors turn device debugging on and off, on
+	// tunnels run with DevTools. The client answers everything under it
+	// rather than the local server.
+	DevToolsPath = "/_lobber/devtools"
+
+	// devToolsCookie remembers a browser's device debugging mode: "log"
+	// sends its console to the terminal, "eruda" also shows an on-screen
+	// console
+	devToolsCookie = "lobber_devtools"
+
+	// devLogBodyLimit caps a batch of console entries from a browser
+	devLogBodyLimit = 64 << 10
+
+	// devLogMessageLimit caps one entry's message
+	devLogMessageLimit = 2000
+)
+
+// erudaURL is the on-screen console injected in "eruda" mode
+const erudaURL = "https://cdn.jsdelivr.net/npm/eruda@3"
+
+// DevLog is a console entry from a browser debugging the tunnel, such as a
+// phone without developer tools
+type DevLog struct {
+	Level   string    `json:"level"` // log, info, warn, error or debug
+	Message string    `json:"message"`
+	URL     string    `json:"url"` // the page that logged it
+	Time    time.Time `json:"time"`
+	Agent   string    `json:"-"` // the browser's User-Agent
+}
+
+// devToolsRequest reports whether req is for DevToolsPath or below
+func devToolsRequest(req *tunnel.Request) bool {
+	path, _, _ := strings.Cut(req.Path, "?")
+	return path == DevToolsPath || strings.HasPrefix(path, DevToolsPath+"/")
+}
+
+// devToolsMode returns the debugging mode req's browser turned on, or ""
+func devToolsMode(req *tunnel.Request) string {
+	r := http.Request{Header: http.Header(req.Headers)}
+	if c, err := r.Cookie(devToolsCookie); err == nil && (c.Value == "log" || c.Value == "eruda") {
+		return c.Value
+	}
+	return ""
+}
+
+// serveDevTools answers a request under DevToolsPath: the page that turns
+// debugging on, the script injected into pages and the sink it sends
+// console entries to
+func (c *Client) serveDevTools(req *tunnel.Request) *tunnel.Response {
+	u, err := url.ParseRequestURI(req.Path)
+	if err != nil {
+		return textResponse(req.ID, http.StatusBadRequest, "invalid path")
+	}
+	switch {
+	case u.Path == DevToolsPath && req.Method == http.MethodGet:
+		if mode := u.Query().Get("enable"); mode != "" {
+			return setDevToolsMode(req.ID, mode)
+		}
+		return c.devToolsPage(req)
+	case u.Path == DevToolsPath+"/console.js" && req.Method == http.MethodGet:
+		script := devToolsScript
+		if devToolsMode(req) == "eruda" {
+			script += erudaLoader
+		}
+		return &tunnel.Response{
+			ID:         req.ID,
+			StatusCode: http.StatusOK,
+			Headers:    map[string][]string{"Content-Type": {"text/javascript; charset=utf-8"}, "Cache-Control": {"no-store"}},
+			Body:       []byte(script),
+		}
+	case u.Path == DevToolsPath+"/log" && req.Method == http.MethodPost:
+		return c.receiveDevLogs(req)
+	}
+	return textResponse(req.ID, http.StatusNotFound, "not found")
+}
+
+// setDevToolsMode turns debugging on in mode, or off for "off", and sends
+// the browser back to the site
+func setDevToolsMode(id, mode string) *tunnel.Response {
+	cookie := &http.Cookie{Name: devToolsCookie, Value: mode, Path: "/", SameSite: http.SameSiteLaxMode}
+	switch mode {
+	case "log", "eruda":
+	case "off":
+		cookie.MaxAge = -1
+	default:
+		return textResponse(id, http.StatusBadRequest, "unknown mode "+mode+"; want log, eruda or off")
+	}
+	return &tunnel.Response{
+		ID:         id,
+		StatusCode: http.StatusSeeOther,
+		Headers:    map[string][]string{"Location": {"/"}, "Set-Cookie": {cookie.String()}},
+	}
+}
+
+// receiveDevLogs passes the console entries a browser sent to the
+// terminal, with anything that could drive it stripped
+func (c *Client) receiveDevLogs(req *tunnel.Request) *tunnel.Response {
+	if len(req.Body) > devLogBodyLimit {
+		return textResponse(req.ID, http.StatusRequestEntityTooLarge, "too many entries")
+	}
+	var entries []DevLog
+	if err := json.Unmarshal(req.Body, &entries); err != nil {
+		return textResponse(req.ID, http.StatusBadRequest, "invalid entries: "+err.Error())
+	}
+	agent := http.Header(req.Headers).Get("User-Agent")
+	for _, e := range entries {
+		e.Level, e.Message, e.URL, e.Agent = printable(e.Level, 16), printable(e.Message, devLogMessageLimit), printable(e.URL, 500), printable(agent, 200)
+		if c.onDevLog != nil {
+			c.onDevLog(e)
+		}
+	}
+	return &tunnel.Response{ID: req.ID, StatusCode: http.StatusNoContent}
+}
+
+// printable returns s cut to limit runes, with control characters other
+// than newlines and tabs removed
+func printable(s string, limit int) string {
+	var b strings.Builder
+	n := 0
+	for _, r := range s {
+		if n == limit {
+			b.WriteString("…")
+			break
+		}
+		if unicode.IsControl(r) && r != '\n' && r != '\t' {
+			continue
+		}
+		b.WriteRune(r)
+		n++
+	}
+	return b.String()
+}
+
+// devToolsTag is what injectDevTools adds to pages
+var devToolsTag = []byte(`<script src="` + DevToolsPath + `/console.js"></script>`)
+
+// injectDevTools adds the console script to an HTML response, at the end
+// of its head or else its body
+func injectDevTools(resp *tunnel.Response) {
+	h := http.Header(resp.Headers)
+	if !strings.HasPrefix(h.Get("Content-Type"), "text/html") || h.Get("Content-Encoding") != "" {
+		return
+	}
+	lower := bytes.ToLower(resp.Body)
+	at := bytes.Index(lower, []byte("</head>"))
+	if at < 0 {
+		at = bytes.LastIndex(lower, []byte("</body>"))
+	}
+	if at < 0 {
+		return
+	}
+	body := make([]byte, 0, len(resp.Body)+len(devToolsTag))
+	body = append(body, resp.Body[:at]...)
+	body = append(body, devToolsTag...)
+	body = append(body, resp.Body[at:]...)
+	resp.Body = body
+	h = h.Clone()
+	h.Del("Content-Length")
+	resp.Headers = h
+}
+
+// textResponse is a plain text response the client answers itself
+func textResponse(id string, status int, text string) *tunnel.Response {
+	return &tunnel.Response{
+		ID:         id,
+		StatusCode: status,
+		Headers:    map[string][]string{"Content-Type": {"text/plain; charset=utf-8"}},
+		Body:       []byte(text + "\n"),
+	}
+}
+
+var devToolsPageTmpl = template.Must(template.New("devtools").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>lobber device debugging</title>
+    <style>
+        body { font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", sans-serif; background: #0a0a0a; color: #fafafa; margin: 0; }
+        main { max-width: 560px; margin: 0 auto; padding: 24px; }
+        p { color: #a1a1aa; line-height: 1.5; }
+        a { display: block; margin: 12px 0; padding: 14px; border-radius: 8px; background: #18181b; color: #fafafa; text-decoration: none; }
+        a.on { outline: 2px solid #22c55e; }
+    </style>
+</head>
+<body>
+    <main>
+        <h1>Device debugging</h1>
+        <p>Pages on this tunnel get a script that sends this browser's console and errors to the terminal running <code>lobber up</code>.</p>
+        <a href="?enable=log"{{if eq .Mode "log"}} class="on"{{end}}>Send console to the terminal</a>
+        <a href="?enable=eruda"{{if eq .Mode "eruda"}} class="on"{{end}}>Also show an on-screen console (eruda)</a>
+        <a href="?enable=off"{{if eq .Mode ""}} class="on"{{end}}>Off</a>
+    </main>
+</body>
+</html>
+`))
+
+// devToolsPage lets a visitor pick a debugging mode for their browser
+func (c *Client) devToolsPage(req *tunnel.Request) *tunnel.Response {
+	var buf bytes.Buffer
+	if err := devToolsPageTmpl.Execute(&buf, struct{ Mode string }{devToolsMode(req)}); err != nil {
+		return textResponse(req.ID, http.StatusInternalServerError, err.Error())
+	}
+	return &tunnel.Response{
+		ID:         req.ID,
+		StatusCode: http.StatusOK,
+		Headers:    map[string][]string{"Content-Type": {"text/html; charset=utf-8"}, "Cache-Control": {"no-store"}},
+		Body:       buf.Bytes(),
+	}
+}
+
+// devToolsScript forwards the page's console and uncaught errors to the
+// sink in batches
+const devToolsScript = `(function () {
+  if (window.__lobberDevtools) return;
+  window.__lobberDevtools = true;
+  var queue = [], timer = null;
+  function flush() {
+    timer = null;
+    if (!queue.length) return;
+    var batch = queue.splice(0, queue.length);
+    fetch('` + DevToolsPath + `/log', {method: 'POST', headers: {'Content-Type': 'application/json'}, body: JSON.stringify(batch), keepalive: true}).catch(function () {});
+  }
+  function push(level, args) {
+    var parts = [];
+    for (var i = 0; i < args.length; i++) {
+      var a = args[i];
+      try {
+        parts.push(typeof a === 'string' ? a : a instanceof Error ? (a.stack || String(a)) : JSON.stringify(a));
+      } catch (e) {
+        parts.push(String(a));
+      }
+    }
+    if (queue.length < 100) queue.push({level: level, message: parts.join(' '), url: location.href, time: new Date().toISOString()});
+    if (!timer) timer = setTimeout(flush, 500);
+  }
+  ['log', 'info', 'warn', 'error', 'debug'].forEach(function (level) {
+    var original = console[level];
+    console[level] = function () {
+      push(level, arguments);
+      return original.apply(console, arguments);
+    };
+  });
+  window.addEventListener('error', function (e) { push('error', [e.message + ' (' + e.filename + ':' + e.lineno + ')']); });
+  window.addEventListener('unhandledrejection', function (e) { push('error', ['Unhandled rejection:', e.reason]); });
+  window.addEventListener('pagehide', flush);
+})();
+`
+
+// erudaLoader adds the on-screen console
+const erudaLoader = `(function () {
+  var s = document.createElement('script');
+  s.src = '` + erudaURL + `';
+  s.onload = function () { eruda.init(); };
+  document.head.appendChild(s);
+})();
+`
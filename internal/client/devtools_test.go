@@ -0,0 +1,83 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/lobber-dev/lobber/internal/tunnel"
+)
+
+func TestDevTools(t *testing.T) {
+	local := startClientTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api" {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"html":"</head>"}`))
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte("<html><HEAD><title>app</title></HEAD><body>hi</body></html>"))
+	}))
+	defer local.Close()
+
+	c := New(local.URL, "http://relay.invalid", "test-token", "app.mysite.com")
+	c.DevTools = true
+	var logs []DevLog
+	c.SetOnDevLog(func(e DevLog) { logs = append(logs, e) })
+
+	on := map[string][]string{"Cookie": {"lobber_devtools=log"}, "Accept-Encoding": {"gzip"}}
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		headers    map[string][]string
+		body       string
+		status     int
+		wantInBody string
+		injected   bool
+	}{
+		{"page", "GET", "/_lobber/devtools", nil, "", 200, "Device debugging", false},
+		{"enable", "GET", "/_lobber/devtools?enable=eruda", nil, "", 303, "", false},
+		{"unknown mode", "GET", "/_lobber/devtools?enable=all", nil, "", 400, "unknown mode", false},
+		{"script", "GET", "/_lobber/devtools/console.js", on, "", 200, "console[level]", false},
+		{"script with eruda", "GET", "/_lobber/devtools/console.js", map[string][]string{"Cookie": {"lobber_devtools=eruda"}}, "", 200, "eruda.init()", false},
+		{"log", "POST", "/_lobber/devtools/log", on, `[{"level":"error","message":"boom\u001b[2J","url":"https://app.mysite.com/"}]`, 204, "", false},
+		{"bad log", "POST", "/_lobber/devtools/log", on, `{`, 400, "invalid entries", false},
+		{"off", "GET", "/", nil, "", 200, "<HEAD><title>app</title></HEAD>", false},
+		{"on", "GET", "/", on, "", 200, `<title>app</title><script src="/_lobber/devtools/console.js"></script></HEAD>`, true},
+		{"not html", "GET", "/api", on, "", 200, `{"html":"</head>"}`, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, _ := c.handle(context.Background(), &tunnel.Request{ID: "1", Method: tt.method, Path: tt.path, Headers: tt.headers, Body: []byte(tt.body)})
+			if resp.StatusCode != tt.status {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+			if !strings.Contains(string(resp.Body), tt.wantInBody) {
+				t.Errorf("body = %q, want it to contain %q", resp.Body, tt.wantInBody)
+			}
+			if got := strings.Contains(string(resp.Body), "console.js"); got != tt.injected && tt.method == "GET" && !strings.HasPrefix(tt.path, DevToolsPath) {
+				t.Errorf("injected = %v, want %v", got, tt.injected)
+			}
+		})
+	}
+
+	if len(logs) != 1 || logs[0].Level != "error" || logs[0].Message != "boom[2J" {
+		t.Errorf("logs = %+v, want one error with the escape stripped", logs)
+	}
+}
+
+func TestDevToolsOff(t *testing.T) {
+	local := startClientTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("local " + r.URL.Path))
+	}))
+	defer local.Close()
+
+	c := New(local.URL, "http://relay.invalid", "test-token", "app.mysite.com")
+	resp, _ := c.handle(context.Background(), &tunnel.Request{ID: "1", Method: "GET", Path: DevToolsPath})
+	if string(resp.Body) != "local "+DevToolsPath {
+		t.Errorf("body = %q, want the local server to answer without DevTools", resp.Body)
+	}
+}
@@ -0,0 +1,115 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// diffSkipHeaders are headers expected to differ between any two
+// responses, so aren't reported
+var diffSkipHeaders = []string{"Date", "Connection", "Keep-Alive"}
+
+// diffMaxValue caps the values shown for a difference
+const diffMaxValue = 200
+
+// Difference is one way the public URL's answer differs from the local
+// server's
+type Difference struct {
+	What   string `json:"what"` // "status", "header X-Foo" or "body line 3"
+	Local  string `json:"local"`
+	Public string `json:"public"`
+}
+
+// DiffResponse is the answers of the local server and the public URL to
+// the same request, and how they differ
+type DiffResponse struct {
+	Local       *ComposeResponse `json:"local"`
+	Public      *ComposeResponse `json:"public"`
+	Differences []Difference     `json:"differences"`
+}
+
+// diffResponses lists how public differs from local: its status, each
+// header, and the first line of the body that differs
+func diffResponses(local, public *ComposeResponse) []Difference {
+	diffs := []Difference{}
+	if local.StatusCode != public.StatusCode {
+		diffs = append(diffs, Difference{"status", fmt.Sprint(local.StatusCode), fmt.Sprint(public.StatusCode)})
+	}
+
+	lh, ph := http.Header(local.Headers), http.Header(public.Headers)
+	var names []string
+	for name := range lh {
+		names = append(names, name)
+	}
+	for name := range ph {
+		if _, ok := lh[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		if slices.Contains(diffSkipHeaders, name) {
+			continue
+		}
+		l, p := strings.Join(lh.Values(name), ", "), strings.Join(ph.Values(name), ", ")
+		if l != p {
+			diffs = append(diffs, Difference{"header " + name, clip(l), clip(p)})
+		}
+	}
+
+	if local.Body != public.Body {
+		ll, pl := strings.Split(local.Body, "\n"), strings.Split(public.Body, "\n")
+		for n := range max(len(ll), len(pl)) {
+			var l, p string
+			if n < len(ll) {
+				l = ll[n]
+			}
+			if n < len(pl) {
+				p = pl[n]
+			}
+			if l != p || n >= len(ll) || n >= len(pl) {
+				diffs = append(diffs, Difference{fmt.Sprintf("body line %d", n+1), clip(l), clip(p)})
+				break
+			}
+		}
+	}
+	return diffs
+}
+
+// clip shortens s to diffMaxValue bytes
+func clip(s string) string {
+	if len(s) <= diffMaxValue {
+		return s
+	}
+	return s[:diffMaxValue] + "..."
+}
+
+// handleDiff sends the same request to the local server and the public
+// URL and reports how the answers differ, such as headers the relay drops
+// or a change of compression
+func (i *Inspector) handleDiff(w http.ResponseWriter, r *http.Request) {
+	req, ok := decodeCompose(w, r)
+	if !ok {
+		return
+	}
+	local, err := i.send(r.Context(), req, ComposeLocal)
+	if err != nil {
+		writeComposeError(w, err)
+		return
+	}
+	public, err := i.send(r.Context(), req, ComposePublic)
+	if err != nil {
+		writeComposeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(DiffResponse{
+		Local:       local,
+		Public:      public,
+		Differences: diffResponses(local, public),
+	})
+}
@@ -0,0 +1,65 @@
+package client
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestDiffResponses(t *testing.T) {
+	local := &ComposeResponse{
+		StatusCode: 200,
+		Headers:    map[string][]string{"Date": {"Mon"}, "Cache-Control": {"no-store"}, "X-Trace": {"1"}},
+		Body:       "line one\nline two\n",
+	}
+	public := &ComposeResponse{
+		StatusCode: 200,
+		Headers:    map[string][]string{"Date": {"Tue"}, "Content-Encoding": {"gzip"}, "X-Trace": {"1"}},
+		Body:       "line one\nline 2\n",
+	}
+
+	got := diffResponses(local, public)
+	want := []Difference{
+		{"header Cache-Control", "no-store", ""},
+		{"header Content-Encoding", "", "gzip"},
+		{"body line 2", "line two", "line 2"},
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("diffResponses() = %+v, want %+v", got, want)
+	}
+	if got := diffResponses(local, local); len(got) != 0 {
+		t.Errorf("diffResponses() of the same response = %+v, want none", got)
+	}
+}
+
+func TestInspectorDiff(t *testing.T) {
+	app := func(via string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Via", via)
+			w.Write([]byte("hello"))
+		}))
+	}
+	local, public := app("local"), app("relay")
+	defer local.Close()
+	defer public.Close()
+
+	inspector := NewInspector()
+	inspector.SetComposeTargets(local.URL, func() string { return public.URL })
+	req := httptest.NewRequest("POST", "/api/diff", strings.NewReader(`{"path":"/"}`))
+	req.Host = "127.0.0.1:4040"
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	inspector.ServeHTTP(rec, req)
+
+	var got DiffResponse
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatalf("decode: %v (status %d)", err, rec.Code)
+	}
+	want := []Difference{{"header X-Via", "local", "relay"}}
+	if !slices.Equal(got.Differences, want) {
+		t.Errorf("Differences = %+v, want %+v", got.Differences, want)
+	}
+}
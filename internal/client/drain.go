@@ -0,0 +1,62 @@
+package client
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/lobber-dev/lobber/internal/tunnel"
+)
+
+const (
+	// drainReason is why Run reconnects when the relay drains the tunnel
+	drainReason = "relay restart"
+
+	// drainTimeout bounds how long a drained connection is kept for its
+	// requests and streams when the relay gave no deadline
+	drainTimeout = 30 * time.Second
+
+	// drainQuiet is how long a drained connection must have had nothing
+	// in flight before it's closed, as the relay may still be sending a
+	// request it had queued
+	drainQuiet = 500 * time.Millisecond
+
+	// drainPoll is how often retire checks what's still in flight
+	drainPoll = 50 * time.Millisecond
+)
+
+// retire closes a connection the relay is draining, and the streams and
+// forwarders on it, once nothing has been in flight for drainQuiet, or at
+// the relay's deadline. Requests arriving on it meanwhile are still served.
+func (c *Client) retire(ctx context.Context, conn net.Conn, d *tunnel.Drain, requests *inflight, streams *streamer, udp *udpForwarder) {
+	defer closeForwarders(streams, udp)
+	defer conn.Close()
+
+	deadline := time.Now().Add(drainTimeout)
+	if !d.Deadline.IsZero() && d.Deadline.Before(deadline) {
+		deadline = d.Deadline
+	}
+	ticker := time.NewTicker(drainPoll)
+	defer ticker.Stop()
+	idleSince := time.Now()
+	for now := time.Now(); now.Before(deadline); now = time.Now() {
+		if requests.len() > 0 || streams.len() > 0 {
+			idleSince = now
+		} else if now.Sub(idleSince) >= drainQuiet {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// closeForwarders ends a connection's streams and UDP forwarding
+func closeForwarders(streams *streamer, udp *udpForwarder) {
+	streams.close()
+	if udp != nil {
+		udp.close()
+	}
+}
@@ -0,0 +1,16 @@
+package client
+
+import (
+	"strings"
+
+	"github.com/lobber-dev/lobber/internal/proxyerr"
+	"github.com/lobber-dev/lobber/internal/tunnel"
+)
+
+// addError records that forwarding req failed with err, answering the
+// visitor with status, for Quality and `lobber status --errors`. The query
+// is left out of the path, as it may carry secrets.
+func (c *Client) addError(req *tunnel.Request, status int, err error) {
+	path, _, _ := strings.Cut(req.Path, "?")
+	c.errors.Add(proxyerr.Entry{Method: req.Method, Path: path, Status: status, Cause: "local server: " + err.Error()})
+}
@@ -0,0 +1,44 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/lobber-dev/lobber/internal/tunnel"
+)
+
+func TestQualityErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		buffer int // -1 leaves the default
+		want   int
+	}{
+		{"default", -1, 2},
+		{"one", 1, 1},
+		{"none", 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := New("http://127.0.0.1:1", "http://relay.invalid", "test-token", "app.mysite.com")
+			if tt.buffer >= 0 {
+				c.SetErrorBuffer(tt.buffer)
+			}
+			c.handle(context.Background(), &tunnel.Request{ID: "1", Method: "GET", Path: "/first"})
+			c.handle(context.Background(), &tunnel.Request{ID: "2", Method: "POST", Path: "/login?token=secret"})
+
+			errs := c.Quality().Errors
+			if len(errs) != tt.want {
+				t.Fatalf("errors = %+v, want %d", errs, tt.want)
+			}
+			if tt.want == 0 {
+				return
+			}
+			e := errs[0]
+			if e.Method != "POST" || e.Path != "/login" || e.Status != http.StatusBadGateway || !strings.Contains(e.Cause, "connection refused") {
+				t.Errorf("latest error = %+v, want POST /login refused with 502 and no query", e)
+			}
+		})
+	}
+}
@@ -0,0 +1,32 @@
+package client
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/lobber-dev/lobber/internal/tunnel"
+)
+
+// setForwarded tells the local server who a request came from, as reverse
+// proxies do: X-Forwarded-For gains the visitor's address after any the
+// request already listed, and X-Forwarded-Proto and X-Forwarded-Host say
+// how the visitor reached the relay. Relays that don't send a caller leave
+// the headers as they were.
+func setForwarded(h http.Header, c *tunnel.Caller) {
+	if c == nil {
+		return
+	}
+	if c.RemoteIP != "" {
+		chain := c.RemoteIP
+		if prior := h.Values("X-Forwarded-For"); len(prior) > 0 {
+			chain = strings.Join(prior, ", ") + ", " + chain
+		}
+		h.Set("X-Forwarded-For", chain)
+	}
+	if c.Scheme != "" {
+		h.Set("X-Forwarded-Proto", c.Scheme)
+	}
+	if c.Host != "" {
+		h.Set("X-Forwarded-Host", c.Host)
+	}
+}
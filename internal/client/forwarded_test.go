@@ -0,0 +1,55 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/lobber-dev/lobber/internal/tunnel"
+)
+
+func TestForwardedHeaders(t *testing.T) {
+	seen := make(chan http.Header, 1)
+	local := startClientTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen <- r.Header.Clone()
+	}))
+	defer local.Close()
+	c := New(local.URL, "http://relay.invalid", "test-token", "app.mysite.com")
+
+	tests := []struct {
+		name    string
+		headers map[string][]string
+		caller  *tunnel.Caller
+		want    map[string]string
+	}{
+		{
+			"from the relay",
+			nil,
+			&tunnel.Caller{RemoteIP: "203.0.113.7", Scheme: "https", Host: "app.mysite.com"},
+			map[string]string{"X-Forwarded-For": "203.0.113.7", "X-Forwarded-Proto": "https", "X-Forwarded-Host": "app.mysite.com"},
+		},
+		{
+			"behind another proxy",
+			map[string][]string{"X-Forwarded-For": {"198.51.100.1"}, "X-Forwarded-Proto": {"http"}},
+			&tunnel.Caller{RemoteIP: "10.0.0.2", Scheme: "https", Host: "app.mysite.com:8443"},
+			map[string]string{"X-Forwarded-For": "198.51.100.1, 10.0.0.2", "X-Forwarded-Proto": "https", "X-Forwarded-Host": "app.mysite.com:8443"},
+		},
+		{
+			"older relay",
+			map[string][]string{"X-Forwarded-For": {"198.51.100.1"}},
+			nil,
+			map[string]string{"X-Forwarded-For": "198.51.100.1", "X-Forwarded-Proto": "", "X-Forwarded-Host": ""},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c.handle(context.Background(), &tunnel.Request{ID: "1", Method: "GET", Path: "/", Headers: tt.headers, Caller: tt.caller})
+			got := <-seen
+			for name, want := range tt.want {
+				if v := got.Get(name); v != want {
+					t.Errorf("%s = %q, want %q", name, v, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package client
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// isGRPC reports whether a request is gRPC over HTTP/2, which gRPC servers
+// only speak with its trailers. gRPC-Web works over HTTP/1.1 and goes as
+// any other request.
+func isGRPC(h http.Header) bool {
+	ct := h.Get("Content-Type")
+	return (ct == "application/grpc" || strings.HasPrefix(ct, "application/grpc+") || strings.HasPrefix(ct, "application/grpc;")) &&
+		!strings.HasPrefix(ct, "application/grpc-web")
+}
+
+// localClient is the client a request goes to the local server with. gRPC
+// to a plain-HTTP local server goes as HTTP/2 with prior knowledge (h2c),
+// as gRPC servers expect; over HTTPS it's negotiated as usual.
+func (c *Client) localClient(req *http.Request) *http.Client {
+	if req.URL.Scheme != "http" || !isGRPC(req.Header) {
+		return c.httpClient
+	}
+	c.h2cOnce.Do(func() {
+		var protocols http.Protocols
+		protocols.SetUnencryptedHTTP2(true)
+		c.h2cClient = &http.Client{
+			Timeout:   30 * time.Second,
+			Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, Protocols: &protocols},
+		}
+	})
+	return c.h2cClient
+}
+
+// trailers returns the trailers a local response ended with, leaving out
+// those it announced and didn't send
+func trailers(resp *http.Response) map[string][]string {
+	var t map[string][]string
+	for k, v := range resp.Trailer {
+		if len(v) == 0 {
+			continue
+		}
+		if t == nil {
+			t = make(map[string][]string, len(resp.Trailer))
+		}
+		t[k] = v
+	}
+	return t
+}
@@ -5,8 +5,11 @@ import (
 	"encoding/json"
 	"io/fs"
 	"net/http"
+	"slices"
 	"sync"
 	"time"
+
+	"github.com/lobber-dev/lobber/internal/scrub"
 )
 
 //go:embed static/*
@@ -23,13 +26,25 @@ type InspectedRequest struct {
 	ResponseBody    string              `json:"response_body,omitempty"`
 	DurationMs      int64               `json:"duration_ms"`
 	Timestamp       time.Time           `json:"timestamp"`
+
+	// Where a visitor's wait went, as far as the client can tell. The relay
+	// reports its part; the network is the latest heartbeat's round trip.
+	RelayMs   float64 `json:"relay_ms,omitempty"`
+	NetworkMs float64 `json:"network_ms,omitempty"`
+	LocalMs   float64 `json:"local_ms,omitempty"`
 }
 
 type Inspector struct {
 	mu       sync.RWMutex
 	requests []*InspectedRequest
 	maxSize  int
+	maxAge   time.Duration
 	mux      *http.ServeMux
+	quality  func() Quality  // reports the tunnel's connection, if set
+	scrubber *scrub.Scrubber // redacts requests as they're captured, if set
+
+	composeLocal  string        // the local server's URL; see SetComposeTargets
+	composePublic func() string // the tunnel's public URL, if known
 }
 
 func NewInspector() *Inspector {
@@ -43,6 +58,9 @@ func NewInspector() *Inspector {
 	i.mux.HandleFunc("/api/requests", i.handleListRequests)
 	i.mux.HandleFunc("/api/requests/", i.handleGetRequest)
 	i.mux.HandleFunc("/api/replay/", i.handleReplay)
+	i.mux.HandleFunc("/api/quality", i.handleQuality)
+	i.mux.HandleFunc("/api/compose", i.handleCompose)
+	i.mux.HandleFunc("/api/diff", i.handleDiff)
 
 	// Static files
 	staticFS, _ := fs.Sub(staticFiles, "static")
@@ -51,7 +69,44 @@ func NewInspector() *Inspector {
 	return i
 }
 
+// SetMaxAge drops captured requests older than d. Zero keeps them until they
+// are pushed out by newer requests.
+func (i *Inspector) SetMaxAge(d time.Duration) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.maxAge = d
+	i.pruneLocked(time.Now())
+}
+
+// SetScrubber redacts requests captured from now on with s, before they're
+// kept or shown
+func (i *Inspector) SetScrubber(s *scrub.Scrubber) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.scrubber = s
+}
+
+// SetQualitySource has /api/quality report fn's connection quality, usually
+// Client.Quality
+func (i *Inspector) SetQualitySource(fn func() Quality) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.quality = fn
+}
+
+// Handle serves h alongside the inspector, such as the Tunnels API
+func (i *Inspector) Handle(pattern string, h http.Handler) {
+	i.mux.Handle(pattern, h)
+}
+
+// ServeHTTP answers only requests addressed to localhost. Compose and diff
+// send requests from the developer's machine, so a page rebinding its
+// hostname to 127.0.0.1 mustn't reach any of the inspector.
 func (i *Inspector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !loopbackHost(r) {
+		http.Error(w, "the inspector only answers on localhost", http.StatusForbidden)
+		return
+	}
 	i.mux.ServeHTTP(w, r)
 }
 
@@ -62,24 +117,68 @@ func (i *Inspector) AddRequest(req *InspectedRequest) {
 	if req.Timestamp.IsZero() {
 		req.Timestamp = time.Now()
 	}
+	if s := i.scrubber; s != nil {
+		req.Path = s.String(req.Path)
+		req.RequestBody = string(s.Body(http.Header(req.RequestHeaders).Get("Content-Type"), []byte(req.RequestBody)))
+		req.ResponseBody = string(s.Body(http.Header(req.ResponseHeaders).Get("Content-Type"), []byte(req.ResponseBody)))
+		req.RequestHeaders = s.Headers(req.RequestHeaders)
+		req.ResponseHeaders = s.Headers(req.ResponseHeaders)
+	}
 
 	i.requests = append([]*InspectedRequest{req}, i.requests...)
 
 	if len(i.requests) > i.maxSize {
 		i.requests = i.requests[:i.maxSize]
 	}
+	i.pruneLocked(time.Now())
+}
+
+// Recent returns up to n of the latest requests, newest first
+func (i *Inspector) Recent(n int) []*InspectedRequest {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.pruneLocked(time.Now())
+	return slices.Clone(i.requests[:min(n, len(i.requests))])
+}
+
+// pruneLocked removes requests older than maxAge. Requests are newest first.
+func (i *Inspector) pruneLocked(now time.Time) {
+	if i.maxAge <= 0 {
+		return
+	}
+	cutoff := now.Add(-i.maxAge)
+	for n, req := range i.requests {
+		if req.Timestamp.Before(cutoff) {
+			i.requests = i.requests[:n]
+			return
+		}
+	}
 }
 
 func (i *Inspector) handleListRequests(w http.ResponseWriter, r *http.Request) {
-	i.mu.RLock()
+	i.mu.Lock()
+	i.pruneLocked(time.Now())
 	requests := make([]*InspectedRequest, len(i.requests))
 	copy(requests, i.requests)
-	i.mu.RUnlock()
+	i.mu.Unlock()
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(requests)
 }
 
+func (i *Inspector) handleQuality(w http.ResponseWriter, r *http.Request) {
+	i.mu.RLock()
+	quality := i.quality
+	i.mu.RUnlock()
+	if quality == nil {
+		http.Error(w, "no tunnel", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(quality())
+}
+
 func (i *Inspector) handleGetRequest(w http.ResponseWriter, r *http.Request) {
 	// TODO: Get single request by ID
 	http.Error(w, "not implemented", http.StatusNotImplemented)
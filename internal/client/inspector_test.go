@@ -4,7 +4,11 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/lobber-dev/lobber/internal/scrub"
 )
 
 func TestInspectorReturnsRequests(t *testing.T) {
@@ -19,6 +23,7 @@ func TestInspectorReturnsRequests(t *testing.T) {
 	})
 
 	req := httptest.NewRequest("GET", "/api/requests", nil)
+	req.Host = "127.0.0.1:4040"
 	rec := httptest.NewRecorder()
 
 	inspector.ServeHTTP(rec, req)
@@ -40,3 +45,102 @@ func TestInspectorReturnsRequests(t *testing.T) {
 		t.Errorf("ID = %q, want %q", requests[0].ID, "req-1")
 	}
 }
+
+func TestInspectorScrubs(t *testing.T) {
+	s, err := scrub.New(scrub.Rules{
+		Headers:  []string{"authorization"},
+		Fields:   []string{"card.number"},
+		Patterns: []string{`tok_\w+`},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	inspector := NewInspector()
+	inspector.SetScrubber(s)
+
+	inspector.AddRequest(&InspectedRequest{
+		ID:              "req-1",
+		Path:            "/charges/tok_123",
+		RequestHeaders:  map[string][]string{"Authorization": {"Bearer secret"}, "Content-Type": {"application/json"}},
+		RequestBody:     `{"card":{"number":"4242424242424242","exp":"12/30"}}`,
+		ResponseHeaders: map[string][]string{"Content-Type": {"text/plain"}},
+		ResponseBody:    "charged tok_123",
+	})
+
+	got := inspector.Recent(1)[0]
+	if got.Path != "/charges/[REDACTED]" {
+		t.Errorf("path = %q, want the token scrubbed", got.Path)
+	}
+	if auth := got.RequestHeaders["Authorization"][0]; auth != scrub.Placeholder {
+		t.Errorf("Authorization = %q, want it scrubbed", auth)
+	}
+	if got.RequestBody != `{"card":{"exp":"12/30","number":"[REDACTED]"}}` {
+		t.Errorf("request body = %s, want the card number scrubbed", got.RequestBody)
+	}
+	if got.ResponseBody != "charged [REDACTED]" {
+		t.Errorf("response body = %s, want the token scrubbed", got.ResponseBody)
+	}
+}
+
+func TestInspectorMaxAge(t *testing.T) {
+	inspector := NewInspector()
+	inspector.AddRequest(&InspectedRequest{ID: "old", Timestamp: time.Now().Add(-2 * time.Hour)})
+	inspector.AddRequest(&InspectedRequest{ID: "new"})
+
+	inspector.SetMaxAge(time.Hour)
+
+	req := httptest.NewRequest("GET", "/api/requests", nil)
+	req.Host = "127.0.0.1:4040"
+	rec := httptest.NewRecorder()
+	inspector.ServeHTTP(rec, req)
+
+	var requests []InspectedRequest
+	if err := json.NewDecoder(rec.Body).Decode(&requests); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(requests) != 1 || requests[0].ID != "new" {
+		t.Errorf("requests = %+v, want only %q", requests, "new")
+	}
+}
+
+func TestInspectorQuality(t *testing.T) {
+	inspector := NewInspector()
+
+	req := httptest.NewRequest("GET", "/api/quality", nil)
+	req.Host = "localhost:4040"
+	rec := httptest.NewRecorder()
+	inspector.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("status without a tunnel = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+
+	inspector.SetQualitySource(func() Quality {
+		return Quality{Domain: "app.mysite.com", Connected: true, Heartbeat: true, RTTMs: 42}
+	})
+	rec = httptest.NewRecorder()
+	inspector.ServeHTTP(rec, req)
+
+	var q Quality
+	if err := json.NewDecoder(rec.Body).Decode(&q); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if q.Domain != "app.mysite.com" || q.RTTMs != 42 {
+		t.Errorf("quality = %+v, want the source's", q)
+	}
+}
+
+func TestInspectorRefusesReboundHosts(t *testing.T) {
+	inspector := NewInspector()
+	inspector.SetComposeTargets("http://127.0.0.1:1", nil)
+
+	for _, path := range []string{"/", "/api/requests", "/api/compose", "/api/diff"} {
+		req := httptest.NewRequest("POST", path, strings.NewReader(`{"target":"local","path":"/"}`))
+		req.Host = "evil.example.com:4040"
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		inspector.ServeHTTP(rec, req)
+		if rec.Code != http.StatusForbidden {
+			t.Errorf("POST %s from a rebound host: status = %d, want %d", path, rec.Code, http.StatusForbidden)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package client
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics counts what the client has done since it started, across
+// reconnects, for telling where a busy tunnel's time goes: in the local
+// server, or in reading, encoding and writing frames
+type Metrics struct {
+	Requests     int64   `json:"requests"`      // forwarded to the local server
+	InFlight     int64   `json:"in_flight"`     // being forwarded now
+	LocalMs      float64 `json:"local_ms"`      // mean time the local server took to answer
+	Frames       int64   `json:"frames"`        // read from the relay
+	BytesRead    int64   `json:"bytes_read"`    // from the relay, as sent: framed and maybe compressed
+	BytesWritten int64   `json:"bytes_written"` // to the relay, likewise
+	Flushes      int64   `json:"flushes"`       // writes to the relay's connection, of one frame or a few
+}
+
+// metricsTracker accumulates Metrics. Its counters are bumped on every
+// frame, so they're atomics rather than behind a lock.
+type metricsTracker struct {
+	requests     atomic.Int64
+	inFlight     atomic.Int64
+	local        atomic.Int64 // nanoseconds the local server took, summed
+	bytesRead    atomic.Int64
+	bytesWritten atomic.Int64
+	flushes      atomic.Int64
+}
+
+// forwarding counts a request on its way to the local server, and returns
+// a func to call with how long the local server took once it's answered
+func (m *metricsTracker) forwarding() func(local time.Duration) {
+	m.requests.Add(1)
+	m.inFlight.Add(1)
+	return func(local time.Duration) {
+		m.inFlight.Add(-1)
+		m.local.Add(int64(local))
+	}
+}
+
+func (m *metricsTracker) snapshot() Metrics {
+	s := Metrics{
+		Requests:     m.requests.Load(),
+		InFlight:     m.inFlight.Load(),
+		BytesRead:    m.bytesRead.Load(),
+		BytesWritten: m.bytesWritten.Load(),
+		Flushes:      m.flushes.Load(),
+	}
+	if answered := s.Requests - s.InFlight; answered > 0 {
+		s.LocalMs = ms(time.Duration(m.local.Load() / answered))
+	}
+	return s
+}
+
+// countingReader counts the bytes read through it into n
+type countingReader struct {
+	r io.Reader
+	n *atomic.Int64
+}
+
+func (c countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// countingWriter counts the bytes written through it into n
+type countingWriter struct {
+	w io.Writer
+	n *atomic.Int64
+}
+
+func (c countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// Metrics reports what the client has done since it started
+func (c *Client) Metrics() Metrics {
+	m := c.metrics.snapshot()
+	m.Frames = c.quality.snapshot().Frames
+	return m
+}
@@ -0,0 +1,69 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/lobber-dev/lobber/internal/tunnel"
+)
+
+func TestMetrics(t *testing.T) {
+	local := startClientTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		w.Write([]byte("hello"))
+	}))
+	defer local.Close()
+
+	// A relay that sends one request and waits for its answer
+	answered := make(chan *tunnel.Response, 1)
+	relay := startClientTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, bufrw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		bufrw.WriteString("HTTP/1.1 200 OK\r\n\r\n")
+		bufrw.Flush()
+		if _, err := tunnel.DecodeReady(bufrw); err != nil {
+			return
+		}
+		tunnel.EncodeRequest(bufrw, &tunnel.Request{ID: "req-1", Method: "GET", Path: "/"})
+		bufrw.Flush()
+		frame, err := tunnel.ReadFrame(bufrw)
+		if err != nil {
+			return
+		}
+		var resp tunnel.Response
+		frame.Decode(&resp)
+		answered <- &resp
+		<-r.Context().Done()
+	}))
+	defer relay.Close()
+
+	c := New(local.URL, relay.URL, "test-token", "app.mysite.com")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.Run(ctx)
+
+	select {
+	case resp := <-answered:
+		if string(resp.Body) != "hello" {
+			t.Fatalf("response body = %q, want hello", resp.Body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the response")
+	}
+
+	m := c.Metrics()
+	if m.Requests != 1 || m.InFlight != 0 || m.Frames != 1 {
+		t.Errorf("Metrics() = %+v, want 1 request answered from 1 frame", m)
+	}
+	if m.LocalMs < 20 {
+		t.Errorf("LocalMs = %v, want at least the 20ms the local server took", m.LocalMs)
+	}
+	if m.BytesRead == 0 || m.BytesWritten <= int64(len("hello")) || m.Flushes != 1 {
+		t.Errorf("Metrics() = %+v, want bytes both ways and the response flushed once", m)
+	}
+}
@@ -0,0 +1,71 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/lobber-dev/lobber/internal/tunnel"
+)
+
+// handlePassthrough connects a visitor's TLS connection, which the relay
+// passes on unopened, to the local server, which terminates it with its own
+// certificate. The relay hears 101 once the local server has answered the
+// dial, and the connection then carries on as a stream until either end
+// closes it.
+func (c *Client) handlePassthrough(ctx context.Context, req *tunnel.Request, streams *streamer, write func(func(io.Writer) error) error) {
+	start := time.Now()
+	dialCtx, cancel := context.WithTimeout(ctx, upgradeTimeout)
+	conn, err := new(net.Dialer).DialContext(dialCtx, "tcp", c.LocalAddr)
+	cancel()
+	meta := &tunnel.Metadata{ID: req.ID, Local: time.Since(start), ClientVersion: Version}
+	resp := &tunnel.Response{ID: req.ID, StatusCode: http.StatusSwitchingProtocols, Upgrade: tunnel.ProtocolTLS}
+	if err != nil {
+		meta.LocalError = err.Error()
+		c.addError(req, http.StatusBadGateway, err)
+		resp = &tunnel.Response{
+			ID:         req.ID,
+			StatusCode: http.StatusBadGateway,
+			Headers:    map[string][]string{"Content-Type": {"text/plain"}},
+			Body:       []byte("local forward error: " + err.Error()),
+		}
+	} else {
+		meta.LocalStatus = resp.StatusCode
+	}
+
+	if c.inspector != nil {
+		c.inspector.AddRequest(&InspectedRequest{
+			ID:         req.ID,
+			Method:     req.Method,
+			Path:       req.Path,
+			StatusCode: resp.StatusCode,
+			DurationMs: time.Since(start).Milliseconds(),
+			Timestamp:  start,
+			RelayMs:    ms(req.RelayTime),
+			LocalMs:    ms(meta.Local),
+			NetworkMs:  c.quality.snapshot().RTTMs,
+		})
+	}
+
+	// As with an upgrade, the stream must be known before the relay hears
+	// of the 101
+	connected := conn != nil && streams.add(req.ID, conn)
+	if conn != nil && !connected {
+		conn.Close()
+	}
+	meta.Client = time.Since(start)
+	if err := c.respond(write, resp, meta); err != nil {
+		if connected {
+			streams.remove(req.ID)
+			conn.Close()
+		}
+		return
+	}
+	c.release(write, req)
+	if connected {
+		streams.pump(req.ID, bufio.NewReader(conn))
+	}
+}
@@ -0,0 +1,231 @@
+package client
+
+import (
+	"sync"
+	"time"
+
+	"github.com/lobber-dev/lobber/internal/proxyerr"
+	"github.com/lobber-dev/lobber/internal/tunnel"
+)
+
+const (
+	// DefaultHeartbeat is how often New's clients ping the relay
+	DefaultHeartbeat = 10 * time.Second
+
+	// rttSamples is how many recent heartbeats the average RTT covers
+	rttSamples = 10
+
+	// reconnectWindow is how far back reconnects count as recent
+	reconnectWindow = time.Hour
+
+	// SlowRTT is the average heartbeat round trip above which the link to
+	// the relay, rather than the relay or the local app, likely slows
+	// requests down. The link counts as recovered once the average is back
+	// under two thirds of it, so one borderline sample doesn't flap.
+	SlowRTT = 300 * time.Millisecond
+
+	// minSlowSamples is how many heartbeats the average needs before it
+	// marks the link slow
+	minSlowSamples = 3
+)
+
+// Quality describes the tunnel's connection to the relay, so users can
+// tell a slow uplink from a slow relay or local app
+type Quality struct {
+	Domain    string    `json:"domain"`
+	Relay     string    `json:"relay"`
+	Connected bool      `json:"connected"`
+	Since     time.Time `json:"since,omitzero"` // when the current connection came up
+
+	Name    string        `json:"name,omitempty"`
+	Labels  tunnel.Labels `json:"labels,omitempty"`
+	UDPPort int           `json:"udp_port,omitempty"` // public port of a UDP tunnel on the relay
+
+	// Round trips of heartbeats to the relay. Heartbeat is false when the
+	// relay doesn't answer them, and the RTTs stay 0.
+	Heartbeat        bool    `json:"heartbeat"`
+	RTTMs            float64 `json:"rtt_ms"`            // latest heartbeat
+	AvgRTTMs         float64 `json:"avg_rtt_ms"`        // mean of the last rttSamples heartbeats
+	JitterMs         float64 `json:"jitter_ms"`         // mean change between consecutive ones of those
+	Slow             bool    `json:"slow,omitempty"`    // the average is over SlowRTT; see SetOnLatency
+	MissedHeartbeats int     `json:"missed_heartbeats"` // pings still unanswered when the next was due
+
+	Reconnects  int   `json:"reconnects"`   // in the last reconnectWindow
+	Frames      int64 `json:"frames"`       // frames read from the relay
+	FrameErrors int64 `json:"frame_errors"` // frames that were malformed or of an unknown type
+
+	Errors []proxyerr.Entry `json:"errors,omitempty"` // the latest requests the tunnel failed to forward, newest first
+}
+
+// FrameErrorRate returns the fraction of frames from the relay that were bad
+func (q Quality) FrameErrorRate() float64 {
+	if q.Frames == 0 {
+		return 0
+	}
+	return float64(q.FrameErrors) / float64(q.Frames)
+}
+
+// qualityTracker accumulates Quality across the client's connections
+type qualityTracker struct {
+	mu          sync.Mutex
+	connected   bool
+	since       time.Time
+	heartbeat   bool
+	rtts        []time.Duration // newest last, at most rttSamples
+	slow        bool
+	missed      int
+	reconnects  []time.Time
+	frames      int64
+	frameErrors int64
+}
+
+func (q *qualityTracker) up(heartbeat bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.connected, q.since, q.heartbeat = true, time.Now(), heartbeat
+}
+
+func (q *qualityTracker) down() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.connected = false
+}
+
+func (q *qualityTracker) reconnected() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.reconnects = append(q.reconnects, time.Now())
+}
+
+// rtt records a heartbeat's round trip. It reports whether the link went
+// slow or recovered with it, whether it's now slow, and the average.
+func (q *qualityTracker) rtt(d time.Duration) (changed, slow bool, avg time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.rtts = append(q.rtts, d)
+	if len(q.rtts) > rttSamples {
+		q.rtts = q.rtts[len(q.rtts)-rttSamples:]
+	}
+	avg, _ = q.average()
+	switch {
+	case !q.slow && avg > SlowRTT && len(q.rtts) >= minSlowSamples:
+		q.slow = true
+		return true, true, avg
+	case q.slow && avg < SlowRTT*2/3:
+		q.slow = false
+		return true, false, avg
+	}
+	return false, q.slow, avg
+}
+
+// average returns the mean of the recent round trips and of the changes
+// between them. q.mu must be held.
+func (q *qualityTracker) average() (avg, jitter time.Duration) {
+	n := len(q.rtts)
+	if n == 0 {
+		return 0, 0
+	}
+	var total, changes time.Duration
+	for i, d := range q.rtts {
+		total += d
+		if i > 0 {
+			changes += (d - q.rtts[i-1]).Abs()
+		}
+	}
+	if n > 1 {
+		jitter = changes / time.Duration(n-1)
+	}
+	return total / time.Duration(n), jitter
+}
+
+func (q *qualityTracker) missedHeartbeat() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.missed++
+}
+
+// frame counts a frame read from the relay, and whether it was bad
+func (q *qualityTracker) frame(bad bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.frames++
+	if bad {
+		q.frameErrors++
+	}
+}
+
+func (q *qualityTracker) snapshot() Quality {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	// Forget reconnects that are no longer recent
+	cutoff := time.Now().Add(-reconnectWindow)
+	for len(q.reconnects) > 0 && q.reconnects[0].Before(cutoff) {
+		q.reconnects = q.reconnects[1:]
+	}
+
+	s := Quality{
+		Connected:        q.connected,
+		Heartbeat:        q.heartbeat,
+		MissedHeartbeats: q.missed,
+		Reconnects:       len(q.reconnects),
+		Frames:           q.frames,
+		FrameErrors:      q.frameErrors,
+	}
+	if q.connected {
+		s.Since = q.since
+	}
+	if n := len(q.rtts); n > 0 {
+		avg, jitter := q.average()
+		s.RTTMs = ms(q.rtts[n-1])
+		s.AvgRTTMs, s.JitterMs, s.Slow = ms(avg), ms(jitter), q.slow
+	}
+	return s
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// pinger matches a connection's pongs to its pings. One ping is out at a
+// time; the next replaces it.
+type pinger struct {
+	mu      sync.Mutex
+	seq     uint64
+	sentAt  time.Time
+	waiting bool // the latest ping hasn't been answered
+	delayed bool // a request was forwarded since it went out
+}
+
+// next starts a ping, reporting whether the previous one went unanswered
+// for reasons other than a slow request holding up the reader
+func (p *pinger) next() (hb *tunnel.Heartbeat, missed bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	missed = p.waiting && !p.delayed
+	p.seq++
+	p.sentAt, p.waiting, p.delayed = time.Now(), true, false
+	return &tunnel.Heartbeat{Seq: p.seq}, missed
+}
+
+// forwarding notes that the reader is busy with a request, so a pong read
+// after it no longer times the network alone
+func (p *pinger) forwarding() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.waiting {
+		p.delayed = true
+	}
+}
+
+// answered takes a pong and returns the round trip, if it answers the
+// latest ping and is a fair sample
+func (p *pinger) answered(seq uint64) (time.Duration, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.waiting || seq != p.seq {
+		return 0, false
+	}
+	p.waiting = false
+	return time.Since(p.sentAt), !p.delayed
+}
@@ -0,0 +1,108 @@
+package client
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPinger(t *testing.T) {
+	var p pinger
+
+	hb, missed := p.next()
+	if missed {
+		t.Error("first ping reported the previous one missed")
+	}
+	if _, ok := p.answered(hb.Seq + 1); ok {
+		t.Error("answered() took a pong for another ping")
+	}
+	if _, ok := p.answered(hb.Seq); !ok {
+		t.Error("answered() refused the pong for the latest ping")
+	}
+	if _, ok := p.answered(hb.Seq); ok {
+		t.Error("answered() took the same pong twice")
+	}
+
+	// A pong held up behind a forwarded request isn't a fair sample, and
+	// the wait doesn't count as a missed heartbeat
+	hb, _ = p.next()
+	p.forwarding()
+	if _, ok := p.answered(hb.Seq); ok {
+		t.Error("answered() sampled a pong delayed by a request")
+	}
+	p.next()
+	p.forwarding()
+	if _, missed := p.next(); missed {
+		t.Error("ping delayed by a request counted as missed")
+	}
+	if _, missed := p.next(); !missed {
+		t.Error("unanswered ping not counted as missed")
+	}
+}
+
+func TestQualitySnapshot(t *testing.T) {
+	var q qualityTracker
+	q.up(true)
+	for _, ms := range []time.Duration{10, 20, 60} {
+		q.rtt(ms * time.Millisecond)
+	}
+	q.reconnected()
+	q.reconnects = append([]time.Time{time.Now().Add(-2 * reconnectWindow)}, q.reconnects...)
+	for i := 0; i < 99; i++ {
+		q.frame(false)
+	}
+	q.frame(true)
+
+	s := q.snapshot()
+	if !s.Connected || !s.Heartbeat || s.Since.IsZero() {
+		t.Errorf("snapshot = %+v, want connected with heartbeats", s)
+	}
+	if s.RTTMs != 60 || s.AvgRTTMs != 30 || s.JitterMs != 25 {
+		t.Errorf("RTT = %v ms avg %v ms jitter %v ms, want 60 avg 30 jitter 25", s.RTTMs, s.AvgRTTMs, s.JitterMs)
+	}
+	if s.Reconnects != 1 {
+		t.Errorf("Reconnects = %d, want only the recent one", s.Reconnects)
+	}
+	if rate := s.FrameErrorRate(); rate != 0.01 {
+		t.Errorf("FrameErrorRate() = %v, want 0.01", rate)
+	}
+
+	q.down()
+	if s := q.snapshot(); s.Connected || !s.Since.IsZero() {
+		t.Errorf("snapshot after down = %+v, want disconnected", s)
+	}
+}
+
+func TestQualitySlow(t *testing.T) {
+	var q qualityTracker
+	q.up(true)
+
+	// Each step is a heartbeat's RTT in ms and whether the link is slow after it
+	steps := []struct {
+		rttMs       time.Duration
+		wantChanged bool
+		wantSlow    bool
+	}{
+		{900, false, false}, // one slow heartbeat isn't enough to go on
+		{900, false, false},
+		{900, true, true},
+		{900, false, true},
+		{50, false, true}, // the average is still well over SlowRTT
+		{50, false, true},
+		{50, false, true},
+		{50, false, true},
+		{50, false, true},
+		{50, false, true},
+		{50, false, true},
+		{50, false, true}, // 220ms is under SlowRTT but not by enough
+		{50, true, false},
+	}
+	for i, s := range steps {
+		changed, slow, avg := q.rtt(s.rttMs * time.Millisecond)
+		if changed != s.wantChanged || slow != s.wantSlow {
+			t.Errorf("heartbeat %d (avg %s): changed, slow = %v, %v, want %v, %v", i, avg, changed, slow, s.wantChanged, s.wantSlow)
+		}
+	}
+	if q.snapshot().Slow {
+		t.Error("snapshot still slow after recovering")
+	}
+}
@@ -0,0 +1,67 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/quic"
+
+	"github.com/lobber-dev/lobber/internal/tunnel"
+)
+
+const (
+	// quicDialTimeout bounds the QUIC handshake with the relay
+	quicDialTimeout = 10 * time.Second
+
+	// quicKeepAlive is how often an idle QUIC connection sends a packet,
+	// well within the relay's idle timeout and NAT bindings' lifetimes
+	quicKeepAlive = 15 * time.Second
+
+	// quicIdleTimeout is how long the connection may go without packets
+	quicIdleTimeout = time.Minute
+
+	// quicEndpointClose bounds closing the endpoint once the tunnel ends
+	quicEndpointClose = time.Second
+)
+
+// dialQUIC opens a QUIC connection to the relay's HTTPS port, host, and
+// returns its first stream for the connect request and the tunnel after it.
+// Each connect gets its own UDP socket, closed with the tunnel. x/net/quic
+// doesn't migrate connections, so a network change ends the connection and
+// watchWake reconnects and resumes the session as it does over TCP
+func (c *Client) dialQUIC(ctx context.Context, relayURL *url.URL, host string) (net.Conn, error) {
+	ep, err := quic.Listen("udp", ":0", nil)
+	if err != nil {
+		return nil, err
+	}
+	closeEndpoint := func() {
+		closeCtx, cancel := context.WithTimeout(context.Background(), quicEndpointClose)
+		defer cancel()
+		ep.Close(closeCtx)
+	}
+
+	tlsConfig := c.relayTLSConfig(relayURL.Hostname())
+	tlsConfig.NextProtos = []string{tunnel.QUICProtocol}
+	tlsConfig.MinVersion = tls.VersionTLS13
+	dialCtx, cancel := context.WithTimeout(ctx, quicDialTimeout)
+	defer cancel()
+	conn, err := ep.Dial(dialCtx, "udp", host, &quic.Config{
+		TLSConfig:       tlsConfig,
+		MaxIdleTimeout:  quicIdleTimeout,
+		KeepAlivePeriod: quicKeepAlive,
+	})
+	if err != nil {
+		closeEndpoint()
+		return nil, err
+	}
+	stream, err := conn.NewStream(dialCtx)
+	if err != nil {
+		conn.Abort(nil)
+		closeEndpoint()
+		return nil, err
+	}
+	return tunnel.NewQUICConn(conn, stream, closeEndpoint), nil
+}
@@ -0,0 +1,81 @@
+package client
+
+import (
+	"fmt"
+	"maps"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/lobber-dev/lobber/internal/tunnel"
+)
+
+// ParseOrigin checks s is an http or https origin, such as
+// http://localhost:3000, and returns it as scheme://host for RewriteOrigins
+func ParseOrigin(s string) (string, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", fmt.Errorf("parse origin: %w", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || strings.Trim(u.Path, "/") != "" || u.RawQuery != "" {
+		return "", fmt.Errorf("origin %q should look like http://localhost:3000", s)
+	}
+	return u.Scheme + "://" + strings.ToLower(u.Host), nil
+}
+
+// publicOrigin is where visitors reach the tunnel, as scheme://host: the
+// first URL the relay welcomed it with, or https on Domain if it didn't
+func (c *Client) publicOrigin() string {
+	if w := c.welcome.Load(); w != nil && len(w.URLs) > 0 {
+		if u, err := url.Parse(w.URLs[0]); err == nil && u.Scheme != "" && u.Host != "" {
+			return u.Scheme + "://" + u.Host
+		}
+	}
+	return "https://" + c.Domain
+}
+
+// rewritable reports whether a response of this Content-Type is text links
+// are rewritten in: HTML or JSON
+func rewritable(contentType string) bool {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mt == "text/html" || mt == "application/xhtml+xml" || mt == "application/json" || strings.HasSuffix(mt, "+json")
+}
+
+// rewriteOrigins replaces RewriteOrigins in resp's Location header and, for
+// HTML and JSON, its body with the tunnel's public origin, so links a local
+// app writes as http://localhost:3000 work through the tunnel. In JSON the
+// slashes may be escaped, as \/.
+func (c *Client) rewriteOrigins(resp *tunnel.Response) {
+	public := c.publicOrigin()
+	pairs := make([]string, 0, 4*len(c.RewriteOrigins))
+	for _, origin := range c.RewriteOrigins {
+		pairs = append(pairs, origin, public)
+		pairs = append(pairs, strings.ReplaceAll(origin, "/", `\/`), strings.ReplaceAll(public, "/", `\/`))
+	}
+	r := strings.NewReplacer(pairs...)
+
+	h := http.Header(resp.Headers).Clone()
+	if loc := h.Get("Location"); loc != "" {
+		h.Set("Location", r.Replace(loc))
+	}
+	if h.Get("Content-Encoding") == "" && rewritable(h.Get("Content-Type")) {
+		if body := r.Replace(string(resp.Body)); body != string(resp.Body) {
+			resp.Body = []byte(body)
+			h.Del("Content-Length")
+		}
+	}
+	resp.Headers = h
+}
+
+// uncompressed returns req without its Accept-Encoding, so the response
+// arrives decoded and its body can be changed
+func uncompressed(req *tunnel.Request) *tunnel.Request {
+	r := *req
+	r.Headers = maps.Clone(req.Headers)
+	delete(r.Headers, "Accept-Encoding")
+	return &r
+}
@@ -0,0 +1,79 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/lobber-dev/lobber/internal/tunnel"
+)
+
+func TestParseOrigin(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{"http://localhost:3000", "http://localhost:3000", false},
+		{"http://LOCALHOST:3000/", "http://localhost:3000", false},
+		{"https://127.0.0.1:8443", "https://127.0.0.1:8443", false},
+		{"localhost:3000", "", true},
+		{"http://localhost:3000/app", "", true},
+		{"ftp://localhost", "", true},
+		{"http://", "", true},
+	}
+	for _, tt := range tests {
+		got, err := ParseOrigin(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseOrigin(%q) = %q, %v, want %q, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestRewriteOrigins(t *testing.T) {
+	local := startClientTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/page":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Write([]byte(`<a href="http://localhost:3000/docs">docs</a> <img src="http://127.0.0.1:3000/x.png">`))
+		case "/api":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"next":"http:\/\/localhost:3000\/api?page=2","self":"http://localhost:3000/api"}`))
+		case "/items":
+			w.Header().Set("Location", "http://localhost:3000/items/7")
+			w.WriteHeader(http.StatusCreated)
+		case "/script.js":
+			w.Header().Set("Content-Type", "text/javascript")
+			w.Write([]byte(`fetch("http://localhost:3000/api")`))
+		}
+	}))
+	defer local.Close()
+
+	c := New(local.URL, "http://relay.invalid", "test-token", "app.mysite.com")
+	c.RewriteOrigins = []string{"http://localhost:3000", "http://127.0.0.1:3000"}
+	c.welcome.Store(&tunnel.Welcome{URLs: []string{"https://app.mysite.com:8443/"}})
+
+	tests := []struct {
+		path     string
+		body     string
+		location string
+	}{
+		{"/page", `<a href="https://app.mysite.com:8443/docs">docs</a> <img src="https://app.mysite.com:8443/x.png">`, ""},
+		{"/api", `{"next":"https:\/\/app.mysite.com:8443\/api?page=2","self":"https://app.mysite.com:8443/api"}`, ""},
+		{"/items", "", "https://app.mysite.com:8443/items/7"},
+		{"/script.js", `fetch("http://localhost:3000/api")`, ""},
+	}
+	for _, tt := range tests {
+		resp, _ := c.handle(context.Background(), &tunnel.Request{ID: "1", Method: "GET", Path: tt.path})
+		h := http.Header(resp.Headers)
+		if tt.body != "" && string(resp.Body) != tt.body {
+			t.Errorf("%s body = %s, want %s", tt.path, resp.Body, tt.body)
+		}
+		if got := h.Get("Location"); got != tt.location {
+			t.Errorf("%s Location = %q, want %q", tt.path, got, tt.location)
+		}
+		if cl := h.Get("Content-Length"); tt.path == "/page" && cl != "" {
+			t.Errorf("%s Content-Length = %s, want it dropped", tt.path, cl)
+		}
+	}
+}
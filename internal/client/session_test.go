@@ -0,0 +1,81 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lobber-dev/lobber/internal/tunnel"
+)
+
+func TestRunResumesSession(t *testing.T) {
+	// A relay that hands out a session and reports what each connection
+	// presented and how it ended
+	presented := make(chan string, 2)
+	ended := make(chan string, 2)
+	relay := startClientTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, bufrw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		bufrw.WriteString("HTTP/1.1 200 OK\r\n" + tunnel.SessionHeader + ": s-1\r\n\r\n")
+		bufrw.Flush()
+		if _, err := tunnel.DecodeReady(bufrw); err != nil {
+			return
+		}
+		presented <- r.Header.Get(tunnel.SessionHeader)
+		frame, err := tunnel.ReadFrame(bufrw)
+		if err != nil {
+			ended <- "dropped"
+			return
+		}
+		var e tunnel.Error
+		frame.Decode(&e)
+		ended <- e.Code
+	}))
+	defer relay.Close()
+
+	var addrs atomic.Value
+	addrs.Store("en0=192.168.1.5")
+	c := New("http://localhost:3000", relay.URL, "test-token", "app.mysite.com")
+	c.WakeCheck = 10 * time.Millisecond
+	c.localAddrs = func() string { return addrs.Load().(string) }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- c.Run(ctx) }()
+
+	waitFor := func(ch chan string, what string) string {
+		t.Helper()
+		select {
+		case v := <-ch:
+			return v
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %s", what)
+			return ""
+		}
+	}
+	if session := waitFor(presented, "first connection"); session != "" {
+		t.Errorf("first connection presented session %q, want none", session)
+	}
+
+	// The connection drops without a word, and the client comes back with
+	// the session it was given
+	addrs.Store("en0=10.0.0.7")
+	if how := waitFor(ended, "first connection to end"); how != "dropped" {
+		t.Errorf("first connection ended with %q, want dropped", how)
+	}
+	if session := waitFor(presented, "reconnection"); session != "s-1" {
+		t.Errorf("reconnection presented session %q, want s-1", session)
+	}
+
+	// Shutting down tells the relay not to hold the hostname
+	cancel()
+	if how := waitFor(ended, "shutdown"); how != tunnel.ErrorShutdown {
+		t.Errorf("shutdown ended the connection with %q, want %q", how, tunnel.ErrorShutdown)
+	}
+	<-done
+}
@@ -0,0 +1,361 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lobber-dev/lobber/internal/tunnel"
+)
+
+// upgradeTimeout bounds dialing the local server and its answer to an
+// upgrade; the stream that follows has no deadline
+const upgradeTimeout = 30 * time.Second
+
+// streamWriteTimeout is how long the local server may take to accept a
+// stream's bytes before the stream is closed, so one stuck connection
+// doesn't hold up the tunnel
+const streamWriteTimeout = 10 * time.Second
+
+// streamer carries the tunnel's streams: upgraded connections, such as
+// WebSockets, to and from the local server, the bodies of chunked
+// responses and of requests the relay held back. An upgraded connection
+// is the local connection the request that opened it was sent on, by the
+// request's ID.
+type streamer struct {
+	write    func(func(io.Writer) error) error
+	windowed bool // the relay uses tunnel.FeatureWindow, so waits for room to send more
+
+	mu      sync.Mutex
+	conns   map[string]net.Conn
+	credits map[string]*tunnel.Credit // room the relay granted for each stream's bytes
+	bodies  map[string]*heldBody
+	closed  bool
+}
+
+func newStreamer(write func(func(io.Writer) error) error, windowed bool) *streamer {
+	return &streamer{write: write, windowed: windowed, conns: make(map[string]net.Conn), credits: make(map[string]*tunnel.Credit), bodies: make(map[string]*heldBody)}
+}
+
+// body registers the stream with id as the body of a request the relay
+// holds back, and returns it to send the local server
+func (s *streamer) body(id string) *heldBody {
+	b := newHeldBody(func(n int64) {
+		win := &tunnel.Window{ID: id, Bytes: n}
+		s.write(func(w io.Writer) error { return tunnel.EncodeWindow(w, win) })
+	})
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		b.finish(io.ErrUnexpectedEOF)
+	} else {
+		s.bodies[id] = b
+	}
+	return b
+}
+
+// dropBody forgets the body with id once its request has been answered
+func (s *streamer) dropBody(id string) {
+	s.mu.Lock()
+	b := s.bodies[id]
+	delete(s.bodies, id)
+	s.mu.Unlock()
+	if b != nil {
+		b.Close()
+	}
+}
+
+// add registers conn as the stream with id, or reports false once the
+// streamer has closed
+func (s *streamer) add(id string, conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.conns[id] = conn
+	s.credits[id] = s.newCredit()
+	return true
+}
+
+// open registers a stream with id that has no local connection, such as a
+// chunked response's body, and returns the room it has
+func (s *streamer) open(id string) *tunnel.Credit {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	credit := s.newCredit()
+	s.credits[id] = credit
+	if s.closed {
+		credit.Close()
+	}
+	return credit
+}
+
+// newCredit is the room a new stream starts with, nil if the relay doesn't
+// use tunnel.FeatureWindow
+func (s *streamer) newCredit() *tunnel.Credit {
+	if !s.windowed {
+		return nil
+	}
+	return tunnel.NewCredit(tunnel.StreamWindow)
+}
+
+// remove forgets the stream with id and returns its connection, or nil if
+// it has already gone or has none. Anything waiting to send on it stops.
+func (s *streamer) remove(id string) net.Conn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	conn := s.conns[id]
+	delete(s.conns, id)
+	s.credits[id].Close()
+	delete(s.credits, id)
+	return conn
+}
+
+// grant gives a stream the room a Window frame from the relay grants
+func (s *streamer) grant(win *tunnel.Window) {
+	s.mu.Lock()
+	credit := s.credits[win.ID]
+	s.mu.Unlock()
+	credit.Grant(win.Bytes)
+}
+
+// forward writes a Stream frame from the relay to its local connection,
+// closing it when the visitor has gone. Once the local server has taken
+// the bytes, the relay may send as many more.
+func (s *streamer) forward(st *tunnel.Stream) {
+	s.mu.Lock()
+	body := s.bodies[st.ID]
+	s.mu.Unlock()
+	if body != nil {
+		if st.Close {
+			body.finish(io.EOF)
+		} else {
+			body.write(st.Data)
+		}
+		return
+	}
+	if st.Close {
+		if conn := s.remove(st.ID); conn != nil {
+			conn.Close()
+		}
+		return
+	}
+	s.mu.Lock()
+	conn := s.conns[st.ID]
+	s.mu.Unlock()
+	if conn == nil {
+		return
+	}
+	conn.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+	if _, err := conn.Write(st.Data); err != nil {
+		s.end(st.ID)
+		return
+	}
+	if s.windowed {
+		win := &tunnel.Window{ID: st.ID, Bytes: int64(len(st.Data))}
+		s.write(func(w io.Writer) error { return tunnel.EncodeWindow(w, win) })
+	}
+}
+
+// end closes the stream with id from this side and tells the relay, unless
+// the relay closed it first
+func (s *streamer) end(id string) {
+	conn := s.remove(id)
+	if conn == nil {
+		return
+	}
+	conn.Close()
+	s.write(func(w io.Writer) error { return tunnel.EncodeStream(w, &tunnel.Stream{ID: id, Close: true}) })
+}
+
+// pump sends what the local server writes on the stream with id to the
+// relay, until either end closes it. The local server is only read while
+// the relay has room for more.
+func (s *streamer) pump(id string, br *bufio.Reader) {
+	defer s.end(id)
+	s.mu.Lock()
+	credit := s.credits[id]
+	s.mu.Unlock()
+	buf := make([]byte, tunnel.MaxStreamChunk)
+	for {
+		room, err := credit.Take(context.Background(), int64(len(buf)))
+		if err != nil {
+			return
+		}
+		n, err := br.Read(buf[:room])
+		credit.Grant(room - int64(n))
+		if n > 0 {
+			data := &tunnel.Stream{ID: id, Data: buf[:n]}
+			if s.write(func(w io.Writer) error { return tunnel.EncodeStream(w, data) }) != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// len returns how many streams are open
+func (s *streamer) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.credits)
+}
+
+// close ends every stream, as the tunnel they ran over has gone
+func (s *streamer) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for id, conn := range s.conns {
+		conn.Close()
+		delete(s.conns, id)
+	}
+	for id, credit := range s.credits {
+		credit.Close()
+		delete(s.credits, id)
+	}
+	for id, body := range s.bodies {
+		body.finish(io.ErrUnexpectedEOF)
+		delete(s.bodies, id)
+	}
+}
+
+// handleUpgrade forwards a request to switch protocols, such as a
+// WebSocket handshake, to the local server. If it answers 101, the
+// connection stays open as a stream carrying bytes both ways until the
+// visitor or the local server closes it.
+func (c *Client) handleUpgrade(ctx context.Context, req *tunnel.Request, streams *streamer, write func(func(io.Writer) error) error) {
+	start := time.Now()
+	conn, br, resp, err := c.dialUpgrade(ctx, req)
+	meta := &tunnel.Metadata{ID: req.ID, Local: time.Since(start), ClientVersion: Version}
+	if err != nil {
+		meta.LocalError = err.Error()
+		c.addError(req, http.StatusBadGateway, err)
+		resp = &tunnel.Response{
+			ID:         req.ID,
+			StatusCode: http.StatusBadGateway,
+			Headers:    map[string][]string{"Content-Type": {"text/plain"}},
+			Body:       []byte("local forward error: " + err.Error()),
+		}
+	} else {
+		meta.LocalStatus = resp.StatusCode
+	}
+
+	if c.inspector != nil {
+		c.inspector.AddRequest(&InspectedRequest{
+			ID:              req.ID,
+			Method:          req.Method,
+			Path:            req.Path,
+			StatusCode:      resp.StatusCode,
+			RequestHeaders:  req.Headers,
+			ResponseHeaders: resp.Headers,
+			DurationMs:      time.Since(start).Milliseconds(),
+			Timestamp:       start,
+			RelayMs:         ms(req.RelayTime),
+			LocalMs:         ms(meta.Local),
+			NetworkMs:       c.quality.snapshot().RTTMs,
+		})
+	}
+
+	// The stream must be known before the relay hears of the 101, as the
+	// visitor's bytes follow straight after
+	upgraded := conn != nil && streams.add(req.ID, conn)
+	if conn != nil && !upgraded {
+		conn.Close()
+	}
+	meta.Client = time.Since(start)
+	if err := c.respond(write, resp, meta); err != nil {
+		if upgraded {
+			streams.remove(req.ID)
+			conn.Close()
+		}
+		return
+	}
+	c.release(write, req)
+	if upgraded {
+		streams.pump(req.ID, br)
+	}
+}
+
+// dialUpgrade sends an upgrade request to the local server on a connection
+// of its own. On a 101 it returns that connection, and a reader holding
+// anything the server sent after its answer; otherwise the connection is
+// closed and only the answer returned.
+func (c *Client) dialUpgrade(ctx context.Context, req *tunnel.Request) (net.Conn, *bufio.Reader, *tunnel.Response, error) {
+	localURL, err := c.localURL(req)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	addr := localURL.Host
+	if localURL.Port() == "" {
+		port := "80"
+		if localURL.Scheme == "https" {
+			port = "443"
+		}
+		addr = net.JoinHostPort(localURL.Hostname(), port)
+	}
+
+	dialCtx, cancel := context.WithTimeout(ctx, upgradeTimeout)
+	defer cancel()
+	var conn net.Conn
+	if localURL.Scheme == "https" {
+		d := &tls.Dialer{Config: &tls.Config{ServerName: localURL.Hostname()}}
+		conn, err = d.DialContext(dialCtx, "tcp", addr)
+	} else {
+		var d net.Dialer
+		conn, err = d.DialContext(dialCtx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("local request: %w", err)
+	}
+	conn.SetDeadline(time.Now().Add(upgradeTimeout))
+
+	httpReq, err := http.NewRequestWithContext(ctx, req.Method, localURL.String(), strings.NewReader(string(req.Body)))
+	if err != nil {
+		conn.Close()
+		return nil, nil, nil, fmt.Errorf("create request: %w", err)
+	}
+	for k, v := range req.Headers {
+		httpReq.Header[k] = v
+	}
+	setForwarded(httpReq.Header, req.Caller)
+	httpReq.Header.Set("Connection", "Upgrade")
+	httpReq.Header.Set("Upgrade", req.Upgrade)
+	if err := httpReq.Write(conn); err != nil {
+		conn.Close()
+		return nil, nil, nil, fmt.Errorf("local request: %w", err)
+	}
+
+	br := bufio.NewReader(conn)
+	httpResp, err := http.ReadResponse(br, httpReq)
+	if err != nil {
+		conn.Close()
+		return nil, nil, nil, fmt.Errorf("local response: %w", err)
+	}
+	resp := &tunnel.Response{
+		ID:         req.ID,
+		StatusCode: httpResp.StatusCode,
+		Headers:    httpResp.Header,
+	}
+	if httpResp.StatusCode != http.StatusSwitchingProtocols {
+		defer conn.Close()
+		defer httpResp.Body.Close()
+		if resp.Body, err = io.ReadAll(httpResp.Body); err != nil {
+			return nil, nil, nil, fmt.Errorf("read body: %w", err)
+		}
+		return nil, nil, resp, nil
+	}
+	resp.Upgrade = httpResp.Header.Get("Upgrade")
+	conn.SetDeadline(time.Time{})
+	return conn, br, resp, nil
+}
@@ -0,0 +1,57 @@
+package client
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/lobber-dev/lobber/internal/tunnel"
+)
+
+func TestDialUpgrade(t *testing.T) {
+	local := startClientTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Connection") != "Upgrade" || r.Header.Get("Upgrade") != "websocket" {
+			t.Errorf("local server got Connection %q, Upgrade %q", r.Header.Get("Connection"), r.Header.Get("Upgrade"))
+		}
+		if r.URL.Path == "/refuse" {
+			http.Error(w, "no sockets here", http.StatusNotFound)
+			return
+		}
+		conn, bufrw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			t.Errorf("hijack: %v", err)
+			return
+		}
+		defer conn.Close()
+		bufrw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\nhi")
+		bufrw.Flush()
+		io.Copy(conn, bufrw)
+	}))
+	defer local.Close()
+	c := &Client{LocalAddr: local.URL}
+
+	// A refusal comes back as an ordinary response
+	conn, _, resp, err := c.dialUpgrade(context.Background(), &tunnel.Request{ID: "1", Method: "GET", Path: "/refuse", Upgrade: "websocket"})
+	if err != nil {
+		t.Fatalf("dialUpgrade(refused) error = %v", err)
+	}
+	if conn != nil || resp.StatusCode != http.StatusNotFound || string(resp.Body) != "no sockets here\n" {
+		t.Errorf("dialUpgrade(refused) = %v, %d %q, want no connection and the 404", conn, resp.StatusCode, resp.Body)
+	}
+
+	// An upgrade keeps the connection, and what followed the 101
+	conn, br, resp, err := c.dialUpgrade(context.Background(), &tunnel.Request{ID: "2", Method: "GET", Path: "/socket", Upgrade: "websocket"})
+	if err != nil {
+		t.Fatalf("dialUpgrade() error = %v", err)
+	}
+	defer conn.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Upgrade != "websocket" {
+		t.Errorf("response = %d upgrading to %q, want 101 to websocket", resp.StatusCode, resp.Upgrade)
+	}
+	conn.Write([]byte(" there"))
+	buf := make([]byte, 8)
+	if _, err := io.ReadFull(br, buf); err != nil || string(buf) != "hi there" {
+		t.Errorf("stream = %q (%v), want the server's greeting then our echo", buf, err)
+	}
+}
@@ -0,0 +1,264 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tunnelOpenTimeout is how long opening a tunnel through the API waits for
+// it to be ready
+const tunnelOpenTimeout = 15 * time.Second
+
+// primaryID is the ID of the tunnel `lobber up` opened
+const primaryID = "1"
+
+// TunnelInfo is a tunnel as /api/tunnels lists it
+type TunnelInfo struct {
+	ID        string    `json:"id"`
+	Domain    string    `json:"domain"`
+	Local     string    `json:"local"`
+	PublicURL string    `json:"public_url"`
+	Connected bool      `json:"connected"`
+	Started   time.Time `json:"started"`
+	Primary   bool      `json:"primary,omitempty"` // opened by `lobber up`, so it can't be closed through the API
+}
+
+// OpenTunnel is the body of POST /api/tunnels
+type OpenTunnel struct {
+	Port   int    `json:"port"`             // local port to forward to
+	Domain string `json:"domain,omitempty"` // empty picks a hostname
+}
+
+// Tunnels is the local API editor extensions and scripts on the same
+// machine use to list the running client's tunnels, open more for other
+// local ports and close those again. It's served next to the inspector:
+//
+//	GET    /api/tunnels       list tunnels
+//	POST   /api/tunnels       open one, {"port": 5173}
+//	GET    /api/tunnels/{id}  one tunnel, with its public URL
+//	DELETE /api/tunnels/{id}  close one opened here
+type Tunnels struct {
+	ctx    context.Context
+	open   func(port int, domain string) (*Client, error) // a new tunnel to localhost:port
+	public func(*Client) string                           // where visitors reach a tunnel
+
+	mu      sync.Mutex
+	tunnels map[string]*managedTunnel
+	nextID  int
+	mux     *http.ServeMux
+}
+
+// managedTunnel is a tunnel the API knows about
+type managedTunnel struct {
+	id      string
+	client  *Client
+	started time.Time
+	cancel  context.CancelFunc // stops it; nil for the primary tunnel
+	done    chan struct{}      // closed once it has stopped
+}
+
+// NewTunnels serves the API for primary, the tunnel `lobber up` opened,
+// and the ones open builds. Tunnels opened through it run until they're
+// closed or ctx ends.
+func NewTunnels(ctx context.Context, primary *Client, open func(port int, domain string) (*Client, error), public func(*Client) string) *Tunnels {
+	t := &Tunnels{
+		ctx:     ctx,
+		open:    open,
+		public:  public,
+		tunnels: map[string]*managedTunnel{primaryID: {id: primaryID, client: primary, started: time.Now()}},
+		nextID:  2,
+		mux:     http.NewServeMux(),
+	}
+	t.mux.HandleFunc("GET /api/tunnels", t.handleList)
+	t.mux.HandleFunc("POST /api/tunnels", t.handleOpen)
+	t.mux.HandleFunc("GET /api/tunnels/{id}", t.handleGet)
+	t.mux.HandleFunc("DELETE /api/tunnels/{id}", t.handleClose)
+	return t
+}
+
+// List returns the running tunnels, oldest first
+func (t *Tunnels) List() []TunnelInfo {
+	t.mu.Lock()
+	managed := make([]*managedTunnel, 0, len(t.tunnels))
+	for _, m := range t.tunnels {
+		managed = append(managed, m)
+	}
+	t.mu.Unlock()
+
+	slices.SortFunc(managed, func(a, b *managedTunnel) int { return a.started.Compare(b.started) })
+	infos := make([]TunnelInfo, len(managed))
+	for i, m := range managed {
+		infos[i] = t.info(m)
+	}
+	return infos
+}
+
+// Open starts a tunnel to localhost:port and waits until it's ready. An
+// empty domain leaves the hostname to the open function.
+func (t *Tunnels) Open(port int, domain string) (TunnelInfo, error) {
+	if port < 1 || port > 65535 {
+		return TunnelInfo{}, fmt.Errorf("%w %d", errInvalidPort, port)
+	}
+	c, err := t.open(port, domain)
+	if err != nil {
+		return TunnelInfo{}, err
+	}
+
+	// Listed from the start, as not yet connected, and forgotten once it stops
+	ctx, cancel := context.WithCancel(t.ctx)
+	m := &managedTunnel{client: c, started: time.Now(), cancel: cancel, done: make(chan struct{})}
+	t.mu.Lock()
+	m.id = strconv.Itoa(t.nextID)
+	t.nextID++
+	t.tunnels[m.id] = m
+	t.mu.Unlock()
+
+	ready := make(chan struct{})
+	var once sync.Once
+	c.SetOnReady(func() { once.Do(func() { close(ready) }) })
+	errCh := make(chan error, 1)
+	go func() {
+		defer close(m.done)
+		errCh <- c.Run(ctx)
+		t.mu.Lock()
+		if t.tunnels[m.id] == m {
+			delete(t.tunnels, m.id)
+		}
+		t.mu.Unlock()
+	}()
+
+	select {
+	case <-ready:
+	case err := <-errCh:
+		cancel()
+		return TunnelInfo{}, err
+	case <-time.After(tunnelOpenTimeout):
+		cancel()
+		return TunnelInfo{}, errors.New("timed out waiting for the tunnel to be ready")
+	}
+	return t.info(m), nil
+}
+
+// Close stops a tunnel opened through the API and waits until it has
+func (t *Tunnels) Close(id string) error {
+	t.mu.Lock()
+	m, ok := t.tunnels[id]
+	if ok && m.cancel != nil {
+		delete(t.tunnels, id)
+	}
+	t.mu.Unlock()
+	if !ok {
+		return errTunnelNotFound
+	}
+	if m.cancel == nil {
+		return errPrimaryTunnel
+	}
+	m.cancel()
+	<-m.done
+	return nil
+}
+
+var (
+	errInvalidPort    = errors.New("invalid port")
+	errTunnelNotFound = errors.New("no such tunnel")
+	errPrimaryTunnel  = errors.New("this tunnel was opened by lobber up; stop it there")
+)
+
+// info describes m for the API
+func (t *Tunnels) info(m *managedTunnel) TunnelInfo {
+	return TunnelInfo{
+		ID:        m.id,
+		Domain:    m.client.Domain,
+		Local:     m.client.LocalAddr,
+		PublicURL: t.public(m.client),
+		Connected: m.client.Quality().Connected,
+		Started:   m.started,
+		Primary:   m.cancel == nil,
+	}
+}
+
+// ServeHTTP answers only requests addressed to the loopback interface by
+// name or address, so a web page can't reach the API by rebinding its
+// hostname to 127.0.0.1
+func (t *Tunnels) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !loopbackHost(r) {
+		http.Error(w, "the tunnels API only answers on localhost", http.StatusForbidden)
+		return
+	}
+	t.mux.ServeHTTP(w, r)
+}
+
+// loopbackHost reports whether r's Host names the loopback interface
+func loopbackHost(r *http.Request) bool {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	ip := net.ParseIP(host)
+	return strings.EqualFold(host, "localhost") || (ip != nil && ip.IsLoopback())
+}
+
+func (t *Tunnels) handleList(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(t.List())
+}
+
+// handleOpen opens a tunnel. Only JSON is accepted, so other sites a
+// browser visits can't open one with a plain form post.
+func (t *Tunnels) handleOpen(w http.ResponseWriter, r *http.Request) {
+	if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt != "application/json" {
+		http.Error(w, "want application/json", http.StatusUnsupportedMediaType)
+		return
+	}
+	var req OpenTunnel
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil {
+		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	info, err := t.Open(req.Port, req.Domain)
+	if errors.Is(err, errInvalidPort) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "open tunnel: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(info)
+}
+
+func (t *Tunnels) handleGet(w http.ResponseWriter, r *http.Request) {
+	t.mu.Lock()
+	m, ok := t.tunnels[r.PathValue("id")]
+	t.mu.Unlock()
+	if !ok {
+		http.Error(w, errTunnelNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(t.info(m))
+}
+
+func (t *Tunnels) handleClose(w http.ResponseWriter, r *http.Request) {
+	err := t.Close(r.PathValue("id"))
+	switch {
+	case errors.Is(err, errTunnelNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, errPrimaryTunnel):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
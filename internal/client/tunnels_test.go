@@ -0,0 +1,59 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTunnelsAPIGuards(t *testing.T) {
+	primary := New("http://localhost:3000", "https://lobber.dev", "tok", "app.mysite.com")
+	opened := 0
+	tunnels := NewTunnels(context.Background(), primary, func(port int, domain string) (*Client, error) {
+		opened++
+		return nil, errors.New("no relay in this test")
+	}, func(c *Client) string { return "https://" + c.Domain + "/" })
+
+	tests := []struct {
+		name        string
+		method      string
+		host        string
+		path        string
+		contentType string
+		body        string
+		status      int
+	}{
+		{"list", "GET", "127.0.0.1:4040", "/api/tunnels", "", "", http.StatusOK},
+		{"list by name", "GET", "localhost:4040", "/api/tunnels", "", "", http.StatusOK},
+		{"rebound hostname", "GET", "evil.example.com:4040", "/api/tunnels", "", "", http.StatusForbidden},
+		{"form post", "POST", "127.0.0.1:4040", "/api/tunnels", "application/x-www-form-urlencoded", "port=22", http.StatusUnsupportedMediaType},
+		{"bad port", "POST", "127.0.0.1:4040", "/api/tunnels", "application/json", `{"port": 70000}`, http.StatusBadRequest},
+		{"open fails", "POST", "127.0.0.1:4040", "/api/tunnels", "application/json", `{"port": 5173}`, http.StatusBadGateway},
+		{"get primary", "GET", "127.0.0.1:4040", "/api/tunnels/1", "", "", http.StatusOK},
+		{"close primary", "DELETE", "127.0.0.1:4040", "/api/tunnels/1", "", "", http.StatusConflict},
+		{"close unknown", "DELETE", "127.0.0.1:4040", "/api/tunnels/9", "", "", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			req.Host = tt.host
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			rec := httptest.NewRecorder()
+			tunnels.ServeHTTP(rec, req)
+			if rec.Code != tt.status {
+				t.Errorf("status = %d, want %d (body %q)", rec.Code, tt.status, rec.Body.String())
+			}
+		})
+	}
+	if opened != 1 {
+		t.Errorf("open called %d times, want 1", opened)
+	}
+	if list := tunnels.List(); len(list) != 1 || !list[0].Primary || list[0].PublicURL != "https://app.mysite.com/" {
+		t.Errorf("List() = %+v, want just the primary tunnel", list)
+	}
+}
@@ -0,0 +1,108 @@
+package client
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/lobber-dev/lobber/internal/tunnel"
+)
+
+// udpSessionIdle is how long a UDP session may go quiet before its local
+// socket is closed, matching the relay's timeout
+const udpSessionIdle = 2 * time.Minute
+
+// udpForwarder relays a UDP tunnel's datagrams to the local service. Each
+// remote peer gets its own local socket, so the service sees one client
+// per peer and its replies find their way back.
+type udpForwarder struct {
+	target string
+	write  func(func(io.Writer) error) error
+
+	mu       sync.Mutex
+	sessions map[string]*net.UDPConn
+	closed   bool
+}
+
+func newUDPForwarder(target string, write func(func(io.Writer) error) error) *udpForwarder {
+	return &udpForwarder{
+		target:   target,
+		write:    write,
+		sessions: make(map[string]*net.UDPConn),
+	}
+}
+
+// forward sends a datagram from the relay to the local service, opening a
+// socket for its session if it's new
+func (f *udpForwarder) forward(d *tunnel.Datagram) error {
+	f.mu.Lock()
+	if f.closed {
+		f.mu.Unlock()
+		return net.ErrClosed
+	}
+	conn, ok := f.sessions[d.Session]
+	if !ok {
+		addr, err := net.ResolveUDPAddr("udp", f.target)
+		if err != nil {
+			f.mu.Unlock()
+			return err
+		}
+		conn, err = net.DialUDP("udp", nil, addr)
+		if err != nil {
+			f.mu.Unlock()
+			return err
+		}
+		f.sessions[d.Session] = conn
+		go f.replies(d.Session, conn)
+	}
+	f.mu.Unlock()
+
+	// Traffic either way keeps the session open
+	conn.SetReadDeadline(time.Now().Add(udpSessionIdle))
+	_, err := conn.Write(d.Data)
+	return err
+}
+
+// replies sends what the local service answers on conn back through the
+// tunnel, until the session goes idle or the forwarder closes
+func (f *udpForwarder) replies(session string, conn *net.UDPConn) {
+	defer func() {
+		f.mu.Lock()
+		if f.sessions[session] == conn {
+			delete(f.sessions, session)
+		}
+		f.mu.Unlock()
+		conn.Close()
+	}()
+
+	buf := make([]byte, tunnel.MaxDatagramSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			// The local service may refuse a datagram (ICMP port
+			// unreachable) and still be there for the next one
+			var netErr net.Error
+			if (errors.As(err, &netErr) && netErr.Timeout()) || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		conn.SetReadDeadline(time.Now().Add(udpSessionIdle))
+		d := &tunnel.Datagram{Session: session, Data: buf[:n]}
+		if err := f.write(func(w io.Writer) error { return tunnel.EncodeDatagram(w, d) }); err != nil {
+			return
+		}
+	}
+}
+
+// close ends every session
+func (f *udpForwarder) close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	for _, conn := range f.sessions {
+		conn.Close()
+	}
+}
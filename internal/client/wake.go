@@ -0,0 +1,105 @@
+package client
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultWakeCheck is how often New's clients check for sleep and
+	// network changes
+	DefaultWakeCheck = 2 * time.Second
+
+	// sleepThreshold is how far the wall clock may run ahead of the
+	// monotonic clock between checks before the machine is taken to have
+	// slept. It leaves room for NTP nudging the wall clock.
+	sleepThreshold = 5 * time.Second
+
+	// resumeTimeout bounds how long Run keeps reconnecting after a wake
+	resumeTimeout = 30 * time.Second
+)
+
+// watchWake checks every WakeCheck whether the connection has likely died
+// under the client, and sends the reason once it has. The channel is nil,
+// and never ready, when WakeCheck is 0.
+func (c *Client) watchWake(ctx context.Context) <-chan string {
+	if c.WakeCheck <= 0 {
+		return nil
+	}
+	addrs := c.localAddrs
+	if addrs == nil {
+		addrs = networkAddrs
+	}
+
+	ch := make(chan string, 1)
+	go func() {
+		ticker := time.NewTicker(c.WakeCheck)
+		defer ticker.Stop()
+
+		last, lastAddrs := time.Now(), addrs()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			now, nowAddrs := time.Now(), addrs()
+			if reason := wakeReason(sleptFor(last, now), lastAddrs, nowAddrs); reason != "" {
+				ch <- reason
+				return
+			}
+			last, lastAddrs = now, nowAddrs
+		}
+	}()
+	return ch
+}
+
+// sleptFor returns how much longer the wall clock ran than the monotonic
+// clock between two time.Now readings. The monotonic clock stops while the
+// machine is suspended; the wall clock doesn't.
+func sleptFor(last, now time.Time) time.Duration {
+	return now.Round(0).Sub(last.Round(0)) - now.Sub(last)
+}
+
+// wakeReason explains why the connection is probably dead given how long
+// the machine slept between checks and its addresses before and after, or
+// returns "" if nothing changed
+func wakeReason(slept time.Duration, before, after string) string {
+	if slept > sleepThreshold {
+		return "wake from sleep"
+	}
+	if before != after {
+		return "network change"
+	}
+	return ""
+}
+
+// networkAddrs lists the IPv4 addresses of the machine's interfaces that
+// are up, other than loopback. Joining another network changes them; IPv6
+// addresses are left out because privacy addresses rotate on their own.
+func networkAddrs() string {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return ""
+	}
+	var addrs []string
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		ifaddrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range ifaddrs {
+			if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+				addrs = append(addrs, iface.Name+"="+ipnet.IP.String())
+			}
+		}
+	}
+	sort.Strings(addrs)
+	return strings.Join(addrs, ",")
+}
@@ -0,0 +1,174 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lobber-dev/lobber/internal/tunnel"
+)
+
+func TestWakeReason(t *testing.T) {
+	tests := []struct {
+		name          string
+		slept         time.Duration
+		before, after string
+		want          string
+	}{
+		{"nothing changed", 0, "en0=192.168.1.5", "en0=192.168.1.5", ""},
+		{"clock nudged", time.Second, "en0=192.168.1.5", "en0=192.168.1.5", ""},
+		{"slept", 10 * time.Minute, "en0=192.168.1.5", "en0=192.168.1.5", "wake from sleep"},
+		{"new network", 0, "en0=192.168.1.5", "en0=10.0.0.7", "network change"},
+		{"network lost", 0, "en0=192.168.1.5", "", "network change"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := wakeReason(tt.slept, tt.before, tt.after); got != tt.want {
+				t.Errorf("wakeReason() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSleptFor(t *testing.T) {
+	last := time.Now()
+	if slept := sleptFor(last, last.Add(time.Minute)); slept != 0 {
+		t.Errorf("sleptFor() while awake = %v, want 0", slept)
+	}
+}
+
+func TestRunResumesAfterNetworkChange(t *testing.T) {
+	// A relay that accepts every tunnel and holds the connection open
+	connects := make(chan string, 2)
+	relay := startClientTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, bufrw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		bufrw.WriteString("HTTP/1.1 200 OK\r\n\r\n")
+		bufrw.Flush()
+		if _, err := tunnel.DecodeReady(bufrw); err != nil {
+			return
+		}
+		connects <- r.Header.Get("X-Lobber-Domain")
+		bufio.NewReader(conn).ReadByte() // until the client hangs up
+	}))
+	defer relay.Close()
+
+	var addrs atomic.Value
+	addrs.Store("en0=192.168.1.5")
+	c := New("http://localhost:3000", relay.URL, "test-token", "app.mysite.com")
+	c.WakeCheck = 10 * time.Millisecond
+	c.localAddrs = func() string { return addrs.Load().(string) }
+	resumed := make(chan string, 1)
+	c.SetOnResume(func(reason string) { resumed <- reason })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- c.Run(ctx) }()
+
+	waitFor := func(ch chan string, what string) string {
+		t.Helper()
+		select {
+		case v := <-ch:
+			return v
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %s", what)
+			return ""
+		}
+	}
+	waitFor(connects, "first connection")
+
+	// Joining another network brings the tunnel back for the same domain
+	addrs.Store("en0=10.0.0.7")
+	if domain := waitFor(connects, "reconnection"); domain != "app.mysite.com" {
+		t.Errorf("reconnected domain = %q, want app.mysite.com", domain)
+	}
+	if reason := waitFor(resumed, "resume callback"); reason != "network change" {
+		t.Errorf("resume reason = %q, want %q", reason, "network change")
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Run() error = %v, want context.Canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not stop after cancel")
+	}
+}
+
+func TestRunPausesOnDisconnect(t *testing.T) {
+	defer func(d time.Duration) { minPause = d }(minPause)
+	minPause = 10 * time.Millisecond
+
+	// A relay whose first connection is sent away for a moment
+	var connects atomic.Int32
+	until := time.Now().Add(200 * time.Millisecond)
+	relay := startClientTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, bufrw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		bufrw.WriteString("HTTP/1.1 200 OK\r\n\r\n")
+		bufrw.Flush()
+		if _, err := tunnel.DecodeReady(bufrw); err != nil {
+			return
+		}
+		if connects.Add(1) == 1 {
+			tunnel.EncodeDisconnect(bufrw, &tunnel.Disconnect{Reason: "outside its schedule", Until: until})
+			bufrw.Flush()
+		}
+		bufio.NewReader(conn).ReadByte() // until the client hangs up
+	}))
+	defer relay.Close()
+
+	c := New("http://localhost:3000", relay.URL, "test-token", "app.mysite.com")
+	c.WakeCheck = 0
+	paused := make(chan time.Time, 1)
+	c.SetOnPause(func(reason string, until time.Time) { paused <- until })
+	resumed := make(chan string, 1)
+	c.SetOnResume(func(reason string) { resumed <- reason })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- c.Run(ctx) }()
+
+	select {
+	case got := <-paused:
+		if !got.Equal(until) {
+			t.Errorf("pause until = %v, want %v", got, until)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for pause callback")
+	}
+	select {
+	case reason := <-resumed:
+		if time.Now().Before(until) {
+			t.Error("client reconnected before the relay's until time")
+		}
+		if reason != "scheduled pause" {
+			t.Errorf("resume reason = %q, want %q", reason, "scheduled pause")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for resume callback")
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Run() error = %v, want context.Canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not stop after cancel")
+	}
+}
@@ -0,0 +1,13 @@
+-- 005_usage_notifications.sql
+-- Track which quota thresholds a user has been notified about each billing period
+
+CREATE TABLE IF NOT EXISTS usage_notifications (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    level TEXT NOT NULL, -- 'warning', 'exceeded', 'capped'
+    billing_period DATE NOT NULL DEFAULT date_trunc('month', NOW())::DATE,
+    sent_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    UNIQUE (user_id, level, billing_period)
+);
+
+CREATE INDEX IF NOT EXISTS idx_usage_notifications_user_id ON usage_notifications(user_id);
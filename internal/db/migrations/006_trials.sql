@@ -0,0 +1,6 @@
+-- 006_trials.sql
+-- Track subscription trial end so lapsed trials can be downgraded
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS trial_ends_at TIMESTAMPTZ;
+
+CREATE INDEX IF NOT EXISTS idx_users_trial_ends_at ON users(trial_ends_at) WHERE trial_ends_at IS NOT NULL;
@@ -0,0 +1,6 @@
+-- 007_billing_details.sql
+-- Billing address and tax ID collected for Stripe Tax (mirrors the Stripe customer)
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS billing_address JSONB;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS tax_id_type TEXT;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS tax_id TEXT;
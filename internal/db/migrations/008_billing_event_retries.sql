@@ -0,0 +1,10 @@
+-- 008_billing_event_retries.sql
+-- Retry queue for webhook events whose processing failed
+
+ALTER TABLE billing_events
+    ADD COLUMN IF NOT EXISTS attempts INTEGER NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS last_error TEXT,
+    ADD COLUMN IF NOT EXISTS next_attempt_at TIMESTAMPTZ;
+
+CREATE INDEX IF NOT EXISTS idx_billing_events_retry ON billing_events(next_attempt_at)
+    WHERE NOT processed AND next_attempt_at IS NOT NULL;
@@ -0,0 +1,4 @@
+-- 010_user_theme.sql
+-- Dashboard color theme, persisted per user
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS theme TEXT NOT NULL DEFAULT 'system'; -- 'system', 'light', 'dark'
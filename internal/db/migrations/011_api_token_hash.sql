@@ -0,0 +1,6 @@
+-- 011_api_token_hash.sql
+-- API tokens are looked up by hash when the CLI connects, so they are stored
+-- as SHA256 hex digests like sessions rather than bcrypt hashes
+
+COMMENT ON COLUMN api_tokens.token_hash IS 'SHA256 hex digest of the token';
+CREATE INDEX IF NOT EXISTS idx_api_tokens_user_id ON api_tokens(user_id);
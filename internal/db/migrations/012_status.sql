@@ -0,0 +1,35 @@
+-- 012_status.sql
+-- Public status page: relay health checks and operator-posted incidents
+
+-- Latest health of each relay instance, upserted by its health check job
+CREATE TABLE IF NOT EXISTS relay_health (
+    relay_id TEXT PRIMARY KEY,
+    region TEXT NOT NULL DEFAULT '',
+    ok BOOLEAN NOT NULL,
+    detail TEXT NOT NULL DEFAULT '',
+    tunnels INTEGER NOT NULL DEFAULT 0,
+    last_seen_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- Every health check result, for historical uptime
+CREATE TABLE IF NOT EXISTS health_checks (
+    id BIGSERIAL PRIMARY KEY,
+    relay_id TEXT NOT NULL,
+    ok BOOLEAN NOT NULL,
+    latency_ms INTEGER NOT NULL DEFAULT 0,
+    checked_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_health_checks_checked_at ON health_checks(checked_at);
+
+-- Incidents shown as a banner on the status page; at most one is open
+CREATE TABLE IF NOT EXISTS incidents (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    title TEXT NOT NULL,
+    message TEXT NOT NULL DEFAULT '',
+    severity TEXT NOT NULL DEFAULT 'minor', -- 'minor', 'major'
+    started_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    resolved_at TIMESTAMPTZ
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_incidents_open ON incidents((resolved_at IS NULL)) WHERE resolved_at IS NULL;
@@ -0,0 +1,20 @@
+-- 013_admin.sql
+-- Operator dashboard: plan overrides and abuse reports
+
+-- Plans set by an operator rather than a Stripe subscription; reconciliation leaves these alone
+ALTER TABLE users ADD COLUMN IF NOT EXISTS plan_override BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- Reports of abusive tunnels (phishing, malware, spam) filed from the public form
+CREATE TABLE IF NOT EXISTS abuse_reports (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    hostname TEXT NOT NULL,
+    reason TEXT NOT NULL, -- 'phishing', 'malware', 'spam', 'other'
+    details TEXT NOT NULL DEFAULT '',
+    reporter_email TEXT NOT NULL DEFAULT '',
+    reporter_ip TEXT NOT NULL DEFAULT '',
+    resolution TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    resolved_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS idx_abuse_reports_open ON abuse_reports(created_at DESC) WHERE resolved_at IS NULL;
@@ -0,0 +1,5 @@
+-- 014_impersonation.sql
+-- Operators can open a read-only dashboard session as a user to debug support
+-- tickets. The column names the operator; it is NULL for the user's own sessions.
+
+ALTER TABLE sessions ADD COLUMN IF NOT EXISTS impersonator TEXT;
@@ -0,0 +1,11 @@
+-- 015_request_client_metadata.sql
+-- How each visitor reached the relay, for abuse investigations and for
+-- debugging clients that fall back to an older protocol. The fingerprint is a
+-- hash of the TLS ClientHello; empty strings mean plain HTTP.
+
+ALTER TABLE request_logs ADD COLUMN IF NOT EXISTS remote_ip TEXT NOT NULL DEFAULT '';
+ALTER TABLE request_logs ADD COLUMN IF NOT EXISTS tls_version TEXT NOT NULL DEFAULT '';
+ALTER TABLE request_logs ADD COLUMN IF NOT EXISTS alpn TEXT NOT NULL DEFAULT '';
+ALTER TABLE request_logs ADD COLUMN IF NOT EXISTS tls_fingerprint TEXT NOT NULL DEFAULT '';
+
+CREATE INDEX IF NOT EXISTS idx_request_logs_remote_ip ON request_logs(remote_ip, created_at);
@@ -0,0 +1,31 @@
+-- 016_usage_audit.sql
+-- Signed daily rollups of served bytes, so a disputed bill can be answered
+-- with a per-day, per-domain breakdown long after bandwidth_usage rows are
+-- pruned. Rows are written once per closed UTC day and never updated; the
+-- signature is an HMAC over the row so later edits show up. These tables
+-- are billing records and aren't pruned.
+
+CREATE TABLE IF NOT EXISTS usage_audit (
+    day DATE NOT NULL,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    hostname TEXT NOT NULL, -- '' for bandwidth recorded without a tunnel session
+    bytes_in BIGINT NOT NULL,
+    bytes_out BIGINT NOT NULL,
+    reported_bytes BIGINT NOT NULL, -- part of the total already reported to Stripe when sealed
+    signature TEXT NOT NULL,
+    sealed_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (user_id, day, hostname)
+);
+
+-- Every usage record sent to Stripe, as sent
+CREATE TABLE IF NOT EXISTS usage_reports (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    subscription_item_id TEXT NOT NULL,
+    bytes BIGINT NOT NULL,
+    quantity BIGINT NOT NULL, -- billed units (MB)
+    signature TEXT NOT NULL,
+    reported_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_usage_reports_user_id ON usage_reports(user_id, reported_at);
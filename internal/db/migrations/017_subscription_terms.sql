@@ -0,0 +1,10 @@
+-- 017_subscription_terms.sql
+-- Billing interval, seat count and next renewal of a user's subscription,
+-- kept in sync from the billing provider for display. Team plans are priced
+-- per seat; any paid plan can be billed monthly or yearly.
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS billing_interval TEXT NOT NULL DEFAULT 'month'; -- 'month', 'year'
+ALTER TABLE users ADD COLUMN IF NOT EXISTS seats INTEGER NOT NULL DEFAULT 1;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS renewal_amount BIGINT; -- minor units, NULL for metered or free plans
+ALTER TABLE users ADD COLUMN IF NOT EXISTS renewal_currency TEXT;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS renews_at TIMESTAMPTZ;
@@ -0,0 +1,15 @@
+-- 018_usage_alerts.sql
+-- User-defined bandwidth alerts, e.g. "tell me at 2 GB". A periodic job
+-- compares them with bandwidth_usage and fires each at most once a month.
+
+CREATE TABLE IF NOT EXISTS usage_alerts (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    threshold_bytes BIGINT NOT NULL,
+    channel TEXT NOT NULL, -- 'email', 'webhook', 'slack'
+    target TEXT NOT NULL DEFAULT '', -- URL for webhook and slack
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    last_fired_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS idx_usage_alerts_user_id ON usage_alerts(user_id);
@@ -0,0 +1,6 @@
+-- 019_request_labels.sql
+-- Labels the tunnel carried when the request went through it, such as
+-- {"env": "staging"}, so logs from many tunnels on one domain can be told
+-- apart.
+
+ALTER TABLE request_logs ADD COLUMN IF NOT EXISTS labels JSONB NOT NULL DEFAULT '{}';
@@ -0,0 +1,10 @@
+-- 020_tunnel_names.sql
+-- Stable tunnel names from `lobber up --name` or lobber.yml. Sessions and
+-- request logs carry the name so the dashboard can group a project's history
+-- even when it connects on a different hostname each day. Empty means the
+-- tunnel wasn't named.
+
+ALTER TABLE tunnel_sessions ADD COLUMN IF NOT EXISTS name TEXT NOT NULL DEFAULT '';
+ALTER TABLE request_logs ADD COLUMN IF NOT EXISTS tunnel_name TEXT NOT NULL DEFAULT '';
+
+CREATE INDEX IF NOT EXISTS idx_tunnel_sessions_name ON tunnel_sessions(name, started_at) WHERE name <> '';
@@ -0,0 +1,16 @@
+-- 021_events.sql
+-- Users' activity feeds: tunnels connecting and disconnecting, domains
+-- verified, certificates issued and quota warnings. IDs only grow, so
+-- `lobber events --follow` asks for everything after the last ID it saw.
+
+CREATE TABLE IF NOT EXISTS events (
+    id BIGSERIAL PRIMARY KEY,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    type TEXT NOT NULL, -- e.g. 'tunnel.connected'
+    hostname TEXT NOT NULL DEFAULT '',
+    message TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_events_user_id ON events(user_id, id);
+CREATE INDEX IF NOT EXISTS idx_events_created_at ON events(created_at);
@@ -0,0 +1,6 @@
+-- 022_domain_schedules.sql
+-- Weekly availability windows, e.g. 'Mon-Fri 09:00-18:00 Europe/London'.
+-- Outside them the relay answers visitors with a closed page instead of
+-- proxying. Empty means the domain is always available.
+
+ALTER TABLE domains ADD COLUMN IF NOT EXISTS schedule TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,5 @@
+-- 023_domain_sampling.sql
+-- Which proxied requests a domain's request log keeps, e.g. 'errors, 1%'
+-- or 'path:/api/*'. Empty keeps every request.
+
+ALTER TABLE domains ADD COLUMN IF NOT EXISTS sampling TEXT NOT NULL DEFAULT '';
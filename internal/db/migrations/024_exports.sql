@@ -0,0 +1,20 @@
+-- 024_exports.sql
+-- Scheduled exports of a user's request logs and daily usage to their own
+-- S3-compatible bucket (S3, or GCS through its interoperability API). The
+-- secret key is sealed with the relay's EXPORT_KEY, never stored in clear.
+
+CREATE TABLE IF NOT EXISTS exports (
+    user_id UUID PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    provider TEXT NOT NULL, -- 's3' or 'gcs'
+    endpoint TEXT NOT NULL DEFAULT '',
+    region TEXT NOT NULL DEFAULT '',
+    bucket TEXT NOT NULL,
+    prefix TEXT NOT NULL DEFAULT '',
+    access_key_id TEXT NOT NULL,
+    secret_sealed TEXT NOT NULL,
+    format TEXT NOT NULL DEFAULT 'jsonl', -- 'jsonl' or 'jsonl.gz'
+    exported_through TIMESTAMPTZ NOT NULL, -- data before this has been written
+    last_run_at TIMESTAMPTZ,
+    last_error TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
@@ -0,0 +1,31 @@
+-- 025_data_residency.sql
+-- Where a user's request logs are kept: 'us' or 'eu'. request_logs becomes
+-- a table partitioned by region, with each region's partition in its own
+-- schema so operators can put it on storage in that region, e.g. with
+-- ALTER TABLE region_eu.request_logs SET TABLESPACE. Existing logs become
+-- the US partition.
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS data_region TEXT NOT NULL DEFAULT 'us'
+    CHECK (data_region IN ('us', 'eu'));
+
+CREATE SCHEMA IF NOT EXISTS region_us;
+CREATE SCHEMA IF NOT EXISTS region_eu;
+
+-- Checking the region before attaching saves a second scan of the table
+ALTER TABLE request_logs ADD COLUMN region TEXT NOT NULL DEFAULT 'us'
+    CONSTRAINT request_logs_region_us CHECK (region = 'us');
+ALTER TABLE request_logs SET SCHEMA region_us;
+
+CREATE TABLE request_logs (LIKE region_us.request_logs INCLUDING DEFAULTS)
+    PARTITION BY LIST (region);
+ALTER TABLE request_logs ADD FOREIGN KEY (domain_id) REFERENCES domains(id) ON DELETE CASCADE;
+ALTER TABLE request_logs ATTACH PARTITION region_us.request_logs FOR VALUES IN ('us');
+ALTER TABLE region_us.request_logs DROP CONSTRAINT request_logs_region_us;
+CREATE TABLE region_eu.request_logs PARTITION OF request_logs FOR VALUES IN ('eu');
+
+-- The US partition keeps its indexes; these attach to them and build the EU ones
+CREATE INDEX IF NOT EXISTS idx_request_logs_domain_id ON request_logs(domain_id);
+CREATE INDEX IF NOT EXISTS idx_request_logs_created_at ON request_logs(created_at DESC);
+CREATE INDEX IF NOT EXISTS idx_request_logs_method ON request_logs(method);
+CREATE INDEX IF NOT EXISTS idx_request_logs_status ON request_logs(status_code);
+CREATE INDEX IF NOT EXISTS idx_request_logs_remote_ip ON request_logs(remote_ip, created_at);
@@ -0,0 +1,18 @@
+-- 026_cert_cache.sql
+-- ACME certificates, the account key and challenge tokens shared by the
+-- relay fleet (CERT_CACHE=db), so a certificate is issued once rather than
+-- by every relay. Entries are stored as autocert writes them, private keys
+-- included, as the directory cache does. A lease in cert_locks marks the
+-- relay issuing a certificate while the others wait for it.
+
+CREATE TABLE IF NOT EXISTS cert_cache (
+    key TEXT PRIMARY KEY,
+    data BYTEA NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS cert_locks (
+    key TEXT PRIMARY KEY,
+    holder TEXT NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL
+);
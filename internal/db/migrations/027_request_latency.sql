@@ -0,0 +1,12 @@
+-- 027_request_latency.sql
+-- Where each proxied request's time went, in microseconds: the relay
+-- reading it and waiting for the tunnel, the network to the client and
+-- back, the local server, and writing the response. Zero for requests the
+-- relay answered itself; tunnel and local are zero for clients too old to
+-- report their part. Adding them to the partitioned table adds them to
+-- every region's partition.
+
+ALTER TABLE request_logs ADD COLUMN IF NOT EXISTS relay_us BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE request_logs ADD COLUMN IF NOT EXISTS tunnel_us BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE request_logs ADD COLUMN IF NOT EXISTS local_us BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE request_logs ADD COLUMN IF NOT EXISTS write_us BIGINT NOT NULL DEFAULT 0;
@@ -0,0 +1,7 @@
+-- 028_response_metadata.sql
+-- What the client reported about each response: the local server's status
+-- before any rewrite such as a debug page (0 if it wasn't reached), and the
+-- client's version. Both are empty for clients too old to report them.
+
+ALTER TABLE request_logs ADD COLUMN IF NOT EXISTS local_status INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE request_logs ADD COLUMN IF NOT EXISTS client_version TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,13 @@
+-- 029_user_preferences.sql
+-- Defaults a user sets once and every machine they run the CLI on picks up
+-- at login: whether `lobber up` runs the inspector, the burst limit it asks
+-- for, and a request log window shorter than their plan's (0 keeps the
+-- plan's). Users without a row have the defaults.
+
+CREATE TABLE IF NOT EXISTS user_preferences (
+    user_id UUID PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    inspect BOOLEAN NOT NULL DEFAULT TRUE,
+    log_retention_days INTEGER NOT NULL DEFAULT 0,
+    burst_limit TEXT NOT NULL DEFAULT '', -- '' for the relay's, 'off' or requests per second
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
@@ -0,0 +1,12 @@
+-- 030_domain_grants.sql
+-- Members of a team a domain's owner lets connect tunnels on it. Without a
+-- grant only the owner can bind a registered hostname.
+
+CREATE TABLE IF NOT EXISTS domain_grants (
+    domain_id UUID NOT NULL REFERENCES domains(id) ON DELETE CASCADE,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (domain_id, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_domain_grants_user_id ON domain_grants(user_id);
@@ -0,0 +1,8 @@
+-- 031_sso.sql
+-- The team owner a user was created for when they first signed in through
+-- their company's identity provider. Members keep their account if the
+-- owner's is deleted.
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS org_id UUID REFERENCES users(id) ON DELETE SET NULL;
+
+CREATE INDEX IF NOT EXISTS idx_users_org_id ON users(org_id) WHERE org_id IS NOT NULL;
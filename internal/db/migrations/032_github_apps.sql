@@ -0,0 +1,12 @@
+-- 032_github_apps.sql
+-- The GitHub App a user's CI tunnels comment preview links on pull
+-- requests through (`lobber up --github-pr`). The App's private key is
+-- sealed with the relay's EXPORT_KEY, never stored in clear.
+
+CREATE TABLE IF NOT EXISTS github_apps (
+    user_id UUID PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    app_id BIGINT NOT NULL,
+    key_sealed TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
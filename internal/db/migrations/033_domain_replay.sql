@@ -0,0 +1,6 @@
+-- 033_domain_replay.sql
+-- Where a copy of a domain's proxied traffic is replayed, such as a staging
+-- environment: an https:// URL optionally followed by a sampling policy,
+-- e.g. 'https://staging.example.com path:/webhooks/*'. Empty replays nothing.
+
+ALTER TABLE domains ADD COLUMN IF NOT EXISTS replay TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,6 @@
+-- 034_domain_headers.sql
+-- Headers the relay adds to every response a domain serves to visitors,
+-- one "Name: value" per line, e.g. 'X-Robots-Tag: noindex'. Empty adds
+-- none.
+
+ALTER TABLE domains ADD COLUMN IF NOT EXISTS headers TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,6 @@
+-- 035_domain_https.sql
+-- How the relay keeps a domain's visitors on HTTPS, e.g. 'redirect, hsts'
+-- to send plain HTTP requests to https:// and have browsers remember to.
+-- Empty serves plain HTTP as it comes.
+
+ALTER TABLE domains ADD COLUMN IF NOT EXISTS https TEXT NOT NULL DEFAULT '';
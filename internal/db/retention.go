@@ -0,0 +1,186 @@
+// internal/db/retention.go
+package db
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// RetentionPolicy says how long stored data is kept. A zero duration keeps data forever.
+type RetentionPolicy struct {
+	RequestLogs        map[string]time.Duration // per plan, e.g. "free" -> 24h
+	DefaultRequestLogs time.Duration            // plans missing from RequestLogs
+	BandwidthUsage     time.Duration            // rows not yet synced to Stripe are always kept
+	BillingEvents      time.Duration            // unprocessed events are always kept
+	HealthChecks       time.Duration            // relay health history behind the status page
+	Events             time.Duration            // users' activity feeds
+}
+
+// PruneResult counts the rows removed by Prune
+type PruneResult struct {
+	RequestLogs    int64
+	BandwidthUsage int64
+	BillingEvents  int64
+	HealthChecks   int64
+	Events         int64
+}
+
+// DefaultRetentionPolicy keeps request logs for 1 day on free, 7 days on
+// pay-as-you-go and 30 days on Pro and Team, billing data for 13 months, relay
+// health history for the 90 days the status page shows and activity feeds
+// for 30 days
+func DefaultRetentionPolicy() *RetentionPolicy {
+	return &RetentionPolicy{
+		RequestLogs: map[string]time.Duration{
+			"free": 24 * time.Hour,
+			"payg": 7 * 24 * time.Hour,
+			"pro":  30 * 24 * time.Hour,
+			"team": 30 * 24 * time.Hour,
+		},
+		DefaultRequestLogs: 24 * time.Hour,
+		BandwidthUsage:     395 * 24 * time.Hour,
+		BillingEvents:      395 * 24 * time.Hour,
+		HealthChecks:       90 * 24 * time.Hour,
+		Events:             30 * 24 * time.Hour,
+	}
+}
+
+// ParsePlanRetention parses per-plan windows like "free=24h,pro=720h"
+func ParsePlanRetention(s string) (map[string]time.Duration, error) {
+	windows := make(map[string]time.Duration)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		plan, value, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid retention %q: want plan=duration", part)
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(value))
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("invalid retention for %s: %q", plan, value)
+		}
+		windows[strings.TrimSpace(plan)] = d
+	}
+	return windows, nil
+}
+
+// Prune deletes data older than the policy allows. It is meant to run
+// frequently so each pass only removes a small slice of rows.
+func (d *DB) Prune(ctx context.Context, policy *RetentionPolicy) (*PruneResult, error) {
+	ctx, done := Timed(ctx, "db.Prune")
+	defer done()
+
+	result := &PruneResult{}
+
+	plans := make([]string, 0, len(policy.RequestLogs))
+	for plan, window := range policy.RequestLogs {
+		plans = append(plans, plan)
+		if window <= 0 {
+			continue
+		}
+		n, err := d.exec(ctx, `
+			DELETE FROM request_logs r
+			USING domains dm, users u
+			WHERE r.domain_id = dm.id AND dm.user_id = u.id
+			AND COALESCE(u.plan, 'free') = $1
+			AND r.created_at < NOW() - make_interval(secs => $2)
+		`, plan, window.Seconds())
+		if err != nil {
+			return result, fmt.Errorf("prune request logs for %s: %w", plan, err)
+		}
+		result.RequestLogs += n
+	}
+
+	if policy.DefaultRequestLogs > 0 {
+		n, err := d.exec(ctx, `
+			DELETE FROM request_logs r
+			USING domains dm, users u
+			WHERE r.domain_id = dm.id AND dm.user_id = u.id
+			AND NOT (COALESCE(u.plan, 'free') = ANY($1))
+			AND r.created_at < NOW() - make_interval(secs => $2)
+		`, pq.Array(plans), policy.DefaultRequestLogs.Seconds())
+		if err != nil {
+			return result, fmt.Errorf("prune request logs: %w", err)
+		}
+		result.RequestLogs += n
+	}
+
+	// Users may keep their logs for less time than their plan allows
+	n, err := d.exec(ctx, `
+		DELETE FROM request_logs r
+		USING domains dm, user_preferences pr
+		WHERE r.domain_id = dm.id AND dm.user_id = pr.user_id
+		AND pr.log_retention_days > 0
+		AND r.created_at < NOW() - make_interval(days => pr.log_retention_days)
+	`)
+	if err != nil {
+		return result, fmt.Errorf("prune request logs by preference: %w", err)
+	}
+	result.RequestLogs += n
+
+	if policy.BandwidthUsage > 0 {
+		// Unsynced usage for paid users hasn't been billed yet
+		n, err := d.exec(ctx, `
+			DELETE FROM bandwidth_usage bu
+			USING users u
+			WHERE bu.user_id = u.id
+			AND bu.recorded_at < NOW() - make_interval(secs => $1)
+			AND (bu.synced_to_stripe OR COALESCE(u.plan, 'free') = 'free')
+		`, policy.BandwidthUsage.Seconds())
+		if err != nil {
+			return result, fmt.Errorf("prune bandwidth usage: %w", err)
+		}
+		result.BandwidthUsage = n
+	}
+
+	if policy.BillingEvents > 0 {
+		n, err := d.exec(ctx, `
+			DELETE FROM billing_events
+			WHERE processed
+			AND created_at < NOW() - make_interval(secs => $1)
+		`, policy.BillingEvents.Seconds())
+		if err != nil {
+			return result, fmt.Errorf("prune billing events: %w", err)
+		}
+		result.BillingEvents = n
+	}
+
+	if policy.HealthChecks > 0 {
+		n, err := d.exec(ctx, `
+			DELETE FROM health_checks
+			WHERE checked_at < NOW() - make_interval(secs => $1)
+		`, policy.HealthChecks.Seconds())
+		if err != nil {
+			return result, fmt.Errorf("prune health checks: %w", err)
+		}
+		result.HealthChecks = n
+	}
+
+	if policy.Events > 0 {
+		n, err := d.exec(ctx, `
+			DELETE FROM events
+			WHERE created_at < NOW() - make_interval(secs => $1)
+		`, policy.Events.Seconds())
+		if err != nil {
+			return result, fmt.Errorf("prune events: %w", err)
+		}
+		result.Events = n
+	}
+
+	return result, nil
+}
+
+// exec runs a statement and returns the number of affected rows
+func (d *DB) exec(ctx context.Context, query string, args ...any) (int64, error) {
+	res, err := d.ExecContext(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,56 @@
+package db
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParsePlanRetention(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    map[string]time.Duration
+		wantErr bool
+	}{
+		{"", map[string]time.Duration{}, false},
+		{"free=24h", map[string]time.Duration{"free": 24 * time.Hour}, false},
+		{"free=24h, pro=720h", map[string]time.Duration{"free": 24 * time.Hour, "pro": 720 * time.Hour}, false},
+		{"pro=0s", map[string]time.Duration{"pro": 0}, false},
+		{"free", nil, true},
+		{"free=forever", nil, true},
+		{"free=-1h", nil, true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParsePlanRetention(tt.input)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParsePlanRetention(%q) error = %v, wantErr %v", tt.input, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("ParsePlanRetention(%q) = %v, want %v", tt.input, got, tt.want)
+			continue
+		}
+		for plan, d := range tt.want {
+			if got[plan] != d {
+				t.Errorf("ParsePlanRetention(%q)[%s] = %v, want %v", tt.input, plan, got[plan], d)
+			}
+		}
+	}
+}
+
+func TestDefaultRetentionPolicy(t *testing.T) {
+	p := DefaultRetentionPolicy()
+
+	if p.RequestLogs["free"] >= p.RequestLogs["pro"] {
+		t.Errorf("free retention %v should be shorter than pro %v", p.RequestLogs["free"], p.RequestLogs["pro"])
+	}
+	if p.RequestLogs["pro"] != 30*24*time.Hour {
+		t.Errorf("pro retention = %v, want 30 days", p.RequestLogs["pro"])
+	}
+	if p.BandwidthUsage < 365*24*time.Hour {
+		t.Errorf("bandwidth retention = %v, want at least a year for invoicing", p.BandwidthUsage)
+	}
+}
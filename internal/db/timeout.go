@@ -0,0 +1,80 @@
+// internal/db/timeout.go
+package db
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// QueryTimeouts configures per-statement deadlines and slow-query logging
+type QueryTimeouts struct {
+	Default       time.Duration            // deadline for statements without an override (0 disables)
+	Statements    map[string]time.Duration // per-statement overrides, keyed by statement name
+	SlowThreshold time.Duration            // statements slower than this are logged (0 disables)
+}
+
+// DefaultQueryTimeouts gives interactive queries 5s and logs anything over 500ms.
+// Retention pruning and reconciliation scan large tables and get longer.
+func DefaultQueryTimeouts() QueryTimeouts {
+	return QueryTimeouts{
+		Default: 5 * time.Second,
+		Statements: map[string]time.Duration{
+			"db.Prune":                  5 * time.Minute,
+			"billing.Reconcile":         time.Minute,
+			"billing.SyncUsageToStripe": time.Minute,
+			"billing.SealUsage":         time.Minute,
+		},
+		SlowThreshold: 500 * time.Millisecond,
+	}
+}
+
+var (
+	timeoutsMu sync.RWMutex
+	timeouts   = DefaultQueryTimeouts()
+)
+
+// SetQueryTimeouts replaces the process-wide query timeouts
+func SetQueryTimeouts(t QueryTimeouts) {
+	timeoutsMu.Lock()
+	defer timeoutsMu.Unlock()
+	timeouts = t
+}
+
+// timeoutFor returns the deadline and slow threshold for a statement
+func timeoutFor(name string) (time.Duration, time.Duration) {
+	timeoutsMu.RLock()
+	defer timeoutsMu.RUnlock()
+	if d, ok := timeouts.Statements[name]; ok {
+		return d, timeouts.SlowThreshold
+	}
+	return timeouts.Default, timeouts.SlowThreshold
+}
+
+// Timed bounds a statement with its configured deadline. Call done once the
+// statement and any rows it returned are finished; it releases the context and
+// logs the statement by name if it was slow or timed out.
+//
+//	ctx, done := db.Timed(ctx, "store.GetUser")
+//	defer done()
+func Timed(ctx context.Context, name string) (context.Context, func()) {
+	timeout, slow := timeoutFor(name)
+
+	cancel := context.CancelFunc(func() {})
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	}
+
+	start := time.Now()
+	return ctx, func() {
+		elapsed := time.Since(start)
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			log.Printf("query %s timed out after %v", name, elapsed.Round(time.Millisecond))
+		} else if slow > 0 && elapsed >= slow {
+			log.Printf("slow query %s took %v", name, elapsed.Round(time.Millisecond))
+		}
+		cancel()
+	}
+}
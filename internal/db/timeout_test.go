@@ -0,0 +1,89 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func captureLog(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return &buf
+}
+
+func withTimeouts(t *testing.T, qt QueryTimeouts) {
+	t.Helper()
+	SetQueryTimeouts(qt)
+	t.Cleanup(func() { SetQueryTimeouts(DefaultQueryTimeouts()) })
+}
+
+func TestTimedDeadline(t *testing.T) {
+	withTimeouts(t, QueryTimeouts{
+		Default:    time.Second,
+		Statements: map[string]time.Duration{"long": time.Hour},
+	})
+
+	tests := []struct {
+		name string
+		max  time.Duration
+	}{
+		{"short", time.Second},
+		{"long", time.Hour},
+	}
+
+	for _, tt := range tests {
+		ctx, done := Timed(context.Background(), tt.name)
+		deadline, ok := ctx.Deadline()
+		if !ok {
+			t.Errorf("%s: no deadline set", tt.name)
+		} else if time.Until(deadline) > tt.max {
+			t.Errorf("%s: deadline %v away, want at most %v", tt.name, time.Until(deadline), tt.max)
+		}
+		done()
+		if ctx.Err() == nil {
+			t.Errorf("%s: context should be cancelled after done", tt.name)
+		}
+	}
+}
+
+func TestTimedNoDefault(t *testing.T) {
+	withTimeouts(t, QueryTimeouts{})
+
+	ctx, done := Timed(context.Background(), "anything")
+	defer done()
+	if _, ok := ctx.Deadline(); ok {
+		t.Error("zero Default should not set a deadline")
+	}
+}
+
+func TestTimedLogsSlowAndTimedOut(t *testing.T) {
+	buf := captureLog(t)
+	withTimeouts(t, QueryTimeouts{
+		Default:       time.Millisecond,
+		Statements:    map[string]time.Duration{"slow": time.Hour},
+		SlowThreshold: time.Millisecond,
+	})
+
+	_, done := Timed(context.Background(), "slow")
+	time.Sleep(5 * time.Millisecond)
+	done()
+
+	ctx, done := Timed(context.Background(), "stuck")
+	<-ctx.Done()
+	done()
+
+	out := buf.String()
+	if !strings.Contains(out, "slow query slow") {
+		t.Errorf("log = %q, want a slow query line", out)
+	}
+	if !strings.Contains(out, "query stuck timed out") {
+		t.Errorf("log = %q, want a timeout line", out)
+	}
+}
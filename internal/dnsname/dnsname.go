@@ -0,0 +1,73 @@
+// internal/dnsname/dnsname.go
+package dnsname
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// ErrInvalid is returned for strings that can't be used as a tunnel or
+// custom domain hostname
+var ErrInvalid = errors.New("invalid domain")
+
+// profile maps Unicode hostnames the way browsers do before a DNS lookup,
+// so "Bücher.example" and "xn--bcher-kva.example" name the same tunnel
+var profile = idna.New(idna.MapForLookup(), idna.BidiRule(), idna.Transitional(false))
+
+// Normalize returns the form hostnames are stored and routed under:
+// lowercase ASCII with IDN labels in punycode and no trailing dot, e.g.
+// "Bücher.Example.com." -> "xn--bcher-kva.example.com". It rejects anything
+// that isn't a DNS name with at least two labels.
+func Normalize(raw string) (string, error) {
+	name := strings.TrimSuffix(strings.TrimSpace(raw), ".")
+	if name == "" {
+		return "", fmt.Errorf("%w: enter a hostname like app.example.com", ErrInvalid)
+	}
+	ascii, err := profile.ToASCII(name)
+	if err != nil {
+		return "", fmt.Errorf("%w %q: use letters, digits, hyphens and dots only", ErrInvalid, name)
+	}
+	ascii = strings.ToLower(ascii)
+	if len(ascii) > 253 {
+		return "", fmt.Errorf("%w: hostname is too long", ErrInvalid)
+	}
+
+	labels := strings.Split(ascii, ".")
+	if len(labels) < 2 {
+		return "", fmt.Errorf("%w %q: use a fully qualified hostname like app.example.com", ErrInvalid, name)
+	}
+	for _, label := range labels {
+		if !validLabel(label) {
+			return "", fmt.Errorf("%w %q: use letters, digits, hyphens and dots only", ErrInvalid, name)
+		}
+	}
+	return ascii, nil
+}
+
+// Lookup normalizes a Host header for matching against registered
+// hostnames. Unlike Normalize it never fails: a host it can't convert is
+// only lowercased, so it simply matches nothing.
+func Lookup(host string) string {
+	host = strings.TrimSuffix(host, ".")
+	if ascii, err := profile.ToASCII(host); err == nil {
+		return strings.ToLower(ascii)
+	}
+	return strings.ToLower(host)
+}
+
+// validLabel reports whether s is a valid DNS label (letters, digits and
+// inner hyphens, at most 63 characters)
+func validLabel(s string) bool {
+	if len(s) == 0 || len(s) > 63 || s[0] == '-' || s[len(s)-1] == '-' {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,63 @@
+// internal/dnsname/dnsname_test.go
+package dnsname
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    string
+		wantErr bool
+	}{
+		{"app.example.com", "app.example.com", false},
+		{"  App.Example.COM. ", "app.example.com", false},
+		{"bücher.example.com", "xn--bcher-kva.example.com", false},
+		{"BÜCHER.Example.com", "xn--bcher-kva.example.com", false},
+		{"xn--bcher-kva.example.com", "xn--bcher-kva.example.com", false},
+		{"ＡＰＰ.example.com", "app.example.com", false}, // fullwidth letters
+		{"", "", true},
+		{"localhost", "", true},
+		{"-bad.example.com", "", true},
+		{"app..example.com", "", true},
+		{"app.example.com:443", "", true},
+		{"https://app.example.com", "", true},
+		{"app_1.example.com", "", true},
+		{"app example.com", "", true},
+		{strings.Repeat("a", 64) + ".example.com", "", true},
+	}
+
+	for _, tt := range tests {
+		got, err := Normalize(tt.input)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Normalize(%q) error = %v, wantErr %v", tt.input, err, tt.wantErr)
+			continue
+		}
+		if err != nil && !errors.Is(err, ErrInvalid) {
+			t.Errorf("Normalize(%q) error = %v, want ErrInvalid", tt.input, err)
+		}
+		if got != tt.want {
+			t.Errorf("Normalize(%q) = %q, want %q", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestLookup(t *testing.T) {
+	tests := []struct {
+		host, want string
+	}{
+		{"App.Example.com", "app.example.com"},
+		{"bücher.example.com.", "xn--bcher-kva.example.com"},
+		{"localhost", "localhost"},
+		{"127.0.0.1", "127.0.0.1"},
+		{"Bad_Host.Example.com", "bad_host.example.com"},
+	}
+	for _, tt := range tests {
+		if got := Lookup(tt.host); got != tt.want {
+			t.Errorf("Lookup(%q) = %q, want %q", tt.host, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+// internal/events/events.go
+package events
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/lobber-dev/lobber/internal/store"
+)
+
+// Types of event in a user's activity feed
+const (
+	TunnelConnected    = "tunnel.connected"
+	TunnelDisconnected = "tunnel.disconnected"
+	DomainVerified     = "domain.verified"
+	CertIssued         = "cert.issued"
+	QuotaWarning       = "quota.warning"
+	PreviewCommented   = "github.commented"
+)
+
+const (
+	// subscriberBuffer is how many events a slow subscriber can fall
+	// behind before it misses some; followers catch up from the store
+	subscriberBuffer = 16
+
+	// pollInterval is how often Wait checks the store for events
+	// published on other relays
+	pollInterval = 2 * time.Second
+
+	recordTimeout = 5 * time.Second
+)
+
+// Bus records events to users' activity feeds and hands them to anyone
+// following a feed on this process. A nil *Bus drops every event, so
+// components built without one need no checks.
+type Bus struct {
+	store store.EventStore
+
+	mu   sync.Mutex
+	subs map[string]map[chan store.Event]struct{} // user ID -> subscribers
+}
+
+// NewBus creates a bus that persists events to s
+func NewBus(s store.EventStore) *Bus {
+	return &Bus{
+		store: s,
+		subs:  make(map[string]map[chan store.Event]struct{}),
+	}
+}
+
+// Publish records an event and passes it to the user's subscribers.
+// Failing to record it is logged rather than returned, since the feed
+// never holds up what it reports on.
+func (b *Bus) Publish(ctx context.Context, e store.Event) {
+	if b == nil || e.UserID == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), recordTimeout)
+	defer cancel()
+	recorded, err := b.store.RecordEvent(ctx, e)
+	if err != nil {
+		log.Printf("events: record %s for %s: %v", e.Type, e.UserID, err)
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs[e.UserID] {
+		select {
+		case ch <- *recorded:
+		default:
+		}
+	}
+}
+
+// Subscribe returns a channel that receives the user's events as they're
+// published on this process, and a function that stops the subscription.
+// Events published on other relays only show up in the store.
+func (b *Bus) Subscribe(userID string) (<-chan store.Event, func()) {
+	ch := make(chan store.Event, subscriberBuffer)
+	if b == nil {
+		return ch, func() {}
+	}
+
+	b.mu.Lock()
+	if b.subs[userID] == nil {
+		b.subs[userID] = make(map[chan store.Event]struct{})
+	}
+	b.subs[userID][ch] = struct{}{}
+	b.mu.Unlock()
+
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.subs[userID], ch)
+		if len(b.subs[userID]) == 0 {
+			delete(b.subs, userID)
+		}
+	}
+}
+
+// Wait returns the user's events after the given ID, waiting up to timeout
+// for one if there are none yet. It polls the store as well as listening
+// on the bus, so events published on other relays arrive too. Unlike
+// Publish, it needs a non-nil bus.
+func (b *Bus) Wait(ctx context.Context, userID string, after int64, limit int, timeout time.Duration) ([]store.Event, error) {
+	ch, stop := b.Subscribe(userID)
+	defer stop()
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	poll := time.NewTicker(pollInterval)
+	defer poll.Stop()
+	for {
+		events, err := b.store.ListEvents(ctx, userID, after, limit)
+		if err != nil || len(events) > 0 {
+			return events, err
+		}
+		select {
+		case <-ch:
+		case <-poll.C:
+		case <-deadline.C:
+			return nil, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package events
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/lobber-dev/lobber/internal/store"
+)
+
+func TestPublishSubscribe(t *testing.T) {
+	mem := store.NewMemory()
+	b := NewBus(mem)
+	ctx := context.Background()
+
+	ch, stop := b.Subscribe("user-1")
+	b.Publish(ctx, store.Event{UserID: "user-2", Type: DomainVerified, Message: "Domain verified"})
+	b.Publish(ctx, store.Event{UserID: "user-1", Type: TunnelConnected, Message: "Tunnel connected"})
+
+	select {
+	case e := <-ch:
+		if e.Type != TunnelConnected || e.ID == 0 {
+			t.Errorf("subscriber got %+v, want the recorded tunnel.connected event", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("subscriber got nothing")
+	}
+	select {
+	case e := <-ch:
+		t.Errorf("subscriber got another user's event %+v", e)
+	default:
+	}
+
+	stop()
+	b.Publish(ctx, store.Event{UserID: "user-1", Type: TunnelDisconnected, Message: "Tunnel disconnected"})
+	if events, _ := mem.ListEvents(ctx, "user-1", 0, 10); len(events) != 2 {
+		t.Errorf("stored %d events for user-1, want 2", len(events))
+	}
+
+	// A nil bus drops events
+	var nilBus *Bus
+	nilBus.Publish(ctx, store.Event{UserID: "user-1", Type: QuotaWarning})
+}
+
+func TestWait(t *testing.T) {
+	mem := store.NewMemory()
+	b := NewBus(mem)
+	ctx := context.Background()
+	first, _ := mem.RecordEvent(ctx, store.Event{UserID: "user-1", Type: TunnelConnected})
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		b.Publish(ctx, store.Event{UserID: "user-1", Type: TunnelDisconnected})
+	}()
+	start := time.Now()
+	events, err := b.Wait(ctx, "user-1", first.ID, 10, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Wait() error = %v", err)
+	}
+	if len(events) != 1 || events[0].Type != TunnelDisconnected {
+		t.Fatalf("Wait() = %+v, want the event published while waiting", events)
+	}
+	if waited := time.Since(start); waited > time.Second {
+		t.Errorf("Wait() took %s, want it to return once the event was published", waited)
+	}
+
+	events, err = b.Wait(ctx, "user-1", events[0].ID, 10, 10*time.Millisecond)
+	if err != nil || len(events) != 0 {
+		t.Errorf("Wait() with nothing new = %+v, %v, want nothing after the timeout", events, err)
+	}
+}
@@ -0,0 +1,104 @@
+// internal/export/export.go
+package export
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/lobber-dev/lobber/internal/publicnet"
+	"github.com/lobber-dev/lobber/internal/store"
+)
+
+// Providers an export can write to. Both speak the S3 API; GCS through its
+// interoperability endpoint with HMAC keys.
+const (
+	ProviderS3  = "s3"
+	ProviderGCS = "gcs"
+)
+
+// Formats an export can write
+const (
+	FormatJSONL     = "jsonl"
+	FormatJSONLGzip = "jsonl.gz"
+)
+
+// ErrInvalid wraps every validation failure
+var ErrInvalid = errors.New("invalid export")
+
+var bucketName = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{1,61}[a-z0-9]$`)
+
+// Validate checks where e writes to, filling in the provider's endpoint
+// and region when they're left out
+func Validate(e *store.Export) error {
+	switch e.Provider {
+	case ProviderS3:
+		if e.Region == "" {
+			e.Region = "us-east-1"
+		}
+		if e.Endpoint == "" {
+			e.Endpoint = "s3." + e.Region + ".amazonaws.com"
+		}
+	case ProviderGCS:
+		if e.Region == "" {
+			e.Region = "auto"
+		}
+		if e.Endpoint == "" {
+			e.Endpoint = "storage.googleapis.com"
+		}
+	default:
+		return fmt.Errorf("%w: provider must be %s or %s", ErrInvalid, ProviderS3, ProviderGCS)
+	}
+
+	endpoint, err := normalizeEndpoint(e.Endpoint)
+	if err != nil {
+		return err
+	}
+	e.Endpoint = endpoint
+
+	if !bucketName.MatchString(e.Bucket) {
+		return fmt.Errorf("%w: bucket %q is not a valid bucket name", ErrInvalid, e.Bucket)
+	}
+	e.Prefix = strings.Trim(e.Prefix, "/")
+	if len(e.Prefix) > 256 || strings.Contains(e.Prefix, "..") {
+		return fmt.Errorf("%w: prefix must be a path of at most 256 characters", ErrInvalid)
+	}
+	if e.AccessKeyID == "" || len(e.AccessKeyID) > 128 {
+		return fmt.Errorf("%w: access key ID is required", ErrInvalid)
+	}
+
+	switch e.Format {
+	case "":
+		e.Format = FormatJSONL
+	case FormatJSONL, FormatJSONLGzip:
+	default:
+		return fmt.Errorf("%w: format must be %s or %s", ErrInvalid, FormatJSONL, FormatJSONLGzip)
+	}
+	return nil
+}
+
+// normalizeEndpoint reduces an endpoint to the host the relay sends to over
+// HTTPS. Addresses on the relay's own network are refused; names that
+// resolve to one are refused when the exporter dials them.
+func normalizeEndpoint(endpoint string) (string, error) {
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "https://" + endpoint
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Scheme != "https" || u.Host == "" || (u.Path != "" && u.Path != "/") || u.User != nil {
+		return "", fmt.Errorf("%w: endpoint must be an https:// host", ErrInvalid)
+	}
+	if addr, err := netip.ParseAddr(strings.Trim(u.Hostname(), "[]")); err == nil {
+		if !publicnet.Public(addr) {
+			return "", fmt.Errorf("%w: endpoint must be a public host", ErrInvalid)
+		}
+	}
+	if u.Port() != "" {
+		return net.JoinHostPort(u.Hostname(), u.Port()), nil
+	}
+	return u.Hostname(), nil
+}
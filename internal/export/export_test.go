@@ -0,0 +1,54 @@
+// internal/export/export_test.go
+package export
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/lobber-dev/lobber/internal/store"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name         string
+		in           store.Export
+		wantEndpoint string
+		wantErr      bool
+	}{
+		{"s3 defaults", store.Export{Provider: "s3", Bucket: "logs", AccessKeyID: "AKID"}, "s3.us-east-1.amazonaws.com", false},
+		{"s3 region", store.Export{Provider: "s3", Region: "eu-west-1", Bucket: "logs", AccessKeyID: "AKID"}, "s3.eu-west-1.amazonaws.com", false},
+		{"gcs", store.Export{Provider: "gcs", Bucket: "team_logs", AccessKeyID: "GOOG1"}, "storage.googleapis.com", false},
+		{"compatible endpoint", store.Export{Provider: "s3", Endpoint: "https://acct.r2.cloudflarestorage.com/", Bucket: "logs", AccessKeyID: "AKID"}, "acct.r2.cloudflarestorage.com", false},
+		{"endpoint port", store.Export{Provider: "s3", Endpoint: "minio.example.com:9000", Bucket: "logs", AccessKeyID: "AKID"}, "minio.example.com:9000", false},
+		{"plain http", store.Export{Provider: "s3", Endpoint: "http://minio.example.com", Bucket: "logs", AccessKeyID: "AKID"}, "", true},
+		{"private address", store.Export{Provider: "s3", Endpoint: "10.0.0.5", Bucket: "logs", AccessKeyID: "AKID"}, "", true},
+		{"loopback", store.Export{Provider: "s3", Endpoint: "https://[::1]:9000", Bucket: "logs", AccessKeyID: "AKID"}, "", true},
+		{"unknown provider", store.Export{Provider: "azure", Bucket: "logs", AccessKeyID: "AKID"}, "", true},
+		{"bad bucket", store.Export{Provider: "s3", Bucket: "Logs!", AccessKeyID: "AKID"}, "", true},
+		{"no access key", store.Export{Provider: "s3", Bucket: "logs"}, "", true},
+		{"parquet", store.Export{Provider: "s3", Bucket: "logs", AccessKeyID: "AKID", Format: "parquet"}, "", true},
+		{"prefix escapes", store.Export{Provider: "s3", Bucket: "logs", AccessKeyID: "AKID", Prefix: "../other"}, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := tt.in
+			err := Validate(&e)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				if !errors.Is(err, ErrInvalid) {
+					t.Errorf("Validate() error = %v, want it to wrap ErrInvalid", err)
+				}
+				return
+			}
+			if e.Endpoint != tt.wantEndpoint {
+				t.Errorf("endpoint = %q, want %q", e.Endpoint, tt.wantEndpoint)
+			}
+			if e.Format != FormatJSONL {
+				t.Errorf("format = %q, want the %s default", e.Format, FormatJSONL)
+			}
+		})
+	}
+}
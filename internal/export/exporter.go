@@ -0,0 +1,212 @@
+// internal/export/exporter.go
+package export
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/lobber-dev/lobber/internal/publicnet"
+	"github.com/lobber-dev/lobber/internal/store"
+)
+
+const (
+	// settleDelay is how long after an hour ends before it's exported,
+	// leaving time for queued request logs and usage to be written
+	settleDelay = 5 * time.Minute
+	// maxHoursPerRun caps how far one run catches a lagging export up
+	maxHoursPerRun = 24
+	// maxLogsPerHour caps the request logs written for one hour
+	maxLogsPerHour = 100_000
+)
+
+// requestRecord is a request log as exported
+type requestRecord struct {
+	ID             string            `json:"id"`
+	Time           time.Time         `json:"time"`
+	Domain         string            `json:"domain"`
+	Method         string            `json:"method"`
+	Path           string            `json:"path"`
+	Status         int               `json:"status"`
+	DurationMs     int64             `json:"duration_ms"`
+	RequestBytes   int64             `json:"request_bytes"`
+	ResponseBytes  int64             `json:"response_bytes"`
+	RemoteIP       string            `json:"remote_ip,omitempty"`
+	TLSVersion     string            `json:"tls_version,omitempty"`
+	ALPN           string            `json:"alpn,omitempty"`
+	TLSFingerprint string            `json:"tls_fingerprint,omitempty"`
+	TunnelName     string            `json:"tunnel_name,omitempty"`
+	Labels         map[string]string `json:"labels,omitempty"`
+	Region         string            `json:"region,omitempty"`
+}
+
+// Exporter writes each user's new request logs, an object per hour, and
+// daily usage, an object per UTC day, to their bucket
+type Exporter struct {
+	exports store.ExportStore
+	sealer  *Sealer
+	client  *http.Client
+	now     func() time.Time
+}
+
+// NewExporter returns an Exporter that opens users' secrets with sealer
+func NewExporter(exports store.ExportStore, sealer *Sealer) *Exporter {
+	return &Exporter{
+		exports: exports,
+		sealer:  sealer,
+		client:  publicnet.Client(time.Minute),
+		now:     time.Now,
+	}
+}
+
+// Run exports every user's data up to the last settled hour and returns
+// how many objects it wrote. A failing export is recorded against the user
+// and doesn't stop the others.
+func (x *Exporter) Run(ctx context.Context) (int, error) {
+	exports, err := x.exports.ListExports(ctx)
+	if err != nil {
+		return 0, err
+	}
+	written := 0
+	for _, e := range exports {
+		if ctx.Err() != nil {
+			return written, ctx.Err()
+		}
+		n, through, runErr := x.export(ctx, e)
+		written += n
+		msg := ""
+		if runErr != nil {
+			msg = runErr.Error()
+			log.Printf("export for user %s: %v", e.UserID, runErr)
+		}
+		if err := x.exports.MarkExported(ctx, e.UserID, through, msg); err != nil {
+			log.Printf("export for user %s: record progress: %v", e.UserID, err)
+		}
+	}
+	return written, nil
+}
+
+// export writes e's hours from ExportedThrough on, returning how many
+// objects it wrote and how far it got
+func (x *Exporter) export(ctx context.Context, e store.Export) (int, time.Time, error) {
+	from := e.ExportedThrough.UTC().Truncate(time.Hour)
+	until := x.now().UTC().Add(-settleDelay).Truncate(time.Hour)
+	if !from.Before(until) {
+		return 0, e.ExportedThrough, nil
+	}
+
+	secret, err := x.sealer.Open(e.SecretSealed)
+	if err != nil {
+		return 0, e.ExportedThrough, err
+	}
+	b := &Bucket{
+		Endpoint:        e.Endpoint,
+		Region:          e.Region,
+		Name:            e.Bucket,
+		AccessKeyID:     e.AccessKeyID,
+		SecretAccessKey: secret,
+		Client:          x.client,
+	}
+
+	written := 0
+	for hours := 0; from.Before(until) && hours < maxHoursPerRun; hours++ {
+		to := from.Add(time.Hour)
+		logs, err := x.exports.RequestLogsBetween(ctx, e.UserID, from, to, maxLogsPerHour)
+		if err != nil {
+			return written, from, err
+		}
+		if len(logs) > 0 {
+			if err := upload(ctx, b, e, from.Format("requests/2006/01/02/15"), requestRecords(logs)); err != nil {
+				return written, from, err
+			}
+			written++
+		}
+		if len(logs) == maxLogsPerHour {
+			log.Printf("export for user %s: %s had over %d requests; the rest weren't exported", e.UserID, from.Format(time.RFC3339), maxLogsPerHour)
+		}
+
+		// The last hour of a UTC day completes that day's usage
+		if to.Hour() == 0 {
+			day := to.Add(-24 * time.Hour)
+			usage, err := x.exports.DailyUsage(ctx, e.UserID, day, to)
+			if err != nil {
+				return written, from, err
+			}
+			if len(usage) > 0 {
+				if err := upload(ctx, b, e, day.Format("usage/2006-01-02"), usage); err != nil {
+					return written, from, err
+				}
+				written++
+			}
+		}
+		from = to
+	}
+	return written, from, nil
+}
+
+// encode writes rows as one JSON object per line, gzipped for jsonl.gz, and
+// returns the Content-Encoding to upload it with
+func encode[T any](format string, rows []T) ([]byte, string, error) {
+	var buf bytes.Buffer
+	var w io.Writer = &buf
+	var gz *gzip.Writer
+	if format == FormatJSONLGzip {
+		gz = gzip.NewWriter(&buf)
+		w = gz
+	}
+	enc := json.NewEncoder(w)
+	for _, row := range rows {
+		if err := enc.Encode(row); err != nil {
+			return nil, "", err
+		}
+	}
+	if gz == nil {
+		return buf.Bytes(), "", nil
+	}
+	if err := gz.Close(); err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), "gzip", nil
+}
+
+// upload encodes rows and puts them in b at e's prefix
+func upload[T any](ctx context.Context, b *Bucket, e store.Export, name string, rows []T) error {
+	body, contentEncoding, err := encode(e.Format, rows)
+	if err != nil {
+		return fmt.Errorf("encode %s: %w", name, err)
+	}
+	key := path.Join(e.Prefix, name) + "." + e.Format
+	return b.Put(ctx, key, body, "application/x-ndjson", contentEncoding)
+}
+
+func requestRecords(logs []store.RequestLog) []requestRecord {
+	records := make([]requestRecord, len(logs))
+	for i, l := range logs {
+		records[i] = requestRecord{
+			ID:             l.ID,
+			Time:           l.CreatedAt.UTC(),
+			Domain:         l.Domain,
+			Method:         l.Method,
+			Path:           l.Path,
+			Status:         l.StatusCode,
+			DurationMs:     l.Duration.Milliseconds(),
+			RequestBytes:   l.RequestSize,
+			ResponseBytes:  l.ResponseSize,
+			RemoteIP:       l.RemoteIP,
+			TLSVersion:     l.TLSVersion,
+			ALPN:           l.ALPN,
+			TLSFingerprint: l.TLSFingerprint,
+			TunnelName:     l.TunnelName,
+			Labels:         l.Labels,
+			Region:         l.Region,
+		}
+	}
+	return records
+}
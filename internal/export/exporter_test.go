@@ -0,0 +1,179 @@
+// internal/export/exporter_test.go
+package export
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lobber-dev/lobber/internal/publicnet"
+	"github.com/lobber-dev/lobber/internal/store"
+)
+
+// fakeBucket records the objects put to it
+type fakeBucket struct {
+	mu      sync.Mutex
+	objects map[string]string // path -> body, decompressed
+	status  int
+}
+
+func (f *fakeBucket) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut || !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/") {
+		http.Error(w, "unsigned", http.StatusBadRequest)
+		return
+	}
+	if f.status != 0 {
+		w.WriteHeader(f.status)
+		io.WriteString(w, "<Error><Code>AccessDenied</Code></Error>")
+		return
+	}
+	var body io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		body = gz
+	}
+	data, _ := io.ReadAll(body)
+	f.mu.Lock()
+	f.objects[r.URL.Path] = string(data)
+	f.mu.Unlock()
+}
+
+func newTestExporter(t *testing.T, format string, status int) (*Exporter, *store.Memory, *fakeBucket) {
+	t.Helper()
+	bucket := &fakeBucket{objects: map[string]string{}, status: status}
+	srv := httptest.NewTLSServer(bucket)
+	t.Cleanup(srv.Close)
+
+	key := bytes.Repeat([]byte{7}, 32)
+	sealer, err := NewSealer(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, _ := sealer.Seal("secret")
+
+	mem := store.NewMemory()
+	ctx := context.Background()
+	mem.AddDomain("u1", store.Domain{Name: "app.example.com"})
+	mem.SetExport(ctx, store.Export{
+		UserID:          "u1",
+		Provider:        ProviderS3,
+		Endpoint:        srv.Listener.Addr().String(),
+		Region:          "us-east-1",
+		Bucket:          "warehouse",
+		Prefix:          "lobber",
+		AccessKeyID:     "AKID",
+		SecretSealed:    sealed,
+		Format:          format,
+		ExportedThrough: time.Date(2026, 10, 15, 22, 0, 0, 0, time.UTC),
+	})
+
+	at := func(h, m int) time.Time { return time.Date(2026, 10, 15, h, m, 0, 0, time.UTC) }
+	for _, l := range []store.RequestLog{
+		{Method: "GET", Path: "/", StatusCode: 200, CreatedAt: at(22, 10)},
+		{Method: "POST", Path: "/orders", StatusCode: 201, CreatedAt: at(22, 20)},
+		{Method: "GET", Path: "/missing", StatusCode: 404, CreatedAt: at(23, 30)},
+	} {
+		mem.LogRequest(ctx, "app.example.com", l)
+	}
+	session, _ := mem.StartTunnelSession(ctx, "app.example.com", "")
+	mem.SetClock(func() time.Time { return at(23, 0) })
+	mem.RecordBandwidth(ctx, "u1", session, 100, 200)
+
+	x := NewExporter(mem, sealer)
+	x.client = srv.Client()
+	x.now = func() time.Time { return time.Date(2026, 10, 16, 0, 30, 0, 0, time.UTC) }
+	return x, mem, bucket
+}
+
+func TestExporterRun(t *testing.T) {
+	x, mem, bucket := newTestExporter(t, FormatJSONL, 0)
+
+	n, err := x.Run(context.Background())
+	if err != nil || n != 3 {
+		t.Fatalf("Run() = %d, %v, want 3 objects", n, err)
+	}
+
+	lines := func(path string) []string {
+		return strings.Split(strings.TrimSpace(bucket.objects[path]), "\n")
+	}
+	if got := lines("/warehouse/lobber/requests/2026/10/15/22.jsonl"); len(got) != 2 || !strings.Contains(got[1], `"path":"/orders"`) {
+		t.Errorf("22:00 requests = %q, want 2 lines ending with /orders", got)
+	}
+	if got := lines("/warehouse/lobber/requests/2026/10/15/23.jsonl"); len(got) != 1 || !strings.Contains(got[0], `"status":404`) {
+		t.Errorf("23:00 requests = %q, want the 404", got)
+	}
+	usage := bucket.objects["/warehouse/lobber/usage/2026-10-15.jsonl"]
+	for _, want := range []string{`"domain":"app.example.com"`, `"bytes_in":100`, `"bytes_out":200`, `"requests":3`} {
+		if !strings.Contains(usage, want) {
+			t.Errorf("usage = %s, want %s", usage, want)
+		}
+	}
+
+	e, _ := mem.GetExport(context.Background(), "u1")
+	if want := time.Date(2026, 10, 16, 0, 0, 0, 0, time.UTC); !e.ExportedThrough.Equal(want) || e.LastError != "" {
+		t.Errorf("export = through %v, error %q, want through %v", e.ExportedThrough, e.LastError, want)
+	}
+
+	// Nothing new has settled, so another run writes nothing
+	if n, _ := x.Run(context.Background()); n != 0 {
+		t.Errorf("second Run() wrote %d objects, want 0", n)
+	}
+}
+
+func TestExporterGzip(t *testing.T) {
+	x, _, bucket := newTestExporter(t, FormatJSONLGzip, 0)
+	if _, err := x.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := bucket.objects["/warehouse/lobber/requests/2026/10/15/23.jsonl.gz"]; !strings.Contains(got, `"path":"/missing"`) {
+		t.Errorf("23:00 requests = %q, want the gzipped 404", got)
+	}
+}
+
+func TestExporterRecordsFailures(t *testing.T) {
+	x, mem, _ := newTestExporter(t, FormatJSONL, http.StatusForbidden)
+	if _, err := x.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	e, _ := mem.GetExport(context.Background(), "u1")
+	if !strings.Contains(e.LastError, "AccessDenied") {
+		t.Errorf("last error = %q, want the bucket's AccessDenied", e.LastError)
+	}
+	if want := time.Date(2026, 10, 15, 22, 0, 0, 0, time.UTC); !e.ExportedThrough.Equal(want) {
+		t.Errorf("exported through = %v, want it left at %v to retry", e.ExportedThrough, want)
+	}
+}
+
+func TestExporterRefusesPrivateHosts(t *testing.T) {
+	x, mem, bucket := newTestExporter(t, FormatJSONL, 0)
+	x.client = NewExporter(mem, nil).client
+
+	// A name passes validation, but it resolves to the relay's own network
+	ctx := context.Background()
+	e, _ := mem.GetExport(ctx, "u1")
+	_, port, _ := strings.Cut(e.Endpoint, ":")
+	e.Endpoint = "localhost:" + port
+	mem.SetExport(ctx, *e)
+
+	if n, err := x.Run(ctx); err != nil || n != 0 {
+		t.Fatalf("Run() = %d, %v, want nothing written", n, err)
+	}
+	if len(bucket.objects) != 0 {
+		t.Errorf("bucket got %d objects, want none", len(bucket.objects))
+	}
+	e, _ = mem.GetExport(ctx, "u1")
+	if !strings.Contains(e.LastError, publicnet.ErrPrivate.Error()) {
+		t.Errorf("last error = %q, want the address refused", e.LastError)
+	}
+}
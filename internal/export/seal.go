@@ -0,0 +1,74 @@
+// internal/export/seal.go
+package export
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// sealPrefix marks the format of a sealed secret, so the key or cipher can
+// change later
+const sealPrefix = "v1."
+
+// Sealer encrypts exports' secret keys at rest with AES-256-GCM
+type Sealer struct {
+	aead cipher.AEAD
+}
+
+// ParseKey reads a 32 byte key written as hex or base64
+func ParseKey(s string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	if key, err := hex.DecodeString(s); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(s); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	return nil, errors.New("want 32 random bytes as hex or base64, e.g. from `openssl rand -hex 32`")
+}
+
+// NewSealer returns a Sealer for a 32 byte key
+func NewSealer(key []byte) (*Sealer, error) {
+	if len(key) != 32 {
+		return nil, errors.New("export key: want 32 bytes")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("export key: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("export key: %w", err)
+	}
+	return &Sealer{aead: aead}, nil
+}
+
+// Seal encrypts secret
+func (s *Sealer) Seal(secret string) (string, error) {
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("seal: %w", err)
+	}
+	sealed := s.aead.Seal(nonce, nonce, []byte(secret), nil)
+	return sealPrefix + base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// Open decrypts a secret sealed with the same key
+func (s *Sealer) Open(sealed string) (string, error) {
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(sealed, sealPrefix))
+	if err != nil || !strings.HasPrefix(sealed, sealPrefix) || len(data) < s.aead.NonceSize() {
+		return "", errors.New("open sealed secret: malformed")
+	}
+	nonce, ciphertext := data[:s.aead.NonceSize()], data[s.aead.NonceSize():]
+	secret, err := s.aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", errors.New("open sealed secret: wrong key or corrupted")
+	}
+	return string(secret), nil
+}
@@ -0,0 +1,59 @@
+// internal/export/seal_test.go
+package export
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseKey(t *testing.T) {
+	tests := []struct {
+		in      string
+		wantErr bool
+	}{
+		{strings.Repeat("ab", 32), false},
+		{"q83vEjRWeJq83vEjRWeJq83vEjRWeJq83vEjRWeJq80=", false},
+		{strings.Repeat("ab", 16), true},
+		{"not a key", true},
+	}
+	for _, tt := range tests {
+		key, err := ParseKey(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseKey(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+		}
+		if err == nil && len(key) != 32 {
+			t.Errorf("ParseKey(%q) = %d bytes, want 32", tt.in, len(key))
+		}
+	}
+}
+
+func TestSealer(t *testing.T) {
+	key, _ := ParseKey(strings.Repeat("ab", 32))
+	s, err := NewSealer(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sealed, err := s.Seal("wJalrXUtnFEMI/K7MDENG")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(sealed, "wJalrXUtnFEMI") {
+		t.Fatalf("Seal() = %q, want the secret hidden", sealed)
+	}
+	if again, _ := s.Seal("wJalrXUtnFEMI/K7MDENG"); again == sealed {
+		t.Error("Seal() gave the same output twice, want a fresh nonce")
+	}
+	if got, err := s.Open(sealed); err != nil || got != "wJalrXUtnFEMI/K7MDENG" {
+		t.Errorf("Open() = %q, %v, want the secret back", got, err)
+	}
+
+	otherKey, _ := ParseKey(strings.Repeat("cd", 32))
+	other, _ := NewSealer(otherKey)
+	if _, err := other.Open(sealed); err == nil {
+		t.Error("Open() with another key succeeded")
+	}
+	if _, err := s.Open(sealed[:len(sealed)-4]); err == nil {
+		t.Error("Open() of a truncated secret succeeded")
+	}
+}
@@ -0,0 +1,141 @@
+// internal/forcehttps/forcehttps.go
+package forcehttps
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// MaxLength caps a policy's text
+const MaxLength = 100
+
+// DefaultMaxAge is how long, in days, browsers remember "hsts" without a
+// length: a year, as preload lists ask for
+const DefaultMaxAge = 365
+
+// Policy is how a domain keeps visitors on HTTPS. It is a comma-separated
+// list of options:
+//
+//	redirect    send visitors arriving over plain HTTP to https://
+//	hsts        tell browsers to use https:// for the next year
+//	hsts=30d    ... for 30 days instead
+//	subdomains  the HSTS policy covers subdomains too
+//	preload     ask to be preloaded in browsers; needs a year and subdomains
+//
+// For example "redirect, hsts" moves visitors over and keeps them there.
+type Policy struct {
+	Redirect   bool
+	MaxAge     int // days browsers remember to use https; 0 sends no HSTS
+	Subdomains bool
+	Preload    bool
+}
+
+// Parse reads a policy. An empty string is not a policy; callers treat it
+// as serving plain HTTP as it comes.
+func Parse(s string) (*Policy, error) {
+	s = strings.Join(strings.Fields(s), " ")
+	if s == "" {
+		return nil, fmt.Errorf("empty HTTPS policy")
+	}
+	if len(s) > MaxLength {
+		return nil, fmt.Errorf("HTTPS policy is longer than %d characters", MaxLength)
+	}
+
+	p := &Policy{}
+	for part := range strings.SplitSeq(s, ",") {
+		part = strings.ToLower(strings.TrimSpace(part))
+		switch {
+		case part == "redirect":
+			p.Redirect = true
+		case part == "hsts":
+			p.MaxAge = DefaultMaxAge
+		case strings.HasPrefix(part, "hsts="):
+			days, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(part, "hsts="), "d"))
+			if err != nil || !strings.HasSuffix(part, "d") || days < 1 || days > 2*DefaultMaxAge {
+				return nil, fmt.Errorf("invalid HSTS length %q, want days such as hsts=180d, at most %dd", part, 2*DefaultMaxAge)
+			}
+			p.MaxAge = days
+		case part == "subdomains":
+			p.Subdomains = true
+		case part == "preload":
+			p.Preload = true
+		default:
+			return nil, fmt.Errorf("unknown HTTPS option %q, want redirect, hsts, hsts=<days>d, subdomains or preload", part)
+		}
+	}
+	if (p.Subdomains || p.Preload) && p.MaxAge == 0 {
+		return nil, fmt.Errorf("subdomains and preload need hsts")
+	}
+	if p.Preload && (p.MaxAge < DefaultMaxAge || !p.Subdomains) {
+		return nil, fmt.Errorf("preload needs hsts for at least %d days and subdomains", DefaultMaxAge)
+	}
+	return p, nil
+}
+
+// String returns the policy with its options in a fixed order
+func (p *Policy) String() string {
+	var parts []string
+	if p.Redirect {
+		parts = append(parts, "redirect")
+	}
+	switch {
+	case p.MaxAge == DefaultMaxAge:
+		parts = append(parts, "hsts")
+	case p.MaxAge > 0:
+		parts = append(parts, "hsts="+strconv.Itoa(p.MaxAge)+"d")
+	}
+	if p.Subdomains {
+		parts = append(parts, "subdomains")
+	}
+	if p.Preload {
+		parts = append(parts, "preload")
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Header returns the Strict-Transport-Security value the policy sends, or
+// "" if it sends none
+func (p *Policy) Header() string {
+	if p.MaxAge == 0 {
+		return ""
+	}
+	v := "max-age=" + strconv.Itoa(p.MaxAge*24*60*60)
+	if p.Subdomains {
+		v += "; includeSubDomains"
+	}
+	if p.Preload {
+		v += "; preload"
+	}
+	return v
+}
+
+// Secure reports whether r reached the relay over TLS, directly or through
+// a proxy in front of it that says so
+func Secure(r *http.Request) bool {
+	return r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
+}
+
+// Enforce sends r to the same URL over https if the policy redirects and
+// r came over plain HTTP, and reports whether it did. Requests that may
+// carry a body get a 308, so browsers resend it; the rest get a 301.
+func (p *Policy) Enforce(w http.ResponseWriter, r *http.Request, hostname string) bool {
+	if !p.Redirect || Secure(r) {
+		return false
+	}
+	status := http.StatusMovedPermanently
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		status = http.StatusPermanentRedirect
+	}
+	http.Redirect(w, r, "https://"+hostname+r.URL.RequestURI(), status)
+	return true
+}
+
+// Apply adds the HSTS header to h for a response to r. Browsers ignore it
+// over plain HTTP, so it's only sent over TLS.
+func (p *Policy) Apply(h http.Header, r *http.Request) {
+	if v := p.Header(); v != "" && Secure(r) {
+		h.Set("Strict-Transport-Security", v)
+	}
+}
@@ -0,0 +1,98 @@
+// internal/forcehttps/forcehttps_test.go
+package forcehttps
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name       string
+		in         string
+		want       string
+		wantHeader string
+		wantErr    string
+	}{
+		{"redirect", "redirect", "redirect", "", ""},
+		{"hsts", " HSTS ,redirect", "redirect, hsts", "max-age=31536000", ""},
+		{"short hsts", "hsts=30d", "hsts=30d", "max-age=2592000", ""},
+		{"year spelled out", "hsts=365d", "hsts", "max-age=31536000", ""},
+		{"preload", "redirect, hsts, subdomains, preload", "redirect, hsts, subdomains, preload", "max-age=31536000; includeSubDomains; preload", ""},
+		{"blank", "  ", "", "", "empty HTTPS policy"},
+		{"unknown", "redirect, always", "", "", "unknown HTTPS option"},
+		{"bad length", "hsts=30", "", "", "invalid HSTS length"},
+		{"too long", "hsts=1000d", "", "", "invalid HSTS length"},
+		{"subdomains alone", "redirect, subdomains", "", "", "need hsts"},
+		{"short preload", "hsts=30d, subdomains, preload", "", "", "preload needs"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse(tt.in)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("Parse() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || got.String() != tt.want {
+				t.Fatalf("Parse() = %q, %v, want %q", got, err, tt.want)
+			}
+			if h := got.Header(); h != tt.wantHeader {
+				t.Errorf("Header() = %q, want %q", h, tt.wantHeader)
+			}
+		})
+	}
+}
+
+func TestEnforce(t *testing.T) {
+	p, err := Parse("redirect, hsts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name         string
+		method       string
+		tls          bool
+		forwarded    string
+		wantStatus   int // 0 when the request goes through
+		wantLocation string
+	}{
+		{"plain get", "GET", false, "", http.StatusMovedPermanently, "https://app.example.com/a?b=c"},
+		{"plain post", "POST", false, "", http.StatusPermanentRedirect, "https://app.example.com/a?b=c"},
+		{"tls", "GET", true, "", 0, ""},
+		{"behind a proxy", "GET", false, "https", 0, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "http://app.example.com:8080/a?b=c", nil)
+			if tt.tls {
+				req.TLS = &tls.ConnectionState{}
+			}
+			if tt.forwarded != "" {
+				req.Header.Set("X-Forwarded-Proto", tt.forwarded)
+			}
+			rec := httptest.NewRecorder()
+			redirected := p.Enforce(rec, req, "app.example.com")
+			if redirected != (tt.wantStatus != 0) {
+				t.Fatalf("Enforce() = %v, want %v", redirected, tt.wantStatus != 0)
+			}
+			if !redirected {
+				p.Apply(rec.Header(), req)
+				if got := rec.Header().Get("Strict-Transport-Security"); got != "max-age=31536000" {
+					t.Errorf("Strict-Transport-Security = %q, want max-age=31536000", got)
+				}
+				return
+			}
+			if rec.Code != tt.wantStatus || rec.Header().Get("Location") != tt.wantLocation {
+				t.Errorf("redirect = %d %q, want %d %q", rec.Code, rec.Header().Get("Location"), tt.wantStatus, tt.wantLocation)
+			}
+			if got := rec.Header().Get("Strict-Transport-Security"); got != "" {
+				t.Errorf("Strict-Transport-Security = %q over plain HTTP, want none", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,206 @@
+// internal/github/github.go
+package github
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultBaseURL is GitHub's REST API
+const DefaultBaseURL = "https://api.github.com"
+
+// CommentMarker starts every preview comment, so later runs for the same
+// pull request edit it instead of adding another
+const CommentMarker = "<!-- lobber-preview -->"
+
+// ErrInvalid wraps every validation failure
+var ErrInvalid = errors.New("invalid GitHub setting")
+
+var repoName = regexp.MustCompile(`^[A-Za-z0-9-]{1,39}/[A-Za-z0-9._-]{1,100}$`)
+
+// PR names a pull request, e.g. "lobber-dev/lobber#42"
+type PR struct {
+	Repo   string // owner/name
+	Number int
+}
+
+func (p PR) String() string {
+	return p.Repo + "#" + strconv.Itoa(p.Number)
+}
+
+// ParsePR reads a pull request written as "owner/name#42"
+func ParsePR(s string) (PR, error) {
+	repo, num, ok := strings.Cut(strings.TrimSpace(s), "#")
+	n, err := strconv.Atoi(num)
+	if !ok || err != nil || n < 1 || !repoName.MatchString(repo) {
+		return PR{}, fmt.Errorf("%w: pull request %q: want owner/repo#number", ErrInvalid, s)
+	}
+	return PR{Repo: repo, Number: n}, nil
+}
+
+// App is a GitHub App that comments on pull requests in the repositories
+// it's installed on
+type App struct {
+	ID  int64
+	Key *rsa.PrivateKey
+}
+
+// ParseApp checks an App's ID and the PEM private key GitHub generated for it
+func ParseApp(id int64, privateKey string) (*App, error) {
+	if id < 1 {
+		return nil, fmt.Errorf("%w: app ID is required", ErrInvalid)
+	}
+	block, _ := pem.Decode([]byte(strings.TrimSpace(privateKey)))
+	if block == nil {
+		return nil, fmt.Errorf("%w: private key must be the PEM file GitHub generated", ErrInvalid)
+	}
+	var key *rsa.PrivateKey
+	if k, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		key = k
+	} else if k, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		key, _ = k.(*rsa.PrivateKey)
+	}
+	if key == nil {
+		return nil, fmt.Errorf("%w: private key must be an RSA key", ErrInvalid)
+	}
+	return &App{ID: id, Key: key}, nil
+}
+
+// jwt signs the short-lived token an App authenticates as itself with
+func (a *App) jwt(now time.Time) (string, error) {
+	enc := base64.RawURLEncoding
+	header := enc.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`))
+	claims, err := json.Marshal(map[string]int64{
+		"iat": now.Add(-time.Minute).Unix(), // allow for clock drift
+		"exp": now.Add(9 * time.Minute).Unix(),
+		"iss": a.ID,
+	})
+	if err != nil {
+		return "", err
+	}
+	signing := header + "." + enc.EncodeToString(claims)
+	sum := sha256.Sum256([]byte(signing))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, a.Key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", fmt.Errorf("sign app token: %w", err)
+	}
+	return signing + "." + enc.EncodeToString(sig), nil
+}
+
+// Client calls GitHub's REST API
+type Client struct {
+	BaseURL string // DefaultBaseURL, or a GitHub Enterprise server's API
+	HTTP    *http.Client
+}
+
+// NewClient returns a Client for github.com
+func NewClient() *Client {
+	return &Client{BaseURL: DefaultBaseURL, HTTP: &http.Client{Timeout: 15 * time.Second}}
+}
+
+// InstallationToken returns a token acting as app's installation on repo,
+// good for an hour
+func (c *Client) InstallationToken(ctx context.Context, app *App, repo string) (string, error) {
+	appToken, err := app.jwt(time.Now())
+	if err != nil {
+		return "", err
+	}
+	var inst struct {
+		ID int64 `json:"id"`
+	}
+	if err := c.do(ctx, appToken, http.MethodGet, "/repos/"+repo+"/installation", nil, &inst); err != nil {
+		return "", fmt.Errorf("find app installation on %s: %w", repo, err)
+	}
+	var tok struct {
+		Token string `json:"token"`
+	}
+	if err := c.do(ctx, appToken, http.MethodPost, fmt.Sprintf("/app/installations/%d/access_tokens", inst.ID), nil, &tok); err != nil {
+		return "", fmt.Errorf("get installation token: %w", err)
+	}
+	return tok.Token, nil
+}
+
+// UpsertComment sets the body of the preview comment on pr, posting it if
+// there isn't one yet. body is prefixed with CommentMarker.
+func (c *Client) UpsertComment(ctx context.Context, token string, pr PR, body string) error {
+	body = CommentMarker + "\n" + body
+	var comments []struct {
+		ID   int64  `json:"id"`
+		Body string `json:"body"`
+	}
+	path := fmt.Sprintf("/repos/%s/issues/%d/comments", pr.Repo, pr.Number)
+	if err := c.do(ctx, token, http.MethodGet, path+"?per_page=100", nil, &comments); err != nil {
+		return fmt.Errorf("list comments on %s: %w", pr, err)
+	}
+	for _, existing := range comments {
+		if strings.HasPrefix(existing.Body, CommentMarker) {
+			if existing.Body == body {
+				return nil
+			}
+			err := c.do(ctx, token, http.MethodPatch, fmt.Sprintf("/repos/%s/issues/comments/%d", pr.Repo, existing.ID), map[string]string{"body": body}, nil)
+			if err != nil {
+				return fmt.Errorf("update comment on %s: %w", pr, err)
+			}
+			return nil
+		}
+	}
+	if err := c.do(ctx, token, http.MethodPost, path, map[string]string{"body": body}, nil); err != nil {
+		return fmt.Errorf("comment on %s: %w", pr, err)
+	}
+	return nil
+}
+
+// do sends an API request with body as JSON and decodes the answer into
+// out, turning error statuses into errors that quote GitHub
+func (c *Client) do(ctx context.Context, token, method, path string, body, out any) error {
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(c.BaseURL, "/")+path, reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("X-GitHub-Api-Version", "2022-11-28")
+
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		var e struct {
+			Message string `json:"message"`
+		}
+		json.NewDecoder(io.LimitReader(resp.Body, 4096)).Decode(&e)
+		return fmt.Errorf("GitHub returned %s: %s", resp.Status, e.Message)
+	}
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return fmt.Errorf("decode answer: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+// internal/github/github_test.go
+package github
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestParsePR(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    PR
+		wantErr bool
+	}{
+		{"lobber-dev/lobber#42", PR{Repo: "lobber-dev/lobber", Number: 42}, false},
+		{" acme/web.app#7 ", PR{Repo: "acme/web.app", Number: 7}, false},
+		{"lobber#42", PR{}, true},
+		{"a/b#0", PR{}, true},
+		{"a/b#x", PR{}, true},
+		{"a/b/c#1", PR{}, true},
+	}
+	for _, tt := range tests {
+		got, err := ParsePR(tt.in)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("ParsePR(%q) = %v, %v, want %v (error %v)", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func testKey(t *testing.T) (*rsa.PrivateKey, string) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	return key, string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}))
+}
+
+func TestParseApp(t *testing.T) {
+	_, pemKey := testKey(t)
+	if _, err := ParseApp(123, pemKey); err != nil {
+		t.Errorf("ParseApp() error = %v", err)
+	}
+	if _, err := ParseApp(0, pemKey); err == nil {
+		t.Error("ParseApp() without an ID succeeded")
+	}
+	if _, err := ParseApp(123, "not a key"); err == nil {
+		t.Error("ParseApp() with a bad key succeeded")
+	}
+}
+
+func TestPreviewComment(t *testing.T) {
+	key, pemKey := testKey(t)
+	app, _ := ParseApp(123, pemKey)
+
+	var mu sync.Mutex
+	var calls []string
+	comments := `[{"id":1,"body":"LGTM"}]`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		body, _ := io.ReadAll(r.Body)
+		calls = append(calls, r.Method+" "+r.URL.Path)
+		auth := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		switch r.Method + " " + r.URL.Path {
+		case "GET /repos/acme/web/installation":
+			if err := verifyJWT(auth, &key.PublicKey); err != nil {
+				http.Error(w, `{"message":"bad JWT"}`, http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte(`{"id":77}`))
+		case "POST /app/installations/77/access_tokens":
+			w.Write([]byte(`{"token":"ghs_install"}`))
+		case "GET /repos/acme/web/issues/5/comments":
+			w.Write([]byte(comments))
+		case "POST /repos/acme/web/issues/5/comments", "PATCH /repos/acme/web/issues/comments/2":
+			if auth != "ghs_install" {
+				http.Error(w, `{"message":"Bad credentials"}`, http.StatusUnauthorized)
+				return
+			}
+			var c struct{ Body string }
+			json.Unmarshal(body, &c)
+			comments = `[{"id":1,"body":"LGTM"},{"id":2,"body":` + jsonQuote(c.Body) + `}]`
+			w.Write([]byte(`{}`))
+		default:
+			http.Error(w, `{"message":"Not Found"}`, http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	c := &Client{BaseURL: srv.URL, HTTP: srv.Client()}
+	ctx := context.Background()
+	pr := PR{Repo: "acme/web", Number: 5}
+
+	token, err := c.InstallationToken(ctx, app, pr.Repo)
+	if err != nil || token != "ghs_install" {
+		t.Fatalf("InstallationToken() = %q, %v, want ghs_install", token, err)
+	}
+
+	// Posted once, edited when the link changes and left alone when it doesn't
+	for _, body := range []string{"Preview: https://a.example.com/", "Preview: https://b.example.com/", "Preview: https://b.example.com/"} {
+		if err := c.UpsertComment(ctx, token, pr, body); err != nil {
+			t.Fatalf("UpsertComment(%q) error = %v", body, err)
+		}
+	}
+	want := []string{
+		"GET /repos/acme/web/installation",
+		"POST /app/installations/77/access_tokens",
+		"GET /repos/acme/web/issues/5/comments",
+		"POST /repos/acme/web/issues/5/comments",
+		"GET /repos/acme/web/issues/5/comments",
+		"PATCH /repos/acme/web/issues/comments/2",
+		"GET /repos/acme/web/issues/5/comments",
+	}
+	if strings.Join(calls, "\n") != strings.Join(want, "\n") {
+		t.Errorf("calls =\n%s\nwant\n%s", strings.Join(calls, "\n"), strings.Join(want, "\n"))
+	}
+
+	err = c.UpsertComment(ctx, "ghs_wrong", PR{Repo: "acme/other", Number: 1}, "x")
+	if err == nil || !strings.Contains(err.Error(), "Not Found") {
+		t.Errorf("UpsertComment() on an unknown repo error = %v, want GitHub's message", err)
+	}
+}
+
+func jsonQuote(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
+
+// verifyJWT checks an App token's signature and issuer
+func verifyJWT(token string, pub *rsa.PublicKey) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return io.ErrUnexpectedEOF
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, sum[:], sig); err != nil {
+		return err
+	}
+	claims, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	var c struct {
+		Iss int64 `json:"iss"`
+	}
+	if err := json.Unmarshal(claims, &c); err != nil || c.Iss != 123 {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+// internal/listing/listing.go
+package listing
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Every list endpoint takes the same query parameters:
+//
+//	limit=N          how many items a page holds
+//	sort=field       order by field, ascending; -field for descending
+//	cursor=...       the next_cursor of the previous page
+//	<filter>=value   only items matching, for the filters the endpoint has
+//
+// Cursors are opaque and only valid with the sort they were made for. They
+// name the last item of a page rather than an offset, so items added or
+// removed in the meantime don't shift the next page.
+
+// Spec is what a list endpoint lets clients sort and filter by
+type Spec[T any] struct {
+	DefaultLimit int
+	MaxLimit     int
+	DefaultSort  string // e.g. "-created_at"
+
+	// Sorts maps each sortable field to a key that orders items as text.
+	// String, Time and Int make keys for common types.
+	Sorts map[string]func(T) string
+	// Filters maps each filter parameter to whether an item matches it
+	Filters map[string]func(item T, value string) bool
+	// ID tells items apart, breaking ties between equal sort keys
+	ID func(T) string
+}
+
+// Page is one page of a list
+type Page[T any] struct {
+	Items []T
+	Next  string // cursor for the next page; empty on the last one
+}
+
+// ErrInvalidCursor is returned for cursors that weren't made by List
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// List filters, sorts and pages items by the list parameters in q. Its
+// errors describe the bad parameter and are meant for the client.
+func (s Spec[T]) List(items []T, q url.Values) (Page[T], error) {
+	limit := s.DefaultLimit
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > s.MaxLimit {
+			return Page[T]{}, fmt.Errorf("limit must be between 1 and %d", s.MaxLimit)
+		}
+		limit = n
+	}
+
+	order := s.DefaultSort
+	if v := q.Get("sort"); v != "" {
+		order = v
+	}
+	field, desc := strings.CutPrefix(order, "-")
+	key, ok := s.Sorts[field]
+	if !ok {
+		return Page[T]{}, fmt.Errorf("sort must be one of %s", strings.Join(s.sortNames(), ", "))
+	}
+
+	var after *entry
+	if v := q.Get("cursor"); v != "" {
+		c, err := decodeCursor(v, order)
+		if err != nil {
+			return Page[T]{}, err
+		}
+		after = &c
+	}
+
+	entries := make([]entry, 0, len(items))
+	for i, item := range items {
+		if s.matches(item, q) {
+			entries = append(entries, entry{key: key(item), id: s.ID(item), index: i})
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if desc {
+			return entries[j].less(entries[i])
+		}
+		return entries[i].less(entries[j])
+	})
+
+	start := 0
+	if after != nil {
+		start = sort.Search(len(entries), func(i int) bool {
+			if desc {
+				return entries[i].less(*after)
+			}
+			return after.less(entries[i])
+		})
+	}
+	end := min(start+limit, len(entries))
+
+	page := Page[T]{Items: make([]T, 0, end-start)}
+	for _, e := range entries[start:end] {
+		page.Items = append(page.Items, items[e.index])
+	}
+	if end < len(entries) {
+		page.Next = encodeCursor(order, entries[end-1])
+	}
+	return page, nil
+}
+
+// matches reports whether item passes every filter set in q
+func (s Spec[T]) matches(item T, q url.Values) bool {
+	for name, match := range s.Filters {
+		if v := q.Get(name); v != "" && !match(item, v) {
+			return false
+		}
+	}
+	return true
+}
+
+// sortNames lists the accepted values of sort
+func (s Spec[T]) sortNames() []string {
+	var names []string
+	for field := range s.Sorts {
+		names = append(names, field, "-"+field)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// entry is an item's place in the sorted list
+type entry struct {
+	key   string
+	id    string
+	index int
+}
+
+func (e entry) less(o entry) bool {
+	if e.key != o.key {
+		return e.key < o.key
+	}
+	return e.id < o.id
+}
+
+// encodeCursor names e as the last item seen under order
+func encodeCursor(order string, e entry) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(order + "\n" + e.key + "\n" + e.id))
+}
+
+func decodeCursor(s, order string) (entry, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return entry{}, ErrInvalidCursor
+	}
+	parts := strings.SplitN(string(b), "\n", 3)
+	if len(parts) != 3 {
+		return entry{}, ErrInvalidCursor
+	}
+	if parts[0] != order {
+		return entry{}, fmt.Errorf("cursor is for sort=%s, not %s", parts[0], order)
+	}
+	return entry{key: parts[1], id: parts[2]}, nil
+}
+
+// String is a case-insensitive sort key
+func String(s string) string {
+	return strings.ToLower(s)
+}
+
+// Time is a sort key that orders times; the zero time sorts first
+func Time(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format("2006-01-02T15:04:05.000000000")
+}
+
+// Int is a sort key that orders non-negative numbers
+func Int(n int64) string {
+	return fmt.Sprintf("%020d", max(n, 0))
+}
+
+// Contains is a filter matching fields that contain the value, ignoring case
+func Contains(field, value string) bool {
+	return strings.Contains(strings.ToLower(field), strings.ToLower(value))
+}
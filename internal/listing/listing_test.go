@@ -0,0 +1,117 @@
+// internal/listing/listing_test.go
+package listing
+
+import (
+	"errors"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+type item struct {
+	id      string
+	name    string
+	created time.Time
+}
+
+var spec = Spec[item]{
+	DefaultLimit: 2,
+	MaxLimit:     3,
+	DefaultSort:  "-created_at",
+	Sorts: map[string]func(item) string{
+		"name":       func(i item) string { return String(i.name) },
+		"created_at": func(i item) string { return Time(i.created) },
+	},
+	Filters: map[string]func(item, string) bool{
+		"q": func(i item, v string) bool { return Contains(i.name, v) },
+	},
+	ID: func(i item) string { return i.id },
+}
+
+func TestList(t *testing.T) {
+	day := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	items := []item{
+		{"a", "beta", day},
+		{"b", "Alpha", day.Add(time.Hour)},
+		{"c", "gamma", day.Add(2 * time.Hour)},
+		{"d", "alpha-2", day.Add(2 * time.Hour)},
+		{"e", "delta", day.Add(3 * time.Hour)},
+	}
+
+	// all walks every page of the list, returning the IDs in order
+	all := func(t *testing.T, query string) []string {
+		t.Helper()
+		q, _ := url.ParseQuery(query)
+		var ids []string
+		for range len(items) + 1 {
+			page, err := spec.List(items, q)
+			if err != nil {
+				t.Fatalf("List(%s) error = %v", q.Encode(), err)
+			}
+			for _, i := range page.Items {
+				ids = append(ids, i.id)
+			}
+			if page.Next == "" {
+				return ids
+			}
+			q.Set("cursor", page.Next)
+		}
+		t.Fatal("List() never reached the last page")
+		return nil
+	}
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{"e", "d", "c", "b", "a"}},
+		{"sort=created_at", []string{"a", "b", "c", "d", "e"}},
+		{"sort=name&limit=3", []string{"b", "d", "a", "e", "c"}},
+		{"sort=-name&limit=1", []string{"c", "e", "a", "d", "b"}},
+		{"q=ALPHA", []string{"d", "b"}},
+		{"q=zeta", nil},
+		{"other=ignored", []string{"e", "d", "c", "b", "a"}},
+	}
+	for _, tt := range tests {
+		if got := all(t, tt.query); !slices.Equal(got, tt.want) {
+			t.Errorf("List(%s) = %v, want %v", tt.query, got, tt.want)
+		}
+	}
+
+	// A cursor names the last item, so deleting it doesn't skip the next one
+	q := url.Values{}
+	page, _ := spec.List(items, q)
+	q.Set("cursor", page.Next)
+	page, _ = spec.List(slices.Delete(slices.Clone(items), 3, 4), q)
+	if len(page.Items) == 0 || page.Items[0].id != "c" {
+		t.Errorf("page after a deleted item = %v, want it to start at c", page.Items)
+	}
+}
+
+func TestListErrors(t *testing.T) {
+	items := []item{{"a", "a", time.Now()}, {"b", "b", time.Now()}, {"c", "c", time.Now()}}
+	page, _ := spec.List(items, url.Values{})
+
+	tests := []struct {
+		query   url.Values
+		wantErr string
+	}{
+		{url.Values{"limit": {"0"}}, "limit must be between 1 and 3"},
+		{url.Values{"limit": {"4"}}, "limit must be between 1 and 3"},
+		{url.Values{"sort": {"size"}}, "sort must be one of -created_at, -name, created_at, name"},
+		{url.Values{"cursor": {"!!"}}, ErrInvalidCursor.Error()},
+		{url.Values{"cursor": {"bm9wZQ"}}, ErrInvalidCursor.Error()},
+		{url.Values{"cursor": {page.Next}, "sort": {"name"}}, "cursor is for sort=-created_at"},
+	}
+	for _, tt := range tests {
+		_, err := spec.List(items, tt.query)
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("List(%s) error = %v, want %q", tt.query.Encode(), err, tt.wantErr)
+		}
+	}
+	if _, err := spec.List(items, url.Values{"cursor": {"!!"}}); !errors.Is(err, ErrInvalidCursor) {
+		t.Errorf("List() error = %v, want ErrInvalidCursor", err)
+	}
+}
@@ -0,0 +1,89 @@
+// internal/notify/notify.go
+package notify
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/smtp"
+	"os"
+	"strings"
+)
+
+// Message is a user-facing notification
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Notifier delivers messages to users
+type Notifier interface {
+	Send(ctx context.Context, msg *Message) error
+}
+
+// LogNotifier writes messages to the process log instead of delivering them.
+// It is the fallback when no mail transport is configured.
+type LogNotifier struct{}
+
+// Send logs the message
+func (LogNotifier) Send(ctx context.Context, msg *Message) error {
+	log.Printf("notify: to=%s subject=%q", msg.To, msg.Subject)
+	return nil
+}
+
+// SMTPNotifier sends messages as plain-text email
+type SMTPNotifier struct {
+	Addr     string // host:port of the SMTP server
+	From     string
+	Username string
+	Password string
+}
+
+// Send delivers the message over SMTP
+func (n *SMTPNotifier) Send(ctx context.Context, msg *Message) error {
+	if msg.To == "" {
+		return fmt.Errorf("send mail: missing recipient")
+	}
+
+	var auth smtp.Auth
+	if n.Username != "" {
+		host, _, _ := strings.Cut(n.Addr, ":")
+		auth = smtp.PlainAuth("", n.Username, n.Password, host)
+	}
+
+	if err := smtp.SendMail(n.Addr, auth, n.From, []string{msg.To}, formatMail(n.From, msg)); err != nil {
+		return fmt.Errorf("send mail: %w", err)
+	}
+	return nil
+}
+
+// FromEnv returns an SMTPNotifier when SMTP_ADDR is set, otherwise a LogNotifier
+func FromEnv() Notifier {
+	addr := os.Getenv("SMTP_ADDR")
+	if addr == "" {
+		return LogNotifier{}
+	}
+	from := os.Getenv("SMTP_FROM")
+	if from == "" {
+		from = "Lobber <noreply@lobber.dev>"
+	}
+	return &SMTPNotifier{
+		Addr:     addr,
+		From:     from,
+		Username: os.Getenv("SMTP_USERNAME"),
+		Password: os.Getenv("SMTP_PASSWORD"),
+	}
+}
+
+func formatMail(from string, msg *Message) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", msg.Subject)
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(msg.Body)
+	return []byte(b.String())
+}
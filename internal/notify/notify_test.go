@@ -0,0 +1,44 @@
+package notify
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFromEnvFallsBackToLog(t *testing.T) {
+	t.Setenv("SMTP_ADDR", "")
+
+	if _, ok := FromEnv().(LogNotifier); !ok {
+		t.Error("FromEnv() without SMTP_ADDR should return LogNotifier")
+	}
+}
+
+func TestFromEnvSMTP(t *testing.T) {
+	t.Setenv("SMTP_ADDR", "smtp.example.com:587")
+	t.Setenv("SMTP_FROM", "")
+
+	n, ok := FromEnv().(*SMTPNotifier)
+	if !ok {
+		t.Fatal("FromEnv() with SMTP_ADDR should return *SMTPNotifier")
+	}
+	if n.Addr != "smtp.example.com:587" {
+		t.Errorf("Addr = %q, want %q", n.Addr, "smtp.example.com:587")
+	}
+	if n.From == "" {
+		t.Error("From should have a default")
+	}
+}
+
+func TestFormatMail(t *testing.T) {
+	data := string(formatMail("a@example.com", &Message{
+		To:      "b@example.com",
+		Subject: "Usage warning",
+		Body:    "hello",
+	}))
+
+	for _, want := range []string{"From: a@example.com\r\n", "To: b@example.com\r\n", "Subject: Usage warning\r\n", "\r\n\r\nhello"} {
+		if !strings.Contains(data, want) {
+			t.Errorf("mail missing %q:\n%s", want, data)
+		}
+	}
+}
@@ -0,0 +1,373 @@
+// internal/oidc/oidc.go
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// clockSkew is how far the provider's clock may be ahead of ours
+	clockSkew = time.Minute
+
+	// keyRefetchInterval limits how often an unknown key ID makes the
+	// provider's keys be fetched again, so forged tokens can't hammer it
+	keyRefetchInterval = time.Minute
+
+	// maxResponseSize caps what is read from the provider
+	maxResponseSize = 1 << 20
+)
+
+// Connection routes the users of an email domain to their company's
+// identity provider, and the team account they sign in to
+type Connection struct {
+	Domain       string `yaml:"domain"` // email domain, such as acme.com
+	Org          string `yaml:"org"`    // ID of the team owner's account that new users join
+	Issuer       string `yaml:"issuer"` // such as https://acme.okta.com
+	ClientID     string `yaml:"client_id"`
+	ClientSecret string `yaml:"client_secret"`
+}
+
+// ParseConnections reads a YAML list of connections, each with every field
+// set and a domain of its own
+func ParseConnections(data []byte) ([]Connection, error) {
+	var conns []Connection
+	if err := yaml.Unmarshal(data, &conns); err != nil {
+		return nil, fmt.Errorf("parse connections: %w", err)
+	}
+	seen := make(map[string]bool)
+	for i, c := range conns {
+		c.Domain = strings.ToLower(strings.TrimSpace(c.Domain))
+		if c.Domain == "" || c.Org == "" || c.ClientID == "" || c.ClientSecret == "" {
+			return nil, fmt.Errorf("connection %d: domain, org, issuer, client_id and client_secret are required", i+1)
+		}
+		if u, err := url.Parse(c.Issuer); err != nil || u.Scheme != "https" || u.Host == "" {
+			return nil, fmt.Errorf("connection %s: issuer must be an https URL", c.Domain)
+		}
+		if seen[c.Domain] {
+			return nil, fmt.Errorf("connection %s: domain listed twice", c.Domain)
+		}
+		seen[c.Domain] = true
+		conns[i] = c
+	}
+	return conns, nil
+}
+
+// Claims are what an ID token says about the user who signed in
+type Claims struct {
+	Subject string
+	Email   string
+	Name    string
+}
+
+// Provider signs a Connection's users in with the authorization code flow.
+// Its configuration and signing keys are fetched on first use.
+type Provider struct {
+	Connection
+	client *http.Client
+	now    func() time.Time
+
+	mu          sync.Mutex
+	config      *discovery
+	keys        map[string]crypto.PublicKey
+	keysFetched time.Time
+}
+
+// NewProvider creates a provider for conn, fetching from it with client
+func NewProvider(conn Connection, client *http.Client) *Provider {
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	return &Provider{Connection: conn, client: client, now: time.Now}
+}
+
+// discovery is the part of the provider's configuration document we use
+type discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// discover fetches the provider's configuration, once
+func (p *Provider) discover(ctx context.Context) (*discovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.config != nil {
+		return p.config, nil
+	}
+	var d discovery
+	if err := p.getJSON(ctx, strings.TrimSuffix(p.Issuer, "/")+"/.well-known/openid-configuration", &d); err != nil {
+		return nil, fmt.Errorf("discover %s: %w", p.Issuer, err)
+	}
+	if d.Issuer != p.Issuer {
+		return nil, fmt.Errorf("discover %s: configuration is for issuer %q", p.Issuer, d.Issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, fmt.Errorf("discover %s: configuration is missing endpoints", p.Issuer)
+	}
+	p.config = &d
+	return p.config, nil
+}
+
+// AuthURL is where to send the user to sign in. The provider sends them
+// back to redirectURI with state and a code for Exchange; loginHint
+// pre-fills their email.
+func (p *Provider) AuthURL(ctx context.Context, redirectURI, state, nonce, loginHint string) (string, error) {
+	d, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	q := url.Values{
+		"response_type": {"code"},
+		"client_id":     {p.ClientID},
+		"redirect_uri":  {redirectURI},
+		"scope":         {"openid email profile"},
+		"state":         {state},
+		"nonce":         {nonce},
+	}
+	if loginHint != "" {
+		q.Set("login_hint", loginHint)
+	}
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return d.AuthorizationEndpoint + sep + q.Encode(), nil
+}
+
+// Exchange trades the code the provider sent the user back with for an ID
+// token, and returns its verified claims
+func (p *Provider) Exchange(ctx context.Context, code, redirectURI, nonce string) (*Claims, error) {
+	d, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {redirectURI},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("build token request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("exchange code: %w", err)
+	}
+	defer resp.Body.Close()
+	var body struct {
+		IDToken     string `json:"id_token"`
+		Error       string `json:"error"`
+		Description string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize)).Decode(&body); err != nil {
+		return nil, fmt.Errorf("exchange code: %s: %w", resp.Status, err)
+	}
+	if body.Error != "" {
+		return nil, fmt.Errorf("exchange code: %s: %s", body.Error, body.Description)
+	}
+	if resp.StatusCode != http.StatusOK || body.IDToken == "" {
+		return nil, fmt.Errorf("exchange code: %s without an ID token", resp.Status)
+	}
+	return p.Verify(ctx, body.IDToken, nonce)
+}
+
+// audience is an ID token's aud, which may be one string or several
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var one string
+	if err := json.Unmarshal(b, &one); err == nil {
+		*a = audience{one}
+		return nil
+	}
+	return json.Unmarshal(b, (*[]string)(a))
+}
+
+// Verify checks an ID token's signature against the provider's keys, and
+// that it was issued by the provider to us for this sign-in and hasn't
+// expired
+func (p *Provider) Verify(ctx context.Context, raw, nonce string) (*Claims, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("verify id token: not a JWT")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("verify id token: header: %w", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("verify id token: signature: %w", err)
+	}
+	key, err := p.key(ctx, header.Kid)
+	if err != nil {
+		return nil, fmt.Errorf("verify id token: %w", err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if !verifySignature(header.Alg, key, digest[:], sig) {
+		return nil, errors.New("verify id token: bad signature")
+	}
+
+	var c struct {
+		Issuer   string   `json:"iss"`
+		Subject  string   `json:"sub"`
+		Audience audience `json:"aud"`
+		Expiry   int64    `json:"exp"`
+		Nonce    string   `json:"nonce"`
+		Email    string   `json:"email"`
+		Name     string   `json:"name"`
+	}
+	if err := decodeSegment(parts[1], &c); err != nil {
+		return nil, fmt.Errorf("verify id token: claims: %w", err)
+	}
+	switch {
+	case c.Issuer != p.Issuer:
+		return nil, fmt.Errorf("verify id token: issued by %q", c.Issuer)
+	case !slices.Contains(c.Audience, p.ClientID):
+		return nil, errors.New("verify id token: issued to another client")
+	case p.now().After(time.Unix(c.Expiry, 0).Add(clockSkew)):
+		return nil, errors.New("verify id token: expired")
+	case c.Nonce != nonce:
+		return nil, errors.New("verify id token: nonce mismatch")
+	case c.Subject == "":
+		return nil, errors.New("verify id token: no subject")
+	}
+	return &Claims{Subject: c.Subject, Email: c.Email, Name: c.Name}, nil
+}
+
+// verifySignature checks sig over digest with key, for the algorithms
+// providers sign ID tokens with
+func verifySignature(alg string, key crypto.PublicKey, digest, sig []byte) bool {
+	switch alg {
+	case "RS256":
+		pub, ok := key.(*rsa.PublicKey)
+		return ok && rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest, sig) == nil
+	case "ES256":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(sig) != 64 {
+			return false
+		}
+		r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+		return ecdsa.Verify(pub, digest, r, s)
+	}
+	return false
+}
+
+// key returns the provider's signing key with kid, fetching its keys again
+// if it has rotated to one we haven't seen
+func (p *Provider) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	d, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if k, ok := p.keys[kid]; ok {
+		return k, nil
+	}
+	if p.keys != nil && p.now().Sub(p.keysFetched) < keyRefetchInterval {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := p.getJSON(ctx, d.JWKSURI, &set); err != nil {
+		return nil, fmt.Errorf("fetch signing keys: %w", err)
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		switch {
+		case k.Kty == "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(k.N)
+			e, errE := base64.RawURLEncoding.DecodeString(k.E)
+			if errN != nil || errE != nil || len(e) > 4 {
+				continue
+			}
+			keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case k.Kty == "EC" && k.Crv == "P-256":
+			x, errX := base64.RawURLEncoding.DecodeString(k.X)
+			y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+			if errX != nil || errY != nil {
+				continue
+			}
+			pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+			if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+				continue
+			}
+			keys[k.Kid] = pub
+		}
+	}
+	p.keys, p.keysFetched = keys, p.now()
+	if k, ok := keys[kid]; ok {
+		return k, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// getJSON fetches url into v
+func (p *Provider) getJSON(ctx context.Context, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize)).Decode(v)
+}
+
+// decodeSegment decodes one base64url JSON part of a JWT into v
+func decodeSegment(seg string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
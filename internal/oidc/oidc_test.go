@@ -0,0 +1,186 @@
+// internal/oidc/oidc_test.go
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testIdP is an identity provider that issues the ID token its test sets
+type testIdP struct {
+	*httptest.Server
+	rsaKey  *rsa.PrivateKey
+	ecKey   *ecdsa.PrivateKey
+	claims  map[string]any
+	alg     string
+	kid     string
+	fetches int
+}
+
+func newTestIdP(t *testing.T) *testIdP {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &testIdP{rsaKey: rsaKey, ecKey: ecKey, alg: "RS256", kid: "rsa-1"}
+	b64 := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.URL,
+			"authorization_endpoint": idp.URL + "/authorize",
+			"token_endpoint":         idp.URL + "/token",
+			"jwks_uri":               idp.URL + "/keys",
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		idp.fetches++
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{
+			{"kty": "RSA", "kid": "rsa-1", "use": "sig", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+			{"kty": "EC", "kid": "ec-1", "crv": "P-256", "x": b64(ecKey.X.FillBytes(make([]byte, 32))), "y": b64(ecKey.Y.FillBytes(make([]byte, 32)))},
+		}})
+	})
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		id, secret, _ := r.BasicAuth()
+		if id != "lobber" || secret != "s3cret" || r.PostFormValue("code") != "good-code" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant", "error_description": "bad code"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": idp.token(t)})
+	})
+	idp.Server = httptest.NewServer(mux)
+	t.Cleanup(idp.Close)
+	return idp
+}
+
+// token signs the IdP's claims with its key for alg
+func (idp *testIdP) token(t *testing.T) string {
+	enc := func(v any) string {
+		b, _ := json.Marshal(v)
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	signed := enc(map[string]string{"alg": idp.alg, "kid": idp.kid}) + "." + enc(idp.claims)
+	digest := sha256.Sum256([]byte(signed))
+	var sig []byte
+	var err error
+	if idp.alg == "ES256" {
+		r, s, e := ecdsa.Sign(rand.Reader, idp.ecKey, digest[:])
+		sig, err = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...), e
+	} else {
+		sig, err = rsa.SignPKCS1v15(rand.Reader, idp.rsaKey, crypto.SHA256, digest[:])
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestParseConnections(t *testing.T) {
+	tests := []struct {
+		name    string
+		yaml    string
+		wantErr bool
+	}{
+		{"valid", "- {domain: Acme.com, org: u1, issuer: 'https://idp.acme.com', client_id: a, client_secret: b}", false},
+		{"missing secret", "- {domain: acme.com, org: u1, issuer: 'https://idp.acme.com', client_id: a}", true},
+		{"http issuer", "- {domain: acme.com, org: u1, issuer: 'http://idp.acme.com', client_id: a, client_secret: b}", true},
+		{"duplicate domain", "- {domain: acme.com, org: u1, issuer: 'https://a.com', client_id: a, client_secret: b}\n- {domain: ACME.com, org: u2, issuer: 'https://b.com', client_id: a, client_secret: b}", true},
+		{"not a list", "domain: acme.com", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conns, err := ParseConnections([]byte(tt.yaml))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseConnections() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && conns[0].Domain != "acme.com" {
+				t.Errorf("Domain = %q, want acme.com", conns[0].Domain)
+			}
+		})
+	}
+}
+
+func TestProviderSignIn(t *testing.T) {
+	idp := newTestIdP(t)
+	p := NewProvider(Connection{Domain: "acme.com", Issuer: idp.URL, ClientID: "lobber", ClientSecret: "s3cret"}, idp.Client())
+	ctx := context.Background()
+
+	authURL, err := p.AuthURL(ctx, "https://lobber.dev/dashboard/sso/callback", "state-1", "nonce-1", "ada@acme.com")
+	if err != nil {
+		t.Fatalf("AuthURL() error = %v", err)
+	}
+	u, _ := url.Parse(authURL)
+	if q := u.Query(); u.Path != "/authorize" || q.Get("state") != "state-1" || q.Get("nonce") != "nonce-1" || q.Get("login_hint") != "ada@acme.com" {
+		t.Errorf("AuthURL() = %s, want the authorize endpoint with state, nonce and hint", authURL)
+	}
+
+	valid := func() map[string]any {
+		return map[string]any{
+			"iss": idp.URL, "sub": "00u1", "aud": "lobber", "nonce": "nonce-1",
+			"exp": time.Now().Add(time.Hour).Unix(), "email": "ada@acme.com", "name": "Ada",
+		}
+	}
+	tests := []struct {
+		name    string
+		alg     string
+		kid     string
+		code    string
+		change  func(map[string]any)
+		wantErr string
+	}{
+		{"rs256", "RS256", "rsa-1", "good-code", nil, ""},
+		{"es256", "ES256", "ec-1", "good-code", nil, ""},
+		{"audience list", "RS256", "rsa-1", "good-code", func(c map[string]any) { c["aud"] = []string{"other", "lobber"} }, ""},
+		{"bad code", "RS256", "rsa-1", "bad-code", nil, "invalid_grant"},
+		{"other issuer", "RS256", "rsa-1", "good-code", func(c map[string]any) { c["iss"] = "https://evil.example.com" }, "issued by"},
+		{"other client", "RS256", "rsa-1", "good-code", func(c map[string]any) { c["aud"] = "other" }, "another client"},
+		{"expired", "RS256", "rsa-1", "good-code", func(c map[string]any) { c["exp"] = time.Now().Add(-time.Hour).Unix() }, "expired"},
+		{"replayed", "RS256", "rsa-1", "good-code", func(c map[string]any) { c["nonce"] = "nonce-0" }, "nonce"},
+		{"wrong key type", "ES256", "rsa-1", "good-code", nil, "bad signature"},
+		{"unknown key", "RS256", "rsa-2", "good-code", nil, "unknown signing key"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			idp.claims, idp.alg, idp.kid = valid(), tt.alg, tt.kid
+			if tt.change != nil {
+				tt.change(idp.claims)
+			}
+			claims, err := p.Exchange(ctx, tt.code, "https://lobber.dev/dashboard/sso/callback", "nonce-1")
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("Exchange() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || claims.Subject != "00u1" || claims.Email != "ada@acme.com" || claims.Name != "Ada" {
+				t.Errorf("Exchange() = %+v, %v, want Ada's claims", claims, err)
+			}
+		})
+	}
+
+	// Unknown key IDs don't refetch the keys on every token
+	if idp.fetches != 1 {
+		t.Errorf("keys fetched %d times, want 1", idp.fetches)
+	}
+}
@@ -0,0 +1,82 @@
+// internal/proxyerr/proxyerr.go
+package proxyerr
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// DefaultSize is how many errors a Ring keeps unless told otherwise
+const DefaultSize = 20
+
+// maxCause caps the text kept of an error
+const maxCause = 500
+
+// Entry is one request a tunnel failed to proxy, or a failure of the tunnel
+// itself such as a frame that wouldn't decode, which has no request
+type Entry struct {
+	At     time.Time `json:"at"`
+	Method string    `json:"method,omitempty"`
+	Path   string    `json:"path,omitempty"`
+	Status int       `json:"status,omitempty"` // what the visitor got; 0 if no request failed
+	Cause  string    `json:"cause"`
+}
+
+// Ring keeps a tunnel's latest errors in memory, so failures can be looked
+// into after the fact without a log search. The zero value keeps
+// DefaultSize errors; a nil Ring keeps none.
+type Ring struct {
+	mu      sync.Mutex
+	size    int
+	sized   bool
+	entries []Entry // oldest first
+}
+
+// SetSize has r keep the latest n errors, dropping older ones now if it
+// holds more. Zero or less keeps none.
+func (r *Ring) SetSize(n int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.size, r.sized = max(n, 0), true
+	r.trimLocked()
+}
+
+// Add records e, stamping it with the time if it has none
+func (r *Ring) Add(e Entry) {
+	if r == nil {
+		return
+	}
+	if e.At.IsZero() {
+		e.At = time.Now()
+	}
+	if len(e.Cause) > maxCause {
+		e.Cause = e.Cause[:maxCause]
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries = append(r.entries, e)
+	r.trimLocked()
+}
+
+func (r *Ring) trimLocked() {
+	size := r.size
+	if !r.sized {
+		size = DefaultSize
+	}
+	if over := len(r.entries) - size; over > 0 {
+		r.entries = slices.Clone(r.entries[over:])
+	}
+}
+
+// List returns the errors r holds, newest first
+func (r *Ring) List() []Entry {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := slices.Clone(r.entries)
+	slices.Reverse(out)
+	return out
+}
@@ -0,0 +1,67 @@
+// internal/proxyerr/proxyerr_test.go
+package proxyerr
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestRing(t *testing.T) {
+	tests := []struct {
+		name  string
+		size  int // -1 leaves the default
+		added int
+		want  []string // causes, newest first
+	}{
+		{"default size", -1, DefaultSize + 5, nil},
+		{"under size", 3, 2, []string{"1", "0"}},
+		{"over size", 3, 5, []string{"4", "3", "2"}},
+		{"keeps none", 0, 2, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var r Ring
+			if tt.size >= 0 {
+				r.SetSize(tt.size)
+			}
+			for i := range tt.added {
+				r.Add(Entry{Cause: strconv.Itoa(i)})
+			}
+			got := r.List()
+			if tt.want == nil {
+				if len(got) != DefaultSize || got[0].Cause != strconv.Itoa(tt.added-1) {
+					t.Errorf("List() = %d entries starting %+v, want the latest %d", len(got), got[0], DefaultSize)
+				}
+				return
+			}
+			var causes []string
+			for _, e := range got {
+				if e.At.IsZero() {
+					t.Errorf("entry %q has no time", e.Cause)
+				}
+				causes = append(causes, e.Cause)
+			}
+			if strings.Join(causes, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("List() = %v, want %v", causes, tt.want)
+			}
+		})
+	}
+}
+
+func TestRingShrinks(t *testing.T) {
+	var r Ring
+	for i := range 5 {
+		r.Add(Entry{Cause: strings.Repeat("x", maxCause+i)})
+	}
+	r.SetSize(2)
+	got := r.List()
+	if len(got) != 2 || len(got[0].Cause) != maxCause {
+		t.Errorf("List() = %d entries with causes of %d bytes, want 2 cut to %d", len(got), len(got[0].Cause), maxCause)
+	}
+	var nilRing *Ring
+	nilRing.Add(Entry{Cause: "ignored"})
+	if nilRing.List() != nil {
+		t.Error("nil ring kept an error")
+	}
+}
@@ -0,0 +1,44 @@
+// internal/publicnet/publicnet.go
+package publicnet
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/netip"
+	"syscall"
+	"time"
+)
+
+// dialTimeout bounds connecting to a host
+const dialTimeout = 5 * time.Second
+
+// ErrPrivate is returned for dials to addresses on the relay's own network
+var ErrPrivate = errors.New("address is not public")
+
+// Public reports whether addr is reachable beyond the relay's own network
+func Public(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return !(addr.IsLoopback() || addr.IsPrivate() || addr.IsLinkLocalUnicast() || addr.IsUnspecified() || addr.IsMulticast())
+}
+
+// Client returns a client for URLs users give the relay, such as webhooks
+// and buckets, that refuses to dial addresses on the relay's own network.
+// The check runs on the address dialed, so a public name resolving to a
+// private address is refused too, as is a redirect to one.
+func Client(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: dialTimeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			ap, err := netip.ParseAddrPort(address)
+			if err != nil || !Public(ap.Addr()) {
+				return ErrPrivate
+			}
+			return nil
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	transport.Proxy = nil
+	return &http.Client{Transport: transport, Timeout: timeout}
+}
@@ -0,0 +1,48 @@
+// internal/publicnet/publicnet_test.go
+package publicnet
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPublic(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"203.0.113.7", true},
+		{"2001:db8::1", true},
+		{"127.0.0.1", false},
+		{"10.1.2.3", false},
+		{"169.254.169.254", false},
+		{"::ffff:192.168.1.1", false},
+		{"0.0.0.0", false},
+		{"::1", false},
+		{"fe80::1", false},
+	}
+	for _, tt := range tests {
+		if got := Public(netip.MustParseAddr(tt.addr)); got != tt.want {
+			t.Errorf("Public(%s) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestClientRefusesPrivateNames(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("request reached a private address")
+	}))
+	defer srv.Close()
+
+	// localhost is a name, so only the dial can tell where it leads
+	_, port, _ := strings.Cut(srv.Listener.Addr().String(), ":")
+	_, err := Client(time.Second).Get("http://localhost:" + port)
+	if !errors.Is(err, ErrPrivate) {
+		t.Errorf("Get() error = %v, want %v", err, ErrPrivate)
+	}
+}
@@ -0,0 +1,96 @@
+// internal/ratelimit/memory.go
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// sweepEvery is how many writes pass between sweeps of expired keys
+const sweepEvery = 1024
+
+type memoryEntry struct {
+	count     int64
+	expiresAt time.Time
+}
+
+// Memory keeps counters in process. Each relay counts on its own.
+type Memory struct {
+	mu      sync.Mutex
+	now     func() time.Time
+	entries map[string]memoryEntry
+	writes  int
+}
+
+var _ Backend = (*Memory)(nil)
+
+// NewMemory creates an empty in-memory backend
+func NewMemory() *Memory {
+	return &Memory{now: time.Now, entries: make(map[string]memoryEntry)}
+}
+
+// SetClock overrides the time source used for windows and lockouts
+func (m *Memory) SetClock(now func() time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.now = now
+}
+
+func (m *Memory) Incr(ctx context.Context, key string, window time.Duration) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	e, ok := m.entries[key]
+	if !ok || !now.Before(e.expiresAt) {
+		e = memoryEntry{expiresAt: now.Add(window)}
+	}
+	e.count++
+	m.entries[key] = e
+	m.sweep(now)
+	return e.count, nil
+}
+
+func (m *Memory) Lock(ctx context.Context, key string, d time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	m.entries[key] = memoryEntry{count: 1, expiresAt: now.Add(d)}
+	m.sweep(now)
+	return nil
+}
+
+func (m *Memory) LockedFor(ctx context.Context, key string) (time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.entries[key]
+	if !ok {
+		return 0, nil
+	}
+	left := e.expiresAt.Sub(m.now())
+	if left <= 0 {
+		delete(m.entries, key)
+		return 0, nil
+	}
+	return left, nil
+}
+
+func (m *Memory) Reset(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.entries, key)
+	return nil
+}
+
+// sweep drops expired keys now and then so one-off IPs don't pile up
+func (m *Memory) sweep(now time.Time) {
+	m.writes++
+	if m.writes%sweepEvery != 0 {
+		return
+	}
+	for k, e := range m.entries {
+		if !now.Before(e.expiresAt) {
+			delete(m.entries, k)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+// internal/ratelimit/quota.go
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// QuotaPolicy is how many requests a key may make per window, by the plan
+// of the account it belongs to. Plans missing from Plans get Default; a
+// limit of 0 or less is unlimited.
+type QuotaPolicy struct {
+	Window  time.Duration
+	Default int
+	Plans   map[string]int
+}
+
+// Limit returns the number of requests plan may make per window
+func (p QuotaPolicy) Limit(plan string) int {
+	if n, ok := p.Plans[plan]; ok {
+		return n
+	}
+	return p.Default
+}
+
+// Quota caps the rate of requests per key, such as an API token, in fixed
+// windows. Unlike Limiter it counts every request, not only failures, and
+// reports where the key stands in X-RateLimit-* headers. Backend errors
+// fail open.
+type Quota struct {
+	backend Backend
+	scope   string
+	policy  QuotaPolicy
+	now     func() time.Time
+}
+
+// NewQuota creates a quota. scope namespaces its keys, e.g. "api".
+func NewQuota(backend Backend, scope string, policy QuotaPolicy) *Quota {
+	return &Quota{backend: backend, scope: scope, policy: policy, now: time.Now}
+}
+
+// Usage is where a key stands in the current window
+type Usage struct {
+	Limit     int
+	Remaining int
+	Reset     time.Time // when the window ends and the count starts again
+}
+
+// Take counts a request by key, whose account is on plan, and reports
+// whether it is within the plan's limit
+func (q *Quota) Take(ctx context.Context, key, plan string) (Usage, bool) {
+	if q == nil {
+		return Usage{}, true
+	}
+	limit := q.policy.Limit(plan)
+	if limit <= 0 || q.policy.Window <= 0 {
+		return Usage{}, true
+	}
+	// Windows line up with the clock, so every relay sharing a backend
+	// counts into the same one and knows when it ends
+	now := q.now()
+	start := now.Truncate(q.policy.Window)
+	u := Usage{Limit: limit, Remaining: limit, Reset: start.Add(q.policy.Window)}
+
+	n, err := q.backend.Incr(ctx, fmt.Sprintf("%s:quota:%s:%d", q.scope, key, start.Unix()), q.policy.Window)
+	if err != nil {
+		log.Printf("ratelimit %s: count request: %v", q.scope, err)
+		return u, true
+	}
+	u.Remaining = max(limit-int(n), 0)
+	return u, n <= int64(limit)
+}
+
+// Allow counts r against key and sets the X-RateLimit-* headers on w. Over
+// the limit, it answers 429 with a JSON body and returns false.
+func (q *Quota) Allow(w http.ResponseWriter, r *http.Request, key, plan string) bool {
+	u, ok := q.Take(r.Context(), key, plan)
+	if u.Limit == 0 {
+		return true
+	}
+	h := w.Header()
+	h.Set("X-RateLimit-Limit", strconv.Itoa(u.Limit))
+	h.Set("X-RateLimit-Remaining", strconv.Itoa(u.Remaining))
+	h.Set("X-RateLimit-Reset", strconv.FormatInt(u.Reset.Unix(), 10))
+	if ok {
+		return true
+	}
+
+	wait := RetryAfter(u.Reset.Sub(q.now()))
+	h.Set("Retry-After", wait)
+	h.Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusTooManyRequests)
+	fmt.Fprintf(w, "{\"error\":\"rate limit exceeded\",\"limit\":%d,\"retry_after\":%s}\n", u.Limit, wait)
+	return false
+}
@@ -0,0 +1,110 @@
+// internal/ratelimit/ratelimit.go
+package ratelimit
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"time"
+)
+
+// Backend stores failure counters and lockouts. Memory suits a single relay;
+// Redis shares counters across a fleet.
+type Backend interface {
+	// Incr adds one to key's counter, starting a new window when the counter
+	// has expired, and returns the count
+	Incr(ctx context.Context, key string, window time.Duration) (int64, error)
+	// Lock blocks key for d
+	Lock(ctx context.Context, key string, d time.Duration) error
+	// LockedFor returns how much longer key is locked, or zero
+	LockedFor(ctx context.Context, key string) (time.Duration, error)
+	// Reset clears key's counter
+	Reset(ctx context.Context, key string) error
+}
+
+// Policy is how many failures a key may have in a window before it is locked out
+type Policy struct {
+	MaxFailures int
+	Window      time.Duration
+	Lockout     time.Duration
+}
+
+// Limiter counts authentication failures per key (an IP address, an account)
+// and locks keys out after too many. Backend errors fail open: an outage of
+// the counter store shouldn't lock everyone out.
+type Limiter struct {
+	backend Backend
+	scope   string
+	policy  Policy
+}
+
+// New creates a limiter. scope namespaces its keys, e.g. "connect:ip".
+func New(backend Backend, scope string, policy Policy) *Limiter {
+	return &Limiter{backend: backend, scope: scope, policy: policy}
+}
+
+// Locked returns how much longer key is locked out, or zero
+func (l *Limiter) Locked(ctx context.Context, key string) time.Duration {
+	if l == nil {
+		return 0
+	}
+	d, err := l.backend.LockedFor(ctx, l.scope+":lock:"+key)
+	if err != nil {
+		log.Printf("ratelimit %s: check lock: %v", l.scope, err)
+		return 0
+	}
+	return d
+}
+
+// Fail records a failed attempt and reports whether it locked key out
+func (l *Limiter) Fail(ctx context.Context, key string) bool {
+	if l == nil || l.policy.MaxFailures <= 0 {
+		return false
+	}
+	n, err := l.backend.Incr(ctx, l.scope+":fail:"+key, l.policy.Window)
+	if err != nil {
+		log.Printf("ratelimit %s: count failure: %v", l.scope, err)
+		return false
+	}
+	if n < int64(l.policy.MaxFailures) {
+		return false
+	}
+
+	if err := l.backend.Lock(ctx, l.scope+":lock:"+key, l.policy.Lockout); err != nil {
+		log.Printf("ratelimit %s: lock: %v", l.scope, err)
+		return false
+	}
+	// Start counting afresh once the lockout ends
+	l.backend.Reset(ctx, l.scope+":fail:"+key)
+	return true
+}
+
+// Allow counts an attempt against key whether or not it succeeds, for caps
+// on raw attempt rates. It returns how long key must wait, or zero if the
+// attempt may go ahead.
+func (l *Limiter) Allow(ctx context.Context, key string) time.Duration {
+	if wait := l.Locked(ctx, key); wait > 0 {
+		return wait
+	}
+	l.Fail(ctx, key)
+	return 0
+}
+
+// Succeed clears key's failures after a successful attempt
+func (l *Limiter) Succeed(ctx context.Context, key string) {
+	if l == nil {
+		return
+	}
+	if err := l.backend.Reset(ctx, l.scope+":fail:"+key); err != nil {
+		log.Printf("ratelimit %s: reset: %v", l.scope, err)
+	}
+}
+
+// RetryAfter formats a lockout for the Retry-After header, in whole seconds
+func RetryAfter(d time.Duration) string {
+	secs := int64((d + time.Second - 1) / time.Second)
+	if secs < 1 {
+		secs = 1
+	}
+	return strconv.FormatInt(secs, 10)
+}
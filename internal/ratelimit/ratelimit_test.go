@@ -0,0 +1,195 @@
+// internal/ratelimit/ratelimit_test.go
+package ratelimit
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestLimiter(t *testing.T) {
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	mem := NewMemory()
+	mem.SetClock(func() time.Time { return now })
+	l := New(mem, "login:ip", Policy{MaxFailures: 3, Window: time.Minute, Lockout: 10 * time.Minute})
+	ctx := context.Background()
+
+	if l.Fail(ctx, "1.2.3.4") || l.Fail(ctx, "1.2.3.4") {
+		t.Fatal("locked before reaching MaxFailures")
+	}
+	if d := l.Locked(ctx, "1.2.3.4"); d != 0 {
+		t.Errorf("Locked() = %v before lockout, want 0", d)
+	}
+	if !l.Fail(ctx, "1.2.3.4") {
+		t.Fatal("third failure did not lock")
+	}
+	if d := l.Locked(ctx, "1.2.3.4"); d != 10*time.Minute {
+		t.Errorf("Locked() = %v, want 10m", d)
+	}
+	if d := l.Locked(ctx, "5.6.7.8"); d != 0 {
+		t.Errorf("other key Locked() = %v, want 0", d)
+	}
+
+	now = now.Add(11 * time.Minute)
+	if d := l.Locked(ctx, "1.2.3.4"); d != 0 {
+		t.Errorf("Locked() after lockout = %v, want 0", d)
+	}
+	if l.Fail(ctx, "1.2.3.4") {
+		t.Error("first failure after lockout locked again; counter should restart")
+	}
+}
+
+func TestQuota(t *testing.T) {
+	now := time.Date(2025, 6, 1, 12, 0, 30, 0, time.UTC)
+	q := NewQuota(NewMemory(), "api", QuotaPolicy{Window: time.Minute, Default: 2, Plans: map[string]int{"pro": 3, "team": 0}})
+	q.now = func() time.Time { return now }
+	req := httptest.NewRequest("GET", "/api/v1/me", nil)
+
+	allow := func(key, plan string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		if q.Allow(rec, req, key, plan) {
+			rec.WriteHeader(http.StatusOK)
+		}
+		return rec
+	}
+
+	tests := []struct {
+		key, plan     string
+		status        int
+		limit, remain string
+	}{
+		{"a", "free", http.StatusOK, "2", "1"},
+		{"a", "free", http.StatusOK, "2", "0"},
+		{"a", "free", http.StatusTooManyRequests, "2", "0"},
+		{"b", "pro", http.StatusOK, "3", "2"},
+		{"c", "team", http.StatusOK, "", ""},
+	}
+	for i, tt := range tests {
+		rec := allow(tt.key, tt.plan)
+		if rec.Code != tt.status {
+			t.Errorf("request %d: status = %d, want %d", i+1, rec.Code, tt.status)
+		}
+		if got := rec.Header().Get("X-RateLimit-Limit"); got != tt.limit {
+			t.Errorf("request %d: X-RateLimit-Limit = %q, want %q", i+1, got, tt.limit)
+		}
+		if got := rec.Header().Get("X-RateLimit-Remaining"); got != tt.remain {
+			t.Errorf("request %d: X-RateLimit-Remaining = %q, want %q", i+1, got, tt.remain)
+		}
+	}
+
+	rec := allow("a", "free")
+	if got := rec.Header().Get("X-RateLimit-Reset"); got != "1748779260" {
+		t.Errorf("X-RateLimit-Reset = %s, want the end of the minute", got)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "30" {
+		t.Errorf("Retry-After = %s, want 30", got)
+	}
+
+	now = now.Add(30 * time.Second)
+	if rec := allow("a", "free"); rec.Code != http.StatusOK {
+		t.Errorf("next window status = %d, want 200", rec.Code)
+	}
+}
+
+func TestLimiterAllow(t *testing.T) {
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	mem := NewMemory()
+	mem.SetClock(func() time.Time { return now })
+	l := New(mem, "connect:ip", Policy{MaxFailures: 2, Window: time.Minute, Lockout: 5 * time.Minute})
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		if d := l.Allow(ctx, "a"); d != 0 {
+			t.Fatalf("attempt %d: Allow() = %v, want 0", i+1, d)
+		}
+	}
+	if d := l.Allow(ctx, "a"); d != 5*time.Minute {
+		t.Errorf("Allow() over the cap = %v, want 5m", d)
+	}
+}
+
+func TestLimiterWindow(t *testing.T) {
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	mem := NewMemory()
+	mem.SetClock(func() time.Time { return now })
+	l := New(mem, "connect:ip", Policy{MaxFailures: 2, Window: time.Minute, Lockout: time.Minute})
+	ctx := context.Background()
+
+	l.Fail(ctx, "a")
+	now = now.Add(2 * time.Minute)
+	if l.Fail(ctx, "a") {
+		t.Error("failures from an expired window counted toward the lockout")
+	}
+
+	l.Succeed(ctx, "a")
+	if l.Fail(ctx, "a") {
+		t.Error("Succeed() did not clear failures")
+	}
+}
+
+func TestNilLimiter(t *testing.T) {
+	var l *Limiter
+	ctx := context.Background()
+	if l.Fail(ctx, "a") || l.Locked(ctx, "a") != 0 {
+		t.Error("nil limiter should never lock")
+	}
+	l.Succeed(ctx, "a")
+}
+
+func TestRedis(t *testing.T) {
+	srv := miniredis.RunT(t)
+	backend, err := NewRedisFromURL("redis://" + srv.Addr())
+	if err != nil {
+		t.Fatalf("NewRedisFromURL() error = %v", err)
+	}
+	l := New(backend, "login:ip", Policy{MaxFailures: 2, Window: time.Minute, Lockout: 5 * time.Minute})
+	ctx := context.Background()
+
+	l.Fail(ctx, "1.2.3.4")
+	if ttl := srv.TTL("lobber:ratelimit:login:ip:fail:1.2.3.4"); ttl != time.Minute {
+		t.Errorf("counter TTL = %v, want the 1m window", ttl)
+	}
+	if !l.Fail(ctx, "1.2.3.4") {
+		t.Fatal("second failure did not lock")
+	}
+	if d := l.Locked(ctx, "1.2.3.4"); d != 5*time.Minute {
+		t.Errorf("Locked() = %v, want 5m", d)
+	}
+
+	srv.FastForward(6 * time.Minute)
+	if d := l.Locked(ctx, "1.2.3.4"); d != 0 {
+		t.Errorf("Locked() after lockout = %v, want 0", d)
+	}
+}
+
+func TestRedisFailsOpen(t *testing.T) {
+	srv := miniredis.RunT(t)
+	backend, _ := NewRedisFromURL("redis://" + srv.Addr())
+	l := New(backend, "login:ip", Policy{MaxFailures: 1, Window: time.Minute, Lockout: time.Minute})
+	srv.Close()
+
+	ctx := context.Background()
+	if l.Fail(ctx, "a") || l.Locked(ctx, "a") != 0 {
+		t.Error("limiter locked while Redis was down; it should fail open")
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		d    time.Duration
+		want string
+	}{
+		{0, "1"},
+		{1500 * time.Millisecond, "2"},
+		{15 * time.Minute, "900"},
+	}
+	for _, tt := range tests {
+		if got := RetryAfter(tt.d); got != tt.want {
+			t.Errorf("RetryAfter(%v) = %q, want %q", tt.d, got, tt.want)
+		}
+	}
+}
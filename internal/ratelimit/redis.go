@@ -0,0 +1,76 @@
+// internal/ratelimit/redis.go
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Redis keeps counters in Redis so every relay in a fleet shares them
+type Redis struct {
+	client redis.UniversalClient
+	prefix string
+}
+
+var _ Backend = (*Redis)(nil)
+
+// NewRedis creates a backend whose keys all start with prefix
+func NewRedis(client redis.UniversalClient, prefix string) *Redis {
+	return &Redis{client: client, prefix: prefix}
+}
+
+// NewRedisFromURL connects to a redis:// or rediss:// URL
+func NewRedisFromURL(url string) (*Redis, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("parse redis URL: %w", err)
+	}
+	return NewRedis(redis.NewClient(opts), "lobber:ratelimit:"), nil
+}
+
+// incrScript starts the window's clock on the first failure, atomically so a
+// counter can never be left without an expiry
+var incrScript = redis.NewScript(`
+local n = redis.call("INCR", KEYS[1])
+if n == 1 then
+	redis.call("PEXPIRE", KEYS[1], ARGV[1])
+end
+return n
+`)
+
+func (r *Redis) Incr(ctx context.Context, key string, window time.Duration) (int64, error) {
+	n, err := incrScript.Run(ctx, r.client, []string{r.prefix + key}, window.Milliseconds()).Int64()
+	if err != nil {
+		return 0, fmt.Errorf("incr: %w", err)
+	}
+	return n, nil
+}
+
+func (r *Redis) Lock(ctx context.Context, key string, d time.Duration) error {
+	if err := r.client.Set(ctx, r.prefix+key, 1, d).Err(); err != nil {
+		return fmt.Errorf("set lock: %w", err)
+	}
+	return nil
+}
+
+func (r *Redis) LockedFor(ctx context.Context, key string) (time.Duration, error) {
+	d, err := r.client.PTTL(ctx, r.prefix+key).Result()
+	if err != nil {
+		return 0, fmt.Errorf("pttl: %w", err)
+	}
+	// PTTL is negative for missing keys and keys without an expiry
+	if d < 0 {
+		return 0, nil
+	}
+	return d, nil
+}
+
+func (r *Redis) Reset(ctx context.Context, key string) error {
+	if err := r.client.Del(ctx, r.prefix+key).Err(); err != nil {
+		return fmt.Errorf("del: %w", err)
+	}
+	return nil
+}
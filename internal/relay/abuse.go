@@ -0,0 +1,71 @@
+// internal/relay/abuse.go
+package relay
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/lobber-dev/lobber/internal/dnsname"
+	"github.com/lobber-dev/lobber/internal/store"
+)
+
+// abuseReasons are the categories a public abuse report can use
+var abuseReasons = []string{"phishing", "malware", "spam", "other"}
+
+// maxAbuseDetails caps the free-text part of a report
+const maxAbuseDetails = 4000
+
+// abuseRequest is the body of POST /abuse on the primary host
+type abuseRequest struct {
+	Hostname string `json:"hostname"`
+	Reason   string `json:"reason"`
+	Details  string `json:"details"`
+	Email    string `json:"email"`
+}
+
+// handleAbuseReport takes abuse reports about tunneled hostnames from anyone.
+// Reports land in the operator UI for triage.
+func (s *Server) handleAbuseReport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req abuseRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON body", http.StatusBadRequest)
+		return
+	}
+
+	hostname, err := dnsname.Normalize(req.Hostname)
+	req.Hostname = hostname
+	req.Details = strings.TrimSpace(req.Details)
+	switch {
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case !slices.Contains(abuseReasons, req.Reason):
+		http.Error(w, "reason must be one of "+strings.Join(abuseReasons, ", "), http.StatusBadRequest)
+		return
+	case len(req.Details) > maxAbuseDetails:
+		http.Error(w, "details are too long", http.StatusBadRequest)
+		return
+	}
+
+	report, err := s.stores.Abuse.CreateAbuseReport(r.Context(), store.AbuseReport{
+		Hostname:      req.Hostname,
+		Reason:        req.Reason,
+		Details:       req.Details,
+		ReporterEmail: strings.TrimSpace(req.Email),
+		ReporterIP:    remoteIP(r),
+	})
+	if err != nil {
+		log.Printf("abuse report for %s: %v", req.Hostname, err)
+		http.Error(w, "could not save report", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("abuse report %s filed against %s (%s)", report.ID, report.Hostname, report.Reason)
+	writeJSON(w, http.StatusCreated, map[string]string{"id": report.ID})
+}
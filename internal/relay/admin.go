@@ -0,0 +1,259 @@
+// internal/relay/admin.go
+package relay
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lobber-dev/lobber/internal/store"
+	"github.com/lobber-dev/lobber/web/admin"
+)
+
+// adminPrefix is the path prefix for operator endpoints. It lives under the
+// reserved /_lobber namespace so it never shadows a tunneled app's routes.
+const adminPrefix = "/_lobber/admin/"
+
+// adminUIPrefix is where the operator web UI is mounted
+const adminUIPrefix = adminPrefix + "ui/"
+
+// registerAdminRoutes mounts the operator API. It is disabled unless an admin token is configured.
+func (s *Server) registerAdminRoutes() {
+	if s.config.AdminToken == "" {
+		return
+	}
+	s.mux.HandleFunc(adminPrefix+"billing/reconcile", s.requireAdmin(s.handleAdminReconcile))
+	s.mux.HandleFunc(adminPrefix+"billing/events", s.requireAdmin(s.handleAdminFailedEvents))
+	s.mux.HandleFunc(adminPrefix+"billing/events/{id}/reprocess", s.requireAdmin(s.handleAdminReprocessEvent))
+	s.mux.HandleFunc(adminPrefix+"status/incident", s.requireAdmin(s.handleAdminIncident))
+	s.mux.HandleFunc(adminPrefix+"overview", s.requireAdmin(s.handleAdminOverview))
+	s.mux.HandleFunc(adminPrefix+"domains/top", s.requireAdmin(s.handleAdminTopDomains))
+	s.mux.HandleFunc(adminPrefix+"tunnels", s.requireAdmin(s.handleAdminTunnels))
+	s.mux.HandleFunc(adminPrefix+"tunnels/{domain}/errors", s.requireAdmin(s.handleAdminTunnelErrors))
+	s.mux.HandleFunc(adminPrefix+"requests", s.requireAdmin(s.handleAdminRequests))
+	s.mux.HandleFunc(adminPrefix+"requests/{id}", s.requireAdmin(s.handleAdminRequest))
+	s.mux.HandleFunc(adminPrefix+"memory", s.requireAdmin(s.handleAdminMemory))
+	s.mux.HandleFunc(adminPrefix+"abuse", s.requireAdmin(s.handleAdminAbuse))
+	s.mux.HandleFunc(adminPrefix+"abuse/{id}/resolve", s.requireAdmin(s.handleAdminResolveAbuse))
+	s.mux.HandleFunc(adminPrefix+"users", s.requireAdmin(s.handleAdminUsers))
+	s.mux.HandleFunc(adminPrefix+"users/{id}/plan", s.requireAdmin(s.handleAdminUserPlan))
+	s.mux.HandleFunc(adminPrefix+"users/{id}/impersonate", s.requireAdmin(s.handleAdminImpersonate))
+	s.mux.HandleFunc(adminPrefix+"users/{id}/usage-audit", s.requireAdmin(s.handleAdminUsageAudit))
+
+	// The operator UI has its own login, so it isn't behind the bearer token
+	ui, err := admin.NewHandler(adminAPI{s}, s.config.AdminToken, adminUIPrefix)
+	if err != nil {
+		log.Printf("admin UI: %v", err)
+		return
+	}
+	ui.SetLoginLimiter(s.authIP)
+	s.mux.Handle(adminUIPrefix, ui)
+}
+
+// requireAdmin checks the request carries the configured admin bearer token
+func (s *Server) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ip := remoteIP(r)
+		if s.authLockedOut(w, r, ip, "") {
+			return
+		}
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(s.config.AdminToken)) != 1 {
+			s.authFailed(r.Context(), ip, "", "admin API")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// handleAdminReconcile returns the last billing reconciliation report (GET)
+// or runs a new reconciliation (POST, with ?fix=true to repair drift)
+func (s *Server) handleAdminReconcile(w http.ResponseWriter, r *http.Request) {
+	if s.billingService == nil {
+		http.Error(w, "billing not configured", http.StatusServiceUnavailable)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		report := s.billingService.LastReconcileReport()
+		if report == nil {
+			http.Error(w, "no reconciliation has run yet", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, report)
+	case http.MethodPost:
+		report, err := s.billingService.Reconcile(r.Context(), r.URL.Query().Get("fix") == "true")
+		if err != nil {
+			http.Error(w, "reconcile: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, report)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleAdminFailedEvents lists billing webhook events that are awaiting retry or have exhausted their attempts
+func (s *Server) handleAdminFailedEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.webhookHandler == nil {
+		http.Error(w, "billing not configured", http.StatusServiceUnavailable)
+		return
+	}
+
+	events, err := s.webhookHandler.FailedEvents(r.Context(), 100)
+	if err != nil {
+		http.Error(w, "list events: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, events)
+}
+
+// handleAdminReprocessEvent runs a stored billing webhook event through the handlers again
+func (s *Server) handleAdminReprocessEvent(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.webhookHandler == nil {
+		http.Error(w, "billing not configured", http.StatusServiceUnavailable)
+		return
+	}
+
+	eventID := r.PathValue("id")
+	if err := s.webhookHandler.ReprocessEvent(r.Context(), eventID); err != nil {
+		http.Error(w, "reprocess: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"stripe_event_id": eventID, "status": "processed"})
+}
+
+// maxAuditDays bounds one usage audit request, a little over a year
+const maxAuditDays = 400
+
+// handleAdminUsageAudit returns a user's signed per-day, per-domain usage and
+// the reports sent to Stripe, for ?from= and ?to= dates (default this month)
+func (s *Server) handleAdminUsageAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.billingService == nil {
+		http.Error(w, "billing not configured", http.StatusServiceUnavailable)
+		return
+	}
+
+	now := time.Now().UTC()
+	from := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	var err error
+	if v := r.URL.Query().Get("from"); v != "" {
+		if from, err = time.Parse(time.DateOnly, v); err != nil {
+			http.Error(w, "from must be a date like 2006-01-02", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := r.URL.Query().Get("to"); v != "" {
+		if to, err = time.Parse(time.DateOnly, v); err != nil {
+			http.Error(w, "to must be a date like 2006-01-02", http.StatusBadRequest)
+			return
+		}
+	}
+	if to.Before(from) || to.Sub(from) > maxAuditDays*24*time.Hour {
+		http.Error(w, fmt.Sprintf("from must be before to and at most %d days apart", maxAuditDays), http.StatusBadRequest)
+		return
+	}
+
+	audit, err := s.billingService.UsageAudit(r.Context(), r.PathValue("id"), from, to)
+	if err != nil {
+		http.Error(w, "usage audit: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, audit)
+}
+
+// incidentRequest is the body of POST /_lobber/admin/status/incident
+type incidentRequest struct {
+	Title    string `json:"title"`
+	Message  string `json:"message"`
+	Severity string `json:"severity"` // "minor" (default) or "major"
+}
+
+// handleAdminIncident manages the status page banner: GET returns the open
+// incident, POST posts a new one (replacing any open incident) and DELETE resolves it
+func (s *Server) handleAdminIncident(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		incident, err := s.status.ActiveIncident(r.Context())
+		if errors.Is(err, store.ErrNotFound) {
+			http.Error(w, "no open incident", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "get incident: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, incident)
+	case http.MethodPost:
+		var req incidentRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+			http.Error(w, "invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		req.Title = strings.TrimSpace(req.Title)
+		if req.Title == "" {
+			http.Error(w, "title is required", http.StatusBadRequest)
+			return
+		}
+		if req.Severity == "" {
+			req.Severity = "minor"
+		}
+		if req.Severity != "minor" && req.Severity != "major" {
+			http.Error(w, "severity must be minor or major", http.StatusBadRequest)
+			return
+		}
+
+		incident, err := s.status.OpenIncident(r.Context(), store.Incident{
+			Title:    req.Title,
+			Message:  strings.TrimSpace(req.Message),
+			Severity: req.Severity,
+		})
+		if err != nil {
+			http.Error(w, "open incident: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("status incident opened: %s (%s)", incident.Title, incident.Severity)
+		writeJSON(w, http.StatusCreated, incident)
+	case http.MethodDelete:
+		err := s.status.ResolveIncident(r.Context())
+		if errors.Is(err, store.ErrNotFound) {
+			http.Error(w, "no open incident", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "resolve incident: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("status incident resolved")
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// writeJSON writes v as a JSON response with the given status
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,422 @@
+// internal/relay/admin_api.go
+package relay
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lobber-dev/lobber/internal/auth"
+	"github.com/lobber-dev/lobber/internal/store"
+	"github.com/lobber-dev/lobber/internal/tunnel"
+	"github.com/lobber-dev/lobber/web/admin"
+)
+
+// Result limits for the operator API
+const (
+	adminSearchLimit = 50
+	adminAbuseLimit  = 200
+	adminMaxDomains  = 100
+)
+
+// adminAPI answers operator questions from the stores. It backs both the JSON
+// endpoints and the operator UI.
+type adminAPI struct {
+	s *Server
+}
+
+var _ admin.API = adminAPI{}
+
+// Overview counts tunnels from each relay's latest health check, using the
+// live count for this relay
+func (a adminAPI) Overview(ctx context.Context) (*admin.Overview, error) {
+	health, err := a.s.stores.Status.ListRelayHealth(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("list relay health: %w", err)
+	}
+	byPlan, err := a.s.stores.Admin.CountUsersByPlan(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("count users: %w", err)
+	}
+	open, err := a.s.stores.Abuse.ListAbuseReports(ctx, false, adminAbuseLimit)
+	if err != nil {
+		return nil, fmt.Errorf("list abuse reports: %w", err)
+	}
+
+	o := &admin.Overview{UsersByPlan: byPlan, OpenAbuseReports: len(open)}
+	self := false
+	for _, h := range health {
+		r := admin.RelayTunnels{
+			ID:         h.RelayID,
+			Region:     h.Region,
+			Tunnels:    h.Tunnels,
+			OK:         h.OK,
+			Detail:     h.Detail,
+			LastSeenAt: h.LastSeenAt,
+		}
+		if h.RelayID == a.s.config.RelayID {
+			r.Tunnels = a.s.tunnelCount()
+			self = true
+		}
+		o.Relays = append(o.Relays, r)
+		o.Tunnels += r.Tunnels
+	}
+	if !self {
+		// This relay hasn't recorded a health check yet
+		n := a.s.tunnelCount()
+		o.Relays = append(o.Relays, admin.RelayTunnels{
+			ID:         a.s.config.RelayID,
+			Region:     a.s.config.Region,
+			Tunnels:    n,
+			OK:         true,
+			LastSeenAt: time.Now(),
+		})
+		o.Tunnels += n
+	}
+	return o, nil
+}
+
+// TopDomains ranks domains by traffic this month
+func (a adminAPI) TopDomains(ctx context.Context, limit int) ([]store.DomainTraffic, error) {
+	now := time.Now().UTC()
+	since := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	return a.s.stores.Admin.TopDomains(ctx, since, limit)
+}
+
+func (a adminAPI) AbuseReports(ctx context.Context, includeResolved bool) ([]store.AbuseReport, error) {
+	return a.s.stores.Abuse.ListAbuseReports(ctx, includeResolved, adminAbuseLimit)
+}
+
+func (a adminAPI) ResolveAbuseReport(ctx context.Context, id, resolution string) error {
+	if err := a.s.stores.Abuse.ResolveAbuseReport(ctx, id, resolution); err != nil {
+		return err
+	}
+	log.Printf("abuse report %s resolved: %s", id, resolution)
+	return nil
+}
+
+func (a adminAPI) SearchUsers(ctx context.Context, query string) ([]admin.UserSummary, error) {
+	users, err := a.s.stores.Admin.SearchUsers(ctx, query, adminSearchLimit)
+	if err != nil {
+		return nil, err
+	}
+	summaries := make([]admin.UserSummary, 0, len(users))
+	for _, u := range users {
+		summaries = append(summaries, admin.UserSummary{
+			ID:               u.ID,
+			Email:            u.Email,
+			Name:             u.Name,
+			Plan:             u.Plan,
+			PlanOverride:     u.PlanOverride,
+			StripeCustomerID: u.StripeCustomerID,
+			TrialEndsAt:      u.TrialEndsAt,
+		})
+	}
+	return summaries, nil
+}
+
+// SetPlanOverride pins a plan and drops the cached quota decision so the new
+// plan applies to the user's next request
+func (a adminAPI) SetPlanOverride(ctx context.Context, userID, plan string) error {
+	if plan != "" && !slices.Contains(admin.Plans, plan) {
+		return fmt.Errorf("%w %q", admin.ErrInvalidPlan, plan)
+	}
+	if err := a.s.stores.Admin.SetPlanOverride(ctx, userID, plan); err != nil {
+		return err
+	}
+	if a.s.quota != nil {
+		a.s.quota.expire(userID)
+	}
+	if plan == "" {
+		log.Printf("plan override removed for user %s", userID)
+	} else {
+		log.Printf("plan override for user %s: %s", userID, plan)
+	}
+	return nil
+}
+
+// Impersonate opens a read-only support session and records it in the user's audit log
+func (a adminAPI) Impersonate(ctx context.Context, userID, operator, reason string) (*admin.Impersonation, error) {
+	if _, err := a.s.stores.Users.GetUser(ctx, userID); err != nil {
+		return nil, err
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, fmt.Errorf("generate session token: %w", err)
+	}
+	session := &admin.Impersonation{
+		Token:     hex.EncodeToString(raw),
+		ExpiresAt: time.Now().Add(admin.ImpersonationTTL),
+	}
+	if err := a.s.stores.Sessions.CreateImpersonationSession(ctx, userID, auth.HashToken(session.Token), operator, session.ExpiresAt); err != nil {
+		return nil, err
+	}
+
+	// The audit entry is what tells the user support looked at their account,
+	// so don't hand out the session without it
+	err := a.s.stores.Audit.RecordAudit(ctx, store.AuditEntry{
+		UserID: userID,
+		Action: "support.session_started",
+		Detail: fmt.Sprintf("by %s: %s", operator, reason),
+	})
+	if err != nil {
+		a.s.stores.Sessions.DeleteSession(ctx, auth.HashToken(session.Token))
+		return nil, fmt.Errorf("record audit: %w", err)
+	}
+	log.Printf("support session for user %s opened by %s: %s", userID, operator, reason)
+	return session, nil
+}
+
+// handleAdminOverview returns tunnel counts, users per plan and open abuse reports
+func (s *Server) handleAdminOverview(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	overview, err := adminAPI{s}.Overview(r.Context())
+	if err != nil {
+		http.Error(w, "overview: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, overview)
+}
+
+// handleAdminTopDomains ranks domains by traffic this month, ?limit= up to 100
+func (s *Server) handleAdminTopDomains(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	limit := 20
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > adminMaxDomains {
+			http.Error(w, "limit must be between 1 and 100", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	domains, err := adminAPI{s}.TopDomains(r.Context(), limit)
+	if err != nil {
+		http.Error(w, "top domains: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, domains)
+}
+
+// adminTunnel is a tunnel open on this relay, in GET /_lobber/admin/tunnels
+type adminTunnel struct {
+	Domain      string        `json:"domain"`
+	Name        string        `json:"name,omitempty"`
+	UserID      string        `json:"user_id"`
+	Ready       bool          `json:"ready"`
+	ConnectedAt time.Time     `json:"connected_at"`
+	Labels      tunnel.Labels `json:"labels,omitempty"`
+	UDPPort     int           `json:"udp_port,omitempty"`
+	Features    []string      `json:"features,omitempty"` // optional protocol features the client uses
+	Protocol    int           `json:"protocol"`           // the client's protocol version
+	Goroutines  int           `json:"goroutines"`         // running for the tunnel, see Tunnel.spawn
+	FDs         int           `json:"fds"`                // file descriptors the tunnel holds
+	ConnMeta
+}
+
+// handleAdminTunnels lists the tunnels open on this relay with how each
+// client connected, optionally only those from ?ip=, carrying every
+// ?label=key=value or using ?feature=, such as one about to be retired
+func (s *Server) handleAdminTunnels(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ip := r.URL.Query().Get("ip")
+	feature := r.URL.Query().Get("feature")
+	selector, err := tunnel.ParseLabels(strings.Join(r.URL.Query()["label"], ","))
+	if err != nil {
+		http.Error(w, "invalid label filter: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.mu.RLock()
+	tunnels := make([]adminTunnel, 0, len(s.tunnels))
+	for _, t := range s.tunnels {
+		if ip != "" && t.Meta.RemoteIP != ip {
+			continue
+		}
+		if !t.Labels.Match(selector) {
+			continue
+		}
+		t.stateMu.RLock()
+		ready := t.state == TunnelStateReady
+		features := t.features
+		t.stateMu.RUnlock()
+		if feature != "" && !slices.Contains(features, feature) {
+			continue
+		}
+		at := adminTunnel{
+			Domain:      t.Domain,
+			Name:        t.Name,
+			UserID:      t.UserID,
+			Ready:       ready,
+			ConnectedAt: t.ConnectedAt,
+			Labels:      t.Labels,
+			Features:    features,
+			Protocol:    t.protocol,
+			Goroutines:  t.Goroutines(),
+			FDs:         t.FDs(),
+			ConnMeta:    t.Meta,
+		}
+		if t.udp != nil {
+			at.UDPPort = t.udp.port
+		}
+		tunnels = append(tunnels, at)
+	}
+	s.mu.RUnlock()
+
+	slices.SortFunc(tunnels, func(a, b adminTunnel) int { return strings.Compare(a.Domain, b.Domain) })
+	writeJSON(w, http.StatusOK, tunnels)
+}
+
+// handleAdminAbuse lists open abuse reports, or every report with ?all=true
+func (s *Server) handleAdminAbuse(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	reports, err := adminAPI{s}.AbuseReports(r.Context(), r.URL.Query().Get("all") == "true")
+	if err != nil {
+		http.Error(w, "list abuse reports: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, reports)
+}
+
+// resolveRequest is the body of POST /_lobber/admin/abuse/{id}/resolve
+type resolveRequest struct {
+	Resolution string `json:"resolution"`
+}
+
+// handleAdminResolveAbuse closes an abuse report with a note on what was done
+func (s *Server) handleAdminResolveAbuse(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req resolveRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	req.Resolution = strings.TrimSpace(req.Resolution)
+	if req.Resolution == "" {
+		http.Error(w, "resolution is required", http.StatusBadRequest)
+		return
+	}
+
+	err := adminAPI{s}.ResolveAbuseReport(r.Context(), r.PathValue("id"), req.Resolution)
+	if errors.Is(err, store.ErrNotFound) {
+		http.Error(w, "no open report with that id", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "resolve abuse report: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleAdminUsers searches users by ID or email with ?q=
+func (s *Server) handleAdminUsers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	if query == "" {
+		http.Error(w, "q is required", http.StatusBadRequest)
+		return
+	}
+	users, err := adminAPI{s}.SearchUsers(r.Context(), query)
+	if err != nil {
+		http.Error(w, "search users: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, users)
+}
+
+// planRequest is the body of POST /_lobber/admin/users/{id}/plan
+type planRequest struct {
+	Plan string `json:"plan"` // empty removes the override
+}
+
+// handleAdminUserPlan pins a user's plan or removes the pin
+func (s *Server) handleAdminUserPlan(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req planRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON body", http.StatusBadRequest)
+		return
+	}
+
+	err := adminAPI{s}.SetPlanOverride(r.Context(), r.PathValue("id"), req.Plan)
+	switch {
+	case errors.Is(err, admin.ErrInvalidPlan):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, store.ErrNotFound):
+		http.Error(w, "user not found", http.StatusNotFound)
+	case err != nil:
+		http.Error(w, "set plan: "+err.Error(), http.StatusInternalServerError)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// impersonateRequest is the body of POST /_lobber/admin/users/{id}/impersonate
+type impersonateRequest struct {
+	Operator string `json:"operator"` // who is asking, for the user's audit log
+	Reason   string `json:"reason"`
+}
+
+// handleAdminImpersonate returns a read-only dashboard session token for a user
+func (s *Server) handleAdminImpersonate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req impersonateRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	req.Operator = strings.TrimSpace(req.Operator)
+	req.Reason = strings.TrimSpace(req.Reason)
+	if req.Operator == "" || req.Reason == "" {
+		http.Error(w, "operator and reason are required", http.StatusBadRequest)
+		return
+	}
+
+	session, err := adminAPI{s}.Impersonate(r.Context(), r.PathValue("id"), req.Operator, req.Reason)
+	if errors.Is(err, store.ErrNotFound) {
+		http.Error(w, "user not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "impersonate: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusCreated, session)
+}
@@ -0,0 +1,285 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/lobber-dev/lobber/internal/auth"
+	"github.com/lobber-dev/lobber/internal/store"
+)
+
+func TestAdminAPIDisabledWithoutToken(t *testing.T) {
+	s := NewServer(nil)
+
+	req := httptest.NewRequest("GET", "/_lobber/admin/billing/reconcile", nil)
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestAdminAPIRequiresToken(t *testing.T) {
+	config := DefaultServerConfig()
+	config.AdminToken = "secret"
+	s := NewServerWithConfig(nil, config)
+
+	tests := []struct {
+		name   string
+		auth   string
+		status int
+	}{
+		{"missing token", "", http.StatusUnauthorized},
+		{"wrong token", "Bearer nope", http.StatusUnauthorized},
+		// Billing isn't configured in tests, so an authorized call reaches the handler and reports that
+		{"valid token", "Bearer secret", http.StatusServiceUnavailable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/_lobber/admin/billing/reconcile", nil)
+			if tt.auth != "" {
+				req.Header.Set("Authorization", tt.auth)
+			}
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, req)
+
+			if rec.Code != tt.status {
+				t.Errorf("status = %d, want %d", rec.Code, tt.status)
+			}
+		})
+	}
+}
+
+func TestAdminReprocessEventRoute(t *testing.T) {
+	config := DefaultServerConfig()
+	config.AdminToken = "secret"
+	s := NewServerWithConfig(nil, config)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		status int
+	}{
+		{"list without billing", "GET", "/_lobber/admin/billing/events", http.StatusServiceUnavailable},
+		{"reprocess without billing", "POST", "/_lobber/admin/billing/events/evt_123/reprocess", http.StatusServiceUnavailable},
+		{"reprocess wrong method", "GET", "/_lobber/admin/billing/events/evt_123/reprocess", http.StatusMethodNotAllowed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			req.Header.Set("Authorization", "Bearer secret")
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, req)
+
+			if rec.Code != tt.status {
+				t.Errorf("status = %d, want %d", rec.Code, tt.status)
+			}
+		})
+	}
+}
+
+func TestAdminIncident(t *testing.T) {
+	config := DefaultServerConfig()
+	config.AdminToken = "secret"
+	s := NewServerWithConfig(nil, config)
+
+	send := func(method, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/_lobber/admin/status/incident", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		return rec
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		body   string
+		status int
+	}{
+		{"none open", "GET", "", http.StatusNotFound},
+		{"missing title", "POST", `{"message":"x"}`, http.StatusBadRequest},
+		{"bad severity", "POST", `{"title":"Outage","severity":"critical"}`, http.StatusBadRequest},
+		{"open", "POST", `{"title":"Elevated latency","message":"Investigating"}`, http.StatusCreated},
+		{"get open", "GET", "", http.StatusOK},
+		{"resolve", "DELETE", "", http.StatusNoContent},
+		{"resolve again", "DELETE", "", http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rec := send(tt.method, tt.body); rec.Code != tt.status {
+				t.Errorf("status = %d, want %d (body %q)", rec.Code, tt.status, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestStatusPageRouting(t *testing.T) {
+	config := DefaultServerConfig()
+	config.BaseDomain = "lobber.dev"
+	s := NewServerWithConfig(nil, config)
+	if err := s.recordHealth(context.Background()); err != nil {
+		t.Fatalf("recordHealth() error = %v", err)
+	}
+
+	req := httptest.NewRequest("GET", "/status.json", nil)
+	req.Host = "lobber.dev"
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", rec.Code)
+	}
+	if !strings.Contains(rec.Body.String(), `"status":"operational"`) {
+		t.Errorf("body = %q, want operational", rec.Body.String())
+	}
+
+	// Other hosts belong to tunneled apps, whose own /status must not be shadowed
+	req = httptest.NewRequest("GET", "/status", nil)
+	req.Host = "app.example.com"
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("tunnel host status = %d, want 502 tunnel not found", rec.Code)
+	}
+}
+
+func TestAdminOperatorAPI(t *testing.T) {
+	config := DefaultServerConfig()
+	config.AdminToken = "secret"
+	config.BaseDomain = "lobber.dev"
+	s := NewServerWithConfig(nil, config)
+	mem := s.stores.Admin.(*store.Memory)
+	mem.AddUser(store.User{ID: "u1", Email: "ada@example.com", Plan: "free"})
+	mem.AddDomainTraffic("u1", "ada.lobber.dev", 2048, 3)
+
+	send := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		req.Host = "lobber.dev"
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// Anyone can report abuse on the primary host
+	rec := send("POST", "/abuse", `{"hostname":"Ada.lobber.dev","reason":"phishing","details":"fake bank login"}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("abuse report status = %d, want 201 (body %q)", rec.Code, rec.Body.String())
+	}
+	var created struct{ ID string }
+	json.Unmarshal(rec.Body.Bytes(), &created)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		status int
+		want   string
+	}{
+		{"overview", "GET", "/_lobber/admin/overview", "", http.StatusOK, `"open_abuse_reports":1`},
+		{"top domains", "GET", "/_lobber/admin/domains/top?limit=5", "", http.StatusOK, `"hostname":"ada.lobber.dev"`},
+		{"bad limit", "GET", "/_lobber/admin/domains/top?limit=0", "", http.StatusBadRequest, ""},
+		{"abuse", "GET", "/_lobber/admin/abuse", "", http.StatusOK, `"reason":"phishing"`},
+		{"resolve without note", "POST", "/_lobber/admin/abuse/" + created.ID + "/resolve", `{}`, http.StatusBadRequest, ""},
+		{"resolve", "POST", "/_lobber/admin/abuse/" + created.ID + "/resolve", `{"resolution":"tunnel disabled"}`, http.StatusNoContent, ""},
+		{"resolve again", "POST", "/_lobber/admin/abuse/" + created.ID + "/resolve", `{"resolution":"again"}`, http.StatusNotFound, ""},
+		{"search", "GET", "/_lobber/admin/users?q=ada", "", http.StatusOK, `"email":"ada@example.com"`},
+		{"search without query", "GET", "/_lobber/admin/users", "", http.StatusBadRequest, ""},
+		{"unknown plan", "POST", "/_lobber/admin/users/u1/plan", `{"plan":"platinum"}`, http.StatusBadRequest, ""},
+		{"unknown user", "POST", "/_lobber/admin/users/nobody/plan", `{"plan":"pro"}`, http.StatusNotFound, ""},
+		{"pin plan", "POST", "/_lobber/admin/users/u1/plan", `{"plan":"pro"}`, http.StatusNoContent, ""},
+		{"pinned", "GET", "/_lobber/admin/users?q=u1", "", http.StatusOK, `"plan":"pro","plan_override":true`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := send(tt.method, tt.path, tt.body)
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d (body %q)", rec.Code, tt.status, rec.Body.String())
+			}
+			if !strings.Contains(rec.Body.String(), tt.want) {
+				t.Errorf("body = %q, want it to contain %q", rec.Body.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestAbuseReportValidation(t *testing.T) {
+	config := DefaultServerConfig()
+	config.BaseDomain = "lobber.dev"
+	s := NewServerWithConfig(nil, config)
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{"missing hostname", `{"reason":"spam"}`, http.StatusBadRequest},
+		{"unknown reason", `{"hostname":"a.lobber.dev","reason":"rude"}`, http.StatusBadRequest},
+		{"too long", `{"hostname":"a.lobber.dev","reason":"spam","details":"` + strings.Repeat("x", maxAbuseDetails+1) + `"}`, http.StatusBadRequest},
+		{"valid", `{"hostname":"a.lobber.dev","reason":"spam"}`, http.StatusCreated},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/abuse", strings.NewReader(tt.body))
+			req.Host = "lobber.dev"
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, req)
+			if rec.Code != tt.status {
+				t.Errorf("status = %d, want %d (body %q)", rec.Code, tt.status, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestAdminImpersonate(t *testing.T) {
+	config := DefaultServerConfig()
+	config.AdminToken = "secret"
+	s := NewServerWithConfig(nil, config)
+	mem := s.stores.Users.(*store.Memory)
+	mem.AddUser(store.User{ID: "u1", Email: "ada@example.com", Plan: "free"})
+
+	send := func(path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := send("/_lobber/admin/users/u1/impersonate", `{"operator":"grace"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("without reason: status = %d, want 400", rec.Code)
+	}
+	if rec := send("/_lobber/admin/users/nobody/impersonate", `{"operator":"grace","reason":"ticket 7"}`); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown user: status = %d, want 404", rec.Code)
+	}
+
+	rec := send("/_lobber/admin/users/u1/impersonate", `{"operator":"grace","reason":"ticket 7"}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("status = %d, want 201 (body %q)", rec.Code, rec.Body.String())
+	}
+	var session struct{ Token string }
+	json.Unmarshal(rec.Body.Bytes(), &session)
+
+	ctx := context.Background()
+	user, err := mem.SessionUser(ctx, auth.HashToken(session.Token))
+	if err != nil || user.ID != "u1" || user.ImpersonatedBy != "grace" {
+		t.Errorf("SessionUser() = %+v, %v, want u1 impersonated by grace", user, err)
+	}
+	entries, _ := mem.ListAudit(ctx, "u1", 10)
+	if len(entries) != 1 || entries[0].Action != "support.session_started" || entries[0].Detail != "by grace: ticket 7" {
+		t.Errorf("audit = %+v, want support.session_started by grace", entries)
+	}
+}
@@ -0,0 +1,164 @@
+// internal/relay/api.go
+package relay
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lobber-dev/lobber/internal/auth"
+	"github.com/lobber-dev/lobber/internal/store"
+)
+
+const (
+	// eventsPageSize and eventsMaxPageSize bound a page of GET /api/v1/events
+	eventsPageSize    = 100
+	eventsMaxPageSize = 500
+
+	// eventsMaxWait caps how long GET /api/v1/events holds a request open
+	// waiting for new events
+	eventsMaxWait = time.Minute
+)
+
+// meResponse is what GET /api/v1/me returns for a valid CLI token
+type meResponse struct {
+	ID    string `json:"id"`
+	Email string `json:"email"`
+	Name  string `json:"name,omitempty"`
+	Plan  string `json:"plan"`
+
+	// Preferences are the defaults `lobber login` saves for `lobber up`.
+	// They are left out if they can't be read, so logging in still works.
+	Preferences *mePreferences `json:"preferences,omitempty"`
+}
+
+// mePreferences are a user's CLI defaults, as in store.Preferences
+type mePreferences struct {
+	Region           string `json:"region"`
+	Inspect          bool   `json:"inspect"`
+	LogRetentionDays int    `json:"log_retention_days"`
+	BurstLimit       string `json:"burst_limit"`
+}
+
+// handleMe tells the CLI who a token belongs to, so `lobber login` can check
+// a token before saving it and pick up the user's preferences
+func (s *Server) handleMe(w http.ResponseWriter, r *http.Request) {
+	user, ok := s.apiUser(w, r)
+	if !ok {
+		return
+	}
+
+	me := meResponse{
+		ID:    user.ID,
+		Email: user.Email,
+		Name:  user.Name,
+		Plan:  user.Plan,
+	}
+	if p, err := s.stores.Accounts.Preferences(r.Context(), user.ID); err != nil {
+		log.Printf("api: preferences for %s: %v", user.ID, err)
+	} else {
+		me.Preferences = &mePreferences{user.DataRegion, p.Inspect, p.LogRetentionDays, p.BurstLimit}
+	}
+	writeJSON(w, http.StatusOK, me)
+}
+
+// handleEvents returns a page of the token owner's activity feed. With
+// ?after= it returns what came after that event, and with ?wait= it holds
+// the request open until there is some, which is how `lobber events
+// --follow` streams the feed.
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	user, ok := s.apiUser(w, r)
+	if !ok {
+		return
+	}
+
+	q := r.URL.Query()
+	after, err := strconv.ParseInt(q.Get("after"), 10, 64)
+	if q.Get("after") != "" && (err != nil || after < 0) {
+		http.Error(w, "after must be an event ID", http.StatusBadRequest)
+		return
+	}
+	limit := eventsPageSize
+	if v := q.Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 1 {
+			http.Error(w, "limit must be a positive number", http.StatusBadRequest)
+			return
+		}
+		limit = min(limit, eventsMaxPageSize)
+	}
+	var wait time.Duration
+	if v := q.Get("wait"); v != "" {
+		wait, err = time.ParseDuration(v)
+		if err != nil || wait < 0 {
+			http.Error(w, "wait must be a duration such as 30s", http.StatusBadRequest)
+			return
+		}
+		wait = min(wait, eventsMaxWait)
+	}
+
+	var events []store.Event
+	if wait > 0 {
+		events, err = s.events.Wait(r.Context(), user.ID, after, limit, wait)
+	} else {
+		events, err = s.stores.Events.ListEvents(r.Context(), user.ID, after, limit)
+	}
+	if err != nil {
+		if r.Context().Err() == nil {
+			log.Printf("api: list events for %s: %v", user.ID, err)
+			http.Error(w, "could not list events", http.StatusInternalServerError)
+		}
+		return
+	}
+	if events == nil {
+		events = []store.Event{}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"events": events})
+}
+
+// apiUser authenticates a CLI GET request by its API token. It writes the
+// error response and returns false when the token is missing or invalid.
+func (s *Server) apiUser(w http.ResponseWriter, r *http.Request) (*store.User, bool) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return nil, false
+	}
+	return s.apiAuth(w, r)
+}
+
+// apiAuth is apiUser for routes whose methods the mux has already checked
+func (s *Server) apiAuth(w http.ResponseWriter, r *http.Request) (*store.User, bool) {
+	w.Header().Set("Cache-Control", "no-store")
+
+	authHeader := r.Header.Get("Authorization")
+	token := strings.TrimPrefix(authHeader, "Bearer ")
+	if token == "" || token == authHeader {
+		http.Error(w, "missing or invalid Authorization header", http.StatusUnauthorized)
+		return nil, false
+	}
+
+	ip := remoteIP(r)
+	if s.authLockedOut(w, r, ip, "") {
+		return nil, false
+	}
+
+	user, err := s.stores.Tokens.TokenUser(r.Context(), auth.HashToken(token))
+	if err != nil {
+		if !errors.Is(err, store.ErrNotFound) {
+			log.Printf("api: look up token: %v", err)
+			http.Error(w, "could not check token", http.StatusInternalServerError)
+			return nil, false
+		}
+		s.authFailed(r.Context(), ip, "", "API token")
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return nil, false
+	}
+	s.authSucceeded(r.Context(), ip, "")
+	if !s.apiQuota.Allow(w, r, auth.HashToken(token), user.Plan) {
+		return nil, false
+	}
+	return user, true
+}
@@ -1,13 +1,19 @@
 package relay
 
 import (
+	"context"
+	"fmt"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/lobber-dev/lobber/internal/auth"
+	"github.com/lobber-dev/lobber/internal/ratelimit"
+	"github.com/lobber-dev/lobber/internal/store"
+	"github.com/lobber-dev/lobber/internal/tunnel"
 )
 
 func TestConnectRequiresAuth(t *testing.T) {
@@ -68,6 +74,51 @@ func TestConnectWithValidToken(t *testing.T) {
 	}
 }
 
+func TestConnectDomainGrants(t *testing.T) {
+	s := NewServerWithConfig(nil, DefaultServerConfig())
+	mem := s.stores.Domains.(*store.Memory)
+	ctx := context.Background()
+	for _, id := range []string{"owner", "member", "other", "squatter"} {
+		mem.AddUser(store.User{ID: id, Email: id + "@example.com"})
+	}
+	d, _ := mem.CreateDomain(ctx, "owner", "app.example.com")
+	mem.MarkDomainVerified(ctx, "owner", d.ID)
+	// An unverified claim doesn't keep the hostname's real owner off it
+	mem.CreateDomain(ctx, "squatter", "claimed.example.com")
+	if _, err := mem.GrantDomain(ctx, "owner", d.ID, "member@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	s.SetTokenValidator(func(token string) (string, bool) { return strings.TrimPrefix(token, "lb_"), true })
+
+	tests := []struct {
+		user   string
+		domain string
+		denied bool
+	}{
+		{"owner", "app.example.com", false},
+		{"member", "app.example.com", false},
+		{"other", "app.example.com", true},
+		{"other", "unregistered.example.com", false},
+		{"other", "claimed.example.com", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.user+" "+tt.domain, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/_lobber/connect", nil)
+			req.Host = "localhost"
+			req.Header.Set("X-Lobber-Domain", tt.domain)
+			req.Header.Set("Authorization", "Bearer lb_"+tt.user)
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, req)
+
+			// Connects that are let through fail to hijack the recorder
+			if denied := rec.Code == http.StatusForbidden; denied != tt.denied {
+				t.Errorf("status = %d, denied = %v, want %v", rec.Code, denied, tt.denied)
+			}
+		})
+	}
+}
+
 func startTestServer(t *testing.T, handler http.Handler) *httptest.Server {
 	t.Helper()
 
@@ -84,3 +135,192 @@ func startTestServer(t *testing.T, handler http.Handler) *httptest.Server {
 	srv.Start()
 	return srv
 }
+
+func TestStoreTokenValidator(t *testing.T) {
+	mem := store.NewMemory()
+	mem.AddUser(store.User{ID: "user-1"})
+	mem.CreateToken(context.Background(), "user-1", "cli", auth.HashToken("lb_secret"))
+	validate := StoreTokenValidator(mem)
+
+	if userID, ok := validate("lb_secret"); !ok || userID != "user-1" {
+		t.Errorf("validate(known) = %q, %v, want user-1, true", userID, ok)
+	}
+	if _, ok := validate("lb_other"); ok {
+		t.Error("validate(unknown) = true, want false")
+	}
+}
+
+func TestUserTunnels(t *testing.T) {
+	s := NewServer(nil)
+	s.RegisterTunnel(&Tunnel{Domain: "b.example.com", UserID: "user-1"})
+	s.RegisterTunnel(&Tunnel{Domain: "a.example.com", UserID: "user-1", Labels: tunnel.Labels{"env": "staging"}})
+	s.RegisterTunnel(&Tunnel{Domain: "c.example.com", UserID: "user-2"})
+
+	got := s.UserTunnels("user-1")
+	if len(got) != 2 || got[0].Hostname != "a.example.com" || got[1].Hostname != "b.example.com" {
+		t.Errorf("UserTunnels(user-1) = %v, want [a.example.com b.example.com]", got)
+	}
+	if got[0].Labels["env"] != "staging" {
+		t.Errorf("UserTunnels(user-1)[0].Labels = %v, want env=staging", got[0].Labels)
+	}
+	if got := s.UserTunnels("user-3"); len(got) != 0 {
+		t.Errorf("UserTunnels(user-3) = %v, want none", got)
+	}
+}
+
+func TestConnectLockout(t *testing.T) {
+	config := DefaultServerConfig()
+	config.AuthIPLimit = ratelimit.Policy{MaxFailures: 3, Window: time.Minute, Lockout: time.Minute}
+	config.AuthAccountLimit = ratelimit.Policy{MaxFailures: 5, Window: time.Minute, Lockout: time.Minute}
+	s := NewServerWithConfig(nil, config)
+	s.SetTokenValidator(func(token string) (string, bool) { return "user-1", token == "lb_good" })
+	mem := s.stores.Domains.(*store.Memory)
+	mem.AddUser(store.User{ID: "user-1", Email: "dev@example.com"})
+	mem.CreateDomain(context.Background(), "user-1", "app.example.com")
+
+	connect := func(ip, domain, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/_lobber/connect", nil)
+		req.RemoteAddr = ip + ":4000"
+		req.Header.Set("X-Lobber-Domain", domain)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for i := 0; i < 3; i++ {
+		if rec := connect("10.0.0.1", "other.example.com", "lb_guess"); rec.Code != http.StatusUnauthorized {
+			t.Fatalf("attempt %d: status = %d, want 401", i+1, rec.Code)
+		}
+	}
+	rec := connect("10.0.0.1", "other.example.com", "lb_good")
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "60" {
+		t.Errorf("locked IP: status = %d, Retry-After = %q, want 429 and 60", rec.Code, rec.Header().Get("Retry-After"))
+	}
+
+	// Guesses spread across IPs still lock the account they target
+	for i := 0; i < 5; i++ {
+		connect(fmt.Sprintf("10.0.1.%d", i), "app.example.com", "lb_guess")
+	}
+	if rec := connect("10.0.2.1", "app.example.com", "lb_guess"); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("locked account: status = %d, want 429", rec.Code)
+	}
+
+	// Its owner's valid token still connects, or anyone could lock them out
+	// by guessing at their hostname. Connects let through fail to hijack
+	// the recorder.
+	if rec := connect("10.0.3.1", "app.example.com", "lb_good"); rec.Code == http.StatusTooManyRequests || rec.Code == http.StatusUnauthorized {
+		t.Errorf("valid token on a locked hostname: status = %d, want it let through", rec.Code)
+	}
+
+	entries, _ := mem.ListAudit(context.Background(), "user-1", 10)
+	if len(entries) != 1 || entries[0].Action != "auth.locked_out" || !strings.Contains(entries[0].Detail, "app.example.com") {
+		t.Errorf("audit = %+v, want one auth.locked_out entry for app.example.com", entries)
+	}
+}
+
+func TestAdminAPILockout(t *testing.T) {
+	config := DefaultServerConfig()
+	config.AdminToken = "secret"
+	config.AuthIPLimit = ratelimit.Policy{MaxFailures: 2, Window: time.Minute, Lockout: time.Minute}
+	s := NewServerWithConfig(nil, config)
+
+	send := func(token string) int {
+		req := httptest.NewRequest("GET", "/_lobber/admin/overview", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	send("wrong")
+	send("wrong")
+	if code := send("secret"); code != http.StatusTooManyRequests {
+		t.Errorf("status after lockout = %d, want 429", code)
+	}
+}
+
+func TestAPIMe(t *testing.T) {
+	s := NewServerWithConfig(nil, DefaultServerConfig())
+	mem := s.stores.Tokens.(*store.Memory)
+	mem.AddUser(store.User{ID: "user-1", Email: "dev@example.com", Plan: "pro"})
+	mem.CreateToken(context.Background(), "user-1", "ci", auth.HashToken("lb_good"))
+	mem.SetPreferences(context.Background(), "user-1", store.Preferences{BurstLimit: "off"})
+
+	tests := []struct {
+		name   string
+		host   string
+		auth   string
+		status int
+	}{
+		{"valid token", "localhost", "Bearer lb_good", http.StatusOK},
+		{"unknown token", "localhost", "Bearer lb_bad", http.StatusUnauthorized},
+		{"no token", "localhost", "", http.StatusUnauthorized},
+		{"tunnel host", "app.example.com", "Bearer lb_good", http.StatusBadGateway},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/api/v1/me", nil)
+			req.Host = tt.host
+			if tt.auth != "" {
+				req.Header.Set("Authorization", tt.auth)
+			}
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, req)
+
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.status)
+			}
+			if tt.status == http.StatusOK && !strings.Contains(rec.Body.String(), `"email":"dev@example.com"`) {
+				t.Errorf("body = %s, want the token owner's email", rec.Body.String())
+			}
+			if tt.status == http.StatusOK && !strings.Contains(rec.Body.String(), `"preferences":{"region":"us","inspect":false,"log_retention_days":0,"burst_limit":"off"}`) {
+				t.Errorf("body = %s, want the token owner's preferences", rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestAPIQuota(t *testing.T) {
+	config := DefaultServerConfig()
+	config.APIQuota = ratelimit.QuotaPolicy{Window: time.Hour, Default: 2, Plans: map[string]int{"pro": 3}}
+	s := NewServerWithConfig(nil, config)
+	mem := s.stores.Tokens.(*store.Memory)
+	mem.AddUser(store.User{ID: "free", Email: "free@example.com"})
+	mem.AddUser(store.User{ID: "pro", Email: "pro@example.com", Plan: "pro"})
+	mem.CreateToken(context.Background(), "free", "ci", auth.HashToken("lb_free"))
+	mem.CreateToken(context.Background(), "pro", "ci", auth.HashToken("lb_pro"))
+
+	get := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/v1/me", nil)
+		req.Host = "localhost"
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		return rec
+	}
+
+	tests := []struct {
+		token     string
+		status    int
+		remaining string
+	}{
+		{"lb_free", http.StatusOK, "1"},
+		{"lb_free", http.StatusOK, "0"},
+		{"lb_free", http.StatusTooManyRequests, "0"},
+		{"lb_pro", http.StatusOK, "2"},
+	}
+	for i, tt := range tests {
+		rec := get(tt.token)
+		if rec.Code != tt.status {
+			t.Fatalf("request %d: status = %d, want %d", i+1, rec.Code, tt.status)
+		}
+		if got := rec.Header().Get("X-RateLimit-Remaining"); got != tt.remaining {
+			t.Errorf("request %d: X-RateLimit-Remaining = %q, want %q", i+1, got, tt.remaining)
+		}
+		if tt.status == http.StatusTooManyRequests && (rec.Header().Get("Retry-After") == "" || !strings.Contains(rec.Body.String(), `"error":"rate limit exceeded"`)) {
+			t.Errorf("429 = %v %s, want Retry-After and a JSON error", rec.Header(), rec.Body)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+// internal/relay/authlimit.go
+package relay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/lobber-dev/lobber/internal/ratelimit"
+	"github.com/lobber-dev/lobber/internal/store"
+)
+
+// remoteIP returns the client address without its port
+func remoteIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+// authLockedOut rejects the request with 429 when the client IP or the
+// hostname it is authenticating for (either may be empty) is locked out, and
+// reports whether it did. The hostname is whatever the client says, so its
+// lockout is only checked once a token has failed; a valid one connects
+// regardless.
+func (s *Server) authLockedOut(w http.ResponseWriter, r *http.Request, ip, hostname string) bool {
+	var wait time.Duration
+	if ip != "" {
+		wait = s.authIP.Locked(r.Context(), ip)
+	}
+	if hostname != "" {
+		wait = max(wait, s.authAccount.Locked(r.Context(), hostname))
+	}
+	if wait == 0 {
+		return false
+	}
+	w.Header().Set("Retry-After", ratelimit.RetryAfter(wait))
+	http.Error(w, fmt.Sprintf("too many failed attempts, try again in %s", wait.Round(time.Second)), http.StatusTooManyRequests)
+	return true
+}
+
+// authFailed counts a failed attempt from ip against hostname (which may be
+// empty) and records any lockout it causes in the hostname owner's audit log
+func (s *Server) authFailed(ctx context.Context, ip, hostname, what string) {
+	if s.authIP.Fail(ctx, ip) {
+		log.Printf("auth: locked out %s after repeated failed %s attempts", ip, what)
+		s.auditLockout(ctx, hostname, ip, fmt.Sprintf("%s from %s blocked for %s after repeated failures", what, ip, s.config.AuthIPLimit.Lockout))
+	}
+	if hostname != "" && s.authAccount.Fail(ctx, hostname) {
+		log.Printf("auth: locked out %s for %s after repeated failed attempts", what, hostname)
+		s.auditLockout(ctx, hostname, ip, fmt.Sprintf("%s for %s blocked for %s after repeated failures", what, hostname, s.config.AuthAccountLimit.Lockout))
+	}
+}
+
+// authSucceeded clears the failure counters after a successful attempt
+func (s *Server) authSucceeded(ctx context.Context, ip, hostname string) {
+	s.authIP.Succeed(ctx, ip)
+	if hostname != "" {
+		s.authAccount.Succeed(ctx, hostname)
+	}
+}
+
+// auditLockout tells the owner of a registered hostname that someone was
+// locked out trying to use it
+func (s *Server) auditLockout(ctx context.Context, hostname, ip, detail string) {
+	if hostname == "" {
+		return
+	}
+	userID, err := s.stores.Domains.DomainOwner(ctx, hostname)
+	if err != nil {
+		if !errors.Is(err, store.ErrNotFound) {
+			log.Printf("auth: find owner of %s: %v", hostname, err)
+		}
+		return
+	}
+	err = s.stores.Audit.RecordAudit(ctx, store.AuditEntry{
+		UserID:    userID,
+		Action:    "auth.locked_out",
+		Detail:    detail,
+		IPAddress: ip,
+	})
+	if err != nil {
+		log.Printf("auth: record lockout for %s: %v", userID, err)
+	}
+}
@@ -0,0 +1,122 @@
+// internal/relay/burst.go
+package relay
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BurstHeader lets a tunnel override the relay's BurstPolicy on connect:
+// "off", or the requests per second it always accepts
+const BurstHeader = "X-Lobber-Burst-Limit"
+
+// BurstPolicy caps sudden traffic spikes to one hostname, such as a link
+// landing on a busy forum, before they reach the developer's machine
+type BurstPolicy struct {
+	Factor float64       // How many times its usual rate a hostname may spike to; 0 disables the limit
+	Floor  float64       // Requests per second always allowed, however quiet the hostname usually is
+	Window time.Duration // How long the usual rate is averaged over
+}
+
+// DefaultBurstPolicy allows 100x a hostname's usual traffic, and at least
+// 20 requests a second
+func DefaultBurstPolicy() BurstPolicy {
+	return BurstPolicy{Factor: 100, Floor: 20, Window: 10 * time.Minute}
+}
+
+// withOverride applies a tunnel's BurstHeader value to the policy
+func (p BurstPolicy) withOverride(v string) (BurstPolicy, error) {
+	v = strings.TrimSpace(v)
+	switch {
+	case v == "":
+		return p, nil
+	case strings.EqualFold(v, "off"):
+		p.Factor = 0
+		return p, nil
+	}
+	floor, err := strconv.ParseFloat(v, 64)
+	if err != nil || floor <= 0 || math.IsInf(floor, 0) {
+		return p, fmt.Errorf("want \"off\" or requests per second, got %q", v)
+	}
+	p.Floor = floor
+	if p.Factor == 0 {
+		p.Factor = DefaultBurstPolicy().Factor
+	}
+	return p, nil
+}
+
+// burstLimiter is a token bucket refilled at Factor times the hostname's
+// usual rate, never below Floor. The usual rate is a moving average of
+// admitted requests that decays over Window.
+type burstLimiter struct {
+	policy BurstPolicy
+
+	mu       sync.Mutex
+	baseline float64 // usual requests per second
+	tokens   float64
+	last     time.Time
+}
+
+func newBurstLimiter(policy BurstPolicy) *burstLimiter {
+	if policy.Factor <= 0 {
+		return nil
+	}
+	if policy.Window <= 0 {
+		policy.Window = DefaultBurstPolicy().Window
+	}
+	return &burstLimiter{policy: policy}
+}
+
+// allow admits one request, or returns how long until the next one fits.
+// A nil limiter admits everything.
+func (b *burstLimiter) allow(now time.Time) (bool, time.Duration) {
+	if b == nil {
+		return true, 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	window := b.policy.Window.Seconds()
+	if b.last.IsZero() {
+		b.tokens = b.policy.Floor
+	} else if dt := now.Sub(b.last).Seconds(); dt > 0 {
+		b.baseline *= math.Exp(-dt / window)
+		b.tokens = min(b.rate(), b.tokens+dt*b.rate())
+	}
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		b.baseline += 1 / window
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / b.rate() * float64(time.Second))
+	return false, wait
+}
+
+// rate is how many requests a second the bucket refills with
+func (b *burstLimiter) rate() float64 {
+	return max(b.policy.Floor, b.policy.Factor*b.baseline, 1)
+}
+
+var burstPageTmpl = visitorPage(`{{define "title"}}Too much traffic right now{{end}}
+{{define "content"}}
+        <h1>This preview is being rate limited</h1>
+        <p><code>{{.Domain}}</code> is served from a developer's own machine and is getting far more visitors than usual.</p>
+        <p>Please try again in {{.RetryAfter}} second{{if ne .RetryAfter 1}}s{{end}}.</p>
+{{end}}`)
+
+// writeBurstPage responds with 429 Too Many Requests for a spiking domain
+func writeBurstPage(w http.ResponseWriter, domain string, wait time.Duration) {
+	secs := max(1, int(math.Ceil(wait.Seconds())))
+	w.Header().Set("Retry-After", strconv.Itoa(secs))
+	writeVisitorPage(w, http.StatusTooManyRequests, burstPageTmpl, struct {
+		Domain     string
+		RetryAfter int
+	}{domain, secs})
+}
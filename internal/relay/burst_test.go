@@ -0,0 +1,129 @@
+// internal/relay/burst_test.go
+package relay
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lobber-dev/lobber/internal/tunnel"
+)
+
+// admitted counts how many of n requests spread evenly over d get through
+func admitted(b *burstLimiter, start time.Time, n int, d time.Duration) int {
+	ok := 0
+	for i := range n {
+		if allowed, _ := b.allow(start.Add(d * time.Duration(i) / time.Duration(n))); allowed {
+			ok++
+		}
+	}
+	return ok
+}
+
+func TestBurstLimiter(t *testing.T) {
+	policy := BurstPolicy{Factor: 100, Floor: 20, Window: 10 * time.Minute}
+	start := time.Now()
+
+	// A quiet hostname can take the floor but not a flood
+	quiet := newBurstLimiter(policy)
+	if got := admitted(quiet, start, 10, time.Second); got != 10 {
+		t.Errorf("quiet hostname admitted %d of 10, want all", got)
+	}
+	// What's left in the bucket plus a second of refill at the floor
+	if got := admitted(quiet, start.Add(time.Second), 1000, time.Second); got > 45 {
+		t.Errorf("flood to a quiet hostname admitted %d/s, want at most about twice the floor of 20", got)
+	}
+
+	// A hostname used to 1 req/s may spike well past the floor
+	busy := newBurstLimiter(policy)
+	admitted(busy, start, 600, 10*time.Minute)
+	spike := start.Add(10 * time.Minute)
+	if got := admitted(busy, spike, 1000, time.Second); got < 50 {
+		t.Errorf("spike on a busy hostname admitted %d/s, want far more than the floor", got)
+	}
+
+	if newBurstLimiter(BurstPolicy{}) != nil {
+		t.Error("zero policy built a limiter, want none")
+	}
+	var none *burstLimiter
+	if ok, _ := none.allow(start); !ok {
+		t.Error("nil limiter refused a request")
+	}
+}
+
+func TestBurstOverride(t *testing.T) {
+	tests := []struct {
+		header  string
+		factor  float64
+		floor   float64
+		wantErr bool
+	}{
+		{"", 100, 20, false},
+		{"off", 0, 20, false},
+		{"OFF", 0, 20, false},
+		{"500", 100, 500, false},
+		{"0", 0, 0, true},
+		{"lots", 0, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			p, err := DefaultBurstPolicy().withOverride(tt.header)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("withOverride(%q) error = %v, wantErr %v", tt.header, err, tt.wantErr)
+			}
+			if !tt.wantErr && (p.Factor != tt.factor || p.Floor != tt.floor) {
+				t.Errorf("withOverride(%q) = factor %v floor %v, want %v and %v", tt.header, p.Factor, p.Floor, tt.factor, tt.floor)
+			}
+		})
+	}
+}
+
+func TestProxyServesBurstPage(t *testing.T) {
+	config := DefaultServerConfig()
+	s := NewServerWithConfig(nil, config)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tun := &Tunnel{
+		Domain:  "app.example.com",
+		state:   TunnelStateReady,
+		reqCh:   make(chan *pendingRequest, 10),
+		done:    make(chan struct{}),
+		config:  config,
+		ctx:     ctx,
+		cancel:  cancel,
+		onClose: func() {},
+		burst:   newBurstLimiter(BurstPolicy{Factor: 100, Floor: 2, Window: time.Minute}),
+	}
+	s.RegisterTunnel(tun)
+	go func() {
+		for pr := range tun.reqCh {
+			pr.respCh <- &tunnel.Response{ID: pr.req.ID, StatusCode: http.StatusOK}
+		}
+	}()
+
+	codes := make([]int, 3)
+	var limited *httptest.ResponseRecorder
+	for i := range codes {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Host = "app.example.com"
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		codes[i] = rec.Code
+		limited = rec
+	}
+
+	if codes[0] != http.StatusOK || codes[1] != http.StatusOK || codes[2] != http.StatusTooManyRequests {
+		t.Fatalf("statuses = %v, want two admitted then 429", codes)
+	}
+	if limited.Header().Get("Retry-After") == "" {
+		t.Error("429 without Retry-After")
+	}
+	if !strings.Contains(limited.Body.String(), "being rate limited") {
+		t.Errorf("429 body = %q, want the rate limit page", limited.Body.String())
+	}
+}
@@ -0,0 +1,43 @@
+// internal/relay/cancel.go
+package relay
+
+import (
+	"slices"
+
+	"github.com/lobber-dev/lobber/internal/tunnel"
+)
+
+// statusClientClosed is logged for requests whose visitor went away before
+// the client answered, as nginx does
+const statusClientClosed = 499
+
+// abandon forgets pr, whose visitor went away or whose answer took too
+// long. A request already sent is cancelled on clients that use
+// tunnel.FeatureCancel, so they stop forwarding it; others finish it and
+// their response is dropped.
+func (t *Tunnel) abandon(pr *pendingRequest) {
+	t.queueMu.Lock()
+	t.pendingQueue = slices.DeleteFunc(t.pendingQueue, func(q *pendingRequest) bool { return q == pr })
+	t.queueMu.Unlock()
+
+	t.sentMu.Lock()
+	pr.abandoned = true
+	sent := t.sent[pr.req.ID] == pr
+	if sent {
+		delete(t.sent, pr.req.ID)
+	}
+	t.sentMu.Unlock()
+	if !sent {
+		t.refund(pr)
+		return
+	}
+	if !t.uses(tunnel.FeatureCancel) {
+		return
+	}
+
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+	if tunnel.EncodeCancel(t.frames(), &tunnel.Cancel{IDs: []string{pr.req.ID}}) == nil {
+		t.bufrw.Flush()
+	}
+}
@@ -0,0 +1,110 @@
+// internal/relay/capacity.go
+package relay
+
+import (
+	"math"
+	"os"
+	"runtime/debug"
+	"runtime/metrics"
+	"sync"
+	"time"
+)
+
+// capacitySampleTTL is how long a capacity sample is reused, so a connect
+// storm doesn't walk the descriptor table on every attempt
+const capacitySampleTTL = time.Second
+
+// capacityRetryAfter is the Retry-After, in seconds, sent with connects
+// refused for capacity
+const capacityRetryAfter = "30"
+
+// Capacity is how close the relay is to the limits of what it can hold.
+// A limit of 0 means there is none, or it couldn't be read.
+type Capacity struct {
+	Tunnels     int     `json:"tunnels"`
+	MaxTunnels  int     `json:"max_tunnels"`
+	OpenFiles   int     `json:"open_files"`
+	FileLimit   int     `json:"file_limit"`   // soft RLIMIT_NOFILE
+	MemoryBytes uint64  `json:"memory_bytes"` // mapped by the Go runtime
+	MemoryLimit uint64  `json:"memory_limit"` // GOMEMLIMIT
+	Utilization float64 `json:"utilization"`  // highest share of any limit in use
+}
+
+// utilization returns the highest share of a limit in use
+func (c Capacity) utilization() float64 {
+	u := 0.0
+	share := func(used, limit float64) {
+		if limit > 0 {
+			u = max(u, used/limit)
+		}
+	}
+	share(float64(c.Tunnels), float64(c.MaxTunnels))
+	share(float64(c.OpenFiles), float64(c.FileLimit))
+	share(float64(c.MemoryBytes), float64(c.MemoryLimit))
+	return u
+}
+
+// capacityGate caches capacity samples for admission decisions
+type capacityGate struct {
+	sample func() Capacity
+
+	mu        sync.Mutex
+	last      Capacity
+	sampledAt time.Time
+}
+
+// current returns a sample no older than capacitySampleTTL
+func (g *capacityGate) current() Capacity {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if time.Since(g.sampledAt) > capacitySampleTTL {
+		g.last = g.sample()
+		g.last.Utilization = g.last.utilization()
+		g.sampledAt = time.Now()
+	}
+	return g.last
+}
+
+// atCapacity reports whether new tunnels should be turned away because the
+// relay is past CapacityLimit of a limit or holds MaxTunnels already
+func (s *Server) atCapacity() (Capacity, bool) {
+	c := s.capacity.current()
+	if c.MaxTunnels > 0 && c.Tunnels >= c.MaxTunnels {
+		return c, true
+	}
+	return c, s.config.CapacityLimit > 0 && c.Utilization >= s.config.CapacityLimit
+}
+
+// sampleCapacity measures the relay against its limits
+func (s *Server) sampleCapacity() Capacity {
+	c := Capacity{
+		Tunnels:    s.tunnelCount(),
+		MaxTunnels: s.config.MaxTunnels,
+		OpenFiles:  openFiles(),
+		FileLimit:  fileLimit(),
+	}
+
+	samples := []metrics.Sample{
+		{Name: "/memory/classes/total:bytes"},
+		{Name: "/memory/classes/heap/released:bytes"},
+	}
+	metrics.Read(samples)
+	if samples[0].Value.Kind() == metrics.KindUint64 && samples[1].Value.Kind() == metrics.KindUint64 {
+		c.MemoryBytes = samples[0].Value.Uint64() - samples[1].Value.Uint64()
+	}
+	if limit := debug.SetMemoryLimit(-1); limit != math.MaxInt64 {
+		c.MemoryLimit = uint64(limit)
+	}
+	return c
+}
+
+// openFiles counts the process's open descriptors, or returns 0 where the
+// system doesn't list them
+func openFiles() int {
+	for _, dir := range []string{"/proc/self/fd", "/dev/fd"} {
+		if entries, err := os.ReadDir(dir); err == nil {
+			return len(entries)
+		}
+	}
+	return 0
+}
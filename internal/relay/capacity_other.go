@@ -0,0 +1,9 @@
+//go:build !unix
+
+// internal/relay/capacity_other.go
+package relay
+
+// fileLimit returns 0: there is no descriptor limit to read here
+func fileLimit() int {
+	return 0
+}
@@ -0,0 +1,90 @@
+// internal/relay/capacity_test.go
+package relay
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+)
+
+func TestCapacityUtilization(t *testing.T) {
+	tests := []struct {
+		name string
+		c    Capacity
+		want float64
+	}{
+		{"no limits", Capacity{Tunnels: 500, OpenFiles: 900, MemoryBytes: 1 << 30}, 0},
+		{"files", Capacity{OpenFiles: 900, FileLimit: 1000}, 0.9},
+		{"memory", Capacity{OpenFiles: 10, FileLimit: 1000, MemoryBytes: 3 << 20, MemoryLimit: 4 << 20}, 0.75},
+		{"tunnels", Capacity{Tunnels: 50, MaxTunnels: 50, OpenFiles: 10, FileLimit: 1000}, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.c.utilization(); got != tt.want {
+				t.Errorf("utilization() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConnectAtCapacity(t *testing.T) {
+	tests := []struct {
+		name     string
+		capacity Capacity
+		status   int
+	}{
+		{"room", Capacity{OpenFiles: 100, FileLimit: 1024}, http.StatusBadRequest}, // through to header checks
+		{"out of descriptors", Capacity{OpenFiles: 1000, FileLimit: 1024}, http.StatusServiceUnavailable},
+		{"out of memory", Capacity{MemoryBytes: 95, MemoryLimit: 100}, http.StatusServiceUnavailable},
+		{"tunnel cap", Capacity{Tunnels: 3, MaxTunnels: 3}, http.StatusServiceUnavailable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServer(nil)
+			s.capacity.sample = func() Capacity { return tt.capacity }
+
+			req := httptest.NewRequest("POST", "/_lobber/connect", nil)
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, req)
+
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.status)
+			}
+			if tt.status == http.StatusServiceUnavailable && rec.Header().Get("Retry-After") == "" {
+				t.Error("capacity refusal without Retry-After")
+			}
+		})
+	}
+}
+
+func TestHealthReportsCapacity(t *testing.T) {
+	config := DefaultServerConfig()
+	config.MaxTunnels = 100
+	s := NewServerWithConfig(nil, config)
+	s.RegisterTunnel(&Tunnel{Domain: "app.example.com"})
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest("GET", "/health", nil))
+
+	var body struct {
+		Status   string   `json:"status"`
+		Capacity Capacity `json:"capacity"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	c := body.Capacity
+	if body.Status != "ok" || c.Tunnels != 1 || c.MaxTunnels != 100 || c.MemoryBytes == 0 {
+		t.Errorf("health = %+v, want ok with 1 of 100 tunnels and memory in use", body)
+	}
+	if runtime.GOOS == "linux" && (c.OpenFiles == 0 || c.FileLimit == 0) {
+		t.Errorf("capacity = %+v, want open files and their limit on linux", c)
+	}
+	if c.Utilization < 0.01 {
+		t.Errorf("Utilization = %v, want at least the tunnel share", c.Utilization)
+	}
+}
@@ -0,0 +1,18 @@
+//go:build unix
+
+// internal/relay/capacity_unix.go
+package relay
+
+import (
+	"math"
+	"syscall"
+)
+
+// fileLimit returns the soft limit on open descriptors
+func fileLimit() int {
+	var rlim syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlim); err != nil || rlim.Cur > math.MaxInt32 {
+		return 0
+	}
+	return int(rlim.Cur)
+}
@@ -0,0 +1,119 @@
+// internal/relay/certcache.go
+package relay
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/lobber-dev/lobber/internal/store"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const (
+	// certLockTTL is how long a relay has to obtain a certificate before
+	// another may try
+	certLockTTL = 2 * time.Minute
+	// certPollInterval is how often a relay waiting on another's
+	// certificate looks for it
+	certPollInterval = time.Second
+)
+
+// fleetCertCache is an autocert.Cache in the store, shared by every relay.
+// The first relay to miss a certificate takes a lease on it and orders it
+// from the ACME CA; the others wait for it to be stored rather than order
+// their own and run into the CA's rate limits. Challenge tokens are shared
+// too, so any relay can answer the CA's HTTP-01 request.
+type fleetCertCache struct {
+	certs  store.CertStore
+	holder string         // this relay, unique across restarts
+	seed   autocert.Cache // read when the store misses, e.g. a relay's old DirCache; may be nil
+	poll   time.Duration
+}
+
+// CertCache returns an autocert.Cache in the relay's store for the fleet to
+// share. Certificates missing from it are copied from seed when it has
+// them, so moving from a directory cache doesn't reissue everything.
+func (s *Server) CertCache(seed autocert.Cache) autocert.Cache {
+	return newFleetCertCache(s.stores.Certs, s.config.RelayID, seed)
+}
+
+func newFleetCertCache(certs store.CertStore, relayID string, seed autocert.Cache) *fleetCertCache {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return &fleetCertCache{
+		certs:  certs,
+		holder: relayID + "-" + hex.EncodeToString(b),
+		seed:   seed,
+		poll:   certPollInterval,
+	}
+}
+
+// Get returns the data under key. For a certificate nobody has, it waits
+// while another relay holds the lease, and returns autocert.ErrCacheMiss
+// once this relay has it.
+func (c *fleetCertCache) Get(ctx context.Context, key string) ([]byte, error) {
+	for {
+		data, err := c.certs.GetCert(ctx, key)
+		if err == nil {
+			return data, nil
+		}
+		if !errors.Is(err, store.ErrNotFound) {
+			return nil, err
+		}
+		if data, ok := c.seeded(ctx, key); ok {
+			return data, nil
+		}
+		if _, ok := certHost(key); !ok {
+			return nil, autocert.ErrCacheMiss
+		}
+
+		locked, err := c.certs.LockCert(ctx, key, c.holder, certLockTTL)
+		if err != nil {
+			return nil, err
+		}
+		if locked {
+			return nil, autocert.ErrCacheMiss
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(c.poll):
+		}
+	}
+}
+
+// seeded copies key from the seed cache into the store
+func (c *fleetCertCache) seeded(ctx context.Context, key string) ([]byte, bool) {
+	if c.seed == nil {
+		return nil, false
+	}
+	data, err := c.seed.Get(ctx, key)
+	if err != nil {
+		return nil, false
+	}
+	if err := c.certs.PutCert(ctx, key, data); err != nil {
+		log.Printf("cert cache: copy %s: %v", key, err)
+	}
+	return data, true
+}
+
+// Put stores data under key, releasing this relay's lease on a certificate
+func (c *fleetCertCache) Put(ctx context.Context, key string, data []byte) error {
+	if err := c.certs.PutCert(ctx, key, data); err != nil {
+		return err
+	}
+	if _, ok := certHost(key); ok {
+		if err := c.certs.UnlockCert(ctx, key, c.holder); err != nil {
+			log.Printf("cert cache: unlock %s: %v", key, err)
+		}
+	}
+	return nil
+}
+
+func (c *fleetCertCache) Delete(ctx context.Context, key string) error {
+	return c.certs.DeleteCert(ctx, key)
+}
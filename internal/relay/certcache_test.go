@@ -0,0 +1,97 @@
+// internal/relay/certcache_test.go
+package relay
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/lobber-dev/lobber/internal/store"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+func TestFleetCertCacheIssuesOnce(t *testing.T) {
+	mem := store.NewMemory()
+	first := newFleetCertCache(mem, "relay-1", nil)
+	second := newFleetCertCache(mem, "relay-2", nil)
+	second.poll = 5 * time.Millisecond
+	ctx := context.Background()
+
+	if _, err := first.Get(ctx, "app.mysite.com"); !errors.Is(err, autocert.ErrCacheMiss) {
+		t.Fatalf("first Get() error = %v, want ErrCacheMiss so it orders the certificate", err)
+	}
+
+	// The second relay waits for the first instead of ordering its own
+	got := make(chan []byte, 1)
+	go func() {
+		data, err := second.Get(ctx, "app.mysite.com")
+		if err != nil {
+			t.Errorf("second Get() error = %v", err)
+		}
+		got <- data
+	}()
+	select {
+	case <-got:
+		t.Fatal("second Get() returned while the first relay held the lease")
+	case <-time.After(30 * time.Millisecond):
+	}
+	if err := first.Put(ctx, "app.mysite.com", []byte("cert")); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+	select {
+	case data := <-got:
+		if string(data) != "cert" {
+			t.Errorf("second Get() = %q, want the first relay's certificate", data)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("second Get() didn't pick up the stored certificate")
+	}
+
+	// Challenge tokens and the account key miss without a lease
+	short, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	for _, key := range []string{"acme_account+key", "www.mysite.com+http-01"} {
+		if _, err := second.Get(short, key); !errors.Is(err, autocert.ErrCacheMiss) {
+			t.Errorf("Get(%q) error = %v, want ErrCacheMiss", key, err)
+		}
+	}
+}
+
+func TestFleetCertCacheLeaseExpires(t *testing.T) {
+	mem := store.NewMemory()
+	now := time.Now()
+	mem.SetClock(func() time.Time { return now })
+	first := newFleetCertCache(mem, "relay-1", nil)
+	second := newFleetCertCache(mem, "relay-2", nil)
+	second.poll = time.Millisecond
+	ctx := context.Background()
+
+	first.Get(ctx, "app.mysite.com")
+	short, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if _, err := second.Get(short, "app.mysite.com"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Get() during the lease error = %v, want it to wait", err)
+	}
+
+	// The first relay never stored its certificate; the second takes over
+	now = now.Add(certLockTTL + time.Second)
+	if _, err := second.Get(ctx, "app.mysite.com"); !errors.Is(err, autocert.ErrCacheMiss) {
+		t.Errorf("Get() after the lease expired error = %v, want ErrCacheMiss", err)
+	}
+}
+
+func TestFleetCertCacheSeed(t *testing.T) {
+	mem := store.NewMemory()
+	dir := autocert.DirCache(t.TempDir())
+	ctx := context.Background()
+	dir.Put(ctx, "app.mysite.com", []byte("old cert"))
+
+	c := newFleetCertCache(mem, "relay-1", dir)
+	if data, err := c.Get(ctx, "app.mysite.com"); err != nil || string(data) != "old cert" {
+		t.Fatalf("Get() = %q, %v, want the certificate from the directory", data, err)
+	}
+	if data, err := mem.GetCert(ctx, "app.mysite.com"); err != nil || string(data) != "old cert" {
+		t.Errorf("store has %q, %v, want the certificate copied in", data, err)
+	}
+}
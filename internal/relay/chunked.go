@@ -0,0 +1,72 @@
+// internal/relay/chunked.go
+package relay
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/lobber-dev/lobber/internal/tunnel"
+)
+
+// copyChunked writes the body of the chunked response with id to the
+// visitor as its Stream frames arrive, granting the client room for more
+// as it goes, and returns how many bytes it wrote. A visitor that goes away
+// ends the stream, so the client stops sending it.
+func (t *Tunnel) copyChunked(ctx context.Context, w http.ResponseWriter, id string) int64 {
+	t.streamMu.Lock()
+	st := t.streams[id]
+	t.streamMu.Unlock()
+	if st == nil {
+		return 0
+	}
+	defer t.closeStream(id)
+
+	rc := http.NewResponseController(w)
+	var written int64
+	write := func(data []byte) bool {
+		n, err := w.Write(data)
+		written += int64(n)
+		if err == nil {
+			err = rc.Flush()
+		}
+		return err == nil && t.writeWindow(id, n) == nil
+	}
+	for {
+		select {
+		case data := <-st.data:
+			if !write(data) {
+				t.writeStream(&tunnel.Stream{ID: id, Close: true})
+				return written
+			}
+		case <-st.done:
+			for len(st.data) > 0 {
+				write(<-st.data)
+			}
+			return written
+		case <-ctx.Done():
+			t.writeStream(&tunnel.Stream{ID: id, Close: true})
+			return written
+		case <-t.done:
+			return written
+		}
+	}
+}
+
+// discard ends a chunked response to pr that arrived as its visitor went
+// away, so the client stops sending its body. Callers have abandoned pr.
+func (t *Tunnel) discard(pr *pendingRequest) {
+	select {
+	case resp := <-pr.respCh:
+		if resp != nil && resp.Chunked {
+			t.endChunked(resp.ID)
+		}
+	default:
+	}
+}
+
+// endChunked ends the chunked response with id unread, so the client stops
+// sending its body
+func (t *Tunnel) endChunked(id string) {
+	t.closeStream(id)
+	t.writeStream(&tunnel.Stream{ID: id, Close: true})
+}
@@ -0,0 +1,72 @@
+// internal/relay/connlimit.go
+package relay
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// ParseBanList parses a comma or space separated list of IP addresses and
+// CIDR ranges, e.g. "203.0.113.7, 198.51.100.0/24"
+func ParseBanList(s string) ([]netip.Prefix, error) {
+	var bans []netip.Prefix
+	for _, field := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ' ' }) {
+		if strings.Contains(field, "/") {
+			prefix, err := netip.ParsePrefix(field)
+			if err != nil {
+				return nil, fmt.Errorf("parse ban %q: %w", field, err)
+			}
+			bans = append(bans, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(field)
+		if err != nil {
+			return nil, fmt.Errorf("parse ban %q: %w", field, err)
+		}
+		bans = append(bans, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+	}
+	return bans, nil
+}
+
+// banned reports whether ip falls in the configured ban list
+func (s *Server) banned(ip string) bool {
+	if len(s.config.BannedIPs) == 0 {
+		return false
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range s.config.BannedIPs {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// reserveConn counts a tunnel connection from ip against MaxTunnelsPerIP and
+// reports whether there was room. Every reservation must be released with
+// releaseConn when the connection ends.
+func (s *Server) reserveConn(ip string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.config.MaxTunnelsPerIP > 0 && s.connsByIP[ip] >= s.config.MaxTunnelsPerIP {
+		return false
+	}
+	s.connsByIP[ip]++
+	return true
+}
+
+// releaseConn gives back a reservation from reserveConn
+func (s *Server) releaseConn(ip string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.connsByIP[ip] <= 1 {
+		delete(s.connsByIP, ip)
+		return
+	}
+	s.connsByIP[ip]--
+}
@@ -0,0 +1,135 @@
+// internal/relay/connlimit_test.go
+package relay
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/lobber-dev/lobber/internal/ratelimit"
+	"github.com/lobber-dev/lobber/internal/tunnel"
+)
+
+func TestParseBanList(t *testing.T) {
+	bans, err := ParseBanList("203.0.113.7, 198.51.100.9/24 2001:db8::/32")
+	if err != nil {
+		t.Fatalf("ParseBanList() error = %v", err)
+	}
+	want := []string{"203.0.113.7/32", "198.51.100.0/24", "2001:db8::/32"}
+	if len(bans) != len(want) {
+		t.Fatalf("ParseBanList() = %v, want %v", bans, want)
+	}
+	for i := range want {
+		if bans[i].String() != want[i] {
+			t.Errorf("bans[%d] = %s, want %s", i, bans[i], want[i])
+		}
+	}
+
+	if _, err := ParseBanList("203.0.113.300"); err == nil {
+		t.Error("ParseBanList() accepted an invalid address")
+	}
+}
+
+func TestConnectBanList(t *testing.T) {
+	config := DefaultServerConfig()
+	config.BannedIPs, _ = ParseBanList("198.51.100.0/24")
+	s := NewServerWithConfig(nil, config)
+
+	tests := []struct {
+		addr   string
+		status int
+	}{
+		{"198.51.100.23:5000", http.StatusForbidden},
+		{"[::ffff:198.51.100.23]:5000", http.StatusForbidden},
+		{"192.0.2.1:5000", http.StatusBadRequest}, // allowed through to header checks
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("POST", "/_lobber/connect", nil)
+		req.RemoteAddr = tt.addr
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		if rec.Code != tt.status {
+			t.Errorf("%s: status = %d, want %d", tt.addr, rec.Code, tt.status)
+		}
+	}
+}
+
+func TestConnectAttemptCap(t *testing.T) {
+	config := DefaultServerConfig()
+	config.ConnectIPLimit = ratelimit.Policy{MaxFailures: 3, Window: time.Minute, Lockout: time.Minute}
+	s := NewServerWithConfig(nil, config)
+
+	connect := func(ip string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/_lobber/connect", nil)
+		req.RemoteAddr = ip + ":5000"
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for i := 0; i < 3; i++ {
+		if rec := connect("192.0.2.1"); rec.Code == http.StatusTooManyRequests {
+			t.Fatalf("attempt %d throttled", i+1)
+		}
+	}
+	rec := connect("192.0.2.1")
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("over the cap: status = %d, Retry-After = %q, want 429 with Retry-After", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	if rec := connect("192.0.2.2"); rec.Code == http.StatusTooManyRequests {
+		t.Error("another IP was throttled")
+	}
+}
+
+func TestReserveConn(t *testing.T) {
+	config := DefaultServerConfig()
+	config.MaxTunnelsPerIP = 2
+	s := NewServerWithConfig(nil, config)
+
+	if !s.reserveConn("a") || !s.reserveConn("a") {
+		t.Fatal("reservations under the cap were refused")
+	}
+	if s.reserveConn("a") {
+		t.Error("third reservation allowed, want the cap of 2 enforced")
+	}
+	if !s.reserveConn("b") {
+		t.Error("another IP was refused")
+	}
+
+	s.releaseConn("a")
+	if !s.reserveConn("a") {
+		t.Error("reservation refused after one was released")
+	}
+	s.releaseConn("a")
+	s.releaseConn("a")
+	s.releaseConn("b")
+	if len(s.connsByIP) != 0 {
+		t.Errorf("connsByIP = %v after releasing everything, want empty", s.connsByIP)
+	}
+}
+
+func TestConnectRefusedOpensNoShare(t *testing.T) {
+	config := DefaultServerConfig()
+	config.MaxTunnelsPerIP = 1
+	s := NewServerWithConfig(nil, config)
+	s.SetTokenValidator(func(token string) (string, bool) { return "u1", true })
+	s.reserveConn("192.0.2.1")
+
+	const host = "k3vq7m2xwa4tc.share.example.com"
+	req := httptest.NewRequest("POST", "/_lobber/connect", nil)
+	req.RemoteAddr = "192.0.2.1:5000"
+	req.Header.Set("X-Lobber-Domain", host)
+	req.Header.Set("Authorization", "Bearer lb_u1")
+	req.Header.Set(tunnel.ShareHeader, "ttl=1h")
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("status = %d, want %d (body %q)", rec.Code, http.StatusTooManyRequests, rec.Body.String())
+	}
+	if len(s.shares.shares) != 0 {
+		t.Errorf("shares = %v after a refused connect, want none opened", s.shares.shares)
+	}
+}
@@ -0,0 +1,132 @@
+// internal/relay/connmeta.go
+package relay
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/lobber-dev/lobber/internal/forcehttps"
+	"github.com/lobber-dev/lobber/internal/tunnel"
+)
+
+// ConnMeta describes how a client reached the relay. It is recorded for
+// tunnel connections and visitor requests so abuse reports can be traced to
+// an address and client software, and so protocol fallbacks show up.
+type ConnMeta struct {
+	RemoteIP       string `json:"remote_ip"`
+	TLSVersion     string `json:"tls_version,omitempty"`     // e.g. "TLS 1.3"; empty for plain HTTP
+	ALPN           string `json:"alpn,omitempty"`            // negotiated protocol such as "h2"
+	TLSFingerprint string `json:"tls_fingerprint,omitempty"` // hash of the ClientHello, see RecordClientHello
+	Transport      string `json:"transport,omitempty"`       // for tunnels not carried over plain TCP: tunnel.TransportWebSocket or TransportQUIC
+}
+
+// connMeta returns the connection metadata for r. It must be called before
+// the connection is hijacked, which forgets its fingerprint.
+func (s *Server) connMeta(r *http.Request) ConnMeta {
+	m := ConnMeta{RemoteIP: remoteIP(r)}
+	if r.TLS != nil {
+		m.TLSVersion = tls.VersionName(r.TLS.Version)
+		m.ALPN = r.TLS.NegotiatedProtocol
+		if fp, ok := s.hellos.Load(r.RemoteAddr); ok {
+			m.TLSFingerprint = fp.(string)
+		}
+	}
+	return m
+}
+
+// caller describes the visitor behind r, whose connection metadata is
+// meta, for the tunnel's client to pass on to the local server
+func caller(r *http.Request, meta ConnMeta) *tunnel.Caller {
+	c := &tunnel.Caller{
+		RemoteIP:   meta.RemoteIP,
+		Scheme:     "http",
+		Host:       r.Host,
+		TLSVersion: meta.TLSVersion,
+		ALPN:       meta.ALPN,
+	}
+	if forcehttps.Secure(r) {
+		c.Scheme = "https"
+	}
+	if r.TLS != nil {
+		c.ServerName = r.TLS.ServerName
+	}
+	return c
+}
+
+// describe summarizes the protocol for log lines, e.g. "TLS 1.3, h2"
+func (m ConnMeta) describe() string {
+	d := "plain HTTP"
+	switch {
+	case m.TLSVersion != "" && m.ALPN != "":
+		d = m.TLSVersion + ", " + m.ALPN
+	case m.TLSVersion != "":
+		d = m.TLSVersion
+	}
+	switch m.Transport {
+	case tunnel.TransportWebSocket:
+		d += ", WebSocket"
+	case tunnel.TransportQUIC:
+		d += ", QUIC"
+	}
+	return d
+}
+
+// RecordClientHello fingerprints the ClientHello of each TLS connection so
+// requests on it carry the fingerprint. Set it as the HTTPS listener's
+// tls.Config.GetConfigForClient, along with ConnState.
+func (s *Server) RecordClientHello(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	if hello.Conn != nil {
+		s.hellos.Store(hello.Conn.RemoteAddr().String(), clientHelloFingerprint(hello))
+	}
+	return nil, nil
+}
+
+// ConnState forgets a connection's fingerprint once it closes or is
+// hijacked for a tunnel. Set it as the HTTPS listener's http.Server.ConnState.
+func (s *Server) ConnState(c net.Conn, state http.ConnState) {
+	if state == http.StateClosed || state == http.StateHijacked {
+		s.hellos.Delete(c.RemoteAddr().String())
+	}
+}
+
+// clientHelloFingerprint hashes the parts of a ClientHello that identify the
+// TLS library that sent it, in the spirit of JA3: versions, cipher suites,
+// extensions, curves and point formats, with GREASE values dropped. Browsers
+// shuffle their extensions, so those are sorted first.
+func clientHelloFingerprint(hello *tls.ClientHelloInfo) string {
+	extensions := slices.Clone(hello.Extensions)
+	slices.Sort(extensions)
+
+	fields := []string{
+		joinHelloValues(hello.SupportedVersions),
+		joinHelloValues(hello.CipherSuites),
+		joinHelloValues(extensions),
+		joinHelloValues(hello.SupportedCurves),
+		joinHelloValues(hello.SupportedPoints),
+	}
+	sum := sha256.Sum256([]byte(strings.Join(fields, ",")))
+	return hex.EncodeToString(sum[:16])
+}
+
+// joinHelloValues joins ClientHello values with dashes, skipping GREASE
+// values (RFC 8701), which clients pick at random
+func joinHelloValues[T ~uint8 | ~uint16](vals []T) string {
+	parts := make([]string, 0, len(vals))
+	for _, v := range vals {
+		if isGREASE(uint16(v)) {
+			continue
+		}
+		parts = append(parts, strconv.Itoa(int(v)))
+	}
+	return strings.Join(parts, "-")
+}
+
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
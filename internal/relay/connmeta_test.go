@@ -0,0 +1,283 @@
+// internal/relay/connmeta_test.go
+package relay
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/lobber-dev/lobber/internal/store"
+	"github.com/lobber-dev/lobber/internal/tunnel"
+)
+
+func TestClientHelloFingerprint(t *testing.T) {
+	hello := &tls.ClientHelloInfo{
+		SupportedVersions: []uint16{0x1a1a, tls.VersionTLS13, tls.VersionTLS12},
+		CipherSuites:      []uint16{0x2a2a, tls.TLS_AES_128_GCM_SHA256, tls.TLS_CHACHA20_POLY1305_SHA256},
+		Extensions:        []uint16{0x3a3a, 43, 0, 10, 16},
+		SupportedCurves:   []tls.CurveID{0x4a4a, tls.X25519, tls.CurveP256},
+		SupportedPoints:   []uint8{0},
+	}
+	// The same client on another connection: new GREASE values, shuffled extensions
+	again := &tls.ClientHelloInfo{
+		SupportedVersions: []uint16{0xbaba, tls.VersionTLS13, tls.VersionTLS12},
+		CipherSuites:      []uint16{tls.TLS_AES_128_GCM_SHA256, tls.TLS_CHACHA20_POLY1305_SHA256},
+		Extensions:        []uint16{16, 10, 0xcaca, 0, 43},
+		SupportedCurves:   []tls.CurveID{tls.X25519, tls.CurveP256},
+		SupportedPoints:   []uint8{0},
+	}
+	other := &tls.ClientHelloInfo{
+		SupportedVersions: []uint16{tls.VersionTLS12},
+		CipherSuites:      []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+		Extensions:        []uint16{0, 10},
+		SupportedCurves:   []tls.CurveID{tls.CurveP256},
+		SupportedPoints:   []uint8{0},
+	}
+
+	fp := clientHelloFingerprint(hello)
+	if len(fp) != 32 {
+		t.Errorf("fingerprint = %q, want 32 hex characters", fp)
+	}
+	if got := clientHelloFingerprint(again); got != fp {
+		t.Errorf("fingerprint with other GREASE values and extension order = %s, want %s", got, fp)
+	}
+	if got := clientHelloFingerprint(other); got == fp {
+		t.Error("different clients have the same fingerprint")
+	}
+}
+
+func TestConnMetaOverTLS(t *testing.T) {
+	s := NewServer(nil)
+
+	metas := make(chan ConnMeta, 1)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		metas <- s.connMeta(r)
+	}))
+	srv.EnableHTTP2 = true
+	srv.TLS = &tls.Config{GetConfigForClient: s.RecordClientHello}
+	srv.Config.ConnState = s.ConnState
+	srv.StartTLS()
+	defer srv.Close()
+
+	client := srv.Client()
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("GET error = %v", err)
+	}
+	resp.Body.Close()
+
+	meta := <-metas
+	if meta.RemoteIP != "127.0.0.1" || meta.TLSVersion != "TLS 1.3" || meta.ALPN != "h2" || meta.TLSFingerprint == "" {
+		t.Errorf("connMeta() = %+v, want 127.0.0.1 over TLS 1.3 and h2 with a fingerprint", meta)
+	}
+
+	// Fingerprints are forgotten when the connection closes
+	client.CloseIdleConnections()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		n := 0
+		s.hellos.Range(func(_, _ any) bool { n++; return true })
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d fingerprints kept after the connection closed", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestProxyLogsRequests(t *testing.T) {
+	s := NewServer(nil)
+	mem := s.stores.Usage.(*store.Memory)
+	mem.AddDomain("u1", store.Domain{Name: "app.example.com"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.writeRequestLogs(ctx)
+
+	tun := &Tunnel{
+		Domain:  "app.example.com",
+		UserID:  "u1",
+		Name:    "checkout",
+		Labels:  tunnel.Labels{"env": "staging"},
+		state:   TunnelStateReady,
+		reqCh:   make(chan *pendingRequest, 1),
+		done:    make(chan struct{}),
+		config:  s.config,
+		ctx:     ctx,
+		cancel:  cancel,
+		onClose: func() {},
+	}
+	s.RegisterTunnel(tun)
+	go func() {
+		pr := <-tun.reqCh
+		pr.respCh <- &tunnel.Response{ID: pr.req.ID, StatusCode: http.StatusCreated, Body: []byte("done")}
+	}()
+
+	req := httptest.NewRequest("POST", "/orders?token=secret", nil)
+	req.Host = "app.example.com"
+	req.RemoteAddr = "203.0.113.7:5000"
+	req.TLS = &tls.ConnectionState{Version: tls.VersionTLS12, NegotiatedProtocol: "http/1.1"}
+	s.ServeHTTP(httptest.NewRecorder(), req)
+
+	var logs []store.RequestLog
+	deadline := time.Now().Add(2 * time.Second)
+	for len(logs) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		logs, _ = mem.RecentRequests(ctx, "u1", 10)
+	}
+	if len(logs) != 1 {
+		t.Fatalf("RecentRequests() = %+v, want 1 log", logs)
+	}
+	l := logs[0]
+	if l.Method != "POST" || l.Path != "/orders" || l.StatusCode != http.StatusCreated || l.ResponseSize != 4 {
+		t.Errorf("log = %+v, want POST /orders 201 with a 4 byte response and no query", l)
+	}
+	if l.RemoteIP != "203.0.113.7" || l.TLSVersion != "TLS 1.2" || l.ALPN != "http/1.1" {
+		t.Errorf("log client = %s %s %s, want 203.0.113.7 TLS 1.2 http/1.1", l.RemoteIP, l.TLSVersion, l.ALPN)
+	}
+	if l.Labels["env"] != "staging" {
+		t.Errorf("log labels = %v, want the tunnel's env=staging", l.Labels)
+	}
+	if l.TunnelName != "checkout" {
+		t.Errorf("log tunnel name = %q, want checkout", l.TunnelName)
+	}
+}
+
+func TestAdminTunnels(t *testing.T) {
+	config := DefaultServerConfig()
+	config.AdminToken = "secret"
+	s := NewServerWithConfig(nil, config)
+
+	connected := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	for _, tun := range []*Tunnel{
+		{Domain: "b.example.com", UserID: "u1", state: TunnelStateReady, ConnectedAt: connected,
+			Meta: ConnMeta{RemoteIP: "203.0.113.7", TLSVersion: "TLS 1.3", ALPN: "http/1.1", TLSFingerprint: "abc"}},
+		{Domain: "a.example.com", UserID: "u2", state: TunnelStateConnected, ConnectedAt: connected,
+			Meta: ConnMeta{RemoteIP: "203.0.113.7"}},
+		{Domain: "c.example.com", UserID: "u3", state: TunnelStateReady, ConnectedAt: connected,
+			Meta: ConnMeta{RemoteIP: "198.51.100.1", TLSVersion: "TLS 1.2"}},
+	} {
+		s.RegisterTunnel(tun)
+	}
+
+	req := httptest.NewRequest("GET", "/_lobber/admin/tunnels?ip=203.0.113.7", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200 (body %q)", rec.Code, rec.Body.String())
+	}
+
+	var tunnels []adminTunnel
+	if err := json.Unmarshal(rec.Body.Bytes(), &tunnels); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(tunnels) != 2 || tunnels[0].Domain != "a.example.com" || tunnels[1].Domain != "b.example.com" {
+		t.Fatalf("tunnels = %+v, want a and b from 203.0.113.7", tunnels)
+	}
+	b := tunnels[1]
+	if !b.Ready || b.UserID != "u1" || !b.ConnectedAt.Equal(connected) || b.TLSVersion != "TLS 1.3" || b.TLSFingerprint != "abc" {
+		t.Errorf("tunnel = %+v, want ready u1 over TLS 1.3 with its fingerprint", b)
+	}
+	if tunnels[0].Ready {
+		t.Error("tunnel still waiting for its ready frame reported ready")
+	}
+}
+
+func TestAdminTunnelsByLabel(t *testing.T) {
+	config := DefaultServerConfig()
+	config.AdminToken = "secret"
+	s := NewServerWithConfig(nil, config)
+
+	s.RegisterTunnel(&Tunnel{Domain: "api.example.com", Labels: tunnel.Labels{"env": "staging", "service": "api"}})
+	s.RegisterTunnel(&Tunnel{Domain: "web.example.com", Labels: tunnel.Labels{"env": "staging", "service": "web"}})
+	s.RegisterTunnel(&Tunnel{Domain: "prod.example.com", Labels: tunnel.Labels{"env": "prod", "service": "api"}})
+	s.RegisterTunnel(&Tunnel{Domain: "bare.example.com", features: []string{tunnel.FeatureHeartbeat, tunnel.FeatureMetadata}})
+
+	tests := []struct {
+		query  string
+		status int
+		want   []string
+	}{
+		{"", http.StatusOK, []string{"api.example.com", "bare.example.com", "prod.example.com", "web.example.com"}},
+		{"?label=env=staging", http.StatusOK, []string{"api.example.com", "web.example.com"}},
+		{"?label=env=staging&label=service=api", http.StatusOK, []string{"api.example.com"}},
+		{"?label=env=qa", http.StatusOK, nil},
+		{"?label=env", http.StatusBadRequest, nil},
+		{"?feature=metadata", http.StatusOK, []string{"bare.example.com"}},
+		{"?feature=echo", http.StatusOK, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/_lobber/admin/tunnels"+tt.query, nil)
+			req.Header.Set("Authorization", "Bearer secret")
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, req)
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d (body %q)", rec.Code, tt.status, rec.Body.String())
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+
+			var tunnels []adminTunnel
+			if err := json.Unmarshal(rec.Body.Bytes(), &tunnels); err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			var got []string
+			for _, tun := range tunnels {
+				got = append(got, tun.Domain)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("tunnels = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCaller(t *testing.T) {
+	tests := []struct {
+		name      string
+		tls       *tls.ConnectionState
+		forwarded string
+		meta      ConnMeta
+		want      tunnel.Caller
+	}{
+		{
+			"plain HTTP", nil, "",
+			ConnMeta{RemoteIP: "203.0.113.7"},
+			tunnel.Caller{RemoteIP: "203.0.113.7", Scheme: "http", Host: "app.example.com:8080"},
+		},
+		{
+			"TLS", &tls.ConnectionState{ServerName: "app.example.com"}, "",
+			ConnMeta{RemoteIP: "203.0.113.7", TLSVersion: "TLS 1.3", ALPN: "h2"},
+			tunnel.Caller{RemoteIP: "203.0.113.7", Scheme: "https", Host: "app.example.com:8080", TLSVersion: "TLS 1.3", ALPN: "h2", ServerName: "app.example.com"},
+		},
+		{
+			"behind a proxy", nil, "https",
+			ConnMeta{RemoteIP: "10.0.0.2"},
+			tunnel.Caller{RemoteIP: "10.0.0.2", Scheme: "https", Host: "app.example.com:8080"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "http://app.example.com:8080/", nil)
+			r.TLS = tt.tls
+			if tt.forwarded != "" {
+				r.Header.Set("X-Forwarded-Proto", tt.forwarded)
+			}
+			if got := caller(r, tt.meta); !reflect.DeepEqual(*got, tt.want) {
+				t.Errorf("caller() = %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
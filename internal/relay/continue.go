@@ -0,0 +1,101 @@
+// internal/relay/continue.go
+package relay
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/lobber-dev/lobber/internal/tunnel"
+)
+
+// streamThreshold is the smallest request body streamed to clients that
+// take held bodies, rather than sent in the request's frame
+const streamThreshold = 4 * tunnel.MaxStreamChunk
+
+// expectsContinue reports whether r's visitor waits for 100 Continue
+// before sending its body. The server sends it when the body is first
+// read.
+func expectsContinue(r *http.Request) bool {
+	return r.ContentLength != 0 && strings.EqualFold(r.Header.Get("Expect"), "100-continue")
+}
+
+// streamsBody reports whether r's body is large enough to hold up the
+// tunnel in one frame, or of unknown length
+func streamsBody(r *http.Request) bool {
+	return r.ContentLength < 0 || r.ContentLength >= streamThreshold
+}
+
+// bodyAllowed reports whether a response with status to a request with
+// method may have a body (RFC 9110, section 6.4.1)
+func bodyAllowed(method string, status int) bool {
+	return method != http.MethodHead && status >= 200 && status != http.StatusNoContent && status != http.StatusNotModified
+}
+
+// heldBody is a visitor's body the relay holds back until the client asks
+// for it, see tunnel.FeatureContinue
+type heldBody struct {
+	done   chan struct{}
+	cancel context.CancelFunc
+	asked  atomic.Bool // the client asked for the body, so the visitor was told to send it
+	sent   int64       // bytes sent to the client, once done
+}
+
+// sendBody sends body to the client as the stream of the request with id,
+// as the client grants room for it. The stream is opened with no room, so
+// nothing is read from the visitor until the local server asks for it.
+func (t *Tunnel) sendBody(ctx context.Context, id string, body io.Reader) *heldBody {
+	window := t.streamWindow()
+	if window != nil {
+		window = tunnel.NewCredit(0)
+	}
+	st := t.addStream(id, window)
+	ctx, cancel := context.WithCancel(ctx)
+	b := &heldBody{done: make(chan struct{}), cancel: cancel}
+	t.spawn(func() {
+		defer close(b.done)
+		defer t.closeStream(id)
+		// However it ends, the local server shouldn't wait for more
+		defer t.writeStream(&tunnel.Stream{ID: id, Close: true})
+		buf := make([]byte, tunnel.MaxStreamChunk)
+		for {
+			room, err := st.window.Take(ctx, int64(len(buf)))
+			if err != nil {
+				return
+			}
+			b.asked.Store(true)
+			n, err := body.Read(buf[:room])
+			st.window.Grant(room - int64(n))
+			if n > 0 {
+				if t.writeStream(&tunnel.Stream{ID: id, Data: buf[:n]}) != nil {
+					return
+				}
+				b.sent += int64(n)
+			}
+			if err != nil {
+				return
+			}
+		}
+	})
+	return b
+}
+
+// stop ends the body once the client's response is in, and returns how
+// many bytes of it were sent. A visitor still sending it, to a local
+// server that answered without reading it all, is cut short, as the body
+// can't be read once the handler returns.
+func (b *heldBody) stop(w http.ResponseWriter) int64 {
+	b.cancel()
+	if b.asked.Load() {
+		select {
+		case <-b.done:
+		default:
+			http.NewResponseController(w).SetReadDeadline(time.Now())
+		}
+	}
+	<-b.done
+	return b.sent
+}
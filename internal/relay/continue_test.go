@@ -0,0 +1,122 @@
+// internal/relay/continue_test.go
+package relay
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/lobber-dev/lobber/internal/tunnel"
+)
+
+// readCounter is a request body that counts reads of it
+type readCounter struct {
+	*strings.Reader
+	reads int
+}
+
+func (r *readCounter) Read(p []byte) (int, error) {
+	r.reads++
+	return r.Reader.Read(p)
+}
+
+func (r *readCounter) Close() error { return nil }
+
+func TestBodilessResponses(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		resp       tunnel.Response
+		wantLength string
+		wantBody   string
+	}{
+		{"HEAD keeps the local length", "HEAD", tunnel.Response{StatusCode: http.StatusOK, Headers: map[string][]string{"Content-Length": {"1234"}}, Body: []byte("page")}, "1234", ""},
+		{"204 has no length", "DELETE", tunnel.Response{StatusCode: http.StatusNoContent, Body: []byte("gone")}, "", ""},
+		{"304 keeps the entity's length", "GET", tunnel.Response{StatusCode: http.StatusNotModified, Headers: map[string][]string{"Content-Length": {"10"}}}, "10", ""},
+		{"GET has its body", "GET", tunnel.Response{StatusCode: http.StatusOK, Body: []byte("page")}, "4", "page"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := DefaultServerConfig()
+			s := NewServerWithConfig(nil, config)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			tun := &Tunnel{
+				Domain:  "app.example.com",
+				UserID:  "test-user",
+				state:   TunnelStateReady,
+				reqCh:   make(chan *pendingRequest, 1),
+				respCh:  make(chan *tunnel.Response, 1),
+				done:    make(chan struct{}),
+				config:  config,
+				ctx:     ctx,
+				cancel:  cancel,
+				onClose: func() {},
+			}
+			s.RegisterTunnel(tun)
+
+			rec := httptest.NewRecorder()
+			proxied := make(chan struct{})
+			go func() {
+				defer close(proxied)
+				req := httptest.NewRequest(tt.method, "/file", nil)
+				req.Host = "app.example.com"
+				s.ServeHTTP(rec, req)
+			}()
+			pr := <-tun.reqCh
+			resp := tt.resp
+			resp.ID = pr.req.ID
+			pr.respCh <- &resp
+			<-proxied
+
+			if rec.Code != tt.resp.StatusCode {
+				t.Errorf("status = %d, want %d", rec.Code, tt.resp.StatusCode)
+			}
+			if got := rec.Header().Get("Content-Length"); got != tt.wantLength {
+				t.Errorf("Content-Length = %q, want %q", got, tt.wantLength)
+			}
+			if got := rec.Body.String(); got != tt.wantBody {
+				t.Errorf("body = %q, want %q", got, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestOversizeBodyRefusedUnread(t *testing.T) {
+	config := DefaultServerConfig()
+	s := NewServerWithConfig(nil, config)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tun := &Tunnel{
+		Domain:  "app.example.com",
+		UserID:  "test-user",
+		state:   TunnelStateReady,
+		framing: tunnel.Framing{MaxSize: tunnel.MinFrameSize},
+		reqCh:   make(chan *pendingRequest, 1),
+		respCh:  make(chan *tunnel.Response, 1),
+		done:    make(chan struct{}),
+		config:  config,
+		ctx:     ctx,
+		cancel:  cancel,
+		onClose: func() {},
+	}
+	s.RegisterTunnel(tun)
+
+	// Had the body been read, the visitor would have been told to send it
+	body := &readCounter{Reader: strings.NewReader(strings.Repeat("x", tunnel.MinFrameSize+1))}
+	req := httptest.NewRequest("PUT", "/upload", nil)
+	req.Host = "app.example.com"
+	req.Header.Set("Expect", "100-continue")
+	req.Body, req.ContentLength = body, int64(body.Len())
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("status = %d, want 413", rec.Code)
+	}
+	if body.reads != 0 {
+		t.Errorf("body read %d times before refusing it, want none", body.reads)
+	}
+}
@@ -0,0 +1,56 @@
+// internal/relay/dev.go
+package relay
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/lobber-dev/lobber/internal/auth"
+	"github.com/lobber-dev/lobber/internal/store"
+	"github.com/lobber-dev/lobber/web/dashboard"
+)
+
+// Sandbox user that owns the dev token
+const (
+	DevUserID = "dev"
+	DevEmail  = "dev@localhost"
+
+	devLoginPath  = "/_lobber/dev/login"
+	devSessionTTL = 30 * 24 * time.Hour
+)
+
+// seedDev creates the sandbox user with token as both its CLI token and its
+// dashboard session, so the one printed token opens tunnels and the dashboard
+func seedDev(mem *store.Memory, token string) error {
+	ctx := context.Background()
+	hash := auth.HashToken(token)
+
+	mem.AddUser(store.User{ID: DevUserID, Email: DevEmail, Name: "Dev"})
+	if _, err := mem.CreateToken(ctx, DevUserID, "dev", hash); err != nil {
+		return fmt.Errorf("create dev token: %w", err)
+	}
+	if err := mem.CreateSession(ctx, DevUserID, hash, time.Now().Add(devSessionTTL)); err != nil {
+		return fmt.Errorf("create dev session: %w", err)
+	}
+	return nil
+}
+
+// DevLoginURL is the link that signs a browser into the sandbox dashboard
+func DevLoginURL(baseURL, token string) string {
+	return baseURL + devLoginPath + "?token=" + token
+}
+
+// handleDevLogin sets the dev session cookie and opens the dashboard. It is
+// only routed when the relay runs in dev mode.
+func (s *Server) handleDevLogin(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(s.config.DevToken)) != 1 {
+		http.Error(w, "invalid dev token", http.StatusUnauthorized)
+		return
+	}
+	dashboard.SetSessionCookie(w, token, time.Now().Add(devSessionTTL))
+	http.Redirect(w, r, "/dashboard", http.StatusSeeOther)
+}
@@ -0,0 +1,63 @@
+package relay
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDevMode(t *testing.T) {
+	config := DefaultServerConfig()
+	config.DevToken = "lb_devtoken"
+	s := NewServerWithConfig(nil, config)
+
+	if userID, ok := s.tokenValidator("lb_devtoken"); !ok || userID != DevUserID {
+		t.Errorf("tokenValidator(dev token) = %q, %v, want %q, true", userID, ok, DevUserID)
+	}
+	if _, ok := s.tokenValidator("lb_other"); ok {
+		t.Error("tokenValidator accepted a token other than the dev token")
+	}
+
+	tests := []struct {
+		name   string
+		path   string
+		bearer string
+		status int
+	}{
+		{"login", DevLoginURL("", "lb_devtoken"), "", http.StatusSeeOther},
+		{"login with wrong token", DevLoginURL("", "lb_other"), "", http.StatusUnauthorized},
+		{"dashboard API", "/api/dashboard/account", "lb_devtoken", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.path, nil)
+			if tt.bearer != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.bearer)
+			}
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, req)
+			if rec.Code != tt.status {
+				t.Errorf("status = %d, want %d (body %q)", rec.Code, tt.status, rec.Body.String())
+			}
+			if tt.status == http.StatusSeeOther && !strings.Contains(rec.Header().Get("Set-Cookie"), "session=lb_devtoken") {
+				t.Errorf("Set-Cookie = %q, want the dev session", rec.Header().Get("Set-Cookie"))
+			}
+		})
+	}
+}
+
+func TestDevLoginOnlyInDevMode(t *testing.T) {
+	s := NewServer(nil)
+	s.landingHandler = nil
+
+	req := httptest.NewRequest("GET", DevLoginURL("", "lb_devtoken"), nil)
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want %d without dev mode", rec.Code, http.StatusNotFound)
+	}
+	if s.dashboardHandler != nil {
+		t.Error("dashboard enabled without a database or dev mode")
+	}
+}
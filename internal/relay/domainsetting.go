@@ -0,0 +1,82 @@
+// internal/relay/domainsetting.go
+package relay
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/lobber-dev/lobber/internal/store"
+)
+
+// domainSettingTTL is how long a domain's setting is cached, and so how
+// long a change in the dashboard takes to reach the relay
+const domainSettingTTL = 30 * time.Second
+
+type settingEntry[T any] struct {
+	value     *T // nil when the domain doesn't set it
+	checkedAt time.Time
+}
+
+// domainSetting caches a per-domain setting the store keeps as text, such
+// as a schedule, so the proxy path doesn't hit the database on every
+// request
+type domainSetting[T any] struct {
+	name   string // what the setting is, for logs
+	lookup func(ctx context.Context, hostname string) (string, error)
+	parse  func(string) (*T, error)
+
+	mu      sync.Mutex
+	entries map[string]settingEntry[T]
+}
+
+func newDomainSetting[T any](name string, lookup func(ctx context.Context, hostname string) (string, error), parse func(string) (*T, error)) *domainSetting[T] {
+	return &domainSetting[T]{
+		name:    name,
+		lookup:  lookup,
+		parse:   parse,
+		entries: make(map[string]settingEntry[T]),
+	}
+}
+
+// get returns the setting for hostname, refreshing it when stale, or nil if
+// the domain doesn't set it. Lookup failures fail open, keeping the last
+// value seen.
+func (d *domainSetting[T]) get(hostname string) *T {
+	d.mu.Lock()
+	entry, ok := d.entries[hostname]
+	d.mu.Unlock()
+	if ok && time.Since(entry.checkedAt) < domainSettingTTL {
+		return entry.value
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	text, err := d.lookup(ctx, hostname)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		log.Printf("%s lookup for %s failed: %v", d.name, hostname, err)
+		return entry.value
+	}
+	var value *T
+	if text != "" {
+		if value, err = d.parse(text); err != nil {
+			log.Printf("domain %s: ignoring %s %q: %v", hostname, d.name, text, err)
+		}
+	}
+
+	d.mu.Lock()
+	d.entries[hostname] = settingEntry[T]{value: value, checkedAt: time.Now()}
+	d.mu.Unlock()
+	return value
+}
+
+// known returns the cached setting for hostname without looking it up, so
+// requests for hostnames with no tunnel can't fill the cache
+func (d *domainSetting[T]) known(hostname string) *T {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.entries[hostname].value
+}
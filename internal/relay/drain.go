@@ -0,0 +1,71 @@
+// internal/relay/drain.go
+package relay
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/lobber-dev/lobber/internal/tunnel"
+)
+
+// drainPoll is how often Drain checks whether its tunnels have gone
+const drainPoll = 100 * time.Millisecond
+
+// Drain readies the relay to stop without dropping traffic. It turns new
+// tunnels away, so clients reconnecting land on another instance behind
+// the load balancer, and sends a Drain frame to every client that speaks
+// tunnel.FeatureDrain. Those tunnels keep serving until their clients have
+// moved and closed them. Drain returns once none are left, or when ctx
+// ends; clients that don't speak the feature are left for the caller's
+// shutdown to cut off.
+func (s *Server) Drain(ctx context.Context) error {
+	s.draining.Store(true)
+
+	d := &tunnel.Drain{Reason: "relay restarting"}
+	d.Deadline, _ = ctx.Deadline()
+	s.mu.RLock()
+	tunnels := make([]*Tunnel, 0, len(s.tunnels))
+	for _, t := range s.tunnels {
+		if t.uses(tunnel.FeatureDrain) {
+			tunnels = append(tunnels, t)
+		}
+	}
+	s.mu.RUnlock()
+	for _, t := range tunnels {
+		if err := t.drain(d); err != nil {
+			log.Printf("tunnel %s: send drain: %v", t.Domain, err)
+		}
+	}
+	log.Printf("draining: asked %d tunnels to move", len(tunnels))
+
+	ticker := time.NewTicker(drainPoll)
+	defer ticker.Stop()
+	for {
+		left := 0
+		for _, t := range tunnels {
+			if t.GetState() != TunnelStateClosed {
+				left++
+			}
+		}
+		if left == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			log.Printf("draining: %d tunnels still open", left)
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// drain tells the client the relay is about to restart
+func (t *Tunnel) drain(d *tunnel.Drain) error {
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+	if err := tunnel.EncodeDrain(t.frames(), d); err != nil {
+		return err
+	}
+	return t.bufrw.Flush()
+}
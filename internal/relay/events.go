@@ -0,0 +1,68 @@
+// internal/relay/events.go
+package relay
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	"github.com/lobber-dev/lobber/internal/billing"
+	"github.com/lobber-dev/lobber/internal/dnsname"
+	"github.com/lobber-dev/lobber/internal/events"
+	"github.com/lobber-dev/lobber/internal/store"
+)
+
+// quotaMessages describe each quota level in the activity feed
+var quotaMessages = map[billing.QuotaLevel]string{
+	billing.QuotaWarning:  "Most of this month's bandwidth is used",
+	billing.QuotaExceeded: "This month's bandwidth allowance is used up",
+	billing.QuotaCapped:   "Tunnels paused: the monthly bandwidth cap is reached",
+}
+
+// tunnelEvent adds a tunnel's connect or disconnect to its owner's feed
+func (s *Server) tunnelEvent(t *Tunnel, typ, what string) {
+	msg := "Tunnel " + what
+	if t.Name != "" {
+		msg = "Tunnel " + t.Name + " " + what
+	}
+	s.events.Publish(context.Background(), store.Event{
+		UserID:   t.UserID,
+		Type:     typ,
+		Hostname: t.Domain,
+		Message:  msg,
+	})
+}
+
+// quotaChanged adds a quota warning to the user's feed once they pass a
+// threshold
+func (s *Server) quotaChanged(userID string, level billing.QuotaLevel) {
+	msg, ok := quotaMessages[level]
+	if !ok {
+		return
+	}
+	s.events.Publish(context.Background(), store.Event{
+		UserID:  userID,
+		Type:    events.QuotaWarning,
+		Message: msg,
+	})
+}
+
+// CertIssued adds a newly issued certificate to the feed of the user who
+// owns host. Set it as the TLSManager's OnCertIssued.
+func (s *Server) CertIssued(host string) {
+	ctx := context.Background()
+	host = dnsname.Lookup(host)
+	userID, err := s.stores.Domains.DomainOwner(ctx, host)
+	if err != nil {
+		if !errors.Is(err, store.ErrNotFound) {
+			log.Printf("cert for %s: look up owner: %v", host, err)
+		}
+		return
+	}
+	s.events.Publish(ctx, store.Event{
+		UserID:   userID,
+		Type:     events.CertIssued,
+		Hostname: host,
+		Message:  "TLS certificate issued",
+	})
+}
@@ -0,0 +1,111 @@
+// internal/relay/events_test.go
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/lobber-dev/lobber/internal/auth"
+	"github.com/lobber-dev/lobber/internal/billing"
+	"github.com/lobber-dev/lobber/internal/events"
+	"github.com/lobber-dev/lobber/internal/store"
+)
+
+func TestActivityEvents(t *testing.T) {
+	s := NewServer(nil)
+	mem := s.stores.Events.(*store.Memory)
+	mem.AddDomain("u1", store.Domain{Name: "app.example.com"})
+	ctx := context.Background()
+
+	tun := &Tunnel{Domain: "app.example.com", UserID: "u1", Name: "checkout"}
+	s.startSession(tun)
+	s.endSession(tun, "client closed")
+	unowned := &Tunnel{Domain: "other.example.com", UserID: "u1"}
+	s.startSession(unowned)
+	s.endSession(unowned, "closed")
+	s.CertIssued("App.Example.com")
+	s.CertIssued("other.example.com")
+	s.quotaChanged("u1", billing.QuotaWarning)
+
+	got, err := mem.ListEvents(ctx, "u1", 0, 10)
+	if err != nil {
+		t.Fatalf("ListEvents() error = %v", err)
+	}
+	want := []store.Event{
+		{Type: events.TunnelConnected, Hostname: "app.example.com", Message: "Tunnel checkout connected"},
+		{Type: events.TunnelDisconnected, Hostname: "app.example.com", Message: "Tunnel checkout disconnected (client closed)"},
+		{Type: events.CertIssued, Hostname: "app.example.com", Message: "TLS certificate issued"},
+		{Type: events.QuotaWarning, Message: quotaMessages[billing.QuotaWarning]},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("events = %+v, want %d", got, len(want))
+	}
+	for i, w := range want {
+		if got[i].Type != w.Type || got[i].Hostname != w.Hostname || got[i].Message != w.Message {
+			t.Errorf("event %d = %s %q %q, want %s %q %q", i, got[i].Type, got[i].Hostname, got[i].Message, w.Type, w.Hostname, w.Message)
+		}
+	}
+}
+
+func TestAPIEvents(t *testing.T) {
+	s := NewServerWithConfig(nil, DefaultServerConfig())
+	mem := s.stores.Tokens.(*store.Memory)
+	mem.AddUser(store.User{ID: "user-1", Email: "dev@example.com"})
+	mem.CreateToken(context.Background(), "user-1", "ci", auth.HashToken("lb_good"))
+	for _, typ := range []string{events.TunnelConnected, events.TunnelDisconnected, events.TunnelConnected} {
+		mem.RecordEvent(context.Background(), store.Event{UserID: "user-1", Type: typ})
+	}
+	mem.RecordEvent(context.Background(), store.Event{UserID: "user-2", Type: events.CertIssued})
+
+	get := func(query, token string) (int, []store.Event) {
+		req := httptest.NewRequest("GET", "/api/v1/events"+query, nil)
+		req.Host = "localhost"
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		var page struct {
+			Events []store.Event `json:"events"`
+		}
+		json.NewDecoder(rec.Body).Decode(&page)
+		return rec.Code, page.Events
+	}
+
+	tests := []struct {
+		query  string
+		token  string
+		status int
+		want   int
+	}{
+		{"", "lb_good", http.StatusOK, 3},
+		{"?limit=2", "lb_good", http.StatusOK, 2},
+		{"?after=2", "lb_good", http.StatusOK, 1},
+		{"?after=3&wait=10ms", "lb_good", http.StatusOK, 0},
+		{"?after=-1", "lb_good", http.StatusBadRequest, 0},
+		{"?limit=0", "lb_good", http.StatusBadRequest, 0},
+		{"?wait=soon", "lb_good", http.StatusBadRequest, 0},
+		{"", "lb_bad", http.StatusUnauthorized, 0},
+		{"", "", http.StatusUnauthorized, 0},
+	}
+	for _, tt := range tests {
+		status, got := get(tt.query, tt.token)
+		if status != tt.status || len(got) != tt.want {
+			t.Errorf("GET /api/v1/events%s = %d with %d events, want %d with %d", tt.query, status, len(got), tt.status, tt.want)
+		}
+	}
+
+	// Following the feed returns as soon as something happens
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		s.events.Publish(context.Background(), store.Event{UserID: "user-1", Type: events.QuotaWarning})
+	}()
+	status, got := get("?after=3&wait=10s", "lb_good")
+	if status != http.StatusOK || len(got) != 1 || got[0].Type != events.QuotaWarning {
+		t.Errorf("waiting GET /api/v1/events = %d %+v, want the quota warning", status, got)
+	}
+}
@@ -0,0 +1,94 @@
+// internal/relay/github.go
+package relay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/lobber-dev/lobber/internal/events"
+	"github.com/lobber-dev/lobber/internal/github"
+	"github.com/lobber-dev/lobber/internal/store"
+)
+
+// githubTimeout bounds the calls that post one preview comment
+const githubTimeout = 30 * time.Second
+
+// errNoGitHubApp means the tunnel's owner hasn't set up a GitHub App in the
+// dashboard
+var errNoGitHubApp = errors.New("no GitHub App is set up; add one under Account in the dashboard")
+
+// commentPreview comments t's link on the pull request its client named,
+// through its owner's GitHub App, and records how that went in their feed.
+// A link already commented on the pull request isn't posted again.
+func (s *Server) commentPreview(t *Tunnel) {
+	pr := *t.GitHubPR
+	if last, ok := s.previewed.Load(pr.String()); ok && last == t.PublicURL {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(t.ctx, githubTimeout)
+	defer cancel()
+	err := s.postPreview(ctx, t.UserID, pr, previewBody(t))
+	if err != nil {
+		log.Printf("tunnel %s: comment on %s: %v", t.Domain, pr, err)
+		s.events.Publish(ctx, store.Event{
+			UserID:   t.UserID,
+			Type:     events.PreviewCommented,
+			Hostname: t.Domain,
+			Message:  fmt.Sprintf("Couldn't comment the preview link on %s: %v", pr, err),
+		})
+		return
+	}
+	s.previewed.Store(pr.String(), t.PublicURL)
+	s.events.Publish(ctx, store.Event{
+		UserID:   t.UserID,
+		Type:     events.PreviewCommented,
+		Hostname: t.Domain,
+		Message:  "Preview link commented on " + pr.String(),
+	})
+}
+
+// postPreview posts or updates the preview comment on pr as userID's
+// GitHub App
+func (s *Server) postPreview(ctx context.Context, userID string, pr github.PR, body string) error {
+	if s.exportSealer == nil {
+		return errors.New("the GitHub integration isn't enabled on this relay")
+	}
+	saved, err := s.stores.Accounts.GitHubApp(ctx, userID)
+	if errors.Is(err, store.ErrNotFound) {
+		return errNoGitHubApp
+	}
+	if err != nil {
+		return fmt.Errorf("load GitHub App: %w", err)
+	}
+	key, err := s.exportSealer.Open(saved.KeySealed)
+	if err != nil {
+		return fmt.Errorf("open GitHub App key: %w", err)
+	}
+	app, err := github.ParseApp(saved.AppID, key)
+	if err != nil {
+		return err
+	}
+
+	client := s.config.GitHub
+	if client == nil {
+		client = github.NewClient()
+	}
+	token, err := client.InstallationToken(ctx, app, pr.Repo)
+	if err != nil {
+		return err
+	}
+	return client.UpsertComment(ctx, token, pr, body)
+}
+
+// previewBody is the comment reviewers see on the pull request
+func previewBody(t *Tunnel) string {
+	name := t.Domain
+	if t.Name != "" {
+		name = t.Name
+	}
+	return fmt.Sprintf("**Preview:** %s\n\nServed by lobber tunnel `%s`.", t.PublicURL, name)
+}
@@ -0,0 +1,85 @@
+// internal/relay/github_test.go
+package relay
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/lobber-dev/lobber/internal/events"
+	"github.com/lobber-dev/lobber/internal/github"
+	"github.com/lobber-dev/lobber/internal/store"
+)
+
+func TestCommentPreview(t *testing.T) {
+	var mu sync.Mutex
+	var posted []string
+	gh := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.Method + " " + r.URL.Path {
+		case "GET /repos/acme/web/installation":
+			w.Write([]byte(`{"id":7}`))
+		case "POST /app/installations/7/access_tokens":
+			w.Write([]byte(`{"token":"ghs_x"}`))
+		case "GET /repos/acme/web/issues/5/comments":
+			w.Write([]byte(`[]`))
+		case "POST /repos/acme/web/issues/5/comments":
+			posted = append(posted, r.URL.Path)
+			w.Write([]byte(`{}`))
+		default:
+			http.Error(w, `{"message":"Not Found"}`, http.StatusNotFound)
+		}
+	}))
+	defer gh.Close()
+
+	config := DefaultServerConfig()
+	config.ExportKey = bytes.Repeat([]byte{7}, 32)
+	config.GitHub = &github.Client{BaseURL: gh.URL, HTTP: gh.Client()}
+	s := NewServerWithConfig(nil, config)
+	mem := s.stores.Events.(*store.Memory)
+	mem.AddUser(store.User{ID: "u1", Email: "dev@example.com"})
+	ctx := context.Background()
+
+	pr := github.PR{Repo: "acme/web", Number: 5}
+	tun := &Tunnel{Domain: "x1.preview.example.com", UserID: "u1", GitHubPR: &pr, PublicURL: "https://x1.preview.example.com/", ctx: ctx}
+
+	// Without an App the owner is told to set one up
+	s.commentPreview(tun)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := s.exportSealer.Seal(string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mem.SetGitHubApp(ctx, store.GitHubApp{UserID: "u1", AppID: 42, KeySealed: sealed}); err != nil {
+		t.Fatal(err)
+	}
+	s.commentPreview(tun)
+	s.commentPreview(tun) // the same link isn't posted twice
+
+	if len(posted) != 1 {
+		t.Errorf("posted %d comments, want 1", len(posted))
+	}
+	got, _ := mem.ListEvents(ctx, "u1", 0, 10)
+	if len(got) != 2 {
+		t.Fatalf("events = %+v, want 2", got)
+	}
+	if got[0].Type != events.PreviewCommented || !strings.Contains(got[0].Message, "add one under Account") {
+		t.Errorf("event 0 = %s %q, want a hint to set up the App", got[0].Type, got[0].Message)
+	}
+	if got[1].Message != "Preview link commented on acme/web#5" {
+		t.Errorf("event 1 = %q, want the comment recorded", got[1].Message)
+	}
+}
@@ -0,0 +1,138 @@
+// internal/relay/headers.go
+package relay
+
+import (
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// hopHeaders describe a single connection rather than the message, so they
+// must not cross the tunnel. Forwarding them would let either side smuggle
+// framing instructions (Transfer-Encoding, Connection: close, Upgrade) to
+// the other. An upgrade the relay carries as a stream goes in
+// tunnel.Request.Upgrade instead, so Upgrade is always dropped.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// sanitizeHeaders returns a copy of h that is safe to forward across the
+// tunnel. It drops hop-by-hop headers and any header Connection names,
+// headers with invalid names or values, and replaces Content-Length with
+// one value that agrees with the body the relay actually has.
+func sanitizeHeaders(h http.Header, bodyLen int) http.Header {
+	out := make(http.Header, len(h))
+	for name, vals := range h {
+		if !validHeaderName(name) {
+			continue
+		}
+		key := textproto.CanonicalMIMEHeaderKey(name)
+		for _, v := range vals {
+			if strings.ContainsAny(v, "\r\n\x00") {
+				continue
+			}
+			out[key] = append(out[key], v)
+		}
+	}
+
+	for _, v := range out.Values("Connection") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				out.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		out.Del(name)
+	}
+
+	normalizeContentLength(out, bodyLen)
+	return out
+}
+
+// badTrailers may not come after the body (RFC 9110, section 6.5.1): by
+// then the visitor has framed, routed and decoded the message by them
+var badTrailers = []string{
+	"Authorization",
+	"Cache-Control",
+	"Content-Encoding",
+	"Content-Length",
+	"Content-Range",
+	"Content-Type",
+	"Expect",
+	"Host",
+	"Max-Forwards",
+	"Pragma",
+	"Range",
+	"Set-Cookie",
+	"Www-Authenticate",
+}
+
+// sanitizeTrailers returns the trailers of a response that are safe to
+// pass on: those sanitizeHeaders keeps, less the ones that may not be
+// trailers. It's nil if none are left.
+func sanitizeTrailers(t map[string][]string) http.Header {
+	if len(t) == 0 {
+		return nil
+	}
+	out := sanitizeHeaders(t, 0)
+	for _, name := range badTrailers {
+		out.Del(name)
+	}
+	if len(out) == 0 {
+		return nil
+	}
+	return out
+}
+
+// normalizeContentLength leaves h with at most one Content-Length. The
+// relay buffers whole bodies, so a non-empty body's real length wins. An
+// empty body keeps a single agreed value, which HEAD and 304 responses use
+// to describe the entity they omit; conflicting values are dropped.
+func normalizeContentLength(h http.Header, bodyLen int) {
+	if bodyLen > 0 {
+		h.Set("Content-Length", strconv.Itoa(bodyLen))
+		return
+	}
+
+	var length string
+	for _, v := range h.Values("Content-Length") {
+		for _, part := range strings.Split(v, ",") {
+			part = strings.TrimSpace(part)
+			if _, err := strconv.ParseUint(part, 10, 63); err != nil || (length != "" && part != length) {
+				h.Del("Content-Length")
+				return
+			}
+			length = part
+		}
+	}
+	if length != "" {
+		h.Set("Content-Length", length)
+	}
+}
+
+// validHeaderName reports whether name is an RFC 9110 token
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,301 @@
+// internal/relay/headers_test.go
+package relay
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lobber-dev/lobber/internal/store"
+	"github.com/lobber-dev/lobber/internal/tunnel"
+)
+
+func TestSanitizeHeaders(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      http.Header
+		bodyLen int
+		want    http.Header
+	}{
+		{
+			name:    "content-length and transfer-encoding",
+			in:      http.Header{"Content-Length": {"4"}, "Transfer-Encoding": {"chunked"}},
+			bodyLen: 11,
+			want:    http.Header{"Content-Length": {"11"}},
+		},
+		{
+			name:    "duplicate content-length disagreeing with the body",
+			in:      http.Header{"Content-Length": {"4", "40"}},
+			bodyLen: 11,
+			want:    http.Header{"Content-Length": {"11"}},
+		},
+		{
+			name: "identical duplicate content-length on an empty body",
+			in:   http.Header{"Content-Length": {"42, 42", "42"}},
+			want: http.Header{"Content-Length": {"42"}},
+		},
+		{
+			name: "conflicting content-length on an empty body",
+			in:   http.Header{"Content-Length": {"42", "7"}},
+			want: http.Header{},
+		},
+		{
+			name: "negative content-length",
+			in:   http.Header{"Content-Length": {"-1"}},
+			want: http.Header{},
+		},
+		{
+			name: "hop-by-hop headers",
+			in: http.Header{
+				"Connection":          {"keep-alive, Upgrade"},
+				"Keep-Alive":          {"timeout=5"},
+				"Upgrade":             {"h2c"},
+				"Http2-Settings":      {"AAMAAABkAARAAAAAAAIAAAAA"},
+				"Te":                  {"trailers"},
+				"Trailer":             {"X-Checksum"},
+				"Proxy-Authorization": {"Basic dXNlcjpwYXNz"},
+				"Proxy-Connection":    {"keep-alive"},
+				"Accept":              {"*/*"},
+			},
+			want: http.Header{"Accept": {"*/*"}, "Http2-Settings": {"AAMAAABkAARAAAAAAAIAAAAA"}},
+		},
+		{
+			name: "headers named in connection",
+			in:   http.Header{"Connection": {"close, X-Internal-Auth"}, "X-Internal-Auth": {"admin"}, "Accept": {"*/*"}},
+			want: http.Header{"Accept": {"*/*"}},
+		},
+		{
+			name: "lowercase keys from the tunnel",
+			in:   map[string][]string{"connection": {"x-debug"}, "x-debug": {"1"}, "transfer-encoding": {"chunked"}, "content-type": {"text/plain"}},
+			want: http.Header{"Content-Type": {"text/plain"}},
+		},
+		{
+			name: "invalid names and values",
+			in: map[string][]string{
+				"Bad Name":     {"x"},
+				"X-Split":      {"a\r\nSet-Cookie: session=stolen"},
+				"X-Nul":        {"a\x00b"},
+				"Content-Type": {"text/html"},
+			},
+			want: http.Header{"Content-Type": {"text/html"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := sanitizeHeaders(tt.in, tt.bodyLen)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("sanitizeHeaders() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSanitizeTrailers(t *testing.T) {
+	tests := []struct {
+		name string
+		in   map[string][]string
+		want http.Header
+	}{
+		{"none", nil, nil},
+		{"grpc status", map[string][]string{"grpc-status": {"0"}, "Grpc-Message": {"ok"}}, http.Header{"Grpc-Status": {"0"}, "Grpc-Message": {"ok"}}},
+		{
+			name: "framing and hop-by-hop",
+			in: map[string][]string{
+				"Content-Length":    {"3"},
+				"Content-Type":      {"text/html"},
+				"Transfer-Encoding": {"chunked"},
+				"Trailer":           {"X-Checksum"},
+				"Set-Cookie":        {"session=late"},
+				"X-Checksum":        {"abc"},
+			},
+			want: http.Header{"X-Checksum": {"abc"}},
+		},
+		{"only disallowed", map[string][]string{"Host": {"evil.example.com"}, "Bad Name": {"x"}}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sanitizeTrailers(tt.in); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("sanitizeTrailers() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProxySanitizesHeaders(t *testing.T) {
+	config := DefaultServerConfig()
+	s := NewServerWithConfig(nil, config)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tun := &Tunnel{
+		Domain:  "app.example.com",
+		UserID:  "test-user",
+		state:   TunnelStateReady,
+		reqCh:   make(chan *pendingRequest, 1),
+		respCh:  make(chan *tunnel.Response, 1),
+		done:    make(chan struct{}),
+		config:  config,
+		ctx:     ctx,
+		cancel:  cancel,
+		onClose: func() {},
+	}
+	s.RegisterTunnel(tun)
+
+	// Stand in for the client: check what crossed the tunnel and answer
+	// with a response that tries to smuggle framing back
+	forwarded := make(chan http.Header, 1)
+	go func() {
+		pr := <-tun.reqCh
+		forwarded <- pr.req.Headers
+		pr.respCh <- &tunnel.Response{
+			ID:         pr.req.ID,
+			StatusCode: http.StatusOK,
+			Headers: map[string][]string{
+				"Content-Length":    {"2", "100"},
+				"Transfer-Encoding": {"chunked"},
+				"Connection":        {"close"},
+				"Content-Type":      {"text/plain"},
+			},
+			Body: []byte("ok"),
+		}
+	}()
+
+	req := httptest.NewRequest("POST", "/webhook", strings.NewReader("payload"))
+	req.Host = "app.example.com"
+	req.Header.Set("Content-Length", "3")
+	req.Header.Set("Connection", "Upgrade, X-Forwarded-Secret")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("X-Forwarded-Secret", "let-me-in")
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+
+	select {
+	case h := <-forwarded:
+		if got := h.Get("Content-Length"); got != "7" {
+			t.Errorf("forwarded Content-Length = %q, want 7", got)
+		}
+		for _, name := range []string{"Connection", "Upgrade", "X-Forwarded-Secret"} {
+			if v := h.Get(name); v != "" {
+				t.Errorf("forwarded %s = %q, want it stripped", name, v)
+			}
+		}
+	case <-time.After(time.Second):
+		t.Fatal("request never reached the tunnel")
+	}
+
+	if rec.Code != http.StatusOK || rec.Body.String() != "ok" {
+		t.Fatalf("response = %d %q, want 200 ok", rec.Code, rec.Body.String())
+	}
+	if got := rec.Header().Values("Content-Length"); len(got) != 1 || got[0] != "2" {
+		t.Errorf("response Content-Length = %v, want [2]", got)
+	}
+	if rec.Header().Get("Transfer-Encoding") != "" || rec.Header().Get("Connection") != "" {
+		t.Errorf("response kept hop-by-hop headers: %v", rec.Header())
+	}
+}
+
+func TestProxyDomainHeaders(t *testing.T) {
+	config := DefaultServerConfig()
+	s := NewServerWithConfig(nil, config)
+	mem := s.stores.Usage.(*store.Memory)
+	mem.AddDomain("test-user", store.Domain{Name: "app.example.com", Headers: "X-Robots-Tag: noindex\nX-Frame-Options: DENY"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tun := &Tunnel{
+		Domain:  "app.example.com",
+		UserID:  "test-user",
+		state:   TunnelStateReady,
+		reqCh:   make(chan *pendingRequest, 1),
+		respCh:  make(chan *tunnel.Response, 1),
+		done:    make(chan struct{}),
+		config:  config,
+		ctx:     ctx,
+		cancel:  cancel,
+		onClose: func() {},
+	}
+	s.RegisterTunnel(tun)
+	go func() {
+		pr := <-tun.reqCh
+		pr.respCh <- &tunnel.Response{
+			ID:         pr.req.ID,
+			StatusCode: http.StatusOK,
+			Headers:    map[string][]string{"X-Frame-Options": {"SAMEORIGIN"}, "Content-Type": {"text/html"}},
+			Body:       []byte("ok"),
+		}
+	}()
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Host = "app.example.com"
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", rec.Code)
+	}
+	want := http.Header{"X-Robots-Tag": {"noindex"}, "X-Frame-Options": {"DENY"}, "Content-Type": {"text/html"}}
+	for name, vals := range want {
+		if got := rec.Header().Values(name); !reflect.DeepEqual(got, vals) {
+			t.Errorf("%s = %v, want %v", name, got, vals)
+		}
+	}
+}
+
+func TestProxyDomainHTTPS(t *testing.T) {
+	config := DefaultServerConfig()
+	s := NewServerWithConfig(nil, config)
+	mem := s.stores.Usage.(*store.Memory)
+	mem.AddDomain("test-user", store.Domain{Name: "app.example.com", HTTPS: "redirect, hsts", Headers: "Strict-Transport-Security: max-age=60"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tun := &Tunnel{
+		Domain:  "app.example.com",
+		UserID:  "test-user",
+		state:   TunnelStateReady,
+		reqCh:   make(chan *pendingRequest, 1),
+		respCh:  make(chan *tunnel.Response, 1),
+		done:    make(chan struct{}),
+		config:  config,
+		ctx:     ctx,
+		cancel:  cancel,
+		onClose: func() {},
+	}
+	s.RegisterTunnel(tun)
+
+	// Plain HTTP never reaches the tunnel
+	req := httptest.NewRequest("GET", "/login?next=/", nil)
+	req.Host = "app.example.com"
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	if rec.Code != http.StatusMovedPermanently || rec.Header().Get("Location") != "https://app.example.com/login?next=/" {
+		t.Errorf("plain HTTP = %d %q, want 301 to https://app.example.com/login?next=/", rec.Code, rec.Header().Get("Location"))
+	}
+
+	go func() {
+		pr := <-tun.reqCh
+		pr.respCh <- &tunnel.Response{
+			ID:         pr.req.ID,
+			StatusCode: http.StatusOK,
+			Headers:    map[string][]string{"Strict-Transport-Security": {"max-age=0"}},
+			Body:       []byte("ok"),
+		}
+	}()
+	req = httptest.NewRequest("GET", "/login", nil)
+	req.Host = "app.example.com"
+	req.Header.Set("X-Forwarded-Proto", "https")
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", rec.Code)
+	}
+	if got := rec.Header().Values("Strict-Transport-Security"); !reflect.DeepEqual(got, []string{"max-age=31536000"}) {
+		t.Errorf("Strict-Transport-Security = %v, want [max-age=31536000]", got)
+	}
+}
@@ -0,0 +1,53 @@
+// internal/relay/health.go
+package relay
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/lobber-dev/lobber/internal/store"
+)
+
+// healthCheckTimeout bounds each dependency probe so a hung database shows up
+// as a failed check instead of a missing one
+const healthCheckTimeout = 5 * time.Second
+
+// checkHealth probes the relay's dependencies for the status page
+func (s *Server) checkHealth(ctx context.Context) store.HealthCheck {
+	start := time.Now()
+	c := store.HealthCheck{
+		RelayID: s.config.RelayID,
+		Region:  s.config.Region,
+		OK:      true,
+		Tunnels: s.tunnelCount(),
+	}
+
+	if s.db != nil {
+		ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+		defer cancel()
+		if err := s.db.PingContext(ctx); err != nil {
+			c.OK = false
+			c.Detail = fmt.Sprintf("database: %v", err)
+		}
+	}
+
+	c.Latency = time.Since(start)
+	return c
+}
+
+// recordHealth runs a health check and stores the result
+func (s *Server) recordHealth(ctx context.Context) error {
+	c := s.checkHealth(ctx)
+	if err := s.status.RecordHealthCheck(ctx, c); err != nil {
+		return fmt.Errorf("record health check: %w", err)
+	}
+	return nil
+}
+
+// tunnelCount returns how many tunnels are connected
+func (s *Server) tunnelCount() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.tunnels)
+}
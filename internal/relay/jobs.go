@@ -0,0 +1,183 @@
+// internal/relay/jobs.go
+package relay
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/lobber-dev/lobber/internal/alerts"
+	"github.com/lobber-dev/lobber/internal/export"
+)
+
+// job is a periodic background task run by the relay
+type job struct {
+	name     string
+	interval time.Duration
+	run      func(ctx context.Context) error
+}
+
+// StartJobs runs the relay's periodic background jobs until ctx is cancelled
+func (s *Server) StartJobs(ctx context.Context) {
+	for _, j := range s.jobs() {
+		go runJob(ctx, j)
+	}
+	go s.writeRequestLogs(ctx)
+	go s.replayer.Run(ctx)
+}
+
+// jobs returns the background jobs enabled by the server's configuration
+func (s *Server) jobs() []job {
+	var jobs []job
+
+	if s.status != nil && s.config.HealthInterval > 0 {
+		jobs = append(jobs, job{
+			name:     "health-check",
+			interval: s.config.HealthInterval,
+			run:      s.recordHealth,
+		})
+	}
+
+	if s.config.UsageFlush > 0 {
+		jobs = append(jobs, job{
+			name:     "flush-usage",
+			interval: s.config.UsageFlush,
+			run:      s.flushAllUsage,
+		})
+	}
+
+	if s.config.AlertInterval > 0 {
+		dispatcher := alerts.NewDispatcher(s.stores.Alerts, s.config.Notifier, s.config.baseURL())
+		jobs = append(jobs, job{
+			name:     "usage-alerts",
+			interval: s.config.AlertInterval,
+			run: func(ctx context.Context) error {
+				n, err := dispatcher.Run(ctx)
+				if n > 0 {
+					log.Printf("sent %d usage alerts", n)
+				}
+				return err
+			},
+		})
+	}
+
+	if s.config.WatchdogInterval > 0 {
+		jobs = append(jobs, job{
+			name:     "memory-watchdog",
+			interval: s.config.WatchdogInterval,
+			run:      s.watchMemory,
+		})
+	}
+
+	if s.config.ScheduleCheck > 0 {
+		jobs = append(jobs, job{
+			name:     "schedule-windows",
+			interval: s.config.ScheduleCheck,
+			run:      s.checkSchedules,
+		})
+	}
+
+	// Every relay exports; an hour exported twice overwrites the same objects
+	if s.exportSealer != nil && s.config.ExportInterval > 0 {
+		exporter := export.NewExporter(s.stores.Exports, s.exportSealer)
+		jobs = append(jobs, job{
+			name:     "export-data",
+			interval: s.config.ExportInterval,
+			run: func(ctx context.Context) error {
+				n, err := exporter.Run(ctx)
+				if n > 0 {
+					log.Printf("exported %d objects to users' buckets", n)
+				}
+				return err
+			},
+		})
+	}
+
+	if s.db != nil && s.config.Retention != nil {
+		jobs = append(jobs, job{
+			name:     "prune-data",
+			interval: time.Hour,
+			run: func(ctx context.Context) error {
+				res, err := s.db.Prune(ctx, s.config.Retention)
+				if res != nil && res.RequestLogs+res.BandwidthUsage+res.BillingEvents+res.HealthChecks+res.Events > 0 {
+					log.Printf("pruned %d request logs, %d bandwidth records, %d billing events, %d health checks, %d events",
+						res.RequestLogs, res.BandwidthUsage, res.BillingEvents, res.HealthChecks, res.Events)
+				}
+				return err
+			},
+		})
+	}
+
+	if s.billingService != nil {
+		jobs = append(jobs, job{
+			name:     "expire-trials",
+			interval: time.Hour,
+			run: func(ctx context.Context) error {
+				n, err := s.billingService.ExpireLapsedTrials(ctx)
+				if n > 0 {
+					log.Printf("downgraded %d users with lapsed trials", n)
+				}
+				return err
+			},
+		})
+		if s.config.UsageAuditKey != "" {
+			jobs = append(jobs, job{
+				name:     "seal-usage",
+				interval: time.Hour,
+				run: func(ctx context.Context) error {
+					n, err := s.billingService.SealUsage(ctx)
+					if n > 0 {
+						log.Printf("sealed %d daily usage records", n)
+					}
+					return err
+				},
+			})
+		}
+		jobs = append(jobs, job{
+			name:     "reconcile-billing",
+			interval: 6 * time.Hour,
+			run: func(ctx context.Context) error {
+				report, err := s.billingService.Reconcile(ctx, s.config.ReconcileAutoFix)
+				if err != nil {
+					return err
+				}
+				for _, m := range report.Mismatches {
+					log.Printf("billing drift for user %s: %s (fixed=%v)", m.UserID, m.Reason, m.Fixed)
+				}
+				return nil
+			},
+		})
+	}
+
+	if s.webhookHandler != nil {
+		jobs = append(jobs, job{
+			name:     "retry-billing-events",
+			interval: time.Minute,
+			run: func(ctx context.Context) error {
+				n, err := s.webhookHandler.RetryFailedEvents(ctx)
+				if n > 0 {
+					log.Printf("reprocessed %d failed billing events", n)
+				}
+				return err
+			},
+		})
+	}
+
+	return jobs
+}
+
+func runJob(ctx context.Context, j job) {
+	ticker := time.NewTicker(j.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := j.run(ctx); err != nil {
+				log.Printf("job %s failed: %v", j.name, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,29 @@
+// internal/relay/noindex.go
+package relay
+
+import "net/http"
+
+// noIndexTag is the X-Robots-Tag on every response of a tunnel search
+// engines are kept off
+const noIndexTag = "noindex, nofollow"
+
+// noIndexRobots is the robots.txt such a tunnel serves, whatever the local
+// server has
+const noIndexRobots = "User-agent: *\nDisallow: /\n"
+
+// serveNoIndex keeps search engines off tun, if it asked: it tags the
+// response the relay goes on to write, and answers robots.txt itself,
+// reporting whether it did
+func serveNoIndex(w http.ResponseWriter, r *http.Request, tun *Tunnel) bool {
+	if !tun.noIndex {
+		return false
+	}
+	w.Header().Set("X-Robots-Tag", noIndexTag)
+	if r.URL.Path != "/robots.txt" || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+		return false
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	w.Write([]byte(noIndexRobots))
+	return true
+}
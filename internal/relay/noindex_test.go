@@ -0,0 +1,71 @@
+// internal/relay/noindex_test.go
+package relay
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/lobber-dev/lobber/internal/tunnel"
+)
+
+func TestProxyNoIndex(t *testing.T) {
+	config := DefaultServerConfig()
+	s := NewServerWithConfig(nil, config)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tun := &Tunnel{
+		Domain:  "k3vq7m2xwa4tc.preview.example.com",
+		UserID:  "test-user",
+		state:   TunnelStateReady,
+		reqCh:   make(chan *pendingRequest, 1),
+		respCh:  make(chan *tunnel.Response, 1),
+		done:    make(chan struct{}),
+		config:  config,
+		ctx:     ctx,
+		cancel:  cancel,
+		onClose: func() {},
+		noIndex: true,
+	}
+	s.RegisterTunnel(tun)
+	forwarded := make(chan string, 2)
+	go func() {
+		for pr := range tun.reqCh {
+			forwarded <- pr.req.Path
+			pr.respCh <- &tunnel.Response{
+				ID:         pr.req.ID,
+				StatusCode: http.StatusOK,
+				Headers:    map[string][]string{"X-Robots-Tag": {"all"}},
+				Body:       []byte("local " + pr.req.Path),
+			}
+		}
+	}()
+	defer close(tun.reqCh)
+
+	tests := []struct {
+		path     string
+		wantBody string
+	}{
+		{"/robots.txt", noIndexRobots},
+		{"/", "local /"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", tt.path, nil)
+		req.Host = tun.Domain
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusOK || rec.Body.String() != tt.wantBody {
+			t.Errorf("GET %s = %d %q, want 200 %q", tt.path, rec.Code, rec.Body.String(), tt.wantBody)
+		}
+		if got := rec.Header().Values("X-Robots-Tag"); !reflect.DeepEqual(got, []string{noIndexTag}) {
+			t.Errorf("GET %s X-Robots-Tag = %v, want [%s]", tt.path, got, noIndexTag)
+		}
+	}
+	if len(forwarded) != 1 || <-forwarded != "/" {
+		t.Error("robots.txt was forwarded to the tunnel, want it answered by the relay")
+	}
+}
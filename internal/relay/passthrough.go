@@ -0,0 +1,229 @@
+// internal/relay/passthrough.go
+package relay
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/lobber-dev/lobber/internal/billing"
+	"github.com/lobber-dev/lobber/internal/dnsname"
+	"github.com/lobber-dev/lobber/internal/store"
+	"github.com/lobber-dev/lobber/internal/tunnel"
+)
+
+// helloTimeout bounds reading the ClientHello a TLS connection is routed by
+const helloTimeout = 10 * time.Second
+
+// errHelloRead stops the handshake peekHello starts once it has the
+// ClientHello
+var errHelloRead = errors.New("client hello read")
+
+// passthroughURL is where visitors reach a TLS passthrough tunnel
+func passthroughURL(hostname string) string {
+	return "https://" + hostname + "/"
+}
+
+// PassthroughListener wraps the HTTPS listener so TLS connections whose SNI
+// names a tunnel opened with tunnel.ProtocolTLS go to that tunnel's client
+// unopened. Accept returns the rest, with the bytes read to route them
+// still to come, for the relay to terminate as before.
+func (s *Server) PassthroughListener(ln net.Listener) net.Listener {
+	l := &passthroughListener{Listener: ln, s: s, accepted: make(chan accepted), done: make(chan struct{})}
+	go l.run()
+	return l
+}
+
+type passthroughListener struct {
+	net.Listener
+	s        *Server
+	accepted chan accepted // connections for the relay to terminate
+	done     chan struct{}
+	once     sync.Once
+}
+
+type accepted struct {
+	conn net.Conn
+	err  error
+}
+
+// run accepts connections and routes each by its ClientHello. Accept
+// errors are handed to whoever calls Accept, which paces retries.
+func (l *passthroughListener) run() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			select {
+			case l.accepted <- accepted{err: err}:
+			case <-l.done:
+				return
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		go l.route(conn)
+	}
+}
+
+// route passes conn to its passthrough tunnel, if its SNI names one, and
+// otherwise to Accept
+func (l *passthroughListener) route(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(helloTimeout))
+	hello, peeked := peekHello(conn)
+	conn.SetReadDeadline(time.Time{})
+	conn = &peekedConn{Conn: conn, r: io.MultiReader(bytes.NewReader(peeked), conn)}
+
+	if hello != nil {
+		if tun := l.s.passthroughTunnel(hello.ServerName); tun != nil {
+			l.s.proxyPassthrough(tun, conn, hello)
+			return
+		}
+	}
+	select {
+	case l.accepted <- accepted{conn: conn}:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+func (l *passthroughListener) Accept() (net.Conn, error) {
+	select {
+	case a := <-l.accepted:
+		return a.conn, a.err
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *passthroughListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+// peekHello reads the ClientHello conn opens with and returns it, or nil if
+// conn isn't TLS, along with every byte it read
+func peekHello(conn net.Conn) (*tls.ClientHelloInfo, []byte) {
+	var peeked bytes.Buffer
+	var hello *tls.ClientHelloInfo
+	tls.Server(readOnlyConn{r: io.TeeReader(conn, &peeked)}, &tls.Config{
+		GetConfigForClient: func(h *tls.ClientHelloInfo) (*tls.Config, error) {
+			hello = h
+			return nil, errHelloRead
+		},
+	}).Handshake()
+	return hello, peeked.Bytes()
+}
+
+// readOnlyConn lets a TLS handshake read a ClientHello without answering it
+type readOnlyConn struct {
+	r io.Reader
+}
+
+func (c readOnlyConn) Read(p []byte) (int, error)       { return c.r.Read(p) }
+func (c readOnlyConn) Write(p []byte) (int, error)      { return 0, io.ErrClosedPipe }
+func (c readOnlyConn) Close() error                     { return nil }
+func (c readOnlyConn) LocalAddr() net.Addr              { return nil }
+func (c readOnlyConn) RemoteAddr() net.Addr             { return nil }
+func (c readOnlyConn) SetDeadline(time.Time) error      { return nil }
+func (c readOnlyConn) SetReadDeadline(time.Time) error  { return nil }
+func (c readOnlyConn) SetWriteDeadline(time.Time) error { return nil }
+
+// peekedConn is a connection whose first bytes were read to route it, and
+// are read again from r
+type peekedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// passthroughTunnel returns the passthrough tunnel for a ClientHello's
+// server name, or nil if there is none
+func (s *Server) passthroughTunnel(serverName string) *Tunnel {
+	s.mu.RLock()
+	tun := s.tunnels[dnsname.Lookup(serverName)]
+	s.mu.RUnlock()
+	if tun == nil || !tun.passthrough {
+		return nil
+	}
+	return tun
+}
+
+// proxyPassthrough carries a visitor's TLS connection to tun's client
+// unopened, as a stream, until either end closes it, and logs it once it
+// has. The client answers 101 once it has connected to the local server.
+func (s *Server) proxyPassthrough(tun *Tunnel, conn net.Conn, hello *tls.ClientHelloInfo) {
+	defer conn.Close()
+	hostname := tun.Domain
+	start := time.Now()
+
+	// Owners past their hard cap and domains outside their hours get
+	// nothing through, as on HTTP, though there's no page to tell them
+	if s.quota != nil && tun.UserID != "anonymous" && s.quota.level(tun.UserID) == billing.QuotaCapped {
+		return
+	}
+	if s.closed(tun, start) != nil {
+		return
+	}
+
+	ip, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	_, port, _ := net.SplitHostPort(conn.LocalAddr().String())
+	entry := store.RequestLog{
+		Method:         http.MethodConnect,
+		Path:           net.JoinHostPort(hostname, port),
+		StatusCode:     http.StatusBadGateway,
+		CreatedAt:      start,
+		RemoteIP:       ip,
+		TLSFingerprint: clientHelloFingerprint(hello),
+		Labels:         tun.Labels,
+		TunnelName:     tun.Name,
+	}
+	defer func() {
+		entry.Duration = time.Since(start)
+		s.logRequest(hostname, entry)
+	}()
+	if ok, _ := tun.burst.allow(start); !ok {
+		entry.StatusCode = http.StatusTooManyRequests
+		return
+	}
+
+	req := &tunnel.Request{ID: generateRequestID(), Method: http.MethodConnect, Path: entry.Path, Upgrade: tunnel.ProtocolTLS}
+	st := tun.openStream(req.ID)
+	defer tun.closeStream(req.ID)
+
+	resp, err := s.roundTrip(tun.ctx, tun, req, start)
+	if err != nil {
+		switch {
+		case errors.Is(err, errQueueFull), errors.Is(err, errSaturated):
+			entry.StatusCode = http.StatusServiceUnavailable
+		case errors.Is(err, errTunnelTimeout):
+			entry.StatusCode = http.StatusGatewayTimeout
+		}
+		return
+	}
+	entry.StatusCode = resp.StatusCode
+	entry.Latency = requestLatency(start, time.Now(), req, resp)
+	if resp.Meta != nil {
+		entry.LocalStatus, entry.ClientVersion = resp.Meta.LocalStatus, resp.Meta.ClientVersion
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return
+	}
+
+	in, out := tun.pipe(req.ID, st, conn, bufio.NewReader(conn))
+	entry.RequestSize, entry.ResponseSize = in, out
+	tun.bytesIn.Add(in)
+	tun.bytesOut.Add(out)
+	log.Printf("tunnel %s: TLS stream %s closed after %s", hostname, req.ID, time.Since(start).Round(time.Second))
+}
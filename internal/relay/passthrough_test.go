@@ -0,0 +1,53 @@
+// internal/relay/passthrough_test.go
+package relay
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestPeekHello(t *testing.T) {
+	tests := []struct {
+		name       string
+		open       func(net.Conn)
+		serverName string // "" for a connection that isn't TLS
+		prefix     []byte // what the peeked bytes start with
+	}{
+		{
+			name: "tls",
+			open: func(c net.Conn) {
+				tls.Client(c, &tls.Config{ServerName: "app.example.com"}).Handshake()
+			},
+			serverName: "app.example.com",
+			prefix:     []byte{0x16, 0x03}, // a handshake record
+		},
+		{
+			name:   "plain http",
+			open:   func(c net.Conn) { io.WriteString(c, "GET / HTTP/1.1\r\nHost: app.example.com\r\n\r\n") },
+			prefix: []byte("GET /"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			visitor, relay := net.Pipe()
+			defer visitor.Close()
+			go tt.open(visitor)
+
+			hello, peeked := peekHello(relay)
+			relay.Close()
+			got := ""
+			if hello != nil {
+				got = hello.ServerName
+			}
+			if got != tt.serverName {
+				t.Errorf("ServerName = %q, want %q", got, tt.serverName)
+			}
+			if !bytes.HasPrefix(peeked, tt.prefix) {
+				t.Errorf("peeked = %q, want it to start with %q", peeked, tt.prefix)
+			}
+		})
+	}
+}
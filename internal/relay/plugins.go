@@ -0,0 +1,59 @@
+// internal/relay/plugins.go
+package relay
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/lobber-dev/lobber/plugin"
+)
+
+// pluginsOf returns the plugins in ps that implement T
+func pluginsOf[T plugin.Plugin](ps []plugin.Plugin) []T {
+	var out []T
+	for _, p := range ps {
+		if t, ok := p.(T); ok {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// intercept runs the interceptor plugins on a visitor's request, in
+// registration order. It returns false once one has answered the request.
+func (s *Server) intercept(w http.ResponseWriter, r *http.Request, tun *Tunnel) bool {
+	if len(s.interceptors) == 0 {
+		return true
+	}
+	info := plugin.Tunnel{Hostname: tun.Domain, UserID: tun.UserID, Name: tun.Name, Labels: tun.Labels}
+	for _, i := range s.interceptors {
+		if !i.Intercept(w, r, info) {
+			return false
+		}
+	}
+	return true
+}
+
+// pluginTokenValidator asks each auth provider plugin about a token before
+// falling back to next, which may be nil
+func pluginTokenValidator(providers []plugin.AuthProvider, next TokenValidator) TokenValidator {
+	return func(token string) (string, bool) {
+		for _, p := range providers {
+			userID, err := p.Authenticate(context.Background(), token)
+			if errors.Is(err, plugin.ErrUnknownToken) {
+				continue
+			}
+			if err != nil {
+				log.Printf("plugin %s: authenticate: %v", p.Name(), err)
+				return "", false
+			}
+			return userID, true
+		}
+		if next == nil {
+			return "", false
+		}
+		return next(token)
+	}
+}
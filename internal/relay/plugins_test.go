@@ -0,0 +1,139 @@
+// internal/relay/plugins_test.go
+package relay
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/lobber-dev/lobber/internal/auth"
+	"github.com/lobber-dev/lobber/internal/store"
+	"github.com/lobber-dev/lobber/internal/tunnel"
+	"github.com/lobber-dev/lobber/plugin"
+)
+
+// ssoPlugin lets requests with an SSO cookie through, tagging them with the
+// user, and sends everyone else to a login page
+type ssoPlugin struct{}
+
+func (ssoPlugin) Name() string { return "sso" }
+
+func (ssoPlugin) Intercept(w http.ResponseWriter, r *http.Request, t plugin.Tunnel) bool {
+	if t.Labels["sso"] != "required" {
+		return true
+	}
+	c, err := r.Cookie("sso")
+	if err != nil {
+		http.Redirect(w, r, "https://sso.example.com/login", http.StatusFound)
+		return false
+	}
+	r.Header.Set("X-Forwarded-User", c.Value)
+	return true
+}
+
+// tokenPlugin issues tokens starting with "corp_" and refuses "corp_revoked"
+type tokenPlugin struct{}
+
+func (tokenPlugin) Name() string { return "corp-tokens" }
+
+func (tokenPlugin) Authenticate(ctx context.Context, token string) (string, error) {
+	switch token {
+	case "corp_alice":
+		return "alice", nil
+	case "corp_revoked":
+		return "", errors.New("revoked")
+	}
+	return "", plugin.ErrUnknownToken
+}
+
+func TestInterceptorPlugin(t *testing.T) {
+	config := DefaultServerConfig()
+	config.Plugins = []plugin.Plugin{ssoPlugin{}}
+	s := NewServerWithConfig(nil, config)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tun := &Tunnel{
+		Domain:  "internal.example.com",
+		Labels:  tunnel.Labels{"sso": "required"},
+		state:   TunnelStateReady,
+		reqCh:   make(chan *pendingRequest, 1),
+		done:    make(chan struct{}),
+		config:  s.config,
+		ctx:     ctx,
+		cancel:  cancel,
+		onClose: func() {},
+	}
+	s.RegisterTunnel(tun)
+	go func() {
+		for pr := range tun.reqCh {
+			user := http.Header(pr.req.Headers).Get("X-Forwarded-User")
+			pr.respCh <- &tunnel.Response{ID: pr.req.ID, StatusCode: http.StatusOK, Body: []byte(user)}
+		}
+	}()
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Host = "internal.example.com"
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	if rec.Code != http.StatusFound {
+		t.Errorf("without cookie status = %d, want 302 to the login page", rec.Code)
+	}
+
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Host = "internal.example.com"
+	req.AddCookie(&http.Cookie{Name: "sso", Value: "alice"})
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || rec.Body.String() != "alice" {
+		t.Errorf("with cookie = %d %q, want 200 proxied as alice", rec.Code, rec.Body.String())
+	}
+}
+
+func TestAuthProviderPlugin(t *testing.T) {
+	config := DefaultServerConfig()
+	config.Plugins = []plugin.Plugin{tokenPlugin{}}
+	config.DevToken = "lb_dev"
+	s := NewServerWithConfig(nil, config)
+
+	tests := []struct {
+		token  string
+		userID string
+		ok     bool
+	}{
+		{"corp_alice", "alice", true},
+		{"corp_revoked", "", false},
+		{"lb_dev", DevUserID, true},
+		{"lb_unknown", "", false},
+	}
+
+	for _, tt := range tests {
+		userID, ok := s.tokenValidator(tt.token)
+		if userID != tt.userID || ok != tt.ok {
+			t.Errorf("tokenValidator(%q) = %q, %v, want %q, %v", tt.token, userID, ok, tt.userID, tt.ok)
+		}
+	}
+}
+
+func TestStoreFromConfig(t *testing.T) {
+	mem := store.NewMemory()
+	mem.AddUser(store.User{ID: "user-1"})
+	if _, err := mem.CreateToken(context.Background(), "user-1", "ci", auth.HashToken("lb_plugin")); err != nil {
+		t.Fatal(err)
+	}
+	config := DefaultServerConfig()
+	config.Store = mem
+	s := NewServerWithConfig(nil, config)
+
+	if s.stores.Usage != store.UsageStore(mem) {
+		t.Error("relay isn't using the configured store")
+	}
+	if s.dashboardHandler == nil {
+		t.Error("dashboard is off with a configured store")
+	}
+	if userID, ok := s.tokenValidator("lb_plugin"); !ok || userID != "user-1" {
+		t.Errorf("tokenValidator() = %q, %v, want the store's user-1", userID, ok)
+	}
+}
@@ -0,0 +1,147 @@
+// internal/relay/quic.go
+package relay
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/quic"
+
+	"github.com/lobber-dev/lobber/internal/tunnel"
+)
+
+// quicHandshakeTimeout bounds how long a QUIC connection may take to open
+// its stream and send the connect request on it
+const quicHandshakeTimeout = 10 * time.Second
+
+// quicIdleTimeout is how long a QUIC connection may go without packets
+// before it's dropped. Clients send keepalives well within it.
+const quicIdleTimeout = time.Minute
+
+// QUICConfig returns the QUIC settings for accepting tunnels with the
+// relay's HTTPS certificates
+func QUICConfig(tlsConfig *tls.Config) *quic.Config {
+	cfg := tlsConfig.Clone()
+	cfg.NextProtos = []string{tunnel.QUICProtocol}
+	cfg.MinVersion = tls.VersionTLS13
+	cfg.GetConfigForClient = nil
+	return &quic.Config{TLSConfig: cfg, MaxIdleTimeout: quicIdleTimeout}
+}
+
+// quicKey marks requests that arrived over QUIC
+type quicKey struct{}
+
+// overQUIC reports whether r arrived on a QUIC connection
+func overQUIC(r *http.Request) bool {
+	v, _ := r.Context().Value(quicKey{}).(bool)
+	return v
+}
+
+// ServeQUIC accepts tunnels over QUIC on ep, which should listen on the
+// HTTPS address's UDP port, until ctx ends or ep closes. Each connection
+// carries a connect request on its first stream, answered as over TCP.
+func (s *Server) ServeQUIC(ctx context.Context, ep *quic.Endpoint) error {
+	for {
+		conn, err := ep.Accept(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go s.serveQUIC(ctx, conn)
+	}
+}
+
+// serveQUIC reads the connect request from conn's first stream and hands
+// it to handleConnect, which takes the stream over as the tunnel
+func (s *Server) serveQUIC(ctx context.Context, conn *quic.Conn) {
+	acceptCtx, cancel := context.WithTimeout(ctx, quicHandshakeTimeout)
+	stream, err := conn.AcceptStream(acceptCtx)
+	cancel()
+	if err != nil {
+		conn.Abort(nil)
+		return
+	}
+	qc := tunnel.NewQUICConn(conn, stream, nil)
+	qc.SetReadDeadline(time.Now().Add(quicHandshakeTimeout))
+	br := bufio.NewReader(qc)
+	r, err := http.ReadRequest(br)
+	if err != nil {
+		log.Printf("quic: read connect request from %s: %v", qc.RemoteAddr(), err)
+		qc.Close()
+		return
+	}
+	qc.SetReadDeadline(time.Time{})
+	state := conn.ConnectionState()
+	r.TLS = &state
+	r.RemoteAddr = qc.RemoteAddr().String()
+	r = r.WithContext(context.WithValue(ctx, quicKey{}, true))
+
+	w := &quicResponseWriter{conn: qc, br: br, header: http.Header{}}
+	if r.URL.Path == "/_lobber/connect" {
+		s.handleConnect(w, r)
+	} else {
+		http.NotFound(w, r)
+	}
+	if !w.hijacked {
+		w.finish()
+		qc.Close()
+	}
+}
+
+// quicResponseWriter answers a connect request on a QUIC stream as HTTP/1.1,
+// or hands the stream over when the connect succeeds
+type quicResponseWriter struct {
+	conn     net.Conn
+	br       *bufio.Reader
+	header   http.Header
+	status   int
+	body     bytes.Buffer
+	hijacked bool
+}
+
+func (w *quicResponseWriter) Header() http.Header { return w.header }
+
+func (w *quicResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *quicResponseWriter) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(p)
+}
+
+func (w *quicResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if w.status != 0 {
+		return nil, nil, errors.New("response already written")
+	}
+	w.hijacked = true
+	return w.conn, bufio.NewReadWriter(w.br, bufio.NewWriter(w.conn)), nil
+}
+
+// finish sends the response handleConnect wrote
+func (w *quicResponseWriter) finish() {
+	w.WriteHeader(http.StatusOK)
+	w.header.Set("Content-Length", strconv.Itoa(w.body.Len()))
+	resp := &http.Response{
+		StatusCode:    w.status,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        w.header,
+		ContentLength: int64(w.body.Len()),
+		Body:          io.NopCloser(&w.body),
+	}
+	resp.Write(w.conn)
+}
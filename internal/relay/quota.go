@@ -0,0 +1,120 @@
+// internal/relay/quota.go
+package relay
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/lobber-dev/lobber/internal/billing"
+)
+
+// QuotaChecker reports a tunnel owner's quota level and sends threshold warnings
+type QuotaChecker interface {
+	GetQuotaLevel(ctx context.Context, userID string) (billing.QuotaLevel, error)
+	NotifyUsageThresholds(ctx context.Context, userID string) error
+}
+
+type quotaEntry struct {
+	level     billing.QuotaLevel
+	checkedAt time.Time
+}
+
+// quotaGate caches quota levels per user so the proxy path doesn't hit the
+// database on every request
+type quotaGate struct {
+	checker QuotaChecker
+	ttl     time.Duration
+	changed func(userID string, level billing.QuotaLevel) // called when a user passes a threshold; may be nil
+
+	mu      sync.Mutex
+	entries map[string]quotaEntry
+}
+
+func newQuotaGate(checker QuotaChecker, ttl time.Duration) *quotaGate {
+	if ttl <= 0 {
+		ttl = 30 * time.Second
+	}
+	return &quotaGate{
+		checker: checker,
+		ttl:     ttl,
+		entries: make(map[string]quotaEntry),
+	}
+}
+
+// level returns the cached quota level for a user, refreshing it when stale.
+// Lookup failures fail open so a database hiccup doesn't take tunnels down.
+func (g *quotaGate) level(userID string) billing.QuotaLevel {
+	g.mu.Lock()
+	entry, ok := g.entries[userID]
+	g.mu.Unlock()
+	if ok && time.Since(entry.checkedAt) < g.ttl {
+		return entry.level
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	level, err := g.checker.GetQuotaLevel(ctx, userID)
+	if err != nil {
+		log.Printf("quota check for %s failed: %v", userID, err)
+		return entry.level
+	}
+
+	g.mu.Lock()
+	g.entries[userID] = quotaEntry{level: level, checkedAt: time.Now()}
+	g.mu.Unlock()
+
+	if level != entry.level && level >= billing.QuotaWarning {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			if err := g.checker.NotifyUsageThresholds(ctx, userID); err != nil {
+				log.Printf("usage notification for %s failed: %v", userID, err)
+			}
+			if g.changed != nil {
+				g.changed(userID, level)
+			}
+		}()
+	}
+
+	return level
+}
+
+// expire forces the next lookup for a user to refresh, keeping the last level
+// so threshold warnings aren't sent twice
+func (g *quotaGate) expire(userID string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if entry, ok := g.entries[userID]; ok {
+		entry.checkedAt = time.Time{}
+		g.entries[userID] = entry
+	}
+}
+
+// SetQuotaChecker overrides the quota checker used to cap over-quota tunnels
+func (s *Server) SetQuotaChecker(c QuotaChecker) {
+	if c == nil {
+		s.quota = nil
+		return
+	}
+	s.quota = newQuotaGate(c, s.config.QuotaCacheTTL)
+	s.quota.changed = s.quotaChanged
+}
+
+var quotaPageTmpl = visitorPage(`{{define "title"}}Bandwidth limit reached{{end}}
+{{define "content"}}
+        <h1>This tunnel is temporarily unavailable</h1>
+        <p>The owner of <code>{{.Domain}}</code> has reached their monthly bandwidth limit.</p>
+        {{if .BaseDomain}}<p>If this is your tunnel, upgrade your plan at <a href="https://{{.BaseDomain}}/dashboard/account" style="color:#ef4444">{{.BaseDomain}}</a> to bring it back online.</p>
+        {{else}}<p>If this is your tunnel, upgrade your plan to bring it back online.</p>
+        {{end}}
+{{end}}`)
+
+// writeQuotaPage responds with 402 Payment Required for a capped domain,
+// linking to the dashboard on baseDomain if it's set
+func writeQuotaPage(w http.ResponseWriter, domain, baseDomain string) {
+	writeVisitorPage(w, http.StatusPaymentRequired, quotaPageTmpl, struct{ Domain, BaseDomain string }{domain, baseDomain})
+}
@@ -0,0 +1,93 @@
+package relay
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lobber-dev/lobber/internal/billing"
+	"github.com/lobber-dev/lobber/internal/tunnel"
+)
+
+type fakeQuotaChecker struct {
+	level    billing.QuotaLevel
+	calls    atomic.Int32
+	notified atomic.Int32
+}
+
+func (f *fakeQuotaChecker) GetQuotaLevel(ctx context.Context, userID string) (billing.QuotaLevel, error) {
+	f.calls.Add(1)
+	return f.level, nil
+}
+
+func (f *fakeQuotaChecker) NotifyUsageThresholds(ctx context.Context, userID string) error {
+	f.notified.Add(1)
+	return nil
+}
+
+func TestCappedTunnelServesQuotaPage(t *testing.T) {
+	config := DefaultServerConfig()
+	config.BaseDomain = "relay.example.com"
+	s := NewServerWithConfig(nil, config)
+	s.SetQuotaChecker(&fakeQuotaChecker{level: billing.QuotaCapped})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s.RegisterTunnel(&Tunnel{
+		Domain:       "capped.example.com",
+		UserID:       "user-1",
+		state:        TunnelStateReady,
+		reqCh:        make(chan *pendingRequest, 1),
+		respCh:       make(chan *tunnel.Response, 1),
+		done:         make(chan struct{}),
+		pendingQueue: make([]*pendingRequest, 0),
+		config:       s.config,
+		ctx:          ctx,
+		cancel:       cancel,
+	})
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Host = "capped.example.com"
+	rec := httptest.NewRecorder()
+
+	s.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusPaymentRequired {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusPaymentRequired)
+	}
+	if !strings.Contains(rec.Body.String(), "capped.example.com") {
+		t.Error("quota page should name the domain")
+	}
+	if !strings.Contains(rec.Body.String(), `href="https://relay.example.com/dashboard/account"`) {
+		t.Error("quota page should link to this relay's dashboard")
+	}
+}
+
+func TestQuotaGateCachesLevel(t *testing.T) {
+	checker := &fakeQuotaChecker{level: billing.QuotaWarning}
+	g := newQuotaGate(checker, time.Minute)
+
+	for i := 0; i < 3; i++ {
+		if got := g.level("user-1"); got != billing.QuotaWarning {
+			t.Fatalf("level = %v, want %v", got, billing.QuotaWarning)
+		}
+	}
+
+	if n := checker.calls.Load(); n != 1 {
+		t.Errorf("checker called %d times, want 1", n)
+	}
+
+	// Crossing into warning should trigger exactly one notification
+	deadline := time.Now().Add(time.Second)
+	for checker.notified.Load() == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := checker.notified.Load(); n != 1 {
+		t.Errorf("notified %d times, want 1", n)
+	}
+}
@@ -0,0 +1,31 @@
+// internal/relay/replay.go
+package relay
+
+import (
+	"net/http"
+
+	"github.com/lobber-dev/lobber/internal/replay"
+	"github.com/lobber-dev/lobber/internal/tunnel"
+)
+
+// replayRequest queues a copy of req, which hostname's tunnel answered
+// with status, for the domain's replay target if it has one and its
+// sampling policy picks the request. The copy is scrubbed by the relay's
+// rules, as the request log is. Replays of replays are left alone.
+func (s *Server) replayRequest(hostname string, req *tunnel.Request, path string, status int) {
+	headers := http.Header(req.Headers)
+	if headers.Get(replay.Header) != "" {
+		return
+	}
+	target := s.replays.get(hostname)
+	if target == nil || !target.Keep(path, status) {
+		return
+	}
+	s.replayer.Send(target, replay.Request{
+		Hostname: hostname,
+		Method:   req.Method,
+		Path:     s.config.Scrub.String(req.Path),
+		Headers:  s.config.Scrub.Headers(req.Headers),
+		Body:     s.config.Scrub.Body(headers.Get("Content-Type"), req.Body),
+	})
+}
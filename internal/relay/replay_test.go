@@ -0,0 +1,74 @@
+// internal/relay/replay_test.go
+package relay
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lobber-dev/lobber/internal/replay"
+	"github.com/lobber-dev/lobber/internal/scrub"
+	"github.com/lobber-dev/lobber/internal/store"
+	"github.com/lobber-dev/lobber/internal/tunnel"
+)
+
+func TestReplayRequest(t *testing.T) {
+	type replayed struct{ path, key, body string }
+	got := make(chan replayed, 4)
+	staging := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		got <- replayed{r.URL.RequestURI(), r.Header.Get("X-Api-Key"), string(body)}
+	}))
+	defer staging.Close()
+	// The target names example.com, which the test server's certificate is
+	// for, and is dialed at the test server
+	client := staging.Client()
+	client.Transport.(*http.Transport).DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+		return new(net.Dialer).DialContext(ctx, network, staging.Listener.Addr().String())
+	}
+
+	config := DefaultServerConfig()
+	config.ReplayClient = client
+	rules, err := scrub.New(scrub.Rules{Headers: []string{"X-Api-Key"}, Fields: []string{"email"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Scrub = rules
+	s := NewServerWithConfig(nil, config)
+	mem := s.stores.Usage.(*store.Memory)
+	mem.AddDomain("u1", store.Domain{Name: "app.example.com", Replay: "https://example.com/mirror path:/webhooks/*"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.replayer.Run(ctx)
+
+	headers := map[string][]string{"Content-Type": {"application/json"}, "X-Api-Key": {"secret"}}
+	for _, req := range []*tunnel.Request{
+		{Method: "GET", Path: "/", Headers: headers},
+		{Method: "POST", Path: "/webhooks/stripe?x=1", Headers: map[string][]string{replay.Header: {"other.example.com"}}},
+		{Method: "POST", Path: "/webhooks/stripe?x=2", Headers: headers, Body: []byte(`{"email":"ann@example.com"}`)},
+	} {
+		path, _, _ := strings.Cut(req.Path, "?")
+		s.replayRequest("app.example.com", req, path, http.StatusOK)
+	}
+
+	select {
+	case r := <-got:
+		want := replayed{"/mirror/webhooks/stripe?x=2", scrub.Placeholder, `{"email":"` + scrub.Placeholder + `"}`}
+		if r != want {
+			t.Errorf("replayed %+v, want %+v", r, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing replayed")
+	}
+	select {
+	case r := <-got:
+		t.Errorf("also replayed %+v, want only the webhook", r)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
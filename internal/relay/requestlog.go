@@ -0,0 +1,61 @@
+// internal/relay/requestlog.go
+package relay
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	"github.com/lobber-dev/lobber/internal/store"
+)
+
+// requestLogQueue is how many request logs can wait to be written. When the
+// store falls behind, logs are dropped rather than slowing down the proxy.
+const requestLogQueue = 1024
+
+// requestLogEntry is a proxied request waiting to be written
+type requestLogEntry struct {
+	hostname string
+	log      store.RequestLog
+}
+
+// logRequest queues a request log without blocking
+func (s *Server) logRequest(hostname string, l store.RequestLog) {
+	select {
+	case s.requestLogs <- requestLogEntry{hostname: hostname, log: l}:
+	default:
+	}
+}
+
+// writeRequestLogs saves queued request logs until ctx is cancelled.
+// Tunnels on hostnames nobody owns, such as anonymous ones, aren't logged,
+// and neither are requests the domain's sampling policy leaves out. The
+// rest are scrubbed by the relay's rules on the way into the store, which
+// tags each with its owner's data region and keeps it there.
+func (s *Server) writeRequestLogs(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-s.requestLogs:
+			if !s.sampled(e) {
+				continue
+			}
+			e.log.Path = s.config.Scrub.String(e.log.Path)
+			err := s.stores.Usage.LogRequest(ctx, e.hostname, e.log)
+			if err != nil && !errors.Is(err, store.ErrNotFound) && ctx.Err() == nil {
+				log.Printf("log request for %s: %v", e.hostname, err)
+			}
+		}
+	}
+}
+
+// sampled reports whether e's domain keeps a log of it. Domains without a
+// sampling policy keep everything.
+func (s *Server) sampled(e requestLogEntry) bool {
+	if s.sampling == nil {
+		return true
+	}
+	policy := s.sampling.get(e.hostname)
+	return policy == nil || policy.Keep(e.log.Path, e.log.StatusCode)
+}
@@ -0,0 +1,76 @@
+// internal/relay/requestlog_test.go
+package relay
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/lobber-dev/lobber/internal/scrub"
+	"github.com/lobber-dev/lobber/internal/store"
+)
+
+func TestRequestLogSampling(t *testing.T) {
+	s := NewServer(nil)
+	mem := s.stores.Usage.(*store.Memory)
+	mem.AddDomain("u1", store.Domain{Name: "app.example.com", Sampling: "errors, path:/api/*"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.writeRequestLogs(ctx)
+
+	start := time.Now()
+	for i, l := range []store.RequestLog{
+		{Method: "GET", Path: "/", StatusCode: http.StatusOK},
+		{Method: "GET", Path: "/missing", StatusCode: http.StatusNotFound},
+		{Method: "GET", Path: "/assets/app.js", StatusCode: http.StatusOK},
+		{Method: "POST", Path: "/api/orders", StatusCode: http.StatusCreated},
+	} {
+		l.CreatedAt = start.Add(time.Duration(i) * time.Second)
+		s.logRequest("app.example.com", l)
+	}
+
+	// Logs are written in order, so once the last is in, the rest are done
+	var logs []store.RequestLog
+	deadline := time.Now().Add(2 * time.Second)
+	for (len(logs) == 0 || logs[0].Path != "/api/orders") && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		logs, _ = mem.RecentRequests(ctx, "u1", 10)
+	}
+	got := make(map[string]bool)
+	for _, l := range logs {
+		got[l.Path] = true
+	}
+	if len(logs) != 2 || !got["/missing"] || !got["/api/orders"] {
+		t.Errorf("RecentRequests() = %+v, want only the 404 and the /api/ request", logs)
+	}
+}
+
+func TestRequestLogScrubbing(t *testing.T) {
+	config := DefaultServerConfig()
+	rules, err := scrub.New(scrub.Rules{Patterns: []string{`[\w.+-]+@[\w-]+\.[\w.]+`}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Scrub = rules
+	s := NewServerWithConfig(nil, config)
+	mem := s.stores.Usage.(*store.Memory)
+	mem.AddDomain("u1", store.Domain{Name: "app.example.com"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.writeRequestLogs(ctx)
+
+	s.logRequest("app.example.com", store.RequestLog{Method: "GET", Path: "/users/ann@example.com/orders", StatusCode: http.StatusOK})
+
+	var logs []store.RequestLog
+	deadline := time.Now().Add(2 * time.Second)
+	for len(logs) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		logs, _ = mem.RecentRequests(ctx, "u1", 10)
+	}
+	if len(logs) != 1 || logs[0].Path != "/users/"+scrub.Placeholder+"/orders" {
+		t.Errorf("RecentRequests() = %+v, want the email scrubbed from the path", logs)
+	}
+}
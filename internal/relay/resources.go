@@ -0,0 +1,320 @@
+// internal/relay/resources.go
+package relay
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lobber-dev/lobber/internal/auth"
+	"github.com/lobber-dev/lobber/internal/dnsname"
+	"github.com/lobber-dev/lobber/internal/forcehttps"
+	"github.com/lobber-dev/lobber/internal/replay"
+	"github.com/lobber-dev/lobber/internal/respheader"
+	"github.com/lobber-dev/lobber/internal/sampling"
+	"github.com/lobber-dev/lobber/internal/schedule"
+	"github.com/lobber-dev/lobber/internal/store"
+)
+
+// resourcesPrefix is where the CLI API manages the account's domains and
+// tokens, for `lobber apply`
+const resourcesPrefix = "/api/v1/"
+
+// apiDomain is a domain as GET /api/v1/domains returns it
+type apiDomain struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Verified bool   `json:"verified"`
+	Schedule string `json:"schedule,omitempty"` // hours the domain is available; empty means always
+	Sampling string `json:"sampling,omitempty"` // which requests are logged; empty means all
+	Replay   string `json:"replay,omitempty"`   // where a copy of its traffic is sent; empty means nowhere
+	Headers  string `json:"headers,omitempty"`  // added to its responses, one "Name: value" per line
+	HTTPS    string `json:"https,omitempty"`    // how visitors are kept on https; empty means they aren't
+}
+
+// apiToken is a CLI token as GET /api/v1/tokens returns it. Token, the
+// secret, is only set in the answer to creating it.
+type apiToken struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Token      string     `json:"token,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// domainSettings is the body of PATCH /api/v1/domains/{id}. Fields left out
+// are unchanged.
+type domainSettings struct {
+	Schedule *string `json:"schedule"`
+	Sampling *string `json:"sampling"`
+	Replay   *string `json:"replay"`
+	Headers  *string `json:"headers"`
+	HTTPS    *string `json:"https"`
+}
+
+func (s *Server) registerResourceRoutes() {
+	s.mux.HandleFunc("GET "+resourcesPrefix+"domains", s.handleAPIDomains)
+	s.mux.HandleFunc("POST "+resourcesPrefix+"domains", s.handleAPICreateDomain)
+	s.mux.HandleFunc("PATCH "+resourcesPrefix+"domains/{id}", s.handleAPIUpdateDomain)
+	s.mux.HandleFunc("DELETE "+resourcesPrefix+"domains/{id}", s.handleAPIDeleteDomain)
+	s.mux.HandleFunc("GET "+resourcesPrefix+"tokens", s.handleAPITokens)
+	s.mux.HandleFunc("POST "+resourcesPrefix+"tokens", s.handleAPICreateToken)
+}
+
+// isResourceRoute reports whether path is one registerResourceRoutes serves
+func isResourceRoute(path string) bool {
+	rest, ok := strings.CutPrefix(path, resourcesPrefix)
+	return ok && (rest == "domains" || strings.HasPrefix(rest, "domains/") || rest == "tokens")
+}
+
+func toAPIDomain(d store.Domain) apiDomain {
+	return apiDomain{ID: d.ID, Name: d.Name, Verified: d.Verified, Schedule: d.Schedule, Sampling: d.Sampling, Replay: d.Replay, Headers: d.Headers, HTTPS: d.HTTPS}
+}
+
+// handleAPIDomains lists the token owner's domains
+func (s *Server) handleAPIDomains(w http.ResponseWriter, r *http.Request) {
+	user, ok := s.apiAuth(w, r)
+	if !ok {
+		return
+	}
+	domains, err := s.stores.Domains.ListDomains(r.Context(), user.ID)
+	if err != nil {
+		log.Printf("api: list domains for %s: %v", user.ID, err)
+		http.Error(w, "could not list domains", http.StatusInternalServerError)
+		return
+	}
+	out := make([]apiDomain, 0, len(domains))
+	for _, d := range domains {
+		out = append(out, toAPIDomain(d))
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"domains": out})
+}
+
+// handleAPICreateDomain registers the hostname in {"name": "..."}, which
+// still has to be verified from the dashboard
+func (s *Server) handleAPICreateDomain(w http.ResponseWriter, r *http.Request) {
+	user, ok := s.apiAuth(w, r)
+	if !ok {
+		return
+	}
+	var body struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&body); err != nil {
+		http.Error(w, "invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	hostname, err := dnsname.Normalize(body.Name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	d, err := s.stores.Domains.CreateDomain(r.Context(), user.ID, hostname)
+	if errors.Is(err, store.ErrDomainTaken) {
+		http.Error(w, hostname+" is already registered", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("api: create domain %s for %s: %v", hostname, user.ID, err)
+		http.Error(w, "could not add domain", http.StatusInternalServerError)
+		return
+	}
+	s.auditAPI(r, user.ID, "domain.created", hostname)
+	writeJSON(w, http.StatusCreated, toAPIDomain(*d))
+}
+
+// handleAPIUpdateDomain sets a domain's schedule, sampling policy, replay
+// target, response headers and HTTPS policy
+func (s *Server) handleAPIUpdateDomain(w http.ResponseWriter, r *http.Request) {
+	user, ok := s.apiAuth(w, r)
+	if !ok {
+		return
+	}
+	var body domainSettings
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&body); err != nil {
+		http.Error(w, "invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	d, err := s.stores.Domains.GetDomain(r.Context(), user.ID, r.PathValue("id"))
+	if errors.Is(err, store.ErrNotFound) {
+		http.Error(w, "domain not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "could not load domain", http.StatusInternalServerError)
+		return
+	}
+
+	if body.Schedule != nil {
+		text := ""
+		if strings.TrimSpace(*body.Schedule) != "" {
+			sched, err := schedule.Parse(*body.Schedule)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			text = sched.String()
+		}
+		if err := s.stores.Domains.SetDomainSchedule(r.Context(), user.ID, d.ID, text); err != nil {
+			http.Error(w, "could not save schedule", http.StatusInternalServerError)
+			return
+		}
+		d.Schedule = text
+	}
+	if body.Sampling != nil {
+		text := ""
+		if raw := strings.TrimSpace(*body.Sampling); raw != "" && !strings.EqualFold(raw, "all") {
+			policy, err := sampling.Parse(raw)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			text = policy.String()
+		}
+		if err := s.stores.Domains.SetDomainSampling(r.Context(), user.ID, d.ID, text); err != nil {
+			http.Error(w, "could not save sampling", http.StatusInternalServerError)
+			return
+		}
+		d.Sampling = text
+	}
+	if body.Replay != nil {
+		text := ""
+		if raw := strings.TrimSpace(*body.Replay); raw != "" {
+			target, err := replay.Parse(raw)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			text = target.String()
+		}
+		if err := s.stores.Domains.SetDomainReplay(r.Context(), user.ID, d.ID, text); err != nil {
+			http.Error(w, "could not save replay target", http.StatusInternalServerError)
+			return
+		}
+		d.Replay = text
+	}
+	if body.Headers != nil {
+		text := ""
+		if strings.TrimSpace(*body.Headers) != "" {
+			set, err := respheader.Parse(*body.Headers)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			text = set.String()
+		}
+		if err := s.stores.Domains.SetDomainHeaders(r.Context(), user.ID, d.ID, text); err != nil {
+			http.Error(w, "could not save response headers", http.StatusInternalServerError)
+			return
+		}
+		d.Headers = text
+	}
+	if body.HTTPS != nil {
+		text := ""
+		if strings.TrimSpace(*body.HTTPS) != "" {
+			policy, err := forcehttps.Parse(*body.HTTPS)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			text = policy.String()
+		}
+		if err := s.stores.Domains.SetDomainHTTPS(r.Context(), user.ID, d.ID, text); err != nil {
+			http.Error(w, "could not save HTTPS policy", http.StatusInternalServerError)
+			return
+		}
+		d.HTTPS = text
+	}
+	writeJSON(w, http.StatusOK, toAPIDomain(*d))
+}
+
+// handleAPIDeleteDomain removes a domain
+func (s *Server) handleAPIDeleteDomain(w http.ResponseWriter, r *http.Request) {
+	user, ok := s.apiAuth(w, r)
+	if !ok {
+		return
+	}
+	d, err := s.stores.Domains.GetDomain(r.Context(), user.ID, r.PathValue("id"))
+	if err == nil {
+		err = s.stores.Domains.DeleteDomain(r.Context(), user.ID, d.ID)
+	}
+	if errors.Is(err, store.ErrNotFound) {
+		http.Error(w, "domain not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "could not delete domain", http.StatusInternalServerError)
+		return
+	}
+	s.auditAPI(r, user.ID, "domain.deleted", d.Name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleAPITokens lists the token owner's CLI tokens, without their secrets
+func (s *Server) handleAPITokens(w http.ResponseWriter, r *http.Request) {
+	user, ok := s.apiAuth(w, r)
+	if !ok {
+		return
+	}
+	tokens, err := s.stores.Tokens.ListTokens(r.Context(), user.ID)
+	if err != nil {
+		log.Printf("api: list tokens for %s: %v", user.ID, err)
+		http.Error(w, "could not list tokens", http.StatusInternalServerError)
+		return
+	}
+	out := make([]apiToken, 0, len(tokens))
+	for _, t := range tokens {
+		out = append(out, apiToken{ID: t.ID, Name: t.Name, LastUsedAt: t.LastUsedAt, CreatedAt: t.CreatedAt})
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"tokens": out})
+}
+
+// handleAPICreateToken creates a CLI token named by {"name": "..."}. Its
+// secret is in the answer and never shown again.
+func (s *Server) handleAPICreateToken(w http.ResponseWriter, r *http.Request) {
+	user, ok := s.apiAuth(w, r)
+	if !ok {
+		return
+	}
+	var body struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&body); err != nil {
+		http.Error(w, "invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	name := strings.TrimSpace(body.Name)
+	if name == "" || len(name) > 100 {
+		http.Error(w, "name must be 1 to 100 characters", http.StatusBadRequest)
+		return
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		http.Error(w, "could not create token", http.StatusInternalServerError)
+		return
+	}
+	secret := "lb_" + hex.EncodeToString(b)
+	t, err := s.stores.Tokens.CreateToken(r.Context(), user.ID, name, auth.HashToken(secret))
+	if err != nil {
+		log.Printf("api: create token for %s: %v", user.ID, err)
+		http.Error(w, "could not create token", http.StatusInternalServerError)
+		return
+	}
+	s.auditAPI(r, user.ID, "token.created", name)
+	writeJSON(w, http.StatusCreated, apiToken{ID: t.ID, Name: t.Name, Token: secret, CreatedAt: t.CreatedAt})
+}
+
+// auditAPI records a change made through the CLI API in the user's audit log
+func (s *Server) auditAPI(r *http.Request, userID, action, detail string) {
+	entry := store.AuditEntry{UserID: userID, Action: action, Detail: detail, IPAddress: remoteIP(r)}
+	if err := s.stores.Audit.RecordAudit(r.Context(), entry); err != nil {
+		log.Printf("api: record audit %s for %s: %v", action, userID, err)
+	}
+}
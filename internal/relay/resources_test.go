@@ -0,0 +1,87 @@
+// internal/relay/resources_test.go
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/lobber-dev/lobber/internal/auth"
+	"github.com/lobber-dev/lobber/internal/store"
+)
+
+func TestResourceAPI(t *testing.T) {
+	s := NewServerWithConfig(nil, DefaultServerConfig())
+	mem := s.stores.Tokens.(*store.Memory)
+	mem.AddUser(store.User{ID: "user-1", Email: "dev@example.com"})
+	mem.AddUser(store.User{ID: "user-2", Email: "other@example.com"})
+	mem.CreateToken(context.Background(), "user-1", "ci", auth.HashToken("lb_good"))
+	mem.AddDomain("user-2", store.Domain{ID: "theirs", Name: "taken.example.com"})
+
+	call := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Host = "localhost"
+		req.Header.Set("Authorization", "Bearer lb_good")
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := call("POST", "/api/v1/domains", `{"name":"App.Example.com"}`)
+	var d apiDomain
+	json.NewDecoder(rec.Body).Decode(&d)
+	if rec.Code != http.StatusCreated || d.Name != "app.example.com" || d.ID == "" {
+		t.Fatalf("create domain = %d %+v, want app.example.com created", rec.Code, d)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		status int
+		want   string
+	}{
+		{"taken", "POST", "/api/v1/domains", `{"name":"taken.example.com"}`, http.StatusConflict, "already registered"},
+		{"invalid name", "POST", "/api/v1/domains", `{"name":"nodot"}`, http.StatusBadRequest, ""},
+		{"set schedule", "PATCH", "/api/v1/domains/" + d.ID, `{"schedule":"Mon-Fri  09:00-18:00 UTC"}`, http.StatusOK, `"schedule":"Mon-Fri 09:00-18:00 UTC"`},
+		{"set sampling keeps schedule", "PATCH", "/api/v1/domains/" + d.ID, `{"sampling":"errors"}`, http.StatusOK, `"schedule":"Mon-Fri 09:00-18:00 UTC","sampling":"errors"`},
+		{"bad sampling", "PATCH", "/api/v1/domains/" + d.ID, `{"sampling":"most"}`, http.StatusBadRequest, ""},
+		{"set replay", "PATCH", "/api/v1/domains/" + d.ID, `{"replay":"https://staging.example.com  path:/webhooks/*"}`, http.StatusOK, `"replay":"https://staging.example.com path:/webhooks/*"`},
+		{"private replay target", "PATCH", "/api/v1/domains/" + d.ID, `{"replay":"https://10.0.0.5"}`, http.StatusBadRequest, "public host"},
+		{"set headers", "PATCH", "/api/v1/domains/" + d.ID, `{"headers":"x-robots-tag: noindex\nX-Frame-Options:DENY"}`, http.StatusOK, `"headers":"X-Robots-Tag: noindex\nX-Frame-Options: DENY"`},
+		{"framing header", "PATCH", "/api/v1/domains/" + d.ID, `{"headers":"Content-Length: 0"}`, http.StatusBadRequest, "set by the relay"},
+		{"set https", "PATCH", "/api/v1/domains/" + d.ID, `{"https":"HSTS, redirect"}`, http.StatusOK, `"https":"redirect, hsts"`},
+		{"bad https", "PATCH", "/api/v1/domains/" + d.ID, `{"https":"always"}`, http.StatusBadRequest, "unknown HTTPS option"},
+		{"someone else's domain", "PATCH", "/api/v1/domains/theirs", `{"sampling":"errors"}`, http.StatusNotFound, ""},
+		{"list domains", "GET", "/api/v1/domains", "", http.StatusOK, `"name":"app.example.com"`},
+		{"create token", "POST", "/api/v1/tokens", `{"name":"deploy"}`, http.StatusCreated, `"token":"lb_`},
+		{"unnamed token", "POST", "/api/v1/tokens", `{"name":" "}`, http.StatusBadRequest, ""},
+		{"list tokens", "GET", "/api/v1/tokens", "", http.StatusOK, `"name":"deploy"`},
+		{"delete domain", "DELETE", "/api/v1/domains/" + d.ID, "", http.StatusNoContent, ""},
+		{"deleted", "DELETE", "/api/v1/domains/" + d.ID, "", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := call(tt.method, tt.path, tt.body)
+			if rec.Code != tt.status || !strings.Contains(rec.Body.String(), tt.want) {
+				t.Errorf("%s %s = %d %s, want %d with %q", tt.method, tt.path, rec.Code, rec.Body, tt.status, tt.want)
+			}
+		})
+	}
+
+	// Listing never shows secrets
+	if rec := call("GET", "/api/v1/tokens", ""); strings.Contains(rec.Body.String(), `"token"`) {
+		t.Errorf("token list = %s, want no secrets", rec.Body)
+	}
+	req := httptest.NewRequest("GET", "/api/v1/domains", nil)
+	req.Host = "localhost"
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("without a token = %d, want 401", rec.Code)
+	}
+}
@@ -0,0 +1,71 @@
+// internal/relay/resume.go
+package relay
+
+import (
+	"crypto/rand"
+	"errors"
+	"log"
+	"time"
+)
+
+// errHeld turns away a client that connects for a hostname held for
+// another's session to resume
+var errHeld = errors.New("hostname is held for its tunnel to reconnect, try again shortly")
+
+// heldSession is the hostname of a tunnel whose connection dropped, kept
+// for its client to come back to
+type heldSession struct {
+	id     string
+	userID string
+	until  time.Time
+}
+
+// holdSession keeps t's hostname for its client to resume its session for
+// ResumeWindow, if its connection dropped rather than either end closing
+// it. Callers hold s.mu and have just removed t.
+func (s *Server) holdSession(t *Tunnel) {
+	if t.session == "" || !t.dropped.Load() || s.config.ResumeWindow <= 0 || s.draining.Load() {
+		return
+	}
+	now := time.Now()
+	for hostname, h := range s.held {
+		if !now.Before(h.until) {
+			delete(s.held, hostname)
+		}
+	}
+	s.held[t.Domain] = heldSession{id: t.session, userID: t.UserID, until: now.Add(s.config.ResumeWindow)}
+	log.Printf("tunnel %s: connection dropped, holding the hostname %s for it to resume", t.Domain, s.config.ResumeWindow)
+}
+
+// heldUntil returns when hostname stops being held for a dropped tunnel to
+// resume, or the zero time if it isn't
+func (s *Server) heldUntil(hostname string) time.Time {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if h, ok := s.held[hostname]; ok && time.Now().Before(h.until) {
+		return h.until
+	}
+	return time.Time{}
+}
+
+// resumeSession returns the session a client of userID connecting for
+// hostname with the session it presented, if any, gets: the one it had if
+// the hostname is held for it, or else a new one. While a hostname is held,
+// only the same account may take it over without the session, and for
+// anonymous tunnels nobody may; they get errHeld and how long to wait.
+func (s *Server) resumeSession(hostname, userID, presented string) (session string, resumed bool, wait time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h, ok := s.held[hostname]
+	if ok && !time.Now().Before(h.until) {
+		delete(s.held, hostname)
+		ok = false
+	}
+	switch {
+	case ok && presented == h.id && userID == h.userID:
+		return h.id, true, 0, nil
+	case ok && (userID != h.userID || userID == "anonymous"):
+		return "", false, time.Until(h.until), errHeld
+	}
+	return rand.Text(), false, 0, nil
+}
@@ -0,0 +1,123 @@
+// internal/relay/resume_test.go
+package relay
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/lobber-dev/lobber/internal/tunnel"
+)
+
+// connectAs opens a tunnel for app.example.com presenting session, if any,
+// and returns the connection and the relay's answer
+func connectAs(t *testing.T, addr, session string) (net.Conn, *bufio.Reader, *http.Response) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	fmt.Fprintf(conn, "POST /_lobber/connect HTTP/1.1\r\nHost: relay\r\nAuthorization: Bearer test\r\nX-Lobber-Domain: app.example.com\r\n%s: %s\r\n\r\n", tunnel.SessionHeader, session)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	return conn, br, resp
+}
+
+// awaitGone waits for s to unregister app.example.com
+func awaitGone(t *testing.T, s *Server) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for s.HasTunnel("app.example.com") {
+		if time.Now().After(deadline) {
+			t.Fatal("tunnel still registered after its connection closed")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestResumeSession(t *testing.T) {
+	config := DefaultServerConfig()
+	config.ResumeWindow = 5 * time.Second
+	s := NewServerWithConfig(nil, config)
+	srv := startTestServer(t, s)
+	defer srv.Close()
+	addr := srv.Listener.Addr().String()
+
+	conn, _, resp := connectAs(t, addr, "")
+	session := resp.Header.Get(tunnel.SessionHeader)
+	if resp.StatusCode != http.StatusOK || session == "" {
+		t.Fatalf("connect = %d with session %q, want 200 and a session", resp.StatusCode, session)
+	}
+	tunnel.EncodeReady(conn, nil)
+	conn.Close()
+	awaitGone(t, s)
+
+	// Someone else can't take the hostname while it's held
+	if _, _, resp := connectAs(t, addr, "stolen"); resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("connect without the session = %d, want 503 with Retry-After", resp.StatusCode)
+	}
+
+	// A visitor arriving in the gap waits for the tunnel to come back
+	visited := make(chan string, 1)
+	go func() {
+		req, _ := http.NewRequest("GET", srv.URL+"/gap", nil)
+		req.Host = "app.example.com"
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			visited <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		visited <- string(body)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	conn, br, resp := connectAs(t, addr, session)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get(tunnel.SessionHeader) != session {
+		t.Fatalf("resume = %d with session %q, want 200 and %q", resp.StatusCode, resp.Header.Get(tunnel.SessionHeader), session)
+	}
+	tunnel.EncodeReady(conn, nil)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	frame, err := tunnel.ReadFrame(br)
+	if err != nil || frame.Type != tunnel.TypeRequest {
+		t.Fatalf("read request frame: %v, %v", frame, err)
+	}
+	var req tunnel.Request
+	if err := frame.Decode(&req); err != nil || req.Path != "/gap" {
+		t.Fatalf("request = %+v, %v", req, err)
+	}
+	tunnel.EncodeResponse(conn, &tunnel.Response{ID: req.ID, StatusCode: http.StatusOK, Body: []byte("resumed")})
+	if got := <-visited; got != "resumed" {
+		t.Errorf("visitor got %q, want resumed", got)
+	}
+}
+
+func TestShutdownReleasesHostname(t *testing.T) {
+	config := DefaultServerConfig()
+	config.ResumeWindow = 5 * time.Second
+	s := NewServerWithConfig(nil, config)
+	srv := startTestServer(t, s)
+	defer srv.Close()
+	addr := srv.Listener.Addr().String()
+
+	conn, _, _ := connectAs(t, addr, "")
+	tunnel.EncodeReady(conn, nil)
+	tunnel.EncodeError(conn, &tunnel.Error{Code: tunnel.ErrorShutdown, Message: "client shutting down"})
+	awaitGone(t, s)
+
+	if until := s.heldUntil("app.example.com"); !until.IsZero() {
+		t.Errorf("hostname held until %v after the client shut down, want it free", until)
+	}
+	if _, _, resp := connectAs(t, addr, ""); resp.StatusCode != http.StatusOK {
+		t.Errorf("connect after shutdown = %d, want 200", resp.StatusCode)
+	}
+}
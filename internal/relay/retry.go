@@ -0,0 +1,70 @@
+// internal/relay/retry.go
+package relay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Why roundTrip gave up on a request; each message is what the visitor sees
+var (
+	errTunnelClosed  = errors.New("tunnel closed")
+	errTunnelFailed  = errors.New("tunnel error")
+	errQueueFull     = errors.New("tunnel not ready, queue full")
+	errTunnelTimeout = errors.New("tunnel response timeout")
+	errVisitorGone   = errors.New("visitor closed the request")
+	errSaturated     = errors.New("tunnel saturated, the client is still busy with earlier requests")
+
+	errRequestTooLarge = errors.New("request too large for this tunnel")
+
+	// The tunnel closed before the client saw the request, so any request
+	// may be replayed on a replacement
+	errNotSent = fmt.Errorf("%w before the request was sent", errTunnelClosed)
+)
+
+// replacementPoll is how often a retried request looks for a new tunnel
+const replacementPoll = 20 * time.Millisecond
+
+// tunnelLost reports whether roundTrip failed because the connection died,
+// which a replacement tunnel may recover from
+func tunnelLost(err error) bool {
+	return errors.Is(err, errTunnelClosed) || errors.Is(err, errTunnelFailed)
+}
+
+// retryable reports whether a request can be replayed after its tunnel
+// died. Only GET and HEAD are, since the client may have acted on anything
+// else before the connection dropped.
+func (s *Server) retryable(method string, bodySize int) bool {
+	if method != http.MethodGet && method != http.MethodHead {
+		return false
+	}
+	return s.config.RetryBodyLimit > 0 && bodySize <= s.config.RetryBodyLimit
+}
+
+// awaitReplacement waits up to RetryWait, or for as long as hostname is
+// held for its tunnel to resume, for a live tunnel other than dead to serve
+// hostname, and returns it. It gives up early if the visitor leaves.
+func (s *Server) awaitReplacement(ctx context.Context, hostname string, dead *Tunnel) *Tunnel {
+	deadline := time.Now().Add(s.config.RetryWait)
+	for {
+		if t := s.GetTunnel(hostname); t != nil && t != dead && t.GetState() != TunnelStateClosed {
+			return t
+		}
+		// The hold starts once the dead tunnel has unregistered, which may
+		// be after the first look
+		if until := s.heldUntil(hostname); until.After(deadline) {
+			deadline = until
+		}
+		if !time.Now().Before(deadline) {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(min(replacementPoll, time.Until(deadline))):
+		}
+	}
+}
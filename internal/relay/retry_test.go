@@ -0,0 +1,179 @@
+package relay
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lobber-dev/lobber/internal/tunnel"
+)
+
+func TestRetryOnReplacementTunnel(t *testing.T) {
+	tests := []struct {
+		name      string
+		method    string
+		body      string
+		bodyLimit int
+		status    int
+	}{
+		{"GET is retried", "GET", "", 64, http.StatusOK},
+		{"HEAD is retried", "HEAD", "", 64, http.StatusOK},
+		{"small GET body is replayed", "GET", "query", 64, http.StatusOK},
+		{"POST is not retried", "POST", "payload", 64, http.StatusBadGateway},
+		{"body over the limit", "GET", strings.Repeat("x", 65), 64, http.StatusBadGateway},
+		{"retries disabled", "GET", "", 0, http.StatusBadGateway},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := DefaultServerConfig()
+			config.RetryBodyLimit = tt.bodyLimit
+			config.RetryWait = time.Second
+			s := NewServerWithConfig(nil, config)
+
+			newTun := func() *Tunnel {
+				ctx, cancel := context.WithCancel(context.Background())
+				t.Cleanup(cancel)
+				tun := &Tunnel{
+					Domain: "app.example.com",
+					UserID: "test-user",
+					state:  TunnelStateReady,
+					reqCh:  make(chan *pendingRequest, 1),
+					done:   make(chan struct{}),
+					config: config,
+					ctx:    ctx,
+					cancel: cancel,
+				}
+				tun.onClose = func() { s.unregisterTunnel(tun) }
+				return tun
+			}
+			dying, replacement := newTun(), newTun()
+			s.RegisterTunnel(dying)
+
+			// The first client takes the request and drops the connection
+			// as its replacement connects
+			go func() {
+				<-dying.reqCh
+				s.RegisterTunnel(replacement)
+				dying.Close()
+			}()
+			replayed := make(chan string, 1)
+			go func() {
+				select {
+				case pr := <-replacement.reqCh:
+					replayed <- string(pr.req.Body)
+					pr.respCh <- &tunnel.Response{ID: pr.req.ID, StatusCode: http.StatusOK}
+				case <-replacement.done:
+				}
+			}()
+			t.Cleanup(replacement.Close)
+
+			req := httptest.NewRequest(tt.method, "/page", strings.NewReader(tt.body))
+			req.Host = "app.example.com"
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, req)
+
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.status)
+			}
+			if tt.status == http.StatusOK {
+				if body := <-replayed; body != tt.body {
+					t.Errorf("replayed body = %q, want %q", body, tt.body)
+				}
+			}
+		})
+	}
+}
+
+func TestRetryGivesUpWithoutReplacement(t *testing.T) {
+	config := DefaultServerConfig()
+	config.RetryWait = 50 * time.Millisecond
+	s := NewServerWithConfig(nil, config)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tun := &Tunnel{
+		Domain: "app.example.com",
+		state:  TunnelStateReady,
+		reqCh:  make(chan *pendingRequest, 1),
+		done:   make(chan struct{}),
+		config: config,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	tun.onClose = func() { s.unregisterTunnel(tun) }
+	s.RegisterTunnel(tun)
+	go func() {
+		<-tun.reqCh
+		tun.Close()
+	}()
+
+	req := httptest.NewRequest("GET", "/page", nil)
+	req.Host = "app.example.com"
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusBadGateway)
+	}
+	if body := strings.TrimSpace(rec.Body.String()); body != "tunnel closed" {
+		t.Errorf("body = %q, want %q", body, "tunnel closed")
+	}
+}
+
+func TestReplayUnsentRequest(t *testing.T) {
+	config := DefaultServerConfig()
+	config.RetryWait = time.Second
+	s := NewServerWithConfig(nil, config)
+
+	newTun := func() *Tunnel {
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+		tun := &Tunnel{
+			Domain: "app.example.com",
+			UserID: "test-user",
+			state:  TunnelStateReady,
+			reqCh:  make(chan *pendingRequest, 1),
+			done:   make(chan struct{}),
+			config: config,
+			ctx:    ctx,
+			cancel: cancel,
+		}
+		tun.onClose = func() { s.unregisterTunnel(tun) }
+		return tun
+	}
+	dying, replacement := newTun(), newTun()
+	s.RegisterTunnel(dying)
+	t.Cleanup(replacement.Close)
+
+	// The connection drops with the POST still queued for it, so the
+	// client never saw it and it's safe to send again
+	go func() {
+		for len(dying.reqCh) == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		s.RegisterTunnel(replacement)
+		dying.Close()
+	}()
+	replayed := make(chan string, 1)
+	go func() {
+		pr := <-replacement.reqCh
+		replayed <- string(pr.req.Body)
+		pr.respCh <- &tunnel.Response{ID: pr.req.ID, StatusCode: http.StatusCreated}
+	}()
+
+	req := httptest.NewRequest("POST", "/orders", strings.NewReader("payload"))
+	req.Host = "app.example.com"
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusCreated)
+	}
+	if body := <-replayed; body != "payload" {
+		t.Errorf("replayed body = %q, want payload", body)
+	}
+}
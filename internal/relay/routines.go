@@ -0,0 +1,43 @@
+// internal/relay/routines.go
+package relay
+
+// spawn runs fn in a goroutine counted against the tunnel, so Wait can
+// tell when everything the tunnel started has returned
+func (t *Tunnel) spawn(fn func()) {
+	t.routines.Add(1)
+	t.goroutines.Add(1)
+	go func() {
+		defer t.routines.Done()
+		defer t.goroutines.Add(-1)
+		fn()
+	}()
+}
+
+// Wait blocks until the tunnel has closed and every goroutine it started
+// has returned
+func (t *Tunnel) Wait() {
+	<-t.done
+	t.routines.Wait()
+}
+
+// Goroutines returns how many goroutines the tunnel is running
+func (t *Tunnel) Goroutines() int {
+	return int(t.goroutines.Load())
+}
+
+// FDs returns how many file descriptors the tunnel holds: its connection
+// to the client and its UDP port until it closes, and the connections of
+// visitors it carries as streams until they end
+func (t *Tunnel) FDs() int {
+	n := int(t.piped.Load())
+	if t.GetState() == TunnelStateClosed {
+		return n
+	}
+	if t.conn != nil {
+		n++
+	}
+	if t.udp != nil {
+		n++
+	}
+	return n
+}
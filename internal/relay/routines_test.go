@@ -0,0 +1,87 @@
+// internal/relay/routines_test.go
+package relay
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.uber.org/goleak"
+
+	"github.com/lobber-dev/lobber/internal/tunnel"
+)
+
+func TestCloseStopsGoroutines(t *testing.T) {
+	tests := []struct {
+		name  string
+		close func(conn net.Conn, tun *Tunnel)
+	}{
+		{"client hangs up", func(conn net.Conn, _ *Tunnel) { conn.Close() }},
+		{"relay closes", func(_ net.Conn, tun *Tunnel) { tun.Close() }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+			s := NewServerWithConfig(nil, DefaultServerConfig())
+			srv := startTestServer(t, s)
+			defer srv.Close()
+
+			conn, br, _ := connectAs(t, srv.Listener.Addr().String(), "")
+			tunnel.EncodeReady(conn, nil)
+			tun := s.GetTunnel("app.example.com")
+			if tun == nil {
+				t.Fatal("tunnel not registered")
+			}
+			<-tun.GetReadyChannel()
+
+			// A request through the tunnel, so the writer is running too
+			visited := make(chan int, 1)
+			go func() {
+				req := httptest.NewRequest("GET", "http://app.example.com/", nil)
+				rec := httptest.NewRecorder()
+				s.ServeHTTP(rec, req)
+				visited <- rec.Code
+			}()
+			conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			frame, err := tunnel.ReadFrame(br)
+			if err != nil || frame.Type != tunnel.TypeRequest {
+				t.Fatalf("read request frame: %v, %v", frame, err)
+			}
+			var req tunnel.Request
+			frame.Decode(&req)
+			tunnel.EncodeResponse(conn, &tunnel.Response{ID: req.ID, StatusCode: http.StatusOK})
+			if code := <-visited; code != http.StatusOK {
+				t.Fatalf("visitor got %d, want 200", code)
+			}
+
+			if n := tun.Goroutines(); n < 2 {
+				t.Errorf("Goroutines() = %d while open, want at least 2", n)
+			}
+			if n := tun.FDs(); n != 1 {
+				t.Errorf("FDs() = %d while open, want 1", n)
+			}
+
+			tt.close(conn, tun)
+			waited := make(chan struct{})
+			go func() {
+				tun.Wait()
+				close(waited)
+			}()
+			select {
+			case <-waited:
+			case <-time.After(2 * time.Second):
+				t.Fatalf("Wait() still blocked with %d goroutines running", tun.Goroutines())
+			}
+			if n := tun.Goroutines(); n != 0 {
+				t.Errorf("Goroutines() = %d after Wait, want 0", n)
+			}
+			if n := tun.FDs(); n != 0 {
+				t.Errorf("FDs() = %d after Wait, want 0", n)
+			}
+			conn.Close()
+		})
+	}
+}
@@ -0,0 +1,92 @@
+// internal/relay/schedule.go
+package relay
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/lobber-dev/lobber/internal/schedule"
+	"github.com/lobber-dev/lobber/internal/tunnel"
+)
+
+// newScheduleCache caches domains' availability windows; a nil schedule
+// means always available
+func newScheduleCache(lookup func(ctx context.Context, hostname string) (string, error)) *domainSetting[schedule.Schedule] {
+	return newDomainSetting("schedule", lookup, schedule.Parse)
+}
+
+// closed returns the schedule of t's domain if it is outside its window at
+// now. Anonymous tunnels have no domain record and so no schedule.
+func (s *Server) closed(t *Tunnel, now time.Time) *schedule.Schedule {
+	if s.schedules == nil || t.UserID == "anonymous" {
+		return nil
+	}
+	if sched := s.schedules.get(t.Domain); sched != nil && !sched.Open(now) {
+		return sched
+	}
+	return nil
+}
+
+// checkSchedule tells t's client to disconnect until its domain's schedule
+// next opens, if it is closed now. Each tunnel is told once; a client too
+// old to understand stays connected, but its visitors get the closed page.
+func (s *Server) checkSchedule(t *Tunnel, now time.Time) {
+	sched := s.closed(t, now)
+	if sched == nil || t.GetState() != TunnelStateReady || !t.scheduleNotified.CompareAndSwap(false, true) {
+		return
+	}
+	d := &tunnel.Disconnect{
+		Reason: fmt.Sprintf("outside its schedule (%s)", sched),
+		Until:  sched.NextOpen(now),
+	}
+	if err := t.disconnect(d); err != nil {
+		log.Printf("tunnel %s: send disconnect: %v", t.Domain, err)
+		return
+	}
+	log.Printf("tunnel %s: %s, asked client to return at %s", t.Domain, d.Reason, d.Until.Format(time.RFC3339))
+}
+
+// checkSchedules asks the clients of tunnels whose schedules have closed to
+// disconnect
+func (s *Server) checkSchedules(ctx context.Context) error {
+	s.mu.RLock()
+	tunnels := make([]*Tunnel, 0, len(s.tunnels))
+	for _, t := range s.tunnels {
+		tunnels = append(tunnels, t)
+	}
+	s.mu.RUnlock()
+
+	now := time.Now()
+	for _, t := range tunnels {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		s.checkSchedule(t, now)
+	}
+	return nil
+}
+
+var schedulePageTmpl = visitorPage(`{{define "title"}}Outside opening hours{{end}}
+{{define "content"}}
+        <h1>This tunnel is closed right now</h1>
+        <p><code>{{.Domain}}</code> is only available <code>{{.Schedule}}</code>.</p>
+        <p>It's back {{.Next}}.</p>
+{{end}}`)
+
+// writeSchedulePage responds with 503 Service Unavailable for a domain
+// outside its schedule, with Retry-After set to when it next opens
+func writeSchedulePage(w http.ResponseWriter, domain string, sched *schedule.Schedule, now time.Time) {
+	next := sched.NextOpen(now)
+	secs := max(1, int(math.Ceil(next.Sub(now).Seconds())))
+	w.Header().Set("Retry-After", strconv.Itoa(secs))
+	writeVisitorPage(w, http.StatusServiceUnavailable, schedulePageTmpl, struct {
+		Domain   string
+		Schedule string
+		Next     string
+	}{domain, sched.String(), next.In(sched.Location()).Format("Mon Jan 2 at 15:04 MST")})
+}
@@ -0,0 +1,129 @@
+// internal/relay/schedule_test.go
+package relay
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lobber-dev/lobber/internal/tunnel"
+)
+
+// closedNow is a schedule that is closed at the current hour
+func closedNow() string {
+	h := time.Now().UTC().Hour()
+	return fmt.Sprintf("%02d:00-%02d:00", (h+2)%24, (h+3)%24)
+}
+
+func scheduledTunnel(s *Server, domain string) *Tunnel {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Tunnel{
+		Domain:       domain,
+		UserID:       "user-1",
+		state:        TunnelStateReady,
+		reqCh:        make(chan *pendingRequest, 1),
+		respCh:       make(chan *tunnel.Response, 1),
+		done:         make(chan struct{}),
+		pendingQueue: make([]*pendingRequest, 0),
+		config:       s.config,
+		ctx:          ctx,
+		cancel:       cancel,
+	}
+}
+
+func TestClosedScheduleServesPage(t *testing.T) {
+	s := NewServer(nil)
+	s.schedules = newScheduleCache(func(ctx context.Context, hostname string) (string, error) {
+		if hostname == "demo.example.com" {
+			return closedNow(), nil
+		}
+		return "", nil
+	})
+	tun := scheduledTunnel(s, "demo.example.com")
+	s.RegisterTunnel(tun)
+
+	get := func(host string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Host = host
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := get("demo.example.com")
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+	if secs, err := strconv.Atoi(rec.Header().Get("Retry-After")); err != nil || secs < 1 || secs > 3*3600 {
+		t.Errorf("Retry-After = %q, want seconds until the window opens", rec.Header().Get("Retry-After"))
+	}
+	if !strings.Contains(rec.Body.String(), "demo.example.com") {
+		t.Error("schedule page should name the domain")
+	}
+
+	// Once the client has gone away the domain still reads as closed
+	s.UnregisterTunnel(tun.Domain, tun.generation)
+	if rec := get("demo.example.com"); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("status after disconnect = %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+	if rec := get("nothing.example.com"); rec.Code != http.StatusBadGateway {
+		t.Errorf("status for unknown host = %d, want %d", rec.Code, http.StatusBadGateway)
+	}
+}
+
+func TestCheckScheduleSendsDisconnect(t *testing.T) {
+	s := NewServer(nil)
+	schedule := "00:00-24:00"
+	s.schedules = newScheduleCache(func(ctx context.Context, hostname string) (string, error) {
+		return schedule, nil
+	})
+
+	var out bytes.Buffer
+	tun := scheduledTunnel(s, "demo.example.com")
+	tun.bufrw = bufio.NewReadWriter(bufio.NewReader(&bytes.Buffer{}), bufio.NewWriter(&out))
+
+	now := time.Now()
+	s.checkSchedule(tun, now)
+	if out.Len() != 0 {
+		t.Fatal("checkSchedule() wrote to a tunnel inside its window")
+	}
+
+	schedule = closedNow()
+	clear(s.schedules.entries)
+	s.checkSchedule(tun, now)
+	s.checkSchedule(tun, now)
+
+	frame, err := tunnel.ReadFrame(&out)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	var d tunnel.Disconnect
+	if frame.Type != tunnel.TypeDisconnect || frame.Decode(&d) != nil {
+		t.Fatalf("frame = type %d, want a disconnect", frame.Type)
+	}
+	if !d.Until.After(now) || d.Until.Minute() != 0 {
+		t.Errorf("until = %v, want the top of the hour the window opens", d.Until)
+	}
+	if out.Len() != 0 {
+		t.Error("checkSchedule() told the client twice")
+	}
+}
+
+func TestScheduleCacheFailsOpen(t *testing.T) {
+	g := newScheduleCache(func(ctx context.Context, hostname string) (string, error) {
+		return "", fmt.Errorf("database down")
+	})
+	if sched := g.get("demo.example.com"); sched != nil {
+		t.Errorf("get() = %v on a failed lookup, want nil", sched)
+	}
+	if sched := g.known("other.example.com"); sched != nil {
+		t.Errorf("known() = %v for an unseen host, want nil", sched)
+	}
+}
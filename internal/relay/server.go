@@ -5,17 +5,44 @@ import (
 	"bufio"
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"log"
+	"maps"
 	"net"
 	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/lobber-dev/lobber/internal/auth"
 	"github.com/lobber-dev/lobber/internal/billing"
 	"github.com/lobber-dev/lobber/internal/db"
+	"github.com/lobber-dev/lobber/internal/dnsname"
+	"github.com/lobber-dev/lobber/internal/events"
+	"github.com/lobber-dev/lobber/internal/export"
+	"github.com/lobber-dev/lobber/internal/forcehttps"
+	"github.com/lobber-dev/lobber/internal/github"
+	"github.com/lobber-dev/lobber/internal/notify"
+	"github.com/lobber-dev/lobber/internal/oidc"
+	"github.com/lobber-dev/lobber/internal/proxyerr"
+	"github.com/lobber-dev/lobber/internal/ratelimit"
+	"github.com/lobber-dev/lobber/internal/replay"
+	"github.com/lobber-dev/lobber/internal/respheader"
+	"github.com/lobber-dev/lobber/internal/sampling"
+	"github.com/lobber-dev/lobber/internal/schedule"
+	"github.com/lobber-dev/lobber/internal/scrub"
+	"github.com/lobber-dev/lobber/internal/store"
 	"github.com/lobber-dev/lobber/internal/tunnel"
+	"github.com/lobber-dev/lobber/plugin"
 	"github.com/lobber-dev/lobber/web/dashboard"
+	"github.com/lobber-dev/lobber/web/static"
+	"github.com/lobber-dev/lobber/web/status"
 )
 
 // TokenValidator validates a token and returns (userID, valid)
@@ -32,68 +59,263 @@ const (
 
 // ServerConfig holds configurable parameters for the relay server
 type ServerConfig struct {
-	MaxPendingQueue  int           // Max requests to queue before tunnel ready (default 100)
-	PendingQueueTTL  time.Duration // Max time a request can wait in queue (default 5s)
-	StripeAPIKey     string        // Stripe API key for billing
-	StripeWebhookKey string        // Stripe webhook signing secret
-	BaseDomain       string        // Base domain for the application (e.g., lobber.dev)
+	MaxPendingQueue   int                   // Max requests to queue before tunnel ready (default 100)
+	PendingQueueTTL   time.Duration         // Max time a request can wait in queue (default 5s)
+	HandshakeTimeout  time.Duration         // How long a client has after connecting to send its ready frame (default 10s)
+	HeartbeatInterval time.Duration         // Longest a client should go between pings, e.g. to stay under a load balancer's idle timeout; 0 leaves it to clients (default 30s)
+	Features          []string              // Optional protocol features offered to clients that speak them, to roll a protocol change out one relay at a time; empty offers none (default tunnel.Features)
+	Deprecated        []string              // Offered features clients are warned will be withdrawn, so their users upgrade first
+	MinProtocol       int                   // Oldest client protocol version (tunnel.VersionHeader) accepted; older clients are told to upgrade (default 1)
+	MaxFrameSize      int                   // Largest frame payload read from clients, advertised in tunnel.MaxFrameHeader; larger ones close the tunnel with an Error frame (default tunnel.MaxFrameSize)
+	StripeAPIKey      string                // Stripe API key for billing
+	BillingProvider   billing.Provider      // Payment processor for billing; nil uses Stripe when StripeAPIKey is set
+	StripeWebhookKey  string                // Stripe webhook signing secret
+	StripeTaxEnabled  bool                  // Enable Stripe Tax on new subscriptions
+	ReconcileAutoFix  bool                  // Let the reconciliation job repair plan drift instead of only reporting it
+	AdminToken        string                // Bearer token for the operator API; empty disables it
+	BaseDomain        string                // Base domain for the application (e.g., lobber.dev)
+	QuotaCacheTTL     time.Duration         // How long a user's quota level is cached (default 30s)
+	Notifier          notify.Notifier       // Delivers usage warning emails (optional)
+	Retention         *db.RetentionPolicy   // How long logs and billing data are kept (default db.DefaultRetentionPolicy)
+	RelayID           string                // Name of this relay instance on the status page (default "relay")
+	Region            string                // Region shown next to the relay on the status page (optional)
+	HealthInterval    time.Duration         // How often the relay checks its own health for the status page (default 30s)
+	AuthIPLimit       ratelimit.Policy      // Failed auth attempts allowed per client IP before a lockout
+	AuthAccountLimit  ratelimit.Policy      // Failed auth attempts allowed against one account before a lockout
+	RateLimitBackend  ratelimit.Backend     // Where auth failures are counted; nil counts in memory on this relay
+	ConnectIPLimit    ratelimit.Policy      // Connect attempts allowed per client IP, valid or not, before it is throttled
+	APIQuota          ratelimit.QuotaPolicy // Requests each token may make to /api/v1 and the dashboard's JSON API, by plan
+	BurstLimit        BurstPolicy           // Caps sudden traffic spikes to one hostname; tunnels may override it with BurstHeader
+	MaxTunnelsPerIP   int                   // Concurrent tunnels one client IP may hold on this relay; 0 means no cap (default 20)
+	MaxTunnels        int                   // Tunnels this relay holds in total before refusing new ones; 0 means no cap
+	CapacityLimit     float64               // Share of the open-file or memory (GOMEMLIMIT) limit past which new tunnels get a 503; 0 disables the check (default 0.9)
+	BannedIPs         []netip.Prefix        // Client addresses refused on /_lobber/connect
+	UsageFlush        time.Duration         // How often tunnels' byte counters are written to bandwidth usage (default 1m)
+	UsageAuditKey     string                // Signs daily usage rollups and Stripe reports; empty disables sealing
+	AlertInterval     time.Duration         // How often users' usage alerts are checked; 0 disables them (default 5m)
+	ScheduleCheck     time.Duration         // How often tunnels are checked against their domains' schedules; 0 disables disconnect notices (default 1m)
+	ExportKey         []byte                // 32 byte key sealing users' object storage credentials and GitHub App keys; empty disables exports and PR comments
+	GitHub            *github.Client        // Comments preview links on pull requests (default github.com)
+	ExportInterval    time.Duration         // How often users' request logs and usage are exported to their buckets (default 10m)
+	RetryBodyLimit    int                   // Largest GET/HEAD body replayed on a replacement tunnel when the first dies mid-request; 0 disables retries (default 64KB)
+	RetryWait         time.Duration         // How long such a request waits for a replacement tunnel to connect (default 2s)
+	ResumeWindow      time.Duration         // How long a dropped tunnel's hostname is held for its client to reconnect and resume, visitors' requests waiting meanwhile; 0 disables (default 10s)
+	UDPPorts          PortRange             // Public ports handed out to UDP tunnels, one each; empty disables UDP tunnels
+	TLSPassthrough    bool                  // Route TLS connections unopened to tunnels that ask, by SNI; needs the HTTPS listener wrapped with PassthroughListener
+	Scrub             *scrub.Scrubber       // Redacts request data, such as emails in paths, before it's logged or replayed; nil leaves it as is
+	ReplayClient      *http.Client          // Sends copies of domains' traffic to their replay targets (default one that only dials public addresses)
+	SSO               []oidc.Connection     // Identity providers team members sign in to the dashboard through, by email domain
+	Plugins           []plugin.Plugin       // Interceptors and auth providers, usually plugin.Registered()
+	Store             store.All             // Replaces the Postgres or in-memory stores, e.g. with a plugin.StorageBackend
+	DevToken          string                // Sandbox mode without a database: in-memory stores with a dev user who signs in with this token
+	TraceBuffer       int                   // Recent requests whose timings GET /_lobber/admin/requests keeps; 0 keeps none (default 1024)
+	TunnelErrors      int                   // Recent proxy errors each tunnel keeps for the admin API and dashboard; 0 keeps none (default 20)
+	WatchdogInterval  time.Duration         // How often the memory watchdog samples the relay's memory, goroutines and tunnel map, logging anything that looks like a leak; 0 disables it (default 1m)
+	WatchdogGrowth    float64               // How many times over the heap or goroutines may grow within the watchdog's window, with tunnels growing less, before it's reported (default 2)
+	HeapProfileDir    string                // Where the watchdog writes a heap profile when it reports something, at most one every 10m; empty writes none
 }
 
 // DefaultServerConfig returns sensible defaults
 func DefaultServerConfig() *ServerConfig {
 	return &ServerConfig{
-		MaxPendingQueue: 100,
-		PendingQueueTTL: 5 * time.Second,
+		MaxPendingQueue:   100,
+		PendingQueueTTL:   5 * time.Second,
+		HandshakeTimeout:  10 * time.Second,
+		HeartbeatInterval: 30 * time.Second,
+		Features:          slices.Clone(tunnel.Features),
+		MinProtocol:       1,
+		MaxFrameSize:      tunnel.MaxFrameSize,
+		QuotaCacheTTL:     30 * time.Second,
+		Retention:         db.DefaultRetentionPolicy(),
+		RelayID:           "relay",
+		HealthInterval:    30 * time.Second,
+		AuthIPLimit:       ratelimit.Policy{MaxFailures: 10, Window: 15 * time.Minute, Lockout: 15 * time.Minute},
+		AuthAccountLimit:  ratelimit.Policy{MaxFailures: 50, Window: 15 * time.Minute, Lockout: 15 * time.Minute},
+		ConnectIPLimit:    ratelimit.Policy{MaxFailures: 60, Window: time.Minute, Lockout: 5 * time.Minute},
+		APIQuota:          ratelimit.QuotaPolicy{Window: time.Minute, Default: 60, Plans: map[string]int{"pro": 300, "payg": 300, "team": 600}},
+		BurstLimit:        DefaultBurstPolicy(),
+		MaxTunnelsPerIP:   20,
+		CapacityLimit:     0.9,
+		UsageFlush:        time.Minute,
+		AlertInterval:     5 * time.Minute,
+		ScheduleCheck:     time.Minute,
+		ExportInterval:    10 * time.Minute,
+		RetryBodyLimit:    64 << 10,
+		RetryWait:         2 * time.Second,
+		ResumeWindow:      10 * time.Second,
+		TraceBuffer:       1024,
+		TunnelErrors:      proxyerr.DefaultSize,
+		WatchdogInterval:  time.Minute,
+		WatchdogGrowth:    2,
 	}
 }
 
+// baseURL is the dashboard's origin on BaseDomain, or empty if it's unset
+func (c *ServerConfig) baseURL() string {
+	if c.BaseDomain == "" {
+		return ""
+	}
+	return "https://" + c.BaseDomain
+}
+
+// maxFrameSize is MaxFrameSize, or tunnel.MaxFrameSize if it's unset
+func (c *ServerConfig) maxFrameSize() int {
+	if c.MaxFrameSize > 0 {
+		return c.MaxFrameSize
+	}
+	return tunnel.MaxFrameSize
+}
+
 type Server struct {
 	db               *db.DB
 	mu               sync.RWMutex
-	tunnels          map[string]*Tunnel // hostname -> tunnel
+	tunnels          map[string]*Tunnel     // hostname -> tunnel
+	generation       uint64                 // last generation RegisterTunnel handed out, guarded by mu
+	held             map[string]heldSession // hostnames of dropped tunnels waiting to resume, guarded by mu
 	mux              *http.ServeMux
 	tokenValidator   TokenValidator
 	config           *ServerConfig
 	billingService   *billing.Service
+	exportSealer     *export.Sealer // nil when exports are disabled
 	webhookHandler   *billing.WebhookHandler
 	dashboardHandler *dashboard.Handler
 	landingHandler   http.Handler
 	staticHandler    http.Handler
+	statusHandler    http.Handler
+	stores           store.Stores
+	status           store.StatusStore
+	quota            *quotaGate
+	authIP           *ratelimit.Limiter
+	authAccount      *ratelimit.Limiter
+	connectIP        *ratelimit.Limiter
+	apiQuota         *ratelimit.Quota
+	connsByIP        map[string]int // client IP -> open tunnel connections
+	hellos           sync.Map       // TLS client address -> ClientHello fingerprint
+	requestLogs      chan requestLogEntry
+	capacity         *capacityGate
+	udpPorts         map[int]*Tunnel // UDP port -> tunnel listening on it, guarded by mu
+	interceptors     []plugin.Interceptor
+	events           *events.Bus
+	schedules        *domainSetting[schedule.Schedule]
+	sampling         *domainSetting[sampling.Policy]
+	replays          *domainSetting[replay.Target]
+	replayer         *replay.Replayer
+	respHeaders      *domainSetting[respheader.Set]
+	httpsPolicies    *domainSetting[forcehttps.Policy]
+	traces           *traceRing
+	watchdog         *watchdog
+	shares           *shareRegistry
+	previewed        sync.Map    // pull request -> link last commented on it
+	draining         atomic.Bool // set by Drain; new tunnels are turned away
 }
 
 // pendingRequest holds a request waiting for tunnel to become ready
 type pendingRequest struct {
-	req      *tunnel.Request
-	respCh   chan *tunnel.Response
-	queuedAt time.Time
+	req        *tunnel.Request
+	respCh     chan *tunnel.Response
+	queuedAt   time.Time
+	receivedAt time.Time        // when the visitor's request reached the relay
+	meta       *tunnel.Metadata // sent by the client ahead of its response
+	trace      *requestTrace    // nil for requests that aren't traced
+	err        error            // why respCh was sent nil, if not errTunnelFailed
+	abandoned  bool             // the visitor went away; guarded by the tunnel's sentMu
+	cost       atomic.Int64     // room reserved in the client's window, see reserve
 }
 
 type Tunnel struct {
-	Domain string
-	UserID string
-	conn   net.Conn
-	bufrw  *bufio.ReadWriter
+	Domain      string
+	UserID      string
+	Name        string         // stable name from `lobber up --name` or lobber.yml; empty if unnamed
+	Labels      tunnel.Labels  // set by the client, e.g. with `lobber up --label env=staging`
+	GitHubPR    *github.PR     // pull request to comment the tunnel's link on; nil if none
+	PublicURL   string         // where visitors reach the tunnel
+	Meta        ConnMeta       // how the client connected
+	ConnectedAt time.Time      // when the connect request was accepted
+	protocol    int            // the client's protocol version, from its connect request
+	framing     tunnel.Framing // how frames to the client are encoded, as negotiated on connect
+	conn        net.Conn
+	bufrw       *bufio.ReadWriter
+	writeMu     sync.Mutex // serializes frames written to bufrw
 
 	// State machine
-	state   TunnelState
-	stateMu sync.RWMutex
+	state    TunnelState
+	features []string     // offered on connect, then those the client says it uses in its Ready frame
+	stateMu  sync.RWMutex // guards state, features and unknownFrames
+
+	unknownFrames map[byte]bool // frame types the client sent that the relay skipped
 
 	// Request/response channels for dedicated I/O goroutines
 	reqCh  chan *pendingRequest
 	respCh chan *tunnel.Response
 	done   chan struct{}
 
+	// Upgraded connections carried over the tunnel, by request ID
+	streams  map[string]*stream
+	streamMu sync.Mutex
+
 	// Pre-ready queue
 	pendingQueue []*pendingRequest
 	queueMu      sync.Mutex
 	config       *ServerConfig
 
+	// Requests sent to the client and awaiting its response, by ID
+	sent   map[string]*pendingRequest
+	sentMu sync.Mutex
+
+	// Room the client granted on connect for requests in flight, and what
+	// is left of it; nil for clients that don't send tunnel.WindowHeader
+	windowSize int64
+	window     *tunnel.Credit
+
 	// Context for cancellation
 	ctx    context.Context
 	cancel context.CancelFunc
 
 	// Cleanup callback (set by server to unregister tunnel)
 	onClose func()
+
+	// Set by RegisterTunnel under the server's mu; a newer connection for
+	// the same hostname always has a higher generation
+	generation uint64
+
+	// Admits requests while traffic is within the tunnel's BurstPolicy; nil
+	// admits everything
+	burst *burstLimiter
+
+	// Public port of a UDP tunnel; nil for HTTP tunnels
+	udp *udpListener
+
+	// Set for tunnels opened with tunnel.ProtocolTLS, which take TLS
+	// connections for their hostname unopened
+	passthrough bool
+
+	// Set for tunnels search engines are kept off, see serveNoIndex
+	noIndex bool
+
+	// Bytes proxied since they were last recorded, see flushUsage
+	bytesIn   atomic.Int64
+	bytesOut  atomic.Int64
+	sessionID string // tunnel session the bytes are recorded against, if any
+	usageMu   sync.Mutex
+
+	// Set once the client has been asked to disconnect for its domain's
+	// schedule, see checkSchedule
+	scheduleNotified atomic.Bool
+
+	// The session the client presents to resume the tunnel after its
+	// connection drops, which is marked dropped, see holdSession
+	session string
+	dropped atomic.Bool
+
+	// The latest requests the tunnel failed to proxy, and why it closed if
+	// the client sent something it couldn't read
+	errors proxyerr.Ring
+
+	// Goroutines the tunnel started, see spawn, and visitors' connections
+	// it carries as streams
+	routines   sync.WaitGroup
+	goroutines atomic.Int32
+	piped      atomic.Int32
 }
 
 func NewServer(database *db.DB) *Server {
@@ -107,30 +329,152 @@ func NewServerWithConfig(database *db.DB, config *ServerConfig) *Server {
 	s := &Server{
 		db:             database,
 		tunnels:        make(map[string]*Tunnel),
+		held:           make(map[string]heldSession),
+		connsByIP:      make(map[string]int),
+		udpPorts:       make(map[int]*Tunnel),
+		shares:         newShareRegistry(),
+		requestLogs:    make(chan requestLogEntry, requestLogQueue),
 		mux:            http.NewServeMux(),
 		config:         config,
 		landingHandler: http.FileServer(http.Dir("web/landing")),
-		staticHandler:  http.StripPrefix("/static/", http.FileServer(http.Dir("web/static"))),
+	}
+	s.capacity = &capacityGate{sample: s.sampleCapacity}
+
+	// Brute-force protection for every endpoint that checks a secret
+	limits := config.RateLimitBackend
+	if limits == nil {
+		limits = ratelimit.NewMemory()
+	}
+	s.authIP = ratelimit.New(limits, "auth:ip", config.AuthIPLimit)
+	s.authAccount = ratelimit.New(limits, "auth:account", config.AuthAccountLimit)
+	s.connectIP = ratelimit.New(limits, "connect:ip", config.ConnectIPLimit)
+	s.apiQuota = ratelimit.NewQuota(limits, "api", config.APIQuota)
+
+	// Static assets are embedded in the binary; fall back to disk if indexing fails
+	if assets, err := static.New("/static/"); err == nil {
+		s.staticHandler = assets
+	} else {
+		log.Printf("static assets: %v", err)
+		s.staticHandler = http.StripPrefix("/static/", http.FileServer(http.Dir("web/static")))
 	}
 
-	// Initialize billing service if Stripe API key is configured
-	if config.StripeAPIKey != "" && database != nil {
-		s.billingService = billing.NewService(database.DB, config.StripeAPIKey)
-		if config.StripeWebhookKey != "" {
+	// Initialize billing service if a payment processor is configured
+	provider := config.BillingProvider
+	if provider == nil && config.StripeAPIKey != "" {
+		provider = billing.NewStripeClient(config.StripeAPIKey)
+	}
+	if provider != nil && database != nil {
+		s.billingService = billing.NewServiceWithProvider(database.DB, provider)
+		if config.Notifier != nil {
+			s.billingService.SetNotifier(config.Notifier, config.baseURL())
+		}
+		s.billingService.SetAutomaticTax(config.StripeTaxEnabled)
+		if config.UsageAuditKey != "" {
+			s.billingService.SetAuditKey([]byte(config.UsageAuditKey))
+		}
+		s.quota = newQuotaGate(s.billingService, config.QuotaCacheTTL)
+		if _, ok := provider.(*billing.StripeClient); ok && config.StripeWebhookKey != "" {
 			s.webhookHandler = billing.NewWebhookHandler(database.DB, config.StripeWebhookKey, s.billingService)
 			s.mux.HandleFunc("/stripe/webhook", s.webhookHandler.HandleWebhook)
 		}
 	}
 
+	// The status page and operator API read from the database so every relay
+	// in the fleet shows up; without one they only know about this relay
+	switch {
+	case config.Store != nil:
+		s.stores = store.NewStores(config.Store)
+	case database != nil:
+		s.stores = store.NewStores(store.NewPostgres(database.DB))
+	default:
+		mem := store.NewMemory()
+		if config.DevToken != "" {
+			if err := seedDev(mem, config.DevToken); err != nil {
+				log.Printf("dev mode: %v", err)
+			}
+		}
+		s.stores = store.NewStores(mem)
+	}
+	s.status = s.stores.Status
+	s.events = events.NewBus(s.stores.Events)
+	s.schedules = newScheduleCache(s.stores.Domains.DomainSchedule)
+	s.sampling = newDomainSetting("sampling policy", s.stores.Domains.DomainSampling, sampling.Parse)
+	s.replays = newDomainSetting("replay target", s.stores.Domains.DomainReplay, replay.Parse)
+	s.replayer = replay.NewReplayer(config.ReplayClient)
+	s.respHeaders = newDomainSetting("response headers", s.stores.Domains.DomainHeaders, respheader.Parse)
+	s.httpsPolicies = newDomainSetting("HTTPS policy", s.stores.Domains.DomainHTTPS, forcehttps.Parse)
+	s.traces = newTraceRing(config.TraceBuffer)
+	s.watchdog = &watchdog{growth: config.WatchdogGrowth}
+	if len(config.ExportKey) > 0 {
+		if sealer, err := export.NewSealer(config.ExportKey); err == nil {
+			s.exportSealer = sealer
+		} else {
+			log.Printf("exports disabled: %v", err)
+		}
+	}
+	if s.quota != nil {
+		s.quota.changed = s.quotaChanged
+	}
+	if statusHandler, err := status.NewHandler(s.status, 3*config.HealthInterval); err == nil {
+		s.statusHandler = statusHandler
+	} else {
+		log.Printf("status page: %v", err)
+	}
+
 	s.mux.HandleFunc("/health", s.handleHealth)
 	s.mux.HandleFunc("/_lobber/connect", s.handleConnect)
+	s.registerAdminRoutes()
+	s.registerResourceRoutes()
+
+	// With a database, tunnels authenticate with tokens created in the
+	// dashboard; in dev mode, with the seeded dev token. Auth provider
+	// plugins get the first look.
+	if database != nil || config.DevToken != "" || config.Store != nil {
+		s.tokenValidator = StoreTokenValidator(s.stores.Tokens)
+	}
+	if providers := pluginsOf[plugin.AuthProvider](config.Plugins); len(providers) > 0 {
+		s.tokenValidator = pluginTokenValidator(providers, s.tokenValidator)
+	}
+	s.interceptors = pluginsOf[plugin.Interceptor](config.Plugins)
+	for _, p := range config.Plugins {
+		log.Printf("plugin %s loaded", p.Name())
+	}
 
-	// Initialize dashboard if database is available
-	if database != nil {
-		dashHandler, err := dashboard.NewHandler(database.DB)
-		if err == nil {
-			s.dashboardHandler = dashHandler
+	// Initialize dashboard if database is available, or on the in-memory
+	// stores in dev mode
+	var dashHandler *dashboard.Handler
+	var err error
+	switch {
+	case config.Store != nil:
+		dashHandler, err = dashboard.NewHandlerWithStores(s.stores)
+	case database != nil:
+		dashHandler, err = dashboard.NewHandler(database.DB)
+	case config.DevToken != "":
+		dashHandler, err = dashboard.NewHandlerWithStores(s.stores)
+		s.mux.HandleFunc("GET "+devLoginPath, s.handleDevLogin)
+	}
+	if dashHandler != nil && err == nil {
+		dashHandler.SetDomainVerifier(VerifyCNAME)
+		dashHandler.SetTunnelLister(s.UserTunnels)
+		dashHandler.SetAuthLimiter(s.authIP)
+		dashHandler.SetAPIQuota(s.apiQuota)
+		dashHandler.SetEvents(s.events)
+		if config.Notifier != nil && config.BaseDomain != "" {
+			dashHandler.SetNotifier(config.Notifier, "https://"+config.BaseDomain)
+		}
+		if s.billingService != nil {
+			dashHandler.SetBillingService(s.billingService)
+		}
+		if s.exportSealer != nil {
+			dashHandler.SetExportSealer(s.exportSealer)
 		}
+		if len(config.SSO) > 0 && config.BaseDomain != "" {
+			dashHandler.SetBaseURL("https://" + config.BaseDomain)
+		}
+		for _, conn := range config.SSO {
+			dashHandler.AddSSOConnection(conn, oidc.NewProvider(conn, &http.Client{Timeout: 10 * time.Second}))
+		}
+		s.dashboardHandler = dashHandler
 	}
 
 	return s
@@ -138,7 +482,8 @@ func NewServerWithConfig(database *db.DB, config *ServerConfig) *Server {
 
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// Internal routes
-	if r.URL.Path == "/health" || r.URL.Path == "/_lobber/connect" || r.URL.Path == "/stripe/webhook" {
+	if r.URL.Path == "/health" || r.URL.Path == "/_lobber/connect" || r.URL.Path == "/stripe/webhook" ||
+		r.URL.Path == devLoginPath || strings.HasPrefix(r.URL.Path, adminPrefix) {
 		s.mux.ServeHTTP(w, r)
 		return
 	}
@@ -150,7 +495,7 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Dashboard
-	if strings.HasPrefix(r.URL.Path, "/dashboard") {
+	if strings.HasPrefix(r.URL.Path, "/dashboard") || strings.HasPrefix(r.URL.Path, "/api/dashboard") {
 		if s.dashboardHandler == nil {
 			http.Error(w, "dashboard unavailable", http.StatusServiceUnavailable)
 			return
@@ -159,14 +504,35 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Tunnel routing vs landing fallback
-	host := stripPort(r.Host)
-	if s.HasTunnel(host) {
+	// Tunnel routing vs landing fallback, a hostname held for its tunnel
+	// to resume counting as routed
+	host := dnsname.Lookup(stripPort(r.Host))
+	if s.HasTunnel(host) || !s.heldUntil(host).IsZero() {
 		s.handleProxy(w, r)
 		return
 	}
 
 	if isPrimaryHost(host, s.config.BaseDomain) {
+		if (r.URL.Path == "/status" || r.URL.Path == "/status.json") && s.statusHandler != nil {
+			s.statusHandler.ServeHTTP(w, r)
+			return
+		}
+		if r.URL.Path == "/abuse" {
+			s.handleAbuseReport(w, r)
+			return
+		}
+		if r.URL.Path == "/api/v1/me" {
+			s.handleMe(w, r)
+			return
+		}
+		if r.URL.Path == "/api/v1/events" {
+			s.handleEvents(w, r)
+			return
+		}
+		if isResourceRoute(r.URL.Path) {
+			s.mux.ServeHTTP(w, r)
+			return
+		}
 		if s.landingHandler != nil {
 			s.landingHandler.ServeHTTP(w, r)
 			return
@@ -175,23 +541,171 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	s.writeNoTunnel(w, host)
+}
+
+// writeNoTunnel answers a visitor to a hostname with no tunnel. A retired
+// share link reads as gone, and a client that disconnected for its
+// schedule leaves its domain closed rather than missing.
+func (s *Server) writeNoTunnel(w http.ResponseWriter, hostname string) {
+	if s.shares.isRetired(hostname) {
+		writeSharePage(w, hostname)
+		return
+	}
+	if sched := s.schedules.known(hostname); sched != nil && !sched.Open(time.Now()) {
+		writeSchedulePage(w, hostname, sched, time.Now())
+		return
+	}
 	http.Error(w, "tunnel not found", http.StatusBadGateway)
 }
 
 func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{
-		"status": "ok",
+	json.NewEncoder(w).Encode(map[string]any{
+		"status":   "ok",
+		"capacity": s.capacity.current(),
 	})
 }
 
 func (s *Server) handleConnect(w http.ResponseWriter, r *http.Request) {
+	// Turn away banned addresses and connect floods before doing any work
+	ip := remoteIP(r)
+	if s.banned(ip) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	if wait := s.connectIP.Allow(r.Context(), ip); wait > 0 {
+		w.Header().Set("Retry-After", ratelimit.RetryAfter(wait))
+		http.Error(w, "too many connection attempts", http.StatusTooManyRequests)
+		return
+	}
+
+	// A relay on its way down sends clients to whichever instance replaces it
+	if s.draining.Load() {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "relay is restarting, try again", http.StatusServiceUnavailable)
+		return
+	}
+
+	// Near its limits a relay's tunnels fail in odd ways, so send clients
+	// elsewhere or back later instead
+	if c, full := s.atCapacity(); full {
+		log.Printf("connect: refused tunnel from %s: relay at capacity (%.0f%% used, %d tunnels)", ip, 100*c.Utilization, c.Tunnels)
+		w.Header().Set("Retry-After", capacityRetryAfter)
+		http.Error(w, "relay at capacity, try again later", http.StatusServiceUnavailable)
+		return
+	}
+
+	// A client too old to speak to is told so in plain HTTP, which every
+	// version reads, rather than sent frames it would choke on
+	protocol, err := tunnel.ParseVersion(r.Header.Get(tunnel.VersionHeader))
+	if err != nil {
+		http.Error(w, "invalid "+tunnel.VersionHeader+" header: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if protocol < s.config.MinProtocol {
+		w.Header().Set(tunnel.VersionHeader, strconv.Itoa(tunnel.ProtocolVersion))
+		http.Error(w, fmt.Sprintf("this lobber client speaks protocol version %d, but the relay needs %d or newer; upgrade lobber to connect", protocol, s.config.MinProtocol), http.StatusUpgradeRequired)
+		return
+	}
+	clientMaxFrame, err := tunnel.ParseMaxFrame(r.Header.Get(tunnel.MaxFrameHeader))
+	if err != nil {
+		http.Error(w, "invalid "+tunnel.MaxFrameHeader+" header: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	var windowSize int64
+	if v := r.Header.Get(tunnel.WindowHeader); v != "" {
+		if windowSize, err = tunnel.ParseWindow(v); err != nil {
+			http.Error(w, "invalid "+tunnel.WindowHeader+" header: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
 	// Get domain from header
 	domain := r.Header.Get("X-Lobber-Domain")
 	if domain == "" {
 		http.Error(w, "missing X-Lobber-Domain header", http.StatusBadRequest)
 		return
 	}
+	domain, err = dnsname.Normalize(domain)
+	if err != nil {
+		http.Error(w, "invalid X-Lobber-Domain header: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	burst, err := s.config.BurstLimit.withOverride(r.Header.Get(BurstHeader))
+	if err != nil {
+		http.Error(w, "invalid "+BurstHeader+" header: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	labels, err := tunnel.ParseLabels(r.Header.Get(tunnel.LabelsHeader))
+	if err != nil {
+		http.Error(w, "invalid "+tunnel.LabelsHeader+" header: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	name := r.Header.Get(tunnel.NameHeader)
+	if name != "" {
+		if err := tunnel.ValidateName(name); err != nil {
+			http.Error(w, "invalid "+tunnel.NameHeader+" header: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	var githubPR *github.PR
+	if v := r.Header.Get(tunnel.GitHubPRHeader); v != "" {
+		pr, err := github.ParsePR(v)
+		if err != nil {
+			http.Error(w, "invalid "+tunnel.GitHubPRHeader+" header: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		githubPR = &pr
+	}
+	var shareLimits tunnel.ShareLimits
+	if v := r.Header.Get(tunnel.ShareHeader); v != "" {
+		if shareLimits, err = tunnel.ParseShareLimits(v); err != nil {
+			http.Error(w, "invalid "+tunnel.ShareHeader+" header: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	noIndex := shareLimits != (tunnel.ShareLimits{})
+	if v := r.Header.Get(tunnel.NoIndexHeader); v != "" {
+		asked, err := strconv.ParseBool(v)
+		if err != nil {
+			http.Error(w, "invalid "+tunnel.NoIndexHeader+" header: want true or false", http.StatusBadRequest)
+			return
+		}
+		noIndex = noIndex || asked
+	}
+	udp, passthrough := false, false
+	switch p := r.Header.Get(tunnel.ProtocolHeader); p {
+	case "", "http":
+	case tunnel.ProtocolUDP:
+		if s.config.UDPPorts.empty() {
+			http.Error(w, "UDP tunnels are not enabled on this relay", http.StatusBadRequest)
+			return
+		}
+		udp = true
+	case tunnel.ProtocolTLS:
+		if !s.config.TLSPassthrough {
+			http.Error(w, "TLS passthrough is not enabled on this relay", http.StatusBadRequest)
+			return
+		}
+		if !slices.Contains(s.offer(r), tunnel.FeatureStream) {
+			http.Error(w, "TLS passthrough needs the "+tunnel.FeatureStream+" feature", http.StatusBadRequest)
+			return
+		}
+		passthrough = true
+	default:
+		http.Error(w, "unsupported "+tunnel.ProtocolHeader+" "+p, http.StatusBadRequest)
+		return
+	}
+
+	// Clients behind proxies that cut hijacked connections carry the
+	// tunnel over a WebSocket instead, and some over QUIC
+	transport, wsKey, err := connectTransport(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ws := transport == tunnel.TransportWebSocket
 
 	// Validate auth token
 	authHeader := r.Header.Get("Authorization")
@@ -201,34 +715,183 @@ func (s *Server) handleConnect(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if s.authLockedOut(w, r, ip, "") {
+		return
+	}
+
 	userID := "anonymous"
 	if s.tokenValidator != nil {
 		var valid bool
 		userID, valid = s.tokenValidator(token)
 		if !valid {
+			// Anyone can name any hostname, so its lockout only turns away
+			// guesses, never the owner's own token
+			if s.authLockedOut(w, r, "", domain) {
+				return
+			}
+			s.authFailed(r.Context(), ip, domain, "tunnel connect")
 			http.Error(w, "invalid token", http.StatusUnauthorized)
 			return
 		}
 	}
+	s.authSucceeded(r.Context(), ip, domain)
+
+	// A verified hostname takes tunnels only from its owner and the
+	// members they granted it to
+	if userID != "anonymous" {
+		allowed, err := s.stores.Domains.MayBindDomain(r.Context(), userID, domain)
+		if err != nil {
+			log.Printf("connect: check %s for %s: %v", domain, userID, err)
+			w.Header().Set("Retry-After", capacityRetryAfter)
+			http.Error(w, "could not check domain permissions, try again later", http.StatusServiceUnavailable)
+			return
+		}
+		if !allowed {
+			http.Error(w, domain+" belongs to another account; ask its owner to grant you access", http.StatusForbidden)
+			return
+		}
+	}
+
+	// A client whose connection dropped comes back to its hostname, which
+	// others can't take in the meantime; they retry once it's let go
+	session, resumed, wait, err := s.resumeSession(domain, userID, r.Header.Get(tunnel.SessionHeader))
+	if err != nil {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	if (udp || passthrough) && shareLimits != (tunnel.ShareLimits{}) {
+		http.Error(w, "share links are HTTP only", http.StatusBadRequest)
+		return
+	}
+
+	// Reserved before a share opens, so a refused tunnel leaves no share
+	// behind with its TTL running
+	if !s.reserveConn(ip) {
+		log.Printf("connect: refused tunnel for %s from %s: %d tunnels already open", domain, ip, s.config.MaxTunnelsPerIP)
+		http.Error(w, "too many tunnels from this address", http.StatusTooManyRequests)
+		return
+	}
+
+	// A share link's hostname is its own for good, even once retired
+	newShare, err := s.shares.open(domain, userID, shareLimits, time.Now())
+	switch {
+	case errors.Is(err, errShareRetired):
+		s.releaseConn(ip)
+		http.Error(w, err.Error(), http.StatusGone)
+		return
+	case err != nil:
+		s.releaseConn(ip)
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case newShare:
+		log.Printf("share %s: opened (%s)", domain, shareLimits)
+		if shareLimits.TTL > 0 {
+			s.shares.expireAfter(domain, func() { s.retireShare(domain, shareLimits.TTL.String()) })
+		}
+	}
+
+	// A UDP tunnel gets its public port up front so the client learns it
+	// in the answer. A reconnecting client asks for the port it had.
+	var udpConn *net.UDPConn
+	if udp {
+		want, _ := strconv.Atoi(r.Header.Get(tunnel.UDPPortHeader))
+		udpConn, err = s.listenUDP(domain, userID, want)
+		if err != nil {
+			s.releaseConn(ip)
+			log.Printf("connect: refused UDP tunnel for %s from %s: %v", domain, ip, err)
+			w.Header().Set("Retry-After", capacityRetryAfter)
+			http.Error(w, "no UDP ports free on this relay, try again later", http.StatusServiceUnavailable)
+			return
+		}
+	}
+	release := func() {
+		s.releaseConn(ip)
+		if udpConn != nil {
+			udpConn.Close()
+		}
+	}
+
+	// Hijacking forgets the connection's TLS fingerprint
+	meta := s.connMeta(r)
+	if transport != tunnel.TransportTCP {
+		meta.Transport = transport
+	}
+
+	// Clients that ask learn what they were granted in a Welcome frame,
+	// rather than assume the hostname they asked for is where visitors go
+	features := s.offer(r)
+	var welcome *tunnel.Welcome
+	if slices.Contains(features, tunnel.FeatureWelcome) {
+		port := 0
+		if udpConn != nil {
+			port = udpConn.LocalAddr().(*net.UDPAddr).Port
+		}
+		welcome = s.welcome(r, domain, userID, features, burst, shareLimits, port)
+		if passthrough {
+			welcome.URLs = []string{passthroughURL(domain)}
+		}
+	}
 
 	// Hijack the connection
 	hijacker, ok := w.(http.Hijacker)
 	if !ok {
+		release()
 		http.Error(w, "hijacking not supported", http.StatusInternalServerError)
 		return
 	}
 
 	conn, bufrw, err := hijacker.Hijack()
 	if err != nil {
+		release()
 		http.Error(w, "hijack failed: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// Send HTTP 200 OK response to indicate successful connection
-	bufrw.WriteString("HTTP/1.1 200 OK\r\n")
-	bufrw.WriteString("Content-Type: application/octet-stream\r\n")
+	// Bound the handshake: a client that connects and never sends its ready
+	// frame would otherwise hold the socket and the hostname forever.
+	// waitForReady lifts the deadline once the frame arrives.
+	if s.config.HandshakeTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(s.config.HandshakeTimeout))
+	}
+
+	// Send HTTP 200 OK response to indicate successful connection, or
+	// complete the WebSocket upgrade
+	if ws {
+		bufrw.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+		bufrw.WriteString("Upgrade: websocket\r\nConnection: Upgrade\r\n")
+		bufrw.WriteString("Sec-WebSocket-Accept: " + tunnel.WebSocketAccept(wsKey) + "\r\n")
+	} else {
+		bufrw.WriteString("HTTP/1.1 200 OK\r\n")
+		bufrw.WriteString("Content-Type: application/octet-stream\r\n")
+	}
+	bufrw.WriteString(tunnel.FeaturesHeader + ": " + strings.Join(features, ",") + "\r\n")
+	bufrw.WriteString(tunnel.VersionHeader + ": " + strconv.Itoa(tunnel.ProtocolVersion) + "\r\n")
+	bufrw.WriteString(tunnel.MaxFrameHeader + ": " + strconv.Itoa(s.config.maxFrameSize()) + "\r\n")
+	bufrw.WriteString(tunnel.SessionHeader + ": " + session + "\r\n")
+	if udpConn != nil {
+		bufrw.WriteString(tunnel.UDPPortHeader + ": " + strconv.Itoa(udpConn.LocalAddr().(*net.UDPAddr).Port) + "\r\n")
+	}
 	bufrw.WriteString("\r\n")
-	bufrw.Flush()
+	if ws {
+		// From here on frames travel as the payload of binary messages
+		if err := bufrw.Flush(); err != nil {
+			conn.Close()
+			release()
+			return
+		}
+		conn = tunnel.NewWebSocketConn(conn, bufrw.Reader, false)
+		bufrw = bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	}
+	if welcome != nil {
+		tunnel.EncodeWelcome(bufrw, welcome)
+	}
+	if err := bufrw.Flush(); err != nil {
+		conn.Close()
+		release()
+		return
+	}
 
 	// Create context for tunnel lifecycle
 	ctx, cancel := context.WithCancel(context.Background())
@@ -237,9 +900,18 @@ func (s *Server) handleConnect(w http.ResponseWriter, r *http.Request) {
 	t := &Tunnel{
 		Domain:       domain,
 		UserID:       userID,
+		Name:         name,
+		Labels:       labels,
+		GitHubPR:     githubPR,
+		PublicURL:    publicURL(r, domain),
+		Meta:         meta,
+		ConnectedAt:  time.Now(),
 		conn:         conn,
 		bufrw:        bufrw,
 		state:        TunnelStateConnected,
+		features:     features,
+		protocol:     protocol,
+		framing:      tunnel.Framing{Compress: tunnel.Compression(features), Binary: protocol >= tunnel.BinaryVersion, MaxSize: clientMaxFrame},
 		reqCh:        make(chan *pendingRequest, 100),
 		respCh:       make(chan *tunnel.Response, 100),
 		done:         make(chan struct{}),
@@ -247,162 +919,582 @@ func (s *Server) handleConnect(w http.ResponseWriter, r *http.Request) {
 		config:       s.config,
 		ctx:          ctx,
 		cancel:       cancel,
+		burst:        newBurstLimiter(burst),
+		noIndex:      noIndex,
+		session:      session,
+	}
+	t.errors.SetSize(s.config.TunnelErrors)
+	if windowSize > 0 {
+		t.windowSize, t.window = windowSize, tunnel.NewCredit(windowSize)
+	}
+	if udpConn != nil {
+		t.udp = newUDPListener(udpConn)
+		s.claimUDPPort(t)
+	}
+	if passthrough {
+		t.passthrough, t.PublicURL = true, passthroughURL(domain)
 	}
 
 	// Set cleanup callback to unregister from server
 	t.onClose = func() {
-		s.UnregisterTunnel(domain)
+		s.unregisterTunnel(t)
+		s.releaseConn(ip)
+		if t.udp != nil {
+			s.releaseUDPPort(t)
+		}
+		t.spawn(func() { s.endSession(t, "closed") })
 	}
 
 	// Register tunnel (even before ready, so requests can queue)
 	s.RegisterTunnel(t)
 
 	// Handle the tunnel lifecycle in a goroutine
-	go func() {
+	t.spawn(func() {
 		// First wait for ready frame
 		if err := t.waitForReady(); err != nil {
+			log.Printf("tunnel %s: handshake from %s failed: %v", domain, ip, err)
 			t.Close()
 			return
 		}
-
-		// Once ready, start I/O goroutines
-		go t.writeLoop()
+		if resumed {
+			log.Printf("tunnel %s: resumed from %s (%s)", domain, ip, meta.describe())
+		} else {
+			log.Printf("tunnel %s: connected from %s (%s)", domain, ip, meta.describe())
+		}
+		s.startSession(t)
+		if t.GitHubPR != nil && t.UserID != "anonymous" {
+			t.spawn(func() { s.commentPreview(t) })
+		}
+		s.checkSchedule(t, time.Now())
+		if t.udp != nil {
+			log.Printf("tunnel %s: forwarding UDP port %d", domain, t.udp.port)
+			t.spawn(func() { s.serveUDP(t) })
+		}
 		t.readLoop() // Block on read loop
-	}()
+	})
 }
 
 func (s *Server) handleProxy(w http.ResponseWriter, r *http.Request) {
-	hostname := r.Host
+	hostname := dnsname.Lookup(stripPort(r.Host))
 
 	s.mu.RLock()
-	tun, ok := s.tunnels[hostname]
+	tun := s.tunnels[hostname]
 	s.mu.RUnlock()
 
-	if !ok {
-		http.Error(w, "tunnel not found", http.StatusBadGateway)
+	// A dropped tunnel's client may be about to resume it
+	if tun == nil && !s.heldUntil(hostname).IsZero() {
+		tun = s.awaitReplacement(r.Context(), hostname, nil)
+	}
+	if tun == nil {
+		s.writeNoTunnel(w, hostname)
+		return
+	}
+	if tun.udp != nil {
+		http.Error(w, fmt.Sprintf("%s is a UDP tunnel on port %d", hostname, tun.udp.port), http.StatusBadGateway)
+		return
+	}
+	if tun.passthrough {
+		// Only the local server holds the hostname's certificate, so
+		// visitors have to come in over TLS
+		http.Redirect(w, r, passthroughURL(hostname)+strings.TrimPrefix(r.URL.RequestURI(), "/"), http.StatusPermanentRedirect)
+		return
+	}
+	// Keep the domain's visitors on HTTPS if it asks to
+	https := s.httpsPolicies.get(hostname)
+	if https != nil {
+		if https.Enforce(w, r, hostname) {
+			return
+		}
+		https.Apply(w.Header(), r)
+	}
+	if serveNoIndex(w, r, tun) {
+		return
+	}
+	if !s.intercept(w, r, tun) {
+		return
+	}
+
+	// Refuse traffic for owners past their hard cap
+	if s.quota != nil && tun.UserID != "anonymous" && s.quota.level(tun.UserID) == billing.QuotaCapped {
+		writeQuotaPage(w, hostname, s.config.BaseDomain)
+		return
+	}
+	if sched := s.closed(tun, time.Now()); sched != nil {
+		writeSchedulePage(w, hostname, sched, time.Now())
 		return
 	}
 
-	// Check tunnel state
-	tun.stateMu.RLock()
-	state := tun.state
-	tun.stateMu.RUnlock()
+	// Share links count requests and retire after the last one is served
+	admitted, last := s.shares.admit(hostname)
+	if !admitted {
+		writeSharePage(w, hostname)
+		return
+	}
+	if last {
+		defer s.retireShare(hostname, shareRequests(s.shares.limit(hostname)))
+	}
 
-	if state == TunnelStateClosed {
-		http.Error(w, "tunnel closed", http.StatusBadGateway)
+	meta := s.connMeta(r)
+	start := time.Now()
+
+	// Shed a sudden flood of visitors rather than pass it to the laptop
+	if ok, wait := tun.burst.allow(start); !ok {
+		writeBurstPage(w, hostname, wait)
+		s.logRequest(hostname, store.RequestLog{
+			Method:         r.Method,
+			Path:           r.URL.Path,
+			StatusCode:     http.StatusTooManyRequests,
+			CreatedAt:      start,
+			RemoteIP:       meta.RemoteIP,
+			TLSVersion:     meta.TLSVersion,
+			ALPN:           meta.ALPN,
+			TLSFingerprint: meta.TLSFingerprint,
+			Labels:         tun.Labels,
+			TunnelName:     tun.Name,
+		})
 		return
 	}
 
-	// Read request body
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		http.Error(w, "read body: "+err.Error(), http.StatusBadGateway)
+	// A visitor waiting for 100 Continue is only told to send its body
+	// once the local server asks for it, by clients that can pass the
+	// question on. Those clients get large bodies the same way, in chunks
+	// as the local server reads them, so an upload doesn't hold up the
+	// tunnel. Other bodies are read first, so one too large for the
+	// client is refused before the visitor is told to send it.
+	takesHeld := upgradeProtocol(r) == "" && tun.uses(tunnel.FeatureContinue)
+	continued := expectsContinue(r) && takesHeld
+	streamed := continued || (takesHeld && streamsBody(r))
+	declared := max(r.ContentLength, 0)
+	if streamed {
+		declared = 0
+	} else if declared > int64(tun.sendLimit()) {
+		http.Error(w, errRequestTooLarge.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	// Hold the body back while the client has no room for the request
+	if err := tun.awaitRoom(r.Context(), declared); err != nil {
+		status := statusClientClosed
+		if !errors.Is(err, errVisitorGone) {
+			status = http.StatusServiceUnavailable
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, err.Error(), status)
+			tun.addError(r.Method, r.URL.Path, status, err.Error())
+		}
+		s.logRequest(hostname, store.RequestLog{
+			Method:     r.Method,
+			Path:       r.URL.Path,
+			StatusCode: status,
+			Duration:   time.Since(start),
+			CreatedAt:  start,
+			RemoteIP:   meta.RemoteIP,
+			Labels:     tun.Labels,
+			TunnelName: tun.Name,
+		})
 		return
 	}
 
+	// Read request body, refusing one the client couldn't read in a frame
+	// rather than buffering it
+	var body []byte
+	if !streamed {
+		var err error
+		body, err = io.ReadAll(http.MaxBytesReader(w, r.Body, int64(tun.sendLimit())))
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, errRequestTooLarge.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			http.Error(w, "read body: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+	}
+
 	// Generate request ID if not provided
 	reqID := r.Header.Get("X-Request-ID")
 	if reqID == "" {
 		reqID = generateRequestID()
 	}
 
-	// Create tunnel request
+	// Create tunnel request. With the body already read, the local server
+	// has nothing to agree to.
+	headers := sanitizeHeaders(r.Header, len(body))
+	if !continued {
+		headers.Del("Expect")
+	}
 	tunnelReq := &tunnel.Request{
-		ID:      reqID,
-		Method:  r.Method,
-		Path:    r.URL.RequestURI(),
-		Headers: r.Header,
-		Body:    body,
+		ID:       reqID,
+		Method:   r.Method,
+		Path:     r.URL.RequestURI(),
+		Headers:  headers,
+		Body:     body,
+		Continue: streamed,
+	}
+	if tun.uses(tunnel.FeatureCaller) {
+		tunnelReq.Caller = caller(r, meta)
+	}
+	trace := s.traces.begin(reqID, hostname, r.Method, r.URL.Path, start)
+
+	// A WebSocket handshake holds the visitor's connection open as a
+	// stream, for clients that can carry one. Others get the request
+	// without its upgrade, as before.
+	if proto := upgradeProtocol(r); proto != "" && tun.uses(tunnel.FeatureStream) {
+		tunnelReq.Upgrade = proto
+		s.proxyUpgrade(r.Context(), w, tun, tunnelReq, start, store.RequestLog{
+			Method:         r.Method,
+			Path:           r.URL.Path,
+			CreatedAt:      start,
+			RemoteIP:       meta.RemoteIP,
+			TLSVersion:     meta.TLSVersion,
+			ALPN:           meta.ALPN,
+			TLSFingerprint: meta.TLSFingerprint,
+			Labels:         tun.Labels,
+			TunnelName:     tun.Name,
+		})
+		trace.finish(time.Now(), 0, len(body), 0, nil)
+		return
 	}
 
-	// Create pending request with response channel
+	var held *heldBody
+	if streamed {
+		held = tun.sendBody(r.Context(), reqID, r.Body)
+	}
+	resp, err := s.roundTrip(r.Context(), tun, tunnelReq, start)
+	// A held body the client asked for has gone with it
+	unread := held == nil || !held.asked.Load()
+	if tunnelLost(err) && unread && (errors.Is(err, errNotSent) || s.retryable(r.Method, len(body))) {
+		// The body is still in hand, so a replacement tunnel can take the
+		// request as if the first had never seen it
+		if next := s.awaitReplacement(r.Context(), hostname, tun); next != nil {
+			log.Printf("tunnel %s: retrying %s %s on replacement connection", hostname, r.Method, r.URL.Path)
+			tun = next
+			if held != nil {
+				held.stop(w)
+				held = tun.sendBody(r.Context(), reqID, r.Body)
+			}
+			resp, err = s.roundTrip(r.Context(), tun, tunnelReq, start)
+		}
+	}
+	answered := time.Now()
+	reqSize := len(body)
+	if held != nil {
+		reqSize = int(held.stop(w))
+	}
+
+	status, respSize := http.StatusBadGateway, 0
+	var latency store.Latency
+	var reported tunnel.Metadata // what the client told the relay about the response
+	switch {
+	case err == nil:
+		// Whatever the client sent, HEAD, 204 and 304 responses have no
+		// body, and a HEAD's Content-Length stays the local server's
+		bodiless := !bodyAllowed(r.Method, resp.StatusCode)
+		if bodiless {
+			resp.Body, resp.Trailers = nil, nil
+		}
+		status, respSize = resp.StatusCode, len(resp.Body)
+		// Write response headers
+		headers, trailers := sanitizeHeaders(resp.Headers, len(resp.Body)), sanitizeTrailers(resp.Trailers)
+		if resp.StatusCode == http.StatusNoContent || resp.StatusCode < 200 {
+			headers.Del("Content-Length")
+		}
+		if trailers != nil {
+			// HTTP/1.1 only has trailers in the chunked encoding, which a
+			// declared length rules out
+			headers.Del("Content-Length")
+			headers["Trailer"] = slices.Sorted(maps.Keys(trailers))
+		}
+		for k, vals := range headers {
+			for _, v := range vals {
+				w.Header().Add(k, v)
+			}
+		}
+		if set := s.respHeaders.get(hostname); set != nil {
+			set.Apply(w.Header())
+		}
+		if https != nil {
+			// Over whatever the local server or the domain's headers said
+			https.Apply(w.Header(), r)
+		}
+		if tun.noIndex {
+			// Whatever the local server or the domain's headers said
+			w.Header().Set("X-Robots-Tag", noIndexTag)
+		}
+		w.WriteHeader(resp.StatusCode)
+		w.Write(resp.Body)
+		switch {
+		case resp.Chunked && bodiless:
+			tun.endChunked(resp.ID)
+		case resp.Chunked:
+			respSize = int(tun.copyChunked(r.Context(), w, resp.ID))
+		}
+		// Announced above, so they're sent whatever the response headers had
+		for k, vals := range trailers {
+			w.Header()[k] = vals
+		}
+		tun.bytesIn.Add(int64(reqSize))
+		tun.bytesOut.Add(int64(respSize))
+		latency = requestLatency(start, answered, tunnelReq, resp)
+		if resp.Meta != nil {
+			reported = *resp.Meta
+		}
+		// A held body went straight to the client, so there's none to replay
+		if held == nil {
+			s.replayRequest(hostname, tunnelReq, r.URL.Path, status)
+		}
+	case errors.Is(err, errQueueFull), errors.Is(err, errSaturated):
+		status = http.StatusServiceUnavailable
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, err.Error(), status)
+	case errors.Is(err, errTunnelTimeout):
+		status = http.StatusGatewayTimeout
+		http.Error(w, err.Error(), status)
+	case errors.Is(err, errRequestTooLarge):
+		status = http.StatusRequestEntityTooLarge
+		http.Error(w, err.Error(), status)
+	case errors.Is(err, errVisitorGone):
+		status = statusClientClosed
+	default:
+		http.Error(w, err.Error(), status)
+	}
+	trace.finish(time.Now(), status, reqSize, respSize, err)
+	switch {
+	case err != nil && !errors.Is(err, errVisitorGone):
+		tun.addError(r.Method, r.URL.Path, status, err.Error())
+	case reported.LocalError != "":
+		tun.addError(r.Method, r.URL.Path, status, "local server: "+reported.LocalError)
+	}
+
+	s.logRequest(hostname, store.RequestLog{
+		Method:         r.Method,
+		Path:           r.URL.Path,
+		StatusCode:     status,
+		Duration:       time.Since(start),
+		RequestSize:    int64(reqSize),
+		ResponseSize:   int64(respSize),
+		CreatedAt:      start,
+		RemoteIP:       meta.RemoteIP,
+		TLSVersion:     meta.TLSVersion,
+		ALPN:           meta.ALPN,
+		TLSFingerprint: meta.TLSFingerprint,
+		Labels:         tun.Labels,
+		TunnelName:     tun.Name,
+		Latency:        latency,
+		LocalStatus:    reported.LocalStatus,
+		ClientVersion:  reported.ClientVersion,
+	})
+}
+
+// requestLatency breaks down the time from a visitor's request reaching
+// the relay at received to its response being written, given that the
+// client's response arrived at answered. Only the client can tell the
+// network from the local server, so for clients that send no metadata,
+// Tunnel and Local are left zero.
+func requestLatency(received, answered time.Time, req *tunnel.Request, resp *tunnel.Response) store.Latency {
+	l := store.Latency{
+		Relay: req.RelayTime,
+		Write: time.Since(answered),
+	}
+	if resp.Meta != nil {
+		l.Local = resp.Meta.Local
+		l.Tunnel = max(0, answered.Sub(received)-req.RelayTime-resp.Meta.Local)
+	}
+	return l
+}
+
+// roundTrip sends req through tun and waits for the client's response.
+// received is when the visitor's request reached the relay. If ctx ends
+// first, the client is told to stop forwarding the request.
+func (s *Server) roundTrip(ctx context.Context, tun *Tunnel, req *tunnel.Request, received time.Time) (*tunnel.Response, error) {
 	pr := &pendingRequest{
-		req:      tunnelReq,
-		respCh:   make(chan *tunnel.Response, 1),
-		queuedAt: time.Now(),
+		req:        req,
+		respCh:     make(chan *tunnel.Response, 1),
+		queuedAt:   time.Now(),
+		receivedAt: received,
+		trace:      s.traces.find(req.ID, received),
+	}
+	pr.trace.queued(pr.queuedAt)
+	if err := tun.reserve(ctx, pr); err != nil {
+		return nil, err
 	}
 
-	// If tunnel not ready, queue the request
-	if state == TunnelStateConnected {
+	switch tun.GetState() {
+	case TunnelStateClosed:
+		tun.refund(pr)
+		return nil, errNotSent
+	case TunnelStateConnected:
+		// Not ready yet, queue the request
 		tun.queueMu.Lock()
-		if len(tun.pendingQueue) >= tun.config.MaxPendingQueue {
+		if len(tun.pendingQueue) >= s.config.MaxPendingQueue {
 			tun.queueMu.Unlock()
-			w.Header().Set("Retry-After", "1")
-			http.Error(w, "tunnel not ready, queue full", http.StatusServiceUnavailable)
-			return
+			tun.refund(pr)
+			return nil, errQueueFull
 		}
 		tun.pendingQueue = append(tun.pendingQueue, pr)
 		tun.queueMu.Unlock()
-	} else {
-		// Tunnel is ready, send directly
+	default:
 		select {
 		case tun.reqCh <- pr:
 		case <-tun.done:
-			http.Error(w, "tunnel closed", http.StatusBadGateway)
-			return
+			return nil, errNotSent
 		}
 	}
 
 	// Wait for response with TTL
 	select {
 	case resp := <-pr.respCh:
+		if resp == nil && pr.err != nil {
+			return nil, pr.err
+		}
 		if resp == nil {
-			http.Error(w, "tunnel error", http.StatusBadGateway)
-			return
+			return nil, errTunnelFailed
 		}
-		// Write response headers
-		for k, vals := range resp.Headers {
-			for _, v := range vals {
-				w.Header().Add(k, v)
+		return resp, nil
+	case <-time.After(s.config.PendingQueueTTL + 5*time.Second):
+		tun.abandon(pr)
+		tun.discard(pr)
+		return nil, errTunnelTimeout
+	case <-ctx.Done():
+		tun.abandon(pr)
+		tun.discard(pr)
+		return nil, errVisitorGone
+	case <-tun.done:
+		// Close may have handed the request back unsent
+		select {
+		case resp := <-pr.respCh:
+			if resp == nil && pr.err != nil {
+				return nil, pr.err
 			}
+		default:
 		}
-		w.WriteHeader(resp.StatusCode)
-		w.Write(resp.Body)
-	case <-time.After(tun.config.PendingQueueTTL + 5*time.Second):
-		http.Error(w, "tunnel response timeout", http.StatusGatewayTimeout)
-	case <-tun.done:
-		http.Error(w, "tunnel closed", http.StatusBadGateway)
+		return nil, errTunnelClosed
 	}
 }
 
-func (s *Server) RegisterTunnel(t *Tunnel) {
+// RegisterTunnel routes t's hostname to it, replacing any earlier tunnel,
+// and returns the generation that unregistering it takes. A tunnel that
+// has already closed is not registered and gets generation 0.
+func (s *Server) RegisterTunnel(t *Tunnel) uint64 {
+	t.Domain = dnsname.Lookup(t.Domain)
 	s.mu.Lock()
 	defer s.mu.Unlock()
+
+	// Close marks the tunnel closed before unregistering it, so a
+	// registration racing with Close is either refused here or undone there
+	if t.GetState() == TunnelStateClosed {
+		return 0
+	}
+	s.generation++
+	t.generation = s.generation
 	s.tunnels[t.Domain] = t
+	delete(s.held, t.Domain)
+	return t.generation
+}
+
+// UnregisterTunnel removes the tunnel for domain if it is still the
+// registration with the given generation. It reports whether it did; false
+// means a newer connection has taken over the hostname.
+func (s *Server) UnregisterTunnel(domain string, generation uint64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.removeTunnel(dnsname.Lookup(domain), generation)
 }
 
-func (s *Server) UnregisterTunnel(domain string) {
+// unregisterTunnel removes t unless a newer connection has since taken over
+// its hostname, which closing the old one must not disturb
+func (s *Server) unregisterTunnel(t *Tunnel) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	delete(s.tunnels, domain)
+	if s.removeTunnel(t.Domain, t.generation) {
+		s.holdSession(t)
+	}
+}
+
+// removeTunnel deletes hostname's tunnel if it has the given generation.
+// Callers hold s.mu.
+func (s *Server) removeTunnel(hostname string, generation uint64) bool {
+	t, ok := s.tunnels[hostname]
+	if !ok || generation == 0 || t.generation != generation {
+		return false
+	}
+	delete(s.tunnels, hostname)
+	return true
 }
 
 // HasTunnel checks if a tunnel is registered for the given domain
 func (s *Server) HasTunnel(domain string) bool {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	_, ok := s.tunnels[domain]
+	_, ok := s.tunnels[dnsname.Lookup(domain)]
 	return ok
 }
 
+// UserTunnels returns a user's connected tunnels with their labels, sorted
+// by hostname
+func (s *Server) UserTunnels(userID string) []dashboard.Tunnel {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var tunnels []dashboard.Tunnel
+	for host, t := range s.tunnels {
+		if t.UserID == userID {
+			dt := dashboard.Tunnel{Hostname: host, Name: t.Name, Labels: t.Labels, Errors: t.Errors()}
+			if t.udp != nil {
+				dt.UDPPort = t.udp.port
+			}
+			tunnels = append(tunnels, dt)
+		}
+	}
+	slices.SortFunc(tunnels, func(a, b dashboard.Tunnel) int { return strings.Compare(a.Hostname, b.Hostname) })
+	return tunnels
+}
+
 // SetTokenValidator sets the function used to validate auth tokens
 func (s *Server) SetTokenValidator(v TokenValidator) {
 	s.tokenValidator = v
 }
 
+// StoreTokenValidator accepts API tokens created in the dashboard
+func StoreTokenValidator(tokens store.TokenStore) TokenValidator {
+	return func(token string) (string, bool) {
+		u, err := tokens.TokenUser(context.Background(), auth.HashToken(token))
+		if err != nil {
+			if !errors.Is(err, store.ErrNotFound) {
+				log.Printf("validate token: %v", err)
+			}
+			return "", false
+		}
+		return u.ID, true
+	}
+}
+
 // Tunnel methods
 
 // waitForReady waits for the client to send a ready frame
 func (t *Tunnel) waitForReady() error {
-	if err := tunnel.DecodeReady(t.bufrw); err != nil {
+	ready, err := tunnel.DecodeReady(t.bufrw)
+	if err != nil {
 		return err
 	}
+	if t.conn != nil {
+		t.conn.SetDeadline(time.Time{})
+	}
 
 	// Transition to Ready state
 	t.stateMu.Lock()
 	t.state = TunnelStateReady
+	if slices.Contains(t.features, tunnel.FeatureEcho) {
+		t.features = ready.Features
+	}
+	features := t.features
 	t.stateMu.Unlock()
 
+	for _, f := range features {
+		if slices.Contains(t.config.Deprecated, f) {
+			log.Printf("tunnel %s: client uses deprecated feature %s", t.Domain, f)
+		}
+	}
+
 	// Flush pending queue
 	t.flushPendingQueue()
 
@@ -418,6 +1510,7 @@ func (t *Tunnel) flushPendingQueue() {
 	for _, pr := range t.pendingQueue {
 		// Check TTL - discard expired requests
 		if now.Sub(pr.queuedAt) > t.config.PendingQueueTTL {
+			t.refund(pr)
 			pr.respCh <- &tunnel.Response{
 				ID:         pr.req.ID,
 				StatusCode: 503,
@@ -432,6 +1525,7 @@ func (t *Tunnel) flushPendingQueue() {
 		case t.reqCh <- pr:
 		default:
 			// Channel full, fail the request
+			t.refund(pr)
 			pr.respCh <- &tunnel.Response{
 				ID:         pr.req.ID,
 				StatusCode: 503,
@@ -448,18 +1542,29 @@ func (t *Tunnel) flushPendingQueue() {
 func (t *Tunnel) readLoop() {
 	defer t.Close()
 
-	// Map to track pending requests by ID
-	pending := make(map[string]*pendingRequest)
-	var pendingMu sync.Mutex
+	t.sentMu.Lock()
+	t.sent = make(map[string]*pendingRequest)
+	t.sentMu.Unlock()
 
 	// Goroutine to track outgoing requests
-	go func() {
+	t.spawn(func() {
 		for {
 			select {
 			case pr := <-t.reqCh:
-				pendingMu.Lock()
-				pending[pr.req.ID] = pr
-				pendingMu.Unlock()
+				if !pr.receivedAt.IsZero() {
+					pr.req.RelayTime = time.Since(pr.receivedAt)
+				}
+				// Registered and written under writeMu, so a Cancel for the
+				// request can't overtake it on the wire
+				t.writeMu.Lock()
+				t.sentMu.Lock()
+				if pr.abandoned {
+					t.sentMu.Unlock()
+					t.writeMu.Unlock()
+					continue
+				}
+				t.sent[pr.req.ID] = pr
+				t.sentMu.Unlock()
 
 				// Send to write loop
 				select {
@@ -468,21 +1573,36 @@ func (t *Tunnel) readLoop() {
 				}
 
 				// Actually write the request
-				if err := tunnel.EncodeRequest(t.bufrw, pr.req); err != nil {
-					pendingMu.Lock()
-					delete(pending, pr.req.ID)
-					pendingMu.Unlock()
+				pr.trace.writing(time.Now())
+				err := tunnel.EncodeRequest(t.frames(), pr.req)
+				if err == nil {
+					t.bufrw.Flush()
+					pr.trace.written(time.Now())
+				}
+				t.writeMu.Unlock()
+				if err != nil {
+					t.sentMu.Lock()
+					delete(t.sent, pr.req.ID)
+					t.sentMu.Unlock()
+					// Nothing was written of a frame too large for the
+					// client, so only this request fails
+					if errors.Is(err, tunnel.ErrFrameTooLarge) {
+						t.refund(pr)
+						pr.err = errRequestTooLarge
+						pr.respCh <- nil
+						close(pr.respCh)
+						continue
+					}
 					pr.respCh <- nil
 					close(pr.respCh)
 					return
 				}
-				t.bufrw.Flush()
 
 			case <-t.done:
 				return
 			}
 		}
-	}()
+	})
 
 	// Read responses from client
 	for {
@@ -492,30 +1612,176 @@ func (t *Tunnel) readLoop() {
 		default:
 		}
 
-		resp, err := tunnel.DecodeResponse(t.bufrw)
+		frame, err := tunnel.ReadFrameLimit(t.bufrw, t.config.maxFrameSize())
+		if errors.Is(err, tunnel.ErrFrameTooLarge) {
+			t.fail(err)
+			return
+		}
 		if err != nil {
+			// Unless the relay is closing it, the connection died under
+			// the client, which may come back to resume it
+			if t.GetState() != TunnelStateClosed {
+				t.dropped.Store(true)
+			}
+			return
+		}
+		if frame.Type == tunnel.TypePing {
+			if err := t.pong(frame); err != nil {
+				return
+			}
+			continue
+		}
+		if frame.Type == tunnel.TypeDatagram && t.udp != nil {
+			var d tunnel.Datagram
+			if err := frame.Decode(&d); err != nil {
+				t.fail(err)
+				return
+			}
+			if n, err := t.udp.reply(&d); err == nil {
+				t.bytesOut.Add(int64(n))
+			}
+			continue
+		}
+		if frame.Type == tunnel.TypeStream {
+			var st tunnel.Stream
+			if err := frame.Decode(&st); err != nil {
+				t.fail(err)
+				return
+			}
+			t.deliver(&st)
+			continue
+		}
+		if frame.Type == tunnel.TypeWindow {
+			var win tunnel.Window
+			if err := frame.Decode(&win); err != nil {
+				t.fail(err)
+				return
+			}
+			t.grant(&win)
+			continue
+		}
+		if frame.Type == tunnel.TypeMetadata {
+			var m tunnel.Metadata
+			if err := frame.Decode(&m); err != nil {
+				t.fail(err)
+				return
+			}
+			t.sentMu.Lock()
+			if pr, ok := t.sent[m.ID]; ok {
+				pr.meta = &m
+			}
+			t.sentMu.Unlock()
+			continue
+		}
+		if frame.Type == tunnel.TypeError {
+			var e tunnel.Error
+			if frame.Decode(&e) == nil {
+				log.Printf("tunnel %s: client closing the tunnel: %s (%s)", t.Domain, e.Message, e.Code)
+			}
+			return
+		}
+		if frame.Type != tunnel.TypeResponse {
+			// Skip frames a newer client sends that this relay doesn't
+			// know, as clients do, rather than drop the tunnel
+			t.unknownFrame(frame.Type)
+			continue
+		}
+		resp := new(tunnel.Response)
+		if err := frame.Decode(resp); err != nil {
+			t.fail(err)
 			return
 		}
 
-		pendingMu.Lock()
-		pr, ok := pending[resp.ID]
+		// Handed over under sentMu, so abandoning the request either comes
+		// first or finds the response, see discard. The stream for a
+		// chunked body is open before its first Stream frame is read.
+		t.sentMu.Lock()
+		pr, ok := t.sent[resp.ID]
 		if ok {
-			delete(pending, resp.ID)
+			delete(t.sent, resp.ID)
+			if resp.Chunked {
+				t.openStream(resp.ID)
+			}
+			if pr.respCh != nil {
+				resp.Meta = pr.meta
+				pr.trace.responded(time.Now(), resp.StatusCode, len(resp.Body))
+				pr.respCh <- resp
+				close(pr.respCh)
+			}
 		}
-		pendingMu.Unlock()
-
-		if ok && pr.respCh != nil {
-			pr.respCh <- resp
-			close(pr.respCh)
+		t.sentMu.Unlock()
+		if !ok && resp.Chunked {
+			// Nobody is waiting for the body any more
+			if err := t.writeStream(&tunnel.Stream{ID: resp.ID, Close: true}); err != nil {
+				return
+			}
 		}
 	}
 }
 
-// writeLoop is now integrated into readLoop for simplicity
-func (t *Tunnel) writeLoop() {
-	// Requests are written in readLoop's goroutine
-	// This is kept for potential future use
-	<-t.done
+// frames returns where to encode frames to the client, in the encoding and
+// compression it reads. Callers hold writeMu.
+func (t *Tunnel) frames() io.Writer {
+	return t.framing.Writer(t.bufrw)
+}
+
+// fail tells the client why the relay is closing the tunnel: err, from
+// reading or decoding one of its frames. The caller closes it.
+func (t *Tunnel) fail(err error) {
+	log.Printf("tunnel %s: closing: %v", t.Domain, err)
+	t.errors.Add(proxyerr.Entry{Cause: "closing tunnel: " + err.Error()})
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+	if tunnel.EncodeError(t.frames(), tunnel.ErrorFor(err)) == nil {
+		t.bufrw.Flush()
+	}
+}
+
+// sendLimit is the largest frame payload the client reads
+func (t *Tunnel) sendLimit() int {
+	if t.framing.MaxSize > 0 {
+		return t.framing.MaxSize
+	}
+	return tunnel.MaxFrameSize
+}
+
+// unknownFrame notes a frame of a type the relay doesn't know, once per
+// type per tunnel
+func (t *Tunnel) unknownFrame(typ byte) {
+	t.stateMu.Lock()
+	defer t.stateMu.Unlock()
+	if t.unknownFrames == nil {
+		t.unknownFrames = make(map[byte]bool)
+	}
+	if !t.unknownFrames[typ] {
+		t.unknownFrames[typ] = true
+		log.Printf("tunnel %s: skipping %s frames from a protocol version %d client", t.Domain, tunnel.FrameName(typ), t.protocol)
+	}
+}
+
+// pong answers a client's heartbeat so it can time the round trip
+func (t *Tunnel) pong(ping *tunnel.Frame) error {
+	var hb tunnel.Heartbeat
+	if err := ping.Decode(&hb); err != nil {
+		return err
+	}
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+	if err := tunnel.EncodePong(t.frames(), &hb); err != nil {
+		return err
+	}
+	return t.bufrw.Flush()
+}
+
+// disconnect asks the client to close the tunnel, and to stay away until
+// d.Until or for good
+func (t *Tunnel) disconnect(d *tunnel.Disconnect) error {
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+	if err := tunnel.EncodeDisconnect(t.frames(), d); err != nil {
+		return err
+	}
+	return t.bufrw.Flush()
 }
 
 // Close shuts down the tunnel and cleans up pending requests
@@ -528,14 +1794,35 @@ func (t *Tunnel) Close() {
 	t.state = TunnelStateClosed
 	t.stateMu.Unlock()
 
+	// Counted until onClose has started what it needs, so Wait covers it
+	t.routines.Add(1)
+	defer t.routines.Done()
+
+	// Hand back the requests the client never got, so they can be replayed
+	// on a replacement, before anyone waiting on done gives up on them
+	for unsent := true; unsent; {
+		select {
+		case pr := <-t.reqCh:
+			pr.err = errNotSent
+			pr.respCh <- nil
+			close(pr.respCh)
+		default:
+			unsent = false
+		}
+	}
+
 	// Cancel context and signal done
 	t.cancel()
 	close(t.done)
+	t.window.Close()
 
 	// Close connection
 	if t.conn != nil {
 		t.conn.Close()
 	}
+	if t.udp != nil {
+		t.udp.conn.Close()
+	}
 
 	// Fail all pending queue requests
 	t.queueMu.Lock()
@@ -595,13 +1882,21 @@ func (t *Tunnel) GetReadyChannel() <-chan struct{} {
 func (s *Server) GetTunnel(domain string) *Tunnel {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	return s.tunnels[domain]
+	return s.tunnels[dnsname.Lookup(domain)]
 }
 
+// stripPort returns the host part of a Host header, without brackets for
+// IPv6 literals: "app.example.com:443" -> "app.example.com",
+// "[::1]:443" and "[::1]" -> "::1"
 func stripPort(hostport string) string {
-	if host, _, ok := strings.Cut(hostport, ":"); ok {
+	if host, _, err := net.SplitHostPort(hostport); err == nil {
 		return host
 	}
+	// No port. A bracketed IPv6 literal still needs its brackets removed;
+	// anything else, including a bare IPv6 address, is already a host.
+	if strings.HasPrefix(hostport, "[") && strings.HasSuffix(hostport, "]") {
+		return hostport[1 : len(hostport)-1]
+	}
 	return hostport
 }
 
@@ -610,7 +1905,7 @@ func isPrimaryHost(host, baseDomain string) bool {
 	if base != "" && host == base {
 		return true
 	}
-	if host == "" || host == "localhost" || strings.HasPrefix(host, "127.") {
+	if host == "" || host == "localhost" || host == "::1" || strings.HasPrefix(host, "127.") {
 		return true
 	}
 	return false
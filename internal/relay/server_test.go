@@ -3,15 +3,21 @@ package relay
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/lobber-dev/lobber/internal/store"
 	"github.com/lobber-dev/lobber/internal/tunnel"
 )
 
@@ -177,7 +183,7 @@ func TestDisconnectCleanup(t *testing.T) {
 		cancel:       cancel,
 	}
 	tun.onClose = func() {
-		s.UnregisterTunnel("cleanup.example.com")
+		s.unregisterTunnel(tun)
 	}
 	s.RegisterTunnel(tun)
 
@@ -364,3 +370,518 @@ func TestTunnelClosesConnection(t *testing.T) {
 		t.Error("connection should be closed after tunnel.Close()")
 	}
 }
+
+func TestHandshakeTimeout(t *testing.T) {
+	config := DefaultServerConfig()
+	config.HandshakeTimeout = 100 * time.Millisecond
+	s := NewServerWithConfig(nil, config)
+	srv := startTestServer(t, s)
+	defer srv.Close()
+
+	// Connect but never send the ready frame
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "POST /_lobber/connect HTTP/1.1\r\nHost: relay\r\nAuthorization: Bearer test\r\nX-Lobber-Domain: stalled.example.com\r\n\r\n")
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("connect: %v, %v", resp, err)
+	}
+	if !s.HasTunnel("stalled.example.com") {
+		t.Fatal("tunnel not registered while waiting for ready")
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for s.HasTunnel("stalled.example.com") {
+		if time.Now().After(deadline) {
+			t.Fatal("tunnel still registered after the handshake timeout")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.mu.RLock()
+	conns := len(s.connsByIP)
+	s.mu.RUnlock()
+	if conns != 0 {
+		t.Errorf("connsByIP has %d entries after cleanup, want 0", conns)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("relay left the stalled connection open")
+	}
+}
+
+func TestCloseKeepsReplacementTunnel(t *testing.T) {
+	s := NewServer(nil)
+	newTun := func() *Tunnel {
+		ctx, cancel := context.WithCancel(context.Background())
+		tun := &Tunnel{
+			Domain: "app.example.com",
+			state:  TunnelStateConnected,
+			done:   make(chan struct{}),
+			config: s.config,
+			ctx:    ctx,
+			cancel: cancel,
+		}
+		tun.onClose = func() { s.unregisterTunnel(tun) }
+		return tun
+	}
+
+	old := newTun()
+	s.RegisterTunnel(old)
+	replacement := newTun()
+	s.RegisterTunnel(replacement)
+
+	old.Close()
+	if !s.HasTunnel("app.example.com") {
+		t.Error("closing the old tunnel unregistered its replacement")
+	}
+	replacement.Close()
+	if s.HasTunnel("app.example.com") {
+		t.Error("tunnel still registered after close")
+	}
+}
+
+func TestTunnelGenerations(t *testing.T) {
+	s := NewServer(nil)
+	newTun := func() *Tunnel {
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+		return &Tunnel{Domain: "app.example.com", done: make(chan struct{}), ctx: ctx, cancel: cancel}
+	}
+
+	old, replacement := newTun(), newTun()
+	oldGen := s.RegisterTunnel(old)
+	newGen := s.RegisterTunnel(replacement)
+	if oldGen == 0 || newGen <= oldGen {
+		t.Fatalf("generations = %d, %d, want increasing and non-zero", oldGen, newGen)
+	}
+
+	if s.UnregisterTunnel("App.Example.com", oldGen) {
+		t.Error("UnregisterTunnel with the replaced generation = true, want false")
+	}
+	if s.GetTunnel("app.example.com") != replacement {
+		t.Error("stale unregister removed the replacement tunnel")
+	}
+	if !s.UnregisterTunnel("App.Example.com", newGen) {
+		t.Error("UnregisterTunnel with the current generation = false, want true")
+	}
+	if s.HasTunnel("app.example.com") {
+		t.Error("tunnel still registered after unregister")
+	}
+
+	closed := newTun()
+	closed.Close()
+	if gen := s.RegisterTunnel(closed); gen != 0 {
+		t.Errorf("RegisterTunnel(closed) = %d, want 0", gen)
+	}
+	if s.HasTunnel("app.example.com") {
+		t.Error("closed tunnel was registered")
+	}
+}
+
+// TestTunnelRegistryRace closes each tunnel while its replacement registers,
+// the way a reconnecting client races its own dying connection
+func TestTunnelRegistryRace(t *testing.T) {
+	s := NewServer(nil)
+	newTun := func() *Tunnel {
+		ctx, cancel := context.WithCancel(context.Background())
+		tun := &Tunnel{Domain: "app.example.com", done: make(chan struct{}), ctx: ctx, cancel: cancel}
+		tun.onClose = func() { s.unregisterTunnel(tun) }
+		return tun
+	}
+
+	current := newTun()
+	s.RegisterTunnel(current)
+	for i := 0; i < 500; i++ {
+		old, replacement := current, newTun()
+
+		var wg sync.WaitGroup
+		start := make(chan struct{})
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			<-start
+			old.Close()
+		}()
+		go func() {
+			defer wg.Done()
+			<-start
+			s.RegisterTunnel(replacement)
+		}()
+		close(start)
+		wg.Wait()
+
+		if got := s.GetTunnel("app.example.com"); got != replacement {
+			t.Fatalf("iteration %d: registered tunnel = %p, want the replacement %p", i, got, replacement)
+		}
+		current = replacement
+	}
+
+	// A registration racing its own tunnel's close never outlives it
+	for i := 0; i < 500; i++ {
+		tun := newTun()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			tun.Close()
+		}()
+		s.RegisterTunnel(tun)
+		<-done
+		if got := s.GetTunnel("app.example.com"); got == tun {
+			t.Fatalf("iteration %d: closed tunnel left registered", i)
+		}
+	}
+}
+
+func TestHostNormalization(t *testing.T) {
+	config := DefaultServerConfig()
+	s := NewServerWithConfig(nil, config)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tun := &Tunnel{
+		Domain:  "Bücher.Example.com",
+		state:   TunnelStateReady,
+		reqCh:   make(chan *pendingRequest, 1),
+		done:    make(chan struct{}),
+		config:  config,
+		ctx:     ctx,
+		cancel:  cancel,
+		onClose: func() {},
+	}
+	s.RegisterTunnel(tun)
+
+	for _, host := range []string{"bücher.example.com", "XN--BCHER-KVA.example.com", "xn--bcher-kva.example.com."} {
+		if !s.HasTunnel(host) {
+			t.Errorf("HasTunnel(%q) = false, want true", host)
+		}
+	}
+
+	// Requests with a mixed-case Host and a port reach the tunnel
+	go func() {
+		pr := <-tun.reqCh
+		pr.respCh <- &tunnel.Response{ID: pr.req.ID, StatusCode: http.StatusOK, Body: []byte("ok")}
+	}()
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Host = "XN--BCHER-KVA.Example.COM:443"
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || rec.Body.String() != "ok" {
+		t.Errorf("proxy = %d %q, want 200 ok", rec.Code, rec.Body.String())
+	}
+}
+
+func TestConnectValidatesDomain(t *testing.T) {
+	s := NewServer(nil)
+
+	for _, domain := range []string{"localhost", "app.example.com:8080", "bad_name.example.com", "a/b.example.com"} {
+		req := httptest.NewRequest("POST", "/_lobber/connect", nil)
+		req.Header.Set("X-Lobber-Domain", domain)
+		req.Header.Set("Authorization", "Bearer test")
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("X-Lobber-Domain %q: status = %d, want 400", domain, rec.Code)
+		}
+	}
+}
+
+func TestStripPort(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"app.example.com", "app.example.com"},
+		{"app.example.com:443", "app.example.com"},
+		{"app.example.com:", "app.example.com"},
+		{"127.0.0.1:8080", "127.0.0.1"},
+		{"[::1]:443", "::1"},
+		{"[::1]", "::1"},
+		{"[2001:db8::1]:8443", "2001:db8::1"},
+		{"2001:db8::1", "2001:db8::1"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := stripPort(tt.in); got != tt.want {
+			t.Errorf("stripPort(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestIPv6HostRouting(t *testing.T) {
+	s := NewServer(nil)
+	s.landingHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("landing"))
+	})
+
+	tests := []struct {
+		host   string
+		status int
+	}{
+		{"[::1]:8080", http.StatusOK},
+		{"[::1]", http.StatusOK},
+		{"[2001:db8::1]:443", http.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Host = tt.host
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		if rec.Code != tt.status {
+			t.Errorf("Host %q: status = %d, want %d", tt.host, rec.Code, tt.status)
+		}
+	}
+}
+
+func TestRequestLatency(t *testing.T) {
+	received := time.Now().Add(-200 * time.Millisecond)
+	answered := received.Add(150 * time.Millisecond)
+	req := &tunnel.Request{RelayTime: 10 * time.Millisecond}
+
+	got := requestLatency(received, answered, req, &tunnel.Response{Meta: &tunnel.Metadata{Local: 100 * time.Millisecond, Client: 101 * time.Millisecond}})
+	if got.Relay != 10*time.Millisecond || got.Local != 100*time.Millisecond || got.Tunnel != 40*time.Millisecond {
+		t.Errorf("requestLatency() = %+v, want 10ms relay, 40ms tunnel, 100ms local", got)
+	}
+	if got.Write < 50*time.Millisecond {
+		t.Errorf("Write = %v, want the time since the response arrived", got.Write)
+	}
+
+	// A client that sends no metadata leaves the relay unable to split
+	// the round trip
+	got = requestLatency(received, answered, req, &tunnel.Response{})
+	if got.Tunnel != 0 || got.Local != 0 || got.Relay != req.RelayTime {
+		t.Errorf("requestLatency() without metadata = %+v, want only the relay's own parts", got)
+	}
+}
+
+func TestOfferFeatures(t *testing.T) {
+	tests := []struct {
+		name    string
+		enabled []string
+		header  string // the client's FeaturesHeader; empty for clients that send none
+		want    []string
+	}{
+		{"old client", tunnel.Features, "", []string{tunnel.FeatureHeartbeat, tunnel.FeatureMetadata}},
+		{"welcome only", tunnel.Features, "welcome", []string{tunnel.FeatureHeartbeat, tunnel.FeatureWelcome, tunnel.FeatureMetadata}},
+		{"current client", tunnel.Features, strings.Join(tunnel.Features, ","), tunnel.Features},
+		{"held back", []string{tunnel.FeatureHeartbeat, tunnel.FeatureWelcome}, "heartbeat, welcome, metadata, echo", []string{tunnel.FeatureHeartbeat, tunnel.FeatureWelcome}},
+		{"unknown to relay", tunnel.Features, "welcome,multiplex", []string{tunnel.FeatureHeartbeat, tunnel.FeatureWelcome, tunnel.FeatureMetadata}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := DefaultServerConfig()
+			config.Features = tt.enabled
+			s := &Server{config: config}
+			r := httptest.NewRequest("GET", "/_lobber/connect", nil)
+			if tt.header != "" {
+				r.Header.Set(tunnel.FeaturesHeader, tt.header)
+			}
+			if got := s.offer(r); !slices.Equal(got, tt.want) {
+				t.Errorf("offer() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConnectProtocolVersion(t *testing.T) {
+	config := DefaultServerConfig()
+	config.MinProtocol = 2
+	s := NewServerWithConfig(nil, config)
+
+	tests := []struct {
+		name    string
+		version string // the client's VersionHeader; empty for clients that send none
+		status  int
+	}{
+		{"old client", "", http.StatusUpgradeRequired},
+		{"version 1", "1", http.StatusUpgradeRequired},
+		{"current client", strconv.Itoa(tunnel.ProtocolVersion), http.StatusInternalServerError},
+		{"garbled", "two", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/_lobber/connect", nil)
+			req.Header.Set("X-Lobber-Domain", "app.example.com")
+			req.Header.Set("Authorization", "Bearer test")
+			if tt.version != "" {
+				req.Header.Set(tunnel.VersionHeader, tt.version)
+			}
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, req)
+
+			// Connects that are let through fail to hijack the recorder
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			if tt.status == http.StatusUpgradeRequired && !strings.Contains(rec.Body.String(), "upgrade lobber") {
+				t.Errorf("body = %q, want it to say to upgrade", rec.Body)
+			}
+		})
+	}
+}
+
+func TestSkipUnknownFrames(t *testing.T) {
+	s := NewServerWithConfig(nil, DefaultServerConfig())
+	srv := startTestServer(t, s)
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "POST /_lobber/connect HTTP/1.1\r\nHost: relay\r\nAuthorization: Bearer test\r\nX-Lobber-Domain: newer.example.com\r\n%s: 9\r\n\r\n", tunnel.VersionHeader)
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("connect: %v, %v", resp, err)
+	}
+	if v := resp.Header.Get(tunnel.VersionHeader); v != strconv.Itoa(tunnel.ProtocolVersion) {
+		t.Errorf("%s = %q, want %d", tunnel.VersionHeader, v, tunnel.ProtocolVersion)
+	}
+
+	// A frame from the future, then a ping the relay still answers
+	tunnel.EncodeReady(conn, nil)
+	conn.Write([]byte{0x7f, 0, 0, 0, 2, '{', '}'})
+	tunnel.EncodePing(conn, &tunnel.Heartbeat{Seq: 7})
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	frame, err := tunnel.ReadFrame(br)
+	if err != nil || frame.Type != tunnel.TypePong {
+		t.Fatalf("after an unknown frame got %v, %v, want a pong", frame, err)
+	}
+}
+
+func TestBinaryFramesByVersion(t *testing.T) {
+	s := NewServerWithConfig(nil, DefaultServerConfig())
+	srv := startTestServer(t, s)
+	defer srv.Close()
+
+	tests := []struct {
+		version string
+		binary  bool
+	}{
+		{"2", false},
+		{strconv.Itoa(tunnel.BinaryVersion), true},
+	}
+	for _, tt := range tests {
+		t.Run("version "+tt.version, func(t *testing.T) {
+			domain := "v" + tt.version + ".example.com"
+			conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+			if err != nil {
+				t.Fatalf("dial: %v", err)
+			}
+			defer conn.Close()
+			fmt.Fprintf(conn, "POST /_lobber/connect HTTP/1.1\r\nHost: relay\r\nAuthorization: Bearer test\r\nX-Lobber-Domain: %s\r\n%s: %s\r\n\r\n", domain, tunnel.VersionHeader, tt.version)
+			br := bufio.NewReader(conn)
+			if resp, err := http.ReadResponse(br, nil); err != nil || resp.StatusCode != http.StatusOK {
+				t.Fatalf("connect: %v, %v", resp, err)
+			}
+			tunnel.EncodeReady(conn, nil)
+
+			visited := make(chan string, 1)
+			go func() {
+				req, _ := http.NewRequest("POST", srv.URL+"/upload", strings.NewReader("\x00\xffraw"))
+				req.Host = domain
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					visited <- err.Error()
+					return
+				}
+				defer resp.Body.Close()
+				body, _ := io.ReadAll(resp.Body)
+				visited <- string(body)
+			}()
+
+			conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			frame, err := tunnel.ReadFrame(br)
+			if err != nil || frame.Type != tunnel.TypeRequest {
+				t.Fatalf("read request frame: %v, %v", frame, err)
+			}
+			if binary := frame.Payload[0] == 0; binary != tt.binary {
+				t.Errorf("binary request = %v, want %v", binary, tt.binary)
+			}
+			var req tunnel.Request
+			if err := frame.Decode(&req); err != nil || req.Path != "/upload" || string(req.Body) != "\x00\xffraw" {
+				t.Fatalf("request = %+v, %v", req, err)
+			}
+
+			// The relay reads JSON responses from any client
+			tunnel.EncodeResponse(conn, &tunnel.Response{ID: req.ID, StatusCode: 200, Body: []byte("ok")})
+			if got := <-visited; got != "ok" {
+				t.Errorf("visitor got %q, want ok", got)
+			}
+		})
+	}
+}
+
+func TestMaxFrameSize(t *testing.T) {
+	config := DefaultServerConfig()
+	config.MaxFrameSize = tunnel.MinFrameSize
+	s := NewServerWithConfig(nil, config)
+	srv := startTestServer(t, s)
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "POST /_lobber/connect HTTP/1.1\r\nHost: relay\r\nAuthorization: Bearer test\r\nX-Lobber-Domain: small.example.com\r\n%s: 3\r\n%s: %d\r\n\r\n", tunnel.VersionHeader, tunnel.MaxFrameHeader, 2*tunnel.MinFrameSize)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("connect: %v, %v", resp, err)
+	}
+	if got := resp.Header.Get(tunnel.MaxFrameHeader); got != strconv.Itoa(tunnel.MinFrameSize) {
+		t.Errorf("%s = %q, want %d", tunnel.MaxFrameHeader, got, tunnel.MinFrameSize)
+	}
+	tunnel.EncodeReady(conn, nil)
+
+	// A body the client couldn't read in a frame never reaches it
+	req, _ := http.NewRequest("POST", srv.URL+"/upload", bytes.NewReader(make([]byte, 3*tunnel.MinFrameSize)))
+	req.Host = "small.example.com"
+	visit, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("visit: %v", err)
+	}
+	visit.Body.Close()
+	if visit.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized request = %d, want 413", visit.StatusCode)
+	}
+
+	// A frame over the relay's limit gets an error frame, then the tunnel
+	// is closed
+	tunnel.EncodeResponse(conn, &tunnel.Response{ID: "req-1", StatusCode: 200, Body: make([]byte, tunnel.MinFrameSize)})
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	frame, err := tunnel.ReadFrame(br)
+	if err != nil || frame.Type != tunnel.TypeError {
+		t.Fatalf("after an oversized frame got %v, %v, want an error frame", frame, err)
+	}
+	var e tunnel.Error
+	if err := frame.Decode(&e); err != nil || e.Code != tunnel.ErrorFrameTooLarge {
+		t.Errorf("error frame = %+v, %v, want %s", e, err, tunnel.ErrorFrameTooLarge)
+	}
+	if _, err := tunnel.ReadFrame(br); err == nil {
+		t.Error("tunnel still open after the error frame")
+	}
+}
+
+func TestWelcomeRetention(t *testing.T) {
+	s := NewServerWithConfig(nil, DefaultServerConfig())
+	s.stores.Users.(*store.Memory).AddUser(store.User{ID: "u1", Email: "u1@example.com", Plan: "pro"})
+	r := httptest.NewRequest("POST", "/_lobber/connect", nil)
+
+	if got := s.welcome(r, "app.example.com", "u1", nil, BurstPolicy{}, tunnel.ShareLimits{}, 0).Limits.RetentionSeconds; got != 30*24*3600 {
+		t.Errorf("pro RetentionSeconds = %d, want 30 days", got)
+	}
+	if got := s.welcome(r, "app.example.com", "anonymous", nil, BurstPolicy{}, tunnel.ShareLimits{}, 0).Limits.RetentionSeconds; got != 24*3600 {
+		t.Errorf("anonymous RetentionSeconds = %d, want the default day", got)
+	}
+}
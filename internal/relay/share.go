@@ -0,0 +1,168 @@
+// internal/relay/share.go
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/lobber-dev/lobber/internal/tunnel"
+)
+
+// shareRetiredKeep is how long a retired share's hostname keeps answering
+// 410 Gone before the relay forgets it
+const shareRetiredKeep = 24 * time.Hour
+
+var (
+	errShareRetired = errors.New("this share link has been retired")
+	errShareTaken   = errors.New("hostname is a share link of another tunnel")
+)
+
+// share is a one-time preview URL: a hostname the relay retires for good
+// once its tunnel has served MaxRequests requests or its TTL has passed
+type share struct {
+	userID  string
+	limits  tunnel.ShareLimits
+	used    int
+	retired time.Time // zero while the share is live
+	timer   *time.Timer
+}
+
+// shareRegistry tracks the shares this relay has opened, live and retired
+type shareRegistry struct {
+	mu     sync.Mutex
+	shares map[string]*share // hostname -> share
+}
+
+func newShareRegistry() *shareRegistry {
+	return &shareRegistry{shares: make(map[string]*share)}
+}
+
+// open admits a tunnel connecting for hostname. With limits, it opens a
+// share, or resumes the user's share after a reconnect with its count so
+// far; without, it only checks that hostname isn't a share. It returns
+// whether a new share was opened.
+func (r *shareRegistry) open(hostname, userID string, limits tunnel.ShareLimits, now time.Time) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for host, sh := range r.shares {
+		if !sh.retired.IsZero() && now.Sub(sh.retired) > shareRetiredKeep {
+			delete(r.shares, host)
+		}
+	}
+
+	sh, ok := r.shares[hostname]
+	switch {
+	case ok && !sh.retired.IsZero():
+		return false, errShareRetired
+	case ok && (sh.userID != userID || limits == tunnel.ShareLimits{}):
+		return false, errShareTaken
+	case ok, limits == tunnel.ShareLimits{}:
+		return false, nil
+	}
+	r.shares[hostname] = &share{userID: userID, limits: limits}
+	return true, nil
+}
+
+// expireAfter retires hostname once its TTL runs out
+func (r *shareRegistry) expireAfter(hostname string, retire func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if sh, ok := r.shares[hostname]; ok && sh.limits.TTL > 0 {
+		sh.timer = time.AfterFunc(sh.limits.TTL, retire)
+	}
+}
+
+// admit counts a visitor request for hostname. It returns false if
+// hostname is a retired share, and last for the request that uses up the
+// share's allowance.
+func (r *shareRegistry) admit(hostname string) (ok, last bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sh, found := r.shares[hostname]
+	if !found {
+		return true, false
+	}
+	if !sh.retired.IsZero() {
+		return false, false
+	}
+	sh.used++
+	return true, sh.limits.MaxRequests > 0 && sh.used >= sh.limits.MaxRequests
+}
+
+// limit returns the request allowance of hostname's share
+func (r *shareRegistry) limit(hostname string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if sh, ok := r.shares[hostname]; ok {
+		return sh.limits.MaxRequests
+	}
+	return 0
+}
+
+// isRetired reports whether hostname is a retired share
+func (r *shareRegistry) isRetired(hostname string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sh, ok := r.shares[hostname]
+	return ok && !sh.retired.IsZero()
+}
+
+// retire marks hostname's share retired, reporting false if it wasn't a
+// live share
+func (r *shareRegistry) retire(hostname string, now time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sh, ok := r.shares[hostname]
+	if !ok || !sh.retired.IsZero() {
+		return false
+	}
+	sh.retired = now
+	if sh.timer != nil {
+		sh.timer.Stop()
+	}
+	return true
+}
+
+// retireShare retires a share for good and tells its client, which exits
+// rather than reconnect
+func (s *Server) retireShare(hostname, reason string) {
+	if !s.shares.retire(hostname, time.Now()) {
+		return
+	}
+	log.Printf("share %s: retired after %s", hostname, reason)
+
+	s.mu.RLock()
+	t, ok := s.tunnels[hostname]
+	s.mu.RUnlock()
+	if !ok {
+		return
+	}
+	if err := t.disconnect(&tunnel.Disconnect{Reason: "share link retired after " + reason}); err != nil {
+		log.Printf("tunnel %s: send disconnect: %v", hostname, err)
+	}
+	t.Close()
+}
+
+var sharePageTmpl = visitorPage(`{{define "title"}}Link expired{{end}}
+{{define "content"}}
+        <h1>This link has expired</h1>
+        <p><code>{{.}}</code> was a one-time preview and is no longer available.</p>
+        <p>Ask whoever shared it with you for a new link.</p>
+{{end}}`)
+
+// writeSharePage responds with 410 Gone for a retired share
+func writeSharePage(w http.ResponseWriter, domain string) {
+	writeVisitorPage(w, http.StatusGone, sharePageTmpl, domain)
+}
+
+// shareRequests describes a used-up request allowance for logs and the client
+func shareRequests(n int) string {
+	if n == 1 {
+		return "1 request"
+	}
+	return fmt.Sprintf("%d requests", n)
+}
@@ -0,0 +1,93 @@
+// internal/relay/share_test.go
+package relay
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lobber-dev/lobber/internal/tunnel"
+)
+
+func TestShareRegistry(t *testing.T) {
+	r := newShareRegistry()
+	now := time.Now()
+	limits := tunnel.ShareLimits{MaxRequests: 2}
+	const host = "k3vq7m2xwa4tc.share.example.com"
+
+	if created, err := r.open(host, "u1", limits, now); !created || err != nil {
+		t.Fatalf("open() = %v, %v, want a new share", created, err)
+	}
+	if created, err := r.open(host, "u1", limits, now); created || err != nil {
+		t.Errorf("open() on reconnect = %v, %v, want the share resumed", created, err)
+	}
+	if _, err := r.open(host, "u2", limits, now); err != errShareTaken {
+		t.Errorf("open() by another user error = %v, want errShareTaken", err)
+	}
+	if _, err := r.open(host, "u1", tunnel.ShareLimits{}, now); err != errShareTaken {
+		t.Errorf("open() as a normal tunnel error = %v, want errShareTaken", err)
+	}
+	if created, err := r.open("app.example.com", "u1", tunnel.ShareLimits{}, now); created || err != nil {
+		t.Errorf("open() of a normal tunnel = %v, %v, want it left alone", created, err)
+	}
+
+	if ok, last := r.admit(host); !ok || last {
+		t.Errorf("admit() first = %v, %v, want admitted", ok, last)
+	}
+	if ok, last := r.admit(host); !ok || !last {
+		t.Errorf("admit() second = %v, %v, want admitted as the last", ok, last)
+	}
+	if !r.retire(host, now) || r.retire(host, now) {
+		t.Error("retire() should succeed once")
+	}
+	if ok, _ := r.admit(host); ok {
+		t.Error("admit() after retiring let a request through")
+	}
+	if _, err := r.open(host, "u1", limits, now); err != errShareRetired {
+		t.Errorf("open() after retiring error = %v, want errShareRetired", err)
+	}
+
+	// Long after, the hostname is forgotten
+	later := now.Add(shareRetiredKeep + time.Minute)
+	if created, err := r.open("other.example.com", "u1", tunnel.ShareLimits{}, later); created || err != nil {
+		t.Fatalf("open() = %v, %v", created, err)
+	}
+	if r.isRetired(host) {
+		t.Error("retired share kept past shareRetiredKeep")
+	}
+}
+
+func TestShareExpires(t *testing.T) {
+	s := NewServer(nil)
+	const host = "k3vq7m2xwa4tc.share.example.com"
+	if _, err := s.shares.open(host, "u1", tunnel.ShareLimits{TTL: 10 * time.Millisecond}, time.Now()); err != nil {
+		t.Fatalf("open() error = %v", err)
+	}
+	retired := make(chan struct{})
+	s.shares.expireAfter(host, func() {
+		s.retireShare(host, "10ms")
+		close(retired)
+	})
+
+	select {
+	case <-retired:
+	case <-time.After(5 * time.Second):
+		t.Fatal("share never expired")
+	}
+	if !s.shares.isRetired(host) {
+		t.Error("share still live after its ttl")
+	}
+}
+
+func TestWriteSharePage(t *testing.T) {
+	rec := httptest.NewRecorder()
+	writeSharePage(rec, "k3vq7m2xwa4tc.share.example.com")
+	if rec.Code != http.StatusGone {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusGone)
+	}
+	if body := rec.Body.String(); !strings.Contains(body, "<title>Link expired</title>") || !strings.Contains(body, "k3vq7m2xwa4tc.share.example.com") {
+		t.Errorf("body = %q, want the expired link page naming the share", body)
+	}
+}
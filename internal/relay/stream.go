@@ -0,0 +1,273 @@
+// internal/relay/stream.go
+package relay
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lobber-dev/lobber/internal/store"
+	"github.com/lobber-dev/lobber/internal/tunnel"
+)
+
+// upgradeProtocol returns the protocol r asks to switch to, such as
+// "websocket", or "" if it doesn't ask
+func upgradeProtocol(r *http.Request) string {
+	for _, v := range r.Header.Values("Connection") {
+		for token := range strings.SplitSeq(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return r.Header.Get("Upgrade")
+			}
+		}
+	}
+	return ""
+}
+
+// uses reports whether t's client uses the optional protocol feature
+func (t *Tunnel) uses(feature string) bool {
+	t.stateMu.RLock()
+	defer t.stateMu.RUnlock()
+	return slices.Contains(t.features, feature)
+}
+
+// stream is a visitor's upgraded connection as it arrives from the client
+type stream struct {
+	data   chan []byte   // bytes from the client, in order
+	done   chan struct{} // closed once the client closes its end
+	once   sync.Once
+	window *tunnel.Credit // room the client granted for the visitor's bytes
+}
+
+// finish marks the client's end closed
+func (st *stream) finish() {
+	st.once.Do(func() { close(st.done) })
+}
+
+// openStream registers a stream for the request with id, before the
+// request goes out so no bytes the client sends after its 101 are missed
+func (t *Tunnel) openStream(id string) *stream {
+	return t.addStream(id, t.streamWindow())
+}
+
+// addStream registers a stream for the request with id that starts with
+// the room in window
+func (t *Tunnel) addStream(id string, window *tunnel.Credit) *stream {
+	st := &stream{data: make(chan []byte, 16), done: make(chan struct{}), window: window}
+	t.streamMu.Lock()
+	defer t.streamMu.Unlock()
+	if t.streams == nil {
+		t.streams = make(map[string]*stream)
+	}
+	t.streams[id] = st
+	return st
+}
+
+// closeStream forgets the stream with id
+func (t *Tunnel) closeStream(id string) {
+	t.streamMu.Lock()
+	defer t.streamMu.Unlock()
+	if st := t.streams[id]; st != nil {
+		st.window.Close()
+		delete(t.streams, id)
+	}
+}
+
+// deliver hands a Stream frame from the client to its visitor's
+// connection. Frames for streams that have closed are dropped.
+func (t *Tunnel) deliver(s *tunnel.Stream) {
+	t.streamMu.Lock()
+	st := t.streams[s.ID]
+	t.streamMu.Unlock()
+	if st == nil {
+		return
+	}
+	if s.Close {
+		st.finish()
+		return
+	}
+	select {
+	case st.data <- s.Data:
+	case <-st.done:
+	case <-t.done:
+	}
+}
+
+// writeStream sends a Stream frame to the client
+func (t *Tunnel) writeStream(s *tunnel.Stream) error {
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+	if err := tunnel.EncodeStream(t.frames(), s); err != nil {
+		return err
+	}
+	return t.bufrw.Flush()
+}
+
+// pipe copies bytes between the visitor's connection and st until either
+// end closes, and returns how many went each way. The visitor's side is
+// only read while the client has room for more of it.
+func (t *Tunnel) pipe(id string, st *stream, conn net.Conn, br *bufio.Reader) (in, out int64) {
+	t.piped.Add(1)
+	defer t.piped.Add(-1)
+	ctx, cancel := context.WithCancel(t.ctx)
+	visitorDone := make(chan struct{})
+	t.spawn(func() {
+		defer close(visitorDone)
+		buf := make([]byte, tunnel.MaxStreamChunk)
+		for {
+			room, err := st.window.Take(ctx, int64(len(buf)))
+			if err != nil {
+				return
+			}
+			n, err := br.Read(buf[:room])
+			st.window.Grant(room - int64(n))
+			if n > 0 {
+				if t.writeStream(&tunnel.Stream{ID: id, Data: buf[:n]}) != nil {
+					return
+				}
+				in += int64(n)
+			}
+			if err != nil {
+				return
+			}
+		}
+	})
+
+	clientClosed := false
+	write := func(data []byte) bool {
+		n, err := conn.Write(data)
+		out += int64(n)
+		return err == nil && t.writeWindow(id, n) == nil
+	}
+loop:
+	for {
+		select {
+		case data := <-st.data:
+			if !write(data) {
+				break loop
+			}
+		case <-st.done:
+			// Bytes the client sent before closing may still be queued
+			for len(st.data) > 0 {
+				write(<-st.data)
+			}
+			clientClosed = true
+			break loop
+		case <-visitorDone:
+			break loop
+		case <-t.done:
+			break loop
+		}
+	}
+
+	conn.Close()
+	cancel()
+	<-visitorDone
+	if !clientClosed {
+		t.writeStream(&tunnel.Stream{ID: id, Close: true})
+	}
+	return in, out
+}
+
+// proxyUpgrade sends a request to switch protocols, such as a WebSocket
+// handshake, through tun. If the local server agrees, the visitor's
+// connection is carried over the tunnel as a stream until either end
+// closes it, and logged once it has.
+func (s *Server) proxyUpgrade(ctx context.Context, w http.ResponseWriter, tun *Tunnel, req *tunnel.Request, start time.Time, entry store.RequestLog) {
+	hostname := tun.Domain
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "upgrades need HTTP/1.1", http.StatusHTTPVersionNotSupported)
+		return
+	}
+
+	st := tun.openStream(req.ID)
+	defer tun.closeStream(req.ID)
+
+	entry.StatusCode = http.StatusBadGateway
+	entry.RequestSize = int64(len(req.Body))
+	defer func() {
+		entry.Duration = time.Since(start)
+		s.logRequest(hostname, entry)
+	}()
+
+	resp, err := s.roundTrip(ctx, tun, req, start)
+	if err != nil {
+		switch {
+		case errors.Is(err, errQueueFull), errors.Is(err, errSaturated):
+			entry.StatusCode = http.StatusServiceUnavailable
+			w.Header().Set("Retry-After", "1")
+		case errors.Is(err, errTunnelTimeout):
+			entry.StatusCode = http.StatusGatewayTimeout
+		}
+		http.Error(w, err.Error(), entry.StatusCode)
+		if !errors.Is(err, errVisitorGone) {
+			tun.addError(entry.Method, entry.Path, entry.StatusCode, err.Error())
+		}
+		return
+	}
+	entry.Latency = requestLatency(start, time.Now(), req, resp)
+	if resp.Meta != nil {
+		entry.LocalStatus, entry.ClientVersion = resp.Meta.LocalStatus, resp.Meta.ClientVersion
+		if resp.Meta.LocalError != "" {
+			tun.addError(entry.Method, entry.Path, resp.StatusCode, "local server: "+resp.Meta.LocalError)
+		}
+	}
+	entry.StatusCode = resp.StatusCode
+
+	// The local server turned the upgrade down, so it's an ordinary answer
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		for k, vals := range sanitizeHeaders(resp.Headers, len(resp.Body)) {
+			for _, v := range vals {
+				w.Header().Add(k, v)
+			}
+		}
+		w.WriteHeader(resp.StatusCode)
+		w.Write(resp.Body)
+		entry.ResponseSize = int64(len(resp.Body))
+		if resp.Chunked {
+			entry.ResponseSize = tun.copyChunked(ctx, w, req.ID)
+		}
+		tun.bytesIn.Add(entry.RequestSize)
+		tun.bytesOut.Add(entry.ResponseSize)
+		return
+	}
+
+	conn, bufrw, err := hijacker.Hijack()
+	if err != nil {
+		tun.writeStream(&tunnel.Stream{ID: req.ID, Close: true})
+		entry.StatusCode = http.StatusBadGateway
+		http.Error(w, "hijack failed: "+err.Error(), entry.StatusCode)
+		return
+	}
+	// The server's read and write timeouts would cut a long-lived
+	// connection off
+	conn.SetDeadline(time.Time{})
+
+	protocol := resp.Upgrade
+	if protocol == "" || strings.ContainsAny(protocol, "\r\n\x00") {
+		protocol = req.Upgrade
+	}
+	fmt.Fprintf(bufrw, "HTTP/1.1 101 Switching Protocols\r\n")
+	sanitizeHeaders(resp.Headers, 0).Write(bufrw)
+	fmt.Fprintf(bufrw, "Connection: Upgrade\r\nUpgrade: %s\r\n\r\n", protocol)
+	if err := bufrw.Flush(); err != nil {
+		conn.Close()
+		tun.writeStream(&tunnel.Stream{ID: req.ID, Close: true})
+		return
+	}
+
+	in, out := tun.pipe(req.ID, st, conn, bufrw.Reader)
+	entry.RequestSize += in
+	entry.ResponseSize = out
+	tun.bytesIn.Add(entry.RequestSize)
+	tun.bytesOut.Add(out)
+	log.Printf("tunnel %s: %s stream %s closed after %s", hostname, protocol, req.ID, time.Since(start).Round(time.Second))
+}
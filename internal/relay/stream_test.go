@@ -0,0 +1,60 @@
+// internal/relay/stream_test.go
+package relay
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/lobber-dev/lobber/internal/tunnel"
+)
+
+func TestUpgradeProtocol(t *testing.T) {
+	tests := []struct {
+		connection string
+		upgrade    string
+		want       string
+	}{
+		{"", "", ""},
+		{"Upgrade", "websocket", "websocket"},
+		{"keep-alive, Upgrade", "websocket", "websocket"},
+		{"keep-alive", "websocket", ""},
+		{"upgrade", "", ""},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/socket", nil)
+		if tt.connection != "" {
+			r.Header.Set("Connection", tt.connection)
+		}
+		if tt.upgrade != "" {
+			r.Header.Set("Upgrade", tt.upgrade)
+		}
+		if got := upgradeProtocol(r); got != tt.want {
+			t.Errorf("upgradeProtocol(Connection: %q, Upgrade: %q) = %q, want %q", tt.connection, tt.upgrade, got, tt.want)
+		}
+	}
+}
+
+func TestDeliverStream(t *testing.T) {
+	tun := &Tunnel{done: make(chan struct{})}
+	st := tun.openStream("req-1")
+
+	tun.deliver(&tunnel.Stream{ID: "req-1", Data: []byte("hello")})
+	tun.deliver(&tunnel.Stream{ID: "req-2", Data: []byte("for nobody")})
+	if got := string(<-st.data); got != "hello" {
+		t.Errorf("data = %q, want %q", got, "hello")
+	}
+
+	tun.deliver(&tunnel.Stream{ID: "req-1", Close: true})
+	select {
+	case <-st.done:
+	default:
+		t.Error("stream still open after the client closed it")
+	}
+
+	// Once closed, the client's late frames don't hold up the tunnel
+	tun.closeStream("req-1")
+	for range cap(st.data) + 1 {
+		tun.deliver(&tunnel.Stream{ID: "req-1", Data: []byte("late")})
+	}
+}
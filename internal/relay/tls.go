@@ -6,8 +6,10 @@ import (
 	"crypto/tls"
 	"fmt"
 	"net/http"
+	"strings"
 	"sync"
 
+	"github.com/lobber-dev/lobber/internal/dnsname"
 	"golang.org/x/crypto/acme/autocert"
 )
 
@@ -16,9 +18,20 @@ type TLSManager struct {
 	AllowedDomains map[string]bool
 	ServiceDomain  string
 	certManager    *autocert.Manager
+	ca             *LocalCA // issues certificates instead of ACME when set
+
+	// OnCertIssued, if set, is called with the hostname of every new
+	// certificate. Set it before serving.
+	OnCertIssued func(host string)
 }
 
 func NewTLSManager(serviceDomain, cacheDir string) *TLSManager {
+	return NewTLSManagerWithCache(serviceDomain, autocert.DirCache(cacheDir))
+}
+
+// NewTLSManagerWithCache keeps ACME certificates in cache, such as the
+// relay's CertCache so the fleet shares them
+func NewTLSManagerWithCache(serviceDomain string, cache autocert.Cache) *TLSManager {
 	mgr := &TLSManager{
 		AllowedDomains: make(map[string]bool),
 		ServiceDomain:  serviceDomain,
@@ -27,12 +40,22 @@ func NewTLSManager(serviceDomain, cacheDir string) *TLSManager {
 	mgr.certManager = &autocert.Manager{
 		Prompt:     autocert.AcceptTOS,
 		HostPolicy: mgr.HostPolicy,
-		Cache:      autocert.DirCache(cacheDir),
+		Cache:      issuedCache{Cache: cache, m: mgr},
 	}
 
 	return mgr
 }
 
+// NewTLSManagerWithCA serves certificates from a local CA instead of ACME,
+// under the same host policy, so tests exercise the real HTTPS path
+func NewTLSManagerWithCA(serviceDomain string, ca *LocalCA) *TLSManager {
+	return &TLSManager{
+		AllowedDomains: make(map[string]bool),
+		ServiceDomain:  serviceDomain,
+		ca:             ca,
+	}
+}
+
 func (m *TLSManager) HostPolicy(ctx context.Context, host string) error {
 	// Always allow service domain
 	if host == m.ServiceDomain || host == "tunnel.lobber.dev" {
@@ -53,23 +76,80 @@ func (m *TLSManager) HostPolicy(ctx context.Context, host string) error {
 func (m *TLSManager) AddDomain(domain string) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	m.AllowedDomains[domain] = true
+	m.AllowedDomains[dnsname.Lookup(domain)] = true
 }
 
 func (m *TLSManager) RemoveDomain(domain string) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	delete(m.AllowedDomains, domain)
+	delete(m.AllowedDomains, dnsname.Lookup(domain))
 }
 
 func (m *TLSManager) TLSConfig() *tls.Config {
+	if m.ca != nil {
+		return &tls.Config{
+			GetCertificate: m.GetCertificate,
+			NextProtos:     []string{"h2", "http/1.1"},
+		}
+	}
 	return m.certManager.TLSConfig()
 }
 
 func (m *TLSManager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if m.ca != nil {
+		host := dnsname.Lookup(hello.ServerName)
+		if host == "" {
+			return nil, fmt.Errorf("missing server name")
+		}
+		if err := m.HostPolicy(hello.Context(), host); err != nil {
+			return nil, err
+		}
+		cert, fresh, err := m.ca.certificate(host)
+		if err == nil && fresh {
+			m.certIssued(host)
+		}
+		return cert, err
+	}
 	return m.certManager.GetCertificate(hello)
 }
 
+// HTTPHandler answers ACME challenges on port 80, passing everything else to
+// fallback. A local CA needs no challenges.
 func (m *TLSManager) HTTPHandler(fallback http.Handler) http.Handler {
+	if m.ca != nil {
+		return fallback
+	}
 	return m.certManager.HTTPHandler(fallback)
 }
+
+func (m *TLSManager) certIssued(host string) {
+	if m.OnCertIssued != nil {
+		go m.OnCertIssued(host)
+	}
+}
+
+// issuedCache tells the TLSManager about certificates autocert stores,
+// which it does once per certificate it obtains or renews
+type issuedCache struct {
+	autocert.Cache
+	m *TLSManager
+}
+
+func (c issuedCache) Put(ctx context.Context, key string, data []byte) error {
+	if err := c.Cache.Put(ctx, key, data); err != nil {
+		return err
+	}
+	if host, ok := certHost(key); ok {
+		c.m.certIssued(host)
+	}
+	return nil
+}
+
+// certHost returns the hostname of an autocert cache key, and false for
+// keys that aren't certificates. Besides certificates, keyed by hostname
+// with an optional "+rsa", autocert caches its account key and challenge
+// tokens.
+func certHost(key string) (string, bool) {
+	host, suffix, _ := strings.Cut(key, "+")
+	return host, suffix == "" || suffix == "rsa"
+}
@@ -2,7 +2,14 @@
 package relay
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"slices"
 	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
 )
 
 func TestHostPolicy(t *testing.T) {
@@ -28,3 +35,86 @@ func TestHostPolicy(t *testing.T) {
 		}
 	}
 }
+
+func TestTLSManagerWithCA(t *testing.T) {
+	ca, err := NewLocalCA()
+	if err != nil {
+		t.Fatalf("NewLocalCA() error = %v", err)
+	}
+	mgr := NewTLSManagerWithCA("lobber.test", ca)
+	mgr.AddDomain("App.MySite.com")
+
+	tests := []struct {
+		serverName string
+		wantErr    bool
+	}{
+		{"lobber.test", false},
+		{"app.mysite.com", false},
+		{"APP.mysite.com", false},
+		{"unknown.com", true},
+		{"", true},
+	}
+
+	for _, tt := range tests {
+		cert, err := mgr.GetCertificate(&tls.ClientHelloInfo{ServerName: tt.serverName})
+		if (err != nil) != tt.wantErr {
+			t.Errorf("GetCertificate(%q) error = %v, wantErr %v", tt.serverName, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatalf("parse certificate: %v", err)
+		}
+		if _, err := leaf.Verify(x509.VerifyOptions{DNSName: tt.serverName, Roots: ca.CertPool()}); err != nil {
+			t.Errorf("certificate for %q does not verify: %v", tt.serverName, err)
+		}
+	}
+}
+
+func TestOnCertIssued(t *testing.T) {
+	issued := make(chan string, 10)
+	record := func(host string) { issued <- host }
+
+	ca, err := NewLocalCA()
+	if err != nil {
+		t.Fatalf("NewLocalCA() error = %v", err)
+	}
+	mgr := NewTLSManagerWithCA("lobber.test", ca)
+	mgr.OnCertIssued = record
+	mgr.AddDomain("app.mysite.com")
+	for range 2 {
+		if _, err := mgr.GetCertificate(&tls.ClientHelloInfo{ServerName: "app.mysite.com"}); err != nil {
+			t.Fatalf("GetCertificate() error = %v", err)
+		}
+	}
+
+	// autocert stores certificates alongside its account key and challenge tokens
+	cache := issuedCache{Cache: autocert.DirCache(t.TempDir()), m: &TLSManager{OnCertIssued: record}}
+	for _, key := range []string{"acme_account+key", "www.mysite.com+http-01", "www.mysite.com", "www.mysite.com+rsa"} {
+		if err := cache.Put(context.Background(), key, []byte("data")); err != nil {
+			t.Fatalf("Put(%q) error = %v", key, err)
+		}
+	}
+
+	var got []string
+	for len(got) < 3 {
+		select {
+		case host := <-issued:
+			got = append(got, host)
+		case <-time.After(time.Second):
+			t.Fatalf("OnCertIssued calls = %v, want 3", got)
+		}
+	}
+	slices.Sort(got)
+	if want := []string{"app.mysite.com", "www.mysite.com", "www.mysite.com"}; !slices.Equal(got, want) {
+		t.Errorf("OnCertIssued calls = %v, want %v", got, want)
+	}
+	select {
+	case host := <-issued:
+		t.Errorf("OnCertIssued called again for %s", host)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
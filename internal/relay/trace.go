@@ -0,0 +1,299 @@
+// internal/relay/trace.go
+package relay
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// traceLimit caps how many traces GET /_lobber/admin/requests lists
+const traceLimit = 50
+
+// tracePathLength caps the path kept with a trace
+const tracePathLength = 256
+
+// requestTrace times one proxied request through the relay, so a report of
+// "this one request took 30s" can be pinned on the visitor, the relay, the
+// tunnel or the local server. Tunnel goroutines mark it as the request
+// passes them, so its fields are guarded by mu.
+type requestTrace struct {
+	mu          sync.Mutex
+	id          string
+	domain      string
+	method      string
+	path        string
+	receivedAt  time.Time // the visitor's request reached the relay
+	queuedAt    time.Time // its body was read and it was handed to the tunnel
+	writingAt   time.Time // the tunnel started writing its frame
+	writtenAt   time.Time // the frame was flushed to the client
+	respondedAt time.Time // the client's response frame was read
+	finishedAt  time.Time // the response was written to the visitor
+	attempts    int       // tunnels it was sent on, more than one after a retry
+	bytesIn     int       // request body
+	bytesOut    int       // response body, chunks included
+	status      int
+	err         string
+}
+
+// queued marks the request handed to a tunnel, again on a retry
+func (t *requestTrace) queued(now time.Time) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.queuedAt = now
+	t.writingAt, t.writtenAt, t.respondedAt = time.Time{}, time.Time{}, time.Time{}
+	t.attempts++
+}
+
+// writing marks the tunnel starting to write the request frame
+func (t *requestTrace) writing(now time.Time) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.writingAt = now
+}
+
+// written marks the request frame flushed to the client
+func (t *requestTrace) written(now time.Time) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.writtenAt = now
+}
+
+// responded marks the client's response read
+func (t *requestTrace) responded(now time.Time, status, bytes int) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.respondedAt = now
+	t.status, t.bytesOut = status, bytes
+}
+
+// finish marks the visitor answered with status, having sent bytesIn and
+// been sent bytesOut, or the error that cut the request short. A status of
+// 0 keeps the client's, for upgrades that ran as streams.
+func (t *requestTrace) finish(now time.Time, status, bytesIn, bytesOut int, err error) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.finishedAt = now
+	t.bytesIn, t.bytesOut = bytesIn, max(t.bytesOut, bytesOut)
+	if status != 0 {
+		t.status = status
+	}
+	if err != nil {
+		t.err = err.Error()
+	}
+}
+
+// adminTrace is a request's trace in GET /_lobber/admin/requests. Each
+// stage is how long the request spent in it, in milliseconds, and is left
+// out until the request gets past it.
+type adminTrace struct {
+	ID         string    `json:"id"`
+	Domain     string    `json:"domain"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	ReceivedAt time.Time `json:"received_at"`
+	Done       bool      `json:"done"` // false while the request is in flight
+	Attempts   int       `json:"attempts,omitempty"`
+	Status     int       `json:"status,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	BytesIn    int       `json:"bytes_in"`
+	BytesOut   int       `json:"bytes_out"`
+
+	Read    *float64 `json:"read_ms,omitempty"`    // reading the visitor's body and waiting for window room
+	Queue   *float64 `json:"queue_ms,omitempty"`   // waiting for the tunnel to be ready and free to write
+	Write   *float64 `json:"write_ms,omitempty"`   // encoding and flushing the request frame
+	Wait    *float64 `json:"wait_ms,omitempty"`    // the client and local server, until the response frame arrived
+	Respond *float64 `json:"respond_ms,omitempty"` // writing the response to the visitor, streamed chunks included
+	Total   float64  `json:"total_ms"`             // so far, for requests in flight
+}
+
+// snapshot returns the trace as it stands at now
+func (t *requestTrace) snapshot(now time.Time) adminTrace {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	a := adminTrace{
+		ID:         t.id,
+		Domain:     t.domain,
+		Method:     t.method,
+		Path:       t.path,
+		ReceivedAt: t.receivedAt,
+		Done:       !t.finishedAt.IsZero(),
+		Attempts:   t.attempts,
+		Status:     t.status,
+		Error:      t.err,
+		BytesIn:    t.bytesIn,
+		BytesOut:   t.bytesOut,
+		Read:       stage(t.receivedAt, t.queuedAt),
+		Queue:      stage(t.queuedAt, t.writingAt),
+		Write:      stage(t.writingAt, t.writtenAt),
+		Wait:       stage(t.writtenAt, t.respondedAt),
+		Respond:    stage(t.respondedAt, t.finishedAt),
+	}
+	end := t.finishedAt
+	if end.IsZero() {
+		end = now
+	}
+	a.Total = milliseconds(end.Sub(t.receivedAt))
+	return a
+}
+
+// stage returns the milliseconds from start to end, or nil if either
+// hasn't happened
+func stage(start, end time.Time) *float64 {
+	if start.IsZero() || end.IsZero() {
+		return nil
+	}
+	ms := milliseconds(max(end.Sub(start), 0))
+	return &ms
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// traceRing keeps the traces of the last requests through the relay, the
+// oldest dropping out as new ones arrive. A nil ring keeps nothing.
+type traceRing struct {
+	mu     sync.Mutex
+	traces []*requestTrace // in arrival order from next, once full
+	next   int
+	byID   map[string]*requestTrace
+}
+
+// newTraceRing returns a ring of size traces, or nil for a size of 0
+func newTraceRing(size int) *traceRing {
+	if size <= 0 {
+		return nil
+	}
+	return &traceRing{traces: make([]*requestTrace, 0, size), byID: make(map[string]*requestTrace, size)}
+}
+
+// begin starts a trace for the request with id, which reached the relay at
+// received
+func (r *traceRing) begin(id, domain, method, path string, received time.Time) *requestTrace {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(path) > tracePathLength {
+		path = path[:tracePathLength]
+	}
+	t := &requestTrace{id: id, domain: domain, method: method, path: path, receivedAt: received}
+	if len(r.traces) < cap(r.traces) {
+		r.traces = append(r.traces, t)
+	} else {
+		if old := r.traces[r.next]; r.byID[old.id] == old {
+			delete(r.byID, old.id)
+		}
+		r.traces[r.next] = t
+		r.next = (r.next + 1) % len(r.traces)
+	}
+	r.byID[id] = t
+	return t
+}
+
+// get returns the latest trace of the request with id, or nil
+func (r *traceRing) get(id string) *requestTrace {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.byID[id]
+}
+
+// find returns the trace begun for the request with id that reached the
+// relay at received, or nil for requests nobody traces, such as the
+// handshakes of passthrough connections
+func (r *traceRing) find(id string, received time.Time) *requestTrace {
+	if t := r.get(id); t != nil && t.receivedAt.Equal(received) {
+		return t
+	}
+	return nil
+}
+
+// recent returns up to limit traces, newest first, of requests to domain,
+// or to any domain if it's empty, that have taken at least atLeast
+func (r *traceRing) recent(domain string, atLeast time.Duration, limit int) []adminTrace {
+	if r == nil {
+		return []adminTrace{}
+	}
+	r.mu.Lock()
+	ordered := slices.Concat(r.traces[r.next:], r.traces[:r.next])
+	r.mu.Unlock()
+
+	now := time.Now()
+	out := []adminTrace{}
+	for i := len(ordered) - 1; i >= 0 && len(out) < limit; i-- {
+		if domain != "" && ordered[i].domain != domain {
+			continue
+		}
+		a := ordered[i].snapshot(now)
+		if a.Total < milliseconds(atLeast) {
+			continue
+		}
+		out = append(out, a)
+	}
+	return out
+}
+
+// handleAdminRequests lists the relay's recent requests, newest first:
+// ?domain= narrows them to one hostname and ?min= to those that took at
+// least a duration such as 10s
+func (s *Server) handleAdminRequests(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var atLeast time.Duration
+	if v := r.URL.Query().Get("min"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			http.Error(w, "min must be a duration such as 10s", http.StatusBadRequest)
+			return
+		}
+		atLeast = d
+	}
+	limit := traceLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > traceLimit {
+			http.Error(w, "limit must be between 1 and "+strconv.Itoa(traceLimit), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	writeJSON(w, http.StatusOK, s.traces.recent(r.URL.Query().Get("domain"), atLeast, limit))
+}
+
+// handleAdminRequest traces one recent request by its ID, in flight or done
+func (s *Server) handleAdminRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	t := s.traces.get(r.PathValue("id"))
+	if t == nil {
+		http.Error(w, "no recent request with that ID", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, t.snapshot(time.Now()))
+}
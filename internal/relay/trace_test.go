@@ -0,0 +1,121 @@
+// internal/relay/trace_test.go
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lobber-dev/lobber/internal/tunnel"
+)
+
+func TestTraceRing(t *testing.T) {
+	ring := newTraceRing(2)
+	start := time.Now()
+	ring.begin("a", "one.example.com", "GET", "/a", start.Add(-3*time.Second)).finish(start, 200, 0, 0, nil)
+	ring.begin("b", "two.example.com", "GET", "/b", start.Add(-2*time.Second)).finish(start, 200, 0, 0, nil)
+	ring.begin("c", "one.example.com", "POST", "/"+strings.Repeat("c", 2*tracePathLength), start.Add(-time.Second)).finish(start, 201, 0, 0, nil)
+
+	if ring.get("a") != nil {
+		t.Error("oldest trace kept past the ring's size")
+	}
+	if got := ring.get("c"); got == nil || len(got.path) != tracePathLength {
+		t.Errorf("trace c = %+v, want its path cut to %d", got, tracePathLength)
+	}
+	if ring.find("b", start) != nil {
+		t.Error("find() matched a request received at another time")
+	}
+
+	tests := []struct {
+		name    string
+		domain  string
+		atLeast time.Duration
+		want    []string
+	}{
+		{"all", "", 0, []string{"c", "b"}},
+		{"one domain", "one.example.com", 0, []string{"c"}},
+		{"slow", "", 1500 * time.Millisecond, []string{"b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, a := range ring.recent(tt.domain, tt.atLeast, traceLimit) {
+				got = append(got, a.ID)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("recent() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if got := (*traceRing)(nil).recent("", 0, traceLimit); got == nil || len(got) != 0 {
+		t.Errorf("nil ring recent() = %v, want an empty list", got)
+	}
+}
+
+func TestAdminRequestTrace(t *testing.T) {
+	config := DefaultServerConfig()
+	config.AdminToken = "secret"
+	s := NewServerWithConfig(nil, config)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tun := &Tunnel{
+		Domain:  "app.example.com",
+		UserID:  "test-user",
+		state:   TunnelStateReady,
+		reqCh:   make(chan *pendingRequest, 1),
+		respCh:  make(chan *tunnel.Response, 1),
+		done:    make(chan struct{}),
+		config:  config,
+		ctx:     ctx,
+		cancel:  cancel,
+		onClose: func() {},
+	}
+	s.RegisterTunnel(tun)
+
+	trace := func(id string) (int, adminTrace) {
+		req := httptest.NewRequest("GET", "/_lobber/admin/requests/"+id, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		var a adminTrace
+		if rec.Code == http.StatusOK {
+			if err := json.Unmarshal(rec.Body.Bytes(), &a); err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+		}
+		return rec.Code, a
+	}
+
+	proxied := make(chan struct{})
+	go func() {
+		defer close(proxied)
+		req := httptest.NewRequest("POST", "/slow?token=x", strings.NewReader("hello"))
+		req.Host = "app.example.com"
+		req.Header.Set("X-Request-ID", "req-42")
+		s.ServeHTTP(httptest.NewRecorder(), req)
+	}()
+
+	// The client holds on to the request: it's in flight
+	pr := <-tun.reqCh
+	status, a := trace("req-42")
+	if status != http.StatusOK || a.Done || a.Domain != "app.example.com" || a.Path != "/slow" || a.Attempts != 1 || a.Read == nil {
+		t.Errorf("in flight trace = %d %+v, want req-42 to app.example.com /slow, read and not done", status, a)
+	}
+
+	pr.respCh <- &tunnel.Response{ID: pr.req.ID, StatusCode: http.StatusAccepted, Body: []byte("queued!")}
+	<-proxied
+	status, a = trace("req-42")
+	if status != http.StatusOK || !a.Done || a.Status != http.StatusAccepted || a.BytesIn != 5 || a.BytesOut != 7 {
+		t.Errorf("finished trace = %d %+v, want done with 202 after 5 bytes in and 7 out", status, a)
+	}
+
+	if status, _ := trace("nope"); status != http.StatusNotFound {
+		t.Errorf("unknown request status = %d, want 404", status)
+	}
+}
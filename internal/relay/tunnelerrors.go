@@ -0,0 +1,45 @@
+// internal/relay/tunnelerrors.go
+package relay
+
+import (
+	"net/http"
+
+	"github.com/lobber-dev/lobber/internal/dnsname"
+	"github.com/lobber-dev/lobber/internal/proxyerr"
+)
+
+// addError records that the tunnel failed a method request for path, whose
+// visitor got status, for cause
+func (t *Tunnel) addError(method, path string, status int, cause string) {
+	if len(path) > tracePathLength {
+		path = path[:tracePathLength]
+	}
+	t.errors.Add(proxyerr.Entry{Method: method, Path: path, Status: status, Cause: cause})
+}
+
+// Errors returns the latest errors the tunnel ran into, newest first
+func (t *Tunnel) Errors() []proxyerr.Entry {
+	return t.errors.List()
+}
+
+// handleAdminTunnelErrors lists the latest errors of the tunnel connected
+// for a domain, newest first: requests it timed out on, couldn't queue or
+// whose local server wasn't reached, and frames it couldn't decode
+func (s *Server) handleAdminTunnelErrors(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s.mu.RLock()
+	t, ok := s.tunnels[dnsname.Lookup(r.PathValue("domain"))]
+	s.mu.RUnlock()
+	if !ok {
+		http.Error(w, "no tunnel connected for that domain", http.StatusNotFound)
+		return
+	}
+	errs := t.Errors()
+	if errs == nil {
+		errs = []proxyerr.Entry{}
+	}
+	writeJSON(w, http.StatusOK, errs)
+}
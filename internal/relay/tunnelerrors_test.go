@@ -0,0 +1,91 @@
+// internal/relay/tunnelerrors_test.go
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/lobber-dev/lobber/internal/proxyerr"
+	"github.com/lobber-dev/lobber/internal/tunnel"
+)
+
+func TestAdminTunnelErrors(t *testing.T) {
+	config := DefaultServerConfig()
+	config.AdminToken = "secret"
+	s := NewServerWithConfig(nil, config)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tun := &Tunnel{
+		Domain:  "app.example.com",
+		UserID:  "test-user",
+		state:   TunnelStateReady,
+		reqCh:   make(chan *pendingRequest, 1),
+		respCh:  make(chan *tunnel.Response, 1),
+		done:    make(chan struct{}),
+		config:  config,
+		ctx:     ctx,
+		cancel:  cancel,
+		onClose: func() {},
+	}
+	s.RegisterTunnel(tun)
+
+	// One request the local server wasn't up for, then one it answered
+	for _, resp := range []*tunnel.Response{
+		{StatusCode: http.StatusBadGateway, Meta: &tunnel.Metadata{LocalError: "connection refused"}},
+		{StatusCode: http.StatusOK},
+	} {
+		proxied := make(chan struct{})
+		go func() {
+			defer close(proxied)
+			req := httptest.NewRequest("GET", "/checkout", nil)
+			req.Host = "app.example.com"
+			s.ServeHTTP(httptest.NewRecorder(), req)
+		}()
+		pr := <-tun.reqCh
+		resp.ID = pr.req.ID
+		pr.respCh <- resp
+		<-proxied
+	}
+
+	tests := []struct {
+		domain string
+		status int
+		want   []proxyerr.Entry
+	}{
+		{"app.example.com", http.StatusOK, []proxyerr.Entry{{Method: "GET", Path: "/checkout", Status: http.StatusBadGateway, Cause: "local server: connection refused"}}},
+		{"APP.example.com", http.StatusOK, []proxyerr.Entry{{Method: "GET", Path: "/checkout", Status: http.StatusBadGateway, Cause: "local server: connection refused"}}},
+		{"gone.example.com", http.StatusNotFound, nil},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/_lobber/admin/tunnels/"+tt.domain+"/errors", nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		if rec.Code != tt.status {
+			t.Errorf("%s status = %d, want %d", tt.domain, rec.Code, tt.status)
+			continue
+		}
+		if tt.status != http.StatusOK {
+			continue
+		}
+		var got []proxyerr.Entry
+		if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		for i := range got {
+			if got[i].At.IsZero() {
+				t.Errorf("%s error %d has no time", tt.domain, i)
+			}
+			got[i].At = time.Time{}
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s errors = %+v, want %+v", tt.domain, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+// internal/relay/udp.go
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lobber-dev/lobber/internal/billing"
+	"github.com/lobber-dev/lobber/internal/tunnel"
+)
+
+const (
+	// udpSessionIdle is how long a UDP peer may go quiet before replies to
+	// it are dropped and its slot is given to a new peer
+	udpSessionIdle = 2 * time.Minute
+
+	// udpMaxPeers caps the peers one UDP tunnel tracks at a time
+	udpMaxPeers = 1024
+)
+
+var errNoUDPPorts = errors.New("no UDP ports free")
+
+// PortRange is an inclusive range of ports. The zero value is empty.
+type PortRange struct {
+	First, Last int
+}
+
+// ParsePortRange parses "40000-40999", or a single port
+func ParsePortRange(s string) (PortRange, error) {
+	first, last, ok := strings.Cut(strings.TrimSpace(s), "-")
+	if !ok {
+		last = first
+	}
+	a, err1 := strconv.Atoi(strings.TrimSpace(first))
+	b, err2 := strconv.Atoi(strings.TrimSpace(last))
+	if err1 != nil || err2 != nil || a < 1 || b > 65535 || a > b {
+		return PortRange{}, fmt.Errorf("invalid port range %q, want e.g. 40000-40999", s)
+	}
+	return PortRange{First: a, Last: b}, nil
+}
+
+func (r PortRange) empty() bool {
+	return r.First <= 0 || r.Last < r.First
+}
+
+func (r PortRange) contains(port int) bool {
+	return !r.empty() && port >= r.First && port <= r.Last
+}
+
+// udpListener is the public UDP port of a UDP tunnel. Every address that
+// writes to it is a session; the client's replies only go back to sessions
+// that are still live, so a tunnel can't make the relay send anywhere else.
+type udpListener struct {
+	conn *net.UDPConn
+	port int
+
+	mu    sync.Mutex
+	peers map[string]*udpPeer // session -> peer
+}
+
+type udpPeer struct {
+	addr     *net.UDPAddr
+	lastSeen time.Time
+}
+
+func newUDPListener(conn *net.UDPConn) *udpListener {
+	return &udpListener{
+		conn:  conn,
+		port:  conn.LocalAddr().(*net.UDPAddr).Port,
+		peers: make(map[string]*udpPeer),
+	}
+}
+
+// seen records a datagram from addr and returns its session, or false if
+// the tunnel already tracks udpMaxPeers live sessions
+func (l *udpListener) seen(addr *net.UDPAddr, now time.Time) (string, bool) {
+	session := addr.String()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if p, ok := l.peers[session]; ok {
+		p.lastSeen = now
+		return session, true
+	}
+	if len(l.peers) >= udpMaxPeers {
+		for s, p := range l.peers {
+			if now.Sub(p.lastSeen) > udpSessionIdle {
+				delete(l.peers, s)
+			}
+		}
+		if len(l.peers) >= udpMaxPeers {
+			return "", false
+		}
+	}
+	l.peers[session] = &udpPeer{addr: addr, lastSeen: now}
+	return session, true
+}
+
+// peer returns the address of a live session
+func (l *udpListener) peer(session string, now time.Time) (*net.UDPAddr, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	p, ok := l.peers[session]
+	if !ok || now.Sub(p.lastSeen) > udpSessionIdle {
+		return nil, false
+	}
+	p.lastSeen = now
+	return p.addr, true
+}
+
+// reply sends a datagram from the client back to its session's peer,
+// dropping it if the session has gone idle
+func (l *udpListener) reply(d *tunnel.Datagram) (int, error) {
+	addr, ok := l.peer(d.Session, time.Now())
+	if !ok || len(d.Data) > tunnel.MaxDatagramSize {
+		return 0, nil
+	}
+	return l.conn.WriteToUDP(d.Data, addr)
+}
+
+// listenUDP opens a public port for a UDP tunnel on domain. It prefers
+// want, the port the client had before reconnecting, taking it over from
+// the same user's earlier tunnel for the domain if that still holds it.
+func (s *Server) listenUDP(domain, userID string, want int) (*net.UDPConn, error) {
+	ports := s.config.UDPPorts
+	if ports.contains(want) {
+		s.mu.RLock()
+		holder := s.udpPorts[want]
+		s.mu.RUnlock()
+		if holder != nil && holder.Domain == domain && holder.UserID == userID {
+			holder.Close()
+		}
+		if conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: want}); err == nil {
+			return conn, nil
+		}
+	}
+
+	// Start somewhere random so tunnels don't all probe the same ports
+	n := ports.Last - ports.First + 1
+	start := rand.IntN(n)
+	for i := range n {
+		port := ports.First + (start+i)%n
+		s.mu.RLock()
+		taken := s.udpPorts[port] != nil
+		s.mu.RUnlock()
+		if taken {
+			continue
+		}
+		if conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: port}); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, errNoUDPPorts
+}
+
+// claimUDPPort records that t holds its UDP port
+func (s *Server) claimUDPPort(t *Tunnel) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.udpPorts[t.udp.port] = t
+}
+
+// releaseUDPPort forgets t's UDP port, unless another tunnel has it now
+func (s *Server) releaseUDPPort(t *Tunnel) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.udpPorts[t.udp.port] == t {
+		delete(s.udpPorts, t.udp.port)
+	}
+}
+
+// serveUDP frames datagrams arriving on t's public port for the client
+// until the tunnel closes
+func (s *Server) serveUDP(t *Tunnel) {
+	buf := make([]byte, tunnel.MaxDatagramSize)
+	for {
+		n, addr, err := t.udp.conn.ReadFromUDP(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("tunnel %s: UDP port %d: %v", t.Domain, t.udp.port, err)
+				t.Close()
+			}
+			return
+		}
+
+		// Owners past their hard cap get nothing through, as on HTTP
+		if s.quota != nil && t.UserID != "anonymous" && s.quota.level(t.UserID) == billing.QuotaCapped {
+			continue
+		}
+		if s.closed(t, time.Now()) != nil {
+			continue
+		}
+		session, ok := t.udp.seen(addr, time.Now())
+		if !ok {
+			continue
+		}
+
+		t.writeMu.Lock()
+		err = tunnel.EncodeDatagram(t.frames(), &tunnel.Datagram{Session: session, Data: buf[:n]})
+		if err == nil {
+			err = t.bufrw.Flush()
+		}
+		t.writeMu.Unlock()
+		if err != nil {
+			t.Close()
+			return
+		}
+		t.bytesIn.Add(int64(n))
+	}
+}
@@ -0,0 +1,143 @@
+// internal/relay/udp_test.go
+package relay
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/lobber-dev/lobber/internal/tunnel"
+)
+
+func TestParsePortRange(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    PortRange
+		wantErr bool
+	}{
+		{"40000-40999", PortRange{40000, 40999}, false},
+		{" 40000 - 40001 ", PortRange{40000, 40001}, false},
+		{"5353", PortRange{5353, 5353}, false},
+		{"40999-40000", PortRange{}, true},
+		{"0-10", PortRange{}, true},
+		{"40000-70000", PortRange{}, true},
+		{"udp", PortRange{}, true},
+		{"", PortRange{}, true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParsePortRange(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParsePortRange(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParsePortRange(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestUDPListenerSessions(t *testing.T) {
+	l := &udpListener{peers: make(map[string]*udpPeer)}
+	now := time.Now()
+
+	first := &net.UDPAddr{IP: net.IPv4(203, 0, 113, 7), Port: 1}
+	session, ok := l.seen(first, now)
+	if !ok || session != "203.0.113.7:1" {
+		t.Fatalf("seen() = %q, %v, want the peer's address", session, ok)
+	}
+	if _, ok := l.peer("198.51.100.1:53", now); ok {
+		t.Error("peer() found a session that never wrote, want replies to strangers dropped")
+	}
+
+	// Fill the table; a new peer only fits once others go idle
+	for i := 2; len(l.peers) < udpMaxPeers; i++ {
+		l.seen(&net.UDPAddr{IP: net.IPv4(203, 0, 113, 7), Port: i}, now)
+	}
+	latecomer := &net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 53}
+	if _, ok := l.seen(latecomer, now); ok {
+		t.Error("seen() admitted a peer past udpMaxPeers")
+	}
+	later := now.Add(udpSessionIdle + time.Second)
+	if _, ok := l.peer(session, later); ok {
+		t.Error("peer() found an idle session")
+	}
+	if _, ok := l.seen(latecomer, later); !ok {
+		t.Error("seen() refused a peer after the others went idle")
+	}
+}
+
+func TestConnectProtocol(t *testing.T) {
+	tests := []struct {
+		name     string
+		protocol string
+		ports    PortRange
+		want     int
+	}{
+		{"udp disabled", tunnel.ProtocolUDP, PortRange{}, http.StatusBadRequest},
+		{"unknown protocol", "sctp", PortRange{40000, 40001}, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := DefaultServerConfig()
+			config.UDPPorts = tt.ports
+			s := NewServerWithConfig(nil, config)
+
+			req := httptest.NewRequest("POST", "/_lobber/connect", nil)
+			req.Header.Set("X-Lobber-Domain", "dns.example.com")
+			req.Header.Set("Authorization", "Bearer test")
+			req.Header.Set(tunnel.ProtocolHeader, tt.protocol)
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d (body %q)", rec.Code, tt.want, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestListenUDPKeepsPort(t *testing.T) {
+	probe, err := net.ListenUDP("udp", &net.UDPAddr{})
+	if err != nil {
+		t.Skipf("skipping UDP test: %v", err)
+	}
+	port := probe.LocalAddr().(*net.UDPAddr).Port
+	probe.Close()
+
+	config := DefaultServerConfig()
+	config.UDPPorts = PortRange{port, port + 1}
+	s := NewServerWithConfig(nil, config)
+
+	conn, err := s.listenUDP("dns.example.com", "u1", port)
+	if err != nil {
+		t.Fatalf("listenUDP() error = %v", err)
+	}
+	old := &Tunnel{Domain: "dns.example.com", UserID: "u1", done: make(chan struct{}), cancel: func() {}, udp: newUDPListener(conn)}
+	old.onClose = func() { s.releaseUDPPort(old) }
+	s.claimUDPPort(old)
+
+	// Another user can't take the port; the same tunnel reconnecting can
+	if conn, err := s.listenUDP("dns.example.com", "u2", port); err == nil {
+		if got := conn.LocalAddr().(*net.UDPAddr).Port; got == port {
+			t.Errorf("listenUDP() for another user took port %d from its holder", got)
+		}
+		conn.Close()
+	}
+	conn, err = s.listenUDP("dns.example.com", "u1", port)
+	if err != nil {
+		t.Fatalf("listenUDP() on reconnect error = %v", err)
+	}
+	defer conn.Close()
+	if got := conn.LocalAddr().(*net.UDPAddr).Port; got != port {
+		t.Errorf("listenUDP() on reconnect = port %d, want %d", got, port)
+	}
+	if old.GetState() != TunnelStateClosed {
+		t.Error("the old tunnel still holds the port, want it closed")
+	}
+	if holder := s.udpPorts[port]; holder != nil {
+		t.Errorf("udpPorts[%d] still names the old tunnel for %s", port, holder.Domain)
+	}
+}
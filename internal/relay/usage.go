@@ -0,0 +1,86 @@
+// internal/relay/usage.go
+package relay
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	"github.com/lobber-dev/lobber/internal/events"
+	"github.com/lobber-dev/lobber/internal/store"
+)
+
+// startSession opens a tunnel session so the tunnel's bandwidth is
+// attributed to its domain. Tunnels on hostnames nobody owns still have
+// their bandwidth recorded, just without a session.
+func (s *Server) startSession(t *Tunnel) {
+	if t.UserID == "anonymous" {
+		return
+	}
+	id, err := s.stores.Usage.StartTunnelSession(context.Background(), t.Domain, t.Name)
+	if err != nil {
+		if !errors.Is(err, store.ErrNotFound) {
+			log.Printf("tunnel %s: start session: %v", t.Domain, err)
+		}
+		return
+	}
+	t.usageMu.Lock()
+	t.sessionID = id
+	t.usageMu.Unlock()
+	s.tunnelEvent(t, events.TunnelConnected, "connected")
+}
+
+// endSession records the tunnel's last bytes and closes its session
+func (s *Server) endSession(t *Tunnel, reason string) {
+	ctx := context.Background()
+	if err := s.flushUsage(ctx, t); err != nil {
+		log.Printf("tunnel %s: record usage: %v", t.Domain, err)
+	}
+
+	t.usageMu.Lock()
+	id := t.sessionID
+	t.usageMu.Unlock()
+	if id == "" {
+		return
+	}
+	if err := s.stores.Usage.EndTunnelSession(ctx, id, reason); err != nil {
+		log.Printf("tunnel %s: end session: %v", t.Domain, err)
+	}
+	s.tunnelEvent(t, events.TunnelDisconnected, "disconnected ("+reason+")")
+}
+
+// flushUsage records the bytes t has proxied since the last flush. The
+// counters are restored if the write fails so the next flush retries them.
+func (s *Server) flushUsage(ctx context.Context, t *Tunnel) error {
+	t.usageMu.Lock()
+	defer t.usageMu.Unlock()
+
+	in, out := t.bytesIn.Swap(0), t.bytesOut.Swap(0)
+	if (in == 0 && out == 0) || t.UserID == "anonymous" {
+		return nil
+	}
+	if err := s.stores.Usage.RecordBandwidth(ctx, t.UserID, t.sessionID, in, out); err != nil {
+		t.bytesIn.Add(in)
+		t.bytesOut.Add(out)
+		return err
+	}
+	return nil
+}
+
+// flushAllUsage records the bandwidth of every tunnel on this relay
+func (s *Server) flushAllUsage(ctx context.Context) error {
+	s.mu.RLock()
+	tunnels := make([]*Tunnel, 0, len(s.tunnels))
+	for _, t := range s.tunnels {
+		tunnels = append(tunnels, t)
+	}
+	s.mu.RUnlock()
+
+	var errs []error
+	for _, t := range tunnels {
+		if err := s.flushUsage(ctx, t); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,138 @@
+// internal/relay/usage_test.go
+package relay
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/lobber-dev/lobber/internal/store"
+	"github.com/lobber-dev/lobber/internal/tunnel"
+)
+
+func TestTunnelUsageAccounting(t *testing.T) {
+	s := NewServer(nil)
+	mem := s.stores.Usage.(*store.Memory)
+	mem.AddDomain("u1", store.Domain{Name: "app.example.com"})
+	ctx := context.Background()
+
+	newTun := func(domain, userID string) *Tunnel {
+		tctx, cancel := context.WithCancel(ctx)
+		t.Cleanup(cancel)
+		tun := &Tunnel{
+			Domain:  domain,
+			UserID:  userID,
+			state:   TunnelStateReady,
+			reqCh:   make(chan *pendingRequest, 1),
+			done:    make(chan struct{}),
+			config:  s.config,
+			ctx:     tctx,
+			cancel:  cancel,
+			onClose: func() {},
+		}
+		s.RegisterTunnel(tun)
+		return tun
+	}
+	serve := func(tun *Tunnel, body, resp string) {
+		go func() {
+			pr := <-tun.reqCh
+			pr.respCh <- &tunnel.Response{ID: pr.req.ID, StatusCode: http.StatusOK, Body: []byte(resp)}
+		}()
+		req := httptest.NewRequest("POST", "/", strings.NewReader(body))
+		req.Host = tun.Domain
+		s.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	owned := newTun("app.example.com", "u1")
+	s.startSession(owned)
+	if owned.sessionID == "" {
+		t.Fatal("no session started for an owned hostname")
+	}
+	unowned := newTun("other.example.com", "u1")
+	s.startSession(unowned)
+	if unowned.sessionID != "" {
+		t.Errorf("session %q started for a hostname nobody owns", unowned.sessionID)
+	}
+	anonymous := newTun("anon.example.com", "anonymous")
+
+	serve(owned, "hello", "hello world")
+	serve(unowned, "", "12345")
+	serve(anonymous, "", "ignored")
+
+	if err := s.flushAllUsage(ctx); err != nil {
+		t.Fatalf("flushAllUsage() error = %v", err)
+	}
+	if got, _ := mem.MonthlyUsage(ctx, "u1"); got != 21 {
+		t.Errorf("MonthlyUsage(u1) = %d, want 21 bytes from both tunnels", got)
+	}
+	if got, _ := mem.MonthlyUsage(ctx, "anonymous"); got != 0 {
+		t.Errorf("MonthlyUsage(anonymous) = %d, want 0", got)
+	}
+
+	// Flushing again records nothing new; closing records the rest and ends the session
+	serve(owned, "", "bye")
+	if err := s.flushAllUsage(ctx); err != nil {
+		t.Fatalf("flushAllUsage() error = %v", err)
+	}
+	serve(owned, "", "!")
+	s.endSession(owned, "closed")
+
+	session, bytes, ok := mem.TunnelSession(owned.sessionID)
+	if !ok || session.EndedAt == nil || session.DisconnectReason != "closed" {
+		t.Errorf("session = %+v, want ended with reason closed", session)
+	}
+	if bytes != 20 {
+		t.Errorf("session bytes = %d, want 20", bytes)
+	}
+}
+
+// failingUsage fails every bandwidth write
+type failingUsage struct {
+	store.UsageStore
+}
+
+func (failingUsage) RecordBandwidth(ctx context.Context, userID, tunnelSessionID string, bytesIn, bytesOut int64) error {
+	return errors.New("database down")
+}
+
+func TestFlushUsageKeepsBytesOnError(t *testing.T) {
+	s := NewServer(nil)
+	working := s.stores.Usage
+	s.stores.Usage = failingUsage{working}
+
+	tun := &Tunnel{Domain: "app.example.com", UserID: "u1"}
+	tun.bytesIn.Add(10)
+	tun.bytesOut.Add(20)
+
+	if err := s.flushUsage(context.Background(), tun); err == nil {
+		t.Fatal("flushUsage() error = nil, want the store's error")
+	}
+	if in, out := tun.bytesIn.Load(), tun.bytesOut.Load(); in != 10 || out != 20 {
+		t.Errorf("counters after failed flush = %d/%d, want 10/20", in, out)
+	}
+
+	s.stores.Usage = working
+	if err := s.flushUsage(context.Background(), tun); err != nil {
+		t.Fatalf("flushUsage() error = %v", err)
+	}
+	if got, _ := working.MonthlyUsage(context.Background(), "u1"); got != 30 {
+		t.Errorf("MonthlyUsage() = %d, want 30 after the retry", got)
+	}
+}
+
+func TestAdminUsageAuditNeedsBilling(t *testing.T) {
+	config := DefaultServerConfig()
+	config.AdminToken = "secret"
+	s := NewServerWithConfig(nil, config)
+
+	req := httptest.NewRequest("GET", "/_lobber/admin/users/u1/usage-audit", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want 503 without billing", rec.Code)
+	}
+}
@@ -0,0 +1,47 @@
+// internal/relay/visitorpage.go
+package relay
+
+import (
+	"html/template"
+	"net/http"
+)
+
+// visitorPageLayout is the shell of the pages the relay answers a tunnel's
+// visitors with in place of the tunnel, such as when it's over quota. Each
+// page defines a "title" and a "content" template for it.
+var visitorPageLayout = template.Must(template.New("visitor").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>{{template "title" .}}</title>
+    <style>
+        body { font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", sans-serif; background: #0a0a0a; color: #fafafa; display: flex; align-items: center; justify-content: center; min-height: 100vh; margin: 0; }
+        main { max-width: 480px; padding: 32px; text-align: center; }
+        h1 { font-size: 1.5rem; margin-bottom: 12px; }
+        p { color: #a1a1aa; line-height: 1.5; }
+        code { background: #18181b; padding: 2px 6px; border-radius: 4px; }
+    </style>
+</head>
+<body>
+    <main>
+{{template "content" .}}
+    </main>
+</body>
+</html>
+`))
+
+// visitorPage parses page, which defines "title" and "content", into its
+// own copy of the layout
+func visitorPage(page string) *template.Template {
+	return template.Must(template.Must(visitorPageLayout.Clone()).Parse(page))
+}
+
+// writeVisitorPage responds with status and page rendered from data. The
+// pages say why the tunnel isn't answering right now, so they're never cached.
+func writeVisitorPage(w http.ResponseWriter, status int, page *template.Template, data any) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	page.Execute(w, data)
+}
@@ -0,0 +1,25 @@
+// internal/relay/visitorpage_test.go
+package relay
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWriteVisitorPage(t *testing.T) {
+	page := visitorPage(`{{define "title"}}Closed{{end}}{{define "content"}}<p><code>{{.}}</code> is closed</p>{{end}}`)
+	rec := httptest.NewRecorder()
+	writeVisitorPage(rec, http.StatusServiceUnavailable, page, "<app>.example.com")
+
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Cache-Control") != "no-store" {
+		t.Errorf("status = %d, Cache-Control = %q, want 503 and no-store", rec.Code, rec.Header().Get("Cache-Control"))
+	}
+	body := rec.Body.String()
+	for _, want := range []string{"<title>Closed</title>", "<main>", "<code>&lt;app&gt;.example.com</code> is closed"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("body = %q, want it to contain %q", body, want)
+		}
+	}
+}
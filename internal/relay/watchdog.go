@@ -0,0 +1,225 @@
+// internal/relay/watchdog.go
+package relay
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"runtime/metrics"
+	"runtime/pprof"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// watchdogSamples is how many samples the memory watchdog keeps: the
+// window growth is measured over, and what GET /_lobber/admin/memory lists
+const watchdogSamples = 60
+
+// Growth smaller than these isn't reported, however large a share of
+// where it started, so an idle relay warming up stays quiet
+const (
+	watchdogHeapFloor      = 64 << 20
+	watchdogGoroutineFloor = 1000
+)
+
+// watchdogDumpGap is the least time between heap profiles written for
+// anomalies, so a relay stuck past a threshold doesn't fill its disk
+const watchdogDumpGap = 10 * time.Minute
+
+// MemorySample is the relay's memory and tunnel bookkeeping at one moment
+type MemorySample struct {
+	Time       time.Time `json:"time"`
+	RSS        uint64    `json:"rss"`  // resident set size; 0 where the system doesn't report it
+	Heap       uint64    `json:"heap"` // live and not yet swept heap objects
+	Goroutines int       `json:"goroutines"`
+	Tunnels    int       `json:"tunnels"` // hostnames in the tunnel map
+	Closed     int       `json:"closed"`  // of those, tunnels already closed, which should have been dropped
+	Held       int       `json:"held"`    // hostnames held for dropped tunnels to resume
+	Anomalies  []string  `json:"anomalies,omitempty"`
+}
+
+// watchdog keeps the relay's recent memory samples and spots leaks in them
+type watchdog struct {
+	growth float64 // see ServerConfig.WatchdogGrowth
+
+	mu       sync.Mutex
+	samples  []MemorySample // oldest first
+	dumpedAt time.Time      // when a heap profile was last written
+}
+
+// add records s, filling in the anomalies it shows against the samples
+// before it
+func (w *watchdog) add(s MemorySample) MemorySample {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	s.Anomalies = w.check(s)
+	if len(w.samples) == watchdogSamples {
+		w.samples = append(w.samples[:0], w.samples[1:]...)
+	}
+	w.samples = append(w.samples, s)
+	return s
+}
+
+// check returns what looks wrong with s. Callers hold mu.
+func (w *watchdog) check(s MemorySample) []string {
+	var found []string
+	if len(w.samples) > 0 {
+		// One sample can catch a tunnel between closing and being dropped
+		if prev := w.samples[len(w.samples)-1]; prev.Closed > 0 && s.Closed > 0 {
+			found = append(found, fmt.Sprintf("%d closed tunnels still registered", s.Closed))
+		}
+
+		// Growth is measured from the window's low point, and only counts
+		// if tunnels didn't grow as much to explain it
+		heapLow, routinesLow := w.samples[0], w.samples[0]
+		for _, prev := range w.samples[1:] {
+			if prev.Heap < heapLow.Heap {
+				heapLow = prev
+			}
+			if prev.Goroutines < routinesLow.Goroutines {
+				routinesLow = prev
+			}
+		}
+		if w.grewAlone(float64(heapLow.Heap), float64(s.Heap), watchdogHeapFloor, heapLow.Tunnels, s.Tunnels) {
+			found = append(found, fmt.Sprintf("heap grew from %dMB to %dMB since %s while tunnels went from %d to %d",
+				heapLow.Heap>>20, s.Heap>>20, heapLow.Time.Format(time.TimeOnly), heapLow.Tunnels, s.Tunnels))
+		}
+		if w.grewAlone(float64(routinesLow.Goroutines), float64(s.Goroutines), watchdogGoroutineFloor, routinesLow.Tunnels, s.Tunnels) {
+			found = append(found, fmt.Sprintf("goroutines grew from %d to %d since %s while tunnels went from %d to %d",
+				routinesLow.Goroutines, s.Goroutines, routinesLow.Time.Format(time.TimeOnly), routinesLow.Tunnels, s.Tunnels))
+		}
+	}
+	if limit := debug.SetMemoryLimit(-1); limit != math.MaxInt64 && s.RSS > uint64(limit) {
+		found = append(found, fmt.Sprintf("RSS %dMB is over GOMEMLIMIT %dMB", s.RSS>>20, limit>>20))
+	}
+	return found
+}
+
+// grewAlone reports whether a measure went from low to now by more than
+// the growth factor and floor, while tunnels grew by less than that factor
+func (w *watchdog) grewAlone(low, now, floor float64, lowTunnels, tunnels int) bool {
+	if w.growth <= 1 || now-low < floor || now < low*w.growth {
+		return false
+	}
+	return float64(tunnels+1) < float64(lowTunnels+1)*w.growth
+}
+
+// recent returns the samples kept, newest first
+func (w *watchdog) recent() []MemorySample {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	samples := make([]MemorySample, len(w.samples))
+	for i, s := range w.samples {
+		samples[len(samples)-1-i] = s
+	}
+	return samples
+}
+
+// dueDump reports whether a heap profile may be written now, and if so
+// counts it as written
+func (w *watchdog) dueDump(now time.Time) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.dumpedAt.IsZero() && now.Sub(w.dumpedAt) < watchdogDumpGap {
+		return false
+	}
+	w.dumpedAt = now
+	return true
+}
+
+// watchMemory samples the relay for the watchdog, logs what looks wrong
+// and writes a heap profile to HeapProfileDir when something does
+func (s *Server) watchMemory(ctx context.Context) error {
+	sample := s.watchdog.add(s.sampleMemory())
+	for _, a := range sample.Anomalies {
+		log.Printf("memory watchdog: %s", a)
+	}
+	if len(sample.Anomalies) == 0 || s.config.HeapProfileDir == "" || !s.watchdog.dueDump(sample.Time) {
+		return nil
+	}
+	path, err := writeHeapProfile(s.config.HeapProfileDir, sample.Time)
+	if err != nil {
+		return fmt.Errorf("write heap profile: %w", err)
+	}
+	log.Printf("memory watchdog: wrote heap profile %s", path)
+	return nil
+}
+
+// sampleMemory measures the relay for the watchdog
+func (s *Server) sampleMemory() MemorySample {
+	sample := MemorySample{
+		Time:       time.Now(),
+		RSS:        residentBytes(),
+		Goroutines: runtime.NumGoroutine(),
+	}
+	heap := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+	metrics.Read(heap)
+	if heap[0].Value.Kind() == metrics.KindUint64 {
+		sample.Heap = heap[0].Value.Uint64()
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	sample.Tunnels = len(s.tunnels)
+	sample.Held = len(s.held)
+	for _, t := range s.tunnels {
+		if t.GetState() == TunnelStateClosed {
+			sample.Closed++
+		}
+	}
+	return sample
+}
+
+// residentBytes returns the process's resident set size, or 0 where the
+// system doesn't report it
+func residentBytes() uint64 {
+	statm, err := os.ReadFile("/proc/self/statm")
+	if err != nil {
+		return 0
+	}
+	fields := strings.Fields(string(statm))
+	if len(fields) < 2 {
+		return 0
+	}
+	pages, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return pages * uint64(os.Getpagesize())
+}
+
+// writeHeapProfile writes the heap profile to a file in dir named for
+// when it was taken, for `go tool pprof`, and returns its path
+func writeHeapProfile(dir string, at time.Time) (string, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, "heap-"+at.UTC().Format("20060102T150405Z")+".pprof")
+	f, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	if err := pprof.Lookup("heap").WriteTo(f, 0); err != nil {
+		f.Close()
+		return "", err
+	}
+	return path, f.Close()
+}
+
+// handleAdminMemory lists the memory watchdog's recent samples, newest
+// first, with what looked wrong in each
+func (s *Server) handleAdminMemory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, s.watchdog.recent())
+}
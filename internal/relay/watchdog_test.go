@@ -0,0 +1,91 @@
+// internal/relay/watchdog_test.go
+package relay
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWatchdogAnomalies(t *testing.T) {
+	const mb = 1 << 20
+	tests := []struct {
+		name    string
+		samples []MemorySample // the last is checked against the others
+		want    string         // start of the anomaly reported; empty for none
+	}{
+		{"steady", []MemorySample{{Heap: 100 * mb, Tunnels: 10}, {Heap: 120 * mb, Tunnels: 10}}, ""},
+		{"heap grows with tunnels", []MemorySample{{Heap: 100 * mb, Tunnels: 10}, {Heap: 300 * mb, Tunnels: 40}}, ""},
+		{"heap grows alone", []MemorySample{{Heap: 100 * mb, Tunnels: 10}, {Heap: 300 * mb, Tunnels: 10}}, "heap grew from 100MB to 300MB"},
+		{"heap measured from its low", []MemorySample{{Heap: 150 * mb}, {Heap: 100 * mb}, {Heap: 140 * mb}, {Heap: 250 * mb}}, "heap grew from 100MB"},
+		{"small heap growth", []MemorySample{{Heap: mb}, {Heap: 10 * mb}}, ""},
+		{"goroutines grow alone", []MemorySample{{Goroutines: 500, Tunnels: 5}, {Goroutines: 3000, Tunnels: 5}}, "goroutines grew from 500 to 3000"},
+		{"tunnel caught closing", []MemorySample{{Tunnels: 3}, {Tunnels: 3, Closed: 1}}, ""},
+		{"closed tunnels left registered", []MemorySample{{Tunnels: 3, Closed: 1}, {Tunnels: 3, Closed: 2}}, "2 closed tunnels still registered"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &watchdog{growth: 2}
+			var last MemorySample
+			for _, s := range tt.samples {
+				last = w.add(s)
+			}
+			got := strings.Join(last.Anomalies, "; ")
+			if tt.want == "" && got != "" {
+				t.Errorf("anomalies = %q, want none", got)
+			}
+			if tt.want != "" && !strings.HasPrefix(got, tt.want) {
+				t.Errorf("anomalies = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	// The window slides, oldest samples dropped
+	w := &watchdog{growth: 2}
+	for i := range watchdogSamples + 5 {
+		w.add(MemorySample{Goroutines: i})
+	}
+	recent := w.recent()
+	if len(recent) != watchdogSamples || recent[0].Goroutines != watchdogSamples+4 || recent[len(recent)-1].Goroutines != 5 {
+		t.Errorf("recent() = %d samples from %d to %d, want %d from %d to 5",
+			len(recent), recent[0].Goroutines, recent[len(recent)-1].Goroutines, watchdogSamples, watchdogSamples+4)
+	}
+}
+
+func TestWatchMemoryWritesHeapProfile(t *testing.T) {
+	config := DefaultServerConfig()
+	config.HeapProfileDir = t.TempDir()
+	s := NewServerWithConfig(nil, config)
+
+	// A closed tunnel its cleanup never dropped
+	s.mu.Lock()
+	s.tunnels["app.example.com"] = &Tunnel{Domain: "app.example.com", state: TunnelStateClosed}
+	s.mu.Unlock()
+
+	for range 3 {
+		if err := s.watchMemory(context.Background()); err != nil {
+			t.Fatalf("watchMemory() error = %v", err)
+		}
+	}
+	recent := s.watchdog.recent()
+	if len(recent) != 3 || len(recent[0].Anomalies) != 1 || recent[0].Tunnels != 1 || recent[0].Closed != 1 {
+		t.Fatalf("recent() = %+v, want 3 samples, the newest reporting the closed tunnel", recent)
+	}
+
+	// One profile, however many samples report something in a row
+	entries, err := os.ReadDir(config.HeapProfileDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || !strings.HasPrefix(entries[0].Name(), "heap-") {
+		t.Fatalf("profiles written = %v, want one", entries)
+	}
+	if info, _ := entries[0].Info(); info.Size() == 0 {
+		t.Error("heap profile is empty")
+	}
+	if s.watchdog.dueDump(time.Now()) {
+		t.Error("dueDump() = true right after a profile, want false")
+	}
+}
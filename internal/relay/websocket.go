@@ -0,0 +1,40 @@
+// internal/relay/websocket.go
+package relay
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/lobber-dev/lobber/internal/tunnel"
+)
+
+// connectTransport returns the transport a connect request asks for the
+// tunnel to be carried over, tunnel.TransportTCP by default, and for a
+// WebSocket the key to answer its upgrade with
+func connectTransport(r *http.Request) (transport, key string, err error) {
+	switch t := r.URL.Query().Get(tunnel.TransportParam); t {
+	case "", tunnel.TransportTCP:
+		return tunnel.TransportTCP, "", nil
+	case tunnel.TransportQUIC:
+		if !overQUIC(r) {
+			return "", "", errors.New("the QUIC transport is only taken over QUIC")
+		}
+		return t, "", nil
+	case tunnel.TransportWebSocket:
+	default:
+		return "", "", errors.New("unsupported transport " + t)
+	}
+	if r.Method != http.MethodGet || !strings.EqualFold(upgradeProtocol(r), "websocket") {
+		return "", "", errors.New("a WebSocket transport needs a GET with Upgrade: websocket")
+	}
+	if v := r.Header.Get("Sec-WebSocket-Version"); v != "13" {
+		return "", "", errors.New("unsupported Sec-WebSocket-Version " + v + "; want 13")
+	}
+	key = r.Header.Get("Sec-WebSocket-Key")
+	if b, err := base64.StdEncoding.DecodeString(key); err != nil || len(b) != 16 {
+		return "", "", errors.New("invalid Sec-WebSocket-Key")
+	}
+	return tunnel.TransportWebSocket, key, nil
+}
@@ -0,0 +1,52 @@
+// internal/relay/websocket_test.go
+package relay
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/lobber-dev/lobber/internal/tunnel"
+)
+
+func TestConnectTransport(t *testing.T) {
+	upgrade := map[string]string{
+		"Connection":            "keep-alive, Upgrade",
+		"Upgrade":               "websocket",
+		"Sec-WebSocket-Version": "13",
+		"Sec-WebSocket-Key":     "dGhlIHNhbXBsZSBub25jZQ==",
+	}
+	tests := []struct {
+		name    string
+		method  string
+		query   string
+		headers map[string]string
+		ws      bool
+		wantErr bool
+	}{
+		{"default", "POST", "", nil, false, false},
+		{"tcp", "POST", "?transport=tcp", nil, false, false},
+		{"websocket", "GET", "?transport=ws", upgrade, true, false},
+		{"unknown", "POST", "?transport=sctp", nil, false, true},
+		{"quic over TCP", "POST", "?transport=quic", nil, false, true},
+		{"websocket without upgrade", "GET", "?transport=ws", nil, false, true},
+		{"websocket over POST", "POST", "?transport=ws", upgrade, false, true},
+		{"old version", "GET", "?transport=ws", map[string]string{"Connection": "Upgrade", "Upgrade": "websocket", "Sec-WebSocket-Version": "8", "Sec-WebSocket-Key": "dGhlIHNhbXBsZSBub25jZQ=="}, false, true},
+		{"bad key", "GET", "?transport=ws", map[string]string{"Connection": "Upgrade", "Upgrade": "websocket", "Sec-WebSocket-Version": "13", "Sec-WebSocket-Key": "short"}, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/_lobber/connect"+tt.query, nil)
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+			transport, key, err := connectTransport(r)
+			ws := transport == tunnel.TransportWebSocket
+			if ws != tt.ws || (err != nil) != tt.wantErr {
+				t.Errorf("connectTransport() = %q, %v, want WebSocket %v, error %v", transport, err, tt.ws, tt.wantErr)
+			}
+			if ws && key != upgrade["Sec-WebSocket-Key"] {
+				t.Errorf("key = %q, want the request's", key)
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+// internal/relay/welcome.go
+package relay
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lobber-dev/lobber/internal/tunnel"
+)
+
+// wantsFeature reports whether a connect request lists feature in its
+// FeaturesHeader
+func wantsFeature(r *http.Request, feature string) bool {
+	for _, v := range r.Header.Values(tunnel.FeaturesHeader) {
+		for f := range strings.SplitSeq(v, ",") {
+			if strings.TrimSpace(f) == feature {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// legacyFeatures are offered to clients whether or not they list them, as
+// clients used them before listing the features they speak
+var legacyFeatures = []string{tunnel.FeatureHeartbeat, tunnel.FeatureMetadata}
+
+// offer returns the features this relay offers a connect request: those it
+// has enabled that the client speaks
+func (s *Server) offer(r *http.Request) []string {
+	var features []string
+	for _, f := range s.config.Features {
+		if wantsFeature(r, f) || slices.Contains(legacyFeatures, f) {
+			features = append(features, f)
+		}
+	}
+	return features
+}
+
+// publicURL returns where visitors reach hostname: the scheme and port the
+// tunnel's client used to reach the relay, as visitors come in the same way
+func publicURL(r *http.Request, hostname string) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	host := hostname
+	if _, port, err := net.SplitHostPort(r.Host); err == nil && port != "80" && port != "443" {
+		host = net.JoinHostPort(hostname, port)
+	}
+	return scheme + "://" + host + "/"
+}
+
+// welcome describes the tunnel a connect request was granted. Plan and
+// bandwidth lookups that fail are left out rather than refusing the tunnel.
+func (s *Server) welcome(r *http.Request, hostname, userID string, features []string, burst BurstPolicy, share tunnel.ShareLimits, udpPort int) *tunnel.Welcome {
+	w := &tunnel.Welcome{
+		URLs:             []string{publicURL(r, hostname)},
+		HeartbeatSeconds: int(s.config.HeartbeatInterval.Seconds()),
+		Features:         features,
+		Version:          tunnel.ProtocolVersion,
+	}
+	for _, f := range features {
+		if slices.Contains(s.config.Deprecated, f) {
+			w.Deprecated = append(w.Deprecated, f)
+		}
+	}
+	if udpPort > 0 {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		}
+		w.URLs = []string{"udp://" + net.JoinHostPort(host, strconv.Itoa(udpPort))}
+	}
+	if burst.Factor > 0 {
+		w.Limits.BurstFloor = burst.Floor
+	}
+	w.Limits.ShareRequests = share.MaxRequests
+	w.Limits.ShareTTLSeconds = int(share.TTL.Seconds())
+	w.Limits.RetentionSeconds = s.retentionSeconds("")
+	if userID == "anonymous" {
+		return w
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+	if user, err := s.stores.Users.GetUser(ctx, userID); err == nil {
+		w.Plan = user.Plan
+		w.Limits.RetentionSeconds = s.retentionSeconds(user.Plan)
+	}
+	if s.billingService != nil {
+		_, used, limit, err := s.billingService.CheckQuota(ctx, userID)
+		if err != nil {
+			log.Printf("connect: quota for %s: %v", hostname, err)
+		} else {
+			w.Limits.UsedBytes = used
+			w.Limits.MonthlyBytes = max(limit, 0) // -1 means unlimited
+		}
+	}
+	return w
+}
+
+// retentionSeconds is how long plan keeps request logs, which the client's
+// inspector keeps its captured requests for too. Zero keeps them.
+func (s *Server) retentionSeconds(plan string) int {
+	p := s.config.Retention
+	if p == nil {
+		return 0
+	}
+	d, ok := p.RequestLogs[plan]
+	if !ok {
+		d = p.DefaultRequestLogs
+	}
+	return int(d.Seconds())
+}
@@ -0,0 +1,107 @@
+// internal/relay/window.go
+package relay
+
+import (
+	"context"
+	"errors"
+
+	"github.com/lobber-dev/lobber/internal/tunnel"
+)
+
+// connWindow is the room t's client granted for requests in flight, or
+// nil if it doesn't use tunnel.FeatureWindow
+func (t *Tunnel) connWindow() *tunnel.Credit {
+	if !t.uses(tunnel.FeatureWindow) {
+		return nil
+	}
+	return t.window
+}
+
+// awaitRoom waits, for as long as a request may queue, until t's client
+// has room for a request with a body of bodySize bytes. Visitors' bodies
+// aren't read until it does, so a saturated tunnel holds them back rather
+// than buffering them.
+func (t *Tunnel) awaitRoom(ctx context.Context, bodySize int64) error {
+	ctx, cancel := t.saturation(ctx)
+	defer cancel()
+	return waitError(t.connWindow().Await(ctx, tunnel.RequestCost(bodySize, t.windowSize)))
+}
+
+// reserve takes room for pr from t's client's window, waiting as awaitRoom
+// does. The room is the client's to grant back once it has the request,
+// or refund's if it never gets it.
+func (t *Tunnel) reserve(ctx context.Context, pr *pendingRequest) error {
+	win := t.connWindow()
+	if win == nil {
+		return nil
+	}
+	ctx, cancel := t.saturation(ctx)
+	defer cancel()
+	cost := tunnel.RequestCost(int64(len(pr.req.Body)), t.windowSize)
+	if err := win.Acquire(ctx, cost); err != nil {
+		return waitError(err)
+	}
+	pr.cost.Store(cost)
+	return nil
+}
+
+// refund gives back the room reserved for pr, which won't reach the
+// client. It's safe to call more than once.
+func (t *Tunnel) refund(pr *pendingRequest) {
+	t.window.Grant(pr.cost.Swap(0))
+}
+
+// saturation bounds waiting for room in t's window like the pre-ready
+// queue, after which requests fail with errSaturated
+func (t *Tunnel) saturation(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeoutCause(ctx, t.config.PendingQueueTTL, errSaturated)
+}
+
+// waitError is why roundTrip gave up waiting for room, given err from the
+// wait
+func waitError(err error) error {
+	switch {
+	case errors.Is(err, context.Canceled):
+		return errVisitorGone
+	case errors.Is(err, tunnel.ErrCreditClosed):
+		return errTunnelClosed
+	}
+	return err
+}
+
+// grant hands a Window frame's room to the connection or stream it's for
+func (t *Tunnel) grant(win *tunnel.Window) {
+	if win.ID == "" {
+		t.window.Grant(win.Bytes)
+		return
+	}
+	t.streamMu.Lock()
+	st := t.streams[win.ID]
+	t.streamMu.Unlock()
+	if st != nil {
+		st.window.Grant(win.Bytes)
+	}
+}
+
+// streamWindow is the room a new stream starts with, nil if t's client
+// doesn't use tunnel.FeatureWindow
+func (t *Tunnel) streamWindow() *tunnel.Credit {
+	if t.connWindow() == nil {
+		return nil
+	}
+	return tunnel.NewCredit(tunnel.StreamWindow)
+}
+
+// writeWindow grants the client room for n more bytes of the stream with
+// id, once the relay has passed them on, if it uses tunnel.FeatureWindow
+func (t *Tunnel) writeWindow(id string, n int) error {
+	if n == 0 || t.connWindow() == nil {
+		return nil
+	}
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+	if err := tunnel.EncodeWindow(t.frames(), &tunnel.Window{ID: id, Bytes: int64(n)}); err != nil {
+		return err
+	}
+	return t.bufrw.Flush()
+}
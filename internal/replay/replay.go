@@ -0,0 +1,192 @@
+// internal/replay/replay.go
+package replay
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/lobber-dev/lobber/internal/publicnet"
+	"github.com/lobber-dev/lobber/internal/sampling"
+)
+
+// Header marks a replayed request with the hostname it was copied from.
+// Requests that already carry it aren't replayed again, so two domains
+// replaying into each other don't loop.
+const Header = "X-Lobber-Replay"
+
+// MaxLength caps a target's text
+const MaxLength = 500
+
+// queueSize is how many copies can wait to be sent. When the targets fall
+// behind, copies are dropped rather than slowing down the proxy.
+const queueSize = 256
+
+// sendTimeout bounds sending one copy
+const sendTimeout = 10 * time.Second
+
+// credentialHeaders are never replayed: a staging copy of the traffic
+// mustn't act as the visitors who sent it
+var credentialHeaders = []string{"Authorization", "Cookie", "Proxy-Authorization"}
+
+// Target is where a domain's traffic is replayed, written as an https://
+// URL optionally followed by a sampling policy choosing which requests:
+//
+//	https://staging.example.com
+//	https://staging.example.com/mirror path:/webhooks/*, 10%
+//
+// A request for /webhooks/stripe is replayed to the URL's path joined with
+// it, here /mirror/webhooks/stripe.
+type Target struct {
+	text   string
+	url    *url.URL
+	policy *sampling.Policy // nil replays every request
+}
+
+// Parse reads a target
+func Parse(s string) (*Target, error) {
+	s = strings.Join(strings.Fields(s), " ")
+	if len(s) > MaxLength {
+		return nil, fmt.Errorf("replay target is longer than %d characters", MaxLength)
+	}
+	raw, rules, _ := strings.Cut(s, " ")
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme != "https" || u.Host == "" || u.User != nil || u.RawQuery != "" || u.Fragment != "" {
+		return nil, fmt.Errorf("invalid replay URL %q, want e.g. https://staging.example.com", raw)
+	}
+	if addr, err := netip.ParseAddr(strings.Trim(u.Hostname(), "[]")); err == nil && !publicnet.Public(addr) {
+		return nil, fmt.Errorf("invalid replay URL %q: it must be a public host", raw)
+	}
+	t := &Target{text: s, url: u}
+	if rules != "" {
+		if t.policy, err = sampling.Parse(rules); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// String returns the target as it was written, with spacing normalized
+func (t *Target) String() string {
+	return t.text
+}
+
+// Keep reports whether to replay a request for path, without its query,
+// that was answered with status
+func (t *Target) Keep(path string, status int) bool {
+	return t.policy == nil || t.policy.Keep(path, status)
+}
+
+// Request is a copy of a proxied request, scrubbed as the caller's rules
+// say
+type Request struct {
+	Hostname string // the domain it was sent to
+	Method   string
+	Path     string // with its query
+	Headers  map[string][]string
+	Body     []byte
+}
+
+type job struct {
+	target *Target
+	req    Request
+}
+
+// Replayer sends copies of requests to their domains' targets in the
+// background
+type Replayer struct {
+	client *http.Client
+	queue  chan job
+}
+
+// NewReplayer returns a Replayer sending with client, or if nil one that
+// only dials public addresses
+func NewReplayer(client *http.Client) *Replayer {
+	if client == nil {
+		client = publicClient()
+	}
+	return &Replayer{client: client, queue: make(chan job, queueSize)}
+}
+
+// Send queues a copy of req for t without blocking, reporting false if the
+// queue is full and it was dropped
+func (r *Replayer) Send(t *Target, req Request) bool {
+	select {
+	case r.queue <- job{target: t, req: req}:
+		return true
+	default:
+		return false
+	}
+}
+
+// Run sends queued copies until ctx ends. Failures are logged, and the
+// copy is not retried.
+func (r *Replayer) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case j := <-r.queue:
+			if err := r.send(ctx, j.target, j.req); err != nil && ctx.Err() == nil {
+				log.Printf("replay %s %s for %s: %v", j.req.Method, j.req.Path, j.req.Hostname, err)
+			}
+		}
+	}
+}
+
+// send replays req to t, treating any 5xx answer as a failure
+func (r *Replayer) send(ctx context.Context, t *Target, req Request) error {
+	// Joined by hand, as resolving a path such as //elsewhere/ against the
+	// URL would change its host
+	ref, err := url.ParseRequestURI(req.Path)
+	if err != nil || ref.Scheme != "" {
+		return fmt.Errorf("invalid path %q", req.Path)
+	}
+	target := *t.url
+	target.Path = strings.TrimSuffix(t.url.Path, "/") + ref.Path
+	target.RawPath = ""
+	if ref.RawPath != "" {
+		target.RawPath = strings.TrimSuffix(t.url.EscapedPath(), "/") + ref.RawPath
+	}
+	target.RawQuery = ref.RawQuery
+
+	ctx, cancel := context.WithTimeout(ctx, sendTimeout)
+	defer cancel()
+	out, err := http.NewRequestWithContext(ctx, req.Method, target.String(), bytes.NewReader(req.Body))
+	if err != nil {
+		return err
+	}
+	for k, vals := range req.Headers {
+		out.Header[http.CanonicalHeaderKey(k)] = vals
+	}
+	for _, name := range credentialHeaders {
+		out.Header.Del(name)
+	}
+	out.Header.Del("Content-Length")
+	out.Header.Set(Header, req.Hostname)
+
+	resp, err := r.client.Do(out)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("%s answered %d", target.Host, resp.StatusCode)
+	}
+	return nil
+}
+
+// publicClient refuses to dial addresses on the relay's own network, even
+// when a public name resolves to one
+func publicClient() *http.Client {
+	client := publicnet.Client(sendTimeout)
+	// A redirect is the target's answer, not a new place to replay to
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	return client
+}
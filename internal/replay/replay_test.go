@@ -0,0 +1,95 @@
+// internal/replay/replay_test.go
+package replay
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr string
+	}{
+		{"https://staging.example.com", "https://staging.example.com", ""},
+		{"  https://staging.example.com/mirror   path:/webhooks/*,  10% ", "https://staging.example.com/mirror path:/webhooks/*, 10%", ""},
+		{"http://staging.example.com", "", "invalid replay URL"},
+		{"https://user:pw@staging.example.com", "", "invalid replay URL"},
+		{"https://staging.example.com?x=1", "", "invalid replay URL"},
+		{"https://10.0.0.5", "", "public host"},
+		{"https://[::1]:8443", "", "public host"},
+		{"https://staging.example.com sometimes", "", "invalid sampling rule"},
+		{"https://staging.example.com/" + strings.Repeat("a", MaxLength), "", "longer than"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := Parse(tt.in)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("Parse() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || got.String() != tt.want {
+				t.Errorf("Parse() = %v, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+
+	target, _ := Parse("https://staging.example.com path:/webhooks/*")
+	if !target.Keep("/webhooks/stripe", 200) || target.Keep("/", 200) {
+		t.Error("Keep() ignores the target's sampling policy")
+	}
+}
+
+func TestReplayerSend(t *testing.T) {
+	got := make(chan *http.Request, 1)
+	bodies := make(chan string, 1)
+	staging := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		got <- r
+		bodies <- string(body)
+	}))
+	defer staging.Close()
+
+	target, err := Parse(staging.URL + "/mirror/")
+	if err == nil {
+		t.Fatalf("Parse(%s) accepted a loopback address", staging.URL)
+	}
+	u, _ := url.Parse(staging.URL + "/mirror/")
+	target = &Target{url: u}
+
+	x := NewReplayer(staging.Client())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go x.Run(ctx)
+	x.Send(target, Request{
+		Hostname: "app.example.com",
+		Method:   "POST",
+		Path:     "//evil.example.com/hooks%2Fstripe?id=7",
+		Headers:  map[string][]string{"Content-Type": {"application/json"}, "Cookie": {"session=secret"}, "Stripe-Signature": {"t=1"}},
+		Body:     []byte(`{"ok":true}`),
+	})
+
+	select {
+	case r := <-got:
+		if r.Method != "POST" || r.URL.RequestURI() != "/mirror//evil.example.com/hooks%2Fstripe?id=7" {
+			t.Errorf("replayed %s %s, want the path under /mirror", r.Method, r.URL.RequestURI())
+		}
+		if r.Header.Get(Header) != "app.example.com" || r.Header.Get("Cookie") != "" || r.Header.Get("Stripe-Signature") != "t=1" {
+			t.Errorf("headers = %v, want the replay header and no cookies", r.Header)
+		}
+		if body := <-bodies; body != `{"ok":true}` {
+			t.Errorf("body = %q, want the original", body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing replayed")
+	}
+}
@@ -0,0 +1,96 @@
+// internal/respheader/respheader.go
+package respheader
+
+import (
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"strings"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+// MaxLength caps a set's text
+const MaxLength = 4000
+
+// reserved are headers the relay owns: they frame the response or describe
+// the visitor's connection, so a domain can't set them
+var reserved = map[string]bool{
+	"Connection":        true,
+	"Content-Encoding":  true,
+	"Content-Length":    true,
+	"Keep-Alive":        true,
+	"Proxy-Connection":  true,
+	"Te":                true,
+	"Trailer":           true,
+	"Transfer-Encoding": true,
+	"Upgrade":           true,
+}
+
+// Set is the headers the relay adds to every response a domain serves to
+// visitors, such as security headers or X-Robots-Tag, one per line:
+//
+//	X-Robots-Tag: noindex
+//	Strict-Transport-Security: max-age=63072000
+//
+// A header named more than once keeps every value. Headers in the set
+// replace any the local server sent under the same name.
+type Set struct {
+	text   string
+	fields []field
+}
+
+type field struct {
+	name, value string
+}
+
+// Parse reads a set. An empty string is not a set; callers treat it as
+// adding nothing.
+func Parse(s string) (*Set, error) {
+	set := &Set{}
+	var lines []string
+	for line := range strings.Lines(s) {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(line, ":")
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		if !ok || !httpguts.ValidHeaderFieldName(name) {
+			return nil, fmt.Errorf("invalid header %q, want e.g. X-Robots-Tag: noindex", line)
+		}
+		if !httpguts.ValidHeaderFieldValue(value) {
+			return nil, fmt.Errorf("invalid value for header %s", name)
+		}
+		name = textproto.CanonicalMIMEHeaderKey(name)
+		if reserved[name] {
+			return nil, fmt.Errorf("header %s is set by the relay and can't be added", name)
+		}
+		set.fields = append(set.fields, field{name, value})
+		lines = append(lines, name+": "+value)
+	}
+	if len(lines) == 0 {
+		return nil, fmt.Errorf("empty header set")
+	}
+	set.text = strings.Join(lines, "\n")
+	if len(set.text) > MaxLength {
+		return nil, fmt.Errorf("headers are longer than %d characters", MaxLength)
+	}
+	return set, nil
+}
+
+// String returns the set as it was written, one header per line with
+// names canonicalized and spacing normalized
+func (s *Set) String() string {
+	return s.text
+}
+
+// Apply adds the set to h, replacing values under the same names
+func (s *Set) Apply(h http.Header) {
+	for _, f := range s.fields {
+		h.Del(f.name)
+	}
+	for _, f := range s.fields {
+		h.Add(f.name, f.value)
+	}
+}
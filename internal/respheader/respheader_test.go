@@ -0,0 +1,60 @@
+// internal/respheader/respheader_test.go
+package respheader
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    string
+		wantErr string
+	}{
+		{"one", "X-Robots-Tag: noindex", "X-Robots-Tag: noindex", ""},
+		{"normalized", "\n  x-robots-tag:noindex \r\n\nstrict-transport-security :  max-age=63072000; includeSubDomains\n", "X-Robots-Tag: noindex\nStrict-Transport-Security: max-age=63072000; includeSubDomains", ""},
+		{"empty value", "X-Empty:", "X-Empty: ", ""},
+		{"blank", " \n ", "", "empty header set"},
+		{"no colon", "X-Robots-Tag noindex", "", "invalid header"},
+		{"bad name", "X Robots: noindex", "", "invalid header"},
+		{"bad value", "X-Robots-Tag: no\x00index", "", "invalid value"},
+		{"framing", "transfer-encoding: chunked", "", "Transfer-Encoding is set by the relay"},
+		{"too long", "X-Long: " + strings.Repeat("a", MaxLength), "", "longer than"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse(tt.in)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("Parse() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || got.String() != tt.want {
+				t.Errorf("Parse() = %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestApply(t *testing.T) {
+	set, err := Parse("X-Robots-Tag: noindex\nX-Frame-Options: DENY\nLink: </a.css>; rel=preload\nLink: </b.js>; rel=preload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := http.Header{"X-Frame-Options": {"SAMEORIGIN"}, "Link": {"</c.css>"}, "Content-Type": {"text/html"}}
+	set.Apply(h)
+	want := http.Header{
+		"X-Robots-Tag":    {"noindex"},
+		"X-Frame-Options": {"DENY"},
+		"Link":            {"</a.css>; rel=preload", "</b.js>; rel=preload"},
+		"Content-Type":    {"text/html"},
+	}
+	if !reflect.DeepEqual(h, want) {
+		t.Errorf("Apply() = %v, want %v", h, want)
+	}
+}
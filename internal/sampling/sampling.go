@@ -0,0 +1,118 @@
+// internal/sampling/sampling.go
+package sampling
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+)
+
+// MaxLength caps a policy's text
+const MaxLength = 200
+
+// Policy decides which of a domain's proxied requests its request log keeps,
+// to hold down storage and keep sensitive paths out of it. It is a comma-
+// separated list of rules, and a request is kept if any rule matches:
+//
+//	all          every request (the default)
+//	none         no requests
+//	errors       responses with a 4xx or 5xx status
+//	1%           a random share of requests; fractions like 0.5% work
+//	path:/api/*  requests whose path matches; * matches anything, even /
+//
+// For example "errors, 1%" keeps every failure and a sample of the rest.
+type Policy struct {
+	text  string
+	rules []rule
+}
+
+type rule struct {
+	all     bool
+	errors  bool
+	percent float64 // share of requests kept when above 0
+	pattern string  // path glob when not empty
+}
+
+// Parse reads a policy. An empty string is not a policy; callers treat it
+// as "all".
+func Parse(s string) (*Policy, error) {
+	s = strings.Join(strings.Fields(s), " ")
+	if s == "" {
+		return nil, fmt.Errorf("empty sampling policy")
+	}
+	if len(s) > MaxLength {
+		return nil, fmt.Errorf("sampling policy is longer than %d characters", MaxLength)
+	}
+
+	p := &Policy{text: s}
+	for part := range strings.SplitSeq(s, ",") {
+		part = strings.TrimSpace(part)
+		var r rule
+		switch {
+		case strings.EqualFold(part, "all"):
+			r.all = true
+		case strings.EqualFold(part, "none"):
+			// Matches nothing, so only other rules keep requests
+		case strings.EqualFold(part, "errors"):
+			r.errors = true
+		case strings.HasSuffix(part, "%"):
+			pct, err := strconv.ParseFloat(strings.TrimSuffix(part, "%"), 64)
+			if err != nil || pct <= 0 || pct > 100 {
+				return nil, fmt.Errorf("invalid sample rate %q, want e.g. 1%%", part)
+			}
+			r.percent = pct
+		case strings.HasPrefix(part, "path:"):
+			r.pattern = strings.TrimPrefix(part, "path:")
+			if !strings.HasPrefix(r.pattern, "/") {
+				return nil, fmt.Errorf("invalid path pattern %q, want e.g. path:/api/*", part)
+			}
+		default:
+			return nil, fmt.Errorf("invalid sampling rule %q, want all, none, errors, a rate such as 1%% or path:/api/*", part)
+		}
+		p.rules = append(p.rules, r)
+	}
+	return p, nil
+}
+
+// String returns the policy as it was written, with spacing normalized
+func (p *Policy) String() string {
+	return p.text
+}
+
+// Keep reports whether to log a request for path, without its query, that
+// was answered with status
+func (p *Policy) Keep(path string, status int) bool {
+	for _, r := range p.rules {
+		switch {
+		case r.all,
+			r.errors && status >= 400,
+			r.percent > 0 && rand.Float64()*100 < r.percent,
+			r.pattern != "" && match(r.pattern, path):
+			return true
+		}
+	}
+	return false
+}
+
+// match reports whether path matches pattern, where * stands for any run
+// of characters
+func match(pattern, path string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return path == pattern
+	}
+	if !strings.HasPrefix(path, parts[0]) {
+		return false
+	}
+	path = path[len(parts[0]):]
+	last := len(parts) - 1
+	for _, part := range parts[1:last] {
+		i := strings.Index(path, part)
+		if i < 0 {
+			return false
+		}
+		path = path[i+len(part):]
+	}
+	return strings.HasSuffix(path, parts[last])
+}
@@ -0,0 +1,81 @@
+// internal/sampling/sampling_test.go
+package sampling
+
+import "testing"
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{"all", "all", false},
+		{" errors ,  1% ", "errors , 1%", false},
+		{"path:/api/*, 0.5%", "path:/api/*, 0.5%", false},
+		{"none", "none", false},
+		{"", "", true},
+		{"0%", "", true},
+		{"150%", "", true},
+		{"some%", "", true},
+		{"path:api/*", "", true},
+		{"warnings", "", true},
+	}
+
+	for _, tt := range tests {
+		got, err := Parse(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Parse(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if err == nil && got.String() != tt.want {
+			t.Errorf("Parse(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestKeep(t *testing.T) {
+	tests := []struct {
+		policy string
+		path   string
+		status int
+		want   bool
+	}{
+		{"all", "/", 200, true},
+		{"none", "/", 500, false},
+		{"errors", "/", 200, false},
+		{"errors", "/", 404, true},
+		{"errors", "/", 502, true},
+		{"100%", "/", 200, true},
+		{"path:/api/*", "/api/v1/users", 200, true},
+		{"path:/api/*", "/app/api/x", 200, false},
+		{"path:/webhooks/*/stripe", "/webhooks/acct_1/stripe", 200, true},
+		{"path:/webhooks/*/stripe", "/webhooks/acct_1/github", 200, false},
+		{"path:/health", "/health", 200, true},
+		{"path:/health", "/healthz", 200, false},
+		{"errors, path:/checkout*", "/checkout/confirm", 200, true},
+		{"errors, path:/checkout*", "/", 200, false},
+	}
+
+	for _, tt := range tests {
+		p, err := Parse(tt.policy)
+		if err != nil {
+			t.Fatalf("Parse(%q) error = %v", tt.policy, err)
+		}
+		if got := p.Keep(tt.path, tt.status); got != tt.want {
+			t.Errorf("Parse(%q).Keep(%q, %d) = %v, want %v", tt.policy, tt.path, tt.status, got, tt.want)
+		}
+	}
+}
+
+func TestKeepSamplesRate(t *testing.T) {
+	p, _ := Parse("10%")
+	kept := 0
+	for range 10000 {
+		if p.Keep("/", 200) {
+			kept++
+		}
+	}
+	if kept < 700 || kept > 1300 {
+		t.Errorf("10%% kept %d of 10000 requests, want about 1000", kept)
+	}
+}
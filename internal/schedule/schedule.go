@@ -0,0 +1,199 @@
+// internal/schedule/schedule.go
+package schedule
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	// Schedules name IANA time zones; don't depend on the host having them
+	_ "time/tzdata"
+)
+
+// MaxLength caps a schedule's text
+const MaxLength = 200
+
+// days are the weekday abbreviations a schedule uses, Sunday first as in
+// time.Weekday
+var days = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// Schedule is the weekly availability of a domain, such as
+// "Mon-Fri 09:00-18:00 Europe/London". Windows are separated by commas; a
+// window without days applies every day, and one that ends before it
+// starts runs past midnight. An optional IANA time zone at the end applies
+// to every window and defaults to UTC.
+type Schedule struct {
+	text    string
+	loc     *time.Location
+	windows []window
+}
+
+type window struct {
+	days       [7]bool
+	start, end int // minutes since midnight; end may be 24*60
+}
+
+// Parse reads a schedule. An empty string is not a schedule; callers treat
+// it as "always available".
+func Parse(s string) (*Schedule, error) {
+	s = strings.Join(strings.Fields(s), " ")
+	if s == "" {
+		return nil, fmt.Errorf("empty schedule")
+	}
+	if len(s) > MaxLength {
+		return nil, fmt.Errorf("schedule is longer than %d characters", MaxLength)
+	}
+
+	sched := &Schedule{text: s, loc: time.UTC}
+	body := s
+	if i := strings.LastIndexByte(s, ' '); i >= 0 && !strings.ContainsAny(s[i+1:], ":,") {
+		// Something like "9am-6pm" is a mistyped window, not a zone
+		loc, err := time.LoadLocation(s[i+1:])
+		switch {
+		case err == nil:
+			sched.loc = loc
+			body = s[:i]
+		case !strings.ContainsAny(s[i+1:], "0123456789"):
+			return nil, fmt.Errorf("unknown time zone %q", s[i+1:])
+		}
+	}
+
+	for _, part := range strings.Split(body, ",") {
+		w, err := parseWindow(strings.TrimSpace(part))
+		if err != nil {
+			return nil, err
+		}
+		sched.windows = append(sched.windows, w)
+	}
+	return sched, nil
+}
+
+// parseWindow reads "Mon-Fri 09:00-18:00", "Sat 10:00-14:00" or "09:00-17:00"
+func parseWindow(s string) (window, error) {
+	var w window
+	fields := strings.Fields(s)
+	hours := ""
+	switch len(fields) {
+	case 1:
+		hours = fields[0]
+		for d := range w.days {
+			w.days[d] = true
+		}
+	case 2:
+		if err := w.parseDays(fields[0]); err != nil {
+			return w, err
+		}
+		hours = fields[1]
+	default:
+		return w, fmt.Errorf("invalid window %q, want e.g. Mon-Fri 09:00-18:00", s)
+	}
+
+	from, to, ok := strings.Cut(hours, "-")
+	if !ok {
+		return w, fmt.Errorf("invalid hours %q, want e.g. 09:00-18:00", hours)
+	}
+	var err error
+	if w.start, err = parseClock(from); err != nil {
+		return w, err
+	}
+	if w.end, err = parseClock(to); err != nil {
+		return w, err
+	}
+	if w.start == w.end || w.start == 24*60 {
+		return w, fmt.Errorf("invalid hours %q", hours)
+	}
+	return w, nil
+}
+
+// parseDays reads "Mon-Fri" or "Sat"
+func (w *window) parseDays(s string) error {
+	from, to, ranged := strings.Cut(strings.ToLower(s), "-")
+	first, last := dayIndex(from), dayIndex(to)
+	if !ranged {
+		last = first
+	}
+	if first < 0 || last < 0 {
+		return fmt.Errorf("invalid days %q, want e.g. Mon-Fri or Sat", s)
+	}
+	for d := first; ; d = (d + 1) % 7 {
+		w.days[d] = true
+		if d == last {
+			return nil
+		}
+	}
+}
+
+func dayIndex(s string) int {
+	for i, d := range days {
+		if s == d {
+			return i
+		}
+	}
+	return -1
+}
+
+// parseClock reads "09:00" as minutes since midnight; "24:00" ends a day
+func parseClock(s string) (int, error) {
+	var h, m int
+	if n, err := fmt.Sscanf(s, "%d:%d", &h, &m); n != 2 || err != nil || len(s) != 5 || h < 0 || m < 0 || m > 59 || h > 24 || (h == 24 && m > 0) {
+		return 0, fmt.Errorf("invalid time %q, want HH:MM", s)
+	}
+	return h*60 + m, nil
+}
+
+// String returns the schedule as it was written, with spacing normalized
+func (s *Schedule) String() string {
+	return s.text
+}
+
+// Location returns the time zone the schedule's hours are in
+func (s *Schedule) Location() *time.Location {
+	return s.loc
+}
+
+// Open reports whether t falls inside one of the schedule's windows
+func (s *Schedule) Open(t time.Time) bool {
+	t = t.In(s.loc)
+	day := int(t.Weekday())
+	yesterday := (day + 6) % 7
+	minute := t.Hour()*60 + t.Minute()
+	for _, w := range s.windows {
+		if w.start < w.end {
+			if w.days[day] && minute >= w.start && minute < w.end {
+				return true
+			}
+			continue
+		}
+		// Overnight: the evening belongs to today, the early hours to yesterday
+		if (w.days[day] && minute >= w.start) || (w.days[yesterday] && minute < w.end) {
+			return true
+		}
+	}
+	return false
+}
+
+// NextOpen returns when the schedule next opens after t, or t itself if it
+// is open already
+func (s *Schedule) NextOpen(t time.Time) time.Time {
+	if s.Open(t) {
+		return t
+	}
+	local := t.In(s.loc)
+	var next time.Time
+	for offset := 0; offset <= 7; offset++ {
+		date := local.AddDate(0, 0, offset)
+		for _, w := range s.windows {
+			if !w.days[date.Weekday()] {
+				continue
+			}
+			start := time.Date(date.Year(), date.Month(), date.Day(), w.start/60, w.start%60, 0, 0, s.loc)
+			if start.After(t) && (next.IsZero() || start.Before(next)) {
+				next = start
+			}
+		}
+		if !next.IsZero() {
+			return next
+		}
+	}
+	return next
+}
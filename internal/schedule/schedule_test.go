@@ -0,0 +1,102 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{"Mon-Fri 09:00-18:00", "Mon-Fri 09:00-18:00", false},
+		{"  mon-fri   09:00-18:00  Europe/London ", "mon-fri 09:00-18:00 Europe/London", false},
+		{"Mon-Fri 09:00-18:00, Sat 10:00-14:00 America/New_York", "Mon-Fri 09:00-18:00, Sat 10:00-14:00 America/New_York", false},
+		{"22:00-02:00", "22:00-02:00", false},
+		{"Fri-Mon 00:00-24:00", "Fri-Mon 00:00-24:00", false},
+		{"", "", true},
+		{"Mon-Fri", "", true},
+		{"Funday 09:00-18:00", "", true},
+		{"Mon-Fri 9:00-18:00", "", true},
+		{"Mon-Fri 09:00-25:00", "", true},
+		{"Mon-Fri 09:00-09:00", "", true},
+		{"Mon-Fri 09:00-18:00 Mars/Olympus", "", true},
+		{"Mon-Fri 9am-6pm", "", true},
+		{"Mon-Fri 09:00-18:00,", "", true},
+	}
+
+	for _, tt := range tests {
+		got, err := Parse(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Parse(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if err == nil && got.String() != tt.want {
+			t.Errorf("Parse(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestOpen(t *testing.T) {
+	// 2026-03-02 is a Monday
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2026, 3, day, hour, minute, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		schedule string
+		t        time.Time
+		want     bool
+	}{
+		{"Mon-Fri 09:00-18:00", at(2, 9, 0), true},
+		{"Mon-Fri 09:00-18:00", at(2, 17, 59), true},
+		{"Mon-Fri 09:00-18:00", at(2, 18, 0), false},
+		{"Mon-Fri 09:00-18:00", at(2, 8, 59), false},
+		{"Mon-Fri 09:00-18:00", at(7, 12, 0), false},
+		{"Mon-Fri 09:00-18:00, Sat 10:00-14:00", at(7, 12, 0), true},
+		{"Fri 22:00-02:00", at(6, 23, 0), true},
+		{"Fri 22:00-02:00", at(7, 1, 30), true},
+		{"Fri 22:00-02:00", at(2, 1, 30), false},
+		{"Sat-Sun 00:00-24:00", at(8, 23, 59), true},
+		{"Sat-Sun 00:00-24:00", at(9, 0, 0), false},
+		// 09:00 in New York is 14:00 UTC in March, before daylight saving starts on the 8th
+		{"Mon-Fri 09:00-17:00 America/New_York", at(2, 14, 0), true},
+		{"Mon-Fri 09:00-17:00 America/New_York", at(2, 13, 59), false},
+	}
+
+	for _, tt := range tests {
+		s, err := Parse(tt.schedule)
+		if err != nil {
+			t.Fatalf("Parse(%q) error = %v", tt.schedule, err)
+		}
+		if got := s.Open(tt.t); got != tt.want {
+			t.Errorf("%q Open(%s) = %v, want %v", tt.schedule, tt.t.Format(time.RFC1123), got, tt.want)
+		}
+	}
+}
+
+func TestNextOpen(t *testing.T) {
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2026, 3, day, hour, minute, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		schedule string
+		t        time.Time
+		want     time.Time
+	}{
+		{"Mon-Fri 09:00-18:00", at(2, 10, 0), at(2, 10, 0)},
+		{"Mon-Fri 09:00-18:00", at(2, 7, 0), at(2, 9, 0)},
+		{"Mon-Fri 09:00-18:00", at(2, 19, 0), at(3, 9, 0)},
+		{"Mon-Fri 09:00-18:00", at(6, 19, 0), at(9, 9, 0)},
+		{"Mon-Fri 09:00-18:00, Sat 10:00-14:00", at(6, 19, 0), at(7, 10, 0)},
+		{"Wed 09:00-10:00", at(4, 10, 0), at(11, 9, 0)},
+	}
+
+	for _, tt := range tests {
+		s, _ := Parse(tt.schedule)
+		if got := s.NextOpen(tt.t); !got.Equal(tt.want) {
+			t.Errorf("%q NextOpen(%s) = %s, want %s", tt.schedule, tt.t.Format(time.RFC1123), got.UTC().Format(time.RFC1123), tt.want.Format(time.RFC1123))
+		}
+	}
+}
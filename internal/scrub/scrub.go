@@ -0,0 +1,219 @@
+// internal/scrub/scrub.go
+package scrub
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// Placeholder replaces every value a Scrubber removes
+const Placeholder = "[REDACTED]"
+
+// Rules say what to scrub from captured requests before they're stored,
+// such as in the relay's request log or the client's inspector
+type Rules struct {
+	// Headers are header names, in any case, whose values are replaced
+	Headers []string `yaml:"headers,omitempty"`
+	// Fields are paths into JSON bodies such as user.email; * matches any
+	// key, and arrays are searched element by element
+	Fields []string `yaml:"fields,omitempty"`
+	// Patterns are regular expressions replaced wherever they match in
+	// paths, header values and bodies
+	Patterns []string `yaml:"patterns,omitempty"`
+}
+
+// Add appends a rule written as header:<name>, field:<path> or
+// regex:<expression>, the form of the --scrub flag
+func (r *Rules) Add(rule string) error {
+	kind, value, ok := strings.Cut(rule, ":")
+	if !ok || value == "" {
+		return fmt.Errorf("invalid scrub rule %q, want header:<name>, field:<path> or regex:<expression>", rule)
+	}
+	switch kind {
+	case "header":
+		r.Headers = append(r.Headers, value)
+	case "field":
+		r.Fields = append(r.Fields, value)
+	case "regex":
+		r.Patterns = append(r.Patterns, value)
+	default:
+		return fmt.Errorf("invalid scrub rule %q, want header:<name>, field:<path> or regex:<expression>", rule)
+	}
+	return nil
+}
+
+// Merge returns r with other's rules added
+func (r Rules) Merge(other Rules) Rules {
+	return Rules{
+		Headers:  append(append([]string(nil), r.Headers...), other.Headers...),
+		Fields:   append(append([]string(nil), r.Fields...), other.Fields...),
+		Patterns: append(append([]string(nil), r.Patterns...), other.Patterns...),
+	}
+}
+
+// IsZero reports whether r scrubs nothing
+func (r Rules) IsZero() bool {
+	return len(r.Headers) == 0 && len(r.Fields) == 0 && len(r.Patterns) == 0
+}
+
+// Scrubber redacts captured request data by a set of rules. A nil
+// Scrubber leaves everything as it is.
+type Scrubber struct {
+	headers  map[string]bool // canonical header names
+	fields   [][]string
+	patterns []*regexp.Regexp
+}
+
+// New compiles rules into a Scrubber, or returns nil if they're empty
+func New(rules Rules) (*Scrubber, error) {
+	if rules.IsZero() {
+		return nil, nil
+	}
+	s := &Scrubber{headers: make(map[string]bool)}
+	for _, h := range rules.Headers {
+		h = strings.TrimSpace(h)
+		if h == "" || strings.ContainsAny(h, " :\t") {
+			return nil, fmt.Errorf("invalid header name %q", h)
+		}
+		s.headers[http.CanonicalHeaderKey(h)] = true
+	}
+	for _, f := range rules.Fields {
+		path := strings.Split(strings.TrimSpace(f), ".")
+		for _, key := range path {
+			if key == "" {
+				return nil, fmt.Errorf("invalid field path %q, want e.g. user.email", f)
+			}
+		}
+		s.fields = append(s.fields, path)
+	}
+	for _, p := range rules.Patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", p, err)
+		}
+		if re.MatchString("") {
+			return nil, fmt.Errorf("invalid pattern %q: it matches empty text", p)
+		}
+		s.patterns = append(s.patterns, re)
+	}
+	return s, nil
+}
+
+// String replaces the matches of the patterns in v
+func (s *Scrubber) String(v string) string {
+	if s == nil {
+		return v
+	}
+	for _, re := range s.patterns {
+		v = re.ReplaceAllLiteralString(v, Placeholder)
+	}
+	return v
+}
+
+// Headers returns a copy of h with the named headers' values replaced and
+// the patterns scrubbed from the rest
+func (s *Scrubber) Headers(h map[string][]string) map[string][]string {
+	if s == nil || h == nil {
+		return h
+	}
+	out := make(map[string][]string, len(h))
+	for k, vals := range h {
+		scrubbed := make([]string, len(vals))
+		for i, v := range vals {
+			if s.headers[http.CanonicalHeaderKey(k)] {
+				scrubbed[i] = Placeholder
+			} else {
+				scrubbed[i] = s.String(v)
+			}
+		}
+		out[k] = scrubbed
+	}
+	return out
+}
+
+// Body returns body with the JSON fields replaced, if it is JSON, and the
+// patterns scrubbed. contentType is the body's Content-Type header.
+func (s *Scrubber) Body(contentType string, body []byte) []byte {
+	if s == nil || len(body) == 0 {
+		return body
+	}
+	if len(s.fields) > 0 && isJSON(contentType) {
+		body = s.jsonFields(body)
+	}
+	if len(s.patterns) == 0 {
+		return body
+	}
+	return []byte(s.String(string(body)))
+}
+
+// jsonFields replaces the values at the field paths in a JSON body. The
+// body is only re-encoded if a field was found, and left alone if it
+// doesn't parse.
+func (s *Scrubber) jsonFields(body []byte) []byte {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var doc any
+	if err := dec.Decode(&doc); err != nil {
+		return body
+	}
+	found := false
+	for _, path := range s.fields {
+		if redactPath(doc, path) {
+			found = true
+		}
+	}
+	if !found {
+		return body
+	}
+	var out bytes.Buffer
+	enc := json.NewEncoder(&out)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(doc); err != nil {
+		return body
+	}
+	return bytes.TrimSuffix(out.Bytes(), []byte("\n"))
+}
+
+// redactPath replaces the values at path in v, reporting whether it found any
+func redactPath(v any, path []string) bool {
+	switch v := v.(type) {
+	case []any:
+		found := false
+		for _, elem := range v {
+			if redactPath(elem, path) {
+				found = true
+			}
+		}
+		return found
+	case map[string]any:
+		found := false
+		for k, child := range v {
+			if path[0] != "*" && path[0] != k {
+				continue
+			}
+			if len(path) == 1 {
+				v[k] = Placeholder
+				found = true
+			} else if redactPath(child, path[1:]) {
+				found = true
+			}
+		}
+		return found
+	}
+	return false
+}
+
+// isJSON reports whether contentType is JSON, such as application/json or
+// application/problem+json
+func isJSON(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
@@ -0,0 +1,157 @@
+// internal/scrub/scrub_test.go
+package scrub
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRulesAdd(t *testing.T) {
+	var r Rules
+	for _, rule := range []string{"header:Authorization", "field:user.email", `regex:\d{4}-\d{4}`, "regex:a:b"} {
+		if err := r.Add(rule); err != nil {
+			t.Fatalf("Add(%q) error = %v", rule, err)
+		}
+	}
+	want := Rules{Headers: []string{"Authorization"}, Fields: []string{"user.email"}, Patterns: []string{`\d{4}-\d{4}`, "a:b"}}
+	if !reflect.DeepEqual(r, want) {
+		t.Errorf("rules = %+v, want %+v", r, want)
+	}
+
+	for _, rule := range []string{"Authorization", "header:", "cookie:session"} {
+		if err := r.Add(rule); err == nil {
+			t.Errorf("Add(%q) succeeded, want an error", rule)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name    string
+		rules   Rules
+		wantErr bool
+	}{
+		{"valid", Rules{Headers: []string{"cookie"}, Fields: []string{"*.token"}, Patterns: []string{`[\w.]+@[\w.]+`}}, false},
+		{"header with space", Rules{Headers: []string{"X Token"}}, true},
+		{"empty field key", Rules{Fields: []string{"user..email"}}, true},
+		{"bad regex", Rules{Patterns: []string{"(unclosed"}}, true},
+		{"matches nothing", Rules{Patterns: []string{"a*"}}, true},
+	}
+
+	for _, tt := range tests {
+		_, err := New(tt.rules)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("New(%s) error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+
+	if s, err := New(Rules{}); s != nil || err != nil {
+		t.Errorf("New(empty) = %v, %v, want nil, nil", s, err)
+	}
+}
+
+func TestHeaders(t *testing.T) {
+	s, err := New(Rules{Headers: []string{"authorization", "Cookie"}, Patterns: []string{`sk_live_\w+`}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := map[string][]string{
+		"Authorization": {"Bearer abc"},
+		"cookie":        {"session=1", "theme=dark"},
+		"X-Key":         {"key sk_live_123 used"},
+		"Accept":        {"text/html"},
+	}
+	got := s.Headers(in)
+	want := map[string][]string{
+		"Authorization": {Placeholder},
+		"cookie":        {Placeholder, Placeholder},
+		"X-Key":         {"key " + Placeholder + " used"},
+		"Accept":        {"text/html"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Headers() = %v, want %v", got, want)
+	}
+	if in["Authorization"][0] != "Bearer abc" {
+		t.Error("Headers() changed its input")
+	}
+}
+
+func TestBody(t *testing.T) {
+	s, err := New(Rules{
+		Fields:   []string{"user.email", "items.card", "*.ssn"},
+		Patterns: []string{`\b\d{3}-\d{2}-\d{4}\b`},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		want        string
+	}{
+		{
+			"nested field",
+			"application/json",
+			`{"user":{"email":"a@example.com","name":"Ann"}}`,
+			`{"user":{"email":"[REDACTED]","name":"Ann"}}`,
+		},
+		{
+			"field in array elements",
+			"application/json; charset=utf-8",
+			`{"items":[{"card":4242,"qty":1},{"card":"5555"}]}`,
+			`{"items":[{"card":"[REDACTED]","qty":1},{"card":"[REDACTED]"}]}`,
+		},
+		{
+			"wildcard key",
+			"application/vnd.api+json",
+			`{"person":{"ssn":"x"},"other":{"ssn":{"n":1}}}`,
+			`{"other":{"ssn":"[REDACTED]"},"person":{"ssn":"[REDACTED]"}}`,
+		},
+		{
+			"untouched json keeps its formatting",
+			"application/json",
+			`{ "user": { "name": "Ann" }, "big": 12345678901234567890 }`,
+			`{ "user": { "name": "Ann" }, "big": 12345678901234567890 }`,
+		},
+		{
+			"pattern in text",
+			"text/plain",
+			"ssn 123-45-6789 on file",
+			"ssn [REDACTED] on file",
+		},
+		{
+			"fields only apply to json",
+			"text/plain",
+			`{"user":{"email":"a@example.com"}}`,
+			`{"user":{"email":"a@example.com"}}`,
+		},
+		{
+			"invalid json is still pattern scrubbed",
+			"application/json",
+			`{"ssn": "123-45-6789"`,
+			`{"ssn": "[REDACTED]"`,
+		},
+	}
+
+	for _, tt := range tests {
+		if got := string(s.Body(tt.contentType, []byte(tt.body))); got != tt.want {
+			t.Errorf("Body(%s) = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestNilScrubber(t *testing.T) {
+	var s *Scrubber
+	if got := s.String("/users/42"); got != "/users/42" {
+		t.Errorf("String() = %q, want it unchanged", got)
+	}
+	h := map[string][]string{"Authorization": {"Bearer abc"}}
+	if got := s.Headers(h); !reflect.DeepEqual(got, h) {
+		t.Errorf("Headers() = %v, want them unchanged", got)
+	}
+	if got := s.Body("application/json", []byte(`{"a":1}`)); string(got) != `{"a":1}` {
+		t.Errorf("Body() = %s, want it unchanged", got)
+	}
+}
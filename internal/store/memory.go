@@ -0,0 +1,1488 @@
+// internal/store/memory.go
+package store
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memoryRequestLogLimit caps the request logs kept per user, since nothing
+// prunes the in-memory store
+const memoryRequestLogLimit = 1000
+
+// Memory is an in-memory implementation of every store for tests and local development
+type Memory struct {
+	mu        sync.Mutex
+	now       func() time.Time
+	users     map[string]User
+	domains   map[string][]Domain
+	requests  map[string][]RequestLog
+	bandwidth []bandwidthSample
+	tunnels   map[string]TunnelSession
+	sessions  map[string]memorySession
+	changes   map[string]memoryEmailChange
+	idents    map[string][]Identity
+	audit     []AuditEntry
+	tokens    map[string]memoryToken
+	relays    map[string]RelayHealth
+	checks    []HealthCheck
+	incidents []Incident
+	traffic   []trafficSample
+	abuse     []AbuseReport
+	alerts    []UsageAlert
+	events    []Event
+	exports   map[string]Export
+	prefs     map[string]Preferences
+	github    map[string]GitHubApp
+	grants    []DomainGrant
+	certs     map[string][]byte
+	certLocks map[string]certLock
+	nextID    int
+}
+
+type certLock struct {
+	holder    string
+	expiresAt time.Time
+}
+
+type memoryEmailChange struct {
+	newEmail  string
+	tokenHash string
+	expiresAt time.Time
+}
+
+type memoryToken struct {
+	userID string
+	token  APIToken
+}
+
+type trafficSample struct {
+	userID   string
+	hostname string
+	bytes    int64
+	requests int64
+	at       time.Time
+}
+
+type bandwidthSample struct {
+	userID     string
+	sessionID  string
+	bytes      int64
+	bytesIn    int64
+	bytesOut   int64
+	recordedAt time.Time
+}
+
+type memorySession struct {
+	userID       string
+	impersonator string
+	expiresAt    time.Time
+}
+
+var _ All = (*Memory)(nil)
+
+// NewMemory creates an empty in-memory store
+func NewMemory() *Memory {
+	return &Memory{
+		now:       time.Now,
+		users:     make(map[string]User),
+		domains:   make(map[string][]Domain),
+		requests:  make(map[string][]RequestLog),
+		tunnels:   make(map[string]TunnelSession),
+		sessions:  make(map[string]memorySession),
+		changes:   make(map[string]memoryEmailChange),
+		idents:    make(map[string][]Identity),
+		tokens:    make(map[string]memoryToken),
+		relays:    make(map[string]RelayHealth),
+		exports:   make(map[string]Export),
+		prefs:     make(map[string]Preferences),
+		github:    make(map[string]GitHubApp),
+		certs:     make(map[string][]byte),
+		certLocks: make(map[string]certLock),
+	}
+}
+
+// SetClock overrides the time source used for expiry and monthly usage
+func (m *Memory) SetClock(now func() time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.now = now
+}
+
+// AddUser inserts or replaces a user
+func (m *Memory) AddUser(u User) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.addUser(u)
+}
+
+// addUser stores u with defaults for the fields it leaves empty. Callers
+// hold m.mu.
+func (m *Memory) addUser(u User) {
+	if u.Plan == "" {
+		u.Plan = "free"
+	}
+	if u.Theme == "" {
+		u.Theme = "system"
+	}
+	if u.DataRegion == "" {
+		u.DataRegion = RegionUS
+	}
+	if u.BillingInterval == "" {
+		u.BillingInterval = "month"
+	}
+	if u.Seats == 0 {
+		u.Seats = 1
+	}
+	m.users[u.ID] = u
+}
+
+// AddIdentity links an OAuth identity to a user, assigning an ID when empty
+func (m *Memory) AddIdentity(userID string, i Identity) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if i.ID == "" {
+		i.ID = m.newID("identity")
+	}
+	m.idents[userID] = append(m.idents[userID], i)
+}
+
+// newID returns a unique ID with the given prefix. Callers hold m.mu.
+func (m *Memory) newID(prefix string) string {
+	m.nextID++
+	return fmt.Sprintf("%s-%d", prefix, m.nextID)
+}
+
+// AddDomain registers a domain to a user, assigning an ID when empty
+func (m *Memory) AddDomain(userID string, d Domain) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if d.ID == "" {
+		d.ID = m.newID("domain")
+	}
+	m.domains[userID] = append(m.domains[userID], d)
+}
+
+// AddDomainTraffic records bandwidth and requests served for a user's domain,
+// as reported by TopDomains
+func (m *Memory) AddDomainTraffic(userID, hostname string, bytes, requests int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.traffic = append(m.traffic, trafficSample{userID: userID, hostname: hostname, bytes: bytes, requests: requests, at: m.now()})
+}
+
+// AddRequestLog records a request against a user's domain
+func (m *Memory) AddRequestLog(userID string, l RequestLog) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[userID] = append(m.requests[userID], l)
+}
+
+func (m *Memory) GetUser(ctx context.Context, id string) (*User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.users[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &u, nil
+}
+
+func (m *Memory) ProvisionUser(ctx context.Context, u User, ident Identity) (*User, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for userID, idents := range m.idents {
+		for _, i := range idents {
+			if i.Provider == ident.Provider && i.ProviderUserID == ident.ProviderUserID {
+				existing := m.users[userID]
+				return &existing, false, nil
+			}
+		}
+	}
+	if m.emailTaken("", u.Email) {
+		return nil, false, ErrEmailTaken
+	}
+	// Seeded users may already have IDs of the same form
+	u.ID = m.newID("user")
+	for m.users[u.ID].ID != "" {
+		u.ID = m.newID("user")
+	}
+	m.addUser(u)
+	if ident.ID == "" {
+		ident.ID = m.newID("identity")
+	}
+	ident.CreatedAt = m.now()
+	m.idents[u.ID] = append(m.idents[u.ID], ident)
+	created := m.users[u.ID]
+	return &created, true, nil
+}
+
+func (m *Memory) ListMembers(ctx context.Context, orgID string) ([]User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	members := []User{}
+	for _, u := range m.users {
+		if orgID != "" && u.OrgID == orgID {
+			members = append(members, u)
+		}
+	}
+	slices.SortFunc(members, func(a, b User) int { return strings.Compare(a.Email, b.Email) })
+	return members, nil
+}
+
+func (m *Memory) SetPlan(ctx context.Context, id, plan string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.users[id]
+	if !ok {
+		return ErrNotFound
+	}
+	u.Plan = plan
+	m.users[id] = u
+	return nil
+}
+
+func (m *Memory) UpdateProfile(ctx context.Context, userID, name, avatarURL string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.users[userID]
+	if !ok {
+		return ErrNotFound
+	}
+	u.Name = name
+	u.AvatarURL = avatarURL
+	m.users[userID] = u
+	return nil
+}
+
+func (m *Memory) SetTheme(ctx context.Context, userID, theme string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.users[userID]
+	if !ok {
+		return ErrNotFound
+	}
+	u.Theme = theme
+	m.users[userID] = u
+	return nil
+}
+
+func (m *Memory) SetDataRegion(ctx context.Context, userID, region string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.users[userID]
+	if !ok {
+		return ErrNotFound
+	}
+	u.DataRegion = region
+	m.users[userID] = u
+	for i := range m.requests[userID] {
+		m.requests[userID][i].Region = region
+	}
+	return nil
+}
+
+func (m *Memory) Preferences(ctx context.Context, userID string) (Preferences, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.users[userID]; !ok {
+		return Preferences{}, ErrNotFound
+	}
+	if p, ok := m.prefs[userID]; ok {
+		return p, nil
+	}
+	return DefaultPreferences(), nil
+}
+
+func (m *Memory) SetPreferences(ctx context.Context, userID string, p Preferences) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.users[userID]; !ok {
+		return ErrNotFound
+	}
+	m.prefs[userID] = p
+	return nil
+}
+
+func (m *Memory) GitHubApp(ctx context.Context, userID string) (*GitHubApp, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	app, ok := m.github[userID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &app, nil
+}
+
+func (m *Memory) SetGitHubApp(ctx context.Context, app GitHubApp) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.users[app.UserID]; !ok {
+		return ErrNotFound
+	}
+	app.CreatedAt, app.UpdatedAt = m.now(), m.now()
+	if old, ok := m.github[app.UserID]; ok {
+		app.CreatedAt = old.CreatedAt
+	}
+	m.github[app.UserID] = app
+	return nil
+}
+
+func (m *Memory) DeleteGitHubApp(ctx context.Context, userID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.github[userID]; !ok {
+		return ErrNotFound
+	}
+	delete(m.github, userID)
+	return nil
+}
+
+// emailTaken reports whether another user has the address. Callers hold m.mu.
+func (m *Memory) emailTaken(userID, email string) bool {
+	for id, u := range m.users {
+		if id != userID && strings.EqualFold(u.Email, email) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Memory) CreateEmailChange(ctx context.Context, userID, newEmail, tokenHash string, expiresAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.emailTaken(userID, newEmail) {
+		return ErrEmailTaken
+	}
+	m.changes[userID] = memoryEmailChange{newEmail: newEmail, tokenHash: tokenHash, expiresAt: expiresAt}
+	return nil
+}
+
+func (m *Memory) ConfirmEmailChange(ctx context.Context, userID, tokenHash string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.changes[userID]
+	if !ok || c.tokenHash != tokenHash || !c.expiresAt.After(m.now()) {
+		return "", ErrNotFound
+	}
+	if m.emailTaken(userID, c.newEmail) {
+		return "", ErrEmailTaken
+	}
+	u, ok := m.users[userID]
+	if !ok {
+		return "", ErrNotFound
+	}
+	u.Email = c.newEmail
+	m.users[userID] = u
+	delete(m.changes, userID)
+	return c.newEmail, nil
+}
+
+func (m *Memory) ListIdentities(ctx context.Context, userID string) ([]Identity, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Identity(nil), m.idents[userID]...), nil
+}
+
+func (m *Memory) DeleteIdentity(ctx context.Context, userID, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	idents := m.idents[userID]
+	for i, ident := range idents {
+		if ident.ID != id {
+			continue
+		}
+		if len(idents) == 1 {
+			return ErrLastIdentity
+		}
+		m.idents[userID] = append(idents[:i:i], idents[i+1:]...)
+		return nil
+	}
+	return ErrNotFound
+}
+
+func (m *Memory) RecordAudit(ctx context.Context, e AuditEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e.ID = m.newID("audit")
+	e.CreatedAt = m.now()
+	m.audit = append(m.audit, e)
+	return nil
+}
+
+func (m *Memory) ListAudit(ctx context.Context, userID string, limit int) ([]AuditEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var entries []AuditEntry
+	for i := len(m.audit) - 1; i >= 0 && len(entries) < limit; i-- {
+		if m.audit[i].UserID == userID {
+			entries = append(entries, m.audit[i])
+		}
+	}
+	return entries, nil
+}
+
+func (m *Memory) ListDomains(ctx context.Context, userID string) ([]Domain, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	domains := append([]Domain(nil), m.domains[userID]...)
+	sort.SliceStable(domains, func(i, j int) bool { return domains[i].CreatedAt.After(domains[j].CreatedAt) })
+	return domains, nil
+}
+
+func (m *Memory) DomainOwner(ctx context.Context, hostname string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for userID, domains := range m.domains {
+		for _, d := range domains {
+			if d.Name == hostname {
+				return userID, nil
+			}
+		}
+	}
+	return "", ErrNotFound
+}
+
+func (m *Memory) GetDomain(ctx context.Context, userID, id string) (*Domain, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, d := range m.domains[userID] {
+		if d.ID == id {
+			return &d, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (m *Memory) CreateDomain(ctx context.Context, userID, hostname string) (*Domain, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, domains := range m.domains {
+		for _, d := range domains {
+			if d.Name == hostname {
+				return nil, ErrDomainTaken
+			}
+		}
+	}
+	d := Domain{ID: m.newID("domain"), Name: hostname, CreatedAt: m.now()}
+	m.domains[userID] = append(m.domains[userID], d)
+	return &d, nil
+}
+
+func (m *Memory) MarkDomainVerified(ctx context.Context, userID, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, d := range m.domains[userID] {
+		if d.ID == id {
+			m.domains[userID][i].Verified = true
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (m *Memory) SetDomainSchedule(ctx context.Context, userID, id, schedule string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, d := range m.domains[userID] {
+		if d.ID == id {
+			m.domains[userID][i].Schedule = schedule
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (m *Memory) DomainSchedule(ctx context.Context, hostname string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, domains := range m.domains {
+		for _, d := range domains {
+			if d.Name == hostname {
+				return d.Schedule, nil
+			}
+		}
+	}
+	return "", ErrNotFound
+}
+
+func (m *Memory) SetDomainSampling(ctx context.Context, userID, id, sampling string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, d := range m.domains[userID] {
+		if d.ID == id {
+			m.domains[userID][i].Sampling = sampling
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (m *Memory) DomainSampling(ctx context.Context, hostname string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, domains := range m.domains {
+		for _, d := range domains {
+			if d.Name == hostname {
+				return d.Sampling, nil
+			}
+		}
+	}
+	return "", ErrNotFound
+}
+
+func (m *Memory) SetDomainReplay(ctx context.Context, userID, id, replay string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, d := range m.domains[userID] {
+		if d.ID == id {
+			m.domains[userID][i].Replay = replay
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (m *Memory) DomainReplay(ctx context.Context, hostname string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, domains := range m.domains {
+		for _, d := range domains {
+			if d.Name == hostname {
+				return d.Replay, nil
+			}
+		}
+	}
+	return "", ErrNotFound
+}
+
+func (m *Memory) SetDomainHeaders(ctx context.Context, userID, id, headers string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, d := range m.domains[userID] {
+		if d.ID == id {
+			m.domains[userID][i].Headers = headers
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (m *Memory) DomainHeaders(ctx context.Context, hostname string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, domains := range m.domains {
+		for _, d := range domains {
+			if d.Name == hostname {
+				return d.Headers, nil
+			}
+		}
+	}
+	return "", ErrNotFound
+}
+
+func (m *Memory) SetDomainHTTPS(ctx context.Context, userID, id, policy string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, d := range m.domains[userID] {
+		if d.ID == id {
+			m.domains[userID][i].HTTPS = policy
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (m *Memory) DomainHTTPS(ctx context.Context, hostname string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, domains := range m.domains {
+		for _, d := range domains {
+			if d.Name == hostname {
+				return d.HTTPS, nil
+			}
+		}
+	}
+	return "", ErrNotFound
+}
+
+func (m *Memory) DeleteDomain(ctx context.Context, userID, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	domains := m.domains[userID]
+	for i, d := range domains {
+		if d.ID == id {
+			m.domains[userID] = append(domains[:i:i], domains[i+1:]...)
+			m.grants = slices.DeleteFunc(m.grants, func(g DomainGrant) bool { return g.DomainID == id })
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (m *Memory) GrantDomain(ctx context.Context, ownerID, id, email string) (*DomainGrant, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i := slices.IndexFunc(m.domains[ownerID], func(d Domain) bool { return d.ID == id })
+	if i < 0 {
+		return nil, ErrNotFound
+	}
+	var member *User
+	for _, u := range m.users {
+		if strings.EqualFold(u.Email, email) {
+			member = &u
+			break
+		}
+	}
+	if member == nil {
+		return nil, ErrNotFound
+	}
+	for _, g := range m.grants {
+		if g.DomainID == id && g.UserID == member.ID {
+			return &g, nil
+		}
+	}
+	g := DomainGrant{DomainID: id, Hostname: m.domains[ownerID][i].Name, UserID: member.ID, Email: member.Email, CreatedAt: m.now()}
+	m.grants = append(m.grants, g)
+	return &g, nil
+}
+
+func (m *Memory) RevokeDomain(ctx context.Context, ownerID, id, memberID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !slices.ContainsFunc(m.domains[ownerID], func(d Domain) bool { return d.ID == id }) {
+		return ErrNotFound
+	}
+	i := slices.IndexFunc(m.grants, func(g DomainGrant) bool { return g.DomainID == id && g.UserID == memberID })
+	if i < 0 {
+		return ErrNotFound
+	}
+	m.grants = slices.Delete(m.grants, i, i+1)
+	return nil
+}
+
+func (m *Memory) ListDomainGrants(ctx context.Context, ownerID string) ([]DomainGrant, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	grants := []DomainGrant{}
+	for _, g := range m.grants {
+		if slices.ContainsFunc(m.domains[ownerID], func(d Domain) bool { return d.ID == g.DomainID }) {
+			grants = append(grants, g)
+		}
+	}
+	return grants, nil
+}
+
+func (m *Memory) MayBindDomain(ctx context.Context, userID, hostname string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for ownerID, domains := range m.domains {
+		for _, d := range domains {
+			if d.Name != hostname || !d.Verified {
+				continue
+			}
+			return ownerID == userID || slices.ContainsFunc(m.grants, func(g DomainGrant) bool {
+				return g.DomainID == d.ID && g.UserID == userID
+			}), nil
+		}
+	}
+	return true, nil
+}
+
+func (m *Memory) RecordBandwidth(ctx context.Context, userID, tunnelSessionID string, bytesIn, bytesOut int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.bandwidth = append(m.bandwidth, bandwidthSample{
+		userID:     userID,
+		sessionID:  tunnelSessionID,
+		bytes:      bytesIn + bytesOut,
+		bytesIn:    bytesIn,
+		bytesOut:   bytesOut,
+		recordedAt: m.now(),
+	})
+	return nil
+}
+
+func (m *Memory) MonthlyUsage(ctx context.Context, userID string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	start := monthStart(m.now())
+	var total int64
+	for _, b := range m.bandwidth {
+		if b.userID == userID && !b.recordedAt.Before(start) {
+			total += b.bytes
+		}
+	}
+	return total, nil
+}
+
+func (m *Memory) RecentRequests(ctx context.Context, userID string, limit int) ([]RequestLog, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	logs := append([]RequestLog(nil), m.requests[userID]...)
+	sort.SliceStable(logs, func(i, j int) bool { return logs[i].CreatedAt.After(logs[j].CreatedAt) })
+	if len(logs) > limit {
+		logs = logs[:limit]
+	}
+	return logs, nil
+}
+
+func (m *Memory) LogRequest(ctx context.Context, hostname string, l RequestLog) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for userID, domains := range m.domains {
+		for _, d := range domains {
+			if d.Name != hostname {
+				continue
+			}
+			if l.ID == "" {
+				l.ID = m.newID("request")
+			}
+			if l.CreatedAt.IsZero() {
+				l.CreatedAt = m.now()
+			}
+			l.Domain = hostname
+			l.Region = m.users[userID].DataRegion
+			logs := append(m.requests[userID], l)
+			if len(logs) > memoryRequestLogLimit {
+				logs = logs[len(logs)-memoryRequestLogLimit:]
+			}
+			m.requests[userID] = logs
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (m *Memory) StartTunnelSession(ctx context.Context, hostname, name string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, domains := range m.domains {
+		for _, d := range domains {
+			if d.Name == hostname {
+				id := m.newID("tunnel")
+				m.tunnels[id] = TunnelSession{ID: id, Domain: hostname, Name: name, StartedAt: m.now()}
+				return id, nil
+			}
+		}
+	}
+	return "", ErrNotFound
+}
+
+// tunnelGroup is how TunnelHistory groups a session or request: by name if
+// the tunnel had one, else by hostname
+func tunnelGroup(name, hostname string) string {
+	if name != "" {
+		return "n:" + name
+	}
+	return "h:" + hostname
+}
+
+// userSessions returns the user's tunnel sessions with their bytes filled in
+func (m *Memory) userSessions(userID string) []TunnelSession {
+	owned := map[string]bool{}
+	for _, d := range m.domains[userID] {
+		owned[d.Name] = true
+	}
+	bytes := map[string]int64{}
+	for _, b := range m.bandwidth {
+		bytes[b.sessionID] += b.bytes
+	}
+	var sessions []TunnelSession
+	for _, t := range m.tunnels {
+		if owned[t.Domain] {
+			t.Bytes = bytes[t.ID]
+			sessions = append(sessions, t)
+		}
+	}
+	return sessions
+}
+
+func (m *Memory) ClientStats(ctx context.Context, userID string, since time.Time) ([]ClientStats, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	byVersion := map[string]*ClientStats{}
+	local := map[string]time.Duration{}
+	for _, l := range m.requests[userID] {
+		if l.CreatedAt.Before(since) {
+			continue
+		}
+		s := byVersion[l.ClientVersion]
+		if s == nil {
+			s = &ClientStats{ClientVersion: l.ClientVersion}
+			byVersion[l.ClientVersion] = s
+		}
+		s.Requests++
+		if l.ClientVersion != "" {
+			local[l.ClientVersion] += l.Latency.Local
+			if l.LocalStatus == 0 || l.LocalStatus >= 500 {
+				s.LocalErrors++
+			}
+		}
+	}
+
+	stats := make([]ClientStats, 0, len(byVersion))
+	for v, s := range byVersion {
+		if v != "" {
+			s.AvgLocalMs = float64(local[v]) / float64(s.Requests) / float64(time.Millisecond)
+		}
+		stats = append(stats, *s)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Requests != stats[j].Requests {
+			return stats[i].Requests > stats[j].Requests
+		}
+		return stats[i].ClientVersion < stats[j].ClientVersion
+	})
+	return stats, nil
+}
+
+func (m *Memory) TunnelHistory(ctx context.Context, userID string, since time.Time) ([]TunnelHistory, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	groups := map[string]*TunnelHistory{}
+	var order []*TunnelHistory
+	for _, t := range m.userSessions(userID) {
+		if t.StartedAt.Before(since) {
+			continue
+		}
+		key := tunnelGroup(t.Name, t.Domain)
+		h := groups[key]
+		if h == nil {
+			h = &TunnelHistory{Name: t.Name}
+			groups[key] = h
+			order = append(order, h)
+		}
+		if !slices.Contains(h.Hostnames, t.Domain) {
+			h.Hostnames = append(h.Hostnames, t.Domain)
+		}
+		h.Sessions++
+		h.TotalBytes += t.Bytes
+		if t.StartedAt.After(h.LastSeen) {
+			h.LastSeen = t.StartedAt
+		}
+	}
+	for _, l := range m.requests[userID] {
+		if h := groups[tunnelGroup(l.TunnelName, l.Domain)]; h != nil && !l.CreatedAt.Before(since) {
+			h.Requests++
+		}
+	}
+
+	history := make([]TunnelHistory, 0, len(order))
+	for _, h := range order {
+		slices.Sort(h.Hostnames)
+		history = append(history, *h)
+	}
+	sort.Slice(history, func(i, j int) bool {
+		if !history[i].LastSeen.Equal(history[j].LastSeen) {
+			return history[i].LastSeen.After(history[j].LastSeen)
+		}
+		return history[i].Hostnames[0] < history[j].Hostnames[0]
+	})
+	return history, nil
+}
+
+func (m *Memory) NamedTunnelSessions(ctx context.Context, userID, name string, limit int) ([]TunnelSession, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var sessions []TunnelSession
+	for _, t := range m.userSessions(userID) {
+		if t.Name == name {
+			sessions = append(sessions, t)
+		}
+	}
+	sort.SliceStable(sessions, func(i, j int) bool { return sessions[i].StartedAt.After(sessions[j].StartedAt) })
+	if len(sessions) > limit {
+		sessions = sessions[:limit]
+	}
+	return sessions, nil
+}
+
+func (m *Memory) EndTunnelSession(ctx context.Context, id, reason string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.tunnels[id]
+	if !ok {
+		return ErrNotFound
+	}
+	now := m.now()
+	t.EndedAt, t.DisconnectReason = &now, reason
+	m.tunnels[id] = t
+	return nil
+}
+
+// TunnelSession returns a session opened with StartTunnelSession and the
+// bytes recorded against it
+func (m *Memory) TunnelSession(id string) (TunnelSession, int64, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.tunnels[id]
+	var bytes int64
+	for _, b := range m.bandwidth {
+		if b.sessionID == id {
+			bytes += b.bytes
+		}
+	}
+	return t, bytes, ok
+}
+
+func (m *Memory) CreateSession(ctx context.Context, userID, tokenHash string, expiresAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sessions[tokenHash] = memorySession{userID: userID, expiresAt: expiresAt}
+	return nil
+}
+
+func (m *Memory) CreateImpersonationSession(ctx context.Context, userID, tokenHash, operator string, expiresAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sessions[tokenHash] = memorySession{userID: userID, impersonator: operator, expiresAt: expiresAt}
+	return nil
+}
+
+func (m *Memory) SessionUser(ctx context.Context, tokenHash string) (*User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[tokenHash]
+	if !ok || !s.expiresAt.After(m.now()) {
+		return nil, ErrNotFound
+	}
+	u, ok := m.users[s.userID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	u.ImpersonatedBy = s.impersonator
+	return &u, nil
+}
+
+func (m *Memory) DeleteSession(ctx context.Context, tokenHash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.sessions, tokenHash)
+	return nil
+}
+
+func (m *Memory) CreateToken(ctx context.Context, userID, name, tokenHash string) (*APIToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t := APIToken{ID: m.newID("token"), Name: name, CreatedAt: m.now()}
+	m.tokens[tokenHash] = memoryToken{userID: userID, token: t}
+	return &t, nil
+}
+
+func (m *Memory) ListTokens(ctx context.Context, userID string) ([]APIToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var tokens []APIToken
+	for _, t := range m.tokens {
+		if t.userID == userID {
+			tokens = append(tokens, t.token)
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].CreatedAt.After(tokens[j].CreatedAt) })
+	return tokens, nil
+}
+
+func (m *Memory) TokenUser(ctx context.Context, tokenHash string) (*User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.tokens[tokenHash]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	u, ok := m.users[t.userID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	now := m.now()
+	t.token.LastUsedAt = &now
+	m.tokens[tokenHash] = t
+	return &u, nil
+}
+
+func (m *Memory) RecordHealthCheck(ctx context.Context, c HealthCheck) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if c.CheckedAt.IsZero() {
+		c.CheckedAt = m.now()
+	}
+	m.checks = append(m.checks, c)
+	m.relays[c.RelayID] = RelayHealth{
+		RelayID:    c.RelayID,
+		Region:     c.Region,
+		OK:         c.OK,
+		Detail:     c.Detail,
+		Tunnels:    c.Tunnels,
+		LastSeenAt: c.CheckedAt,
+	}
+	return nil
+}
+
+func (m *Memory) ListRelayHealth(ctx context.Context) ([]RelayHealth, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	relays := make([]RelayHealth, 0, len(m.relays))
+	for _, r := range m.relays {
+		relays = append(relays, r)
+	}
+	sort.Slice(relays, func(i, j int) bool { return relays[i].RelayID < relays[j].RelayID })
+	return relays, nil
+}
+
+func (m *Memory) DailyUptime(ctx context.Context, since time.Time) ([]UptimeDay, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	byDay := make(map[time.Time]*UptimeDay)
+	for _, c := range m.checks {
+		if c.CheckedAt.Before(since) {
+			continue
+		}
+		t := c.CheckedAt.UTC()
+		day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+		d, ok := byDay[day]
+		if !ok {
+			d = &UptimeDay{Day: day}
+			byDay[day] = d
+		}
+		d.Checks++
+		if !c.OK {
+			d.Failures++
+		}
+	}
+	days := make([]UptimeDay, 0, len(byDay))
+	for _, d := range byDay {
+		days = append(days, *d)
+	}
+	sort.Slice(days, func(i, j int) bool { return days[i].Day.Before(days[j].Day) })
+	return days, nil
+}
+
+func (m *Memory) OpenIncident(ctx context.Context, i Incident) (*Incident, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	for n := range m.incidents {
+		if m.incidents[n].ResolvedAt == nil {
+			m.incidents[n].ResolvedAt = &now
+		}
+	}
+	i.ID = m.newID("incident")
+	i.StartedAt = now
+	i.ResolvedAt = nil
+	m.incidents = append(m.incidents, i)
+	return &i, nil
+}
+
+func (m *Memory) ResolveIncident(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for n := range m.incidents {
+		if m.incidents[n].ResolvedAt == nil {
+			now := m.now()
+			m.incidents[n].ResolvedAt = &now
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (m *Memory) ActiveIncident(ctx context.Context) (*Incident, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, i := range m.incidents {
+		if i.ResolvedAt == nil {
+			return &i, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (m *Memory) SearchUsers(ctx context.Context, query string, limit int) ([]User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	query = strings.ToLower(query)
+	var users []User
+	for _, u := range m.users {
+		if u.ID == query || (query != "" && strings.Contains(strings.ToLower(u.Email), query)) {
+			users = append(users, u)
+		}
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Email < users[j].Email })
+	if len(users) > limit {
+		users = users[:limit]
+	}
+	return users, nil
+}
+
+func (m *Memory) CountUsersByPlan(ctx context.Context) (map[string]int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	counts := make(map[string]int)
+	for _, u := range m.users {
+		counts[u.Plan]++
+	}
+	return counts, nil
+}
+
+func (m *Memory) TopDomains(ctx context.Context, since time.Time, limit int) ([]DomainTraffic, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	byHost := make(map[string]*DomainTraffic)
+	for _, t := range m.traffic {
+		if t.at.Before(since) {
+			continue
+		}
+		d, ok := byHost[t.hostname]
+		if !ok {
+			d = &DomainTraffic{Hostname: t.hostname, UserID: t.userID, UserEmail: m.users[t.userID].Email}
+			byHost[t.hostname] = d
+		}
+		d.TotalBytes += t.bytes
+		d.Requests += t.requests
+	}
+	domains := make([]DomainTraffic, 0, len(byHost))
+	for _, d := range byHost {
+		domains = append(domains, *d)
+	}
+	sort.Slice(domains, func(i, j int) bool {
+		if domains[i].TotalBytes != domains[j].TotalBytes {
+			return domains[i].TotalBytes > domains[j].TotalBytes
+		}
+		return domains[i].Hostname < domains[j].Hostname
+	})
+	if len(domains) > limit {
+		domains = domains[:limit]
+	}
+	return domains, nil
+}
+
+func (m *Memory) SetPlanOverride(ctx context.Context, userID, plan string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.users[userID]
+	if !ok {
+		return ErrNotFound
+	}
+	if plan != "" {
+		u.Plan = plan
+	}
+	u.PlanOverride = plan != ""
+	m.users[userID] = u
+	return nil
+}
+
+func (m *Memory) CreateAbuseReport(ctx context.Context, r AbuseReport) (*AbuseReport, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r.ID = m.newID("abuse")
+	r.CreatedAt = m.now()
+	r.Resolution = ""
+	r.ResolvedAt = nil
+	m.abuse = append(m.abuse, r)
+	return &r, nil
+}
+
+func (m *Memory) ListAbuseReports(ctx context.Context, includeResolved bool, limit int) ([]AbuseReport, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var reports []AbuseReport
+	for i := len(m.abuse) - 1; i >= 0 && len(reports) < limit; i-- {
+		if includeResolved || m.abuse[i].ResolvedAt == nil {
+			reports = append(reports, m.abuse[i])
+		}
+	}
+	return reports, nil
+}
+
+func (m *Memory) ResolveAbuseReport(ctx context.Context, id, resolution string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, r := range m.abuse {
+		if r.ID == id && r.ResolvedAt == nil {
+			now := m.now()
+			m.abuse[i].Resolution = resolution
+			m.abuse[i].ResolvedAt = &now
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (m *Memory) CreateAlert(ctx context.Context, a UsageAlert) (*UsageAlert, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	a.ID = m.newID("alert")
+	a.CreatedAt = m.now()
+	a.LastFiredAt = nil
+	m.alerts = append(m.alerts, a)
+	return &a, nil
+}
+
+func (m *Memory) ListAlerts(ctx context.Context, userID string) ([]UsageAlert, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var alerts []UsageAlert
+	for _, a := range m.alerts {
+		if a.UserID == userID {
+			alerts = append(alerts, a)
+		}
+	}
+	sort.SliceStable(alerts, func(i, j int) bool { return alerts[i].ThresholdBytes < alerts[j].ThresholdBytes })
+	return alerts, nil
+}
+
+func (m *Memory) DeleteAlert(ctx context.Context, userID, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, a := range m.alerts {
+		if a.ID == id && a.UserID == userID {
+			m.alerts = append(m.alerts[:i:i], m.alerts[i+1:]...)
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (m *Memory) DueAlerts(ctx context.Context) ([]DueAlert, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	start := monthStart(m.now())
+	used := make(map[string]int64)
+	for _, b := range m.bandwidth {
+		if !b.recordedAt.Before(start) {
+			used[b.userID] += b.bytes
+		}
+	}
+
+	var due []DueAlert
+	for _, a := range m.alerts {
+		if used[a.UserID] < a.ThresholdBytes || (a.LastFiredAt != nil && !a.LastFiredAt.Before(start)) {
+			continue
+		}
+		due = append(due, DueAlert{UsageAlert: a, Email: m.users[a.UserID].Email, UsedBytes: used[a.UserID]})
+	}
+	return due, nil
+}
+
+func (m *Memory) MarkAlertFired(ctx context.Context, id string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	for i, a := range m.alerts {
+		if a.ID != id {
+			continue
+		}
+		if a.LastFiredAt != nil && !a.LastFiredAt.Before(monthStart(now)) {
+			return false, nil
+		}
+		m.alerts[i].LastFiredAt = &now
+		return true, nil
+	}
+	return false, ErrNotFound
+}
+
+func (m *Memory) RecordEvent(ctx context.Context, e Event) (*Event, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e.ID = int64(len(m.events) + 1)
+	e.CreatedAt = m.now()
+	m.events = append(m.events, e)
+	return &e, nil
+}
+
+func (m *Memory) ListEvents(ctx context.Context, userID string, after int64, limit int) ([]Event, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var events []Event
+	if after > 0 {
+		for _, e := range m.events[min(after, int64(len(m.events))):] {
+			if e.UserID == userID && len(events) < limit {
+				events = append(events, e)
+			}
+		}
+		return events, nil
+	}
+	for i := len(m.events) - 1; i >= 0 && len(events) < limit; i-- {
+		if m.events[i].UserID == userID {
+			events = append(events, m.events[i])
+		}
+	}
+	slices.Reverse(events)
+	return events, nil
+}
+
+func (m *Memory) SetExport(ctx context.Context, e Export) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if old, ok := m.exports[e.UserID]; ok {
+		e.CreatedAt = old.CreatedAt
+	} else {
+		e.CreatedAt = m.now()
+	}
+	m.exports[e.UserID] = e
+	return nil
+}
+
+func (m *Memory) GetExport(ctx context.Context, userID string) (*Export, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.exports[userID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &e, nil
+}
+
+func (m *Memory) DeleteExport(ctx context.Context, userID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.exports[userID]; !ok {
+		return ErrNotFound
+	}
+	delete(m.exports, userID)
+	return nil
+}
+
+func (m *Memory) ListExports(ctx context.Context) ([]Export, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var exports []Export
+	for _, e := range m.exports {
+		exports = append(exports, e)
+	}
+	sort.Slice(exports, func(i, j int) bool { return exports[i].UserID < exports[j].UserID })
+	return exports, nil
+}
+
+func (m *Memory) MarkExported(ctx context.Context, userID string, through time.Time, runErr string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.exports[userID]
+	if !ok {
+		return ErrNotFound
+	}
+	now := m.now()
+	e.ExportedThrough = through
+	e.LastRunAt = &now
+	e.LastError = runErr
+	m.exports[userID] = e
+	return nil
+}
+
+func (m *Memory) RequestLogsBetween(ctx context.Context, userID string, from, to time.Time, limit int) ([]RequestLog, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var logs []RequestLog
+	for _, l := range m.requests[userID] {
+		if !l.CreatedAt.Before(from) && l.CreatedAt.Before(to) {
+			logs = append(logs, l)
+		}
+	}
+	sort.SliceStable(logs, func(i, j int) bool { return logs[i].CreatedAt.Before(logs[j].CreatedAt) })
+	if len(logs) > limit {
+		logs = logs[:limit]
+	}
+	return logs, nil
+}
+
+func (m *Memory) DailyUsage(ctx context.Context, userID string, from, to time.Time) ([]UsageDay, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	type key struct {
+		day    time.Time
+		domain string
+	}
+	days := map[key]*UsageDay{}
+	get := func(at time.Time, domain string) *UsageDay {
+		day := at.UTC().Truncate(24 * time.Hour)
+		k := key{day, domain}
+		if days[k] == nil {
+			days[k] = &UsageDay{Day: day, Domain: domain}
+		}
+		return days[k]
+	}
+	inRange := func(at time.Time) bool {
+		day := at.UTC().Truncate(24 * time.Hour)
+		return !day.Before(from) && day.Before(to)
+	}
+
+	for _, b := range m.bandwidth {
+		t, ok := m.tunnels[b.sessionID]
+		if b.userID != userID || !ok || !inRange(b.recordedAt) {
+			continue
+		}
+		d := get(b.recordedAt, t.Domain)
+		d.BytesIn += b.bytesIn
+		d.BytesOut += b.bytesOut
+	}
+	for _, l := range m.requests[userID] {
+		if inRange(l.CreatedAt) {
+			get(l.CreatedAt, l.Domain).Requests++
+		}
+	}
+
+	out := make([]UsageDay, 0, len(days))
+	for _, d := range days {
+		out = append(out, *d)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if !out[i].Day.Equal(out[j].Day) {
+			return out[i].Day.Before(out[j].Day)
+		}
+		return out[i].Domain < out[j].Domain
+	})
+	return out, nil
+}
+
+func (m *Memory) GetCert(ctx context.Context, key string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.certs[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return bytes.Clone(data), nil
+}
+
+func (m *Memory) PutCert(ctx context.Context, key string, data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.certs[key] = bytes.Clone(data)
+	return nil
+}
+
+func (m *Memory) DeleteCert(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.certs, key)
+	return nil
+}
+
+func (m *Memory) LockCert(ctx context.Context, key, holder string, ttl time.Duration) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	if l, ok := m.certLocks[key]; ok && l.holder != holder && now.Before(l.expiresAt) {
+		return false, nil
+	}
+	m.certLocks[key] = certLock{holder: holder, expiresAt: now.Add(ttl)}
+	return true, nil
+}
+
+func (m *Memory) UnlockCert(ctx context.Context, key, holder string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.certLocks[key].holder == holder {
+		delete(m.certLocks, key)
+	}
+	return nil
+}
@@ -0,0 +1,686 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestMemoryUsers(t *testing.T) {
+	m := NewMemory()
+	ctx := context.Background()
+	m.AddUser(User{ID: "user-1", Email: "dev@example.com"})
+
+	u, err := m.GetUser(ctx, "user-1")
+	if err != nil {
+		t.Fatalf("GetUser() error = %v", err)
+	}
+	if u.Plan != "free" {
+		t.Errorf("Plan = %q, want %q", u.Plan, "free")
+	}
+
+	if err := m.SetPlan(ctx, "user-1", "pro"); err != nil {
+		t.Fatalf("SetPlan() error = %v", err)
+	}
+	if u, _ := m.GetUser(ctx, "user-1"); u.Plan != "pro" {
+		t.Errorf("Plan after SetPlan = %q, want %q", u.Plan, "pro")
+	}
+
+	if _, err := m.GetUser(ctx, "missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetUser(missing) error = %v, want ErrNotFound", err)
+	}
+	if err := m.SetPlan(ctx, "missing", "pro"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("SetPlan(missing) error = %v, want ErrNotFound", err)
+	}
+}
+
+func TestMemorySessions(t *testing.T) {
+	m := NewMemory()
+	ctx := context.Background()
+	now := time.Date(2025, 6, 15, 12, 0, 0, 0, time.UTC)
+	m.SetClock(func() time.Time { return now })
+	m.AddUser(User{ID: "user-1"})
+
+	m.CreateSession(ctx, "user-1", "live", now.Add(time.Hour))
+	m.CreateSession(ctx, "user-1", "expired", now.Add(-time.Hour))
+
+	tests := []struct {
+		hash    string
+		wantErr error
+	}{
+		{"live", nil},
+		{"expired", ErrNotFound},
+		{"unknown", ErrNotFound},
+	}
+	for _, tt := range tests {
+		_, err := m.SessionUser(ctx, tt.hash)
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("SessionUser(%q) error = %v, want %v", tt.hash, err, tt.wantErr)
+		}
+	}
+
+	m.DeleteSession(ctx, "live")
+	if _, err := m.SessionUser(ctx, "live"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("SessionUser after delete error = %v, want ErrNotFound", err)
+	}
+}
+
+func TestMemoryMonthlyUsage(t *testing.T) {
+	m := NewMemory()
+	ctx := context.Background()
+	now := time.Date(2025, 6, 30, 23, 0, 0, 0, time.UTC)
+
+	m.SetClock(func() time.Time { return now.AddDate(0, -1, 0) })
+	m.RecordBandwidth(ctx, "user-1", "", 1000, 1000)
+	m.SetClock(func() time.Time { return now })
+	m.RecordBandwidth(ctx, "user-1", "", 100, 200)
+	m.RecordBandwidth(ctx, "user-2", "", 5, 5)
+
+	got, err := m.MonthlyUsage(ctx, "user-1")
+	if err != nil {
+		t.Fatalf("MonthlyUsage() error = %v", err)
+	}
+	if got != 300 {
+		t.Errorf("MonthlyUsage() = %d, want 300", got)
+	}
+}
+
+func TestMemoryOrdering(t *testing.T) {
+	m := NewMemory()
+	ctx := context.Background()
+	base := time.Now()
+
+	m.AddDomain("user-1", Domain{Name: "old.example.com", CreatedAt: base.Add(-time.Hour)})
+	m.AddDomain("user-1", Domain{Name: "new.example.com", CreatedAt: base})
+	for i := 0; i < 5; i++ {
+		m.AddRequestLog("user-1", RequestLog{ID: string(rune('a' + i)), CreatedAt: base.Add(time.Duration(i) * time.Second)})
+	}
+
+	domains, _ := m.ListDomains(ctx, "user-1")
+	if len(domains) != 2 || domains[0].Name != "new.example.com" {
+		t.Errorf("ListDomains() = %+v, want newest first", domains)
+	}
+
+	logs, _ := m.RecentRequests(ctx, "user-1", 3)
+	if len(logs) != 3 || logs[0].ID != "e" {
+		t.Errorf("RecentRequests() = %+v, want 3 newest first", logs)
+	}
+}
+
+func TestMemoryLogRequest(t *testing.T) {
+	m := NewMemory()
+	ctx := context.Background()
+	m.AddDomain("user-1", Domain{Name: "app.example.com"})
+
+	if err := m.LogRequest(ctx, "other.example.com", RequestLog{Method: "GET"}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("LogRequest(unowned) error = %v, want ErrNotFound", err)
+	}
+
+	for i := 0; i < memoryRequestLogLimit+5; i++ {
+		l := RequestLog{Method: "GET", Path: "/", StatusCode: 200, RemoteIP: "203.0.113.7", TLSVersion: "TLS 1.3", ALPN: "h2"}
+		if err := m.LogRequest(ctx, "app.example.com", l); err != nil {
+			t.Fatalf("LogRequest() error = %v", err)
+		}
+	}
+
+	logs, _ := m.RecentRequests(ctx, "user-1", memoryRequestLogLimit*2)
+	if len(logs) != memoryRequestLogLimit {
+		t.Fatalf("RecentRequests() returned %d logs, want %d", len(logs), memoryRequestLogLimit)
+	}
+	if l := logs[0]; l.Domain != "app.example.com" || l.RemoteIP != "203.0.113.7" || l.TLSVersion != "TLS 1.3" || l.ALPN != "h2" {
+		t.Errorf("RecentRequests()[0] = %+v, want domain and client metadata", l)
+	}
+}
+
+func TestMemoryDataRegion(t *testing.T) {
+	m := NewMemory()
+	ctx := context.Background()
+	m.AddUser(User{ID: "user-1", Email: "dev@example.com"})
+	m.AddDomain("user-1", Domain{Name: "app.example.com"})
+
+	m.LogRequest(ctx, "app.example.com", RequestLog{Method: "GET"})
+	if err := m.SetDataRegion(ctx, "user-1", RegionEU); err != nil {
+		t.Fatalf("SetDataRegion() error = %v", err)
+	}
+	m.LogRequest(ctx, "app.example.com", RequestLog{Method: "POST"})
+
+	logs, _ := m.RecentRequests(ctx, "user-1", 10)
+	if len(logs) != 2 || logs[0].Region != RegionEU || logs[1].Region != RegionEU {
+		t.Errorf("RecentRequests() = %+v, want both logs in eu", logs)
+	}
+	if u, _ := m.GetUser(ctx, "user-1"); u.DataRegion != RegionEU {
+		t.Errorf("DataRegion = %q, want %q", u.DataRegion, RegionEU)
+	}
+	if err := m.SetDataRegion(ctx, "nobody", RegionEU); !errors.Is(err, ErrNotFound) {
+		t.Errorf("SetDataRegion(unknown user) error = %v, want ErrNotFound", err)
+	}
+}
+
+func TestMemoryPreferences(t *testing.T) {
+	m := NewMemory()
+	ctx := context.Background()
+	m.AddUser(User{ID: "user-1", Email: "dev@example.com"})
+
+	if p, err := m.Preferences(ctx, "user-1"); err != nil || p != DefaultPreferences() {
+		t.Errorf("Preferences() = %+v, %v, want the defaults", p, err)
+	}
+	want := Preferences{Inspect: false, LogRetentionDays: 3, BurstLimit: "20"}
+	if err := m.SetPreferences(ctx, "user-1", want); err != nil {
+		t.Fatalf("SetPreferences() error = %v", err)
+	}
+	if p, _ := m.Preferences(ctx, "user-1"); p != want {
+		t.Errorf("Preferences() = %+v, want %+v", p, want)
+	}
+	if err := m.SetPreferences(ctx, "nobody", want); !errors.Is(err, ErrNotFound) {
+		t.Errorf("SetPreferences(unknown user) error = %v, want ErrNotFound", err)
+	}
+}
+
+func TestMemoryGitHubApp(t *testing.T) {
+	m := NewMemory()
+	ctx := context.Background()
+	m.AddUser(User{ID: "user-1", Email: "dev@example.com"})
+
+	if _, err := m.GitHubApp(ctx, "user-1"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GitHubApp() before setting one error = %v, want ErrNotFound", err)
+	}
+	if err := m.SetGitHubApp(ctx, GitHubApp{UserID: "user-1", AppID: 42, KeySealed: "v1.sealed"}); err != nil {
+		t.Fatalf("SetGitHubApp() error = %v", err)
+	}
+	if app, err := m.GitHubApp(ctx, "user-1"); err != nil || app.AppID != 42 || app.KeySealed != "v1.sealed" {
+		t.Errorf("GitHubApp() = %+v, %v, want app 42", app, err)
+	}
+	if err := m.SetGitHubApp(ctx, GitHubApp{UserID: "nobody", AppID: 42}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("SetGitHubApp(unknown user) error = %v, want ErrNotFound", err)
+	}
+	if err := m.DeleteGitHubApp(ctx, "user-1"); err != nil {
+		t.Fatalf("DeleteGitHubApp() error = %v", err)
+	}
+	if err := m.DeleteGitHubApp(ctx, "user-1"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("DeleteGitHubApp() twice error = %v, want ErrNotFound", err)
+	}
+}
+
+func TestMemoryProvisionUser(t *testing.T) {
+	m := NewMemory()
+	ctx := context.Background()
+	m.AddUser(User{ID: "owner", Email: "owner@acme.com", Plan: "team"})
+	ident := Identity{Provider: "oidc:https://idp.acme.com", ProviderUserID: "00u1", Email: "ada@acme.com"}
+
+	u, created, err := m.ProvisionUser(ctx, User{Email: "ada@acme.com", Name: "Ada", OrgID: "owner"}, ident)
+	if err != nil || !created || u.OrgID != "owner" || u.Plan != "free" {
+		t.Fatalf("ProvisionUser() = %+v, %v, %v, want a new free member of owner", u, created, err)
+	}
+	again, created, err := m.ProvisionUser(ctx, User{Email: "renamed@acme.com", OrgID: "owner"}, ident)
+	if err != nil || created || again.ID != u.ID {
+		t.Errorf("ProvisionUser(same identity) = %+v, %v, %v, want %s unchanged", again, created, err, u.ID)
+	}
+	other := Identity{Provider: ident.Provider, ProviderUserID: "00u2"}
+	if _, _, err := m.ProvisionUser(ctx, User{Email: "Owner@acme.com", OrgID: "owner"}, other); !errors.Is(err, ErrEmailTaken) {
+		t.Errorf("ProvisionUser(existing email) error = %v, want ErrEmailTaken", err)
+	}
+
+	members, _ := m.ListMembers(ctx, "owner")
+	if len(members) != 1 || members[0].ID != u.ID {
+		t.Errorf("ListMembers() = %+v, want only %s", members, u.ID)
+	}
+	if members, _ := m.ListMembers(ctx, ""); len(members) != 0 {
+		t.Errorf("ListMembers(\"\") = %+v, want none", members)
+	}
+}
+
+func TestMemoryDomainGrants(t *testing.T) {
+	m := NewMemory()
+	ctx := context.Background()
+	m.AddUser(User{ID: "owner", Email: "owner@example.com"})
+	m.AddUser(User{ID: "member", Email: "member@example.com"})
+	d, _ := m.CreateDomain(ctx, "owner", "app.example.com")
+	m.MarkDomainVerified(ctx, "owner", d.ID)
+	// Anyone can claim a hostname; until it's verified it binds nobody
+	m.CreateDomain(ctx, "owner", "claimed.example.com")
+
+	if _, err := m.GrantDomain(ctx, "member", d.ID, "owner@example.com"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GrantDomain(another user's domain) error = %v, want ErrNotFound", err)
+	}
+	if _, err := m.GrantDomain(ctx, "owner", d.ID, "nobody@example.com"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GrantDomain(unknown email) error = %v, want ErrNotFound", err)
+	}
+	g, err := m.GrantDomain(ctx, "owner", d.ID, "Member@example.com")
+	if err != nil || g.UserID != "member" || g.Hostname != "app.example.com" {
+		t.Fatalf("GrantDomain() = %+v, %v, want member on app.example.com", g, err)
+	}
+
+	tests := []struct {
+		user, hostname string
+		want           bool
+	}{
+		{"owner", "app.example.com", true},
+		{"member", "app.example.com", true},
+		{"stranger", "app.example.com", false},
+		{"stranger", "free.example.com", true},
+		{"stranger", "claimed.example.com", true},
+	}
+	for _, tt := range tests {
+		if got, _ := m.MayBindDomain(ctx, tt.user, tt.hostname); got != tt.want {
+			t.Errorf("MayBindDomain(%s, %s) = %v, want %v", tt.user, tt.hostname, got, tt.want)
+		}
+	}
+
+	// Deleting the domain takes its grants with it
+	m.DeleteDomain(ctx, "owner", d.ID)
+	if grants, _ := m.ListDomainGrants(ctx, "owner"); len(grants) != 0 {
+		t.Errorf("ListDomainGrants() after delete = %+v, want none", grants)
+	}
+}
+
+func TestMemoryTunnelHistory(t *testing.T) {
+	m := NewMemory()
+	ctx := context.Background()
+	now := time.Date(2025, 6, 30, 12, 0, 0, 0, time.UTC)
+	for _, name := range []string{"a1b2.example.com", "c3d4.example.com", "plain.example.com"} {
+		m.AddDomain("user-1", Domain{Name: name})
+	}
+	m.AddDomain("user-2", Domain{Name: "other.example.com"})
+
+	m.SetClock(func() time.Time { return now.Add(-2 * time.Hour) })
+	first, _ := m.StartTunnelSession(ctx, "a1b2.example.com", "checkout")
+	m.RecordBandwidth(ctx, "user-1", first, 100, 200)
+	m.EndTunnelSession(ctx, first, "client closed")
+	m.StartTunnelSession(ctx, "plain.example.com", "")
+	m.StartTunnelSession(ctx, "other.example.com", "checkout")
+	m.SetClock(func() time.Time { return now })
+	second, _ := m.StartTunnelSession(ctx, "c3d4.example.com", "checkout")
+	m.RecordBandwidth(ctx, "user-1", second, 50, 50)
+	m.LogRequest(ctx, "c3d4.example.com", RequestLog{Method: "GET", TunnelName: "checkout"})
+	m.LogRequest(ctx, "plain.example.com", RequestLog{Method: "GET"})
+
+	history, err := m.TunnelHistory(ctx, "user-1", now.Add(-24*time.Hour))
+	if err != nil {
+		t.Fatalf("TunnelHistory() error = %v", err)
+	}
+	if len(history) != 2 {
+		t.Fatalf("TunnelHistory() = %+v, want the named tunnel and the plain hostname", history)
+	}
+	if h := history[0]; h.Name != "checkout" || h.Sessions != 2 || h.TotalBytes != 400 || h.Requests != 1 ||
+		!h.LastSeen.Equal(now) || len(h.Hostnames) != 2 || h.Hostnames[0] != "a1b2.example.com" {
+		t.Errorf("TunnelHistory()[0] = %+v, want checkout across both hostnames", h)
+	}
+	if h := history[1]; h.Name != "" || h.Sessions != 1 || h.Requests != 1 || h.Hostnames[0] != "plain.example.com" {
+		t.Errorf("TunnelHistory()[1] = %+v, want the unnamed tunnel by hostname", h)
+	}
+
+	if history, _ := m.TunnelHistory(ctx, "user-1", now.Add(-time.Hour)); len(history) != 1 || history[0].Sessions != 1 {
+		t.Errorf("TunnelHistory(last hour) = %+v, want only the latest session", history)
+	}
+
+	sessions, err := m.NamedTunnelSessions(ctx, "user-1", "checkout", 10)
+	if err != nil {
+		t.Fatalf("NamedTunnelSessions() error = %v", err)
+	}
+	if len(sessions) != 2 || sessions[0].ID != second || sessions[1].EndedAt == nil || sessions[1].Bytes != 300 {
+		t.Errorf("NamedTunnelSessions() = %+v, want both of user-1's sessions newest first", sessions)
+	}
+	if sessions, _ := m.NamedTunnelSessions(ctx, "user-1", "checkout", 1); len(sessions) != 1 {
+		t.Errorf("NamedTunnelSessions(limit 1) returned %d sessions", len(sessions))
+	}
+}
+
+func TestMemoryClientStats(t *testing.T) {
+	m := NewMemory()
+	ctx := context.Background()
+	now := time.Date(2025, 6, 30, 12, 0, 0, 0, time.UTC)
+	m.AddDomain("user-1", Domain{Name: "app.example.com"})
+
+	m.SetClock(func() time.Time { return now.Add(-48 * time.Hour) })
+	m.LogRequest(ctx, "app.example.com", RequestLog{ClientVersion: "0.0.9", LocalStatus: 200})
+	m.SetClock(func() time.Time { return now })
+	for _, l := range []RequestLog{
+		{ClientVersion: "0.1.0", LocalStatus: 200, Latency: Latency{Local: 2 * time.Millisecond}},
+		{ClientVersion: "0.1.0", LocalStatus: 503, Latency: Latency{Local: 4 * time.Millisecond}},
+		{ClientVersion: "0.1.0", LocalStatus: 0, Latency: Latency{Local: 6 * time.Millisecond}},
+		{StatusCode: 200},
+	} {
+		m.LogRequest(ctx, "app.example.com", l)
+	}
+
+	stats, err := m.ClientStats(ctx, "user-1", now.Add(-24*time.Hour))
+	if err != nil {
+		t.Fatalf("ClientStats() error = %v", err)
+	}
+	want := []ClientStats{
+		{ClientVersion: "0.1.0", Requests: 3, LocalErrors: 2, AvgLocalMs: 4},
+		{ClientVersion: "", Requests: 1},
+	}
+	if !slices.Equal(stats, want) {
+		t.Errorf("ClientStats() = %+v, want %+v", stats, want)
+	}
+	if stats, _ := m.ClientStats(ctx, "user-2", now.Add(-24*time.Hour)); len(stats) != 0 {
+		t.Errorf("ClientStats(user-2) = %+v, want none", stats)
+	}
+}
+
+func TestMemoryDomainLifecycle(t *testing.T) {
+	m := NewMemory()
+	ctx := context.Background()
+
+	d, err := m.CreateDomain(ctx, "user-1", "app.example.com")
+	if err != nil {
+		t.Fatalf("CreateDomain() error = %v", err)
+	}
+	if d.ID == "" || d.Verified {
+		t.Errorf("CreateDomain() = %+v, want an unverified domain with an ID", d)
+	}
+
+	if _, err := m.CreateDomain(ctx, "user-2", "app.example.com"); err != ErrDomainTaken {
+		t.Errorf("CreateDomain() duplicate error = %v, want ErrDomainTaken", err)
+	}
+	if _, err := m.GetDomain(ctx, "user-2", d.ID); err != ErrNotFound {
+		t.Errorf("GetDomain() other user error = %v, want ErrNotFound", err)
+	}
+	if err := m.DeleteDomain(ctx, "user-2", d.ID); err != ErrNotFound {
+		t.Errorf("DeleteDomain() other user error = %v, want ErrNotFound", err)
+	}
+
+	if owner, err := m.DomainOwner(ctx, "app.example.com"); err != nil || owner != "user-1" {
+		t.Errorf("DomainOwner() = %q, %v, want user-1", owner, err)
+	}
+
+	if err := m.MarkDomainVerified(ctx, "user-1", d.ID); err != nil {
+		t.Fatalf("MarkDomainVerified() error = %v", err)
+	}
+	if got, _ := m.GetDomain(ctx, "user-1", d.ID); got == nil || !got.Verified {
+		t.Errorf("GetDomain() = %+v, want verified", got)
+	}
+
+	if err := m.SetDomainSchedule(ctx, "user-2", d.ID, "Sat 10:00-14:00"); err != ErrNotFound {
+		t.Errorf("SetDomainSchedule() other user error = %v, want ErrNotFound", err)
+	}
+	if err := m.SetDomainSchedule(ctx, "user-1", d.ID, "Mon-Fri 09:00-18:00"); err != nil {
+		t.Fatalf("SetDomainSchedule() error = %v", err)
+	}
+	if got, err := m.DomainSchedule(ctx, "app.example.com"); err != nil || got != "Mon-Fri 09:00-18:00" {
+		t.Errorf("DomainSchedule() = %q, %v, want Mon-Fri 09:00-18:00", got, err)
+	}
+	if err := m.SetDomainSampling(ctx, "user-1", d.ID, "errors, 1%"); err != nil {
+		t.Fatalf("SetDomainSampling() error = %v", err)
+	}
+	if got, err := m.DomainSampling(ctx, "app.example.com"); err != nil || got != "errors, 1%" {
+		t.Errorf("DomainSampling() = %q, %v, want errors, 1%%", got, err)
+	}
+	if err := m.SetDomainReplay(ctx, "user-1", d.ID, "https://staging.example.com"); err != nil {
+		t.Fatalf("SetDomainReplay() error = %v", err)
+	}
+	if got, err := m.DomainReplay(ctx, "app.example.com"); err != nil || got != "https://staging.example.com" {
+		t.Errorf("DomainReplay() = %q, %v, want https://staging.example.com", got, err)
+	}
+	if err := m.SetDomainHeaders(ctx, "user-1", d.ID, "X-Robots-Tag: noindex"); err != nil {
+		t.Fatalf("SetDomainHeaders() error = %v", err)
+	}
+	if got, err := m.DomainHeaders(ctx, "app.example.com"); err != nil || got != "X-Robots-Tag: noindex" {
+		t.Errorf("DomainHeaders() = %q, %v, want X-Robots-Tag: noindex", got, err)
+	}
+	if err := m.SetDomainHTTPS(ctx, "user-1", d.ID, "redirect, hsts"); err != nil {
+		t.Fatalf("SetDomainHTTPS() error = %v", err)
+	}
+	if got, err := m.DomainHTTPS(ctx, "app.example.com"); err != nil || got != "redirect, hsts" {
+		t.Errorf("DomainHTTPS() = %q, %v, want redirect, hsts", got, err)
+	}
+
+	if err := m.DeleteDomain(ctx, "user-1", d.ID); err != nil {
+		t.Fatalf("DeleteDomain() error = %v", err)
+	}
+	if domains, _ := m.ListDomains(ctx, "user-1"); len(domains) != 0 {
+		t.Errorf("ListDomains() = %+v, want empty after delete", domains)
+	}
+	if _, err := m.DomainOwner(ctx, "app.example.com"); err != ErrNotFound {
+		t.Errorf("DomainOwner() after delete error = %v, want ErrNotFound", err)
+	}
+}
+
+func TestMemoryEmailChange(t *testing.T) {
+	m := NewMemory()
+	ctx := context.Background()
+	now := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	m.SetClock(func() time.Time { return now })
+	m.AddUser(User{ID: "user-1", Email: "old@example.com"})
+	m.AddUser(User{ID: "user-2", Email: "taken@example.com"})
+
+	if err := m.CreateEmailChange(ctx, "user-1", "Taken@example.com", "hash", now.Add(time.Hour)); err != ErrEmailTaken {
+		t.Errorf("CreateEmailChange() taken error = %v, want ErrEmailTaken", err)
+	}
+	if err := m.CreateEmailChange(ctx, "user-1", "new@example.com", "hash-1", now.Add(time.Hour)); err != nil {
+		t.Fatalf("CreateEmailChange() error = %v", err)
+	}
+	// A second request replaces the first
+	if err := m.CreateEmailChange(ctx, "user-1", "newer@example.com", "hash-2", now.Add(time.Hour)); err != nil {
+		t.Fatalf("CreateEmailChange() error = %v", err)
+	}
+
+	if _, err := m.ConfirmEmailChange(ctx, "user-1", "hash-1"); err != ErrNotFound {
+		t.Errorf("ConfirmEmailChange() replaced token error = %v, want ErrNotFound", err)
+	}
+	if _, err := m.ConfirmEmailChange(ctx, "user-2", "hash-2"); err != ErrNotFound {
+		t.Errorf("ConfirmEmailChange() other user error = %v, want ErrNotFound", err)
+	}
+
+	got, err := m.ConfirmEmailChange(ctx, "user-1", "hash-2")
+	if err != nil || got != "newer@example.com" {
+		t.Fatalf("ConfirmEmailChange() = %q, %v, want newer@example.com", got, err)
+	}
+	if u, _ := m.GetUser(ctx, "user-1"); u.Email != "newer@example.com" {
+		t.Errorf("Email = %q, want newer@example.com", u.Email)
+	}
+	if _, err := m.ConfirmEmailChange(ctx, "user-1", "hash-2"); err != ErrNotFound {
+		t.Errorf("ConfirmEmailChange() reuse error = %v, want ErrNotFound", err)
+	}
+
+	m.CreateEmailChange(ctx, "user-1", "late@example.com", "hash-3", now.Add(time.Hour))
+	now = now.Add(2 * time.Hour)
+	if _, err := m.ConfirmEmailChange(ctx, "user-1", "hash-3"); err != ErrNotFound {
+		t.Errorf("ConfirmEmailChange() expired error = %v, want ErrNotFound", err)
+	}
+}
+
+func TestMemoryDeleteIdentity(t *testing.T) {
+	m := NewMemory()
+	ctx := context.Background()
+	m.AddIdentity("user-1", Identity{ID: "gh", Provider: "github"})
+	m.AddIdentity("user-1", Identity{ID: "google", Provider: "google"})
+
+	if err := m.DeleteIdentity(ctx, "user-2", "gh"); err != ErrNotFound {
+		t.Errorf("DeleteIdentity() other user error = %v, want ErrNotFound", err)
+	}
+	if err := m.DeleteIdentity(ctx, "user-1", "gh"); err != nil {
+		t.Fatalf("DeleteIdentity() error = %v", err)
+	}
+	if err := m.DeleteIdentity(ctx, "user-1", "google"); err != ErrLastIdentity {
+		t.Errorf("DeleteIdentity() last error = %v, want ErrLastIdentity", err)
+	}
+	if idents, _ := m.ListIdentities(ctx, "user-1"); len(idents) != 1 || idents[0].ID != "google" {
+		t.Errorf("ListIdentities() = %+v, want only google", idents)
+	}
+}
+
+func TestMemoryImpersonationSession(t *testing.T) {
+	m := NewMemory()
+	ctx := context.Background()
+	m.AddUser(User{ID: "u1", Email: "ada@example.com"})
+	m.CreateSession(ctx, "u1", "own", time.Now().Add(time.Hour))
+	m.CreateImpersonationSession(ctx, "u1", "support", "grace", time.Now().Add(time.Hour))
+
+	if u, _ := m.SessionUser(ctx, "own"); u.ImpersonatedBy != "" {
+		t.Errorf("own session ImpersonatedBy = %q, want empty", u.ImpersonatedBy)
+	}
+	if u, _ := m.SessionUser(ctx, "support"); u.ImpersonatedBy != "grace" {
+		t.Errorf("support session ImpersonatedBy = %q, want grace", u.ImpersonatedBy)
+	}
+	if u, _ := m.GetUser(ctx, "u1"); u.ImpersonatedBy != "" {
+		t.Errorf("GetUser() ImpersonatedBy = %q, want empty", u.ImpersonatedBy)
+	}
+}
+
+func TestMemoryTokens(t *testing.T) {
+	m := NewMemory()
+	ctx := context.Background()
+	now := time.Date(2025, 6, 15, 12, 0, 0, 0, time.UTC)
+	m.SetClock(func() time.Time { return now })
+	m.AddUser(User{ID: "user-1"})
+
+	if _, err := m.CreateToken(ctx, "user-1", "laptop", "hash-1"); err != nil {
+		t.Fatalf("CreateToken() error = %v", err)
+	}
+
+	tokens, _ := m.ListTokens(ctx, "user-1")
+	if len(tokens) != 1 || tokens[0].Name != "laptop" || tokens[0].LastUsedAt != nil {
+		t.Fatalf("ListTokens() = %+v, want one unused laptop token", tokens)
+	}
+
+	u, err := m.TokenUser(ctx, "hash-1")
+	if err != nil || u.ID != "user-1" {
+		t.Fatalf("TokenUser() = %v, %v, want user-1", u, err)
+	}
+	if tokens, _ := m.ListTokens(ctx, "user-1"); tokens[0].LastUsedAt == nil || !tokens[0].LastUsedAt.Equal(now) {
+		t.Errorf("LastUsedAt = %v, want %v", tokens[0].LastUsedAt, now)
+	}
+
+	if _, err := m.TokenUser(ctx, "unknown"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("TokenUser(unknown) error = %v, want ErrNotFound", err)
+	}
+	if tokens, _ := m.ListTokens(ctx, "user-2"); len(tokens) != 0 {
+		t.Errorf("ListTokens(user-2) = %+v, want none", tokens)
+	}
+}
+
+func TestMemoryIncidents(t *testing.T) {
+	m := NewMemory()
+	ctx := context.Background()
+
+	if _, err := m.ActiveIncident(ctx); !errors.Is(err, ErrNotFound) {
+		t.Errorf("ActiveIncident() error = %v, want ErrNotFound", err)
+	}
+
+	m.OpenIncident(ctx, Incident{Title: "first", Severity: "minor"})
+	m.OpenIncident(ctx, Incident{Title: "second", Severity: "major"})
+	if i, _ := m.ActiveIncident(ctx); i == nil || i.Title != "second" {
+		t.Errorf("ActiveIncident() = %+v, want the second incident", i)
+	}
+
+	if err := m.ResolveIncident(ctx); err != nil {
+		t.Fatalf("ResolveIncident() error = %v", err)
+	}
+	if err := m.ResolveIncident(ctx); !errors.Is(err, ErrNotFound) {
+		t.Errorf("second ResolveIncident() error = %v, want ErrNotFound (opening replaces, not stacks)", err)
+	}
+}
+
+func TestMemoryAdmin(t *testing.T) {
+	m := NewMemory()
+	ctx := context.Background()
+	m.AddUser(User{ID: "u1", Email: "ada@example.com", Plan: "free"})
+	m.AddUser(User{ID: "u2", Email: "grace@example.com", Plan: "pro"})
+	m.AddUser(User{ID: "u3", Email: "alan@example.org", Plan: "free"})
+
+	users, err := m.SearchUsers(ctx, "EXAMPLE.COM", 10)
+	if err != nil || len(users) != 2 {
+		t.Errorf("SearchUsers(example.com) = %d users, %v, want 2", len(users), err)
+	}
+	if users, _ := m.SearchUsers(ctx, "u3", 10); len(users) != 1 || users[0].Email != "alan@example.org" {
+		t.Errorf("SearchUsers(u3) = %+v, want alan", users)
+	}
+
+	if err := m.SetPlanOverride(ctx, "u1", "pro"); err != nil {
+		t.Fatalf("SetPlanOverride() error = %v", err)
+	}
+	counts, _ := m.CountUsersByPlan(ctx)
+	if counts["pro"] != 2 || counts["free"] != 1 {
+		t.Errorf("CountUsersByPlan() = %v, want pro:2 free:1", counts)
+	}
+	if err := m.SetPlanOverride(ctx, "u1", ""); err != nil {
+		t.Fatalf("clear SetPlanOverride() error = %v", err)
+	}
+	if u, _ := m.GetUser(ctx, "u1"); u.Plan != "pro" || u.PlanOverride {
+		t.Errorf("after clearing, user = %+v, want pro without override", u)
+	}
+	if err := m.SetPlanOverride(ctx, "missing", "pro"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("SetPlanOverride(missing) error = %v, want ErrNotFound", err)
+	}
+
+	m.AddDomainTraffic("u1", "small.lobber.dev", 100, 1)
+	m.AddDomainTraffic("u2", "big.lobber.dev", 5000, 10)
+	m.AddDomainTraffic("u1", "small.lobber.dev", 200, 2)
+	top, err := m.TopDomains(ctx, time.Now().Add(-time.Hour), 10)
+	if err != nil || len(top) != 2 {
+		t.Fatalf("TopDomains() = %+v, %v, want 2 domains", top, err)
+	}
+	if top[0].Hostname != "big.lobber.dev" || top[1].TotalBytes != 300 || top[1].UserEmail != "ada@example.com" {
+		t.Errorf("TopDomains() = %+v, want big first and small at 300 bytes", top)
+	}
+}
+
+func TestMemoryAbuseReports(t *testing.T) {
+	m := NewMemory()
+	ctx := context.Background()
+
+	first, _ := m.CreateAbuseReport(ctx, AbuseReport{Hostname: "phish.lobber.dev", Reason: "phishing"})
+	m.CreateAbuseReport(ctx, AbuseReport{Hostname: "spam.lobber.dev", Reason: "spam"})
+
+	if err := m.ResolveAbuseReport(ctx, first.ID, "tunnel disabled"); err != nil {
+		t.Fatalf("ResolveAbuseReport() error = %v", err)
+	}
+	if err := m.ResolveAbuseReport(ctx, first.ID, "again"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("second ResolveAbuseReport() error = %v, want ErrNotFound", err)
+	}
+
+	open, _ := m.ListAbuseReports(ctx, false, 10)
+	if len(open) != 1 || open[0].Hostname != "spam.lobber.dev" {
+		t.Errorf("open reports = %+v, want only spam", open)
+	}
+	all, _ := m.ListAbuseReports(ctx, true, 10)
+	if len(all) != 2 {
+		t.Errorf("all reports = %d, want 2", len(all))
+	}
+}
+
+func TestMemoryEvents(t *testing.T) {
+	m := NewMemory()
+	ctx := context.Background()
+
+	for i, typ := range []string{"tunnel.connected", "domain.verified", "tunnel.disconnected", "cert.issued"} {
+		userID := "user-1"
+		if i == 1 {
+			userID = "user-2"
+		}
+		m.RecordEvent(ctx, Event{UserID: userID, Type: typ, Message: typ})
+	}
+
+	ids := func(events []Event) []int64 {
+		var out []int64
+		for _, e := range events {
+			out = append(out, e.ID)
+		}
+		return out
+	}
+	tests := []struct {
+		after int64
+		limit int
+		want  []int64
+	}{
+		{0, 10, []int64{1, 3, 4}},
+		{0, 2, []int64{3, 4}},
+		{1, 10, []int64{3, 4}},
+		{1, 1, []int64{3}},
+		{4, 10, nil},
+		{99, 10, nil},
+	}
+	for _, tt := range tests {
+		got, err := m.ListEvents(ctx, "user-1", tt.after, tt.limit)
+		if err != nil {
+			t.Fatalf("ListEvents() error = %v", err)
+		}
+		if !slices.Equal(ids(got), tt.want) {
+			t.Errorf("ListEvents(after %d, limit %d) = %v, want %v", tt.after, tt.limit, ids(got), tt.want)
+		}
+	}
+}
@@ -0,0 +1,2111 @@
+// internal/store/postgres.go
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lobber-dev/lobber/internal/db"
+)
+
+// Postgres implements every store on top of the lobber schema
+type Postgres struct {
+	db *sql.DB
+}
+
+var _ All = (*Postgres)(nil)
+
+// NewPostgres creates stores backed by db
+func NewPostgres(db *sql.DB) *Postgres {
+	return &Postgres{db: db}
+}
+
+const userColumns = `
+	u.id, u.email, COALESCE(u.name, ''), COALESCE(u.plan, 'free'), COALESCE(u.avatar_url, ''), u.theme, u.data_region,
+	u.plan_override, COALESCE(u.stripe_customer_id, ''), COALESCE(u.stripe_subscription_id, ''), u.trial_ends_at,
+	u.billing_interval, u.seats, COALESCE(u.renewal_amount, 0), COALESCE(u.renewal_currency, ''), u.renews_at,
+	COALESCE(u.org_id::text, '')
+`
+
+// rowScanner is satisfied by *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// extraColumns scans columns selected after the ones a scan helper knows about
+type extraColumns struct {
+	row   rowScanner
+	extra []any
+}
+
+func (e extraColumns) Scan(dest ...any) error {
+	return e.row.Scan(append(dest, e.extra...)...)
+}
+
+func scanUser(row rowScanner) (*User, error) {
+	var u User
+	var trialEndsAt, renewsAt sql.NullTime
+	err := row.Scan(&u.ID, &u.Email, &u.Name, &u.Plan, &u.AvatarURL, &u.Theme, &u.DataRegion,
+		&u.PlanOverride, &u.StripeCustomerID, &u.StripeSubscriptionID, &trialEndsAt,
+		&u.BillingInterval, &u.Seats, &u.RenewalAmount, &u.RenewalCurrency, &renewsAt, &u.OrgID)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if trialEndsAt.Valid {
+		u.TrialEndsAt = &trialEndsAt.Time
+	}
+	if renewsAt.Valid {
+		u.RenewsAt = &renewsAt.Time
+	}
+	return &u, nil
+}
+
+// GetUser returns a user by ID
+func (p *Postgres) GetUser(ctx context.Context, id string) (*User, error) {
+	ctx, done := db.Timed(ctx, "store.GetUser")
+	defer done()
+
+	u, err := scanUser(p.db.QueryRowContext(ctx, "SELECT "+userColumns+" FROM users u WHERE u.id = $1", id))
+	if err != nil && err != ErrNotFound {
+		return nil, fmt.Errorf("get user: %w", err)
+	}
+	return u, err
+}
+
+// ProvisionUser returns the user linked to ident, or creates u and links it
+func (p *Postgres) ProvisionUser(ctx context.Context, u User, ident Identity) (*User, bool, error) {
+	ctx, done := db.Timed(ctx, "store.ProvisionUser")
+	defer done()
+
+	var userID string
+	err := p.db.QueryRowContext(ctx,
+		"SELECT user_id::text FROM oauth_identities WHERE provider = $1 AND provider_user_id = $2",
+		ident.Provider, ident.ProviderUserID).Scan(&userID)
+	if err == nil {
+		existing, err := p.GetUser(ctx, userID)
+		return existing, false, err
+	}
+	if err != sql.ErrNoRows {
+		return nil, false, fmt.Errorf("get identity: %w", err)
+	}
+
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, false, fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO users (email, name, org_id)
+		SELECT $1, NULLIF($2, ''), NULLIF($3, '')::uuid
+		WHERE NOT EXISTS (SELECT 1 FROM users WHERE lower(email) = lower($1))
+		ON CONFLICT (email) DO NOTHING
+		RETURNING id::text
+	`, u.Email, u.Name, u.OrgID).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return nil, false, ErrEmailTaken
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("create user: %w", err)
+	}
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO oauth_identities (user_id, provider, provider_user_id, email)
+		VALUES ($1, $2, $3, NULLIF($4, ''))
+	`, userID, ident.Provider, ident.ProviderUserID, ident.Email)
+	if err != nil {
+		return nil, false, fmt.Errorf("link identity: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, false, fmt.Errorf("commit user: %w", err)
+	}
+
+	created, err := p.GetUser(ctx, userID)
+	return created, true, err
+}
+
+// ListMembers returns the users provisioned for an org, by email
+func (p *Postgres) ListMembers(ctx context.Context, orgID string) ([]User, error) {
+	ctx, done := db.Timed(ctx, "store.ListMembers")
+	defer done()
+
+	rows, err := p.db.QueryContext(ctx,
+		"SELECT "+userColumns+" FROM users u WHERE u.org_id::text = $1 ORDER BY u.email", orgID)
+	if err != nil {
+		return nil, fmt.Errorf("list members: %w", err)
+	}
+	defer rows.Close()
+
+	members := []User{}
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan row: %w", err)
+		}
+		members = append(members, *u)
+	}
+	return members, rows.Err()
+}
+
+// SetPlan changes a user's plan
+func (p *Postgres) SetPlan(ctx context.Context, id, plan string) error {
+	ctx, done := db.Timed(ctx, "store.SetPlan")
+	defer done()
+
+	res, err := p.db.ExecContext(ctx, "UPDATE users SET plan = $1, updated_at = NOW() WHERE id = $2", plan, id)
+	if err != nil {
+		return fmt.Errorf("set plan: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// UpdateProfile sets a user's display name and avatar
+func (p *Postgres) UpdateProfile(ctx context.Context, userID, name, avatarURL string) error {
+	ctx, done := db.Timed(ctx, "store.UpdateProfile")
+	defer done()
+
+	res, err := p.db.ExecContext(ctx, `
+		UPDATE users
+		SET name = NULLIF($1, ''), avatar_url = NULLIF($2, ''), updated_at = NOW()
+		WHERE id = $3
+	`, name, avatarURL, userID)
+	if err != nil {
+		return fmt.Errorf("update profile: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// SetTheme saves a user's dashboard theme
+func (p *Postgres) SetTheme(ctx context.Context, userID, theme string) error {
+	ctx, done := db.Timed(ctx, "store.SetTheme")
+	defer done()
+
+	res, err := p.db.ExecContext(ctx, "UPDATE users SET theme = $1, updated_at = NOW() WHERE id = $2", theme, userID)
+	if err != nil {
+		return fmt.Errorf("set theme: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// SetDataRegion moves a user, and the request logs they have, to a data
+// region. Postgres moves each log row into the region's partition.
+func (p *Postgres) SetDataRegion(ctx context.Context, userID, region string) error {
+	ctx, done := db.Timed(ctx, "store.SetDataRegion")
+	defer done()
+
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, "UPDATE users SET data_region = $1, updated_at = NOW() WHERE id = $2", region, userID)
+	if err != nil {
+		return fmt.Errorf("set data region: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE request_logs SET region = $1
+		WHERE region <> $1 AND domain_id IN (SELECT id FROM domains WHERE user_id = $2)
+	`, region, userID); err != nil {
+		return fmt.Errorf("move request logs: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit data region: %w", err)
+	}
+	return nil
+}
+
+// Preferences returns a user's preferences, the defaults for any they have
+// never saved
+func (p *Postgres) Preferences(ctx context.Context, userID string) (Preferences, error) {
+	ctx, done := db.Timed(ctx, "store.Preferences")
+	defer done()
+
+	d := DefaultPreferences()
+	var pr Preferences
+	err := p.db.QueryRowContext(ctx, `
+		SELECT COALESCE(pr.inspect, $2), COALESCE(pr.log_retention_days, $3), COALESCE(pr.burst_limit, $4)
+		FROM users u LEFT JOIN user_preferences pr ON pr.user_id = u.id
+		WHERE u.id = $1
+	`, userID, d.Inspect, d.LogRetentionDays, d.BurstLimit).Scan(&pr.Inspect, &pr.LogRetentionDays, &pr.BurstLimit)
+	if err == sql.ErrNoRows {
+		return Preferences{}, ErrNotFound
+	}
+	if err != nil {
+		return Preferences{}, fmt.Errorf("get preferences: %w", err)
+	}
+	return pr, nil
+}
+
+// SetPreferences saves a user's preferences
+func (p *Postgres) SetPreferences(ctx context.Context, userID string, pr Preferences) error {
+	ctx, done := db.Timed(ctx, "store.SetPreferences")
+	defer done()
+
+	res, err := p.db.ExecContext(ctx, `
+		INSERT INTO user_preferences (user_id, inspect, log_retention_days, burst_limit)
+		SELECT id, $2, $3, $4 FROM users WHERE id = $1
+		ON CONFLICT (user_id) DO UPDATE SET
+			inspect = EXCLUDED.inspect,
+			log_retention_days = EXCLUDED.log_retention_days,
+			burst_limit = EXCLUDED.burst_limit,
+			updated_at = NOW()
+	`, userID, pr.Inspect, pr.LogRetentionDays, pr.BurstLimit)
+	if err != nil {
+		return fmt.Errorf("set preferences: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// GitHubApp returns a user's GitHub App
+func (p *Postgres) GitHubApp(ctx context.Context, userID string) (*GitHubApp, error) {
+	ctx, done := db.Timed(ctx, "store.GitHubApp")
+	defer done()
+
+	app := GitHubApp{UserID: userID}
+	err := p.db.QueryRowContext(ctx, `
+		SELECT app_id, key_sealed, created_at, updated_at FROM github_apps WHERE user_id = $1
+	`, userID).Scan(&app.AppID, &app.KeySealed, &app.CreatedAt, &app.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get github app: %w", err)
+	}
+	return &app, nil
+}
+
+// SetGitHubApp creates or replaces a user's GitHub App
+func (p *Postgres) SetGitHubApp(ctx context.Context, app GitHubApp) error {
+	ctx, done := db.Timed(ctx, "store.SetGitHubApp")
+	defer done()
+
+	res, err := p.db.ExecContext(ctx, `
+		INSERT INTO github_apps (user_id, app_id, key_sealed)
+		SELECT id, $2, $3 FROM users WHERE id = $1
+		ON CONFLICT (user_id) DO UPDATE SET
+			app_id = EXCLUDED.app_id,
+			key_sealed = EXCLUDED.key_sealed,
+			updated_at = NOW()
+	`, app.UserID, app.AppID, app.KeySealed)
+	if err != nil {
+		return fmt.Errorf("set github app: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// DeleteGitHubApp removes a user's GitHub App
+func (p *Postgres) DeleteGitHubApp(ctx context.Context, userID string) error {
+	ctx, done := db.Timed(ctx, "store.DeleteGitHubApp")
+	defer done()
+
+	res, err := p.db.ExecContext(ctx, `DELETE FROM github_apps WHERE user_id = $1`, userID)
+	if err != nil {
+		return fmt.Errorf("delete github app: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// CreateEmailChange stores a pending email change, replacing any earlier one
+func (p *Postgres) CreateEmailChange(ctx context.Context, userID, newEmail, tokenHash string, expiresAt time.Time) error {
+	ctx, done := db.Timed(ctx, "store.CreateEmailChange")
+	defer done()
+
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var taken bool
+	err = tx.QueryRowContext(ctx,
+		"SELECT EXISTS (SELECT 1 FROM users WHERE lower(email) = lower($1) AND id <> $2)",
+		newEmail, userID).Scan(&taken)
+	if err != nil {
+		return fmt.Errorf("check email: %w", err)
+	}
+	if taken {
+		return ErrEmailTaken
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM email_changes WHERE user_id = $1", userID); err != nil {
+		return fmt.Errorf("clear email changes: %w", err)
+	}
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO email_changes (user_id, new_email, token_hash, expires_at)
+		VALUES ($1, $2, $3, $4)
+	`, userID, newEmail, tokenHash, expiresAt)
+	if err != nil {
+		return fmt.Errorf("create email change: %w", err)
+	}
+	return tx.Commit()
+}
+
+// ConfirmEmailChange applies a pending email change in one transaction
+func (p *Postgres) ConfirmEmailChange(ctx context.Context, userID, tokenHash string) (string, error) {
+	ctx, done := db.Timed(ctx, "store.ConfirmEmailChange")
+	defer done()
+
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var newEmail string
+	err = tx.QueryRowContext(ctx, `
+		SELECT new_email FROM email_changes
+		WHERE user_id = $1 AND token_hash = $2 AND expires_at > NOW()
+		FOR UPDATE
+	`, userID, tokenHash).Scan(&newEmail)
+	if err == sql.ErrNoRows {
+		return "", ErrNotFound
+	}
+	if err != nil {
+		return "", fmt.Errorf("get email change: %w", err)
+	}
+
+	res, err := tx.ExecContext(ctx, `
+		UPDATE users
+		SET email = $1, updated_at = NOW()
+		WHERE id = $2
+		AND NOT EXISTS (SELECT 1 FROM users WHERE lower(email) = lower($1) AND id <> $2)
+	`, newEmail, userID)
+	if err != nil {
+		return "", fmt.Errorf("update email: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return "", ErrEmailTaken
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM email_changes WHERE user_id = $1", userID); err != nil {
+		return "", fmt.Errorf("clear email changes: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return "", fmt.Errorf("commit email change: %w", err)
+	}
+	return newEmail, nil
+}
+
+// ListIdentities returns a user's linked OAuth identities, oldest first
+func (p *Postgres) ListIdentities(ctx context.Context, userID string) ([]Identity, error) {
+	ctx, done := db.Timed(ctx, "store.ListIdentities")
+	defer done()
+
+	rows, err := p.db.QueryContext(ctx, `
+		SELECT id, provider, provider_user_id, COALESCE(email, ''), created_at
+		FROM oauth_identities
+		WHERE user_id = $1
+		ORDER BY created_at
+	`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("list identities: %w", err)
+	}
+	defer rows.Close()
+
+	var identities []Identity
+	for rows.Next() {
+		var i Identity
+		if err := rows.Scan(&i.ID, &i.Provider, &i.ProviderUserID, &i.Email, &i.CreatedAt); err != nil {
+			return nil, fmt.Errorf("scan row: %w", err)
+		}
+		identities = append(identities, i)
+	}
+	return identities, rows.Err()
+}
+
+// DeleteIdentity unlinks an identity unless it is the user's only one
+func (p *Postgres) DeleteIdentity(ctx context.Context, userID, id string) error {
+	ctx, done := db.Timed(ctx, "store.DeleteIdentity")
+	defer done()
+
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Lock the user's identities so two concurrent unlinks can't remove both
+	rows, err := tx.QueryContext(ctx, "SELECT id::text FROM oauth_identities WHERE user_id = $1 FOR UPDATE", userID)
+	if err != nil {
+		return fmt.Errorf("lock identities: %w", err)
+	}
+	var count int
+	found := false
+	for rows.Next() {
+		var existing string
+		if err := rows.Scan(&existing); err != nil {
+			rows.Close()
+			return fmt.Errorf("scan row: %w", err)
+		}
+		count++
+		found = found || existing == id
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("lock identities: %w", err)
+	}
+	if !found {
+		return ErrNotFound
+	}
+	if count == 1 {
+		return ErrLastIdentity
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM oauth_identities WHERE user_id = $1 AND id::text = $2", userID, id); err != nil {
+		return fmt.Errorf("delete identity: %w", err)
+	}
+	return tx.Commit()
+}
+
+// RecordAudit appends an entry to the audit log
+func (p *Postgres) RecordAudit(ctx context.Context, e AuditEntry) error {
+	ctx, done := db.Timed(ctx, "store.RecordAudit")
+	defer done()
+
+	_, err := p.db.ExecContext(ctx, `
+		INSERT INTO audit_log (user_id, action, detail, ip_address)
+		VALUES ($1, $2, NULLIF($3, ''), NULLIF($4, ''))
+	`, e.UserID, e.Action, e.Detail, e.IPAddress)
+	if err != nil {
+		return fmt.Errorf("record audit: %w", err)
+	}
+	return nil
+}
+
+// ListAudit returns a user's most recent audit entries, newest first
+func (p *Postgres) ListAudit(ctx context.Context, userID string, limit int) ([]AuditEntry, error) {
+	ctx, done := db.Timed(ctx, "store.ListAudit")
+	defer done()
+
+	rows, err := p.db.QueryContext(ctx, `
+		SELECT id, user_id, action, COALESCE(detail, ''), COALESCE(ip_address, ''), created_at
+		FROM audit_log
+		WHERE user_id = $1
+		ORDER BY created_at DESC
+		LIMIT $2
+	`, userID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("list audit log: %w", err)
+	}
+	defer rows.Close()
+
+	var entries []AuditEntry
+	for rows.Next() {
+		var e AuditEntry
+		if err := rows.Scan(&e.ID, &e.UserID, &e.Action, &e.Detail, &e.IPAddress, &e.CreatedAt); err != nil {
+			return nil, fmt.Errorf("scan row: %w", err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// ListDomains returns a user's domains, newest first
+func (p *Postgres) ListDomains(ctx context.Context, userID string) ([]Domain, error) {
+	ctx, done := db.Timed(ctx, "store.ListDomains")
+	defer done()
+
+	rows, err := p.db.QueryContext(ctx, `
+		SELECT id, hostname, verified, schedule, sampling, replay, headers, https, created_at
+		FROM domains
+		WHERE user_id = $1
+		ORDER BY created_at DESC
+	`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("list domains: %w", err)
+	}
+	defer rows.Close()
+
+	var domains []Domain
+	for rows.Next() {
+		var d Domain
+		if err := rows.Scan(&d.ID, &d.Name, &d.Verified, &d.Schedule, &d.Sampling, &d.Replay, &d.Headers, &d.HTTPS, &d.CreatedAt); err != nil {
+			return nil, fmt.Errorf("scan row: %w", err)
+		}
+		domains = append(domains, d)
+	}
+	return domains, rows.Err()
+}
+
+// GetDomain returns one of a user's domains
+func (p *Postgres) GetDomain(ctx context.Context, userID, id string) (*Domain, error) {
+	ctx, done := db.Timed(ctx, "store.GetDomain")
+	defer done()
+
+	var d Domain
+	err := p.db.QueryRowContext(ctx, `
+		SELECT id, hostname, verified, schedule, sampling, replay, headers, https, created_at
+		FROM domains
+		WHERE user_id = $1 AND id::text = $2
+	`, userID, id).Scan(&d.ID, &d.Name, &d.Verified, &d.Schedule, &d.Sampling, &d.Replay, &d.Headers, &d.HTTPS, &d.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get domain: %w", err)
+	}
+	return &d, nil
+}
+
+// DomainOwner returns the ID of the user who registered hostname
+func (p *Postgres) DomainOwner(ctx context.Context, hostname string) (string, error) {
+	ctx, done := db.Timed(ctx, "store.DomainOwner")
+	defer done()
+
+	var userID string
+	err := p.db.QueryRowContext(ctx, "SELECT user_id FROM domains WHERE hostname = $1", hostname).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return "", ErrNotFound
+	}
+	if err != nil {
+		return "", fmt.Errorf("get domain owner: %w", err)
+	}
+	return userID, nil
+}
+
+// CreateDomain registers an unverified hostname to a user
+func (p *Postgres) CreateDomain(ctx context.Context, userID, hostname string) (*Domain, error) {
+	ctx, done := db.Timed(ctx, "store.CreateDomain")
+	defer done()
+
+	d := Domain{Name: hostname}
+	err := p.db.QueryRowContext(ctx, `
+		INSERT INTO domains (user_id, hostname)
+		VALUES ($1, $2)
+		ON CONFLICT (hostname) DO NOTHING
+		RETURNING id, verified, created_at
+	`, userID, hostname).Scan(&d.ID, &d.Verified, &d.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrDomainTaken
+	}
+	if err != nil {
+		return nil, fmt.Errorf("create domain: %w", err)
+	}
+	return &d, nil
+}
+
+// MarkDomainVerified records a successful DNS check
+func (p *Postgres) MarkDomainVerified(ctx context.Context, userID, id string) error {
+	ctx, done := db.Timed(ctx, "store.MarkDomainVerified")
+	defer done()
+
+	res, err := p.db.ExecContext(ctx, `
+		UPDATE domains
+		SET verified = TRUE, verified_at = NOW()
+		WHERE user_id = $1 AND id::text = $2
+	`, userID, id)
+	if err != nil {
+		return fmt.Errorf("mark domain verified: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// SetDomainSchedule sets when a user's domain takes traffic
+func (p *Postgres) SetDomainSchedule(ctx context.Context, userID, id, schedule string) error {
+	ctx, done := db.Timed(ctx, "store.SetDomainSchedule")
+	defer done()
+
+	res, err := p.db.ExecContext(ctx, `
+		UPDATE domains
+		SET schedule = $3
+		WHERE user_id = $1 AND id::text = $2
+	`, userID, id, schedule)
+	if err != nil {
+		return fmt.Errorf("set domain schedule: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// DomainSchedule returns when hostname takes traffic
+func (p *Postgres) DomainSchedule(ctx context.Context, hostname string) (string, error) {
+	ctx, done := db.Timed(ctx, "store.DomainSchedule")
+	defer done()
+
+	var schedule string
+	err := p.db.QueryRowContext(ctx, "SELECT schedule FROM domains WHERE hostname = $1", hostname).Scan(&schedule)
+	if err == sql.ErrNoRows {
+		return "", ErrNotFound
+	}
+	if err != nil {
+		return "", fmt.Errorf("get domain schedule: %w", err)
+	}
+	return schedule, nil
+}
+
+// SetDomainSampling sets which of a user's domain's requests are logged
+func (p *Postgres) SetDomainSampling(ctx context.Context, userID, id, sampling string) error {
+	ctx, done := db.Timed(ctx, "store.SetDomainSampling")
+	defer done()
+
+	res, err := p.db.ExecContext(ctx, `
+		UPDATE domains
+		SET sampling = $3
+		WHERE user_id = $1 AND id::text = $2
+	`, userID, id, sampling)
+	if err != nil {
+		return fmt.Errorf("set domain sampling: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// DomainSampling returns which of hostname's requests are logged
+func (p *Postgres) DomainSampling(ctx context.Context, hostname string) (string, error) {
+	ctx, done := db.Timed(ctx, "store.DomainSampling")
+	defer done()
+
+	var sampling string
+	err := p.db.QueryRowContext(ctx, "SELECT sampling FROM domains WHERE hostname = $1", hostname).Scan(&sampling)
+	if err == sql.ErrNoRows {
+		return "", ErrNotFound
+	}
+	if err != nil {
+		return "", fmt.Errorf("get domain sampling: %w", err)
+	}
+	return sampling, nil
+}
+
+// SetDomainReplay sets where a copy of a user's domain's traffic is sent
+func (p *Postgres) SetDomainReplay(ctx context.Context, userID, id, replay string) error {
+	ctx, done := db.Timed(ctx, "store.SetDomainReplay")
+	defer done()
+
+	res, err := p.db.ExecContext(ctx, `
+		UPDATE domains
+		SET replay = $3
+		WHERE user_id = $1 AND id::text = $2
+	`, userID, id, replay)
+	if err != nil {
+		return fmt.Errorf("set domain replay: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// DomainReplay returns where a copy of hostname's traffic is sent
+func (p *Postgres) DomainReplay(ctx context.Context, hostname string) (string, error) {
+	ctx, done := db.Timed(ctx, "store.DomainReplay")
+	defer done()
+
+	var replay string
+	err := p.db.QueryRowContext(ctx, "SELECT replay FROM domains WHERE hostname = $1", hostname).Scan(&replay)
+	if err == sql.ErrNoRows {
+		return "", ErrNotFound
+	}
+	if err != nil {
+		return "", fmt.Errorf("get domain replay: %w", err)
+	}
+	return replay, nil
+}
+
+// SetDomainHeaders sets the headers added to a user's domain's responses
+func (p *Postgres) SetDomainHeaders(ctx context.Context, userID, id, headers string) error {
+	ctx, done := db.Timed(ctx, "store.SetDomainHeaders")
+	defer done()
+
+	res, err := p.db.ExecContext(ctx, `
+		UPDATE domains
+		SET headers = $3
+		WHERE user_id = $1 AND id::text = $2
+	`, userID, id, headers)
+	if err != nil {
+		return fmt.Errorf("set domain headers: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// DomainHeaders returns the headers added to hostname's responses
+func (p *Postgres) DomainHeaders(ctx context.Context, hostname string) (string, error) {
+	ctx, done := db.Timed(ctx, "store.DomainHeaders")
+	defer done()
+
+	var headers string
+	err := p.db.QueryRowContext(ctx, "SELECT headers FROM domains WHERE hostname = $1", hostname).Scan(&headers)
+	if err == sql.ErrNoRows {
+		return "", ErrNotFound
+	}
+	if err != nil {
+		return "", fmt.Errorf("get domain headers: %w", err)
+	}
+	return headers, nil
+}
+
+// SetDomainHTTPS sets how visitors to a user's domain are kept on HTTPS
+func (p *Postgres) SetDomainHTTPS(ctx context.Context, userID, id, policy string) error {
+	ctx, done := db.Timed(ctx, "store.SetDomainHTTPS")
+	defer done()
+
+	res, err := p.db.ExecContext(ctx, `
+		UPDATE domains
+		SET https = $3
+		WHERE user_id = $1 AND id::text = $2
+	`, userID, id, policy)
+	if err != nil {
+		return fmt.Errorf("set domain https: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// DomainHTTPS returns hostname's HTTPS policy
+func (p *Postgres) DomainHTTPS(ctx context.Context, hostname string) (string, error) {
+	ctx, done := db.Timed(ctx, "store.DomainHTTPS")
+	defer done()
+
+	var policy string
+	err := p.db.QueryRowContext(ctx, "SELECT https FROM domains WHERE hostname = $1", hostname).Scan(&policy)
+	if err == sql.ErrNoRows {
+		return "", ErrNotFound
+	}
+	if err != nil {
+		return "", fmt.Errorf("get domain https: %w", err)
+	}
+	return policy, nil
+}
+
+// DeleteDomain removes one of a user's domains
+func (p *Postgres) DeleteDomain(ctx context.Context, userID, id string) error {
+	ctx, done := db.Timed(ctx, "store.DeleteDomain")
+	defer done()
+
+	res, err := p.db.ExecContext(ctx, "DELETE FROM domains WHERE user_id = $1 AND id::text = $2", userID, id)
+	if err != nil {
+		return fmt.Errorf("delete domain: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// GrantDomain lets the user with email connect tunnels on one of the
+// owner's domains
+func (p *Postgres) GrantDomain(ctx context.Context, ownerID, id, email string) (*DomainGrant, error) {
+	ctx, done := db.Timed(ctx, "store.GrantDomain")
+	defer done()
+
+	var g DomainGrant
+	err := p.db.QueryRowContext(ctx, `
+		SELECT d.id, d.hostname, u.id, u.email
+		FROM domains d, users u
+		WHERE d.user_id = $1 AND d.id::text = $2 AND lower(u.email) = lower($3)
+	`, ownerID, id, email).Scan(&g.DomainID, &g.Hostname, &g.UserID, &g.Email)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("find domain and member: %w", err)
+	}
+
+	// A repeated grant keeps its original date
+	err = p.db.QueryRowContext(ctx, `
+		INSERT INTO domain_grants (domain_id, user_id) VALUES ($1, $2)
+		ON CONFLICT (domain_id, user_id) DO UPDATE SET created_at = domain_grants.created_at
+		RETURNING created_at
+	`, g.DomainID, g.UserID).Scan(&g.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("grant domain: %w", err)
+	}
+	return &g, nil
+}
+
+// RevokeDomain takes back a grant on one of the owner's domains
+func (p *Postgres) RevokeDomain(ctx context.Context, ownerID, id, memberID string) error {
+	ctx, done := db.Timed(ctx, "store.RevokeDomain")
+	defer done()
+
+	res, err := p.db.ExecContext(ctx, `
+		DELETE FROM domain_grants g USING domains d
+		WHERE g.domain_id = d.id AND d.user_id = $1 AND d.id::text = $2 AND g.user_id::text = $3
+	`, ownerID, id, memberID)
+	if err != nil {
+		return fmt.Errorf("revoke domain: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// ListDomainGrants returns the grants on the owner's domains, oldest first
+func (p *Postgres) ListDomainGrants(ctx context.Context, ownerID string) ([]DomainGrant, error) {
+	ctx, done := db.Timed(ctx, "store.ListDomainGrants")
+	defer done()
+
+	rows, err := p.db.QueryContext(ctx, `
+		SELECT g.domain_id, d.hostname, g.user_id, u.email, g.created_at
+		FROM domain_grants g
+		JOIN domains d ON d.id = g.domain_id
+		JOIN users u ON u.id = g.user_id
+		WHERE d.user_id = $1
+		ORDER BY g.created_at, d.hostname
+	`, ownerID)
+	if err != nil {
+		return nil, fmt.Errorf("list domain grants: %w", err)
+	}
+	defer rows.Close()
+
+	grants := []DomainGrant{}
+	for rows.Next() {
+		var g DomainGrant
+		if err := rows.Scan(&g.DomainID, &g.Hostname, &g.UserID, &g.Email, &g.CreatedAt); err != nil {
+			return nil, fmt.Errorf("scan domain grant: %w", err)
+		}
+		grants = append(grants, g)
+	}
+	return grants, rows.Err()
+}
+
+// MayBindDomain reports whether userID may connect a tunnel on hostname.
+// Only a verified claim restricts it, as anyone can add a hostname
+// unverified. User IDs compare as text, as an auth plugin's needn't be UUIDs.
+func (p *Postgres) MayBindDomain(ctx context.Context, userID, hostname string) (bool, error) {
+	ctx, done := db.Timed(ctx, "store.MayBindDomain")
+	defer done()
+
+	var ok bool
+	err := p.db.QueryRowContext(ctx, `
+		SELECT d.user_id::text = $1 OR EXISTS (
+			SELECT 1 FROM domain_grants g WHERE g.domain_id = d.id AND g.user_id::text = $1
+		)
+		FROM domains d WHERE d.hostname = $2 AND d.verified
+	`, userID, hostname).Scan(&ok)
+	if err == sql.ErrNoRows {
+		return true, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("check domain binding: %w", err)
+	}
+	return ok, nil
+}
+
+// RecordBandwidth stores a usage sample for a tunnel session
+func (p *Postgres) RecordBandwidth(ctx context.Context, userID, tunnelSessionID string, bytesIn, bytesOut int64) error {
+	ctx, done := db.Timed(ctx, "store.RecordBandwidth")
+	defer done()
+
+	_, err := p.db.ExecContext(ctx, `
+		INSERT INTO bandwidth_usage (user_id, tunnel_session_id, bytes_in, bytes_out, recorded_at)
+		VALUES ($1, NULLIF($2, '')::UUID, $3, $4, NOW())
+	`, userID, tunnelSessionID, bytesIn, bytesOut)
+	if err != nil {
+		return fmt.Errorf("record bandwidth: %w", err)
+	}
+	return nil
+}
+
+// StartTunnelSession opens a session against the domain that owns hostname
+func (p *Postgres) StartTunnelSession(ctx context.Context, hostname, name string) (string, error) {
+	ctx, done := db.Timed(ctx, "store.StartTunnelSession")
+	defer done()
+
+	var id string
+	err := p.db.QueryRowContext(ctx, `
+		INSERT INTO tunnel_sessions (domain_id, name)
+		SELECT id, $2 FROM domains WHERE hostname = $1
+		RETURNING id
+	`, hostname, name).Scan(&id)
+	if err == sql.ErrNoRows {
+		return "", ErrNotFound
+	}
+	if err != nil {
+		return "", fmt.Errorf("start tunnel session: %w", err)
+	}
+	return id, nil
+}
+
+// EndTunnelSession closes a session opened by StartTunnelSession
+func (p *Postgres) EndTunnelSession(ctx context.Context, id, reason string) error {
+	ctx, done := db.Timed(ctx, "store.EndTunnelSession")
+	defer done()
+
+	res, err := p.db.ExecContext(ctx, `
+		UPDATE tunnel_sessions SET ended_at = NOW(), disconnect_reason = $2
+		WHERE id = $1 AND ended_at IS NULL
+	`, id, reason)
+	if err != nil {
+		return fmt.Errorf("end tunnel session: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// tunnelGroupSQL groups sessions and requests the way TunnelHistory does: by
+// name if the tunnel had one, else by hostname
+const tunnelGroupSQL = "CASE WHEN %[1]s <> '' THEN 'n:' || %[1]s ELSE 'h:' || d.hostname END"
+
+// TunnelHistory sums up the user's tunnels with sessions since the given time
+func (p *Postgres) TunnelHistory(ctx context.Context, userID string, since time.Time) ([]TunnelHistory, error) {
+	ctx, done := db.Timed(ctx, "store.TunnelHistory")
+	defer done()
+
+	rows, err := p.db.QueryContext(ctx, `
+		WITH s AS (
+			SELECT ts.id, ts.name, d.hostname, ts.started_at, `+fmt.Sprintf(tunnelGroupSQL, "ts.name")+` AS grp
+			FROM tunnel_sessions ts
+			JOIN domains d ON d.id = ts.domain_id
+			WHERE d.user_id = $1 AND ts.started_at >= $2
+		), bytes AS (
+			SELECT s.grp, SUM(bu.bytes_in + bu.bytes_out) AS total
+			FROM bandwidth_usage bu
+			JOIN s ON s.id = bu.tunnel_session_id
+			GROUP BY s.grp
+		), reqs AS (
+			SELECT `+fmt.Sprintf(tunnelGroupSQL, "r.tunnel_name")+` AS grp, COUNT(*) AS n
+			FROM request_logs r
+			JOIN domains d ON d.id = r.domain_id
+			WHERE d.user_id = $1 AND r.created_at >= $2
+			GROUP BY 1
+		)
+		SELECT MAX(s.name), string_agg(DISTINCT s.hostname, ',' ORDER BY s.hostname), COUNT(*),
+			MAX(s.started_at), COALESCE(MAX(b.total), 0), COALESCE(MAX(q.n), 0)
+		FROM s
+		LEFT JOIN bytes b ON b.grp = s.grp
+		LEFT JOIN reqs q ON q.grp = s.grp
+		GROUP BY s.grp
+		ORDER BY MAX(s.started_at) DESC, MIN(s.hostname)
+	`, userID, since)
+	if err != nil {
+		return nil, fmt.Errorf("tunnel history: %w", err)
+	}
+	defer rows.Close()
+
+	var history []TunnelHistory
+	for rows.Next() {
+		var h TunnelHistory
+		var hostnames string
+		if err := rows.Scan(&h.Name, &hostnames, &h.Sessions, &h.LastSeen, &h.TotalBytes, &h.Requests); err != nil {
+			return nil, fmt.Errorf("scan row: %w", err)
+		}
+		h.Hostnames = strings.Split(hostnames, ",")
+		history = append(history, h)
+	}
+	return history, rows.Err()
+}
+
+// NamedTunnelSessions returns the latest sessions of the user's named tunnel
+func (p *Postgres) NamedTunnelSessions(ctx context.Context, userID, name string, limit int) ([]TunnelSession, error) {
+	ctx, done := db.Timed(ctx, "store.NamedTunnelSessions")
+	defer done()
+
+	rows, err := p.db.QueryContext(ctx, `
+		SELECT ts.id, d.hostname, ts.name, ts.started_at, ts.ended_at, COALESCE(ts.disconnect_reason, ''),
+			COALESCE((SELECT SUM(bu.bytes_in + bu.bytes_out) FROM bandwidth_usage bu WHERE bu.tunnel_session_id = ts.id), 0)
+		FROM tunnel_sessions ts
+		JOIN domains d ON d.id = ts.domain_id
+		WHERE d.user_id = $1 AND ts.name = $2
+		ORDER BY ts.started_at DESC
+		LIMIT $3
+	`, userID, name, limit)
+	if err != nil {
+		return nil, fmt.Errorf("named tunnel sessions: %w", err)
+	}
+	defer rows.Close()
+
+	var sessions []TunnelSession
+	for rows.Next() {
+		var t TunnelSession
+		if err := rows.Scan(&t.ID, &t.Domain, &t.Name, &t.StartedAt, &t.EndedAt, &t.DisconnectReason, &t.Bytes); err != nil {
+			return nil, fmt.Errorf("scan row: %w", err)
+		}
+		sessions = append(sessions, t)
+	}
+	return sessions, rows.Err()
+}
+
+// MonthlyUsage returns the user's bandwidth since the start of the month
+func (p *Postgres) MonthlyUsage(ctx context.Context, userID string) (int64, error) {
+	ctx, done := db.Timed(ctx, "store.MonthlyUsage")
+	defer done()
+
+	var total int64
+	err := p.db.QueryRowContext(ctx, `
+		SELECT COALESCE(SUM(bytes_in + bytes_out), 0)
+		FROM bandwidth_usage
+		WHERE user_id = $1
+		AND recorded_at >= date_trunc('month', NOW())
+	`, userID).Scan(&total)
+	if err != nil {
+		return 0, fmt.Errorf("get user usage: %w", err)
+	}
+	return total, nil
+}
+
+// RecentRequests returns the user's latest request logs across all domains
+func (p *Postgres) RecentRequests(ctx context.Context, userID string, limit int) ([]RequestLog, error) {
+	ctx, done := db.Timed(ctx, "store.RecentRequests")
+	defer done()
+
+	rows, err := p.db.QueryContext(ctx, `
+		SELECT `+requestLogColumns+`
+		FROM request_logs r
+		JOIN domains d ON r.domain_id = d.id
+		WHERE d.user_id = $1
+		ORDER BY r.created_at DESC
+		LIMIT $2
+	`, userID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("recent requests: %w", err)
+	}
+	return scanRequestLogs(rows)
+}
+
+const requestLogColumns = `r.id, r.method, r.path, r.status_code, r.duration_ms, d.hostname,
+	r.request_size_bytes, r.response_size_bytes, r.created_at,
+	r.remote_ip, r.tls_version, r.alpn, r.tls_fingerprint, r.labels, r.tunnel_name, r.region,
+	r.relay_us, r.tunnel_us, r.local_us, r.write_us, r.local_status, r.client_version`
+
+// scanRequestLogs reads and closes rows selected with requestLogColumns
+func scanRequestLogs(rows *sql.Rows) ([]RequestLog, error) {
+	defer rows.Close()
+
+	var logs []RequestLog
+	for rows.Next() {
+		var l RequestLog
+		var durationMs, relayUs, tunnelUs, localUs, writeUs int64
+		var labels []byte
+		if err := rows.Scan(&l.ID, &l.Method, &l.Path, &l.StatusCode, &durationMs, &l.Domain,
+			&l.RequestSize, &l.ResponseSize, &l.CreatedAt,
+			&l.RemoteIP, &l.TLSVersion, &l.ALPN, &l.TLSFingerprint, &labels, &l.TunnelName, &l.Region,
+			&relayUs, &tunnelUs, &localUs, &writeUs, &l.LocalStatus, &l.ClientVersion); err != nil {
+			return nil, fmt.Errorf("scan row: %w", err)
+		}
+		if err := json.Unmarshal(labels, &l.Labels); err != nil {
+			return nil, fmt.Errorf("decode labels: %w", err)
+		}
+		if len(l.Labels) == 0 {
+			l.Labels = nil
+		}
+		l.Duration = time.Duration(durationMs) * time.Millisecond
+		l.Latency = Latency{
+			Relay:  time.Duration(relayUs) * time.Microsecond,
+			Tunnel: time.Duration(tunnelUs) * time.Microsecond,
+			Local:  time.Duration(localUs) * time.Microsecond,
+			Write:  time.Duration(writeUs) * time.Microsecond,
+		}
+		logs = append(logs, l)
+	}
+	return logs, rows.Err()
+}
+
+// ClientStats sums up a user's logged requests per client version. Only
+// clients that report their version say how the local server did.
+func (p *Postgres) ClientStats(ctx context.Context, userID string, since time.Time) ([]ClientStats, error) {
+	ctx, done := db.Timed(ctx, "store.ClientStats")
+	defer done()
+
+	rows, err := p.db.QueryContext(ctx, `
+		SELECT r.client_version, COUNT(*),
+			COUNT(*) FILTER (WHERE r.client_version <> '' AND (r.local_status = 0 OR r.local_status >= 500)),
+			COALESCE(AVG(r.local_us) FILTER (WHERE r.client_version <> ''), 0) / 1000
+		FROM request_logs r
+		JOIN domains d ON r.domain_id = d.id
+		WHERE d.user_id = $1 AND r.created_at >= $2
+		GROUP BY r.client_version
+		ORDER BY COUNT(*) DESC, r.client_version
+	`, userID, since)
+	if err != nil {
+		return nil, fmt.Errorf("client stats: %w", err)
+	}
+	defer rows.Close()
+
+	var stats []ClientStats
+	for rows.Next() {
+		var s ClientStats
+		if err := rows.Scan(&s.ClientVersion, &s.Requests, &s.LocalErrors, &s.AvgLocalMs); err != nil {
+			return nil, fmt.Errorf("scan row: %w", err)
+		}
+		stats = append(stats, s)
+	}
+	return stats, rows.Err()
+}
+
+// LogRequest records a request against the domain that owns hostname, in
+// the partition of its owner's data region
+func (p *Postgres) LogRequest(ctx context.Context, hostname string, l RequestLog) error {
+	ctx, done := db.Timed(ctx, "store.LogRequest")
+	defer done()
+
+	labels := []byte("{}")
+	if len(l.Labels) > 0 {
+		var err error
+		if labels, err = json.Marshal(l.Labels); err != nil {
+			return fmt.Errorf("encode labels: %w", err)
+		}
+	}
+
+	res, err := p.db.ExecContext(ctx, `
+		INSERT INTO request_logs (domain_id, method, path, status_code, duration_ms,
+			request_size_bytes, response_size_bytes, remote_ip, tls_version, alpn, tls_fingerprint, labels, tunnel_name, region,
+			relay_us, tunnel_us, local_us, write_us, local_status, client_version)
+		SELECT d.id, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, u.data_region, $14, $15, $16, $17, $18, $19
+		FROM domains d
+		JOIN users u ON u.id = d.user_id
+		WHERE d.hostname = $1
+	`, hostname, l.Method, l.Path, l.StatusCode, l.Duration.Milliseconds(),
+		l.RequestSize, l.ResponseSize, l.RemoteIP, l.TLSVersion, l.ALPN, l.TLSFingerprint, labels, l.TunnelName,
+		l.Latency.Relay.Microseconds(), l.Latency.Tunnel.Microseconds(), l.Latency.Local.Microseconds(), l.Latency.Write.Microseconds(),
+		l.LocalStatus, l.ClientVersion)
+	if err != nil {
+		return fmt.Errorf("log request: %w", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// CreateSession stores a new login session
+func (p *Postgres) CreateSession(ctx context.Context, userID, tokenHash string, expiresAt time.Time) error {
+	ctx, done := db.Timed(ctx, "store.CreateSession")
+	defer done()
+
+	_, err := p.db.ExecContext(ctx,
+		"INSERT INTO sessions (user_id, token_hash, expires_at) VALUES ($1, $2, $3)",
+		userID, tokenHash, expiresAt)
+	if err != nil {
+		return fmt.Errorf("create session: %w", err)
+	}
+	return nil
+}
+
+// CreateImpersonationSession opens a read-only support session for an operator
+func (p *Postgres) CreateImpersonationSession(ctx context.Context, userID, tokenHash, operator string, expiresAt time.Time) error {
+	ctx, done := db.Timed(ctx, "store.CreateImpersonationSession")
+	defer done()
+
+	_, err := p.db.ExecContext(ctx,
+		"INSERT INTO sessions (user_id, token_hash, impersonator, expires_at) VALUES ($1, $2, $3, $4)",
+		userID, tokenHash, operator, expiresAt)
+	if err != nil {
+		return fmt.Errorf("create impersonation session: %w", err)
+	}
+	return nil
+}
+
+// SessionUser returns the user for an unexpired session
+func (p *Postgres) SessionUser(ctx context.Context, tokenHash string) (*User, error) {
+	ctx, done := db.Timed(ctx, "store.SessionUser")
+	defer done()
+
+	var impersonator string
+	row := p.db.QueryRowContext(ctx, `
+		SELECT `+userColumns+`, COALESCE(s.impersonator, '')
+		FROM users u
+		JOIN sessions s ON s.user_id = u.id
+		WHERE s.token_hash = $1 AND s.expires_at > NOW()
+	`, tokenHash)
+	u, err := scanUser(extraColumns{row: row, extra: []any{&impersonator}})
+	if err != nil && err != ErrNotFound {
+		return nil, fmt.Errorf("get session user: %w", err)
+	}
+	if u != nil {
+		u.ImpersonatedBy = impersonator
+	}
+	return u, err
+}
+
+// DeleteSession removes a session; deleting a missing session is not an error
+func (p *Postgres) DeleteSession(ctx context.Context, tokenHash string) error {
+	ctx, done := db.Timed(ctx, "store.DeleteSession")
+	defer done()
+
+	_, err := p.db.ExecContext(ctx, "DELETE FROM sessions WHERE token_hash = $1", tokenHash)
+	if err != nil {
+		return fmt.Errorf("delete session: %w", err)
+	}
+	return nil
+}
+
+// CreateToken stores a new API token for the CLI
+func (p *Postgres) CreateToken(ctx context.Context, userID, name, tokenHash string) (*APIToken, error) {
+	ctx, done := db.Timed(ctx, "store.CreateToken")
+	defer done()
+
+	t := APIToken{Name: name}
+	err := p.db.QueryRowContext(ctx, `
+		INSERT INTO api_tokens (user_id, token_hash, name)
+		VALUES ($1, $2, $3)
+		RETURNING id, created_at
+	`, userID, tokenHash, name).Scan(&t.ID, &t.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("create token: %w", err)
+	}
+	return &t, nil
+}
+
+// ListTokens returns a user's API tokens, newest first
+func (p *Postgres) ListTokens(ctx context.Context, userID string) ([]APIToken, error) {
+	ctx, done := db.Timed(ctx, "store.ListTokens")
+	defer done()
+
+	rows, err := p.db.QueryContext(ctx, `
+		SELECT id, name, last_used_at, created_at
+		FROM api_tokens
+		WHERE user_id = $1
+		ORDER BY created_at DESC
+	`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("list tokens: %w", err)
+	}
+	defer rows.Close()
+
+	var tokens []APIToken
+	for rows.Next() {
+		var t APIToken
+		var lastUsed sql.NullTime
+		if err := rows.Scan(&t.ID, &t.Name, &lastUsed, &t.CreatedAt); err != nil {
+			return nil, fmt.Errorf("scan row: %w", err)
+		}
+		if lastUsed.Valid {
+			t.LastUsedAt = &lastUsed.Time
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+// TokenUser returns the owner of an API token and stamps its last use
+func (p *Postgres) TokenUser(ctx context.Context, tokenHash string) (*User, error) {
+	ctx, done := db.Timed(ctx, "store.TokenUser")
+	defer done()
+
+	u, err := scanUser(p.db.QueryRowContext(ctx, `
+		WITH used AS (
+			UPDATE api_tokens SET last_used_at = NOW()
+			WHERE token_hash = $1
+			RETURNING user_id
+		)
+		SELECT `+userColumns+`
+		FROM users u
+		JOIN used ON used.user_id = u.id
+	`, tokenHash))
+	if err != nil && err != ErrNotFound {
+		return nil, fmt.Errorf("get token user: %w", err)
+	}
+	return u, err
+}
+
+// RecordHealthCheck stores a relay health check and upserts the relay's latest state
+func (p *Postgres) RecordHealthCheck(ctx context.Context, c HealthCheck) error {
+	ctx, done := db.Timed(ctx, "store.RecordHealthCheck")
+	defer done()
+
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("record health check: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO health_checks (relay_id, ok, latency_ms)
+		VALUES ($1, $2, $3)
+	`, c.RelayID, c.OK, c.Latency.Milliseconds())
+	if err != nil {
+		return fmt.Errorf("record health check: %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO relay_health (relay_id, region, ok, detail, tunnels, last_seen_at)
+		VALUES ($1, $2, $3, $4, $5, NOW())
+		ON CONFLICT (relay_id) DO UPDATE
+		SET region = EXCLUDED.region, ok = EXCLUDED.ok, detail = EXCLUDED.detail,
+			tunnels = EXCLUDED.tunnels, last_seen_at = EXCLUDED.last_seen_at
+	`, c.RelayID, c.Region, c.OK, c.Detail, c.Tunnels)
+	if err != nil {
+		return fmt.Errorf("update relay health: %w", err)
+	}
+	return tx.Commit()
+}
+
+// ListRelayHealth returns the latest health of every relay that has reported
+func (p *Postgres) ListRelayHealth(ctx context.Context) ([]RelayHealth, error) {
+	ctx, done := db.Timed(ctx, "store.ListRelayHealth")
+	defer done()
+
+	rows, err := p.db.QueryContext(ctx, `
+		SELECT relay_id, region, ok, detail, tunnels, last_seen_at
+		FROM relay_health
+		ORDER BY relay_id
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("list relay health: %w", err)
+	}
+	defer rows.Close()
+
+	var relays []RelayHealth
+	for rows.Next() {
+		var r RelayHealth
+		if err := rows.Scan(&r.RelayID, &r.Region, &r.OK, &r.Detail, &r.Tunnels, &r.LastSeenAt); err != nil {
+			return nil, fmt.Errorf("scan row: %w", err)
+		}
+		relays = append(relays, r)
+	}
+	return relays, rows.Err()
+}
+
+// DailyUptime counts health checks and failures per UTC day
+func (p *Postgres) DailyUptime(ctx context.Context, since time.Time) ([]UptimeDay, error) {
+	ctx, done := db.Timed(ctx, "store.DailyUptime")
+	defer done()
+
+	rows, err := p.db.QueryContext(ctx, `
+		SELECT date_trunc('day', checked_at AT TIME ZONE 'UTC') AS day,
+			COUNT(*), COUNT(*) FILTER (WHERE NOT ok)
+		FROM health_checks
+		WHERE checked_at >= $1
+		GROUP BY day
+		ORDER BY day
+	`, since)
+	if err != nil {
+		return nil, fmt.Errorf("daily uptime: %w", err)
+	}
+	defer rows.Close()
+
+	var days []UptimeDay
+	for rows.Next() {
+		var d UptimeDay
+		if err := rows.Scan(&d.Day, &d.Checks, &d.Failures); err != nil {
+			return nil, fmt.Errorf("scan row: %w", err)
+		}
+		d.Day = d.Day.UTC()
+		days = append(days, d)
+	}
+	return days, rows.Err()
+}
+
+// OpenIncident resolves any open incident and posts a new one
+func (p *Postgres) OpenIncident(ctx context.Context, i Incident) (*Incident, error) {
+	ctx, done := db.Timed(ctx, "store.OpenIncident")
+	defer done()
+
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("open incident: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "UPDATE incidents SET resolved_at = NOW() WHERE resolved_at IS NULL"); err != nil {
+		return nil, fmt.Errorf("resolve previous incident: %w", err)
+	}
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO incidents (title, message, severity)
+		VALUES ($1, $2, $3)
+		RETURNING id, started_at
+	`, i.Title, i.Message, i.Severity).Scan(&i.ID, &i.StartedAt)
+	if err != nil {
+		return nil, fmt.Errorf("open incident: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("open incident: %w", err)
+	}
+	i.ResolvedAt = nil
+	return &i, nil
+}
+
+// ResolveIncident closes the open incident
+func (p *Postgres) ResolveIncident(ctx context.Context) error {
+	ctx, done := db.Timed(ctx, "store.ResolveIncident")
+	defer done()
+
+	res, err := p.db.ExecContext(ctx, "UPDATE incidents SET resolved_at = NOW() WHERE resolved_at IS NULL")
+	if err != nil {
+		return fmt.Errorf("resolve incident: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// ActiveIncident returns the open incident
+func (p *Postgres) ActiveIncident(ctx context.Context) (*Incident, error) {
+	ctx, done := db.Timed(ctx, "store.ActiveIncident")
+	defer done()
+
+	var i Incident
+	err := p.db.QueryRowContext(ctx, `
+		SELECT id, title, message, severity, started_at
+		FROM incidents
+		WHERE resolved_at IS NULL
+	`).Scan(&i.ID, &i.Title, &i.Message, &i.Severity, &i.StartedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get active incident: %w", err)
+	}
+	return &i, nil
+}
+
+// SearchUsers finds users by exact ID or email substring, newest first
+func (p *Postgres) SearchUsers(ctx context.Context, query string, limit int) ([]User, error) {
+	ctx, done := db.Timed(ctx, "store.SearchUsers")
+	defer done()
+
+	rows, err := p.db.QueryContext(ctx, `
+		SELECT `+userColumns+`
+		FROM users u
+		WHERE u.id::text = $1 OR u.email ILIKE '%' || $2 || '%'
+		ORDER BY u.created_at DESC
+		LIMIT $3
+	`, query, escapeLike(query), limit)
+	if err != nil {
+		return nil, fmt.Errorf("search users: %w", err)
+	}
+	defer rows.Close()
+
+	var users []User
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan row: %w", err)
+		}
+		users = append(users, *u)
+	}
+	return users, rows.Err()
+}
+
+// escapeLike escapes LIKE wildcards so a search for "a_b" matches literally
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+// CountUsersByPlan returns how many users are on each plan
+func (p *Postgres) CountUsersByPlan(ctx context.Context) (map[string]int, error) {
+	ctx, done := db.Timed(ctx, "store.CountUsersByPlan")
+	defer done()
+
+	rows, err := p.db.QueryContext(ctx, "SELECT COALESCE(plan, 'free'), COUNT(*) FROM users GROUP BY 1")
+	if err != nil {
+		return nil, fmt.Errorf("count users: %w", err)
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
+	for rows.Next() {
+		var plan string
+		var n int
+		if err := rows.Scan(&plan, &n); err != nil {
+			return nil, fmt.Errorf("scan row: %w", err)
+		}
+		counts[plan] = n
+	}
+	return counts, rows.Err()
+}
+
+// TopDomains ranks domains across all users by bandwidth since the given time
+func (p *Postgres) TopDomains(ctx context.Context, since time.Time, limit int) ([]DomainTraffic, error) {
+	ctx, done := db.Timed(ctx, "store.TopDomains")
+	defer done()
+
+	rows, err := p.db.QueryContext(ctx, `
+		WITH bytes AS (
+			SELECT ts.domain_id, SUM(bu.bytes_in + bu.bytes_out) AS total
+			FROM bandwidth_usage bu
+			JOIN tunnel_sessions ts ON ts.id = bu.tunnel_session_id
+			WHERE bu.recorded_at >= $1
+			GROUP BY ts.domain_id
+			ORDER BY total DESC
+			LIMIT $2
+		)
+		SELECT d.hostname, u.id, u.email, b.total,
+			(SELECT COUNT(*) FROM request_logs r WHERE r.domain_id = d.id AND r.created_at >= $1)
+		FROM bytes b
+		JOIN domains d ON d.id = b.domain_id
+		JOIN users u ON u.id = d.user_id
+		ORDER BY b.total DESC, d.hostname
+	`, since, limit)
+	if err != nil {
+		return nil, fmt.Errorf("top domains: %w", err)
+	}
+	defer rows.Close()
+
+	var domains []DomainTraffic
+	for rows.Next() {
+		var d DomainTraffic
+		if err := rows.Scan(&d.Hostname, &d.UserID, &d.UserEmail, &d.TotalBytes, &d.Requests); err != nil {
+			return nil, fmt.Errorf("scan row: %w", err)
+		}
+		domains = append(domains, d)
+	}
+	return domains, rows.Err()
+}
+
+// SetPlanOverride pins or unpins an operator-set plan
+func (p *Postgres) SetPlanOverride(ctx context.Context, userID, plan string) error {
+	ctx, done := db.Timed(ctx, "store.SetPlanOverride")
+	defer done()
+
+	res, err := p.db.ExecContext(ctx, `
+		UPDATE users
+		SET plan = COALESCE(NULLIF($2, ''), plan), plan_override = $2 <> '', updated_at = NOW()
+		WHERE id = $1
+	`, userID, plan)
+	if err != nil {
+		return fmt.Errorf("set plan override: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+const abuseColumns = `id, hostname, reason, details, reporter_email, reporter_ip, resolution, created_at, resolved_at`
+
+func scanAbuseReport(row rowScanner) (*AbuseReport, error) {
+	var r AbuseReport
+	var resolvedAt sql.NullTime
+	err := row.Scan(&r.ID, &r.Hostname, &r.Reason, &r.Details, &r.ReporterEmail, &r.ReporterIP,
+		&r.Resolution, &r.CreatedAt, &resolvedAt)
+	if err != nil {
+		return nil, err
+	}
+	if resolvedAt.Valid {
+		r.ResolvedAt = &resolvedAt.Time
+	}
+	return &r, nil
+}
+
+// CreateAbuseReport files a new report
+func (p *Postgres) CreateAbuseReport(ctx context.Context, r AbuseReport) (*AbuseReport, error) {
+	ctx, done := db.Timed(ctx, "store.CreateAbuseReport")
+	defer done()
+
+	created, err := scanAbuseReport(p.db.QueryRowContext(ctx, `
+		INSERT INTO abuse_reports (hostname, reason, details, reporter_email, reporter_ip)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING `+abuseColumns, r.Hostname, r.Reason, r.Details, r.ReporterEmail, r.ReporterIP))
+	if err != nil {
+		return nil, fmt.Errorf("create abuse report: %w", err)
+	}
+	return created, nil
+}
+
+// ListAbuseReports returns the newest reports
+func (p *Postgres) ListAbuseReports(ctx context.Context, includeResolved bool, limit int) ([]AbuseReport, error) {
+	ctx, done := db.Timed(ctx, "store.ListAbuseReports")
+	defer done()
+
+	rows, err := p.db.QueryContext(ctx, `
+		SELECT `+abuseColumns+`
+		FROM abuse_reports
+		WHERE $1 OR resolved_at IS NULL
+		ORDER BY created_at DESC
+		LIMIT $2
+	`, includeResolved, limit)
+	if err != nil {
+		return nil, fmt.Errorf("list abuse reports: %w", err)
+	}
+	defer rows.Close()
+
+	var reports []AbuseReport
+	for rows.Next() {
+		r, err := scanAbuseReport(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan row: %w", err)
+		}
+		reports = append(reports, *r)
+	}
+	return reports, rows.Err()
+}
+
+// ResolveAbuseReport closes an open report with a note on what was done
+func (p *Postgres) ResolveAbuseReport(ctx context.Context, id, resolution string) error {
+	ctx, done := db.Timed(ctx, "store.ResolveAbuseReport")
+	defer done()
+
+	res, err := p.db.ExecContext(ctx, `
+		UPDATE abuse_reports SET resolution = $2, resolved_at = NOW()
+		WHERE id::text = $1 AND resolved_at IS NULL
+	`, id, resolution)
+	if err != nil {
+		return fmt.Errorf("resolve abuse report: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+const alertColumns = `a.id, a.user_id, a.threshold_bytes, a.channel, a.target, a.created_at, a.last_fired_at`
+
+func scanAlert(row rowScanner) (*UsageAlert, error) {
+	var a UsageAlert
+	var firedAt sql.NullTime
+	if err := row.Scan(&a.ID, &a.UserID, &a.ThresholdBytes, &a.Channel, &a.Target, &a.CreatedAt, &firedAt); err != nil {
+		return nil, err
+	}
+	if firedAt.Valid {
+		a.LastFiredAt = &firedAt.Time
+	}
+	return &a, nil
+}
+
+// CreateAlert adds a usage alert for a.UserID
+func (p *Postgres) CreateAlert(ctx context.Context, a UsageAlert) (*UsageAlert, error) {
+	ctx, done := db.Timed(ctx, "store.CreateAlert")
+	defer done()
+
+	created, err := scanAlert(p.db.QueryRowContext(ctx, `
+		INSERT INTO usage_alerts AS a (user_id, threshold_bytes, channel, target)
+		VALUES ($1, $2, $3, $4)
+		RETURNING `+alertColumns, a.UserID, a.ThresholdBytes, a.Channel, a.Target))
+	if err != nil {
+		return nil, fmt.Errorf("create alert: %w", err)
+	}
+	return created, nil
+}
+
+// ListAlerts returns a user's alerts, lowest threshold first
+func (p *Postgres) ListAlerts(ctx context.Context, userID string) ([]UsageAlert, error) {
+	ctx, done := db.Timed(ctx, "store.ListAlerts")
+	defer done()
+
+	rows, err := p.db.QueryContext(ctx, `
+		SELECT `+alertColumns+`
+		FROM usage_alerts a
+		WHERE a.user_id = $1
+		ORDER BY a.threshold_bytes, a.created_at
+	`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("list alerts: %w", err)
+	}
+	defer rows.Close()
+
+	var alerts []UsageAlert
+	for rows.Next() {
+		a, err := scanAlert(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan row: %w", err)
+		}
+		alerts = append(alerts, *a)
+	}
+	return alerts, rows.Err()
+}
+
+// DeleteAlert removes one of a user's alerts
+func (p *Postgres) DeleteAlert(ctx context.Context, userID, id string) error {
+	ctx, done := db.Timed(ctx, "store.DeleteAlert")
+	defer done()
+
+	res, err := p.db.ExecContext(ctx, "DELETE FROM usage_alerts WHERE user_id = $1 AND id::text = $2", userID, id)
+	if err != nil {
+		return fmt.Errorf("delete alert: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// DueAlerts returns unfired alerts whose threshold this month's bandwidth has reached
+func (p *Postgres) DueAlerts(ctx context.Context) ([]DueAlert, error) {
+	ctx, done := db.Timed(ctx, "store.DueAlerts")
+	defer done()
+
+	rows, err := p.db.QueryContext(ctx, `
+		SELECT `+alertColumns+`, u.email, used.total
+		FROM usage_alerts a
+		JOIN users u ON u.id = a.user_id
+		JOIN (
+			SELECT user_id, SUM(bytes_in + bytes_out) AS total
+			FROM bandwidth_usage
+			WHERE recorded_at >= date_trunc('month', NOW())
+			GROUP BY user_id
+		) used ON used.user_id = a.user_id
+		WHERE used.total >= a.threshold_bytes
+		AND (a.last_fired_at IS NULL OR a.last_fired_at < date_trunc('month', NOW()))
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("query due alerts: %w", err)
+	}
+	defer rows.Close()
+
+	var due []DueAlert
+	for rows.Next() {
+		var d DueAlert
+		a, err := scanAlert(extraColumns{row: rows, extra: []any{&d.Email, &d.UsedBytes}})
+		if err != nil {
+			return nil, fmt.Errorf("scan row: %w", err)
+		}
+		d.UsageAlert = *a
+		due = append(due, d)
+	}
+	return due, rows.Err()
+}
+
+// MarkAlertFired records that an alert fired, unless it already did this month
+func (p *Postgres) MarkAlertFired(ctx context.Context, id string) (bool, error) {
+	ctx, done := db.Timed(ctx, "store.MarkAlertFired")
+	defer done()
+
+	res, err := p.db.ExecContext(ctx, `
+		UPDATE usage_alerts SET last_fired_at = NOW()
+		WHERE id::text = $1
+		AND (last_fired_at IS NULL OR last_fired_at < date_trunc('month', NOW()))
+	`, id)
+	if err != nil {
+		return false, fmt.Errorf("mark alert fired: %w", err)
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+const eventColumns = `id, user_id, type, hostname, message, created_at`
+
+// RecordEvent adds an event to a user's activity feed
+func (p *Postgres) RecordEvent(ctx context.Context, e Event) (*Event, error) {
+	ctx, done := db.Timed(ctx, "store.RecordEvent")
+	defer done()
+
+	var created Event
+	err := p.db.QueryRowContext(ctx, `
+		INSERT INTO events (user_id, type, hostname, message)
+		VALUES ($1, $2, $3, $4)
+		RETURNING `+eventColumns, e.UserID, e.Type, e.Hostname, e.Message).
+		Scan(&created.ID, &created.UserID, &created.Type, &created.Hostname, &created.Message, &created.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("record event: %w", err)
+	}
+	return &created, nil
+}
+
+// ListEvents returns a user's events after the given ID, oldest first, or
+// their latest events when after is 0
+func (p *Postgres) ListEvents(ctx context.Context, userID string, after int64, limit int) ([]Event, error) {
+	ctx, done := db.Timed(ctx, "store.ListEvents")
+	defer done()
+
+	query := `
+		SELECT ` + eventColumns + `
+		FROM events
+		WHERE user_id = $1 AND id > $2
+		ORDER BY id
+		LIMIT $3
+	`
+	if after <= 0 {
+		query = `
+			SELECT ` + eventColumns + ` FROM (
+				SELECT ` + eventColumns + `
+				FROM events
+				WHERE user_id = $1 AND id > $2
+				ORDER BY id DESC
+				LIMIT $3
+			) latest
+			ORDER BY id
+		`
+	}
+	rows, err := p.db.QueryContext(ctx, query, userID, after, limit)
+	if err != nil {
+		return nil, fmt.Errorf("list events: %w", err)
+	}
+	defer rows.Close()
+
+	var events []Event
+	for rows.Next() {
+		var e Event
+		if err := rows.Scan(&e.ID, &e.UserID, &e.Type, &e.Hostname, &e.Message, &e.CreatedAt); err != nil {
+			return nil, fmt.Errorf("scan row: %w", err)
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+const exportColumns = `user_id, provider, endpoint, region, bucket, prefix, access_key_id, secret_sealed,
+	format, exported_through, last_run_at, last_error, created_at`
+
+func scanExport(row rowScanner) (*Export, error) {
+	var e Export
+	var runAt sql.NullTime
+	if err := row.Scan(&e.UserID, &e.Provider, &e.Endpoint, &e.Region, &e.Bucket, &e.Prefix, &e.AccessKeyID, &e.SecretSealed,
+		&e.Format, &e.ExportedThrough, &runAt, &e.LastError, &e.CreatedAt); err != nil {
+		return nil, err
+	}
+	if runAt.Valid {
+		e.LastRunAt = &runAt.Time
+	}
+	return &e, nil
+}
+
+// SetExport creates or replaces a user's export. Replacing it keeps how far
+// the last one got, so changing a bucket doesn't re-send old data.
+func (p *Postgres) SetExport(ctx context.Context, e Export) error {
+	ctx, done := db.Timed(ctx, "store.SetExport")
+	defer done()
+
+	_, err := p.db.ExecContext(ctx, `
+		INSERT INTO exports (user_id, provider, endpoint, region, bucket, prefix, access_key_id, secret_sealed, format, exported_through)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		ON CONFLICT (user_id) DO UPDATE SET
+			provider = EXCLUDED.provider,
+			endpoint = EXCLUDED.endpoint,
+			region = EXCLUDED.region,
+			bucket = EXCLUDED.bucket,
+			prefix = EXCLUDED.prefix,
+			access_key_id = EXCLUDED.access_key_id,
+			secret_sealed = EXCLUDED.secret_sealed,
+			format = EXCLUDED.format,
+			last_error = ''
+	`, e.UserID, e.Provider, e.Endpoint, e.Region, e.Bucket, e.Prefix, e.AccessKeyID, e.SecretSealed, e.Format, e.ExportedThrough)
+	if err != nil {
+		return fmt.Errorf("set export: %w", err)
+	}
+	return nil
+}
+
+// GetExport returns a user's export
+func (p *Postgres) GetExport(ctx context.Context, userID string) (*Export, error) {
+	ctx, done := db.Timed(ctx, "store.GetExport")
+	defer done()
+
+	e, err := scanExport(p.db.QueryRowContext(ctx, `
+		SELECT `+exportColumns+` FROM exports WHERE user_id = $1
+	`, userID))
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get export: %w", err)
+	}
+	return e, nil
+}
+
+// DeleteExport stops a user's export
+func (p *Postgres) DeleteExport(ctx context.Context, userID string) error {
+	ctx, done := db.Timed(ctx, "store.DeleteExport")
+	defer done()
+
+	res, err := p.db.ExecContext(ctx, `DELETE FROM exports WHERE user_id = $1`, userID)
+	if err != nil {
+		return fmt.Errorf("delete export: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// ListExports returns every user's export
+func (p *Postgres) ListExports(ctx context.Context) ([]Export, error) {
+	ctx, done := db.Timed(ctx, "store.ListExports")
+	defer done()
+
+	rows, err := p.db.QueryContext(ctx, `SELECT `+exportColumns+` FROM exports ORDER BY user_id`)
+	if err != nil {
+		return nil, fmt.Errorf("list exports: %w", err)
+	}
+	defer rows.Close()
+
+	var exports []Export
+	for rows.Next() {
+		e, err := scanExport(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan row: %w", err)
+		}
+		exports = append(exports, *e)
+	}
+	return exports, rows.Err()
+}
+
+// MarkExported records how far a user's export got
+func (p *Postgres) MarkExported(ctx context.Context, userID string, through time.Time, runErr string) error {
+	ctx, done := db.Timed(ctx, "store.MarkExported")
+	defer done()
+
+	res, err := p.db.ExecContext(ctx, `
+		UPDATE exports SET exported_through = $2, last_run_at = NOW(), last_error = $3
+		WHERE user_id = $1
+	`, userID, through, runErr)
+	if err != nil {
+		return fmt.Errorf("mark exported: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// RequestLogsBetween returns a user's request logs in a time range, oldest first
+func (p *Postgres) RequestLogsBetween(ctx context.Context, userID string, from, to time.Time, limit int) ([]RequestLog, error) {
+	ctx, done := db.Timed(ctx, "store.RequestLogsBetween")
+	defer done()
+
+	rows, err := p.db.QueryContext(ctx, `
+		SELECT `+requestLogColumns+`
+		FROM request_logs r
+		JOIN domains d ON r.domain_id = d.id
+		WHERE d.user_id = $1 AND r.created_at >= $2 AND r.created_at < $3
+		ORDER BY r.created_at
+		LIMIT $4
+	`, userID, from, to, limit)
+	if err != nil {
+		return nil, fmt.Errorf("request logs between: %w", err)
+	}
+	return scanRequestLogs(rows)
+}
+
+// DailyUsage sums a user's bandwidth and logged requests per domain and UTC day
+func (p *Postgres) DailyUsage(ctx context.Context, userID string, from, to time.Time) ([]UsageDay, error) {
+	ctx, done := db.Timed(ctx, "store.DailyUsage")
+	defer done()
+
+	rows, err := p.db.QueryContext(ctx, `
+		WITH bytes AS (
+			SELECT date_trunc('day', bu.recorded_at AT TIME ZONE 'UTC') AS day, d.hostname,
+				SUM(bu.bytes_in) AS bytes_in, SUM(bu.bytes_out) AS bytes_out
+			FROM bandwidth_usage bu
+			JOIN tunnel_sessions ts ON ts.id = bu.tunnel_session_id
+			JOIN domains d ON d.id = ts.domain_id
+			WHERE bu.user_id = $1 AND bu.recorded_at >= $2 AND bu.recorded_at < $3
+			GROUP BY 1, 2
+		), reqs AS (
+			SELECT date_trunc('day', r.created_at AT TIME ZONE 'UTC') AS day, d.hostname, COUNT(*) AS requests
+			FROM request_logs r
+			JOIN domains d ON d.id = r.domain_id
+			WHERE d.user_id = $1 AND r.created_at >= $2 AND r.created_at < $3
+			GROUP BY 1, 2
+		)
+		SELECT COALESCE(b.day, q.day), COALESCE(b.hostname, q.hostname),
+			COALESCE(b.bytes_in, 0), COALESCE(b.bytes_out, 0), COALESCE(q.requests, 0)
+		FROM bytes b
+		FULL OUTER JOIN reqs q ON q.day = b.day AND q.hostname = b.hostname
+		ORDER BY 1, 2
+	`, userID, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("daily usage: %w", err)
+	}
+	defer rows.Close()
+
+	var days []UsageDay
+	for rows.Next() {
+		var d UsageDay
+		if err := rows.Scan(&d.Day, &d.Domain, &d.BytesIn, &d.BytesOut, &d.Requests); err != nil {
+			return nil, fmt.Errorf("scan row: %w", err)
+		}
+		d.Day = time.Date(d.Day.Year(), d.Day.Month(), d.Day.Day(), 0, 0, 0, 0, time.UTC)
+		days = append(days, d)
+	}
+	return days, rows.Err()
+}
+
+// GetCert returns the certificate cache entry under key
+func (p *Postgres) GetCert(ctx context.Context, key string) ([]byte, error) {
+	ctx, done := db.Timed(ctx, "store.GetCert")
+	defer done()
+
+	var data []byte
+	err := p.db.QueryRowContext(ctx, `SELECT data FROM cert_cache WHERE key = $1`, key).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get cert: %w", err)
+	}
+	return data, nil
+}
+
+// PutCert creates or replaces the certificate cache entry under key
+func (p *Postgres) PutCert(ctx context.Context, key string, data []byte) error {
+	ctx, done := db.Timed(ctx, "store.PutCert")
+	defer done()
+
+	_, err := p.db.ExecContext(ctx, `
+		INSERT INTO cert_cache (key, data) VALUES ($1, $2)
+		ON CONFLICT (key) DO UPDATE SET data = EXCLUDED.data, updated_at = NOW()
+	`, key, data)
+	if err != nil {
+		return fmt.Errorf("put cert: %w", err)
+	}
+	return nil
+}
+
+// DeleteCert removes the certificate cache entry under key, if there is one
+func (p *Postgres) DeleteCert(ctx context.Context, key string) error {
+	ctx, done := db.Timed(ctx, "store.DeleteCert")
+	defer done()
+
+	if _, err := p.db.ExecContext(ctx, `DELETE FROM cert_cache WHERE key = $1`, key); err != nil {
+		return fmt.Errorf("delete cert: %w", err)
+	}
+	return nil
+}
+
+// LockCert takes or renews holder's lease on key. An expired lease of
+// another holder is taken over.
+func (p *Postgres) LockCert(ctx context.Context, key, holder string, ttl time.Duration) (bool, error) {
+	ctx, done := db.Timed(ctx, "store.LockCert")
+	defer done()
+
+	res, err := p.db.ExecContext(ctx, `
+		INSERT INTO cert_locks (key, holder, expires_at)
+		VALUES ($1, $2, NOW() + make_interval(secs => $3))
+		ON CONFLICT (key) DO UPDATE SET holder = EXCLUDED.holder, expires_at = EXCLUDED.expires_at
+		WHERE cert_locks.holder = EXCLUDED.holder OR cert_locks.expires_at < NOW()
+	`, key, holder, ttl.Seconds())
+	if err != nil {
+		return false, fmt.Errorf("lock cert: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("lock cert: %w", err)
+	}
+	return n == 1, nil
+}
+
+// UnlockCert releases holder's lease on key
+func (p *Postgres) UnlockCert(ctx context.Context, key, holder string) error {
+	ctx, done := db.Timed(ctx, "store.UnlockCert")
+	defer done()
+
+	if _, err := p.db.ExecContext(ctx, `DELETE FROM cert_locks WHERE key = $1 AND holder = $2`, key, holder); err != nil {
+		return fmt.Errorf("unlock cert: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,622 @@
+// internal/store/store.go
+package store
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrNotFound is returned when a record doesn't exist
+var ErrNotFound = errors.New("not found")
+
+// ErrDomainTaken is returned when a hostname is already registered to any user
+var ErrDomainTaken = errors.New("domain already registered")
+
+// ErrEmailTaken is returned when an email address belongs to another user
+var ErrEmailTaken = errors.New("email already in use")
+
+// ErrLastIdentity is returned when unlinking would leave a user unable to log in
+var ErrLastIdentity = errors.New("cannot remove the last login method")
+
+// Data regions a user's request logs can be kept in
+const (
+	RegionUS = "us"
+	RegionEU = "eu"
+)
+
+// DataRegions lists the data regions, the default first
+var DataRegions = []string{RegionUS, RegionEU}
+
+// User is an account holder
+type User struct {
+	ID                   string
+	Email                string
+	Name                 string
+	Plan                 string
+	AvatarURL            string
+	Theme                string // dashboard theme: "system", "light" or "dark"
+	DataRegion           string // where request logs are kept: RegionUS or RegionEU
+	PlanOverride         bool   // plan was set by an operator, not a subscription
+	StripeCustomerID     string
+	StripeSubscriptionID string
+	TrialEndsAt          *time.Time
+	BillingInterval      string // "month" or "year"
+	Seats                int    // seats paid for on a team plan, 1 otherwise
+	RenewalAmount        int64  // next renewal in the currency's minor unit; 0 for metered or free plans
+	RenewalCurrency      string
+	RenewsAt             *time.Time // end of the current billing period, nil without a subscription
+	OrgID                string     // team owner the user was provisioned for by single sign-on; empty otherwise
+
+	// ImpersonatedBy names the operator viewing this account through a
+	// read-only support session; empty for the user's own sessions
+	ImpersonatedBy string
+}
+
+// Preferences are a user's defaults, kept server-side so the CLI behaves
+// the same on every machine. Its flags still override them.
+type Preferences struct {
+	Inspect          bool   // run the local inspector with `lobber up`
+	LogRetentionDays int    // days request logs are kept, 0 for the plan's window; only ever shortens it
+	BurstLimit       string // default --burst-limit: "" for the relay's, "off" or requests per second
+}
+
+// DefaultPreferences are a user's preferences until they change them
+func DefaultPreferences() Preferences {
+	return Preferences{Inspect: true}
+}
+
+// GitHubApp is the GitHub App a user's tunnels comment preview links on
+// pull requests through
+type GitHubApp struct {
+	UserID    string    `json:"-"`
+	AppID     int64     `json:"app_id"`
+	KeySealed string    `json:"-"` // the App's private key, encrypted with the relay's export key
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Domain is a hostname registered to a user
+type Domain struct {
+	ID        string
+	Name      string
+	Verified  bool
+	Schedule  string // weekly availability such as "Mon-Fri 09:00-18:00"; empty for always
+	Sampling  string // which requests the request log keeps, such as "errors, 1%"; empty for all
+	Replay    string // where a copy of its traffic goes, such as "https://staging.example.com 10%"; empty for nowhere
+	Headers   string // added to its responses, one "Name: value" per line; empty for none
+	HTTPS     string // how visitors are kept on https, such as "redirect, hsts"; empty for as they come
+	CreatedAt time.Time
+}
+
+// DomainGrant lets another user, such as a member of the owner's team,
+// connect tunnels on one of the owner's domains
+type DomainGrant struct {
+	DomainID  string    `json:"domain_id"`
+	Hostname  string    `json:"hostname"`
+	UserID    string    `json:"user_id"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// RequestLog is a request that went through one of a user's tunnels
+type RequestLog struct {
+	ID           string
+	Method       string
+	Path         string
+	StatusCode   int
+	Duration     time.Duration
+	Domain       string
+	RequestSize  int64
+	ResponseSize int64
+	CreatedAt    time.Time
+
+	// How the visitor reached the relay
+	RemoteIP       string
+	TLSVersion     string // e.g. "TLS 1.3"; empty for plain HTTP
+	ALPN           string // negotiated protocol such as "h2"
+	TLSFingerprint string // hash of the TLS ClientHello
+
+	// Labels of the tunnel that carried the request, e.g. env=staging
+	Labels map[string]string
+	// TunnelName is the stable name of that tunnel, if it had one
+	TunnelName string
+	// Region is the data region the log is kept in, its owner's at the time
+	Region string
+	// Latency breaks Duration down by where it was spent
+	Latency Latency
+	// LocalStatus is the local server's status as the client reported it,
+	// before any rewrite such as a debug page; 0 if it wasn't reached or the
+	// client didn't say
+	LocalStatus int
+	// ClientVersion is the version of the lobber client that served the
+	// request; empty for clients too old to report it
+	ClientVersion string
+}
+
+// Latency is where a proxied request's time went. It is zero for requests
+// the relay answered itself, and Tunnel and Local are zero for clients too
+// old to time their part.
+type Latency struct {
+	Relay  time.Duration // reading the visitor's request and waiting for the tunnel
+	Tunnel time.Duration // the network to the client and back, and the client itself
+	Local  time.Duration // waiting on the local server
+	Write  time.Duration // writing the response to the visitor
+}
+
+// TunnelSession is one connection of a tunnel to a relay. Bandwidth is
+// recorded against it so usage can be broken down by domain.
+type TunnelSession struct {
+	ID               string
+	Domain           string
+	Name             string // stable tunnel name; empty if the tunnel wasn't named
+	StartedAt        time.Time
+	EndedAt          *time.Time
+	DisconnectReason string
+	Bytes            int64 // bandwidth recorded against the session
+}
+
+// TunnelHistory sums up a tunnel's sessions over a period. Named tunnels are
+// grouped by name across hostnames; unnamed ones by hostname.
+type TunnelHistory struct {
+	Name       string   // empty for unnamed tunnels
+	Hostnames  []string // sorted
+	Sessions   int
+	LastSeen   time.Time // when the latest session started
+	TotalBytes int64
+	Requests   int64
+}
+
+// Identity is an OAuth login linked to a user
+type Identity struct {
+	ID             string
+	Provider       string // "github", "google"
+	ProviderUserID string
+	Email          string
+	CreatedAt      time.Time
+}
+
+// APIToken is a named token the CLI uses to open tunnels. Only its hash is stored.
+type APIToken struct {
+	ID         string
+	Name       string
+	LastUsedAt *time.Time
+	CreatedAt  time.Time
+}
+
+// AuditEntry records a security-relevant change to an account
+type AuditEntry struct {
+	ID        string
+	UserID    string
+	Action    string // e.g. "profile.updated", "email.changed"
+	Detail    string
+	IPAddress string
+	CreatedAt time.Time
+}
+
+// HealthCheck is one internal health check result from a relay instance
+type HealthCheck struct {
+	RelayID   string
+	Region    string
+	OK        bool
+	Detail    string // why the check failed, empty when OK
+	Latency   time.Duration
+	Tunnels   int // tunnels connected to the relay at the time
+	CheckedAt time.Time
+}
+
+// RelayHealth is the latest health check from a relay instance
+type RelayHealth struct {
+	RelayID    string
+	Region     string
+	OK         bool
+	Detail     string
+	Tunnels    int
+	LastSeenAt time.Time
+}
+
+// UptimeDay counts one day of health checks across the fleet
+type UptimeDay struct {
+	Day      time.Time // midnight UTC
+	Checks   int
+	Failures int
+}
+
+// Incident is an operator-posted notice shown on the status page
+type Incident struct {
+	ID         string     `json:"id"`
+	Title      string     `json:"title"`
+	Message    string     `json:"message,omitempty"`
+	Severity   string     `json:"severity"` // "minor" or "major"
+	StartedAt  time.Time  `json:"started_at"`
+	ResolvedAt *time.Time `json:"resolved_at,omitempty"`
+}
+
+// DomainTraffic is a domain's bandwidth and request count over a period
+type DomainTraffic struct {
+	Hostname   string `json:"hostname"`
+	UserID     string `json:"user_id"`
+	UserEmail  string `json:"user_email"`
+	TotalBytes int64  `json:"total_bytes"`
+	Requests   int64  `json:"requests"`
+}
+
+// AbuseReport is a complaint about content served through a tunnel
+type AbuseReport struct {
+	ID            string     `json:"id"`
+	Hostname      string     `json:"hostname"`
+	Reason        string     `json:"reason"` // "phishing", "malware", "spam" or "other"
+	Details       string     `json:"details,omitempty"`
+	ReporterEmail string     `json:"reporter_email,omitempty"`
+	ReporterIP    string     `json:"reporter_ip,omitempty"`
+	Resolution    string     `json:"resolution,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	ResolvedAt    *time.Time `json:"resolved_at,omitempty"`
+}
+
+// UsageAlert notifies a user once their bandwidth this month reaches a
+// threshold they chose. It fires at most once per month.
+type UsageAlert struct {
+	ID             string     `json:"id"`
+	UserID         string     `json:"-"`
+	ThresholdBytes int64      `json:"threshold_bytes"`
+	Channel        string     `json:"channel"`          // "email", "webhook" or "slack"
+	Target         string     `json:"target,omitempty"` // URL for webhook and slack; empty for email to the account address
+	CreatedAt      time.Time  `json:"created_at"`
+	LastFiredAt    *time.Time `json:"last_fired_at,omitempty"`
+}
+
+// DueAlert is an alert whose threshold was reached this month
+type DueAlert struct {
+	UsageAlert
+	Email     string // the account's address, for email alerts
+	UsedBytes int64  // bandwidth this month
+}
+
+// Event is something that happened to one of a user's tunnels or domains,
+// as shown in their activity feed. IDs only grow, so a client can follow
+// the feed by asking for events after the last one it saw.
+type Event struct {
+	ID        int64     `json:"id"`
+	UserID    string    `json:"-"`
+	Type      string    `json:"type"` // e.g. "tunnel.connected", see package events
+	Hostname  string    `json:"hostname,omitempty"`
+	Message   string    `json:"message"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Export sends a user's request logs and daily usage to their own
+// S3-compatible object storage on a schedule
+type Export struct {
+	UserID          string     `json:"-"`
+	Provider        string     `json:"provider"`           // "s3" or "gcs"
+	Endpoint        string     `json:"endpoint,omitempty"` // API host; empty uses the provider's
+	Region          string     `json:"region,omitempty"`
+	Bucket          string     `json:"bucket"`
+	Prefix          string     `json:"prefix,omitempty"`
+	AccessKeyID     string     `json:"access_key_id"`
+	SecretSealed    string     `json:"-"`      // secret access key, encrypted with the relay's export key
+	Format          string     `json:"format"` // "jsonl" or "jsonl.gz"
+	ExportedThrough time.Time  `json:"exported_through"`
+	LastRunAt       *time.Time `json:"last_run_at,omitempty"`
+	LastError       string     `json:"last_error,omitempty"`
+	CreatedAt       time.Time  `json:"created_at"`
+}
+
+// ClientStats is how the requests one client version served fared
+type ClientStats struct {
+	ClientVersion string  `json:"client_version"` // empty for clients too old to report it
+	Requests      int64   `json:"requests"`
+	LocalErrors   int64   `json:"local_errors"` // the local server answered 5xx or wasn't reached
+	AvgLocalMs    float64 `json:"avg_local_ms"` // mean time waiting on the local server
+}
+
+// UsageDay is what one of a user's domains served on one UTC day
+type UsageDay struct {
+	Day      time.Time `json:"day"`
+	Domain   string    `json:"domain"`
+	BytesIn  int64     `json:"bytes_in"`
+	BytesOut int64     `json:"bytes_out"`
+	Requests int64     `json:"requests"` // requests logged, after sampling
+}
+
+// UserStore reads and updates users
+type UserStore interface {
+	GetUser(ctx context.Context, id string) (*User, error)
+	SetPlan(ctx context.Context, id, plan string) error
+	// ProvisionUser returns the user ident is linked to, or creates u
+	// linked to it, reporting whether it did. It returns ErrEmailTaken if
+	// a user who isn't linked to ident already has u's email.
+	ProvisionUser(ctx context.Context, u User, ident Identity) (user *User, created bool, err error)
+	// ListMembers returns the users provisioned for orgID, by email
+	ListMembers(ctx context.Context, orgID string) ([]User, error)
+}
+
+// DomainStore manages a user's domains. Lookups are scoped to the owner, so
+// another user's domain ID returns ErrNotFound.
+type DomainStore interface {
+	ListDomains(ctx context.Context, userID string) ([]Domain, error)
+	GetDomain(ctx context.Context, userID, id string) (*Domain, error)
+	// DomainOwner returns the ID of the user who registered hostname, or ErrNotFound
+	DomainOwner(ctx context.Context, hostname string) (string, error)
+	// CreateDomain registers an unverified hostname, or returns ErrDomainTaken
+	CreateDomain(ctx context.Context, userID, hostname string) (*Domain, error)
+	MarkDomainVerified(ctx context.Context, userID, id string) error
+	// SetDomainSchedule sets when the domain takes traffic; an empty
+	// schedule means always
+	SetDomainSchedule(ctx context.Context, userID, id, schedule string) error
+	// DomainSchedule returns the schedule of hostname, or ErrNotFound if
+	// nobody owns it
+	DomainSchedule(ctx context.Context, hostname string) (string, error)
+	// SetDomainSampling sets which of the domain's requests are logged; an
+	// empty policy logs them all
+	SetDomainSampling(ctx context.Context, userID, id, sampling string) error
+	// DomainSampling returns the sampling policy of hostname, or
+	// ErrNotFound if nobody owns it
+	DomainSampling(ctx context.Context, hostname string) (string, error)
+	// SetDomainReplay sets where a copy of the domain's traffic is sent;
+	// an empty target sends it nowhere
+	SetDomainReplay(ctx context.Context, userID, id, replay string) error
+	// DomainReplay returns the replay target of hostname, or ErrNotFound
+	// if nobody owns it
+	DomainReplay(ctx context.Context, hostname string) (string, error)
+	// SetDomainHeaders sets the headers added to the domain's responses;
+	// empty adds none
+	SetDomainHeaders(ctx context.Context, userID, id, headers string) error
+	// DomainHeaders returns the headers added to hostname's responses, or
+	// ErrNotFound if nobody owns it
+	DomainHeaders(ctx context.Context, hostname string) (string, error)
+	// SetDomainHTTPS sets how the domain's visitors are kept on HTTPS;
+	// empty serves plain HTTP as it comes
+	SetDomainHTTPS(ctx context.Context, userID, id, policy string) error
+	// DomainHTTPS returns hostname's HTTPS policy, or ErrNotFound if
+	// nobody owns it
+	DomainHTTPS(ctx context.Context, hostname string) (string, error)
+	DeleteDomain(ctx context.Context, userID, id string) error
+	// GrantDomain lets the user with email connect tunnels on the owner's
+	// domain id. It returns ErrNotFound for another user's domain or an
+	// email nobody has, and the existing grant if there is one.
+	GrantDomain(ctx context.Context, ownerID, id, email string) (*DomainGrant, error)
+	// RevokeDomain takes back a grant, or returns ErrNotFound
+	RevokeDomain(ctx context.Context, ownerID, id, memberID string) error
+	// ListDomainGrants returns the grants on the owner's domains, oldest first
+	ListDomainGrants(ctx context.Context, ownerID string) ([]DomainGrant, error)
+	// MayBindDomain reports whether userID may connect a tunnel on
+	// hostname: nobody has verified it, userID has, or its owner granted
+	// it to userID. An unverified claim proves nothing, so it doesn't
+	// keep anyone off the hostname.
+	MayBindDomain(ctx context.Context, userID, hostname string) (bool, error)
+}
+
+// AccountStore edits a user's profile, email and linked identities
+type AccountStore interface {
+	UpdateProfile(ctx context.Context, userID, name, avatarURL string) error
+	SetTheme(ctx context.Context, userID, theme string) error
+	// SetDataRegion changes where the user's request logs are kept, moving
+	// the logs already written
+	SetDataRegion(ctx context.Context, userID, region string) error
+	// Preferences returns the user's preferences, DefaultPreferences if
+	// they have never changed them
+	Preferences(ctx context.Context, userID string) (Preferences, error)
+	SetPreferences(ctx context.Context, userID string, p Preferences) error
+	// GitHubApp returns the user's GitHub App, or ErrNotFound
+	GitHubApp(ctx context.Context, userID string) (*GitHubApp, error)
+	// SetGitHubApp creates or replaces app.UserID's GitHub App
+	SetGitHubApp(ctx context.Context, app GitHubApp) error
+	// DeleteGitHubApp removes the user's GitHub App, or returns ErrNotFound
+	DeleteGitHubApp(ctx context.Context, userID string) error
+	// CreateEmailChange stores a pending change, replacing any earlier one.
+	// It returns ErrEmailTaken if another user already has the address.
+	CreateEmailChange(ctx context.Context, userID, newEmail, tokenHash string, expiresAt time.Time) error
+	// ConfirmEmailChange applies an unexpired pending change and returns the new address
+	ConfirmEmailChange(ctx context.Context, userID, tokenHash string) (string, error)
+	ListIdentities(ctx context.Context, userID string) ([]Identity, error)
+	// DeleteIdentity unlinks an identity, or returns ErrLastIdentity for the only one
+	DeleteIdentity(ctx context.Context, userID, id string) error
+}
+
+// AuditStore records account changes
+type AuditStore interface {
+	RecordAudit(ctx context.Context, e AuditEntry) error
+	// ListAudit returns a user's most recent entries, newest first
+	ListAudit(ctx context.Context, userID string, limit int) ([]AuditEntry, error)
+}
+
+// TokenStore manages CLI API tokens, keyed by the token's SHA256 hash
+type TokenStore interface {
+	CreateToken(ctx context.Context, userID, name, tokenHash string) (*APIToken, error)
+	ListTokens(ctx context.Context, userID string) ([]APIToken, error)
+	// TokenUser returns the token's owner and records that the token was used
+	TokenUser(ctx context.Context, tokenHash string) (*User, error)
+}
+
+// StatusStore backs the public status page
+type StatusStore interface {
+	// RecordHealthCheck stores a result and updates the relay's latest health
+	RecordHealthCheck(ctx context.Context, c HealthCheck) error
+	ListRelayHealth(ctx context.Context) ([]RelayHealth, error)
+	// DailyUptime returns per-day check counts since the given time, oldest first
+	DailyUptime(ctx context.Context, since time.Time) ([]UptimeDay, error)
+	// OpenIncident posts an incident, resolving any that is already open
+	OpenIncident(ctx context.Context, i Incident) (*Incident, error)
+	// ResolveIncident closes the open incident, or returns ErrNotFound
+	ResolveIncident(ctx context.Context) error
+	// ActiveIncident returns the open incident, or ErrNotFound
+	ActiveIncident(ctx context.Context) (*Incident, error)
+}
+
+// AdminStore answers fleet-wide questions for operators
+type AdminStore interface {
+	// SearchUsers matches an exact user ID or part of an email address
+	SearchUsers(ctx context.Context, query string, limit int) ([]User, error)
+	CountUsersByPlan(ctx context.Context) (map[string]int, error)
+	// TopDomains returns the domains with the most traffic since the given time
+	TopDomains(ctx context.Context, since time.Time, limit int) ([]DomainTraffic, error)
+	// SetPlanOverride pins a user's plan so billing reconciliation leaves it
+	// alone. An empty plan removes the pin and keeps the current plan.
+	SetPlanOverride(ctx context.Context, userID, plan string) error
+}
+
+// AbuseStore records and triages abuse reports
+type AbuseStore interface {
+	CreateAbuseReport(ctx context.Context, r AbuseReport) (*AbuseReport, error)
+	// ListAbuseReports returns the newest reports, only open ones unless includeResolved
+	ListAbuseReports(ctx context.Context, includeResolved bool, limit int) ([]AbuseReport, error)
+	// ResolveAbuseReport closes an open report, or returns ErrNotFound
+	ResolveAbuseReport(ctx context.Context, id, resolution string) error
+}
+
+// AlertStore keeps users' usage alerts
+type AlertStore interface {
+	CreateAlert(ctx context.Context, a UsageAlert) (*UsageAlert, error)
+	ListAlerts(ctx context.Context, userID string) ([]UsageAlert, error)
+	// DeleteAlert removes one of a user's alerts, or returns ErrNotFound
+	DeleteAlert(ctx context.Context, userID, id string) error
+	// DueAlerts returns the alerts whose threshold the user's bandwidth this
+	// month has reached and that haven't fired this month
+	DueAlerts(ctx context.Context) ([]DueAlert, error)
+	// MarkAlertFired records that an alert fired this month, reporting false
+	// if it already had
+	MarkAlertFired(ctx context.Context, id string) (bool, error)
+}
+
+// EventStore keeps users' activity feeds
+type EventStore interface {
+	RecordEvent(ctx context.Context, e Event) (*Event, error)
+	// ListEvents returns up to limit of a user's events with IDs above
+	// after, oldest first. An after of 0 returns the latest limit events.
+	ListEvents(ctx context.Context, userID string, after int64, limit int) ([]Event, error)
+}
+
+// ExportStore keeps users' exports and reads the data they send
+type ExportStore interface {
+	// SetExport creates or replaces e.UserID's export
+	SetExport(ctx context.Context, e Export) error
+	// GetExport returns the user's export, or ErrNotFound
+	GetExport(ctx context.Context, userID string) (*Export, error)
+	// DeleteExport removes the user's export, or returns ErrNotFound
+	DeleteExport(ctx context.Context, userID string) error
+	// ListExports returns every user's export
+	ListExports(ctx context.Context) ([]Export, error)
+	// MarkExported records a run: data before through has been written, and
+	// runErr says why the run stopped early, if it did
+	MarkExported(ctx context.Context, userID string, through time.Time, runErr string) error
+	// RequestLogsBetween returns up to limit of the user's request logs
+	// created in [from, to), oldest first
+	RequestLogsBetween(ctx context.Context, userID string, from, to time.Time, limit int) ([]RequestLog, error)
+	// DailyUsage returns the user's traffic per domain for the UTC days
+	// starting in [from, to), oldest first
+	DailyUsage(ctx context.Context, userID string, from, to time.Time) ([]UsageDay, error)
+}
+
+// CertStore shares the ACME certificates, account key and challenge tokens
+// of the relay fleet, so each certificate is issued once
+type CertStore interface {
+	// GetCert returns the data cached under key, or ErrNotFound
+	GetCert(ctx context.Context, key string) ([]byte, error)
+	PutCert(ctx context.Context, key string, data []byte) error
+	DeleteCert(ctx context.Context, key string) error
+	// LockCert takes a lease on key for holder until ttl passes. It returns
+	// false while another holder's lease is unexpired.
+	LockCert(ctx context.Context, key, holder string, ttl time.Duration) (bool, error)
+	// UnlockCert releases holder's lease on key, if it still has it
+	UnlockCert(ctx context.Context, key, holder string) error
+}
+
+// UsageStore records and reports bandwidth and request traffic
+type UsageStore interface {
+	RecordBandwidth(ctx context.Context, userID, tunnelSessionID string, bytesIn, bytesOut int64) error
+	// MonthlyUsage returns bytes in plus bytes out since the start of the current month
+	MonthlyUsage(ctx context.Context, userID string) (int64, error)
+	RecentRequests(ctx context.Context, userID string, limit int) ([]RequestLog, error)
+	// LogRequest records a request served for hostname. It returns ErrNotFound
+	// when no user owns the hostname, since logs are kept per domain.
+	LogRequest(ctx context.Context, hostname string, l RequestLog) error
+	// StartTunnelSession opens a session for a tunnel on hostname, under the
+	// tunnel's name if it has one. It returns ErrNotFound when no user owns
+	// the hostname.
+	StartTunnelSession(ctx context.Context, hostname, name string) (string, error)
+	// EndTunnelSession records when and why a session ended
+	EndTunnelSession(ctx context.Context, id, reason string) error
+	// TunnelHistory sums up the user's tunnels with sessions since the given
+	// time, most recently seen first
+	TunnelHistory(ctx context.Context, userID string, since time.Time) ([]TunnelHistory, error)
+	// NamedTunnelSessions returns the latest sessions of the user's tunnel
+	// with the given name, newest first
+	NamedTunnelSessions(ctx context.Context, userID, name string, limit int) ([]TunnelSession, error)
+	// ClientStats sums up the user's requests logged since the given time
+	// by the version of the client that served them, most requests first
+	ClientStats(ctx context.Context, userID string, since time.Time) ([]ClientStats, error)
+}
+
+// SessionStore manages dashboard login sessions, keyed by the token's SHA256 hash
+type SessionStore interface {
+	CreateSession(ctx context.Context, userID, tokenHash string, expiresAt time.Time) error
+	// CreateImpersonationSession opens a read-only support session for an operator
+	CreateImpersonationSession(ctx context.Context, userID, tokenHash, operator string, expiresAt time.Time) error
+	// SessionUser returns the user for an unexpired session, with ImpersonatedBy
+	// set for support sessions
+	SessionUser(ctx context.Context, tokenHash string) (*User, error)
+	DeleteSession(ctx context.Context, tokenHash string) error
+}
+
+// All is implemented by backends that provide every store
+type All interface {
+	UserStore
+	AccountStore
+	AuditStore
+	DomainStore
+	UsageStore
+	SessionStore
+	TokenStore
+	StatusStore
+	AdminStore
+	AbuseStore
+	AlertStore
+	EventStore
+	ExportStore
+	CertStore
+}
+
+// Stores groups the stores a component depends on
+type Stores struct {
+	Users    UserStore
+	Accounts AccountStore
+	Audit    AuditStore
+	Domains  DomainStore
+	Usage    UsageStore
+	Sessions SessionStore
+	Tokens   TokenStore
+	Status   StatusStore
+	Admin    AdminStore
+	Abuse    AbuseStore
+	Alerts   AlertStore
+	Events   EventStore
+	Exports  ExportStore
+	Certs    CertStore
+}
+
+// NewStores uses one backend for every store
+func NewStores(backend All) Stores {
+	return Stores{
+		Users:    backend,
+		Accounts: backend,
+		Audit:    backend,
+		Domains:  backend,
+		Usage:    backend,
+		Sessions: backend,
+		Tokens:   backend,
+		Status:   backend,
+		Admin:    backend,
+		Abuse:    backend,
+		Alerts:   backend,
+		Events:   backend,
+		Exports:  backend,
+		Certs:    backend,
+	}
+}
+
+// monthStart returns midnight on the first of t's month
+func monthStart(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+}
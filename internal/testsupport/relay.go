@@ -0,0 +1,309 @@
+// internal/testsupport/relay.go
+package testsupport
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/quic"
+
+	"github.com/lobber-dev/lobber/internal/client"
+	"github.com/lobber-dev/lobber/internal/db"
+	"github.com/lobber-dev/lobber/internal/relay"
+)
+
+// DevToken is the token tunnels use against an in-memory relay. It belongs
+// to relay.DevUserID.
+const DevToken = "lb_testsupport"
+
+// readyTimeout bounds how long a tunnel may take to come up or go away
+const readyTimeout = 5 * time.Second
+
+// StartServer serves handler on a loopback port until the test ends. Tests
+// are skipped where the sandbox forbids listening.
+func StartServer(t testing.TB, handler http.Handler) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(handler)
+	srv.Listener = listen(t)
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// listen opens a loopback listener, skipping the test where that's forbidden
+func listen(t testing.TB) net.Listener {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		if strings.Contains(err.Error(), "operation not permitted") {
+			t.Skipf("skipping test server start: %v", err)
+		}
+		t.Fatalf("listen error: %v", err)
+	}
+	return ln
+}
+
+// Relay is a relay server listening on a loopback port
+type Relay struct {
+	*relay.Server
+	URL string
+
+	// Token opens tunnels; DevToken unless the relay has a database
+	Token string
+
+	// Set by StartTLSRelay: certificates come from CA under TLS's host policy
+	CA  *relay.LocalCA
+	TLS *relay.TLSManager
+
+	// HTTPClient reaches the relay; against a TLS relay it trusts CA and
+	// dials the relay whatever the URL's host
+	HTTPClient *http.Client
+
+	tlsConfig *tls.Config // the HTTPS server's, for ServeQUIC
+}
+
+// StartRelay runs a relay until the test ends. A nil config uses
+// relay.DefaultServerConfig. Without a database the relay runs in dev mode
+// with DevToken, so tunnels belong to a real user rather than "anonymous".
+func StartRelay(t testing.TB, config *relay.ServerConfig, database *db.DB) *Relay {
+	t.Helper()
+	server, config := newServer(t, config, database)
+	return &Relay{
+		Server:     server,
+		URL:        StartServer(t, server).URL,
+		Token:      config.DevToken,
+		HTTPClient: http.DefaultClient,
+	}
+}
+
+// newServer builds a relay with StartRelay's defaults and runs its jobs
+// until the test ends
+func newServer(t testing.TB, config *relay.ServerConfig, database *db.DB) (*relay.Server, *relay.ServerConfig) {
+	if config == nil {
+		config = relay.DefaultServerConfig()
+	}
+	if database == nil && config.DevToken == "" {
+		config.DevToken = DevToken
+	}
+
+	server := relay.NewServerWithConfig(database, config)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	server.StartJobs(ctx)
+	return server, config
+}
+
+// StartTLSRelay is StartRelay behind HTTPS the way cmd/relay serves it, with
+// certificates from a local CA instead of ACME. The relay answers as
+// localhost; visitors' hostnames must be allowed with TLS.AddDomain.
+func StartTLSRelay(t testing.TB, config *relay.ServerConfig, database *db.DB) *Relay {
+	t.Helper()
+
+	if config == nil {
+		config = relay.DefaultServerConfig()
+	}
+	config.BaseDomain = "localhost"
+	server, config := newServer(t, config, database)
+
+	ca, err := relay.NewLocalCA()
+	if err != nil {
+		t.Fatalf("local CA: %v", err)
+	}
+	tlsMgr := relay.NewTLSManagerWithCA(config.BaseDomain, ca)
+	tlsMgr.OnCertIssued = server.CertIssued
+
+	ln := listen(t)
+	tlsConfig := tlsMgr.TLSConfig()
+	tlsConfig.GetConfigForClient = server.RecordClientHello
+	httpsServer := &http.Server{
+		Handler:   server,
+		TLSConfig: tlsConfig,
+		ConnState: server.ConnState,
+	}
+	var httpsLn net.Listener = ln
+	if config.TLSPassthrough {
+		httpsLn = server.PassthroughListener(ln)
+	}
+	go httpsServer.ServeTLS(httpsLn, "", "")
+	t.Cleanup(func() { httpsServer.Close() })
+
+	addr := ln.Addr().String()
+	_, port, _ := net.SplitHostPort(addr)
+	dialer := &net.Dialer{Timeout: readyTimeout}
+	return &Relay{
+		Server: server,
+		URL:    "https://localhost:" + port,
+		Token:  config.DevToken,
+		CA:     ca,
+		TLS:    tlsMgr,
+
+		tlsConfig: tlsConfig,
+		HTTPClient: &http.Client{
+			Transport: &http.Transport{
+				// Every visitor hostname resolves to the relay
+				DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+					return dialer.DialContext(ctx, network, addr)
+				},
+				TLSClientConfig:   &tls.Config{RootCAs: ca.CertPool()},
+				ForceAttemptHTTP2: true,
+			},
+			Timeout: readyTimeout,
+		},
+	}
+}
+
+// ServeQUIC has a relay started with StartTLSRelay also take tunnels over
+// QUIC, on its HTTPS port, until the test ends
+func (r *Relay) ServeQUIC(t testing.TB) {
+	t.Helper()
+	u, err := url.Parse(r.URL)
+	if err != nil || r.tlsConfig == nil {
+		t.Fatalf("ServeQUIC needs a relay started with StartTLSRelay")
+	}
+	ep, err := quic.Listen("udp", "127.0.0.1:"+u.Port(), relay.QUICConfig(r.tlsConfig))
+	if err != nil {
+		t.Skipf("listen on UDP: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go r.Server.ServeQUIC(ctx, ep)
+	t.Cleanup(func() {
+		cancel()
+		closeCtx, closeCancel := context.WithTimeout(context.Background(), time.Second)
+		defer closeCancel()
+		ep.Close(closeCtx)
+	})
+}
+
+// Tunnel is a client connected to a Relay
+type Tunnel struct {
+	*client.Client
+	Domain string
+
+	relay      *Relay
+	registered *relay.Tunnel // the relay's end of this connection
+	cancel     context.CancelFunc
+	done       chan error
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// Connect opens a tunnel for domain to localURL with the relay's token and
+// waits until both ends are ready
+func (r *Relay) Connect(t testing.TB, domain, localURL string) *Tunnel {
+	t.Helper()
+	tun, err := r.ConnectWithToken(domain, localURL, r.Token)
+	if err != nil {
+		t.Fatalf("connect tunnel %s: %v", domain, err)
+	}
+	t.Cleanup(func() { tun.Close() })
+	return tun
+}
+
+// ConnectWithToken opens a tunnel with the given token. The caller closes it.
+func (r *Relay) ConnectWithToken(domain, localURL, token string) (*Tunnel, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	tun := &Tunnel{
+		Client: client.New(localURL, r.URL, token, domain),
+		Domain: domain,
+		relay:  r,
+		cancel: cancel,
+		done:   make(chan error, 1),
+	}
+	if r.CA != nil {
+		tun.TLSConfig = &tls.Config{RootCAs: r.CA.CertPool()}
+	}
+
+	ready := make(chan struct{})
+	tun.SetOnReady(func() { close(ready) })
+	go func() { tun.done <- tun.Run(ctx) }()
+
+	select {
+	case <-ready:
+	case err := <-tun.done:
+		cancel()
+		return nil, err
+	case <-time.After(readyTimeout):
+		cancel()
+		return nil, errors.New("timeout waiting for tunnel to become ready")
+	}
+
+	// The relay marks the tunnel ready once it has read the ready frame
+	tun.registered = r.GetTunnel(domain)
+	if tun.registered == nil {
+		cancel()
+		return nil, errors.New("tunnel not registered")
+	}
+	select {
+	case <-tun.registered.GetReadyChannel():
+	case <-time.After(readyTimeout):
+		cancel()
+		return nil, errors.New("timeout waiting for relay to mark tunnel ready")
+	}
+	return tun, nil
+}
+
+// Close disconnects the tunnel and waits for the relay to let go of its
+// hostname. Closing twice is fine.
+func (tun *Tunnel) Close() error {
+	tun.closeOnce.Do(func() { tun.closeErr = tun.close() })
+	return tun.closeErr
+}
+
+func (tun *Tunnel) close() error {
+	tun.cancel()
+	select {
+	case <-tun.done:
+	case <-time.After(readyTimeout):
+		return errors.New("timeout waiting for tunnel client to stop")
+	}
+
+	deadline := time.Now().Add(readyTimeout)
+	for time.Now().Before(deadline) {
+		if tun.relay.GetTunnel(tun.Domain) != tun.registered {
+			return nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return errors.New("timeout waiting for relay to drop tunnel")
+}
+
+// Get requests path from the relay as if the browser had asked for host.
+// Against a TLS relay host is also the SNI name the certificate must match.
+func (r *Relay) Get(t testing.TB, host, path string) *http.Response {
+	t.Helper()
+	resp, err := r.get(host, path)
+	if err != nil {
+		t.Fatalf("GET %s%s: %v", host, path, err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+// TryGet is Get for requests expected to fail, such as a TLS handshake
+// the relay refuses
+func (r *Relay) TryGet(host, path string) (*http.Response, error) {
+	return r.get(host, path)
+}
+
+func (r *Relay) get(host, path string) (*http.Response, error) {
+	target := r.URL + path
+	if r.CA != nil {
+		target = "https://" + host + path
+	}
+	req, err := http.NewRequest("GET", target, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Host = host
+	return r.HTTPClient.Do(req)
+}
@@ -0,0 +1,311 @@
+// internal/testsupport/stripe.go
+package testsupport
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stripe/stripe-go/v76"
+	"github.com/stripe/stripe-go/v76/webhook"
+)
+
+// FakeStripe answers the Stripe API calls billing.StripeClient makes from
+// memory: customers, subscriptions, seat changes and usage records
+type FakeStripe struct {
+	URL string
+
+	mu            sync.Mutex
+	nextID        int
+	prices        map[string]stripe.Price
+	customers     map[string]*stripe.Customer
+	subscriptions map[string]*stripe.Subscription
+	usage         map[string]int64 // subscription item -> MB reported
+}
+
+// StartFakeStripe points the stripe-go client at a fake API until the test
+// ends. Tests using it must not run in parallel with other Stripe callers.
+func StartFakeStripe(t testing.TB) *FakeStripe {
+	t.Helper()
+
+	f := &FakeStripe{
+		prices:        make(map[string]stripe.Price),
+		customers:     make(map[string]*stripe.Customer),
+		subscriptions: make(map[string]*stripe.Subscription),
+		usage:         make(map[string]int64),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/customers", f.createCustomer)
+	mux.HandleFunc("POST /v1/customers/{id}", f.updateCustomer)
+	mux.HandleFunc("POST /v1/subscriptions", f.createSubscription)
+	mux.HandleFunc("GET /v1/subscriptions/{id}", f.getSubscription)
+	mux.HandleFunc("DELETE /v1/subscriptions/{id}", f.cancelSubscription)
+	mux.HandleFunc("POST /v1/subscription_items/{id}", f.updateItem)
+	mux.HandleFunc("POST /v1/subscription_items/{id}/usage_records", f.createUsageRecord)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		writeStripeError(w, http.StatusNotFound, "", "fake Stripe does not implement "+r.Method+" "+r.URL.Path)
+	})
+	srv := StartServer(t, mux)
+	f.URL = srv.URL
+
+	stripe.Key = "sk_test_fake"
+	stripe.SetBackend(stripe.APIBackend, stripe.GetBackendWithConfig(stripe.APIBackend, &stripe.BackendConfig{
+		URL:               stripe.String(srv.URL),
+		HTTPClient:        srv.Client(),
+		MaxNetworkRetries: stripe.Int64(0),
+		LeveledLogger:     &stripe.LeveledLogger{Level: stripe.LevelNull},
+	}))
+	t.Cleanup(func() { stripe.SetBackend(stripe.APIBackend, nil) })
+
+	return f
+}
+
+// AddPrice registers a price subscriptions can use. Unknown prices are
+// treated as monthly metered usage prices.
+func (f *FakeStripe) AddPrice(p stripe.Price) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.prices[p.ID] = p
+}
+
+// Customer returns a customer created through the API, or nil
+func (f *FakeStripe) Customer(id string) *stripe.Customer {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.customers[id]
+}
+
+// Subscription returns a subscription created through the API, or nil
+func (f *FakeStripe) Subscription(id string) *stripe.Subscription {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.subscriptions[id]
+}
+
+// UsageReported returns the MB reported against a subscription item
+func (f *FakeStripe) UsageReported(itemID string) int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.usage[itemID]
+}
+
+// SendWebhook posts a signed event wrapping object to a webhook endpoint
+func (f *FakeStripe) SendWebhook(endpoint, secret string, eventType stripe.EventType, object any) (*http.Response, error) {
+	data, err := json.Marshal(object)
+	if err != nil {
+		return nil, fmt.Errorf("marshal event object: %w", err)
+	}
+	f.mu.Lock()
+	id := f.newID("evt")
+	f.mu.Unlock()
+
+	payload, err := json.Marshal(map[string]any{
+		"id":          id,
+		"object":      "event",
+		"type":        eventType,
+		"api_version": stripe.APIVersion,
+		"created":     time.Now().Unix(),
+		"data":        map[string]json.RawMessage{"object": data},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("marshal event: %w", err)
+	}
+	signed := webhook.GenerateTestSignedPayload(&webhook.UnsignedPayload{Payload: payload, Secret: secret})
+
+	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(signed.Payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Stripe-Signature", signed.Header)
+	return http.DefaultClient.Do(req)
+}
+
+func (f *FakeStripe) newID(prefix string) string {
+	f.nextID++
+	return fmt.Sprintf("%s_fake%d", prefix, f.nextID)
+}
+
+func (f *FakeStripe) createCustomer(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	c := &stripe.Customer{
+		ID:      f.newID("cus"),
+		Object:  "customer",
+		Email:   r.PostFormValue("email"),
+		Name:    r.PostFormValue("name"),
+		Created: time.Now().Unix(),
+	}
+	f.customers[c.ID] = c
+	writeStripeJSON(w, c)
+}
+
+func (f *FakeStripe) updateCustomer(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	c, ok := f.customers[r.PathValue("id")]
+	if !ok {
+		writeStripeError(w, http.StatusNotFound, "resource_missing", "No such customer")
+		return
+	}
+	if v := r.PostFormValue("email"); v != "" {
+		c.Email = v
+	}
+	if v := r.PostFormValue("name"); v != "" {
+		c.Name = v
+	}
+	writeStripeJSON(w, c)
+}
+
+func (f *FakeStripe) createSubscription(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.customers[r.PostFormValue("customer")]; !ok {
+		writeStripeError(w, http.StatusBadRequest, "resource_missing", "No such customer")
+		return
+	}
+
+	price, ok := f.prices[r.PostFormValue("items[0][price]")]
+	if !ok {
+		price = stripe.Price{
+			ID:        r.PostFormValue("items[0][price]"),
+			Currency:  stripe.CurrencyUSD,
+			Recurring: &stripe.PriceRecurring{Interval: stripe.PriceRecurringIntervalMonth, UsageType: stripe.PriceRecurringUsageTypeMetered},
+		}
+	}
+	quantity := int64(1)
+	if v := r.PostFormValue("items[0][quantity]"); v != "" {
+		quantity, _ = strconv.ParseInt(v, 10, 64)
+	}
+
+	now := time.Now()
+	periodEnd := now.AddDate(0, 1, 0)
+	if price.Recurring != nil && price.Recurring.Interval == stripe.PriceRecurringIntervalYear {
+		periodEnd = now.AddDate(1, 0, 0)
+	}
+	sub := &stripe.Subscription{
+		ID:                 f.newID("sub"),
+		Object:             "subscription",
+		Customer:           &stripe.Customer{ID: r.PostFormValue("customer")},
+		Status:             stripe.SubscriptionStatusActive,
+		Created:            now.Unix(),
+		CurrentPeriodStart: now.Unix(),
+		CurrentPeriodEnd:   periodEnd.Unix(),
+		Items: &stripe.SubscriptionItemList{
+			Data: []*stripe.SubscriptionItem{{ID: f.newID("si"), Price: &price, Quantity: quantity}},
+		},
+	}
+	if v := r.PostFormValue("trial_period_days"); v != "" {
+		days, _ := strconv.Atoi(v)
+		sub.Status = stripe.SubscriptionStatusTrialing
+		sub.TrialEnd = now.AddDate(0, 0, days).Unix()
+	}
+	f.subscriptions[sub.ID] = sub
+	writeStripeJSON(w, sub)
+}
+
+func (f *FakeStripe) getSubscription(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	sub, ok := f.subscriptions[r.PathValue("id")]
+	if !ok {
+		writeStripeError(w, http.StatusNotFound, "resource_missing", "No such subscription")
+		return
+	}
+	writeStripeJSON(w, sub)
+}
+
+func (f *FakeStripe) cancelSubscription(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	sub, ok := f.subscriptions[r.PathValue("id")]
+	if !ok {
+		writeStripeError(w, http.StatusNotFound, "resource_missing", "No such subscription")
+		return
+	}
+	sub.Status = stripe.SubscriptionStatusCanceled
+	sub.CanceledAt = time.Now().Unix()
+	writeStripeJSON(w, sub)
+}
+
+func (f *FakeStripe) updateItem(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	item := f.item(r.PathValue("id"))
+	if item == nil {
+		writeStripeError(w, http.StatusNotFound, "resource_missing", "No such subscription item")
+		return
+	}
+	if v := r.PostFormValue("quantity"); v != "" {
+		item.Quantity, _ = strconv.ParseInt(v, 10, 64)
+	}
+	writeStripeJSON(w, item)
+}
+
+func (f *FakeStripe) createUsageRecord(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	itemID := r.PathValue("id")
+	if f.item(itemID) == nil {
+		writeStripeError(w, http.StatusNotFound, "resource_missing", "No such subscription item")
+		return
+	}
+	quantity, _ := strconv.ParseInt(r.PostFormValue("quantity"), 10, 64)
+	if r.PostFormValue("action") == string(stripe.UsageRecordActionSet) {
+		f.usage[itemID] = quantity
+	} else {
+		f.usage[itemID] += quantity
+	}
+	writeStripeJSON(w, &stripe.UsageRecord{
+		ID:               f.newID("mbur"),
+		Object:           "usage_record",
+		Quantity:         quantity,
+		SubscriptionItem: itemID,
+		Timestamp:        time.Now().Unix(),
+	})
+}
+
+// item finds a subscription item by ID. Callers hold f.mu.
+func (f *FakeStripe) item(id string) *stripe.SubscriptionItem {
+	for _, sub := range f.subscriptions {
+		for _, item := range sub.Items.Data {
+			if item.ID == id {
+				return item
+			}
+		}
+	}
+	return nil
+}
+
+func writeStripeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeStripeError responds the way Stripe does, so stripe-go returns a
+// *stripe.Error with the given code
+func writeStripeError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{
+		"error": map[string]string{"type": "invalid_request_error", "code": code, "message": message},
+	})
+}
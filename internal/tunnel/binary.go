@@ -0,0 +1,251 @@
+// internal/tunnel/binary.go
+package tunnel
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// BinaryVersion is the first protocol version that reads Request and
+// Response frames in the binary encoding. Ends only send it to peers whose
+// VersionHeader is at least this, and read either encoding whatever the
+// peer's version.
+const BinaryVersion = 3
+
+// binaryMarker starts a payload in the binary encoding. JSON payloads never
+// start with a zero byte, so readers tell the two apart by the first byte.
+//
+// After it come the message's fields in order, each a uvarint, or a string
+// or bytes as a uvarint length and its data. Headers are a count of names,
+// each followed by a count of values. Fields in brackets are only written
+// when set, as peers that don't know them refuse trailing bytes. A
+// response's flags are chunked (1) and trailers (2), the latter followed by
+// its trailers as headers. A request's caller is its fields in order, all
+// empty for a request with flags but no caller, and its only flag is
+// continue (1).
+//
+//	Request:  id method path upgrade relay_ns headers body [caller [flags]]
+//	Response: id status_code upgrade headers body [flags [trailers]]
+const binaryMarker = 0x00
+
+// Response flags
+const (
+	flagChunked  = 1 << 0
+	flagTrailers = 1 << 1
+)
+
+// Request flags
+const flagContinue = 1 << 0
+
+var errBinaryTruncated = errors.New("binary payload truncated")
+
+// marshalBinary encodes requests and responses in the binary encoding,
+// returning nil for other messages, which are always JSON
+func marshalBinary(v any) []byte {
+	switch m := v.(type) {
+	case *Request:
+		b := make([]byte, 0, 64+len(m.Path)+len(m.Body)+headersSize(m.Headers))
+		b = append(b, binaryMarker)
+		b = appendString(b, m.ID)
+		b = appendString(b, m.Method)
+		b = appendString(b, m.Path)
+		b = appendString(b, m.Upgrade)
+		b = binary.AppendUvarint(b, uint64(max(m.RelayTime, 0)))
+		b = appendHeaders(b, m.Headers)
+		b = appendBytes(b, m.Body)
+		c := m.Caller
+		if c == nil && m.Continue {
+			c = &Caller{}
+		}
+		if c != nil {
+			for _, s := range []string{c.RemoteIP, c.Scheme, c.Host, c.TLSVersion, c.ALPN, c.ServerName} {
+				b = appendString(b, s)
+			}
+		}
+		if m.Continue {
+			b = binary.AppendUvarint(b, flagContinue)
+		}
+		return b
+	case *Response:
+		b := make([]byte, 0, 64+len(m.Body)+headersSize(m.Headers)+headersSize(m.Trailers))
+		b = append(b, binaryMarker)
+		b = appendString(b, m.ID)
+		b = binary.AppendUvarint(b, uint64(max(m.StatusCode, 0)))
+		b = appendString(b, m.Upgrade)
+		b = appendHeaders(b, m.Headers)
+		b = appendBytes(b, m.Body)
+		var flags uint64
+		if m.Chunked {
+			flags |= flagChunked
+		}
+		if len(m.Trailers) > 0 {
+			flags |= flagTrailers
+		}
+		if flags != 0 {
+			b = binary.AppendUvarint(b, flags)
+		}
+		if flags&flagTrailers != 0 {
+			b = appendHeaders(b, m.Trailers)
+		}
+		return b
+	}
+	return nil
+}
+
+// unmarshalBinary decodes a payload in the binary encoding into v
+func unmarshalBinary(data []byte, v any) error {
+	d := binaryDecoder{data: data[1:]}
+	switch m := v.(type) {
+	case *Request:
+		m.ID = d.string()
+		m.Method = d.string()
+		m.Path = d.string()
+		m.Upgrade = d.string()
+		m.RelayTime = time.Duration(d.uvarint())
+		m.Headers = d.headers()
+		m.Body = d.bytes()
+		if d.err == nil && len(d.data) > 0 {
+			m.Caller = &Caller{
+				RemoteIP:   d.string(),
+				Scheme:     d.string(),
+				Host:       d.string(),
+				TLSVersion: d.string(),
+				ALPN:       d.string(),
+				ServerName: d.string(),
+			}
+			if *m.Caller == (Caller{}) {
+				m.Caller = nil
+			}
+		}
+		// Unknown flags are left as trailing bytes, and refused
+		if flags, n := binary.Uvarint(d.data); d.err == nil && n > 0 && flags == flagContinue {
+			d.data = d.data[n:]
+			m.Continue = true
+		}
+	case *Response:
+		m.ID = d.string()
+		m.StatusCode = int(d.uvarint())
+		m.Upgrade = d.string()
+		m.Headers = d.headers()
+		m.Body = d.bytes()
+		// Unknown flags are left as trailing bytes, and refused
+		if flags, n := binary.Uvarint(d.data); n > 0 && flags != 0 && flags&^(flagChunked|flagTrailers) == 0 {
+			d.data = d.data[n:]
+			m.Chunked = flags&flagChunked != 0
+			if flags&flagTrailers != 0 {
+				m.Trailers = d.headers()
+			}
+		}
+	default:
+		return fmt.Errorf("unmarshal: binary payload for %T", v)
+	}
+	if d.err == nil && len(d.data) > 0 {
+		d.err = fmt.Errorf("%d bytes after binary payload", len(d.data))
+	}
+	if d.err != nil {
+		return fmt.Errorf("unmarshal: %w", d.err)
+	}
+	return nil
+}
+
+func appendString(b []byte, s string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+func appendBytes(b, data []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+func appendHeaders(b []byte, h map[string][]string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(h)))
+	for name, values := range h {
+		b = appendString(b, name)
+		b = binary.AppendUvarint(b, uint64(len(values)))
+		for _, v := range values {
+			b = appendString(b, v)
+		}
+	}
+	return b
+}
+
+// headersSize estimates the encoded size of h, to size the buffer once
+func headersSize(h map[string][]string) int {
+	n := 0
+	for name, values := range h {
+		n += len(name) + 2
+		for _, v := range values {
+			n += len(v) + 2
+		}
+	}
+	return n
+}
+
+// binaryDecoder reads fields off a binary payload. After the first error
+// every read returns the zero value, so callers check err once at the end.
+type binaryDecoder struct {
+	data []byte
+	err  error
+}
+
+func (d *binaryDecoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.data)
+	if n <= 0 {
+		d.err = errBinaryTruncated
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+func (d *binaryDecoder) bytes() []byte {
+	n := d.uvarint()
+	if n > uint64(len(d.data)) {
+		d.err = errBinaryTruncated
+	}
+	if d.err != nil || n == 0 {
+		return nil
+	}
+	b := d.data[:n:n]
+	d.data = d.data[n:]
+	return b
+}
+
+func (d *binaryDecoder) string() string {
+	return string(d.bytes())
+}
+
+func (d *binaryDecoder) headers() map[string][]string {
+	// Every name and value takes at least a byte, which bounds the counts
+	// a hostile payload can make us allocate for
+	n := d.uvarint()
+	if n > uint64(len(d.data)) {
+		d.err = errBinaryTruncated
+	}
+	if d.err != nil || n == 0 {
+		return nil
+	}
+	h := make(map[string][]string, n)
+	for range n {
+		name := d.string()
+		count := d.uvarint()
+		if count > uint64(len(d.data)) {
+			d.err = errBinaryTruncated
+		}
+		if d.err != nil {
+			return nil
+		}
+		values := make([]string, 0, count)
+		for range count {
+			values = append(values, d.string())
+		}
+		h[name] = values
+	}
+	return h
+}
@@ -0,0 +1,125 @@
+// internal/tunnel/binary_test.go
+package tunnel
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBinaryFrames(t *testing.T) {
+	body := bytes.Repeat([]byte{0x00, 0xff, 0x7f}, 1000)
+	req := &Request{
+		ID:        "req-1",
+		Method:    "POST",
+		Path:      "/upload?x=1",
+		Headers:   map[string][]string{"Content-Type": {"application/octet-stream"}, "X-Multi": {"a", "b"}},
+		Body:      body,
+		RelayTime: 3 * time.Millisecond,
+		Upgrade:   "websocket",
+		Caller:    &Caller{RemoteIP: "203.0.113.7", Scheme: "https", Host: "app.example.com", TLSVersion: "TLS 1.3", ALPN: "h2", ServerName: "app.example.com"},
+	}
+	resp := &Response{ID: "req-1", StatusCode: 201, Headers: map[string][]string{"Set-Cookie": {"a=1", "b=2"}}, Body: body}
+	head := &Response{ID: "req-2", StatusCode: 200, Headers: map[string][]string{"Content-Length": {"3000"}}, Chunked: true}
+	grpc := &Response{ID: "req-3", StatusCode: 200, Body: body, Trailers: map[string][]string{"Grpc-Status": {"0"}, "Grpc-Message": {""}}}
+	held := &Request{ID: "req-4", Method: "PUT", Path: "/upload", Headers: map[string][]string{"Expect": {"100-continue"}}, Continue: true}
+
+	var buf bytes.Buffer
+	w := Framing{Binary: true}.Writer(&buf)
+	if err := EncodeRequest(w, req); err != nil {
+		t.Fatalf("EncodeRequest() error = %v", err)
+	}
+	jsonReq, _ := json.Marshal(req)
+	if buf.Len() >= len(jsonReq)*4/5 {
+		t.Errorf("binary request is %d bytes, want under base64ed JSON's %d", buf.Len(), len(jsonReq))
+	}
+	if err := EncodeResponse(w, resp); err != nil {
+		t.Fatalf("EncodeResponse() error = %v", err)
+	}
+	if err := EncodeResponse(w, head); err != nil {
+		t.Fatalf("EncodeResponse(head) error = %v", err)
+	}
+	if err := EncodeResponse(w, grpc); err != nil {
+		t.Fatalf("EncodeResponse(trailers) error = %v", err)
+	}
+	if err := EncodeRequest(w, held); err != nil {
+		t.Fatalf("EncodeRequest(continue) error = %v", err)
+	}
+	// Other frames stay JSON
+	if err := EncodePing(w, &Heartbeat{Seq: 9}); err != nil {
+		t.Fatalf("EncodePing() error = %v", err)
+	}
+
+	gotReq, err := DecodeRequest(&buf)
+	if err != nil || !reflect.DeepEqual(gotReq, req) {
+		t.Errorf("DecodeRequest() = %+v, %v, want %+v", gotReq, err, req)
+	}
+	gotResp, err := DecodeResponse(&buf)
+	if err != nil || !reflect.DeepEqual(gotResp, resp) {
+		t.Errorf("DecodeResponse() = %+v, %v, want %+v", gotResp, err, resp)
+	}
+	gotHead, err := DecodeResponse(&buf)
+	if err != nil || !reflect.DeepEqual(gotHead, head) {
+		t.Errorf("DecodeResponse(head) = %+v, %v, want %+v", gotHead, err, head)
+	}
+	gotGRPC, err := DecodeResponse(&buf)
+	if err != nil || !reflect.DeepEqual(gotGRPC, grpc) {
+		t.Errorf("DecodeResponse(trailers) = %+v, %v, want %+v", gotGRPC, err, grpc)
+	}
+	gotHeld, err := DecodeRequest(&buf)
+	if err != nil || !reflect.DeepEqual(gotHeld, held) {
+		t.Errorf("DecodeRequest(continue) = %+v, %v, want %+v", gotHeld, err, held)
+	}
+	ping, err := ReadFrame(&buf)
+	if err != nil || ping.Payload[0] != '{' {
+		t.Errorf("ping = %q, %v, want JSON", ping.Payload, err)
+	}
+}
+
+func TestBinaryFramesCompressed(t *testing.T) {
+	var buf bytes.Buffer
+	resp := &Response{ID: "req-1", StatusCode: 200, Body: []byte(strings.Repeat("hello world ", 500))}
+	if err := EncodeResponse(Framing{Compress: CompressGzip, Binary: true}.Writer(&buf), resp); err != nil {
+		t.Fatalf("EncodeResponse() error = %v", err)
+	}
+	if buf.Bytes()[0]&compressedBit == 0 {
+		t.Error("large binary response wasn't compressed")
+	}
+	got, err := DecodeResponse(&buf)
+	if err != nil || string(got.Body) != string(resp.Body) {
+		t.Errorf("DecodeResponse() = %d bytes, %v, want the body back", len(got.Body), err)
+	}
+}
+
+func TestBinaryMalformed(t *testing.T) {
+	full := marshalBinary(&Response{ID: "req-1", StatusCode: 200, Headers: map[string][]string{"A": {"b"}}, Body: []byte("body")})
+	full = full[:len(full):len(full)] // so each append below copies
+	called := marshalBinary(&Request{ID: "req-1", Method: "GET", Path: "/", Caller: &Caller{RemoteIP: "203.0.113.7", Scheme: "https"}})
+
+	tests := []struct {
+		name    string
+		payload []byte
+		v       any
+		wantErr string
+	}{
+		{"truncated", full[:len(full)-2], &Response{}, "truncated"},
+		{"trailing bytes", append(full, 'x'), &Response{}, "after binary payload"},
+		{"unknown flag", append(full, 4), &Response{}, "after binary payload"},
+		{"truncated trailers", append(full, flagTrailers, 1), &Response{}, "truncated"},
+		{"truncated caller", called[:len(called)-1], &Request{}, "truncated"},
+		{"unknown request flag", append(called, 2), &Request{}, "after binary payload"},
+		{"huge header count", []byte{binaryMarker, 1, 'x', 200, 0xff, 0x0f}, &Response{}, "truncated"},
+		{"not a request or response", full, &Heartbeat{}, "binary payload for"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &Frame{Type: TypeResponse, Payload: tt.payload}
+			if err := f.Decode(tt.v); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Decode() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+// internal/tunnel/compress.go
+package tunnel
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// FeatureGzip means the relay reads gzip-compressed frames and sends them
+// to clients that list it. Either end only compresses once the other has
+// said it reads them.
+const FeatureGzip = "gzip"
+
+// Compression algorithms, as the flag byte of a compressed frame. 2 is
+// kept for zstd.
+const (
+	CompressNone byte = 0
+	CompressGzip byte = 1
+)
+
+// compressedBit is set in a frame's type byte when a flag byte naming its
+// compression follows it:
+//
+//	[type|0x80:1][flag:1][length:4][compressed payload:length]
+//
+// Uncompressed frames are unchanged, so peers that don't compress never
+// see one.
+const compressedBit = 0x80
+
+// CompressMin is the smallest payload worth compressing. Below it the
+// gzip header and checksum outweigh what they save.
+const CompressMin = 1 << 10
+
+// Compression returns the best algorithm among features that this build
+// speaks, or CompressNone
+func Compression(features []string) byte {
+	for _, f := range features {
+		if f == FeatureGzip {
+			return CompressGzip
+		}
+	}
+	return CompressNone
+}
+
+var gzipWriters = sync.Pool{New: func() any {
+	zw, _ := gzip.NewWriterLevel(nil, gzip.BestSpeed)
+	return zw
+}}
+
+// compress returns data compressed with alg, or nil if that doesn't make it
+// smaller
+func compress(alg byte, data []byte) []byte {
+	if alg != CompressGzip || len(data) < CompressMin {
+		return nil
+	}
+	var buf bytes.Buffer
+	zw := gzipWriters.Get().(*gzip.Writer)
+	defer gzipWriters.Put(zw)
+	zw.Reset(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return nil
+	}
+	if err := zw.Close(); err != nil || buf.Len() >= len(data) {
+		return nil
+	}
+	return buf.Bytes()
+}
+
+// decompress inflates a compressed frame's payload, refusing any that
+// would grow past limit
+func decompress(alg byte, data []byte, limit int) ([]byte, error) {
+	if alg != CompressGzip {
+		return nil, fmt.Errorf("unsupported frame compression %d", alg)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("decompress: %w", err)
+	}
+	out, err := io.ReadAll(io.LimitReader(zr, int64(limit)+1))
+	if err != nil {
+		return nil, fmt.Errorf("decompress: %w", err)
+	}
+	if len(out) > limit {
+		return nil, fmt.Errorf("decompress: %w", ErrFrameTooLarge)
+	}
+	return out, nil
+}
@@ -0,0 +1,75 @@
+// internal/tunnel/compress_test.go
+package tunnel
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestCompressedFrames(t *testing.T) {
+	tests := []struct {
+		name       string
+		alg        byte
+		body       string
+		compressed bool
+	}{
+		{"large text", CompressGzip, strings.Repeat(`{"user":"ada","ok":true},`, 200), true},
+		{"small", CompressGzip, "hello", false},
+		{"peer doesn't read them", CompressNone, strings.Repeat("a", 4<<10), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			resp := &Response{ID: "req-1", StatusCode: 200, Body: []byte(tt.body)}
+			if err := EncodeResponse(Framing{Compress: tt.alg}.Writer(&buf), resp); err != nil {
+				t.Fatalf("encode: %v", err)
+			}
+			if compressed := buf.Bytes()[0]&compressedBit != 0; compressed != tt.compressed {
+				t.Errorf("compressed = %v, want %v", compressed, tt.compressed)
+			}
+			got, err := DecodeResponse(&buf)
+			if err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			if string(got.Body) != tt.body {
+				t.Errorf("body changed in transit: %d bytes, want %d", len(got.Body), len(tt.body))
+			}
+		})
+	}
+}
+
+func TestDecompressLimits(t *testing.T) {
+	frame := func(alg byte, payload []byte) *bytes.Buffer {
+		var buf bytes.Buffer
+		buf.Write([]byte{TypeResponse | compressedBit, alg})
+		binary.Write(&buf, binary.BigEndian, uint32(len(payload)))
+		buf.Write(payload)
+		return &buf
+	}
+
+	// A small frame that inflates past MaxFrameSize
+	var bomb bytes.Buffer
+	zw := gzip.NewWriter(&bomb)
+	zw.Write(make([]byte, MaxFrameSize+1))
+	zw.Close()
+	if _, err := ReadFrame(frame(CompressGzip, bomb.Bytes())); !errors.Is(err, ErrFrameTooLarge) {
+		t.Errorf("ReadFrame(bomb) error = %v, want ErrFrameTooLarge", err)
+	}
+	if _, err := ReadFrame(frame(2, []byte("zstd"))); err == nil || !strings.Contains(err.Error(), "unsupported frame compression") {
+		t.Errorf("ReadFrame(unknown compression) error = %v, want unsupported", err)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	if got := Compression([]string{FeatureHeartbeat, FeatureGzip}); got != CompressGzip {
+		t.Errorf("Compression(with gzip) = %d, want gzip", got)
+	}
+	if got := Compression([]string{FeatureHeartbeat}); got != CompressNone {
+		t.Errorf("Compression(without) = %d, want none", got)
+	}
+}
@@ -0,0 +1,114 @@
+// internal/tunnel/credit.go
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// ErrCreditClosed means a Credit was closed while waiting on it, as its
+// tunnel or stream went away
+var ErrCreditClosed = errors.New("flow control window closed")
+
+// Credit is room one end of a tunnel granted the other, as in
+// FeatureWindow: for the requests in flight on a connection, or for one
+// stream's bytes. A nil Credit never runs out.
+type Credit struct {
+	mu     sync.Mutex
+	avail  int64
+	closed bool
+	grown  chan struct{} // closed and replaced whenever room is granted
+}
+
+// NewCredit returns a Credit with n bytes of room
+func NewCredit(n int64) *Credit {
+	return &Credit{avail: n, grown: make(chan struct{})}
+}
+
+// Grant gives c n more bytes
+func (c *Credit) Grant(n int64) {
+	if c == nil || n <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.avail += n
+	c.wake()
+}
+
+// Close fails everything waiting on c, now and later, with ErrCreditClosed
+func (c *Credit) Close() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.closed {
+		c.closed = true
+		c.wake()
+	}
+}
+
+// wake lets waiters look again. Callers hold mu.
+func (c *Credit) wake() {
+	close(c.grown)
+	c.grown = make(chan struct{})
+}
+
+// Acquire waits until n bytes are free and takes them
+func (c *Credit) Acquire(ctx context.Context, n int64) error {
+	return c.until(ctx, func() bool {
+		if c.avail < n {
+			return false
+		}
+		c.avail -= n
+		return true
+	})
+}
+
+// Await waits until n bytes are free without taking them
+func (c *Credit) Await(ctx context.Context, n int64) error {
+	return c.until(ctx, func() bool { return c.avail >= n })
+}
+
+// Take waits until any room is free and takes up to n bytes of it,
+// returning how many it took
+func (c *Credit) Take(ctx context.Context, n int64) (int64, error) {
+	if c == nil {
+		return n, nil
+	}
+	var got int64
+	err := c.until(ctx, func() bool {
+		got = min(n, c.avail)
+		c.avail -= got
+		return got > 0
+	})
+	return got, err
+}
+
+// until waits for ready, called under mu each time c grows, to report
+// true. It gives up with ctx's cause, or ErrCreditClosed once c is closed.
+func (c *Credit) until(ctx context.Context, ready func() bool) error {
+	if c == nil {
+		return nil
+	}
+	for {
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			return ErrCreditClosed
+		}
+		ok := ready()
+		grown := c.grown
+		c.mu.Unlock()
+		if ok {
+			return nil
+		}
+		select {
+		case <-grown:
+		case <-ctx.Done():
+			return context.Cause(ctx)
+		}
+	}
+}
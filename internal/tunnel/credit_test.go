@@ -0,0 +1,58 @@
+// internal/tunnel/credit_test.go
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCredit(t *testing.T) {
+	ctx := context.Background()
+	c := NewCredit(10)
+
+	if err := c.Acquire(ctx, 8); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := c.Take(ctx, 5); got != 2 || err != nil {
+		t.Errorf("Take(5) = %d, %v, want the 2 left", got, err)
+	}
+
+	// With no room, Acquire waits for a grant
+	acquired := make(chan error, 1)
+	go func() { acquired <- c.Acquire(ctx, 4) }()
+	select {
+	case err := <-acquired:
+		t.Fatalf("Acquire on a full window returned %v, want it to wait", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	c.Grant(3)
+	select {
+	case err := <-acquired:
+		t.Fatalf("Acquire(4) after granting 3 returned %v, want it to wait", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	c.Grant(1)
+	if err := <-acquired; err != nil {
+		t.Fatalf("Acquire after grants = %v", err)
+	}
+
+	errSlow := errors.New("too slow")
+	short, cancel := context.WithTimeoutCause(ctx, 10*time.Millisecond, errSlow)
+	defer cancel()
+	if err := c.Await(short, 1); !errors.Is(err, errSlow) {
+		t.Errorf("Await past its deadline = %v, want %v", err, errSlow)
+	}
+	go func() { acquired <- c.Acquire(ctx, 1) }()
+	c.Close()
+	if err := <-acquired; !errors.Is(err, ErrCreditClosed) {
+		t.Errorf("Acquire on a closed window = %v, want %v", err, ErrCreditClosed)
+	}
+
+	// A peer that doesn't use windows is never held back
+	var none *Credit
+	if got, err := none.Take(ctx, 5); got != 5 || err != nil {
+		t.Errorf("nil Take(5) = %d, %v, want 5", got, err)
+	}
+}
@@ -0,0 +1,89 @@
+// internal/tunnel/labels.go
+package tunnel
+
+import (
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// LabelsHeader carries a tunnel's labels on /_lobber/connect, as
+// comma-separated key=value pairs
+const LabelsHeader = "X-Lobber-Labels"
+
+// NameHeader carries a tunnel's stable name on /_lobber/connect, which
+// groups its sessions, usage and logs across hostnames
+const NameHeader = "X-Lobber-Name"
+
+// GitHubPRHeader names the pull request, as owner/repo#42, the relay
+// comments the tunnel's link on once it's ready
+const GitHubPRHeader = "X-Lobber-GitHub-PR"
+
+// MaxLabels caps how many labels one tunnel may carry
+const MaxLabels = 16
+
+// labelPattern is what tunnel names and label keys and values may look
+// like: short, lowercase and free of the separators used by the header
+var labelPattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9_.-]{0,61}[a-z0-9])?$`)
+
+// Labels are key=value metadata a client attaches to its tunnel, such as
+// env=staging, so teams can tell many tunnels apart
+type Labels map[string]string
+
+// ParseLabels parses key=value pairs separated by commas, as sent in
+// LabelsHeader. Values may be empty; keys may not repeat.
+func ParseLabels(s string) (Labels, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	labels := Labels{}
+	for pair := range strings.SplitSeq(s, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok {
+			return nil, fmt.Errorf("label %q is not key=value", pair)
+		}
+		if !labelPattern.MatchString(k) {
+			return nil, fmt.Errorf("invalid label key %q", k)
+		}
+		if v != "" && !labelPattern.MatchString(v) {
+			return nil, fmt.Errorf("invalid value %q for label %s", v, k)
+		}
+		if _, dup := labels[k]; dup {
+			return nil, fmt.Errorf("label %s given twice", k)
+		}
+		labels[k] = v
+	}
+	if len(labels) > MaxLabels {
+		return nil, fmt.Errorf("%d labels, at most %d allowed", len(labels), MaxLabels)
+	}
+	return labels, nil
+}
+
+// ValidateName checks a tunnel name such as "checkout-api"
+func ValidateName(name string) error {
+	if !labelPattern.MatchString(name) {
+		return fmt.Errorf("invalid tunnel name %q: use up to 63 lowercase letters, digits, '-', '_' or '.'", name)
+	}
+	return nil
+}
+
+// String encodes the labels for LabelsHeader, sorted by key
+func (l Labels) String() string {
+	pairs := make([]string, 0, len(l))
+	for _, k := range slices.Sorted(maps.Keys(l)) {
+		pairs = append(pairs, k+"="+l[k])
+	}
+	return strings.Join(pairs, ",")
+}
+
+// Match reports whether l has every label in selector with the same value
+func (l Labels) Match(selector Labels) bool {
+	for k, v := range selector {
+		if got, ok := l[k]; !ok || got != v {
+			return false
+		}
+	}
+	return true
+}
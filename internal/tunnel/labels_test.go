@@ -0,0 +1,92 @@
+// internal/tunnel/labels_test.go
+package tunnel
+
+import (
+	"maps"
+	"strings"
+	"testing"
+)
+
+func TestParseLabels(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Labels
+		wantErr bool
+	}{
+		{"", nil, false},
+		{"env=staging", Labels{"env": "staging"}, false},
+		{"env=staging, service=api", Labels{"env": "staging", "service": "api"}, false},
+		{"team.owner=payments-2,canary=", Labels{"team.owner": "payments-2", "canary": ""}, false},
+		{"env", nil, true},
+		{"Env=staging", nil, true},
+		{"env=has space", nil, true},
+		{"env=a,env=b", nil, true},
+		{"=staging", nil, true},
+		{strings.Repeat("k", 64) + "=v", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseLabels(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseLabels(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			}
+			if !maps.Equal(got, tt.want) {
+				t.Errorf("ParseLabels(%q) = %v, want %v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLabelsRoundTrip(t *testing.T) {
+	l := Labels{"service": "api", "env": "staging"}
+	if s := l.String(); s != "env=staging,service=api" {
+		t.Errorf("String() = %q, want sorted pairs", s)
+	}
+	back, err := ParseLabels(l.String())
+	if err != nil || !maps.Equal(back, l) {
+		t.Errorf("ParseLabels(String()) = %v, %v, want %v", back, err, l)
+	}
+}
+
+func TestLabelsMatch(t *testing.T) {
+	l := Labels{"env": "staging", "service": "api"}
+	tests := []struct {
+		selector Labels
+		want     bool
+	}{
+		{nil, true},
+		{Labels{"env": "staging"}, true},
+		{Labels{"env": "staging", "service": "api"}, true},
+		{Labels{"env": "prod"}, false},
+		{Labels{"team": ""}, false},
+	}
+
+	for _, tt := range tests {
+		if got := l.Match(tt.selector); got != tt.want {
+			t.Errorf("Match(%v) = %v, want %v", tt.selector, got, tt.want)
+		}
+	}
+}
+
+func TestValidateName(t *testing.T) {
+	tests := []struct {
+		name    string
+		wantErr bool
+	}{
+		{"checkout-api", false},
+		{"web.v2", false},
+		{"a", false},
+		{"", true},
+		{"Checkout", true},
+		{"-api", true},
+		{"my api", true},
+		{strings.Repeat("n", 64), true},
+	}
+
+	for _, tt := range tests {
+		if err := ValidateName(tt.name); (err != nil) != tt.wantErr {
+			t.Errorf("ValidateName(%q) error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
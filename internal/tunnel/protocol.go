@@ -4,17 +4,252 @@ package tunnel
 import (
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // Message types for framing
 const (
-	TypeRequest  byte = 0x01
-	TypeResponse byte = 0x02
-	TypeReady    byte = 0x03
+	TypeRequest    byte = 0x01
+	TypeResponse   byte = 0x02
+	TypeReady      byte = 0x03
+	TypePing       byte = 0x04
+	TypePong       byte = 0x05
+	TypeDatagram   byte = 0x06
+	TypeDisconnect byte = 0x07
+	TypeWelcome    byte = 0x08
+	TypeMetadata   byte = 0x09
+	TypeStream     byte = 0x0A
+	TypeError      byte = 0x0B
+	TypeCancel     byte = 0x0C
+	TypeWindow     byte = 0x0D
+	TypeDrain      byte = 0x0E
 )
 
+// VersionHeader carries the protocol version each end speaks on
+// /_lobber/connect: the client's on the request and the relay's on its
+// answer, both repeated in the Ready and Welcome frames. Versions change
+// only for what features can't negotiate, such as the framing itself, so a
+// relay can turn away clients too old to talk to with an error they can
+// show rather than frames they can't read. Ends that don't send it speak
+// version 1.
+const VersionHeader = "X-Lobber-Protocol-Version"
+
+// ProtocolVersion is the version this build speaks. Version 2 adds
+// VersionHeader and skipping frames of unknown types, which version 1
+// relays close the tunnel on. Version 3 adds the binary encoding of
+// requests and responses; see BinaryVersion.
+const ProtocolVersion = 3
+
+// ParseVersion reads a VersionHeader value. Empty is version 1.
+func ParseVersion(v string) (int, error) {
+	if v == "" {
+		return 1, nil
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(v))
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("invalid protocol version %q", v)
+	}
+	return n, nil
+}
+
+// FeaturesHeader lists optional protocol features. On /_lobber/connect the
+// client lists those it speaks, and the relay answers with those it offers
+// the tunnel; clients only use what the answer advertises. Relays roll a
+// change out by offering its feature, and clients too old to list it never
+// see it.
+const FeaturesHeader = "X-Lobber-Features"
+
+// FeatureHeartbeat means the relay answers ping frames with pongs
+const FeatureHeartbeat = "heartbeat"
+
+// FeatureWelcome means the relay sends a Welcome frame straight after its
+// answer to /_lobber/connect. Clients ask for one by listing it in
+// FeaturesHeader on the connect request, so older clients never see it.
+const FeatureWelcome = "welcome"
+
+// FeatureMetadata means the relay accepts a Metadata frame ahead of each
+// response. Older relays close the tunnel on frames they don't know.
+const FeatureMetadata = "metadata"
+
+// FeatureStream means the relay carries upgraded connections, such as
+// WebSockets, as Stream frames. Only clients that list it are sent
+// requests to upgrade.
+const FeatureStream = "stream"
+
+// FeatureEcho means the relay reads the features a client uses from its
+// Ready frame. Older relays refuse a Ready frame with a payload.
+const FeatureEcho = "echo"
+
+// FeatureCancel means the relay sends a Cancel frame when a visitor gives
+// up on a request, and clients that use it forward requests concurrently
+// so they can read one mid-request
+const FeatureCancel = "cancel"
+
+// FeatureWindow means the relay only sends what the client has room for,
+// like HTTP/2 flow control: requests while their cost fits the connection
+// window the client granted in WindowHeader, and each stream's bytes
+// within StreamWindow. The client grants room back with Window frames as
+// it finishes with them, and a relay with no room stops reading from
+// visitors.
+const FeatureWindow = "window"
+
+// FeatureChunked means the relay takes a large response as its head, with
+// Chunked set and no body, followed by the body in Stream frames with the
+// response's ID, the last with Close set. The client sends them within
+// StreamWindow and other frames go out between them, so many responses
+// share the connection at once and one large one doesn't hold up the
+// rest. Clients only use it alongside FeatureWindow.
+const FeatureChunked = "chunked"
+
+// FeatureTrailers means the relay sends a response's Trailers to the
+// visitor after its body, as gRPC needs for its status. Older relays drop
+// them, so clients only send them when it's offered.
+const FeatureTrailers = "trailers"
+
+// FeatureDrain means the relay sends a Drain frame before it restarts.
+// Only clients that list it are sent one; others find the connection
+// closed once the relay has gone.
+const FeatureDrain = "drain"
+
+// FeatureCaller means the relay sends each Request with its Caller, so the
+// local server can see who reached it. Older clients refuse the extra
+// field in binary requests, so only clients that list it are sent one.
+const FeatureCaller = "caller"
+
+// FeatureContinue means the relay sends a request whose visitor waits for
+// 100 Continue before sending its body with Continue set and no body. The
+// body follows in Stream frames with the request's ID, the last with Close
+// set, once the client grants room for it with a Window frame, which it
+// does when the local server asks for the body. Until then the visitor
+// isn't told to send it, so a local server that answers first, say with a
+// 401 or 413, never has it uploaded. Clients only use it alongside
+// FeatureWindow and FeatureCancel, as the body arrives while the request
+// is being forwarded. Large request bodies, and those of unknown length,
+// are sent the same way, so an upload doesn't hold up the other requests
+// on the tunnel in one frame.
+const FeatureContinue = "continue"
+
+// Features are the optional features this build speaks, in the order
+// clients list them
+var Features = []string{FeatureHeartbeat, FeatureWelcome, FeatureMetadata, FeatureEcho, FeatureStream, FeatureGzip, FeatureCancel, FeatureWindow, FeatureChunked, FeatureTrailers, FeatureDrain, FeatureCaller, FeatureContinue}
+
+// ParseFeatures splits a FeaturesHeader value into its features
+func ParseFeatures(v string) []string {
+	var features []string
+	for f := range strings.SplitSeq(v, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			features = append(features, f)
+		}
+	}
+	return features
+}
+
+// ProtocolHeader asks /_lobber/connect for a tunnel other than HTTP:
+// ProtocolUDP or ProtocolTLS
+const ProtocolHeader = "X-Lobber-Protocol"
+
+// ProtocolUDP tunnels datagrams: the relay listens on a UDP port, named by
+// UDPPortHeader in its answer, and frames what arrives there as Datagrams
+const ProtocolUDP = "udp"
+
+// ProtocolTLS tunnels TLS connections unopened: the relay routes those
+// whose SNI names the tunnel's hostname to the client without terminating
+// them, so the certificate and key stay with the local server. Each
+// arrives as a Request with Method CONNECT and Upgrade ProtocolTLS, which
+// the client answers 101 once it has connected to the local server, and
+// then carries on as a stream. It needs FeatureStream.
+const ProtocolTLS = "tls"
+
+// UDPPortHeader carries the public port the relay allocated to a UDP tunnel
+const UDPPortHeader = "X-Lobber-UDP-Port"
+
+// SessionHeader carries the session the relay answers /_lobber/connect
+// with. A client whose connection drops presents it when it connects
+// again to resume the tunnel: the relay holds the hostname for it a while,
+// with visitors' requests waiting, and turns away other clients meanwhile.
+const SessionHeader = "X-Lobber-Session"
+
+// NoIndexHeader set to "true" on /_lobber/connect asks the relay to keep
+// search engines off the tunnel, for throwaway hostnames nobody wants
+// turning up in results. Relays do so for share links regardless.
+const NoIndexHeader = "X-Lobber-Noindex"
+
+// MaxDatagramSize is the largest UDP payload either end forwards
+const MaxDatagramSize = 65507
+
+// MaxFrameSize caps a frame's payload so a corrupt or hostile length prefix
+// can't make the reader allocate gigabytes. It is the default limit, and
+// the one ends that don't send MaxFrameHeader read up to.
+const MaxFrameSize = 64 << 20
+
+// MinFrameSize is the smallest frame limit an end may set, leaving room
+// for handshake and control frames
+const MinFrameSize = 64 << 10
+
+// MaxFrameHeader carries the largest frame payload each end reads, in
+// bytes: the client's on /_lobber/connect and the relay's on its answer.
+// Each end sends nothing larger, turning away what wouldn't fit instead.
+const MaxFrameHeader = "X-Lobber-Max-Frame"
+
+// ParseMaxFrame reads a MaxFrameHeader value. Empty is MaxFrameSize.
+func ParseMaxFrame(v string) (int, error) {
+	if v == "" {
+		return MaxFrameSize, nil
+	}
+	n, err := strconv.ParseUint(strings.TrimSpace(v), 10, 32)
+	if err != nil || n < MinFrameSize {
+		return 0, fmt.Errorf("invalid frame size %q: want %d to %d bytes", v, MinFrameSize, uint32(math.MaxUint32))
+	}
+	return int(n), nil
+}
+
+// MaxStreamChunk is the most of an upgraded connection's bytes either end
+// puts in one Stream frame
+const MaxStreamChunk = 32 << 10
+
+// WindowHeader carries the connection window a client grants on
+// /_lobber/connect: how many bytes of requests, by RequestCost, the relay
+// may have sent it and not had back in Window frames
+const WindowHeader = "X-Lobber-Window"
+
+// DefaultWindow is the connection window clients grant unless told
+// otherwise
+const DefaultWindow = 16 << 20
+
+// StreamWindow is how many bytes of a stream the relay may send before
+// the client grants it more
+const StreamWindow = 256 << 10
+
+// requestOverhead is what RequestCost charges for a request besides its
+// body, standing in for its method, path and headers
+const requestOverhead = 1 << 10
+
+// ParseWindow reads a WindowHeader value
+func ParseWindow(v string) (int64, error) {
+	n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+	if err != nil || n < MinFrameSize {
+		return 0, fmt.Errorf("invalid window %q: want at least %d bytes", v, MinFrameSize)
+	}
+	return n, nil
+}
+
+// RequestCost is what a request with a body of bodySize bytes takes from a
+// connection window of the given size. One costing more than the whole
+// window takes all of it, so it waits for the others rather than forever.
+func RequestCost(bodySize, window int64) int64 {
+	return min(bodySize+requestOverhead, window)
+}
+
+// ErrFrameTooLarge is returned for frames longer than the reader's limit,
+// and by encoders for frames longer than the other end's
+var ErrFrameTooLarge = errors.New("frame too large")
+
 // Request represents an HTTP request to forward through tunnel
 type Request struct {
 	ID      string              `json:"id"`
@@ -22,6 +257,35 @@ type Request struct {
 	Path    string              `json:"path"`
 	Headers map[string][]string `json:"headers"`
 	Body    []byte              `json:"body"`
+
+	// How long the relay had the request before sending it: reading it
+	// from the visitor and waiting for the tunnel
+	RelayTime time.Duration `json:"relay_ns,omitempty"`
+
+	// Upgrade is the protocol the visitor asked to switch to, such as
+	// "websocket". If the local server agrees with a 101, the connection
+	// goes on as a stream of Stream frames with the request's ID.
+	Upgrade string `json:"upgrade,omitempty"`
+
+	// Caller describes the visitor's connection to the relay, for clients
+	// that use FeatureCaller; nil from relays that don't send it
+	Caller *Caller `json:"caller,omitempty"`
+
+	// Continue means the body follows in Stream frames once the client
+	// asks for it, see FeatureContinue; Body is empty
+	Continue bool `json:"continue,omitempty"`
+}
+
+// Caller is how a visitor reached the relay, which the local server would
+// otherwise only see as the lobber client. Clients pass it on as
+// X-Forwarded-For, X-Forwarded-Proto and X-Forwarded-Host.
+type Caller struct {
+	RemoteIP   string `json:"remote_ip"`
+	Scheme     string `json:"scheme"`                // "http" or "https"
+	Host       string `json:"host"`                  // the Host the visitor asked for, port included
+	TLSVersion string `json:"tls_version,omitempty"` // e.g. "TLS 1.3"; empty for plain HTTP
+	ALPN       string `json:"alpn,omitempty"`        // negotiated protocol such as "h2"
+	ServerName string `json:"server_name,omitempty"` // the SNI the visitor sent
 }
 
 // Response represents an HTTP response from the tunnel client
@@ -30,6 +294,152 @@ type Response struct {
 	StatusCode int                 `json:"status_code"`
 	Headers    map[string][]string `json:"headers"`
 	Body       []byte              `json:"body"`
+	Upgrade    string              `json:"upgrade,omitempty"`  // the protocol a 101 switched to
+	Chunked    bool                `json:"chunked,omitempty"`  // the body follows in Stream frames, see FeatureChunked
+	Trailers   map[string][]string `json:"trailers,omitempty"` // sent after the body, see FeatureTrailers
+
+	// Meta is the Metadata frame the client sent ahead of the response,
+	// attached by the relay; nil from clients that don't send one
+	Meta *Metadata `json:"-"`
+}
+
+// Metadata is what the client knows about a response that the visitor
+// doesn't see. It precedes the response with the same ID.
+type Metadata struct {
+	ID            string        `json:"id"`
+	Local         time.Duration `json:"local_ns"`                 // waiting on the local server
+	Client        time.Duration `json:"client_ns"`                // from reading the request frame to writing the response, Local included
+	LocalStatus   int           `json:"local_status,omitempty"`   // the local server's status, before a debug page replaced it; 0 if it wasn't reached
+	LocalError    string        `json:"local_error,omitempty"`    // why the local server wasn't reached
+	ClientVersion string        `json:"client_version,omitempty"` // the lobber client's version
+}
+
+// Datagram is a UDP payload on a UDP tunnel. Session is the remote peer's
+// address as the relay saw it; the client answers on the same session and
+// the relay only sends to peers that have written to it.
+type Datagram struct {
+	Session string `json:"session"`
+	Data    []byte `json:"data"`
+}
+
+// Stream carries bytes of an upgraded connection either way, or of a
+// chunked response's body. ID is the request that opened it; Close means
+// the sender's end has closed and the other should close too.
+type Stream struct {
+	ID    string `json:"id"`
+	Data  []byte `json:"data,omitempty"`
+	Close bool   `json:"close,omitempty"`
+}
+
+// Cancel tells the client the relay has given up on requests, such as
+// when their visitors closed the connection, so it should stop forwarding
+// them and send no response
+type Cancel struct {
+	IDs []string `json:"ids"`
+}
+
+// Window grants the relay room for Bytes more: on the connection when ID
+// is empty, or on the stream with that ID
+type Window struct {
+	ID    string `json:"id,omitempty"`
+	Bytes int64  `json:"bytes"`
+}
+
+// Disconnect asks the client to close its tunnel and stay away until
+// Until, such as when its domain's schedule closes. A zero Until means
+// don't come back on your own.
+type Disconnect struct {
+	Reason string    `json:"reason"`
+	Until  time.Time `json:"until,omitzero"`
+}
+
+// Drain tells the client the relay is about to restart. The client opens a
+// new tunnel, which a load balancer sends to another relay, while this
+// connection finishes the requests and streams it has; the relay keeps
+// forwarding on it until the client closes it, or Deadline passes.
+type Drain struct {
+	Reason   string    `json:"reason"`
+	Deadline time.Time `json:"deadline,omitzero"` // zero if the relay didn't say
+}
+
+// Welcome tells the client what its tunnel was granted, rather than what it
+// asked for
+type Welcome struct {
+	URLs             []string `json:"urls"`                        // where visitors reach the tunnel, e.g. "https://app.mysite.com/"
+	Plan             string   `json:"plan,omitempty"`              // the account's plan; empty for anonymous tunnels
+	Limits           Limits   `json:"limits"`                      // what the relay enforces on the tunnel
+	HeartbeatSeconds int      `json:"heartbeat_seconds,omitempty"` // how often the client should ping; 0 leaves it to the client
+	Features         []string `json:"features,omitempty"`          // as in FeaturesHeader
+	Deprecated       []string `json:"deprecated,omitempty"`        // of Features, those the relay plans to stop offering
+	Version          int      `json:"version,omitempty"`           // the relay's protocol version, as in VersionHeader
+}
+
+// Ready tells the relay the client is ready for requests, and which of the
+// features it was offered it uses
+type Ready struct {
+	Features []string `json:"features,omitempty"`
+	Version  int      `json:"version,omitempty"` // the client's protocol version, as in VersionHeader
+}
+
+// Limits are what the relay enforces on a tunnel. Zero means no limit.
+type Limits struct {
+	MonthlyBytes     int64   `json:"monthly_bytes,omitempty"`     // bandwidth the plan includes each month
+	UsedBytes        int64   `json:"used_bytes,omitempty"`        // bandwidth used so far this month
+	BurstFloor       float64 `json:"burst_floor,omitempty"`       // requests per second always let through in a spike
+	ShareRequests    int     `json:"share_requests,omitempty"`    // requests a one-time share serves before it retires
+	ShareTTLSeconds  int     `json:"share_ttl_seconds,omitempty"` // how long a one-time share lasts
+	RetentionSeconds int     `json:"retention_seconds,omitempty"` // how long the plan keeps captured requests
+}
+
+// Error tells the other end why the sender is about to close the tunnel,
+// such as a frame over its size limit, so it has more to go on than a
+// dropped connection. Ends that don't know the frame skip it.
+type Error struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Error codes
+const (
+	ErrorFrameTooLarge  = "frame_too_large"
+	ErrorMalformedFrame = "malformed_frame"
+	ErrorShutdown       = "shutdown" // the client closed the tunnel on purpose and isn't coming back to resume it
+)
+
+func (e *Error) Error() string {
+	return "tunnel closed by the other end: " + e.Message
+}
+
+// ErrorFor is the Error frame explaining err, a failure reading or
+// decoding a frame, to the end that sent it
+func ErrorFor(err error) *Error {
+	if errors.Is(err, ErrFrameTooLarge) {
+		return &Error{Code: ErrorFrameTooLarge, Message: err.Error()}
+	}
+	return &Error{Code: ErrorMalformedFrame, Message: err.Error()}
+}
+
+// Heartbeat is the payload of a ping and of the pong that echoes it
+type Heartbeat struct {
+	Seq uint64 `json:"seq"`
+}
+
+// Frame is a message read off the wire with its payload still encoded
+type Frame struct {
+	Type    byte
+	Payload []byte
+}
+
+// Decode unmarshals the frame's payload into v, in whichever encoding the
+// sender used
+func (f *Frame) Decode(v any) error {
+	if len(f.Payload) > 0 && f.Payload[0] == binaryMarker {
+		return unmarshalBinary(f.Payload, v)
+	}
+	if err := json.Unmarshal(f.Payload, v); err != nil {
+		return fmt.Errorf("unmarshal: %w", err)
+	}
+	return nil
 }
 
 // EncodeRequest writes a request to the wire
@@ -60,8 +470,76 @@ func DecodeResponse(r io.Reader) (*Response, error) {
 	return &resp, nil
 }
 
-// EncodeReady writes a ready frame to signal client is ready for requests
-func EncodeReady(w io.Writer) error {
+// EncodePing writes a heartbeat the peer answers with a pong
+func EncodePing(w io.Writer, hb *Heartbeat) error {
+	return encodeMessage(w, TypePing, hb)
+}
+
+// EncodePong answers a ping, echoing its heartbeat
+func EncodePong(w io.Writer, hb *Heartbeat) error {
+	return encodeMessage(w, TypePong, hb)
+}
+
+// EncodeDatagram writes a UDP payload to the wire
+func EncodeDatagram(w io.Writer, d *Datagram) error {
+	return encodeMessage(w, TypeDatagram, d)
+}
+
+// EncodeStream writes bytes of an upgraded connection to the wire
+func EncodeStream(w io.Writer, s *Stream) error {
+	return encodeMessage(w, TypeStream, s)
+}
+
+// EncodeCancel writes a cancellation of in-flight requests to the wire
+func EncodeCancel(w io.Writer, c *Cancel) error {
+	return encodeMessage(w, TypeCancel, c)
+}
+
+// EncodeWindow writes a flow control grant to the wire
+func EncodeWindow(w io.Writer, win *Window) error {
+	return encodeMessage(w, TypeWindow, win)
+}
+
+// EncodeDisconnect writes a disconnect notice to the wire
+func EncodeDisconnect(w io.Writer, d *Disconnect) error {
+	return encodeMessage(w, TypeDisconnect, d)
+}
+
+// EncodeDrain writes a drain notice to the wire
+func EncodeDrain(w io.Writer, d *Drain) error {
+	return encodeMessage(w, TypeDrain, d)
+}
+
+// EncodeError writes an error frame to the wire
+func EncodeError(w io.Writer, e *Error) error {
+	return encodeMessage(w, TypeError, e)
+}
+
+// EncodeMetadata writes a response's metadata to the wire
+func EncodeMetadata(w io.Writer, m *Metadata) error {
+	return encodeMessage(w, TypeMetadata, m)
+}
+
+// EncodeWelcome writes the relay's welcome to the wire
+func EncodeWelcome(w io.Writer, wel *Welcome) error {
+	return encodeMessage(w, TypeWelcome, wel)
+}
+
+// DecodeWelcome reads the relay's welcome from the wire
+func DecodeWelcome(r io.Reader) (*Welcome, error) {
+	var wel Welcome
+	if err := decodeMessage(r, TypeWelcome, &wel); err != nil {
+		return nil, err
+	}
+	return &wel, nil
+}
+
+// EncodeReady writes a ready frame to signal client is ready for requests.
+// A nil ready has no payload, as relays without FeatureEcho require.
+func EncodeReady(w io.Writer, ready *Ready) error {
+	if ready != nil {
+		return encodeMessage(w, TypeReady, ready)
+	}
 	// Ready frame: [type:1][length:4=0] (no payload)
 	if err := binary.Write(w, binary.BigEndian, TypeReady); err != nil {
 		return fmt.Errorf("write ready type: %w", err)
@@ -72,24 +550,24 @@ func EncodeReady(w io.Writer) error {
 	return nil
 }
 
-// DecodeReady reads and validates a ready frame
-func DecodeReady(r io.Reader) error {
-	var msgType byte
-	if err := binary.Read(r, binary.BigEndian, &msgType); err != nil {
-		return fmt.Errorf("read ready type: %w", err)
+// DecodeReady reads and validates a ready frame. One without a payload,
+// from a client that doesn't echo its features, lists none.
+func DecodeReady(r io.Reader) (*Ready, error) {
+	f, err := ReadFrame(r)
+	if err != nil {
+		return nil, fmt.Errorf("read ready: %w", err)
 	}
-	if msgType != TypeReady {
-		return fmt.Errorf("unexpected message type: got %d, want %d (ready)", msgType, TypeReady)
+	if f.Type != TypeReady {
+		return nil, unexpectedFrame(f.Type, TypeReady)
 	}
-
-	var length uint32
-	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
-		return fmt.Errorf("read ready length: %w", err)
+	var ready Ready
+	if len(f.Payload) == 0 {
+		return &ready, nil
 	}
-	if length != 0 {
-		return fmt.Errorf("ready frame should have zero length, got %d", length)
+	if err := f.Decode(&ready); err != nil {
+		return nil, fmt.Errorf("read ready: %w", err)
 	}
-	return nil
+	return &ready, nil
 }
 
 // ReadFrameType peeks at the next frame type without consuming payload
@@ -101,14 +579,61 @@ func ReadFrameType(r io.Reader) (byte, error) {
 	return msgType, nil
 }
 
+// Framing is how an end encodes the frames it sends, as agreed with the
+// other end on connect
+type Framing struct {
+	Compress byte // compression for large payloads; CompressNone for none
+	Binary   bool // requests and responses in the binary encoding
+	MaxSize  int  // largest payload the other end reads, as in MaxFrameHeader; 0 for MaxFrameSize
+}
+
+// framingWriter is a writer whose frames are encoded with its Framing
+type framingWriter struct {
+	io.Writer
+	Framing
+}
+
+// Writer wraps w so frames encoded to it use f. The zero Framing, plain
+// JSON frames, returns w.
+func (f Framing) Writer(w io.Writer) io.Writer {
+	if f == (Framing{}) {
+		return w
+	}
+	return &framingWriter{Writer: w, Framing: f}
+}
+
 func encodeMessage(w io.Writer, msgType byte, v any) error {
-	data, err := json.Marshal(v)
-	if err != nil {
-		return fmt.Errorf("marshal: %w", err)
+	var framing Framing
+	if fw, ok := w.(*framingWriter); ok {
+		framing = fw.Framing
+	}
+	var data []byte
+	if framing.Binary {
+		data = marshalBinary(v)
+	}
+	if data == nil {
+		var err error
+		if data, err = json.Marshal(v); err != nil {
+			return fmt.Errorf("marshal: %w", err)
+		}
 	}
 
-	// Frame format: [type:1][length:4][payload:n]
-	if err := binary.Write(w, binary.BigEndian, msgType); err != nil {
+	// Frame format: [type:1][length:4][payload:n], or with compressedBit
+	// set on the type, a flag byte naming the compression after it
+	header := []byte{msgType}
+	if packed := compress(framing.Compress, data); packed != nil {
+		header = []byte{msgType | compressedBit, framing.Compress}
+		data = packed
+	}
+	// Checked before writing anything, so the connection stays usable
+	limit := framing.MaxSize
+	if limit == 0 {
+		limit = MaxFrameSize
+	}
+	if len(data) > limit {
+		return fmt.Errorf("write payload: %w (%d bytes, limit %d)", ErrFrameTooLarge, len(data), limit)
+	}
+	if _, err := w.Write(header); err != nil {
 		return fmt.Errorf("write type: %w", err)
 	}
 	if err := binary.Write(w, binary.BigEndian, uint32(len(data))); err != nil {
@@ -121,28 +646,90 @@ func encodeMessage(w io.Writer, msgType byte, v any) error {
 	return nil
 }
 
+// frameNames name the frame types for errors
+var frameNames = map[byte]string{
+	TypeRequest:    "request",
+	TypeResponse:   "response",
+	TypeReady:      "ready",
+	TypePing:       "ping",
+	TypePong:       "pong",
+	TypeDatagram:   "datagram",
+	TypeDisconnect: "disconnect",
+	TypeWelcome:    "welcome",
+	TypeMetadata:   "metadata",
+	TypeStream:     "stream",
+	TypeError:      "error",
+	TypeCancel:     "cancel",
+	TypeWindow:     "window",
+	TypeDrain:      "drain",
+}
+
+// FrameName names a frame type, or says it's one this build doesn't know
+func FrameName(t byte) string {
+	if name, ok := frameNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown (0x%02x)", t)
+}
+
+// unexpectedFrame explains a frame that arrived in place of want. One of a
+// type this build doesn't know most likely comes from a newer peer.
+func unexpectedFrame(got, want byte) error {
+	if _, ok := frameNames[got]; !ok {
+		return fmt.Errorf("unexpected message type: got %s, want %s; the other end speaks a newer protocol than this build (version %d)", FrameName(got), FrameName(want), ProtocolVersion)
+	}
+	return fmt.Errorf("unexpected message type: got %s, want %s", FrameName(got), FrameName(want))
+}
+
 func decodeMessage(r io.Reader, expectedType byte, v any) error {
+	f, err := ReadFrame(r)
+	if err != nil {
+		return err
+	}
+	if f.Type != expectedType {
+		return unexpectedFrame(f.Type, expectedType)
+	}
+	return f.Decode(v)
+}
+
+// ReadFrame reads the next frame whatever its type, for readers that
+// dispatch on it
+func ReadFrame(r io.Reader) (*Frame, error) {
+	return ReadFrameLimit(r, MaxFrameSize)
+}
+
+// ReadFrameLimit is ReadFrame refusing payloads over limit bytes, before
+// or after decompressing, with ErrFrameTooLarge
+func ReadFrameLimit(r io.Reader, limit int) (*Frame, error) {
 	var msgType byte
 	if err := binary.Read(r, binary.BigEndian, &msgType); err != nil {
-		return fmt.Errorf("read type: %w", err)
+		return nil, fmt.Errorf("read type: %w", err)
 	}
-	if msgType != expectedType {
-		return fmt.Errorf("unexpected message type: got %d, want %d", msgType, expectedType)
+	alg := CompressNone
+	if msgType&compressedBit != 0 {
+		msgType &^= compressedBit
+		if err := binary.Read(r, binary.BigEndian, &alg); err != nil {
+			return nil, fmt.Errorf("read compression: %w", err)
+		}
 	}
 
 	var length uint32
 	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
-		return fmt.Errorf("read length: %w", err)
+		return nil, fmt.Errorf("read length: %w", err)
+	}
+	if uint64(length) > uint64(limit) {
+		return nil, fmt.Errorf("read payload: %w (%d bytes, limit %d)", ErrFrameTooLarge, length, limit)
 	}
 
 	data := make([]byte, length)
 	if _, err := io.ReadFull(r, data); err != nil {
-		return fmt.Errorf("read payload: %w", err)
+		return nil, fmt.Errorf("read payload: %w", err)
 	}
-
-	if err := json.Unmarshal(data, v); err != nil {
-		return fmt.Errorf("unmarshal: %w", err)
+	if alg != CompressNone {
+		var err error
+		if data, err = decompress(alg, data, limit); err != nil {
+			return nil, fmt.Errorf("read payload: %w", err)
+		}
 	}
-
-	return nil
+	return &Frame{Type: msgType, Payload: data}, nil
 }
@@ -3,7 +3,11 @@ package tunnel
 
 import (
 	"bytes"
+	"errors"
+	"slices"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestEncodeDecodeRequest(t *testing.T) {
@@ -64,3 +68,286 @@ func TestEncodeDecodeResponse(t *testing.T) {
 		t.Errorf("StatusCode = %d, want %d", decoded.StatusCode, resp.StatusCode)
 	}
 }
+
+func TestDecodeRejectsOversizedFrame(t *testing.T) {
+	// A response frame header claiming a 4 GiB payload, with nothing behind it
+	frame := []byte{TypeResponse, 0xff, 0xff, 0xff, 0xff}
+	_, err := DecodeResponse(bytes.NewReader(frame))
+	if !errors.Is(err, ErrFrameTooLarge) {
+		t.Errorf("DecodeResponse() error = %v, want ErrFrameTooLarge", err)
+	}
+}
+
+func TestFrameLimits(t *testing.T) {
+	resp := &Response{ID: "req-1", StatusCode: 200, Body: bytes.Repeat([]byte("x"), MinFrameSize)}
+
+	// Writers refuse frames the other end won't read, writing nothing
+	var buf bytes.Buffer
+	err := EncodeResponse(Framing{MaxSize: MinFrameSize}.Writer(&buf), resp)
+	if !errors.Is(err, ErrFrameTooLarge) || buf.Len() != 0 {
+		t.Errorf("EncodeResponse() over the limit = %v with %d bytes written, want ErrFrameTooLarge and nothing", err, buf.Len())
+	}
+
+	// Readers refuse frames over their own limit
+	EncodeResponse(&buf, resp)
+	if _, err := ReadFrameLimit(bytes.NewReader(buf.Bytes()), MinFrameSize); !errors.Is(err, ErrFrameTooLarge) {
+		t.Errorf("ReadFrameLimit() error = %v, want ErrFrameTooLarge", err)
+	}
+	if _, err := ReadFrameLimit(&buf, 2*MinFrameSize); err != nil {
+		t.Errorf("ReadFrameLimit() under the limit error = %v", err)
+	}
+}
+
+func TestParseMaxFrame(t *testing.T) {
+	tests := []struct {
+		header  string
+		want    int
+		wantErr bool
+	}{
+		{"", MaxFrameSize, false},
+		{"1048576", 1 << 20, false},
+		{" 65536 ", MinFrameSize, false},
+		{"1024", 0, true},
+		{"8589934592", 0, true},
+		{"1MB", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseMaxFrame(tt.header)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("ParseMaxFrame(%q) = %d, %v, want %d (error %v)", tt.header, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestEncodeError(t *testing.T) {
+	var buf bytes.Buffer
+	_, readErr := ReadFrameLimit(bytes.NewReader([]byte{TypeResponse, 0, 0x10, 0, 0}), MinFrameSize)
+	if err := EncodeError(&buf, ErrorFor(readErr)); err != nil {
+		t.Fatalf("EncodeError() error = %v", err)
+	}
+	frame, err := ReadFrame(&buf)
+	if err != nil || frame.Type != TypeError {
+		t.Fatalf("ReadFrame() = %v, %v, want an error frame", frame, err)
+	}
+	var e Error
+	if err := frame.Decode(&e); err != nil || e.Code != ErrorFrameTooLarge || !strings.Contains(e.Message, "limit 65536") {
+		t.Errorf("error frame = %+v, %v, want frame_too_large with the limit", e, err)
+	}
+	if got := ErrorFor(errors.New("unmarshal: bad")).Code; got != ErrorMalformedFrame {
+		t.Errorf("ErrorFor(decode error).Code = %q, want %q", got, ErrorMalformedFrame)
+	}
+}
+
+func TestReadFrameDispatch(t *testing.T) {
+	var buf bytes.Buffer
+	if err := EncodePing(&buf, &Heartbeat{Seq: 7}); err != nil {
+		t.Fatalf("encode ping: %v", err)
+	}
+	if err := EncodeResponse(&buf, &Response{ID: "req-1", StatusCode: 204}); err != nil {
+		t.Fatalf("encode response: %v", err)
+	}
+
+	frame, err := ReadFrame(&buf)
+	if err != nil {
+		t.Fatalf("read ping: %v", err)
+	}
+	var hb Heartbeat
+	if frame.Type != TypePing || frame.Decode(&hb) != nil || hb.Seq != 7 {
+		t.Errorf("first frame = type %d seq %d, want ping 7", frame.Type, hb.Seq)
+	}
+
+	// Typed decoders still refuse frames of another type
+	if _, err := DecodeRequest(&buf); err == nil {
+		t.Error("DecodeRequest() read a response frame, want an error")
+	}
+}
+
+func TestEncodeDatagram(t *testing.T) {
+	var buf bytes.Buffer
+	d := &Datagram{Session: "203.0.113.7:5353", Data: []byte{0, 1, 0xff}}
+	if err := EncodeDatagram(&buf, d); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+
+	frame, err := ReadFrame(&buf)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	var got Datagram
+	if frame.Type != TypeDatagram || frame.Decode(&got) != nil {
+		t.Fatalf("frame = type %d, want a datagram", frame.Type)
+	}
+	if got.Session != d.Session || !bytes.Equal(got.Data, d.Data) {
+		t.Errorf("datagram = %+v, want %+v", got, d)
+	}
+}
+
+func TestEncodeDisconnect(t *testing.T) {
+	var buf bytes.Buffer
+	d := &Disconnect{Reason: "outside its schedule", Until: time.Date(2026, 3, 2, 9, 0, 0, 0, time.UTC)}
+	if err := EncodeDisconnect(&buf, d); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+
+	frame, err := ReadFrame(&buf)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	var got Disconnect
+	if frame.Type != TypeDisconnect || frame.Decode(&got) != nil {
+		t.Fatalf("frame = type %d, want a disconnect", frame.Type)
+	}
+	if got.Reason != d.Reason || !got.Until.Equal(d.Until) {
+		t.Errorf("disconnect = %+v, want %+v", got, d)
+	}
+}
+
+func TestEncodeDecodeWelcome(t *testing.T) {
+	var buf bytes.Buffer
+	w := &Welcome{
+		URLs:             []string{"https://app.example.com/"},
+		Plan:             "pro",
+		Limits:           Limits{MonthlyBytes: 100 << 30, UsedBytes: 3 << 30, BurstFloor: 50},
+		HeartbeatSeconds: 10,
+		Features:         []string{FeatureHeartbeat, FeatureWelcome},
+	}
+	if err := EncodeWelcome(&buf, w); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+
+	got, err := DecodeWelcome(&buf)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(got.URLs) != 1 || got.URLs[0] != w.URLs[0] {
+		t.Errorf("URLs = %v, want %v", got.URLs, w.URLs)
+	}
+	if got.Plan != w.Plan || got.Limits != w.Limits || got.HeartbeatSeconds != w.HeartbeatSeconds {
+		t.Errorf("welcome = %+v, want %+v", got, w)
+	}
+	if len(got.Features) != 2 {
+		t.Errorf("Features = %v, want %v", got.Features, w.Features)
+	}
+}
+
+func TestEncodeMetadata(t *testing.T) {
+	var buf bytes.Buffer
+	m := &Metadata{ID: "req-1", Local: 120 * time.Millisecond, Client: 121 * time.Millisecond, LocalStatus: 500, ClientVersion: "0.1.0"}
+	if err := EncodeMetadata(&buf, m); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+
+	frame, err := ReadFrame(&buf)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	var got Metadata
+	if frame.Type != TypeMetadata || frame.Decode(&got) != nil {
+		t.Fatalf("frame = type %d, want metadata", frame.Type)
+	}
+	if got != *m {
+		t.Errorf("metadata = %+v, want %+v", got, *m)
+	}
+}
+
+func TestEncodeDecodeReady(t *testing.T) {
+	tests := []struct {
+		name  string
+		ready *Ready
+		want  []string
+	}{
+		{"without payload", nil, nil},
+		{"echoing features", &Ready{Features: []string{FeatureHeartbeat, FeatureMetadata}}, []string{FeatureHeartbeat, FeatureMetadata}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := EncodeReady(&buf, tt.ready); err != nil {
+				t.Fatalf("encode: %v", err)
+			}
+			if tt.ready == nil && buf.Len() != 5 {
+				t.Errorf("frame is %d bytes, want 5 as older relays expect", buf.Len())
+			}
+			got, err := DecodeReady(&buf)
+			if err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			if !slices.Equal(got.Features, tt.want) {
+				t.Errorf("Features = %v, want %v", got.Features, tt.want)
+			}
+		})
+	}
+
+	var buf bytes.Buffer
+	EncodePing(&buf, &Heartbeat{Seq: 1})
+	if _, err := DecodeReady(&buf); err == nil || !strings.Contains(err.Error(), "got ping, want ready") {
+		t.Errorf("DecodeReady(ping) error = %v, want it to name both frames", err)
+	}
+	// A frame from a newer peer says so, rather than just its number
+	encodeMessage(&buf, 0x7f, &Ready{})
+	if _, err := DecodeReady(&buf); err == nil || !strings.Contains(err.Error(), "newer protocol") {
+		t.Errorf("DecodeReady(unknown frame) error = %v, want it to blame a newer protocol", err)
+	}
+}
+
+func TestParseVersion(t *testing.T) {
+	tests := []struct {
+		header  string
+		want    int
+		wantErr bool
+	}{
+		{"", 1, false},
+		{"2", 2, false},
+		{" 3 ", 3, false},
+		{"0", 0, true},
+		{"v2", 0, true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseVersion(tt.header)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("ParseVersion(%q) = %d, %v, want %d (error %v)", tt.header, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestParseFeatures(t *testing.T) {
+	tests := []struct {
+		header string
+		want   []string
+	}{
+		{"", nil},
+		{"heartbeat", []string{"heartbeat"}},
+		{" welcome , metadata,,echo ", []string{"welcome", "metadata", "echo"}},
+	}
+
+	for _, tt := range tests {
+		if got := ParseFeatures(tt.header); !slices.Equal(got, tt.want) {
+			t.Errorf("ParseFeatures(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestEncodeStream(t *testing.T) {
+	var buf bytes.Buffer
+	EncodeStream(&buf, &Stream{ID: "req-1", Data: []byte("\x81\x05hello")})
+	EncodeStream(&buf, &Stream{ID: "req-1", Close: true})
+
+	var data, closing Stream
+	for _, s := range []*Stream{&data, &closing} {
+		frame, err := ReadFrame(&buf)
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		if frame.Type != TypeStream || frame.Decode(s) != nil {
+			t.Fatalf("frame = type %d, want stream", frame.Type)
+		}
+	}
+	if data.ID != "req-1" || string(data.Data) != "\x81\x05hello" || data.Close {
+		t.Errorf("data = %+v, want the bytes sent", data)
+	}
+	if closing.ID != "req-1" || len(closing.Data) != 0 || !closing.Close {
+		t.Errorf("close = %+v, want an empty closing frame", closing)
+	}
+}
@@ -0,0 +1,111 @@
+// internal/tunnel/quic.go
+package tunnel
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/net/quic"
+)
+
+// TransportQUIC carries the tunnel over a QUIC connection to the relay's
+// HTTPS port, for links where TCP's head-of-line blocking on loss hurts.
+// The connect request and the frames after it travel on the connection's
+// first stream.
+const TransportQUIC = "quic"
+
+// QUICProtocol is the ALPN protocol tunnels are carried over QUIC with
+const QUICProtocol = "lobber"
+
+// quicCloseTimeout bounds waiting for the peer to take the last of the
+// stream when a QUICConn closes
+const quicCloseTimeout = time.Second
+
+// QUICConn is one stream of a QUIC connection as a net.Conn, so frames are
+// encoded on it as on a plain connection. Deadlines become the stream's
+// read and write contexts, so they only apply to reads and writes started
+// after they're set.
+type QUICConn struct {
+	conn    *quic.Conn
+	stream  *quic.Stream
+	onClose func() // after the connection has closed; may be nil
+
+	mu          sync.Mutex // deadlines
+	cancelRead  context.CancelFunc
+	cancelWrite context.CancelFunc
+	closeOnce   sync.Once
+}
+
+// NewQUICConn returns stream as a net.Conn. Closing it closes conn, the
+// connection stream belongs to, and then calls onClose, if set.
+func NewQUICConn(conn *quic.Conn, stream *quic.Stream, onClose func()) *QUICConn {
+	return &QUICConn{conn: conn, stream: stream, onClose: onClose}
+}
+
+func (c *QUICConn) Read(p []byte) (int, error) {
+	return c.stream.Read(p)
+}
+
+// Write sends p without waiting for the stream's buffer to fill, as frames
+// arrive already batched
+func (c *QUICConn) Write(p []byte) (int, error) {
+	n, err := c.stream.Write(p)
+	if err == nil {
+		err = c.stream.Flush()
+	}
+	return n, err
+}
+
+// Close finishes the stream, waiting briefly for the peer to take what's
+// left of it, and closes the connection
+func (c *QUICConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.stream.CloseRead()
+		c.SetWriteDeadline(time.Now().Add(quicCloseTimeout))
+		c.stream.Close()
+		c.conn.Abort(nil)
+		if c.onClose != nil {
+			c.onClose()
+		}
+	})
+	return nil
+}
+
+func (c *QUICConn) LocalAddr() net.Addr  { return net.UDPAddrFromAddrPort(c.conn.LocalAddr()) }
+func (c *QUICConn) RemoteAddr() net.Addr { return net.UDPAddrFromAddrPort(c.conn.RemoteAddr()) }
+
+func (c *QUICConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *QUICConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cancelRead = deadlineContext(c.cancelRead, t, c.stream.SetReadContext)
+	return nil
+}
+
+func (c *QUICConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cancelWrite = deadlineContext(c.cancelWrite, t, c.stream.SetWriteContext)
+	return nil
+}
+
+// deadlineContext hands set a context ending at t, or never for a zero t,
+// after cancelling the one it replaces. It returns the new one's cancel.
+func deadlineContext(cancel context.CancelFunc, t time.Time, set func(context.Context)) context.CancelFunc {
+	if cancel != nil {
+		cancel()
+	}
+	if t.IsZero() {
+		set(context.Background())
+		return nil
+	}
+	ctx, cancel := context.WithDeadline(context.Background(), t)
+	set(ctx)
+	return cancel
+}
@@ -0,0 +1,74 @@
+// internal/tunnel/share.go
+package tunnel
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ShareHeader makes /_lobber/connect open a one-time share, as
+// comma-separated key=value limits such as "max-requests=50, ttl=1h". The
+// relay retires the hostname for good once either limit is reached.
+const ShareHeader = "X-Lobber-Share"
+
+// MaxShareTTL caps how long a one-time share may stay up
+const MaxShareTTL = 7 * 24 * time.Hour
+
+// ShareLimits are when a one-time share retires: after MaxRequests visitor
+// requests or TTL after it first connects, whichever comes first. A zero
+// limit doesn't apply, but a share needs at least one.
+type ShareLimits struct {
+	MaxRequests int
+	TTL         time.Duration
+}
+
+// ParseShareLimits parses the value of ShareHeader
+func ParseShareLimits(s string) (ShareLimits, error) {
+	var l ShareLimits
+	for pair := range strings.SplitSeq(s, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok {
+			return l, fmt.Errorf("share limit %q is not key=value", pair)
+		}
+		var err error
+		switch k {
+		case "max-requests":
+			l.MaxRequests, err = strconv.Atoi(v)
+		case "ttl":
+			l.TTL, err = time.ParseDuration(v)
+		default:
+			return l, fmt.Errorf("unknown share limit %q", k)
+		}
+		if err != nil {
+			return l, fmt.Errorf("invalid %s %q", k, v)
+		}
+	}
+	return l, l.Validate()
+}
+
+// Validate checks that the limits make a share that retires
+func (l ShareLimits) Validate() error {
+	switch {
+	case l.MaxRequests < 0 || l.TTL < 0:
+		return fmt.Errorf("share limits can't be negative")
+	case l.MaxRequests == 0 && l.TTL == 0:
+		return fmt.Errorf("a share needs max-requests, ttl or both")
+	case l.TTL > MaxShareTTL:
+		return fmt.Errorf("share ttl %s is longer than %s", l.TTL, MaxShareTTL)
+	}
+	return nil
+}
+
+// String encodes the limits for ShareHeader
+func (l ShareLimits) String() string {
+	var pairs []string
+	if l.MaxRequests > 0 {
+		pairs = append(pairs, "max-requests="+strconv.Itoa(l.MaxRequests))
+	}
+	if l.TTL > 0 {
+		pairs = append(pairs, "ttl="+l.TTL.String())
+	}
+	return strings.Join(pairs, ",")
+}
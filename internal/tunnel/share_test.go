@@ -0,0 +1,42 @@
+// internal/tunnel/share_test.go
+package tunnel
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseShareLimits(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    ShareLimits
+		wantErr bool
+	}{
+		{"max-requests=50,ttl=1h", ShareLimits{MaxRequests: 50, TTL: time.Hour}, false},
+		{" max-requests=5 ", ShareLimits{MaxRequests: 5}, false},
+		{"ttl=30m", ShareLimits{TTL: 30 * time.Minute}, false},
+		{"", ShareLimits{}, true},
+		{"max-requests=0", ShareLimits{}, true},
+		{"max-requests=-1,ttl=1h", ShareLimits{}, true},
+		{"ttl=forever", ShareLimits{}, true},
+		{"ttl=720h", ShareLimits{}, true},
+		{"views=3", ShareLimits{}, true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseShareLimits(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseShareLimits(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if err == nil && got != tt.want {
+			t.Errorf("ParseShareLimits(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+
+	// Limits survive the header
+	l := ShareLimits{MaxRequests: 50, TTL: 90 * time.Minute}
+	if got, err := ParseShareLimits(l.String()); err != nil || got != l {
+		t.Errorf("ParseShareLimits(%q) = %+v, %v, want %+v", l.String(), got, err, l)
+	}
+}
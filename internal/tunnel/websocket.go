@@ -0,0 +1,232 @@
+// internal/tunnel/websocket.go
+package tunnel
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// TransportParam is the /_lobber/connect query parameter naming how the
+// tunnel is carried. TransportTCP, the default, takes over the connect
+// request's connection as is; TransportWebSocket upgrades it to a
+// WebSocket first, which proxies that cut hijacked connections let through.
+const (
+	TransportParam     = "transport"
+	TransportTCP       = "tcp"
+	TransportWebSocket = "ws"
+)
+
+// websocketGUID is what RFC 6455 has Sec-WebSocket-Accept hash the key with
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket opcodes
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xA
+)
+
+// wsMaxControl is the largest payload a control frame may carry
+const wsMaxControl = 125
+
+// wsCloseTimeout bounds sending the close frame when a WebSocketConn closes
+const wsCloseTimeout = time.Second
+
+// NewWebSocketKey returns a random Sec-WebSocket-Key for an upgrade request
+func NewWebSocketKey() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+// WebSocketAccept is the Sec-WebSocket-Accept a server answers key with
+func WebSocketAccept(key string) string {
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// WebSocketConn carries the tunnel over a WebSocket (RFC 6455) as a byte
+// stream: writes go out as binary messages and reads return their payloads
+// in order, so frames above it are encoded as on a plain connection. Pings
+// are answered and a close frame ends the stream.
+type WebSocketConn struct {
+	net.Conn
+	r      *bufio.Reader // the connection, with anything read past the upgrade
+	client bool          // masks what it sends, as clients must
+
+	// Read side, used by one reader at a time
+	remaining uint64 // unread payload of the current data frame
+	masked    bool
+	mask      [4]byte
+	pos       int // into mask
+
+	wmu       sync.Mutex // one frame at a time
+	closeOnce sync.Once
+}
+
+// NewWebSocketConn returns the stream carried by the WebSocket on conn,
+// once the upgrade has been answered. r reads conn, and may hold bytes
+// already read past the upgrade response. A client masks what it sends.
+func NewWebSocketConn(conn net.Conn, r *bufio.Reader, client bool) *WebSocketConn {
+	return &WebSocketConn{Conn: conn, r: r, client: client}
+}
+
+// Read returns payload from binary messages, answering the control frames
+// it meets on the way
+func (c *WebSocketConn) Read(p []byte) (int, error) {
+	for c.remaining == 0 {
+		if err := c.next(); err != nil {
+			return 0, err
+		}
+	}
+	if uint64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.r.Read(p)
+	c.remaining -= uint64(n)
+	if c.masked {
+		for i := range p[:n] {
+			p[i] ^= c.mask[c.pos]
+			c.pos = (c.pos + 1) & 3
+		}
+	}
+	if errors.Is(err, io.EOF) && c.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// next reads frame headers until one starts data, handling control frames
+func (c *WebSocketConn) next() error {
+	var head [2]byte
+	if _, err := io.ReadFull(c.r, head[:]); err != nil {
+		return err
+	}
+	opcode := head[0] & 0x0f
+	masked := head[1]&0x80 != 0
+	length := uint64(head[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+			return err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+			return err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+		if length>>63 != 0 {
+			return errors.New("websocket: invalid frame length")
+		}
+	}
+	var mask [4]byte
+	if masked {
+		if _, err := io.ReadFull(c.r, mask[:]); err != nil {
+			return err
+		}
+	}
+
+	switch opcode {
+	case wsContinuation, wsBinary:
+		c.remaining, c.masked, c.mask, c.pos = length, masked, mask, 0
+		return nil
+	case wsClose, wsPing, wsPong:
+		if length > wsMaxControl {
+			return fmt.Errorf("websocket: control frame of %d bytes", length)
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(c.r, payload); err != nil {
+			return err
+		}
+		if masked {
+			for i := range payload {
+				payload[i] ^= mask[i&3]
+			}
+		}
+		switch opcode {
+		case wsPing:
+			if err := c.writeFrame(wsPong, payload); err != nil {
+				return err
+			}
+		case wsClose:
+			c.closeOnce.Do(func() { c.writeFrame(wsClose, nil) })
+			return io.EOF
+		}
+		return nil
+	case wsText:
+		return errors.New("websocket: unexpected text message")
+	}
+	return fmt.Errorf("websocket: unknown opcode %#x", opcode)
+}
+
+// Write sends p as one binary message
+func (c *WebSocketConn) Write(p []byte) (int, error) {
+	if err := c.writeFrame(wsBinary, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// writeFrame sends a final frame of opcode carrying payload
+func (c *WebSocketConn) writeFrame(opcode byte, payload []byte) error {
+	frame := make([]byte, 0, 14+len(payload))
+	frame = append(frame, 0x80|opcode)
+	var maskBit byte
+	if c.client {
+		maskBit = 0x80
+	}
+	switch n := len(payload); {
+	case n <= wsMaxControl:
+		frame = append(frame, maskBit|byte(n))
+	case n <= 0xffff:
+		frame = append(frame, maskBit|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+	if c.client {
+		var mask [4]byte
+		if _, err := rand.Read(mask[:]); err != nil {
+			return err
+		}
+		frame = append(frame, mask[:]...)
+		for i, b := range payload {
+			frame = append(frame, b^mask[i&3])
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	_, err := c.Conn.Write(frame)
+	return err
+}
+
+// Close says goodbye with a close frame, if the other end hasn't already,
+// and closes the connection
+func (c *WebSocketConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.Conn.SetWriteDeadline(time.Now().Add(wsCloseTimeout))
+		c.writeFrame(wsClose, nil)
+	})
+	return c.Conn.Close()
+}
@@ -0,0 +1,86 @@
+// internal/tunnel/websocket_test.go
+package tunnel
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestWebSocketAccept(t *testing.T) {
+	// The example from RFC 6455, section 1.3
+	if got, want := WebSocketAccept("dGhlIHNhbXBsZSBub25jZQ=="), "s3pPLMBiTxaQ9kYGzzhZRbK+xOo="; got != want {
+		t.Errorf("WebSocketAccept() = %q, want %q", got, want)
+	}
+}
+
+func TestWebSocketConn(t *testing.T) {
+	a, b := net.Pipe()
+	client := NewWebSocketConn(a, bufio.NewReader(a), true)
+	server := NewWebSocketConn(b, bufio.NewReader(b), false)
+	defer client.Close()
+	defer server.Close()
+
+	// Messages of each length encoding arrive as one stream
+	var sent bytes.Buffer
+	go func() {
+		for _, n := range []int{0, 5, 125, 126, 70_000} {
+			p := bytes.Repeat([]byte{byte(n)}, n)
+			sent.Write(p)
+			if _, err := client.Write(p); err != nil {
+				t.Errorf("Write(%d bytes) error = %v", n, err)
+			}
+		}
+	}()
+	got := make([]byte, 5+125+126+70_000)
+	if _, err := io.ReadFull(server, got); err != nil {
+		t.Fatalf("ReadFull() error = %v", err)
+	}
+	if !bytes.Equal(got, sent.Bytes()) {
+		t.Error("server read different bytes than the client wrote")
+	}
+
+	// Pings are answered with pongs carrying the same payload
+	go func() {
+		b.Write([]byte{0x89, 2, 'h', 'i'})
+		b.Write([]byte{0x82, 2, 'o', 'k'})
+	}()
+	go io.ReadFull(server.r, make([]byte, 4)) // the pong, as the peer sees it
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(client, buf); err != nil || string(buf) != "ok" {
+		t.Errorf("read after ping = %q, %v, want ok", buf, err)
+	}
+}
+
+func TestWebSocketConnErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame []byte
+		want  error
+	}{
+		{"close", []byte{0x88, 0}, io.EOF},
+		{"truncated", []byte{0x82, 10, 'a'}, io.ErrUnexpectedEOF},
+		{"text", []byte{0x81, 1, 'a'}, nil},
+		{"large control", append([]byte{0x89, 126, 0, 200}, make([]byte, 200)...), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := NewWebSocketConn(discardConn{}, bufio.NewReader(bytes.NewReader(tt.frame)), false)
+			var err error
+			for err == nil {
+				_, err = conn.Read(make([]byte, 8))
+			}
+			if tt.want != nil && !errors.Is(err, tt.want) || tt.want == nil && errors.Is(err, io.EOF) {
+				t.Errorf("read error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+// discardConn swallows what's written to it
+type discardConn struct{ net.Conn }
+
+func (discardConn) Write(p []byte) (int, error) { return len(p), nil }
@@ -0,0 +1,140 @@
+// plugin/plugin.go
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/lobber-dev/lobber/internal/store"
+)
+
+// Plugin extends the relay without forking it. A plugin package registers
+// itself from init, and a relay binary built with a blank import of it
+// (see cmd/relay/plugins.go) picks it up. A plugin implements one or more
+// of Interceptor, AuthProvider and StorageBackend.
+type Plugin interface {
+	// Name identifies the plugin in logs; it must be unique
+	Name() string
+}
+
+// Tunnel describes the tunnel a request is for
+type Tunnel struct {
+	Hostname string
+	UserID   string
+	Name     string            // stable tunnel name; empty if unnamed
+	Labels   map[string]string // set by the client, e.g. env=staging
+}
+
+// Interceptor sees every visitor request before it's proxied, such as a
+// company SSO check in front of internal tunnels
+type Interceptor interface {
+	Plugin
+	// Intercept returns true to let the request through, after changing
+	// its headers if it likes. Returning false means the interceptor has
+	// written the response itself, e.g. a redirect to a login page.
+	Intercept(w http.ResponseWriter, r *http.Request, t Tunnel) bool
+}
+
+// ErrUnknownToken is returned by an AuthProvider for tokens it doesn't
+// issue, so the next provider, and then the relay's own API tokens, get a
+// look
+var ErrUnknownToken = errors.New("unknown token")
+
+// AuthProvider authenticates the tokens tunnels connect with
+type AuthProvider interface {
+	Plugin
+	// Authenticate returns the ID of the user token belongs to. Any error
+	// but ErrUnknownToken rejects the tunnel.
+	Authenticate(ctx context.Context, token string) (userID string, err error)
+}
+
+// StorageBackend keeps the relay's users, domains, tokens and usage
+// somewhere other than Postgres
+type StorageBackend interface {
+	Plugin
+	// Scheme is the URL scheme of the relay's STORE_URL that selects this
+	// backend, such as "dynamodb"
+	Scheme() string
+	// Open connects to the store at url
+	Open(ctx context.Context, url string) (Store, error)
+}
+
+// Store is everything the relay keeps, as a StorageBackend must provide it.
+// The record types it uses are aliased below so plugins outside this
+// module can name them.
+type Store = store.All
+
+type (
+	User          = store.User
+	Domain        = store.Domain
+	DomainGrant   = store.DomainGrant
+	RequestLog    = store.RequestLog
+	Latency       = store.Latency
+	ClientStats   = store.ClientStats
+	Preferences   = store.Preferences
+	TunnelSession = store.TunnelSession
+	TunnelHistory = store.TunnelHistory
+	Identity      = store.Identity
+	APIToken      = store.APIToken
+	AuditEntry    = store.AuditEntry
+	HealthCheck   = store.HealthCheck
+	RelayHealth   = store.RelayHealth
+	UptimeDay     = store.UptimeDay
+	Incident      = store.Incident
+	DomainTraffic = store.DomainTraffic
+	AbuseReport   = store.AbuseReport
+	UsageAlert    = store.UsageAlert
+	DueAlert      = store.DueAlert
+	Event         = store.Event
+	Export        = store.Export
+	UsageDay      = store.UsageDay
+)
+
+// Errors a Store returns, which the relay tells apart
+var (
+	ErrNotFound     = store.ErrNotFound
+	ErrDomainTaken  = store.ErrDomainTaken
+	ErrEmailTaken   = store.ErrEmailTaken
+	ErrLastIdentity = store.ErrLastIdentity
+)
+
+var (
+	mu         sync.RWMutex
+	registered []Plugin
+)
+
+// Register adds a plugin to the relay. It panics on a nil plugin or a
+// duplicate name, as both are mistakes in the build.
+func Register(p Plugin) {
+	if p == nil {
+		panic("plugin: Register of nil plugin")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for _, r := range registered {
+		if r.Name() == p.Name() {
+			panic(fmt.Sprintf("plugin: Register called twice for %s", p.Name()))
+		}
+	}
+	registered = append(registered, p)
+}
+
+// Registered returns the registered plugins in registration order
+func Registered() []Plugin {
+	mu.RLock()
+	defer mu.RUnlock()
+	return append([]Plugin(nil), registered...)
+}
+
+// StorageBackendFor returns the plugin in ps that stores under scheme
+func StorageBackendFor(ps []Plugin, scheme string) (StorageBackend, bool) {
+	for _, p := range ps {
+		if b, ok := p.(StorageBackend); ok && b.Scheme() == scheme {
+			return b, true
+		}
+	}
+	return nil, false
+}
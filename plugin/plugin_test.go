@@ -0,0 +1,44 @@
+// plugin/plugin_test.go
+package plugin
+
+import (
+	"context"
+	"testing"
+)
+
+type named string
+
+func (n named) Name() string { return string(n) }
+
+type backend struct{ named }
+
+func (b backend) Scheme() string { return "mem" }
+
+func (b backend) Open(ctx context.Context, url string) (Store, error) { return nil, nil }
+
+func TestRegister(t *testing.T) {
+	Register(named("test-first"))
+	Register(backend{named("test-store")})
+
+	got := Registered()
+	if len(got) < 2 || got[len(got)-2].Name() != "test-first" || got[len(got)-1].Name() != "test-store" {
+		t.Fatalf("Registered() = %v, want plugins in registration order", got)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Register() of a duplicate name didn't panic")
+		}
+	}()
+	Register(named("test-first"))
+}
+
+func TestStorageBackendFor(t *testing.T) {
+	ps := []Plugin{named("sso"), backend{named("memstore")}}
+	if b, ok := StorageBackendFor(ps, "mem"); !ok || b.Name() != "memstore" {
+		t.Errorf("StorageBackendFor(mem) = %v, %v, want memstore", b, ok)
+	}
+	if _, ok := StorageBackendFor(ps, "postgres"); ok {
+		t.Error("StorageBackendFor(postgres) found a backend")
+	}
+}
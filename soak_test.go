@@ -0,0 +1,128 @@
+// soak_test.go
+package integration_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lobber-dev/lobber/internal/relay"
+	"github.com/lobber-dev/lobber/internal/testsupport"
+)
+
+// soakEnv sets how long TestSoak churns tunnels through the relay; it's
+// skipped unless set, as it runs for as long as it's given:
+//
+//	LOBBER_SOAK=30m go test -run TestSoak -timeout 0 .
+//
+// HEAP_PROFILE_DIR keeps the watchdog's heap profiles if it reports a leak.
+const soakEnv = "LOBBER_SOAK"
+
+// soakWorkers is how many tunnels connect and disconnect at once, each
+// carrying soakRequests requests in between
+const (
+	soakWorkers  = 8
+	soakRequests = 5
+)
+
+func TestSoak(t *testing.T) {
+	v := os.Getenv(soakEnv)
+	if v == "" {
+		t.Skipf("%s not set; set it to how long to soak the relay, e.g. 30m", soakEnv)
+	}
+	duration, err := time.ParseDuration(v)
+	if err != nil || duration <= 0 {
+		t.Fatalf("%s: invalid duration %q", soakEnv, v)
+	}
+
+	config := relay.DefaultServerConfig()
+	config.AdminToken = "admin"
+	// Every cycle connects again from the same address
+	config.ConnectIPLimit.MaxFailures = 0
+	config.WatchdogInterval = time.Second
+	config.HeapProfileDir = os.Getenv("HEAP_PROFILE_DIR")
+	r := testsupport.StartRelay(t, config, nil)
+	app := localApp(t, "soaked")
+	baseline := runtime.NumGoroutine()
+
+	// Connect, proxy a few requests and disconnect, over and over
+	deadline := time.Now().Add(duration)
+	var cycles atomic.Int64
+	var wg sync.WaitGroup
+	for w := range soakWorkers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			domain := fmt.Sprintf("soak-%d.example.com", w)
+			for time.Now().Before(deadline) {
+				tun, err := r.ConnectWithToken(domain, app, r.Token)
+				if err != nil {
+					t.Errorf("cycle %d: connect %s: %v", cycles.Load(), domain, err)
+					return
+				}
+				for range soakRequests {
+					resp, err := r.TryGet(domain, "/")
+					if err != nil {
+						t.Errorf("GET %s: %v", domain, err)
+						break
+					}
+					io.Copy(io.Discard, resp.Body)
+					resp.Body.Close()
+					if resp.StatusCode != http.StatusOK {
+						t.Errorf("GET %s: status %d, want 200", domain, resp.StatusCode)
+					}
+				}
+				if err := tun.Close(); err != nil {
+					t.Errorf("close %s: %v", domain, err)
+					return
+				}
+				cycles.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if t.Failed() {
+		return
+	}
+
+	// Everything the churn started winds down once it stops
+	r.HTTPClient.CloseIdleConnections()
+	settle := time.Now().Add(10 * time.Second)
+	for runtime.NumGoroutine() > baseline && time.Now().Before(settle) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > baseline {
+		buf := make([]byte, 1<<20)
+		t.Errorf("%d goroutines after %d cycles, want at most %d as before them:\n%s",
+			n, cycles.Load(), baseline, buf[:runtime.Stack(buf, true)])
+	}
+
+	req, _ := http.NewRequest("GET", r.URL+"/_lobber/admin/memory", nil)
+	req.Header.Set("Authorization", "Bearer admin")
+	resp, err := r.HTTPClient.Do(req)
+	if err != nil {
+		t.Fatalf("admin memory: %v", err)
+	}
+	defer resp.Body.Close()
+	var samples []relay.MemorySample
+	if err := json.NewDecoder(resp.Body).Decode(&samples); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(samples) == 0 {
+		t.Fatal("the watchdog took no samples")
+	}
+	for _, s := range samples {
+		if len(s.Anomalies) > 0 {
+			t.Errorf("watchdog at %s: %v", s.Time.Format(time.TimeOnly), s.Anomalies)
+		}
+	}
+	t.Logf("%d cycles in %s; latest sample: %d tunnels, %dMB heap, %dMB RSS, %d goroutines",
+		cycles.Load(), duration, samples[0].Tunnels, samples[0].Heap>>20, samples[0].RSS>>20, samples[0].Goroutines)
+}
@@ -0,0 +1,489 @@
+// web/admin/admin.go
+package admin
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"embed"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lobber-dev/lobber/internal/billing"
+	"github.com/lobber-dev/lobber/internal/ratelimit"
+	"github.com/lobber-dev/lobber/internal/store"
+	"github.com/lobber-dev/lobber/web/dashboard"
+	"github.com/lobber-dev/lobber/web/static"
+)
+
+//go:embed templates/*.html
+var content embed.FS
+
+const (
+	// sessionCookie holds the operator's signed login, separate from user sessions
+	sessionCookie = "lobber_admin"
+	sessionTTL    = 12 * time.Hour
+
+	// maxOperatorName bounds the name operators log in with
+	maxOperatorName = 100
+
+	// topDomainsLimit is how many domains the overview ranks
+	topDomainsLimit = 20
+)
+
+// API is the operator API the UI is built on. The relay implements it and
+// serves the same methods as JSON under /_lobber/admin/.
+type API interface {
+	Overview(ctx context.Context) (*Overview, error)
+	TopDomains(ctx context.Context, limit int) ([]store.DomainTraffic, error)
+	AbuseReports(ctx context.Context, includeResolved bool) ([]store.AbuseReport, error)
+	ResolveAbuseReport(ctx context.Context, id, resolution string) error
+	SearchUsers(ctx context.Context, query string) ([]UserSummary, error)
+	// SetPlanOverride pins a user's plan; an empty plan removes the pin
+	SetPlanOverride(ctx context.Context, userID, plan string) error
+	// Impersonate opens a read-only dashboard session as the user and records
+	// who opened it and why in the user's audit log
+	Impersonate(ctx context.Context, userID, operator, reason string) (*Impersonation, error)
+}
+
+// ImpersonationTTL is how long a support session lasts
+const ImpersonationTTL = 30 * time.Minute
+
+// Impersonation is a support session token for the user's dashboard
+type Impersonation struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// ErrInvalidPlan is returned by SetPlanOverride for an unknown plan
+var ErrInvalidPlan = errors.New("unknown plan")
+
+// Overview is the fleet at a glance
+type Overview struct {
+	Tunnels          int            `json:"tunnels"` // connected across every relay
+	Relays           []RelayTunnels `json:"relays"`
+	UsersByPlan      map[string]int `json:"users_by_plan"`
+	OpenAbuseReports int            `json:"open_abuse_reports"`
+}
+
+// RelayTunnels is one relay's latest health check and tunnel count
+type RelayTunnels struct {
+	ID         string    `json:"id"`
+	Region     string    `json:"region,omitempty"`
+	Tunnels    int       `json:"tunnels"`
+	OK         bool      `json:"ok"`
+	Detail     string    `json:"detail,omitempty"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+}
+
+// UserSummary is what operators see about a user
+type UserSummary struct {
+	ID               string     `json:"id"`
+	Email            string     `json:"email"`
+	Name             string     `json:"name,omitempty"`
+	Plan             string     `json:"plan"`
+	PlanOverride     bool       `json:"plan_override"`
+	StripeCustomerID string     `json:"stripe_customer_id,omitempty"`
+	TrialEndsAt      *time.Time `json:"trial_ends_at,omitempty"`
+}
+
+// Plans are the plans an operator can pin
+var Plans = []string{string(billing.PlanFree), string(billing.PlanPAYG), string(billing.PlanPro), string(billing.PlanTeam)}
+
+// Handler serves the operator UI under a path prefix, e.g. /_lobber/admin/ui
+type Handler struct {
+	api       API
+	token     string
+	prefix    string
+	templates map[string]*template.Template
+	mux       *http.ServeMux
+	limiter   *ratelimit.Limiter
+	now       func() time.Time
+}
+
+// NewHandler creates the operator UI. Operators log in with the admin token;
+// the UI never accepts dashboard user sessions.
+func NewHandler(api API, adminToken, prefix string) (*Handler, error) {
+	if adminToken == "" {
+		return nil, fmt.Errorf("admin UI requires an admin token")
+	}
+	assets, err := static.New("/static/")
+	if err != nil {
+		return nil, err
+	}
+
+	h := &Handler{
+		api:    api,
+		token:  adminToken,
+		prefix: "/" + strings.Trim(prefix, "/"),
+		mux:    http.NewServeMux(),
+		now:    time.Now,
+	}
+
+	h.templates, err = parseTemplates(template.FuncMap{
+		"asset":       assets.Path,
+		"prefix":      func() string { return h.prefix },
+		"formatBytes": formatBytes,
+		"formatTime":  func(t time.Time) string { return t.Format("Jan 2, 15:04") },
+		"plans":       func() []string { return Plans },
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	h.mux.HandleFunc("GET "+h.prefix+"/{$}", h.requireOperator(h.handleOverview))
+	h.mux.HandleFunc("GET "+h.prefix+"/login", h.handleLoginForm)
+	h.mux.HandleFunc("POST "+h.prefix+"/login", h.handleLogin)
+	h.mux.HandleFunc("POST "+h.prefix+"/logout", h.handleLogout)
+	h.mux.HandleFunc("GET "+h.prefix+"/abuse", h.requireOperator(h.handleAbuse))
+	h.mux.HandleFunc("POST "+h.prefix+"/abuse/{id}/resolve", h.requireOperator(h.handleResolveAbuse))
+	h.mux.HandleFunc("GET "+h.prefix+"/users", h.requireOperator(h.handleUsers))
+	h.mux.HandleFunc("POST "+h.prefix+"/users/{id}/plan", h.requireOperator(h.handleSetPlan))
+	h.mux.HandleFunc("POST "+h.prefix+"/users/{id}/impersonate", h.requireOperator(h.handleImpersonate))
+
+	return h, nil
+}
+
+// SetLoginLimiter locks out client IPs that keep entering the wrong admin token
+func (h *Handler) SetLoginLimiter(l *ratelimit.Limiter) {
+	h.limiter = l
+}
+
+// ServeHTTP implements http.Handler
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+// parseTemplates builds one set per page on top of the shared layout
+func parseTemplates(funcs template.FuncMap) (map[string]*template.Template, error) {
+	base, err := template.New("").Funcs(funcs).ParseFS(content, "templates/layout.html")
+	if err != nil {
+		return nil, fmt.Errorf("parse layout: %w", err)
+	}
+	pages, err := fs.Glob(content, "templates/*.html")
+	if err != nil {
+		return nil, err
+	}
+
+	sets := make(map[string]*template.Template)
+	for _, page := range pages {
+		name := path.Base(page)
+		if name == "layout.html" {
+			continue
+		}
+		set, err := base.Clone()
+		if err != nil {
+			return nil, err
+		}
+		if sets[name], err = set.ParseFS(content, page); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", name, err)
+		}
+	}
+	return sets, nil
+}
+
+// render executes a page into a buffer so template errors don't send half a page
+func (h *Handler) render(w http.ResponseWriter, status int, name string, data map[string]any) {
+	tmpl, ok := h.templates[name]
+	if !ok {
+		log.Printf("admin: unknown template %q", name)
+		http.Error(w, "template error", http.StatusInternalServerError)
+		return
+	}
+	var buf bytes.Buffer
+	if err := tmpl.ExecuteTemplate(&buf, name, data); err != nil {
+		log.Printf("admin: render %s: %v", name, err)
+		http.Error(w, "template error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	buf.WriteTo(w)
+}
+
+// sign returns the session signature for an operator and expiry time
+func (h *Handler) sign(operator string, expires int64) string {
+	mac := hmac.New(sha256.New, []byte(h.token))
+	fmt.Fprintf(mac, "admin-ui:%s:%d", operator, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// sessionValue encodes a signed session as operator.expires.signature
+func (h *Handler) sessionValue(operator string, expires int64) string {
+	return fmt.Sprintf("%s.%d.%s", base64.RawURLEncoding.EncodeToString([]byte(operator)), expires, h.sign(operator, expires))
+}
+
+// sessionOperator returns who is logged in from the signed session cookie.
+// Rotating the admin token logs every operator out.
+func (h *Handler) sessionOperator(r *http.Request) (string, bool) {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return "", false
+	}
+	parts := strings.Split(cookie.Value, ".")
+	if len(parts) != 3 {
+		return "", false
+	}
+	operator, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", false
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || h.now().Unix() > expires {
+		return "", false
+	}
+	if !hmac.Equal([]byte(parts[2]), []byte(h.sign(string(operator), expires))) {
+		return "", false
+	}
+	return string(operator), true
+}
+
+type contextKey string
+
+const operatorContextKey contextKey = "operator"
+
+// requireOperator sends requests without an operator session to the login form
+func (h *Handler) requireOperator(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		operator, ok := h.sessionOperator(r)
+		if !ok {
+			http.Redirect(w, r, h.prefix+"/login", http.StatusSeeOther)
+			return
+		}
+		ctx := context.WithValue(r.Context(), operatorContextKey, operator)
+		next(w, r.WithContext(ctx))
+	}
+}
+
+// operator returns the logged-in operator set by requireOperator
+func operator(r *http.Request) string {
+	name, _ := r.Context().Value(operatorContextKey).(string)
+	return name
+}
+
+// handleLoginForm asks for the admin token
+func (h *Handler) handleLoginForm(w http.ResponseWriter, r *http.Request) {
+	h.render(w, http.StatusOK, "login.html", map[string]any{"Title": "Operator login"})
+}
+
+// handleLogin exchanges the admin token for a signed session cookie. The
+// token is shared, so operators also say who they are for the audit trail.
+func (h *Handler) handleLogin(w http.ResponseWriter, r *http.Request) {
+	operator := strings.TrimSpace(r.PostFormValue("operator"))
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if wait := h.limiter.Locked(r.Context(), ip); wait > 0 {
+		w.Header().Set("Retry-After", ratelimit.RetryAfter(wait))
+		h.render(w, http.StatusTooManyRequests, "login.html", map[string]any{
+			"Title":    "Operator login",
+			"Operator": operator,
+			"Error":    fmt.Sprintf("Too many failed attempts. Try again in %s.", wait.Round(time.Second)),
+		})
+		return
+	}
+
+	token := r.PostFormValue("token")
+	if token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(h.token)) != 1 {
+		log.Printf("admin: failed operator login from %s", ip)
+		if h.limiter.Fail(r.Context(), ip) {
+			log.Printf("admin: locked out %s after repeated failed logins", ip)
+		}
+		h.render(w, http.StatusUnauthorized, "login.html", map[string]any{"Title": "Operator login", "Operator": operator, "Error": "That token is not valid."})
+		return
+	}
+	h.limiter.Succeed(r.Context(), ip)
+	if operator == "" || len(operator) > maxOperatorName {
+		h.render(w, http.StatusBadRequest, "login.html", map[string]any{"Title": "Operator login", "Error": "Enter your name or email."})
+		return
+	}
+	log.Printf("admin: %s logged in from %s", operator, r.RemoteAddr)
+
+	expires := h.now().Add(sessionTTL).Unix()
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    h.sessionValue(operator, expires),
+		Path:     h.prefix,
+		MaxAge:   int(sessionTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	http.Redirect(w, r, h.prefix+"/", http.StatusSeeOther)
+}
+
+// handleLogout clears the operator session
+func (h *Handler) handleLogout(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    "",
+		Path:     h.prefix,
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	http.Redirect(w, r, h.prefix+"/login", http.StatusSeeOther)
+}
+
+// handleOverview shows tunnel counts per relay, users per plan and the top domains
+func (h *Handler) handleOverview(w http.ResponseWriter, r *http.Request) {
+	overview, err := h.api.Overview(r.Context())
+	if err != nil {
+		h.apiError(w, "overview", err)
+		return
+	}
+	domains, err := h.api.TopDomains(r.Context(), topDomainsLimit)
+	if err != nil {
+		h.apiError(w, "top domains", err)
+		return
+	}
+
+	h.render(w, http.StatusOK, "overview.html", map[string]any{
+		"Title":      "Overview",
+		"Page":       "overview",
+		"Operator":   operator(r),
+		"Overview":   overview,
+		"TopDomains": domains,
+	})
+}
+
+// handleAbuse lists open abuse reports, or all of them with ?all=1
+func (h *Handler) handleAbuse(w http.ResponseWriter, r *http.Request) {
+	all := r.URL.Query().Get("all") == "1"
+	reports, err := h.api.AbuseReports(r.Context(), all)
+	if err != nil {
+		h.apiError(w, "abuse reports", err)
+		return
+	}
+
+	h.render(w, http.StatusOK, "abuse.html", map[string]any{
+		"Title":    "Abuse reports",
+		"Page":     "abuse",
+		"Operator": operator(r),
+		"Reports":  reports,
+		"All":      all,
+	})
+}
+
+// handleResolveAbuse closes a report with a note on the action taken
+func (h *Handler) handleResolveAbuse(w http.ResponseWriter, r *http.Request) {
+	resolution := strings.TrimSpace(r.PostFormValue("resolution"))
+	if resolution == "" {
+		http.Error(w, "describe what was done", http.StatusBadRequest)
+		return
+	}
+
+	err := h.api.ResolveAbuseReport(r.Context(), r.PathValue("id"), resolution)
+	if errors.Is(err, store.ErrNotFound) {
+		http.Error(w, "report not found or already resolved", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		h.apiError(w, "resolve abuse report", err)
+		return
+	}
+	http.Redirect(w, r, h.prefix+"/abuse", http.StatusSeeOther)
+}
+
+// handleUsers searches users by ID or email
+func (h *Handler) handleUsers(w http.ResponseWriter, r *http.Request) {
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	var users []UserSummary
+	if query != "" {
+		var err error
+		if users, err = h.api.SearchUsers(r.Context(), query); err != nil {
+			h.apiError(w, "search users", err)
+			return
+		}
+	}
+
+	h.render(w, http.StatusOK, "users.html", map[string]any{
+		"Title":    "Users",
+		"Page":     "users",
+		"Operator": operator(r),
+		"Query":    query,
+		"Users":    users,
+	})
+}
+
+// handleSetPlan pins a user's plan, or removes the pin when plan is empty
+func (h *Handler) handleSetPlan(w http.ResponseWriter, r *http.Request) {
+	err := h.api.SetPlanOverride(r.Context(), r.PathValue("id"), r.PostFormValue("plan"))
+	switch {
+	case errors.Is(err, ErrInvalidPlan):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case errors.Is(err, store.ErrNotFound):
+		http.Error(w, "user not found", http.StatusNotFound)
+		return
+	case err != nil:
+		h.apiError(w, "set plan", err)
+		return
+	}
+	http.Redirect(w, r, h.prefix+"/users?"+url.Values{"q": {r.PostFormValue("q")}}.Encode(), http.StatusSeeOther)
+}
+
+// handleImpersonate opens the user's dashboard in a read-only support session.
+// The session replaces any dashboard session the operator's browser had.
+func (h *Handler) handleImpersonate(w http.ResponseWriter, r *http.Request) {
+	reason := strings.TrimSpace(r.PostFormValue("reason"))
+	if reason == "" {
+		http.Error(w, "say why you need to see this account, e.g. a ticket number", http.StatusBadRequest)
+		return
+	}
+
+	session, err := h.api.Impersonate(r.Context(), r.PathValue("id"), operator(r), reason)
+	if errors.Is(err, store.ErrNotFound) {
+		http.Error(w, "user not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		h.apiError(w, "impersonate", err)
+		return
+	}
+
+	dashboard.SetSessionCookie(w, session.Token, session.ExpiresAt)
+	http.Redirect(w, r, "/dashboard", http.StatusSeeOther)
+}
+
+// apiError logs a failed API call and shows a generic error
+func (h *Handler) apiError(w http.ResponseWriter, what string, err error) {
+	log.Printf("admin: %s: %v", what, err)
+	http.Error(w, what+" unavailable", http.StatusInternalServerError)
+}
+
+// formatBytes formats byte counts for humans
+func formatBytes(bytes int64) string {
+	const (
+		KB = 1024
+		MB = KB * 1024
+		GB = MB * 1024
+	)
+	switch {
+	case bytes >= GB:
+		return fmt.Sprintf("%.2f GB", float64(bytes)/GB)
+	case bytes >= MB:
+		return fmt.Sprintf("%.2f MB", float64(bytes)/MB)
+	case bytes >= KB:
+		return fmt.Sprintf("%.2f KB", float64(bytes)/KB)
+	default:
+		return fmt.Sprintf("%d B", bytes)
+	}
+}
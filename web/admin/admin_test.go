@@ -0,0 +1,268 @@
+// web/admin/admin_test.go
+package admin
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lobber-dev/lobber/internal/ratelimit"
+	"github.com/lobber-dev/lobber/internal/store"
+)
+
+// fakeAPI serves canned answers and records plan changes and support sessions
+type fakeAPI struct {
+	plans         map[string]string
+	impersonation string
+}
+
+func (f *fakeAPI) Overview(ctx context.Context) (*Overview, error) {
+	return &Overview{
+		Tunnels:          7,
+		Relays:           []RelayTunnels{{ID: "us-1", Tunnels: 7, OK: true, LastSeenAt: time.Now()}},
+		UsersByPlan:      map[string]int{"free": 40, "pro": 2},
+		OpenAbuseReports: 1,
+	}, nil
+}
+
+func (f *fakeAPI) TopDomains(ctx context.Context, limit int) ([]store.DomainTraffic, error) {
+	return []store.DomainTraffic{{Hostname: "busy.lobber.dev", UserID: "u1", UserEmail: "ada@example.com", TotalBytes: 3 << 30, Requests: 900}}, nil
+}
+
+func (f *fakeAPI) AbuseReports(ctx context.Context, includeResolved bool) ([]store.AbuseReport, error) {
+	return []store.AbuseReport{{ID: "abuse_1", Hostname: "phish.lobber.dev", Reason: "phishing", CreatedAt: time.Now()}}, nil
+}
+
+func (f *fakeAPI) ResolveAbuseReport(ctx context.Context, id, resolution string) error {
+	if id != "abuse_1" {
+		return store.ErrNotFound
+	}
+	return nil
+}
+
+func (f *fakeAPI) SearchUsers(ctx context.Context, query string) ([]UserSummary, error) {
+	return []UserSummary{{ID: "u1", Email: "ada@example.com", Plan: "free"}}, nil
+}
+
+func (f *fakeAPI) SetPlanOverride(ctx context.Context, userID, plan string) error {
+	if plan == "platinum" {
+		return fmt.Errorf("%w %q", ErrInvalidPlan, plan)
+	}
+	f.plans[userID] = plan
+	return nil
+}
+
+func (f *fakeAPI) Impersonate(ctx context.Context, userID, operator, reason string) (*Impersonation, error) {
+	if userID != "u1" {
+		return nil, store.ErrNotFound
+	}
+	f.impersonation = operator + ": " + reason
+	return &Impersonation{Token: "support-token", ExpiresAt: time.Now().Add(ImpersonationTTL)}, nil
+}
+
+func newTestHandler(t *testing.T) (*Handler, *fakeAPI) {
+	t.Helper()
+	api := &fakeAPI{plans: make(map[string]string)}
+	h, err := NewHandler(api, "secret", "/_lobber/admin/ui")
+	if err != nil {
+		t.Fatalf("NewHandler() error = %v", err)
+	}
+	return h, api
+}
+
+// login posts the admin token and returns the session cookie
+func login(t *testing.T, h *Handler, token string) (*httptest.ResponseRecorder, *http.Cookie) {
+	t.Helper()
+	form := url.Values{"operator": {"grace@lobber.dev"}, "token": {token}}
+	req := httptest.NewRequest("POST", "/_lobber/admin/ui/login", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == sessionCookie {
+			return rec, c
+		}
+	}
+	return rec, nil
+}
+
+func TestNewHandlerRequiresToken(t *testing.T) {
+	if _, err := NewHandler(&fakeAPI{}, "", "/admin"); err == nil {
+		t.Error("NewHandler() without a token succeeded")
+	}
+}
+
+func TestLogin(t *testing.T) {
+	h, _ := newTestHandler(t)
+
+	rec, cookie := login(t, h, "wrong")
+	if rec.Code != http.StatusUnauthorized || cookie != nil {
+		t.Errorf("wrong token: status = %d, cookie = %v, want 401 without a cookie", rec.Code, cookie)
+	}
+
+	rec, cookie = login(t, h, "secret")
+	if rec.Code != http.StatusSeeOther || cookie == nil {
+		t.Fatalf("login: status = %d, cookie = %v, want 303 with a cookie", rec.Code, cookie)
+	}
+	if !cookie.HttpOnly || !cookie.Secure || cookie.SameSite != http.SameSiteStrictMode {
+		t.Errorf("cookie = %+v, want HttpOnly, Secure and SameSite=Strict", cookie)
+	}
+}
+
+func TestRequireOperator(t *testing.T) {
+	h, _ := newTestHandler(t)
+	_, valid := login(t, h, "secret")
+
+	expired := &http.Cookie{Name: sessionCookie, Value: h.sessionValue("grace", time.Now().Add(-time.Minute).Unix())}
+	future := time.Now().Add(time.Hour).Unix()
+	forged := &http.Cookie{Name: sessionCookie, Value: fmt.Sprintf("Z3JhY2U.%d.%s", future, strings.Repeat("0", 64))}
+	// A valid signature for one operator can't be reused under another name
+	renamed := &http.Cookie{Name: sessionCookie, Value: "bWFsbG9yeQ" + valid.Value[strings.Index(valid.Value, "."):]}
+
+	tests := []struct {
+		name   string
+		cookie *http.Cookie
+		status int
+	}{
+		{"no session", nil, http.StatusSeeOther},
+		{"expired", expired, http.StatusSeeOther},
+		{"forged", forged, http.StatusSeeOther},
+		{"renamed", renamed, http.StatusSeeOther},
+		{"garbage", &http.Cookie{Name: sessionCookie, Value: "admin"}, http.StatusSeeOther},
+		{"valid", valid, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/_lobber/admin/ui/", nil)
+			if tt.cookie != nil {
+				req.AddCookie(tt.cookie)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tt.status {
+				t.Errorf("status = %d, want %d", rec.Code, tt.status)
+			}
+		})
+	}
+}
+
+func TestPages(t *testing.T) {
+	h, _ := newTestHandler(t)
+	_, cookie := login(t, h, "secret")
+
+	tests := []struct {
+		path string
+		want []string
+	}{
+		{"/_lobber/admin/ui/", []string{"Connected Tunnels", "us-1", "busy.lobber.dev", "3.00 GB", "1 open abuse reports"}},
+		{"/_lobber/admin/ui/abuse", []string{"phish.lobber.dev", "/_lobber/admin/ui/abuse/abuse_1/resolve"}},
+		{"/_lobber/admin/ui/users?q=ada", []string{"ada@example.com", "/_lobber/admin/ui/users/u1/plan", "/_lobber/admin/ui/users/u1/impersonate", "grace@lobber.dev"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.path, nil)
+			req.AddCookie(cookie)
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200 (body %q)", rec.Code, rec.Body.String())
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(rec.Body.String(), want) {
+					t.Errorf("page is missing %q", want)
+				}
+			}
+		})
+	}
+}
+
+func TestSetPlan(t *testing.T) {
+	h, api := newTestHandler(t)
+	_, cookie := login(t, h, "secret")
+
+	post := func(path string, form url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(cookie)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := post("/_lobber/admin/ui/users/u1/plan", url.Values{"plan": {"pro"}, "q": {"ada"}})
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/_lobber/admin/ui/users?q=ada" {
+		t.Errorf("set plan: status = %d, location = %q, want 303 back to the search", rec.Code, rec.Header().Get("Location"))
+	}
+	if api.plans["u1"] != "pro" {
+		t.Errorf("plan = %q, want pro", api.plans["u1"])
+	}
+
+	if rec := post("/_lobber/admin/ui/users/u1/plan", url.Values{"plan": {"platinum"}}); rec.Code != http.StatusBadRequest {
+		t.Errorf("unknown plan status = %d, want 400", rec.Code)
+	}
+	if rec := post("/_lobber/admin/ui/abuse/abuse_9/resolve", url.Values{"resolution": {"done"}}); rec.Code != http.StatusNotFound {
+		t.Errorf("resolve unknown report status = %d, want 404", rec.Code)
+	}
+}
+
+func TestImpersonate(t *testing.T) {
+	h, api := newTestHandler(t)
+	_, cookie := login(t, h, "secret")
+
+	post := func(userID, reason string) *httptest.ResponseRecorder {
+		form := url.Values{"reason": {reason}}
+		req := httptest.NewRequest("POST", "/_lobber/admin/ui/users/"+userID+"/impersonate", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(cookie)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := post("u1", ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("without reason: status = %d, want 400", rec.Code)
+	}
+	if rec := post("nobody", "ticket 12"); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown user: status = %d, want 404", rec.Code)
+	}
+
+	rec := post("u1", "ticket 12")
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/dashboard" {
+		t.Fatalf("status = %d, location = %q, want 303 to /dashboard", rec.Code, rec.Header().Get("Location"))
+	}
+	if api.impersonation != "grace@lobber.dev: ticket 12" {
+		t.Errorf("impersonation = %q, want the logged-in operator and reason", api.impersonation)
+	}
+	var session *http.Cookie
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == "session" {
+			session = c
+		}
+	}
+	if session == nil || session.Value != "support-token" || session.Path != "/" {
+		t.Errorf("session cookie = %+v, want the support token for the dashboard", session)
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	h, _ := newTestHandler(t)
+	h.SetLoginLimiter(ratelimit.New(ratelimit.NewMemory(), "admin", ratelimit.Policy{MaxFailures: 2, Window: time.Minute, Lockout: time.Minute}))
+
+	login(t, h, "wrong")
+	login(t, h, "wrong")
+	rec, cookie := login(t, h, "secret")
+	if rec.Code != http.StatusTooManyRequests || cookie != nil {
+		t.Errorf("locked out: status = %d, cookie = %v, want 429 without a cookie", rec.Code, cookie)
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Error("locked out response has no Retry-After")
+	}
+}
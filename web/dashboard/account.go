@@ -0,0 +1,415 @@
+// web/dashboard/account.go
+package dashboard
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/lobber-dev/lobber/internal/notify"
+	"github.com/lobber-dev/lobber/internal/store"
+)
+
+const (
+	// emailChangeTTL is how long an email confirmation link stays valid
+	emailChangeTTL = 24 * time.Hour
+
+	// auditLogLimit is how many audit entries the account page shows
+	auditLogLimit = 20
+
+	maxNameLength = 100
+	maxAvatarURL  = 2048
+
+	// maxLogRetentionDays caps the log window a user can prefer; their
+	// plan's window applies when it is shorter
+	maxLogRetentionDays = 365
+)
+
+// accountNotices are the messages shown after an account form redirects back
+var accountNotices = map[string]string{
+	"profile-saved":      "Profile saved.",
+	"email-sent":         "Check your new inbox for a confirmation link. Your email changes once you click it.",
+	"email-changed":      "Your email address has been updated.",
+	"identity-unlinked":  "Login method removed.",
+	"email-already-same": "That is already your email address.",
+	"alert-saved":        "Usage alert saved.",
+	"export-saved":       "Export saved. New data is sent to your bucket every hour.",
+	"github-saved":       "GitHub App saved. Tunnels started with --github-pr now comment their link on the pull request.",
+	"region-saved":       "Data region saved. Your request logs are now kept there.",
+	"preferences-saved":  "Preferences saved. Run lobber login on your other machines to pick them up.",
+}
+
+// remoteIP returns the client address without its port
+func remoteIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+// SetNotifier sets how email confirmation links are delivered. baseURL is
+// the public dashboard origin used to build links, e.g. https://lobber.dev.
+func (h *Handler) SetNotifier(n notify.Notifier, baseURL string) {
+	h.notifier = n
+	h.SetBaseURL(baseURL)
+}
+
+// SetBaseURL sets the public dashboard origin links and sign-in redirects
+// are built on, e.g. https://lobber.dev
+func (h *Handler) SetBaseURL(baseURL string) {
+	h.baseURL = strings.TrimSuffix(baseURL, "/")
+}
+
+// audit records an account change, logging rather than failing the request on error
+func (h *Handler) audit(r *http.Request, userID, action, detail string) {
+	entry := store.AuditEntry{UserID: userID, Action: action, Detail: detail, IPAddress: remoteIP(r)}
+	if err := h.stores.Audit.RecordAudit(r.Context(), entry); err != nil {
+		log.Printf("record audit %s for %s: %v", action, userID, err)
+	}
+}
+
+// handleAccountProfile saves the display name and avatar form
+func (h *Handler) handleAccountProfile(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userContextKey).(*User)
+
+	name := strings.TrimSpace(r.PostFormValue("name"))
+	avatarURL := strings.TrimSpace(r.PostFormValue("avatar_url"))
+	if err := validateProfile(name, avatarURL); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var changed []string
+	if name != user.Name {
+		changed = append(changed, "name")
+	}
+	if avatarURL != user.AvatarURL {
+		changed = append(changed, "avatar")
+	}
+	if len(changed) > 0 {
+		if err := h.stores.Accounts.UpdateProfile(r.Context(), user.ID, name, avatarURL); err != nil {
+			http.Error(w, "update profile failed", http.StatusInternalServerError)
+			return
+		}
+		h.audit(r, user.ID, "profile.updated", strings.Join(changed, ", "))
+	}
+
+	http.Redirect(w, r, "/dashboard/account?notice=profile-saved", http.StatusSeeOther)
+}
+
+// validateProfile checks the display name and avatar URL
+func validateProfile(name, avatarURL string) error {
+	if utf8.RuneCountInString(name) > maxNameLength {
+		return fmt.Errorf("name must be at most %d characters", maxNameLength)
+	}
+	if strings.IndexFunc(name, unicode.IsControl) >= 0 {
+		return fmt.Errorf("name contains invalid characters")
+	}
+	if avatarURL == "" {
+		return nil
+	}
+	if len(avatarURL) > maxAvatarURL {
+		return fmt.Errorf("avatar URL is too long")
+	}
+	u, err := url.Parse(avatarURL)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("avatar URL must be an https:// link")
+	}
+	return nil
+}
+
+// themes are the accepted dashboard color themes
+var themes = map[string]bool{"system": true, "light": true, "dark": true}
+
+// handleAccountTheme saves the dashboard theme. The sidebar toggle posts here
+// in the background; the account page form redirects back.
+func (h *Handler) handleAccountTheme(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userContextKey).(*User)
+
+	theme := r.PostFormValue("theme")
+	if !themes[theme] {
+		http.Error(w, "theme must be system, light or dark", http.StatusBadRequest)
+		return
+	}
+	if theme != user.Theme {
+		if err := h.stores.Accounts.SetTheme(r.Context(), user.ID, theme); err != nil {
+			http.Error(w, "save theme failed", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if isHTMX(r) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	http.Redirect(w, r, "/dashboard/account", http.StatusSeeOther)
+}
+
+// checkDataRegion rejects regions request logs can't be kept in
+func checkDataRegion(region string) error {
+	if !slices.Contains(store.DataRegions, region) {
+		return fmt.Errorf("region must be one of %s", strings.Join(store.DataRegions, ", "))
+	}
+	return nil
+}
+
+// setDataRegion moves the user's request logs to a checked region
+func (h *Handler) setDataRegion(r *http.Request, user *User, region string) error {
+	if region == user.DataRegion {
+		return nil
+	}
+	if err := h.stores.Accounts.SetDataRegion(r.Context(), user.ID, region); err != nil {
+		return err
+	}
+	h.audit(r, user.ID, "data_region.changed", user.DataRegion+" -> "+region)
+	return nil
+}
+
+// handleAccountRegion saves where the user's request logs are kept
+func (h *Handler) handleAccountRegion(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userContextKey).(*User)
+
+	region := r.PostFormValue("region")
+	if err := checkDataRegion(region); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := h.setDataRegion(r, user, region); err != nil {
+		http.Error(w, "save data region failed", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/dashboard/account?notice=region-saved", http.StatusSeeOther)
+}
+
+// checkPreferences rejects preferences the CLI and relay can't act on
+func checkPreferences(p store.Preferences) error {
+	if p.LogRetentionDays < 0 || p.LogRetentionDays > maxLogRetentionDays {
+		return fmt.Errorf("log retention must be between 0 and %d days", maxLogRetentionDays)
+	}
+	if p.BurstLimit == "" || p.BurstLimit == "off" {
+		return nil
+	}
+	if n, err := strconv.ParseFloat(p.BurstLimit, 64); err != nil || n <= 0 || n > 1e6 {
+		return fmt.Errorf(`burst limit must be "off" or requests per second, got %q`, p.BurstLimit)
+	}
+	return nil
+}
+
+// setPreferences saves the user's checked preferences
+func (h *Handler) setPreferences(r *http.Request, user *User, p store.Preferences) error {
+	if err := h.stores.Accounts.SetPreferences(r.Context(), user.ID, p); err != nil {
+		return err
+	}
+	h.audit(r, user.ID, "preferences.changed", fmt.Sprintf("inspect=%t log_retention_days=%d burst_limit=%q", p.Inspect, p.LogRetentionDays, p.BurstLimit))
+	return nil
+}
+
+// handleAccountPreferences saves the defaults the CLI picks up at login
+func (h *Handler) handleAccountPreferences(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userContextKey).(*User)
+
+	p := store.Preferences{
+		Inspect:    r.PostFormValue("inspect") != "",
+		BurstLimit: strings.TrimSpace(r.PostFormValue("burst_limit")),
+	}
+	if v := r.PostFormValue("log_retention_days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, "log retention must be a number of days", http.StatusBadRequest)
+			return
+		}
+		p.LogRetentionDays = n
+	}
+	if err := checkPreferences(p); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := h.setPreferences(r, user, p); err != nil {
+		http.Error(w, "save preferences failed", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/dashboard/account?notice=preferences-saved", http.StatusSeeOther)
+}
+
+// handleAccountEmail starts an email change by mailing a confirmation link
+// to the new address. The old address is told about the request.
+func (h *Handler) handleAccountEmail(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userContextKey).(*User)
+
+	newEmail, err := parseEmail(r.PostFormValue("email"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if strings.EqualFold(newEmail, user.Email) {
+		http.Redirect(w, r, "/dashboard/account?notice=email-already-same", http.StatusSeeOther)
+		return
+	}
+
+	token, err := newToken()
+	if err != nil {
+		http.Error(w, "could not start email change", http.StatusInternalServerError)
+		return
+	}
+	err = h.stores.Accounts.CreateEmailChange(r.Context(), user.ID, newEmail, hashToken(token), time.Now().Add(emailChangeTTL))
+	if errors.Is(err, store.ErrEmailTaken) {
+		http.Error(w, "that email address is used by another account", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "could not start email change", http.StatusInternalServerError)
+		return
+	}
+
+	link := h.baseURL + "/dashboard/account/email/confirm?token=" + token
+	if err := h.notifier.Send(r.Context(), emailConfirmMessage(newEmail, link)); err != nil {
+		log.Printf("send email confirmation to %s: %v", newEmail, err)
+		http.Error(w, "could not send confirmation email", http.StatusBadGateway)
+		return
+	}
+	if err := h.notifier.Send(r.Context(), emailChangeRequestedMessage(user.Email, newEmail, h.baseURL)); err != nil {
+		log.Printf("send email change notice to %s: %v", user.Email, err)
+	}
+
+	h.audit(r, user.ID, "email.change_requested", newEmail)
+	http.Redirect(w, r, "/dashboard/account?notice=email-sent", http.StatusSeeOther)
+}
+
+// handleAccountEmailConfirm applies an email change from a confirmation link.
+// The link only works for the account that requested it.
+func (h *Handler) handleAccountEmailConfirm(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userContextKey).(*User)
+
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		http.Error(w, "missing token", http.StatusBadRequest)
+		return
+	}
+
+	newEmail, err := h.stores.Accounts.ConfirmEmailChange(r.Context(), user.ID, hashToken(token))
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		http.Error(w, "this confirmation link is invalid or has expired", http.StatusBadRequest)
+		return
+	case errors.Is(err, store.ErrEmailTaken):
+		http.Error(w, "that email address is used by another account", http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, "could not change email", http.StatusInternalServerError)
+		return
+	}
+
+	h.audit(r, user.ID, "email.changed", user.Email+" -> "+newEmail)
+	if err := h.notifier.Send(r.Context(), emailChangedMessage(user.Email, newEmail)); err != nil {
+		log.Printf("send email changed notice to %s: %v", user.Email, err)
+	}
+
+	http.Redirect(w, r, "/dashboard/account?notice=email-changed", http.StatusSeeOther)
+}
+
+// handleUnlinkIdentity removes a connected OAuth login. The last one can't be
+// removed, since it is the only way back into the account.
+func (h *Handler) handleUnlinkIdentity(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userContextKey).(*User)
+	id := r.PathValue("id")
+
+	identities, err := h.stores.Accounts.ListIdentities(r.Context(), user.ID)
+	if err != nil {
+		http.Error(w, "identities unavailable", http.StatusInternalServerError)
+		return
+	}
+	provider := ""
+	for _, i := range identities {
+		if i.ID == id {
+			provider = i.Provider
+		}
+	}
+
+	err = h.stores.Accounts.DeleteIdentity(r.Context(), user.ID, id)
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		http.NotFound(w, r)
+		return
+	case errors.Is(err, store.ErrLastIdentity):
+		http.Error(w, "connect another login method before removing this one", http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, "remove identity failed", http.StatusInternalServerError)
+		return
+	}
+
+	h.audit(r, user.ID, "identity.unlinked", provider)
+
+	if !isHTMX(r) {
+		http.Redirect(w, r, "/dashboard/account?notice=identity-unlinked", http.StatusSeeOther)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// parseEmail accepts a bare address like dev@example.com
+func parseEmail(raw string) (string, error) {
+	raw = strings.TrimSpace(raw)
+	addr, err := mail.ParseAddress(raw)
+	if err != nil || addr.Address != raw {
+		return "", fmt.Errorf("enter a valid email address")
+	}
+	// Require a dotted domain so typos like dev@localhost are caught
+	if domain := raw[strings.LastIndex(raw, "@")+1:]; !strings.Contains(domain, ".") {
+		return "", fmt.Errorf("enter a valid email address")
+	}
+	return raw, nil
+}
+
+// newToken returns a random hex token for confirmation links
+func newToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generate token: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func emailConfirmMessage(to, link string) *notify.Message {
+	return &notify.Message{
+		To:      to,
+		Subject: "Confirm your new Lobber email address",
+		Body: "Someone asked to change the email on a Lobber account to this address.\n\n" +
+			"If it was you, confirm the change within 24 hours:\n" + link + "\n\n" +
+			"If it wasn't, ignore this message and nothing will change.\n",
+	}
+}
+
+func emailChangeRequestedMessage(to, newEmail, baseURL string) *notify.Message {
+	return &notify.Message{
+		To:      to,
+		Subject: "Your Lobber email address is being changed",
+		Body: fmt.Sprintf("A request was made to change your Lobber email to %s. "+
+			"The change only happens once the new address is confirmed.\n\n"+
+			"If this wasn't you, log in and review your account at %s/dashboard/account\n", newEmail, baseURL),
+	}
+}
+
+func emailChangedMessage(to, newEmail string) *notify.Message {
+	return &notify.Message{
+		To:      to,
+		Subject: "Your Lobber email address was changed",
+		Body: fmt.Sprintf("Your Lobber account email is now %s. You will no longer receive account emails at this address.\n\n"+
+			"If this wasn't you, contact support@lobber.dev right away.\n", newEmail),
+	}
+}
@@ -0,0 +1,358 @@
+// web/dashboard/account_test.go
+package dashboard
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lobber-dev/lobber/internal/billing"
+	"github.com/lobber-dev/lobber/internal/notify"
+	"github.com/lobber-dev/lobber/internal/store"
+)
+
+// recordingNotifier captures sent messages
+type recordingNotifier struct {
+	mu   sync.Mutex
+	sent []*notify.Message
+}
+
+func (n *recordingNotifier) Send(ctx context.Context, msg *notify.Message) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.sent = append(n.sent, msg)
+	return nil
+}
+
+// postForm sends an authenticated form post through the handler
+func postForm(h *Handler, target string, form url.Values, cookie *http.Cookie) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", target, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(cookie)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestValidateProfile(t *testing.T) {
+	tests := []struct {
+		name, avatar string
+		wantErr      bool
+	}{
+		{"Ada Lovelace", "", false},
+		{"", "https://example.com/me.png", false},
+		{strings.Repeat("a", 101), "", true},
+		{"bad\nname", "", true},
+		{"Ada", "http://example.com/me.png", true},
+		{"Ada", "javascript:alert(1)", true},
+		{"Ada", "https://", true},
+	}
+
+	for _, tt := range tests {
+		err := validateProfile(tt.name, tt.avatar)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("validateProfile(%q, %q) error = %v, wantErr %v", tt.name, tt.avatar, err, tt.wantErr)
+		}
+	}
+}
+
+func TestParseEmail(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    string
+		wantErr bool
+	}{
+		{"dev@example.com", "dev@example.com", false},
+		{"  dev@example.com ", "dev@example.com", false},
+		{"Dev <dev@example.com>", "", true},
+		{"dev@localhost", "", true},
+		{"not-an-email", "", true},
+		{"", "", true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseEmail(tt.input)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseEmail(%q) error = %v, wantErr %v", tt.input, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseEmail(%q) = %q, want %q", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestAccountProfile(t *testing.T) {
+	h, mem, cookie := newTestHandler(t)
+	ctx := context.Background()
+
+	rec := postForm(h, "/dashboard/account/profile", url.Values{"name": {" Ada "}, "avatar_url": {"https://example.com/ada.png"}}, cookie)
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("status = %d, want 303", rec.Code)
+	}
+
+	u, _ := mem.GetUser(ctx, "user-1")
+	if u.Name != "Ada" || u.AvatarURL != "https://example.com/ada.png" {
+		t.Errorf("user = %+v, want updated name and avatar", u)
+	}
+	entries, _ := mem.ListAudit(ctx, "user-1", 10)
+	if len(entries) != 1 || entries[0].Action != "profile.updated" || entries[0].Detail != "name, avatar" {
+		t.Errorf("audit = %+v, want one profile.updated entry", entries)
+	}
+
+	// Saving unchanged values doesn't add audit noise
+	postForm(h, "/dashboard/account/profile", url.Values{"name": {"Ada"}, "avatar_url": {"https://example.com/ada.png"}}, cookie)
+	if entries, _ := mem.ListAudit(ctx, "user-1", 10); len(entries) != 1 {
+		t.Errorf("audit has %d entries after no-op save, want 1", len(entries))
+	}
+
+	if rec := postForm(h, "/dashboard/account/profile", url.Values{"avatar_url": {"http://insecure.example.com"}}, cookie); rec.Code != http.StatusBadRequest {
+		t.Errorf("invalid avatar status = %d, want 400", rec.Code)
+	}
+}
+
+func TestAccountDataRegion(t *testing.T) {
+	h, mem, cookie := newTestHandler(t)
+	ctx := context.Background()
+	mem.AddDomain("user-1", store.Domain{Name: "app.example.com"})
+	mem.LogRequest(ctx, "app.example.com", store.RequestLog{Method: "GET", Path: "/"})
+
+	rec := postForm(h, "/dashboard/account/region", url.Values{"region": {"eu"}}, cookie)
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/dashboard/account?notice=region-saved" {
+		t.Fatalf("status = %d, location %q, want redirect with notice", rec.Code, rec.Header().Get("Location"))
+	}
+	u, _ := mem.GetUser(ctx, "user-1")
+	logs, _ := mem.RecentRequests(ctx, "user-1", 10)
+	if u.DataRegion != store.RegionEU || len(logs) != 1 || logs[0].Region != store.RegionEU {
+		t.Errorf("region = %q, logs = %+v, want the user and their log in eu", u.DataRegion, logs)
+	}
+	entries, _ := mem.ListAudit(ctx, "user-1", 10)
+	if len(entries) != 1 || entries[0].Action != "data_region.changed" || entries[0].Detail != "us -> eu" {
+		t.Errorf("audit = %+v, want one data_region.changed entry", entries)
+	}
+
+	if rec := postForm(h, "/dashboard/account/region", url.Values{"region": {"apac"}}, cookie); rec.Code != http.StatusBadRequest {
+		t.Errorf("unknown region status = %d, want 400", rec.Code)
+	}
+
+	req := httptest.NewRequest("PUT", "/api/dashboard/account/region", strings.NewReader(`{"region": "us"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.AddCookie(cookie)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"data_region":"us"`) {
+		t.Errorf("PUT status = %d, body %q, want the user back in us", rec.Code, rec.Body.String())
+	}
+	if u, _ := mem.GetUser(ctx, "user-1"); u.DataRegion != store.RegionUS {
+		t.Errorf("region after PUT = %q, want %q", u.DataRegion, store.RegionUS)
+	}
+}
+
+func TestAccountPreferences(t *testing.T) {
+	h, mem, cookie := newTestHandler(t)
+	ctx := context.Background()
+
+	if p, _ := mem.Preferences(ctx, "user-1"); p != store.DefaultPreferences() {
+		t.Fatalf("Preferences() = %+v, want the defaults", p)
+	}
+
+	rec := postForm(h, "/dashboard/account/preferences", url.Values{"burst_limit": {"off"}, "log_retention_days": {"7"}}, cookie)
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/dashboard/account?notice=preferences-saved" {
+		t.Fatalf("status = %d, location %q, want redirect with notice", rec.Code, rec.Header().Get("Location"))
+	}
+	want := store.Preferences{Inspect: false, LogRetentionDays: 7, BurstLimit: "off"}
+	if p, _ := mem.Preferences(ctx, "user-1"); p != want {
+		t.Errorf("Preferences() = %+v, want %+v", p, want)
+	}
+
+	for _, form := range []url.Values{
+		{"burst_limit": {"lots"}},
+		{"burst_limit": {"-5"}},
+		{"log_retention_days": {"400"}},
+		{"log_retention_days": {"a week"}},
+	} {
+		if rec := postForm(h, "/dashboard/account/preferences", form, cookie); rec.Code != http.StatusBadRequest {
+			t.Errorf("%v: status = %d, want 400", form, rec.Code)
+		}
+	}
+
+	// Fields left out of a PUT keep their values
+	req := httptest.NewRequest("PUT", "/api/dashboard/preferences", strings.NewReader(`{"inspect": true, "region": "eu"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.AddCookie(cookie)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"preferences":{"region":"eu","inspect":true,"log_retention_days":7,"burst_limit":"off"}`) {
+		t.Errorf("PUT status = %d, body %q, want the merged preferences", rec.Code, rec.Body.String())
+	}
+	if u, _ := mem.GetUser(ctx, "user-1"); u.DataRegion != store.RegionEU {
+		t.Errorf("region after PUT = %q, want %q", u.DataRegion, store.RegionEU)
+	}
+
+	req = httptest.NewRequest("PUT", "/api/dashboard/preferences", strings.NewReader(`{"burst_limit": "fast"}`))
+	req.AddCookie(cookie)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("invalid PUT status = %d, want 400", rec.Code)
+	}
+}
+
+func TestAccountEmailChange(t *testing.T) {
+	h, mem, cookie := newTestHandler(t)
+	ctx := context.Background()
+	notifier := &recordingNotifier{}
+	h.SetNotifier(notifier, "https://lobber.test/")
+	mem.AddUser(store.User{ID: "user-2", Email: "taken@example.com"})
+
+	if rec := postForm(h, "/dashboard/account/email", url.Values{"email": {"taken@example.com"}}, cookie); rec.Code != http.StatusConflict {
+		t.Errorf("taken email status = %d, want 409", rec.Code)
+	}
+
+	rec := postForm(h, "/dashboard/account/email", url.Values{"email": {"new@example.com"}}, cookie)
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("status = %d, want 303 (body %q)", rec.Code, rec.Body.String())
+	}
+	if len(notifier.sent) != 2 {
+		t.Fatalf("sent %d messages, want confirmation and notice", len(notifier.sent))
+	}
+	if notifier.sent[0].To != "new@example.com" || notifier.sent[1].To != "dev@example.com" {
+		t.Errorf("recipients = %s, %s, want new then old address", notifier.sent[0].To, notifier.sent[1].To)
+	}
+	if !strings.Contains(notifier.sent[1].Body, "https://lobber.test/dashboard/account\n") {
+		t.Errorf("notice body = %q, want a link to this relay's account page", notifier.sent[1].Body)
+	}
+	if u, _ := mem.GetUser(ctx, "user-1"); u.Email != "dev@example.com" {
+		t.Errorf("email changed to %q before confirmation", u.Email)
+	}
+
+	link := regexp.MustCompile(`https://lobber\.test/dashboard/account/email/confirm\?token=([0-9a-f]+)`).FindStringSubmatch(notifier.sent[0].Body)
+	if link == nil {
+		t.Fatalf("confirmation body has no link: %q", notifier.sent[0].Body)
+	}
+
+	confirm := func(token string) int {
+		req := httptest.NewRequest("GET", "/dashboard/account/email/confirm?token="+token, nil)
+		req.AddCookie(cookie)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := confirm("wrong"); code != http.StatusBadRequest {
+		t.Errorf("wrong token status = %d, want 400", code)
+	}
+	if code := confirm(link[1]); code != http.StatusSeeOther {
+		t.Fatalf("confirm status = %d, want 303", code)
+	}
+	if u, _ := mem.GetUser(ctx, "user-1"); u.Email != "new@example.com" {
+		t.Errorf("Email = %q, want new@example.com", u.Email)
+	}
+	if code := confirm(link[1]); code != http.StatusBadRequest {
+		t.Errorf("reused token status = %d, want 400", code)
+	}
+
+	entries, _ := mem.ListAudit(ctx, "user-1", 10)
+	if len(entries) != 2 || entries[0].Action != "email.changed" || entries[1].Action != "email.change_requested" {
+		t.Errorf("audit = %+v, want change_requested then changed", entries)
+	}
+	if entries[0].Detail != "dev@example.com -> new@example.com" {
+		t.Errorf("changed detail = %q", entries[0].Detail)
+	}
+}
+
+func TestUnlinkIdentity(t *testing.T) {
+	h, mem, cookie := newTestHandler(t)
+	mem.AddIdentity("user-1", store.Identity{ID: "gh", Provider: "github"})
+	mem.AddIdentity("user-1", store.Identity{ID: "google", Provider: "google"})
+
+	tests := []struct {
+		name   string
+		id     string
+		status int
+	}{
+		{"unknown", "nope", http.StatusNotFound},
+		{"first of two", "gh", http.StatusOK},
+		{"last one", "google", http.StatusConflict},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("DELETE", "/dashboard/account/identities/"+tt.id, nil)
+			req.Header.Set("HX-Request", "true")
+			req.AddCookie(cookie)
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != tt.status {
+				t.Errorf("status = %d, want %d", rec.Code, tt.status)
+			}
+		})
+	}
+
+	entries, _ := mem.ListAudit(context.Background(), "user-1", 10)
+	if len(entries) != 1 || entries[0].Action != "identity.unlinked" || entries[0].Detail != "github" {
+		t.Errorf("audit = %+v, want one identity.unlinked entry for github", entries)
+	}
+}
+
+// seatBilling records seat changes
+type seatBilling struct {
+	BillingService
+	seats int64
+}
+
+func (b *seatBilling) GetBillingDetails(ctx context.Context, userID string) (*billing.BillingDetails, error) {
+	return nil, nil
+}
+
+func (b *seatBilling) GetUpcomingInvoice(ctx context.Context, userID string) (*billing.InvoicePreview, error) {
+	return nil, errors.New("no invoice")
+}
+
+func (b *seatBilling) SetSeats(ctx context.Context, userID string, seats int64) error {
+	b.seats = seats
+	return nil
+}
+
+func TestAccountTeamSeats(t *testing.T) {
+	h, mem, cookie := newTestHandler(t)
+	renews := time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC)
+	mem.AddUser(store.User{ID: "user-1", Email: "dev@example.com", Plan: "team", BillingInterval: "year", Seats: 5,
+		RenewalAmount: 48000, RenewalCurrency: "usd", RenewsAt: &renews})
+	b := &seatBilling{}
+	h.SetBillingService(b)
+
+	req := httptest.NewRequest("GET", "/dashboard/account", nil)
+	req.AddCookie(cookie)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	body := rec.Body.String()
+	for _, want := range []string{"Billed yearly for 5 seats", "480.00 USD", `name="seats"`} {
+		if !strings.Contains(body, want) {
+			t.Errorf("account page missing %q", want)
+		}
+	}
+
+	if rec := postForm(h, "/dashboard/account/seats", url.Values{"seats": {"8"}}, cookie); rec.Code != http.StatusSeeOther {
+		t.Fatalf("status = %d, want 303 (body %q)", rec.Code, rec.Body.String())
+	}
+	if b.seats != 8 {
+		t.Errorf("seats = %d, want 8", b.seats)
+	}
+	entries, _ := mem.ListAudit(context.Background(), "user-1", 10)
+	if len(entries) != 1 || entries[0].Action != "billing.seats" || entries[0].Detail != "5 -> 8" {
+		t.Errorf("audit = %+v, want one billing.seats entry", entries)
+	}
+
+	if rec := postForm(h, "/dashboard/account/seats", url.Values{"seats": {"0"}}, cookie); rec.Code != http.StatusBadRequest {
+		t.Errorf("zero seats status = %d, want 400", rec.Code)
+	}
+}
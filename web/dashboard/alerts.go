@@ -0,0 +1,150 @@
+// web/dashboard/alerts.go
+package dashboard
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/lobber-dev/lobber/internal/alerts"
+	"github.com/lobber-dev/lobber/internal/store"
+)
+
+// errTooManyAlerts is returned when a user already has alerts.MaxPerUser alerts
+var errTooManyAlerts = fmt.Errorf("%w: at most %d alerts per account", alerts.ErrInvalid, alerts.MaxPerUser)
+
+// createAlert validates and saves a usage alert for the user
+func (h *Handler) createAlert(r *http.Request, user *User, a store.UsageAlert) (*store.UsageAlert, error) {
+	a.UserID = user.ID
+	if err := alerts.Validate(a); err != nil {
+		return nil, err
+	}
+	existing, err := h.stores.Alerts.ListAlerts(r.Context(), user.ID)
+	if err != nil {
+		return nil, err
+	}
+	if len(existing) >= alerts.MaxPerUser {
+		return nil, errTooManyAlerts
+	}
+
+	created, err := h.stores.Alerts.CreateAlert(r.Context(), a)
+	if err != nil {
+		return nil, err
+	}
+	h.audit(r, user.ID, "alert.created", fmt.Sprintf("%s at %d bytes", a.Channel, a.ThresholdBytes))
+	return created, nil
+}
+
+// deleteAlert removes one of the user's alerts
+func (h *Handler) deleteAlert(r *http.Request, user *User, id string) error {
+	if err := h.stores.Alerts.DeleteAlert(r.Context(), user.ID, id); err != nil {
+		return err
+	}
+	h.audit(r, user.ID, "alert.deleted", id)
+	return nil
+}
+
+// handleAccountAlert saves the usage alert form. The threshold is entered in GB.
+func (h *Handler) handleAccountAlert(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userContextKey).(*User)
+
+	gb, err := strconv.ParseFloat(strings.TrimSpace(r.PostFormValue("threshold_gb")), 64)
+	if err != nil || gb <= 0 {
+		http.Error(w, "threshold must be a number of GB", http.StatusBadRequest)
+		return
+	}
+	a := store.UsageAlert{
+		ThresholdBytes: int64(gb * 1024 * 1024 * 1024),
+		Channel:        r.PostFormValue("channel"),
+		Target:         strings.TrimSpace(r.PostFormValue("target")),
+	}
+	if _, err := h.createAlert(r, user, a); err != nil {
+		if errors.Is(err, alerts.ErrInvalid) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Error(w, "save alert failed", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/dashboard/account?notice=alert-saved", http.StatusSeeOther)
+}
+
+// handleDeleteAlert removes an alert. HTMX swaps the row out with the empty body.
+func (h *Handler) handleDeleteAlert(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userContextKey).(*User)
+
+	err := h.deleteAlert(r, user, r.PathValue("id"))
+	if errors.Is(err, store.ErrNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, "delete alert failed", http.StatusInternalServerError)
+		return
+	}
+
+	if !isHTMX(r) {
+		http.Redirect(w, r, "/dashboard/account", http.StatusSeeOther)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleAPIAlerts returns the user's usage alerts
+func (h *Handler) handleAPIAlerts(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userContextKey).(*User)
+
+	list, err := h.stores.Alerts.ListAlerts(r.Context(), user.ID)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "alerts unavailable")
+		return
+	}
+	if list == nil {
+		list = []store.UsageAlert{}
+	}
+	writeJSON(w, map[string]any{"alerts": list})
+}
+
+// handleAPICreateAlert creates an alert from {"threshold_bytes", "channel", "target"}
+func (h *Handler) handleAPICreateAlert(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userContextKey).(*User)
+
+	var a store.UsageAlert
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&a); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	created, err := h.createAlert(r, user, store.UsageAlert{ThresholdBytes: a.ThresholdBytes, Channel: a.Channel, Target: a.Target})
+	if errors.Is(err, alerts.ErrInvalid) {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "save alert failed")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(created)
+}
+
+// handleAPIDeleteAlert removes an alert
+func (h *Handler) handleAPIDeleteAlert(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userContextKey).(*User)
+
+	err := h.deleteAlert(r, user, r.PathValue("id"))
+	if errors.Is(err, store.ErrNotFound) {
+		writeJSONError(w, http.StatusNotFound, "alert not found")
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "delete alert failed")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
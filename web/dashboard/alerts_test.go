@@ -0,0 +1,102 @@
+// web/dashboard/alerts_test.go
+package dashboard
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/lobber-dev/lobber/internal/alerts"
+	"github.com/lobber-dev/lobber/internal/store"
+)
+
+func TestAlertsAPI(t *testing.T) {
+	h, mem, cookie := newTestHandler(t)
+	ctx := context.Background()
+
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.AddCookie(cookie)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{"email", `{"threshold_bytes": 2147483648, "channel": "email"}`, http.StatusCreated},
+		{"slack", `{"threshold_bytes": 1073741824, "channel": "slack", "target": "https://hooks.slack.com/services/T0/B0/x"}`, http.StatusCreated},
+		{"plain http webhook", `{"threshold_bytes": 1073741824, "channel": "webhook", "target": "http://example.com"}`, http.StatusBadRequest},
+		{"too small", `{"threshold_bytes": 100, "channel": "email"}`, http.StatusBadRequest},
+		{"malformed", `{"threshold_bytes":`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rec := do("POST", "/api/dashboard/alerts", tt.body); rec.Code != tt.status {
+				t.Errorf("status = %d, want %d (body %q)", rec.Code, tt.status, rec.Body.String())
+			}
+		})
+	}
+
+	rec := do("GET", "/api/dashboard/alerts", "")
+	var got struct {
+		Alerts []store.UsageAlert `json:"alerts"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("decode alerts: %v", err)
+	}
+	if len(got.Alerts) != 2 || got.Alerts[0].Channel != "slack" || got.Alerts[1].ThresholdBytes != 2<<30 {
+		t.Fatalf("alerts = %+v, want slack at 1 GB then email at 2 GB", got.Alerts)
+	}
+	if strings.Contains(rec.Body.String(), "user-1") {
+		t.Errorf("body leaks user ID: %s", rec.Body.String())
+	}
+
+	if rec := do("DELETE", "/api/dashboard/alerts/"+got.Alerts[0].ID, ""); rec.Code != http.StatusNoContent {
+		t.Errorf("DELETE status = %d, want %d", rec.Code, http.StatusNoContent)
+	}
+	if rec := do("DELETE", "/api/dashboard/alerts/"+got.Alerts[0].ID, ""); rec.Code != http.StatusNotFound {
+		t.Errorf("second DELETE status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+
+	entries, _ := mem.ListAudit(ctx, "user-1", 10)
+	if len(entries) != 3 || entries[0].Action != "alert.deleted" {
+		t.Errorf("audit = %+v, want two alert.created and one alert.deleted", entries)
+	}
+}
+
+func TestAccountAlertForm(t *testing.T) {
+	h, mem, cookie := newTestHandler(t)
+	ctx := context.Background()
+
+	rec := postForm(h, "/dashboard/account/alerts", url.Values{"threshold_gb": {"2"}, "channel": {"email"}}, cookie)
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/dashboard/account?notice=alert-saved" {
+		t.Fatalf("status = %d, location %q, want redirect with notice", rec.Code, rec.Header().Get("Location"))
+	}
+	if rec := postForm(h, "/dashboard/account/alerts", url.Values{"threshold_gb": {"lots"}, "channel": {"email"}}, cookie); rec.Code != http.StatusBadRequest {
+		t.Errorf("invalid threshold status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+
+	for i := 1; i < alerts.MaxPerUser; i++ {
+		mem.CreateAlert(ctx, store.UsageAlert{UserID: "user-1", ThresholdBytes: int64(i+2) << 30, Channel: alerts.ChannelEmail})
+	}
+	if rec := postForm(h, "/dashboard/account/alerts", url.Values{"threshold_gb": {"50"}, "channel": {"email"}}, cookie); rec.Code != http.StatusBadRequest {
+		t.Errorf("alert over the limit status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+
+	req := httptest.NewRequest("GET", "/dashboard/account", nil)
+	req.AddCookie(cookie)
+	page := httptest.NewRecorder()
+	h.ServeHTTP(page, req)
+	if !strings.Contains(page.Body.String(), "2.00 GB") {
+		t.Errorf("account page does not list the 2 GB alert")
+	}
+}
@@ -0,0 +1,486 @@
+// web/dashboard/api.go
+package dashboard
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lobber-dev/lobber/internal/billing"
+	"github.com/lobber-dev/lobber/internal/store"
+)
+
+// apiPrefix is where the JSON variants of the dashboard pages live. The same
+// data is served from the page URLs when the request sends Accept: application/json.
+const apiPrefix = "/api/dashboard"
+
+// apiUser is the JSON view of the logged-in user. Stripe IDs stay server-side.
+type apiUser struct {
+	ID          string     `json:"id"`
+	Email       string     `json:"email"`
+	Name        string     `json:"name,omitempty"`
+	Plan        string     `json:"plan"`
+	AvatarURL   string     `json:"avatar_url,omitempty"`
+	Theme       string     `json:"theme"`
+	DataRegion  string     `json:"data_region"`
+	TrialEndsAt *time.Time `json:"trial_ends_at,omitempty"`
+
+	BillingInterval string     `json:"billing_interval"`
+	Seats           int        `json:"seats"`
+	RenewsAt        *time.Time `json:"renews_at,omitempty"`
+	RenewalAmount   int64      `json:"renewal_amount,omitempty"` // minor units of RenewalCurrency
+	RenewalCurrency string     `json:"renewal_currency,omitempty"`
+}
+
+// apiPreferences is the JSON view of a user's preferences, with the data
+// region their request logs are kept in
+type apiPreferences struct {
+	Region           string `json:"region"`
+	Inspect          bool   `json:"inspect"`
+	LogRetentionDays int    `json:"log_retention_days"` // 0 keeps the plan's window
+	BurstLimit       string `json:"burst_limit"`        // "" for the relay's default
+}
+
+// apiDomain is the JSON view of a registered domain
+type apiDomain struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Verified  bool      `json:"verified"`
+	Schedule  string    `json:"schedule,omitempty"` // hours the domain is available; empty means always
+	Sampling  string    `json:"sampling,omitempty"` // which requests are logged; empty means all
+	Headers   string    `json:"headers,omitempty"`  // added to its responses, one "Name: value" per line
+	HTTPS     string    `json:"https,omitempty"`    // how visitors are kept on https; empty means they aren't
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// apiRequestLog is the JSON view of a logged request
+type apiRequestLog struct {
+	ID         string    `json:"id"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	StatusCode int       `json:"status_code"`
+	DurationMs float64   `json:"duration_ms"`
+	Domain     string    `json:"domain"`
+	CreatedAt  time.Time `json:"created_at"`
+	RemoteIP   string    `json:"remote_ip,omitempty"`
+	TLSVersion string    `json:"tls_version,omitempty"`
+	ALPN       string    `json:"alpn,omitempty"`
+
+	TunnelName string            `json:"tunnel_name,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+	Region     string            `json:"region,omitempty"` // data region the log is kept in
+
+	Latency *apiLatency `json:"latency,omitempty"` // omitted for requests the relay answered itself
+
+	// Reported by the client: the local server's own status, before any
+	// rewrite, and the client's version
+	LocalStatus   int    `json:"local_status,omitempty"`
+	ClientVersion string `json:"client_version,omitempty"`
+}
+
+// apiLatency is the JSON view of where a request's time went
+type apiLatency struct {
+	RelayMs  float64 `json:"relay_ms"`
+	TunnelMs float64 `json:"tunnel_ms"`
+	LocalMs  float64 `json:"local_ms"`
+	WriteMs  float64 `json:"write_ms"`
+}
+
+// apiToken is the JSON view of a CLI token. The secret is only ever shown
+// when it's created.
+type apiToken struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// apiIdentity is the JSON view of a linked OAuth login
+type apiIdentity struct {
+	ID        string    `json:"id"`
+	Provider  string    `json:"provider"`
+	Email     string    `json:"email,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// apiAuditEntry is the JSON view of an audit log entry
+type apiAuditEntry struct {
+	Action    string    `json:"action"`
+	Detail    string    `json:"detail,omitempty"`
+	IPAddress string    `json:"ip_address,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func toAPIUser(u *User) apiUser {
+	return apiUser{
+		ID:          u.ID,
+		Email:       u.Email,
+		Name:        u.Name,
+		Plan:        u.Plan,
+		AvatarURL:   u.AvatarURL,
+		Theme:       u.Theme,
+		DataRegion:  u.DataRegion,
+		TrialEndsAt: u.TrialEndsAt,
+
+		BillingInterval: u.BillingInterval,
+		Seats:           u.Seats,
+		RenewsAt:        u.RenewsAt,
+		RenewalAmount:   u.RenewalAmount,
+		RenewalCurrency: u.RenewalCurrency,
+	}
+}
+
+func toAPIDomains(domains []Domain) []apiDomain {
+	out := make([]apiDomain, 0, len(domains))
+	for _, d := range domains {
+		out = append(out, apiDomain{ID: d.ID, Name: d.Name, Verified: d.Verified, Schedule: d.Schedule, Sampling: d.Sampling, Headers: d.Headers, HTTPS: d.HTTPS, CreatedAt: d.CreatedAt})
+	}
+	return out
+}
+
+func toAPITokens(tokens []store.APIToken) []apiToken {
+	out := make([]apiToken, 0, len(tokens))
+	for _, t := range tokens {
+		out = append(out, apiToken{ID: t.ID, Name: t.Name, LastUsedAt: t.LastUsedAt, CreatedAt: t.CreatedAt})
+	}
+	return out
+}
+
+func toAPIIdentities(identities []store.Identity) []apiIdentity {
+	out := make([]apiIdentity, 0, len(identities))
+	for _, i := range identities {
+		out = append(out, apiIdentity{ID: i.ID, Provider: i.Provider, Email: i.Email, CreatedAt: i.CreatedAt})
+	}
+	return out
+}
+
+func toAPIAuditLog(entries []store.AuditEntry) []apiAuditEntry {
+	out := make([]apiAuditEntry, 0, len(entries))
+	for _, e := range entries {
+		out = append(out, apiAuditEntry{Action: e.Action, Detail: e.Detail, IPAddress: e.IPAddress, CreatedAt: e.CreatedAt})
+	}
+	return out
+}
+
+// apiTunnel is the JSON view of a connected tunnel
+type apiTunnel struct {
+	Hostname string            `json:"hostname"`
+	Name     string            `json:"name,omitempty"`
+	Labels   map[string]string `json:"labels,omitempty"`
+	UDPPort  int               `json:"udp_port,omitempty"`
+}
+
+func toAPITunnels(tunnels []Tunnel) []apiTunnel {
+	out := make([]apiTunnel, 0, len(tunnels))
+	for _, t := range tunnels {
+		out = append(out, apiTunnel{Hostname: t.Hostname, Name: t.Name, Labels: t.Labels, UDPPort: t.UDPPort})
+	}
+	return out
+}
+
+func toAPIRequestLogs(logs []RequestLog) []apiRequestLog {
+	ms := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+	out := make([]apiRequestLog, 0, len(logs))
+	for _, l := range logs {
+		var latency *apiLatency
+		if l.Latency != (store.Latency{}) {
+			latency = &apiLatency{ms(l.Latency.Relay), ms(l.Latency.Tunnel), ms(l.Latency.Local), ms(l.Latency.Write)}
+		}
+		out = append(out, apiRequestLog{
+			ID:         l.ID,
+			Method:     l.Method,
+			Path:       l.Path,
+			StatusCode: l.StatusCode,
+			DurationMs: ms(l.Duration),
+			Domain:     l.Domain,
+			CreatedAt:  l.CreatedAt,
+			RemoteIP:   l.RemoteIP,
+			TLSVersion: l.TLSVersion,
+			ALPN:       l.ALPN,
+			TunnelName: l.TunnelName,
+			Labels:     l.Labels,
+			Region:     l.Region,
+			Latency:    latency,
+
+			LocalStatus:   l.LocalStatus,
+			ClientVersion: l.ClientVersion,
+		})
+	}
+	return out
+}
+
+// registerAPIRoutes adds the JSON endpoints under /api/dashboard
+func (h *Handler) registerAPIRoutes() {
+	h.mux.HandleFunc("GET "+apiPrefix, h.requireAuth(h.handleAPIOverview))
+	h.mux.HandleFunc("GET "+apiPrefix+"/usage", h.requireAuth(h.handleAPIUsage))
+	h.mux.HandleFunc("GET "+apiPrefix+"/usage/domains", h.requireAuth(h.handleUsageByDomain))
+	h.mux.HandleFunc("GET "+apiPrefix+"/usage/daily", h.requireAuth(h.handleDailyUsage))
+	h.mux.HandleFunc("GET "+apiPrefix+"/domains", h.requireAuth(h.handleAPIDomains))
+	h.mux.HandleFunc("PUT "+apiPrefix+"/domains/{id}/schedule", h.requireAuth(h.handleAPIDomainSchedule))
+	h.mux.HandleFunc("PUT "+apiPrefix+"/domains/{id}/sampling", h.requireAuth(h.handleAPIDomainSampling))
+	h.mux.HandleFunc("PUT "+apiPrefix+"/domains/{id}/headers", h.requireAuth(h.handleAPIDomainHeaders))
+	h.mux.HandleFunc("PUT "+apiPrefix+"/domains/{id}/https", h.requireAuth(h.handleAPIDomainHTTPS))
+	h.mux.HandleFunc("GET "+apiPrefix+"/grants", h.requireAuth(h.handleAPIGrants))
+	h.mux.HandleFunc("POST "+apiPrefix+"/domains/{id}/grants", h.requireAuth(h.handleAPIGrantDomain))
+	h.mux.HandleFunc("DELETE "+apiPrefix+"/domains/{id}/grants/{user}", h.requireAuth(h.handleAPIRevokeDomain))
+	h.mux.HandleFunc("GET "+apiPrefix+"/members", h.requireAuth(h.handleAPIMembers))
+	h.mux.HandleFunc("GET "+apiPrefix+"/tokens", h.requireAuth(h.handleAPITokens))
+	h.mux.HandleFunc("GET "+apiPrefix+"/logs", h.requireAuth(h.handleAPILogs))
+	h.mux.HandleFunc("GET "+apiPrefix+"/analytics/clients", h.requireAuth(h.handleAPIClientStats))
+	h.mux.HandleFunc("GET "+apiPrefix+"/tunnels", h.requireAuth(h.handleTunnels))
+	h.mux.HandleFunc("GET "+apiPrefix+"/tunnels/{name}", h.requireAuth(h.handleTunnel))
+	h.mux.HandleFunc("GET "+apiPrefix+"/events", h.requireAuth(h.handleEvents))
+	h.mux.HandleFunc("GET "+apiPrefix+"/account", h.requireAuth(h.handleAPIAccount))
+	h.mux.HandleFunc("PUT "+apiPrefix+"/account/region", h.requireAuth(h.handleAPIAccountRegion))
+	h.mux.HandleFunc("GET "+apiPrefix+"/preferences", h.requireAuth(h.handleAPIPreferences))
+	h.mux.HandleFunc("PUT "+apiPrefix+"/preferences", h.requireAuth(h.handleAPIPutPreferences))
+	h.mux.HandleFunc("GET "+apiPrefix+"/alerts", h.requireAuth(h.handleAPIAlerts))
+	h.mux.HandleFunc("POST "+apiPrefix+"/alerts", h.requireAuth(h.handleAPICreateAlert))
+	h.mux.HandleFunc("DELETE "+apiPrefix+"/alerts/{id}", h.requireAuth(h.handleAPIDeleteAlert))
+	h.mux.HandleFunc("GET "+apiPrefix+"/export", h.requireAuth(h.handleAPIExport))
+	h.mux.HandleFunc("PUT "+apiPrefix+"/export", h.requireAuth(h.handleAPIPutExport))
+	h.mux.HandleFunc("DELETE "+apiPrefix+"/export", h.requireAuth(h.handleAPIDeleteExport))
+	h.mux.HandleFunc("GET "+apiPrefix+"/github", h.requireAuth(h.handleAPIGitHub))
+	h.mux.HandleFunc("PUT "+apiPrefix+"/github", h.requireAuth(h.handleAPIPutGitHub))
+	h.mux.HandleFunc("DELETE "+apiPrefix+"/github", h.requireAuth(h.handleAPIDeleteGitHub))
+	h.mux.HandleFunc("GET "+apiPrefix+"/onboarding", h.requireAuth(h.handleOnboardingStatus))
+}
+
+// wantsJSON reports whether a request should get JSON instead of HTML, either
+// because it targets /api/dashboard or because it asks for application/json
+func wantsJSON(r *http.Request) bool {
+	if r.URL.Path == apiPrefix || strings.HasPrefix(r.URL.Path, apiPrefix+"/") {
+		return true
+	}
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err == nil && mediaType == "application/json" {
+			return true
+		}
+	}
+	return false
+}
+
+// writeJSONError writes {"error": msg} with the given status
+func writeJSONError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "{\"error\":%q}\n", msg)
+}
+
+// handleAPIOverview returns the data behind the main dashboard page
+func (h *Handler) handleAPIOverview(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userContextKey).(*User)
+
+	writeJSON(w, map[string]any{
+		"user":        toAPIUser(user),
+		"usage":       h.getUserUsage(r.Context(), user),
+		"domains":     toAPIDomains(h.getUserDomains(r.Context(), user.ID)),
+		"recent_logs": toAPIRequestLogs(h.getRecentLogs(r.Context(), user.ID, 10)),
+		"tunnels":     toAPITunnels(h.userTunnels(user.ID)),
+	})
+}
+
+// handleAPIUsage returns the usage summary with per-domain and per-day breakdowns.
+// ?days=N selects the daily window (default 30).
+func (h *Handler) handleAPIUsage(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userContextKey).(*User)
+
+	days := 30
+	if v := r.URL.Query().Get("days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > billing.MaxUsageDays {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("days must be between 1 and %d", billing.MaxUsageDays))
+			return
+		}
+		days = n
+	}
+
+	byDomain, err := h.usage.GetUsageByDomain(r.Context(), user.ID)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "usage unavailable")
+		return
+	}
+	daily, err := h.usage.GetDailyUsage(r.Context(), user.ID, days)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "usage unavailable")
+		return
+	}
+	if byDomain == nil {
+		byDomain = []billing.DomainUsage{}
+	}
+	if daily == nil {
+		daily = []billing.DailyUsage{}
+	}
+
+	writeJSON(w, map[string]any{
+		"summary":   h.getUserUsage(r.Context(), user),
+		"by_domain": byDomain,
+		"daily":     daily,
+	})
+}
+
+// handleAPIDomains returns a page of the user's registered domains, by
+// name unless ?sort= says otherwise. ?q= and ?verified= filter them.
+func (h *Handler) handleAPIDomains(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userContextKey).(*User)
+
+	page, ok := listPage(w, r, domainList, h.getUserDomains(r.Context(), user.ID))
+	if !ok {
+		return
+	}
+	writeJSON(w, pageBody("domains", toAPIDomains(page.Items), page.Next))
+}
+
+// handleAPITokens returns a page of the user's CLI tokens, newest first
+// unless ?sort= says otherwise. ?q= filters them by name.
+func (h *Handler) handleAPITokens(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userContextKey).(*User)
+
+	tokens, err := h.stores.Tokens.ListTokens(r.Context(), user.ID)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "load tokens failed")
+		return
+	}
+	page, ok := listPage(w, r, tokenList, tokens)
+	if !ok {
+		return
+	}
+	writeJSON(w, pageBody("tokens", toAPITokens(page.Items), page.Next))
+}
+
+// handleAPILogs returns a page of the user's recent requests, newest first
+// unless ?sort= says otherwise. ?domain=, ?method=, ?status= (such as 404
+// or 5xx), ?tunnel= and ?path= filter them.
+func (h *Handler) handleAPILogs(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userContextKey).(*User)
+
+	page, ok := listPage(w, r, logList, h.getRecentLogs(r.Context(), user.ID, logsListWindow))
+	if !ok {
+		return
+	}
+	writeJSON(w, pageBody("logs", toAPIRequestLogs(page.Items), page.Next))
+}
+
+// handleAPIClientStats breaks the user's requests down by the client
+// version that served them, with how often the local server failed and how
+// long it took. ?days=N selects the window (default 7).
+func (h *Handler) handleAPIClientStats(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userContextKey).(*User)
+
+	days := 7
+	if v := r.URL.Query().Get("days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > billing.MaxUsageDays {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("days must be between 1 and %d", billing.MaxUsageDays))
+			return
+		}
+		days = n
+	}
+
+	stats, err := h.stores.Usage.ClientStats(r.Context(), user.ID, time.Now().AddDate(0, 0, -days))
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "analytics unavailable")
+		return
+	}
+	if stats == nil {
+		stats = []store.ClientStats{}
+	}
+	writeJSON(w, map[string]any{
+		"days":    days,
+		"clients": stats,
+	})
+}
+
+// handleAPIAccount returns the account page data: profile, usage, billing,
+// linked identities and recent audit entries
+func (h *Handler) handleAPIAccount(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userContextKey).(*User)
+	details, preview := h.getAccountBilling(r.Context(), user)
+	identities, _ := h.stores.Accounts.ListIdentities(r.Context(), user.ID)
+	auditLog, _ := h.stores.Audit.ListAudit(r.Context(), user.ID, auditLogLimit)
+
+	writeJSON(w, map[string]any{
+		"user":             toAPIUser(user),
+		"usage":            h.getUserUsage(r.Context(), user),
+		"billing_details":  details,
+		"upcoming_invoice": preview,
+		"identities":       toAPIIdentities(identities),
+		"audit_log":        toAPIAuditLog(auditLog),
+	})
+}
+
+// handleAPIAccountRegion changes where the user's request logs are kept
+func (h *Handler) handleAPIAccountRegion(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userContextKey).(*User)
+
+	var req struct {
+		Region string `json:"region"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	if err := checkDataRegion(req.Region); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := h.setDataRegion(r, user, req.Region); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "save data region failed")
+		return
+	}
+	updated := *user
+	updated.DataRegion = req.Region
+	writeJSON(w, map[string]any{"user": toAPIUser(&updated)})
+}
+
+// handleAPIPreferences returns the user's preferences
+func (h *Handler) handleAPIPreferences(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userContextKey).(*User)
+
+	p, err := h.stores.Accounts.Preferences(r.Context(), user.ID)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "load preferences failed")
+		return
+	}
+	writeJSON(w, map[string]any{"preferences": apiPreferences{user.DataRegion, p.Inspect, p.LogRetentionDays, p.BurstLimit}})
+}
+
+// handleAPIPutPreferences changes the user's preferences. Fields left out
+// of the body keep their values; a new region moves the user's request logs.
+func (h *Handler) handleAPIPutPreferences(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userContextKey).(*User)
+
+	p, err := h.stores.Accounts.Preferences(r.Context(), user.ID)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "load preferences failed")
+		return
+	}
+	req := apiPreferences{user.DataRegion, p.Inspect, p.LogRetentionDays, p.BurstLimit}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	p = store.Preferences{Inspect: req.Inspect, LogRetentionDays: req.LogRetentionDays, BurstLimit: strings.TrimSpace(req.BurstLimit)}
+	if err := checkDataRegion(req.Region); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := checkPreferences(p); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := h.setDataRegion(r, user, req.Region); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "save data region failed")
+		return
+	}
+	if err := h.setPreferences(r, user, p); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "save preferences failed")
+		return
+	}
+	writeJSON(w, map[string]any{"preferences": apiPreferences{req.Region, p.Inspect, p.LogRetentionDays, p.BurstLimit}})
+}
@@ -0,0 +1,238 @@
+// web/dashboard/api_test.go
+package dashboard
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lobber-dev/lobber/internal/ratelimit"
+	"github.com/lobber-dev/lobber/internal/store"
+)
+
+func TestWantsJSON(t *testing.T) {
+	tests := []struct {
+		path   string
+		accept string
+		want   bool
+	}{
+		{"/dashboard", "", false},
+		{"/dashboard", "text/html,application/xhtml+xml,*/*;q=0.8", false},
+		{"/dashboard", "application/json", true},
+		{"/dashboard/logs", "text/html, application/json; q=0.9", true},
+		{"/api/dashboard", "", true},
+		{"/api/dashboard/usage", "text/html", true},
+		{"/api/dashboardx", "", false},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", tt.path, nil)
+		if tt.accept != "" {
+			req.Header.Set("Accept", tt.accept)
+		}
+		if got := wantsJSON(req); got != tt.want {
+			t.Errorf("wantsJSON(%s, %q) = %v, want %v", tt.path, tt.accept, got, tt.want)
+		}
+	}
+}
+
+func TestDashboardJSONEndpoints(t *testing.T) {
+	h, mem, cookie := newTestHandler(t)
+	h.SetUsageService(&fakeUsageService{})
+	created := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	mem.AddDomain("user-1", store.Domain{ID: "d1", Name: "app.example.com", Verified: true, CreatedAt: created})
+	mem.AddRequestLog("user-1", store.RequestLog{ID: "r1", Method: "GET", Path: "/", StatusCode: 200, Duration: 1500 * time.Microsecond, Domain: "app.example.com", CreatedAt: created, RemoteIP: "203.0.113.7", TLSVersion: "TLS 1.3", ALPN: "h2", Labels: map[string]string{"env": "staging"}})
+	mem.LogRequest(context.Background(), "app.example.com", store.RequestLog{Method: "GET", Path: "/down", StatusCode: 502, LocalStatus: 0, ClientVersion: "0.1.0", Latency: store.Latency{Local: 4 * time.Millisecond}})
+	mem.LogRequest(context.Background(), "app.example.com", store.RequestLog{Method: "GET", Path: "/named", StatusCode: 200, TunnelName: "checkout"})
+	mem.StartTunnelSession(context.Background(), "app.example.com", "checkout")
+	mem.RecordEvent(context.Background(), store.Event{UserID: "user-1", Type: "tunnel.connected", Hostname: "app.example.com", Message: "Tunnel checkout connected"})
+	mem.CreateToken(context.Background(), "user-1", "laptop", "hash")
+	h.SetTunnelLister(func(string) []Tunnel {
+		return []Tunnel{{Hostname: "app.example.com", Labels: map[string]string{"service": "api"}}}
+	})
+
+	tests := []struct {
+		name   string
+		path   string
+		accept string
+		status int
+		keys   []string
+		body   string
+	}{
+		{"overview", "/api/dashboard", "", http.StatusOK, []string{"user", "usage", "domains", "recent_logs"}, `"email":"dev@example.com"`},
+		{"overview via accept", "/dashboard", "application/json", http.StatusOK, []string{"user", "usage", "domains", "recent_logs"}, `"limit_bytes":5368709120`},
+		{"overview tunnels", "/api/dashboard", "", http.StatusOK, []string{"tunnels"}, `"tunnels":[{"hostname":"app.example.com","labels":{"service":"api"}}]`},
+		{"usage", "/api/dashboard/usage?days=7", "", http.StatusOK, []string{"summary", "by_domain", "daily"}, `"domain":"app.example.com"`},
+		{"usage invalid days", "/api/dashboard/usage?days=0", "", http.StatusBadRequest, []string{"error"}, "days must be"},
+		{"domains", "/api/dashboard/domains", "", http.StatusOK, []string{"domains"}, `"verified":true`},
+		{"domains via accept", "/dashboard/domains", "application/json", http.StatusOK, []string{"domains"}, `"name":"app.example.com"`},
+		{"domains filtered", "/api/dashboard/domains?verified=false", "", http.StatusOK, []string{"domains"}, `"domains":[]`},
+		{"tokens", "/api/dashboard/tokens?q=LAP", "", http.StatusOK, []string{"tokens"}, `"name":"laptop"`},
+		{"logs", "/api/dashboard/logs?limit=5", "", http.StatusOK, []string{"logs"}, `"duration_ms":1.5`},
+		{"logs client", "/api/dashboard/logs", "", http.StatusOK, []string{"logs"}, `"remote_ip":"203.0.113.7","tls_version":"TLS 1.3","alpn":"h2"`},
+		{"logs labels", "/api/dashboard/logs", "", http.StatusOK, []string{"logs"}, `"labels":{"env":"staging"}`},
+		{"logs tunnel name", "/api/dashboard/logs", "", http.StatusOK, []string{"logs"}, `"tunnel_name":"checkout"`},
+		{"logs client version", "/api/dashboard/logs", "", http.StatusOK, []string{"logs"}, `"client_version":"0.1.0"`},
+		{"logs by status class", "/api/dashboard/logs?status=5xx", "", http.StatusOK, []string{"logs"}, `"path":"/down"`},
+		{"logs invalid sort", "/api/dashboard/logs?sort=size", "", http.StatusBadRequest, []string{"error"}, "sort must be one of"},
+		{"client stats", "/api/dashboard/analytics/clients?days=30", "", http.StatusOK, []string{"days", "clients"}, `{"client_version":"0.1.0","requests":1,"local_errors":1,"avg_local_ms":4}`},
+		{"client stats invalid days", "/api/dashboard/analytics/clients?days=x", "", http.StatusBadRequest, []string{"error"}, "days must be"},
+		{"tunnel history", "/api/dashboard/tunnels", "", http.StatusOK, []string{"tunnels"}, `"name":"checkout","hostnames":["app.example.com"],"sessions":1`},
+		{"tunnel sessions", "/api/dashboard/tunnels/checkout", "", http.StatusOK, []string{"name", "sessions", "errors"}, `"hostname":"app.example.com"`},
+		{"tunnel sessions by hostname", "/api/dashboard/tunnels/checkout?hostname=other.example.com", "", http.StatusOK, []string{"name", "sessions"}, `"sessions":[]`},
+		{"unknown tunnel", "/api/dashboard/tunnels/nope", "", http.StatusNotFound, []string{"error"}, "tunnel not found"},
+		{"events", "/api/dashboard/events", "", http.StatusOK, []string{"events"}, `"id":1,"type":"tunnel.connected","hostname":"app.example.com"`},
+		{"events after", "/api/dashboard/events?after=1", "", http.StatusOK, []string{"events"}, `"events":[]`},
+		{"events invalid after", "/api/dashboard/events?after=x", "", http.StatusBadRequest, []string{"error"}, "after must be"},
+		{"events by type", "/api/dashboard/events?type=domain.verified", "", http.StatusOK, []string{"events"}, `"events":[]`},
+		{"events invalid cursor", "/api/dashboard/events?cursor=x", "", http.StatusBadRequest, []string{"error"}, "invalid cursor"},
+		{"logs invalid limit", "/api/dashboard/logs?limit=abc", "", http.StatusBadRequest, []string{"error"}, "limit must be"},
+		{"account", "/api/dashboard/account", "", http.StatusOK, []string{"user", "usage", "billing_details", "upcoming_invoice"}, `"plan":"free"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.path, nil)
+			req.AddCookie(cookie)
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d (body %q)", rec.Code, tt.status, rec.Body.String())
+			}
+			if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+				t.Errorf("Content-Type = %q, want application/json", ct)
+			}
+
+			var got map[string]json.RawMessage
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatalf("decode body: %v", err)
+			}
+			for _, key := range tt.keys {
+				if _, ok := got[key]; !ok {
+					t.Errorf("response missing %q: %s", key, rec.Body.String())
+				}
+			}
+			if !strings.Contains(rec.Body.String(), tt.body) {
+				t.Errorf("body = %q, want it to contain %q", rec.Body.String(), tt.body)
+			}
+			if strings.Contains(rec.Body.String(), "stripe") {
+				t.Errorf("body leaks Stripe fields: %s", rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestDashboardListPages(t *testing.T) {
+	h, mem, cookie := newTestHandler(t)
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	for i := range 5 {
+		mem.AddRequestLog("user-1", store.RequestLog{ID: fmt.Sprintf("r%d", i), Method: "GET", Path: "/", StatusCode: 200, CreatedAt: start.Add(time.Duration(i) * time.Minute)})
+	}
+
+	var ids []string
+	next := ""
+	for pages := 1; ; pages++ {
+		req := httptest.NewRequest("GET", "/api/dashboard/logs?limit=2&cursor="+next, nil)
+		req.AddCookie(cookie)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		var body struct {
+			Logs []struct {
+				ID string `json:"id"`
+			} `json:"logs"`
+			NextCursor string `json:"next_cursor"`
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&body); err != nil || rec.Code != http.StatusOK {
+			t.Fatalf("page %d = %d, %v", pages, rec.Code, err)
+		}
+		for _, l := range body.Logs {
+			ids = append(ids, l.ID)
+		}
+		if next = body.NextCursor; next == "" {
+			break
+		}
+		if pages > 3 {
+			t.Fatal("more pages than logs")
+		}
+	}
+	if got := strings.Join(ids, ","); got != "r4,r3,r2,r1,r0" {
+		t.Errorf("logs across pages = %s, want r4,r3,r2,r1,r0", got)
+	}
+}
+
+func TestDashboardAPIQuota(t *testing.T) {
+	h, _, cookie := newTestHandler(t)
+	h.SetAPIQuota(ratelimit.NewQuota(ratelimit.NewMemory(), "api", ratelimit.QuotaPolicy{Window: time.Hour, Default: 1}))
+
+	get := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.AddCookie(cookie)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := get("/api/dashboard/preferences"); rec.Code != http.StatusOK || rec.Header().Get("X-RateLimit-Limit") != "1" {
+		t.Fatalf("first call = %d %v, want 200 with rate limit headers", rec.Code, rec.Header())
+	}
+	if rec := get("/api/dashboard/preferences"); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("second call status = %d, want 429", rec.Code)
+	}
+	// Pages don't count against the quota
+	if rec := get("/dashboard/account"); rec.Code != http.StatusOK || rec.Header().Get("X-RateLimit-Limit") != "" {
+		t.Errorf("page = %d %v, want 200 without rate limit headers", rec.Code, rec.Header())
+	}
+}
+
+func TestDashboardJSONAuth(t *testing.T) {
+	h, _, _ := newTestHandler(t)
+
+	tests := []struct {
+		name   string
+		path   string
+		accept string
+		auth   string
+		cookie string
+		status int
+	}{
+		{"api without session", "/api/dashboard/usage", "", "", "", http.StatusUnauthorized},
+		{"page asking for json", "/dashboard/logs", "application/json", "", "", http.StatusUnauthorized},
+		{"bearer token", "/api/dashboard/domains", "", "Bearer token-1", "", http.StatusOK},
+		{"bearer token with a stale cookie", "/api/dashboard/domains", "", "Bearer token-1", "expired", http.StatusOK},
+		{"bad bearer token", "/api/dashboard/domains", "", "Bearer nope", "", http.StatusUnauthorized},
+		{"html page still redirects", "/dashboard/logs", "text/html", "", "", http.StatusSeeOther},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.path, nil)
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+			if tt.auth != "" {
+				req.Header.Set("Authorization", tt.auth)
+			}
+			if tt.cookie != "" {
+				req.AddCookie(&http.Cookie{Name: "session", Value: tt.cookie})
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != tt.status {
+				t.Errorf("status = %d, want %d", rec.Code, tt.status)
+			}
+			if tt.status == http.StatusUnauthorized && !strings.Contains(rec.Body.String(), `"error"`) {
+				t.Errorf("body = %q, want a JSON error", rec.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,509 @@
+// web/dashboard/domains.go
+package dashboard
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/lobber-dev/lobber/internal/dnsname"
+	"github.com/lobber-dev/lobber/internal/events"
+	"github.com/lobber-dev/lobber/internal/forcehttps"
+	"github.com/lobber-dev/lobber/internal/respheader"
+	"github.com/lobber-dev/lobber/internal/sampling"
+	"github.com/lobber-dev/lobber/internal/schedule"
+	"github.com/lobber-dev/lobber/internal/store"
+)
+
+// DomainVerifier checks that a hostname's DNS points at the relay
+type DomainVerifier func(hostname string) error
+
+// domainRow is the data for the "domain-row" template
+type domainRow struct {
+	Domain
+	VerifyError   string
+	ScheduleError string
+	SamplingError string
+	HeadersError  string
+	HTTPSError    string
+}
+
+// newDomainRow wraps a domain for the "domain-row" template
+func newDomainRow(d Domain) domainRow {
+	return domainRow{Domain: d}
+}
+
+// SetDomainVerifier sets the DNS check run by the "verify now" button
+func (h *Handler) SetDomainVerifier(v DomainVerifier) {
+	h.verifyDomain = v
+}
+
+// isHTMX reports whether the request came from an HTMX action
+func isHTMX(r *http.Request) bool {
+	return r.Header.Get("HX-Request") == "true"
+}
+
+// handleAddDomain registers a new hostname and re-renders the domain list,
+// which shows the CNAME instructions for the pending domain
+func (h *Handler) handleAddDomain(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userContextKey).(*User)
+
+	hostname, err := normalizeDomain(r.PostFormValue("domain"))
+	if err == nil {
+		_, err = h.stores.Domains.CreateDomain(r.Context(), user.ID, hostname)
+	}
+	if err != nil {
+		h.writeDomainError(w, r, hostname, err)
+		return
+	}
+
+	if !isHTMX(r) {
+		http.Redirect(w, r, "/dashboard/domains", http.StatusSeeOther)
+		return
+	}
+
+	h.render(w, "domain-added", map[string]interface{}{
+		"Domains": h.getUserDomains(r.Context(), user.ID),
+	})
+}
+
+// writeDomainError reports a failed add. HTMX requests get a fragment swapped
+// into the form's error slot; plain form posts get a 400.
+func (h *Handler) writeDomainError(w http.ResponseWriter, r *http.Request, hostname string, err error) {
+	status, msg := http.StatusBadRequest, err.Error()
+	switch {
+	case errors.Is(err, store.ErrDomainTaken):
+		msg = fmt.Sprintf("%s is already registered", hostname)
+	case errors.Is(err, errInvalidDomain):
+	default:
+		log.Printf("add domain %s: %v", hostname, err)
+		status, msg = http.StatusInternalServerError, "could not add domain, try again"
+	}
+
+	if !isHTMX(r) {
+		http.Error(w, msg, status)
+		return
+	}
+	// HTMX only swaps 2xx responses, so retarget the error instead
+	w.Header().Set("HX-Retarget", "#domain-error")
+	w.Header().Set("HX-Reswap", "innerHTML")
+	h.render(w, "domain-error", msg)
+}
+
+// handleVerifyDomain runs the CNAME check for a pending domain and re-renders its row
+func (h *Handler) handleVerifyDomain(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userContextKey).(*User)
+
+	d, err := h.stores.Domains.GetDomain(r.Context(), user.ID, r.PathValue("id"))
+	if errors.Is(err, store.ErrNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, "domain unavailable", http.StatusInternalServerError)
+		return
+	}
+
+	row := newDomainRow(*d)
+	if !d.Verified {
+		if err := h.checkDomain(d.Name); err != nil {
+			row.VerifyError = err.Error()
+		} else if err := h.stores.Domains.MarkDomainVerified(r.Context(), user.ID, d.ID); err != nil {
+			log.Printf("mark domain %s verified: %v", d.Name, err)
+			row.VerifyError = "verified, but saving failed; try again"
+		} else {
+			row.Verified = true
+			h.events.Publish(r.Context(), store.Event{
+				UserID:   user.ID,
+				Type:     events.DomainVerified,
+				Hostname: d.Name,
+				Message:  "Domain verified",
+			})
+		}
+	}
+
+	if !isHTMX(r) {
+		http.Redirect(w, r, "/dashboard/domains", http.StatusSeeOther)
+		return
+	}
+	h.render(w, "domain-row", row)
+}
+
+// handleDomainSchedule sets or, given an empty schedule, clears the hours a
+// domain is available and re-renders its row
+func (h *Handler) handleDomainSchedule(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userContextKey).(*User)
+
+	d, err := h.stores.Domains.GetDomain(r.Context(), user.ID, r.PathValue("id"))
+	if errors.Is(err, store.ErrNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, "domain unavailable", http.StatusInternalServerError)
+		return
+	}
+
+	row := newDomainRow(*d)
+	text, err := normalizeSchedule(r.PostFormValue("schedule"))
+	if err != nil {
+		if !isHTMX(r) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		row.ScheduleError = err.Error()
+	} else if err := h.stores.Domains.SetDomainSchedule(r.Context(), user.ID, d.ID, text); err != nil {
+		log.Printf("set schedule for %s: %v", d.Name, err)
+		row.ScheduleError = "saving failed; try again"
+	} else {
+		row.Schedule = text
+	}
+
+	if !isHTMX(r) {
+		http.Redirect(w, r, "/dashboard/domains", http.StatusSeeOther)
+		return
+	}
+	h.render(w, "domain-row", row)
+}
+
+// handleAPIDomainSchedule sets a domain's schedule from {"schedule": "..."}
+// and returns the domain
+func (h *Handler) handleAPIDomainSchedule(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userContextKey).(*User)
+
+	var body struct {
+		Schedule string `json:"schedule"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&body); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	text, err := normalizeSchedule(body.Schedule)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	d, err := h.stores.Domains.GetDomain(r.Context(), user.ID, r.PathValue("id"))
+	if err == nil {
+		err = h.stores.Domains.SetDomainSchedule(r.Context(), user.ID, d.ID, text)
+	}
+	if errors.Is(err, store.ErrNotFound) {
+		writeJSONError(w, http.StatusNotFound, "domain not found")
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "save schedule failed")
+		return
+	}
+	d.Schedule = text
+	writeJSON(w, toAPIDomains([]Domain{*d})[0])
+}
+
+// normalizeSchedule checks a schedule such as "Mon-Fri 09:00-18:00
+// Europe/London" and returns it with spacing normalized. Blank means
+// always available.
+func normalizeSchedule(raw string) (string, error) {
+	if strings.TrimSpace(raw) == "" {
+		return "", nil
+	}
+	sched, err := schedule.Parse(raw)
+	if err != nil {
+		return "", err
+	}
+	return sched.String(), nil
+}
+
+// handleDomainSampling sets which of a domain's requests its request log
+// keeps and re-renders its row
+func (h *Handler) handleDomainSampling(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userContextKey).(*User)
+
+	d, err := h.stores.Domains.GetDomain(r.Context(), user.ID, r.PathValue("id"))
+	if errors.Is(err, store.ErrNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, "domain unavailable", http.StatusInternalServerError)
+		return
+	}
+
+	row := newDomainRow(*d)
+	text, err := normalizeSampling(r.PostFormValue("sampling"))
+	if err != nil {
+		if !isHTMX(r) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		row.SamplingError = err.Error()
+	} else if err := h.stores.Domains.SetDomainSampling(r.Context(), user.ID, d.ID, text); err != nil {
+		log.Printf("set sampling for %s: %v", d.Name, err)
+		row.SamplingError = "saving failed; try again"
+	} else {
+		row.Sampling = text
+	}
+
+	if !isHTMX(r) {
+		http.Redirect(w, r, "/dashboard/domains", http.StatusSeeOther)
+		return
+	}
+	h.render(w, "domain-row", row)
+}
+
+// handleAPIDomainSampling sets a domain's sampling policy from
+// {"sampling": "..."} and returns the domain
+func (h *Handler) handleAPIDomainSampling(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userContextKey).(*User)
+
+	var body struct {
+		Sampling string `json:"sampling"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&body); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	text, err := normalizeSampling(body.Sampling)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	d, err := h.stores.Domains.GetDomain(r.Context(), user.ID, r.PathValue("id"))
+	if err == nil {
+		err = h.stores.Domains.SetDomainSampling(r.Context(), user.ID, d.ID, text)
+	}
+	if errors.Is(err, store.ErrNotFound) {
+		writeJSONError(w, http.StatusNotFound, "domain not found")
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "save sampling failed")
+		return
+	}
+	d.Sampling = text
+	writeJSON(w, toAPIDomains([]Domain{*d})[0])
+}
+
+// normalizeSampling checks a sampling policy such as "errors, 1%" and
+// returns it with spacing normalized. Blank and "all" both mean every
+// request is logged, and are stored as blank.
+func normalizeSampling(raw string) (string, error) {
+	if raw = strings.TrimSpace(raw); raw == "" || strings.EqualFold(raw, "all") {
+		return "", nil
+	}
+	policy, err := sampling.Parse(raw)
+	if err != nil {
+		return "", err
+	}
+	return policy.String(), nil
+}
+
+// handleDomainHeaders sets the headers added to a domain's responses and
+// re-renders its row
+func (h *Handler) handleDomainHeaders(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userContextKey).(*User)
+
+	d, err := h.stores.Domains.GetDomain(r.Context(), user.ID, r.PathValue("id"))
+	if errors.Is(err, store.ErrNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, "domain unavailable", http.StatusInternalServerError)
+		return
+	}
+
+	row := newDomainRow(*d)
+	text, err := normalizeHeaders(r.PostFormValue("headers"))
+	if err != nil {
+		if !isHTMX(r) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		row.HeadersError = err.Error()
+	} else if err := h.stores.Domains.SetDomainHeaders(r.Context(), user.ID, d.ID, text); err != nil {
+		log.Printf("set headers for %s: %v", d.Name, err)
+		row.HeadersError = "saving failed; try again"
+	} else {
+		row.Headers = text
+	}
+
+	if !isHTMX(r) {
+		http.Redirect(w, r, "/dashboard/domains", http.StatusSeeOther)
+		return
+	}
+	h.render(w, "domain-row", row)
+}
+
+// handleAPIDomainHeaders sets the headers added to a domain's responses
+// from {"headers": "Name: value\n..."} and returns the domain
+func (h *Handler) handleAPIDomainHeaders(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userContextKey).(*User)
+
+	var body struct {
+		Headers string `json:"headers"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&body); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	text, err := normalizeHeaders(body.Headers)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	d, err := h.stores.Domains.GetDomain(r.Context(), user.ID, r.PathValue("id"))
+	if err == nil {
+		err = h.stores.Domains.SetDomainHeaders(r.Context(), user.ID, d.ID, text)
+	}
+	if errors.Is(err, store.ErrNotFound) {
+		writeJSONError(w, http.StatusNotFound, "domain not found")
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "save headers failed")
+		return
+	}
+	d.Headers = text
+	writeJSON(w, toAPIDomains([]Domain{*d})[0])
+}
+
+// normalizeHeaders checks response headers, one "Name: value" per line,
+// and returns them with names canonicalized. Blank adds none.
+func normalizeHeaders(raw string) (string, error) {
+	if strings.TrimSpace(raw) == "" {
+		return "", nil
+	}
+	set, err := respheader.Parse(raw)
+	if err != nil {
+		return "", err
+	}
+	return set.String(), nil
+}
+
+// handleDomainHTTPS sets how a domain's visitors are kept on HTTPS and
+// re-renders its row
+func (h *Handler) handleDomainHTTPS(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userContextKey).(*User)
+
+	d, err := h.stores.Domains.GetDomain(r.Context(), user.ID, r.PathValue("id"))
+	if errors.Is(err, store.ErrNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, "domain unavailable", http.StatusInternalServerError)
+		return
+	}
+
+	row := newDomainRow(*d)
+	text, err := normalizeHTTPS(r.PostFormValue("https"))
+	if err != nil {
+		if !isHTMX(r) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		row.HTTPSError = err.Error()
+	} else if err := h.stores.Domains.SetDomainHTTPS(r.Context(), user.ID, d.ID, text); err != nil {
+		log.Printf("set https for %s: %v", d.Name, err)
+		row.HTTPSError = "saving failed; try again"
+	} else {
+		row.HTTPS = text
+	}
+
+	if !isHTMX(r) {
+		http.Redirect(w, r, "/dashboard/domains", http.StatusSeeOther)
+		return
+	}
+	h.render(w, "domain-row", row)
+}
+
+// handleAPIDomainHTTPS sets how a domain's visitors are kept on HTTPS from
+// {"https": "redirect, hsts"} and returns the domain
+func (h *Handler) handleAPIDomainHTTPS(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userContextKey).(*User)
+
+	var body struct {
+		HTTPS string `json:"https"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<12)).Decode(&body); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	text, err := normalizeHTTPS(body.HTTPS)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	d, err := h.stores.Domains.GetDomain(r.Context(), user.ID, r.PathValue("id"))
+	if err == nil {
+		err = h.stores.Domains.SetDomainHTTPS(r.Context(), user.ID, d.ID, text)
+	}
+	if errors.Is(err, store.ErrNotFound) {
+		writeJSONError(w, http.StatusNotFound, "domain not found")
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "save HTTPS policy failed")
+		return
+	}
+	d.HTTPS = text
+	writeJSON(w, toAPIDomains([]Domain{*d})[0])
+}
+
+// normalizeHTTPS checks an HTTPS policy and returns it in its usual form.
+// Blank serves plain HTTP as it comes.
+func normalizeHTTPS(raw string) (string, error) {
+	if strings.TrimSpace(raw) == "" {
+		return "", nil
+	}
+	policy, err := forcehttps.Parse(raw)
+	if err != nil {
+		return "", err
+	}
+	return policy.String(), nil
+}
+
+// checkDomain runs the configured DNS check
+func (h *Handler) checkDomain(hostname string) error {
+	if h.verifyDomain == nil {
+		return fmt.Errorf("domain verification is unavailable")
+	}
+	return h.verifyDomain(hostname)
+}
+
+// handleDeleteDomain removes a domain. HTMX swaps the row out with the empty body.
+func (h *Handler) handleDeleteDomain(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userContextKey).(*User)
+
+	err := h.stores.Domains.DeleteDomain(r.Context(), user.ID, r.PathValue("id"))
+	if errors.Is(err, store.ErrNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, "delete domain failed", http.StatusInternalServerError)
+		return
+	}
+
+	if !isHTMX(r) {
+		http.Redirect(w, r, "/dashboard/domains", http.StatusSeeOther)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+var errInvalidDomain = dnsname.ErrInvalid
+
+// normalizeDomain lower-cases a hostname, converts IDN labels to punycode and
+// checks it is a valid DNS name with at least two labels,
+// e.g. "App.Example.com." -> "app.example.com"
+func normalizeDomain(raw string) (string, error) {
+	return dnsname.Normalize(raw)
+}
@@ -0,0 +1,495 @@
+// web/dashboard/domains_test.go
+package dashboard
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/lobber-dev/lobber/internal/events"
+	"github.com/lobber-dev/lobber/internal/store"
+)
+
+func TestNormalizeDomain(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    string
+		wantErr bool
+	}{
+		{"app.example.com", "app.example.com", false},
+		{"  App.Example.COM. ", "app.example.com", false},
+		{"my-app.example.co.uk", "my-app.example.co.uk", false},
+		{"Bücher.example.com", "xn--bcher-kva.example.com", false},
+		{"", "", true},
+		{"localhost", "", true},
+		{"-bad.example.com", "", true},
+		{"bad-.example.com", "", true},
+		{"app..example.com", "", true},
+		{"https://app.example.com", "", true},
+		{"app_1.example.com", "", true},
+		{strings.Repeat("a", 64) + ".example.com", "", true},
+	}
+
+	for _, tt := range tests {
+		got, err := normalizeDomain(tt.input)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("normalizeDomain(%q) error = %v, wantErr %v", tt.input, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("normalizeDomain(%q) = %q, want %q", tt.input, got, tt.want)
+		}
+	}
+}
+
+// domainRequest builds an authenticated HTMX request against the handler
+func domainRequest(method, target string, form url.Values, cookie *http.Cookie) *http.Request {
+	var req *http.Request
+	if form != nil {
+		req = httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		req = httptest.NewRequest(method, target, nil)
+	}
+	req.Header.Set("HX-Request", "true")
+	req.AddCookie(cookie)
+	return req
+}
+
+func TestAddDomain(t *testing.T) {
+	h, mem, cookie := newTestHandler(t)
+	mem.AddUser(store.User{ID: "user-2", Email: "other@example.com"})
+	mem.CreateDomain(context.Background(), "user-2", "taken.example.com")
+
+	tests := []struct {
+		name      string
+		domain    string
+		retarget  bool
+		body      string
+		wantCount int
+	}{
+		{"valid", "App.Example.com", false, "CNAME app.example.com", 1},
+		{"invalid", "bad_name.example.com", true, "letters, digits, hyphens", 1},
+		{"not qualified", "localhost", true, "fully qualified", 1},
+		{"taken by another user", "taken.example.com", true, "taken.example.com is already registered", 1},
+		{"duplicate", "app.example.com", true, "already registered", 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, domainRequest("POST", "/dashboard/domains/add", url.Values{"domain": {tt.domain}}, cookie))
+
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200", rec.Code)
+			}
+			if got := rec.Header().Get("HX-Retarget") != ""; got != tt.retarget {
+				t.Errorf("retargeted = %v, want %v", got, tt.retarget)
+			}
+			if !strings.Contains(rec.Body.String(), tt.body) {
+				t.Errorf("body = %q, want it to contain %q", rec.Body.String(), tt.body)
+			}
+			domains, _ := mem.ListDomains(context.Background(), "user-1")
+			if len(domains) != tt.wantCount {
+				t.Errorf("user has %d domains, want %d", len(domains), tt.wantCount)
+			}
+		})
+	}
+}
+
+func TestAddDomainWithoutHTMX(t *testing.T) {
+	h, _, cookie := newTestHandler(t)
+
+	req := domainRequest("POST", "/dashboard/domains/add", url.Values{"domain": {"app.example.com"}}, cookie)
+	req.Header.Del("HX-Request")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/dashboard/domains" {
+		t.Errorf("got %d to %q, want 303 to /dashboard/domains", rec.Code, rec.Header().Get("Location"))
+	}
+}
+
+func TestVerifyDomain(t *testing.T) {
+	tests := []struct {
+		name         string
+		verifier     DomainVerifier
+		wantVerified bool
+		body         string
+	}{
+		{"cname ok", func(string) error { return nil }, true, "Verified"},
+		{"cname wrong", func(string) error { return errors.New("CNAME points to elsewhere.net, expected tunnel.lobber.dev") }, false, "CNAME points to elsewhere.net"},
+		{"no verifier", nil, false, "verification is unavailable"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, mem, cookie := newTestHandler(t)
+			h.SetDomainVerifier(tt.verifier)
+			h.SetEvents(events.NewBus(mem))
+			d, _ := mem.CreateDomain(context.Background(), "user-1", "app.example.com")
+
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, domainRequest("POST", "/dashboard/domains/verify/"+d.ID, nil, cookie))
+
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200", rec.Code)
+			}
+			if !strings.Contains(rec.Body.String(), `id="domain-`+d.ID+`"`) {
+				t.Errorf("body = %q, want the domain row", rec.Body.String())
+			}
+			if !strings.Contains(rec.Body.String(), tt.body) {
+				t.Errorf("body = %q, want it to contain %q", rec.Body.String(), tt.body)
+			}
+			got, _ := mem.GetDomain(context.Background(), "user-1", d.ID)
+			if got.Verified != tt.wantVerified {
+				t.Errorf("Verified = %v, want %v", got.Verified, tt.wantVerified)
+			}
+			feed, _ := mem.ListEvents(context.Background(), "user-1", 0, 10)
+			if verified := len(feed) == 1 && feed[0].Type == events.DomainVerified; verified != tt.wantVerified {
+				t.Errorf("activity feed = %+v, want a domain.verified event: %v", feed, tt.wantVerified)
+			}
+		})
+	}
+}
+
+func TestDeleteDomain(t *testing.T) {
+	h, mem, cookie := newTestHandler(t)
+	mem.AddUser(store.User{ID: "user-2", Email: "other@example.com"})
+	mine, _ := mem.CreateDomain(context.Background(), "user-1", "app.example.com")
+	theirs, _ := mem.CreateDomain(context.Background(), "user-2", "other.example.com")
+
+	tests := []struct {
+		name   string
+		id     string
+		status int
+	}{
+		{"own domain", mine.ID, http.StatusOK},
+		{"already deleted", mine.ID, http.StatusNotFound},
+		{"another user's domain", theirs.ID, http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, domainRequest("DELETE", "/dashboard/domains/"+tt.id, nil, cookie))
+			if rec.Code != tt.status {
+				t.Errorf("status = %d, want %d", rec.Code, tt.status)
+			}
+		})
+	}
+
+	if _, err := mem.GetDomain(context.Background(), "user-2", theirs.ID); err != nil {
+		t.Errorf("other user's domain was deleted: %v", err)
+	}
+}
+
+func TestDomainSchedule(t *testing.T) {
+	h, mem, cookie := newTestHandler(t)
+	mem.AddUser(store.User{ID: "user-2", Email: "other@example.com"})
+	ctx := context.Background()
+	mine, _ := mem.CreateDomain(ctx, "user-1", "demo.example.com")
+	theirs, _ := mem.CreateDomain(ctx, "user-2", "other.example.com")
+
+	tests := []struct {
+		name     string
+		id       string
+		schedule string
+		status   int
+		want     string // stored schedule afterwards
+		wantBody string
+	}{
+		{"weekdays", mine.ID, "mon-fri  09:00-18:00 Europe/London", http.StatusOK, "mon-fri 09:00-18:00 Europe/London", "mon-fri 09:00-18:00 Europe/London"},
+		{"invalid hours", mine.ID, "Mon-Fri 9am-6pm", http.StatusOK, "mon-fri 09:00-18:00 Europe/London", "invalid"},
+		{"cleared", mine.ID, "", http.StatusOK, "", "Always available"},
+		{"another user's domain", theirs.ID, "Sat 10:00-14:00", http.StatusNotFound, "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, domainRequest("POST", "/dashboard/domains/schedule/"+tt.id, url.Values{"schedule": {tt.schedule}}, cookie))
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.status)
+			}
+			if !strings.Contains(rec.Body.String(), tt.wantBody) {
+				t.Errorf("body does not mention %q:\n%s", tt.wantBody, rec.Body.String())
+			}
+			if got, _ := mem.DomainSchedule(ctx, "demo.example.com"); got != tt.want {
+				t.Errorf("schedule = %q, want %q", got, tt.want)
+			}
+		})
+	}
+	if got, _ := mem.DomainSchedule(ctx, "other.example.com"); got != "" {
+		t.Errorf("other user's schedule = %q, want it untouched", got)
+	}
+}
+
+func TestAPIDomainSchedule(t *testing.T) {
+	h, mem, cookie := newTestHandler(t)
+	d, _ := mem.CreateDomain(context.Background(), "user-1", "demo.example.com")
+
+	do := func(id, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("PUT", "/api/dashboard/domains/"+id+"/schedule", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.AddCookie(cookie)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	tests := []struct {
+		name   string
+		id     string
+		body   string
+		status int
+	}{
+		{"set", d.ID, `{"schedule": "Mon-Fri 09:00-18:00"}`, http.StatusOK},
+		{"unknown zone", d.ID, `{"schedule": "Mon-Fri 09:00-18:00 Mars/Olympus"}`, http.StatusBadRequest},
+		{"malformed", d.ID, `{"schedule":`, http.StatusBadRequest},
+		{"missing domain", "nope", `{"schedule": ""}`, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rec := do(tt.id, tt.body); rec.Code != tt.status {
+				t.Errorf("status = %d, want %d (body %q)", rec.Code, tt.status, rec.Body.String())
+			}
+		})
+	}
+
+	rec := do(d.ID, `{"schedule": "Sat 10:00-14:00"}`)
+	var got apiDomain
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if got.Schedule != "Sat 10:00-14:00" || got.Name != "demo.example.com" {
+		t.Errorf("domain = %+v, want demo.example.com open Sat 10:00-14:00", got)
+	}
+}
+
+func TestDomainSampling(t *testing.T) {
+	h, mem, cookie := newTestHandler(t)
+	ctx := context.Background()
+	d, _ := mem.CreateDomain(ctx, "user-1", "demo.example.com")
+
+	tests := []struct {
+		name     string
+		sampling string
+		want     string // stored policy afterwards
+		wantBody string
+	}{
+		{"errors and a sample", "errors,  1%", "errors, 1%", "errors, 1%"},
+		{"invalid rate", "150%", "errors, 1%", "invalid sample rate"},
+		{"all", "ALL", "", "Log all requests"},
+		{"path", "path:/api/*", "path:/api/*", "path:/api/*"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, domainRequest("POST", "/dashboard/domains/sampling/"+d.ID, url.Values{"sampling": {tt.sampling}}, cookie))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+			}
+			if !strings.Contains(rec.Body.String(), tt.wantBody) {
+				t.Errorf("body does not mention %q:\n%s", tt.wantBody, rec.Body.String())
+			}
+			if got, _ := mem.DomainSampling(ctx, "demo.example.com"); got != tt.want {
+				t.Errorf("sampling = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAPIDomainSampling(t *testing.T) {
+	h, mem, cookie := newTestHandler(t)
+	d, _ := mem.CreateDomain(context.Background(), "user-1", "demo.example.com")
+
+	do := func(id, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("PUT", "/api/dashboard/domains/"+id+"/sampling", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.AddCookie(cookie)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	tests := []struct {
+		name   string
+		id     string
+		body   string
+		status int
+	}{
+		{"set", d.ID, `{"sampling": "errors"}`, http.StatusOK},
+		{"unknown rule", d.ID, `{"sampling": "sometimes"}`, http.StatusBadRequest},
+		{"relative path", d.ID, `{"sampling": "path:api/*"}`, http.StatusBadRequest},
+		{"missing domain", "nope", `{"sampling": ""}`, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rec := do(tt.id, tt.body); rec.Code != tt.status {
+				t.Errorf("status = %d, want %d (body %q)", rec.Code, tt.status, rec.Body.String())
+			}
+		})
+	}
+
+	rec := do(d.ID, `{"sampling": "errors, 0.5%"}`)
+	var got apiDomain
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if got.Sampling != "errors, 0.5%" || got.Name != "demo.example.com" {
+		t.Errorf("domain = %+v, want demo.example.com sampling errors, 0.5%%", got)
+	}
+}
+
+func TestDomainHeaders(t *testing.T) {
+	h, mem, cookie := newTestHandler(t)
+	ctx := context.Background()
+	d, _ := mem.CreateDomain(ctx, "user-1", "demo.example.com")
+
+	tests := []struct {
+		name     string
+		headers  string
+		want     string // stored headers afterwards
+		wantBody string
+	}{
+		{"two headers", "x-robots-tag: noindex\r\nX-Frame-Options:DENY", "X-Robots-Tag: noindex\nX-Frame-Options: DENY", "X-Frame-Options: DENY"},
+		{"framing header", "Transfer-Encoding: chunked", "X-Robots-Tag: noindex\nX-Frame-Options: DENY", "set by the relay"},
+		{"cleared", "  ", "", "Response headers, one per line"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, domainRequest("POST", "/dashboard/domains/headers/"+d.ID, url.Values{"headers": {tt.headers}}, cookie))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+			}
+			if !strings.Contains(rec.Body.String(), tt.wantBody) {
+				t.Errorf("body does not mention %q:\n%s", tt.wantBody, rec.Body.String())
+			}
+			if got, _ := mem.DomainHeaders(ctx, "demo.example.com"); got != tt.want {
+				t.Errorf("headers = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAPIDomainHeaders(t *testing.T) {
+	h, mem, cookie := newTestHandler(t)
+	d, _ := mem.CreateDomain(context.Background(), "user-1", "demo.example.com")
+
+	do := func(id, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("PUT", "/api/dashboard/domains/"+id+"/headers", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.AddCookie(cookie)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	tests := []struct {
+		name   string
+		id     string
+		body   string
+		status int
+	}{
+		{"invalid name", d.ID, `{"headers": "X Robots: noindex"}`, http.StatusBadRequest},
+		{"missing domain", "nope", `{"headers": ""}`, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rec := do(tt.id, tt.body); rec.Code != tt.status {
+				t.Errorf("status = %d, want %d (body %q)", rec.Code, tt.status, rec.Body.String())
+			}
+		})
+	}
+
+	rec := do(d.ID, `{"headers": "X-Robots-Tag: noindex"}`)
+	var got apiDomain
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if got.Headers != "X-Robots-Tag: noindex" || got.Name != "demo.example.com" {
+		t.Errorf("domain = %+v, want demo.example.com with X-Robots-Tag: noindex", got)
+	}
+}
+
+func TestDomainHTTPS(t *testing.T) {
+	h, mem, cookie := newTestHandler(t)
+	ctx := context.Background()
+	d, _ := mem.CreateDomain(ctx, "user-1", "demo.example.com")
+
+	tests := []struct {
+		name     string
+		https    string
+		want     string // stored policy afterwards
+		wantBody string
+	}{
+		{"redirect and hsts", "HSTS,redirect", "redirect, hsts", `value="redirect, hsts"`},
+		{"preload too soon", "hsts=30d, subdomains, preload", "redirect, hsts", "preload needs"},
+		{"cleared", "  ", "", "Serve plain HTTP too"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, domainRequest("POST", "/dashboard/domains/https/"+d.ID, url.Values{"https": {tt.https}}, cookie))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+			}
+			if !strings.Contains(rec.Body.String(), tt.wantBody) {
+				t.Errorf("body does not mention %q:\n%s", tt.wantBody, rec.Body.String())
+			}
+			if got, _ := mem.DomainHTTPS(ctx, "demo.example.com"); got != tt.want {
+				t.Errorf("https = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAPIDomainHTTPS(t *testing.T) {
+	h, mem, cookie := newTestHandler(t)
+	d, _ := mem.CreateDomain(context.Background(), "user-1", "demo.example.com")
+
+	do := func(id, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("PUT", "/api/dashboard/domains/"+id+"/https", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.AddCookie(cookie)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	tests := []struct {
+		name   string
+		id     string
+		body   string
+		status int
+	}{
+		{"unknown option", d.ID, `{"https": "always"}`, http.StatusBadRequest},
+		{"missing domain", "nope", `{"https": ""}`, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rec := do(tt.id, tt.body); rec.Code != tt.status {
+				t.Errorf("status = %d, want %d (body %q)", rec.Code, tt.status, rec.Body.String())
+			}
+		})
+	}
+
+	rec := do(d.ID, `{"https": "redirect, hsts=180d"}`)
+	var got apiDomain
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if got.HTTPS != "redirect, hsts=180d" || got.Name != "demo.example.com" {
+		t.Errorf("domain = %+v, want demo.example.com with redirect, hsts=180d", got)
+	}
+}
@@ -0,0 +1,98 @@
+// web/dashboard/events.go
+package dashboard
+
+import (
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+
+	"github.com/lobber-dev/lobber/internal/events"
+	"github.com/lobber-dev/lobber/internal/store"
+)
+
+// eventsFeedLimit is how many events the activity page shows
+const eventsFeedLimit = 100
+
+// eventIcons are the lucide icons shown next to each type of event
+var eventIcons = map[string]string{
+	events.TunnelConnected:    "plug-zap",
+	events.TunnelDisconnected: "unplug",
+	events.DomainVerified:     "badge-check",
+	events.CertIssued:         "lock",
+	events.QuotaWarning:       "gauge",
+}
+
+// eventRow is an event as the activity page lists it
+type eventRow struct {
+	store.Event
+	Icon string
+}
+
+// SetEvents adds dashboard actions, such as verifying a domain, to users'
+// activity feeds
+func (h *Handler) SetEvents(b *events.Bus) {
+	h.events = b
+}
+
+// handleEvents shows the user's activity feed, newest first. As JSON it
+// returns a page of the feed, or with ?after= the events since that one,
+// oldest first, like the CLI API.
+func (h *Handler) handleEvents(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userContextKey).(*User)
+
+	if v := r.URL.Query().Get("after"); v != "" && wantsJSON(r) {
+		after, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || after < 0 {
+			writeJSONError(w, http.StatusBadRequest, "after must be an event ID")
+			return
+		}
+		list, err := h.stores.Events.ListEvents(r.Context(), user.ID, after, eventsFeedLimit)
+		if err != nil {
+			log.Printf("events for %s: %v", user.ID, err)
+		}
+		if list == nil {
+			list = []store.Event{}
+		}
+		writeJSON(w, map[string]any{"events": list})
+		return
+	}
+
+	if wantsJSON(r) {
+		list, err := h.stores.Events.ListEvents(r.Context(), user.ID, 0, eventsListWindow)
+		if err != nil {
+			log.Printf("events for %s: %v", user.ID, err)
+		}
+		page, ok := listPage(w, r, eventList, list)
+		if !ok {
+			return
+		}
+		writeJSON(w, pageBody("events", page.Items, page.Next))
+		return
+	}
+
+	list, err := h.stores.Events.ListEvents(r.Context(), user.ID, 0, eventsFeedLimit)
+	if err != nil {
+		log.Printf("events for %s: %v", user.ID, err)
+	}
+
+	rows := make([]eventRow, 0, len(list))
+	for _, e := range slices.Backward(list) {
+		icon := eventIcons[e.Type]
+		if icon == "" {
+			icon = "circle-dot"
+		}
+		rows = append(rows, eventRow{Event: e, Icon: icon})
+	}
+	data := map[string]any{
+		"User":   user,
+		"Events": rows,
+		"Title":  "Activity",
+		"Page":   "events",
+	}
+	if isHTMX(r) {
+		h.render(w, "events-list.html", data)
+		return
+	}
+	h.render(w, "events.html", data)
+}
@@ -0,0 +1,204 @@
+// web/dashboard/exports.go
+package dashboard
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lobber-dev/lobber/internal/export"
+	"github.com/lobber-dev/lobber/internal/store"
+)
+
+// errExportsDisabled is returned when the relay has no key to seal
+// credentials with
+var errExportsDisabled = errors.New("exports aren't enabled on this relay")
+
+// SetExportSealer enables exports, sealing users' secret keys with s
+func (h *Handler) SetExportSealer(s *export.Sealer) {
+	h.exportSealer = s
+}
+
+// exportRequest is the export form, and the body of PUT /export
+type exportRequest struct {
+	Provider        string `json:"provider"`
+	Endpoint        string `json:"endpoint"`
+	Region          string `json:"region"`
+	Bucket          string `json:"bucket"`
+	Prefix          string `json:"prefix"`
+	AccessKeyID     string `json:"access_key_id"`
+	SecretAccessKey string `json:"secret_access_key"` // empty keeps the saved one
+	Format          string `json:"format"`
+}
+
+// saveExport validates and saves the user's export. A new export starts
+// with the current hour; a changed one carries on where the last left off.
+func (h *Handler) saveExport(r *http.Request, user *User, req exportRequest) (*store.Export, error) {
+	if h.exportSealer == nil {
+		return nil, errExportsDisabled
+	}
+	e := store.Export{
+		UserID:      user.ID,
+		Provider:    strings.TrimSpace(req.Provider),
+		Endpoint:    strings.TrimSpace(req.Endpoint),
+		Region:      strings.TrimSpace(req.Region),
+		Bucket:      strings.TrimSpace(req.Bucket),
+		Prefix:      strings.TrimSpace(req.Prefix),
+		AccessKeyID: strings.TrimSpace(req.AccessKeyID),
+		Format:      req.Format,
+	}
+	if err := export.Validate(&e); err != nil {
+		return nil, err
+	}
+
+	existing, err := h.stores.Exports.GetExport(r.Context(), user.ID)
+	switch {
+	case err == nil:
+		e.ExportedThrough = existing.ExportedThrough
+		e.SecretSealed = existing.SecretSealed
+	case errors.Is(err, store.ErrNotFound):
+		e.ExportedThrough = time.Now().UTC().Truncate(time.Hour)
+	default:
+		return nil, err
+	}
+	if secret := strings.TrimSpace(req.SecretAccessKey); secret != "" {
+		if e.SecretSealed, err = h.exportSealer.Seal(secret); err != nil {
+			return nil, err
+		}
+	}
+	if e.SecretSealed == "" {
+		return nil, fmt.Errorf("%w: secret access key is required", export.ErrInvalid)
+	}
+
+	if err := h.stores.Exports.SetExport(r.Context(), e); err != nil {
+		return nil, err
+	}
+	h.audit(r, user.ID, "export.saved", fmt.Sprintf("%s %s/%s", e.Provider, e.Bucket, e.Prefix))
+	return h.stores.Exports.GetExport(r.Context(), user.ID)
+}
+
+// deleteExport stops the user's export
+func (h *Handler) deleteExport(r *http.Request, user *User) error {
+	if err := h.stores.Exports.DeleteExport(r.Context(), user.ID); err != nil {
+		return err
+	}
+	h.audit(r, user.ID, "export.deleted", "")
+	return nil
+}
+
+// exportStatus maps a saveExport error to a status code
+func exportStatus(err error) int {
+	switch {
+	case errors.Is(err, export.ErrInvalid):
+		return http.StatusBadRequest
+	case errors.Is(err, errExportsDisabled):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// handleAccountExport saves the export form
+func (h *Handler) handleAccountExport(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userContextKey).(*User)
+
+	_, err := h.saveExport(r, user, exportRequest{
+		Provider:        r.PostFormValue("provider"),
+		Endpoint:        r.PostFormValue("endpoint"),
+		Region:          r.PostFormValue("region"),
+		Bucket:          r.PostFormValue("bucket"),
+		Prefix:          r.PostFormValue("prefix"),
+		AccessKeyID:     r.PostFormValue("access_key_id"),
+		SecretAccessKey: r.PostFormValue("secret_access_key"),
+		Format:          r.PostFormValue("format"),
+	})
+	if err != nil {
+		status := exportStatus(err)
+		msg := err.Error()
+		if status == http.StatusInternalServerError {
+			msg = "save export failed"
+		}
+		http.Error(w, msg, status)
+		return
+	}
+
+	http.Redirect(w, r, "/dashboard/account?notice=export-saved", http.StatusSeeOther)
+}
+
+// handleDeleteExport stops the export. HTMX swaps its card body out with the
+// empty response.
+func (h *Handler) handleDeleteExport(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userContextKey).(*User)
+
+	err := h.deleteExport(r, user)
+	if errors.Is(err, store.ErrNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, "delete export failed", http.StatusInternalServerError)
+		return
+	}
+
+	if !isHTMX(r) {
+		http.Redirect(w, r, "/dashboard/account", http.StatusSeeOther)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleAPIExport returns the user's export, without its secret key
+func (h *Handler) handleAPIExport(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userContextKey).(*User)
+
+	e, err := h.stores.Exports.GetExport(r.Context(), user.ID)
+	if errors.Is(err, store.ErrNotFound) {
+		writeJSONError(w, http.StatusNotFound, "no export configured")
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "export unavailable")
+		return
+	}
+	writeJSON(w, e)
+}
+
+// handleAPIPutExport creates or changes the user's export
+func (h *Handler) handleAPIPutExport(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userContextKey).(*User)
+
+	var req exportRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	e, err := h.saveExport(r, user, req)
+	if err != nil {
+		status := exportStatus(err)
+		msg := err.Error()
+		if status == http.StatusInternalServerError {
+			msg = "save export failed"
+		}
+		writeJSONError(w, status, msg)
+		return
+	}
+	writeJSON(w, e)
+}
+
+// handleAPIDeleteExport stops the user's export
+func (h *Handler) handleAPIDeleteExport(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userContextKey).(*User)
+
+	err := h.deleteExport(r, user)
+	if errors.Is(err, store.ErrNotFound) {
+		writeJSONError(w, http.StatusNotFound, "no export configured")
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "delete export failed")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
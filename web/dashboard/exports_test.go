@@ -0,0 +1,148 @@
+// web/dashboard/exports_test.go
+package dashboard
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lobber-dev/lobber/internal/export"
+	"github.com/lobber-dev/lobber/internal/store"
+)
+
+func TestExportAPI(t *testing.T) {
+	h, mem, cookie := newTestHandler(t)
+	ctx := context.Background()
+
+	do := func(method, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/api/dashboard/export", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.AddCookie(cookie)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	valid := `{"provider": "s3", "bucket": "logs", "access_key_id": "AKIDEXAMPLE", "secret_access_key": "s3cret"}`
+	if rec := do("PUT", valid); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("PUT without a sealer status = %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+
+	sealer, err := export.NewSealer(bytes.Repeat([]byte{7}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.SetExportSealer(sealer)
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{"no secret", `{"provider": "s3", "bucket": "logs", "access_key_id": "AKIDEXAMPLE"}`, http.StatusBadRequest},
+		{"plain http endpoint", `{"provider": "s3", "endpoint": "http://minio.example.com", "bucket": "logs", "access_key_id": "AKIDEXAMPLE", "secret_access_key": "s3cret"}`, http.StatusBadRequest},
+		{"parquet", `{"provider": "gcs", "bucket": "logs", "access_key_id": "GOOG1", "secret_access_key": "s3cret", "format": "parquet"}`, http.StatusBadRequest},
+		{"malformed", `{"provider":`, http.StatusBadRequest},
+		{"valid", valid, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rec := do("PUT", tt.body); rec.Code != tt.status {
+				t.Errorf("status = %d, want %d (body %q)", rec.Code, tt.status, rec.Body.String())
+			}
+		})
+	}
+
+	saved, err := mem.GetExport(ctx, "user-1")
+	if err != nil {
+		t.Fatalf("GetExport() error = %v", err)
+	}
+	if secret, err := sealer.Open(saved.SecretSealed); err != nil || secret != "s3cret" {
+		t.Errorf("sealed secret opens to %q, %v, want s3cret", secret, err)
+	}
+	since := saved.ExportedThrough
+
+	// Changing the bucket without a secret keeps the secret and the progress
+	if rec := do("PUT", `{"provider": "s3", "bucket": "other-logs", "prefix": "/lobber/", "access_key_id": "AKIDEXAMPLE"}`); rec.Code != http.StatusOK {
+		t.Fatalf("second PUT status = %d (body %q)", rec.Code, rec.Body.String())
+	}
+	changed, _ := mem.GetExport(ctx, "user-1")
+	if changed.Bucket != "other-logs" || changed.Prefix != "lobber" || changed.SecretSealed != saved.SecretSealed || !changed.ExportedThrough.Equal(since) {
+		t.Errorf("export = %+v, want the new bucket with the old secret and progress", changed)
+	}
+
+	rec := do("GET", "")
+	var got store.Export
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("decode export: %v", err)
+	}
+	if got.Bucket != "other-logs" || got.Endpoint != "s3.us-east-1.amazonaws.com" {
+		t.Errorf("GET = %+v, want other-logs on the default endpoint", got)
+	}
+	if body := rec.Body.String(); strings.Contains(body, saved.SecretSealed) || strings.Contains(body, "user-1") {
+		t.Errorf("body leaks the secret or user ID: %s", body)
+	}
+
+	if rec := do("DELETE", ""); rec.Code != http.StatusNoContent {
+		t.Errorf("DELETE status = %d, want %d", rec.Code, http.StatusNoContent)
+	}
+	if rec := do("GET", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("GET after DELETE status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+
+	entries, _ := mem.ListAudit(ctx, "user-1", 10)
+	if len(entries) != 3 || entries[0].Action != "export.deleted" {
+		t.Errorf("audit = %+v, want two export.saved and one export.deleted", entries)
+	}
+}
+
+func TestAccountExportForm(t *testing.T) {
+	h, mem, cookie := newTestHandler(t)
+	sealer, _ := export.NewSealer(bytes.Repeat([]byte{7}, 32))
+	h.SetExportSealer(sealer)
+
+	form := url.Values{
+		"provider":          {"gcs"},
+		"bucket":            {"lobber-exports"},
+		"access_key_id":     {"GOOG1EXAMPLE"},
+		"secret_access_key": {"s3cret"},
+		"format":            {"jsonl.gz"},
+	}
+	rec := postForm(h, "/dashboard/account/export", form, cookie)
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/dashboard/account?notice=export-saved" {
+		t.Fatalf("status = %d, location %q, want redirect with notice", rec.Code, rec.Header().Get("Location"))
+	}
+	e, err := mem.GetExport(context.Background(), "user-1")
+	if err != nil || e.Endpoint != "storage.googleapis.com" || e.Format != export.FormatJSONLGzip {
+		t.Fatalf("export = %+v, %v, want gzipped JSONL to storage.googleapis.com", e, err)
+	}
+	if hour := time.Now().UTC().Truncate(time.Hour); !e.ExportedThrough.Equal(hour) {
+		t.Errorf("ExportedThrough = %v, want the current hour %v", e.ExportedThrough, hour)
+	}
+
+	req := httptest.NewRequest("GET", "/dashboard/account", nil)
+	req.AddCookie(cookie)
+	page := httptest.NewRecorder()
+	h.ServeHTTP(page, req)
+	if body := page.Body.String(); !strings.Contains(body, "gcs://lobber-exports/") || strings.Contains(body, e.SecretSealed) {
+		t.Errorf("account page doesn't show the export, or shows its secret")
+	}
+
+	del := httptest.NewRequest("DELETE", "/dashboard/account/export", nil)
+	del.Header.Set("HX-Request", "true")
+	del.AddCookie(cookie)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, del)
+	if rec.Code != http.StatusOK {
+		t.Errorf("DELETE status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	if _, err := mem.GetExport(context.Background(), "user-1"); err != store.ErrNotFound {
+		t.Errorf("GetExport() after DELETE error = %v, want ErrNotFound", err)
+	}
+}
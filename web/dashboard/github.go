@@ -0,0 +1,177 @@
+// web/dashboard/github.go
+package dashboard
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/lobber-dev/lobber/internal/github"
+	"github.com/lobber-dev/lobber/internal/store"
+)
+
+// errGitHubDisabled is returned when the relay has no key to seal the App's
+// private key with
+var errGitHubDisabled = errors.New("the GitHub integration isn't enabled on this relay")
+
+// githubRequest is the GitHub App form, and the body of PUT /github
+type githubRequest struct {
+	AppID      int64  `json:"app_id"`
+	PrivateKey string `json:"private_key"` // empty keeps the saved one
+}
+
+// saveGitHubApp checks the App's key and saves it, sealed, as the one the
+// user's tunnels comment on pull requests through
+func (h *Handler) saveGitHubApp(r *http.Request, user *User, req githubRequest) (*store.GitHubApp, error) {
+	if h.exportSealer == nil {
+		return nil, errGitHubDisabled
+	}
+	app := store.GitHubApp{UserID: user.ID, AppID: req.AppID}
+
+	if key := strings.TrimSpace(req.PrivateKey); key != "" {
+		if _, err := github.ParseApp(req.AppID, key); err != nil {
+			return nil, err
+		}
+		sealed, err := h.exportSealer.Seal(key)
+		if err != nil {
+			return nil, err
+		}
+		app.KeySealed = sealed
+	} else {
+		existing, err := h.stores.Accounts.GitHubApp(r.Context(), user.ID)
+		if errors.Is(err, store.ErrNotFound) {
+			return nil, fmt.Errorf("%w: private key is required", github.ErrInvalid)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if req.AppID < 1 {
+			return nil, fmt.Errorf("%w: app ID is required", github.ErrInvalid)
+		}
+		app.KeySealed = existing.KeySealed
+	}
+
+	if err := h.stores.Accounts.SetGitHubApp(r.Context(), app); err != nil {
+		return nil, err
+	}
+	h.audit(r, user.ID, "github.saved", fmt.Sprintf("app %d", app.AppID))
+	return h.stores.Accounts.GitHubApp(r.Context(), user.ID)
+}
+
+// deleteGitHubApp stops the user's tunnels commenting on pull requests
+func (h *Handler) deleteGitHubApp(r *http.Request, user *User) error {
+	if err := h.stores.Accounts.DeleteGitHubApp(r.Context(), user.ID); err != nil {
+		return err
+	}
+	h.audit(r, user.ID, "github.deleted", "")
+	return nil
+}
+
+// githubStatus maps a saveGitHubApp error to a status code
+func githubStatus(err error) int {
+	switch {
+	case errors.Is(err, github.ErrInvalid):
+		return http.StatusBadRequest
+	case errors.Is(err, errGitHubDisabled):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// handleAccountGitHub saves the GitHub App form
+func (h *Handler) handleAccountGitHub(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userContextKey).(*User)
+
+	appID, _ := strconv.ParseInt(strings.TrimSpace(r.PostFormValue("app_id")), 10, 64)
+	_, err := h.saveGitHubApp(r, user, githubRequest{AppID: appID, PrivateKey: r.PostFormValue("private_key")})
+	if err != nil {
+		status := githubStatus(err)
+		msg := err.Error()
+		if status == http.StatusInternalServerError {
+			msg = "save GitHub App failed"
+		}
+		http.Error(w, msg, status)
+		return
+	}
+
+	http.Redirect(w, r, "/dashboard/account?notice=github-saved", http.StatusSeeOther)
+}
+
+// handleDeleteGitHub removes the GitHub App. HTMX swaps its row out with
+// the empty response.
+func (h *Handler) handleDeleteGitHub(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userContextKey).(*User)
+
+	err := h.deleteGitHubApp(r, user)
+	if errors.Is(err, store.ErrNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, "delete GitHub App failed", http.StatusInternalServerError)
+		return
+	}
+
+	if !isHTMX(r) {
+		http.Redirect(w, r, "/dashboard/account", http.StatusSeeOther)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleAPIGitHub returns the user's GitHub App, without its key
+func (h *Handler) handleAPIGitHub(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userContextKey).(*User)
+
+	app, err := h.stores.Accounts.GitHubApp(r.Context(), user.ID)
+	if errors.Is(err, store.ErrNotFound) {
+		writeJSONError(w, http.StatusNotFound, "no GitHub App configured")
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "GitHub App unavailable")
+		return
+	}
+	writeJSON(w, app)
+}
+
+// handleAPIPutGitHub sets the user's GitHub App
+func (h *Handler) handleAPIPutGitHub(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userContextKey).(*User)
+
+	var req githubRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	app, err := h.saveGitHubApp(r, user, req)
+	if err != nil {
+		status := githubStatus(err)
+		msg := err.Error()
+		if status == http.StatusInternalServerError {
+			msg = "save GitHub App failed"
+		}
+		writeJSONError(w, status, msg)
+		return
+	}
+	writeJSON(w, app)
+}
+
+// handleAPIDeleteGitHub removes the user's GitHub App
+func (h *Handler) handleAPIDeleteGitHub(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userContextKey).(*User)
+
+	err := h.deleteGitHubApp(r, user)
+	if errors.Is(err, store.ErrNotFound) {
+		writeJSONError(w, http.StatusNotFound, "no GitHub App configured")
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "delete GitHub App failed")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,86 @@
+// web/dashboard/github_test.go
+package dashboard
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/lobber-dev/lobber/internal/export"
+)
+
+func TestGitHubAPI(t *testing.T) {
+	h, mem, cookie := newTestHandler(t)
+	ctx := context.Background()
+
+	do := func(method, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/api/dashboard/github", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.AddCookie(cookie)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pemKey, _ := json.Marshal(string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})))
+	valid := `{"app_id": 42, "private_key": ` + string(pemKey) + `}`
+	if rec := do("PUT", valid); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("PUT without a sealer status = %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+
+	sealer, err := export.NewSealer(bytes.Repeat([]byte{7}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.SetExportSealer(sealer)
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{"no key yet", `{"app_id": 42}`, http.StatusBadRequest},
+		{"not a key", `{"app_id": 42, "private_key": "hunter2"}`, http.StatusBadRequest},
+		{"no app ID", `{"private_key": ` + string(pemKey) + `}`, http.StatusBadRequest},
+		{"valid", valid, http.StatusOK},
+		{"new ID keeps the key", `{"app_id": 43}`, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rec := do("PUT", tt.body); rec.Code != tt.status {
+				t.Errorf("status = %d, want %d (body %q)", rec.Code, tt.status, rec.Body.String())
+			}
+		})
+	}
+
+	saved, err := mem.GitHubApp(ctx, "user-1")
+	if err != nil || saved.AppID != 43 {
+		t.Fatalf("GitHubApp() = %+v, %v, want app 43", saved, err)
+	}
+	if opened, err := sealer.Open(saved.KeySealed); err != nil || !strings.Contains(opened, "RSA PRIVATE KEY") {
+		t.Errorf("sealed key opens to %q, %v, want the PEM key", opened, err)
+	}
+
+	rec := do("GET", "")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"app_id":43`) || strings.Contains(rec.Body.String(), "v1.") {
+		t.Errorf("GET = %d %s, want the app without its key", rec.Code, rec.Body)
+	}
+	if rec := do("DELETE", ""); rec.Code != http.StatusNoContent {
+		t.Errorf("DELETE status = %d, want %d", rec.Code, http.StatusNoContent)
+	}
+	if rec := do("GET", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("GET after DELETE status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
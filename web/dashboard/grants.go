@@ -0,0 +1,179 @@
+// web/dashboard/grants.go
+package dashboard
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/lobber-dev/lobber/internal/billing"
+	"github.com/lobber-dev/lobber/internal/store"
+)
+
+// Reasons a domain can't be granted, beyond an unknown domain or member
+var (
+	errGrantNeedsTeam = errors.New("sharing domains with members needs the team plan")
+	errGrantSelf      = errors.New("you already own this domain")
+	errGrantEmail     = errors.New("enter a valid email address")
+)
+
+// errSeatsFull is returned when every seat but the owner's already has a
+// member with access to one of their domains
+type errSeatsFull int
+
+func (e errSeatsFull) Error() string {
+	return fmt.Sprintf("all %d seats are in use; add seats to share domains with more members", int(e))
+}
+
+// grantDomain lets the member with email connect tunnels on the user's
+// domain id. Members take a seat each, on top of the owner's.
+func (h *Handler) grantDomain(r *http.Request, user *User, id, rawEmail string) (*store.DomainGrant, error) {
+	if user.Plan != string(billing.PlanTeam) {
+		return nil, errGrantNeedsTeam
+	}
+	email, err := parseEmail(rawEmail)
+	if err != nil {
+		return nil, errGrantEmail
+	}
+	if strings.EqualFold(email, user.Email) {
+		return nil, errGrantSelf
+	}
+
+	grants, err := h.stores.Domains.ListDomainGrants(r.Context(), user.ID)
+	if err != nil {
+		return nil, err
+	}
+	members := map[string]bool{}
+	granted := false
+	for _, g := range grants {
+		members[strings.ToLower(g.Email)] = true
+		granted = granted || g.DomainID == id && strings.EqualFold(g.Email, email)
+	}
+	if !members[strings.ToLower(email)] && len(members)+1 >= user.Seats {
+		return nil, errSeatsFull(user.Seats)
+	}
+
+	g, err := h.stores.Domains.GrantDomain(r.Context(), user.ID, id, email)
+	if err != nil {
+		return nil, err
+	}
+	if !granted {
+		h.audit(r, user.ID, "domain.granted", g.Hostname+" -> "+g.Email)
+	}
+	return g, nil
+}
+
+// grantStatus is the HTTP status for an error from grantDomain
+func grantStatus(err error) (int, string) {
+	var full errSeatsFull
+	switch {
+	case errors.Is(err, errGrantNeedsTeam):
+		return http.StatusForbidden, err.Error()
+	case errors.As(err, &full):
+		return http.StatusConflict, err.Error()
+	case errors.Is(err, store.ErrNotFound):
+		return http.StatusNotFound, "no such domain, or nobody has an account with that email"
+	case errors.Is(err, errGrantSelf), errors.Is(err, errGrantEmail):
+		return http.StatusBadRequest, err.Error()
+	}
+	return http.StatusInternalServerError, "grant domain failed"
+}
+
+// revokeDomain takes back a member's access to one of the user's domains
+func (h *Handler) revokeDomain(r *http.Request, user *User, id, memberID string) error {
+	grants, err := h.stores.Domains.ListDomainGrants(r.Context(), user.ID)
+	if err != nil {
+		return err
+	}
+	if err := h.stores.Domains.RevokeDomain(r.Context(), user.ID, id, memberID); err != nil {
+		return err
+	}
+	for _, g := range grants {
+		if g.DomainID == id && g.UserID == memberID {
+			h.audit(r, user.ID, "domain.revoked", g.Hostname+" -> "+g.Email)
+		}
+	}
+	return nil
+}
+
+// handleGrantDomain shares the form's domain with the member it emails
+func (h *Handler) handleGrantDomain(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userContextKey).(*User)
+
+	if _, err := h.grantDomain(r, user, r.PostFormValue("domain_id"), r.PostFormValue("email")); err != nil {
+		status, msg := grantStatus(err)
+		http.Error(w, msg, status)
+		return
+	}
+	http.Redirect(w, r, "/dashboard/domains", http.StatusSeeOther)
+}
+
+// handleRevokeDomain takes back a member's access. HTMX swaps the grant's
+// row out with the empty body.
+func (h *Handler) handleRevokeDomain(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userContextKey).(*User)
+
+	err := h.revokeDomain(r, user, r.PathValue("id"), r.PathValue("user"))
+	if errors.Is(err, store.ErrNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, "revoke access failed", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleAPIGrants lists who may connect tunnels on the user's domains
+func (h *Handler) handleAPIGrants(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userContextKey).(*User)
+
+	grants, err := h.stores.Domains.ListDomainGrants(r.Context(), user.ID)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "load grants failed")
+		return
+	}
+	writeJSON(w, map[string]any{"grants": grants, "seats": user.Seats})
+}
+
+// handleAPIGrantDomain shares a domain with {"email": "..."} and returns
+// the grant
+func (h *Handler) handleAPIGrantDomain(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userContextKey).(*User)
+
+	var body struct {
+		Email string `json:"email"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&body); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	g, err := h.grantDomain(r, user, r.PathValue("id"), body.Email)
+	if err != nil {
+		status, msg := grantStatus(err)
+		writeJSONError(w, status, msg)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(g)
+}
+
+// handleAPIRevokeDomain takes back a member's access to a domain
+func (h *Handler) handleAPIRevokeDomain(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userContextKey).(*User)
+
+	err := h.revokeDomain(r, user, r.PathValue("id"), r.PathValue("user"))
+	if errors.Is(err, store.ErrNotFound) {
+		writeJSONError(w, http.StatusNotFound, "grant not found")
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "revoke access failed")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
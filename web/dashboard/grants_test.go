@@ -0,0 +1,101 @@
+// web/dashboard/grants_test.go
+package dashboard
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/lobber-dev/lobber/internal/store"
+)
+
+func TestDomainGrantsAPI(t *testing.T) {
+	h, mem, cookie := newTestHandler(t)
+	ctx := context.Background()
+	d, _ := mem.CreateDomain(ctx, "user-1", "app.example.com")
+	mem.MarkDomainVerified(ctx, "user-1", d.ID)
+	for _, id := range []string{"member-1", "member-2", "member-3"} {
+		mem.AddUser(store.User{ID: id, Email: id + "@example.com"})
+	}
+
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.AddCookie(cookie)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	grant := "/api/dashboard/domains/" + d.ID + "/grants"
+
+	if rec := do("POST", grant, `{"email": "member-1@example.com"}`); rec.Code != http.StatusForbidden {
+		t.Fatalf("free plan status = %d, want 403", rec.Code)
+	}
+	mem.AddUser(store.User{ID: "user-1", Email: "dev@example.com", Plan: "team", Seats: 3})
+
+	tests := []struct {
+		name   string
+		target string
+		body   string
+		status int
+	}{
+		{"member", grant, `{"email": "member-1@example.com"}`, http.StatusCreated},
+		{"same member again", grant, `{"email": "MEMBER-1@example.com"}`, http.StatusCreated},
+		{"second member", grant, `{"email": "member-2@example.com"}`, http.StatusCreated},
+		{"seats full", grant, `{"email": "member-3@example.com"}`, http.StatusConflict},
+		{"owner", grant, `{"email": "dev@example.com"}`, http.StatusBadRequest},
+		{"invalid email", grant, `{"email": "member-1"}`, http.StatusBadRequest},
+		{"unknown domain", "/api/dashboard/domains/nope/grants", `{"email": "member-1@example.com"}`, http.StatusNotFound},
+		{"malformed", grant, `{"email":`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rec := do("POST", tt.target, tt.body); rec.Code != tt.status {
+				t.Errorf("status = %d, want %d (body %q)", rec.Code, tt.status, rec.Body.String())
+			}
+		})
+	}
+
+	var got struct {
+		Grants []store.DomainGrant `json:"grants"`
+		Seats  int                 `json:"seats"`
+	}
+	if err := json.Unmarshal(do("GET", "/api/dashboard/grants", "").Body.Bytes(), &got); err != nil {
+		t.Fatalf("decode grants: %v", err)
+	}
+	if len(got.Grants) != 2 || got.Grants[0].Email != "member-1@example.com" || got.Grants[0].Hostname != "app.example.com" || got.Seats != 3 {
+		t.Fatalf("grants = %+v, want member-1 then member-2 on app.example.com", got)
+	}
+	if ok, _ := mem.MayBindDomain(ctx, "member-1", "app.example.com"); !ok {
+		t.Error("member-1 may not bind app.example.com after the grant")
+	}
+
+	if rec := do("DELETE", grant+"/member-1", ""); rec.Code != http.StatusNoContent {
+		t.Errorf("revoke status = %d, want 204", rec.Code)
+	}
+	if rec := do("DELETE", grant+"/member-1", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("second revoke status = %d, want 404", rec.Code)
+	}
+	if ok, _ := mem.MayBindDomain(ctx, "member-1", "app.example.com"); ok {
+		t.Error("member-1 may still bind app.example.com after the revoke")
+	}
+
+	// A freed seat can go to someone else, from the domains page too
+	rec := postForm(h, "/dashboard/domains/grants", url.Values{"domain_id": {d.ID}, "email": {"member-3@example.com"}}, cookie)
+	if rec.Code != http.StatusSeeOther {
+		t.Errorf("form status = %d, want 303 (body %q)", rec.Code, rec.Body.String())
+	}
+
+	entries, _ := mem.ListAudit(ctx, "user-1", 10)
+	var actions []string
+	for _, e := range entries {
+		actions = append(actions, e.Action)
+	}
+	if want := "domain.granted domain.revoked domain.granted domain.granted"; strings.Join(actions, " ") != want {
+		t.Errorf("audit = %v, want %s", actions, want)
+	}
+}
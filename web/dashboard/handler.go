@@ -2,94 +2,202 @@
 package dashboard
 
 import (
+	"bytes"
 	"context"
-	"crypto/sha256"
 	"database/sql"
 	"embed"
+	"encoding/json"
 	"fmt"
 	"html/template"
+	"log"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
+
+	"github.com/lobber-dev/lobber/internal/auth"
+	"github.com/lobber-dev/lobber/internal/billing"
+	"github.com/lobber-dev/lobber/internal/events"
+	"github.com/lobber-dev/lobber/internal/export"
+	"github.com/lobber-dev/lobber/internal/notify"
+	"github.com/lobber-dev/lobber/internal/ratelimit"
+	"github.com/lobber-dev/lobber/internal/store"
+	"github.com/lobber-dev/lobber/web/static"
 )
 
 //go:embed templates/*.html
 var content embed.FS
 
 // User represents the logged-in user for templates
-type User struct {
-	ID        string
-	Email     string
-	Name      string
-	Plan      string
-	AvatarURL string
-}
+type User = store.User
 
 // Domain represents a user's registered domain
-type Domain struct {
-	ID        string
-	Name      string
-	Verified  bool
-	CreatedAt time.Time
-}
+type Domain = store.Domain
 
 // UsageSummary holds bandwidth usage info
 type UsageSummary struct {
-	UsedBytes   int64
-	LimitBytes  int64
-	UsedGB      float64
-	LimitGB     float64
-	PercentUsed float64
-	OverLimit   bool
+	UsedBytes      int64   `json:"used_bytes"`
+	LimitBytes     int64   `json:"limit_bytes"` // -1 when unlimited
+	RemainingBytes int64   `json:"remaining_bytes"`
+	UsedGB         float64 `json:"used_gb"`
+	LimitGB        float64 `json:"limit_gb"`
+	PercentUsed    float64 `json:"percent_used"`
+	OverLimit      bool    `json:"over_limit"`
+	Level          string  `json:"level"` // "ok", "warning", "exceeded" or "capped"
 }
 
 // RequestLog represents a logged request
-type RequestLog struct {
-	ID         string
-	Method     string
-	Path       string
-	StatusCode int
-	Duration   time.Duration
-	Domain     string
-	CreatedAt  time.Time
+type RequestLog = store.RequestLog
+
+// BillingService is the subset of billing.Service used by the dashboard
+type BillingService interface {
+	GetBillingDetails(ctx context.Context, userID string) (*billing.BillingDetails, error)
+	UpdateBillingDetails(ctx context.Context, userID string, details *billing.BillingDetails) error
+	GetUpcomingInvoice(ctx context.Context, userID string) (*billing.InvoicePreview, error)
+	SetSeats(ctx context.Context, userID string, seats int64) error
+}
+
+// UsageService reports per-domain and per-day usage breakdowns
+type UsageService interface {
+	GetUsageByDomain(ctx context.Context, userID string) ([]billing.DomainUsage, error)
+	GetDailyUsage(ctx context.Context, userID string, days int) ([]billing.DailyUsage, error)
 }
 
 // Handler serves the web dashboard
 type Handler struct {
-	db        *sql.DB
-	templates *template.Template
+	stores    store.Stores
+	templates map[string]*template.Template // template name -> page set defining it
+	assets    *static.Assets
 	mux       *http.ServeMux
+	billing   BillingService
+	usage     UsageService
+
+	verifyDomain DomainVerifier
+	listTunnels  TunnelLister
+	authLimit    *ratelimit.Limiter
+	apiQuota     *ratelimit.Quota
+	notifier     notify.Notifier
+	baseURL      string
+	events       *events.Bus
+	exportSealer *export.Sealer            // nil when exports are disabled
+	sso          map[string]*ssoConnection // by email domain
 }
 
-// NewHandler creates a new dashboard handler
+// NewHandler creates a new dashboard handler backed by Postgres. Without a
+// database every request is treated as logged out.
 func NewHandler(db *sql.DB) (*Handler, error) {
+	var backend store.All = store.NewMemory()
+	if db != nil {
+		backend = store.NewPostgres(db)
+	}
+	h, err := NewHandlerWithStores(store.NewStores(backend))
+	if err != nil {
+		return nil, err
+	}
+	// Usage breakdowns only need the database, not Stripe
+	h.usage = billing.NewService(db, "")
+	return h, nil
+}
+
+// NewHandlerWithStores creates a dashboard handler on top of the given stores
+func NewHandlerWithStores(stores store.Stores) (*Handler, error) {
+	assets, err := static.New("/dashboard/static/")
+	if err != nil {
+		return nil, err
+	}
+
 	// Parse templates
-	tmpl, err := template.New("").Funcs(template.FuncMap{
+	tmpl, err := parseTemplates(template.FuncMap{
 		"formatBytes":    formatBytes,
 		"formatTime":     formatTime,
 		"formatDuration": formatDuration,
+		"formatLatency":  formatLatency,
+		"formatMoney":    formatMoney,
+		"percentOf":      percentOf,
+		"domainRow":      newDomainRow,
+		"asset":          assets.Path,
 		"lower":          strings.ToLower,
-	}).ParseFS(content, "templates/*.html")
+	})
 	if err != nil {
 		return nil, err
 	}
 
 	h := &Handler{
-		db:        db,
+		stores:    stores,
 		templates: tmpl,
+		assets:    assets,
 		mux:       http.NewServeMux(),
+		usage:     billing.NewService(nil, ""),
+		notifier:  notify.LogNotifier{},
+		baseURL:   "https://lobber.dev",
 	}
 
 	// Routes
+	h.mux.Handle("GET /dashboard/static/", h.assets)
 	h.mux.HandleFunc("/dashboard", h.requireAuth(h.handleDashboard))
 	h.mux.HandleFunc("/dashboard/account", h.requireAuth(h.handleAccount))
+	h.mux.HandleFunc("/dashboard/account/billing", h.requireAuth(h.handleAccountBilling))
+	h.mux.HandleFunc("POST /dashboard/account/seats", h.requireAuth(h.handleAccountSeats))
+	h.mux.HandleFunc("POST /dashboard/account/alerts", h.requireAuth(h.handleAccountAlert))
+	h.mux.HandleFunc("DELETE /dashboard/account/alerts/{id}", h.requireAuth(h.handleDeleteAlert))
+	h.mux.HandleFunc("POST /dashboard/account/export", h.requireAuth(h.handleAccountExport))
+	h.mux.HandleFunc("DELETE /dashboard/account/export", h.requireAuth(h.handleDeleteExport))
+	h.mux.HandleFunc("POST /dashboard/account/github", h.requireAuth(h.handleAccountGitHub))
+	h.mux.HandleFunc("DELETE /dashboard/account/github", h.requireAuth(h.handleDeleteGitHub))
+	h.mux.HandleFunc("POST /dashboard/account/profile", h.requireAuth(h.handleAccountProfile))
+	h.mux.HandleFunc("POST /dashboard/account/theme", h.requireAuth(h.handleAccountTheme))
+	h.mux.HandleFunc("POST /dashboard/account/region", h.requireAuth(h.handleAccountRegion))
+	h.mux.HandleFunc("POST /dashboard/account/preferences", h.requireAuth(h.handleAccountPreferences))
+	h.mux.HandleFunc("POST /dashboard/account/email", h.requireAuth(h.handleAccountEmail))
+	h.mux.HandleFunc("GET /dashboard/account/email/confirm", h.requireAuth(ownerOnly(h.handleAccountEmailConfirm)))
+	h.mux.HandleFunc("DELETE /dashboard/account/identities/{id}", h.requireAuth(h.handleUnlinkIdentity))
 	h.mux.HandleFunc("/dashboard/domains", h.requireAuth(h.handleDomains))
+	h.mux.HandleFunc("POST /dashboard/domains/add", h.requireAuth(h.handleAddDomain))
+	h.mux.HandleFunc("POST /dashboard/domains/verify/{id}", h.requireAuth(h.handleVerifyDomain))
+	h.mux.HandleFunc("DELETE /dashboard/domains/{id}", h.requireAuth(h.handleDeleteDomain))
+	h.mux.HandleFunc("POST /dashboard/domains/schedule/{id}", h.requireAuth(h.handleDomainSchedule))
+	h.mux.HandleFunc("POST /dashboard/domains/sampling/{id}", h.requireAuth(h.handleDomainSampling))
+	h.mux.HandleFunc("POST /dashboard/domains/headers/{id}", h.requireAuth(h.handleDomainHeaders))
+	h.mux.HandleFunc("POST /dashboard/domains/https/{id}", h.requireAuth(h.handleDomainHTTPS))
+	h.mux.HandleFunc("POST /dashboard/domains/grants", h.requireAuth(h.handleGrantDomain))
+	h.mux.HandleFunc("DELETE /dashboard/domains/{id}/grants/{user}", h.requireAuth(h.handleRevokeDomain))
 	h.mux.HandleFunc("/dashboard/logs", h.requireAuth(h.handleLogs))
+	h.mux.HandleFunc("GET /dashboard/tunnels", h.requireAuth(h.handleTunnels))
+	h.mux.HandleFunc("GET /dashboard/tunnels/{name}", h.requireAuth(h.handleTunnel))
+	h.mux.HandleFunc("GET /dashboard/events", h.requireAuth(h.handleEvents))
+	h.mux.HandleFunc("GET /dashboard/onboarding", h.requireAuth(h.handleOnboarding))
+	h.mux.HandleFunc("POST /dashboard/onboarding/token", h.requireAuth(h.handleOnboardingToken))
+	h.mux.HandleFunc("GET /dashboard/onboarding/status", h.requireAuth(h.handleOnboardingStatus))
 	h.mux.HandleFunc("/dashboard/logout", h.handleLogout)
+	h.mux.HandleFunc("GET /dashboard/sso", h.handleSSO)
+	h.mux.HandleFunc("GET /dashboard/sso/callback", h.handleSSOCallback)
+	h.mux.HandleFunc("/dashboard/api/usage/domains", h.requireAuth(h.handleUsageByDomain))
+	h.mux.HandleFunc("/dashboard/api/usage/daily", h.requireAuth(h.handleDailyUsage))
+	h.registerAPIRoutes()
 
 	return h, nil
 }
 
+// SetBillingService enables billing details and invoice previews on the account page
+func (h *Handler) SetBillingService(b BillingService) {
+	h.billing = b
+}
+
+// SetAuthLimiter locks out client IPs that keep presenting unknown bearer tokens
+func (h *Handler) SetAuthLimiter(l *ratelimit.Limiter) {
+	h.authLimit = l
+}
+
+// SetAPIQuota caps how often each session or token may call the JSON API
+func (h *Handler) SetAPIQuota(q *ratelimit.Quota) {
+	h.apiQuota = q
+}
+
+// SetUsageService overrides where usage breakdowns are read from
+func (h *Handler) SetUsageService(u UsageService) {
+	h.usage = u
+}
+
 // ServeHTTP implements http.Handler
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	h.mux.ServeHTTP(w, r)
@@ -98,63 +206,137 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 // requireAuth middleware checks for valid session
 func (h *Handler) requireAuth(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		user := h.getUserFromSession(r)
+		token := cookieToken(r)
+		user := h.sessionUser(r.Context(), token)
+
+		// A bearer token is tried when the cookie doesn't sign the request
+		// in, so an old cookie sent along doesn't shadow it. Only bearer
+		// tokens count toward lockouts; a browser with a stale cookie isn't
+		// guessing anything.
+		if bearer := bearerToken(r); user == nil && bearer != "" {
+			ip := remoteIP(r)
+			if wait := h.authLimit.Locked(r.Context(), ip); wait > 0 {
+				w.Header().Set("Retry-After", ratelimit.RetryAfter(wait))
+				writeJSONError(w, http.StatusTooManyRequests, "too many failed attempts")
+				return
+			}
+			token, user = bearer, h.sessionUser(r.Context(), bearer)
+			if user == nil && h.authLimit.Fail(r.Context(), ip) {
+				log.Printf("dashboard: locked out %s after repeated invalid bearer tokens", ip)
+			} else if user != nil {
+				h.authLimit.Succeed(r.Context(), ip)
+			}
+		}
+
 		if user == nil {
+			if wantsJSON(r) {
+				writeJSONError(w, http.StatusUnauthorized, "not logged in")
+				return
+			}
 			http.Redirect(w, r, "/login", http.StatusSeeOther)
 			return
 		}
+		// Pages aren't counted, only what scripts and integrations call
+		if wantsJSON(r) && !h.apiQuota.Allow(w, r, hashToken(token), user.Plan) {
+			return
+		}
+		if user.ImpersonatedBy != "" {
+			log.Printf("support session: %s requested %s %s as user %s", user.ImpersonatedBy, r.Method, r.URL.Path, user.ID)
+			if r.Method != http.MethodGet && r.Method != http.MethodHead {
+				readOnlyError(w, r)
+				return
+			}
+		}
 		// Add user to context
 		ctx := context.WithValue(r.Context(), userContextKey, user)
 		next(w, r.WithContext(ctx))
 	}
 }
 
+// ownerOnly rejects support sessions on GET routes that change the account
+func ownerOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Context().Value(userContextKey).(*User).ImpersonatedBy != "" {
+			readOnlyError(w, r)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// readOnlyError tells an operator that support sessions can't make changes
+func readOnlyError(w http.ResponseWriter, r *http.Request) {
+	const msg = "support sessions are read-only"
+	if wantsJSON(r) {
+		writeJSONError(w, http.StatusForbidden, msg)
+		return
+	}
+	http.Error(w, msg, http.StatusForbidden)
+}
+
 type contextKey string
 
 const userContextKey contextKey = "user"
 
-// getUserFromSession retrieves user from session cookie
-func (h *Handler) getUserFromSession(r *http.Request) *User {
-	cookie, err := r.Cookie("session")
-	if err != nil {
-		return nil
+// cookieToken returns the session cookie's token
+func cookieToken(r *http.Request) string {
+	if cookie, err := r.Cookie("session"); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
+
+// bearerToken returns the session token API clients send in an
+// Authorization: Bearer header
+func bearerToken(r *http.Request) string {
+	if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(bearer)
 	}
+	return ""
+}
 
-	if h.db == nil {
+// sessionUser retrieves the user signed in with token, or nil
+func (h *Handler) sessionUser(ctx context.Context, token string) *User {
+	if token == "" {
 		return nil
 	}
-
-	// Look up session in database
-	var user User
-	hashed := hashToken(cookie.Value)
-
-	err = h.db.QueryRowContext(r.Context(), `
-		SELECT u.id, u.email, COALESCE(u.name, ''), COALESCE(u.plan, 'free'), COALESCE(u.avatar_url, '')
-		FROM users u
-		JOIN sessions s ON s.user_id = u.id
-		WHERE s.token_hash = $1 AND s.expires_at > NOW()
-	`, hashed).Scan(&user.ID, &user.Email, &user.Name, &user.Plan, &user.AvatarURL)
+	user, err := h.stores.Sessions.SessionUser(ctx, hashToken(token))
 	if err != nil {
 		return nil
 	}
-
-	return &user
+	return user
 }
 
 // handleDashboard renders the main dashboard page
 func (h *Handler) handleDashboard(w http.ResponseWriter, r *http.Request) {
+	if wantsJSON(r) {
+		h.handleAPIOverview(w, r)
+		return
+	}
+
 	user := r.Context().Value(userContextKey).(*User)
+	if h.onboardingRedirect(w, r, user) {
+		return
+	}
 
-	usage := h.getUserUsage(r.Context(), user.ID)
+	usage := h.getUserUsage(r.Context(), user)
 	domains := h.getUserDomains(r.Context(), user.ID)
 	recentLogs := h.getRecentLogs(r.Context(), user.ID, 10)
+	domainUsage, _ := h.usage.GetUsageByDomain(r.Context(), user.ID)
+	dailyUsage, _ := h.usage.GetDailyUsage(r.Context(), user.ID, 30)
 
 	data := map[string]interface{}{
-		"User":       user,
-		"Usage":      usage,
-		"Domains":    domains,
-		"RecentLogs": recentLogs,
-		"Page":       "dashboard",
+		"User":           user,
+		"Usage":          usage,
+		"Domains":        domains,
+		"RecentLogs":     recentLogs,
+		"Tunnels":        h.userTunnels(user.ID),
+		"DomainUsage":    domainUsage,
+		"DomainUsageMax": maxTotalBytes(domainUsage, func(u billing.DomainUsage) int64 { return u.TotalBytes }),
+		"DailyUsage":     dailyUsage,
+		"DailyUsageMax":  maxTotalBytes(dailyUsage, func(u billing.DailyUsage) int64 { return u.TotalBytes }),
+		"Title":          "Dashboard",
+		"Page":           "dashboard",
 	}
 
 	h.render(w, "dashboard.html", data)
@@ -162,26 +344,132 @@ func (h *Handler) handleDashboard(w http.ResponseWriter, r *http.Request) {
 
 // handleAccount renders the account settings page
 func (h *Handler) handleAccount(w http.ResponseWriter, r *http.Request) {
+	if wantsJSON(r) {
+		h.handleAPIAccount(w, r)
+		return
+	}
+
 	user := r.Context().Value(userContextKey).(*User)
-	usage := h.getUserUsage(r.Context(), user.ID)
+	usage := h.getUserUsage(r.Context(), user)
+
+	identities, _ := h.stores.Accounts.ListIdentities(r.Context(), user.ID)
+	auditLog, _ := h.stores.Audit.ListAudit(r.Context(), user.ID, auditLogLimit)
+	usageAlerts, _ := h.stores.Alerts.ListAlerts(r.Context(), user.ID)
+	dataExport, _ := h.stores.Exports.GetExport(r.Context(), user.ID)
+	githubApp, _ := h.stores.Accounts.GitHubApp(r.Context(), user.ID)
+	prefs, err := h.stores.Accounts.Preferences(r.Context(), user.ID)
+	if err != nil {
+		prefs = store.DefaultPreferences()
+	}
 
 	data := map[string]interface{}{
-		"User":  user,
-		"Usage": usage,
-		"Page":  "account",
+		"User":           user,
+		"Usage":          usage,
+		"Identities":     identities,
+		"AuditLog":       auditLog,
+		"Alerts":         usageAlerts,
+		"Export":         dataExport,
+		"GitHubApp":      githubApp,
+		"Preferences":    prefs,
+		"ExportsEnabled": h.exportSealer != nil,
+		"Notice":         accountNotices[r.URL.Query().Get("notice")],
+		"MaxSeats":       billing.MaxSeats,
+		"Title":          "Account",
+		"Page":           "account",
+	}
+
+	details, preview := h.getAccountBilling(r.Context(), user)
+	if details != nil {
+		data["BillingDetails"] = details
+	}
+	if preview != nil {
+		data["UpcomingInvoice"] = preview
 	}
 
 	h.render(w, "account.html", data)
 }
 
+// handleAccountBilling saves the billing address and tax ID form
+func (h *Handler) handleAccountBilling(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if h.billing == nil {
+		http.Error(w, "billing unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	user := r.Context().Value(userContextKey).(*User)
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "invalid form", http.StatusBadRequest)
+		return
+	}
+
+	details := &billing.BillingDetails{
+		Address: billing.Address{
+			Line1:      r.PostFormValue("line1"),
+			Line2:      r.PostFormValue("line2"),
+			City:       r.PostFormValue("city"),
+			State:      r.PostFormValue("state"),
+			PostalCode: r.PostFormValue("postal_code"),
+			Country:    r.PostFormValue("country"),
+		},
+		TaxIDType: r.PostFormValue("tax_id_type"),
+		TaxID:     r.PostFormValue("tax_id"),
+	}
+
+	if err := h.billing.UpdateBillingDetails(r.Context(), user.ID, details); err != nil {
+		http.Error(w, "update billing details: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	http.Redirect(w, r, "/dashboard/account", http.StatusSeeOther)
+}
+
+// handleAccountSeats changes the seats on a team subscription
+func (h *Handler) handleAccountSeats(w http.ResponseWriter, r *http.Request) {
+	if h.billing == nil {
+		http.Error(w, "billing unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	user := r.Context().Value(userContextKey).(*User)
+	seats, err := strconv.ParseInt(r.PostFormValue("seats"), 10, 64)
+	if err != nil || seats < 1 || seats > billing.MaxSeats {
+		http.Error(w, fmt.Sprintf("seats must be between 1 and %d", billing.MaxSeats), http.StatusBadRequest)
+		return
+	}
+	if seats == int64(user.Seats) {
+		http.Redirect(w, r, "/dashboard/account", http.StatusSeeOther)
+		return
+	}
+
+	if err := h.billing.SetSeats(r.Context(), user.ID, seats); err != nil {
+		http.Error(w, "update seats: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	h.audit(r, user.ID, "billing.seats", fmt.Sprintf("%d -> %d", user.Seats, seats))
+
+	http.Redirect(w, r, "/dashboard/account", http.StatusSeeOther)
+}
+
 // handleDomains renders the domain management page
 func (h *Handler) handleDomains(w http.ResponseWriter, r *http.Request) {
+	if wantsJSON(r) {
+		h.handleAPIDomains(w, r)
+		return
+	}
+
 	user := r.Context().Value(userContextKey).(*User)
 	domains := h.getUserDomains(r.Context(), user.ID)
+	grants, _ := h.stores.Domains.ListDomainGrants(r.Context(), user.ID)
 
 	data := map[string]interface{}{
 		"User":    user,
 		"Domains": domains,
+		"Grants":  grants,
+		"Title":   "Domains",
 		"Page":    "domains",
 	}
 
@@ -196,13 +484,19 @@ func (h *Handler) handleDomains(w http.ResponseWriter, r *http.Request) {
 
 // handleLogs renders the request logs page
 func (h *Handler) handleLogs(w http.ResponseWriter, r *http.Request) {
+	if wantsJSON(r) {
+		h.handleAPILogs(w, r)
+		return
+	}
+
 	user := r.Context().Value(userContextKey).(*User)
 	logs := h.getRecentLogs(r.Context(), user.ID, 100)
 
 	data := map[string]interface{}{
-		"User": user,
-		"Logs": logs,
-		"Page": "logs",
+		"User":  user,
+		"Logs":  logs,
+		"Title": "Request Logs",
+		"Page":  "logs",
 	}
 
 	// Handle HTMX partial requests
@@ -214,45 +508,88 @@ func (h *Handler) handleLogs(w http.ResponseWriter, r *http.Request) {
 	h.render(w, "logs.html", data)
 }
 
+// handleUsageByDomain returns this billing period's usage per domain as JSON
+func (h *Handler) handleUsageByDomain(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userContextKey).(*User)
+
+	usage, err := h.usage.GetUsageByDomain(r.Context(), user.ID)
+	if err != nil {
+		http.Error(w, "usage unavailable", http.StatusInternalServerError)
+		return
+	}
+	if usage == nil {
+		usage = []billing.DomainUsage{}
+	}
+	writeJSON(w, usage)
+}
+
+// handleDailyUsage returns usage per day as JSON, for the last ?days=N days (default 30)
+func (h *Handler) handleDailyUsage(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userContextKey).(*User)
+
+	days := 30
+	if v := r.URL.Query().Get("days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > billing.MaxUsageDays {
+			http.Error(w, fmt.Sprintf("days must be between 1 and %d", billing.MaxUsageDays), http.StatusBadRequest)
+			return
+		}
+		days = n
+	}
+
+	usage, err := h.usage.GetDailyUsage(r.Context(), user.ID, days)
+	if err != nil {
+		http.Error(w, "usage unavailable", http.StatusInternalServerError)
+		return
+	}
+	if usage == nil {
+		usage = []billing.DailyUsage{}
+	}
+	writeJSON(w, usage)
+}
+
 // handleLogout clears the session and redirects
 func (h *Handler) handleLogout(w http.ResponseWriter, r *http.Request) {
+	// Invalidate the session server-side so a copied cookie stops working
+	if cookie, err := r.Cookie("session"); err == nil {
+		if user := h.sessionUser(r.Context(), cookie.Value); user != nil && user.ImpersonatedBy != "" {
+			h.audit(r, user.ID, "support.session_ended", "by "+user.ImpersonatedBy)
+		}
+		h.stores.Sessions.DeleteSession(r.Context(), hashToken(cookie.Value))
+	}
+
 	// Clear session cookie
+	SetSessionCookie(w, "", time.Time{})
+
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// SetSessionCookie sets the dashboard session cookie, or clears it when token is empty
+func SetSessionCookie(w http.ResponseWriter, token string, expiresAt time.Time) {
+	maxAge := -1
+	if token != "" {
+		maxAge = int(time.Until(expiresAt).Seconds())
+	}
 	http.SetCookie(w, &http.Cookie{
 		Name:     "session",
-		Value:    "",
+		Value:    token,
 		Path:     "/",
-		MaxAge:   -1,
+		MaxAge:   maxAge,
 		HttpOnly: true,
 		Secure:   true,
 		SameSite: http.SameSiteStrictMode,
 	})
-
-	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
 // getUserUsage retrieves bandwidth usage for a user
-func (h *Handler) getUserUsage(ctx context.Context, userID string) *UsageSummary {
-	if h.db == nil {
-		return &UsageSummary{}
-	}
-
-	var usedBytes int64
-	err := h.db.QueryRowContext(ctx, `
-		SELECT COALESCE(SUM(bytes_in + bytes_out), 0)
-		FROM bandwidth_usage
-		WHERE user_id = $1
-		AND recorded_at >= date_trunc('month', NOW())
-	`, userID).Scan(&usedBytes)
+func (h *Handler) getUserUsage(ctx context.Context, user *User) *UsageSummary {
+	usedBytes, err := h.stores.Usage.MonthlyUsage(ctx, user.ID)
 	if err != nil {
 		return &UsageSummary{}
 	}
 
-	// Get user plan for limit
-	var plan string
-	h.db.QueryRowContext(ctx, `SELECT COALESCE(plan, 'free') FROM users WHERE id = $1`, userID).Scan(&plan)
-
 	var limitBytes int64 = 5 * 1024 * 1024 * 1024 // 5GB free tier
-	if plan == "pro" || plan == "payg" {
+	if user.Plan == "pro" || user.Plan == "team" || user.Plan == "payg" {
 		limitBytes = -1 // Unlimited
 	}
 
@@ -260,83 +597,91 @@ func (h *Handler) getUserUsage(ctx context.Context, userID string) *UsageSummary
 		UsedBytes:  usedBytes,
 		LimitBytes: limitBytes,
 		UsedGB:     float64(usedBytes) / (1024 * 1024 * 1024),
+		Level:      billing.DefaultQuotaPolicy().Level(billing.Plan(user.Plan), usedBytes, limitBytes).String(),
 	}
 
 	if limitBytes > 0 {
 		summary.LimitGB = float64(limitBytes) / (1024 * 1024 * 1024)
 		summary.PercentUsed = float64(usedBytes) / float64(limitBytes) * 100
 		summary.OverLimit = usedBytes >= limitBytes
+		summary.RemainingBytes = max(limitBytes-usedBytes, 0)
 	}
 
 	return summary
 }
 
-// getUserDomains retrieves domains for a user
-func (h *Handler) getUserDomains(ctx context.Context, userID string) []Domain {
-	if h.db == nil {
-		return nil
+// getAccountBilling returns the user's billing details and, for paid plans,
+// their upcoming invoice. Either is nil when unavailable.
+func (h *Handler) getAccountBilling(ctx context.Context, user *User) (*billing.BillingDetails, *billing.InvoicePreview) {
+	if h.billing == nil {
+		return nil, nil
 	}
 
-	rows, err := h.db.QueryContext(ctx, `
-		SELECT id, hostname AS domain, verified, created_at
-		FROM domains
-		WHERE user_id = $1
-		ORDER BY created_at DESC
-	`, userID)
+	details, err := h.billing.GetBillingDetails(ctx, user.ID)
 	if err != nil {
-		return nil
+		details = nil
 	}
-	defer rows.Close()
 
-	var domains []Domain
-	for rows.Next() {
-		var d Domain
-		if err := rows.Scan(&d.ID, &d.Name, &d.Verified, &d.CreatedAt); err != nil {
-			continue
+	var preview *billing.InvoicePreview
+	if user.Plan != "free" {
+		if p, err := h.billing.GetUpcomingInvoice(ctx, user.ID); err == nil {
+			preview = p
 		}
-		domains = append(domains, d)
 	}
-	return domains
+	return details, preview
 }
 
-// getRecentLogs retrieves recent request logs for a user
-func (h *Handler) getRecentLogs(ctx context.Context, userID string, limit int) []RequestLog {
-	if h.db == nil {
+// getUserDomains retrieves domains for a user
+func (h *Handler) getUserDomains(ctx context.Context, userID string) []Domain {
+	domains, err := h.stores.Domains.ListDomains(ctx, userID)
+	if err != nil {
 		return nil
 	}
+	return domains
+}
 
-	rows, err := h.db.QueryContext(ctx, `
-		SELECT r.id, r.method, r.path, r.status_code, r.duration_ms, d.hostname AS domain, r.created_at
-		FROM request_logs r
-		JOIN domains d ON r.domain_id = d.id
-		WHERE d.user_id = $1
-		ORDER BY r.created_at DESC
-		LIMIT $2
-	`, userID, limit)
+// getRecentLogs retrieves recent request logs for a user
+func (h *Handler) getRecentLogs(ctx context.Context, userID string, limit int) []RequestLog {
+	logs, err := h.stores.Usage.RecentRequests(ctx, userID, limit)
 	if err != nil {
 		return nil
 	}
-	defer rows.Close()
-
-	var logs []RequestLog
-	for rows.Next() {
-		var l RequestLog
-		var durationMs int64
-		if err := rows.Scan(&l.ID, &l.Method, &l.Path, &l.StatusCode, &durationMs, &l.Domain, &l.CreatedAt); err != nil {
-			continue
-		}
-		l.Duration = time.Duration(durationMs) * time.Millisecond
-		logs = append(logs, l)
-	}
 	return logs
 }
 
-// render executes a template
+// render executes a page or partial template. Output is buffered so a
+// template error returns a clean 500 instead of a half-written page.
 func (h *Handler) render(w http.ResponseWriter, name string, data interface{}) {
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	if err := h.templates.ExecuteTemplate(w, name, data); err != nil {
+	tmpl, ok := h.templates[name]
+	if !ok {
+		log.Printf("dashboard: unknown template %q", name)
+		http.Error(w, "template error", http.StatusInternalServerError)
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.ExecuteTemplate(&buf, name, data); err != nil {
+		log.Printf("dashboard: render %s: %v", name, err)
 		http.Error(w, "template error", http.StatusInternalServerError)
+		return
 	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	buf.WriteTo(w)
+}
+
+// writeJSON writes v as a JSON response
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// maxTotalBytes returns the largest value in a usage series, for scaling charts
+func maxTotalBytes[T any](items []T, total func(T) int64) int64 {
+	var m int64
+	for _, item := range items {
+		m = max(m, total(item))
+	}
+	return m
 }
 
 // Template helper functions
@@ -358,6 +703,19 @@ func formatBytes(bytes int64) string {
 	}
 }
 
+// formatMoney formats an amount in a currency's minor unit, e.g. 1550 "eur" -> "15.50 EUR"
+func formatMoney(amount int64, currency string) string {
+	return fmt.Sprintf("%.2f %s", float64(amount)/100, strings.ToUpper(currency))
+}
+
+// percentOf returns part as a percentage of whole, for chart bar widths
+func percentOf(part, whole int64) float64 {
+	if whole <= 0 {
+		return 0
+	}
+	return float64(part) / float64(whole) * 100
+}
+
 func formatTime(t time.Time) string {
 	return t.Format("Jan 2, 2006 3:04 PM")
 }
@@ -369,8 +727,20 @@ func formatDuration(d time.Duration) string {
 	return d.Truncate(time.Millisecond).String()
 }
 
+// formatLatency describes where a request's time went, or returns "" if
+// the relay answered it itself
+func formatLatency(l store.Latency) string {
+	switch {
+	case l == store.Latency{}:
+		return ""
+	case l.Tunnel == 0 && l.Local == 0:
+		return fmt.Sprintf("relay %s, write %s", formatDuration(l.Relay), formatDuration(l.Write))
+	}
+	return fmt.Sprintf("relay %s, tunnel %s, local %s, write %s",
+		formatDuration(l.Relay), formatDuration(l.Tunnel), formatDuration(l.Local), formatDuration(l.Write))
+}
+
 // hashToken returns a hex SHA256 hash for session token comparison
 func hashToken(token string) string {
-	sum := sha256.Sum256([]byte(token))
-	return fmt.Sprintf("%x", sum[:])
+	return auth.HashToken(token)
 }
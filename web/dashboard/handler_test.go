@@ -2,10 +2,16 @@
 package dashboard
 
 import (
+	"context"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/lobber-dev/lobber/internal/billing"
+	"github.com/lobber-dev/lobber/internal/ratelimit"
+	"github.com/lobber-dev/lobber/internal/store"
 )
 
 func TestNewHandler(t *testing.T) {
@@ -126,6 +132,23 @@ func TestFormatDuration(t *testing.T) {
 	}
 }
 
+func TestFormatLatency(t *testing.T) {
+	tests := []struct {
+		latency store.Latency
+		want    string
+	}{
+		{store.Latency{}, ""},
+		{store.Latency{Relay: 2 * time.Millisecond, Write: 300 * time.Microsecond}, "relay 2ms, write <1ms"},
+		{store.Latency{Relay: time.Millisecond, Tunnel: 38 * time.Millisecond, Local: 1200 * time.Millisecond}, "relay 1ms, tunnel 38ms, local 1.2s, write <1ms"},
+	}
+
+	for _, tt := range tests {
+		if got := formatLatency(tt.latency); got != tt.want {
+			t.Errorf("formatLatency(%+v) = %q, want %q", tt.latency, got, tt.want)
+		}
+	}
+}
+
 func TestUserStruct(t *testing.T) {
 	u := User{
 		ID:        "user-123",
@@ -198,3 +221,252 @@ func TestRequestLogStruct(t *testing.T) {
 		t.Errorf("RequestLog.StatusCode = %d, want 200", log.StatusCode)
 	}
 }
+
+func TestFormatMoney(t *testing.T) {
+	tests := []struct {
+		amount   int64
+		currency string
+		expected string
+	}{
+		{0, "usd", "0.00 USD"},
+		{1550, "eur", "15.50 EUR"},
+		{285, "gbp", "2.85 GBP"},
+	}
+
+	for _, tt := range tests {
+		result := formatMoney(tt.amount, tt.currency)
+		if result != tt.expected {
+			t.Errorf("formatMoney(%d, %q) = %s, want %s", tt.amount, tt.currency, result, tt.expected)
+		}
+	}
+}
+
+// fakeUsageService returns canned usage breakdowns
+type fakeUsageService struct {
+	days int
+}
+
+func (f *fakeUsageService) GetUsageByDomain(ctx context.Context, userID string) ([]billing.DomainUsage, error) {
+	return []billing.DomainUsage{{Domain: "app.example.com", BytesIn: 100, BytesOut: 200, TotalBytes: 300, Requests: 4}}, nil
+}
+
+func (f *fakeUsageService) GetDailyUsage(ctx context.Context, userID string, days int) ([]billing.DailyUsage, error) {
+	f.days = days
+	return nil, nil
+}
+
+func TestUsageAPI(t *testing.T) {
+	h, err := NewHandler(nil)
+	if err != nil {
+		t.Fatalf("NewHandler failed: %v", err)
+	}
+	usage := &fakeUsageService{}
+	h.SetUsageService(usage)
+
+	tests := []struct {
+		name     string
+		handler  http.HandlerFunc
+		url      string
+		status   int
+		body     string
+		wantDays int
+	}{
+		{"by domain", h.handleUsageByDomain, "/dashboard/api/usage/domains", http.StatusOK, `"domain":"app.example.com"`, 0},
+		{"daily default", h.handleDailyUsage, "/dashboard/api/usage/daily", http.StatusOK, "[]", 30},
+		{"daily custom", h.handleDailyUsage, "/dashboard/api/usage/daily?days=7", http.StatusOK, "[]", 7},
+		{"daily invalid", h.handleDailyUsage, "/dashboard/api/usage/daily?days=1000", http.StatusBadRequest, "days must be", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			usage.days = 0
+			req := httptest.NewRequest("GET", tt.url, nil)
+			req = req.WithContext(context.WithValue(req.Context(), userContextKey, &User{ID: "user-1"}))
+			rec := httptest.NewRecorder()
+			tt.handler(rec, req)
+
+			if rec.Code != tt.status {
+				t.Errorf("status = %d, want %d", rec.Code, tt.status)
+			}
+			if !strings.Contains(rec.Body.String(), tt.body) {
+				t.Errorf("body = %q, want it to contain %q", rec.Body.String(), tt.body)
+			}
+			if usage.days != tt.wantDays {
+				t.Errorf("days = %d, want %d", usage.days, tt.wantDays)
+			}
+		})
+	}
+}
+
+func TestPercentOf(t *testing.T) {
+	tests := []struct {
+		part, whole int64
+		want        float64
+	}{
+		{0, 0, 0},
+		{5, 0, 0},
+		{25, 100, 25},
+		{100, 100, 100},
+	}
+
+	for _, tt := range tests {
+		if got := percentOf(tt.part, tt.whole); got != tt.want {
+			t.Errorf("percentOf(%d, %d) = %v, want %v", tt.part, tt.whole, got, tt.want)
+		}
+	}
+}
+
+// newTestHandler returns a handler backed by in-memory stores with one logged-in user
+func newTestHandler(t *testing.T) (*Handler, *store.Memory, *http.Cookie) {
+	t.Helper()
+	mem := store.NewMemory()
+	mem.AddUser(store.User{ID: "user-1", Email: "dev@example.com", Plan: "free"})
+	mem.CreateSession(context.Background(), "user-1", hashToken("token-1"), time.Now().Add(time.Hour))
+
+	h, err := NewHandlerWithStores(store.NewStores(mem))
+	if err != nil {
+		t.Fatalf("NewHandlerWithStores failed: %v", err)
+	}
+	return h, mem, &http.Cookie{Name: "session", Value: "token-1"}
+}
+
+func TestSessionAuth(t *testing.T) {
+	h, _, cookie := newTestHandler(t)
+
+	tests := []struct {
+		name   string
+		cookie *http.Cookie
+		status int
+	}{
+		{"valid session", cookie, http.StatusOK},
+		{"unknown session", &http.Cookie{Name: "session", Value: "nope"}, http.StatusSeeOther},
+		{"no cookie", nil, http.StatusSeeOther},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/dashboard/api/usage/domains", nil)
+			if tt.cookie != nil {
+				req.AddCookie(tt.cookie)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != tt.status {
+				t.Errorf("status = %d, want %d", rec.Code, tt.status)
+			}
+		})
+	}
+}
+
+func TestLogoutDeletesSession(t *testing.T) {
+	h, mem, cookie := newTestHandler(t)
+
+	req := httptest.NewRequest("GET", "/dashboard/logout", nil)
+	req.AddCookie(cookie)
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	if _, err := mem.SessionUser(context.Background(), hashToken(cookie.Value)); err == nil {
+		t.Error("session should be deleted after logout")
+	}
+}
+
+func TestSupportSession(t *testing.T) {
+	h, mem, _ := newTestHandler(t)
+	ctx := context.Background()
+	mem.CreateImpersonationSession(ctx, "user-1", hashToken("support-1"), "grace@lobber.dev", time.Now().Add(time.Hour))
+	support := &http.Cookie{Name: "session", Value: "support-1"}
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		status int
+	}{
+		{"view dashboard", "GET", "/dashboard", http.StatusOK},
+		{"view domains", "GET", "/dashboard/domains", http.StatusOK},
+		{"add domain", "POST", "/dashboard/domains/add", http.StatusForbidden},
+		{"create token", "POST", "/dashboard/onboarding/token", http.StatusForbidden},
+		{"edit profile", "POST", "/dashboard/account/profile", http.StatusForbidden},
+		{"confirm email", "GET", "/dashboard/account/email/confirm?token=x", http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader("domain=evil.example.com&name=x"))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			req.AddCookie(support)
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.status)
+			}
+			if tt.status == http.StatusOK && !strings.Contains(rec.Body.String(), "grace@lobber.dev is viewing") {
+				t.Error("support session page is missing the banner")
+			}
+		})
+	}
+
+	if domains, _ := mem.ListDomains(ctx, "user-1"); len(domains) != 0 {
+		t.Errorf("support session added domains: %+v", domains)
+	}
+
+	req := httptest.NewRequest("GET", "/dashboard/logout", nil)
+	req.AddCookie(support)
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	entries, _ := mem.ListAudit(ctx, "user-1", 10)
+	if len(entries) != 1 || entries[0].Action != "support.session_ended" {
+		t.Errorf("audit after ending support session = %+v, want support.session_ended", entries)
+	}
+}
+
+func TestGetUserUsage(t *testing.T) {
+	h, mem, _ := newTestHandler(t)
+	ctx := context.Background()
+	mem.RecordBandwidth(ctx, "user-1", "", 4*1024*1024*1024, 512*1024*1024)
+
+	tests := []struct {
+		plan      string
+		wantLimit int64
+		wantLevel string
+	}{
+		{"free", 5 * 1024 * 1024 * 1024, "warning"},
+		{"pro", -1, "ok"},
+	}
+
+	for _, tt := range tests {
+		usage := h.getUserUsage(ctx, &User{ID: "user-1", Plan: tt.plan})
+		if usage.LimitBytes != tt.wantLimit {
+			t.Errorf("%s: LimitBytes = %d, want %d", tt.plan, usage.LimitBytes, tt.wantLimit)
+		}
+		if usage.Level != tt.wantLevel {
+			t.Errorf("%s: Level = %q, want %q", tt.plan, usage.Level, tt.wantLevel)
+		}
+	}
+}
+
+func TestBearerLockout(t *testing.T) {
+	h, _, cookie := newTestHandler(t)
+	h.SetAuthLimiter(ratelimit.New(ratelimit.NewMemory(), "dashboard", ratelimit.Policy{MaxFailures: 2, Window: time.Minute, Lockout: time.Minute}))
+
+	send := func(c *http.Cookie) int {
+		req := httptest.NewRequest("GET", "/dashboard/api/usage/domains", nil)
+		req.Header.Set("Authorization", "Bearer guess")
+		if c != nil {
+			req.AddCookie(c)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	send(nil)
+	send(nil)
+	if code := send(nil); code != http.StatusTooManyRequests {
+		t.Errorf("bearer after lockout: status = %d, want 429", code)
+	}
+	if code := send(cookie); code != http.StatusOK {
+		t.Errorf("session cookie after lockout: status = %d, want 200", code)
+	}
+}
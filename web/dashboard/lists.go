@@ -0,0 +1,134 @@
+// web/dashboard/lists.go
+package dashboard
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/lobber-dev/lobber/internal/listing"
+	"github.com/lobber-dev/lobber/internal/store"
+)
+
+// The JSON list endpoints page, sort and filter the same way, see package
+// listing. Logs, sessions and events are read from the store up to a
+// window of the newest, and paged within it.
+const (
+	// maxListLimit caps ?limit on every list endpoint
+	maxListLimit = 500
+
+	logsListWindow     = 2000
+	sessionsListWindow = 500
+	eventsListWindow   = 1000
+)
+
+var domainList = listing.Spec[Domain]{
+	DefaultLimit: 100,
+	MaxLimit:     maxListLimit,
+	DefaultSort:  "name",
+	Sorts: map[string]func(Domain) string{
+		"name":       func(d Domain) string { return listing.String(d.Name) },
+		"created_at": func(d Domain) string { return listing.Time(d.CreatedAt) },
+	},
+	Filters: map[string]func(Domain, string) bool{
+		"q":        func(d Domain, v string) bool { return listing.Contains(d.Name, v) },
+		"verified": func(d Domain, v string) bool { return v == strconv.FormatBool(d.Verified) },
+	},
+	ID: func(d Domain) string { return d.ID },
+}
+
+var tokenList = listing.Spec[store.APIToken]{
+	DefaultLimit: 100,
+	MaxLimit:     maxListLimit,
+	DefaultSort:  "-created_at",
+	Sorts: map[string]func(store.APIToken) string{
+		"name":       func(t store.APIToken) string { return listing.String(t.Name) },
+		"created_at": func(t store.APIToken) string { return listing.Time(t.CreatedAt) },
+		"last_used_at": func(t store.APIToken) string {
+			if t.LastUsedAt == nil {
+				return ""
+			}
+			return listing.Time(*t.LastUsedAt)
+		},
+	},
+	Filters: map[string]func(store.APIToken, string) bool{
+		"q": func(t store.APIToken, v string) bool { return listing.Contains(t.Name, v) },
+	},
+	ID: func(t store.APIToken) string { return t.ID },
+}
+
+var logList = listing.Spec[RequestLog]{
+	DefaultLimit: 100,
+	MaxLimit:     maxListLimit,
+	DefaultSort:  "-created_at",
+	Sorts: map[string]func(RequestLog) string{
+		"created_at": func(l RequestLog) string { return listing.Time(l.CreatedAt) },
+		"duration":   func(l RequestLog) string { return listing.Int(int64(l.Duration)) },
+		"status":     func(l RequestLog) string { return listing.Int(int64(l.StatusCode)) },
+	},
+	Filters: map[string]func(RequestLog, string) bool{
+		"domain": func(l RequestLog, v string) bool { return strings.EqualFold(l.Domain, v) },
+		"method": func(l RequestLog, v string) bool { return strings.EqualFold(l.Method, v) },
+		"status": matchStatus,
+		"tunnel": func(l RequestLog, v string) bool { return l.TunnelName == v },
+		"path":   func(l RequestLog, v string) bool { return strings.HasPrefix(l.Path, v) },
+	},
+	ID: func(l RequestLog) string { return l.ID },
+}
+
+var sessionList = listing.Spec[store.TunnelSession]{
+	DefaultLimit: 50,
+	MaxLimit:     maxListLimit,
+	DefaultSort:  "-started_at",
+	Sorts: map[string]func(store.TunnelSession) string{
+		"started_at": func(s store.TunnelSession) string { return listing.Time(s.StartedAt) },
+		"bytes":      func(s store.TunnelSession) string { return listing.Int(s.Bytes) },
+	},
+	Filters: map[string]func(store.TunnelSession, string) bool{
+		"hostname": func(s store.TunnelSession, v string) bool { return strings.EqualFold(s.Domain, v) },
+	},
+	ID: func(s store.TunnelSession) string { return s.ID },
+}
+
+var eventList = listing.Spec[store.Event]{
+	DefaultLimit: 100,
+	MaxLimit:     maxListLimit,
+	DefaultSort:  "-created_at",
+	Sorts: map[string]func(store.Event) string{
+		"created_at": func(e store.Event) string { return listing.Time(e.CreatedAt) },
+	},
+	Filters: map[string]func(store.Event, string) bool{
+		"type":     func(e store.Event, v string) bool { return e.Type == v },
+		"hostname": func(e store.Event, v string) bool { return strings.EqualFold(e.Hostname, v) },
+	},
+	ID: func(e store.Event) string { return listing.Int(e.ID) },
+}
+
+// matchStatus matches a status code exactly, or by class such as 5xx
+func matchStatus(l RequestLog, v string) bool {
+	if class, ok := strings.CutSuffix(strings.ToLower(v), "xx"); ok && len(class) == 1 {
+		return strconv.Itoa(l.StatusCode/100) == class
+	}
+	return strconv.Itoa(l.StatusCode) == v
+}
+
+// listPage pages items by the request's list parameters, answering 400 and
+// returning false if they're invalid
+func listPage[T any](w http.ResponseWriter, r *http.Request, spec listing.Spec[T], items []T) (listing.Page[T], bool) {
+	page, err := spec.List(items, r.URL.Query())
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return page, false
+	}
+	return page, true
+}
+
+// pageBody is the JSON body of a page: its items under key, and the cursor
+// for the next page unless it's the last
+func pageBody(key string, items any, next string) map[string]any {
+	body := map[string]any{key: items}
+	if next != "" {
+		body["next_cursor"] = next
+	}
+	return body
+}
@@ -0,0 +1,239 @@
+// web/dashboard/onboarding.go
+package dashboard
+
+import (
+	"context"
+	"log"
+	"net/http"
+
+	"github.com/lobber-dev/lobber/internal/proxyerr"
+	"github.com/lobber-dev/lobber/internal/store"
+)
+
+// onboardingTokenName labels tokens created from the getting started page
+const onboardingTokenName = "CLI (getting started)"
+
+// installCommand installs the CLI; shown on the getting started page
+const installCommand = "go install github.com/lobber-dev/lobber/cmd/lobber@latest"
+
+// Tunnel is one of a user's connected tunnels
+type Tunnel struct {
+	Hostname string
+	Name     string            // stable name from the client; empty if unnamed
+	Labels   map[string]string // set by the client, e.g. env=staging
+	UDPPort  int               // public port of a UDP tunnel; 0 for HTTP tunnels
+	Errors   []proxyerr.Entry  // the latest requests it failed to proxy, newest first
+}
+
+// TunnelLister returns a user's connected tunnels, sorted by hostname
+type TunnelLister func(userID string) []Tunnel
+
+// SetTunnelLister lets the getting started page check whether a tunnel has
+// connected, and the dashboard list live tunnels
+func (h *Handler) SetTunnelLister(l TunnelLister) {
+	h.listTunnels = l
+}
+
+// userTunnels returns the user's connected tunnels, if the dashboard can see them
+func (h *Handler) userTunnels(userID string) []Tunnel {
+	if h.listTunnels == nil {
+		return nil
+	}
+	return h.listTunnels(userID)
+}
+
+// onboardingState is how far a user has got through the getting started steps
+type onboardingState struct {
+	Tokens   []store.APIToken
+	Tunnels  []string
+	Domains  []Domain
+	NewToken string // plaintext of a token created by this request, shown once
+
+	HasToken       bool
+	TokenUsed      bool // a token has authenticated a tunnel at some point
+	Connected      bool // a tunnel is connected right now
+	DomainVerified bool
+}
+
+// Complete reports whether every step is done
+func (s *onboardingState) Complete() bool {
+	return s.HasToken && (s.Connected || s.TokenUsed) && s.DomainVerified
+}
+
+// loadOnboarding gathers the user's tokens, live tunnels and domains
+func (h *Handler) loadOnboarding(ctx context.Context, userID string) *onboardingState {
+	s := &onboardingState{Domains: h.getUserDomains(ctx, userID)}
+
+	tokens, err := h.stores.Tokens.ListTokens(ctx, userID)
+	if err != nil {
+		log.Printf("list tokens for %s: %v", userID, err)
+	}
+	s.Tokens = tokens
+	s.HasToken = len(tokens) > 0
+	for _, t := range tokens {
+		if t.LastUsedAt != nil {
+			s.TokenUsed = true
+		}
+	}
+
+	for _, t := range h.userTunnels(userID) {
+		s.Tunnels = append(s.Tunnels, t.Hostname)
+	}
+	s.Connected = len(s.Tunnels) > 0
+
+	for _, d := range s.Domains {
+		if d.Verified {
+			s.DomainVerified = true
+		}
+	}
+	return s
+}
+
+// upCommand is the `lobber up` line for the current step, using the user's
+// first domain when they have one
+func (h *Handler) upCommand(s *onboardingState) string {
+	target := "app.example.com:3000"
+	if len(s.Domains) > 0 {
+		target = s.Domains[0].Name + ":3000"
+	}
+	token := "<your token>"
+	if s.NewToken != "" {
+		token = s.NewToken
+	}
+	cmd := "lobber up --token " + token
+	if h.baseURL != "https://lobber.dev" {
+		cmd += " --relay " + h.baseURL
+	}
+	return cmd + " " + target
+}
+
+// onboardingData is the template data for the getting started page
+func (h *Handler) onboardingData(user *User, s *onboardingState) map[string]interface{} {
+	return map[string]interface{}{
+		"User":           user,
+		"Onboarding":     s,
+		"InstallCommand": installCommand,
+		"UpCommand":      h.upCommand(s),
+		"Title":          "Getting Started",
+		"Page":           "onboarding",
+	}
+}
+
+// handleOnboarding renders the getting started wizard: create a token, install
+// the CLI, run `lobber up` and verify a custom domain
+func (h *Handler) handleOnboarding(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userContextKey).(*User)
+	s := h.loadOnboarding(r.Context(), user.ID)
+
+	if wantsJSON(r) {
+		writeJSON(w, toAPIOnboarding(s))
+		return
+	}
+	h.render(w, "onboarding.html", h.onboardingData(user, s))
+}
+
+// handleOnboardingToken creates a CLI token. The plaintext is only ever shown
+// in this response, so plain form posts render the page instead of redirecting.
+func (h *Handler) handleOnboardingToken(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userContextKey).(*User)
+
+	secret, err := newToken()
+	if err != nil {
+		http.Error(w, "could not create token", http.StatusInternalServerError)
+		return
+	}
+	secret = "lb_" + secret
+	if _, err := h.stores.Tokens.CreateToken(r.Context(), user.ID, onboardingTokenName, hashToken(secret)); err != nil {
+		log.Printf("create token for %s: %v", user.ID, err)
+		http.Error(w, "could not create token", http.StatusInternalServerError)
+		return
+	}
+	h.audit(r, user.ID, "token.created", onboardingTokenName)
+
+	s := h.loadOnboarding(r.Context(), user.ID)
+	s.NewToken = secret
+	data := h.onboardingData(user, s)
+
+	w.Header().Set("Cache-Control", "no-store")
+	if isHTMX(r) {
+		h.render(w, "onboarding-steps", data)
+		return
+	}
+	h.render(w, "onboarding.html", data)
+}
+
+// handleOnboardingStatus is polled by the page until a tunnel connects. It
+// renders the live status fragment, or JSON for API clients.
+func (h *Handler) handleOnboardingStatus(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userContextKey).(*User)
+	s := h.loadOnboarding(r.Context(), user.ID)
+
+	if wantsJSON(r) {
+		writeJSON(w, toAPIOnboarding(s))
+		return
+	}
+	h.render(w, "onboarding-status", s)
+}
+
+// apiOnboarding is the JSON view of the getting started progress
+type apiOnboarding struct {
+	TokenCreated    bool     `json:"token_created"`
+	TunnelConnected bool     `json:"tunnel_connected"`
+	Tunnels         []string `json:"tunnels"`
+	DomainVerified  bool     `json:"domain_verified"`
+	Complete        bool     `json:"complete"`
+}
+
+func toAPIOnboarding(s *onboardingState) apiOnboarding {
+	tunnels := s.Tunnels
+	if tunnels == nil {
+		tunnels = []string{}
+	}
+	return apiOnboarding{
+		TokenCreated:    s.HasToken,
+		TunnelConnected: s.Connected,
+		Tunnels:         tunnels,
+		DomainVerified:  s.DomainVerified,
+		Complete:        s.Complete(),
+	}
+}
+
+// needsOnboarding reports whether a user hasn't set anything up yet, so the
+// dashboard should send them to the getting started page
+func (h *Handler) needsOnboarding(ctx context.Context, userID string) bool {
+	tokens, err := h.stores.Tokens.ListTokens(ctx, userID)
+	if err != nil || len(tokens) > 0 {
+		return false
+	}
+	return len(h.getUserDomains(ctx, userID)) == 0
+}
+
+// onboardingSkippedCookie remembers that a user chose to skip getting started
+const onboardingSkippedCookie = "onboarding_skipped"
+
+// onboardingRedirect sends a first-time user to the getting started page and
+// reports whether it did. ?skip=onboarding shows the dashboard and stops the
+// redirect for this browser.
+func (h *Handler) onboardingRedirect(w http.ResponseWriter, r *http.Request, user *User) bool {
+	if r.URL.Query().Get("skip") == "onboarding" {
+		http.SetCookie(w, &http.Cookie{
+			Name:     onboardingSkippedCookie,
+			Value:    "1",
+			Path:     "/dashboard",
+			MaxAge:   365 * 24 * 60 * 60,
+			HttpOnly: true,
+			Secure:   true,
+			SameSite: http.SameSiteLaxMode,
+		})
+		return false
+	}
+	// Support sessions look at the dashboard the user is stuck on, not the wizard
+	if _, err := r.Cookie(onboardingSkippedCookie); err == nil || isHTMX(r) || user.ImpersonatedBy != "" {
+		return false
+	}
+	if !h.needsOnboarding(r.Context(), user.ID) {
+		return false
+	}
+	http.Redirect(w, r, "/dashboard/onboarding", http.StatusSeeOther)
+	return true
+}
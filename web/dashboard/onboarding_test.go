@@ -0,0 +1,190 @@
+// web/dashboard/onboarding_test.go
+package dashboard
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lobber-dev/lobber/internal/store"
+)
+
+func TestDashboardRedirectsNewUsers(t *testing.T) {
+	tests := []struct {
+		name     string
+		setup    func(mem *store.Memory)
+		target   string
+		skipped  bool
+		redirect bool
+	}{
+		{"new user", nil, "/dashboard", false, true},
+		{"skip link", nil, "/dashboard?skip=onboarding", false, false},
+		{"skipped before", nil, "/dashboard", true, false},
+		{"has a token", func(mem *store.Memory) {
+			mem.CreateToken(context.Background(), "user-1", "cli", "hash")
+		}, "/dashboard", false, false},
+		{"has a domain", func(mem *store.Memory) {
+			mem.CreateDomain(context.Background(), "user-1", "app.example.com")
+		}, "/dashboard", false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, mem, cookie := newTestHandler(t)
+			if tt.setup != nil {
+				tt.setup(mem)
+			}
+
+			req := httptest.NewRequest("GET", tt.target, nil)
+			req.AddCookie(cookie)
+			if tt.skipped {
+				req.AddCookie(&http.Cookie{Name: onboardingSkippedCookie, Value: "1"})
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			redirected := rec.Code == http.StatusSeeOther && rec.Header().Get("Location") == "/dashboard/onboarding"
+			if redirected != tt.redirect {
+				t.Errorf("got %d to %q, want redirect = %v", rec.Code, rec.Header().Get("Location"), tt.redirect)
+			}
+		})
+	}
+}
+
+func TestOnboardingToken(t *testing.T) {
+	h, mem, cookie := newTestHandler(t)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, domainRequest("POST", "/dashboard/onboarding/token", nil, cookie))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", rec.Code)
+	}
+
+	token := regexp.MustCompile(`lb_[0-9a-f]{64}`).FindString(rec.Body.String())
+	if token == "" {
+		t.Fatalf("body has no token: %q", rec.Body.String())
+	}
+	if !strings.Contains(rec.Body.String(), "lobber up --token "+token+" app.example.com:3000") {
+		t.Error("lobber up command doesn't include the new token")
+	}
+	if rec.Header().Get("Cache-Control") != "no-store" {
+		t.Errorf("Cache-Control = %q, want no-store", rec.Header().Get("Cache-Control"))
+	}
+
+	u, err := mem.TokenUser(context.Background(), hashToken(token))
+	if err != nil || u.ID != "user-1" {
+		t.Errorf("TokenUser() = %v, %v, want user-1", u, err)
+	}
+
+	// The plaintext is never shown again
+	req := httptest.NewRequest("GET", "/dashboard/onboarding", nil)
+	req.AddCookie(cookie)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if strings.Contains(rec.Body.String(), token) {
+		t.Error("onboarding page shows the token after it was created")
+	}
+}
+
+func TestOnboardingStatus(t *testing.T) {
+	h, mem, cookie := newTestHandler(t)
+	tunnels := map[string][]Tunnel{}
+	h.SetTunnelLister(func(userID string) []Tunnel { return tunnels[userID] })
+
+	status := func() apiOnboarding {
+		t.Helper()
+		req := httptest.NewRequest("GET", "/api/dashboard/onboarding", nil)
+		req.AddCookie(cookie)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status = %d, want 200", rec.Code)
+		}
+		var got apiOnboarding
+		if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		return got
+	}
+
+	if got := status(); got.TokenCreated || got.TunnelConnected || got.Complete {
+		t.Errorf("fresh account = %+v, want nothing done", got)
+	}
+
+	mem.CreateToken(context.Background(), "user-1", "cli", "hash")
+	tunnels["user-1"] = []Tunnel{{Hostname: "app.example.com"}}
+	got := status()
+	if !got.TokenCreated || !got.TunnelConnected || len(got.Tunnels) != 1 {
+		t.Errorf("after connect = %+v, want token and tunnel", got)
+	}
+	if got.Complete {
+		t.Error("complete before a domain is verified")
+	}
+
+	d, _ := mem.CreateDomain(context.Background(), "user-1", "app.example.com")
+	mem.MarkDomainVerified(context.Background(), "user-1", d.ID)
+	if got := status(); !got.Complete {
+		t.Errorf("after verify = %+v, want complete", got)
+	}
+}
+
+func TestOnboardingStatusFragment(t *testing.T) {
+	h, mem, cookie := newTestHandler(t)
+	connected := false
+	h.SetTunnelLister(func(string) []Tunnel {
+		if connected {
+			return []Tunnel{{Hostname: "app.example.com"}}
+		}
+		return nil
+	})
+
+	poll := func() string {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, domainRequest("GET", "/dashboard/onboarding/status", nil, cookie))
+		return rec.Body.String()
+	}
+
+	if body := poll(); !strings.Contains(body, `hx-trigger="every 3s"`) {
+		t.Errorf("waiting fragment doesn't keep polling: %q", body)
+	}
+
+	// A token that connected earlier changes the message but keeps polling
+	mem.CreateToken(context.Background(), "user-1", "cli", "hash")
+	mem.TokenUser(context.Background(), "hash")
+	if body := poll(); !strings.Contains(body, "No tunnel connected right now") {
+		t.Errorf("fragment = %q, want the reconnect message", body)
+	}
+
+	connected = true
+	body := poll()
+	if strings.Contains(body, "hx-trigger") {
+		t.Error("connected fragment still polls")
+	}
+	if !strings.Contains(body, "app.example.com") {
+		t.Errorf("fragment = %q, want the connected hostname", body)
+	}
+}
+
+func TestOnboardingPageUsesDomain(t *testing.T) {
+	h, mem, cookie := newTestHandler(t)
+	mem.AddDomain("user-1", store.Domain{ID: "d1", Name: "api.example.com", CreatedAt: time.Now()})
+	h.SetNotifier(&recordingNotifier{}, "https://relay.example.com")
+
+	req := httptest.NewRequest("GET", "/dashboard/onboarding", nil)
+	req.AddCookie(cookie)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", rec.Code)
+	}
+	want := "lobber up --token &lt;your token&gt; --relay https://relay.example.com api.example.com:3000"
+	if !strings.Contains(rec.Body.String(), want) {
+		t.Errorf("page is missing %q", want)
+	}
+}
@@ -0,0 +1,222 @@
+// web/dashboard/sso.go
+package dashboard
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lobber-dev/lobber/internal/billing"
+	"github.com/lobber-dev/lobber/internal/oidc"
+	"github.com/lobber-dev/lobber/internal/store"
+)
+
+const (
+	ssoCookie     = "sso"
+	ssoCookieTTL  = 10 * time.Minute // how long the user has to sign in at their provider
+	ssoSessionTTL = 7 * 24 * time.Hour
+)
+
+// SSOProvider signs users in through their company's identity provider
+type SSOProvider interface {
+	AuthURL(ctx context.Context, redirectURI, state, nonce, loginHint string) (string, error)
+	Exchange(ctx context.Context, code, redirectURI, nonce string) (*oidc.Claims, error)
+}
+
+// ssoConnection is an email domain's identity provider and the team it
+// signs users in to
+type ssoConnection struct {
+	oidc.Connection
+	provider SSOProvider
+}
+
+// AddSSOConnection lets users with an email at conn's domain sign in
+// through p, creating their account on first sign-in as a member of
+// conn's team owner
+func (h *Handler) AddSSOConnection(conn oidc.Connection, p SSOProvider) {
+	if h.sso == nil {
+		h.sso = make(map[string]*ssoConnection)
+	}
+	h.sso[strings.ToLower(conn.Domain)] = &ssoConnection{Connection: conn, provider: p}
+}
+
+// ssoRedirectURI is where identity providers send users back to
+func (h *Handler) ssoRedirectURI() string {
+	return h.baseURL + "/dashboard/sso/callback"
+}
+
+// emailDomain returns the lowercased part of email after the @
+func emailDomain(email string) string {
+	return strings.ToLower(email[strings.LastIndex(email, "@")+1:])
+}
+
+// handleSSO sends the user to the identity provider for ?email=, or for
+// ?domain= when they'd rather not type their address
+func (h *Handler) handleSSO(w http.ResponseWriter, r *http.Request) {
+	email := strings.TrimSpace(r.URL.Query().Get("email"))
+	domain := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("domain")))
+	if email != "" {
+		parsed, err := parseEmail(email)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		email, domain = parsed, emailDomain(parsed)
+	}
+	conn := h.sso[domain]
+	if conn == nil {
+		http.Error(w, "single sign-on isn't set up for "+domain, http.StatusNotFound)
+		return
+	}
+
+	state, err := newToken()
+	if err != nil {
+		http.Error(w, "start sign-in failed", http.StatusInternalServerError)
+		return
+	}
+	nonce, err := newToken()
+	if err != nil {
+		http.Error(w, "start sign-in failed", http.StatusInternalServerError)
+		return
+	}
+	authURL, err := conn.provider.AuthURL(r.Context(), h.ssoRedirectURI(), state, nonce, email)
+	if err != nil {
+		log.Printf("dashboard: sso for %s: %v", domain, err)
+		http.Error(w, "your identity provider is unavailable", http.StatusBadGateway)
+		return
+	}
+
+	// Lax, as the provider's redirect back is a cross-site navigation
+	http.SetCookie(w, &http.Cookie{
+		Name:     ssoCookie,
+		Value:    domain + "|" + state + "|" + nonce,
+		Path:     "/dashboard/sso",
+		MaxAge:   int(ssoCookieTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, authURL, http.StatusSeeOther)
+}
+
+// handleSSOCallback finishes a sign-in the identity provider has sent the
+// user back from, creating their account the first time
+func (h *Handler) handleSSOCallback(w http.ResponseWriter, r *http.Request) {
+	cookie, err := r.Cookie(ssoCookie)
+	if err != nil {
+		http.Error(w, "sign-in expired; start again", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: ssoCookie, Path: "/dashboard/sso", MaxAge: -1, HttpOnly: true, Secure: true})
+
+	domain, rest, _ := strings.Cut(cookie.Value, "|")
+	state, nonce, _ := strings.Cut(rest, "|")
+	q := r.URL.Query()
+	if state == "" || subtle.ConstantTimeCompare([]byte(q.Get("state")), []byte(state)) != 1 {
+		http.Error(w, "sign-in expired; start again", http.StatusBadRequest)
+		return
+	}
+	conn := h.sso[domain]
+	if conn == nil {
+		http.Error(w, "single sign-on isn't set up for "+domain, http.StatusNotFound)
+		return
+	}
+	if e := q.Get("error"); e != "" {
+		http.Error(w, "your identity provider declined the sign-in: "+e, http.StatusUnauthorized)
+		return
+	}
+
+	claims, err := conn.provider.Exchange(r.Context(), q.Get("code"), h.ssoRedirectURI(), nonce)
+	if err != nil {
+		log.Printf("dashboard: sso for %s: %v", domain, err)
+		http.Error(w, "sign-in failed", http.StatusUnauthorized)
+		return
+	}
+	// The provider vouches for its own users, not another company's
+	email, err := parseEmail(claims.Email)
+	if err != nil || emailDomain(email) != domain {
+		http.Error(w, "your identity provider didn't give an email address at "+domain, http.StatusForbidden)
+		return
+	}
+
+	user, status, msg := h.provisionSSOUser(r, conn, claims, email)
+	if user == nil {
+		http.Error(w, msg, status)
+		return
+	}
+
+	token, err := newToken()
+	if err != nil {
+		http.Error(w, "sign-in failed", http.StatusInternalServerError)
+		return
+	}
+	expiresAt := time.Now().Add(ssoSessionTTL)
+	if err := h.stores.Sessions.CreateSession(r.Context(), user.ID, hashToken(token), expiresAt); err != nil {
+		http.Error(w, "sign-in failed", http.StatusInternalServerError)
+		return
+	}
+	SetSessionCookie(w, token, expiresAt)
+	h.audit(r, user.ID, "sso.login", conn.Issuer)
+
+	// The session cookie is Strict, so browsers wouldn't send it on a
+	// redirect that began at the provider. Moving on from a page of our own
+	// makes the next request same-site.
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(`<!DOCTYPE html><meta http-equiv="refresh" content="0;url=/dashboard"><a href="/dashboard">Continue to your dashboard</a>`))
+}
+
+// provisionSSOUser returns the account for the provider's user, creating it
+// as a member of the connection's team owner if this is their first
+// sign-in. On failure it returns nil with the status and message to show.
+func (h *Handler) provisionSSOUser(r *http.Request, conn *ssoConnection, claims *oidc.Claims, email string) (*store.User, int, string) {
+	owner, err := h.stores.Users.GetUser(r.Context(), conn.Org)
+	if err != nil {
+		log.Printf("dashboard: sso org %s for %s: %v", conn.Org, conn.Domain, err)
+		return nil, http.StatusServiceUnavailable, "single sign-on for " + conn.Domain + " is misconfigured"
+	}
+	if owner.Plan != string(billing.PlanTeam) {
+		return nil, http.StatusForbidden, "single sign-on for " + conn.Domain + " needs the team plan"
+	}
+
+	ident := store.Identity{Provider: "oidc:" + conn.Issuer, ProviderUserID: claims.Subject, Email: email}
+	user, created, err := h.stores.Users.ProvisionUser(r.Context(), store.User{Email: email, Name: claims.Name, OrgID: owner.ID}, ident)
+	if errors.Is(err, store.ErrEmailTaken) {
+		return nil, http.StatusConflict, "an account already uses " + email + "; sign in to it the way you did before"
+	}
+	if err != nil {
+		return nil, http.StatusInternalServerError, "sign-in failed"
+	}
+	if created {
+		h.audit(r, user.ID, "sso.provisioned", "member of "+owner.Email)
+		h.audit(r, owner.ID, "member.provisioned", email)
+	}
+	return user, 0, ""
+}
+
+// apiMember is a user single sign-on created for the team
+type apiMember struct {
+	ID    string `json:"id"`
+	Email string `json:"email"`
+	Name  string `json:"name"`
+}
+
+// handleAPIMembers lists the members single sign-on has created for the
+// user's team
+func (h *Handler) handleAPIMembers(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userContextKey).(*User)
+
+	members, err := h.stores.Users.ListMembers(r.Context(), user.ID)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "load members failed")
+		return
+	}
+	out := make([]apiMember, 0, len(members))
+	for _, m := range members {
+		out = append(out, apiMember{ID: m.ID, Email: m.Email, Name: m.Name})
+	}
+	writeJSON(w, map[string]any{"members": out})
+}
@@ -0,0 +1,142 @@
+// web/dashboard/sso_test.go
+package dashboard
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/lobber-dev/lobber/internal/oidc"
+	"github.com/lobber-dev/lobber/internal/store"
+)
+
+// fakeIdP signs in whoever its test sets, for the code "good"
+type fakeIdP struct {
+	claims oidc.Claims
+	nonce  string
+}
+
+func (f *fakeIdP) AuthURL(ctx context.Context, redirectURI, state, nonce, loginHint string) (string, error) {
+	f.nonce = nonce
+	return "https://idp.acme.com/authorize?" + url.Values{"state": {state}, "login_hint": {loginHint}}.Encode(), nil
+}
+
+func (f *fakeIdP) Exchange(ctx context.Context, code, redirectURI, nonce string) (*oidc.Claims, error) {
+	if code != "good" || nonce != f.nonce || redirectURI != "https://lobber.dev/dashboard/sso/callback" {
+		return nil, errors.New("invalid_grant")
+	}
+	claims := f.claims
+	return &claims, nil
+}
+
+func TestSSOSignIn(t *testing.T) {
+	h, mem, cookie := newTestHandler(t)
+	mem.AddUser(store.User{ID: "user-1", Email: "dev@example.com", Plan: "team", Seats: 5})
+	mem.AddUser(store.User{ID: "taken", Email: "grace@acme.com"})
+	idp := &fakeIdP{}
+	h.AddSSOConnection(oidc.Connection{Domain: "acme.com", Org: "user-1", Issuer: "https://idp.acme.com"}, idp)
+
+	// signIn starts at the dashboard, follows the IdP back and returns the
+	// callback's answer
+	signIn := func(t *testing.T, email, code string) *httptest.ResponseRecorder {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/dashboard/sso?email="+url.QueryEscape(email), nil))
+		if rec.Code != http.StatusSeeOther {
+			t.Fatalf("start status = %d, want 303: %s", rec.Code, rec.Body)
+		}
+		loc, _ := url.Parse(rec.Header().Get("Location"))
+		if loc.Host != "idp.acme.com" || loc.Query().Get("login_hint") != email {
+			t.Fatalf("redirect = %s, want the IdP with a login hint", loc)
+		}
+
+		req := httptest.NewRequest("GET", "/dashboard/sso/callback?code="+code+"&state="+loc.Query().Get("state"), nil)
+		for _, c := range rec.Result().Cookies() {
+			req.AddCookie(c)
+		}
+		rec = httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	tests := []struct {
+		name   string
+		claims oidc.Claims
+		code   string
+		status int
+	}{
+		{"first sign-in", oidc.Claims{Subject: "00u1", Email: "ada@acme.com", Name: "Ada"}, "good", http.StatusOK},
+		{"again", oidc.Claims{Subject: "00u1", Email: "ada@acme.com", Name: "Ada"}, "good", http.StatusOK},
+		{"bad code", oidc.Claims{Subject: "00u1", Email: "ada@acme.com"}, "bad", http.StatusUnauthorized},
+		{"other company's email", oidc.Claims{Subject: "00u2", Email: "eve@evil.com"}, "good", http.StatusForbidden},
+		{"existing account", oidc.Claims{Subject: "00u3", Email: "grace@acme.com"}, "good", http.StatusConflict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			idp.claims = tt.claims
+			rec := signIn(t, "ada@acme.com", tt.code)
+			if rec.Code != tt.status {
+				t.Fatalf("callback status = %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			var session *http.Cookie
+			for _, c := range rec.Result().Cookies() {
+				if c.Name == "session" {
+					session = c
+				}
+			}
+			if session == nil {
+				t.Fatal("no session cookie after signing in")
+			}
+			user, err := mem.SessionUser(context.Background(), hashToken(session.Value))
+			if err != nil || user.Email != "ada@acme.com" || user.OrgID != "user-1" {
+				t.Errorf("session user = %+v, %v, want ada in user-1's team", user, err)
+			}
+		})
+	}
+
+	t.Run("state mismatch", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/dashboard/sso/callback?code=good&state=forged", nil)
+		req.AddCookie(&http.Cookie{Name: ssoCookie, Value: "acme.com|real|nonce"})
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("status = %d, want 400", rec.Code)
+		}
+	})
+
+	t.Run("unknown domain", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/dashboard/sso?email=bob@example.org", nil))
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("status = %d, want 404", rec.Code)
+		}
+	})
+
+	// Only the one account SSO created is a member
+	req := httptest.NewRequest("GET", "/api/dashboard/members", nil)
+	req.AddCookie(cookie)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	var body struct {
+		Members []apiMember `json:"members"`
+	}
+	json.NewDecoder(rec.Body).Decode(&body)
+	if len(body.Members) != 1 || body.Members[0].Email != "ada@acme.com" {
+		t.Errorf("members = %+v, want only ada@acme.com", body.Members)
+	}
+
+	// Downgrading ends sign-in through the team's provider
+	mem.AddUser(store.User{ID: "user-1", Email: "dev@example.com", Plan: "free"})
+	idp.claims = oidc.Claims{Subject: "00u1", Email: "ada@acme.com"}
+	if rec := signIn(t, "ada@acme.com", "good"); rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), "team plan") {
+		t.Errorf("free plan status = %d, want 403 asking for the team plan", rec.Code)
+	}
+}
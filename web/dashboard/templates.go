@@ -0,0 +1,55 @@
+// web/dashboard/templates.go
+package dashboard
+
+import (
+	"fmt"
+	"html/template"
+	"io/fs"
+	"path"
+)
+
+// sharedTemplates are parsed into every page: the layout and reusable partials
+var sharedTemplates = []string{"templates/layout.html", "templates/partials.html"}
+
+// parseTemplates builds one template set per page on top of the shared
+// layout, so each page's "content" block doesn't collide with the others.
+// The result maps every page file and named partial to the set defining it.
+func parseTemplates(funcs template.FuncMap) (map[string]*template.Template, error) {
+	base, err := template.New("").Funcs(funcs).ParseFS(content, sharedTemplates...)
+	if err != nil {
+		return nil, fmt.Errorf("parse layout: %w", err)
+	}
+
+	pages, err := fs.Glob(content, "templates/*.html")
+	if err != nil {
+		return nil, err
+	}
+
+	sets := make(map[string]*template.Template)
+	for _, page := range pages {
+		if page == sharedTemplates[0] || page == sharedTemplates[1] {
+			continue
+		}
+
+		set, err := base.Clone()
+		if err != nil {
+			return nil, err
+		}
+		if set, err = set.ParseFS(content, page); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", path.Base(page), err)
+		}
+
+		for _, t := range set.Templates() {
+			name := t.Name()
+			// Every page defines its own "content"; shared templates resolve from any set
+			if name == "content" || base.Lookup(name) != nil {
+				continue
+			}
+			if _, dup := sets[name]; dup {
+				return nil, fmt.Errorf("template %q is defined by more than one page", name)
+			}
+			sets[name] = set
+		}
+	}
+	return sets, nil
+}
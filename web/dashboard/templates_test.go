@@ -0,0 +1,207 @@
+// web/dashboard/templates_test.go
+package dashboard
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lobber-dev/lobber/internal/proxyerr"
+	"github.com/lobber-dev/lobber/internal/store"
+)
+
+func TestParseTemplatesPerPage(t *testing.T) {
+	h, _, _ := newTestHandler(t)
+
+	for _, name := range []string{"dashboard.html", "account.html", "domains.html", "logs.html", "domains-list.html", "domain-row", "logs-list.html", "tunnels.html", "tunnel.html", "events.html", "events-list.html"} {
+		if h.templates[name] == nil {
+			t.Errorf("template %q not registered", name)
+		}
+	}
+	if h.templates["content"] != nil {
+		t.Error(`"content" should not be addressable on its own`)
+	}
+}
+
+func TestRenderPages(t *testing.T) {
+	h, mem, cookie := newTestHandler(t)
+	ctx := context.Background()
+	now := time.Now()
+	mem.RecordBandwidth(ctx, "user-1", "", 4*1024*1024*1024, 512*1024*1024)
+	mem.AddDomain("user-1", store.Domain{ID: "d1", Name: "app.example.com", CreatedAt: now})
+	mem.AddRequestLog("user-1", store.RequestLog{ID: "r1", Method: "GET", Path: "/", StatusCode: 502, Domain: "app.example.com", CreatedAt: now})
+	mem.AddIdentity("user-1", store.Identity{ID: "gh", Provider: "github", CreatedAt: now})
+	mem.RecordAudit(ctx, store.AuditEntry{UserID: "user-1", Action: "profile.updated", Detail: "name"})
+
+	tests := []struct {
+		path  string
+		title string
+	}{
+		{"/dashboard", "<h1 class=\"page-title\">Dashboard</h1>"},
+		{"/dashboard/account", "<h1 class=\"page-title\">Account Settings</h1>"},
+		{"/dashboard/domains", "<h1 class=\"page-title\">Domains</h1>"},
+		{"/dashboard/logs", "<h1 class=\"page-title\">Request Logs</h1>"},
+		{"/dashboard/tunnels", "<h1 class=\"page-title\">Tunnels</h1>"},
+		{"/dashboard/events", "<h1 class=\"page-title\">Activity</h1>"},
+	}
+
+	assetLink := regexp.MustCompile(`/dashboard/static/css/dashboard\.[0-9a-f]{8}\.css`)
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.path, nil)
+			req.AddCookie(cookie)
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200 (body %q)", rec.Code, rec.Body.String())
+			}
+			body := rec.Body.String()
+			if !strings.Contains(body, tt.title) {
+				t.Errorf("page is missing its own content %q", tt.title)
+			}
+			if !strings.Contains(body, `data-theme="system"`) {
+				t.Error("page is missing the user's theme")
+			}
+			if !assetLink.MatchString(body) {
+				t.Error("page is missing the fingerprinted stylesheet")
+			}
+		})
+	}
+}
+
+func TestRenderLabels(t *testing.T) {
+	h, mem, cookie := newTestHandler(t)
+	mem.AddDomain("user-1", store.Domain{ID: "d1", Name: "app.example.com", CreatedAt: time.Now()})
+	mem.AddRequestLog("user-1", store.RequestLog{ID: "r1", Method: "GET", Path: "/", StatusCode: 200, Domain: "app.example.com", CreatedAt: time.Now(), Labels: map[string]string{"env": "staging"}})
+	h.SetTunnelLister(func(string) []Tunnel {
+		return []Tunnel{{Hostname: "api.example.com", Labels: map[string]string{"service": "api"}}}
+	})
+
+	tests := []struct {
+		path string
+		want []string
+	}{
+		{"/dashboard", []string{"Live Tunnels", "api.example.com", "service=api"}},
+		{"/dashboard/logs", []string{"env=staging"}},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", tt.path, nil)
+		req.AddCookie(cookie)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		for _, want := range tt.want {
+			if !strings.Contains(rec.Body.String(), want) {
+				t.Errorf("%s is missing %q", tt.path, want)
+			}
+		}
+	}
+}
+
+func TestRenderTunnels(t *testing.T) {
+	h, mem, cookie := newTestHandler(t)
+	ctx := context.Background()
+	mem.AddDomain("user-1", store.Domain{ID: "d1", Name: "a1b2.example.com", CreatedAt: time.Now()})
+	mem.AddDomain("user-1", store.Domain{ID: "d2", Name: "c3d4.example.com", CreatedAt: time.Now()})
+	old, _ := mem.StartTunnelSession(ctx, "a1b2.example.com", "checkout")
+	mem.EndTunnelSession(ctx, old, "client closed")
+	mem.StartTunnelSession(ctx, "c3d4.example.com", "checkout")
+	h.SetTunnelLister(func(string) []Tunnel {
+		return []Tunnel{{Hostname: "c3d4.example.com", Name: "checkout", Errors: []proxyerr.Entry{
+			{At: time.Now(), Method: "GET", Path: "/slow", Status: http.StatusGatewayTimeout, Cause: "tunnel timeout"},
+		}}}
+	})
+
+	tests := []struct {
+		path   string
+		status int
+		want   []string
+	}{
+		{"/dashboard/tunnels", http.StatusOK, []string{`href="/dashboard/tunnels/checkout"`, "a1b2.example.com", "c3d4.example.com", "Live"}},
+		{"/dashboard/tunnels/checkout", http.StatusOK, []string{"<h1 class=\"page-title\">checkout", "client closed", "a1b2.example.com", "Recent errors", "GET /slow", "tunnel timeout"}},
+		{"/dashboard/tunnels/unknown", http.StatusNotFound, nil},
+		{"/dashboard/tunnels/Bad%20Name", http.StatusNotFound, nil},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", tt.path, nil)
+		req.AddCookie(cookie)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tt.status {
+			t.Errorf("%s status = %d, want %d", tt.path, rec.Code, tt.status)
+			continue
+		}
+		for _, want := range tt.want {
+			if !strings.Contains(rec.Body.String(), want) {
+				t.Errorf("%s is missing %q", tt.path, want)
+			}
+		}
+	}
+}
+
+func TestDashboardAssets(t *testing.T) {
+	h, _, _ := newTestHandler(t)
+
+	path := h.assets.Path("css/dashboard.css")
+	tests := []struct {
+		path  string
+		code  int
+		cache string
+	}{
+		{path, http.StatusOK, "immutable"},
+		{"/dashboard/static/css/dashboard.css", http.StatusOK, "no-cache"},
+		{"/dashboard/static/css/", http.StatusNotFound, ""},
+		{"/dashboard/static/css/missing.css", http.StatusNotFound, ""},
+	}
+
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", tt.path, nil))
+		if rec.Code != tt.code {
+			t.Errorf("GET %s status = %d, want %d", tt.path, rec.Code, tt.code)
+		}
+		if !strings.Contains(rec.Header().Get("Cache-Control"), tt.cache) {
+			t.Errorf("GET %s Cache-Control = %q, want %q", tt.path, rec.Header().Get("Cache-Control"), tt.cache)
+		}
+	}
+}
+
+func TestAccountTheme(t *testing.T) {
+	h, mem, cookie := newTestHandler(t)
+
+	tests := []struct {
+		theme  string
+		htmx   bool
+		status int
+		want   string
+	}{
+		{"dark", true, http.StatusNoContent, "dark"},
+		{"light", false, http.StatusSeeOther, "light"},
+		{"purple", false, http.StatusBadRequest, "light"},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("POST", "/dashboard/account/theme", strings.NewReader(url.Values{"theme": {tt.theme}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if tt.htmx {
+			req.Header.Set("HX-Request", "true")
+		}
+		req.AddCookie(cookie)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		if rec.Code != tt.status {
+			t.Errorf("theme %s: status = %d, want %d", tt.theme, rec.Code, tt.status)
+		}
+		if u, _ := mem.GetUser(context.Background(), "user-1"); u.Theme != tt.want {
+			t.Errorf("theme %s: Theme = %q, want %q", tt.theme, u.Theme, tt.want)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+// web/dashboard/tunnels.go
+package dashboard
+
+import (
+	"log"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/lobber-dev/lobber/internal/proxyerr"
+	"github.com/lobber-dev/lobber/internal/store"
+	"github.com/lobber-dev/lobber/internal/tunnel"
+)
+
+const (
+	// tunnelHistoryWindow is how far back the tunnels page looks
+	tunnelHistoryWindow = 30 * 24 * time.Hour
+
+	// tunnelSessionsLimit is how many sessions a tunnel's page lists
+	tunnelSessionsLimit = 50
+)
+
+// tunnelRow is a tunnel's history with whether it's connected right now
+type tunnelRow struct {
+	store.TunnelHistory
+	Live bool
+}
+
+// apiTunnelHistory is the JSON view of a tunnel's history
+type apiTunnelHistory struct {
+	Name       string    `json:"name,omitempty"`
+	Hostnames  []string  `json:"hostnames"`
+	Sessions   int       `json:"sessions"`
+	LastSeen   time.Time `json:"last_seen"`
+	TotalBytes int64     `json:"total_bytes"`
+	Requests   int64     `json:"requests"`
+	Live       bool      `json:"live"`
+}
+
+// apiTunnelSession is the JSON view of one connection of a named tunnel
+type apiTunnelSession struct {
+	ID               string     `json:"id"`
+	Hostname         string     `json:"hostname"`
+	StartedAt        time.Time  `json:"started_at"`
+	EndedAt          *time.Time `json:"ended_at,omitempty"`
+	DisconnectReason string     `json:"disconnect_reason,omitempty"`
+	Bytes            int64      `json:"bytes"`
+}
+
+// liveTunnel reports whether a tunnel with this history is connected, going
+// by name for named tunnels and by hostname otherwise
+func liveTunnel(h store.TunnelHistory, live []Tunnel) bool {
+	for _, t := range live {
+		if h.Name != "" && t.Name == h.Name {
+			return true
+		}
+		if h.Name == "" && t.Name == "" && slices.Contains(h.Hostnames, t.Hostname) {
+			return true
+		}
+	}
+	return false
+}
+
+// liveErrors returns the latest errors of the connected tunnels named name,
+// newest first
+func liveErrors(name string, live []Tunnel) []proxyerr.Entry {
+	errs := []proxyerr.Entry{}
+	for _, t := range live {
+		if t.Name == name {
+			errs = append(errs, t.Errors...)
+		}
+	}
+	slices.SortStableFunc(errs, func(a, b proxyerr.Entry) int { return b.At.Compare(a.At) })
+	return errs
+}
+
+// getTunnelRows returns the user's tunnel history over tunnelHistoryWindow
+func (h *Handler) getTunnelRows(r *http.Request, userID string) []tunnelRow {
+	history, err := h.stores.Usage.TunnelHistory(r.Context(), userID, time.Now().Add(-tunnelHistoryWindow))
+	if err != nil {
+		log.Printf("tunnel history for %s: %v", userID, err)
+	}
+	live := h.userTunnels(userID)
+	rows := make([]tunnelRow, 0, len(history))
+	for _, t := range history {
+		rows = append(rows, tunnelRow{TunnelHistory: t, Live: liveTunnel(t, live)})
+	}
+	return rows
+}
+
+// handleTunnels lists the user's tunnels, named ones grouped across hostnames
+func (h *Handler) handleTunnels(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userContextKey).(*User)
+	rows := h.getTunnelRows(r, user.ID)
+
+	if wantsJSON(r) {
+		out := make([]apiTunnelHistory, 0, len(rows))
+		for _, t := range rows {
+			out = append(out, apiTunnelHistory{
+				Name:       t.Name,
+				Hostnames:  t.Hostnames,
+				Sessions:   t.Sessions,
+				LastSeen:   t.LastSeen,
+				TotalBytes: t.TotalBytes,
+				Requests:   t.Requests,
+				Live:       t.Live,
+			})
+		}
+		writeJSON(w, map[string]any{"tunnels": out})
+		return
+	}
+
+	h.render(w, "tunnels.html", map[string]any{
+		"User":    user,
+		"Tunnels": rows,
+		"Days":    int(tunnelHistoryWindow / (24 * time.Hour)),
+		"Title":   "Tunnels",
+		"Page":    "tunnels",
+	})
+}
+
+// handleTunnel shows the recent sessions of one named tunnel. As JSON it
+// returns a page of them, newest first, which ?hostname= filters.
+func (h *Handler) handleTunnel(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userContextKey).(*User)
+	name := r.PathValue("name")
+	if err := tunnel.ValidateName(name); err != nil {
+		h.tunnelNotFound(w, r)
+		return
+	}
+
+	limit := tunnelSessionsLimit
+	if wantsJSON(r) {
+		limit = sessionsListWindow
+	}
+	sessions, err := h.stores.Usage.NamedTunnelSessions(r.Context(), user.ID, name, limit)
+	if err != nil {
+		log.Printf("sessions of tunnel %s for %s: %v", name, user.ID, err)
+	}
+	if len(sessions) == 0 {
+		h.tunnelNotFound(w, r)
+		return
+	}
+
+	if wantsJSON(r) {
+		page, ok := listPage(w, r, sessionList, sessions)
+		if !ok {
+			return
+		}
+		out := make([]apiTunnelSession, 0, len(page.Items))
+		for _, s := range page.Items {
+			out = append(out, apiTunnelSession{
+				ID:               s.ID,
+				Hostname:         s.Domain,
+				StartedAt:        s.StartedAt,
+				EndedAt:          s.EndedAt,
+				DisconnectReason: s.DisconnectReason,
+				Bytes:            s.Bytes,
+			})
+		}
+		body := pageBody("sessions", out, page.Next)
+		body["name"] = name
+		body["errors"] = liveErrors(name, h.userTunnels(user.ID))
+		writeJSON(w, body)
+		return
+	}
+
+	live := h.userTunnels(user.ID)
+	h.render(w, "tunnel.html", map[string]any{
+		"User":     user,
+		"Name":     name,
+		"Sessions": sessions,
+		"Live":     liveTunnel(store.TunnelHistory{Name: name}, live),
+		"Errors":   liveErrors(name, live),
+		"Title":    name,
+		"Page":     "tunnels",
+	})
+}
+
+func (h *Handler) tunnelNotFound(w http.ResponseWriter, r *http.Request) {
+	if wantsJSON(r) {
+		writeJSONError(w, http.StatusNotFound, "tunnel not found")
+		return
+	}
+	http.NotFound(w, r)
+}
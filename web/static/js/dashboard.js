@@ -0,0 +1,43 @@
+// Dashboard behaviour shared by every page
+(function () {
+  function createIcons() {
+    if (window.lucide) lucide.createIcons();
+  }
+
+  createIcons();
+
+  // Re-initialize lucide icons after HTMX swaps
+  document.body.addEventListener('htmx:afterSwap', createIcons);
+
+  // Copy buttons: copy their data-copy value to the clipboard
+  document.body.addEventListener('click', function (e) {
+    var button = e.target.closest('[data-copy]');
+    if (!button || !navigator.clipboard) return;
+    navigator.clipboard.writeText(button.dataset.copy).then(function () {
+      var label = button.innerHTML;
+      button.textContent = 'Copied!';
+      setTimeout(function () { button.innerHTML = label; }, 1500);
+    });
+  });
+
+  // Theme toggle: flips between light and dark and saves the choice to the account
+  var toggle = document.querySelector('[data-theme-toggle]');
+  if (!toggle) return;
+
+  toggle.addEventListener('click', function () {
+    var root = document.documentElement;
+    var current = root.dataset.theme;
+    if (current === 'system') {
+      current = window.matchMedia('(prefers-color-scheme: light)').matches ? 'light' : 'dark';
+    }
+    var next = current === 'light' ? 'dark' : 'light';
+    root.dataset.theme = next;
+
+    fetch('/dashboard/account/theme', {
+      method: 'POST',
+      credentials: 'same-origin',
+      headers: { 'Content-Type': 'application/x-www-form-urlencoded', 'HX-Request': 'true' },
+      body: 'theme=' + encodeURIComponent(next)
+    });
+  });
+})();
@@ -0,0 +1,106 @@
+// web/static/static.go
+package static
+
+import (
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+)
+
+//go:embed css js
+var files embed.FS
+
+// immutableCache is sent for fingerprinted names, whose content never changes
+const immutableCache = "public, max-age=31536000, immutable"
+
+// Assets serves the embedded static files under a URL prefix. Every file is
+// also reachable under a fingerprinted name containing a hash of its content,
+// e.g. css/dashboard.css -> css/dashboard.3f2a1b9c.css, which can be cached
+// forever because a new build changes the name.
+type Assets struct {
+	prefix  string
+	hashed  map[string]string // logical name -> fingerprinted name
+	logical map[string]string // fingerprinted name -> logical name
+	files   http.Handler
+}
+
+// New indexes the embedded files for serving under prefix, e.g. "/static/"
+func New(prefix string) (*Assets, error) {
+	return newAssets(prefix, files)
+}
+
+func newAssets(prefix string, fsys fs.FS) (*Assets, error) {
+	a := &Assets{
+		prefix:  "/" + strings.Trim(prefix, "/") + "/",
+		hashed:  make(map[string]string),
+		logical: make(map[string]string),
+		files:   http.FileServer(http.FS(fsys)),
+	}
+
+	err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return err
+		}
+		fingerprinted := fingerprint(name, data)
+		a.hashed[name] = fingerprinted
+		a.logical[fingerprinted] = name
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("index static assets: %w", err)
+	}
+	return a, nil
+}
+
+// fingerprint inserts a short content hash before the file extension
+func fingerprint(name string, data []byte) string {
+	sum := sha256.Sum256(data)
+	ext := path.Ext(name)
+	return strings.TrimSuffix(name, ext) + "." + hex.EncodeToString(sum[:4]) + ext
+}
+
+// Path returns the fingerprinted URL for a file, e.g. Path("css/dashboard.css").
+// Unknown names fall back to their plain URL so a typo shows up as a 404.
+func (a *Assets) Path(name string) string {
+	name = strings.TrimPrefix(name, "/")
+	if hashed, ok := a.hashed[name]; ok {
+		return a.prefix + hashed
+	}
+	return a.prefix + name
+}
+
+// ServeHTTP serves fingerprinted names with a long-lived cache header and
+// plain names with revalidation, so pages that link them directly (and CSS
+// @imports) still pick up changes
+func (a *Assets) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name, ok := strings.CutPrefix(r.URL.Path, a.prefix)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	if logical, ok := a.logical[name]; ok {
+		w.Header().Set("Cache-Control", immutableCache)
+		name = logical
+	} else if _, ok := a.hashed[name]; ok {
+		w.Header().Set("Cache-Control", "no-cache")
+	} else {
+		// Only known files, never directory listings
+		http.NotFound(w, r)
+		return
+	}
+
+	r2 := r.Clone(r.Context())
+	r2.URL.Path = "/" + name
+	r2.URL.RawPath = ""
+	a.files.ServeHTTP(w, r2)
+}
@@ -0,0 +1,69 @@
+// web/static/static_test.go
+package static
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"testing/fstest"
+)
+
+func TestFingerprint(t *testing.T) {
+	a := fingerprint("css/app.css", []byte("body{}"))
+	b := fingerprint("css/app.css", []byte("body{color:red}"))
+
+	if a == b {
+		t.Errorf("fingerprint() = %q for different content", a)
+	}
+	if len(a) != len("css/app.12345678.css") {
+		t.Errorf("fingerprint() = %q, want css/app.<8 hex>.css", a)
+	}
+}
+
+func TestAssets(t *testing.T) {
+	fsys := fstest.MapFS{
+		"css/app.css": {Data: []byte("body{}")},
+		"js/app.js":   {Data: []byte("console.log(1)")},
+	}
+	a, err := newAssets("static", fsys)
+	if err != nil {
+		t.Fatalf("newAssets() error = %v", err)
+	}
+
+	hashed := a.Path("css/app.css")
+	if want := "/static/" + fingerprint("css/app.css", []byte("body{}")); hashed != want {
+		t.Errorf("Path() = %q, want %q", hashed, want)
+	}
+	if got := a.Path("/css/missing.css"); got != "/static/css/missing.css" {
+		t.Errorf("Path() unknown = %q, want plain URL", got)
+	}
+
+	tests := []struct {
+		path  string
+		code  int
+		cache string
+		body  string
+	}{
+		{hashed, http.StatusOK, immutableCache, "body{}"},
+		{"/static/js/app.js", http.StatusOK, "no-cache", "console.log(1)"},
+		{"/static/css/", http.StatusNotFound, "", ""},
+		{"/static/css/other.css", http.StatusNotFound, "", ""},
+		{"/elsewhere/css/app.css", http.StatusNotFound, "", ""},
+	}
+
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		a.ServeHTTP(rec, httptest.NewRequest("GET", tt.path, nil))
+
+		if rec.Code != tt.code {
+			t.Errorf("GET %s status = %d, want %d", tt.path, rec.Code, tt.code)
+			continue
+		}
+		if got := rec.Header().Get("Cache-Control"); got != tt.cache {
+			t.Errorf("GET %s Cache-Control = %q, want %q", tt.path, got, tt.cache)
+		}
+		if tt.body != "" && rec.Body.String() != tt.body {
+			t.Errorf("GET %s body = %q, want %q", tt.path, rec.Body.String(), tt.body)
+		}
+	}
+}
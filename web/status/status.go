@@ -0,0 +1,272 @@
+// web/status/status.go
+package status
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lobber-dev/lobber/internal/store"
+	"github.com/lobber-dev/lobber/web/static"
+)
+
+//go:embed status.html
+var pageTemplate string
+
+// UptimeDays is how much history the status page shows
+const UptimeDays = 90
+
+// Overall and per-relay states
+const (
+	StateOperational = "operational"
+	StateDegraded    = "degraded"
+	StateOutage      = "outage"
+	StateUnknown     = "unknown" // no relay has reported yet
+
+	RelayUp       = "up"
+	RelayDegraded = "degraded"
+	RelayDown     = "down"
+)
+
+// Page is everything shown on the status page, and its JSON form
+type Page struct {
+	Status        string    `json:"status"`
+	Incident      *Incident `json:"incident,omitempty"`
+	Relays        []Relay   `json:"relays"`
+	Uptime        []Day     `json:"uptime"`
+	UptimePercent float64   `json:"uptime_percent"` // -1 without any checks
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+// Incident is the banner posted by an operator
+type Incident struct {
+	Title     string    `json:"title"`
+	Message   string    `json:"message,omitempty"`
+	Severity  string    `json:"severity"`
+	StartedAt time.Time `json:"started_at"`
+}
+
+// Relay is one relay instance. Tunnel counts and failure details stay internal.
+type Relay struct {
+	ID         string    `json:"id"`
+	Region     string    `json:"region,omitempty"`
+	Status     string    `json:"status"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+}
+
+// Day is one day of fleet uptime
+type Day struct {
+	Date    string  `json:"date"`    // YYYY-MM-DD, UTC
+	Percent float64 `json:"percent"` // -1 when no checks ran that day
+}
+
+// Handler serves the public status page at /status and /status.json
+type Handler struct {
+	status     store.StatusStore
+	staleAfter time.Duration
+	tmpl       *template.Template
+	now        func() time.Time
+}
+
+// NewHandler creates the status page. A relay that hasn't reported within
+// staleAfter is shown as down.
+func NewHandler(status store.StatusStore, staleAfter time.Duration) (*Handler, error) {
+	assets, err := static.New("/static/")
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := template.New("status").Funcs(template.FuncMap{
+		"asset": assets.Path,
+		"title": stateTitle,
+	}).Parse(pageTemplate)
+	if err != nil {
+		return nil, err
+	}
+	return &Handler{status: status, staleAfter: staleAfter, tmpl: tmpl, now: time.Now}, nil
+}
+
+// ServeHTTP renders the page, or JSON for /status.json and Accept: application/json
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	page, err := h.Build(r.Context())
+	if err != nil {
+		log.Printf("status page: %v", err)
+		http.Error(w, "status unavailable", http.StatusInternalServerError)
+		return
+	}
+
+	// Short enough that an outage shows up quickly, long enough to absorb a rush of visitors
+	w.Header().Set("Cache-Control", "public, max-age=15")
+
+	if r.URL.Path == "/status.json" || acceptsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(page)
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := h.tmpl.Execute(&buf, page); err != nil {
+		log.Printf("render status page: %v", err)
+		http.Error(w, "status unavailable", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	buf.WriteTo(w)
+}
+
+// Build assembles the current status from relay health checks and incidents
+func (h *Handler) Build(ctx context.Context) (*Page, error) {
+	now := h.now().UTC()
+	page := &Page{UpdatedAt: now, UptimePercent: -1}
+
+	incident, err := h.status.ActiveIncident(ctx)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		return nil, err
+	}
+	if incident != nil {
+		page.Incident = &Incident{
+			Title:     incident.Title,
+			Message:   incident.Message,
+			Severity:  incident.Severity,
+			StartedAt: incident.StartedAt,
+		}
+	}
+
+	relays, err := h.status.ListRelayHealth(ctx)
+	if err != nil {
+		return nil, err
+	}
+	page.Relays = make([]Relay, 0, len(relays))
+	for _, r := range relays {
+		page.Relays = append(page.Relays, Relay{
+			ID:         r.RelayID,
+			Region:     r.Region,
+			Status:     h.relayState(r, now),
+			LastSeenAt: r.LastSeenAt,
+		})
+	}
+
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	since := today.AddDate(0, 0, -(UptimeDays - 1))
+	days, err := h.status.DailyUptime(ctx, since)
+	if err != nil {
+		return nil, err
+	}
+	page.Uptime, page.UptimePercent = uptimeSeries(days, since, UptimeDays)
+
+	page.Status = overallState(page.Relays, page.Incident)
+	return page, nil
+}
+
+// relayState classifies a relay by its latest check and how recently it reported
+func (h *Handler) relayState(r store.RelayHealth, now time.Time) string {
+	switch {
+	case now.Sub(r.LastSeenAt) > h.staleAfter:
+		return RelayDown
+	case !r.OK:
+		return RelayDegraded
+	default:
+		return RelayUp
+	}
+}
+
+// overallState rolls relay health and the incident banner into one state.
+// An operator's incident severity wins over what the checks can see.
+func overallState(relays []Relay, incident *Incident) string {
+	if incident != nil && incident.Severity == "major" {
+		return StateOutage
+	}
+	if len(relays) == 0 {
+		if incident != nil {
+			return StateDegraded
+		}
+		return StateUnknown
+	}
+
+	down := 0
+	state := StateOperational
+	for _, r := range relays {
+		switch r.Status {
+		case RelayDown:
+			down++
+			state = StateDegraded
+		case RelayDegraded:
+			state = StateDegraded
+		}
+	}
+	if down == len(relays) {
+		return StateOutage
+	}
+	if incident != nil {
+		return StateDegraded
+	}
+	return state
+}
+
+// uptimeSeries fills in one entry per day from since, marking days without
+// checks, and returns the overall percentage across the window
+func uptimeSeries(days []store.UptimeDay, since time.Time, n int) ([]Day, float64) {
+	byDate := make(map[string]store.UptimeDay, len(days))
+	for _, d := range days {
+		byDate[d.Day.Format(time.DateOnly)] = d
+	}
+
+	series := make([]Day, 0, n)
+	checks, failures := 0, 0
+	for i := 0; i < n; i++ {
+		date := since.AddDate(0, 0, i).Format(time.DateOnly)
+		day := Day{Date: date, Percent: -1}
+		if d, ok := byDate[date]; ok && d.Checks > 0 {
+			day.Percent = percentUp(d.Checks, d.Failures)
+			checks += d.Checks
+			failures += d.Failures
+		}
+		series = append(series, day)
+	}
+
+	if checks == 0 {
+		return series, -1
+	}
+	return series, percentUp(checks, failures)
+}
+
+func percentUp(checks, failures int) float64 {
+	return float64(checks-failures) / float64(checks) * 100
+}
+
+// stateTitle is the headline for an overall state
+func stateTitle(state string) string {
+	switch state {
+	case StateOperational:
+		return "All systems operational"
+	case StateDegraded:
+		return "Degraded performance"
+	case StateOutage:
+		return "Service outage"
+	default:
+		return "Waiting for the first health check"
+	}
+}
+
+// acceptsJSON reports whether the client asked for application/json
+func acceptsJSON(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err == nil && mediaType == "application/json" {
+			return true
+		}
+	}
+	return false
+}
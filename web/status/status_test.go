@@ -0,0 +1,169 @@
+// web/status/status_test.go
+package status
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lobber-dev/lobber/internal/store"
+)
+
+func TestOverallState(t *testing.T) {
+	up := Relay{ID: "a", Status: RelayUp}
+	degraded := Relay{ID: "b", Status: RelayDegraded}
+	down := Relay{ID: "c", Status: RelayDown}
+	minor := &Incident{Title: "Slow dashboard", Severity: "minor"}
+	major := &Incident{Title: "Relays offline", Severity: "major"}
+
+	tests := []struct {
+		name     string
+		relays   []Relay
+		incident *Incident
+		want     string
+	}{
+		{"no data", nil, nil, StateUnknown},
+		{"no data with incident", nil, minor, StateDegraded},
+		{"all up", []Relay{up, up}, nil, StateOperational},
+		{"one degraded", []Relay{up, degraded}, nil, StateDegraded},
+		{"one down", []Relay{up, down}, nil, StateDegraded},
+		{"all down", []Relay{down, down}, nil, StateOutage},
+		{"minor incident", []Relay{up}, minor, StateDegraded},
+		{"major incident", []Relay{up}, major, StateOutage},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := overallState(tt.relays, tt.incident); got != tt.want {
+				t.Errorf("overallState() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUptimeSeries(t *testing.T) {
+	since := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+	days := []store.UptimeDay{
+		{Day: since, Checks: 100, Failures: 0},
+		{Day: since.AddDate(0, 0, 2), Checks: 100, Failures: 10},
+	}
+
+	series, overall := uptimeSeries(days, since, 3)
+	want := []Day{
+		{"2025-06-01", 100},
+		{"2025-06-02", -1},
+		{"2025-06-03", 90},
+	}
+	if len(series) != len(want) {
+		t.Fatalf("len(series) = %d, want %d", len(series), len(want))
+	}
+	for i := range want {
+		if series[i] != want[i] {
+			t.Errorf("series[%d] = %+v, want %+v", i, series[i], want[i])
+		}
+	}
+	if overall != 95 {
+		t.Errorf("overall = %v, want 95", overall)
+	}
+
+	if _, overall := uptimeSeries(nil, since, 3); overall != -1 {
+		t.Errorf("overall without checks = %v, want -1", overall)
+	}
+}
+
+func newTestHandler(t *testing.T, now time.Time) (*Handler, *store.Memory) {
+	t.Helper()
+	mem := store.NewMemory()
+	mem.SetClock(func() time.Time { return now })
+	h, err := NewHandler(mem, time.Minute)
+	if err != nil {
+		t.Fatalf("NewHandler() error = %v", err)
+	}
+	h.now = func() time.Time { return now }
+	return h, mem
+}
+
+func TestBuild(t *testing.T) {
+	now := time.Date(2025, 6, 15, 12, 0, 0, 0, time.UTC)
+	h, mem := newTestHandler(t, now)
+	ctx := context.Background()
+
+	mem.RecordHealthCheck(ctx, store.HealthCheck{RelayID: "us-1", Region: "us-east1", OK: true, CheckedAt: now.Add(-10 * time.Second)})
+	mem.RecordHealthCheck(ctx, store.HealthCheck{RelayID: "eu-1", OK: false, Detail: "database: timeout", CheckedAt: now.Add(-20 * time.Second)})
+	mem.RecordHealthCheck(ctx, store.HealthCheck{RelayID: "ap-1", OK: true, CheckedAt: now.Add(-time.Hour)})
+
+	page, err := h.Build(ctx)
+	if err != nil {
+		t.Fatalf("Build() error = %v", err)
+	}
+
+	want := map[string]string{"ap-1": RelayDown, "eu-1": RelayDegraded, "us-1": RelayUp}
+	for _, r := range page.Relays {
+		if r.Status != want[r.ID] {
+			t.Errorf("relay %s = %q, want %q", r.ID, r.Status, want[r.ID])
+		}
+	}
+	if page.Status != StateDegraded {
+		t.Errorf("Status = %q, want degraded", page.Status)
+	}
+	if len(page.Uptime) != UptimeDays || page.Uptime[UptimeDays-1].Date != "2025-06-15" {
+		t.Errorf("uptime ends on %q with %d days, want 2025-06-15 and %d", page.Uptime[len(page.Uptime)-1].Date, len(page.Uptime), UptimeDays)
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	now := time.Date(2025, 6, 15, 12, 0, 0, 0, time.UTC)
+	h, mem := newTestHandler(t, now)
+	mem.RecordHealthCheck(context.Background(), store.HealthCheck{RelayID: "us-1", OK: true, CheckedAt: now})
+	mem.OpenIncident(context.Background(), store.Incident{Title: "Elevated latency in eu", Severity: "minor"})
+
+	tests := []struct {
+		name   string
+		path   string
+		accept string
+		json   bool
+	}{
+		{"page", "/status", "", false},
+		{"json path", "/status.json", "", true},
+		{"json accept", "/status", "application/json", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.path, nil)
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200", rec.Code)
+			}
+			if !tt.json {
+				body := rec.Body.String()
+				for _, want := range []string{"Elevated latency in eu", "Degraded performance", "us-1"} {
+					if !strings.Contains(body, want) {
+						t.Errorf("page is missing %q", want)
+					}
+				}
+				return
+			}
+
+			var page Page
+			if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			if page.Status != StateDegraded || page.Incident == nil || len(page.Relays) != 1 {
+				t.Errorf("page = %+v, want degraded with an incident and one relay", page)
+			}
+			if strings.Contains(rec.Body.String(), "tunnels") {
+				t.Error("JSON exposes internal tunnel counts")
+			}
+		})
+	}
+}